@@ -382,6 +382,10 @@ export default class InvocationModel {
       return "Not started";
     }
     if (!this.finished) {
+      let progress = this.invocations.find(() => true)?.progress;
+      if (Number(progress?.configuredTargetCount || 0)) {
+        return `In progress (${progress.percentComplete}%)...`;
+      }
       return "In progress...";
     }
     return this.finished.exitCode.code == 0 ? "Succeeded" : "Failed";
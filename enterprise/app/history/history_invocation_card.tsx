@@ -110,6 +110,10 @@ export default class HistoryInvocationCardComponent extends React.Component {
 
   getStatusLabel() {
     if (this.isInProgress()) {
+      const configuredTargetCount = Number(this.props.invocation.progress?.configuredTargetCount || 0);
+      if (configuredTargetCount) {
+        return `In progress (${this.props.invocation.progress.percentComplete}%)...`;
+      }
       return "In progress...";
     }
 
@@ -29,6 +29,10 @@ export default class EditOrgComponent extends OrgForm<grp.UpdateGroupRequest> {
       autoPopulateFromOwnedDomain: Boolean(group.ownedDomain),
       sharingEnabled: group.sharingEnabled,
       useGroupOwnedExecutors: group.useGroupOwnedExecutors,
+      allowedCacheNamespaces: group.allowedCacheNamespaces,
+      defaultPlatformProperties: group.defaultPlatformProperties,
+      forcedPlatformProperties: group.forcedPlatformProperties,
+      besForwardingTarget: group.besForwardingTarget,
     });
     this.setState({ request, initialRequest: this.newRequest(request) });
   }
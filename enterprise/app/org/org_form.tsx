@@ -171,6 +171,73 @@ export default abstract class OrgForm<T extends GroupRequest> extends React.Comp
               <span>Use self-hosted executors</span>
             </label>
         )}
+        <div className="form-row stacked">
+          <label htmlFor="allowedCacheNamespaces" className="input-label">
+            Allowed cache namespaces
+          </label>
+          <div className="input-help-text">
+            Comma-separated namespaces that builds may select with --build_metadata=CACHE_NAMESPACE=&lt;namespace&gt; to
+            keep their cache entries out of the main cache
+          </div>
+          <input
+            autoComplete="off"
+            onFocus={this.onFocus.bind(this)}
+            onChange={this.onChange.bind(this)}
+            type="text"
+            name="allowedCacheNamespaces"
+            value={request.allowedCacheNamespaces}
+          />
+        </div>
+        <div className="form-row stacked">
+          <label htmlFor="defaultPlatformProperties" className="input-label">
+            Default platform properties
+          </label>
+          <div className="input-help-text">
+            Comma-separated name=value platform properties added to remote executions that don't set them, such as
+            Pool=linux
+          </div>
+          <input
+            autoComplete="off"
+            onFocus={this.onFocus.bind(this)}
+            onChange={this.onChange.bind(this)}
+            type="text"
+            name="defaultPlatformProperties"
+            value={request.defaultPlatformProperties}
+          />
+        </div>
+        <div className="form-row stacked">
+          <label htmlFor="forcedPlatformProperties" className="input-label">
+            Forced platform properties
+          </label>
+          <div className="input-help-text">
+            Comma-separated name=value platform properties that replace any value set by remote executions, such as
+            dockerNetwork=off
+          </div>
+          <input
+            autoComplete="off"
+            onFocus={this.onFocus.bind(this)}
+            onChange={this.onChange.bind(this)}
+            type="text"
+            name="forcedPlatformProperties"
+            value={request.forcedPlatformProperties}
+          />
+        </div>
+        <div className="form-row stacked">
+          <label htmlFor="besForwardingTarget" className="input-label">
+            Build event forwarding URL
+          </label>
+          <div className="input-help-text">
+            A build event protocol server that build events are also sent to, such as grpcs://bes.example.com:443
+          </div>
+          <input
+            autoComplete="off"
+            onFocus={this.onFocus.bind(this)}
+            onChange={this.onChange.bind(this)}
+            type="text"
+            name="besForwardingTarget"
+            value={request.besForwardingTarget}
+          />
+        </div>
       </>
     );
   }
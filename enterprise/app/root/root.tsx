@@ -18,6 +18,7 @@ import SettingsComponent from "../settings/settings";
 import SidebarComponent from "../sidebar/sidebar";
 import TapComponent from "../tap/tap";
 import TrendsComponent from "../trends/trends";
+import UsageBannerComponent from "../usage/usage_banner";
 import ExecutorsComponent from "../executors/executors";
 
 const denseModeKey = "VIEW_MODE";
@@ -147,6 +148,7 @@ export default class EnterpriseRootComponent extends React.Component {
           <div className="main">
             {!this.state.loading && (
               <div className={`content ${login ? "content-flex" : ""}`}>
+                {this.state.user && <UsageBannerComponent user={this.state.user} />}
                 {invocationId && (
                   <InvocationComponent
                     user={this.state.user}
@@ -0,0 +1,69 @@
+import React from "react";
+import moment from "moment";
+import { User } from "../../../app/auth/auth_service";
+import rpcService from "../../../app/service/rpc_service";
+import { usage } from "../../../proto/usage_ts_proto";
+
+interface Props {
+  user: User;
+}
+
+interface State {
+  limits: usage.IUsageLimit[];
+}
+
+/**
+ * UsageBannerComponent warns the members of the selected group when it's
+ * approaching, or has exceeded, one of its usage limits.
+ */
+export default class UsageBannerComponent extends React.Component<Props, State> {
+  state: State = { limits: [] };
+
+  componentDidMount() {
+    this.fetchUsageStatus();
+  }
+
+  componentDidUpdate(prevProps: Props) {
+    if (prevProps.user?.selectedGroup?.id !== this.props.user?.selectedGroup?.id) {
+      this.fetchUsageStatus();
+    }
+  }
+
+  fetchUsageStatus() {
+    if (!this.props.user?.selectedGroup) {
+      this.setState({ limits: [] });
+      return;
+    }
+    rpcService.service
+      .getUsageStatus(new usage.GetUsageStatusRequest())
+      .then((response) => this.setState({ limits: response.limit }))
+      .catch((e) => {
+        // Usage limits are optional, so errors shouldn't get in the way.
+        console.warn("Failed to fetch usage status", e);
+        this.setState({ limits: [] });
+      });
+  }
+
+  render() {
+    const warnings = this.state.limits.filter(
+      (limit) =>
+        limit.state === usage.UsageState.WARNING_USAGE_STATE || limit.state === usage.UsageState.EXCEEDED_USAGE_STATE
+    );
+    return (
+      <>
+        {warnings.map((limit) => (
+          <div
+            key={limit.resource}
+            className={`usage-banner ${limit.state === usage.UsageState.EXCEEDED_USAGE_STATE ? "usage-exceeded" : ""}`}>
+            <div>{limit.message}</div>
+            {Number(limit.projectedLimitUsec) > 0 && (
+              <div className="usage-banner-projection">
+                Projected to reach the limit {moment(Number(limit.projectedLimitUsec) / 1000).fromNow()}.
+              </div>
+            )}
+          </div>
+        ))}
+      </>
+    );
+  }
+}
@@ -0,0 +1,175 @@
+// Package access_log records who viewed which invocations and downloaded
+// which of their artifacts, so that groups whose builds contain sensitive
+// code can review who accessed them. Accesses are recorded in the database,
+// either all of them or a configured sample, and are queried through the
+// GetAccessLog API by members of the group that owns the invocation.
+package access_log
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+
+	alpb "github.com/buildbuddy-io/buildbuddy/proto/access_log"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+const (
+	pageTokenOffsetPrefix = "offset_"
+
+	// The number of entries returned per page by GetAccessLog.
+	pageSize = 100
+)
+
+// IsConfigured returns whether access logging is enabled.
+func IsConfigured(c *config.AccessLogConfig) bool {
+	return c.Enabled
+}
+
+type AccessLogService struct {
+	env        environment.Env
+	sampleRate float64
+
+	// sample returns whether an access should be recorded. It is replaced in
+	// tests.
+	sample func() bool
+}
+
+func NewAccessLogService(env environment.Env) (*AccessLogService, error) {
+	c := env.GetConfigurator().GetAccessLogConfig()
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return nil, status.InvalidArgumentErrorf("access_log.sample_rate must be between 0 and 1, but is %f", c.SampleRate)
+	}
+	sampleRate := c.SampleRate
+	if sampleRate == 0 {
+		sampleRate = 1
+	}
+	s := &AccessLogService{env: env, sampleRate: sampleRate}
+	s.sample = func() bool {
+		return s.sampleRate >= 1 || rand.Float64() < s.sampleRate
+	}
+	return s, nil
+}
+
+func (s *AccessLogService) RecordInvocationAccess(ctx context.Context, invocation *inpb.Invocation) {
+	// Invocations without a group aren't visible in any group's log.
+	groupID := invocation.GetAcl().GetGroupId()
+	if groupID == "" || !s.sample() {
+		return
+	}
+	s.insert(ctx, &tables.AccessLogEntry{
+		GroupID:      groupID,
+		InvocationID: invocation.GetInvocationId(),
+		ResourceType: int32(alpb.AccessLogEntry_INVOCATION),
+	})
+}
+
+func (s *AccessLogService) RecordArtifactAccess(ctx context.Context, invocationID, artifactName string) {
+	if !s.sample() {
+		return
+	}
+	inv := &tables.Invocation{}
+	err := s.env.GetDBHandle().Raw(`SELECT group_id FROM Invocations WHERE invocation_id = ?`, invocationID).Take(inv).Error
+	if err != nil {
+		if !db.IsRecordNotFound(err) {
+			log.Warningf("Could not look up the group of invocation %q to record an artifact access: %s", invocationID, err)
+		}
+		return
+	}
+	if inv.GroupID == "" {
+		return
+	}
+	s.insert(ctx, &tables.AccessLogEntry{
+		GroupID:      inv.GroupID,
+		InvocationID: invocationID,
+		ResourceType: int32(alpb.AccessLogEntry_ARTIFACT),
+		ArtifactName: artifactName,
+	})
+}
+
+func (s *AccessLogService) insert(ctx context.Context, entry *tables.AccessLogEntry) {
+	// Anonymous accesses, such as of public invocations, are recorded without
+	// a user.
+	if u, err := perms.AuthenticatedUser(ctx, s.env); err == nil {
+		entry.UserID = u.GetUserID()
+	}
+	pk, err := tables.PrimaryKeyForTable(entry.TableName())
+	if err != nil {
+		log.Warningf("Could not record access of invocation %q: %s", entry.InvocationID, err)
+		return
+	}
+	entry.AccessLogEntryID = pk
+	entry.AccessTimeUsec = timeutil.ToUsec(time.Now())
+	entry.SampleRate = s.sampleRate
+	if err := s.env.GetDBHandle().Create(entry).Error; err != nil {
+		log.Warningf("Could not record access of invocation %q: %s", entry.InvocationID, err)
+	}
+}
+
+func (s *AccessLogService) GetAccessLog(ctx context.Context, req *alpb.GetAccessLogRequest) (*alpb.GetAccessLogResponse, error) {
+	groupID, err := perms.AuthenticateSelectedGroupID(ctx, s.env, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	offset := int64(0)
+	if strings.HasPrefix(req.GetPageToken(), pageTokenOffsetPrefix) {
+		parsedOffset, err := strconv.ParseInt(strings.TrimPrefix(req.GetPageToken(), pageTokenOffsetPrefix), 10, 64)
+		if err != nil || parsedOffset < 0 {
+			return nil, status.InvalidArgumentError("Error parsing pagination token")
+		}
+		offset = parsedOffset
+	} else if req.GetPageToken() != "" {
+		return nil, status.InvalidArgumentError("Invalid pagination token")
+	}
+
+	q := query_builder.NewQuery(`SELECT * FROM AccessLogEntries`)
+	q.AddWhereClause(`group_id = ?`, groupID)
+	if req.GetInvocationId() != "" {
+		q.AddWhereClause(`invocation_id = ?`, req.GetInvocationId())
+	}
+	if req.GetUserId() != "" {
+		q.AddWhereClause(`user_id = ?`, req.GetUserId())
+	}
+	if req.GetStartTimeUsec() != 0 {
+		q.AddWhereClause(`access_time_usec >= ?`, req.GetStartTimeUsec())
+	}
+	if req.GetEndTimeUsec() != 0 {
+		q.AddWhereClause(`access_time_usec < ?`, req.GetEndTimeUsec())
+	}
+	q.SetOrderBy(`access_time_usec`, false /*=ascending*/)
+	q.SetLimit(pageSize)
+	q.SetOffset(offset)
+	qStr, qArgs := q.Build()
+
+	var entries []*tables.AccessLogEntry
+	if err := s.env.GetDBHandle().Raw(qStr, qArgs...).Scan(&entries).Error; err != nil {
+		return nil, err
+	}
+	rsp := &alpb.GetAccessLogResponse{}
+	for _, e := range entries {
+		rsp.Entry = append(rsp.Entry, &alpb.AccessLogEntry{
+			UserId:         e.UserID,
+			InvocationId:   e.InvocationID,
+			ResourceType:   alpb.AccessLogEntry_ResourceType(e.ResourceType),
+			ArtifactName:   e.ArtifactName,
+			AccessTimeUsec: e.AccessTimeUsec,
+			SampleRate:     e.SampleRate,
+		})
+	}
+	if len(entries) == pageSize {
+		rsp.NextPageToken = pageTokenOffsetPrefix + strconv.FormatInt(offset+pageSize, 10)
+	}
+	return rsp, nil
+}
@@ -0,0 +1,108 @@
+package access_log
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	alpb "github.com/buildbuddy-io/buildbuddy/proto/access_log"
+	aclpb "github.com/buildbuddy-io/buildbuddy/proto/acl"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+func newTestService(t *testing.T) (*AccessLogService, *testenv.TestEnv) {
+	te := enterprise_testenv.GetCustomTestEnv(t, &enterprise_testenv.Options{})
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1", "US2", "GR2")))
+	s, err := NewAccessLogService(te)
+	require.NoError(t, err)
+	return s, te
+}
+
+func authContext(t *testing.T, te *testenv.TestEnv, userID string) context.Context {
+	ctx, err := te.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), userID)
+	require.NoError(t, err)
+	return ctx
+}
+
+func invocation(invocationID, groupID string) *inpb.Invocation {
+	return &inpb.Invocation{
+		InvocationId: invocationID,
+		Acl:          &aclpb.ACL{GroupId: groupID},
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	s, te := newTestService(t)
+	ctx1 := authContext(t, te, "US1")
+	ctx2 := authContext(t, te, "US2")
+	err := te.GetDBHandle().Create(&tables.Invocation{InvocationID: "inv1", GroupID: "GR1"}).Error
+	require.NoError(t, err)
+
+	s.RecordInvocationAccess(ctx1, invocation("inv1", "GR1"))
+	s.RecordInvocationAccess(ctx2, invocation("inv1", "GR1"))
+	s.RecordInvocationAccess(context.Background(), invocation("inv1", "GR1"))
+	s.RecordArtifactAccess(ctx2, "inv1", "test.log")
+	s.RecordInvocationAccess(ctx2, invocation("inv2", "GR2"))
+
+	rsp, err := s.GetAccessLog(ctx1, &alpb.GetAccessLogRequest{RequestContext: testauth.RequestContext("US1", "GR1")})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetEntry(), 4)
+	var users []string
+	for _, e := range rsp.GetEntry() {
+		assert.Equal(t, "inv1", e.GetInvocationId())
+		assert.Equal(t, 1.0, e.GetSampleRate())
+		users = append(users, e.GetUserId())
+	}
+	assert.ElementsMatch(t, []string{"US1", "US2", "", "US2"}, users)
+	assert.Empty(t, rsp.GetNextPageToken())
+
+	rsp, err = s.GetAccessLog(ctx1, &alpb.GetAccessLogRequest{
+		RequestContext: testauth.RequestContext("US1", "GR1"),
+		UserId:         "US2",
+	})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetEntry(), 2)
+
+	var artifacts []*alpb.AccessLogEntry
+	for _, e := range rsp.GetEntry() {
+		if e.GetResourceType() == alpb.AccessLogEntry_ARTIFACT {
+			artifacts = append(artifacts, e)
+		}
+	}
+	require.Len(t, artifacts, 1)
+	assert.Equal(t, "test.log", artifacts[0].GetArtifactName())
+
+	// Members of other groups can't see the group's log.
+	_, err = s.GetAccessLog(ctx2, &alpb.GetAccessLogRequest{RequestContext: testauth.RequestContext("US1", "GR1")})
+	assert.Error(t, err)
+	rsp, err = s.GetAccessLog(ctx2, &alpb.GetAccessLogRequest{RequestContext: testauth.RequestContext("US2", "GR2")})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetEntry(), 1)
+	assert.Equal(t, "inv2", rsp.GetEntry()[0].GetInvocationId())
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	s, te := newTestService(t)
+	ctx := authContext(t, te, "US1")
+	sampled := false
+	s.sampleRate = 0.5
+	s.sample = func() bool {
+		sampled = !sampled
+		return sampled
+	}
+
+	for i := 0; i < 4; i++ {
+		s.RecordInvocationAccess(ctx, invocation("inv1", "GR1"))
+	}
+
+	rsp, err := s.GetAccessLog(ctx, &alpb.GetAccessLogRequest{RequestContext: testauth.RequestContext("US1", "GR1")})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetEntry(), 2)
+	assert.Equal(t, 0.5, rsp.GetEntry()[0].GetSampleRate())
+}
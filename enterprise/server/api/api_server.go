@@ -17,9 +17,11 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/http/protolet"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/api_error"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/tags"
 	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
 	"github.com/golang/protobuf/ptypes"
 
@@ -45,7 +47,7 @@ func NewAPIServer(env environment.Env) *APIServer {
 func (s *APIServer) checkPreconditions(ctx context.Context) (interfaces.UserInfo, error) {
 	authenticator := s.env.GetAuthenticator()
 	if authenticator == nil {
-		return nil, status.FailedPreconditionErrorf("No authenticator configured")
+		return nil, api_error.NotConfiguredError("No authenticator configured")
 	}
 	return s.env.GetAuthenticator().AuthenticatedUser(ctx)
 }
@@ -56,18 +58,22 @@ func (s *APIServer) GetInvocation(ctx context.Context, req *apipb.GetInvocationR
 		return nil, err
 	}
 
-	if req.GetSelector().GetInvocationId() == "" && req.GetSelector().GetCommitSha() == "" {
-		return nil, status.InvalidArgumentErrorf("InvocationSelector must contain a valid invocation_id or commit_sha")
+	if req.GetSelector().GetInvocationId() == "" && req.GetSelector().GetCommitSha() == "" && req.GetSelector().GetTag() == "" {
+		return nil, api_error.MissingFieldError("selector", "InvocationSelector must contain a valid invocation_id, commit_sha, or tag")
 	}
 
 	q := query_builder.NewQuery(`SELECT * FROM Invocations`)
 	q = q.AddWhereClause(`group_id = ?`, user.GetGroupID())
+	q = q.AddWhereClause(`deleted_at_usec = 0`)
 	if req.GetSelector().GetInvocationId() != "" {
 		q = q.AddWhereClause(`invocation_id = ?`, req.GetSelector().GetInvocationId())
 	}
 	if req.GetSelector().GetCommitSha() != "" {
 		q = q.AddWhereClause(`commit_sha = ?`, req.GetSelector().GetCommitSha())
 	}
+	if req.GetSelector().GetTag() != "" {
+		q = q.AddWhereClause(`invocation_id IN (SELECT invocation_id FROM InvocationTags WHERE tag = ?)`, tags.Normalize(req.GetSelector().GetTag()))
+	}
 	if err := perms.AddPermissionsCheckToQuery(ctx, s.env, q); err != nil {
 		return nil, err
 	}
@@ -106,18 +112,49 @@ func (s *APIServer) GetInvocation(ctx context.Context, req *apipb.GetInvocationR
 		invocations = append(invocations, apiInvocation)
 	}
 
+	iids := make([]string, 0, len(invocations))
+	for _, in := range invocations {
+		iids = append(iids, in.GetId().GetInvocationId())
+	}
+	tagsByInvocation, err := s.env.GetInvocationDB().LookupInvocationTags(ctx, iids)
+	if err != nil {
+		return nil, err
+	}
+	for _, in := range invocations {
+		in.Tag = tagsByInvocation[in.GetId().GetInvocationId()]
+	}
+
 	return &apipb.GetInvocationResponse{
 		Invocation: invocations,
 	}, nil
 }
 
+func (s *APIServer) UpdateInvocationTags(ctx context.Context, req *apipb.UpdateInvocationTagsRequest) (*apipb.UpdateInvocationTagsResponse, error) {
+	if _, err := s.checkPreconditions(ctx); err != nil {
+		return nil, err
+	}
+
+	if req.GetInvocationId() == "" {
+		return nil, api_error.MissingFieldError("invocation_id", "UpdateInvocationTagsRequest must contain a valid invocation_id")
+	}
+
+	updatedTags, err := build_event_handler.UpdateInvocationTags(ctx, s.env, req.GetInvocationId(), req.GetAddTag(), req.GetRemoveTag())
+	if err != nil {
+		return nil, err
+	}
+
+	return &apipb.UpdateInvocationTagsResponse{
+		Tag: updatedTags,
+	}, nil
+}
+
 func (s *APIServer) GetTarget(ctx context.Context, req *apipb.GetTargetRequest) (*apipb.GetTargetResponse, error) {
 	if _, err := s.checkPreconditions(ctx); err != nil {
 		return nil, err
 	}
 
 	if req.GetSelector().GetInvocationId() == "" {
-		return nil, status.InvalidArgumentErrorf("TargetSelector must contain a valid invocation_id")
+		return nil, api_error.MissingFieldError("selector.invocation_id", "TargetSelector must contain a valid invocation_id")
 	}
 
 	inv, err := build_event_handler.LookupInvocation(s.env, ctx, req.GetSelector().GetInvocationId())
@@ -146,7 +183,7 @@ func (s *APIServer) GetAction(ctx context.Context, req *apipb.GetActionRequest)
 	}
 
 	if req.GetSelector().GetInvocationId() == "" {
-		return nil, status.InvalidArgumentErrorf("ActionSelector must contain a valid invocation_id")
+		return nil, api_error.MissingFieldError("selector.invocation_id", "ActionSelector must contain a valid invocation_id")
 	}
 
 	inv, err := build_event_handler.LookupInvocation(s.env, ctx, req.GetSelector().GetInvocationId())
@@ -193,10 +230,65 @@ func (s *APIServer) GetFile(req *apipb.GetFileRequest, server apipb.ApiService_G
 	})
 }
 
+func (s *APIServer) AddEvent(ctx context.Context, req *apipb.AddEventRequest) (*apipb.AddEventResponse, error) {
+	if _, err := s.checkPreconditions(ctx); err != nil {
+		return nil, err
+	}
+
+	if req.GetInvocationId() == "" {
+		return nil, api_error.MissingFieldError("invocation_id", "AddEventRequest must contain a valid invocation_id")
+	}
+	if req.GetEvent().GetType() == "" {
+		return nil, api_error.MissingFieldError("event.type", "Event must contain a type")
+	}
+
+	event, err := build_event_handler.AddCustomEvent(ctx, s.env, req.GetInvocationId(), &invocation.CustomEvent{
+		Source:     req.GetEvent().GetSource(),
+		Type:       req.GetEvent().GetType(),
+		Message:    req.GetEvent().GetMessage(),
+		Properties: req.GetEvent().GetProperties(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &apipb.AddEventResponse{
+		Event: eventFromCustomEvent(req.GetInvocationId(), event),
+	}, nil
+}
+
+func (s *APIServer) GetEvent(ctx context.Context, req *apipb.GetEventRequest) (*apipb.GetEventResponse, error) {
+	if _, err := s.checkPreconditions(ctx); err != nil {
+		return nil, err
+	}
+
+	if req.GetSelector().GetInvocationId() == "" {
+		return nil, api_error.MissingFieldError("selector.invocation_id", "EventSelector must contain a valid invocation_id")
+	}
+
+	customEvents, err := build_event_handler.LookupCustomEvents(ctx, s.env, req.GetSelector().GetInvocationId())
+	if err != nil {
+		return nil, err
+	}
+
+	events := []*apipb.Event{}
+	for _, customEvent := range customEvents {
+		// Filter to only selected events.
+		if req.GetSelector().GetType() != "" && req.GetSelector().GetType() != customEvent.GetEvent().GetType() {
+			continue
+		}
+		events = append(events, eventFromCustomEvent(req.GetSelector().GetInvocationId(), customEvent))
+	}
+
+	return &apipb.GetEventResponse{
+		Event: events,
+	}, nil
+}
+
 // Handle streaming http GetFile request since protolet doesn't handle streaming rpcs yet.
 func (s *APIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if _, err := s.checkPreconditions(r.Context()); err != nil {
-		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		api_error.WriteHTTPError(w, r, err)
 		return
 	}
 
@@ -205,7 +297,7 @@ func (s *APIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	parsedURL, err := url.Parse(req.GetUri())
 	if err != nil {
-		http.Error(w, "Invalid URI", http.StatusBadRequest)
+		api_error.WriteHTTPError(w, r, status.InvalidArgumentError("Invalid URI"))
 		return
 	}
 
@@ -213,7 +305,7 @@ func (s *APIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.Write(data)
 	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		api_error.WriteHTTPError(w, r, err)
 	}
 }
 
@@ -221,6 +313,20 @@ func encodeID(id string) string {
 	return base64.RawURLEncoding.EncodeToString([]byte(encodedIDPrefix + id))
 }
 
+func eventFromCustomEvent(iid string, event *invocation.CustomInvocationEvent) *apipb.Event {
+	return &apipb.Event{
+		Id: &apipb.Event_Id{
+			InvocationId: iid,
+			EventId:      encodeID(fmt.Sprintf("%s/%d", event.GetStreamId(), event.GetSequenceNumber())),
+		},
+		Source:     event.GetEvent().GetSource(),
+		Type:       event.GetEvent().GetType(),
+		Message:    event.GetEvent().GetMessage(),
+		Properties: event.GetEvent().GetProperties(),
+		Time:       event.GetEventTime(),
+	}
+}
+
 func testStatusToStatus(testStatus build_event_stream.TestStatus) cmnpb.Status {
 	switch testStatus {
 	case build_event_stream.TestStatus_PASSED:
@@ -266,6 +372,9 @@ func targetMapFromInvocation(inv *invocation.Invocation) map[string]*apipb.Targe
 			{
 				target := targetMap[event.GetBuildEvent().GetId().GetTargetCompleted().GetLabel()]
 				target.Status = cmnpb.Status_BUILT
+				if !p.Completed.GetSuccess() {
+					target.Status = cmnpb.Status_FAILED_TO_BUILD
+				}
 			}
 		case *build_event_stream.BuildEvent_TestSummary:
 			{
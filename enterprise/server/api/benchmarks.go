@@ -0,0 +1,355 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/bytestream"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/api_error"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/gobench"
+	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
+)
+
+const (
+	// The maximum size of benchmark output that can be added at once.
+	maxBenchmarkOutputBytes = 16 * 1024 * 1024
+
+	// The maximum number of results that can be added at once.
+	maxBenchmarkResults = 10000
+
+	// The number of results returned per page of a benchmark series.
+	benchmarkSeriesPageSize = 100
+
+	defaultBaselineCount              = 10
+	maxBaselineCount                  = 100
+	defaultRegressionThresholdPercent = 5.0
+
+	benchmarkPageTokenOffsetPrefix = "offset_"
+)
+
+var benchmarkOutputFormats = map[apipb.BenchmarkOutputFormat]gobench.Format{
+	apipb.BenchmarkOutputFormat_BENCHMARK_OUTPUT_FORMAT_UNSPECIFIED: gobench.AutoDetect,
+	apipb.BenchmarkOutputFormat_GO_BENCH_TEXT:                       gobench.Text,
+	apipb.BenchmarkOutputFormat_GO_TEST_JSON:                        gobench.JSON,
+}
+
+func (s *APIServer) AddBenchmarkResults(ctx context.Context, req *apipb.AddBenchmarkResultsRequest) (*apipb.AddBenchmarkResultsResponse, error) {
+	user, err := s.checkPreconditions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.GetInvocationId() == "" {
+		return nil, api_error.MissingFieldError("invocation_id", "AddBenchmarkResultsRequest must contain a valid invocation_id")
+	}
+	format, ok := benchmarkOutputFormats[req.GetFormat()]
+	if !ok {
+		return nil, status.InvalidArgumentErrorf("Unknown benchmark output format %s", req.GetFormat())
+	}
+	ti, err := s.lookupGroupInvocation(ctx, user, req.GetInvocationId())
+	if err != nil {
+		return nil, err
+	}
+
+	data := req.GetData()
+	if req.GetUri() != "" {
+		data, err = s.readInvocationFile(ctx, req.GetUri(), maxBenchmarkOutputBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(data) == 0 {
+		return nil, status.InvalidArgumentErrorf("AddBenchmarkResultsRequest must contain data or a uri")
+	}
+	if len(data) > maxBenchmarkOutputBytes {
+		return nil, api_error.RequestTooLargeError(fmt.Sprintf("Benchmark output is larger than %d bytes", maxBenchmarkOutputBytes))
+	}
+
+	parsed, err := gobench.Parse(data, format)
+	if err != nil {
+		return nil, err
+	}
+	if len(parsed) == 0 {
+		return nil, status.InvalidArgumentErrorf("No benchmark results were found in the output")
+	}
+	if len(parsed) > maxBenchmarkResults {
+		return nil, api_error.RequestTooLargeError(fmt.Sprintf("Benchmark output contains more than %d results", maxBenchmarkResults))
+	}
+
+	results := make([]*tables.BenchmarkResult, 0, len(parsed))
+	for _, r := range parsed {
+		results = append(results, &tables.BenchmarkResult{
+			ResultID:         benchmarkResultID(ti.InvocationID, r),
+			GroupID:          ti.GroupID,
+			InvocationID:     ti.InvocationID,
+			RepoURL:          ti.RepoURL,
+			CommitSHA:        ti.CommitSHA,
+			Branch:           req.GetBranch(),
+			BenchmarkPackage: r.Package,
+			BenchmarkName:    r.Name,
+			Unit:             r.Unit,
+			Value:            r.Value,
+			Iterations:       r.Iterations,
+		})
+	}
+	err = s.env.GetDBHandle().Transaction(ctx, func(tx *db.DB) error {
+		for _, r := range results {
+			if err := tx.Exec(`DELETE FROM BenchmarkResults WHERE result_id = ?`, r.ResultID).Error; err != nil {
+				return err
+			}
+			if err := tx.Create(r).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := &apipb.AddBenchmarkResultsResponse{}
+	for _, r := range results {
+		rsp.Result = append(rsp.Result, benchmarkResultToProto(r))
+	}
+	return rsp, nil
+}
+
+func (s *APIServer) GetBenchmarkSeries(ctx context.Context, req *apipb.GetBenchmarkSeriesRequest) (*apipb.GetBenchmarkSeriesResponse, error) {
+	user, err := s.checkPreconditions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	selector := req.GetSelector()
+	if selector.GetName() == "" {
+		return nil, api_error.MissingFieldError("selector.name", "BenchmarkSelector must contain a valid name")
+	}
+	offset := int64(0)
+	if strings.HasPrefix(req.GetPageToken(), benchmarkPageTokenOffsetPrefix) {
+		offset, err = strconv.ParseInt(strings.TrimPrefix(req.GetPageToken(), benchmarkPageTokenOffsetPrefix), 10, 64)
+		if err != nil {
+			return nil, api_error.InvalidPageTokenError()
+		}
+	} else if req.GetPageToken() != "" {
+		return nil, api_error.InvalidPageTokenError()
+	}
+
+	q := query_builder.NewQuery(`SELECT * FROM BenchmarkResults`)
+	q.AddWhereClause(`group_id = ?`, user.GetGroupID())
+	q.AddWhereClause(`benchmark_name = ?`, selector.GetName())
+	if selector.GetPackage() != "" {
+		q.AddWhereClause(`benchmark_package = ?`, selector.GetPackage())
+	}
+	if selector.GetUnit() != "" {
+		q.AddWhereClause(`unit = ?`, selector.GetUnit())
+	}
+	if selector.GetBranch() != "" {
+		q.AddWhereClause(`branch = ?`, selector.GetBranch())
+	}
+	q.SetOrderBy("created_at_usec" /*ascending=*/, false)
+	q.SetLimit(benchmarkSeriesPageSize)
+	q.SetOffset(offset)
+	results, err := s.queryBenchmarkResults(q)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := &apipb.GetBenchmarkSeriesResponse{}
+	// Results are queried from newest to oldest, but returned in
+	// chronological order.
+	for i := len(results) - 1; i >= 0; i-- {
+		rsp.Result = append(rsp.Result, benchmarkResultToProto(results[i]))
+	}
+	if len(results) == benchmarkSeriesPageSize {
+		rsp.NextPageToken = benchmarkPageTokenOffsetPrefix + strconv.FormatInt(offset+benchmarkSeriesPageSize, 10)
+	}
+	return rsp, nil
+}
+
+func (s *APIServer) DetectBenchmarkRegressions(ctx context.Context, req *apipb.DetectBenchmarkRegressionsRequest) (*apipb.DetectBenchmarkRegressionsResponse, error) {
+	user, err := s.checkPreconditions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.GetInvocationId() == "" {
+		return nil, api_error.MissingFieldError("invocation_id", "DetectBenchmarkRegressionsRequest must contain a valid invocation_id")
+	}
+	if req.GetBaselineBranch() == "" {
+		return nil, api_error.MissingFieldError("baseline_branch", "DetectBenchmarkRegressionsRequest must contain a valid baseline_branch")
+	}
+	baselineCount := int64(req.GetBaselineCount())
+	if baselineCount <= 0 {
+		baselineCount = defaultBaselineCount
+	}
+	if baselineCount > maxBaselineCount {
+		baselineCount = maxBaselineCount
+	}
+	thresholdPercent := req.GetThresholdPercent()
+	if thresholdPercent <= 0 {
+		thresholdPercent = defaultRegressionThresholdPercent
+	}
+	ti, err := s.lookupGroupInvocation(ctx, user, req.GetInvocationId())
+	if err != nil {
+		return nil, err
+	}
+
+	q := query_builder.NewQuery(`SELECT * FROM BenchmarkResults`)
+	q.AddWhereClause(`group_id = ?`, ti.GroupID)
+	q.AddWhereClause(`invocation_id = ?`, ti.InvocationID)
+	results, err := s.queryBenchmarkResults(q)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.BenchmarkPackage != b.BenchmarkPackage {
+			return a.BenchmarkPackage < b.BenchmarkPackage
+		}
+		if a.BenchmarkName != b.BenchmarkName {
+			return a.BenchmarkName < b.BenchmarkName
+		}
+		return a.Unit < b.Unit
+	})
+
+	rsp := &apipb.DetectBenchmarkRegressionsResponse{}
+	for _, r := range results {
+		q := query_builder.NewQuery(`SELECT * FROM BenchmarkResults`)
+		q.AddWhereClause(`group_id = ?`, ti.GroupID)
+		q.AddWhereClause(`benchmark_name = ?`, r.BenchmarkName)
+		q.AddWhereClause(`benchmark_package = ?`, r.BenchmarkPackage)
+		q.AddWhereClause(`unit = ?`, r.Unit)
+		q.AddWhereClause(`branch = ?`, req.GetBaselineBranch())
+		q.AddWhereClause(`invocation_id != ?`, ti.InvocationID)
+		if ti.RepoURL != "" {
+			q.AddWhereClause(`repo_url = ?`, ti.RepoURL)
+		}
+		q.SetOrderBy("created_at_usec" /*ascending=*/, false)
+		q.SetLimit(baselineCount)
+		baseline, err := s.queryBenchmarkResults(q)
+		if err != nil {
+			return nil, err
+		}
+		if len(baseline) == 0 {
+			continue
+		}
+		rsp.Comparison = append(rsp.Comparison, compareBenchmarkResult(r, baseline, thresholdPercent))
+	}
+	return rsp, nil
+}
+
+// lookupGroupInvocation returns the given invocation if it belongs to the
+// authenticated user's group.
+func (s *APIServer) lookupGroupInvocation(ctx context.Context, user interfaces.UserInfo, iid string) (*tables.Invocation, error) {
+	ti, err := s.env.GetInvocationDB().LookupInvocation(ctx, iid)
+	if err != nil {
+		if db.IsRecordNotFound(err) {
+			return nil, api_error.InvocationNotFoundError(iid)
+		}
+		return nil, err
+	}
+	if ti.GroupID != user.GetGroupID() {
+		return nil, status.PermissionDeniedErrorf("Invocation %q does not belong to your organization", iid)
+	}
+	return ti, nil
+}
+
+// readInvocationFile reads a file from the given bytestream URI. At most
+// slightly more than maxBytes are buffered, so that callers can check whether
+// the file is too large.
+func (s *APIServer) readInvocationFile(ctx context.Context, uri string, maxBytes int) ([]byte, error) {
+	parsedURL, err := url.Parse(uri)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("Invalid URL")
+	}
+	buf := &bytes.Buffer{}
+	err = bytestream.StreamBytestreamFile(ctx, s.env, parsedURL, func(data []byte) {
+		// Stop buffering once the file is known to be too large.
+		if buf.Len() <= maxBytes {
+			buf.Write(data)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *APIServer) queryBenchmarkResults(q *query_builder.Query) ([]*tables.BenchmarkResult, error) {
+	queryStr, args := q.Build()
+	rows, err := s.env.GetDBHandle().Raw(queryStr, args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []*tables.BenchmarkResult
+	for rows.Next() {
+		r := &tables.BenchmarkResult{}
+		if err := s.env.GetDBHandle().ScanRows(rows, r); err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// compareBenchmarkResult compares a result with the median of the given
+// baseline results.
+func compareBenchmarkResult(r *tables.BenchmarkResult, baseline []*tables.BenchmarkResult, thresholdPercent float64) *apipb.BenchmarkComparison {
+	values := make([]float64, 0, len(baseline))
+	for _, b := range baseline {
+		values = append(values, b.Value)
+	}
+	sort.Float64s(values)
+	median := values[len(values)/2]
+	if len(values)%2 == 0 {
+		median = (values[len(values)/2-1] + values[len(values)/2]) / 2
+	}
+
+	c := &apipb.BenchmarkComparison{
+		Result:        benchmarkResultToProto(r),
+		BaselineValue: median,
+		BaselineCount: int32(len(baseline)),
+	}
+	if median == 0 {
+		return c
+	}
+	c.ChangePercent = (r.Value - median) / median * 100
+	if gobench.HigherIsBetter(r.Unit) {
+		c.Regressed = -c.ChangePercent > thresholdPercent
+	} else {
+		c.Regressed = c.ChangePercent > thresholdPercent
+	}
+	return c
+}
+
+func benchmarkResultID(iid string, r *gobench.Result) string {
+	key := strings.Join([]string{iid, r.Package, r.Name, r.Unit}, "\x00")
+	return fmt.Sprintf("%x", md5.Sum([]byte(key)))
+}
+
+func benchmarkResultToProto(r *tables.BenchmarkResult) *apipb.BenchmarkResult {
+	return &apipb.BenchmarkResult{
+		InvocationId:  r.InvocationID,
+		CommitSha:     r.CommitSHA,
+		Branch:        r.Branch,
+		Package:       r.BenchmarkPackage,
+		Name:          r.BenchmarkName,
+		Unit:          r.Unit,
+		Value:         r.Value,
+		Iterations:    r.Iterations,
+		CreatedAtUsec: r.CreatedAtUsec,
+	}
+}
@@ -0,0 +1,114 @@
+package api_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/api"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
+)
+
+func benchmarkOutput(nsPerOp, mbPerSecond float64) []byte {
+	return []byte(fmt.Sprintf("pkg: example.com/codec\nBenchmarkDecode-8 \t 1000\t %f ns/op\t %f MB/s\nPASS\n", nsPerOp, mbPerSecond))
+}
+
+func TestBenchmarkRegressions(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	users := testauth.TestUsers("USER1", "GROUP1", "USER2", "GROUP2")
+	te.SetAuthenticator(testauth.NewTestAuthenticator(users))
+	ctx := testauth.WithAuthenticatedUserInfo(context.Background(), users["USER1"])
+	s := api.NewAPIServer(te)
+
+	for i, run := range []struct {
+		iid         string
+		branch      string
+		nsPerOp     float64
+		mbPerSecond float64
+	}{
+		{"main-1", "main", 100, 100},
+		{"main-2", "main", 110, 100},
+		{"main-3", "main", 90, 100},
+		{"feature-1", "feature", 120, 90},
+	} {
+		err := te.GetInvocationDB().InsertOrUpdateInvocation(ctx, &tables.Invocation{InvocationID: run.iid, InvocationPK: int64(i + 1)})
+		require.NoError(t, err)
+		rsp, err := s.AddBenchmarkResults(ctx, &apipb.AddBenchmarkResultsRequest{
+			InvocationId: run.iid,
+			Branch:       run.branch,
+			Output:       &apipb.AddBenchmarkResultsRequest_Data{Data: benchmarkOutput(run.nsPerOp, run.mbPerSecond)},
+		})
+		require.NoError(t, err)
+		require.Len(t, rsp.Result, 2)
+	}
+
+	rsp, err := s.DetectBenchmarkRegressions(ctx, &apipb.DetectBenchmarkRegressionsRequest{
+		InvocationId:   "feature-1",
+		BaselineBranch: "main",
+	})
+	require.NoError(t, err)
+	require.Len(t, rsp.Comparison, 2)
+	throughput, latency := rsp.Comparison[0], rsp.Comparison[1]
+	assert.Equal(t, "MB/s", throughput.Result.Unit)
+	assert.Equal(t, float64(100), throughput.BaselineValue)
+	assert.InDelta(t, -10, throughput.ChangePercent, 0.001)
+	assert.True(t, throughput.Regressed)
+	assert.Equal(t, "ns/op", latency.Result.Unit)
+	assert.Equal(t, float64(100), latency.BaselineValue)
+	assert.Equal(t, int32(3), latency.BaselineCount)
+	assert.InDelta(t, 20, latency.ChangePercent, 0.001)
+	assert.True(t, latency.Regressed)
+
+	// A larger threshold tolerates the changes.
+	rsp, err = s.DetectBenchmarkRegressions(ctx, &apipb.DetectBenchmarkRegressionsRequest{
+		InvocationId:     "feature-1",
+		BaselineBranch:   "main",
+		ThresholdPercent: 25,
+	})
+	require.NoError(t, err)
+	for _, c := range rsp.Comparison {
+		assert.False(t, c.Regressed, c.Result.Unit)
+	}
+
+	series, err := s.GetBenchmarkSeries(ctx, &apipb.GetBenchmarkSeriesRequest{
+		Selector: &apipb.BenchmarkSelector{Name: "BenchmarkDecode-8", Unit: "ns/op", Branch: "main"},
+	})
+	require.NoError(t, err)
+	assert.Len(t, series.Result, 3)
+
+	// Other groups can't see the results.
+	otherCtx := testauth.WithAuthenticatedUserInfo(context.Background(), users["USER2"])
+	series, err = s.GetBenchmarkSeries(otherCtx, &apipb.GetBenchmarkSeriesRequest{
+		Selector: &apipb.BenchmarkSelector{Name: "BenchmarkDecode-8"},
+	})
+	require.NoError(t, err)
+	assert.Empty(t, series.Result)
+	_, err = s.DetectBenchmarkRegressions(otherCtx, &apipb.DetectBenchmarkRegressionsRequest{
+		InvocationId:   "feature-1",
+		BaselineBranch: "main",
+	})
+	assert.Error(t, err)
+}
+
+func TestAddBenchmarkResultsWithoutResults(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	users := testauth.TestUsers("USER1", "GROUP1")
+	te.SetAuthenticator(testauth.NewTestAuthenticator(users))
+	ctx := testauth.WithAuthenticatedUserInfo(context.Background(), users["USER1"])
+	s := api.NewAPIServer(te)
+
+	err := te.GetInvocationDB().InsertOrUpdateInvocation(ctx, &tables.Invocation{InvocationID: "iid", InvocationPK: 1})
+	require.NoError(t, err)
+	_, err = s.AddBenchmarkResults(ctx, &apipb.AddBenchmarkResultsRequest{
+		InvocationId: "iid",
+		Output:       &apipb.AddBenchmarkResultsRequest_Data{Data: []byte("PASS\n")},
+	})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+}
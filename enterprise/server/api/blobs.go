@@ -0,0 +1,115 @@
+package api
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/retention"
+	"github.com/buildbuddy-io/buildbuddy/server/util/api_error"
+	"github.com/buildbuddy-io/buildbuddy/server/util/capabilities"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
+	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	// The maximum number of blobs that may be checked or promoted in a single
+	// request.
+	maxBlobsPerRequest = 1000
+)
+
+// blobCache returns the CAS of the given instance name for the authenticated
+// user, reading through the retention store if one is configured, along with
+// the requested digests converted to REAPI digests.
+func (s *APIServer) blobCache(ctx context.Context, instanceName string, blobDigests []*apipb.BlobDigest) (context.Context, interfaces.Cache, []*repb.Digest, error) {
+	if _, err := s.checkPreconditions(ctx); err != nil {
+		return nil, nil, nil, err
+	}
+	if len(blobDigests) == 0 {
+		return nil, nil, nil, api_error.MissingFieldError("digest", "At least one digest must be specified")
+	}
+	if len(blobDigests) > maxBlobsPerRequest {
+		return nil, nil, nil, api_error.RequestTooLargeError(fmt.Sprintf("At most %d digests may be specified per request", maxBlobsPerRequest))
+	}
+	digests := make([]*repb.Digest, 0, len(blobDigests))
+	for _, bd := range blobDigests {
+		d := &repb.Digest{Hash: bd.GetHash(), SizeBytes: bd.GetSizeBytes()}
+		if _, err := digest.Validate(d); err != nil {
+			return nil, nil, nil, status.InvalidArgumentErrorf("Invalid digest %s/%d: %s", d.GetHash(), d.GetSizeBytes(), err)
+		}
+		digests = append(digests, d)
+	}
+
+	cache := s.env.GetCache()
+	if cache == nil {
+		return nil, nil, nil, api_error.NotConfiguredError("No cache configured")
+	}
+	if rs := s.env.GetRetentionStore(); rs != nil {
+		cache = rs.Cache(cache)
+	}
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, s.env)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return ctx, namespace.CASCache(cache, instanceName), digests, nil
+}
+
+func toBlobDigest(d *repb.Digest) *apipb.BlobDigest {
+	return &apipb.BlobDigest{Hash: d.GetHash(), SizeBytes: d.GetSizeBytes()}
+}
+
+func (s *APIServer) CheckBlobs(ctx context.Context, req *apipb.CheckBlobsRequest) (*apipb.CheckBlobsResponse, error) {
+	ctx, cache, digests, err := s.blobCache(ctx, req.GetInstanceName(), req.GetDigest())
+	if err != nil {
+		return nil, err
+	}
+	foundMap, err := cache.ContainsMulti(ctx, digests)
+	if err != nil {
+		return nil, err
+	}
+	rsp := &apipb.CheckBlobsResponse{}
+	for _, d := range digests {
+		if foundMap[d] || d.GetHash() == digest.EmptySha256 {
+			rsp.Found = append(rsp.Found, toBlobDigest(d))
+		} else {
+			rsp.Missing = append(rsp.Missing, toBlobDigest(d))
+		}
+	}
+	return rsp, nil
+}
+
+func (s *APIServer) PromoteBlobs(ctx context.Context, req *apipb.PromoteBlobsRequest) (*apipb.PromoteBlobsResponse, error) {
+	ctx, cache, digests, err := s.blobCache(ctx, req.GetInstanceName(), req.GetDigest())
+	if err != nil {
+		return nil, err
+	}
+	if !retention.IsRetained(cache, retention.Promoted) {
+		return nil, api_error.NotConfiguredError("No retention class is configured for promoted blobs")
+	}
+	canWrite, err := capabilities.IsGranted(ctx, s.env, akpb.ApiKey_CACHE_WRITE_CAPABILITY)
+	if err != nil {
+		return nil, err
+	}
+	if !canWrite {
+		return nil, api_error.MissingCapabilityError(akpb.ApiKey_CACHE_WRITE_CAPABILITY.String(), "Promoting blobs requires an API key with cache write permission")
+	}
+	rsp := &apipb.PromoteBlobsResponse{}
+	for _, d := range digests {
+		err := retention.Retain(ctx, cache, retention.Promoted, d)
+		if status.IsNotFoundError(err) {
+			rsp.Missing = append(rsp.Missing, toBlobDigest(d))
+			continue
+		}
+		if err != nil {
+			return nil, status.WrapErrorf(err, "Could not promote blob %s/%d", d.GetHash(), d.GetSizeBytes())
+		}
+		rsp.Promoted = append(rsp.Promoted, toBlobDigest(d))
+	}
+	return rsp, nil
+}
@@ -0,0 +1,86 @@
+package api_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/api"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/retention"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/api_error"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+func blobDigest(d *repb.Digest) *apipb.BlobDigest {
+	return &apipb.BlobDigest{Hash: d.GetHash(), SizeBytes: d.GetSizeBytes()}
+}
+
+func TestCheckAndPromoteBlobs(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	users := testauth.TestUsers("USER1", "GROUP1")
+	te.SetAuthenticator(testauth.NewTestAuthenticator(users))
+	ctx := testauth.WithAuthenticatedUserInfo(context.Background(), users["USER1"])
+	s := api.NewAPIServer(te)
+
+	present, data := testdigest.NewRandomDigestBuf(t, 100)
+	absent, _ := testdigest.NewRandomDigestBuf(t, 100)
+	prefixedCtx, err := prefix.AttachUserPrefixToContext(ctx, te)
+	require.NoError(t, err)
+	require.NoError(t, te.GetCache().WithPrefix("release").Set(prefixedCtx, present, data))
+	req := []*apipb.BlobDigest{blobDigest(present), blobDigest(absent)}
+
+	checkRsp, err := s.CheckBlobs(ctx, &apipb.CheckBlobsRequest{InstanceName: "release", Digest: req})
+	require.NoError(t, err)
+	assert.Equal(t, []*apipb.BlobDigest{blobDigest(present)}, checkRsp.GetFound())
+	assert.Equal(t, []*apipb.BlobDigest{blobDigest(absent)}, checkRsp.GetMissing())
+
+	// Blobs are checked under the requested instance name.
+	checkRsp, err = s.CheckBlobs(ctx, &apipb.CheckBlobsRequest{Digest: req})
+	require.NoError(t, err)
+	assert.Empty(t, checkRsp.GetFound())
+
+	_, err = s.PromoteBlobs(ctx, &apipb.PromoteBlobsRequest{InstanceName: "release", Digest: req})
+	assert.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition, got %v", err)
+	assert.Equal(t, apipb.Error_NOT_CONFIGURED, api_error.Reason(err))
+
+	rs, err := retention.NewStore([]config.RetentionClassConfig{
+		{Name: "releases", Kinds: []string{"promoted"}, MaxSizeBytes: 1_000_000},
+	})
+	require.NoError(t, err)
+	te.SetRetentionStore(rs)
+
+	promoteRsp, err := s.PromoteBlobs(ctx, &apipb.PromoteBlobsRequest{InstanceName: "release", Digest: req})
+	require.NoError(t, err)
+	assert.Equal(t, []*apipb.BlobDigest{blobDigest(present)}, promoteRsp.GetPromoted())
+	assert.Equal(t, []*apipb.BlobDigest{blobDigest(absent)}, promoteRsp.GetMissing())
+
+	// Promoted blobs are still found after the cache evicts them.
+	require.NoError(t, te.GetCache().WithPrefix("release").Delete(prefixedCtx, present))
+	checkRsp, err = s.CheckBlobs(ctx, &apipb.CheckBlobsRequest{InstanceName: "release", Digest: req})
+	require.NoError(t, err)
+	assert.Equal(t, []*apipb.BlobDigest{blobDigest(present)}, checkRsp.GetFound())
+}
+
+func TestCheckBlobsInvalidDigest(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	users := testauth.TestUsers("USER1", "GROUP1")
+	te.SetAuthenticator(testauth.NewTestAuthenticator(users))
+	ctx := testauth.WithAuthenticatedUserInfo(context.Background(), users["USER1"])
+	s := api.NewAPIServer(te)
+
+	_, err := s.CheckBlobs(ctx, &apipb.CheckBlobsRequest{})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+	assert.Equal(t, apipb.Error_MISSING_FIELD, api_error.Reason(err))
+
+	_, err = s.CheckBlobs(ctx, &apipb.CheckBlobsRequest{Digest: []*apipb.BlobDigest{{Hash: "abc", SizeBytes: 1}}})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+}
@@ -0,0 +1,335 @@
+package api
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/api_error"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/lcov"
+	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
+)
+
+const (
+	// The name of the coverage report that `bazel coverage` writes for each
+	// test, as listed in the test's outputs.
+	coverageReportFileName = "test.lcov"
+
+	// The maximum size of a single coverage report.
+	maxCoverageReportBytes = 64 * 1024 * 1024
+
+	// The number of results returned per page of a coverage series.
+	coverageSeriesPageSize = 100
+
+	coveragePageTokenOffsetPrefix = "offset_"
+)
+
+func (s *APIServer) AddCoverage(ctx context.Context, req *apipb.AddCoverageRequest) (*apipb.AddCoverageResponse, error) {
+	user, err := s.checkPreconditions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.GetInvocationId() == "" {
+		return nil, api_error.MissingFieldError("invocation_id", "AddCoverageRequest must contain a valid invocation_id")
+	}
+	ti, err := s.lookupGroupInvocation(ctx, user, req.GetInvocationId())
+	if err != nil {
+		return nil, err
+	}
+	inv, err := build_event_handler.LookupInvocation(s.env, ctx, req.GetInvocationId())
+	if err != nil {
+		return nil, err
+	}
+
+	// Each run, shard, and attempt of a test writes a report of its own, so
+	// merge them by target.
+	reports := map[string]*lcov.Report{}
+	for _, event := range inv.GetEvent() {
+		testResult, ok := event.GetBuildEvent().GetPayload().(*build_event_stream.BuildEvent_TestResult)
+		if !ok {
+			continue
+		}
+		label := event.GetBuildEvent().GetId().GetTestResult().GetLabel()
+		for _, f := range testResult.TestResult.GetTestActionOutput() {
+			if f.GetName() != coverageReportFileName || f.GetUri() == "" {
+				continue
+			}
+			data, err := s.readInvocationFile(ctx, f.GetUri(), maxCoverageReportBytes)
+			if err != nil {
+				return nil, err
+			}
+			if len(data) > maxCoverageReportBytes {
+				return nil, api_error.RequestTooLargeError(fmt.Sprintf("Coverage report for %q is larger than %d bytes", label, maxCoverageReportBytes))
+			}
+			report, err := lcov.Parse(data)
+			if err != nil {
+				return nil, status.WrapErrorf(err, "Invalid coverage report for %q", label)
+			}
+			if reports[label] == nil {
+				reports[label] = lcov.NewReport()
+			}
+			reports[label].Merge(report)
+		}
+	}
+	if len(reports) == 0 {
+		return nil, status.NotFoundErrorf("No coverage reports were found in invocation %q", ti.InvocationID)
+	}
+
+	labels := make([]string, 0, len(reports))
+	for label := range reports {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	total := lcov.NewReport()
+	coverage := make([]*tables.TargetCoverage, 0, len(reports)+1)
+	for _, label := range labels {
+		total.Merge(reports[label])
+		coverage = append(coverage, newTargetCoverage(ti, req.GetBranch(), label, reports[label].Summary()))
+	}
+	// The combined coverage goes first, under an empty label.
+	coverage = append([]*tables.TargetCoverage{newTargetCoverage(ti, req.GetBranch(), "", total.Summary())}, coverage...)
+
+	err = s.env.GetDBHandle().Transaction(ctx, func(tx *db.DB) error {
+		if err := tx.Exec(`DELETE FROM TargetCoverage WHERE invocation_id = ?`, ti.InvocationID).Error; err != nil {
+			return err
+		}
+		for _, c := range coverage {
+			if err := tx.Create(c).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := &apipb.AddCoverageResponse{
+		Coverage: coverageToProto(coverage[0]),
+	}
+	for _, c := range coverage[1:] {
+		rsp.TargetCoverage = append(rsp.TargetCoverage, coverageToProto(c))
+	}
+	return rsp, nil
+}
+
+func (s *APIServer) GetCoverageSeries(ctx context.Context, req *apipb.GetCoverageSeriesRequest) (*apipb.GetCoverageSeriesResponse, error) {
+	user, err := s.checkPreconditions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := int64(0)
+	if strings.HasPrefix(req.GetPageToken(), coveragePageTokenOffsetPrefix) {
+		offset, err = strconv.ParseInt(strings.TrimPrefix(req.GetPageToken(), coveragePageTokenOffsetPrefix), 10, 64)
+		if err != nil {
+			return nil, api_error.InvalidPageTokenError()
+		}
+	} else if req.GetPageToken() != "" {
+		return nil, api_error.InvalidPageTokenError()
+	}
+
+	selector := req.GetSelector()
+	q := query_builder.NewQuery(`SELECT * FROM TargetCoverage`)
+	q.AddWhereClause(`group_id = ?`, user.GetGroupID())
+	q.AddWhereClause(`label = ?`, selector.GetLabel())
+	if selector.GetBranch() != "" {
+		q.AddWhereClause(`branch = ?`, selector.GetBranch())
+	}
+	if selector.GetCommitSha() != "" {
+		q.AddWhereClause(`commit_sha = ?`, selector.GetCommitSha())
+	}
+	q.SetOrderBy("created_at_usec" /*ascending=*/, false)
+	q.SetLimit(coverageSeriesPageSize)
+	q.SetOffset(offset)
+	coverage, err := s.queryTargetCoverage(q)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := &apipb.GetCoverageSeriesResponse{}
+	// Coverage is queried from newest to oldest, but returned in
+	// chronological order.
+	for i := len(coverage) - 1; i >= 0; i-- {
+		rsp.Coverage = append(rsp.Coverage, coverageToProto(coverage[i]))
+	}
+	if len(coverage) == coverageSeriesPageSize {
+		rsp.NextPageToken = coveragePageTokenOffsetPrefix + strconv.FormatInt(offset+coverageSeriesPageSize, 10)
+	}
+	return rsp, nil
+}
+
+func (s *APIServer) GetCoverageDelta(ctx context.Context, req *apipb.GetCoverageDeltaRequest) (*apipb.GetCoverageDeltaResponse, error) {
+	user, err := s.checkPreconditions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.GetInvocationId() == "" {
+		return nil, api_error.MissingFieldError("invocation_id", "GetCoverageDeltaRequest must contain a valid invocation_id")
+	}
+	if req.GetBaseCommitSha() == "" && req.GetBaselineBranch() == "" {
+		return nil, api_error.MissingFieldError("base_commit_sha", "GetCoverageDeltaRequest must contain a base_commit_sha or baseline_branch")
+	}
+	ti, err := s.lookupGroupInvocation(ctx, user, req.GetInvocationId())
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := s.lookupInvocationCoverage(ti.GroupID, ti.InvocationID)
+	if err != nil {
+		return nil, err
+	}
+	if head[""] == nil {
+		return nil, status.FailedPreconditionErrorf("Coverage has not been added for invocation %q", ti.InvocationID)
+	}
+
+	// Find the most recent invocation that measured the base coverage.
+	q := query_builder.NewQuery(`SELECT * FROM TargetCoverage`)
+	q.AddWhereClause(`group_id = ?`, ti.GroupID)
+	q.AddWhereClause(`label = ?`, "")
+	q.AddWhereClause(`invocation_id != ?`, ti.InvocationID)
+	if req.GetBaseCommitSha() != "" {
+		q.AddWhereClause(`commit_sha = ?`, req.GetBaseCommitSha())
+	} else {
+		q.AddWhereClause(`branch = ?`, req.GetBaselineBranch())
+	}
+	if ti.RepoURL != "" {
+		q.AddWhereClause(`repo_url = ?`, ti.RepoURL)
+	}
+	q.SetOrderBy("created_at_usec" /*ascending=*/, false)
+	q.SetLimit(1)
+	latest, err := s.queryTargetCoverage(q)
+	if err != nil {
+		return nil, err
+	}
+	base := map[string]*tables.TargetCoverage{}
+	if len(latest) > 0 {
+		base, err = s.lookupInvocationCoverage(ti.GroupID, latest[0].InvocationID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rsp := &apipb.GetCoverageDeltaResponse{
+		Head: coverageToProto(head[""]),
+	}
+	if base[""] != nil {
+		rsp.Base = coverageToProto(base[""])
+		rsp.LineCoverageDeltaPercent = rsp.Head.LineCoveragePercent - rsp.Base.LineCoveragePercent
+	}
+
+	labels := make([]string, 0, len(head)+len(base))
+	for label := range head {
+		labels = append(labels, label)
+	}
+	for label := range base {
+		if head[label] == nil {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		if label == "" {
+			continue
+		}
+		delta := &apipb.TargetCoverageDelta{Label: label}
+		if head[label] != nil {
+			delta.Head = coverageToProto(head[label])
+		}
+		if base[label] != nil {
+			delta.Base = coverageToProto(base[label])
+		}
+		delta.LineCoverageDeltaPercent = delta.GetHead().GetLineCoveragePercent() - delta.GetBase().GetLineCoveragePercent()
+		rsp.TargetDelta = append(rsp.TargetDelta, delta)
+	}
+
+	rsp.Passed = rsp.Head.LineCoveragePercent >= req.GetMinLineCoveragePercent()
+	if req.GetFailOnDecrease() && rsp.Base != nil && -rsp.LineCoverageDeltaPercent > req.GetDecreaseTolerancePercent() {
+		rsp.Passed = false
+	}
+	return rsp, nil
+}
+
+// lookupInvocationCoverage returns the coverage stored for the given
+// invocation, by label.
+func (s *APIServer) lookupInvocationCoverage(groupID, iid string) (map[string]*tables.TargetCoverage, error) {
+	q := query_builder.NewQuery(`SELECT * FROM TargetCoverage`)
+	q.AddWhereClause(`group_id = ?`, groupID)
+	q.AddWhereClause(`invocation_id = ?`, iid)
+	coverage, err := s.queryTargetCoverage(q)
+	if err != nil {
+		return nil, err
+	}
+	byLabel := make(map[string]*tables.TargetCoverage, len(coverage))
+	for _, c := range coverage {
+		byLabel[c.Label] = c
+	}
+	return byLabel, nil
+}
+
+func (s *APIServer) queryTargetCoverage(q *query_builder.Query) ([]*tables.TargetCoverage, error) {
+	queryStr, args := q.Build()
+	rows, err := s.env.GetDBHandle().Raw(queryStr, args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var coverage []*tables.TargetCoverage
+	for rows.Next() {
+		c := &tables.TargetCoverage{}
+		if err := s.env.GetDBHandle().ScanRows(rows, c); err != nil {
+			return nil, err
+		}
+		coverage = append(coverage, c)
+	}
+	return coverage, rows.Err()
+}
+
+func newTargetCoverage(ti *tables.Invocation, branch, label string, summary *lcov.Summary) *tables.TargetCoverage {
+	key := ti.InvocationID + "\x00" + label
+	return &tables.TargetCoverage{
+		CoverageID:     fmt.Sprintf("%x", md5.Sum([]byte(key))),
+		GroupID:        ti.GroupID,
+		InvocationID:   ti.InvocationID,
+		RepoURL:        ti.RepoURL,
+		CommitSHA:      ti.CommitSHA,
+		Branch:         branch,
+		Label:          label,
+		LinesFound:     summary.LinesFound,
+		LinesHit:       summary.LinesHit,
+		FunctionsFound: summary.FunctionsFound,
+		FunctionsHit:   summary.FunctionsHit,
+		BranchesFound:  summary.BranchesFound,
+		BranchesHit:    summary.BranchesHit,
+	}
+}
+
+func coverageToProto(c *tables.TargetCoverage) *apipb.Coverage {
+	summary := &lcov.Summary{LinesFound: c.LinesFound, LinesHit: c.LinesHit}
+	return &apipb.Coverage{
+		InvocationId:        c.InvocationID,
+		CommitSha:           c.CommitSHA,
+		Branch:              c.Branch,
+		Label:               c.Label,
+		LinesFound:          c.LinesFound,
+		LinesHit:            c.LinesHit,
+		FunctionsFound:      c.FunctionsFound,
+		FunctionsHit:        c.FunctionsHit,
+		BranchesFound:       c.BranchesFound,
+		BranchesHit:         c.BranchesHit,
+		LineCoveragePercent: summary.LinePercent(),
+		CreatedAtUsec:       c.CreatedAtUsec,
+	}
+}
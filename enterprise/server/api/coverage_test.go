@@ -0,0 +1,115 @@
+package api_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/api"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
+)
+
+func TestCoverageDelta(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	users := testauth.TestUsers("USER1", "GROUP1")
+	te.SetAuthenticator(testauth.NewTestAuthenticator(users))
+	ctx := testauth.WithAuthenticatedUserInfo(context.Background(), users["USER1"])
+	s := api.NewAPIServer(te)
+
+	for i, inv := range []struct {
+		iid       string
+		commitSHA string
+		branch    string
+		coverage  map[string]int64
+	}{
+		{"base", "abc", "main", map[string]int64{"": 80, "//a:test": 80, "//b:test": 80}},
+		{"head", "def", "feature", map[string]int64{"": 70, "//a:test": 90, "//c:test": 50}},
+	} {
+		err := te.GetInvocationDB().InsertOrUpdateInvocation(ctx, &tables.Invocation{
+			InvocationID: inv.iid,
+			InvocationPK: int64(i + 1),
+			GroupID:      "GROUP1",
+			CommitSHA:    inv.commitSHA,
+		})
+		require.NoError(t, err)
+		for label, linesHit := range inv.coverage {
+			err := te.GetDBHandle().Create(&tables.TargetCoverage{
+				CoverageID:   inv.iid + label,
+				GroupID:      "GROUP1",
+				InvocationID: inv.iid,
+				CommitSHA:    inv.commitSHA,
+				Branch:       inv.branch,
+				Label:        label,
+				LinesFound:   100,
+				LinesHit:     linesHit,
+			}).Error
+			require.NoError(t, err)
+		}
+	}
+
+	rsp, err := s.GetCoverageDelta(ctx, &apipb.GetCoverageDeltaRequest{
+		InvocationId:  "head",
+		BaseCommitSha: "abc",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, float64(70), rsp.Head.LineCoveragePercent)
+	assert.Equal(t, float64(80), rsp.Base.LineCoveragePercent)
+	assert.Equal(t, float64(-10), rsp.LineCoverageDeltaPercent)
+	assert.True(t, rsp.Passed)
+	require.Len(t, rsp.TargetDelta, 3)
+	assert.Equal(t, "//a:test", rsp.TargetDelta[0].Label)
+	assert.Equal(t, float64(10), rsp.TargetDelta[0].LineCoverageDeltaPercent)
+	assert.Equal(t, "//b:test", rsp.TargetDelta[1].Label)
+	assert.Nil(t, rsp.TargetDelta[1].Head)
+	assert.Equal(t, "//c:test", rsp.TargetDelta[2].Label)
+	assert.Nil(t, rsp.TargetDelta[2].Base)
+
+	// Coverage gates.
+	rsp, err = s.GetCoverageDelta(ctx, &apipb.GetCoverageDeltaRequest{
+		InvocationId:             "head",
+		BaselineBranch:           "main",
+		FailOnDecrease:           true,
+		DecreaseTolerancePercent: 10,
+	})
+	require.NoError(t, err)
+	assert.True(t, rsp.Passed)
+	rsp, err = s.GetCoverageDelta(ctx, &apipb.GetCoverageDeltaRequest{
+		InvocationId:   "head",
+		BaselineBranch: "main",
+		FailOnDecrease: true,
+	})
+	require.NoError(t, err)
+	assert.False(t, rsp.Passed)
+	rsp, err = s.GetCoverageDelta(ctx, &apipb.GetCoverageDeltaRequest{
+		InvocationId:           "head",
+		BaselineBranch:         "main",
+		MinLineCoveragePercent: 75,
+	})
+	require.NoError(t, err)
+	assert.False(t, rsp.Passed)
+
+	// Without a base, only the minimum coverage is checked.
+	rsp, err = s.GetCoverageDelta(ctx, &apipb.GetCoverageDeltaRequest{
+		InvocationId:   "head",
+		BaselineBranch: "release",
+		FailOnDecrease: true,
+	})
+	require.NoError(t, err)
+	assert.Nil(t, rsp.Base)
+	assert.True(t, rsp.Passed)
+
+	series, err := s.GetCoverageSeries(ctx, &apipb.GetCoverageSeriesRequest{
+		Selector: &apipb.CoverageSelector{Label: "//a:test"},
+	})
+	require.NoError(t, err)
+	require.Len(t, series.Coverage, 2)
+
+	_, err = s.GetCoverageDelta(ctx, &apipb.GetCoverageDeltaRequest{InvocationId: "head"})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+}
@@ -0,0 +1,221 @@
+package api
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/api_error"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/ptypes"
+
+	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
+	cmnpb "github.com/buildbuddy-io/buildbuddy/proto/api/v1/common"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+const (
+	// The maximum number of invocations of a commit, most recent first, that
+	// a verdict is computed from.
+	maxVerdictInvocations = 20
+
+	// The maximum time that GetBuildVerdict waits for a pending verdict.
+	maxVerdictWait = 5 * time.Minute
+
+	// How often a pending verdict is recomputed while waiting.
+	verdictPollInterval = 5 * time.Second
+)
+
+func (s *APIServer) GetBuildVerdict(ctx context.Context, req *apipb.GetBuildVerdictRequest) (*apipb.GetBuildVerdictResponse, error) {
+	user, err := s.checkPreconditions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.GetCommitSha() == "" {
+		return nil, api_error.MissingFieldError("commit_sha", "GetBuildVerdictRequest must contain a valid commit_sha")
+	}
+	if len(req.GetTargetPattern()) == 0 {
+		return nil, api_error.MissingFieldError("target_pattern", "GetBuildVerdictRequest must contain at least one target_pattern")
+	}
+	for _, p := range req.GetTargetPattern() {
+		if !strings.Contains(p, "//") {
+			return nil, status.InvalidArgumentErrorf("Invalid target pattern %q: expected an absolute label such as \"//foo/...\"", p)
+		}
+	}
+	wait := time.Duration(0)
+	if req.GetWait() != nil {
+		wait, err = ptypes.Duration(req.GetWait())
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("Invalid wait: %s", err)
+		}
+		if wait > maxVerdictWait {
+			wait = maxVerdictWait
+		}
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		rsp, err := s.computeBuildVerdict(ctx, user, req)
+		if err != nil {
+			return nil, err
+		}
+		if rsp.GetVerdict() != apipb.BuildVerdict_BUILD_VERDICT_PENDING || !time.Now().Add(verdictPollInterval).Before(deadline) {
+			return rsp, nil
+		}
+		select {
+		case <-ctx.Done():
+			return rsp, nil
+		case <-time.After(verdictPollInterval):
+		}
+	}
+}
+
+// computeBuildVerdict computes the verdict of each requested target pattern
+// from the most recent invocation of the commit which built or tested any
+// target matching the pattern.
+func (s *APIServer) computeBuildVerdict(ctx context.Context, user interfaces.UserInfo, req *apipb.GetBuildVerdictRequest) (*apipb.GetBuildVerdictResponse, error) {
+	q := query_builder.NewQuery(`SELECT * FROM Invocations`)
+	q.AddWhereClause(`group_id = ?`, user.GetGroupID())
+	q.AddWhereClause(`commit_sha = ?`, req.GetCommitSha())
+	q.AddWhereClause(`deleted_at_usec = 0`)
+	if req.GetRepoUrl() != "" {
+		q.AddWhereClause(`repo_url = ?`, req.GetRepoUrl())
+	}
+	if err := perms.AddPermissionsCheckToQuery(ctx, s.env, q); err != nil {
+		return nil, err
+	}
+	q.SetOrderBy("created_at_usec" /*ascending=*/, false)
+	q.SetLimit(maxVerdictInvocations)
+	queryStr, args := q.Build()
+	var invocations []*tables.Invocation
+	if err := s.env.GetDBHandle().WithContext(ctx).Raw(queryStr, args...).Scan(&invocations).Error; err != nil {
+		return nil, err
+	}
+
+	// Invocations are only read from the blobstore once they're needed, and
+	// at most once per request.
+	targetsByInvocation := make(map[string]map[string]*apipb.Target, len(invocations))
+	invocationTargets := func(iid string) (map[string]*apipb.Target, error) {
+		if targets, ok := targetsByInvocation[iid]; ok {
+			return targets, nil
+		}
+		inv, err := build_event_handler.LookupInvocation(s.env, ctx, iid)
+		if err != nil {
+			return nil, err
+		}
+		targetsByInvocation[iid] = targetMapFromInvocation(inv)
+		return targetsByInvocation[iid], nil
+	}
+
+	rsp := &apipb.GetBuildVerdictResponse{Verdict: apipb.BuildVerdict_BUILD_VERDICT_PASSED}
+	for _, pattern := range req.GetTargetPattern() {
+		pv := &apipb.TargetPatternVerdict{
+			TargetPattern: pattern,
+			Verdict:       apipb.BuildVerdict_BUILD_VERDICT_PENDING,
+		}
+		for _, ti := range invocations {
+			targets, err := invocationTargets(ti.InvocationID)
+			if err != nil {
+				return nil, err
+			}
+			var matched []*apipb.Target
+			for label, target := range targets {
+				if matchesTargetPattern(pattern, label) {
+					matched = append(matched, target)
+				}
+			}
+			if len(matched) == 0 {
+				continue
+			}
+			pv.InvocationId = ti.InvocationID
+			pv.InvocationUrl = s.env.GetConfigurator().GetAppBuildBuddyURL() + "/invocation/" + ti.InvocationID
+			pv.Target = sortedTargets(matched)
+			pv.Verdict = targetsVerdict(matched, ti.InvocationStatus == int64(inpb.Invocation_PARTIAL_INVOCATION_STATUS))
+			break
+		}
+		rsp.TargetPatternVerdict = append(rsp.TargetPatternVerdict, pv)
+
+		switch {
+		case pv.Verdict == apipb.BuildVerdict_BUILD_VERDICT_FAILED:
+			rsp.Verdict = apipb.BuildVerdict_BUILD_VERDICT_FAILED
+		case pv.Verdict == apipb.BuildVerdict_BUILD_VERDICT_PENDING && rsp.Verdict != apipb.BuildVerdict_BUILD_VERDICT_FAILED:
+			rsp.Verdict = apipb.BuildVerdict_BUILD_VERDICT_PENDING
+		}
+	}
+	return rsp, nil
+}
+
+// targetsVerdict returns the verdict of the targets matching a pattern in a
+// single invocation. Failures are reported as soon as they happen, even if the
+// invocation is still in progress.
+func targetsVerdict(targets []*apipb.Target, inProgress bool) apipb.BuildVerdict {
+	pending := false
+	for _, t := range targets {
+		switch t.GetStatus() {
+		case cmnpb.Status_BUILT, cmnpb.Status_PASSED, cmnpb.Status_FLAKY, cmnpb.Status_SKIPPED:
+		case cmnpb.Status_BUILDING, cmnpb.Status_TESTING:
+			// Targets that are still building when the invocation finishes
+			// never completed, e.g. because the build stopped at an earlier
+			// failure.
+			if !inProgress {
+				return apipb.BuildVerdict_BUILD_VERDICT_FAILED
+			}
+			pending = true
+		default:
+			return apipb.BuildVerdict_BUILD_VERDICT_FAILED
+		}
+	}
+	if pending {
+		return apipb.BuildVerdict_BUILD_VERDICT_PENDING
+	}
+	return apipb.BuildVerdict_BUILD_VERDICT_PASSED
+}
+
+func sortedTargets(targets []*apipb.Target) []*apipb.Target {
+	sort.Slice(targets, func(i, j int) bool { return targets[i].GetLabel() < targets[j].GetLabel() })
+	return targets
+}
+
+// canonicalLabel strips the repository prefix that Bazel reports labels in
+// the main repository with, "@//" or "@@//" depending on its version.
+func canonicalLabel(label string) string {
+	for _, p := range []string{"@@//", "@//"} {
+		if strings.HasPrefix(label, p) {
+			return "//" + strings.TrimPrefix(label, p)
+		}
+	}
+	return label
+}
+
+// splitLabel splits a label into its package, including any repository, and
+// its target name. "//foo" is shorthand for "//foo:foo".
+func splitLabel(label string) (pkg, name string) {
+	label = canonicalLabel(label)
+	if i := strings.LastIndex(label, ":"); i >= 0 {
+		return label[:i], label[i+1:]
+	}
+	return label, label[strings.LastIndex(label, "/")+1:]
+}
+
+// matchesTargetPattern returns whether the label matches a Bazel target
+// pattern: a single label, all targets in a package ("//foo:all" or
+// "//foo:*"), or all targets beneath a package ("//foo/...").
+func matchesTargetPattern(pattern, label string) bool {
+	labelPkg, labelName := splitLabel(label)
+	if strings.HasSuffix(pattern, "...") {
+		prefix := canonicalLabel(strings.TrimSuffix(pattern, "..."))
+		return strings.HasPrefix(labelPkg+"/", prefix)
+	}
+	pkg, name := splitLabel(pattern)
+	if pkg != labelPkg {
+		return false
+	}
+	return name == "all" || name == "*" || name == "all-targets" || name == labelName
+}
@@ -0,0 +1,138 @@
+package api_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/api"
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/protofile"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+type testTarget struct {
+	label string
+	// Whether the target finished building, and if so whether it succeeded.
+	completed bool
+	success   bool
+}
+
+func writeInvocation(t *testing.T, ctx context.Context, te *testenv.TestEnv, iid string, createdAtUsec int64, invocationStatus inpb.Invocation_InvocationStatus, targets []testTarget) {
+	err := te.GetInvocationDB().InsertOrUpdateInvocation(ctx, &tables.Invocation{
+		InvocationID:     iid,
+		InvocationPK:     createdAtUsec,
+		GroupID:          "GROUP1",
+		Perms:            perms.GROUP_READ,
+		CommitSHA:        "abc123",
+		InvocationStatus: int64(invocationStatus),
+		Model:            tables.Model{CreatedAtUsec: createdAtUsec},
+	})
+	require.NoError(t, err)
+
+	w := protofile.NewBufferedProtoWriter(te.GetBlobstore(), iid, 1024)
+	for _, target := range targets {
+		err := w.WriteProtoToStream(ctx, &inpb.InvocationEvent{BuildEvent: &build_event_stream.BuildEvent{
+			Id: &build_event_stream.BuildEventId{Id: &build_event_stream.BuildEventId_TargetConfigured{
+				TargetConfigured: &build_event_stream.BuildEventId_TargetConfiguredId{Label: target.label},
+			}},
+			Payload: &build_event_stream.BuildEvent_Configured{Configured: &build_event_stream.TargetConfigured{TargetKind: "go_test rule"}},
+		}})
+		require.NoError(t, err)
+		if !target.completed {
+			continue
+		}
+		err = w.WriteProtoToStream(ctx, &inpb.InvocationEvent{BuildEvent: &build_event_stream.BuildEvent{
+			Id: &build_event_stream.BuildEventId{Id: &build_event_stream.BuildEventId_TargetCompleted{
+				TargetCompleted: &build_event_stream.BuildEventId_TargetCompletedId{Label: target.label},
+			}},
+			Payload: &build_event_stream.BuildEvent_Completed{Completed: &build_event_stream.TargetComplete{Success: target.success}},
+		}})
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Flush(ctx))
+}
+
+func TestGetBuildVerdict(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	users := testauth.TestUsers("USER1", "GROUP1")
+	te.SetAuthenticator(testauth.NewTestAuthenticator(users))
+	ctx := testauth.WithAuthenticatedUserInfo(context.Background(), users["USER1"])
+	s := api.NewAPIServer(te)
+
+	// An older invocation in which //server:server_test failed, which was
+	// retried by a newer one.
+	writeInvocation(t, ctx, te, "inv1", 1, inpb.Invocation_COMPLETE_INVOCATION_STATUS, []testTarget{
+		{label: "//server:server_test", completed: true, success: false},
+		{label: "//server/util:util_test", completed: true, success: true},
+		{label: "//app:app", completed: true, success: false},
+	})
+	writeInvocation(t, ctx, te, "inv2", 2, inpb.Invocation_COMPLETE_INVOCATION_STATUS, []testTarget{
+		{label: "@//server:server_test", completed: true, success: true},
+	})
+	writeInvocation(t, ctx, te, "inv3", 3, inpb.Invocation_PARTIAL_INVOCATION_STATUS, []testTarget{
+		{label: "//docs:docs"},
+	})
+
+	rsp, err := s.GetBuildVerdict(ctx, &apipb.GetBuildVerdictRequest{
+		CommitSha:     "abc123",
+		TargetPattern: []string{"//server/...", "//server/util:all"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, apipb.BuildVerdict_BUILD_VERDICT_PASSED, rsp.GetVerdict())
+	require.Len(t, rsp.GetTargetPatternVerdict(), 2)
+	assert.Equal(t, "inv2", rsp.GetTargetPatternVerdict()[0].GetInvocationId())
+	assert.Equal(t, "inv1", rsp.GetTargetPatternVerdict()[1].GetInvocationId())
+	assert.Contains(t, rsp.GetTargetPatternVerdict()[0].GetInvocationUrl(), "/invocation/inv2")
+	require.Len(t, rsp.GetTargetPatternVerdict()[1].GetTarget(), 1)
+	assert.Equal(t, "//server/util:util_test", rsp.GetTargetPatternVerdict()[1].GetTarget()[0].GetLabel())
+
+	// A failed target makes the whole verdict fail, even if other patterns
+	// are still pending.
+	rsp, err = s.GetBuildVerdict(ctx, &apipb.GetBuildVerdictRequest{
+		CommitSha:     "abc123",
+		TargetPattern: []string{"//docs", "//app:app", "//missing/..."},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, apipb.BuildVerdict_BUILD_VERDICT_FAILED, rsp.GetVerdict())
+	assert.Equal(t, apipb.BuildVerdict_BUILD_VERDICT_PENDING, rsp.GetTargetPatternVerdict()[0].GetVerdict())
+	assert.Equal(t, apipb.BuildVerdict_BUILD_VERDICT_FAILED, rsp.GetTargetPatternVerdict()[1].GetVerdict())
+	assert.Equal(t, apipb.BuildVerdict_BUILD_VERDICT_PENDING, rsp.GetTargetPatternVerdict()[2].GetVerdict())
+	assert.Empty(t, rsp.GetTargetPatternVerdict()[2].GetInvocationId())
+
+	// Pending verdicts are returned without waiting if no wait is requested.
+	start := time.Now()
+	rsp, err = s.GetBuildVerdict(ctx, &apipb.GetBuildVerdictRequest{
+		CommitSha:     "abc123",
+		TargetPattern: []string{"//docs:all"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, apipb.BuildVerdict_BUILD_VERDICT_PENDING, rsp.GetVerdict())
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestGetBuildVerdictInvalidRequest(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	users := testauth.TestUsers("USER1", "GROUP1")
+	te.SetAuthenticator(testauth.NewTestAuthenticator(users))
+	ctx := testauth.WithAuthenticatedUserInfo(context.Background(), users["USER1"])
+	s := api.NewAPIServer(te)
+
+	for _, req := range []*apipb.GetBuildVerdictRequest{
+		{TargetPattern: []string{"//..."}},
+		{CommitSha: "abc123"},
+		{CommitSha: "abc123", TargetPattern: []string{"server/..."}},
+	} {
+		_, err := s.GetBuildVerdict(ctx, req)
+		assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument for %+v, got %v", req, err)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/util/capabilities"
 	"github.com/buildbuddy-io/buildbuddy/server/util/db"
@@ -22,6 +23,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
 	"github.com/dgrijalva/jwt-go"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/oauth2"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
@@ -30,6 +32,7 @@ import (
 	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
 	oidc "github.com/coreos/go-oidc"
 	requestcontext "github.com/buildbuddy-io/buildbuddy/server/util/request_context"
+	gstatus "google.golang.org/grpc/status"
 )
 
 const (
@@ -180,6 +183,7 @@ func setLoginCookie(w http.ResponseWriter, jwt, issuer string) {
 func clearLoginCookie(w http.ResponseWriter) {
 	clearCookie(w, jwtCookie)
 	clearCookie(w, authIssuerCookie)
+	clearCookie(w, sessionCookie)
 }
 
 type userToken struct {
@@ -204,14 +208,39 @@ func (t *userToken) GetSubID() string {
 	return t.issuer + "/" + t.Sub
 }
 
+// authenticator is an identity provider that users can log in with. Each
+// authenticator also implements either oauthAuthenticator or
+// passwordAuthenticator, depending on how users log in with it.
 type authenticator interface {
 	getIssuer() string
-	authCodeURL(state string, opts ...oauth2.AuthCodeOption) string
-	exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error)
 	verifyTokenAndExtractUser(ctx context.Context, jwt string, checkExpiry bool) (*userToken, error)
 	renewToken(ctx context.Context, refreshToken string) (*oauth2.Token, error)
 }
 
+// oauthAuthenticator is an authenticator that users log in with by being
+// redirected to it, and which redirects them back to the /auth callback.
+type oauthAuthenticator interface {
+	authenticator
+	authCodeURL(state string, opts ...oauth2.AuthCodeOption) string
+	exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error)
+}
+
+// passwordLogin is the result of a successful password login.
+type passwordLogin struct {
+	jwt  string
+	user *userToken
+	// Whether the user should be a member of each group whose members are
+	// managed by the authenticator, keyed by group ID.
+	groupMemberships map[string]bool
+}
+
+// passwordAuthenticator is an authenticator that users log in with by
+// entering their username and password on the BuildBuddy login page.
+type passwordAuthenticator interface {
+	authenticator
+	login(ctx context.Context, username, password string) (*passwordLogin, error)
+}
+
 type oidcAuthenticator struct {
 	oauth2Config *oauth2.Config
 	oidcConfig   *oidc.Config
@@ -270,7 +299,9 @@ type apiKeyGroupCache struct {
 	// time to force a refresh of the underlying data.
 	lru *lru.LRU
 	ttl time.Duration
-	mu  sync.RWMutex
+	// Getting entries from the LRU updates their recency, so reads lock
+	// exclusively too.
+	mu sync.Mutex
 }
 
 func newAPIKeyGroupCache(configurator *config.Configurator) (*apiKeyGroupCache, error) {
@@ -295,9 +326,21 @@ func newAPIKeyGroupCache(configurator *config.Configurator) (*apiKeyGroupCache,
 }
 
 func (c *apiKeyGroupCache) Get(apiKey string) (akg interfaces.APIKeyGroup, ok bool) {
-	c.mu.RLock()
+	akg, ok = c.get(apiKey)
+	eventType := "miss"
+	if ok {
+		eventType = "hit"
+	}
+	metrics.AuthAPIKeyCacheLookupCount.With(prometheus.Labels{
+		metrics.CacheEventTypeLabel: eventType,
+	}).Inc()
+	return akg, ok
+}
+
+func (c *apiKeyGroupCache) get(apiKey string) (interfaces.APIKeyGroup, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	v, ok := c.lru.Get(apiKey)
-	c.mu.RUnlock()
 	if !ok {
 		return nil, ok
 	}
@@ -308,11 +351,20 @@ func (c *apiKeyGroupCache) Get(apiKey string) (akg interfaces.APIKeyGroup, ok bo
 		return nil, false
 	}
 	if time.Now().After(entry.expiresAfter) {
+		c.lru.Remove(apiKey)
 		return nil, false
 	}
 	return entry.data, true
 }
 
+// Remove drops the cached group of the API key, so that the next lookup
+// reads it from the database.
+func (c *apiKeyGroupCache) Remove(apiKey string) {
+	c.mu.Lock()
+	c.lru.Remove(apiKey)
+	c.mu.Unlock()
+}
+
 func (c *apiKeyGroupCache) Add(apiKey string, apiKeyGroup interfaces.APIKeyGroup) {
 	c.mu.Lock()
 	c.lru.Add(apiKey, &apiKeyGroupCacheEntry{data: apiKeyGroup, expiresAfter: time.Now().Add(c.ttl)})
@@ -324,6 +376,8 @@ type OpenIDAuthenticator struct {
 	myURL            *url.URL
 	apiKeyGroupCache *apiKeyGroupCache
 	authenticators   []authenticator
+	denylist         tokenDenylist
+	lastUse          *lastUseTracker
 }
 
 func createAuthenticatorsFromConfig(ctx context.Context, authConfigs []config.OauthProvider, authURL *url.URL) ([]authenticator, error) {
@@ -356,7 +410,7 @@ func createAuthenticatorsFromConfig(ctx context.Context, authConfigs []config.Oa
 	return authenticators, nil
 }
 
-func newOpenIDAuthenticator(ctx context.Context, env environment.Env, oauthProviders []config.OauthProvider) (*OpenIDAuthenticator, error) {
+func newOpenIDAuthenticator(ctx context.Context, env environment.Env, oauthProviders []config.OauthProvider, ldapProviders []config.LDAPProvider) (*OpenIDAuthenticator, error) {
 	oia := &OpenIDAuthenticator{
 		env: env,
 	}
@@ -370,10 +424,21 @@ func newOpenIDAuthenticator(ctx context.Context, env environment.Env, oauthProvi
 		return nil, err
 	}
 	oia.myURL = myURL
+	oia.lastUse, err = newLastUseTracker()
+	if err != nil {
+		return nil, err
+	}
 	oia.authenticators, err = createAuthenticatorsFromConfig(ctx, oauthProviders, authURL)
 	if err != nil {
 		return nil, err
 	}
+	for _, ldapProvider := range ldapProviders {
+		ldapAuthenticator, err := newLDAPAuthenticator(ldapProvider)
+		if err != nil {
+			return nil, err
+		}
+		oia.authenticators = append(oia.authenticators, ldapAuthenticator)
+	}
 
 	// Set the JWT key.
 	jwtKey = []byte(env.GetConfigurator().GetAuthJWTKey())
@@ -390,7 +455,7 @@ func newOpenIDAuthenticator(ctx context.Context, env environment.Env, oauthProvi
 }
 
 func newForTesting(ctx context.Context, env environment.Env, testAuthenticator authenticator) (*OpenIDAuthenticator, error) {
-	oia, err := newOpenIDAuthenticator(ctx, env, nil /*oauthProviders=*/)
+	oia, err := newOpenIDAuthenticator(ctx, env, nil /*oauthProviders=*/, nil /*ldapProviders=*/)
 	if err != nil {
 		return nil, err
 	}
@@ -400,11 +465,12 @@ func newForTesting(ctx context.Context, env environment.Env, testAuthenticator a
 
 func NewOpenIDAuthenticator(ctx context.Context, env environment.Env) (*OpenIDAuthenticator, error) {
 	authConfigs := env.GetConfigurator().GetAuthOauthProviders()
-	if len(authConfigs) == 0 {
+	ldapConfigs := env.GetConfigurator().GetAuthLDAPProviders()
+	if len(authConfigs) == 0 && len(ldapConfigs) == 0 {
 		return nil, status.FailedPreconditionErrorf("No auth providers specified in config!")
 	}
 
-	return newOpenIDAuthenticator(ctx, env, authConfigs)
+	return newOpenIDAuthenticator(ctx, env, authConfigs, ldapConfigs)
 }
 
 func sameHostname(urlStringA, urlStringB string) bool {
@@ -477,7 +543,11 @@ func (a *OpenIDAuthenticator) lookupAPIKeyGroupFromAPIKey(ctx context.Context, a
 	if authDB == nil {
 		return nil, status.FailedPreconditionError("AuthDB not configured")
 	}
+	start := time.Now()
 	apkg, err := authDB.GetAPIKeyGroupFromAPIKey(ctx, apiKey)
+	metrics.AuthAPIKeyLookupDurationUsec.With(prometheus.Labels{
+		metrics.StatusLabel: fmt.Sprintf("%d", gstatus.Code(err)),
+	}).Observe(float64(time.Since(start).Microseconds()))
 	if err == nil && a.apiKeyGroupCache != nil {
 		a.apiKeyGroupCache.Add(apiKey, apkg)
 	}
@@ -538,11 +608,27 @@ func (a *OpenIDAuthenticator) AuthContextFromAPIKey(ctx context.Context, apiKey
 	return authContextFromClaims(ctx, claims, err)
 }
 
+// InvalidateAPIKey drops the cached group and capabilities of the API key, so
+// that changes to it take effect on this server immediately. Other servers pick
+// up changes once their cache entries expire, or revocations once they reload
+// the token denylist.
+func (a *OpenIDAuthenticator) InvalidateAPIKey(apiKey string) {
+	if a.apiKeyGroupCache != nil {
+		a.apiKeyGroupCache.Remove(apiKey)
+	}
+}
+
 func (a *OpenIDAuthenticator) claimsFromAPIKey(ctx context.Context, apiKey string) (*Claims, error) {
+	// Deleted API keys are denylisted, since they may still be cached.
+	if a.isRevoked(apiKey) {
+		a.InvalidateAPIKey(apiKey)
+		return nil, status.UnauthenticatedErrorf("Invalid API key %s", apiKey)
+	}
 	akg, err := a.lookupAPIKeyGroupFromAPIKey(ctx, apiKey)
 	if err != nil {
 		return nil, err
 	}
+	a.recordAPIKeyUse(ctx, apiKey)
 	return groupClaims(akg), nil
 }
 
@@ -670,6 +756,9 @@ func (a *OpenIDAuthenticator) authenticateUser(w http.ResponseWriter, r *http.Re
 	if jwt == "" {
 		return nil, nil, status.PermissionDeniedErrorf("No jwt set")
 	}
+	if a.isRevoked(jwt) || a.isRevoked(getCookie(r, sessionCookie)) {
+		return nil, nil, status.PermissionDeniedError("Session was revoked")
+	}
 	issuer := getCookie(r, authIssuerCookie)
 	auth := a.getAuthConfig(issuer)
 	if auth == nil {
@@ -686,6 +775,9 @@ func (a *OpenIDAuthenticator) authenticateUser(w http.ResponseWriter, r *http.Re
 	// the token below.
 	if ut, err := auth.verifyTokenAndExtractUser(ctx, jwt /*checkExpiry=*/, true); err == nil {
 		claims, err := a.claimsFromSubID(ctx, ut.GetSubID())
+		if err == nil {
+			a.recordSessionUse(ctx, r, jwt)
+		}
 		return claims, ut, err
 	}
 
@@ -705,6 +797,9 @@ func (a *OpenIDAuthenticator) authenticateUser(w http.ResponseWriter, r *http.Re
 		if jwt, ok := newToken.Extra("id_token").(string); ok {
 			setLoginCookie(w, jwt, issuer)
 			claims, err := a.claimsFromSubID(ctx, ut.GetSubID())
+			if err == nil {
+				a.recordSessionUse(ctx, r, jwt)
+			}
 			return claims, ut, err
 		}
 	}
@@ -742,7 +837,10 @@ func (a *OpenIDAuthenticator) FillUser(ctx context.Context, user *tables.User) e
 	if !ok {
 		return status.FailedPreconditionErrorf("No user token available to fill user")
 	}
+	return fillUserFromToken(user, t)
+}
 
+func fillUserFromToken(user *tables.User, t *userToken) error {
 	pk, err := tables.PrimaryKeyForTable("Users")
 	if err != nil {
 		return err
@@ -757,9 +855,15 @@ func (a *OpenIDAuthenticator) FillUser(ctx context.Context, user *tables.User) e
 }
 
 func (a *OpenIDAuthenticator) Login(w http.ResponseWriter, r *http.Request) {
-	issuer := r.URL.Query().Get(authIssuerParam)
-	auth := a.getAuthConfig(issuer)
-	if auth == nil {
+	issuer := r.FormValue(authIssuerParam)
+	var auth oauthAuthenticator
+	switch authenticator := a.getAuthConfig(issuer).(type) {
+	case oauthAuthenticator:
+		auth = authenticator
+	case passwordAuthenticator:
+		a.passwordLogin(w, r, authenticator)
+		return
+	default:
 		err := status.PermissionDeniedErrorf("No config found for issuer: %s", issuer)
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
@@ -820,8 +924,8 @@ func (a *OpenIDAuthenticator) Auth(w http.ResponseWriter, r *http.Request) {
 
 	// Lookup issuer from the cookie we set in /login.
 	issuer := getCookie(r, authIssuerCookie)
-	auth := a.getAuthConfig(issuer)
-	if auth == nil {
+	auth, ok := a.getAuthConfig(issuer).(oauthAuthenticator)
+	if !ok {
 		err := status.PermissionDeniedErrorf("No config found for issuer: %s", issuer)
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
@@ -852,6 +956,7 @@ func (a *OpenIDAuthenticator) Auth(w http.ResponseWriter, r *http.Request) {
 	// OK, the token is valid so we will: store the refresh token in our DB
 	// for later & set the login cookie so we know this user is logged in.
 	setLoginCookie(w, jwt, issuer)
+	a.startSession(ctx, w, r, ut.GetSubID(), jwt)
 
 	refreshToken, ok := oauth2Token.Extra("refresh_token").(string)
 	if ok {
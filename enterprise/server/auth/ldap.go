@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/ldap"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultLDAPUsernameAttribute = "uid"
+	defaultLDAPEmailAttribute    = "mail"
+	defaultLDAPGroupAttribute    = "memberOf"
+
+	// How long an LDAP login lasts. Group memberships are only synced from
+	// the directory when users log in, and LDAP has no refresh tokens, so
+	// users log in again once a day.
+	ldapLoginDuration = 24 * time.Hour
+)
+
+// ldapClaims are the claims of the JWTs that BuildBuddy issues to users who
+// log in with LDAP, since LDAP itself doesn't issue tokens.
+type ldapClaims struct {
+	jwt.StandardClaims
+	User *userToken `json:"user"`
+}
+
+// ldapAuthenticator logs users in by binding to an LDAP server, such as
+// OpenLDAP or Active Directory, as them.
+type ldapAuthenticator struct {
+	config     config.LDAPProvider
+	tlsConfig  *tls.Config
+	userFilter *ldap.Filter
+	// The IDs of the groups whose members are managed by LDAP, keyed by the
+	// lowercased DN of the LDAP group they're mapped from.
+	groupIDs map[string]string
+}
+
+func newLDAPAuthenticator(c config.LDAPProvider) (*ldapAuthenticator, error) {
+	if c.URL == "" || c.BaseDN == "" {
+		return nil, status.InvalidArgumentError("LDAP providers require a url and a base_dn")
+	}
+	if c.UsernameAttribute == "" {
+		c.UsernameAttribute = defaultLDAPUsernameAttribute
+	}
+	if c.EmailAttribute == "" {
+		c.EmailAttribute = defaultLDAPEmailAttribute
+	}
+	if c.GroupAttribute == "" {
+		c.GroupAttribute = defaultLDAPGroupAttribute
+	}
+	tlsConfig, err := ldapTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	a := &ldapAuthenticator{config: c, tlsConfig: tlsConfig, groupIDs: make(map[string]string, len(c.GroupMappings))}
+	if c.UserFilter != "" {
+		f, err := ldap.ParseFilter(c.UserFilter)
+		if err != nil {
+			return nil, err
+		}
+		a.userFilter = &f
+	}
+	for _, m := range c.GroupMappings {
+		if m.LDAPGroup == "" || m.GroupID == "" {
+			return nil, status.InvalidArgumentError("LDAP group mappings require an ldap_group and a group_id")
+		}
+		a.groupIDs[strings.ToLower(m.LDAPGroup)] = m.GroupID
+	}
+	return a, nil
+}
+
+// ldapTLSConfig returns the config that connections to the provider's server
+// are secured with, which verifies the server's certificate for the host in
+// its URL.
+func ldapTLSConfig(c config.LDAPProvider) (*tls.Config, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid LDAP URL %q: %s", c.URL, err)
+	}
+	switch {
+	case u.Scheme == "ldaps" && c.StartTLS:
+		return nil, status.InvalidArgumentErrorf("LDAP provider %q uses TLS already, so start_tls must not be set", c.URL)
+	case u.Scheme == "ldap" && !c.StartTLS:
+		log.Warningf("LDAP provider %q doesn't use TLS, so passwords are sent to it in plain text. Use an ldaps:// URL or set start_tls.", c.URL)
+	}
+	tlsConfig := &tls.Config{
+		ServerName: u.Hostname(),
+		MinVersion: tls.VersionTLS12,
+	}
+	if c.CACertFile != "" {
+		pem, err := ioutil.ReadFile(c.CACertFile)
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("could not read LDAP CA cert file %q: %s", c.CACertFile, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, status.InvalidArgumentErrorf("LDAP CA cert file %q contains no certificates", c.CACertFile)
+		}
+	}
+	return tlsConfig, nil
+}
+
+func (a *ldapAuthenticator) getIssuer() string {
+	return a.config.URL
+}
+
+// findUser returns the directory entry of the user with the given username.
+func (a *ldapAuthenticator) findUser(ctx context.Context, conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	if err := conn.Bind(ctx, a.config.BindDN, a.config.BindPassword); err != nil {
+		return nil, status.UnavailableErrorf("could not bind to LDAP server as %q: %s", a.config.BindDN, err)
+	}
+	// The username is matched with its own filter, rather than formatted into
+	// the configured one, so that it can't change the filter's meaning.
+	filter := ldap.Equal(a.config.UsernameAttribute, username)
+	if a.userFilter != nil {
+		filter = ldap.And(*a.userFilter, filter)
+	}
+	entries, err := conn.Search(ctx, &ldap.SearchRequest{
+		BaseDN: a.config.BaseDN,
+		Filter: filter,
+		Attributes: []string{
+			a.config.UsernameAttribute,
+			a.config.EmailAttribute,
+			a.config.GroupAttribute,
+			"cn",
+			"givenName",
+			"sn",
+		},
+		SizeLimit: 2,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > 1 {
+		log.Warningf("Multiple LDAP entries matched username %q, refusing to log in", username)
+	}
+	if len(entries) != 1 {
+		return nil, status.UnauthenticatedError("Invalid username or password")
+	}
+	return entries[0], nil
+}
+
+func (a *ldapAuthenticator) login(ctx context.Context, username, password string) (*passwordLogin, error) {
+	username = strings.TrimSpace(username)
+	if username == "" || password == "" {
+		return nil, status.UnauthenticatedError("Invalid username or password")
+	}
+	conn, err := ldap.Dial(ctx, a.config.URL, a.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if a.config.StartTLS {
+		if err := conn.StartTLS(ctx, a.tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	entry, err := a.findUser(ctx, conn, username)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Bind(ctx, entry.DN, password); err != nil {
+		if status.IsUnauthenticatedError(err) {
+			return nil, status.UnauthenticatedError("Invalid username or password")
+		}
+		return nil, err
+	}
+
+	// Directories usually match usernames case-insensitively, so the
+	// directory's spelling is used to identify the user.
+	sub := entry.GetAttributeValue(a.config.UsernameAttribute)
+	if sub == "" {
+		sub = username
+	}
+	ut := &userToken{
+		issuer:     a.config.URL,
+		Sub:        sub,
+		Email:      entry.GetAttributeValue(a.config.EmailAttribute),
+		Name:       entry.GetAttributeValue("cn"),
+		GivenName:  entry.GetAttributeValue("givenName"),
+		FamilyName: entry.GetAttributeValue("sn"),
+	}
+
+	groupMemberships := make(map[string]bool, len(a.groupIDs))
+	for _, groupID := range a.groupIDs {
+		groupMemberships[groupID] = false
+	}
+	for _, dn := range entry.GetAttributeValues(a.config.GroupAttribute) {
+		if groupID, ok := a.groupIDs[strings.ToLower(dn)]; ok {
+			groupMemberships[groupID] = true
+		}
+	}
+
+	tokenString, err := a.newToken(ut, time.Now().Add(ldapLoginDuration))
+	if err != nil {
+		return nil, err
+	}
+	return &passwordLogin{jwt: tokenString, user: ut, groupMemberships: groupMemberships}, nil
+}
+
+func (a *ldapAuthenticator) newToken(ut *userToken, expiry time.Time) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &ldapClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    a.config.URL,
+			Subject:   ut.Sub,
+			ExpiresAt: expiry.Unix(),
+		},
+		User: ut,
+	})
+	return token.SignedString(jwtKey)
+}
+
+func (a *ldapAuthenticator) verifyTokenAndExtractUser(ctx context.Context, tokenString string, checkExpiry bool) (*userToken, error) {
+	claims := &ldapClaims{}
+	parser := &jwt.Parser{
+		ValidMethods: []string{jwt.SigningMethodHS256.Alg()},
+		// Expiry is checked below, if requested.
+		SkipClaimsValidation: true,
+	}
+	if _, err := parser.ParseWithClaims(tokenString, claims, jwtKeyFunc); err != nil {
+		return nil, status.PermissionDeniedErrorf("invalid LDAP login token: %s", err)
+	}
+	if claims.Issuer != a.config.URL || claims.User == nil {
+		return nil, status.PermissionDeniedError("LDAP login token was not issued by this provider")
+	}
+	if checkExpiry {
+		if err := claims.Valid(); err != nil {
+			return nil, status.PermissionDeniedErrorf("invalid LDAP login token: %s", err)
+		}
+	}
+	claims.User.issuer = a.config.URL
+	return claims.User, nil
+}
+
+func (a *ldapAuthenticator) renewToken(ctx context.Context, refreshToken string) (*oauth2.Token, error) {
+	return nil, status.UnauthenticatedError("LDAP logins can't be renewed, log in again")
+}
@@ -0,0 +1,226 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	grpb "github.com/buildbuddy-io/buildbuddy/proto/group"
+)
+
+const (
+	passwordIssuer   = "ldaps://ldap.test"
+	passwordUsername = "fluffy"
+	password         = "hunter2"
+	managedGroupA    = "GR1"
+	managedGroupB    = "GR2"
+)
+
+type fakePasswordAuthenticator struct {
+	groupMemberships map[string]bool
+}
+
+func (f *fakePasswordAuthenticator) getIssuer() string {
+	return passwordIssuer
+}
+
+func (f *fakePasswordAuthenticator) login(ctx context.Context, username, pass string) (*passwordLogin, error) {
+	if username != passwordUsername || pass != password {
+		return nil, status.UnauthenticatedError("Invalid username or password")
+	}
+	return &passwordLogin{
+		jwt:              validJWT,
+		user:             &userToken{issuer: passwordIssuer, Sub: passwordUsername, Email: userEmail},
+		groupMemberships: f.groupMemberships,
+	}, nil
+}
+
+func (f *fakePasswordAuthenticator) verifyTokenAndExtractUser(ctx context.Context, jwt string, checkExpiry bool) (*userToken, error) {
+	return nil, status.UnimplementedError("not implemented")
+}
+
+func (f *fakePasswordAuthenticator) renewToken(ctx context.Context, refreshToken string) (*oauth2.Token, error) {
+	return nil, status.UnimplementedError("not implemented")
+}
+
+func submitLoginForm(auth *OpenIDAuthenticator, state, username, pass string) *http.Response {
+	form := url.Values{
+		authIssuerParam: {passwordIssuer},
+		"state":         {state},
+		"username":      {username},
+		"password":      {pass},
+	}
+	request := httptest.NewRequest(http.MethodPost, "/login/", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.AddCookie(&http.Cookie{Name: stateCookie, Value: state})
+	response := httptest.NewRecorder()
+	auth.Login(response, request)
+	return response.Result()
+}
+
+func groupMembershipStatuses(t *testing.T, auth *OpenIDAuthenticator, subID string) map[string]int32 {
+	user := &tables.User{}
+	require.NoError(t, auth.env.GetDBHandle().Where("sub_id = ?", subID).Take(user).Error)
+	var memberships []*tables.UserGroup
+	require.NoError(t, auth.env.GetDBHandle().Where("user_user_id = ?", user.UserID).Find(&memberships).Error)
+	statuses := make(map[string]int32, len(memberships))
+	for _, m := range memberships {
+		statuses[m.GroupGroupID] = m.MembershipStatus
+	}
+	return statuses
+}
+
+func TestPasswordLogin(t *testing.T) {
+	ctx := context.Background()
+	env := enterprise_testenv.GetCustomTestEnv(t, &enterprise_testenv.Options{})
+	passwordAuth := &fakePasswordAuthenticator{
+		groupMemberships: map[string]bool{managedGroupA: true, managedGroupB: false},
+	}
+	auth, err := newForTesting(ctx, env, passwordAuth)
+	require.NoError(t, err)
+
+	// The login page sets the state cookie that the form is submitted with.
+	request := httptest.NewRequest(http.MethodGet, "/login/?issuer_url="+url.QueryEscape(passwordIssuer)+"&redirect_url="+url.QueryEscape("http://localhost:8080/invocation/"), nil)
+	response := httptest.NewRecorder()
+	auth.Login(response, request)
+	require.Equal(t, http.StatusOK, response.Code)
+	stateCookie := getResponseCookie(response.Result(), stateCookie)
+	require.NotNil(t, stateCookie)
+	require.Contains(t, response.Body.String(), stateCookie.Value)
+
+	// A form submitted without the state cookie is rejected.
+	rsp := submitLoginForm(auth, "", passwordUsername, password)
+	assert.Nil(t, getResponseCookie(rsp, jwtCookie))
+
+	rsp = submitLoginForm(auth, stateCookie.Value, passwordUsername, "wrong")
+	assert.Equal(t, http.StatusUnauthorized, rsp.StatusCode)
+	assert.Nil(t, getResponseCookie(rsp, jwtCookie))
+
+	// Logging in creates the user and adds them to their managed groups.
+	rsp = submitLoginForm(auth, stateCookie.Value, passwordUsername, password)
+	require.Equal(t, http.StatusSeeOther, rsp.StatusCode)
+	jwt := getResponseCookie(rsp, jwtCookie)
+	require.NotNil(t, jwt)
+	assert.Equal(t, validJWT, jwt.Value)
+	assert.Equal(t, passwordIssuer, getResponseCookie(rsp, authIssuerCookie).Value)
+	subID := passwordIssuer + "/" + passwordUsername
+	statuses := groupMembershipStatuses(t, auth, subID)
+	assert.Equal(t, int32(grpb.GroupMembershipStatus_MEMBER), statuses[managedGroupA])
+	assert.NotContains(t, statuses, managedGroupB)
+
+	// Memberships follow the directory on the next login.
+	passwordAuth.groupMemberships = map[string]bool{managedGroupA: false, managedGroupB: true}
+	rsp = submitLoginForm(auth, stateCookie.Value, passwordUsername, password)
+	require.Equal(t, http.StatusSeeOther, rsp.StatusCode)
+	statuses = groupMembershipStatuses(t, auth, subID)
+	assert.NotContains(t, statuses, managedGroupA)
+	assert.Equal(t, int32(grpb.GroupMembershipStatus_MEMBER), statuses[managedGroupB])
+}
+
+func TestLDAPToken(t *testing.T) {
+	ctx := context.Background()
+	a, err := newLDAPAuthenticator(config.LDAPProvider{URL: passwordIssuer, BaseDN: "dc=test"})
+	require.NoError(t, err)
+	ut := &userToken{Sub: passwordUsername, Email: userEmail, GivenName: userName}
+
+	token, err := a.newToken(ut, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	got, err := a.verifyTokenAndExtractUser(ctx, token, true /*=checkExpiry*/)
+	require.NoError(t, err)
+	assert.Equal(t, passwordIssuer+"/"+passwordUsername, got.GetSubID())
+	assert.Equal(t, userEmail, got.Email)
+	assert.Equal(t, userName, got.GivenName)
+
+	expired, err := a.newToken(ut, time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	_, err = a.verifyTokenAndExtractUser(ctx, expired, true /*=checkExpiry*/)
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+	_, err = a.verifyTokenAndExtractUser(ctx, expired, false /*=checkExpiry*/)
+	assert.NoError(t, err)
+
+	// Tokens issued by another provider aren't accepted.
+	other, err := newLDAPAuthenticator(config.LDAPProvider{URL: "ldaps://other.test", BaseDN: "dc=test"})
+	require.NoError(t, err)
+	otherToken, err := other.newToken(ut, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	_, err = a.verifyTokenAndExtractUser(ctx, otherToken, true /*=checkExpiry*/)
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+}
+
+func TestNewLDAPAuthenticatorValidatesConfig(t *testing.T) {
+	_, err := newLDAPAuthenticator(config.LDAPProvider{URL: passwordIssuer})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+
+	_, err = newLDAPAuthenticator(config.LDAPProvider{URL: passwordIssuer, BaseDN: "dc=test", UserFilter: "(cn=a*)"})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+
+	_, err = newLDAPAuthenticator(config.LDAPProvider{
+		URL:           passwordIssuer,
+		BaseDN:        "dc=test",
+		GroupMappings: []config.LDAPGroupMapping{{LDAPGroup: "cn=eng,dc=test"}},
+	})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+
+	_, err = newLDAPAuthenticator(config.LDAPProvider{URL: passwordIssuer, BaseDN: "dc=test", StartTLS: true})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+
+	_, err = newLDAPAuthenticator(config.LDAPProvider{URL: passwordIssuer, BaseDN: "dc=test", CACertFile: filepath.Join(t.TempDir(), "missing.pem")})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, ioutil.WriteFile(notPEM, []byte("not a certificate"), 0644))
+	_, err = newLDAPAuthenticator(config.LDAPProvider{URL: passwordIssuer, BaseDN: "dc=test", CACertFile: notPEM})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+}
+
+func TestLDAPTLSConfig(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+
+	a, err := newLDAPAuthenticator(config.LDAPProvider{URL: "ldap://ldap.test:1389", BaseDN: "dc=test", StartTLS: true, CACertFile: caFile})
+	require.NoError(t, err)
+	assert.Equal(t, "ldap.test", a.tlsConfig.ServerName)
+	assert.Equal(t, uint16(tls.VersionTLS12), a.tlsConfig.MinVersion)
+	require.NotNil(t, a.tlsConfig.RootCAs)
+	assert.Len(t, a.tlsConfig.RootCAs.Subjects(), 1)
+
+	// Without a CA cert file, the system's certificate authorities are used.
+	a, err = newLDAPAuthenticator(config.LDAPProvider{URL: passwordIssuer, BaseDN: "dc=test"})
+	require.NoError(t, err)
+	assert.Equal(t, "ldap.test", a.tlsConfig.ServerName)
+	assert.Nil(t, a.tlsConfig.RootCAs)
+}
@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/random"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	grpb "github.com/buildbuddy-io/buildbuddy/proto/group"
+	uidpb "github.com/buildbuddy-io/buildbuddy/proto/user_id"
+	gstatus "google.golang.org/grpc/status"
+)
+
+var passwordLoginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Log in | BuildBuddy</title>
+<style>
+body { font-family: sans-serif; background: #f5f5f5; display: flex; justify-content: center; padding-top: 96px; margin: 0; }
+form { background: #fff; border: 1px solid #ddd; border-radius: 8px; padding: 32px; width: 320px; }
+h1 { font-size: 20px; margin: 0 0 24px 0; }
+label { display: block; font-size: 14px; margin-bottom: 16px; }
+input[type=text], input[type=password] { display: block; box-sizing: border-box; width: 100%; margin-top: 4px; padding: 8px; font-size: 14px; }
+button { width: 100%; padding: 10px; font-size: 14px; color: #fff; background: #212121; border: none; border-radius: 4px; cursor: pointer; }
+.error { color: #c62828; font-size: 14px; margin-bottom: 16px; }
+</style>
+</head>
+<body>
+<form method="POST" action="/login/">
+<h1>Log in to BuildBuddy</h1>
+{{if .Error}}<div class="error">{{.Error}}</div>{{end}}
+<input type="hidden" name="issuer_url" value="{{.Issuer}}">
+<input type="hidden" name="state" value="{{.State}}">
+<label>Username<input type="text" name="username" value="{{.Username}}" autocomplete="username" autofocus required></label>
+<label>Password<input type="password" name="password" autocomplete="current-password" required></label>
+<button type="submit">Log in</button>
+</form>
+</body>
+</html>
+`))
+
+type passwordLoginPage struct {
+	Issuer   string
+	State    string
+	Username string
+	Error    string
+}
+
+func renderPasswordLoginPage(w http.ResponseWriter, code int, page *passwordLoginPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	if err := passwordLoginTemplate.Execute(w, page); err != nil {
+		log.Warningf("Failed to render login page: %s", err)
+	}
+}
+
+// passwordLogin serves the login page of a password authenticator on GET, and
+// logs the user in when the page is submitted.
+func (a *OpenIDAuthenticator) passwordLogin(w http.ResponseWriter, r *http.Request, auth passwordAuthenticator) {
+	issuer := r.FormValue(authIssuerParam)
+	if r.Method != http.MethodPost {
+		redirectURL := r.FormValue(authRedirectParam)
+		if err := a.validateRedirectURL(redirectURL); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		// The "state" cookie must match the state submitted with the login
+		// form, so that other sites can't log the browser into an account.
+		state := fmt.Sprintf("%d", random.RandUint64())
+		setCookie(w, stateCookie, state, time.Now().Add(tempCookieDuration))
+		setCookie(w, redirCookie, redirectURL, time.Now().Add(tempCookieDuration))
+		renderPasswordLoginPage(w, http.StatusOK, &passwordLoginPage{Issuer: issuer, State: state})
+		return
+	}
+
+	ctx := r.Context()
+	state := getCookie(r, stateCookie)
+	if state == "" || r.PostFormValue("state") != state {
+		log.Printf("state mismatch: %s != %s", r.PostFormValue("state"), state)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	page := &passwordLoginPage{Issuer: issuer, State: state, Username: r.PostFormValue("username")}
+	login, err := auth.login(ctx, page.Username, r.PostFormValue("password"))
+	if err != nil {
+		if status.IsUnauthenticatedError(err) {
+			page.Error = "Invalid username or password."
+		} else {
+			log.Warningf("Login with %s failed: %s", issuer, err)
+			page.Error = "Login failed, please try again later."
+		}
+		renderPasswordLoginPage(w, http.StatusUnauthorized, page)
+		return
+	}
+	if err := a.syncPasswordLoginUser(ctx, login); err != nil {
+		log.Warningf("Failed to sync user %q from %s: %s", login.user.GetSubID(), issuer, err)
+		page.Error = fmt.Sprintf("Login failed: %s", gstatus.Convert(err).Message())
+		renderPasswordLoginPage(w, http.StatusForbidden, page)
+		return
+	}
+	setLoginCookie(w, login.jwt, issuer)
+	a.startSession(ctx, w, r, login.user.GetSubID(), login.jwt)
+
+	redirURL := getCookie(r, redirCookie)
+	if redirURL == "" {
+		redirURL = "/" // default to redirecting home.
+	}
+	http.Redirect(w, r, redirURL, http.StatusSeeOther)
+}
+
+// syncPasswordLoginUser creates the user who logged in if they don't exist yet,
+// and adds them to or removes them from the groups whose members are managed
+// by the authenticator.
+func (a *OpenIDAuthenticator) syncPasswordLoginUser(ctx context.Context, login *passwordLogin) error {
+	userDB := a.env.GetUserDB()
+	dbHandle := a.env.GetDBHandle()
+	if userDB == nil || dbHandle == nil {
+		return nil
+	}
+	subID := login.user.GetSubID()
+	user := &tables.User{}
+	err := dbHandle.WithContext(ctx).Where("sub_id = ?", subID).Take(user).Error
+	if db.IsRecordNotFound(err) {
+		if err := fillUserFromToken(user, login.user); err != nil {
+			return err
+		}
+		err = userDB.InsertUser(ctx, user)
+	}
+	if err != nil {
+		return err
+	}
+	if len(login.groupMemberships) == 0 {
+		return nil
+	}
+
+	var memberships []*tables.UserGroup
+	if err := dbHandle.WithContext(ctx).Where("user_user_id = ?", user.UserID).Find(&memberships).Error; err != nil {
+		return err
+	}
+	membershipStatus := make(map[string]int32, len(memberships))
+	for _, m := range memberships {
+		membershipStatus[m.GroupGroupID] = m.MembershipStatus
+	}
+	for groupID, isMember := range login.groupMemberships {
+		s, inGroup := membershipStatus[groupID]
+		action := grpb.UpdateGroupUsersRequest_Update_UNKNOWN_MEMBERSHIP_ACTION
+		switch {
+		case isMember && !inGroup:
+			if err := userDB.AddUserToGroup(ctx, user.UserID, groupID); err != nil {
+				return err
+			}
+		case isMember && s != int32(grpb.GroupMembershipStatus_MEMBER):
+			// Approve any pending request to join the group.
+			action = grpb.UpdateGroupUsersRequest_Update_ADD
+		case !isMember && inGroup:
+			action = grpb.UpdateGroupUsersRequest_Update_REMOVE
+		}
+		if action == grpb.UpdateGroupUsersRequest_Update_UNKNOWN_MEMBERSHIP_ACTION {
+			continue
+		}
+		update := &grpb.UpdateGroupUsersRequest_Update{
+			UserId:           &uidpb.UserId{Id: user.UserID},
+			MembershipAction: action,
+		}
+		if err := userDB.UpdateGroupUsers(ctx, groupID, []*grpb.UpdateGroupUsersRequest_Update{update}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/lru"
+	"github.com/buildbuddy-io/buildbuddy/server/util/random"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+)
+
+const (
+	// The cookie holding the token of the browser's session.
+	sessionCookie      = "Session-Token"
+	sessionTokenLength = 32
+
+	// How often the token denylist is reloaded from the DB, and how long
+	// reloading it may take. This bounds how long a revoked token keeps
+	// working on servers other than the one that revoked it.
+	denylistRefreshInterval = 5 * time.Second
+
+	// How often the last-used time of a session or API key is written to the
+	// DB, so that credentials used in bursts don't write on every request.
+	lastUsedUpdateInterval = time.Minute
+	lastUsedCacheSize      = 10000
+)
+
+// tokenDenylist holds the hashes of revoked tokens. It's checked on every
+// request, so it's kept in memory and reloaded in the background.
+type tokenDenylist struct {
+	startOnce sync.Once
+	mu        sync.RWMutex // protects hashes
+	hashes    map[string]struct{}
+}
+
+// start loads the denylist, and starts reloading it periodically until the
+// server shuts down.
+func (d *tokenDenylist) start(env environment.Env, authDB interfaces.AuthDB) {
+	d.startOnce.Do(func() {
+		d.refresh(authDB)
+		quit := make(chan struct{})
+		if hc := env.GetHealthChecker(); hc != nil {
+			hc.RegisterShutdownFunction(func(ctx context.Context) error {
+				close(quit)
+				return nil
+			})
+		}
+		go func() {
+			ticker := time.NewTicker(denylistRefreshInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-quit:
+					return
+				case <-ticker.C:
+					d.refresh(authDB)
+				}
+			}
+		}()
+	})
+}
+
+// refresh reloads the denylist from the DB. It's not tied to any request, so
+// that a slow DB doesn't hold up the requests checking the denylist.
+func (d *tokenDenylist) refresh(authDB interfaces.AuthDB) {
+	ctx, cancel := context.WithTimeout(context.Background(), denylistRefreshInterval)
+	defer cancel()
+	hashes, err := authDB.GetRevokedTokenHashes(ctx)
+	if err != nil {
+		log.Warningf("Failed to refresh token denylist: %s", err)
+		return
+	}
+	m := make(map[string]struct{}, len(hashes))
+	for _, h := range hashes {
+		m[h] = struct{}{}
+	}
+	d.mu.Lock()
+	d.hashes = m
+	d.mu.Unlock()
+}
+
+func (d *tokenDenylist) contains(token string) bool {
+	if token == "" {
+		return false
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	_, ok := d.hashes[tables.TokenHash(token)]
+	return ok
+}
+
+// lastUseTracker remembers when credentials' last-used times were written.
+type lastUseTracker struct {
+	mu  sync.Mutex
+	lru *lru.LRU
+}
+
+func newLastUseTracker() (*lastUseTracker, error) {
+	l, err := lru.NewLRU(&lru.Config{
+		MaxSize: lastUsedCacheSize,
+		SizeFn:  func(k, v interface{}) int64 { return 1 },
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &lastUseTracker{lru: l}, nil
+}
+
+// shouldRecord returns whether a use of the credential with the given key
+// should be written, because none was written recently.
+func (t *lastUseTracker) shouldRecord(key string) bool {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if v, ok := t.lru.Get(key); ok && now.Sub(v.(time.Time)) < lastUsedUpdateInterval {
+		return false
+	}
+	t.lru.Add(key, now)
+	return true
+}
+
+// isRevoked returns whether the token is on the denylist.
+func (a *OpenIDAuthenticator) isRevoked(token string) bool {
+	authDB := a.env.GetAuthDB()
+	if authDB == nil {
+		return false
+	}
+	a.denylist.start(a.env, authDB)
+	return a.denylist.contains(token)
+}
+
+func (a *OpenIDAuthenticator) recordAPIKeyUse(ctx context.Context, apiKey string) {
+	authDB := a.env.GetAuthDB()
+	if authDB == nil || !a.lastUse.shouldRecord(tables.TokenHash(apiKey)) {
+		return
+	}
+	if err := authDB.UpdateAPIKeyLastUsed(ctx, apiKey, timeutil.ToUsec(time.Now())); err != nil {
+		log.Warningf("Failed to update API key last used time: %s", err)
+	}
+}
+
+// clientIP returns the IP address that a request was made from, preferring
+// the one reported by a load balancer in front of the app.
+func clientIP(r *http.Request) string {
+	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		return strings.TrimSpace(strings.Split(forwardedFor, ",")[0])
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// startSession records a new login of the user with the given subscriber ID,
+// and sets the session cookie that identifies it.
+func (a *OpenIDAuthenticator) startSession(ctx context.Context, w http.ResponseWriter, r *http.Request, subID, jwt string) {
+	authDB := a.env.GetAuthDB()
+	if authDB == nil {
+		return
+	}
+	token, err := random.RandomString(sessionTokenLength)
+	if err != nil {
+		log.Warningf("Failed to generate session token: %s", err)
+		return
+	}
+	now := time.Now()
+	s := &tables.Session{
+		SubID:          subID,
+		TokenHash:      tables.TokenHash(token),
+		LoginTokenHash: tables.TokenHash(jwt),
+		UserAgent:      r.UserAgent(),
+		IPAddress:      clientIP(r),
+		LastUsedUsec:   timeutil.ToUsec(now),
+	}
+	if err := authDB.InsertSession(ctx, s); err != nil {
+		log.Warningf("Failed to start session for %q: %s", subID, err)
+		return
+	}
+	setCookie(w, sessionCookie, token, now.Add(loginCookieDuration))
+}
+
+// recordSessionUse records that the browser's session was used with the given
+// login token. Logins from before sessions were introduced have no session.
+func (a *OpenIDAuthenticator) recordSessionUse(ctx context.Context, r *http.Request, jwt string) {
+	authDB := a.env.GetAuthDB()
+	token := getCookie(r, sessionCookie)
+	if authDB == nil || token == "" {
+		return
+	}
+	tokenHash, loginTokenHash := tables.TokenHash(token), tables.TokenHash(jwt)
+	// Uses with a new login token, such as after it's refreshed, are always
+	// written, so that the current login token is revoked with the session.
+	if !a.lastUse.shouldRecord(tokenHash + loginTokenHash) {
+		return
+	}
+	err := authDB.UpdateSessionLastUsed(ctx, tokenHash, loginTokenHash, timeutil.ToUsec(time.Now()))
+	if err != nil && !status.IsNotFoundError(err) {
+		log.Warningf("Failed to update session last used time: %s", err)
+	}
+}
@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/capabilities"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+)
+
+func authenticatedRequest(cookies ...*http.Cookie) *http.Request {
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.AddCookie(&http.Cookie{Name: jwtCookie, Value: validJWT})
+	request.AddCookie(&http.Cookie{Name: authIssuerCookie, Value: testIssuer})
+	for _, c := range cookies {
+		request.AddCookie(c)
+	}
+	return request
+}
+
+func TestRevokeSession(t *testing.T) {
+	ctx := context.Background()
+	env := enterprise_testenv.GetCustomTestEnv(t, &enterprise_testenv.Options{})
+	auth, err := newForTesting(ctx, env, &fakeOidcAuthenticator{})
+	require.NoError(t, err)
+	err = env.GetUserDB().InsertUser(ctx, &tables.User{UserID: userID, SubID: subID, Email: userEmail})
+	require.NoError(t, err)
+
+	// Logging in starts a session.
+	response := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/auth/", nil)
+	request.Header.Set("User-Agent", "test-browser")
+	auth.startSession(ctx, response, request, subID, validJWT)
+	session := getResponseCookie(response.Result(), sessionCookie)
+	require.NotNil(t, session)
+
+	requireAuthenticated(t, auth.AuthenticatedHTTPContext(httptest.NewRecorder(), authenticatedRequest(session)))
+	sessions, err := env.GetAuthDB().GetUserSessions(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, "test-browser", sessions[0].UserAgent)
+	assert.NotZero(t, sessions[0].LastUsedUsec)
+
+	require.NoError(t, env.GetAuthDB().RevokeSession(ctx, sessions[0].SessionID))
+	// Reload the denylist, as it would be on other servers within
+	// denylistRefreshInterval.
+	auth.denylist.refresh(env.GetAuthDB())
+
+	// The session is rejected, and so is its login token without it.
+	requireAuthenticationError(t, auth.AuthenticatedHTTPContext(httptest.NewRecorder(), authenticatedRequest(session)))
+	requireAuthenticationError(t, auth.AuthenticatedHTTPContext(httptest.NewRecorder(), authenticatedRequest()))
+	sessions, err = env.GetAuthDB().GetUserSessions(ctx, userID)
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+}
+
+func TestRevokeAPIKey(t *testing.T) {
+	ctx := context.Background()
+	env := enterprise_testenv.GetCustomTestEnv(t, &enterprise_testenv.Options{})
+	auth, err := newForTesting(ctx, env, &fakeOidcAuthenticator{})
+	require.NoError(t, err)
+	require.NoError(t, env.GetDBHandle().Create(&tables.Group{GroupID: "GR1"}).Error)
+	key, err := env.GetUserDB().CreateAPIKey(ctx, "GR1", "test", nil /*=capabilities*/)
+	require.NoError(t, err)
+
+	requireAuthenticated(t, auth.AuthContextFromAPIKey(ctx, key.Value))
+	key, err = env.GetUserDB().GetAPIKey(ctx, key.APIKeyID)
+	require.NoError(t, err)
+	assert.NotZero(t, key.LastUsedUsec)
+
+	// The key is rejected once it's revoked, even though it's cached.
+	require.NoError(t, env.GetAuthDB().RevokeToken(ctx, key.Value))
+	auth.denylist.refresh(env.GetAuthDB())
+	requireAuthenticationError(t, auth.AuthContextFromAPIKey(ctx, key.Value))
+}
+
+func TestInvalidateAPIKey(t *testing.T) {
+	ctx := context.Background()
+	env := enterprise_testenv.GetCustomTestEnv(t, &enterprise_testenv.Options{})
+	auth, err := newForTesting(ctx, env, &fakeOidcAuthenticator{})
+	require.NoError(t, err)
+	require.NoError(t, env.GetDBHandle().Create(&tables.Group{GroupID: "GR1"}).Error)
+	key, err := env.GetUserDB().CreateAPIKey(ctx, "GR1", "test", nil /*=capabilities*/)
+	require.NoError(t, err)
+
+	claims, err := auth.claimsFromAPIKey(ctx, key.Value)
+	require.NoError(t, err)
+	assert.False(t, claims.HasCapability(akpb.ApiKey_CACHE_WRITE_CAPABILITY))
+
+	key.Capabilities = capabilities.ToInt([]akpb.ApiKey_Capability{akpb.ApiKey_CACHE_WRITE_CAPABILITY})
+	require.NoError(t, env.GetUserDB().UpdateAPIKey(ctx, key))
+
+	// The key's capabilities are cached until it's invalidated.
+	claims, err = auth.claimsFromAPIKey(ctx, key.Value)
+	require.NoError(t, err)
+	assert.False(t, claims.HasCapability(akpb.ApiKey_CACHE_WRITE_CAPABILITY))
+	auth.InvalidateAPIKey(key.Value)
+	claims, err = auth.claimsFromAPIKey(ctx, key.Value)
+	require.NoError(t, err)
+	assert.True(t, claims.HasCapability(akpb.ApiKey_CACHE_WRITE_CAPABILITY))
+
+	// Deleted keys are rejected immediately once invalidated.
+	require.NoError(t, env.GetUserDB().DeleteAPIKey(ctx, key.APIKeyID))
+	auth.InvalidateAPIKey(key.Value)
+	_, err = auth.claimsFromAPIKey(ctx, key.Value)
+	assert.Error(t, err)
+}
+
+// slowAuthDB counts the times the token denylist is loaded, and holds up
+// loading it while blocked.
+type slowAuthDB struct {
+	interfaces.AuthDB
+	mu      sync.Mutex
+	loads   int
+	blocked chan struct{}
+}
+
+func (db *slowAuthDB) GetRevokedTokenHashes(ctx context.Context) ([]string, error) {
+	db.mu.Lock()
+	db.loads++
+	blocked := db.blocked
+	db.mu.Unlock()
+	if blocked != nil {
+		select {
+		case <-blocked:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return db.AuthDB.GetRevokedTokenHashes(ctx)
+}
+
+func (db *slowAuthDB) loadCount() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.loads
+}
+
+func TestTokenDenylist(t *testing.T) {
+	ctx := context.Background()
+	env := enterprise_testenv.GetCustomTestEnv(t, &enterprise_testenv.Options{})
+	authDB := &slowAuthDB{AuthDB: env.GetAuthDB()}
+	require.NoError(t, env.GetAuthDB().RevokeToken(ctx, "revoked"))
+
+	d := &tokenDenylist{}
+	d.start(env, authDB)
+	d.start(env, authDB)
+	assert.Equal(t, 1, authDB.loadCount())
+
+	// Checking tokens doesn't query the DB.
+	for i := 0; i < 10; i++ {
+		assert.True(t, d.contains("revoked"))
+		assert.False(t, d.contains("valid"))
+		assert.False(t, d.contains(""))
+	}
+	assert.Equal(t, 1, authDB.loadCount())
+
+	// Nor does it wait for the denylist to be reloaded.
+	authDB.mu.Lock()
+	authDB.blocked = make(chan struct{})
+	authDB.mu.Unlock()
+	require.NoError(t, env.GetAuthDB().RevokeToken(ctx, "valid"))
+	refreshed := make(chan struct{})
+	go func() {
+		d.refresh(authDB)
+		close(refreshed)
+	}()
+	require.Eventually(t, func() bool { return authDB.loadCount() == 2 }, 10*time.Second, time.Millisecond)
+	assert.True(t, d.contains("revoked"))
+	assert.False(t, d.contains("valid"))
+
+	close(authDB.blocked)
+	<-refreshed
+	assert.True(t, d.contains("valid"))
+}
@@ -2,11 +2,19 @@ package authdb
 
 import (
 	"context"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/util/db"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+)
+
+const (
+	// How long revoked tokens stay on the denylist. This is as long as a
+	// login cookie lasts, which outlives any token stored in one.
+	revokedTokenTTL = 365 * 24 * time.Hour
 )
 
 type AuthDB struct {
@@ -97,3 +105,124 @@ func (d *AuthDB) GetAPIKeyGroupFromBasicAuth(ctx context.Context, login, pass st
 	return akg, nil
 
 }
+
+func (d *AuthDB) UpdateAPIKeyLastUsed(ctx context.Context, apiKey string, lastUsedUsec int64) error {
+	return d.h.Exec(`UPDATE APIKeys SET last_used_usec = ? WHERE value = ?`, lastUsedUsec, apiKey).Error
+}
+
+func (d *AuthDB) InsertSession(ctx context.Context, s *tables.Session) error {
+	if s.SessionID == "" {
+		pk, err := tables.PrimaryKeyForTable("Sessions")
+		if err != nil {
+			return err
+		}
+		s.SessionID = pk
+	}
+	return d.h.Transaction(ctx, func(tx *db.DB) error {
+		return tx.Create(s).Error
+	})
+}
+
+func (d *AuthDB) UpdateSessionLastUsed(ctx context.Context, tokenHash, loginTokenHash string, lastUsedUsec int64) error {
+	res := d.h.Exec(`UPDATE Sessions SET login_token_hash = ?, last_used_usec = ? WHERE token_hash = ?`,
+		loginTokenHash, lastUsedUsec, tokenHash)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return status.NotFoundError("Session not found")
+	}
+	return nil
+}
+
+func (d *AuthDB) GetSession(ctx context.Context, sessionID string) (*tables.Session, error) {
+	s := &tables.Session{}
+	if err := d.h.Raw(`SELECT * FROM Sessions WHERE session_id = ?`, sessionID).Take(s).Error; err != nil {
+		if db.IsRecordNotFound(err) {
+			return nil, status.NotFoundErrorf("Session %s not found", sessionID)
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+func (d *AuthDB) GetUserSessions(ctx context.Context, userID string) ([]*tables.Session, error) {
+	sessions := make([]*tables.Session, 0)
+	err := d.h.Raw(`
+		SELECT s.* FROM Sessions AS s JOIN Users AS u ON s.sub_id = u.sub_id
+		WHERE u.user_id = ?
+		ORDER BY s.last_used_usec DESC`, userID).Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// revokeTokenHashes adds the token hashes to the denylist, and removes the
+// hashes that have expired from it.
+func revokeTokenHashes(tx *db.DB, tokenHashes ...string) error {
+	now := time.Now()
+	if err := tx.Exec(`DELETE FROM RevokedTokens WHERE expires_at_usec < ?`, timeutil.ToUsec(now)).Error; err != nil {
+		return err
+	}
+	for _, h := range tokenHashes {
+		if h == "" {
+			continue
+		}
+		var existing tables.RevokedToken
+		err := tx.Where("token_hash = ?", h).First(&existing).Error
+		if err == nil {
+			continue
+		}
+		if !db.IsRecordNotFound(err) {
+			return err
+		}
+		t := &tables.RevokedToken{TokenHash: h, ExpiresAtUsec: timeutil.ToUsec(now.Add(revokedTokenTTL))}
+		if err := tx.Create(t).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *AuthDB) RevokeSession(ctx context.Context, sessionID string) error {
+	return d.h.Transaction(ctx, func(tx *db.DB) error {
+		s := &tables.Session{}
+		if err := tx.Where("session_id = ?", sessionID).First(s).Error; err != nil {
+			if db.IsRecordNotFound(err) {
+				return status.NotFoundErrorf("Session %s not found", sessionID)
+			}
+			return err
+		}
+		if err := revokeTokenHashes(tx, s.TokenHash, s.LoginTokenHash); err != nil {
+			return err
+		}
+		// Expired login tokens are renewed with the refresh token that is
+		// shared by all of the user's sessions, so it's deleted too. The
+		// user's other sessions will need to log in again once their login
+		// tokens expire.
+		if err := tx.Exec(`DELETE FROM Tokens WHERE sub_id = ?`, s.SubID).Error; err != nil {
+			return err
+		}
+		return tx.Exec(`DELETE FROM Sessions WHERE session_id = ?`, sessionID).Error
+	})
+}
+
+func (d *AuthDB) RevokeToken(ctx context.Context, token string) error {
+	return d.h.Transaction(ctx, func(tx *db.DB) error {
+		return revokeTokenHashes(tx, tables.TokenHash(token))
+	})
+}
+
+func (d *AuthDB) GetRevokedTokenHashes(ctx context.Context) ([]string, error) {
+	var tokens []*tables.RevokedToken
+	err := d.h.Raw(`SELECT * FROM RevokedTokens WHERE expires_at_usec >= ?`, timeutil.ToUsec(time.Now())).Find(&tokens).Error
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, 0, len(tokens))
+	for _, t := range tokens {
+		hashes = append(hashes, t.TokenHash)
+	}
+	return hashes, nil
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/cache_metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/toucher"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
@@ -25,6 +26,9 @@ import (
 
 const (
 	maxNumRetries = 3
+
+	// The minimum interval between TTL bumps of an object.
+	minTTLBumpInterval = 1 * time.Hour
 )
 
 var (
@@ -37,6 +41,8 @@ type GCSCache struct {
 	projectID    string
 	prefix       string
 	ttlInDays    int64
+	// Bumps the TTLs of stale objects that were read, in the background.
+	toucher *toucher.Toucher
 }
 
 func NewGCSCache(bucketName, projectID string, ageInDays int64, opts ...option.ClientOption) (*GCSCache, error) {
@@ -50,6 +56,10 @@ func NewGCSCache(bucketName, projectID string, ageInDays int64, opts ...option.C
 		projectID: projectID,
 		ttlInDays: ageInDays,
 	}
+	g.toucher, err = toucher.New(g.bumpTTLs, &toucher.Opts{MinTouchInterval: minTTLBumpInterval})
+	if err != nil {
+		return nil, err
+	}
 	if err := g.createBucketIfNotExists(ctx, bucketName); err != nil {
 		return nil, err
 	}
@@ -122,6 +132,7 @@ func (g *GCSCache) WithPrefix(prefix string) interfaces.Cache {
 		projectID:    g.projectID,
 		ttlInDays:    g.ttlInDays,
 		prefix:       newPrefix,
+		toucher:      g.toucher,
 	}
 }
 
@@ -138,6 +149,7 @@ func (g *GCSCache) Get(ctx context.Context, d *repb.Digest) ([]byte, error) {
 		}
 		return nil, err
 	}
+	g.touchIfStale(k, reader.Attrs.LastModified)
 	timer := cache_metrics.NewCacheTimer(cacheLabels)
 	b, err := ioutil.ReadAll(reader)
 	timer.ObserveGet(len(b), err)
@@ -252,19 +264,24 @@ func (g *GCSCache) Delete(ctx context.Context, d *repb.Digest) error {
 	return err
 }
 
-func (g *GCSCache) bumpTTLIfStale(ctx context.Context, key string, t time.Time) bool {
-	if int64(time.Since(t).Hours()) < 24*g.ttlInDays/2 {
-		return true
-	}
-	obj := g.bucketHandle.Object(key)
-	_, err := obj.CopierFrom(obj).Run(ctx)
-	if err == storage.ErrObjectNotExist {
-		return false
+// touchIfStale schedules a TTL bump for the object with the given key, if it
+// was last written more than half of the TTL ago.
+func (g *GCSCache) touchIfStale(key string, lastModified time.Time) {
+	if int64(time.Since(lastModified).Hours()) < 24*g.ttlInDays/2 {
+		return
 	}
-	if err != nil {
-		log.Printf("Error bumping TTL for key %s: %s", key, err.Error())
+	g.toucher.Touch(key)
+}
+
+// bumpTTLs rewrites the objects with the given keys, resetting their age.
+func (g *GCSCache) bumpTTLs(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		obj := g.bucketHandle.Object(key)
+		_, err := obj.CopierFrom(obj).Run(ctx)
+		if err != nil && err != storage.ErrObjectNotExist {
+			log.Printf("Error bumping TTL for key %s: %s", key, err.Error())
+		}
 	}
-	return true
 }
 
 func (g *GCSCache) Contains(ctx context.Context, d *repb.Digest) (bool, error) {
@@ -283,7 +300,8 @@ func (g *GCSCache) Contains(ctx context.Context, d *repb.Digest) (bool, error) {
 		if err == storage.ErrObjectNotExist {
 			return false, nil
 		} else if err == nil {
-			return g.bumpTTLIfStale(ctx, k, attrs.Created), nil
+			g.touchIfStale(k, attrs.Created)
+			return true, nil
 		} else if isRetryableGCSError(err) {
 			log.Printf("Retrying GCS exists, err: %s", err.Error())
 			continue
@@ -334,6 +352,7 @@ func (g *GCSCache) Reader(ctx context.Context, d *repb.Digest, offset int64) (io
 		}
 		return nil, err
 	}
+	g.touchIfStale(k, reader.Attrs.LastModified)
 	timer := cache_metrics.NewCacheTimer(cacheLabels)
 	return io.NopCloser(timer.NewInstrumentedReader(reader, d.GetSizeBytes())), nil
 }
@@ -0,0 +1,128 @@
+package partitioned_cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/upstream_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+// PartitionedCache partitions a cache by the API key that each request was
+// made with, so that a cache shared by the clients of several groups (such as
+// the local cache of a proxy, which has no way to authenticate them) never
+// serves one client the entries written by another. Requests without an API
+// key are rejected.
+type PartitionedCache struct {
+	cache interfaces.Cache
+	// The prefixes applied with WithPrefix, which are applied within the
+	// partition of each request.
+	prefixes []string
+}
+
+func NewPartitionedCache(cache interfaces.Cache) *PartitionedCache {
+	return &PartitionedCache{cache: cache}
+}
+
+func (c *PartitionedCache) WithPrefix(prefix string) interfaces.Cache {
+	prefixes := make([]string, 0, len(c.prefixes)+1)
+	prefixes = append(prefixes, c.prefixes...)
+	return &PartitionedCache{
+		cache:    c.cache,
+		prefixes: append(prefixes, prefix),
+	}
+}
+
+// partition returns the partition of the cache for the API key of the
+// request.
+func (c *PartitionedCache) partition(ctx context.Context) (interfaces.Cache, error) {
+	apiKey := upstream_cache.ClientAPIKey(ctx)
+	if apiKey == "" {
+		return nil, status.UnauthenticatedError("an API key is required")
+	}
+	// API keys are hashed so that they don't end up in cache keys, such as
+	// the paths of a disk cache.
+	h := sha256.Sum256([]byte(apiKey))
+	p := c.cache.WithPrefix(hex.EncodeToString(h[:16]))
+	for _, prefix := range c.prefixes {
+		p = p.WithPrefix(prefix)
+	}
+	return p, nil
+}
+
+func (c *PartitionedCache) Contains(ctx context.Context, d *repb.Digest) (bool, error) {
+	p, err := c.partition(ctx)
+	if err != nil {
+		return false, err
+	}
+	return p.Contains(ctx, d)
+}
+
+func (c *PartitionedCache) ContainsMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest]bool, error) {
+	p, err := c.partition(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.ContainsMulti(ctx, digests)
+}
+
+func (c *PartitionedCache) Get(ctx context.Context, d *repb.Digest) ([]byte, error) {
+	p, err := c.partition(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.Get(ctx, d)
+}
+
+func (c *PartitionedCache) GetMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest][]byte, error) {
+	p, err := c.partition(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.GetMulti(ctx, digests)
+}
+
+func (c *PartitionedCache) Set(ctx context.Context, d *repb.Digest, data []byte) error {
+	p, err := c.partition(ctx)
+	if err != nil {
+		return err
+	}
+	return p.Set(ctx, d, data)
+}
+
+func (c *PartitionedCache) SetMulti(ctx context.Context, kvs map[*repb.Digest][]byte) error {
+	p, err := c.partition(ctx)
+	if err != nil {
+		return err
+	}
+	return p.SetMulti(ctx, kvs)
+}
+
+func (c *PartitionedCache) Delete(ctx context.Context, d *repb.Digest) error {
+	p, err := c.partition(ctx)
+	if err != nil {
+		return err
+	}
+	return p.Delete(ctx, d)
+}
+
+func (c *PartitionedCache) Reader(ctx context.Context, d *repb.Digest, offset int64) (io.ReadCloser, error) {
+	p, err := c.partition(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.Reader(ctx, d, offset)
+}
+
+func (c *PartitionedCache) Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser, error) {
+	p, err := c.partition(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.Writer(ctx, d)
+}
@@ -0,0 +1,59 @@
+package partitioned_cache_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/auth"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/partitioned_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+func withAPIKey(apiKey string) context.Context {
+	ctx := prefix.AttachGroupPrefixToContext(context.Background(), "")
+	return metadata.NewIncomingContext(ctx, metadata.Pairs(auth.APIKeyHeader, apiKey))
+}
+
+func TestEntriesArePartitionedByAPIKey(t *testing.T) {
+	mc, err := memory_cache.NewMemoryCache(1000000)
+	require.NoError(t, err)
+	c := partitioned_cache.NewPartitionedCache(mc).WithPrefix("instance").WithPrefix("ac")
+	ctx1 := withAPIKey("key1")
+	ctx2 := withAPIKey("key2")
+
+	d, buf := testdigest.NewRandomDigestBuf(t, 100)
+	require.NoError(t, c.Set(ctx1, d, buf))
+
+	got, err := c.Get(ctx1, d)
+	require.NoError(t, err)
+	assert.Equal(t, buf, got)
+	found, err := c.Contains(ctx2, d)
+	require.NoError(t, err)
+	assert.False(t, found, "entry written with one API key must not be visible to another")
+	_, err = c.Get(ctx2, d)
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+
+	// Prefixes still separate entries within a partition.
+	found, err = partitioned_cache.NewPartitionedCache(mc).WithPrefix("instance").Contains(ctx1, d)
+	require.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestRequestsWithoutAPIKeyAreRejected(t *testing.T) {
+	mc, err := memory_cache.NewMemoryCache(1000000)
+	require.NoError(t, err)
+	c := partitioned_cache.NewPartitionedCache(mc)
+
+	d, buf := testdigest.NewRandomDigestBuf(t, 100)
+	ctx := prefix.AttachGroupPrefixToContext(context.Background(), "")
+	err = c.Set(ctx, d, buf)
+	assert.True(t, status.IsUnauthenticatedError(err), "expected Unauthenticated, got %v", err)
+	_, err = c.Get(ctx, d)
+	assert.True(t, status.IsUnauthenticatedError(err), "expected Unauthenticated, got %v", err)
+}
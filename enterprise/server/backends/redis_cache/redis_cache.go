@@ -5,6 +5,7 @@ import (
 	"context"
 	"io"
 	"path/filepath"
+	"strconv"
 	"time"
 	"unsafe"
 
@@ -334,6 +335,36 @@ func (c *Cache) IncrementCount(ctx context.Context, counterName string, n int64)
 	return c.rdb.IncrBy(ctx, counterName, n).Result()
 }
 
+func (c *Cache) IncrementCountWithExpiry(ctx context.Context, counterName string, n int64, expiration time.Duration) (int64, error) {
+	pipe := c.rdb.TxPipeline()
+	count := pipe.IncrBy(ctx, counterName, n)
+	pipe.Expire(ctx, counterName, expiration)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return count.Val(), nil
+}
+
 func (c *Cache) ReadCount(ctx context.Context, counterName string) (int64, error) {
 	return c.rdb.IncrBy(ctx, counterName, 0).Result()
 }
+
+func (c *Cache) IncrementMapCount(ctx context.Context, key, field string, n int64) (int64, error) {
+	return c.rdb.HIncrBy(ctx, key, field, n).Result()
+}
+
+func (c *Cache) ReadMapCounts(ctx context.Context, key string) (map[string]int64, error) {
+	values, err := c.rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(values))
+	for field, value := range values {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, status.InternalErrorf("count %q of %q is not an integer: %s", field, key, err)
+		}
+		counts[field] = n
+	}
+	return counts, nil
+}
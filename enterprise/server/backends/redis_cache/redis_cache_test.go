@@ -0,0 +1,45 @@
+package redis_cache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/redis_cache"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/testredis"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/redisutil"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIncrementCountWithExpiry(t *testing.T) {
+	ctx := context.Background()
+	rdb := redis.NewClient(redisutil.TargetToOptions(testredis.Start(t)))
+	// The server may take a moment to start accepting connections.
+	require.Eventually(t, func() bool { return rdb.Ping(ctx).Err() == nil }, 10*time.Second, 10*time.Millisecond)
+	c := redis_cache.NewCache(rdb, 0)
+
+	n, err := c.IncrementCountWithExpiry(ctx, "counter", 3, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	n, err = c.IncrementCountWithExpiry(ctx, "counter", 4, 2*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), n)
+
+	n, err = c.ReadCount(ctx, "counter")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), n)
+	// The expiration is extended by each increment.
+	ttl, err := rdb.TTL(ctx, "counter").Result()
+	require.NoError(t, err)
+	assert.Greater(t, ttl, time.Hour)
+	assert.LessOrEqual(t, ttl, 2*time.Hour)
+
+	// Counters incremented without an expiry are kept.
+	_, err = c.IncrementCount(ctx, "other", 1)
+	require.NoError(t, err)
+	ttl, err = rdb.TTL(ctx, "other").Result()
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(-1), ttl)
+}
@@ -0,0 +1,32 @@
+package redis_kvstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// KeyValStore is a KeyValStore backed by Redis, whose values are shared by
+// all of the apps using the same Redis instance.
+type KeyValStore struct {
+	rdb *redis.Client
+}
+
+func New(redisClient *redis.Client) *KeyValStore {
+	return &KeyValStore{
+		rdb: redisClient,
+	}
+}
+
+func (s *KeyValStore) SetValue(ctx context.Context, key, value string, expiration time.Duration) error {
+	return s.rdb.Set(ctx, key, value, expiration).Err()
+}
+
+func (s *KeyValStore) GetValue(ctx context.Context, key string) (string, error) {
+	value, err := s.rdb.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return value, err
+}
@@ -23,11 +23,17 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/cache_metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/toucher"
 	"golang.org/x/sync/errgroup"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 )
 
+const (
+	// The minimum interval between TTL bumps of an object.
+	minTTLBumpInterval = 1 * time.Hour
+)
+
 var (
 	cacheLabels = cache_metrics.MakeCacheLabels(cache_metrics.CloudCacheTier, "aws_s3")
 )
@@ -40,6 +46,8 @@ type S3Cache struct {
 	uploader   *s3manager.Uploader
 	prefix     string
 	ttlInDays  int64
+	// Bumps the TTLs of stale objects that were read, in the background.
+	toucher *toucher.Toucher
 }
 
 func NewS3Cache(awsConfig *config.S3CacheConfig) (*S3Cache, error) {
@@ -69,6 +77,10 @@ func NewS3Cache(awsConfig *config.S3CacheConfig) (*S3Cache, error) {
 		uploader:   s3manager.NewUploader(sess),
 		ttlInDays:  awsConfig.TTLDays,
 	}
+	s3c.toucher, err = toucher.New(s3c.bumpTTLs, &toucher.Opts{MinTouchInterval: minTTLBumpInterval})
+	if err != nil {
+		return nil, err
+	}
 
 	// S3 access points can't modify or delete buckets
 	// https://github.com/awsdocs/amazon-s3-developer-guide/blob/master/doc_source/access-points.md
@@ -190,6 +202,7 @@ func (s3c *S3Cache) WithPrefix(prefix string) interfaces.Cache {
 		uploader:   s3c.uploader,
 		ttlInDays:  s3c.ttlInDays,
 		prefix:     newPrefix,
+		toucher:    s3c.toucher,
 	}
 }
 
@@ -201,6 +214,11 @@ func (s3c *S3Cache) Get(ctx context.Context, d *repb.Digest) ([]byte, error) {
 	timer := cache_metrics.NewCacheTimer(cacheLabels)
 	b, err := s3c.get(ctx, d, k)
 	timer.ObserveGet(len(b), err)
+	if err == nil {
+		// The download doesn't report when the object was last modified,
+		// so let the toucher check whether it is stale.
+		s3c.toucher.Touch(k)
+	}
 	return b, err
 }
 
@@ -305,24 +323,45 @@ func (s3c *S3Cache) delete(ctx context.Context, key string) error {
 	})
 }
 
-func (s3c *S3Cache) bumpTTLIfStale(ctx context.Context, key string, t time.Time) bool {
-	if int64(time.Since(t).Hours()) < 24*s3c.ttlInDays/2 {
-		return true
-	}
-	input := &s3.CopyObjectInput{
-		CopySource:        aws.String(fmt.Sprintf("%s/%s", *s3c.bucket, key)),
-		Bucket:            s3c.bucket,
-		Key:               aws.String(key),
-		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
-	}
-	_, err := s3c.s3.CopyObject(input)
-	if isNotFoundErr(err) {
-		return false
+func (s3c *S3Cache) isStale(lastModified time.Time) bool {
+	return int64(time.Since(lastModified).Hours()) >= 24*s3c.ttlInDays/2
+}
+
+// touchIfStale schedules a TTL bump for the object with the given key, if it
+// was last written more than half of the TTL ago.
+func (s3c *S3Cache) touchIfStale(key string, lastModified time.Time) {
+	if s3c.isStale(lastModified) {
+		s3c.toucher.Touch(key)
 	}
-	if err != nil {
-		log.Printf("Error bumping TTL for key %s: %s", key, err.Error())
+}
+
+// bumpTTLs rewrites those objects with the given keys which are stale,
+// resetting their age.
+func (s3c *S3Cache) bumpTTLs(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		head, err := s3c.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: s3c.bucket,
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			if !isNotFoundErr(err) {
+				log.Printf("Error checking TTL for key %s: %s", key, err.Error())
+			}
+			continue
+		}
+		if !s3c.isStale(*head.LastModified) {
+			continue
+		}
+		input := &s3.CopyObjectInput{
+			CopySource:        aws.String(fmt.Sprintf("%s/%s", *s3c.bucket, key)),
+			Bucket:            s3c.bucket,
+			Key:               aws.String(key),
+			MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+		}
+		if _, err := s3c.s3.CopyObjectWithContext(ctx, input); err != nil && !isNotFoundErr(err) {
+			log.Printf("Error bumping TTL for key %s: %s", key, err.Error())
+		}
 	}
-	return true
 }
 
 func (s3c *S3Cache) Contains(ctx context.Context, d *repb.Digest) (bool, error) {
@@ -349,7 +388,8 @@ func (s3c *S3Cache) contains(ctx context.Context, key string) (bool, error) {
 		}
 		return false, err
 	}
-	return s3c.bumpTTLIfStale(ctx, key, *head.LastModified), nil
+	s3c.touchIfStale(key, *head.LastModified)
+	return true, nil
 }
 
 func (s3c *S3Cache) ContainsMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest]bool, error) {
@@ -395,8 +435,14 @@ func (s3c *S3Cache) Reader(ctx context.Context, d *repb.Digest, offset int64) (i
 	if isNotFoundErr(err) {
 		return nil, status.NotFoundErrorf("Digest '%s/%d' not found in cache", d.GetHash(), d.GetSizeBytes())
 	}
+	if err != nil {
+		return nil, err
+	}
+	if result.LastModified != nil {
+		s3c.touchIfStale(k, *result.LastModified)
+	}
 	timer := cache_metrics.NewCacheTimer(cacheLabels)
-	return io.NopCloser(timer.NewInstrumentedReader(result.Body, d.GetSizeBytes())), err
+	return io.NopCloser(timer.NewInstrumentedReader(result.Body, d.GetSizeBytes())), nil
 }
 
 type waitForUploadWriteCloser struct {
@@ -0,0 +1,316 @@
+package upstream_cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/auth"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+)
+
+// UpstreamCache is a cache backed by the remote cache APIs of another
+// BuildBuddy server. Proxy deployments put it behind a local cache so that
+// local misses are read through to, and writes are forwarded to, a central
+// BuildBuddy.
+//
+// Credentials presented by the client are forwarded upstream; the cache has
+// none of its own.
+type UpstreamCache struct {
+	acClient  repb.ActionCacheClient
+	casClient repb.ContentAddressableStorageClient
+	bsClient  bspb.ByteStreamClient
+
+	// The remote instance name and whether this is the action cache, as
+	// determined from the prefixes applied by the namespace package.
+	instanceName string
+	isAC         bool
+	hasPrefix    bool
+}
+
+func NewUpstreamCache(conn grpc.ClientConnInterface) *UpstreamCache {
+	return &UpstreamCache{
+		acClient:  repb.NewActionCacheClient(conn),
+		casClient: repb.NewContentAddressableStorageClient(conn),
+		bsClient:  bspb.NewByteStreamClient(conn),
+	}
+}
+
+func (c *UpstreamCache) WithPrefix(prefix string) interfaces.Cache {
+	clone := *c
+	if prefix == namespace.ACCachePrefix {
+		clone.isAC = true
+	} else if !c.hasPrefix {
+		clone.instanceName = prefix
+	}
+	clone.hasPrefix = true
+	return &clone
+}
+
+// outgoingContext forwards the client's API key to the upstream server.
+func (c *UpstreamCache) outgoingContext(ctx context.Context) context.Context {
+	return WithForwardedCredentials(ctx)
+}
+
+// WithForwardedCredentials returns a context whose outgoing metadata carries
+// the API key presented by the incoming request, if any.
+func WithForwardedCredentials(ctx context.Context) context.Context {
+	if apiKey := ClientAPIKey(ctx); apiKey != "" {
+		return metadata.AppendToOutgoingContext(ctx, auth.APIKeyHeader, apiKey)
+	}
+	return ctx
+}
+
+// ClientAPIKey returns the API key presented by the incoming request, or ""
+// if it has none.
+func ClientAPIKey(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if keys := md.Get(auth.APIKeyHeader); len(keys) > 0 {
+		return strings.TrimSpace(keys[0])
+	}
+	return ""
+}
+
+func (c *UpstreamCache) instanceNameDigest(d *repb.Digest) *digest.InstanceNameDigest {
+	return digest.NewInstanceNameDigest(d, c.instanceName)
+}
+
+func (c *UpstreamCache) Contains(ctx context.Context, d *repb.Digest) (bool, error) {
+	found, err := c.ContainsMulti(ctx, []*repb.Digest{d})
+	if err != nil {
+		return false, err
+	}
+	return found[d], nil
+}
+
+func (c *UpstreamCache) ContainsMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest]bool, error) {
+	ctx = c.outgoingContext(ctx)
+	found := make(map[*repb.Digest]bool, len(digests))
+	if c.isAC {
+		for _, d := range digests {
+			_, err := cachetools.GetActionResult(ctx, c.acClient, c.instanceNameDigest(d))
+			if err != nil && !status.IsNotFoundError(err) {
+				return nil, err
+			}
+			found[d] = err == nil
+		}
+		return found, nil
+	}
+	rsp, err := c.casClient.FindMissingBlobs(ctx, &repb.FindMissingBlobsRequest{
+		InstanceName: c.instanceName,
+		BlobDigests:  digests,
+	})
+	if err != nil {
+		return nil, err
+	}
+	missing := make(map[digest.Key]struct{}, len(rsp.GetMissingBlobDigests()))
+	for _, d := range rsp.GetMissingBlobDigests() {
+		missing[digest.NewKey(d)] = struct{}{}
+	}
+	for _, d := range digests {
+		_, isMissing := missing[digest.NewKey(d)]
+		found[d] = !isMissing
+	}
+	return found, nil
+}
+
+func (c *UpstreamCache) Get(ctx context.Context, d *repb.Digest) ([]byte, error) {
+	ctx = c.outgoingContext(ctx)
+	if c.isAC {
+		ar, err := cachetools.GetActionResult(ctx, c.acClient, c.instanceNameDigest(d))
+		if err != nil {
+			return nil, err
+		}
+		return proto.Marshal(ar)
+	}
+	buf := &bytes.Buffer{}
+	if err := cachetools.GetBlob(ctx, c.bsClient, c.instanceNameDigest(d), buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *UpstreamCache) GetMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest][]byte, error) {
+	foundMap := make(map[*repb.Digest][]byte, len(digests))
+	for _, d := range digests {
+		data, err := c.Get(ctx, d)
+		if status.IsNotFoundError(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		foundMap[d] = data
+	}
+	return foundMap, nil
+}
+
+func (c *UpstreamCache) Set(ctx context.Context, d *repb.Digest, data []byte) error {
+	if c.isAC {
+		ar := &repb.ActionResult{}
+		if err := proto.Unmarshal(data, ar); err != nil {
+			return status.InvalidArgumentErrorf("invalid ActionResult: %s", err)
+		}
+		return cachetools.UploadActionResult(c.outgoingContext(ctx), c.acClient, c.instanceNameDigest(d), ar)
+	}
+	w, err := c.Writer(ctx, d)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func (c *UpstreamCache) SetMulti(ctx context.Context, kvs map[*repb.Digest][]byte) error {
+	for d, data := range kvs {
+		if err := c.Set(ctx, d, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *UpstreamCache) Delete(ctx context.Context, d *repb.Digest) error {
+	return status.UnimplementedError("Delete is not supported by the upstream cache")
+}
+
+func (c *UpstreamCache) Reader(ctx context.Context, d *repb.Digest, offset int64) (io.ReadCloser, error) {
+	if c.isAC {
+		data, err := c.Get(ctx, d)
+		if err != nil {
+			return nil, err
+		}
+		if offset > int64(len(data)) {
+			return nil, status.OutOfRangeErrorf("offset %d is past the end of the blob", offset)
+		}
+		return io.NopCloser(bytes.NewReader(data[offset:])), nil
+	}
+	ctx, cancel := context.WithCancel(c.outgoingContext(ctx))
+	stream, err := c.bsClient.Read(ctx, &bspb.ReadRequest{
+		ResourceName: digest.DownloadResourceName(d, c.instanceName),
+		ReadOffset:   offset,
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &streamReader{stream: stream, cancel: cancel}, nil
+}
+
+func (c *UpstreamCache) Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser, error) {
+	if c.isAC {
+		return &acWriter{ctx: ctx, cache: c, d: d}, nil
+	}
+	resourceName, err := digest.UploadResourceName(d, c.instanceName)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(c.outgoingContext(ctx))
+	stream, err := c.bsClient.Write(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &streamWriter{stream: stream, cancel: cancel, resourceName: resourceName}, nil
+}
+
+// streamReader adapts a ByteStream read stream to an io.ReadCloser.
+type streamReader struct {
+	stream bspb.ByteStream_ReadClient
+	cancel context.CancelFunc
+	buf    []byte
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		rsp, err := r.stream.Recv()
+		if err != nil {
+			if status.IsNotFoundError(err) {
+				return 0, status.NotFoundError(err.Error())
+			}
+			return 0, err
+		}
+		r.buf = rsp.GetData()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *streamReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+// streamWriter adapts a ByteStream write stream to an io.WriteCloser.
+type streamWriter struct {
+	stream       bspb.ByteStream_WriteClient
+	cancel       context.CancelFunc
+	resourceName string
+	offset       int64
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	req := &bspb.WriteRequest{
+		Data:        p,
+		WriteOffset: w.offset,
+	}
+	if w.offset == 0 {
+		req.ResourceName = w.resourceName
+	}
+	if err := w.stream.Send(req); err != nil {
+		if err == io.EOF {
+			// The server has closed the stream (e.g. because the blob
+			// already exists); the real status is returned by Close.
+			w.offset += int64(len(p))
+			return len(p), nil
+		}
+		return 0, err
+	}
+	w.offset += int64(len(p))
+	return len(p), nil
+}
+
+func (w *streamWriter) Close() error {
+	defer w.cancel()
+	req := &bspb.WriteRequest{
+		WriteOffset: w.offset,
+		FinishWrite: true,
+	}
+	if w.offset == 0 {
+		req.ResourceName = w.resourceName
+	}
+	if err := w.stream.Send(req); err != nil && err != io.EOF {
+		return err
+	}
+	_, err := w.stream.CloseAndRecv()
+	return err
+}
+
+// acWriter buffers a serialized ActionResult and uploads it on Close.
+type acWriter struct {
+	bytes.Buffer
+	ctx   context.Context
+	cache *UpstreamCache
+	d     *repb.Digest
+}
+
+func (w *acWriter) Close() error {
+	return w.cache.Set(w.ctx, w.d, w.Bytes())
+}
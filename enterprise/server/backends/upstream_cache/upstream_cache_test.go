@@ -0,0 +1,108 @@
+package upstream_cache_test
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/upstream_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/action_cache_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/byte_stream_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/content_addressable_storage_server"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+)
+
+func newUpstreamCache(t *testing.T) *upstream_cache.UpstreamCache {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+
+	casServer, err := content_addressable_storage_server.NewContentAddressableStorageServer(te)
+	require.NoError(t, err)
+	bsServer, err := byte_stream_server.NewByteStreamServer(te)
+	require.NoError(t, err)
+	acServer, err := action_cache_server.NewActionCacheServer(te)
+	require.NoError(t, err)
+
+	grpcServer, runFunc := te.LocalGRPCServer()
+	repb.RegisterContentAddressableStorageServer(grpcServer, casServer)
+	bspb.RegisterByteStreamServer(grpcServer, bsServer)
+	repb.RegisterActionCacheServer(grpcServer, acServer)
+	go runFunc()
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := te.LocalGRPCConn(ctx)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return upstream_cache.NewUpstreamCache(conn)
+}
+
+func TestCASRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	uc := newUpstreamCache(t)
+	c := uc.WithPrefix("instance")
+
+	d, buf := testdigest.NewRandomDigestBuf(t, 1000)
+	found, err := c.Contains(ctx, d)
+	require.NoError(t, err)
+	require.False(t, found)
+	_, err = c.Get(ctx, d)
+	require.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+
+	require.NoError(t, c.Set(ctx, d, buf))
+
+	found, err = c.Contains(ctx, d)
+	require.NoError(t, err)
+	require.True(t, found)
+	data, err := c.Get(ctx, d)
+	require.NoError(t, err)
+	require.Equal(t, buf, data)
+
+	r, err := c.Reader(ctx, d, 10)
+	require.NoError(t, err)
+	data, err = io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, buf[10:], data)
+
+	// Blobs are namespaced by instance name upstream.
+	found, err = uc.WithPrefix("other").Contains(ctx, d)
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestACRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	uc := newUpstreamCache(t)
+	c := uc.WithPrefix("instance").WithPrefix("ac")
+
+	d, _ := testdigest.NewRandomDigestBuf(t, 100)
+	ar := &repb.ActionResult{ExitCode: 3}
+	buf, err := proto.Marshal(ar)
+	require.NoError(t, err)
+
+	found, err := c.Contains(ctx, d)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	require.NoError(t, c.Set(ctx, d, buf))
+
+	found, err = c.Contains(ctx, d)
+	require.NoError(t, err)
+	require.True(t, found)
+	data, err := c.Get(ctx, d)
+	require.NoError(t, err)
+	got := &repb.ActionResult{}
+	require.NoError(t, proto.Unmarshal(data, got))
+	require.Equal(t, ar.GetExitCode(), got.GetExitCode())
+
+	// Action results are namespaced by instance name upstream.
+	_, err = uc.WithPrefix("ac").Get(ctx, d)
+	require.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+}
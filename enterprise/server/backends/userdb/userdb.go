@@ -322,10 +322,13 @@ func (d *UserDB) InsertOrUpdateGroup(ctx context.Context, g *tables.Group) (stri
 		groupID = g.GroupID
 		res := tx.Exec(`
 			UPDATE Groups SET name = ?, url_identifier = ?, owned_domain = ?, sharing_enabled = ?, 
-				use_group_owned_executors = ?
+				use_group_owned_executors = ?, allowed_cache_namespaces = ?, cache_warming_enabled = ?,
+				console_log_index_enabled = ?, default_platform_properties = ?, forced_platform_properties = ?,
+				bes_forwarding_target = ?
 			WHERE group_id = ?`,
 			g.Name, g.URLIdentifier, g.OwnedDomain, g.SharingEnabled, g.UseGroupOwnedExecutors,
-			g.GroupID)
+			g.AllowedCacheNamespaces, g.CacheWarmingEnabled, g.ConsoleLogIndexEnabled,
+			g.DefaultPlatformProperties, g.ForcedPlatformProperties, g.BESForwardingTarget, g.GroupID)
 		if res.Error != nil {
 			return res.Error
 		}
@@ -0,0 +1,565 @@
+package build_event_spool
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/auth"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/grpc/metadata"
+
+	bepb "github.com/buildbuddy-io/buildbuddy/proto/build_events"
+	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
+)
+
+const (
+	// Streams that are still being received are written to files with this
+	// extension, and renamed once the client has finished the stream.
+	tmpExtension   = ".spool.tmp"
+	spoolExtension = ".spool"
+
+	// How often spooled streams are forwarded when no new stream has
+	// completed in the meantime. Also bounds how quickly forwarding is
+	// retried after the upstream server becomes unavailable.
+	forwardInterval = 10 * time.Second
+
+	// How long an unfinished stream may go without being written to before
+	// its client is assumed to have given up on it. Events that were already
+	// acknowledged are then forwarded as they are, rather than waiting for a
+	// retry that will never come.
+	abandonedStreamTimeout = 10 * time.Minute
+
+	// The maximum size of a single spooled record.
+	maxRecordSize = 64 * 1024 * 1024
+)
+
+var errMissingAPIKey = status.UnauthenticatedError("build events must be published with an API key")
+
+// Spool is a PublishBuildEvent server that acknowledges build events as soon
+// as they are written to local disk, and forwards them to an upstream server
+// in the background. This lets builds on the local network finish without
+// waiting on (or failing because of) the link to the upstream server.
+//
+// Each build event stream is spooled to its own file, named after the stream
+// so that a client retrying a failed stream appends to the events that were
+// already acknowledged. Finished files are forwarded in the order in which
+// their streams started, and are deleted only after the upstream server has
+// acknowledged every event in them. Unfinished files survive restarts; they
+// are resumed by the client's retry or, once abandoned, forwarded as they are.
+//
+// Streams must be published with an API key, which is forwarded upstream on
+// the client's behalf. Spool files hold the key so that they can be forwarded
+// after a restart, and are only readable by their owner.
+type Spool struct {
+	dir    string
+	client pepb.PublishBuildEventClient
+
+	// The names of the unfinished spool files that streams are currently
+	// being received into.
+	mu     sync.Mutex
+	active map[string]struct{}
+
+	wake chan struct{}
+	quit chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// NewSpool returns a spool that writes streams under dir and forwards them
+// using client.
+func NewSpool(dir string, client pepb.PublishBuildEventClient) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, status.InternalErrorf("could not create spool directory %q: %s", dir, err)
+	}
+	// The directory may predate the spool, so make sure that other users
+	// can't read the API keys in it.
+	if err := os.Chmod(dir, 0700); err != nil {
+		return nil, status.InternalErrorf("could not restrict permissions of spool directory %q: %s", dir, err)
+	}
+	return &Spool{
+		dir:    dir,
+		client: client,
+		active: make(map[string]struct{}),
+		wake:   make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// Start starts forwarding spooled streams to the upstream server.
+func (s *Spool) Start() {
+	go func() {
+		defer close(s.done)
+		for {
+			s.commitAbandoned()
+			s.forwardAll()
+			select {
+			case <-s.quit:
+				return
+			case <-s.wake:
+			case <-time.After(forwardInterval):
+			}
+		}
+	}()
+}
+
+// Stop stops forwarding. Streams that have not been forwarded yet remain on
+// disk and are forwarded the next time the spool is started.
+func (s *Spool) Stop(ctx context.Context) error {
+	s.once.Do(func() { close(s.quit) })
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Spool) PublishLifecycleEvent(ctx context.Context, req *pepb.PublishLifecycleEventRequest) (*empty.Empty, error) {
+	apiKey := apiKeyFromContext(ctx)
+	if apiKey == "" {
+		return nil, errMissingAPIKey
+	}
+	// Lifecycle events are informational; forward them on a best-effort
+	// basis rather than holding up the client.
+	outCtx := s.outgoingContext(context.Background(), apiKey)
+	go func() {
+		ctx, cancel := context.WithTimeout(outCtx, forwardInterval)
+		defer cancel()
+		if _, err := s.client.PublishLifecycleEvent(ctx, req); err != nil {
+			log.Warningf("Error forwarding lifecycle event: %s", err)
+		}
+	}()
+	return &empty.Empty{}, nil
+}
+
+func (s *Spool) PublishBuildToolEventStream(stream pepb.PublishBuildEvent_PublishBuildToolEventStreamServer) error {
+	apiKey := apiKeyFromContext(stream.Context())
+	if apiKey == "" {
+		return errMissingAPIKey
+	}
+	var sf *spoolFile
+	defer func() {
+		if sf != nil {
+			s.release(sf)
+		}
+	}()
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Events that were already acknowledged stay spooled, and the
+			// client's retry of the stream picks up after them.
+			return err
+		}
+		if sf == nil {
+			if sf, err = s.open(req.GetOrderedBuildEvent().GetStreamId(), apiKey); err != nil {
+				return err
+			}
+		}
+		if err := sf.write(req); err != nil {
+			return err
+		}
+		rsp := &pepb.PublishBuildToolEventStreamResponse{
+			StreamId:       req.GetOrderedBuildEvent().GetStreamId(),
+			SequenceNumber: req.GetOrderedBuildEvent().GetSequenceNumber(),
+		}
+		if err := stream.Send(rsp); err != nil {
+			return err
+		}
+	}
+
+	if sf == nil {
+		return nil
+	}
+	if err := sf.f.Close(); err != nil {
+		return status.UnavailableErrorf("could not close spool file: %s", err)
+	}
+	if err := commit(sf.path); err != nil {
+		return err
+	}
+	s.notify()
+	return nil
+}
+
+// spoolFile is an unfinished spool file that a stream is being received into.
+type spoolFile struct {
+	name string
+	path string
+	f    *os.File
+	w    *bufio.Writer
+	// The sequence number of the last event in the file. Events up to and
+	// including it are acknowledged again, but not rewritten, when the client
+	// retries the stream.
+	lastSequenceNumber int64
+}
+
+func (sf *spoolFile) write(req *pepb.PublishBuildToolEventStreamRequest) error {
+	seq := req.GetOrderedBuildEvent().GetSequenceNumber()
+	if seq <= sf.lastSequenceNumber {
+		return nil
+	}
+	buf, err := proto.Marshal(req)
+	if err != nil {
+		return status.InternalErrorf("could not marshal build event: %s", err)
+	}
+	if err := writeRecord(sf.w, buf); err != nil {
+		return status.UnavailableErrorf("could not write spool file: %s", err)
+	}
+	// Events must be durable before they are acknowledged, since the client
+	// will not resend acknowledged events.
+	if err := sf.w.Flush(); err != nil {
+		return status.UnavailableErrorf("could not write spool file: %s", err)
+	}
+	if err := sf.f.Sync(); err != nil {
+		return status.UnavailableErrorf("could not sync spool file: %s", err)
+	}
+	sf.lastSequenceNumber = seq
+	return nil
+}
+
+// open opens the unfinished spool file of the given stream for writing,
+// creating it if the stream hasn't been spooled before.
+func (s *Spool) open(streamID *bepb.StreamId, apiKey string) (*spoolFile, error) {
+	// The file is located by the stream's ID alone, since its name starts
+	// with the time at which the stream was first received.
+	h := sha256.Sum256([]byte(streamID.GetBuildId() + "/" + streamID.GetInvocationId() + "/" + streamID.GetComponent().String()))
+	streamKey := hex.EncodeToString(h[:16])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	matches, err := filepath.Glob(filepath.Join(s.dir, "*-"+streamKey+tmpExtension))
+	if err != nil {
+		return nil, status.InternalError(err.Error())
+	}
+	if len(matches) == 0 {
+		name := fmt.Sprintf("%020d-%s%s", time.Now().UnixNano(), streamKey, tmpExtension)
+		sf, err := create(filepath.Join(s.dir, name), apiKey)
+		if err != nil {
+			return nil, err
+		}
+		sf.name = name
+		s.active[name] = struct{}{}
+		return sf, nil
+	}
+
+	name := filepath.Base(matches[0])
+	if _, ok := s.active[name]; ok {
+		// The client gave up on the stream before its previous attempt
+		// noticed; it will retry again.
+		return nil, status.UnavailableErrorf("stream %q is already being received", streamID.GetInvocationId())
+	}
+	sf, err := resume(matches[0], apiKey)
+	if err != nil {
+		return nil, err
+	}
+	sf.name = name
+	s.active[name] = struct{}{}
+	return sf, nil
+}
+
+func (s *Spool) release(sf *spoolFile) {
+	sf.f.Close()
+	s.mu.Lock()
+	delete(s.active, sf.name)
+	s.mu.Unlock()
+}
+
+func create(path, apiKey string) (*spoolFile, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, status.UnavailableErrorf("could not create spool file: %s", err)
+	}
+	sf := &spoolFile{path: path, f: f, w: bufio.NewWriter(f)}
+	if err := writeRecord(sf.w, []byte(apiKey)); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, status.UnavailableErrorf("could not write spool file: %s", err)
+	}
+	return sf, nil
+}
+
+// resume opens an unfinished spool file to append the rest of its stream.
+func resume(path, apiKey string) (*spoolFile, error) {
+	scan, err := scanSpoolFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if scan.apiKey != apiKey {
+		return nil, status.PermissionDeniedError("stream was started with a different API key")
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, status.UnavailableErrorf("could not open spool file: %s", err)
+	}
+	// Drop whatever part of a record was written before the process
+	// exited; that event was never acknowledged, so it will be resent.
+	if err := f.Truncate(scan.size); err != nil {
+		f.Close()
+		return nil, status.UnavailableErrorf("could not truncate spool file: %s", err)
+	}
+	if _, err := f.Seek(scan.size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, status.UnavailableErrorf("could not seek spool file: %s", err)
+	}
+	return &spoolFile{
+		path:               path,
+		f:                  f,
+		w:                  bufio.NewWriter(f),
+		lastSequenceNumber: scan.lastSequenceNumber,
+	}, nil
+}
+
+type spoolFileScan struct {
+	apiKey             string
+	lastSequenceNumber int64
+	// The size of the complete records in the file.
+	size int64
+}
+
+// scanSpoolFile reads the complete records of an unfinished spool file,
+// ignoring a partial record at its end.
+func scanSpoolFile(path string) (*spoolFileScan, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, status.UnavailableErrorf("could not open spool file: %s", err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	apiKey, err := readRecord(r)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("corrupt spool file: %s", err)
+	}
+	scan := &spoolFileScan{apiKey: string(apiKey), size: recordSize(apiKey)}
+	for {
+		buf, err := readRecord(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return scan, nil
+		}
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("corrupt spool file: %s", err)
+		}
+		req := &pepb.PublishBuildToolEventStreamRequest{}
+		if err := proto.Unmarshal(buf, req); err != nil {
+			return nil, status.InvalidArgumentErrorf("corrupt spool file: %s", err)
+		}
+		scan.lastSequenceNumber = req.GetOrderedBuildEvent().GetSequenceNumber()
+		scan.size += recordSize(buf)
+	}
+}
+
+// commit marks the unfinished spool file at path as ready to be forwarded.
+func commit(path string) error {
+	if err := os.Rename(path, strings.TrimSuffix(path, tmpExtension)+spoolExtension); err != nil {
+		return status.UnavailableErrorf("could not commit spool file: %s", err)
+	}
+	return nil
+}
+
+// commitAbandoned commits the unfinished spool files whose streams have not
+// been written to for abandonedStreamTimeout, including those left over from
+// before a restart, so that the events acknowledged in them are forwarded.
+func (s *Spool) commitAbandoned() {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"+tmpExtension))
+	if err != nil {
+		log.Errorf("Could not list spool directory: %s", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, path := range paths {
+		if _, ok := s.active[filepath.Base(path)]; ok {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || time.Since(info.ModTime()) < abandonedStreamTimeout {
+			continue
+		}
+		scan, err := scanSpoolFile(path)
+		if err == nil {
+			err = os.Truncate(path, scan.size)
+		}
+		if err == nil {
+			err = commit(path)
+		}
+		if err != nil {
+			log.Warningf("Could not commit abandoned spool file %q: %s", filepath.Base(path), err)
+			continue
+		}
+		log.Infof("Forwarding abandoned build event stream %q", filepath.Base(path))
+	}
+}
+
+func (s *Spool) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// forwardAll forwards completed spool files in order, stopping at the first
+// file that cannot be forwarded so that it is retried before any later one.
+func (s *Spool) forwardAll() {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"+spoolExtension))
+	if err != nil {
+		log.Errorf("Could not list spool directory: %s", err)
+		return
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		select {
+		case <-s.quit:
+			return
+		default:
+		}
+		if err := s.forward(path); err != nil {
+			if status.IsInvalidArgumentError(err) {
+				// The upstream server will never accept this stream, so
+				// retrying would block every stream spooled after it.
+				log.Errorf("Dropping spooled build event stream %q: %s", filepath.Base(path), err)
+				os.Remove(path)
+				continue
+			}
+			log.Warningf("Could not forward spooled build event stream %q, will retry: %s", filepath.Base(path), err)
+			return
+		}
+		if err := os.Remove(path); err != nil {
+			log.Warningf("Could not remove forwarded spool file %q: %s", path, err)
+		}
+	}
+}
+
+func (s *Spool) forward(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	apiKey, err := readRecord(r)
+	if err != nil {
+		return status.InvalidArgumentErrorf("corrupt spool file: %s", err)
+	}
+	var events []*pepb.PublishBuildToolEventStreamRequest
+	for {
+		buf, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return status.InvalidArgumentErrorf("corrupt spool file: %s", err)
+		}
+		req := &pepb.PublishBuildToolEventStreamRequest{}
+		if err := proto.Unmarshal(buf, req); err != nil {
+			return status.InvalidArgumentErrorf("corrupt spool file: %s", err)
+		}
+		events = append(events, req)
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(s.outgoingContext(context.Background(), string(apiKey)))
+	defer cancel()
+	stream, err := s.client.PublishBuildToolEventStream(ctx)
+	if err != nil {
+		return err
+	}
+	sendErr := make(chan error, 1)
+	go func() {
+		for _, req := range events {
+			if err := stream.Send(req); err != nil {
+				sendErr <- err
+				return
+			}
+		}
+		sendErr <- stream.CloseSend()
+	}()
+	acked := 0
+	for {
+		_, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		acked++
+	}
+	if err := <-sendErr; err != nil && err != io.EOF {
+		return err
+	}
+	if acked < len(events) {
+		return status.UnavailableErrorf("upstream acknowledged %d of %d events", acked, len(events))
+	}
+	return nil
+}
+
+func (s *Spool) outgoingContext(ctx context.Context, apiKey string) context.Context {
+	if apiKey == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, auth.APIKeyHeader, apiKey)
+}
+
+func apiKeyFromContext(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if keys := md.Get(auth.APIKeyHeader); len(keys) > 0 {
+		return strings.TrimSpace(keys[0])
+	}
+	return ""
+}
+
+func writeRecord(w io.Writer, buf []byte) error {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(buf)))
+	if _, err := w.Write(lenBuf[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// recordSize returns the size of the record holding buf.
+func recordSize(buf []byte) int64 {
+	var lenBuf [binary.MaxVarintLen64]byte
+	return int64(binary.PutUvarint(lenBuf[:], uint64(len(buf))) + len(buf))
+}
+
+func readRecord(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxRecordSize {
+		return nil, status.InvalidArgumentErrorf("record size %d exceeds limit", size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,254 @@
+package build_event_spool_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/auth"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/build_event_spool"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+
+	bepb "github.com/buildbuddy-io/buildbuddy/proto/build_events"
+	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
+)
+
+const apiKey = "abc123"
+
+// fakeUpstream records the events forwarded to it, along with the API keys
+// they were forwarded with.
+type fakeUpstream struct {
+	mu      sync.Mutex
+	events  []int64
+	apiKeys []string
+}
+
+func (u *fakeUpstream) PublishLifecycleEvent(ctx context.Context, req *pepb.PublishLifecycleEventRequest) (*empty.Empty, error) {
+	return &empty.Empty{}, nil
+}
+
+func (u *fakeUpstream) PublishBuildToolEventStream(stream pepb.PublishBuildEvent_PublishBuildToolEventStreamServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		u.mu.Lock()
+		u.events = append(u.events, req.GetOrderedBuildEvent().GetSequenceNumber())
+		u.apiKeys = append(u.apiKeys, md.Get(auth.APIKeyHeader)...)
+		u.mu.Unlock()
+		rsp := &pepb.PublishBuildToolEventStreamResponse{
+			StreamId:       req.GetOrderedBuildEvent().GetStreamId(),
+			SequenceNumber: req.GetOrderedBuildEvent().GetSequenceNumber(),
+		}
+		if err := stream.Send(rsp); err != nil {
+			return err
+		}
+	}
+}
+
+func (u *fakeUpstream) received() []int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]int64{}, u.events...)
+}
+
+// serve serves the PublishBuildEvent server over an in-memory connection, and
+// returns a client for it.
+func serve(t *testing.T, server pepb.PublishBuildEventServer) pepb.PublishBuildEventClient {
+	lis := bufconn.Listen(1024 * 1024)
+	srv := grpc.NewServer()
+	pepb.RegisterPublishBuildEventServer(srv, server)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return lis.Dial()
+	}))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return pepb.NewPublishBuildEventClient(conn)
+}
+
+func newSpool(t *testing.T, dir string, upstream pepb.PublishBuildEventClient) (*build_event_spool.Spool, pepb.PublishBuildEventClient) {
+	spool, err := build_event_spool.NewSpool(dir, upstream)
+	require.NoError(t, err)
+	return spool, serve(t, spool)
+}
+
+func request(seq int64) *pepb.PublishBuildToolEventStreamRequest {
+	return &pepb.PublishBuildToolEventStreamRequest{
+		OrderedBuildEvent: &pepb.OrderedBuildEvent{
+			StreamId: &bepb.StreamId{
+				BuildId:      "build",
+				InvocationId: "invocation",
+				Component:    bepb.StreamId_TOOL,
+			},
+			SequenceNumber: seq,
+		},
+	}
+}
+
+// publish publishes the events with the given sequence numbers, waiting for
+// each of them to be acknowledged. Unless finish is set, the stream is then
+// broken off, as if the connection to the client was lost.
+func publish(ctx context.Context, client pepb.PublishBuildEventClient, finish bool, seqs ...int64) error {
+	ctx, cancel := context.WithCancel(metadata.AppendToOutgoingContext(ctx, auth.APIKeyHeader, apiKey))
+	defer cancel()
+	stream, err := client.PublishBuildToolEventStream(ctx)
+	if err != nil {
+		return err
+	}
+	for _, seq := range seqs {
+		if err := stream.Send(request(seq)); err != nil {
+			return err
+		}
+		if _, err := stream.Recv(); err != nil {
+			return err
+		}
+	}
+	if !finish {
+		return nil
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	_, err = stream.Recv()
+	if err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func waitForForwarded(t *testing.T, upstream *fakeUpstream, want []int64) {
+	require.Eventually(t, func() bool {
+		return len(upstream.received()) >= len(want)
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, want, upstream.received())
+}
+
+func spoolFiles(t *testing.T, dir, extension string) []string {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+extension))
+	require.NoError(t, err)
+	return paths
+}
+
+func TestFinishedStreamIsForwarded(t *testing.T) {
+	ctx := context.Background()
+	dir := testfs.MakeTempDir(t)
+	upstream := &fakeUpstream{}
+	spool, client := newSpool(t, dir, serve(t, upstream))
+
+	require.NoError(t, publish(ctx, client, true, 1, 2, 3))
+	spool.Start()
+	defer spool.Stop(ctx)
+
+	waitForForwarded(t, upstream, []int64{1, 2, 3})
+	upstream.mu.Lock()
+	assert.Equal(t, []string{apiKey, apiKey, apiKey}, upstream.apiKeys)
+	upstream.mu.Unlock()
+	require.Eventually(t, func() bool {
+		return len(spoolFiles(t, dir, ".spool")) == 0
+	}, 10*time.Second, 10*time.Millisecond)
+
+	info, err := os.Stat(dir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+}
+
+func TestFailedStreamIsResumedByRetry(t *testing.T) {
+	ctx := context.Background()
+	dir := testfs.MakeTempDir(t)
+	upstream := &fakeUpstream{}
+	spool, client := newSpool(t, dir, serve(t, upstream))
+
+	require.NoError(t, publish(ctx, client, false, 1, 2))
+	// The acknowledged events must be kept after the stream fails.
+	require.Len(t, spoolFiles(t, dir, ".spool.tmp"), 1)
+
+	// The client resends the events that it didn't see acknowledged, or, as
+	// here, all of them. The failed attempt may still be winding down, in
+	// which case the retry is rejected as unavailable.
+	require.Eventually(t, func() bool {
+		return publish(ctx, client, true, 1, 2, 3) == nil
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Len(t, spoolFiles(t, dir, ".spool.tmp"), 0)
+
+	spool.Start()
+	defer spool.Stop(ctx)
+	waitForForwarded(t, upstream, []int64{1, 2, 3})
+}
+
+func TestUnfinishedStreamIsForwardedAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	dir := testfs.MakeTempDir(t)
+	upstream := &fakeUpstream{}
+	upstreamClient := serve(t, upstream)
+	_, client := newSpool(t, dir, upstreamClient)
+
+	require.NoError(t, publish(ctx, client, false, 1, 2))
+	paths := spoolFiles(t, dir, ".spool.tmp")
+	require.Len(t, paths, 1)
+
+	// Simulate a crash in the middle of writing the next event, after which
+	// the client never comes back.
+	f, err := os.OpenFile(paths[0], os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0x10, 0x01})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(paths[0], past, past))
+
+	restarted, _ := newSpool(t, dir, upstreamClient)
+	restarted.Start()
+	defer restarted.Stop(ctx)
+	waitForForwarded(t, upstream, []int64{1, 2})
+}
+
+func TestUnfinishedStreamIsResumedAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	dir := testfs.MakeTempDir(t)
+	upstream := &fakeUpstream{}
+	upstreamClient := serve(t, upstream)
+	_, client := newSpool(t, dir, upstreamClient)
+
+	require.NoError(t, publish(ctx, client, false, 1, 2))
+
+	restarted, client := newSpool(t, dir, upstreamClient)
+	require.NoError(t, publish(ctx, client, true, 3))
+	restarted.Start()
+	defer restarted.Stop(ctx)
+	waitForForwarded(t, upstream, []int64{1, 2, 3})
+}
+
+func TestStreamWithoutAPIKeyIsRejected(t *testing.T) {
+	ctx := context.Background()
+	dir := testfs.MakeTempDir(t)
+	_, client := newSpool(t, dir, serve(t, &fakeUpstream{}))
+
+	stream, err := client.PublishBuildToolEventStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(request(1)))
+	_, err = stream.Recv()
+	assert.True(t, status.IsUnauthenticatedError(err), "expected Unauthenticated, got %v", err)
+	assert.Len(t, spoolFiles(t, dir, ".spool.tmp"), 0)
+
+	_, err = client.PublishLifecycleEvent(ctx, &pepb.PublishLifecycleEventRequest{})
+	assert.True(t, status.IsUnauthenticatedError(err), "expected Unauthenticated, got %v", err)
+}
@@ -15,8 +15,10 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/redis_cache"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/s3_cache"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/composable_cache"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/benchmark"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/executor"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/filecache"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/local_action_cache"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/priority_task_scheduler"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/scheduler_client"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/redisutil"
@@ -26,7 +28,9 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/action_cache_server"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/byte_stream_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/content_addressable_storage_server"
+	"github.com/buildbuddy-io/buildbuddy/server/util/bandwidth"
 	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_client"
 	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_server"
 	"github.com/buildbuddy-io/buildbuddy/server/util/healthcheck"
@@ -58,45 +62,82 @@ var (
 var localListener *bufconn.Listener
 
 func InitializeCacheClientsOrDie(cacheTarget string, realEnv *real_environment.RealEnv, useLocal bool) {
-	var conn *grpc.ClientConn
+	executorConfig := realEnv.GetConfigurator().GetExecutorConfig()
+	bandwidthOptions := bandwidth.DialOptions(
+		bandwidth.NewLimiter(executorConfig.MaxCASUploadBytesPerSecond),
+		bandwidth.NewLimiter(executorConfig.MaxCASDownloadBytesPerSecond),
+	)
+
+	var conn *grpc_client.ClientConnPool
 	var err error
 	if useLocal {
 		log.Infof("Using local cache!")
 		dialOptions := grpc_client.CommonGRPCClientOptions()
+		dialOptions = append(dialOptions, bandwidthOptions...)
 		dialOptions = append(dialOptions, grpc.WithContextDialer(bufDialer))
 		dialOptions = append(dialOptions, grpc.WithInsecure())
 
-		conn, err = grpc.DialContext(context.Background(), "bufnet", dialOptions...)
+		localConn, err := grpc.DialContext(context.Background(), "bufnet", dialOptions...)
 		if err != nil {
 			log.Fatalf("Failed to dial bufnet: %v", err)
 		}
+		conn = grpc_client.NewClientConnPool(localConn)
 		log.Debugf("Connecting to local cache over bufnet")
 	} else {
 		if cacheTarget == "" {
 			log.Fatalf("No cache target was set. Run a local cache or specify one in the config")
 		}
-		conn, err = grpc_client.DialTarget(cacheTarget)
+		conn, err = grpc_client.DialTargetPooled(cacheTarget, executorConfig.CacheConnectionPoolSize, bandwidthOptions...)
 		if err != nil {
 			log.Fatalf("Unable to connect to cache '%s': %s", cacheTarget, err)
 		}
 		log.Infof("Connecting to cache target: %s", cacheTarget)
 	}
 
+	// Reads fail over to the fallback caches, so the executor stays healthy
+	// as long as one of them is reachable.
+	conns := []*grpc_client.ClientConnPool{conn}
+	var cacheConn grpc.ClientConnInterface = conn
+	if fallbackTargets := executorConfig.FallbackCacheTargets; !useLocal && len(fallbackTargets) > 0 {
+		var fallbacks []cachetools.Endpoint
+		for _, target := range fallbackTargets {
+			fallbackConn, err := grpc_client.DialTargetPooled(target, executorConfig.CacheConnectionPoolSize, bandwidthOptions...)
+			if err != nil {
+				log.Fatalf("Unable to connect to fallback cache '%s': %s", target, err)
+			}
+			log.Infof("Connecting to fallback cache target: %s", target)
+			conns = append(conns, fallbackConn)
+			fallbacks = append(fallbacks, cachetools.Endpoint{Name: target, Conn: fallbackConn})
+		}
+		cacheConn = cachetools.NewFailoverConn(cachetools.Endpoint{Name: cacheTarget, Conn: conn}, fallbacks...)
+	}
+
 	realEnv.GetHealthChecker().AddHealthCheck(
 		"grpc_cache_connection", interfaces.CheckerFunc(
 			func(ctx context.Context) error {
-				connState := conn.GetState()
-				if connState == connectivity.Ready {
-					return nil
+				connState := connectivity.Shutdown
+				for _, c := range conns {
+					connState = c.GetState()
+					if connState == connectivity.Ready {
+						return nil
+					}
 				}
 				return fmt.Errorf("gRPC connection not yet ready (state: %s)", connState)
 			},
 		),
 	)
 
-	realEnv.SetByteStreamClient(bspb.NewByteStreamClient(conn))
-	realEnv.SetContentAddressableStorageClient(repb.NewContentAddressableStorageClient(conn))
-	realEnv.SetActionCacheClient(repb.NewActionCacheClient(conn))
+	realEnv.SetByteStreamClient(bspb.NewByteStreamClient(cacheConn))
+	realEnv.SetContentAddressableStorageClient(repb.NewContentAddressableStorageClient(cacheConn))
+	acClient := repb.NewActionCacheClient(cacheConn)
+	if lacConfig := &executorConfig.LocalActionCache; lacConfig.Enabled {
+		localAC, err := local_action_cache.New(lacConfig, realEnv.GetClock(), acClient, realEnv.GetContentAddressableStorageClient())
+		if err != nil {
+			log.Fatalf("Error configuring local action cache: %s", err)
+		}
+		acClient = localAC
+	}
+	realEnv.SetActionCacheClient(acClient)
 }
 
 func GetConfiguredEnvironmentOrDie(configurator *config.Configurator, healthChecker *healthcheck.HealthChecker) environment.Env {
@@ -164,7 +205,7 @@ func GetConfiguredEnvironmentOrDie(configurator *config.Configurator, healthChec
 	}
 
 	if executorConfig.GetAppTarget() != "" {
-		conn, err := grpc_client.DialTarget(executorConfig.GetAppTarget())
+		conn, err := grpc_client.DialTargetPooled(executorConfig.GetAppTarget(), executorConfig.AppConnectionPoolSize)
 		if err != nil {
 			log.Fatalf("Unable to connect to app '%s': %s", executorConfig.GetAppTarget(), err)
 		}
@@ -280,21 +321,29 @@ func main() {
 	}
 
 	monitoring.StartMonitoringHandler(fmt.Sprintf("%s:%d", *listen, *monitoringPort))
+	if err := monitoring.StartMetricsExporters(env, "buildbuddy-executor"); err != nil {
+		log.Fatalf("Could not start exporting metrics: %s", err)
+	}
 
 	http.Handle("/healthz", env.GetHealthChecker().LivenessHandler())
 	http.Handle("/readyz", env.GetHealthChecker().ReadinessHandler())
 
+	go func() {
+		localServer.Serve(localListener)
+	}()
+
 	schedulerOpts := &scheduler_client.Options{}
+	if !executorConfig.DisableStartupBenchmark {
+		capability := benchmark.Run(rootContext, env, executorConfig.GetRootDirectory())
+		log.Infof("Executor benchmark: %s", capability)
+		schedulerOpts.Capability = capability
+	}
 	reg, err := scheduler_client.NewRegistration(env, taskScheduler, executorID, schedulerOpts)
 	if err != nil {
 		log.Fatalf("Error initializing executor registration: %s", err)
 	}
 	reg.Start(rootContext)
 
-	go func() {
-		localServer.Serve(localListener)
-	}()
-
 	go func() {
 		http.ListenAndServe(fmt.Sprintf("%s:%d", *listen, *port), nil)
 	}()
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/partitioned_cache"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/upstream_cache"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/build_event_spool"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/composable_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/disk_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_metrics_collector"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/nullauth"
+	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/action_cache_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/byte_stream_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/capabilities_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/content_addressable_storage_server"
+	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_client"
+	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_server"
+	"github.com/buildbuddy-io/buildbuddy/server/util/healthcheck"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/monitoring"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+
+	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	_ "google.golang.org/grpc/encoding/gzip" // imported for side effects; DO NOT REMOVE.
+)
+
+// The proxy is deployed close to the clients of a central BuildBuddy, e.g. in
+// an on-prem network. It serves the remote cache from a local disk cache,
+// reading through to and writing through to the central BuildBuddy, and it
+// spools build events to local disk before forwarding them, so that builds
+// are not held up by the link to the central BuildBuddy.
+//
+// The proxy can't authenticate clients itself, so every request must carry the
+// client's API key, which is forwarded to the central BuildBuddy. The local
+// cache is partitioned by API key, so that clients are only served what was
+// written with their own key.
+
+var (
+	listen         = flag.String("listen", "0.0.0.0", "The interface to listen on (default: 0.0.0.0)")
+	port           = flag.Int("port", 8080, "The port to listen for HTTP traffic on")
+	monitoringPort = flag.Int("monitoring_port", 9090, "The port to listen for monitoring traffic on")
+	gRPCPort       = flag.Int("grpc_port", 1985, "The port to listen for gRPC traffic on")
+	configFile     = flag.String("config_file", "", "The path to a buildbuddy config file")
+	serverType     = flag.String("server_type", "buildbuddy-proxy", "The server type to match on health checks")
+
+	upstreamTarget   = flag.String("proxy.upstream_target", "", "The gRPC target of the BuildBuddy to forward cache requests and build events to. Ex: grpcs://remote.buildbuddy.io")
+	spoolDirectory   = flag.String("proxy.spool_directory", "/tmp/buildbuddy-proxy/spool", "The directory in which to spool build events until they have been forwarded upstream.")
+	upstreamPoolSize = flag.Int("proxy.upstream_connection_pool_size", 1, "The number of connections to open to the upstream target. RPCs are spread across them, so that large transfers don't hold up others sharing a connection.")
+)
+
+var errMissingAPIKey = status.UnauthenticatedError("requests to the proxy must carry an API key")
+
+// requireAPIKeyUnaryInterceptor rejects requests without an API key, rather
+// than serving them anonymously from the shared local cache or forwarding them
+// upstream with credentials other than the client's.
+func requireAPIKeyUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if upstream_cache.ClientAPIKey(ctx) == "" {
+		return nil, errMissingAPIKey
+	}
+	return handler(ctx, req)
+}
+
+func requireAPIKeyStreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if upstream_cache.ClientAPIKey(stream.Context()) == "" {
+		return errMissingAPIKey
+	}
+	return handler(srv, stream)
+}
+
+func main() {
+	// Parse all flags, once and for all.
+	flag.Parse()
+
+	configFilePath := *configFile
+	if configFilePath == "" {
+		_, err := os.Stat("/config.yaml")
+		if err == nil {
+			configFilePath = "/config.yaml"
+		} else if !errors.Is(err, os.ErrNotExist) {
+			log.Fatalf("Error loading config file from file: %s", err)
+		}
+	}
+
+	configurator, err := config.NewConfigurator(configFilePath)
+	if err != nil {
+		log.Fatalf("Error loading config from file: %s", err)
+	}
+
+	opts := log.Opts{
+		Level:                  configurator.GetAppLogLevel(),
+		EnableShortFileName:    configurator.GetAppLogIncludeShortFileName(),
+		EnableGCPLoggingFormat: configurator.GetAppLogEnableGCPLoggingFormat(),
+		EnableStructured:       configurator.GetAppEnableStructuredLogging(),
+	}
+	if err := log.Configure(opts); err != nil {
+		fmt.Printf("Error configuring logging: %s", err)
+		os.Exit(1)
+	}
+
+	if *upstreamTarget == "" {
+		log.Fatalf("proxy.upstream_target must be set")
+	}
+	diskConfig := configurator.GetCacheDiskConfig()
+	if diskConfig == nil {
+		log.Fatalf("A disk cache (cache.disk.root_directory) must be configured")
+	}
+
+	healthChecker := healthcheck.NewHealthChecker(*serverType)
+	env := real_environment.NewRealEnv(configurator, healthChecker)
+	env.SetAuthenticator(&nullauth.NullAuthenticator{})
+	collector, err := memory_metrics_collector.NewMemoryMetricsCollector()
+	if err != nil {
+		log.Fatalf("Error configuring in-memory metrics collector: %s", err.Error())
+	}
+	env.SetMetricsCollector(collector)
+
+	conn, err := grpc_client.DialTargetPooled(*upstreamTarget, *upstreamPoolSize)
+	if err != nil {
+		log.Fatalf("Unable to connect to upstream '%s': %s", *upstreamTarget, err)
+	}
+	log.Infof("Connecting to upstream target: %s", *upstreamTarget)
+	healthChecker.AddHealthCheck(
+		"grpc_upstream_connection", interfaces.CheckerFunc(
+			func(ctx context.Context) error {
+				connState := conn.GetState()
+				if connState == connectivity.Ready {
+					return nil
+				}
+				return fmt.Errorf("gRPC connection not yet ready (state: %s)", connState)
+			},
+		),
+	)
+
+	localCache, err := disk_cache.NewDiskCache(diskConfig.RootDirectory, configurator.GetCacheMaxSizeBytes())
+	if err != nil {
+		log.Fatalf("Error configuring cache: %s", err)
+	}
+	upstreamCache := upstream_cache.NewUpstreamCache(conn)
+	env.SetCache(composable_cache.NewComposableCache(partitioned_cache.NewPartitionedCache(localCache), upstreamCache, composable_cache.ModeReadThrough|composable_cache.ModeWriteThrough))
+
+	spool, err := build_event_spool.NewSpool(*spoolDirectory, pepb.NewPublishBuildEventClient(conn))
+	if err != nil {
+		log.Fatalf("Error initializing build event spool: %s", err)
+	}
+	spool.Start()
+	healthChecker.RegisterShutdownFunction(spool.Stop)
+
+	grpcOptions := append(
+		grpc_server.CommonGRPCServerOptions(env),
+		grpc.ChainUnaryInterceptor(requireAPIKeyUnaryInterceptor),
+		grpc.ChainStreamInterceptor(requireAPIKeyStreamInterceptor),
+	)
+	grpcServer := grpc.NewServer(grpcOptions...)
+
+	// Register to handle content addressable storage (CAS) messages.
+	casServer, err := content_addressable_storage_server.NewContentAddressableStorageServer(env)
+	if err != nil {
+		log.Fatalf("Error initializing ContentAddressableStorageServer: %s", err)
+	}
+	repb.RegisterContentAddressableStorageServer(grpcServer, casServer)
+
+	// Register to handle bytestream (upload and download) messages.
+	byteStreamServer, err := byte_stream_server.NewByteStreamServer(env)
+	if err != nil {
+		log.Fatalf("Error initializing ByteStreamServer: %s", err)
+	}
+	bspb.RegisterByteStreamServer(grpcServer, byteStreamServer)
+
+	// Register to handle action cache (upload and download) messages.
+	actionCacheServer, err := action_cache_server.NewActionCacheServer(env)
+	if err != nil {
+		log.Fatalf("Error initializing ActionCacheServer: %s", err)
+	}
+	repb.RegisterActionCacheServer(grpcServer, actionCacheServer)
+
+	// The proxy serves the cache but not remote execution.
+	repb.RegisterCapabilitiesServer(grpcServer, capabilities_server.NewCapabilitiesServer(env /*supportCAS=*/, true /*supportRemoteExec=*/, false))
+
+	// Register to handle build event protocol messages.
+	pepb.RegisterPublishBuildEventServer(grpcServer, spool)
+
+	hostAndPort := fmt.Sprintf("%s:%d", *listen, *gRPCPort)
+	lis, err := net.Listen("tcp", hostAndPort)
+	if err != nil {
+		log.Fatalf("Failed to listen: %s", err)
+	}
+	log.Printf("gRPC listening on http://%s", hostAndPort)
+	go func() {
+		grpcServer.Serve(lis)
+	}()
+	healthChecker.RegisterShutdownFunction(grpc_server.GRPCShutdownFunc(grpcServer))
+
+	monitoring.StartMonitoringHandler(fmt.Sprintf("%s:%d", *listen, *monitoringPort))
+
+	http.Handle("/healthz", healthChecker.LivenessHandler())
+	http.Handle("/readyz", healthChecker.ReadinessHandler())
+	go func() {
+		http.ListenAndServe(fmt.Sprintf("%s:%d", *listen, *port), nil)
+	}()
+	healthChecker.WaitForGracefulShutdown()
+}
@@ -5,8 +5,12 @@ import (
 	"flag"
 	"fmt"
 	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
 	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/access_log"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/api"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/auth"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/authdb"
@@ -15,21 +19,32 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/memcache"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/pubsub"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/redis_cache"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/redis_kvstore"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/s3_cache"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/userdb"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/composable_cache"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/console_log_index"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/dev_mode"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/execution_service"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/githubapp"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/invocation_export"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/invocation_search_service"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/invocation_stat_service"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/promotion"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/execution_server"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/routing_cache"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/scheduler_server"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/task_router"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/secrets"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/splash"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/redisutil"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/bitbucket"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/github"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/gitlab"
 	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/invocation_archiver"
+	"github.com/buildbuddy-io/buildbuddy/server/invocation_replay"
 	"github.com/buildbuddy-io/buildbuddy/server/janitor"
 	"github.com/buildbuddy-io/buildbuddy/server/libmain"
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
@@ -51,8 +66,34 @@ import (
 var (
 	configFile = flag.String("config_file", "/config.yaml", "The path to a buildbuddy config file")
 	serverType = flag.String("server_type", "buildbuddy-server", "The server type to match on health checks")
+
+	devMode        = flag.Bool("dev_mode", false, "If true, ignore --config_file and run a self-contained local stack for trying out BuildBuddy: the app, an in-memory cache, and (if redis-server is installed) an executor, with no auth and a SQLite database.")
+	devModeDataDir = flag.String("dev_mode_data_dir", filepath.Join(os.TempDir(), "buildbuddy-dev"), "The directory that --dev_mode stores its config, database, and build outputs in.")
 )
 
+// configureDevModeOrDie points --config_file at the config that --dev_mode
+// runs with, starting Redis for remote execution if it's installed.
+func configureDevModeOrDie(ctx context.Context) *dev_mode.Options {
+	opts := &dev_mode.Options{
+		DataDir:  *devModeDataDir,
+		GRPCPort: *libmain.GRPCPort,
+	}
+	httpPort, err := strconv.Atoi(flag.Lookup("port").Value.String())
+	if err != nil {
+		log.Fatalf("Invalid --port: %s", err)
+	}
+	opts.HTTPPort = httpPort
+	opts.RedisTarget, err = dev_mode.StartRedis(ctx)
+	if err != nil {
+		log.Fatalf("Error starting Redis for dev mode: %s", err)
+	}
+	*configFile, err = dev_mode.WriteConfig(opts)
+	if err != nil {
+		log.Fatalf("Error configuring dev mode: %s", err)
+	}
+	return opts
+}
+
 func configureFilesystemsOrDie(realEnv *real_environment.RealEnv) {
 	// Ensure we always override the app filesystem because the enterprise
 	// binary bundles a different app than the OS one does.
@@ -119,15 +160,59 @@ func convertToProdOrDie(ctx context.Context, env *real_environment.RealEnv) {
 	search := invocation_search_service.NewInvocationSearchService(env, env.GetDBHandle())
 	env.SetInvocationSearchService(search)
 
+	consoleLogIndex := console_log_index.NewConsoleLogIndex(env, env.GetDBHandle())
+	consoleLogIndex.Start()
+	env.SetConsoleLogIndex(consoleLogIndex)
+
 	apiServer := api.NewAPIServer(env)
 	env.SetAPIService(apiServer)
 
+	if secrets.IsConfigured(env.GetConfigurator().GetSecretsConfig()) {
+		secretService, err := secrets.NewSecretService(ctx, env)
+		if err != nil {
+			log.Fatalf("Error configuring secrets: %s", err)
+		}
+		env.SetSecretService(secretService)
+	}
+
+	if access_log.IsConfigured(env.GetConfigurator().GetAccessLogConfig()) {
+		accessLogService, err := access_log.NewAccessLogService(env)
+		if err != nil {
+			log.Fatalf("Error configuring access log: %s", err)
+		}
+		env.SetAccessLogService(accessLogService)
+	}
+
+	if invocation_export.IsConfigured(env.GetConfigurator().GetExportConfig()) {
+		exportService, err := invocation_export.NewInvocationExportService(env)
+		if err != nil {
+			log.Fatalf("Error configuring invocation export: %s", err)
+		}
+		env.SetInvocationExportService(exportService)
+	}
+
 	workflowService := workflow.NewWorkflowService(env)
 	env.SetWorkflowService(workflowService)
 	env.SetGitProviders([]interfaces.GitProvider{
 		github.NewProvider(),
+		gitlab.NewProvider(),
 		bitbucket.NewProvider(),
 	})
+	if gc := env.GetConfigurator().GetGithubConfig(); gc != nil && gc.App.ID != 0 {
+		app, err := githubapp.New(env, &gc.App)
+		if err != nil {
+			log.Fatalf("Error configuring GitHub App: %s", err)
+		}
+		env.SetGitHubApp(app)
+	}
+
+	if pc := env.GetConfigurator().GetIntegrationsPromotionConfig(); promotion.IsConfigured(pc) {
+		promoter, err := promotion.New(env, pc)
+		if err != nil {
+			log.Fatalf("Error configuring artifact promotion: %s", err)
+		}
+		env.SetWebhooks(append(env.GetWebhooks(), promoter))
+	}
 
 	env.SetSplashPrinter(&splash.Printer{})
 }
@@ -137,11 +222,25 @@ func main() {
 	rootContext := context.Background()
 	version.Print()
 
+	var devModeOpts *dev_mode.Options
+	devModeCtx, cancelDevMode := context.WithCancel(rootContext)
+	defer cancelDevMode()
+	if *devMode {
+		devModeOpts = configureDevModeOrDie(devModeCtx)
+	}
+
 	configurator, err := config.NewConfigurator(*configFile)
 	if err != nil {
 		log.Fatalf("Error loading config from file: %s", err)
 	}
 	healthChecker := healthcheck.NewHealthChecker(*serverType)
+	if devModeOpts != nil {
+		// Stop the processes started for dev mode along with the server.
+		healthChecker.RegisterShutdownFunction(func(ctx context.Context) error {
+			cancelDevMode()
+			return nil
+		})
+	}
 	realEnv := libmain.GetConfiguredEnvironmentOrDie(configurator, healthChecker)
 	if err := tracing.Configure(configurator); err != nil {
 		log.Fatalf("Could not configure tracing: %s", err)
@@ -151,6 +250,10 @@ func main() {
 	convertToProdOrDie(rootContext, realEnv)
 
 	// Install any prod-specific backends here.
+	cacheBackends := map[string]interfaces.Cache{}
+	if c := realEnv.GetCache(); c != nil {
+		cacheBackends["local"] = c
+	}
 	if gcsCacheConfig := configurator.GetCacheGCSConfig(); gcsCacheConfig != nil {
 		opts := make([]option.ClientOption, 0)
 		if gcsCacheConfig.CredentialsFile != "" {
@@ -161,6 +264,7 @@ func main() {
 			log.Fatalf("Error configuring GCS cache: %s", err)
 		}
 		realEnv.SetCache(gcsCache)
+		cacheBackends["gcs"] = gcsCache
 	}
 
 	if s3CacheConfig := configurator.GetCacheS3Config(); s3CacheConfig != nil {
@@ -169,11 +273,25 @@ func main() {
 			log.Fatalf("Error configuring S3 cache: %s", err)
 		}
 		realEnv.SetCache(s3Cache)
+		cacheBackends["s3"] = s3Cache
+	}
+
+	if cacheRoutes := configurator.GetCacheRoutes(); len(cacheRoutes) > 0 {
+		routes := make([]routing_cache.Route, 0, len(cacheRoutes))
+		for _, r := range cacheRoutes {
+			c, ok := cacheBackends[r.Backend]
+			if !ok {
+				log.Fatalf("Cache route %+v refers to unconfigured backend %q", r, r.Backend)
+			}
+			routes = append(routes, routing_cache.Route{InstanceName: r.InstanceName, GroupID: r.GroupID, Cache: c})
+		}
+		realEnv.SetCache(routing_cache.NewRoutingCache(realEnv, realEnv.GetCache(), routes))
 	}
 
 	if redisTarget := configurator.GetCacheRedisTarget(); redisTarget != "" {
 		redisClient := redisutil.NewClient(redisTarget, healthChecker, "cache_redis")
 		realEnv.SetCacheRedisClient(redisClient)
+		realEnv.SetKeyValStore(redis_kvstore.New(redisClient))
 	}
 
 	if redisTarget := configurator.GetRemoteExecutionRedisTarget(); redisTarget != "" {
@@ -279,5 +397,22 @@ func main() {
 	cleanupService.Start()
 	defer cleanupService.Stop()
 
+	reparser := invocation_replay.NewBackfiller(realEnv)
+	reparser.Start()
+	defer reparser.Stop()
+
+	archiver := invocation_archiver.NewArchiver(realEnv)
+	archiver.Start()
+	defer archiver.Stop()
+
+	if devModeOpts != nil {
+		if devModeOpts.RemoteExecutionEnabled() {
+			if err := dev_mode.StartExecutor(devModeCtx, configurator, healthChecker); err != nil {
+				log.Fatalf("Error starting dev mode executor: %s", err)
+			}
+		}
+		dev_mode.PrintQuickstart(os.Stdout, devModeOpts)
+	}
+
 	libmain.StartAndRunServices(realEnv) // Does not return
 }
@@ -39,6 +39,7 @@ var (
 	realisticBlobSizes = flag.Bool("realistic_blob_sizes", true, "If true, use realistic blob sizes, ignoring blob_size flag.")
 	ssl                = flag.Bool("ssl", false, "If true, use ssl.")
 	blobSize           = flag.Int64("blob_size", 100000, "Num bytes (max) of blob to send/read.")
+	connectionPoolSize = flag.Int("connection_pool_size", 1, "Number of connections to open to the cache target when pre-writing blobs.")
 	htmlOutputFile     = flag.String("html_output_file", "", "If set, results will be written to this file in HTML format")
 )
 
@@ -110,7 +111,7 @@ func writeBlobsForReading() []*repb.Digest {
 	if *ssl {
 		prefix = "grpcs://"
 	}
-	conn, err := grpc_client.DialTarget(prefix + *cacheTarget)
+	conn, err := grpc_client.DialTargetPooled(prefix+*cacheTarget, *connectionPoolSize)
 	if err != nil {
 		log.Fatalf("Unable to connect to cache '%s': %s", *cacheTarget, err)
 	}
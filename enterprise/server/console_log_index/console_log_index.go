@@ -0,0 +1,323 @@
+// Package console_log_index indexes the console logs of invocations, for
+// groups that enabled it, so that users can find which builds printed a given
+// line, such as a linker error.
+package console_log_index
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+const (
+	defaultRetention             = 7 * 24 * time.Hour
+	defaultMaxLinesPerInvocation = 10000
+
+	// How often lines older than the retention period are deleted.
+	cleanupInterval = 1 * time.Hour
+
+	// Words shorter than this aren't indexed, since they match too many
+	// lines to narrow down a search.
+	minTokenLength = 3
+	// Longer words are indexed by their prefix.
+	maxTokenLength = 64
+	// The maximum number of distinct words indexed per line.
+	maxTokensPerLine = 50
+	// The maximum number of characters stored per line.
+	maxLineLength = 1000
+	// The maximum number of words of a query that are looked up in the
+	// index. Matching lines must still contain the whole query.
+	maxQueryTokens = 8
+
+	// The number of rows inserted per statement.
+	insertBatchSize = 100
+
+	defaultSearchCount    = 50
+	maxSearchCount        = 500
+	pageTokenOffsetPrefix = "offset_"
+)
+
+var (
+	tokenRegexp = regexp.MustCompile(`[\p{L}\p{N}_]+`)
+	// Matches the escape sequences used to format console output.
+	ansiEscapeRegexp = regexp.MustCompile("\x1b\\[[0-9;?]*[a-zA-Z]")
+)
+
+type ConsoleLogIndex struct {
+	env                   environment.Env
+	h                     *db.DBHandle
+	retention             time.Duration
+	maxLinesPerInvocation int
+}
+
+func NewConsoleLogIndex(env environment.Env, h *db.DBHandle) *ConsoleLogIndex {
+	conf := env.GetConfigurator().GetStorageConsoleLogIndexConfig()
+	retention := defaultRetention
+	if conf.RetentionDays > 0 {
+		retention = time.Duration(conf.RetentionDays) * 24 * time.Hour
+	}
+	maxLines := defaultMaxLinesPerInvocation
+	if conf.MaxLinesPerInvocation > 0 {
+		maxLines = int(conf.MaxLinesPerInvocation)
+	}
+	return &ConsoleLogIndex{
+		env:                   env,
+		h:                     h,
+		retention:             retention,
+		maxLinesPerInvocation: maxLines,
+	}
+}
+
+// Start periodically deletes indexed lines older than the retention period.
+func (i *ConsoleLogIndex) Start() {
+	shuttingDown := make(chan struct{})
+	i.env.GetHealthChecker().RegisterShutdownFunction(func(ctx context.Context) error {
+		close(shuttingDown)
+		return nil
+	})
+	go func() {
+		for {
+			select {
+			case <-shuttingDown:
+				return
+			case <-i.env.GetClock().After(cleanupInterval):
+				cutoff := i.env.GetClock().Now().Add(-i.retention)
+				if err := i.DeleteLinesOlderThan(context.Background(), cutoff); err != nil {
+					log.Warningf("Error deleting expired console log lines: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+// DeleteLinesOlderThan deletes the lines which were indexed before the given
+// time.
+func (i *ConsoleLogIndex) DeleteLinesOlderThan(ctx context.Context, cutoff time.Time) error {
+	cutoffUsec := timeutil.ToUsec(cutoff)
+	if err := i.h.Exec(`DELETE FROM ConsoleLogTokens WHERE created_at_usec < ?`, cutoffUsec).Error; err != nil {
+		return err
+	}
+	return i.h.Exec(`DELETE FROM ConsoleLogLines WHERE created_at_usec < ?`, cutoffUsec).Error
+}
+
+// tokenize returns the distinct words of the given text that are indexed.
+func tokenize(text string) []string {
+	seen := make(map[string]struct{})
+	var tokens []string
+	for _, token := range tokenRegexp.FindAllString(strings.ToLower(text), -1) {
+		if len(token) < minTokenLength {
+			continue
+		}
+		if r := []rune(token); len(r) > maxTokenLength {
+			token = string(r[:maxTokenLength])
+		}
+		if _, ok := seen[token]; ok {
+			continue
+		}
+		seen[token] = struct{}{}
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+func (i *ConsoleLogIndex) groupIndexEnabled(ctx context.Context, groupID string) (bool, error) {
+	var groups []*tables.Group
+	err := i.h.WithContext(ctx).
+		Select("group_id").
+		Where("group_id = ? AND console_log_index_enabled = ?", groupID, true).
+		Find(&groups).Error
+	if err != nil {
+		return false, err
+	}
+	return len(groups) > 0, nil
+}
+
+// IndexConsoleLog stores the lines of the invocation's console log, if its
+// group enabled console log indexing.
+func (i *ConsoleLogIndex) IndexConsoleLog(ctx context.Context, groupID string, invocation *inpb.Invocation) error {
+	if groupID == "" {
+		// Anonymous invocations can't be searched.
+		return nil
+	}
+	enabled, err := i.groupIndexEnabled(ctx, groupID)
+	if err != nil || !enabled {
+		return err
+	}
+
+	iid := invocation.GetInvocationId()
+	var lines []*tables.ConsoleLogLine
+	var tokens []*tables.ConsoleLogToken
+	for n, line := range strings.Split(invocation.GetConsoleBuffer(), "\n") {
+		if n >= i.maxLinesPerInvocation {
+			break
+		}
+		line = strings.TrimRight(ansiEscapeRegexp.ReplaceAllString(line, ""), " \r\t")
+		lineTokens := tokenize(line)
+		if len(lineTokens) == 0 {
+			continue
+		}
+		if len(lineTokens) > maxTokensPerLine {
+			lineTokens = lineTokens[:maxTokensPerLine]
+		}
+		if r := []rune(line); len(r) > maxLineLength {
+			line = string(r[:maxLineLength])
+		}
+		lineNumber := int64(n + 1)
+		lines = append(lines, &tables.ConsoleLogLine{
+			InvocationID: iid,
+			LineNumber:   lineNumber,
+			GroupID:      groupID,
+			Line:         line,
+		})
+		for _, token := range lineTokens {
+			tokens = append(tokens, &tables.ConsoleLogToken{
+				GroupID:      groupID,
+				Token:        token,
+				InvocationID: iid,
+				LineNumber:   lineNumber,
+			})
+		}
+	}
+
+	return i.h.Transaction(ctx, func(tx *db.DB) error {
+		// Invocations are finalized again if Bazel retries its build event
+		// stream, so replace any lines indexed before.
+		if err := tx.Exec(`DELETE FROM ConsoleLogTokens WHERE group_id = ? AND invocation_id = ?`, groupID, iid).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`DELETE FROM ConsoleLogLines WHERE invocation_id = ?`, iid).Error; err != nil {
+			return err
+		}
+		for start := 0; start < len(lines); start += insertBatchSize {
+			end := start + insertBatchSize
+			if end > len(lines) {
+				end = len(lines)
+			}
+			if err := tx.Create(lines[start:end]).Error; err != nil {
+				return err
+			}
+		}
+		for start := 0; start < len(tokens); start += insertBatchSize {
+			end := start + insertBatchSize
+			if end > len(tokens) {
+				end = len(tokens)
+			}
+			if err := tx.Create(tokens[start:end]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern, using "!" as the
+// escape character.
+func escapeLike(s string) string {
+	s = strings.ReplaceAll(s, "!", "!!")
+	s = strings.ReplaceAll(s, "%", "!%")
+	return strings.ReplaceAll(s, "_", "!_")
+}
+
+func (i *ConsoleLogIndex) SearchConsoleLog(ctx context.Context, req *inpb.SearchConsoleLogRequest) (*inpb.SearchConsoleLogResponse, error) {
+	groupID, err := perms.AuthenticateSelectedGroupID(ctx, i.env, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	query := strings.TrimSpace(req.GetQuery())
+	tokens := tokenize(query)
+	if len(tokens) == 0 {
+		return nil, status.InvalidArgumentErrorf("The query must contain at least one word of %d or more letters or digits", minTokenLength)
+	}
+	if len(tokens) > maxQueryTokens {
+		tokens = tokens[:maxQueryTokens]
+	}
+	// Look up lines by the longest word, which is likely the rarest.
+	longest := 0
+	for n, token := range tokens {
+		if len(token) > len(tokens[longest]) {
+			longest = n
+		}
+	}
+
+	q := query_builder.NewQuery(`
+		SELECT l.* FROM ConsoleLogTokens t
+		JOIN ConsoleLogLines l ON l.invocation_id = t.invocation_id AND l.line_number = t.line_number
+		JOIN Invocations i ON i.invocation_id = l.invocation_id`)
+	q.AddWhereClause("t.group_id = ? AND t.token = ?", groupID, tokens[longest])
+	q.AddWhereClause("i.deleted_at_usec = 0")
+	for n, token := range tokens {
+		if n == longest {
+			continue
+		}
+		q.AddWhereClause(`EXISTS (
+			SELECT 1 FROM ConsoleLogTokens t2
+			WHERE t2.group_id = t.group_id AND t2.invocation_id = t.invocation_id
+				AND t2.line_number = t.line_number AND t2.token = ?)`, token)
+	}
+	q.AddWhereClause("LOWER(l.line) LIKE ? ESCAPE '!'", "%"+escapeLike(strings.ToLower(query))+"%")
+	q.AddWhereClause("l.created_at_usec >= ?", timeutil.ToUsec(i.env.GetClock().Now().Add(-i.retention)))
+	if err := perms.AddPermissionsCheckToQueryWithTableAlias(ctx, i.env, q, "i"); err != nil {
+		return nil, err
+	}
+	q.SetOrderBy("l.created_at_usec, l.invocation_id, l.line_number", true /*=ascending*/)
+
+	count := int64(defaultSearchCount)
+	if req.GetCount() > 0 {
+		count = int64(req.GetCount())
+	}
+	if count > maxSearchCount {
+		count = maxSearchCount
+	}
+	offset := int64(0)
+	if strings.HasPrefix(req.GetPageToken(), pageTokenOffsetPrefix) {
+		parsedOffset, err := strconv.ParseInt(strings.TrimPrefix(req.GetPageToken(), pageTokenOffsetPrefix), 10, 64)
+		if err != nil {
+			return nil, status.InvalidArgumentError("Error parsing pagination token")
+		}
+		offset = parsedOffset
+	} else if req.GetPageToken() != "" {
+		return nil, status.InvalidArgumentError("Invalid pagination token")
+	}
+	// Fetch one more line than requested to tell whether there's another
+	// page.
+	q.SetLimit(count + 1)
+	q.SetOffset(offset)
+
+	qString, qArgs := q.Build()
+	rows, err := i.h.Raw(qString, qArgs...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rsp := &inpb.SearchConsoleLogResponse{}
+	for rows.Next() {
+		var l tables.ConsoleLogLine
+		if err := i.h.ScanRows(rows, &l); err != nil {
+			return nil, err
+		}
+		if int64(len(rsp.Match)) == count {
+			rsp.NextPageToken = pageTokenOffsetPrefix + strconv.FormatInt(offset+count, 10)
+			break
+		}
+		rsp.Match = append(rsp.Match, &inpb.ConsoleLogMatch{
+			InvocationId:  l.InvocationID,
+			LineNumber:    l.LineNumber,
+			Line:          l.Line,
+			CreatedAtUsec: l.CreatedAtUsec,
+		})
+	}
+	return rsp, nil
+}
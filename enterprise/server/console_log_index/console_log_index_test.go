@@ -0,0 +1,105 @@
+package console_log_index_test
+
+import (
+	"context"
+	"hash/fnv"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/console_log_index"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+func insertInvocation(t *testing.T, te *testenv.TestEnv, iid, groupID string) {
+	h := fnv.New64a()
+	h.Write([]byte(iid))
+	err := te.GetDBHandle().Create(&tables.Invocation{
+		InvocationID:     iid,
+		InvocationPK:     int64(h.Sum64()),
+		GroupID:          groupID,
+		InvocationStatus: int64(inpb.Invocation_COMPLETE_INVOCATION_STATUS),
+		Perms:            perms.GROUP_READ,
+	}).Error
+	require.NoError(t, err)
+}
+
+func insertGroup(t *testing.T, te *testenv.TestEnv, groupID string, indexEnabled bool) {
+	err := te.GetDBHandle().Create(&tables.Group{
+		GroupID:                groupID,
+		ConsoleLogIndexEnabled: indexEnabled,
+	}).Error
+	require.NoError(t, err)
+}
+
+func search(ctx context.Context, t *testing.T, index *console_log_index.ConsoleLogIndex, query string) []*inpb.ConsoleLogMatch {
+	rsp, err := index.SearchConsoleLog(ctx, &inpb.SearchConsoleLogRequest{
+		RequestContext: testauth.RequestContext("US1", "GR1"),
+		Query:          query,
+	})
+	require.NoError(t, err)
+	return rsp.GetMatch()
+}
+
+func TestSearchConsoleLog(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")))
+	ctx, err := te.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+	index := console_log_index.NewConsoleLogIndex(te, te.GetDBHandle())
+
+	insertGroup(t, te, "GR1", true)
+	insertGroup(t, te, "GR2", false)
+	logs := map[string]string{
+		"first-failure":  "Compiling main.cc\n\x1b[31mERROR:\x1b[0m undefined reference to `foo_bar'\n",
+		"second-failure": "Linking...\nmain.o: undefined reference to `foo_bar'\nlink failed\n",
+		"other-error":    "main.o: undefined reference to `baz'\n",
+	}
+	for _, iid := range []string{"first-failure", "second-failure", "other-error"} {
+		insertInvocation(t, te, iid, "GR1")
+		err := index.IndexConsoleLog(ctx, "GR1", &inpb.Invocation{InvocationId: iid, ConsoleBuffer: logs[iid]})
+		require.NoError(t, err)
+		// Make sure that invocations are indexed at different times.
+		time.Sleep(time.Millisecond)
+	}
+	// Invocations of groups that didn't enable indexing aren't indexed.
+	insertInvocation(t, te, "not-indexed", "GR2")
+	err = index.IndexConsoleLog(ctx, "GR2", &inpb.Invocation{InvocationId: "not-indexed", ConsoleBuffer: "undefined reference to `foo_bar'"})
+	require.NoError(t, err)
+
+	matches := search(ctx, t, index, "Undefined reference to `foo_bar'")
+	require.Len(t, matches, 2)
+	assert.Equal(t, "first-failure", matches[0].GetInvocationId(), "the earliest build that printed the line should be first")
+	assert.Equal(t, int64(2), matches[0].GetLineNumber())
+	assert.Equal(t, "ERROR: undefined reference to `foo_bar'", matches[0].GetLine())
+	assert.Equal(t, "second-failure", matches[1].GetInvocationId())
+
+	matches = search(ctx, t, index, "undefined reference")
+	assert.Len(t, matches, 3)
+
+	// Wildcards in the query match literally.
+	matches = search(ctx, t, index, "foo%bar")
+	assert.Empty(t, matches)
+
+	_, err = index.SearchConsoleLog(ctx, &inpb.SearchConsoleLogRequest{
+		RequestContext: testauth.RequestContext("US1", "GR1"),
+		Query:          "a b",
+	})
+	assert.Error(t, err, "queries without any indexed words should be rejected")
+
+	// Reindexing an invocation replaces its lines.
+	err = index.IndexConsoleLog(ctx, "GR1", &inpb.Invocation{InvocationId: "other-error", ConsoleBuffer: "Build succeeded\n"})
+	require.NoError(t, err)
+	matches = search(ctx, t, index, "undefined reference")
+	assert.Len(t, matches, 2)
+
+	require.NoError(t, index.DeleteLinesOlderThan(ctx, time.Now().Add(time.Hour)))
+	matches = search(ctx, t, index, "undefined reference")
+	assert.Empty(t, matches)
+}
@@ -0,0 +1,257 @@
+// Package dev_mode runs a self-contained BuildBuddy stack in a single process,
+// so that new users can try out the results UI, remote caching, and remote
+// execution locally without writing a config or setting up any other
+// services.
+package dev_mode
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/executor"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/filecache"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/priority_task_scheduler"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/scheduler_client"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_client"
+	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_server"
+	"github.com/buildbuddy-io/buildbuddy/server/util/healthcheck"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+)
+
+const (
+	// The name of the Redis server binary that is started to back remote
+	// execution, if it's installed.
+	redisServerBinary = "redis-server"
+
+	cacheSizeBytes     = 1_000_000_000 // 1 GB
+	fileCacheSizeBytes = 1_000_000_000 // 1 GB
+
+	executorName = "dev-mode-executor"
+)
+
+// configTemplate is the config that the stack runs with. Everything is stored
+// under the data directory, and anyone can use the app without logging in.
+const configTemplate = `# Generated by --dev_mode. Changes are overwritten on restart.
+app:
+  build_buddy_url: "http://localhost:%[1]d"
+  events_api_url: "grpc://localhost:%[2]d"
+  cache_api_url: "grpc://localhost:%[2]d"
+  remote_execution_api_url: "grpc://localhost:%[2]d"
+database:
+  data_source: "sqlite3://%[3]s"
+storage:
+  disk:
+    root_directory: "%[4]s"
+cache:
+  in_memory: true
+  max_size_bytes: %[5]d
+auth:
+  enable_anonymous_usage: true
+`
+
+const remoteExecutionConfigTemplate = `remote_execution:
+  enable_remote_exec: true
+  redis_target: "%[1]s"
+executor:
+  app_target: "grpc://localhost:%[2]d"
+  root_directory: "%[3]s"
+  local_cache_directory: "%[4]s"
+  local_cache_size_bytes: %[5]d
+  disable_startup_benchmark: true
+`
+
+// Options configure the dev mode stack.
+type Options struct {
+	// The directory that the stack's config, database, and build outputs are
+	// stored in.
+	DataDir string
+
+	// The ports that the app serves HTTP and gRPC traffic on.
+	HTTPPort int
+	GRPCPort int
+
+	// The Redis target backing remote execution, or empty if it's disabled.
+	RedisTarget string
+}
+
+// RemoteExecutionEnabled returns whether the stack runs an executor.
+func (o *Options) RemoteExecutionEnabled() bool {
+	return o.RedisTarget != ""
+}
+
+// WriteConfig writes the config that the stack runs with into the data
+// directory, and returns its path.
+func WriteConfig(opts *Options) (string, error) {
+	if err := os.MkdirAll(opts.DataDir, 0755); err != nil {
+		return "", status.InternalErrorf("could not create dev mode data directory: %s", err)
+	}
+	conf := fmt.Sprintf(configTemplate,
+		opts.HTTPPort, opts.GRPCPort,
+		filepath.Join(opts.DataDir, "buildbuddy.db"),
+		filepath.Join(opts.DataDir, "blobs"),
+		cacheSizeBytes)
+	if opts.RemoteExecutionEnabled() {
+		conf += fmt.Sprintf(remoteExecutionConfigTemplate,
+			opts.RedisTarget, opts.GRPCPort,
+			filepath.Join(opts.DataDir, "remote_build"),
+			filepath.Join(opts.DataDir, "filecache"),
+			fileCacheSizeBytes)
+	}
+	path := filepath.Join(opts.DataDir, "config.yaml")
+	if err := os.WriteFile(path, []byte(conf), 0644); err != nil {
+		return "", status.InternalErrorf("could not write dev mode config: %s", err)
+	}
+	return path, nil
+}
+
+// StartRedis starts a Redis server to back remote execution, which needs it
+// for queueing and streaming execution updates, and returns its target. The
+// server is killed once the context is cancelled. If Redis isn't installed, it
+// returns an empty target, and the stack runs without remote execution.
+func StartRedis(ctx context.Context) (string, error) {
+	redisPath, err := exec.LookPath(redisServerBinary)
+	if err != nil {
+		log.Warningf("%s is not installed, so remote execution is disabled. Install Redis to try it out.", redisServerBinary)
+		return "", nil
+	}
+	port, err := freePort()
+	if err != nil {
+		return "", err
+	}
+	// Nothing needs to outlive the process, so persistence is disabled.
+	cmd := exec.CommandContext(ctx, redisPath, "--port", strconv.Itoa(port), "--bind", "127.0.0.1", "--save", "")
+	cmd.Stdout = &logWriter{}
+	cmd.Stderr = &logWriter{}
+	if err := cmd.Start(); err != nil {
+		return "", status.UnavailableErrorf("could not start %s: %s", redisServerBinary, err)
+	}
+	go func() {
+		if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+			log.Warningf("%s exited: %s", redisServerBinary, err)
+		}
+	}()
+	return fmt.Sprintf("localhost:%d", port), nil
+}
+
+// StartExecutor runs an executor in this process, which executes actions
+// directly on the host. It talks to the app over its gRPC port like any other
+// executor, so it registers once the app starts serving.
+func StartExecutor(ctx context.Context, configurator *config.Configurator, healthChecker *healthcheck.HealthChecker) error {
+	env := real_environment.NewRealEnv(configurator, healthChecker)
+	executorConfig := configurator.GetExecutorConfig()
+
+	conn, err := grpc_client.DialTarget(executorConfig.GetAppTarget())
+	if err != nil {
+		return status.UnavailableErrorf("could not connect to app: %s", err)
+	}
+	env.SetByteStreamClient(bspb.NewByteStreamClient(conn))
+	env.SetContentAddressableStorageClient(repb.NewContentAddressableStorageClient(conn))
+	env.SetActionCacheClient(repb.NewActionCacheClient(conn))
+	env.SetSchedulerClient(scpb.NewSchedulerClient(conn))
+	env.SetRemoteExecutionClient(repb.NewExecutionClient(conn))
+
+	fc, err := filecache.NewFileCache(executorConfig.GetLocalCacheDirectory(), executorConfig.GetLocalCacheSizeBytes())
+	if err != nil {
+		return err
+	}
+	env.SetFileCache(fc)
+
+	executorUUID, err := uuid.NewRandom()
+	if err != nil {
+		return status.InternalErrorf("could not generate executor ID: %s", err)
+	}
+	executorID := executorUUID.String()
+	executionServer, err := executor.NewExecutor(env, executorID, &executor.Options{NameOverride: executorName})
+	if err != nil {
+		return err
+	}
+	taskScheduler := priority_task_scheduler.NewPriorityTaskScheduler(env, executionServer, &priority_task_scheduler.Options{})
+	if err := taskScheduler.Start(); err != nil {
+		return err
+	}
+
+	// The scheduler connects back to executors to offer them work.
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return status.UnavailableErrorf("could not listen for executor traffic: %s", err)
+	}
+	server := grpc.NewServer(grpc_server.CommonGRPCServerOptions(env)...)
+	scpb.RegisterQueueExecutorServer(server, taskScheduler)
+	go server.Serve(lis)
+	healthChecker.RegisterShutdownFunction(func(ctx context.Context) error {
+		server.GracefulStop()
+		return nil
+	})
+
+	reg, err := scheduler_client.NewRegistration(env, taskScheduler, executorID, &scheduler_client.Options{
+		HostnameOverride: "localhost",
+		PortOverride:     int32(lis.Addr().(*net.TCPAddr).Port),
+		NodeNameOverride: executorName,
+	})
+	if err != nil {
+		return err
+	}
+	reg.Start(ctx)
+	return nil
+}
+
+// BazelrcLines returns the .bazelrc lines that point Bazel at the stack.
+func BazelrcLines(opts *Options) []string {
+	grpcTarget := fmt.Sprintf("grpc://localhost:%d", opts.GRPCPort)
+	lines := []string{
+		fmt.Sprintf("build --bes_results_url=http://localhost:%d/invocation/", opts.HTTPPort),
+		"build --bes_backend=" + grpcTarget,
+		"build --remote_cache=" + grpcTarget,
+	}
+	if opts.RemoteExecutionEnabled() {
+		lines = append(lines,
+			"build --remote_executor="+grpcTarget,
+			"build --remote_timeout=3600",
+			"build --jobs=50",
+		)
+	}
+	return lines
+}
+
+// PrintQuickstart prints how to point Bazel at the stack.
+func PrintQuickstart(w io.Writer, opts *Options) {
+	fmt.Fprintf(w, "\nBuildBuddy is running in dev mode at http://localhost:%d\n", opts.HTTPPort)
+	fmt.Fprintf(w, "Data is stored in %s\n", opts.DataDir)
+	fmt.Fprintf(w, "Add these lines to your .bazelrc to use it:\n\n")
+	fmt.Fprintf(w, "%s\n\n", strings.Join(BazelrcLines(opts), "\n"))
+	if !opts.RemoteExecutionEnabled() {
+		fmt.Fprintf(w, "Install %s and restart to try out remote execution too.\n\n", redisServerBinary)
+	}
+}
+
+func freePort() (int, error) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return 0, status.UnavailableErrorf("could not find a free port: %s", err)
+	}
+	defer lis.Close()
+	return lis.Addr().(*net.TCPAddr).Port, nil
+}
+
+type logWriter struct{}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	log.Infof("[%s] %s", redisServerBinary, strings.TrimSuffix(string(b), "\n"))
+	return len(b), nil
+}
@@ -0,0 +1,51 @@
+package dev_mode_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/dev_mode"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteConfig(t *testing.T) {
+	opts := &dev_mode.Options{
+		DataDir:     t.TempDir(),
+		HTTPPort:    8080,
+		GRPCPort:    1985,
+		RedisTarget: "localhost:6379",
+	}
+	path, err := dev_mode.WriteConfig(opts)
+	require.NoError(t, err)
+
+	c, err := config.NewConfigurator(path)
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:8080", c.GetAppBuildBuddyURL())
+	assert.Equal(t, "sqlite3://"+filepath.Join(opts.DataDir, "buildbuddy.db"), c.GetDBDataSource())
+	assert.True(t, c.GetCacheInMemory())
+	assert.True(t, c.GetAnonymousUsageEnabled())
+	require.NotNil(t, c.GetRemoteExecutionConfig())
+	assert.Equal(t, "localhost:6379", c.GetRemoteExecutionRedisTarget())
+	assert.Equal(t, "grpc://localhost:1985", c.GetExecutorConfig().GetAppTarget())
+	assert.Equal(t, filepath.Join(opts.DataDir, "remote_build"), c.GetExecutorConfig().GetRootDirectory())
+
+	assert.Equal(t, []string{
+		"build --bes_results_url=http://localhost:8080/invocation/",
+		"build --bes_backend=grpc://localhost:1985",
+		"build --remote_cache=grpc://localhost:1985",
+		"build --remote_executor=grpc://localhost:1985",
+		"build --remote_timeout=3600",
+		"build --jobs=50",
+	}, dev_mode.BazelrcLines(opts))
+}
+
+func TestBazelrcLinesWithoutRemoteExecution(t *testing.T) {
+	opts := &dev_mode.Options{DataDir: t.TempDir(), HTTPPort: 8080, GRPCPort: 1985}
+	assert.Equal(t, []string{
+		"build --bes_results_url=http://localhost:8080/invocation/",
+		"build --bes_backend=grpc://localhost:1985",
+		"build --remote_cache=grpc://localhost:1985",
+	}, dev_mode.BazelrcLines(opts))
+}
@@ -2,7 +2,10 @@ package execution_service
 
 import (
 	"context"
-	"sort"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
@@ -19,6 +22,15 @@ import (
 	statuspb "google.golang.org/genproto/googleapis/rpc/status"
 )
 
+const (
+	pageTokenOffsetPrefix = "offset_"
+
+	// The number of executions returned by lookups that don't specify an
+	// invocation or a count, and the maximum number returned by any lookup.
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
 type ExecutionService struct {
 	env environment.Env
 }
@@ -29,20 +41,82 @@ func NewExecutionService(env environment.Env) *ExecutionService {
 	}
 }
 
-func checkPreconditions(req *espb.GetExecutionRequest) error {
-	if req.GetExecutionLookup().GetInvocationId() != "" {
+func checkPreconditions(lookup *espb.ExecutionLookup) error {
+	if lookup.GetInvocationId() != "" {
 		return nil
 	}
 	return status.FailedPreconditionError("An execution lookup with invocation_id must be provided")
 }
 
-func (es *ExecutionService) getInvocationExecutions(ctx context.Context, invocationID string) ([]tables.Execution, error) {
+// addStateFilter restricts the query to executions in one of the given
+// states. Executions aren't updated until an executor picks them up, so they
+// remain in the stage they were created in while queued, and executors report
+// the cache check stage after picking them up.
+func addStateFilter(q *query_builder.Query, states []espb.ExecutionLookup_ExecutionState) error {
+	stateClauses := query_builder.OrClauses{}
+	for _, state := range states {
+		switch state {
+		case espb.ExecutionLookup_QUEUED:
+			stateClauses.AddOr(`e.stage NOT IN (?, ?, ?)`, int64(repb.ExecutionStage_CACHE_CHECK), int64(repb.ExecutionStage_EXECUTING), int64(repb.ExecutionStage_COMPLETED))
+		case espb.ExecutionLookup_EXECUTING:
+			stateClauses.AddOr(`e.stage IN (?, ?)`, int64(repb.ExecutionStage_CACHE_CHECK), int64(repb.ExecutionStage_EXECUTING))
+		case espb.ExecutionLookup_SUCCEEDED:
+			stateClauses.AddOr(`(e.stage = ? AND e.status_code = 0)`, int64(repb.ExecutionStage_COMPLETED))
+		case espb.ExecutionLookup_FAILED:
+			stateClauses.AddOr(`(e.stage = ? AND e.status_code != 0)`, int64(repb.ExecutionStage_COMPLETED))
+		default:
+			return status.InvalidArgumentErrorf("Invalid execution state %s", state)
+		}
+	}
+	stateQuery, stateArgs := stateClauses.Build()
+	if stateQuery != "" {
+		q.AddWhereClause(fmt.Sprintf("(%s)", stateQuery), stateArgs...)
+	}
+	return nil
+}
+
+// pageLimit returns the maximum number of executions to return for the
+// request, or 0 if all of them should be returned.
+func pageLimit(req *espb.GetExecutionRequest) int64 {
+	count := int64(req.GetCount())
+	if count <= 0 {
+		if req.GetExecutionLookup().GetInvocationId() != "" {
+			// Invocations are usually looked up to show all of their
+			// executions.
+			return 0
+		}
+		return defaultPageSize
+	}
+	if count > maxPageSize {
+		return maxPageSize
+	}
+	return count
+}
+
+func (es *ExecutionService) getExecutions(ctx context.Context, lookup *espb.ExecutionLookup, limit, offset int64) ([]tables.Execution, error) {
 	db := es.env.GetDBHandle()
 	q := query_builder.NewQuery(`SELECT * FROM Executions as e`)
-	q = q.AddWhereClause(`e.invocation_id = ?`, invocationID)
+	if invocationID := lookup.GetInvocationId(); invocationID != "" {
+		q.AddWhereClause(`e.invocation_id = ?`, invocationID)
+	}
+	if targetLabel := lookup.GetTargetLabel(); targetLabel != "" {
+		q.AddWhereClause(`e.target_id = ?`, targetLabel)
+	}
+	if pool := lookup.GetPool(); pool != "" {
+		q.AddWhereClause(`e.pool = ?`, pool)
+	}
+	if err := addStateFilter(q, lookup.GetState()); err != nil {
+		return nil, err
+	}
 	if err := perms.AddPermissionsCheckToQueryWithTableAlias(ctx, es.env, q, "e"); err != nil {
 		return nil, err
 	}
+	// Order by start time, breaking ties by ID so that pages don't overlap.
+	q.SetOrderBy("e.created_at_usec ASC, e.execution_id" /*ascending=*/, true)
+	if limit > 0 {
+		q.SetLimit(limit)
+		q.SetOffset(offset)
+	}
 	queryStr, args := q.Build()
 	rows, err := db.Raw(queryStr, args...).Rows()
 	if err != nil {
@@ -68,7 +142,7 @@ func timestampProto(timeInUsec int64) *timestamppb.Timestamp {
 }
 
 func tableExecToProto(in tables.Execution) (*espb.Execution, error) {
-	_, d, err := digest.ExtractDigestFromDownloadResourceName(in.ExecutionID)
+	_, d, err := digest.ExtractDigestFromUploadResourceName(in.ExecutionID)
 	if err != nil {
 		return nil, err
 	}
@@ -101,6 +175,16 @@ func tableExecToProto(in tables.Execution) (*espb.Execution, error) {
 			OutputUploadCompletedTimestamp: timestampProto(in.OutputUploadCompletedTimestampUsec),
 		},
 		CommandSnippet: in.CommandSnippet,
+		InvocationId:   in.InvocationID,
+		TargetLabel:    in.TargetID,
+		ActionMnemonic: in.ActionMnemonic,
+		Pool:           in.Pool,
+	}
+	if in.CrashReportHash != "" {
+		out.CrashReportDigest = &repb.Digest{
+			Hash:      in.CrashReportHash,
+			SizeBytes: in.CrashReportSizeBytes,
+		}
 	}
 
 	return out, nil
@@ -110,17 +194,21 @@ func (es *ExecutionService) GetExecution(ctx context.Context, req *espb.GetExecu
 	if es.env.GetDBHandle() == nil {
 		return nil, status.FailedPreconditionError("database not configured")
 	}
-	if err := checkPreconditions(req); err != nil {
-		return nil, err
+	offset := int64(0)
+	if strings.HasPrefix(req.GetPageToken(), pageTokenOffsetPrefix) {
+		parsedOffset, err := strconv.ParseInt(strings.TrimPrefix(req.GetPageToken(), pageTokenOffsetPrefix), 10, 64)
+		if err != nil || parsedOffset < 0 {
+			return nil, status.InvalidArgumentError("Error parsing pagination token")
+		}
+		offset = parsedOffset
+	} else if req.GetPageToken() != "" {
+		return nil, status.InvalidArgumentError("Invalid pagination token")
 	}
-	executions, err := es.getInvocationExecutions(ctx, req.GetExecutionLookup().GetInvocationId())
+	limit := pageLimit(req)
+	executions, err := es.getExecutions(ctx, req.GetExecutionLookup(), limit, offset)
 	if err != nil {
 		return nil, err
 	}
-	// Sort the executions by start time.
-	sort.Slice(executions, func(i, j int) bool {
-		return executions[i].Model.CreatedAtUsec < executions[j].Model.CreatedAtUsec
-	})
 	rsp := &espb.GetExecutionResponse{}
 	for _, execution := range executions {
 		protoExec, err := tableExecToProto(execution)
@@ -129,5 +217,64 @@ func (es *ExecutionService) GetExecution(ctx context.Context, req *espb.GetExecu
 		}
 		rsp.Execution = append(rsp.Execution, protoExec)
 	}
+	if limit > 0 && int64(len(executions)) == limit {
+		rsp.NextPageToken = pageTokenOffsetPrefix + strconv.FormatInt(offset+limit, 10)
+	}
+	return rsp, nil
+}
+
+func (es *ExecutionService) GetExecutionProgress(ctx context.Context, req *espb.GetExecutionProgressRequest) (*espb.GetExecutionProgressResponse, error) {
+	if es.env.GetDBHandle() == nil {
+		return nil, status.FailedPreconditionError("database not configured")
+	}
+	if err := checkPreconditions(req.GetExecutionLookup()); err != nil {
+		return nil, err
+	}
+	q := query_builder.NewQuery(`SELECT e.stage, COUNT(*) AS count, MIN(e.created_at_usec) AS min_created_at_usec FROM Executions as e`)
+	q = q.AddWhereClause(`e.invocation_id = ?`, req.GetExecutionLookup().GetInvocationId())
+	if err := perms.AddPermissionsCheckToQueryWithTableAlias(ctx, es.env, q, "e"); err != nil {
+		return nil, err
+	}
+	q.SetGroupBy("e.stage")
+	queryStr, args := q.Build()
+
+	type stageCount struct {
+		Stage            int64
+		Count            int64
+		MinCreatedAtUsec int64
+	}
+	var counts []*stageCount
+	if err := es.env.GetDBHandle().WithContext(ctx).Raw(queryStr, args...).Scan(&counts).Error; err != nil {
+		return nil, err
+	}
+
+	nowUsec := timeutil.ToUsec(time.Now())
+	age := func(createdAtUsec int64) int64 {
+		if a := nowUsec - createdAtUsec; a > 0 {
+			return a
+		}
+		return 0
+	}
+	rsp := &espb.GetExecutionProgressResponse{}
+	for _, c := range counts {
+		switch repb.ExecutionStage_Value(c.Stage) {
+		case repb.ExecutionStage_COMPLETED:
+			rsp.CompletedCount += c.Count
+		case repb.ExecutionStage_CACHE_CHECK, repb.ExecutionStage_EXECUTING:
+			// Executors report the cache check stage after picking up the
+			// execution.
+			rsp.ExecutingCount += c.Count
+			if a := age(c.MinCreatedAtUsec); a > rsp.OldestExecutingAgeUsec {
+				rsp.OldestExecutingAgeUsec = a
+			}
+		default:
+			// Executions aren't updated until an executor picks them up, so
+			// they remain in the stage they were created in while queued.
+			rsp.QueuedCount += c.Count
+			if a := age(c.MinCreatedAtUsec); a > rsp.OldestQueuedAgeUsec {
+				rsp.OldestQueuedAgeUsec = a
+			}
+		}
+	}
 	return rsp, nil
 }
@@ -0,0 +1,156 @@
+package execution_service_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/execution_service"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+func insertExecution(t *testing.T, te *testenv.TestEnv, id, invocationID, groupID string, stage repb.ExecutionStage_Value, createdAt time.Time) {
+	err := te.GetDBHandle().Create(&tables.Execution{
+		ExecutionID:  id,
+		InvocationID: invocationID,
+		GroupID:      groupID,
+		Perms:        perms.GROUP_READ,
+		Stage:        int64(stage),
+	}).Error
+	require.NoError(t, err)
+	// Creation timestamps are set on insert, so backdate them afterwards.
+	err = te.GetDBHandle().Model(&tables.Execution{}).Where("execution_id = ?", id).UpdateColumn("created_at_usec", timeutil.ToUsec(createdAt)).Error
+	require.NoError(t, err)
+}
+
+func TestGetExecutionProgress(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")))
+	ctx, err := te.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+	es := execution_service.NewExecutionService(te)
+
+	now := time.Now()
+	insertExecution(t, te, "e1", "iid-1", "GR1", repb.ExecutionStage_UNKNOWN, now.Add(-10*time.Minute))
+	insertExecution(t, te, "e2", "iid-1", "GR1", repb.ExecutionStage_UNKNOWN, now.Add(-1*time.Minute))
+	insertExecution(t, te, "e3", "iid-1", "GR1", repb.ExecutionStage_CACHE_CHECK, now.Add(-20*time.Minute))
+	insertExecution(t, te, "e4", "iid-1", "GR1", repb.ExecutionStage_EXECUTING, now.Add(-5*time.Minute))
+	insertExecution(t, te, "e5", "iid-1", "GR1", repb.ExecutionStage_COMPLETED, now.Add(-30*time.Minute))
+	// Executions of other invocations and groups aren't counted.
+	insertExecution(t, te, "e6", "iid-2", "GR1", repb.ExecutionStage_UNKNOWN, now.Add(-time.Hour))
+	insertExecution(t, te, "e7", "iid-1", "GR2", repb.ExecutionStage_UNKNOWN, now.Add(-time.Hour))
+
+	rsp, err := es.GetExecutionProgress(ctx, &espb.GetExecutionProgressRequest{
+		ExecutionLookup: &espb.ExecutionLookup{InvocationId: "iid-1"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), rsp.GetQueuedCount())
+	assert.Equal(t, int64(2), rsp.GetExecutingCount())
+	assert.Equal(t, int64(1), rsp.GetCompletedCount())
+	assert.InDelta(t, (10 * time.Minute).Microseconds(), rsp.GetOldestQueuedAgeUsec(), float64(time.Minute.Microseconds()))
+	assert.InDelta(t, (20 * time.Minute).Microseconds(), rsp.GetOldestExecutingAgeUsec(), float64(time.Minute.Microseconds()))
+
+	_, err = es.GetExecutionProgress(ctx, &espb.GetExecutionProgressRequest{})
+	assert.Error(t, err)
+}
+
+func executionID(t *testing.T, n int) string {
+	id, err := digest.UploadResourceName(&repb.Digest{Hash: fmt.Sprintf("%064d", n), SizeBytes: int64(n)}, "")
+	require.NoError(t, err)
+	return id
+}
+
+func TestGetExecution(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")))
+	ctx, err := te.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+	es := execution_service.NewExecutionService(te)
+
+	now := time.Now()
+	for i, e := range []*tables.Execution{
+		{InvocationID: "iid-1", TargetID: "//a", Pool: "", Stage: int64(repb.ExecutionStage_COMPLETED)},
+		{InvocationID: "iid-1", TargetID: "//a", Pool: "gpu", Stage: int64(repb.ExecutionStage_COMPLETED), StatusCode: 2},
+		{InvocationID: "iid-1", TargetID: "//b", Pool: "gpu", Stage: int64(repb.ExecutionStage_EXECUTING)},
+		{InvocationID: "iid-1", TargetID: "//b", Pool: "", Stage: int64(repb.ExecutionStage_UNKNOWN)},
+		{InvocationID: "iid-2", TargetID: "//a", Pool: "", Stage: int64(repb.ExecutionStage_CACHE_CHECK)},
+		// Executions of other groups are never returned.
+		{InvocationID: "iid-1", TargetID: "//a", GroupID: "GR2", Stage: int64(repb.ExecutionStage_COMPLETED)},
+	} {
+		e.ExecutionID = executionID(t, i+1)
+		if e.GroupID == "" {
+			e.GroupID = "GR1"
+		}
+		e.Perms = perms.GROUP_READ
+		require.NoError(t, te.GetDBHandle().Create(e).Error)
+		err = te.GetDBHandle().Model(&tables.Execution{}).Where("execution_id = ?", e.ExecutionID).UpdateColumn("created_at_usec", timeutil.ToUsec(now.Add(time.Duration(i)*time.Second))).Error
+		require.NoError(t, err)
+	}
+	lookup := func(req *espb.GetExecutionRequest) []int64 {
+		rsp, err := es.GetExecution(ctx, req)
+		require.NoError(t, err)
+		var sizes []int64
+		for _, e := range rsp.GetExecution() {
+			sizes = append(sizes, e.GetActionDigest().GetSizeBytes())
+		}
+		return sizes
+	}
+
+	assert.Equal(t, []int64{1, 2, 3, 4}, lookup(&espb.GetExecutionRequest{ExecutionLookup: &espb.ExecutionLookup{InvocationId: "iid-1"}}))
+	assert.Equal(t, []int64{1, 2, 5}, lookup(&espb.GetExecutionRequest{ExecutionLookup: &espb.ExecutionLookup{TargetLabel: "//a"}}))
+	assert.Equal(t, []int64{2, 3}, lookup(&espb.GetExecutionRequest{ExecutionLookup: &espb.ExecutionLookup{Pool: "gpu"}}))
+	assert.Equal(t, []int64{1}, lookup(&espb.GetExecutionRequest{ExecutionLookup: &espb.ExecutionLookup{
+		State: []espb.ExecutionLookup_ExecutionState{espb.ExecutionLookup_SUCCEEDED},
+	}}))
+	assert.Equal(t, []int64{2, 4}, lookup(&espb.GetExecutionRequest{ExecutionLookup: &espb.ExecutionLookup{
+		InvocationId: "iid-1",
+		State:        []espb.ExecutionLookup_ExecutionState{espb.ExecutionLookup_QUEUED, espb.ExecutionLookup_FAILED},
+	}}))
+	assert.Equal(t, []int64{3, 5}, lookup(&espb.GetExecutionRequest{ExecutionLookup: &espb.ExecutionLookup{
+		State: []espb.ExecutionLookup_ExecutionState{espb.ExecutionLookup_EXECUTING},
+	}}))
+
+	rsp, err := es.GetExecution(ctx, &espb.GetExecutionRequest{ExecutionLookup: &espb.ExecutionLookup{InvocationId: "iid-1"}})
+	require.NoError(t, err)
+	assert.Equal(t, "iid-1", rsp.GetExecution()[1].GetInvocationId())
+	assert.Equal(t, "//a", rsp.GetExecution()[1].GetTargetLabel())
+	assert.Equal(t, "gpu", rsp.GetExecution()[1].GetPool())
+	assert.Empty(t, rsp.GetNextPageToken())
+
+	// Page through the invocation's executions.
+	var pages [][]int64
+	pageToken := ""
+	for {
+		rsp, err := es.GetExecution(ctx, &espb.GetExecutionRequest{
+			ExecutionLookup: &espb.ExecutionLookup{InvocationId: "iid-1"},
+			Count:           3,
+			PageToken:       pageToken,
+		})
+		require.NoError(t, err)
+		var page []int64
+		for _, e := range rsp.GetExecution() {
+			page = append(page, e.GetActionDigest().GetSizeBytes())
+		}
+		pages = append(pages, page)
+		pageToken = rsp.GetNextPageToken()
+		if pageToken == "" {
+			break
+		}
+	}
+	assert.Equal(t, [][]int64{{1, 2, 3}, {4}}, pages)
+
+	_, err = es.GetExecution(ctx, &espb.GetExecutionRequest{PageToken: "bogus"})
+	assert.True(t, status.IsInvalidArgumentError(err), err)
+}
@@ -0,0 +1,602 @@
+// Package githubapp authenticates to GitHub as the installations of a GitHub
+// App, and handles the deliveries of the App's webhook.
+//
+// Installation tokens expire after an hour, so rather than storing them, they
+// are created whenever needed and cached until shortly before they expire.
+//
+// An installation can only be used by the group that it's linked to, by a
+// member of the group who can access the installation on GitHub, since the App
+// may be installed on the repos of many organizations.
+package githubapp
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/random"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/oauth2"
+
+	gitutil "github.com/buildbuddy-io/buildbuddy/server/util/git"
+	gh "github.com/google/go-github/github"
+)
+
+const (
+	// GitHub rejects App JWTs which expire more than 10 minutes after they
+	// were issued. They're backdated to allow for clock drift.
+	appJWTLifetime = 9 * time.Minute
+	appJWTBackdate = 1 * time.Minute
+
+	// Cached installation tokens are replaced once they have less than this
+	// long left, so that callers can use them for at least that long.
+	tokenRefreshMargin = 10 * time.Minute
+
+	// How long the installation that has access to a repo is cached for, in
+	// case an event removing the repo from it is missed.
+	repoInstallationTTL = 10 * time.Minute
+
+	// GitHub doesn't deliver payloads larger than 25MB.
+	maxWebhookPayloadBytes = 25 * 1024 * 1024
+
+	signatureHeader = "X-Hub-Signature-256"
+	signaturePrefix = "sha256="
+
+	linkStateCookieName        = "Github-App-State-Token"
+	linkGroupIDCookieName      = "Github-App-Linked-Group-ID"
+	linkInstallationCookieName = "Github-App-Installation-ID"
+	linkRedirectCookieName     = "Github-App-Redirect-Url"
+)
+
+type installationToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+type repoInstallation struct {
+	installationID int64
+	expiresAt      time.Time
+}
+
+// GitHubApp is a GitHub App configured for this server.
+type GitHubApp struct {
+	env           environment.Env
+	appID         int64
+	privateKey    *rsa.PrivateKey
+	webhookSecret []byte
+	slug          string
+	clientID      string
+	clientSecret  string
+	// The base URLs of the GitHub API and website, overridden by tests.
+	apiURL *url.URL
+	webURL *url.URL
+
+	mu sync.Mutex
+	// Installation tokens by installation ID.
+	tokens map[int64]*installationToken
+	// The installations with access to repos, by lowercase "owner/repo".
+	repoInstallations map[string]*repoInstallation
+}
+
+// New returns the GitHubApp configured in the github.app config section.
+func New(env environment.Env, c *config.GithubAppConfig) (*GitHubApp, error) {
+	if c.ID == 0 || c.PrivateKey == "" || c.WebhookSecret == "" || c.Slug == "" || c.ClientID == "" || c.ClientSecret == "" {
+		return nil, status.InvalidArgumentError("github.app requires an id, private_key, webhook_secret, slug, client_id, and client_secret")
+	}
+	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(c.PrivateKey))
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("github.app.private_key is not a valid PEM-encoded RSA key: %s", err)
+	}
+	apiURL, err := url.Parse("https://api.github.com/")
+	if err != nil {
+		return nil, err
+	}
+	webURL, err := url.Parse("https://github.com/")
+	if err != nil {
+		return nil, err
+	}
+	return &GitHubApp{
+		env:               env,
+		appID:             c.ID,
+		privateKey:        privateKey,
+		webhookSecret:     []byte(c.WebhookSecret),
+		slug:              c.Slug,
+		clientID:          c.ClientID,
+		clientSecret:      c.ClientSecret,
+		apiURL:            apiURL,
+		webURL:            webURL,
+		tokens:            make(map[int64]*installationToken),
+		repoInstallations: make(map[string]*repoInstallation),
+	}, nil
+}
+
+// appJWT returns a token which authenticates as the App itself, which is only
+// used to look up installations and create installation tokens.
+func (a *GitHubApp) appJWT() (string, error) {
+	now := a.env.GetClock().Now()
+	claims := &jwt.StandardClaims{
+		IssuedAt:  now.Add(-appJWTBackdate).Unix(),
+		ExpiresAt: now.Add(appJWTLifetime).Unix(),
+		Issuer:    strconv.FormatInt(a.appID, 10),
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(a.privateKey)
+}
+
+// appTransport authenticates requests as the App.
+type appTransport struct {
+	app *GitHubApp
+}
+
+func (t *appTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.app.appJWT()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (a *GitHubApp) appClient() *gh.Client {
+	client := gh.NewClient(&http.Client{Transport: &appTransport{app: a}})
+	client.BaseURL = a.apiURL
+	return client
+}
+
+func gitHubErrorToStatus(err error) error {
+	if errRsp, ok := err.(*gh.ErrorResponse); ok && errRsp.Response != nil && errRsp.Response.StatusCode == http.StatusNotFound {
+		return status.NotFoundErrorf("%s", err)
+	}
+	return status.UnavailableErrorf("%s", err)
+}
+
+func repoKey(repoURL string) (string, string, error) {
+	ownerRepo, err := gitutil.OwnerRepoFromRepoURL(repoURL)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.Split(ownerRepo, "/")
+	if len(parts) != 2 {
+		return "", "", status.InvalidArgumentErrorf("invalid GitHub repo URL %q", repoURL)
+	}
+	return parts[0], parts[1], nil
+}
+
+// isLinked returns whether the installation is linked to the group.
+func (a *GitHubApp) isLinked(ctx context.Context, groupID string, installationID int64) (bool, error) {
+	if groupID == "" {
+		return false, nil
+	}
+	dbh := a.env.GetDBHandle()
+	if dbh == nil {
+		return false, status.FailedPreconditionError("database not configured")
+	}
+	err := dbh.Raw(`SELECT * FROM GitHubAppInstallations WHERE installation_id = ? AND group_id = ?`, installationID, groupID).Take(&tables.GitHubAppInstallation{}).Error
+	if db.IsRecordNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (a *GitHubApp) GetInstallationID(ctx context.Context, groupID, repoURL string) (int64, error) {
+	owner, repo, err := repoKey(repoURL)
+	if err != nil {
+		return 0, err
+	}
+	installationID, err := a.findInstallationID(ctx, owner, repo)
+	if err != nil {
+		return 0, err
+	}
+	linked, err := a.isLinked(ctx, groupID, installationID)
+	if err != nil {
+		return 0, err
+	}
+	if !linked {
+		return 0, status.NotFoundErrorf("the GitHub App installation on %s/%s is not linked to this organization", owner, repo)
+	}
+	return installationID, nil
+}
+
+// findInstallationID returns the ID of the App's installation that has access
+// to the repo, whichever group it's linked to.
+func (a *GitHubApp) findInstallationID(ctx context.Context, owner, repo string) (int64, error) {
+	key := strings.ToLower(owner + "/" + repo)
+	now := a.env.GetClock().Now()
+	a.mu.Lock()
+	ri, ok := a.repoInstallations[key]
+	a.mu.Unlock()
+	if ok && now.Before(ri.expiresAt) {
+		return ri.installationID, nil
+	}
+
+	installation, _, err := a.appClient().Apps.FindRepositoryInstallation(ctx, owner, repo)
+	if err != nil {
+		err = gitHubErrorToStatus(err)
+		if status.IsNotFoundError(err) {
+			return 0, status.NotFoundErrorf("the GitHub App is not installed on %s/%s", owner, repo)
+		}
+		return 0, err
+	}
+	a.mu.Lock()
+	a.repoInstallations[key] = &repoInstallation{
+		installationID: installation.GetID(),
+		expiresAt:      now.Add(repoInstallationTTL),
+	}
+	a.mu.Unlock()
+	return installation.GetID(), nil
+}
+
+func (a *GitHubApp) GetInstallationToken(ctx context.Context, groupID string, installationID int64) (string, error) {
+	linked, err := a.isLinked(ctx, groupID, installationID)
+	if err != nil {
+		return "", err
+	}
+	if !linked {
+		return "", status.PermissionDeniedErrorf("GitHub App installation %d is not linked to this organization", installationID)
+	}
+	return a.installationToken(ctx, installationID)
+}
+
+func (a *GitHubApp) installationToken(ctx context.Context, installationID int64) (string, error) {
+	now := a.env.GetClock().Now()
+	a.mu.Lock()
+	t, ok := a.tokens[installationID]
+	a.mu.Unlock()
+	if ok && now.Add(tokenRefreshMargin).Before(t.expiresAt) {
+		return t.token, nil
+	}
+
+	// The client library uses a path for this that GitHub no longer serves.
+	client := a.appClient()
+	req, err := client.NewRequest("POST", fmt.Sprintf("app/installations/%d/access_tokens", installationID), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	token := &gh.InstallationToken{}
+	if _, err := client.Do(ctx, req, token); err != nil {
+		return "", gitHubErrorToStatus(err)
+	}
+	a.mu.Lock()
+	a.tokens[installationID] = &installationToken{
+		token:     token.GetToken(),
+		expiresAt: token.GetExpiresAt(),
+	}
+	a.mu.Unlock()
+	return token.GetToken(), nil
+}
+
+// unlinkInstallation removes the link between an installation and a group
+// once the App is uninstalled, since the installation can't come back.
+func (a *GitHubApp) unlinkInstallation(ctx context.Context, installationID int64) error {
+	dbh := a.env.GetDBHandle()
+	if dbh == nil {
+		return nil
+	}
+	return dbh.Exec(`DELETE FROM GitHubAppInstallations WHERE installation_id = ?`, installationID).Error
+}
+
+// forgetInstallation drops the cached token of an installation, and the repos
+// it has access to, once it is uninstalled or suspended.
+func (a *GitHubApp) forgetInstallation(installationID int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.tokens, installationID)
+	for key, ri := range a.repoInstallations {
+		if ri.installationID == installationID {
+			delete(a.repoInstallations, key)
+		}
+	}
+}
+
+// forgetRepos drops the cached installations of repos that were removed from
+// them.
+func (a *GitHubApp) forgetRepos(repos []*gh.Repository) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, repo := range repos {
+		delete(a.repoInstallations, strings.ToLower(repo.GetFullName()))
+	}
+}
+
+// validatePayload returns the payload of a webhook delivery, after checking
+// that it was signed with the App's webhook secret.
+func (a *GitHubApp) validatePayload(r *http.Request) ([]byte, error) {
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxWebhookPayloadBytes))
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("failed to read webhook payload: %s", err)
+	}
+	signature := r.Header.Get(signatureHeader)
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return nil, status.UnauthenticatedErrorf("missing %s header", signatureHeader)
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, signaturePrefix))
+	if err != nil {
+		return nil, status.UnauthenticatedErrorf("malformed %s header", signatureHeader)
+	}
+	mac := hmac.New(sha256.New, a.webhookSecret)
+	mac.Write(payload)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return nil, status.UnauthenticatedError("webhook signature does not match")
+	}
+	return payload, nil
+}
+
+// eventSource holds the fields that identify where an event came from, which
+// all of the App's events have.
+type eventSource struct {
+	Installation struct {
+		ID int64 `json:"id"`
+	} `json:"installation"`
+	Repository struct {
+		HTMLURL string `json:"html_url"`
+	} `json:"repository"`
+}
+
+func (a *GitHubApp) handleEvent(r *http.Request, payload []byte) error {
+	eventType := gh.WebHookType(r)
+	event, err := gh.ParseWebHook(eventType, payload)
+	if err != nil {
+		// Events that the App doesn't use may not be known to the client
+		// library.
+		return nil
+	}
+	switch event := event.(type) {
+	case *gh.InstallationEvent:
+		if action := event.GetAction(); action == "deleted" || action == "suspend" {
+			log.Infof("GitHub App installation %d was %s", event.GetInstallation().GetID(), action)
+			a.forgetInstallation(event.GetInstallation().GetID())
+			if action == "deleted" {
+				return a.unlinkInstallation(r.Context(), event.GetInstallation().GetID())
+			}
+		}
+		return nil
+	case *gh.InstallationRepositoriesEvent:
+		if event.GetAction() == "removed" {
+			a.forgetRepos(event.RepositoriesRemoved)
+		}
+		return nil
+	case *gh.PushEvent, *gh.PullRequestEvent:
+		wfs := a.env.GetWorkflowService()
+		if wfs == nil {
+			return nil
+		}
+		source := &eventSource{}
+		if err := json.Unmarshal(payload, source); err != nil {
+			return status.InvalidArgumentErrorf("failed to parse webhook payload: %s", err)
+		}
+		// Workflows handle the same events whether they're delivered to the
+		// App or to a webhook registered on the repo.
+		r.Body = ioutil.NopCloser(bytes.NewReader(payload))
+		wd, err := a.parseWebhookData(r)
+		if err != nil || wd == nil {
+			return err
+		}
+		return wfs.StartGitHubAppWorkflows(r.Context(), source.Installation.ID, source.Repository.HTMLURL, wd)
+	default:
+		return nil
+	}
+}
+
+func (a *GitHubApp) parseWebhookData(r *http.Request) (*interfaces.WebhookData, error) {
+	for _, provider := range a.env.GetGitProviders() {
+		if provider.MatchWebhookRequest(r) {
+			return provider.ParseWebhookData(r)
+		}
+	}
+	return nil, status.UnimplementedError("no git provider handles GitHub webhooks")
+}
+
+func (a *GitHubApp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	payload, err := a.validatePayload(r)
+	if err != nil {
+		log.Warningf("Rejected GitHub App webhook delivery: %s", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := a.handleEvent(r, payload); err != nil {
+		log.Warningf("Failed to handle GitHub App %q event: %s", gh.WebHookType(r), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+// userInstallationIDs returns the IDs of the App's installations that the
+// user can access, given a token of the user for the App.
+func (a *GitHubApp) userInstallationIDs(ctx context.Context, userToken string) (map[int64]bool, error) {
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: userToken})
+	client := gh.NewClient(oauth2.NewClient(ctx, ts))
+	client.BaseURL = a.apiURL
+	ids := make(map[int64]bool)
+	opt := &gh.ListOptions{PerPage: 100}
+	for {
+		installations, rsp, err := client.Apps.ListUserInstallations(ctx, opt)
+		if err != nil {
+			return nil, gitHubErrorToStatus(err)
+		}
+		for _, installation := range installations {
+			ids[installation.GetID()] = true
+		}
+		if rsp.NextPage == 0 {
+			return ids, nil
+		}
+		opt.Page = rsp.NextPage
+	}
+}
+
+// linkInstallation links an installation to a group, if the authenticated
+// user is a member of the group and the GitHub user whose token is given can
+// access the installation. An installation can only be linked to one group.
+func (a *GitHubApp) linkInstallation(ctx context.Context, groupID string, installationID int64, userToken string) error {
+	if err := perms.AuthorizeGroupAccess(ctx, a.env, groupID); err != nil {
+		return err
+	}
+	ids, err := a.userInstallationIDs(ctx, userToken)
+	if err != nil {
+		return err
+	}
+	if !ids[installationID] {
+		return status.PermissionDeniedErrorf("GitHub App installation %d is not accessible to the GitHub user", installationID)
+	}
+	dbh := a.env.GetDBHandle()
+	if dbh == nil {
+		return status.FailedPreconditionError("database not configured")
+	}
+	return dbh.Transaction(ctx, func(tx *db.DB) error {
+		var existing tables.GitHubAppInstallation
+		err := tx.Where("installation_id = ?", installationID).First(&existing).Error
+		if db.IsRecordNotFound(err) {
+			return tx.Create(&tables.GitHubAppInstallation{InstallationID: installationID, GroupID: groupID}).Error
+		}
+		if err != nil {
+			return err
+		}
+		if existing.GroupID != groupID {
+			return status.AlreadyExistsErrorf("GitHub App installation %d is already linked to another organization", installationID)
+		}
+		return nil
+	})
+}
+
+// exchangeCode exchanges the code that GitHub redirects back with, once the
+// user has authorized the App, for a token of the user.
+func (a *GitHubApp) exchangeCode(ctx context.Context, code, state string) (string, error) {
+	form := url.Values{
+		"client_id":     {a.clientID},
+		"client_secret": {a.clientSecret},
+		"code":          {code},
+		"state":         {state},
+	}
+	req, err := http.NewRequest("POST", a.webURL.String()+"login/oauth/access_token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	rsp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", status.UnavailableErrorf("failed to exchange GitHub authorization code: %s", err)
+	}
+	defer rsp.Body.Close()
+	token := struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}{}
+	if err := json.NewDecoder(rsp.Body).Decode(&token); err != nil {
+		return "", status.UnavailableErrorf("failed to parse GitHub access token response: %s", err)
+	}
+	if token.AccessToken == "" {
+		return "", status.PermissionDeniedErrorf("GitHub did not grant an access token: %s", token.Error)
+	}
+	return token.AccessToken, nil
+}
+
+// Link links an installation of the App to a group in three steps. First, the
+// user is sent to install the App, or to pick an existing installation. GitHub
+// then redirects back with the ID of the installation, and the user is sent to
+// authorize the App. Last, GitHub redirects back with a code that's exchanged
+// for a token of the user, which shows whether they can access the
+// installation.
+func (a *GitHubApp) Link(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("state") == "" {
+		state := fmt.Sprintf("%d", random.RandUint64())
+		setCookie(w, linkStateCookieName, state)
+		setCookie(w, linkGroupIDCookieName, r.FormValue("group_id"))
+		setCookie(w, linkRedirectCookieName, r.FormValue("redirect_url"))
+		installURL := fmt.Sprintf("%sapps/%s/installations/new?state=%s", a.webURL, url.PathEscape(a.slug), url.QueryEscape(state))
+		http.Redirect(w, r, installURL, http.StatusTemporaryRedirect)
+		return
+	}
+
+	state := r.FormValue("state")
+	if state != getCookie(r, linkStateCookieName) {
+		log.Warningf("GitHub App link state mismatch: %s != %s", state, getCookie(r, linkStateCookieName))
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	installationIDParam := r.FormValue("installation_id")
+	if installationIDParam != "" {
+		setCookie(w, linkInstallationCookieName, installationIDParam)
+	} else {
+		installationIDParam = getCookie(r, linkInstallationCookieName)
+	}
+	installationID, err := strconv.ParseInt(installationIDParam, 10, 64)
+	if err != nil {
+		log.Warningf("Invalid GitHub App installation ID %q", installationIDParam)
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	code := r.FormValue("code")
+	if code == "" {
+		redirectURI := a.env.GetConfigurator().GetAppBuildBuddyURL() + "/auth/github/app/link/"
+		authorizeURL := fmt.Sprintf(
+			"%slogin/oauth/authorize?client_id=%s&state=%s&redirect_uri=%s",
+			a.webURL, url.QueryEscape(a.clientID), url.QueryEscape(state), url.QueryEscape(redirectURI))
+		http.Redirect(w, r, authorizeURL, http.StatusTemporaryRedirect)
+		return
+	}
+
+	userToken, err := a.exchangeCode(r.Context(), code, state)
+	if err != nil {
+		log.Warningf("Not linking GitHub App installation %d: %s", installationID, err)
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+	groupID := getCookie(r, linkGroupIDCookieName)
+	if err := a.linkInstallation(r.Context(), groupID, installationID, userToken); err != nil {
+		log.Warningf("Not linking GitHub App installation %d to group %q: %s", installationID, groupID, err)
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+	log.Infof("Linked GitHub App installation %d to group %q", installationID, groupID)
+
+	redirectURL := getCookie(r, linkRedirectCookieName)
+	if redirectURL == "" {
+		redirectURL = "/"
+	}
+	http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
+}
+
+func setCookie(w http.ResponseWriter, name, value string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Expires:  time.Now().Add(time.Hour),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+	})
+}
+
+func getCookie(r *http.Request, name string) string {
+	if c, err := r.Cookie(name); err == nil {
+		return c.Value
+	}
+	return ""
+}
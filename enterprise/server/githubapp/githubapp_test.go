@@ -0,0 +1,412 @@
+package githubapp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/github"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/fakeclock"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	appID          = 123
+	installationID = 42
+	webhookSecret  = "webhook-secret"
+	clientID       = "client-id"
+	clientSecret   = "client-secret"
+)
+
+// fakeGitHub serves the parts of the GitHub API used to authenticate as the
+// App's installations, and as users who authorized the App. The App is
+// installed on owner/repo.
+type fakeGitHub struct {
+	clock     *fakeclock.FakeClock
+	publicKey *rsa.PublicKey
+	// The installations that users can access, by the tokens of the users.
+	userInstallations map[string][]int64
+
+	mu               sync.Mutex
+	tokensCreated    int
+	installationGets int
+}
+
+func (f *fakeGitHub) serveUser(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/login/oauth/access_token":
+		// The code is the token it's exchanged for.
+		if r.FormValue("client_id") != clientID || r.FormValue("client_secret") != clientSecret {
+			fmt.Fprint(w, `{"error": "incorrect_client_credentials"}`)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": r.FormValue("code")})
+	case "/user/installations":
+		ids, ok := f.userInstallations[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+		if !ok {
+			http.Error(w, `{"message": "Bad credentials"}`, http.StatusUnauthorized)
+			return
+		}
+		var installations []map[string]int64
+		for _, id := range ids {
+			installations = append(installations, map[string]int64{"id": id})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"total_count": len(ids), "installations": installations})
+	}
+}
+
+func (f *fakeGitHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/login/oauth/access_token" || r.URL.Path == "/user/installations" {
+		f.serveUser(w, r)
+		return
+	}
+	token, err := (&jwt.Parser{SkipClaimsValidation: true}).Parse(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), func(*jwt.Token) (interface{}, error) {
+		return f.publicKey, nil
+	})
+	if err != nil || token.Claims.(jwt.MapClaims)["iss"] != fmt.Sprint(appID) {
+		http.Error(w, `{"message": "Bad credentials"}`, http.StatusUnauthorized)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/repos/owner/repo/installation":
+		f.installationGets++
+		fmt.Fprintf(w, `{"id": %d}`, installationID)
+	case r.Method == "POST" && r.URL.Path == fmt.Sprintf("/app/installations/%d/access_tokens", installationID):
+		f.tokensCreated++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":      fmt.Sprintf("token-%d", f.tokensCreated),
+			"expires_at": f.clock.Now().Add(time.Hour),
+		})
+	default:
+		http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+	}
+}
+
+type startedWorkflows struct {
+	installationID int64
+	repoURL        string
+	wd             *interfaces.WebhookData
+}
+
+type fakeWorkflowService struct {
+	interfaces.WorkflowService
+	started []*startedWorkflows
+}
+
+func (s *fakeWorkflowService) StartGitHubAppWorkflows(ctx context.Context, installationID int64, repoURL string, wd *interfaces.WebhookData) error {
+	s.started = append(s.started, &startedWorkflows{installationID, repoURL, wd})
+	return nil
+}
+
+func newTestApp(t *testing.T) (*GitHubApp, *fakeGitHub, *fakeWorkflowService) {
+	te := enterprise_testenv.GetCustomTestEnv(t, &enterprise_testenv.Options{})
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1", "US2", "GR2")))
+	clock := te.UseFakeClock()
+	wfs := &fakeWorkflowService{}
+	te.SetWorkflowService(wfs)
+	te.SetGitProviders([]interfaces.GitProvider{github.NewProvider()})
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	app, err := New(te, &config.GithubAppConfig{
+		ID:            appID,
+		PrivateKey:    string(keyPEM),
+		WebhookSecret: webhookSecret,
+		Slug:          "buildbuddy",
+		ClientID:      clientID,
+		ClientSecret:  clientSecret,
+	})
+	require.NoError(t, err)
+
+	gh := &fakeGitHub{
+		clock:     clock,
+		publicKey: &key.PublicKey,
+		userInstallations: map[string][]int64{
+			"member-token":   {7, installationID},
+			"outsider-token": {7},
+		},
+	}
+	server := httptest.NewServer(gh)
+	t.Cleanup(server.Close)
+	app.apiURL, err = url.Parse(server.URL + "/")
+	require.NoError(t, err)
+	app.webURL = app.apiURL
+	return app, gh, wfs
+}
+
+// userContext returns a context authenticated as a BuildBuddy user.
+func userContext(t *testing.T, app *GitHubApp, userID string) context.Context {
+	ctx, err := app.env.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), userID)
+	require.NoError(t, err)
+	return ctx
+}
+
+// link links the installation to the group, as if a member of the group
+// had done so.
+func link(t *testing.T, app *GitHubApp, groupID string) {
+	err := app.env.GetDBHandle().Create(&tables.GitHubAppInstallation{InstallationID: installationID, GroupID: groupID}).Error
+	require.NoError(t, err)
+}
+
+func webhookRequest(t *testing.T, eventType, payload, secret string) *http.Request {
+	req, err := http.NewRequest("POST", "https://buildbuddy.io/webhooks/github/app", strings.NewReader(payload))
+	require.NoError(t, err)
+	req.Header.Set("X-GitHub-Event", eventType)
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(payload))
+		req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return req
+}
+
+func serve(app *GitHubApp, req *http.Request) int {
+	rec := httptest.NewRecorder()
+	app.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestNewRequiresValidConfig(t *testing.T) {
+	te := enterprise_testenv.GetCustomTestEnv(t, &enterprise_testenv.Options{})
+	_, err := New(te, &config.GithubAppConfig{ID: appID, WebhookSecret: webhookSecret})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+	_, err = New(te, &config.GithubAppConfig{ID: appID, PrivateKey: "not a key", WebhookSecret: webhookSecret, Slug: "buildbuddy", ClientID: clientID, ClientSecret: clientSecret})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+}
+
+func TestGetInstallationID(t *testing.T) {
+	app, gh, _ := newTestApp(t)
+	ctx := context.Background()
+	link(t, app, "GR1")
+
+	id, err := app.GetInstallationID(ctx, "GR1", "https://github.com/owner/repo.git")
+	require.NoError(t, err)
+	assert.Equal(t, int64(installationID), id)
+	id, err = app.GetInstallationID(ctx, "GR1", "https://github.com/Owner/Repo")
+	require.NoError(t, err)
+	assert.Equal(t, int64(installationID), id)
+	assert.Equal(t, 1, gh.installationGets, "the installation should be cached")
+
+	_, err = app.GetInstallationID(ctx, "GR1", "https://github.com/owner/other-repo")
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+}
+
+func TestInstallationIsOnlyUsableByLinkedGroup(t *testing.T) {
+	app, _, _ := newTestApp(t)
+	ctx := context.Background()
+
+	// The App is installed on the repo, but the installation isn't linked
+	// to any group yet.
+	_, err := app.GetInstallationID(ctx, "GR1", "https://github.com/owner/repo")
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+	_, err = app.GetInstallationToken(ctx, "GR1", installationID)
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+
+	link(t, app, "GR1")
+	for _, groupID := range []string{"GR2", ""} {
+		_, err = app.GetInstallationID(ctx, groupID, "https://github.com/owner/repo")
+		assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+		_, err = app.GetInstallationToken(ctx, groupID, installationID)
+		assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+	}
+}
+
+func TestLinkInstallation(t *testing.T) {
+	app, _, _ := newTestApp(t)
+
+	// Users can only link installations to their own groups.
+	err := app.linkInstallation(userContext(t, app, "US2"), "GR1", installationID, "member-token")
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+
+	// Nor can they link installations that they can't access on GitHub.
+	err = app.linkInstallation(userContext(t, app, "US2"), "GR2", installationID, "outsider-token")
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+	_, err = app.GetInstallationToken(context.Background(), "GR2", installationID)
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+
+	require.NoError(t, app.linkInstallation(userContext(t, app, "US1"), "GR1", installationID, "member-token"))
+	require.NoError(t, app.linkInstallation(userContext(t, app, "US1"), "GR1", installationID, "member-token"))
+	_, err = app.GetInstallationToken(context.Background(), "GR1", installationID)
+	require.NoError(t, err)
+
+	// Once an installation is linked, a second group can't attach to it,
+	// even if one of its members can access the installation.
+	err = app.linkInstallation(userContext(t, app, "US2"), "GR2", installationID, "member-token")
+	assert.True(t, status.IsAlreadyExistsError(err), "expected AlreadyExists, got %v", err)
+	_, err = app.GetInstallationID(context.Background(), "GR2", "https://github.com/owner/repo")
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+	_, err = app.GetInstallationToken(context.Background(), "GR2", installationID)
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+}
+
+// followLink makes a request to the link flow with the cookies set so far,
+// and returns where it redirects to.
+func followLink(t *testing.T, app *GitHubApp, ctx context.Context, cookies map[string]string, target string) *url.URL {
+	req := httptest.NewRequest("GET", target, nil).WithContext(ctx)
+	for name, value := range cookies {
+		req.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+	rec := httptest.NewRecorder()
+	app.Link(rec, req)
+	require.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+	for _, c := range rec.Result().Cookies() {
+		cookies[c.Name] = c.Value
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	require.NoError(t, err)
+	return location
+}
+
+func TestLinkFlow(t *testing.T) {
+	app, _, _ := newTestApp(t)
+	ctx := userContext(t, app, "US1")
+	cookies := map[string]string{}
+
+	// The user is sent to install the App.
+	location := followLink(t, app, ctx, cookies, "/auth/github/app/link/?group_id=GR1&redirect_url=/workflows/")
+	assert.Equal(t, "/apps/buildbuddy/installations/new", location.Path)
+	state := location.Query().Get("state")
+	require.NotEmpty(t, state)
+
+	// Then to authorize the App, once it's installed.
+	location = followLink(t, app, ctx, cookies, fmt.Sprintf("/auth/github/app/link/?state=%s&installation_id=%d&setup_action=install", state, installationID))
+	assert.Equal(t, "/login/oauth/authorize", location.Path)
+	assert.Equal(t, clientID, location.Query().Get("client_id"))
+	assert.Equal(t, state, location.Query().Get("state"))
+
+	// Then back to BuildBuddy, once the installation is linked.
+	location = followLink(t, app, ctx, cookies, "/auth/github/app/link/?state="+state+"&code=member-token")
+	assert.Equal(t, "/workflows/", location.String())
+	_, err := app.GetInstallationID(context.Background(), "GR1", "https://github.com/owner/repo")
+	require.NoError(t, err)
+}
+
+func TestLinkFlowRejectsMismatchedState(t *testing.T) {
+	app, _, _ := newTestApp(t)
+	ctx := userContext(t, app, "US1")
+	cookies := map[string]string{}
+	followLink(t, app, ctx, cookies, "/auth/github/app/link/?group_id=GR1")
+
+	location := followLink(t, app, ctx, cookies, fmt.Sprintf("/auth/github/app/link/?state=other&installation_id=%d&code=member-token", installationID))
+	assert.Equal(t, "/", location.String())
+	_, err := app.GetInstallationToken(context.Background(), "GR1", installationID)
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+}
+
+func TestGetInstallationTokenIsCachedUntilNearExpiry(t *testing.T) {
+	app, gh, _ := newTestApp(t)
+	ctx := context.Background()
+	link(t, app, "GR1")
+
+	token, err := app.GetInstallationToken(ctx, "GR1", installationID)
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+
+	gh.clock.Advance(45 * time.Minute)
+	token, err = app.GetInstallationToken(ctx, "GR1", installationID)
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+
+	gh.clock.Advance(10 * time.Minute)
+	token, err = app.GetInstallationToken(ctx, "GR1", installationID)
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", token)
+}
+
+func TestWebhookSignatureVerification(t *testing.T) {
+	app, _, _ := newTestApp(t)
+	payload := `{"action": "created", "installation": {"id": 42}}`
+
+	assert.Equal(t, http.StatusOK, serve(app, webhookRequest(t, "installation", payload, webhookSecret)))
+	assert.Equal(t, http.StatusUnauthorized, serve(app, webhookRequest(t, "installation", payload, "")))
+	assert.Equal(t, http.StatusUnauthorized, serve(app, webhookRequest(t, "installation", payload, "wrong-secret")))
+}
+
+func TestSuspendForgetsInstallation(t *testing.T) {
+	app, gh, _ := newTestApp(t)
+	ctx := context.Background()
+	link(t, app, "GR1")
+
+	_, err := app.GetInstallationID(ctx, "GR1", "https://github.com/owner/repo")
+	require.NoError(t, err)
+	_, err = app.GetInstallationToken(ctx, "GR1", installationID)
+	require.NoError(t, err)
+
+	payload := `{"action": "suspend", "installation": {"id": 42}}`
+	require.Equal(t, http.StatusOK, serve(app, webhookRequest(t, "installation", payload, webhookSecret)))
+
+	// The installation stays linked, in case it's unsuspended.
+	_, err = app.GetInstallationID(ctx, "GR1", "https://github.com/owner/repo")
+	require.NoError(t, err)
+	token, err := app.GetInstallationToken(ctx, "GR1", installationID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, gh.installationGets)
+	assert.Equal(t, "token-2", token)
+}
+
+func TestUninstallUnlinksInstallation(t *testing.T) {
+	app, _, _ := newTestApp(t)
+	ctx := context.Background()
+	link(t, app, "GR1")
+
+	payload := `{"action": "deleted", "installation": {"id": 42}}`
+	require.Equal(t, http.StatusOK, serve(app, webhookRequest(t, "installation", payload, webhookSecret)))
+
+	_, err := app.GetInstallationToken(ctx, "GR1", installationID)
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+}
+
+func TestPushStartsWorkflows(t *testing.T) {
+	app, _, wfs := newTestApp(t)
+	payload := `{
+		"ref": "refs/heads/main",
+		"head_commit": {"id": "abc123"},
+		"repository": {
+			"html_url": "https://github.com/owner/repo",
+			"clone_url": "https://github.com/owner/repo.git"
+		},
+		"installation": {"id": 42}
+	}`
+
+	require.Equal(t, http.StatusOK, serve(app, webhookRequest(t, "push", payload, webhookSecret)))
+
+	require.Len(t, wfs.started, 1)
+	assert.Equal(t, int64(installationID), wfs.started[0].installationID)
+	assert.Equal(t, "https://github.com/owner/repo", wfs.started[0].repoURL)
+	assert.Equal(t, "abc123", wfs.started[0].wd.SHA)
+	assert.Equal(t, "main", wfs.started[0].wd.PushedBranch)
+}
+
+func TestUnsignedPushIsRejected(t *testing.T) {
+	app, _, wfs := newTestApp(t)
+	payload := `{"ref": "refs/heads/main", "head_commit": {"id": "abc123"}, "repository": {"clone_url": "https://github.com/owner/repo.git"}}`
+	assert.Equal(t, http.StatusUnauthorized, serve(app, webhookRequest(t, "push", payload, "")))
+	assert.Empty(t, wfs.started)
+}
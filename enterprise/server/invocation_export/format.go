@@ -0,0 +1,86 @@
+package invocation_export
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/parquet"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	iepb "github.com/buildbuddy-io/buildbuddy/proto/invocation_export"
+)
+
+// rowWriter writes the rows of an export in one of the export formats.
+type rowWriter interface {
+	Write(row []interface{}) error
+	Close() error
+}
+
+func newRowWriter(w io.Writer, format iepb.ExportJob_Format, columns []parquet.Column) (rowWriter, error) {
+	switch format {
+	case iepb.ExportJob_CSV_FORMAT:
+		return newCSVWriter(w, columns)
+	case iepb.ExportJob_PARQUET_FORMAT:
+		return parquet.NewWriter(w, columns)
+	default:
+		return nil, status.InvalidArgumentErrorf("Unsupported format %s", format)
+	}
+}
+
+func fileExtension(format iepb.ExportJob_Format) string {
+	if format == iepb.ExportJob_PARQUET_FORMAT {
+		return ".parquet"
+	}
+	return ".csv"
+}
+
+func contentType(format iepb.ExportJob_Format) string {
+	if format == iepb.ExportJob_PARQUET_FORMAT {
+		return "application/vnd.apache.parquet"
+	}
+	return "text/csv"
+}
+
+// csvWriter writes rows as CSV, with a header row of the column names.
+type csvWriter struct {
+	w      *csv.Writer
+	record []string
+}
+
+func newCSVWriter(w io.Writer, columns []parquet.Column) (*csvWriter, error) {
+	cw := &csvWriter{w: csv.NewWriter(w), record: make([]string, len(columns))}
+	for i, c := range columns {
+		cw.record[i] = c.Name
+	}
+	if err := cw.w.Write(cw.record); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *csvWriter) Write(row []interface{}) error {
+	if len(row) != len(cw.record) {
+		return status.InvalidArgumentErrorf("Row has %d values, but the file has %d columns", len(row), len(cw.record))
+	}
+	for i, v := range row {
+		switch v := v.(type) {
+		case string:
+			cw.record[i] = v
+		case int64:
+			cw.record[i] = strconv.FormatInt(v, 10)
+		case float64:
+			cw.record[i] = strconv.FormatFloat(v, 'g', -1, 64)
+		case bool:
+			cw.record[i] = strconv.FormatBool(v)
+		default:
+			return status.InvalidArgumentErrorf("Unsupported value type %T", v)
+		}
+	}
+	return cw.w.Write(cw.record)
+}
+
+func (cw *csvWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
@@ -0,0 +1,388 @@
+// Package invocation_export exports the records of the invocations matching a
+// search, or of their targets or tests, to CSV or Parquet files, so that data
+// teams can analyze them in bulk instead of paging through the search API.
+//
+// Exports run in the background on the app that created them, which writes
+// the file to the blobstore. Once an export is done, GetExportJob returns a
+// URL that the file can be downloaded from until it expires, signed with a
+// key shared by the apps so that the URL can be used by tools without
+// BuildBuddy credentials.
+package invocation_export
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/invocation_search_service"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+
+	iepb "github.com/buildbuddy-io/buildbuddy/proto/invocation_export"
+	uidpb "github.com/buildbuddy-io/buildbuddy/proto/user_id"
+)
+
+const (
+	// The path that exported files are downloaded from, where ServeHTTP is
+	// registered.
+	downloadPath = "/export/download"
+
+	// The most rows an export may contain, unless configured otherwise.
+	defaultMaxRows = 1000000
+
+	// How long a download URL is valid for after it is returned.
+	downloadURLTTL = 1 * time.Hour
+
+	// How long an export may take before it is given up. Exports that are
+	// still running after this long were interrupted, such as by the app
+	// that ran them shutting down.
+	exportTimeout = 1 * time.Hour
+
+	// How long exported files are kept before they are deleted.
+	exportRetention = 7 * 24 * time.Hour
+
+	// How often exports older than exportRetention are deleted.
+	cleanupInterval = 1 * time.Hour
+
+	// The prefix of the blobstore names of exported files.
+	blobNamePrefix = "exports/"
+)
+
+// IsConfigured returns whether exports are enabled.
+func IsConfigured(c *config.ExportConfig) bool {
+	return c.Enabled
+}
+
+type InvocationExportService struct {
+	env        environment.Env
+	signingKey []byte
+	maxRows    int64
+
+	// The parent context of exports, which outlive the requests that
+	// create them. Canceled on shutdown.
+	bgCtx            context.Context
+	cancelBackground context.CancelFunc
+}
+
+func NewInvocationExportService(env environment.Env) (*InvocationExportService, error) {
+	c := env.GetConfigurator().GetExportConfig()
+	if c.MaxRows < 0 {
+		return nil, status.InvalidArgumentErrorf("export.max_rows must not be negative, but is %d", c.MaxRows)
+	}
+	signingKey := []byte(c.URLSigningKey)
+	if len(signingKey) == 0 {
+		log.Warning("export.url_signing_key is not set; export download URLs will only work on the app that created them.")
+		signingKey = make([]byte, 32)
+		if _, err := rand.Read(signingKey); err != nil {
+			return nil, status.InternalErrorf("could not generate export URL signing key: %s", err)
+		}
+	}
+	maxRows := c.MaxRows
+	if maxRows == 0 {
+		maxRows = defaultMaxRows
+	}
+	s := &InvocationExportService{
+		env:        env,
+		signingKey: signingKey,
+		maxRows:    maxRows,
+	}
+	s.bgCtx, s.cancelBackground = context.WithCancel(context.Background())
+	if hc := env.GetHealthChecker(); hc != nil {
+		hc.RegisterShutdownFunction(func(ctx context.Context) error {
+			s.cancelBackground()
+			return nil
+		})
+	}
+	go s.deleteExpiredExports()
+	return s, nil
+}
+
+// CreateExportJob starts exporting the records of the invocations of the
+// selected group which match the query.
+func (s *InvocationExportService) CreateExportJob(ctx context.Context, req *iepb.CreateExportJobRequest) (*iepb.CreateExportJobResponse, error) {
+	if req.GetRecordType() == iepb.ExportJob_UNKNOWN_RECORD_TYPE {
+		return nil, status.InvalidArgumentError("record_type is required")
+	}
+	if req.GetFormat() == iepb.ExportJob_UNKNOWN_FORMAT {
+		return nil, status.InvalidArgumentError("format is required")
+	}
+	if s.env.GetBlobstore() == nil {
+		return nil, status.FailedPreconditionError("No blobstore configured")
+	}
+	groupID, err := perms.AuthenticateSelectedGroupID(ctx, s.env, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	user, err := perms.AuthenticatedUser(ctx, s.env)
+	if err != nil {
+		return nil, err
+	}
+	schema, ok := schemas[req.GetRecordType()]
+	if !ok {
+		return nil, status.InvalidArgumentErrorf("Unsupported record_type %s", req.GetRecordType())
+	}
+
+	// The query is built while the request is authenticated, since the
+	// export runs after the request has returned.
+	q := schema.newQuery()
+	q.AddWhereClause("i.group_id = ?", groupID)
+	q.AddWhereClause("i.deleted_at_usec = 0")
+	invocation_search_service.AddInvocationQueryFilters(q, req.GetQuery())
+	if err := perms.AddPermissionsCheckToQueryWithTableAlias(ctx, s.env, q, "i"); err != nil {
+		return nil, err
+	}
+	q.SetOrderBy("i.created_at_usec", true /*=ascending*/)
+	// One more row than allowed is fetched to tell whether there are too
+	// many.
+	q.SetLimit(s.maxRows + 1)
+
+	jobID, err := tables.PrimaryKeyForTable("ExportJobs")
+	if err != nil {
+		return nil, status.InternalError(err.Error())
+	}
+	permissions := perms.GroupAuthPermissions(groupID)
+	job := &tables.ExportJob{
+		ExportJobID: jobID,
+		UserID:      user.GetUserID(),
+		GroupID:     groupID,
+		Perms:       permissions.Perms,
+		RecordType:  int32(req.GetRecordType()),
+		Format:      int32(req.GetFormat()),
+		Status:      int32(iepb.ExportJob_RUNNING),
+	}
+	if err := s.env.GetDBHandle().Create(job).Error; err != nil {
+		return nil, err
+	}
+
+	rsp := &iepb.CreateExportJobResponse{Job: s.jobProto(job)}
+	go s.runExport(job, schema, q)
+	return rsp, nil
+}
+
+// runExport writes the file of an export and records its outcome.
+func (s *InvocationExportService) runExport(job *tables.ExportJob, schema *recordSchema, q *query_builder.Query) {
+	ctx, cancel := context.WithTimeout(s.bgCtx, exportTimeout)
+	defer cancel()
+
+	blobName, rowCount, size, err := s.writeExport(ctx, job, schema, q)
+	updates := map[string]interface{}{
+		"status":     int32(iepb.ExportJob_DONE),
+		"blob_name":  blobName,
+		"row_count":  rowCount,
+		"size_bytes": size,
+	}
+	if err != nil {
+		log.Warningf("Export %q failed: %s", job.ExportJobID, err)
+		updates = map[string]interface{}{
+			"status": int32(iepb.ExportJob_ERROR),
+			"error":  err.Error(),
+		}
+	}
+	if err := s.env.GetDBHandle().Model(job).Where("export_job_id = ?", job.ExportJobID).Updates(updates).Error; err != nil {
+		log.Errorf("Failed to record outcome of export %q: %s", job.ExportJobID, err)
+	}
+}
+
+func (s *InvocationExportService) writeExport(ctx context.Context, job *tables.ExportJob, schema *recordSchema, q *query_builder.Query) (string, int64, int64, error) {
+	buf := &bytes.Buffer{}
+	w, err := newRowWriter(buf, iepb.ExportJob_Format(job.Format), schema.columns)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	qStr, qArgs := q.Build()
+	rows, err := s.env.GetDBHandle().WithContext(ctx).Raw(qStr, qArgs...).Rows()
+	if err != nil {
+		return "", 0, 0, err
+	}
+	defer rows.Close()
+	rowCount := int64(0)
+	for rows.Next() {
+		if rowCount == s.maxRows {
+			return "", 0, 0, status.ResourceExhaustedErrorf("The export would contain more than %d rows. Narrow down the query, such as by exporting a shorter time range.", s.maxRows)
+		}
+		row, err := schema.scanRow(s.env.GetDBHandle().DB, rows)
+		if err != nil {
+			return "", 0, 0, err
+		}
+		if err := w.Write(row); err != nil {
+			return "", 0, 0, err
+		}
+		rowCount++
+	}
+	if err := rows.Err(); err != nil {
+		return "", 0, 0, err
+	}
+	if err := w.Close(); err != nil {
+		return "", 0, 0, err
+	}
+
+	blobName := blobNamePrefix + job.ExportJobID + fileExtension(iepb.ExportJob_Format(job.Format))
+	if _, err := s.env.GetBlobstore().WriteBlob(ctx, blobName, buf.Bytes()); err != nil {
+		return "", 0, 0, err
+	}
+	return blobName, rowCount, int64(buf.Len()), nil
+}
+
+// GetExportJob returns the status of an export, and the URL its file can be
+// downloaded from once it is done.
+func (s *InvocationExportService) GetExportJob(ctx context.Context, req *iepb.GetExportJobRequest) (*iepb.GetExportJobResponse, error) {
+	if req.GetJobId() == "" {
+		return nil, status.InvalidArgumentError("job_id is required")
+	}
+	user, err := perms.AuthenticatedUser(ctx, s.env)
+	if err != nil {
+		return nil, err
+	}
+	job, err := s.lookupJob(s.env.GetDBHandle().WithContext(ctx), req.GetJobId())
+	if err != nil {
+		return nil, err
+	}
+	acl := perms.ToACLProto(&uidpb.UserId{Id: job.UserID}, job.GroupID, job.Perms)
+	if err := perms.AuthorizeRead(&user, acl); err != nil {
+		return nil, err
+	}
+	return &iepb.GetExportJobResponse{Job: s.jobProto(job)}, nil
+}
+
+func (s *InvocationExportService) lookupJob(tx *db.DB, jobID string) (*tables.ExportJob, error) {
+	job := &tables.ExportJob{}
+	if err := tx.Raw(`SELECT * FROM ExportJobs WHERE export_job_id = ?`, jobID).Take(job).Error; err != nil {
+		if db.IsRecordNotFound(err) {
+			return nil, status.NotFoundErrorf("Export %q not found", jobID)
+		}
+		return nil, err
+	}
+	return job, nil
+}
+
+func (s *InvocationExportService) jobProto(job *tables.ExportJob) *iepb.ExportJob {
+	p := &iepb.ExportJob{
+		JobId:         job.ExportJobID,
+		RecordType:    iepb.ExportJob_RecordType(job.RecordType),
+		Format:        iepb.ExportJob_Format(job.Format),
+		Status:        iepb.ExportJob_Status(job.Status),
+		Error:         job.Error,
+		CreatedAtUsec: job.CreatedAtUsec,
+	}
+	now := s.env.GetClock().Now()
+	switch p.Status {
+	case iepb.ExportJob_RUNNING:
+		if now.Sub(timeutil.FromUsec(job.CreatedAtUsec)) > exportTimeout {
+			p.Status = iepb.ExportJob_ERROR
+			p.Error = "The export was interrupted. Please try again."
+		}
+	case iepb.ExportJob_DONE:
+		expiration := now.Add(downloadURLTTL)
+		p.RowCount = job.RowCount
+		p.SizeBytes = job.SizeBytes
+		p.DownloadUrl = s.downloadURL(job.ExportJobID, expiration)
+		p.DownloadUrlExpirationUsec = timeutil.ToUsec(expiration)
+	}
+	return p
+}
+
+// downloadURL returns the URL that the file of an export can be downloaded
+// from until the expiration time.
+func (s *InvocationExportService) downloadURL(jobID string, expiration time.Time) string {
+	expires := strconv.FormatInt(expiration.Unix(), 10)
+	params := url.Values{}
+	params.Set("job_id", jobID)
+	params.Set("expires", expires)
+	params.Set("signature", s.sign(jobID, expires))
+	return s.env.GetConfigurator().GetAppBuildBuddyURL() + downloadPath + "?" + params.Encode()
+}
+
+func (s *InvocationExportService) sign(jobID, expires string) string {
+	mac := hmac.New(sha256.New, s.signingKey)
+	mac.Write([]byte(jobID + "\x00" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ServeHTTP serves the file of an export to requests for a download URL
+// returned by GetExportJob. The URL's signature is the only credential
+// required.
+func (s *InvocationExportService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	jobID := params.Get("job_id")
+	expires := params.Get("expires")
+	signature, err := hex.DecodeString(params.Get("signature"))
+	if err != nil || jobID == "" || expires == "" {
+		http.Error(w, "Invalid download URL", http.StatusBadRequest)
+		return
+	}
+	want, _ := hex.DecodeString(s.sign(jobID, expires))
+	if !hmac.Equal(signature, want) {
+		http.Error(w, "Invalid download URL signature", http.StatusForbidden)
+		return
+	}
+	expiresUnix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || s.env.GetClock().Now().After(time.Unix(expiresUnix, 0)) {
+		http.Error(w, "Download URL expired", http.StatusForbidden)
+		return
+	}
+
+	job, err := s.lookupJob(s.env.GetDBHandle().WithContext(r.Context()), jobID)
+	if err != nil || job.Status != int32(iepb.ExportJob_DONE) {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	data, err := s.env.GetBlobstore().ReadBlob(r.Context(), job.BlobName)
+	if err != nil {
+		log.Warningf("Could not read file of export %q: %s", jobID, err)
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	format := iepb.ExportJob_Format(job.Format)
+	w.Header().Set("Content-Type", contentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", job.ExportJobID+fileExtension(format)))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// deleteExpiredExports periodically deletes the exports, and their files,
+// that are older than exportRetention.
+func (s *InvocationExportService) deleteExpiredExports() {
+	for {
+		select {
+		case <-s.bgCtx.Done():
+			return
+		case <-time.After(cleanupInterval):
+			s.deleteExportsCreatedBefore(s.bgCtx, s.env.GetClock().Now().Add(-exportRetention))
+		}
+	}
+}
+
+func (s *InvocationExportService) deleteExportsCreatedBefore(ctx context.Context, cutoff time.Time) {
+	var expired []*tables.ExportJob
+	err := s.env.GetDBHandle().WithContext(ctx).Raw(`SELECT * FROM ExportJobs WHERE created_at_usec < ?`, timeutil.ToUsec(cutoff)).Scan(&expired).Error
+	if err != nil {
+		log.Warningf("Could not look up expired exports: %s", err)
+		return
+	}
+	for _, job := range expired {
+		if job.BlobName != "" {
+			if err := s.env.GetBlobstore().DeleteBlob(ctx, job.BlobName); err != nil {
+				log.Warningf("Could not delete file of export %q: %s", job.ExportJobID, err)
+				continue
+			}
+		}
+		if err := s.env.GetDBHandle().WithContext(ctx).Exec(`DELETE FROM ExportJobs WHERE export_job_id = ?`, job.ExportJobID).Error; err != nil {
+			log.Warningf("Could not delete export %q: %s", job.ExportJobID, err)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package invocation_export
+
+import (
+	"context"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	cmpb "github.com/buildbuddy-io/buildbuddy/proto/api/v1/common"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	iepb "github.com/buildbuddy-io/buildbuddy/proto/invocation_export"
+)
+
+func newTestService(t *testing.T) (*InvocationExportService, *testenv.TestEnv) {
+	te := enterprise_testenv.GetCustomTestEnv(t, &enterprise_testenv.Options{})
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1", "US2", "GR2")))
+	s, err := NewInvocationExportService(te)
+	require.NoError(t, err)
+	t.Cleanup(s.cancelBackground)
+	return s, te
+}
+
+func authContext(t *testing.T, te *testenv.TestEnv, userID string) context.Context {
+	ctx, err := te.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), userID)
+	require.NoError(t, err)
+	return ctx
+}
+
+func createInvocation(t *testing.T, te *testenv.TestEnv, ti *tables.Invocation) {
+	ti.Perms = perms.GROUP_READ
+	ti.InvocationStatus = int64(inpb.Invocation_COMPLETE_INVOCATION_STATUS)
+	require.NoError(t, te.GetDBHandle().Create(ti).Error)
+}
+
+// waitForJob returns the export once it is no longer running.
+func waitForJob(t *testing.T, ctx context.Context, s *InvocationExportService, jobID string) *iepb.ExportJob {
+	var job *iepb.ExportJob
+	require.Eventually(t, func() bool {
+		rsp, err := s.GetExportJob(ctx, &iepb.GetExportJobRequest{JobId: jobID})
+		require.NoError(t, err)
+		job = rsp.GetJob()
+		return job.GetStatus() != iepb.ExportJob_RUNNING
+	}, 10*time.Second, 10*time.Millisecond)
+	return job
+}
+
+func download(t *testing.T, s *InvocationExportService, downloadURL string) *httptest.ResponseRecorder {
+	u, err := url.Parse(downloadURL)
+	require.NoError(t, err)
+	assert.Equal(t, downloadPath, u.Path)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", u.RequestURI(), nil))
+	return rec
+}
+
+func export(t *testing.T, ctx context.Context, s *InvocationExportService, req *iepb.CreateExportJobRequest) *iepb.ExportJob {
+	req.RequestContext = testauth.RequestContext("US1", "GR1")
+	rsp, err := s.CreateExportJob(ctx, req)
+	require.NoError(t, err)
+	return waitForJob(t, ctx, s, rsp.GetJob().GetJobId())
+}
+
+func TestExportInvocationsToCSV(t *testing.T) {
+	s, te := newTestService(t)
+	ctx := authContext(t, te, "US1")
+	createInvocation(t, te, &tables.Invocation{InvocationID: "inv1", InvocationPK: 1, GroupID: "GR1", RepoURL: "https://github.com/a/b", Success: true, DurationUsec: 1000})
+	createInvocation(t, te, &tables.Invocation{InvocationID: "inv2", InvocationPK: 2, GroupID: "GR1", RepoURL: "https://github.com/a/b", User: "alice,bob"})
+	createInvocation(t, te, &tables.Invocation{InvocationID: "inv3", InvocationPK: 3, GroupID: "GR1", RepoURL: "https://github.com/c/d"})
+	createInvocation(t, te, &tables.Invocation{InvocationID: "inv4", InvocationPK: 4, GroupID: "GR2", RepoURL: "https://github.com/a/b"})
+
+	job := export(t, ctx, s, &iepb.CreateExportJobRequest{
+		Query:      &inpb.InvocationQuery{RepoUrl: "https://github.com/a/b"},
+		RecordType: iepb.ExportJob_INVOCATION_RECORD,
+		Format:     iepb.ExportJob_CSV_FORMAT,
+	})
+	require.Equal(t, iepb.ExportJob_DONE, job.GetStatus(), job.GetError())
+	assert.Equal(t, int64(2), job.GetRowCount())
+	assert.True(t, job.GetDownloadUrlExpirationUsec() > 0)
+
+	rec := download(t, s, job.GetDownloadUrl())
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "text/csv", rec.Header().Get("Content-Type"))
+	assert.Equal(t, job.GetSizeBytes(), int64(rec.Body.Len()))
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	header := map[string]int{}
+	for i, name := range records[0] {
+		header[name] = i
+	}
+	assert.Equal(t, "inv1", records[1][header["invocation_id"]])
+	assert.Equal(t, "true", records[1][header["success"]])
+	assert.Equal(t, "1000", records[1][header["duration_usec"]])
+	assert.Equal(t, "COMPLETE_INVOCATION_STATUS", records[1][header["invocation_status"]])
+	assert.Equal(t, "inv2", records[2][header["invocation_id"]])
+	assert.Equal(t, "alice,bob", records[2][header["user"]])
+}
+
+func TestExportTestsToParquet(t *testing.T) {
+	s, te := newTestService(t)
+	ctx := authContext(t, te, "US1")
+	createInvocation(t, te, &tables.Invocation{InvocationID: "inv1", InvocationPK: 1, GroupID: "GR1"})
+	for _, target := range []*tables.Target{
+		{TargetID: 1, GroupID: "GR1", Label: "//:lib"},
+		{TargetID: 2, GroupID: "GR1", Label: "//:test"},
+	} {
+		require.NoError(t, te.GetDBHandle().Create(target).Error)
+	}
+	for _, ts := range []*tables.TargetStatus{
+		{TargetID: 1, InvocationPK: 1, TargetType: int32(cmpb.TargetType_LIBRARY)},
+		{TargetID: 2, InvocationPK: 1, TargetType: int32(cmpb.TargetType_TEST)},
+	} {
+		require.NoError(t, te.GetDBHandle().Create(ts).Error)
+	}
+
+	job := export(t, ctx, s, &iepb.CreateExportJobRequest{
+		RecordType: iepb.ExportJob_TEST_RECORD,
+		Format:     iepb.ExportJob_PARQUET_FORMAT,
+	})
+	require.Equal(t, iepb.ExportJob_DONE, job.GetStatus(), job.GetError())
+	assert.Equal(t, int64(1), job.GetRowCount())
+
+	rec := download(t, s, job.GetDownloadUrl())
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	body := rec.Body.String()
+	assert.True(t, strings.HasPrefix(body, "PAR1"))
+	assert.True(t, strings.HasSuffix(body, "PAR1"))
+	assert.Contains(t, body, "//:test")
+	assert.NotContains(t, body, "//:lib")
+
+	job = export(t, ctx, s, &iepb.CreateExportJobRequest{
+		RecordType: iepb.ExportJob_TARGET_RECORD,
+		Format:     iepb.ExportJob_CSV_FORMAT,
+	})
+	require.Equal(t, iepb.ExportJob_DONE, job.GetStatus(), job.GetError())
+	assert.Equal(t, int64(2), job.GetRowCount())
+}
+
+func TestExportFailsWithTooManyRows(t *testing.T) {
+	s, te := newTestService(t)
+	s.maxRows = 1
+	ctx := authContext(t, te, "US1")
+	createInvocation(t, te, &tables.Invocation{InvocationID: "inv1", InvocationPK: 1, GroupID: "GR1"})
+	createInvocation(t, te, &tables.Invocation{InvocationID: "inv2", InvocationPK: 2, GroupID: "GR1"})
+
+	job := export(t, ctx, s, &iepb.CreateExportJobRequest{
+		RecordType: iepb.ExportJob_INVOCATION_RECORD,
+		Format:     iepb.ExportJob_CSV_FORMAT,
+	})
+	assert.Equal(t, iepb.ExportJob_ERROR, job.GetStatus())
+	assert.Contains(t, job.GetError(), "more than 1 rows")
+	assert.Empty(t, job.GetDownloadUrl())
+}
+
+func TestDownloadRequiresValidSignature(t *testing.T) {
+	s, te := newTestService(t)
+	ctx := authContext(t, te, "US1")
+	createInvocation(t, te, &tables.Invocation{InvocationID: "inv1", InvocationPK: 1, GroupID: "GR1"})
+	job := export(t, ctx, s, &iepb.CreateExportJobRequest{
+		RecordType: iepb.ExportJob_INVOCATION_RECORD,
+		Format:     iepb.ExportJob_CSV_FORMAT,
+	})
+	require.Equal(t, iepb.ExportJob_DONE, job.GetStatus(), job.GetError())
+
+	u, err := url.Parse(job.GetDownloadUrl())
+	require.NoError(t, err)
+	params := u.Query()
+	params.Set("expires", params.Get("expires")+"0")
+	u.RawQuery = params.Encode()
+	assert.Equal(t, http.StatusForbidden, download(t, s, u.String()).Code)
+
+	expired := s.downloadURL(job.GetJobId(), time.Now().Add(-time.Minute))
+	assert.Equal(t, http.StatusForbidden, download(t, s, expired).Code)
+
+	other, err := NewInvocationExportService(te)
+	require.NoError(t, err)
+	defer other.cancelBackground()
+	assert.Equal(t, http.StatusForbidden, download(t, other, job.GetDownloadUrl()).Code)
+}
+
+func TestGetExportJobRequiresGroupAccess(t *testing.T) {
+	s, te := newTestService(t)
+	ctx := authContext(t, te, "US1")
+	job := export(t, ctx, s, &iepb.CreateExportJobRequest{
+		RecordType: iepb.ExportJob_INVOCATION_RECORD,
+		Format:     iepb.ExportJob_CSV_FORMAT,
+	})
+
+	_, err := s.GetExportJob(authContext(t, te, "US2"), &iepb.GetExportJobRequest{JobId: job.GetJobId()})
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+
+	_, err = s.CreateExportJob(authContext(t, te, "US2"), &iepb.CreateExportJobRequest{
+		RequestContext: testauth.RequestContext("US2", "GR1"),
+		RecordType:     iepb.ExportJob_INVOCATION_RECORD,
+		Format:         iepb.ExportJob_CSV_FORMAT,
+	})
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+}
+
+func TestDeleteExpiredExports(t *testing.T) {
+	s, te := newTestService(t)
+	ctx := authContext(t, te, "US1")
+	job := export(t, ctx, s, &iepb.CreateExportJobRequest{
+		RecordType: iepb.ExportJob_INVOCATION_RECORD,
+		Format:     iepb.ExportJob_CSV_FORMAT,
+	})
+	require.Equal(t, iepb.ExportJob_DONE, job.GetStatus(), job.GetError())
+
+	s.deleteExportsCreatedBefore(ctx, time.Now().Add(-time.Hour))
+	_, err := s.GetExportJob(ctx, &iepb.GetExportJobRequest{JobId: job.GetJobId()})
+	require.NoError(t, err)
+
+	s.deleteExportsCreatedBefore(ctx, time.Now().Add(time.Hour))
+	_, err = s.GetExportJob(ctx, &iepb.GetExportJobRequest{JobId: job.GetJobId()})
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+	assert.Equal(t, http.StatusNotFound, download(t, s, job.GetDownloadUrl()).Code)
+}
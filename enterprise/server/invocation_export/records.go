@@ -0,0 +1,173 @@
+package invocation_export
+
+import (
+	"database/sql"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/parquet"
+	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
+
+	cmpb "github.com/buildbuddy-io/buildbuddy/proto/api/v1/common"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	iepb "github.com/buildbuddy-io/buildbuddy/proto/invocation_export"
+)
+
+// recordSchema describes the rows exported for a record type: their columns,
+// the query which selects them, and how a row of its results is converted to
+// the values of the columns.
+type recordSchema struct {
+	columns []parquet.Column
+
+	// newQuery returns a query of the rows, which joins the Invocations
+	// table as "i" so that the invocations can be filtered.
+	newQuery func() *query_builder.Query
+
+	scanRow func(tx *db.DB, rows *sql.Rows) ([]interface{}, error)
+}
+
+var schemas = map[iepb.ExportJob_RecordType]*recordSchema{
+	iepb.ExportJob_INVOCATION_RECORD: invocationSchema,
+	iepb.ExportJob_TARGET_RECORD:     targetSchema(false /*=testsOnly*/),
+	iepb.ExportJob_TEST_RECORD:       targetSchema(true /*=testsOnly*/),
+}
+
+var invocationSchema = &recordSchema{
+	columns: []parquet.Column{
+		{Name: "invocation_id", Type: parquet.String},
+		{Name: "user", Type: parquet.String},
+		{Name: "host", Type: parquet.String},
+		{Name: "command", Type: parquet.String},
+		{Name: "pattern", Type: parquet.String},
+		{Name: "role", Type: parquet.String},
+		{Name: "repo_url", Type: parquet.String},
+		{Name: "commit_sha", Type: parquet.String},
+		{Name: "bazel_version", Type: parquet.String},
+		{Name: "invocation_status", Type: parquet.String},
+		{Name: "success", Type: parquet.Bool},
+		{Name: "created_at_usec", Type: parquet.Int64},
+		{Name: "updated_at_usec", Type: parquet.Int64},
+		{Name: "duration_usec", Type: parquet.Int64},
+		{Name: "action_count", Type: parquet.Int64},
+		{Name: "action_cache_hits", Type: parquet.Int64},
+		{Name: "action_cache_misses", Type: parquet.Int64},
+		{Name: "action_cache_uploads", Type: parquet.Int64},
+		{Name: "cas_cache_hits", Type: parquet.Int64},
+		{Name: "cas_cache_misses", Type: parquet.Int64},
+		{Name: "cas_cache_uploads", Type: parquet.Int64},
+		{Name: "total_download_size_bytes", Type: parquet.Int64},
+		{Name: "total_upload_size_bytes", Type: parquet.Int64},
+		{Name: "action_cache_hit_rate", Type: parquet.Double},
+		{Name: "configured_target_count", Type: parquet.Int64},
+		{Name: "failed_target_count", Type: parquet.Int64},
+	},
+	newQuery: func() *query_builder.Query {
+		return query_builder.NewQuery(`SELECT * FROM Invocations AS i`)
+	},
+	scanRow: func(tx *db.DB, rows *sql.Rows) ([]interface{}, error) {
+		ti := &tables.Invocation{}
+		if err := tx.ScanRows(rows, ti); err != nil {
+			return nil, err
+		}
+		return []interface{}{
+			ti.InvocationID,
+			ti.User,
+			ti.Host,
+			ti.Command,
+			ti.Pattern,
+			ti.Role,
+			ti.RepoURL,
+			ti.CommitSHA,
+			ti.BazelVersion,
+			inpb.Invocation_InvocationStatus(ti.InvocationStatus).String(),
+			ti.Success,
+			ti.CreatedAtUsec,
+			ti.UpdatedAtUsec,
+			ti.DurationUsec,
+			ti.ActionCount,
+			ti.ActionCacheHits,
+			ti.ActionCacheMisses,
+			ti.ActionCacheUploads,
+			ti.CasCacheHits,
+			ti.CasCacheMisses,
+			ti.CasCacheUploads,
+			ti.TotalDownloadSizeBytes,
+			ti.TotalUploadSizeBytes,
+			ti.ActionCacheHitRate,
+			ti.ConfiguredTargetCount,
+			ti.FailedTargetCount,
+		}, nil
+	},
+}
+
+// targetRow is a row of the query of targetSchema.
+type targetRow struct {
+	InvocationID  string
+	CommitSHA     string
+	RepoURL       string
+	CreatedAtUsec int64
+	Label         string
+	RuleType      string
+	TargetType    int32
+	TestSize      int32
+	Status        int32
+	StartTimeUsec int64
+	DurationUsec  int64
+}
+
+// targetSchema returns the schema of the targets built or tested by the
+// invocations, or of only their tests.
+func targetSchema(testsOnly bool) *recordSchema {
+	return &recordSchema{
+		columns: []parquet.Column{
+			{Name: "invocation_id", Type: parquet.String},
+			{Name: "repo_url", Type: parquet.String},
+			{Name: "commit_sha", Type: parquet.String},
+			{Name: "invocation_created_at_usec", Type: parquet.Int64},
+			{Name: "label", Type: parquet.String},
+			{Name: "rule_type", Type: parquet.String},
+			{Name: "target_type", Type: parquet.String},
+			{Name: "test_size", Type: parquet.String},
+			{Name: "status", Type: parquet.String},
+			{Name: "start_time_usec", Type: parquet.Int64},
+			{Name: "duration_usec", Type: parquet.Int64},
+		},
+		newQuery: func() *query_builder.Query {
+			q := query_builder.NewQuery(`SELECT i.invocation_id, i.commit_sha, i.repo_url, i.created_at_usec,
+				t.label, t.rule_type, ts.target_type, ts.test_size, ts.status,
+				ts.start_time_usec, ts.duration_usec
+				FROM Targets AS t
+				JOIN TargetStatuses AS ts ON t.target_id = ts.target_id
+				JOIN Invocations AS i ON ts.invocation_pk = i.invocation_pk`)
+			// Targets are keyed by repo and label, so a target of another
+			// group's repo with the same name must not be matched.
+			q.AddWhereClause("t.group_id = i.group_id")
+			if testsOnly {
+				q.AddWhereClause("ts.target_type = ?", int32(cmpb.TargetType_TEST))
+			}
+			return q
+		},
+		scanRow: func(tx *db.DB, rows *sql.Rows) ([]interface{}, error) {
+			r := &targetRow{}
+			if err := tx.ScanRows(rows, r); err != nil {
+				return nil, err
+			}
+			return []interface{}{
+				r.InvocationID,
+				r.RepoURL,
+				r.CommitSHA,
+				r.CreatedAtUsec,
+				r.Label,
+				r.RuleType,
+				cmpb.TargetType(r.TargetType).String(),
+				cmpb.TestSize(r.TestSize).String(),
+				// Target statuses are stored as the test status reported by
+				// Bazel.
+				build_event_stream.TestStatus(r.Status).String(),
+				r.StartTimeUsec,
+				r.DurationUsec,
+			}, nil
+		},
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/tags"
 
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
 )
@@ -22,6 +23,12 @@ const (
 	// See defaultSortParams() for sort defaults.
 	defaultLimitSize     = int64(15)
 	pageSizeOffsetPrefix = "offset_"
+
+	// The most related invocations returned by GetRelatedInvocations.
+	defaultRelatedInvocationsCount = 50
+
+	// The build metadata key holding the branch that an invocation built.
+	gitBranchMetadataKey = "GIT_BRANCH"
 )
 
 type InvocationSearchService struct {
@@ -69,7 +76,7 @@ func (s *InvocationSearchService) checkPreconditions(req *inpb.SearchInvocationR
 	if req.Query == nil {
 		return status.InvalidArgumentError("The query field is required")
 	}
-	if req.Query.Host == "" && req.Query.User == "" && req.Query.CommitSha == "" && req.Query.RepoUrl == "" && req.Query.GroupId == "" {
+	if req.Query.Host == "" && req.Query.User == "" && req.Query.CommitSha == "" && req.Query.RepoUrl == "" && req.Query.GroupId == "" && len(req.Query.Tag) == 0 {
 		return status.InvalidArgumentError("At least one search atom must be set")
 	}
 	return nil
@@ -95,6 +102,38 @@ func addPermissionsCheckToQuery(tu *tables.User, q *query_builder.Query) {
 	q = q.AddWhereClause("("+orQuery+")", orArgs...)
 }
 
+// AddInvocationQueryFilters restricts q, a query of the Invocations table
+// aliased as "i", to the invocations matching the search parameters of iq.
+func AddInvocationQueryFilters(q *query_builder.Query, iq *inpb.InvocationQuery) {
+	if user := iq.GetUser(); user != "" {
+		q.AddWhereClause("i.user = ?", user)
+	}
+	if host := iq.GetHost(); host != "" {
+		q.AddWhereClause("i.host = ?", host)
+	}
+	if url := iq.GetRepoUrl(); url != "" {
+		q.AddWhereClause("i.repo_url = ?", url)
+	}
+	if sha := iq.GetCommitSha(); sha != "" {
+		q.AddWhereClause("i.commit_sha = ?", sha)
+	}
+	if group_id := iq.GetGroupId(); group_id != "" {
+		q.AddWhereClause("i.group_id = ?", group_id)
+	}
+	if role := iq.GetRole(); role != "" {
+		q.AddWhereClause("i.role = ?", role)
+	}
+	for _, tag := range iq.GetTag() {
+		q.AddWhereClause("i.invocation_id IN (SELECT invocation_id FROM InvocationTags WHERE tag = ?)", tags.Normalize(tag))
+	}
+	if after := iq.GetUpdatedAfterUsec(); after != 0 {
+		q.AddWhereClause("i.updated_at_usec >= ?", after)
+	}
+	if before := iq.GetUpdatedBeforeUsec(); before != 0 {
+		q.AddWhereClause("i.updated_at_usec < ?", before)
+	}
+}
+
 func (s *InvocationSearchService) QueryInvocations(ctx context.Context, req *inpb.SearchInvocationRequest) (*inpb.SearchInvocationResponse, error) {
 	if err := s.checkPreconditions(req); err != nil {
 		return nil, err
@@ -120,25 +159,10 @@ func (s *InvocationSearchService) QueryInvocations(ctx context.Context, req *inp
 
 	// Don't include anonymous builds.
 	q.AddWhereClause("((i.user_id != '' AND i.user_id IS NOT NULL) OR (i.group_id != '' AND i.group_id IS NOT NULL))")
+	// Don't include trashed builds.
+	q.AddWhereClause("i.deleted_at_usec = 0")
 
-	if user := req.GetQuery().GetUser(); user != "" {
-		q.AddWhereClause("i.user = ?", user)
-	}
-	if host := req.GetQuery().GetHost(); host != "" {
-		q.AddWhereClause("i.host = ?", host)
-	}
-	if url := req.GetQuery().GetRepoUrl(); url != "" {
-		q.AddWhereClause("i.repo_url = ?", url)
-	}
-	if sha := req.GetQuery().GetCommitSha(); sha != "" {
-		q.AddWhereClause("i.commit_sha = ?", sha)
-	}
-	if group_id := req.GetQuery().GetGroupId(); group_id != "" {
-		q.AddWhereClause("i.group_id = ?", group_id)
-	}
-	if role := req.GetQuery().GetRole(); role != "" {
-		q.AddWhereClause("i.role = ?", role)
-	}
+	AddInvocationQueryFilters(q, req.GetQuery())
 
 	// Always add permissions check.
 	addPermissionsCheckToQuery(tu, q)
@@ -152,6 +176,17 @@ func (s *InvocationSearchService) QueryInvocations(ctx context.Context, req *inp
 		q.SetOrderBy("created_at_usec", sort.Ascending)
 	case inpb.InvocationSort_UPDATED_AT_USEC_SORT_FIELD:
 		q.SetOrderBy("updated_at_usec", sort.Ascending)
+	// These are backed by the invocations_sort_* indexes.
+	case inpb.InvocationSort_DURATION_SORT_FIELD:
+		q.SetOrderBy("duration_usec", sort.Ascending)
+	case inpb.InvocationSort_ACTION_CACHE_HIT_RATE_SORT_FIELD:
+		q.SetOrderBy("action_cache_hit_rate", sort.Ascending)
+	case inpb.InvocationSort_FAILED_TARGET_COUNT_SORT_FIELD:
+		q.SetOrderBy("failed_target_count", sort.Ascending)
+	case inpb.InvocationSort_TRANSFER_SIZE_BYTES_SORT_FIELD:
+		q.SetOrderBy("total_transfer_size_bytes", sort.Ascending)
+	default:
+		return nil, status.InvalidArgumentErrorf("Unsupported sort field %s", sort.SortField)
 	}
 
 	limitSize := defaultLimitSize
@@ -177,12 +212,148 @@ func (s *InvocationSearchService) QueryInvocations(ctx context.Context, req *inp
 	if err != nil {
 		return nil, err
 	}
+	iids := make([]string, 0, len(tableInvocations))
+	for _, ti := range tableInvocations {
+		iids = append(iids, ti.InvocationID)
+	}
+	tagsByInvocation, err := s.env.GetInvocationDB().LookupInvocationTags(ctx, iids)
+	if err != nil {
+		return nil, err
+	}
 	rsp := &inpb.SearchInvocationResponse{}
 	for _, ti := range tableInvocations {
-		rsp.Invocation = append(rsp.Invocation, build_event_handler.TableInvocationToProto(ti))
+		invocation := build_event_handler.TableInvocationToProto(ti)
+		invocation.Tag = tagsByInvocation[ti.InvocationID]
+		rsp.Invocation = append(rsp.Invocation, invocation)
 	}
 	if int64(len(rsp.Invocation)) == limitSize {
 		rsp.NextPageToken = pageSizeOffsetPrefix + strconv.FormatInt(offset+limitSize, 10)
 	}
 	return rsp, nil
 }
+
+// GetBaselineInvocation finds the invocation that the requested invocation is
+// most naturally compared against: the most recent completed invocation that
+// was created before it for the same repo, branch, and command.
+func (s *InvocationSearchService) GetBaselineInvocation(ctx context.Context, req *inpb.GetBaselineInvocationRequest) (*inpb.GetBaselineInvocationResponse, error) {
+	if req.GetInvocationId() == "" {
+		return nil, status.InvalidArgumentError("invocation_id is required")
+	}
+	head, err := s.env.GetInvocationDB().LookupInvocation(ctx, req.GetInvocationId())
+	if err != nil {
+		if db.IsRecordNotFound(err) {
+			return nil, status.NotFoundErrorf("Invocation %q not found", req.GetInvocationId())
+		}
+		return nil, err
+	}
+	branch, err := s.lookupBuildMetadataValue(ctx, head.InvocationID, gitBranchMetadataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	q := query_builder.NewQuery(`SELECT * FROM Invocations as i`)
+	q.AddWhereClause("i.invocation_id != ?", head.InvocationID)
+	q.AddWhereClause("i.group_id = ?", head.GroupID)
+	q.AddWhereClause("i.repo_url = ?", head.RepoURL)
+	q.AddWhereClause("i.deleted_at_usec = 0")
+	q.AddWhereClause("i.command = ?", head.Command)
+	q.AddWhereClause("i.created_at_usec < ?", head.CreatedAtUsec)
+	q.AddWhereClause("i.invocation_status = ?", int64(inpb.Invocation_COMPLETE_INVOCATION_STATUS))
+	if req.GetSuccessfulOnly() {
+		q.AddWhereClause("i.success = ?", true)
+	}
+	if branch != "" {
+		q.AddWhereClause("i.invocation_id IN (SELECT invocation_id FROM InvocationBuildMetadata WHERE group_id = ? AND metadata_key = ? AND metadata_value = ?)", head.GroupID, gitBranchMetadataKey, branch)
+	}
+	if err := perms.AddPermissionsCheckToQueryWithTableAlias(ctx, s.env, q, "i"); err != nil {
+		return nil, err
+	}
+	q.SetOrderBy("i.created_at_usec" /*ascending=*/, false)
+	q.SetLimit(1)
+
+	qString, qArgs := q.Build()
+	tableInvocations, err := s.rawQueryInvocations(ctx, qString, qArgs...)
+	if err != nil {
+		return nil, err
+	}
+	rsp := &inpb.GetBaselineInvocationResponse{}
+	if len(tableInvocations) > 0 {
+		rsp.BaselineInvocation = build_event_handler.TableInvocationToProto(tableInvocations[0])
+	}
+	return rsp, nil
+}
+
+// GetRelatedInvocations finds the invocations of the same repo as the
+// requested invocation which were for the same commit or pull request, such as
+// the local builds reproducing a CI failure.
+func (s *InvocationSearchService) GetRelatedInvocations(ctx context.Context, req *inpb.GetRelatedInvocationsRequest) (*inpb.GetRelatedInvocationsResponse, error) {
+	if req.GetInvocationId() == "" {
+		return nil, status.InvalidArgumentError("invocation_id is required")
+	}
+	head, err := s.env.GetInvocationDB().LookupInvocation(ctx, req.GetInvocationId())
+	if err != nil {
+		if db.IsRecordNotFound(err) {
+			return nil, status.NotFoundErrorf("Invocation %q not found", req.GetInvocationId())
+		}
+		return nil, err
+	}
+	rsp := &inpb.GetRelatedInvocationsResponse{}
+	if head.RepoURL == "" || (head.CommitSHA == "" && head.PullRequestNumber == 0) {
+		return rsp, nil
+	}
+
+	q := query_builder.NewQuery(`SELECT * FROM Invocations as i`)
+	q.AddWhereClause("i.invocation_id != ?", head.InvocationID)
+	q.AddWhereClause("i.group_id = ?", head.GroupID)
+	q.AddWhereClause("i.repo_url = ?", head.RepoURL)
+	q.AddWhereClause("i.deleted_at_usec = 0")
+	o := query_builder.OrClauses{}
+	if head.CommitSHA != "" {
+		o.AddOr("i.commit_sha = ?", head.CommitSHA)
+	}
+	if head.PullRequestNumber != 0 {
+		o.AddOr("i.pull_request_number = ?", head.PullRequestNumber)
+	}
+	orQuery, orArgs := o.Build()
+	q.AddWhereClause("("+orQuery+")", orArgs...)
+	if err := perms.AddPermissionsCheckToQueryWithTableAlias(ctx, s.env, q, "i"); err != nil {
+		return nil, err
+	}
+	q.SetOrderBy("i.created_at_usec" /*ascending=*/, false)
+	count := int64(req.GetCount())
+	if count <= 0 || count > defaultRelatedInvocationsCount {
+		count = defaultRelatedInvocationsCount
+	}
+	q.SetLimit(count)
+
+	qString, qArgs := q.Build()
+	tableInvocations, err := s.rawQueryInvocations(ctx, qString, qArgs...)
+	if err != nil {
+		return nil, err
+	}
+	for _, ti := range tableInvocations {
+		relation := inpb.RelatedInvocation_SAME_PULL_REQUEST_RELATION
+		if head.CommitSHA != "" && ti.CommitSHA == head.CommitSHA {
+			relation = inpb.RelatedInvocation_SAME_COMMIT_RELATION
+		}
+		rsp.RelatedInvocation = append(rsp.RelatedInvocation, &inpb.RelatedInvocation{
+			Relation:   relation,
+			Invocation: build_event_handler.TableInvocationToProto(ti),
+		})
+	}
+	return rsp, nil
+}
+
+// lookupBuildMetadataValue returns the value of the given build metadata key
+// for an invocation, or "" if it wasn't set.
+func (s *InvocationSearchService) lookupBuildMetadataValue(ctx context.Context, iid, key string) (string, error) {
+	md := &tables.InvocationBuildMetadata{}
+	err := s.h.Raw(`SELECT * FROM InvocationBuildMetadata WHERE invocation_id = ? AND metadata_key = ?`, iid, key).Take(md).Error
+	if db.IsRecordNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return md.MetadataValue, nil
+}
@@ -0,0 +1,214 @@
+package invocation_search_service_test
+
+import (
+	"context"
+	"hash/fnv"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/userdb"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/invocation_search_service"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ctxpb "github.com/buildbuddy-io/buildbuddy/proto/context"
+	grpb "github.com/buildbuddy-io/buildbuddy/proto/group"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+type testInvocation struct {
+	id      string
+	groupID string
+	repoURL string
+	command string
+	branch  string
+	success bool
+	age     time.Duration
+
+	commitSHA         string
+	pullRequestNumber int64
+
+	durationUsec      int64
+	failedTargetCount int64
+}
+
+func insertInvocation(t *testing.T, te *testenv.TestEnv, inv *testInvocation) {
+	h := fnv.New64a()
+	h.Write([]byte(inv.id))
+	err := te.GetDBHandle().Create(&tables.Invocation{
+		InvocationID:      inv.id,
+		InvocationPK:      int64(h.Sum64()),
+		GroupID:           inv.groupID,
+		RepoURL:           inv.repoURL,
+		Command:           inv.command,
+		Success:           inv.success,
+		CommitSHA:         inv.commitSHA,
+		PullRequestNumber: inv.pullRequestNumber,
+		DurationUsec:      inv.durationUsec,
+		FailedTargetCount: inv.failedTargetCount,
+		InvocationStatus:  int64(inpb.Invocation_COMPLETE_INVOCATION_STATUS),
+		Perms:             perms.GROUP_READ,
+	}).Error
+	require.NoError(t, err)
+	// Timestamps are set on insert, so backdate them afterwards.
+	usec := timeutil.ToUsec(time.Now().Add(-inv.age))
+	err = te.GetDBHandle().Model(&tables.Invocation{}).Where("invocation_id = ?", inv.id).UpdateColumns(map[string]interface{}{
+		"created_at_usec": usec,
+		"updated_at_usec": usec,
+	}).Error
+	require.NoError(t, err)
+	if inv.branch != "" {
+		err = te.GetDBHandle().Create(&tables.InvocationBuildMetadata{
+			InvocationID:  inv.id,
+			GroupID:       inv.groupID,
+			MetadataKey:   "GIT_BRANCH",
+			MetadataValue: inv.branch,
+		}).Error
+		require.NoError(t, err)
+	}
+}
+
+func TestGetBaselineInvocation(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")))
+	ctx, err := te.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+	s := invocation_search_service.NewInvocationSearchService(te, te.GetDBHandle())
+
+	const repo = "https://github.com/example/example"
+	for _, inv := range []*testInvocation{
+		{id: "head", groupID: "GR1", repoURL: repo, command: "test", branch: "main", success: false, age: 1 * time.Minute},
+		{id: "red", groupID: "GR1", repoURL: repo, command: "test", branch: "main", success: false, age: 10 * time.Minute},
+		{id: "green", groupID: "GR1", repoURL: repo, command: "test", branch: "main", success: true, age: 20 * time.Minute},
+		{id: "old-green", groupID: "GR1", repoURL: repo, command: "test", branch: "main", success: true, age: 30 * time.Minute},
+		// Invocations which aren't comparable or are newer aren't baselines.
+		{id: "newer", groupID: "GR1", repoURL: repo, command: "test", branch: "main", success: true, age: 0},
+		{id: "other-branch", groupID: "GR1", repoURL: repo, command: "test", branch: "feature", success: true, age: 2 * time.Minute},
+		{id: "other-command", groupID: "GR1", repoURL: repo, command: "build", branch: "main", success: true, age: 2 * time.Minute},
+		{id: "other-repo", groupID: "GR1", repoURL: "https://github.com/example/other", command: "test", branch: "main", success: true, age: 2 * time.Minute},
+	} {
+		insertInvocation(t, te, inv)
+	}
+
+	rsp, err := s.GetBaselineInvocation(ctx, &inpb.GetBaselineInvocationRequest{InvocationId: "head"})
+	require.NoError(t, err)
+	assert.Equal(t, "red", rsp.GetBaselineInvocation().GetInvocationId())
+
+	rsp, err = s.GetBaselineInvocation(ctx, &inpb.GetBaselineInvocationRequest{InvocationId: "head", SuccessfulOnly: true})
+	require.NoError(t, err)
+	assert.Equal(t, "green", rsp.GetBaselineInvocation().GetInvocationId())
+
+	rsp, err = s.GetBaselineInvocation(ctx, &inpb.GetBaselineInvocationRequest{InvocationId: "old-green"})
+	require.NoError(t, err)
+	assert.Nil(t, rsp.GetBaselineInvocation())
+
+	_, err = s.GetBaselineInvocation(ctx, &inpb.GetBaselineInvocationRequest{InvocationId: "missing"})
+	assert.Error(t, err)
+}
+
+func TestGetRelatedInvocations(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")))
+	ctx, err := te.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+	s := invocation_search_service.NewInvocationSearchService(te, te.GetDBHandle())
+
+	const repo = "https://github.com/example/example"
+	for _, inv := range []*testInvocation{
+		{id: "head", groupID: "GR1", repoURL: repo, commitSHA: "abc", pullRequestNumber: 7, age: 1 * time.Minute},
+		{id: "local", groupID: "GR1", repoURL: repo, commitSHA: "abc", age: 2 * time.Minute},
+		{id: "earlier-push", groupID: "GR1", repoURL: repo, commitSHA: "def", pullRequestNumber: 7, age: 10 * time.Minute},
+		// Invocations of other commits, PRs, repos, or orgs aren't related.
+		{id: "other-commit", groupID: "GR1", repoURL: repo, commitSHA: "ghi", pullRequestNumber: 8, age: 3 * time.Minute},
+		{id: "other-repo", groupID: "GR1", repoURL: "https://github.com/example/other", commitSHA: "abc", pullRequestNumber: 7, age: 3 * time.Minute},
+		{id: "other-group", groupID: "GR2", repoURL: repo, commitSHA: "abc", pullRequestNumber: 7, age: 3 * time.Minute},
+		{id: "no-commit", groupID: "GR1", repoURL: repo, age: 3 * time.Minute},
+	} {
+		insertInvocation(t, te, inv)
+	}
+
+	rsp, err := s.GetRelatedInvocations(ctx, &inpb.GetRelatedInvocationsRequest{InvocationId: "head"})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetRelatedInvocation(), 2)
+	assert.Equal(t, "local", rsp.GetRelatedInvocation()[0].GetInvocation().GetInvocationId())
+	assert.Equal(t, inpb.RelatedInvocation_SAME_COMMIT_RELATION, rsp.GetRelatedInvocation()[0].GetRelation())
+	assert.Equal(t, "earlier-push", rsp.GetRelatedInvocation()[1].GetInvocation().GetInvocationId())
+	assert.Equal(t, inpb.RelatedInvocation_SAME_PULL_REQUEST_RELATION, rsp.GetRelatedInvocation()[1].GetRelation())
+	assert.Equal(t, int64(7), rsp.GetRelatedInvocation()[1].GetInvocation().GetPullRequestNumber())
+
+	rsp, err = s.GetRelatedInvocations(ctx, &inpb.GetRelatedInvocationsRequest{InvocationId: "head", Count: 1})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetRelatedInvocation(), 1)
+	assert.Equal(t, "local", rsp.GetRelatedInvocation()[0].GetInvocation().GetInvocationId())
+
+	rsp, err = s.GetRelatedInvocations(ctx, &inpb.GetRelatedInvocationsRequest{InvocationId: "no-commit"})
+	require.NoError(t, err)
+	assert.Empty(t, rsp.GetRelatedInvocation())
+
+	_, err = s.GetRelatedInvocations(ctx, &inpb.GetRelatedInvocationsRequest{InvocationId: "missing"})
+	assert.Error(t, err)
+}
+
+func TestQueryInvocationsSort(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")))
+	udb, err := userdb.NewUserDB(te, te.GetDBHandle())
+	require.NoError(t, err)
+	te.SetUserDB(udb)
+	require.NoError(t, te.GetDBHandle().Create(&tables.User{UserID: "US1", SubID: "US1"}).Error)
+	require.NoError(t, te.GetDBHandle().Create(&tables.Group{GroupID: "GR1"}).Error)
+	require.NoError(t, te.GetDBHandle().Create(&tables.UserGroup{
+		UserUserID:       "US1",
+		GroupGroupID:     "GR1",
+		MembershipStatus: int32(grpb.GroupMembershipStatus_MEMBER),
+	}).Error)
+	ctx, err := te.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+	s := invocation_search_service.NewInvocationSearchService(te, te.GetDBHandle())
+
+	for _, inv := range []*testInvocation{
+		{id: "fast", groupID: "GR1", durationUsec: 1e6, failedTargetCount: 3, age: 20 * time.Hour},
+		{id: "slow", groupID: "GR1", durationUsec: 9e6, failedTargetCount: 1, age: 21 * time.Hour},
+		{id: "medium", groupID: "GR1", durationUsec: 5e6, failedTargetCount: 2, age: 22 * time.Hour},
+		// Invocations outside of the time range aren't matched.
+		{id: "slowest-today", groupID: "GR1", durationUsec: 100e6, age: 1 * time.Hour},
+	} {
+		insertInvocation(t, te, inv)
+	}
+
+	query := &inpb.InvocationQuery{
+		GroupId:           "GR1",
+		UpdatedAfterUsec:  timeutil.ToUsec(time.Now().Add(-24 * time.Hour)),
+		UpdatedBeforeUsec: timeutil.ToUsec(time.Now().Add(-12 * time.Hour)),
+	}
+	invocationIDs := func(rsp *inpb.SearchInvocationResponse) []string {
+		var ids []string
+		for _, inv := range rsp.GetInvocation() {
+			ids = append(ids, inv.GetInvocationId())
+		}
+		return ids
+	}
+
+	rsp, err := s.QueryInvocations(ctx, &inpb.SearchInvocationRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: "GR1"},
+		Query:          query,
+		Sort:           &inpb.InvocationSort{SortField: inpb.InvocationSort_DURATION_SORT_FIELD},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"slow", "medium", "fast"}, invocationIDs(rsp))
+
+	rsp, err = s.QueryInvocations(ctx, &inpb.SearchInvocationRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: "GR1"},
+		Query:          query,
+		Sort:           &inpb.InvocationSort{SortField: inpb.InvocationSort_FAILED_TARGET_COUNT_SORT_FIELD, Ascending: true},
+		Count:          2,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"slow", "medium"}, invocationIDs(rsp))
+	assert.Equal(t, int64(1), rsp.GetInvocation()[0].GetProgress().GetFailedTargetCount())
+}
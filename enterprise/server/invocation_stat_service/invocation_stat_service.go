@@ -6,15 +6,32 @@ import (
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/util/blocklist"
+	"github.com/buildbuddy-io/buildbuddy/server/util/client_version"
 	"github.com/buildbuddy-io/buildbuddy/server/util/db"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/sync/errgroup"
 
+	ctxpb "github.com/buildbuddy-io/buildbuddy/proto/context"
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+const (
+	defaultRecentInvocationCount = 10
+	maxRecentInvocationCount     = 100
+
+	defaultFailureClusterLookback = 7 * 24 * time.Hour
+	defaultFailureClusterCount    = 10
+	maxFailureClusterCount        = 100
+	// The number of recent invocations returned per failure cluster.
+	failureClusterExampleCount = 5
 )
 
 type InvocationStatService struct {
@@ -214,3 +231,350 @@ func (i *InvocationStatService) GetInvocationStat(ctx context.Context, req *inpb
 	}
 	return rsp, nil
 }
+
+func (i *InvocationStatService) GetBuildMetadataKeys(ctx context.Context, req *inpb.GetBuildMetadataKeysRequest) (*inpb.GetBuildMetadataKeysResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := perms.AuthorizeGroupAccess(ctx, i.env, groupID); err != nil {
+		return nil, err
+	}
+	if blocklist.IsBlockedForStatsQuery(groupID) {
+		return nil, status.ResourceExhaustedErrorf("Too many rows.")
+	}
+
+	limit := int32(1000)
+	if l := req.GetLimit(); l != 0 {
+		if l < 1 || l > 10000 {
+			return nil, status.InvalidArgumentErrorf("limit must be between 0 and 10000")
+		}
+		limit = l
+	}
+
+	// The most common keys are looked up first, so that their counts include
+	// the values which don't fit within the limit.
+	q := query_builder.NewQuery(`SELECT metadata_key, COUNT(1) as invocation_count
+            FROM InvocationBuildMetadata`)
+	q.AddWhereClause(`group_id = ?`, groupID)
+	if key := req.GetKey(); key != "" {
+		q.AddWhereClause(`metadata_key = ?`, key)
+	}
+	q.SetGroupBy("metadata_key")
+	q.SetOrderBy("invocation_count" /*ascending=*/, false)
+	q.SetLimit(int64(limit))
+
+	qStr, qArgs := q.Build()
+	keyRows, err := i.h.Raw(qStr, qArgs...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer keyRows.Close()
+
+	rsp := &inpb.GetBuildMetadataKeysResponse{}
+	rsp.Key = make([]*inpb.BuildMetadataKeyCount, 0)
+	keys := make(map[string]*inpb.BuildMetadataKeyCount, 0)
+	keyNames := make([]string, 0)
+
+	for keyRows.Next() {
+		row := struct {
+			MetadataKey     string
+			InvocationCount int64
+		}{}
+		if err := i.h.ScanRows(keyRows, &row); err != nil {
+			return nil, err
+		}
+		kc := &inpb.BuildMetadataKeyCount{Key: row.MetadataKey, InvocationCount: row.InvocationCount}
+		keys[kc.Key] = kc
+		keyNames = append(keyNames, kc.Key)
+		rsp.Key = append(rsp.Key, kc)
+	}
+	if len(keyNames) == 0 {
+		return rsp, nil
+	}
+
+	q = query_builder.NewQuery(`SELECT metadata_key, metadata_value, COUNT(1) as invocation_count
+            FROM InvocationBuildMetadata`)
+	q.AddWhereClause(`group_id = ?`, groupID)
+	q.AddWhereClause(`metadata_key IN ?`, keyNames)
+	q.SetGroupBy("metadata_key, metadata_value")
+	q.SetOrderBy("invocation_count" /*ascending=*/, false)
+	q.SetLimit(int64(limit))
+
+	qStr, qArgs = q.Build()
+	rows, err := i.h.Raw(qStr, qArgs...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row := struct {
+			MetadataKey     string
+			MetadataValue   string
+			InvocationCount int64
+		}{}
+		if err := i.h.ScanRows(rows, &row); err != nil {
+			return nil, err
+		}
+		kc := keys[row.MetadataKey]
+		kc.Value = append(kc.Value, &inpb.BuildMetadataValueCount{
+			Value:           row.MetadataValue,
+			InvocationCount: row.InvocationCount,
+		})
+	}
+	return rsp, nil
+}
+
+func (i *InvocationStatService) GetClientVersions(ctx context.Context, req *inpb.GetClientVersionsRequest) (*inpb.GetClientVersionsResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := perms.AuthorizeGroupAccess(ctx, i.env, groupID); err != nil {
+		return nil, err
+	}
+	if blocklist.IsBlockedForStatsQuery(groupID) {
+		return nil, status.ResourceExhaustedErrorf("Too many rows.")
+	}
+	policy, err := client_version.NewPolicyFromConfig(i.env.GetConfigurator())
+	if err != nil {
+		return nil, err
+	}
+
+	q := query_builder.NewQuery(`SELECT bazel_version, COUNT(1) as invocation_count FROM Invocations`)
+	q.AddWhereClause(`group_id = ?`, groupID)
+	if req.GetStartTime() != nil {
+		startTime, err := ptypes.Timestamp(req.GetStartTime())
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid start_time: %s", err)
+		}
+		q.AddWhereClause(`created_at_usec >= ?`, timeutil.ToUsec(startTime))
+	}
+	q.SetGroupBy("bazel_version")
+	q.SetOrderBy("invocation_count" /*ascending=*/, false)
+	q.SetLimit(1000)
+
+	qStr, qArgs := q.Build()
+	rows, err := i.h.Raw(qStr, qArgs...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rsp := &inpb.GetClientVersionsResponse{}
+	rsp.BazelVersion = make([]*inpb.ClientVersionCount, 0)
+	for rows.Next() {
+		row := struct {
+			BazelVersion    string
+			InvocationCount int64
+		}{}
+		if err := i.h.ScanRows(rows, &row); err != nil {
+			return nil, err
+		}
+		rsp.BazelVersion = append(rsp.BazelVersion, &inpb.ClientVersionCount{
+			Version:         row.BazelVersion,
+			InvocationCount: row.InvocationCount,
+			Deprecated:      policy.IsDeprecated(row.BazelVersion),
+		})
+	}
+	return rsp, nil
+}
+
+// GetHomeStats returns a summary of the group's recent activity. The summary
+// is assembled from lookups which run in parallel, so that the dashboard home
+// page can be loaded with a single request.
+func (i *InvocationStatService) GetHomeStats(ctx context.Context, req *inpb.GetHomeStatsRequest) (*inpb.GetHomeStatsResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := perms.AuthorizeGroupAccess(ctx, i.env, groupID); err != nil {
+		return nil, err
+	}
+	if blocklist.IsBlockedForStatsQuery(groupID) {
+		return nil, status.ResourceExhaustedErrorf("Too many rows.")
+	}
+
+	recentInvocationCount := int32(defaultRecentInvocationCount)
+	if c := req.GetRecentInvocationCount(); c != 0 {
+		if c < 1 || c > maxRecentInvocationCount {
+			return nil, status.InvalidArgumentErrorf("recent_invocation_count must be between 0 and %d", maxRecentInvocationCount)
+		}
+		recentInvocationCount = c
+	}
+	dayStart := time.Now().Add(-24 * time.Hour)
+	if req.GetDayStartTime() != nil {
+		t, err := ptypes.Timestamp(req.GetDayStartTime())
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid day_start_time: %s", err)
+		}
+		dayStart = t
+	}
+
+	rsp := &inpb.GetHomeStatsResponse{}
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		searcher := i.env.GetInvocationSearchService()
+		if searcher == nil {
+			return nil
+		}
+		searchRsp, err := searcher.QueryInvocations(ctx, &inpb.SearchInvocationRequest{
+			RequestContext: req.GetRequestContext(),
+			Query:          &inpb.InvocationQuery{GroupId: groupID},
+			Sort: &inpb.InvocationSort{
+				SortField: inpb.InvocationSort_CREATED_AT_USEC_SORT_FIELD,
+				Ascending: false,
+			},
+			Count: recentInvocationCount,
+		})
+		if err != nil {
+			return err
+		}
+		rsp.RecentInvocation = searchRsp.GetInvocation()
+		return nil
+	})
+	eg.Go(func() error {
+		return i.getDailyStats(ctx, groupID, dayStart, rsp)
+	})
+	eg.Go(func() error {
+		fleet, err := i.getExecutorFleetStats(ctx, req.GetRequestContext())
+		if err != nil {
+			return err
+		}
+		rsp.ExecutorFleet = fleet
+		return nil
+	})
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+// getDailyStats fills in the invocation and cache counts of invocations
+// created since the given time.
+func (i *InvocationStatService) getDailyStats(ctx context.Context, groupID string, since time.Time, rsp *inpb.GetHomeStatsResponse) error {
+	q := query_builder.NewQuery(`SELECT
+	    COUNT(1) as invocation_count,
+	    COUNT(CASE WHEN (success != true AND invocation_status = 1) THEN 1 END) as failed_invocation_count,
+	    COALESCE(SUM(action_cache_hits), 0) as action_cache_hits,
+	    COALESCE(SUM(action_cache_misses), 0) as action_cache_misses,
+	    COALESCE(SUM(cas_cache_hits), 0) as cas_cache_hits,
+	    COALESCE(SUM(cas_cache_misses), 0) as cas_cache_misses
+            FROM Invocations`)
+	q.AddWhereClause(`group_id = ?`, groupID)
+	q.AddWhereClause(`created_at_usec >= ?`, timeutil.ToUsec(since))
+
+	qStr, qArgs := q.Build()
+	row := struct {
+		InvocationCount       int64
+		FailedInvocationCount int64
+		ActionCacheHits       int64
+		ActionCacheMisses     int64
+		CasCacheHits          int64
+		CasCacheMisses        int64
+	}{}
+	if err := i.h.WithContext(ctx).Raw(qStr, qArgs...).Scan(&row).Error; err != nil {
+		return err
+	}
+	rsp.InvocationCount = row.InvocationCount
+	rsp.FailedInvocationCount = row.FailedInvocationCount
+	rsp.ActionCacheHits = row.ActionCacheHits
+	rsp.ActionCacheMisses = row.ActionCacheMisses
+	rsp.CasCacheHits = row.CasCacheHits
+	rsp.CasCacheMisses = row.CasCacheMisses
+	return nil
+}
+
+// getExecutorFleetStats summarizes the executors registered for the group. It
+// returns nil if remote execution is not enabled.
+func (i *InvocationStatService) getExecutorFleetStats(ctx context.Context, reqCtx *ctxpb.RequestContext) (*inpb.ExecutorFleetStats, error) {
+	scheduler := i.env.GetSchedulerService()
+	if scheduler == nil {
+		return nil, nil
+	}
+	nodesRsp, err := scheduler.GetExecutionNodes(ctx, &scpb.GetExecutionNodesRequest{RequestContext: reqCtx})
+	if err != nil {
+		return nil, err
+	}
+	fleet := &inpb.ExecutorFleetStats{}
+	for _, node := range nodesRsp.GetExecutionNode() {
+		fleet.ExecutorCount++
+		if node.GetCordoned() {
+			fleet.CordonedExecutorCount++
+		}
+		fleet.AssignableMilliCpu += node.GetAssignableMilliCpu()
+		fleet.AssignableMemoryBytes += node.GetAssignableMemoryBytes()
+	}
+	return fleet, nil
+}
+
+// GetFailureClusters returns the clusters of failures which were printed by
+// the most of the group's recent invocations. Each cluster likely has a
+// single root cause.
+func (i *InvocationStatService) GetFailureClusters(ctx context.Context, req *inpb.GetFailureClustersRequest) (*inpb.GetFailureClustersResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := perms.AuthorizeGroupAccess(ctx, i.env, groupID); err != nil {
+		return nil, err
+	}
+	if blocklist.IsBlockedForStatsQuery(groupID) {
+		return nil, status.ResourceExhaustedErrorf("Too many rows.")
+	}
+
+	lookback := defaultFailureClusterLookback
+	if d := req.GetLookbackWindowDays(); d != 0 {
+		if d < 1 {
+			return nil, status.InvalidArgumentError("lookback_window_days must not be negative")
+		}
+		lookback = time.Duration(d) * 24 * time.Hour
+	}
+	count := int64(defaultFailureClusterCount)
+	if c := req.GetCount(); c != 0 {
+		if c < 1 || c > maxFailureClusterCount {
+			return nil, status.InvalidArgumentErrorf("count must be between 0 and %d", maxFailureClusterCount)
+		}
+		count = int64(c)
+	}
+	sinceUsec := timeutil.ToUsec(time.Now().Add(-lookback))
+
+	q := query_builder.NewQuery(`SELECT
+	    fingerprint,
+	    COUNT(DISTINCT invocation_id) as invocation_count,
+	    MIN(created_at_usec) as first_seen_usec,
+	    MAX(created_at_usec) as last_seen_usec
+            FROM InvocationFailures`)
+	q.AddWhereClause(`group_id = ?`, groupID)
+	q.AddWhereClause(`created_at_usec >= ?`, sinceUsec)
+	q.SetGroupBy("fingerprint")
+	q.SetOrderBy("invocation_count DESC, last_seen_usec" /*ascending=*/, false)
+	q.SetLimit(count)
+
+	qStr, qArgs := q.Build()
+	var clusters []*inpb.FailureCluster
+	rows, err := i.h.WithContext(ctx).Raw(qStr, qArgs...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c := &inpb.FailureCluster{}
+		if err := rows.Scan(&c.Fingerprint, &c.InvocationCount, &c.FirstSeenUsec, &c.LastSeenUsec); err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, c := range clusters {
+		var examples []*tables.InvocationFailure
+		err := i.h.WithContext(ctx).Raw(`
+			SELECT * FROM InvocationFailures
+			WHERE group_id = ? AND fingerprint = ? AND created_at_usec >= ?
+			ORDER BY created_at_usec DESC LIMIT ?`,
+			groupID, c.Fingerprint, sinceUsec, failureClusterExampleCount).Scan(&examples).Error
+		if err != nil {
+			return nil, err
+		}
+		for n, f := range examples {
+			if n == 0 {
+				c.SampleSnippet = f.Snippet
+				c.Label = f.Label
+			}
+			c.ExampleInvocationId = append(c.ExampleInvocationId, f.InvocationID)
+		}
+	}
+	return &inpb.GetFailureClustersResponse{Cluster: clusters}, nil
+}
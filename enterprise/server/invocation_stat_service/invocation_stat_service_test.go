@@ -0,0 +1,241 @@
+package invocation_stat_service_test
+
+import (
+	"context"
+	"hash/fnv"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/invocation_stat_service"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ctxpb "github.com/buildbuddy-io/buildbuddy/proto/context"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+func insertInvocation(t *testing.T, te *testenv.TestEnv, inv *tables.Invocation, createdAt time.Time) {
+	h := fnv.New64a()
+	h.Write([]byte(inv.InvocationID))
+	inv.InvocationPK = int64(h.Sum64())
+	inv.Perms = perms.GROUP_READ
+	inv.InvocationStatus = int64(inpb.Invocation_COMPLETE_INVOCATION_STATUS)
+	err := te.GetDBHandle().Create(inv).Error
+	require.NoError(t, err)
+	// Creation timestamps are set on insert, so backdate them afterwards.
+	err = te.GetDBHandle().Model(&tables.Invocation{}).Where("invocation_id = ?", inv.InvocationID).UpdateColumn("created_at_usec", timeutil.ToUsec(createdAt)).Error
+	require.NoError(t, err)
+}
+
+type fakeSearcher struct {
+	req *inpb.SearchInvocationRequest
+}
+
+func (s *fakeSearcher) IndexInvocation(ctx context.Context, invocation *inpb.Invocation) error {
+	return nil
+}
+
+func (s *fakeSearcher) QueryInvocations(ctx context.Context, req *inpb.SearchInvocationRequest) (*inpb.SearchInvocationResponse, error) {
+	s.req = req
+	return &inpb.SearchInvocationResponse{
+		Invocation: []*inpb.Invocation{{InvocationId: "iid-1"}, {InvocationId: "iid-2"}},
+	}, nil
+}
+
+func (s *fakeSearcher) GetBaselineInvocation(ctx context.Context, req *inpb.GetBaselineInvocationRequest) (*inpb.GetBaselineInvocationResponse, error) {
+	return &inpb.GetBaselineInvocationResponse{}, nil
+}
+
+func (s *fakeSearcher) GetRelatedInvocations(ctx context.Context, req *inpb.GetRelatedInvocationsRequest) (*inpb.GetRelatedInvocationsResponse, error) {
+	return &inpb.GetRelatedInvocationsResponse{}, nil
+}
+
+func TestGetHomeStats(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")))
+	searcher := &fakeSearcher{}
+	te.SetInvocationSearchService(searcher)
+	ctx, err := te.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+	iss := invocation_stat_service.NewInvocationStatService(te, te.GetDBHandle())
+
+	now := time.Now()
+	insertInvocation(t, te, &tables.Invocation{InvocationID: "iid-1", GroupID: "GR1", Success: true, ActionCacheHits: 3, ActionCacheMisses: 1, CasCacheHits: 10}, now.Add(-1*time.Hour))
+	insertInvocation(t, te, &tables.Invocation{InvocationID: "iid-2", GroupID: "GR1", Success: false, ActionCacheHits: 1, CasCacheMisses: 2}, now.Add(-2*time.Hour))
+	// Invocations from before the start of the day aren't counted.
+	insertInvocation(t, te, &tables.Invocation{InvocationID: "iid-3", GroupID: "GR1", Success: false, ActionCacheHits: 100}, now.Add(-5*time.Hour))
+	// Invocations of other groups aren't counted.
+	insertInvocation(t, te, &tables.Invocation{InvocationID: "iid-4", GroupID: "GR2", Success: false, ActionCacheHits: 100}, now.Add(-1*time.Hour))
+
+	dayStart, err := ptypes.TimestampProto(now.Add(-3 * time.Hour))
+	require.NoError(t, err)
+	rsp, err := iss.GetHomeStats(ctx, &inpb.GetHomeStatsRequest{
+		RequestContext:        &ctxpb.RequestContext{GroupId: "GR1"},
+		RecentInvocationCount: 2,
+		DayStartTime:          dayStart,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), rsp.GetInvocationCount())
+	assert.Equal(t, int64(1), rsp.GetFailedInvocationCount())
+	assert.Equal(t, int64(4), rsp.GetActionCacheHits())
+	assert.Equal(t, int64(1), rsp.GetActionCacheMisses())
+	assert.Equal(t, int64(10), rsp.GetCasCacheHits())
+	assert.Equal(t, int64(2), rsp.GetCasCacheMisses())
+	// Remote execution isn't enabled.
+	assert.Nil(t, rsp.GetExecutorFleet())
+
+	assert.Len(t, rsp.GetRecentInvocation(), 2)
+	assert.Equal(t, "GR1", searcher.req.GetQuery().GetGroupId())
+	assert.Equal(t, int32(2), searcher.req.GetCount())
+
+	_, err = iss.GetHomeStats(ctx, &inpb.GetHomeStatsRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: "GR2"},
+	})
+	assert.Error(t, err)
+}
+
+func insertFailure(t *testing.T, te *testenv.TestEnv, iid, fingerprint, label string) {
+	err := te.GetDBHandle().Create(&tables.InvocationFailure{
+		InvocationID: iid,
+		Fingerprint:  fingerprint,
+		GroupID:      "GR1",
+		Label:        label,
+		Snippet:      "ERROR: " + fingerprint + " in " + label,
+	}).Error
+	require.NoError(t, err)
+	// Make sure that failures are recorded at different times.
+	time.Sleep(time.Millisecond)
+}
+
+func TestGetFailureClusters(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")))
+	ctx, err := te.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+	iss := invocation_stat_service.NewInvocationStatService(te, te.GetDBHandle())
+
+	insertFailure(t, te, "iid-1", "flaky-linker", "//a:a")
+	insertFailure(t, te, "iid-1", "compile-error", "//b:b")
+	insertFailure(t, te, "iid-2", "flaky-linker", "//c:c")
+	insertFailure(t, te, "iid-3", "flaky-linker", "//a:a")
+	insertFailure(t, te, "iid-3", "timeout", "//d:d")
+	insertFailure(t, te, "iid-4", "timeout", "//d:d")
+
+	rsp, err := iss.GetFailureClusters(ctx, &inpb.GetFailureClustersRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: "GR1"},
+		Count:          2,
+	})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetCluster(), 2)
+
+	c := rsp.GetCluster()[0]
+	assert.Equal(t, "flaky-linker", c.GetFingerprint())
+	assert.Equal(t, int64(3), c.GetInvocationCount())
+	assert.Equal(t, []string{"iid-3", "iid-2", "iid-1"}, c.GetExampleInvocationId())
+	assert.Equal(t, "//a:a", c.GetLabel(), "the label of the most recent failure should be returned")
+	assert.Equal(t, "ERROR: flaky-linker in //a:a", c.GetSampleSnippet())
+	assert.Less(t, c.GetFirstSeenUsec(), c.GetLastSeenUsec())
+
+	assert.Equal(t, "timeout", rsp.GetCluster()[1].GetFingerprint(), "ties should be broken by the most recent failure")
+	assert.Equal(t, int64(2), rsp.GetCluster()[1].GetInvocationCount())
+
+	_, err = iss.GetFailureClusters(ctx, &inpb.GetFailureClustersRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: "GR2"},
+	})
+	assert.Error(t, err)
+}
+
+func TestGetBuildMetadataKeys(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")))
+	ctx, err := te.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+	iss := invocation_stat_service.NewInvocationStatService(te, te.GetDBHandle())
+
+	now := time.Now()
+	for iid, inv := range map[string]struct {
+		groupID  string
+		metadata map[string]string
+	}{
+		"iid-1": {"GR1", map[string]string{"PIPELINE": "deploy", "USER": "alice"}},
+		"iid-2": {"GR1", map[string]string{"PIPELINE": "deploy"}},
+		"iid-3": {"GR1", map[string]string{"PIPELINE": "test", "USER": "alice"}},
+		// Metadata of other groups isn't counted.
+		"iid-4": {"GR2", map[string]string{"PIPELINE": "deploy", "OTHER": "value"}},
+	} {
+		insertInvocation(t, te, &tables.Invocation{InvocationID: iid, GroupID: inv.groupID}, now)
+		err := te.GetInvocationDB().InsertInvocationBuildMetadata(ctx, iid, inv.metadata)
+		require.NoError(t, err)
+	}
+
+	rsp, err := iss.GetBuildMetadataKeys(ctx, &inpb.GetBuildMetadataKeysRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: "GR1"},
+	})
+	require.NoError(t, err)
+	// Keys and values are ordered by the number of invocations reporting them.
+	require.Len(t, rsp.GetKey(), 2)
+	assert.Equal(t, "PIPELINE", rsp.GetKey()[0].GetKey())
+	assert.Equal(t, int64(3), rsp.GetKey()[0].GetInvocationCount())
+	require.Len(t, rsp.GetKey()[0].GetValue(), 2)
+	assert.Equal(t, "deploy", rsp.GetKey()[0].GetValue()[0].GetValue())
+	assert.Equal(t, int64(2), rsp.GetKey()[0].GetValue()[0].GetInvocationCount())
+	assert.Equal(t, "test", rsp.GetKey()[0].GetValue()[1].GetValue())
+	assert.Equal(t, int64(1), rsp.GetKey()[0].GetValue()[1].GetInvocationCount())
+	assert.Equal(t, "USER", rsp.GetKey()[1].GetKey())
+	assert.Equal(t, int64(2), rsp.GetKey()[1].GetInvocationCount())
+
+	// The values of a single key can be listed.
+	rsp, err = iss.GetBuildMetadataKeys(ctx, &inpb.GetBuildMetadataKeysRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: "GR1"},
+		Key:            "USER",
+	})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetKey(), 1)
+	assert.Equal(t, "USER", rsp.GetKey()[0].GetKey())
+	require.Len(t, rsp.GetKey()[0].GetValue(), 1)
+	assert.Equal(t, "alice", rsp.GetKey()[0].GetValue()[0].GetValue())
+
+	// The limit applies to keys and to key/value pairs. The counts of the
+	// returned keys include the values which don't fit within the limit.
+	rsp, err = iss.GetBuildMetadataKeys(ctx, &inpb.GetBuildMetadataKeysRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: "GR1"},
+		Limit:          1,
+	})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetKey(), 1)
+	assert.Equal(t, "PIPELINE", rsp.GetKey()[0].GetKey())
+	assert.Equal(t, int64(3), rsp.GetKey()[0].GetInvocationCount())
+	require.Len(t, rsp.GetKey()[0].GetValue(), 1)
+	assert.Equal(t, "deploy", rsp.GetKey()[0].GetValue()[0].GetValue())
+
+	rsp, err = iss.GetBuildMetadataKeys(ctx, &inpb.GetBuildMetadataKeysRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: "GR1"},
+		Limit:          2,
+	})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetKey(), 2)
+	assert.Equal(t, "PIPELINE", rsp.GetKey()[0].GetKey())
+	assert.Equal(t, int64(3), rsp.GetKey()[0].GetInvocationCount())
+	assert.Equal(t, "USER", rsp.GetKey()[1].GetKey())
+	assert.Equal(t, int64(2), rsp.GetKey()[1].GetInvocationCount())
+	values := len(rsp.GetKey()[0].GetValue()) + len(rsp.GetKey()[1].GetValue())
+	assert.Equal(t, 2, values)
+
+	_, err = iss.GetBuildMetadataKeys(ctx, &inpb.GetBuildMetadataKeysRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: "GR1"},
+		Limit:          -1,
+	})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+
+	_, err = iss.GetBuildMetadataKeys(ctx, &inpb.GetBuildMetadataKeysRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: "GR2"},
+	})
+	assert.Error(t, err)
+}
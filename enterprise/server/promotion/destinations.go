@@ -0,0 +1,171 @@
+package promotion
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"google.golang.org/api/option"
+)
+
+// objectPath returns the path an artifact is uploaded to in a bucket or
+// repository.
+func objectPath(pathPrefix string, a *artifact) string {
+	return strings.TrimPrefix(path.Join(pathPrefix, a.version, a.name), "/")
+}
+
+// s3Destination uploads artifacts to an S3 bucket.
+type s3Destination struct {
+	bucket     string
+	pathPrefix string
+	uploader   *s3manager.Uploader
+}
+
+func newS3Destination(c *config.PromotionDestinationConfig) (*s3Destination, error) {
+	if c.Bucket == "" {
+		return nil, status.InvalidArgumentError("s3 destinations require a bucket")
+	}
+	var creds *credentials.Credentials
+	if c.CredentialsProfile != "" {
+		creds = credentials.NewSharedCredentials("", c.CredentialsProfile)
+	}
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String(c.Region),
+		Credentials: creds,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Destination{
+		bucket:     c.Bucket,
+		pathPrefix: c.PathPrefix,
+		uploader:   s3manager.NewUploader(sess),
+	}, nil
+}
+
+func (d *s3Destination) push(ctx context.Context, a *artifact) (string, error) {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	key := objectPath(d.pathPrefix, a)
+	_, err = d.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(key),
+		Body:   f,
+	})
+	if err != nil {
+		return "", status.UnavailableErrorf("upload to S3: %s", err)
+	}
+	return fmt.Sprintf("s3://%s/%s", d.bucket, key), nil
+}
+
+// gcsDestination uploads artifacts to a GCS bucket.
+type gcsDestination struct {
+	bucket     string
+	pathPrefix string
+	client     *storage.Client
+}
+
+func newGCSDestination(c *config.PromotionDestinationConfig) (*gcsDestination, error) {
+	if c.Bucket == "" {
+		return nil, status.InvalidArgumentError("gcs destinations require a bucket")
+	}
+	opts := make([]option.ClientOption, 0)
+	if c.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(c.CredentialsFile))
+	}
+	client, err := storage.NewClient(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &gcsDestination{
+		bucket:     c.Bucket,
+		pathPrefix: c.PathPrefix,
+		client:     client,
+	}, nil
+}
+
+func (d *gcsDestination) push(ctx context.Context, a *artifact) (string, error) {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	name := objectPath(d.pathPrefix, a)
+	w := d.client.Bucket(d.bucket).Object(name).NewWriter(ctx)
+	if _, err := io.Copy(w, f); err != nil {
+		w.Close()
+		return "", status.UnavailableErrorf("upload to GCS: %s", err)
+	}
+	// The upload is only complete once the writer is closed.
+	if err := w.Close(); err != nil {
+		return "", status.UnavailableErrorf("upload to GCS: %s", err)
+	}
+	return fmt.Sprintf("gs://%s/%s", d.bucket, name), nil
+}
+
+// artifactoryDestination uploads artifacts to a JFrog Artifactory
+// repository.
+type artifactoryDestination struct {
+	repoURL    string
+	pathPrefix string
+	username   string
+	password   string
+}
+
+func newArtifactoryDestination(c *config.PromotionDestinationConfig) (*artifactoryDestination, error) {
+	if !strings.HasPrefix(c.URL, "https://") && !strings.HasPrefix(c.URL, "http://") {
+		return nil, status.InvalidArgumentError("artifactory destinations require the http(s) URL of a repository")
+	}
+	return &artifactoryDestination{
+		repoURL:    strings.TrimSuffix(c.URL, "/"),
+		pathPrefix: c.PathPrefix,
+		username:   c.Username,
+		password:   c.Password,
+	}, nil
+}
+
+func (d *artifactoryDestination) push(ctx context.Context, a *artifact) (string, error) {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	u := d.repoURL + "/" + objectPath(d.pathPrefix, a)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, f)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = a.sizeBytes
+	// Artifactory rejects the upload if the checksum doesn't match.
+	req.Header.Set("X-Checksum-Sha256", a.digest)
+	if d.username != "" {
+		req.SetBasicAuth(d.username, d.password)
+	} else if d.password != "" {
+		req.Header.Set("Authorization", "Bearer "+d.password)
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", status.UnavailableErrorf("upload to Artifactory: %s", err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(rsp.Body)
+		return "", status.UnavailableErrorf("upload to Artifactory: %s: %s", rsp.Status, strings.TrimSpace(string(body)))
+	}
+	return u, nil
+}
@@ -0,0 +1,381 @@
+// Package promotion pushes the outputs of release invocations to external
+// registries and buckets, as directed by the rules in the
+// integrations.promotion config section, and records where each artifact was
+// pushed.
+//
+// Outputs are read from the invocation's group in this server's cache, so
+// only outputs that the build uploaded to BuildBuddy's remote cache can be
+// promoted.
+package promotion
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	registryDestinationType    = "registry"
+	s3DestinationType          = "s3"
+	gcsDestinationType         = "gcs"
+	artifactoryDestinationType = "artifactory"
+
+	// The tag that invocations must have if a rule doesn't list any.
+	defaultTag = "release"
+
+	gitBranchMetadataKey = "GIT_BRANCH"
+	// The build metadata key that sets the version artifacts are pushed as,
+	// e.g. --build_metadata=VERSION=1.2.3. Defaults to the commit SHA.
+	versionMetadataKey = "VERSION"
+
+	// Outputs are only promoted from targets' default output group.
+	defaultOutputGroup = "default"
+)
+
+// Versions are used as image tags and as path components, so they're limited
+// to what image tags allow.
+var versionRegexp = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
+// artifact is an output of an invocation that is being promoted, downloaded
+// to a local file.
+type artifact struct {
+	label string
+	// The base name of the output file.
+	name string
+	// The path of the local copy of the file.
+	path string
+	// The hex-encoded SHA-256 digest of the file.
+	digest       string
+	sizeBytes    int64
+	version      string
+	invocationID string
+	repoURL      string
+	commitSHA    string
+}
+
+// destination is an external registry or bucket that artifacts are pushed to.
+type destination interface {
+	// push pushes the artifact, and returns the URI it was pushed to.
+	push(ctx context.Context, a *artifact) (string, error)
+}
+
+// IsConfigured returns whether any promotion rules are configured.
+func IsConfigured(c *config.PromotionConfig) bool {
+	return len(c.Rules) > 0
+}
+
+// Promoter implements interfaces.Webhook by promoting the outputs of
+// matching invocations once they complete.
+type Promoter struct {
+	env          environment.Env
+	rules        []config.PromotionRuleConfig
+	destinations map[string]destination
+}
+
+func New(env environment.Env, c *config.PromotionConfig) (*Promoter, error) {
+	p := &Promoter{
+		env:          env,
+		rules:        c.Rules,
+		destinations: make(map[string]destination, len(c.Destinations)),
+	}
+	for i := range c.Destinations {
+		dc := &c.Destinations[i]
+		if dc.Name == "" {
+			return nil, status.InvalidArgumentError("promotion destinations require a name")
+		}
+		if _, ok := p.destinations[dc.Name]; ok {
+			return nil, status.InvalidArgumentErrorf("duplicate promotion destination %q", dc.Name)
+		}
+		d, err := newDestination(dc)
+		if err != nil {
+			return nil, status.WrapErrorf(err, "promotion destination %q", dc.Name)
+		}
+		p.destinations[dc.Name] = d
+	}
+	for _, r := range c.Rules {
+		for _, a := range r.Artifacts {
+			if a.Target == "" {
+				return nil, status.InvalidArgumentErrorf("promotion rule %q has an artifact without a target", r.Name)
+			}
+			if _, err := path.Match(a.Files, ""); err != nil {
+				return nil, status.InvalidArgumentErrorf("promotion rule %q has an invalid files pattern %q", r.Name, a.Files)
+			}
+			if _, ok := p.destinations[a.Destination]; !ok {
+				return nil, status.InvalidArgumentErrorf("promotion rule %q refers to unknown destination %q", r.Name, a.Destination)
+			}
+		}
+	}
+	return p, nil
+}
+
+func newDestination(c *config.PromotionDestinationConfig) (destination, error) {
+	switch c.Type {
+	case registryDestinationType:
+		return newRegistryDestination(c)
+	case s3DestinationType:
+		return newS3Destination(c)
+	case gcsDestinationType:
+		return newGCSDestination(c)
+	case artifactoryDestinationType:
+		return newArtifactoryDestination(c)
+	default:
+		return nil, status.InvalidArgumentErrorf("unknown destination type %q", c.Type)
+	}
+}
+
+func containsAny(values []string, wanted ...string) bool {
+	for _, v := range values {
+		for _, w := range wanted {
+			if v == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchesTags(r *config.PromotionRuleConfig, tags []string) bool {
+	if len(r.Tags) == 0 {
+		return containsAny(tags, defaultTag)
+	}
+	return containsAny(tags, r.Tags...)
+}
+
+// outputs holds what the promoter needs from an invocation's build events.
+type outputs struct {
+	metadata map[string]string
+	fileSets map[string]*build_event_stream.NamedSetOfFiles
+	// The file sets of the default output group of each target that was
+	// built successfully, by label.
+	targetFileSets map[string][]string
+}
+
+func parseOutputs(invocation *inpb.Invocation) *outputs {
+	o := &outputs{
+		metadata:       make(map[string]string),
+		fileSets:       make(map[string]*build_event_stream.NamedSetOfFiles),
+		targetFileSets: make(map[string][]string),
+	}
+	for _, event := range invocation.GetEvent() {
+		be := event.GetBuildEvent()
+		switch p := be.GetPayload().(type) {
+		case *build_event_stream.BuildEvent_BuildMetadata:
+			for k, v := range p.BuildMetadata.GetMetadata() {
+				o.metadata[k] = v
+			}
+		case *build_event_stream.BuildEvent_NamedSetOfFiles:
+			o.fileSets[be.GetId().GetNamedSet().GetId()] = p.NamedSetOfFiles
+		case *build_event_stream.BuildEvent_Completed:
+			if !p.Completed.GetSuccess() {
+				continue
+			}
+			label := be.GetId().GetTargetCompleted().GetLabel()
+			for _, g := range p.Completed.GetOutputGroup() {
+				if g.GetName() != defaultOutputGroup {
+					continue
+				}
+				for _, fs := range g.GetFileSets() {
+					o.targetFileSets[label] = append(o.targetFileSets[label], fs.GetId())
+				}
+			}
+		}
+	}
+	return o
+}
+
+// files returns the default outputs of the target.
+func (o *outputs) files(label string) []*build_event_stream.File {
+	var files []*build_event_stream.File
+	visited := make(map[string]bool)
+	var visit func(id string)
+	visit = func(id string) {
+		if visited[id] {
+			return
+		}
+		visited[id] = true
+		fs := o.fileSets[id]
+		files = append(files, fs.GetFiles()...)
+		for _, child := range fs.GetFileSets() {
+			visit(child.GetId())
+		}
+	}
+	for _, id := range o.targetFileSets[label] {
+		visit(id)
+	}
+	return files
+}
+
+func (p *Promoter) NotifyComplete(ctx context.Context, invocation *inpb.Invocation) error {
+	if !invocation.GetSuccess() {
+		return nil
+	}
+	var rules []*config.PromotionRuleConfig
+	for i := range p.rules {
+		if matchesTags(&p.rules[i], invocation.GetTag()) {
+			rules = append(rules, &p.rules[i])
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	iid := invocation.GetInvocationId()
+	ti := &tables.Invocation{}
+	if err := p.env.GetDBHandle().Raw(`SELECT group_id FROM Invocations WHERE invocation_id = ?`, iid).Take(ti).Error; err != nil {
+		return status.WrapErrorf(err, "look up group of invocation %s", iid)
+	}
+	o := parseOutputs(invocation)
+	version := o.metadata[versionMetadataKey]
+	if version == "" {
+		version = invocation.GetCommitSha()
+	}
+	if !versionRegexp.MatchString(version) {
+		return status.InvalidArgumentErrorf("invocation %s has invalid version %q: versions may contain up to 128 letters, numbers, dots, underscores, or hyphens", iid, version)
+	}
+
+	var lastErr error
+	for _, r := range rules {
+		if len(r.GroupIDs) > 0 && !containsAny(r.GroupIDs, ti.GroupID) {
+			continue
+		}
+		if len(r.Branches) > 0 && !containsAny(r.Branches, o.metadata[gitBranchMetadataKey]) {
+			continue
+		}
+		for _, ac := range r.Artifacts {
+			for _, f := range o.files(ac.Target) {
+				name := path.Base(f.GetName())
+				if ac.Files != "" {
+					if ok, _ := path.Match(ac.Files, name); !ok {
+						continue
+					}
+				}
+				row := &tables.ArtifactPromotion{
+					GroupID:      ti.GroupID,
+					InvocationID: iid,
+					RuleName:     r.Name,
+					TargetLabel:  ac.Target,
+					FileName:     name,
+					Destination:  ac.Destination,
+					Version:      version,
+					RepoURL:      invocation.GetRepoUrl(),
+					CommitSHA:    invocation.GetCommitSha(),
+				}
+				if err := p.promote(ctx, f, o, row); err != nil {
+					log.Warningf("Failed to promote %s of %s in invocation %s to %q: %s", name, ac.Target, iid, ac.Destination, err)
+					row.Error = err.Error()
+					lastErr = err
+				}
+				if err := p.recordPromotion(row); err != nil {
+					lastErr = err
+				}
+			}
+		}
+	}
+	return lastErr
+}
+
+// promote pushes the file to the destination of the promotion, and fills in
+// the digest of the file and the URI it was pushed to.
+func (p *Promoter) promote(ctx context.Context, f *build_event_stream.File, o *outputs, row *tables.ArtifactPromotion) error {
+	localPath, d, err := p.download(ctx, row.GroupID, o.metadata[namespace.OverrideMetadataKey], f)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(localPath)
+	row.Digest = d.GetHash()
+	row.SizeBytes = d.GetSizeBytes()
+	a := &artifact{
+		label:        row.TargetLabel,
+		name:         row.FileName,
+		path:         localPath,
+		digest:       row.Digest,
+		sizeBytes:    row.SizeBytes,
+		version:      row.Version,
+		invocationID: row.InvocationID,
+		repoURL:      row.RepoURL,
+		commitSHA:    row.CommitSHA,
+	}
+	uri, err := p.destinations[row.Destination].push(ctx, a)
+	if err != nil {
+		return err
+	}
+	row.PushedURI = uri
+	return nil
+}
+
+// download copies the file from the cache to a temporary file, and returns
+// its path and digest. The file is read from the cache namespace the invocation asked
+// to use, if any, falling back to the main cache.
+func (p *Promoter) download(ctx context.Context, groupID, cacheNamespace string, f *build_event_stream.File) (string, *repb.Digest, error) {
+	u, err := url.Parse(f.GetUri())
+	if err != nil || u.Scheme != "bytestream" {
+		return "", nil, status.FailedPreconditionErrorf("%s was not uploaded to the remote cache", f.GetName())
+	}
+	instanceName, d, err := digest.ExtractDigestFromDownloadResourceName(strings.TrimPrefix(u.Path, "/"))
+	if err != nil {
+		return "", nil, err
+	}
+	cache := p.env.GetCache()
+	if cache == nil {
+		return "", nil, status.FailedPreconditionError("promotion requires a cache")
+	}
+	ctx = prefix.AttachGroupPrefixToContext(ctx, groupID)
+	r, err := namespace.CASCache(namespace.OverrideCache(cache, cacheNamespace), instanceName).Reader(ctx, d, 0)
+	if status.IsNotFoundError(err) && cacheNamespace != "" {
+		r, err = namespace.CASCache(cache, instanceName).Reader(ctx, d, 0)
+	}
+	if err != nil {
+		return "", nil, status.WrapErrorf(err, "read %s from the cache", f.GetName())
+	}
+	defer r.Close()
+
+	tmp, err := ioutil.TempFile("", "promotion-*")
+	if err != nil {
+		return "", nil, err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && hex.EncodeToString(h.Sum(nil)) != d.GetHash() {
+		err = status.DataLossErrorf("%s does not match its digest %s", f.GetName(), d.GetHash())
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", nil, err
+	}
+	return tmp.Name(), d, nil
+}
+
+func (p *Promoter) recordPromotion(row *tables.ArtifactPromotion) error {
+	pk, err := tables.PrimaryKeyForTable("ArtifactPromotions")
+	if err != nil {
+		return err
+	}
+	row.PromotionID = pk
+	if err := p.env.GetDBHandle().Create(row).Error; err != nil {
+		return status.InternalErrorf("record promotion of %s in invocation %s: %s", row.FileName, row.InvocationID, err)
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package promotion
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	groupID       = "GR1"
+	invocationID  = "IID"
+	registryToken = "registry-token"
+)
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// fakeRegistry serves the parts of the registry API used to push images. It
+// requires a token from its token server, which requires basic auth.
+type fakeRegistry struct {
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/token" {
+		if user, pass, _ := r.BasicAuth(); user != "bb" || pass != "secret" || r.URL.Query().Get("scope") != "repository:team/app:pull,push" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"token": %q}`, registryToken)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+registryToken {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="fake"`, r.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/v2/":
+	case r.Method == "HEAD" && strings.HasPrefix(r.URL.Path, "/v2/team/app/blobs/"):
+		if _, ok := f.blobs[strings.TrimPrefix(r.URL.Path, "/v2/team/app/blobs/")]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case r.Method == "POST" && r.URL.Path == "/v2/team/app/blobs/uploads/":
+		w.Header().Set("Location", "/upload/1?state=abc")
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == "PUT" && r.URL.Path == "/upload/1":
+		digest := r.URL.Query().Get("digest")
+		if r.URL.Query().Get("state") != "abc" || digest != "sha256:"+sha256Hex(body) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.blobs[digest] = body
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/v2/team/app/manifests/"):
+		f.manifests[strings.TrimPrefix(r.URL.Path, "/v2/team/app/manifests/")] = body
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// fakeArtifactory records the files uploaded to it.
+type fakeArtifactory struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func (f *fakeArtifactory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Method != "PUT" || r.Header.Get("Authorization") != "Bearer art-token" || r.Header.Get("X-Checksum-Sha256") != sha256Hex(body) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.files[r.URL.Path] = body
+	w.WriteHeader(http.StatusCreated)
+}
+
+type testSetup struct {
+	te          *testenv.TestEnv
+	promoter    *Promoter
+	registry    *fakeRegistry
+	artifactory *fakeArtifactory
+}
+
+func setup(t *testing.T) *testSetup {
+	te := enterprise_testenv.GetCustomTestEnv(t, &enterprise_testenv.Options{})
+	require.NoError(t, te.GetDBHandle().Create(&tables.Invocation{InvocationID: invocationID, GroupID: groupID}).Error)
+
+	registry := &fakeRegistry{blobs: make(map[string][]byte), manifests: make(map[string][]byte)}
+	registryServer := httptest.NewServer(registry)
+	t.Cleanup(registryServer.Close)
+	artifactory := &fakeArtifactory{files: make(map[string][]byte)}
+	artifactoryServer := httptest.NewServer(artifactory)
+	t.Cleanup(artifactoryServer.Close)
+
+	p, err := New(te, &config.PromotionConfig{
+		Destinations: []config.PromotionDestinationConfig{
+			{Name: "images", Type: "registry", URL: registryServer.URL + "/team/app", Username: "bb", Password: "secret"},
+			{Name: "files", Type: "artifactory", URL: artifactoryServer.URL + "/artifactory/releases", PathPrefix: "app", Password: "art-token"},
+		},
+		Rules: []config.PromotionRuleConfig{{
+			Name:     "release",
+			Branches: []string{"main"},
+			Artifacts: []config.PromotionArtifactConfig{
+				{Target: "//app:image", Files: "*.tar", Destination: "images"},
+				{Target: "//app:cli", Destination: "files"},
+			},
+		}},
+	})
+	require.NoError(t, err)
+	return &testSetup{te: te, promoter: p, registry: registry, artifactory: artifactory}
+}
+
+// addToCache adds a blob to the group's cache, and returns its bytestream
+// URI.
+func addToCache(t *testing.T, te *testenv.TestEnv, data []byte) string {
+	d := &repb.Digest{Hash: sha256Hex(data), SizeBytes: int64(len(data))}
+	ctx := prefix.AttachGroupPrefixToContext(context.Background(), groupID)
+	require.NoError(t, te.GetCache().Set(ctx, d, data))
+	return fmt.Sprintf("bytestream://localhost:1985/blobs/%s/%d", d.GetHash(), d.GetSizeBytes())
+}
+
+func imageTarball(t *testing.T, config, layer []byte) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"manifest.json", []byte(`[{"Config": "config.json", "RepoTags": ["app:latest"], "Layers": ["abc/layer.tar"]}]`)},
+		{"config.json", config},
+		{"abc/layer.tar", layer},
+	}
+	for _, f := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.data)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write(f.data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+type output struct {
+	label string
+	name  string
+	uri   string
+}
+
+func invocation(tags []string, outputs ...*output) *inpb.Invocation {
+	inv := &inpb.Invocation{
+		InvocationId: invocationID,
+		Success:      true,
+		Tag:          tags,
+		RepoUrl:      "https://github.com/acme/app",
+		CommitSha:    "abc123",
+		Event: []*inpb.InvocationEvent{{
+			BuildEvent: &build_event_stream.BuildEvent{
+				Payload: &build_event_stream.BuildEvent_BuildMetadata{
+					BuildMetadata: &build_event_stream.BuildMetadata{Metadata: map[string]string{
+						"GIT_BRANCH": "main",
+						"VERSION":    "1.2.3",
+					}},
+				},
+			},
+		}},
+	}
+	for i, o := range outputs {
+		setID := fmt.Sprint(i)
+		inv.Event = append(inv.Event, &inpb.InvocationEvent{
+			BuildEvent: &build_event_stream.BuildEvent{
+				Id: &build_event_stream.BuildEventId{Id: &build_event_stream.BuildEventId_NamedSet{
+					NamedSet: &build_event_stream.BuildEventId_NamedSetOfFilesId{Id: setID},
+				}},
+				Payload: &build_event_stream.BuildEvent_NamedSetOfFiles{NamedSetOfFiles: &build_event_stream.NamedSetOfFiles{
+					Files: []*build_event_stream.File{{Name: o.name, File: &build_event_stream.File_Uri{Uri: o.uri}}},
+				}},
+			},
+		}, &inpb.InvocationEvent{
+			BuildEvent: &build_event_stream.BuildEvent{
+				Id: &build_event_stream.BuildEventId{Id: &build_event_stream.BuildEventId_TargetCompleted{
+					TargetCompleted: &build_event_stream.BuildEventId_TargetCompletedId{Label: o.label},
+				}},
+				Payload: &build_event_stream.BuildEvent_Completed{Completed: &build_event_stream.TargetComplete{
+					Success: true,
+					OutputGroup: []*build_event_stream.OutputGroup{{
+						Name:     "default",
+						FileSets: []*build_event_stream.BuildEventId_NamedSetOfFilesId{{Id: setID}},
+					}},
+				}},
+			},
+		})
+	}
+	return inv
+}
+
+func promotions(t *testing.T, te *testenv.TestEnv) []*tables.ArtifactPromotion {
+	var rows []*tables.ArtifactPromotion
+	require.NoError(t, te.GetDBHandle().Raw(`SELECT * FROM ArtifactPromotions ORDER BY file_name`).Scan(&rows).Error)
+	return rows
+}
+
+func TestPromoteReleaseArtifacts(t *testing.T) {
+	s := setup(t)
+	config, layer := []byte(`{"architecture": "amd64"}`), []byte("layer contents")
+	image := imageTarball(t, config, layer)
+	cli := []byte("#!/bin/sh\necho hello\n")
+	inv := invocation(
+		[]string{"release"},
+		&output{"//app:image", "app/image.tar", addToCache(t, s.te, image)},
+		&output{"//app:cli", "app/cli.sh", addToCache(t, s.te, cli)},
+	)
+
+	require.NoError(t, s.promoter.NotifyComplete(context.Background(), inv))
+
+	// The image was pushed with its provenance.
+	require.Contains(t, s.registry.manifests, "1.2.3")
+	manifestBytes := s.registry.manifests["1.2.3"]
+	manifest := &ociManifest{}
+	require.NoError(t, json.Unmarshal(manifestBytes, manifest))
+	assert.Equal(t, "sha256:"+sha256Hex(config), manifest.Config.Digest)
+	require.Len(t, manifest.Layers, 1)
+	assert.Equal(t, ociLayerMediaType, manifest.Layers[0].MediaType)
+	assert.Equal(t, layer, s.registry.blobs[manifest.Layers[0].Digest])
+	assert.Equal(t, "abc123", manifest.Annotations["org.opencontainers.image.revision"])
+	assert.Equal(t, invocationID, manifest.Annotations["io.buildbuddy.invocation_id"])
+
+	// The file was uploaded to Artifactory.
+	assert.Equal(t, cli, s.artifactory.files["/artifactory/releases/app/1.2.3/cli.sh"])
+
+	rows := promotions(t, s.te)
+	require.Len(t, rows, 2)
+	assert.Equal(t, "cli.sh", rows[0].FileName)
+	assert.Equal(t, "//app:cli", rows[0].TargetLabel)
+	assert.Equal(t, sha256Hex(cli), rows[0].Digest)
+	assert.True(t, strings.HasSuffix(rows[0].PushedURI, "/artifactory/releases/app/1.2.3/cli.sh"), rows[0].PushedURI)
+	assert.Equal(t, "image.tar", rows[1].FileName)
+	assert.Equal(t, groupID, rows[1].GroupID)
+	assert.Equal(t, "release", rows[1].RuleName)
+	assert.Equal(t, "1.2.3", rows[1].Version)
+	assert.Equal(t, "abc123", rows[1].CommitSHA)
+	assert.True(t, strings.HasSuffix(rows[1].PushedURI, "/team/app@sha256:"+sha256Hex(manifestBytes)), rows[1].PushedURI)
+	assert.Empty(t, rows[1].Error)
+}
+
+func TestOnlyReleaseInvocationsArePromoted(t *testing.T) {
+	s := setup(t)
+	uri := addToCache(t, s.te, []byte("contents"))
+
+	require.NoError(t, s.promoter.NotifyComplete(context.Background(), invocation([]string{"nightly"}, &output{"//app:cli", "app/cli.sh", uri})))
+	failed := invocation([]string{"release"}, &output{"//app:cli", "app/cli.sh", uri})
+	failed.Success = false
+	require.NoError(t, s.promoter.NotifyComplete(context.Background(), failed))
+
+	assert.Empty(t, s.artifactory.files)
+	assert.Empty(t, promotions(t, s.te))
+}
+
+func TestFailedPromotionIsRecorded(t *testing.T) {
+	s := setup(t)
+	missing := fmt.Sprintf("bytestream://localhost:1985/blobs/%s/5", sha256Hex([]byte("other")))
+
+	err := s.promoter.NotifyComplete(context.Background(), invocation([]string{"release"}, &output{"//app:cli", "app/cli.sh", missing}))
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+
+	rows := promotions(t, s.te)
+	require.Len(t, rows, 1)
+	assert.Empty(t, rows[0].PushedURI)
+	assert.NotEmpty(t, rows[0].Error)
+	assert.Empty(t, s.artifactory.files)
+}
+
+func TestNewValidatesConfig(t *testing.T) {
+	te := enterprise_testenv.GetCustomTestEnv(t, &enterprise_testenv.Options{})
+	for _, c := range []*config.PromotionConfig{
+		{Destinations: []config.PromotionDestinationConfig{{Name: "d", Type: "ftp"}}},
+		{Destinations: []config.PromotionDestinationConfig{{Name: "d", Type: "registry", URL: "registry.example.com"}}},
+		{Rules: []config.PromotionRuleConfig{{Name: "r", Artifacts: []config.PromotionArtifactConfig{{Target: "//a", Destination: "missing"}}}}},
+	} {
+		_, err := New(te, c)
+		assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+	}
+}
@@ -0,0 +1,400 @@
+package promotion
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+const (
+	ociManifestMediaType   = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigMediaType     = "application/vnd.oci.image.config.v1+json"
+	ociLayerMediaType      = "application/vnd.oci.image.layer.v1.tar"
+	ociGzipLayerMediaType  = "application/vnd.oci.image.layer.v1.tar+gzip"
+	dockerSaveManifestName = "manifest.json"
+	maxRegistryErrorBytes  = 4096
+	registryScopeActions   = "pull,push"
+)
+
+var (
+	repositoryRegexp = regexp.MustCompile(`^[a-z0-9]+(?:[._-][a-z0-9]+)*(?:/[a-z0-9]+(?:[._-][a-z0-9]+)*)*$`)
+	// Matches the parameters of a WWW-Authenticate challenge, like
+	// realm="https://auth.docker.io/token".
+	challengeParamRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+// registryDestination pushes container images to a registry, like `crane
+// push`. Artifacts must be image tarballs in the format written by `docker
+// save`, such as the .tar outputs of rules_docker's container_image. Images
+// are tagged with the artifact's version.
+type registryDestination struct {
+	// The base URL of the registry, like "https://registry.example.com".
+	baseURL    string
+	host       string
+	repository string
+	username   string
+	password   string
+}
+
+func newRegistryDestination(c *config.PromotionDestinationConfig) (*registryDestination, error) {
+	ref, scheme := c.URL, "https"
+	// Local registries may be served over plain HTTP.
+	if strings.HasPrefix(ref, "http://") {
+		ref, scheme = strings.TrimPrefix(ref, "http://"), "http"
+	}
+	ref = strings.TrimPrefix(ref, "https://")
+	i := strings.Index(ref, "/")
+	if i <= 0 || !repositoryRegexp.MatchString(ref[i+1:]) {
+		return nil, status.InvalidArgumentErrorf("registry destinations require an image repository like registry.example.com/team/app, got %q", c.URL)
+	}
+	return &registryDestination{
+		baseURL:    scheme + "://" + ref[:i],
+		host:       ref[:i],
+		repository: ref[i+1:],
+		username:   c.Username,
+		password:   c.Password,
+	}, nil
+}
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	// The local copy of the blob.
+	path string
+}
+
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Config        *descriptor       `json:"config"`
+	Layers        []*descriptor     `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+func (d *registryDestination) push(ctx context.Context, a *artifact) (string, error) {
+	dir, err := ioutil.TempDir("", "promotion-image-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	manifest, err := readImageTarball(a.path, dir)
+	if err != nil {
+		return "", err
+	}
+	manifest.Annotations = map[string]string{
+		"org.opencontainers.image.version": a.version,
+		"io.buildbuddy.invocation_id":      a.invocationID,
+	}
+	if a.repoURL != "" {
+		manifest.Annotations["org.opencontainers.image.source"] = a.repoURL
+	}
+	if a.commitSHA != "" {
+		manifest.Annotations["org.opencontainers.image.revision"] = a.commitSHA
+	}
+
+	auth, err := d.authenticate(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, blob := range append([]*descriptor{manifest.Config}, manifest.Layers...) {
+		if err := d.uploadBlob(ctx, auth, blob); err != nil {
+			return "", err
+		}
+	}
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	rsp, err := d.do(ctx, auth, http.MethodPut, d.baseURL+"/v2/"+d.repository+"/manifests/"+a.version, bytes.NewReader(b), int64(len(b)), ociManifestMediaType)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusCreated {
+		return "", registryError(rsp, "push manifest")
+	}
+	h := sha256.Sum256(b)
+	return fmt.Sprintf("%s/%s@sha256:%s", d.host, d.repository, hex.EncodeToString(h[:])), nil
+}
+
+// readImageTarball extracts an image tarball written by `docker save` into
+// dir, and returns the manifest to push it with.
+func readImageTarball(tarPath, dir string) (*ociManifest, error) {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("not an image tarball: %s", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name, err := tarballPath(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		if err := extractFile(tr, filepath.Join(dir, name)); err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, dockerSaveManifestName))
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("not an image tarball: missing %s", dockerSaveManifestName)
+	}
+	var images []struct {
+		Config string
+		Layers []string
+	}
+	if err := json.Unmarshal(b, &images); err != nil {
+		return nil, status.InvalidArgumentErrorf("not an image tarball: invalid %s: %s", dockerSaveManifestName, err)
+	}
+	if len(images) != 1 {
+		return nil, status.InvalidArgumentErrorf("image tarballs must contain exactly one image, found %d", len(images))
+	}
+	manifest := &ociManifest{SchemaVersion: 2, MediaType: ociManifestMediaType}
+	if manifest.Config, err = describeBlob(dir, images[0].Config, ociConfigMediaType); err != nil {
+		return nil, err
+	}
+	for _, layer := range images[0].Layers {
+		desc, err := describeBlob(dir, layer, ociLayerMediaType)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+	}
+	return manifest, nil
+}
+
+// tarballPath returns the relative path of a file in an image tarball,
+// rejecting paths outside of it.
+func tarballPath(name string) (string, error) {
+	p := path.Clean(strings.TrimPrefix(name, "./"))
+	if path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+		return "", status.InvalidArgumentErrorf("invalid path %q in image tarball", name)
+	}
+	return filepath.FromSlash(p), nil
+}
+
+func extractFile(r io.Reader, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// describeBlob returns the descriptor of a blob in an extracted image
+// tarball. Layers that are gzipped are described as such.
+func describeBlob(dir, name, mediaType string) (*descriptor, error) {
+	p, err := tarballPath(name)
+	if err != nil {
+		return nil, err
+	}
+	p = filepath.Join(dir, p)
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("image tarball is missing %s", name)
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	if magic, _ := br.Peek(2); mediaType == ociLayerMediaType && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		mediaType = ociGzipLayerMediaType
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, br)
+	if err != nil {
+		return nil, err
+	}
+	return &descriptor{
+		MediaType: mediaType,
+		Digest:    "sha256:" + hex.EncodeToString(h.Sum(nil)),
+		Size:      n,
+		path:      p,
+	}, nil
+}
+
+// authenticate returns the Authorization header to send to the registry, if
+// it requires one. Like other registry clients, it checks which
+// authentication the registry asks for by requesting the API's base URL.
+func (d *registryDestination) authenticate(ctx context.Context) (string, error) {
+	rsp, err := d.do(ctx, "", http.MethodGet, d.baseURL+"/v2/", nil, 0, "")
+	if err != nil {
+		return "", err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode == http.StatusOK {
+		return "", nil
+	}
+	if rsp.StatusCode != http.StatusUnauthorized {
+		return "", registryError(rsp, "check registry API")
+	}
+	challenge := rsp.Header.Get("WWW-Authenticate")
+	params := make(map[string]string)
+	for _, m := range challengeParamRegexp.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(m[1])] = m[2]
+	}
+	switch scheme := strings.ToLower(strings.SplitN(challenge, " ", 2)[0]); scheme {
+	case "basic":
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(d.username+":"+d.password)), nil
+	case "bearer":
+		return d.fetchToken(ctx, params)
+	default:
+		return "", status.UnimplementedErrorf("unsupported registry authentication scheme %q", scheme)
+	}
+}
+
+// fetchToken exchanges the configured credentials for a token that can push
+// to the repository, from the token server named in the registry's challenge.
+func (d *registryDestination) fetchToken(ctx context.Context, challenge map[string]string) (string, error) {
+	realm, err := url.Parse(challenge["realm"])
+	if err != nil || realm.Host == "" {
+		return "", status.UnavailableErrorf("registry returned invalid token realm %q", challenge["realm"])
+	}
+	q := realm.Query()
+	if service := challenge["service"]; service != "" {
+		q.Set("service", service)
+	}
+	q.Set("scope", fmt.Sprintf("repository:%s:%s", d.repository, registryScopeActions))
+	realm.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if d.username != "" {
+		req.SetBasicAuth(d.username, d.password)
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", status.UnavailableErrorf("fetch registry token: %s", err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return "", registryError(rsp, "fetch registry token")
+	}
+	token := &struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(rsp.Body).Decode(token); err != nil {
+		return "", status.UnavailableErrorf("fetch registry token: %s", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	return "Bearer " + token.Token, nil
+}
+
+// uploadBlob uploads a blob to the repository, unless it's already there.
+func (d *registryDestination) uploadBlob(ctx context.Context, auth string, blob *descriptor) error {
+	blobsURL := d.baseURL + "/v2/" + d.repository + "/blobs/"
+	rsp, err := d.do(ctx, auth, http.MethodHead, blobsURL+blob.Digest, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	rsp, err = d.do(ctx, auth, http.MethodPost, blobsURL+"uploads/", nil, 0, "")
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusAccepted {
+		return registryError(rsp, "start blob upload")
+	}
+	location, err := rsp.Request.URL.Parse(rsp.Header.Get("Location"))
+	if err != nil {
+		return status.UnavailableErrorf("registry returned invalid upload location: %s", err)
+	}
+	q := location.Query()
+	q.Set("digest", blob.Digest)
+	location.RawQuery = q.Encode()
+
+	f, err := os.Open(blob.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rsp, err = d.do(ctx, auth, http.MethodPut, location.String(), f, blob.Size, "application/octet-stream")
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusCreated {
+		return registryError(rsp, "upload blob "+blob.Digest)
+	}
+	return nil
+}
+
+func (d *registryDestination) do(ctx context.Context, auth, method, u string, body io.Reader, size int64, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, status.UnavailableErrorf("registry request %s %s: %s", method, u, err)
+	}
+	return rsp, nil
+}
+
+func registryError(rsp *http.Response, what string) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, maxRegistryErrorBytes))
+	msg := fmt.Sprintf("%s: %s: %s", what, rsp.Status, strings.TrimSpace(string(body)))
+	switch rsp.StatusCode {
+	case http.StatusUnauthorized:
+		return status.UnauthenticatedError(msg)
+	case http.StatusForbidden:
+		return status.PermissionDeniedError(msg)
+	case http.StatusNotFound:
+		return status.NotFoundError(msg)
+	default:
+		return status.UnavailableError(msg)
+	}
+}
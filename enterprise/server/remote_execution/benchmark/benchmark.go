@@ -0,0 +1,179 @@
+// Package benchmark measures the performance of an executor machine so that
+// the scheduler can prefer faster executors for heavy tasks in fleets with
+// mixed hardware.
+package benchmark
+
+import (
+	"context"
+	"crypto/sha256"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/auth"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"google.golang.org/grpc/metadata"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+const (
+	cpuBenchmarkDuration = 250 * time.Millisecond
+	cpuBufferSize        = 1024 * 1024
+
+	diskBenchmarkBytes = 32 * 1024 * 1024
+	diskChunkSize      = 1024 * 1024
+
+	cacheRoundTrips       = 5
+	cacheRoundTripTimeout = 5 * time.Second
+
+	MinGrade = 1
+	MaxGrade = 5
+)
+
+// Measurements at or above each threshold earn one more grade point, starting
+// from MinGrade. They are loosely based on typical cloud VMs, where the
+// middle grade corresponds to a general-purpose instance.
+var (
+	cpuHashBytesPerSecondThresholds   = []int64{250e6, 400e6, 600e6, 1000e6}
+	diskWriteBytesPerSecondThresholds = []int64{50e6, 150e6, 400e6, 1000e6}
+	// Lower is better for round trip times, so these earn a grade point for
+	// measurements at or below each threshold.
+	cacheRoundTripUsecThresholds = []int64{50000, 20000, 5000, 1000}
+)
+
+// Run benchmarks the CPU, the disk containing dir, and the round trip time to
+// the remote cache, and returns the graded results. Measurements that fail
+// are left unset and don't count towards the grade.
+func Run(ctx context.Context, env environment.Env, dir string) *scpb.ExecutorCapability {
+	c := &scpb.ExecutorCapability{
+		CpuHashBytesPerSecond: measureCPU(),
+	}
+	diskBytesPerSecond, err := measureDisk(dir)
+	if err != nil {
+		log.Warningf("Could not benchmark disk: %s", err)
+	}
+	c.DiskWriteBytesPerSecond = diskBytesPerSecond
+	if casClient := env.GetContentAddressableStorageClient(); casClient != nil {
+		if apiKey := env.GetConfigurator().GetExecutorConfig().APIKey; apiKey != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, auth.APIKeyHeader, apiKey)
+		}
+		rtt, err := measureCacheRoundTrip(ctx, casClient)
+		if err != nil {
+			log.Warningf("Could not benchmark cache round trip time: %s", err)
+		}
+		c.CacheRoundTripUsec = rtt.Microseconds()
+	}
+	c.Grade = Grade(c)
+	return c
+}
+
+// Grade returns the overall grade for the given measurements: the average of
+// the grades of each measurement that was taken, or 0 if there are none.
+func Grade(c *scpb.ExecutorCapability) int32 {
+	var grades []int
+	if c.GetCpuHashBytesPerSecond() > 0 {
+		grades = append(grades, gradeAtLeast(c.GetCpuHashBytesPerSecond(), cpuHashBytesPerSecondThresholds))
+	}
+	if c.GetDiskWriteBytesPerSecond() > 0 {
+		grades = append(grades, gradeAtLeast(c.GetDiskWriteBytesPerSecond(), diskWriteBytesPerSecondThresholds))
+	}
+	if c.GetCacheRoundTripUsec() > 0 {
+		grades = append(grades, gradeAtMost(c.GetCacheRoundTripUsec(), cacheRoundTripUsecThresholds))
+	}
+	if len(grades) == 0 {
+		return 0
+	}
+	sum := 0
+	for _, g := range grades {
+		sum += g
+	}
+	return int32(math.Round(float64(sum) / float64(len(grades))))
+}
+
+// gradeAtLeast grades a measurement where higher is better.
+func gradeAtLeast(value int64, thresholds []int64) int {
+	grade := MinGrade
+	for _, t := range thresholds {
+		if value >= t {
+			grade++
+		}
+	}
+	return grade
+}
+
+// gradeAtMost grades a measurement where lower is better.
+func gradeAtMost(value int64, thresholds []int64) int {
+	grade := MinGrade
+	for _, t := range thresholds {
+		if value <= t {
+			grade++
+		}
+	}
+	return grade
+}
+
+// measureCPU returns the single-threaded SHA-256 throughput, in bytes per
+// second. Hashing is representative of the executor's own work (computing
+// digests of inputs and outputs) as well as being CPU-bound.
+func measureCPU() int64 {
+	buf := make([]byte, cpuBufferSize)
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+	h := sha256.New()
+	hashed := int64(0)
+	start := time.Now()
+	for time.Since(start) < cpuBenchmarkDuration {
+		h.Write(buf)
+		hashed += int64(len(buf))
+	}
+	return int64(float64(hashed) / time.Since(start).Seconds())
+}
+
+// measureDisk returns the throughput of writing and syncing a file in dir, in
+// bytes per second.
+func measureDisk(dir string) (int64, error) {
+	f, err := os.CreateTemp(dir, "executor-benchmark-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	chunk := make([]byte, diskChunkSize)
+	for i := range chunk {
+		chunk[i] = byte(i * 7)
+	}
+	start := time.Now()
+	for written := 0; written < diskBenchmarkBytes; written += len(chunk) {
+		if _, err := f.Write(chunk); err != nil {
+			return 0, err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return int64(float64(diskBenchmarkBytes) / time.Since(start).Seconds()), nil
+}
+
+// measureCacheRoundTrip returns the median duration of FindMissingBlobs
+// requests for no blobs, which the cache answers without doing any work.
+func measureCacheRoundTrip(ctx context.Context, casClient repb.ContentAddressableStorageClient) (time.Duration, error) {
+	var durations []time.Duration
+	for i := 0; i < cacheRoundTrips; i++ {
+		ctx, cancel := context.WithTimeout(ctx, cacheRoundTripTimeout)
+		start := time.Now()
+		_, err := casClient.FindMissingBlobs(ctx, &repb.FindMissingBlobsRequest{})
+		cancel()
+		if err != nil {
+			return 0, err
+		}
+		durations = append(durations, time.Since(start))
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[len(durations)/2], nil
+}
@@ -0,0 +1,27 @@
+package benchmark_test
+
+import (
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/benchmark"
+	"github.com/stretchr/testify/assert"
+
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+func TestGrade(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		c        *scpb.ExecutorCapability
+		expected int32
+	}{
+		{"no measurements", &scpb.ExecutorCapability{}, 0},
+		{"slowest", &scpb.ExecutorCapability{CpuHashBytesPerSecond: 1, DiskWriteBytesPerSecond: 1, CacheRoundTripUsec: 1e6}, benchmark.MinGrade},
+		{"fastest", &scpb.ExecutorCapability{CpuHashBytesPerSecond: 2e9, DiskWriteBytesPerSecond: 2e9, CacheRoundTripUsec: 500}, benchmark.MaxGrade},
+		{"cpu only", &scpb.ExecutorCapability{CpuHashBytesPerSecond: 500e6}, 3},
+		{"mixed", &scpb.ExecutorCapability{CpuHashBytesPerSecond: 1e9, DiskWriteBytesPerSecond: 100e6, CacheRoundTripUsec: 10000}, 3},
+		{"unknown round trip", &scpb.ExecutorCapability{CpuHashBytesPerSecond: 1e9, DiskWriteBytesPerSecond: 1e9}, benchmark.MaxGrade},
+	} {
+		assert.Equal(t, testCase.expected, benchmark.Grade(testCase.c), testCase.name)
+	}
+}
@@ -27,6 +27,12 @@ import (
 	gstatus "google.golang.org/grpc/status"
 )
 
+const (
+	// ContainerNamePrefix is the prefix of the names of all containers
+	// created for executing commands.
+	ContainerNamePrefix = "buildbuddy_exec_"
+)
+
 var (
 	dockerDaemonErrorCode        = 125
 	containerFinalizationTimeout = 10 * time.Second
@@ -175,7 +181,7 @@ func generateContainerName() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return "buildbuddy_exec_" + suffix, nil
+	return ContainerNamePrefix + suffix, nil
 }
 
 func (r *dockerCommandContainer) Create(ctx context.Context, workDir string) error {
@@ -0,0 +1,249 @@
+// Package crashdump captures information that helps debug actions which
+// crashed on an executor, such as native code that segfaulted or a test that
+// was killed for running out of memory.
+//
+// When an action crashes, the executor records which signal killed it, the
+// core dumps that it left behind, the kernel log lines that mention the
+// crash, and the tail of its stdout and stderr. These are uploaded to the CAS
+// as a CrashReport, whose digest is referenced from the execution so that
+// users can debug the crash without access to the executor.
+package crashdump
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"google.golang.org/grpc/codes"
+
+	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	gstatus "google.golang.org/grpc/status"
+)
+
+const (
+	defaultDmesgLines  = 50
+	defaultMaxLogBytes = 64 * 1024
+
+	// Shells and container runtimes report that a command was killed by
+	// signal N with exit code 128+N.
+	signalExitCodeOffset = 128
+)
+
+var (
+	// crashSignals are the signals that indicate that a command crashed,
+	// rather than exiting on its own or being interrupted.
+	crashSignals = map[syscall.Signal]string{
+		syscall.SIGSEGV: "SIGSEGV",
+		syscall.SIGBUS:  "SIGBUS",
+		syscall.SIGILL:  "SIGILL",
+		syscall.SIGFPE:  "SIGFPE",
+		syscall.SIGABRT: "SIGABRT",
+		syscall.SIGSYS:  "SIGSYS",
+		syscall.SIGTRAP: "SIGTRAP",
+		// Containers that run out of memory are killed with SIGKILL.
+		syscall.SIGKILL: "SIGKILL",
+	}
+
+	// crashKernelLogRegexp matches kernel log lines that describe a crashed
+	// or OOM-killed process.
+	crashKernelLogRegexp = regexp.MustCompile(`(?i)segfault|general protection|traps:|out of memory|oom-kill|oom_reaper|killed process`)
+
+	// coreDumpNameRegexp matches the default core dump file names: "core",
+	// or "core.<pid>" with kernel.core_uses_pid set.
+	coreDumpNameRegexp = regexp.MustCompile(`^core(\.\d+)?$`)
+)
+
+// Crash describes how a command crashed.
+type Crash struct {
+	// Reason is a human-readable description of the crash.
+	Reason string
+	// Signal is the name of the signal that killed the command, if known.
+	Signal string
+}
+
+// DetectCrash returns how the command crashed, or nil if it did not crash.
+func DetectCrash(res *interfaces.CommandResult) *Crash {
+	if res.ExitCode == commandutil.KilledExitCode && gstatus.Code(res.Error) == codes.ResourceExhausted {
+		return &Crash{
+			Reason: "Command was killed, probably by the OOM killer",
+			Signal: crashSignals[syscall.SIGKILL],
+		}
+	}
+	if res.Error != nil || res.ExitCode <= signalExitCodeOffset {
+		return nil
+	}
+	name, ok := crashSignals[syscall.Signal(res.ExitCode-signalExitCodeOffset)]
+	if !ok {
+		return nil
+	}
+	return &Crash{
+		Reason: fmt.Sprintf("Command was killed by signal %s", name),
+		Signal: name,
+	}
+}
+
+// Collector captures crash reports and uploads them to the CAS.
+type Collector struct {
+	bsClient               bspb.ByteStreamClient
+	dmesgLines             int
+	maxLogBytes            int64
+	maxCoreDumpUploadBytes int64
+
+	// readKernelLog returns the kernel log. It is replaced in tests.
+	readKernelLog func(ctx context.Context) ([]byte, error)
+}
+
+// NewCollector returns a collector that uploads crash reports using the given
+// ByteStream client, or nil if crash dumps are not enabled.
+func NewCollector(c *config.CrashDumpConfig, bsClient bspb.ByteStreamClient) *Collector {
+	if !c.Enabled {
+		return nil
+	}
+	dmesgLines := c.DmesgLines
+	if dmesgLines == 0 {
+		dmesgLines = defaultDmesgLines
+	}
+	maxLogBytes := c.MaxLogBytes
+	if maxLogBytes == 0 {
+		maxLogBytes = defaultMaxLogBytes
+	}
+	return &Collector{
+		bsClient:               bsClient,
+		dmesgLines:             dmesgLines,
+		maxLogBytes:            maxLogBytes,
+		maxCoreDumpUploadBytes: c.MaxCoreDumpUploadBytes,
+		readKernelLog:          readDmesg,
+	}
+}
+
+// Capture builds a crash report for a command which crashed while running in
+// workDir, uploads it to the CAS under instanceName, and returns its digest.
+// Parts of the report that cannot be captured are left out of it.
+func (c *Collector) Capture(ctx context.Context, instanceName, workDir string, res *interfaces.CommandResult, crash *Crash) (*repb.Digest, error) {
+	report := &espb.CrashReport{
+		Reason:   crash.Reason,
+		Signal:   crash.Signal,
+		ExitCode: int32(res.ExitCode),
+	}
+
+	coreDumps, err := c.captureCoreDumps(ctx, instanceName, workDir)
+	if err != nil {
+		log.Warningf("Could not capture core dumps in %q: %s", workDir, err)
+	}
+	report.CoreDumps = coreDumps
+
+	if excerpt := c.captureKernelLog(ctx); len(excerpt) > 0 {
+		d, err := cachetools.UploadBlob(ctx, c.bsClient, instanceName, bytes.NewReader(excerpt))
+		if err != nil {
+			return nil, status.UnavailableErrorf("could not upload kernel log excerpt: %s", err)
+		}
+		report.DmesgExcerptDigest = d
+	}
+
+	if logs := c.containerLogs(res); len(logs) > 0 {
+		d, err := cachetools.UploadBlob(ctx, c.bsClient, instanceName, bytes.NewReader(logs))
+		if err != nil {
+			return nil, status.UnavailableErrorf("could not upload container logs: %s", err)
+		}
+		report.ContainerLogsDigest = d
+	}
+
+	return cachetools.UploadProto(ctx, c.bsClient, instanceName, report)
+}
+
+// captureCoreDumps describes the core dumps found under workDir, uploading
+// those that are small enough.
+func (c *Collector) captureCoreDumps(ctx context.Context, instanceName, workDir string) ([]*espb.CrashReport_CoreDump, error) {
+	var coreDumps []*espb.CrashReport_CoreDump
+	err := filepath.Walk(workDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || !coreDumpNameRegexp.MatchString(info.Name()) {
+			return nil
+		}
+		relPath, err := filepath.Rel(workDir, path)
+		if err != nil {
+			return err
+		}
+		coreDump := &espb.CrashReport_CoreDump{
+			Path:      relPath,
+			SizeBytes: info.Size(),
+		}
+		if c.maxCoreDumpUploadBytes > 0 && info.Size() <= c.maxCoreDumpUploadBytes {
+			d, err := cachetools.UploadFile(ctx, c.bsClient, instanceName, path)
+			if err != nil {
+				log.Warningf("Could not upload core dump %q: %s", path, err)
+			} else {
+				coreDump.Digest = d
+			}
+		}
+		coreDumps = append(coreDumps, coreDump)
+		return nil
+	})
+	return coreDumps, err
+}
+
+// captureKernelLog returns the last kernel log lines that mention a crash.
+func (c *Collector) captureKernelLog(ctx context.Context) []byte {
+	kernelLog, err := c.readKernelLog(ctx)
+	if err != nil {
+		// Reading the kernel log usually requires privileges that the executor
+		// may not have.
+		log.Debugf("Could not read kernel log: %s", err)
+		return nil
+	}
+	return filterKernelLog(kernelLog, c.dmesgLines)
+}
+
+// containerLogs returns the tail of the command's stdout and stderr.
+func (c *Collector) containerLogs(res *interfaces.CommandResult) []byte {
+	if len(res.Stdout) == 0 && len(res.Stderr) == 0 {
+		return nil
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "--- stdout ---\n%s\n", tail(res.Stdout, c.maxLogBytes))
+	fmt.Fprintf(buf, "--- stderr ---\n%s\n", tail(res.Stderr, c.maxLogBytes))
+	return buf.Bytes()
+}
+
+func filterKernelLog(kernelLog []byte, maxLines int) []byte {
+	var lines []string
+	for _, line := range strings.Split(string(kernelLog), "\n") {
+		if crashKernelLogRegexp.MatchString(line) {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	if len(lines) > maxLines {
+		lines = lines[len(lines)-maxLines:]
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+func tail(b []byte, maxBytes int64) []byte {
+	if int64(len(b)) <= maxBytes {
+		return b
+	}
+	return b[int64(len(b))-maxBytes:]
+}
+
+func readDmesg(ctx context.Context) ([]byte, error) {
+	return exec.CommandContext(ctx, "dmesg").Output()
+}
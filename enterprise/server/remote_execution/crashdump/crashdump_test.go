@@ -0,0 +1,94 @@
+package crashdump
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectCrash(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		result *interfaces.CommandResult
+		signal string
+	}{
+		{"success", &interfaces.CommandResult{ExitCode: 0}, ""},
+		{"failure", &interfaces.CommandResult{ExitCode: 1}, ""},
+		{"segfault", &interfaces.CommandResult{ExitCode: 139}, "SIGSEGV"},
+		{"abort", &interfaces.CommandResult{ExitCode: 134}, "SIGABRT"},
+		{"killed in container", &interfaces.CommandResult{ExitCode: 137}, "SIGKILL"},
+		{"interrupted", &interfaces.CommandResult{ExitCode: 130}, ""},
+		{"timeout", &interfaces.CommandResult{ExitCode: commandutil.KilledExitCode, Error: status.DeadlineExceededError("timed out")}, ""},
+		{"oom killed", &interfaces.CommandResult{ExitCode: commandutil.KilledExitCode, Error: status.ResourceExhaustedError("killed")}, "SIGKILL"},
+		{"did not start", &interfaces.CommandResult{ExitCode: commandutil.NoExitCode, Error: status.NotFoundError("not found")}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			crash := DetectCrash(tc.result)
+			if tc.signal == "" {
+				assert.Nil(t, crash)
+				return
+			}
+			require.NotNil(t, crash)
+			assert.Equal(t, tc.signal, crash.Signal)
+		})
+	}
+}
+
+func TestNewCollector_Disabled(t *testing.T) {
+	assert.Nil(t, NewCollector(&config.CrashDumpConfig{}, nil))
+}
+
+func TestFilterKernelLog(t *testing.T) {
+	kernelLog := []byte(`[ 1.000000] usb 1-1: new high-speed USB device
+[ 2.000000] test[123]: segfault at 0 ip 000055d5 sp 00007ffd error 6 in test[55d5+1000]
+[ 3.000000] eth0: link up
+[ 4.000000] Memory cgroup out of memory: Killed process 456 (java)
+[ 5.000000] oom_reaper: reaped process 456 (java)
+`)
+
+	assert.Equal(t, `[ 2.000000] test[123]: segfault at 0 ip 000055d5 sp 00007ffd error 6 in test[55d5+1000]
+[ 4.000000] Memory cgroup out of memory: Killed process 456 (java)
+[ 5.000000] oom_reaper: reaped process 456 (java)
+`, string(filterKernelLog(kernelLog, 10)))
+	assert.Equal(t, "[ 5.000000] oom_reaper: reaped process 456 (java)\n", string(filterKernelLog(kernelLog, 1)))
+	assert.Nil(t, filterKernelLog([]byte("[ 1.000000] eth0: link up\n"), 10))
+}
+
+func TestCaptureCoreDumps(t *testing.T) {
+	workDir := testfs.MakeTempDir(t)
+	testfs.WriteAllFileContents(t, workDir, map[string]string{
+		"core":             "core dump",
+		"sub/core.1234":    "another core dump",
+		"core.txt":         "not a core dump",
+		"src/core/main.cc": "not a core dump",
+	})
+	c := NewCollector(&config.CrashDumpConfig{Enabled: true}, nil)
+
+	coreDumps, err := c.captureCoreDumps(context.Background(), "", workDir)
+	require.NoError(t, err)
+
+	require.Len(t, coreDumps, 2)
+	assert.Equal(t, "core", coreDumps[0].GetPath())
+	assert.Equal(t, int64(len("core dump")), coreDumps[0].GetSizeBytes())
+	assert.Nil(t, coreDumps[0].GetDigest(), "core dumps should not be uploaded by default")
+	assert.Equal(t, "sub/core.1234", coreDumps[1].GetPath())
+}
+
+func TestContainerLogs(t *testing.T) {
+	c := NewCollector(&config.CrashDumpConfig{Enabled: true, MaxLogBytes: 4}, nil)
+
+	logs := c.containerLogs(&interfaces.CommandResult{
+		Stdout: []byte("hello world"),
+		Stderr: []byte("bye"),
+	})
+
+	assert.Equal(t, "--- stdout ---\norld\n--- stderr ---\nbye\n", string(logs))
+	assert.Nil(t, c.containerLogs(&interfaces.CommandResult{}))
+}
@@ -59,6 +59,11 @@ type DirHelper struct {
 	dirsToCreate []string
 
 	outputDirs []string
+
+	// The output paths of v2.1 commands, which may be either files or
+	// directories. They're included in both fullPaths and outputDirs until
+	// the command has run and it's known which they are.
+	outputPaths map[string]struct{}
 }
 
 func NewDirHelper(rootDir string, command *repb.Command) *DirHelper {
@@ -68,28 +73,34 @@ func NewDirHelper(rootDir string, command *repb.Command) *DirHelper {
 		fullPaths:    make(map[string]struct{}, 0),
 		dirsToCreate: make([]string, 0),
 		outputDirs:   make([]string, 0),
+		outputPaths:  make(map[string]struct{}, 0),
 	}
 
-	for _, outputFile := range command.GetOutputFiles() {
-		fullPath := filepath.Join(c.rootDir, outputFile)
-		c.fullPaths[fullPath] = struct{}{}
-		c.dirsToCreate = append(c.dirsToCreate, filepath.Dir(fullPath))
-	}
-	for _, outputDir := range command.GetOutputDirectories() {
-		fullPath := filepath.Join(c.rootDir, outputDir)
-		c.fullPaths[fullPath] = struct{}{}
-		c.dirsToCreate = append(c.dirsToCreate, fullPath)
-		c.outputDirs = append(c.outputDirs, fullPath)
+	if outputPaths := command.GetOutputPaths(); len(outputPaths) > 0 {
+		// v2.1 clients list all outputs as output paths, in which case the
+		// output files and directories are ignored.
+		for _, outputPath := range outputPaths {
+			fullPath := filepath.Join(c.rootDir, outputPath)
+			c.fullPaths[fullPath] = struct{}{}
+			c.outputPaths[fullPath] = struct{}{}
+			c.dirsToCreate = append(c.dirsToCreate, filepath.Dir(fullPath))
+			c.outputDirs = append(c.outputDirs, fullPath)
+		}
+	} else {
+		// v2.0 clients say whether each output is a file or a directory.
+		for _, outputFile := range command.GetOutputFiles() {
+			fullPath := filepath.Join(c.rootDir, outputFile)
+			c.fullPaths[fullPath] = struct{}{}
+			c.dirsToCreate = append(c.dirsToCreate, filepath.Dir(fullPath))
+		}
+		for _, outputDir := range command.GetOutputDirectories() {
+			fullPath := filepath.Join(c.rootDir, outputDir)
+			c.fullPaths[fullPath] = struct{}{}
+			c.dirsToCreate = append(c.dirsToCreate, fullPath)
+			c.outputDirs = append(c.outputDirs, fullPath)
+		}
 	}
 
-	// STOPSHIP(tylerw): Do we need an updated copy of the remote APIs proto?
-	// if outputPaths := command.GetOutputPaths(); len(outputPaths) > 0 {
-	// 	c.dirsToCreate = make([]string, 0)
-	// 	for _, outputPath :=  range outputPaths {
-	// 		c.dirsToCreate = append(c.dirsToCreate, filepath.Join(rootDir, filepath.Dir(outputPath)))
-	// 	}
-	// }
-
 	for _, dir := range c.dirsToCreate {
 		for p := dir; p != filepath.Dir(p); p = filepath.Dir(p) {
 			c.prefixes[p] = struct{}{}
@@ -131,6 +142,10 @@ func (c *DirHelper) ShouldBeUploaded(path string) bool {
 	}
 	return false
 }
+func (c *DirHelper) isOutputPath(path string) bool {
+	_, ok := c.outputPaths[path]
+	return ok
+}
 func (c *DirHelper) MatchesOutputFilePrefix(path string) bool {
 	_, ok := c.prefixes[path]
 	return ok
@@ -286,10 +301,11 @@ func UploadTree(ctx context.Context, env environment.Env, dirHelper *DirHelper,
 		}
 		filesToUpload = append(filesToUpload, uploadableFile)
 		fqfn := filepath.Join(parentDir, info.Name())
-		if _, ok := dirHelper.MatchesOutputDir(fqfn); !ok {
+		if outputDir, ok := dirHelper.MatchesOutputDir(fqfn); !ok || (dirHelper.isOutputPath(outputDir) && outputDir == fqfn) {
 			// If this file does *not* match an output dir but wasn't
 			// skipped before the call to uploadFileFn, then it must be
-			// appended to OutputFiles.
+			// appended to OutputFiles. The same goes for files at output
+			// paths, which may be either files or directories.
 			actionResult.OutputFiles = append(actionResult.OutputFiles, uploadableFile.OutputFile(rootDir))
 		}
 
@@ -381,6 +397,10 @@ func UploadTree(ctx context.Context, env environment.Env, dirHelper *DirHelper,
 	}
 
 	for fullFilePath, tree := range trees {
+		if tree.Root == nil && dirHelper.isOutputPath(fullFilePath) {
+			// The output path is a file, or wasn't created.
+			continue
+		}
 		td, err := cachetools.UploadProto(ctx, env.GetByteStreamClient(), instanceName, tree)
 		if err != nil {
 			return nil, err
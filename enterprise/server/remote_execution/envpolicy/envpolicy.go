@@ -0,0 +1,162 @@
+package envpolicy
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/proto"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	stripAction   = "strip"
+	replaceAction = "replace"
+)
+
+type rule struct {
+	// pattern is the configured variable name, used to report which rule
+	// applied.
+	pattern string
+	name    string
+	prefix  bool
+	strip   bool
+	value   string
+}
+
+func (r *rule) matches(name string) bool {
+	if r.prefix {
+		return strings.HasPrefix(name, r.name)
+	}
+	return name == r.name
+}
+
+// Policy normalizes environment variables that vary between otherwise
+// identical actions without affecting their outputs, such as TMPDIR or
+// machine-specific PATH entries. Actions that differ only in these variables
+// have different digests, so the action cache misses; looking up the
+// normalized action as well lets them share cached results.
+type Policy struct {
+	rules []*rule
+}
+
+// New returns a policy for the given configuration, or nil if no variables
+// are configured to be normalized.
+func New(cfg []config.EnvNormalizationConfig) (*Policy, error) {
+	if len(cfg) == 0 {
+		return nil, nil
+	}
+	p := &Policy{}
+	for _, c := range cfg {
+		r := &rule{pattern: c.Name, name: c.Name}
+		if strings.HasSuffix(c.Name, "*") {
+			r.prefix = true
+			r.name = strings.TrimSuffix(c.Name, "*")
+		}
+		if r.name == "" || strings.Contains(r.name, "*") {
+			return nil, status.InvalidArgumentErrorf("invalid env_normalization name %q", c.Name)
+		}
+		switch c.Action {
+		case stripAction:
+			r.strip = true
+		case replaceAction:
+			r.value = c.Value
+		default:
+			return nil, status.InvalidArgumentErrorf("invalid env_normalization action %q for %q; expected %q or %q", c.Action, c.Name, stripAction, replaceAction)
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+func (p *Policy) ruleFor(name string) *rule {
+	for _, r := range p.rules {
+		if r.matches(name) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Apply returns a copy of the command with the policy applied, along with
+// the configured names of the rules that changed it. If no rule changes the
+// command, it returns nil.
+func (p *Policy) Apply(cmd *repb.Command) (*repb.Command, []string) {
+	applied := map[string]bool{}
+	vars := make([]*repb.Command_EnvironmentVariable, 0, len(cmd.GetEnvironmentVariables()))
+	for _, v := range cmd.GetEnvironmentVariables() {
+		r := p.ruleFor(v.GetName())
+		if r == nil {
+			vars = append(vars, v)
+			continue
+		}
+		if r.strip {
+			applied[r.pattern] = true
+			continue
+		}
+		if v.GetValue() != r.value {
+			applied[r.pattern] = true
+		}
+		vars = append(vars, &repb.Command_EnvironmentVariable{Name: v.GetName(), Value: r.value})
+	}
+	if len(applied) == 0 {
+		return nil, nil
+	}
+	normalized := proto.Clone(cmd).(*repb.Command)
+	normalized.EnvironmentVariables = vars
+	patterns := make([]string, 0, len(applied))
+	for pattern := range applied {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	return normalized, patterns
+}
+
+// NormalizedActionDigest returns the digest of the action with the policy
+// applied to its command, along with the configured names of the rules that
+// changed it. The normalized action and command are stored in the CAS, so
+// that cached results for the normalized action are complete. If no rule
+// changes the command, it returns a nil digest.
+func (p *Policy) NormalizedActionDigest(ctx context.Context, cache interfaces.Cache, instanceName string, action *repb.Action, cmd *repb.Command) (*digest.InstanceNameDigest, []string, error) {
+	normalizedCmd, patterns := p.Apply(cmd)
+	if normalizedCmd == nil {
+		return nil, nil, nil
+	}
+	cmdDigest, err := cachetools.UploadProtoToCAS(ctx, cache, instanceName, normalizedCmd)
+	if err != nil {
+		return nil, nil, err
+	}
+	normalizedAction := proto.Clone(action).(*repb.Action)
+	normalizedAction.CommandDigest = cmdDigest
+	actionDigest, err := cachetools.UploadProtoToCAS(ctx, cache, instanceName, normalizedAction)
+	if err != nil {
+		return nil, nil, err
+	}
+	return digest.NewInstanceNameDigest(actionDigest, instanceName), patterns, nil
+}
+
+// ComputeNormalizedActionDigest is like NormalizedActionDigest, but only
+// computes the digest, without storing anything in the CAS.
+func (p *Policy) ComputeNormalizedActionDigest(instanceName string, action *repb.Action, cmd *repb.Command) (*digest.InstanceNameDigest, []string, error) {
+	normalizedCmd, patterns := p.Apply(cmd)
+	if normalizedCmd == nil {
+		return nil, nil, nil
+	}
+	cmdDigest, err := digest.ComputeForMessage(normalizedCmd)
+	if err != nil {
+		return nil, nil, err
+	}
+	normalizedAction := proto.Clone(action).(*repb.Action)
+	normalizedAction.CommandDigest = cmdDigest
+	actionDigest, err := digest.ComputeForMessage(normalizedAction)
+	if err != nil {
+		return nil, nil, err
+	}
+	return digest.NewInstanceNameDigest(actionDigest, instanceName), patterns, nil
+}
@@ -0,0 +1,115 @@
+package envpolicy_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/envpolicy"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+func command(env ...string) *repb.Command {
+	cmd := &repb.Command{Arguments: []string{"cc", "foo.c"}}
+	for i := 0; i < len(env); i += 2 {
+		cmd.EnvironmentVariables = append(cmd.EnvironmentVariables, &repb.Command_EnvironmentVariable{
+			Name:  env[i],
+			Value: env[i+1],
+		})
+	}
+	return cmd
+}
+
+func TestNew_NoRules_ReturnsNilPolicy(t *testing.T) {
+	p, err := envpolicy.New(nil)
+
+	require.NoError(t, err)
+	assert.Nil(t, p)
+}
+
+func TestNew_InvalidRules(t *testing.T) {
+	for _, cfg := range []config.EnvNormalizationConfig{
+		{Name: "TMPDIR", Action: "delete"},
+		{Name: "", Action: "strip"},
+		{Name: "*", Action: "strip"},
+		{Name: "FOO*BAR", Action: "strip"},
+	} {
+		_, err := envpolicy.New([]config.EnvNormalizationConfig{cfg})
+
+		assert.Error(t, err, "config: %+v", cfg)
+	}
+}
+
+func TestApply(t *testing.T) {
+	p, err := envpolicy.New([]config.EnvNormalizationConfig{
+		{Name: "TMPDIR", Action: "strip"},
+		{Name: "PATH", Action: "replace", Value: "/usr/bin:/bin"},
+		{Name: "CI_*", Action: "strip"},
+	})
+	require.NoError(t, err)
+
+	cmd := command(
+		"CI_BUILD_NUMBER", "123",
+		"HOME", "/home/user",
+		"PATH", "/home/user/bin:/usr/bin:/bin",
+		"TMPDIR", "/tmp/abc",
+	)
+	normalized, applied := p.Apply(cmd)
+
+	assert.Equal(t, command("HOME", "/home/user", "PATH", "/usr/bin:/bin"), normalized)
+	assert.Equal(t, []string{"CI_*", "PATH", "TMPDIR"}, applied)
+	// The original command should not be modified.
+	assert.Len(t, cmd.GetEnvironmentVariables(), 4)
+}
+
+func TestApply_AlreadyNormalized_ReturnsNil(t *testing.T) {
+	p, err := envpolicy.New([]config.EnvNormalizationConfig{
+		{Name: "TMPDIR", Action: "strip"},
+		{Name: "PATH", Action: "replace", Value: "/usr/bin:/bin"},
+	})
+	require.NoError(t, err)
+
+	normalized, applied := p.Apply(command("HOME", "/home/user", "PATH", "/usr/bin:/bin"))
+
+	assert.Nil(t, normalized)
+	assert.Empty(t, applied)
+}
+
+func TestComputeNormalizedActionDigest(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te)
+	require.NoError(t, err)
+	p, err := envpolicy.New([]config.EnvNormalizationConfig{{Name: "TMPDIR", Action: "strip"}})
+	require.NoError(t, err)
+	action := &repb.Action{CommandDigest: &repb.Digest{Hash: strings.Repeat("a", 64), SizeBytes: 1}}
+	cmd := command("TMPDIR", "/tmp/abc")
+
+	computed, applied, err := p.ComputeNormalizedActionDigest("instance", action, cmd)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"TMPDIR"}, applied)
+
+	// Computing the digest doesn't store the normalized action.
+	cas := namespace.CASCache(te.GetCache(), "instance")
+	exists, err := cas.Contains(ctx, computed.Digest)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	stored, _, err := p.NormalizedActionDigest(ctx, te.GetCache(), "instance", action, cmd)
+	require.NoError(t, err)
+	assert.Equal(t, stored, computed)
+	exists, err = cas.Contains(ctx, computed.Digest)
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	computed, applied, err = p.ComputeNormalizedActionDigest("instance", action, command("HOME", "/home/user"))
+	require.NoError(t, err)
+	assert.Nil(t, computed)
+	assert.Empty(t, applied)
+}
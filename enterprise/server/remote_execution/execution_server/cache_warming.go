@@ -0,0 +1,237 @@
+package execution_server
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/cron"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/request_info"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+	"github.com/prometheus/client_golang/prometheus"
+
+	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	// How often to check whether the cache of any group is due to be warmed.
+	cacheWarmingCheckInterval = 1 * time.Minute
+
+	// How long after its scheduled time a cache warming run is still started,
+	// e.g. if no app was running at the scheduled time. Runs missed by more
+	// than this are skipped, so that they don't compete with peak traffic.
+	cacheWarmingCatchUpWindow = 1 * time.Hour
+
+	defaultCacheWarmingLookback   = 24 * time.Hour
+	defaultMaxCacheWarmingActions = 100
+
+	// Maximum number of recent executions analyzed per group.
+	maxCacheWarmingExecutionsAnalyzed = 10000
+
+	// The label of the API key that a group's cache is warmed with.
+	cacheWarmingAPIKeyLabel = "Cache warming"
+)
+
+type cacheWarmingOptions struct {
+	schedule   *cron.Schedule
+	lookback   time.Duration
+	maxActions int
+}
+
+func (s *ExecutionServer) startCacheWarming(opts *cacheWarmingOptions) {
+	shuttingDown := make(chan struct{})
+	s.env.GetHealthChecker().RegisterShutdownFunction(func(ctx context.Context) error {
+		close(shuttingDown)
+		return nil
+	})
+	go func() {
+		for {
+			select {
+			case <-shuttingDown:
+				return
+			case <-time.After(cacheWarmingCheckInterval):
+				s.warmDueCaches(context.Background(), opts, time.Now().UTC())
+			}
+		}
+	}()
+}
+
+// warmDueCaches warms the cache of each group that enabled cache warming and
+// whose cache was not yet warmed since the last scheduled time.
+func (s *ExecutionServer) warmDueCaches(ctx context.Context, opts *cacheWarmingOptions, now time.Time) {
+	dbh := s.env.GetDBHandle()
+	if dbh == nil {
+		return
+	}
+	var groups []*tables.Group
+	err := dbh.WithContext(ctx).
+		Select("group_id", "last_cache_warming_usec").
+		Where("cache_warming_enabled = ?", true).
+		Find(&groups).Error
+	if err != nil {
+		log.Warningf("Could not fetch groups with cache warming enabled: %s", err)
+		return
+	}
+	for _, g := range groups {
+		since := now.Add(-cacheWarmingCatchUpWindow)
+		if last := timeutil.FromUsec(g.LastCacheWarmingUsec); last.After(since) {
+			since = last
+		}
+		if next := opts.schedule.Next(since); next.IsZero() || next.After(now) {
+			continue
+		}
+		// Claim the run, so that the cache is only warmed by one app.
+		res := dbh.WithContext(ctx).Model(&tables.Group{}).
+			Where("group_id = ? AND last_cache_warming_usec = ?", g.GroupID, g.LastCacheWarmingUsec).
+			UpdateColumn("last_cache_warming_usec", timeutil.ToUsec(now))
+		if res.Error != nil {
+			log.Warningf("Could not claim cache warming run for group %q: %s", g.GroupID, res.Error)
+			continue
+		}
+		if res.RowsAffected == 0 {
+			continue
+		}
+		n, err := s.warmCache(ctx, g.GroupID, opts, now)
+		if err != nil {
+			log.Warningf("Could not warm cache for group %q after re-running %d actions: %s", g.GroupID, n, err)
+			continue
+		}
+		log.Infof("Re-ran %d actions to warm the cache for group %q", n, g.GroupID)
+	}
+}
+
+// warmCache re-runs the group's actions that most often missed the cache
+// within the lookback period, if their results are no longer cached. It
+// returns the number of actions re-run.
+func (s *ExecutionServer) warmCache(ctx context.Context, groupID string, opts *cacheWarmingOptions, now time.Time) (int, error) {
+	apiKey, err := s.cacheWarmingAPIKey(ctx, groupID)
+	if err != nil {
+		return 0, err
+	}
+	ctx = s.env.GetAuthenticator().AuthContextFromAPIKey(ctx, apiKey.Value)
+	u, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return 0, err
+	}
+	// Warming doesn't go through the gRPC interceptors, so record the request
+	// info that metrics labels are read from here.
+	ctx = request_info.WithInfo(ctx, request_info.New(ctx, u))
+	ctx, err = prefix.AttachUserPrefixToContext(ctx, s.env)
+	if err != nil {
+		return 0, err
+	}
+
+	var executionIDs []string
+	err = s.env.GetDBHandle().WithContext(ctx).Model(&tables.Execution{}).
+		Where("group_id = ? AND created_at_usec >= ?", groupID, timeutil.ToUsec(now.Add(-opts.lookback))).
+		Order("created_at_usec DESC").
+		Limit(maxCacheWarmingExecutionsAnalyzed).
+		Pluck("execution_id", &executionIDs).Error
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, d := range mostExecutedActions(executionIDs) {
+		if n >= opts.maxActions {
+			break
+		}
+		if _, err := s.getActionResultFromCache(ctx, d); err == nil {
+			continue
+		}
+		action := &repb.Action{}
+		if err := cachetools.ReadProtoFromCAS(ctx, s.cache, d, action); err != nil {
+			// The action is no longer cached either, so it can't be re-run.
+			continue
+		}
+		if action.GetDoNotCache() {
+			continue
+		}
+		req := &repb.ExecuteRequest{
+			InstanceName:    d.GetInstanceName(),
+			ActionDigest:    d.Digest,
+			SkipCacheLookup: true,
+		}
+		if _, err := s.Dispatch(ctx, req); err != nil {
+			return n, err
+		}
+		metrics.RemoteExecutionCacheWarmingCount.With(prometheus.Labels{
+			metrics.GroupID: groupID,
+		}).Inc()
+		n++
+	}
+	return n, nil
+}
+
+// cacheWarmingAPIKey returns the API key that the group's cache is warmed
+// with, creating it if the group doesn't have one yet. Warming gets a key of
+// its own, rather than borrowing one of the group's keys, so that it's
+// attributed to cache warming, and so that it's allowed to write to the cache.
+func (s *ExecutionServer) cacheWarmingAPIKey(ctx context.Context, groupID string) (*tables.APIKey, error) {
+	var keys []*tables.APIKey
+	err := s.env.GetDBHandle().WithContext(ctx).
+		Where("group_id = ? AND label = ?", groupID, cacheWarmingAPIKeyLabel).
+		Order("created_at_usec ASC").
+		Find(&keys).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if k.Capabilities&int32(akpb.ApiKey_CACHE_WRITE_CAPABILITY) != 0 {
+			return k, nil
+		}
+	}
+	userDB := s.env.GetUserDB()
+	if userDB == nil {
+		return nil, status.FailedPreconditionError("cache warming requires a user DB")
+	}
+	return userDB.CreateAPIKey(ctx, groupID, cacheWarmingAPIKeyLabel, []akpb.ApiKey_Capability{akpb.ApiKey_CACHE_WRITE_CAPABILITY})
+}
+
+// mostExecutedActions returns the actions of the given executions, ordered by
+// how often they were executed, most often first. Actions are only executed
+// after missing the cache, so these are the actions that most often missed
+// the cache.
+func mostExecutedActions(executionIDs []string) []*digest.InstanceNameDigest {
+	type actionCount struct {
+		d     *digest.InstanceNameDigest
+		key   string
+		count int
+	}
+	counts := make(map[string]*actionCount)
+	for _, id := range executionIDs {
+		d, err := digest.ParseUploadResourceName(id)
+		if err != nil {
+			continue
+		}
+		key := d.GetInstanceName() + "/" + d.GetHash()
+		if c, ok := counts[key]; ok {
+			c.count++
+		} else {
+			counts[key] = &actionCount{d: d, key: key, count: 1}
+		}
+	}
+	sorted := make([]*actionCount, 0, len(counts))
+	for _, c := range counts {
+		sorted = append(sorted, c)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].count != sorted[j].count {
+			return sorted[i].count > sorted[j].count
+		}
+		return sorted[i].key < sorted[j].key
+	})
+	actions := make([]*digest.InstanceNameDigest, 0, len(sorted))
+	for _, c := range sorted {
+		actions = append(actions, c.d)
+	}
+	return actions
+}
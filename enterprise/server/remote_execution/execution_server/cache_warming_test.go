@@ -0,0 +1,271 @@
+package execution_server
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/capabilities"
+	"github.com/buildbuddy-io/buildbuddy/server/util/cron"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/request_info"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+// apiKeyAuthenticator authenticates the API keys stored in the DB as a user of
+// the key's group, with the key's capabilities.
+type apiKeyAuthenticator struct {
+	*testauth.TestAuthenticator
+	env *testenv.TestEnv
+}
+
+func (a *apiKeyAuthenticator) AuthContextFromAPIKey(ctx context.Context, apiKey string) context.Context {
+	k := &tables.APIKey{}
+	if err := a.env.GetDBHandle().Where("value = ?", apiKey).Take(k).Error; err != nil {
+		return ctx
+	}
+	return testauth.WithAuthenticatedUserInfo(ctx, &testauth.TestUser{
+		UserID:        k.APIKeyID,
+		GroupID:       k.GroupID,
+		AllowedGroups: []string{k.GroupID},
+		Capabilities:  capabilities.FromInt(k.Capabilities),
+	})
+}
+
+// fakeScheduler records the tasks scheduled by cache warming, along with the
+// users that scheduled them.
+type fakeScheduler struct {
+	interfaces.SchedulerService
+	env *testenv.TestEnv
+
+	mu      sync.Mutex
+	taskIDs []string
+	userIDs []string
+	// requestGroupIDs are the group IDs recorded in the request info of the
+	// contexts that tasks were scheduled with.
+	requestGroupIDs []string
+}
+
+func (s *fakeScheduler) GetGroupIDAndDefaultPoolForUser(ctx context.Context) (string, string, error) {
+	u, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	return u.GetGroupID(), "", nil
+}
+
+func (s *fakeScheduler) ScheduleTask(ctx context.Context, req *scpb.ScheduleTaskRequest) (*scpb.ScheduleTaskResponse, error) {
+	u, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.taskIDs = append(s.taskIDs, req.GetTaskId())
+	s.userIDs = append(s.userIDs, u.GetUserID())
+	s.requestGroupIDs = append(s.requestGroupIDs, request_info.FromContext(ctx).GroupID)
+	return &scpb.ScheduleTaskResponse{}, nil
+}
+
+func (s *fakeScheduler) scheduledActions(t *testing.T) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hashes := make([]string, 0, len(s.taskIDs))
+	for _, id := range s.taskIDs {
+		d, err := digest.ParseUploadResourceName(id)
+		require.NoError(t, err)
+		hashes = append(hashes, d.GetHash())
+	}
+	return hashes
+}
+
+func getCacheWarmingEnv(t *testing.T) (*testenv.TestEnv, *ExecutionServer, *fakeScheduler) {
+	te := enterprise_testenv.GetCustomTestEnv(t, &enterprise_testenv.Options{})
+	te.SetAuthenticator(&apiKeyAuthenticator{
+		TestAuthenticator: testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")),
+		env:               te,
+	})
+	scheduler := &fakeScheduler{env: te}
+	te.SetSchedulerService(scheduler)
+	namespaces, err := namespace.NewOverrideResolver(te)
+	require.NoError(t, err)
+	s := &ExecutionServer{env: te, cache: te.GetCache(), namespaces: namespaces}
+	return te, s, scheduler
+}
+
+func groupContext(t *testing.T, te *testenv.TestEnv) context.Context {
+	ctx, err := te.GetAuthenticator().(*apiKeyAuthenticator).WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+	ctx, err = prefix.AttachUserPrefixToContext(ctx, te)
+	require.NoError(t, err)
+	return ctx
+}
+
+// addExecutions uploads an action, and records that it was executed the given
+// number of times by the group.
+func addExecutions(ctx context.Context, t *testing.T, te *testenv.TestEnv, action *repb.Action, count int) *repb.Digest {
+	d := uploadProto(ctx, t, te, action)
+	for i := 0; i < count; i++ {
+		id, err := digest.UploadResourceName(d, testInstanceName)
+		require.NoError(t, err)
+		err = te.GetDBHandle().Create(&tables.Execution{ExecutionID: id, GroupID: "GR1"}).Error
+		require.NoError(t, err)
+	}
+	return d
+}
+
+func testAction(ctx context.Context, t *testing.T, te *testenv.TestEnv, arg string) *repb.Action {
+	return &repb.Action{
+		CommandDigest:   uploadProto(ctx, t, te, &repb.Command{Arguments: []string{"echo", arg}}),
+		InputRootDigest: uploadProto(ctx, t, te, &repb.Directory{}),
+	}
+}
+
+func TestMostExecutedActions(t *testing.T) {
+	id := func(instanceName, hash string) string {
+		d := &repb.Digest{Hash: hash, SizeBytes: 1}
+		id, err := digest.UploadResourceName(d, instanceName)
+		require.NoError(t, err)
+		return id
+	}
+	a := strings.Repeat("a", 64)
+	b := strings.Repeat("b", 64)
+	executionIDs := []string{
+		id("", b),
+		id("", a),
+		id("", b),
+		id("other", a),
+		"not/an/upload/resource/name",
+		id("other", a),
+		id("", b),
+	}
+
+	var got []string
+	for _, d := range mostExecutedActions(executionIDs) {
+		got = append(got, d.GetInstanceName()+"/"+d.GetHash())
+	}
+	assert.Equal(t, []string{"/" + b, "other/" + a, "/" + a}, got)
+	assert.Empty(t, mostExecutedActions(nil))
+}
+
+func TestCacheWarmingAPIKey(t *testing.T) {
+	te, s, _ := getCacheWarmingEnv(t)
+	ctx := context.Background()
+
+	// The group's own keys aren't borrowed, nor are keys that can't write to
+	// the cache.
+	_, err := te.GetUserDB().CreateAPIKey(ctx, "GR1", "CI", []akpb.ApiKey_Capability{akpb.ApiKey_CACHE_WRITE_CAPABILITY})
+	require.NoError(t, err)
+	readOnly, err := te.GetUserDB().CreateAPIKey(ctx, "GR1", cacheWarmingAPIKeyLabel, nil)
+	require.NoError(t, err)
+
+	k, err := s.cacheWarmingAPIKey(ctx, "GR1")
+	require.NoError(t, err)
+	assert.NotEqual(t, readOnly.APIKeyID, k.APIKeyID)
+	assert.Equal(t, "GR1", k.GroupID)
+	assert.Equal(t, cacheWarmingAPIKeyLabel, k.Label)
+	assert.Equal(t, []akpb.ApiKey_Capability{akpb.ApiKey_CACHE_WRITE_CAPABILITY}, capabilities.FromInt(k.Capabilities))
+
+	// The key is reused by later runs.
+	again, err := s.cacheWarmingAPIKey(ctx, "GR1")
+	require.NoError(t, err)
+	assert.Equal(t, k.APIKeyID, again.APIKeyID)
+
+	// Each group gets a key of its own.
+	other, err := s.cacheWarmingAPIKey(ctx, "GR2")
+	require.NoError(t, err)
+	assert.Equal(t, "GR2", other.GroupID)
+	assert.NotEqual(t, k.APIKeyID, other.APIKeyID)
+}
+
+func TestWarmCache(t *testing.T) {
+	te, s, scheduler := getCacheWarmingEnv(t)
+	ctx := groupContext(t, te)
+
+	mostExecuted := addExecutions(ctx, t, te, testAction(ctx, t, te, "most"), 3)
+	cached := addExecutions(ctx, t, te, testAction(ctx, t, te, "cached"), 3)
+	doNotCache := testAction(ctx, t, te, "do-not-cache")
+	doNotCache.DoNotCache = true
+	addExecutions(ctx, t, te, doNotCache, 3)
+	second := addExecutions(ctx, t, te, testAction(ctx, t, te, "second"), 2)
+	addExecutions(ctx, t, te, testAction(ctx, t, te, "least"), 1)
+
+	result, err := proto.Marshal(&repb.ActionResult{})
+	require.NoError(t, err)
+	require.NoError(t, namespace.ActionCache(te.GetCache(), testInstanceName).Set(ctx, cached, result))
+
+	opts := &cacheWarmingOptions{lookback: time.Hour, maxActions: 2}
+	n, err := s.warmCache(context.Background(), "GR1", opts, time.Now())
+	require.NoError(t, err)
+
+	// Cached actions, and actions whose results may not be cached, are
+	// skipped.
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{mostExecuted.GetHash(), second.GetHash()}, scheduler.scheduledActions(t))
+
+	// The actions are re-run with the group's cache warming key.
+	k, err := s.cacheWarmingAPIKey(context.Background(), "GR1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{k.APIKeyID, k.APIKeyID}, scheduler.userIDs)
+	// The group is recorded in the request info, for metrics labels.
+	assert.Equal(t, []string{"GR1", "GR1"}, scheduler.requestGroupIDs)
+}
+
+func TestWarmDueCaches(t *testing.T) {
+	te, s, scheduler := getCacheWarmingEnv(t)
+	ctx := groupContext(t, te)
+	action := addExecutions(ctx, t, te, testAction(ctx, t, te, "action"), 1)
+
+	schedule, err := cron.Parse("0 4 * * *")
+	require.NoError(t, err)
+	opts := &cacheWarmingOptions{schedule: schedule, lookback: 24 * time.Hour, maxActions: 10}
+	// The next scheduled time, so that the executions recorded just now are
+	// within the lookback period.
+	dueAt := schedule.Next(time.Now().UTC())
+	for _, g := range []*tables.Group{
+		// Due, since its cache was last warmed at the previous scheduled time.
+		{GroupID: "GR1", CacheWarmingEnabled: true, LastCacheWarmingUsec: timeutil.ToUsec(dueAt.Add(-24 * time.Hour))},
+		// Already warmed at the scheduled time.
+		{GroupID: "GR2", CacheWarmingEnabled: true, LastCacheWarmingUsec: timeutil.ToUsec(dueAt)},
+		// Cache warming isn't enabled.
+		{GroupID: "GR3"},
+	} {
+		require.NoError(t, te.GetDBHandle().Create(g).Error)
+	}
+	lastWarmedUsec := func(groupID string) int64 {
+		g := &tables.Group{}
+		require.NoError(t, te.GetDBHandle().Where("group_id = ?", groupID).Take(g).Error)
+		return g.LastCacheWarmingUsec
+	}
+
+	s.warmDueCaches(context.Background(), opts, dueAt)
+	assert.Equal(t, timeutil.ToUsec(dueAt), lastWarmedUsec("GR1"))
+	assert.Equal(t, timeutil.ToUsec(dueAt), lastWarmedUsec("GR2"))
+	assert.Equal(t, int64(0), lastWarmedUsec("GR3"))
+	assert.Equal(t, []string{action.GetHash()}, scheduler.scheduledActions(t))
+
+	// Runs missed by more than the catch-up window are skipped, and caches
+	// are only warmed once per scheduled time.
+	missedUsec := timeutil.ToUsec(dueAt.Add(-24 * time.Hour))
+	require.NoError(t, te.GetDBHandle().Create(&tables.Group{GroupID: "GR4", CacheWarmingEnabled: true, LastCacheWarmingUsec: missedUsec}).Error)
+	s.warmDueCaches(context.Background(), opts, dueAt.Add(cacheWarmingCatchUpWindow+time.Minute))
+	assert.Equal(t, missedUsec, lastWarmedUsec("GR4"))
+	assert.Equal(t, timeutil.ToUsec(dueAt), lastWarmedUsec("GR1"))
+	assert.Equal(t, []string{action.GetHash()}, scheduler.scheduledActions(t))
+}
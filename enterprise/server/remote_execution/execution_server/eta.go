@@ -0,0 +1,149 @@
+package execution_server
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/operation"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/bazel_request"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/genproto/googleapis/longrunning"
+
+	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	anypb "github.com/golang/protobuf/ptypes/any"
+)
+
+const (
+	// The number of recent executions of a target that its execution
+	// duration is estimated from.
+	etaSampleSize = 20
+)
+
+// executionEstimate is the estimated duration of the execution stage of an
+// action, based on recent executions of the same target and mnemonic.
+type executionEstimate struct {
+	duration time.Duration
+	samples  int64
+}
+
+// estimateExecutionDuration estimates how long the execution stage of an
+// action will take, from the median duration of recent successful, uncached
+// executions of the same target and mnemonic that the caller can read. It
+// returns nil if there is no history to estimate from.
+func estimateExecutionDuration(ctx context.Context, env environment.Env, rmd *repb.RequestMetadata) (*executionEstimate, error) {
+	if env.GetDBHandle() == nil {
+		return nil, status.FailedPreconditionError("database not configured")
+	}
+	if rmd.GetTargetId() == "" || rmd.GetActionMnemonic() == "" {
+		return nil, nil
+	}
+	q := query_builder.NewQuery(`SELECT execution_start_timestamp_usec, execution_completed_timestamp_usec FROM Executions`)
+	q.AddWhereClause("target_id = ?", rmd.GetTargetId())
+	q.AddWhereClause("action_mnemonic = ?", rmd.GetActionMnemonic())
+	q.AddWhereClause("stage = ?", int64(repb.ExecutionStage_COMPLETED))
+	q.AddWhereClause("status_code = ?", 0)
+	q.AddWhereClause("cached_result = ?", false)
+	q.AddWhereClause("execution_start_timestamp_usec > ?", 0)
+	q.AddWhereClause("execution_completed_timestamp_usec >= execution_start_timestamp_usec")
+	if err := perms.AddPermissionsCheckToQuery(ctx, env, q); err != nil {
+		return nil, err
+	}
+	q.SetOrderBy("created_at_usec" /*ascending=*/, false)
+	q.SetLimit(etaSampleSize)
+	queryStr, args := q.Build()
+
+	type executionTimestamps struct {
+		ExecutionStartTimestampUsec     int64
+		ExecutionCompletedTimestampUsec int64
+	}
+	var rows []*executionTimestamps
+	if err := env.GetDBHandle().WithContext(ctx).Raw(queryStr, args...).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	durations := make([]int64, 0, len(rows))
+	for _, r := range rows {
+		durations = append(durations, r.ExecutionCompletedTimestampUsec-r.ExecutionStartTimestampUsec)
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return &executionEstimate{
+		duration: time.Duration(durations[len(durations)/2]) * time.Microsecond,
+		samples:  int64(len(durations)),
+	}, nil
+}
+
+// withExecutionProgress adds the estimated time remaining for an execution
+// which started executing at the given time to the metadata of op.
+func withExecutionProgress(op *longrunning.Operation, start time.Time, estimate *executionEstimate) error {
+	md := &repb.ExecuteOperationMetadata{}
+	if err := ptypes.UnmarshalAny(op.GetMetadata(), md); err != nil {
+		return err
+	}
+	remaining := estimate.duration - time.Since(start)
+	if remaining < 0 {
+		remaining = 0
+	}
+	progress, err := ptypes.MarshalAny(&espb.ExecutionProgress{
+		EstimatedExecutionDurationUsec: estimate.duration.Microseconds(),
+		EstimatedRemainingUsec:         remaining.Microseconds(),
+		SampleCount:                    estimate.samples,
+	})
+	if err != nil {
+		return err
+	}
+	startTimestamp, err := ptypes.TimestampProto(start)
+	if err != nil {
+		return err
+	}
+	md.PartialExecutionMetadata = &repb.ExecutedActionMetadata{
+		ExecutionStartTimestamp: startTimestamp,
+		AuxiliaryMetadata:       []*anypb.Any{progress},
+	}
+	op.Metadata, err = ptypes.MarshalAny(md)
+	return err
+}
+
+// executionProgressTracker adds estimates of the time remaining to the
+// operations published for a single execution.
+type executionProgressTracker struct {
+	env environment.Env
+	// When the execution stage started, or zero if it hasn't yet.
+	start     time.Time
+	estimated bool
+	estimate  *executionEstimate
+}
+
+// update adds the estimated time remaining to op if the execution is in
+// progress and its duration can be estimated. The estimate is only looked up
+// once per execution, when it starts executing.
+func (t *executionProgressTracker) update(ctx context.Context, op *longrunning.Operation) {
+	if operation.ExtractStage(op) != repb.ExecutionStage_EXECUTING || op.GetDone() {
+		return
+	}
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+	if !t.estimated {
+		t.estimated = true
+		estimate, err := estimateExecutionDuration(ctx, t.env, bazel_request.GetRequestMetadata(ctx))
+		if err != nil {
+			log.Debugf("Could not estimate duration of execution %q: %s", op.GetName(), err)
+		}
+		t.estimate = estimate
+	}
+	if t.estimate == nil {
+		return
+	}
+	if err := withExecutionProgress(op, t.start, t.estimate); err != nil {
+		log.Warningf("Could not add progress to execution %q: %s", op.GetName(), err)
+	}
+}
@@ -0,0 +1,110 @@
+package execution_server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/operation"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+type testExecution struct {
+	id       string
+	groupID  string
+	target   string
+	mnemonic string
+	duration time.Duration
+	status   int32
+	cached   bool
+}
+
+func insertCompletedExecution(t *testing.T, te *testenv.TestEnv, e *testExecution) {
+	start := time.Now().Add(-time.Hour)
+	err := te.GetDBHandle().Create(&tables.Execution{
+		ExecutionID:                     e.id,
+		GroupID:                         e.groupID,
+		Perms:                           perms.GROUP_READ,
+		Stage:                           int64(repb.ExecutionStage_COMPLETED),
+		TargetID:                        e.target,
+		ActionMnemonic:                  e.mnemonic,
+		ExecutionStartTimestampUsec:     timeutil.ToUsec(start),
+		ExecutionCompletedTimestampUsec: timeutil.ToUsec(start.Add(e.duration)),
+		StatusCode:                      e.status,
+		CachedResult:                    e.cached,
+	}).Error
+	require.NoError(t, err)
+}
+
+func TestEstimateExecutionDuration(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")))
+	ctx, err := te.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+
+	for _, e := range []*testExecution{
+		{id: "e1", groupID: "GR1", target: "//foo:test", mnemonic: "TestRunner", duration: 10 * time.Second},
+		{id: "e2", groupID: "GR1", target: "//foo:test", mnemonic: "TestRunner", duration: 20 * time.Second},
+		{id: "e3", groupID: "GR1", target: "//foo:test", mnemonic: "TestRunner", duration: 90 * time.Second},
+		// Failed, cached, and other groups' or actions' executions are ignored.
+		{id: "e4", groupID: "GR1", target: "//foo:test", mnemonic: "TestRunner", duration: time.Hour, status: 4},
+		{id: "e5", groupID: "GR1", target: "//foo:test", mnemonic: "TestRunner", duration: time.Hour, cached: true},
+		{id: "e6", groupID: "GR2", target: "//foo:test", mnemonic: "TestRunner", duration: time.Hour},
+		{id: "e7", groupID: "GR1", target: "//foo:test", mnemonic: "CppCompile", duration: time.Hour},
+		{id: "e8", groupID: "GR1", target: "//bar:test", mnemonic: "TestRunner", duration: time.Hour},
+	} {
+		insertCompletedExecution(t, te, e)
+	}
+
+	estimate, err := estimateExecutionDuration(ctx, te, &repb.RequestMetadata{TargetId: "//foo:test", ActionMnemonic: "TestRunner"})
+	require.NoError(t, err)
+	require.NotNil(t, estimate)
+	assert.Equal(t, 20*time.Second, estimate.duration)
+	assert.Equal(t, int64(3), estimate.samples)
+
+	estimate, err = estimateExecutionDuration(ctx, te, &repb.RequestMetadata{TargetId: "//baz:test", ActionMnemonic: "TestRunner"})
+	require.NoError(t, err)
+	assert.Nil(t, estimate)
+
+	estimate, err = estimateExecutionDuration(ctx, te, nil)
+	require.NoError(t, err)
+	assert.Nil(t, estimate)
+}
+
+func TestWithExecutionProgress(t *testing.T) {
+	d := digest.NewInstanceNameDigest(&repb.Digest{Hash: "abc", SizeBytes: 1}, "")
+	op, err := operation.Assemble(repb.ExecutionStage_EXECUTING, "task", d, operation.InProgressExecuteResponse())
+	require.NoError(t, err)
+
+	err = withExecutionProgress(op, time.Now().Add(-15*time.Second), &executionEstimate{duration: time.Minute, samples: 5})
+	require.NoError(t, err)
+
+	md := &repb.ExecuteOperationMetadata{}
+	require.NoError(t, ptypes.UnmarshalAny(op.GetMetadata(), md))
+	assert.Equal(t, repb.ExecutionStage_EXECUTING, md.GetStage())
+	assert.Equal(t, "abc", md.GetActionDigest().GetHash())
+	require.Len(t, md.GetPartialExecutionMetadata().GetAuxiliaryMetadata(), 1)
+	progress := &espb.ExecutionProgress{}
+	require.NoError(t, ptypes.UnmarshalAny(md.GetPartialExecutionMetadata().GetAuxiliaryMetadata()[0], progress))
+	assert.Equal(t, time.Minute.Microseconds(), progress.GetEstimatedExecutionDurationUsec())
+	assert.InDelta(t, (45 * time.Second).Microseconds(), progress.GetEstimatedRemainingUsec(), float64(time.Second.Microseconds()))
+	assert.Equal(t, int64(5), progress.GetSampleCount())
+
+	// Executions taking longer than estimated have no time remaining.
+	err = withExecutionProgress(op, time.Now().Add(-2*time.Minute), &executionEstimate{duration: time.Minute, samples: 5})
+	require.NoError(t, err)
+	require.NoError(t, ptypes.UnmarshalAny(op.GetMetadata(), md))
+	require.NoError(t, ptypes.UnmarshalAny(md.GetPartialExecutionMetadata().GetAuxiliaryMetadata()[0], progress))
+	assert.Equal(t, int64(0), progress.GetEstimatedRemainingUsec())
+}
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/pubsub"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/envpolicy"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/operation"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/tasksize"
@@ -23,10 +24,12 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/util/bazel_request"
+	"github.com/buildbuddy-io/buildbuddy/server/util/cron"
 	"github.com/buildbuddy-io/buildbuddy/server/util/db"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/request_info"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
 	"github.com/golang/protobuf/proto"
@@ -36,10 +39,10 @@ import (
 	"google.golang.org/grpc/codes"
 
 	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
-	gstatus "google.golang.org/grpc/status"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
 	tspb "github.com/golang/protobuf/ptypes/timestamp"
+	gstatus "google.golang.org/grpc/status"
 )
 
 const (
@@ -47,12 +50,6 @@ const (
 	defaultPlatformOSValue = "linux"
 	// The default architecture cpu architecture value, amd64.
 	defaultPlatformArchValue = "amd64"
-	// The key in Bazel platform properties that specifies operating system.
-	platformOSKey = "OSFamily"
-	// The key in Bazel platform properties that specifies executor cpu architecture.
-	platformArchKey = "Arch"
-	// The key in Bazel platform properties that specifies executor pool.
-	platformPoolKey = "Pool"
 )
 
 func timestampToMicros(tsPb *tspb.Timestamp) int64 {
@@ -79,6 +76,9 @@ func fillExecutionFromSummary(summary *espb.ExecutionSummary, execution *tables.
 	execution.ExecutionCompletedTimestampUsec = timestampToMicros(summary.GetExecutedActionMetadata().GetExecutionCompletedTimestamp())
 	execution.OutputUploadStartTimestampUsec = timestampToMicros(summary.GetExecutedActionMetadata().GetOutputUploadStartTimestamp())
 	execution.OutputUploadCompletedTimestampUsec = timestampToMicros(summary.GetExecutedActionMetadata().GetOutputUploadCompletedTimestamp())
+	// CrashReport
+	execution.CrashReportHash = summary.GetCrashReportDigest().GetHash()
+	execution.CrashReportSizeBytes = summary.GetCrashReportDigest().GetSizeBytes()
 }
 
 func generateCommandSnippet(command *repb.Command) string {
@@ -106,10 +106,19 @@ func redisKeyForTaskStatusStream(taskID string) string {
 type ExecutionServer struct {
 	env          environment.Env
 	cache        interfaces.Cache
+	namespaces   *namespace.OverrideResolver
 	streamPubSub *pubsub.StreamPubSub
+	// If set, results are also cached under, and looked up by, the action
+	// digest with this policy applied to the command's environment.
+	envPolicy *envpolicy.Policy
+	// Caches the platform property policies of groups, if groups are
+	// available.
+	platformPolicies *platformPolicyCache
 	// If enabled, users may register their own executors.
 	// When enabled, the executor group ID becomes part of the executor key.
 	enableUserOwnedExecutors bool
+	// If set, actions with longer timeouts are rejected.
+	maxActionTimeout time.Duration
 }
 
 func NewExecutionServer(env environment.Env) (*ExecutionServer, error) {
@@ -120,16 +129,55 @@ func NewExecutionServer(env environment.Env) (*ExecutionServer, error) {
 	if env.GetRemoteExecutionRedisClient() == nil || env.GetRemoteExecutionRedisPubSubClient() == nil {
 		return nil, status.FailedPreconditionErrorf("Redis is required for remote execution")
 	}
+	envPolicy, err := envpolicy.New(env.GetConfigurator().GetRemoteExecutionConfig().EnvNormalization)
+	if err != nil {
+		return nil, err
+	}
+	namespaces, err := namespace.NewOverrideResolver(env)
+	if err != nil {
+		return nil, err
+	}
 	es := &ExecutionServer{
 		env:                      env,
 		cache:                    cache,
+		namespaces:               namespaces,
+		envPolicy:                envPolicy,
 		enableUserOwnedExecutors: env.GetConfigurator().GetRemoteExecutionConfig().EnableUserOwnedExecutors,
 		streamPubSub:             pubsub.NewStreamPubSub(env.GetRemoteExecutionRedisPubSubClient()),
 	}
+	if env.GetUserDB() != nil {
+		if es.platformPolicies, err = newPlatformPolicyCache(env); err != nil {
+			return nil, err
+		}
+	}
+	if t := env.GetConfigurator().GetRemoteExecutionConfig().MaxActionTimeoutSeconds; t > 0 {
+		es.maxActionTimeout = time.Duration(t) * time.Second
+	}
+	if t := env.GetConfigurator().GetRemoteExecutionConfig().StaleExecutionTimeoutSeconds; t > 0 {
+		es.startStaleExecutionReaper(time.Duration(t) * time.Second)
+	}
+	if cwc := env.GetConfigurator().GetRemoteExecutionConfig().CacheWarming; cwc.Schedule != "" {
+		schedule, err := cron.Parse(cwc.Schedule)
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("Invalid cache warming schedule: %s", err)
+		}
+		opts := &cacheWarmingOptions{
+			schedule:   schedule,
+			lookback:   defaultCacheWarmingLookback,
+			maxActions: defaultMaxCacheWarmingActions,
+		}
+		if cwc.LookbackHours > 0 {
+			opts.lookback = time.Duration(cwc.LookbackHours) * time.Hour
+		}
+		if cwc.MaxActionsPerGroup > 0 {
+			opts.maxActions = cwc.MaxActionsPerGroup
+		}
+		es.startCacheWarming(opts)
+	}
 	return es, nil
 }
 
-func (s *ExecutionServer) insertExecution(ctx context.Context, executionID, invocationID, snippet string, stage repb.ExecutionStage_Value) error {
+func (s *ExecutionServer) insertExecution(ctx context.Context, executionID, invocationID, snippet, pool string, stage repb.ExecutionStage_Value) error {
 	if s.env.GetDBHandle() == nil {
 		return status.FailedPreconditionError("database not configured")
 	}
@@ -138,6 +186,11 @@ func (s *ExecutionServer) insertExecution(ctx context.Context, executionID, invo
 		InvocationID:   invocationID,
 		Stage:          int64(stage),
 		CommandSnippet: snippet,
+		Pool:           pool,
+	}
+	if rmd := bazel_request.GetRequestMetadata(ctx); rmd != nil {
+		execution.TargetID = rmd.GetTargetId()
+		execution.ActionMnemonic = rmd.GetActionMnemonic()
 	}
 
 	var permissions *perms.UserGroupPerm
@@ -217,8 +270,11 @@ func (s *ExecutionServer) updateExecution(ctx context.Context, executionID strin
 // N.B. This should only be used if the calling code has already ensured the
 // action is valid and may be returned.
 func (s *ExecutionServer) getUnvalidatedActionResult(ctx context.Context, d *digest.InstanceNameDigest) (*repb.ActionResult, error) {
-	cache := namespace.ActionCache(s.cache, d.GetInstanceName())
-	data, err := cache.Get(ctx, d.Digest)
+	cache, err := s.namespaces.InvocationCache(ctx, s.cache)
+	if err != nil {
+		return nil, err
+	}
+	data, err := namespace.AliasedActionCache(ctx, s.env, cache, d.GetInstanceName()).Get(ctx, d.Digest)
 	if err != nil {
 		if status.IsNotFoundError(err) {
 			return nil, digest.MissingDigestError(d.Digest)
@@ -237,13 +293,88 @@ func (s *ExecutionServer) getActionResultFromCache(ctx context.Context, d *diges
 	if err != nil {
 		return nil, err
 	}
-	casCache := namespace.CASCache(s.cache, d.GetInstanceName())
+	cache, err := s.namespaces.InvocationCache(ctx, s.cache)
+	if err != nil {
+		return nil, err
+	}
+	casCache := namespace.AliasedCASCache(ctx, s.env, cache, d.GetInstanceName())
 	if err := action_cache_server.ValidateActionResult(ctx, casCache, actionResult); err != nil {
 		return nil, err
 	}
 	return actionResult, nil
 }
 
+// normalizedActionDigest returns the digest of the given action with the
+// environment policy applied to its command. It returns a nil digest if the
+// policy does not change the action, or if the action should not be cached.
+func (s *ExecutionServer) normalizedActionDigest(ctx context.Context, d *digest.InstanceNameDigest) (*digest.InstanceNameDigest, []string, error) {
+	action := &repb.Action{}
+	if err := cachetools.ReadProtoFromCAS(ctx, s.cache, d, action); err != nil {
+		return nil, nil, err
+	}
+	if action.GetDoNotCache() {
+		return nil, nil, nil
+	}
+	cmd := &repb.Command{}
+	if err := cachetools.ReadProtoFromCAS(ctx, s.cache, digest.NewInstanceNameDigest(action.GetCommandDigest(), d.GetInstanceName()), cmd); err != nil {
+		return nil, nil, err
+	}
+	return s.envPolicy.NormalizedActionDigest(ctx, s.cache, d.GetInstanceName(), action, cmd)
+}
+
+// getNormalizedActionResultFromCache looks up the cached result of the given
+// action with the environment policy applied to its command.
+func (s *ExecutionServer) getNormalizedActionResultFromCache(ctx context.Context, d *digest.InstanceNameDigest) (*repb.ActionResult, error) {
+	nd, applied, err := s.normalizedActionDigest(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	if nd == nil {
+		return nil, digest.MissingDigestError(d.Digest)
+	}
+	actionResult, err := s.getActionResultFromCache(ctx, nd)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range applied {
+		metrics.EnvNormalizationCacheHits.With(prometheus.Labels{
+			metrics.EnvironmentVariableLabel: name,
+		}).Inc()
+	}
+	return actionResult, nil
+}
+
+// cacheNormalizedActionResult caches the result of a completed execution
+// under the normalized action digest, so that later actions which differ only
+// in normalized environment variables can reuse it.
+func (s *ExecutionServer) cacheNormalizedActionResult(ctx context.Context, taskID string, executeResponse *repb.ExecuteResponse) error {
+	if s.envPolicy == nil || executeResponse.GetCachedResult() {
+		return nil
+	}
+	// Only successful results are cached, matching what the executor uploads
+	// to the action cache.
+	if gstatus.FromProto(executeResponse.GetStatus()).Code() != codes.OK || executeResponse.GetResult().GetExitCode() != 0 {
+		return nil
+	}
+	instanceName, d, err := digest.ExtractDigestFromUploadResourceName(taskID)
+	if err != nil {
+		return err
+	}
+	nd, _, err := s.normalizedActionDigest(ctx, digest.NewInstanceNameDigest(d, instanceName))
+	if err != nil || nd == nil {
+		return err
+	}
+	data, err := proto.Marshal(executeResponse.GetResult())
+	if err != nil {
+		return err
+	}
+	cache, err := s.namespaces.InvocationCache(ctx, s.cache)
+	if err != nil {
+		return err
+	}
+	return namespace.AliasedActionCache(ctx, s.env, cache, instanceName).Set(ctx, nd.Digest, data)
+}
+
 type streamLike interface {
 	Context() context.Context
 	Send(*longrunning.Operation) error
@@ -253,21 +384,67 @@ func (s *ExecutionServer) Execute(req *repb.ExecuteRequest, stream repb.Executio
 	return s.execute(req, stream)
 }
 
+// schedulingMetadata returns the metadata used to schedule the given command
+// for the authenticated user.
+func (s *ExecutionServer) schedulingMetadata(ctx context.Context, command *repb.Command) (*scpb.SchedulingMetadata, error) {
+	os := defaultPlatformOSValue
+	arch := defaultPlatformArchValue
+	groupID, pool, err := s.env.GetSchedulerService().GetGroupIDAndDefaultPoolForUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	platformReqs, err := platform.ParseRequirements(command.GetPlatform())
+	if err != nil {
+		return nil, err
+	}
+	// Exact os, arch, and pool values select a single pool of executors;
+	// anything else is matched by the scheduler against each executor.
+	var requirements []string
+	for _, r := range platformReqs {
+		if r.Attribute == platform.PoolAttribute {
+			for i, v := range r.Values {
+				if v == platform.DefaultPoolValue {
+					r.Values[i] = pool
+				}
+			}
+		}
+		value, exact := r.ExactValue()
+		switch {
+		case exact && r.Attribute == platform.OSAttribute:
+			os = value
+		case exact && r.Attribute == platform.ArchAttribute:
+			arch = value
+		case exact && r.Attribute == platform.PoolAttribute:
+			pool = value
+		default:
+			requirements = append(requirements, r.String())
+			switch r.Attribute {
+			case platform.OSAttribute:
+				os = ""
+			case platform.ArchAttribute:
+				arch = ""
+			case platform.PoolAttribute:
+				pool = ""
+			}
+		}
+	}
+	return &scpb.SchedulingMetadata{
+		Os:           os,
+		Arch:         arch,
+		Pool:         pool,
+		TaskSize:     tasksize.Estimate(command),
+		GroupId:      groupID,
+		Requirements: requirements,
+	}, nil
+}
+
 func (s *ExecutionServer) Dispatch(ctx context.Context, req *repb.ExecuteRequest) (string, error) {
 	scheduler := s.env.GetSchedulerService()
 	if scheduler == nil {
 		return "", status.FailedPreconditionErrorf("No scheduler service configured")
 	}
-	adInstanceDigest := digest.NewInstanceNameDigest(req.GetActionDigest(), req.GetInstanceName())
-	action := &repb.Action{}
-	if err := cachetools.ReadProtoFromCAS(ctx, s.cache, adInstanceDigest, action); err != nil {
-		log.Errorf("Error fetching action: %s", err.Error())
-		return "", err
-	}
-	cmdInstanceDigest := digest.NewInstanceNameDigest(action.GetCommandDigest(), req.GetInstanceName())
-	command := &repb.Command{}
-	if err := cachetools.ReadProtoFromCAS(ctx, s.cache, cmdInstanceDigest, command); err != nil {
-		log.Errorf("Error fetching command: %s", err.Error())
+	action, command, err := s.validateExecuteRequest(ctx, req)
+	if err != nil {
 		return "", err
 	}
 
@@ -275,18 +452,27 @@ func (s *ExecutionServer) Dispatch(ctx context.Context, req *repb.ExecuteRequest
 	if err != nil {
 		return "", err
 	}
+	if err := s.applyPlatformPolicy(ctx, executionID, command); err != nil {
+		return "", err
+	}
 	invocationID := bazel_request.GetInvocationID(ctx)
 
-	if err := s.insertExecution(ctx, executionID, invocationID, generateCommandSnippet(command), repb.ExecutionStage_UNKNOWN); err != nil {
+	schedulingMetadata, err := s.schedulingMetadata(ctx, command)
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.insertExecution(ctx, executionID, invocationID, generateCommandSnippet(command), schedulingMetadata.GetPool(), repb.ExecutionStage_UNKNOWN); err != nil {
 		return "", err
 	}
 
 	executionTask := &repb.ExecutionTask{
-		ExecuteRequest: req,
-		InvocationId:   invocationID,
-		ExecutionId:    executionID,
-		Action:         action,
-		Command:        command,
+		ExecuteRequest:  req,
+		InvocationId:    invocationID,
+		ExecutionId:     executionID,
+		Action:          action,
+		Command:         command,
+		RequestMetadata: bazel_request.GetRequestMetadata(ctx),
 	}
 	// Allow execution worker to auth to cache (if necessary).
 	if jwt, ok := ctx.Value("x-buildbuddy-jwt").(string); ok {
@@ -299,39 +485,17 @@ func (s *ExecutionServer) Dispatch(ctx context.Context, req *repb.ExecuteRequest
 		return "", status.InternalErrorf("Error marshalling execution task %q: %s", executionID, err)
 	}
 
-	taskSize := tasksize.Estimate(command)
-
-	os := defaultPlatformOSValue
-	arch := defaultPlatformArchValue
-	groupID, pool, err := s.env.GetSchedulerService().GetGroupIDAndDefaultPoolForUser(ctx)
-	if err != nil {
-		return "", err
-	}
-	for _, property := range command.GetPlatform().GetProperties() {
-		if property.Name == platformOSKey {
-			os = strings.ToLower(property.Value)
-		}
-		if property.Name == platformPoolKey && property.Value != platform.DefaultPoolValue {
-			pool = strings.ToLower(property.Value)
-		}
-		if property.Name == platformArchKey {
-			arch = strings.ToLower(property.Value)
-		}
-	}
-
-	schedulingMetadata := &scpb.SchedulingMetadata{
-		Os:       os,
-		Arch:     arch,
-		Pool:     pool,
-		TaskSize: taskSize,
-		GroupId:  groupID,
-	}
 	scheduleReq := &scpb.ScheduleTaskRequest{
 		TaskId:         executionID,
 		Metadata:       schedulingMetadata,
 		SerializedTask: serializedTask,
 	}
 	if _, err := scheduler.ScheduleTask(ctx, scheduleReq); err != nil {
+		// Tasks that can never be scheduled as requested should fail rather
+		// than be retried.
+		if status.IsFailedPreconditionError(err) || status.IsInvalidArgumentError(err) {
+			return "", status.WrapErrorf(err, "Error scheduling execution task %q", executionID)
+		}
 		return "", status.UnavailableErrorf("Error scheduling execution task %q: %s", executionID, err.Error())
 	}
 	return executionID, nil
@@ -345,7 +509,11 @@ func (s *ExecutionServer) execute(req *repb.ExecuteRequest, stream streamLike) e
 	}
 
 	if !req.GetSkipCacheLookup() {
-		if actionResult, err := s.getActionResultFromCache(ctx, adInstanceDigest); err == nil {
+		actionResult, err := s.getActionResultFromCache(ctx, adInstanceDigest)
+		if err != nil && s.envPolicy != nil {
+			actionResult, err = s.getNormalizedActionResultFromCache(ctx, adInstanceDigest)
+		}
+		if err == nil {
 			executionID, err := digest.UploadResourceName(req.GetActionDigest(), req.GetInstanceName())
 			if err != nil {
 				return err
@@ -369,6 +537,59 @@ func (s *ExecutionServer) execute(req *repb.ExecuteRequest, stream streamLike) e
 	return s.waitExecution(&waitReq, stream, waitOpts{isExecuteRequest: true})
 }
 
+// PredictExecution predicts the outcome of executing an action without
+// executing it: whether it would be served from the action cache and, if not,
+// which executors would run it and how long it would likely be queued for.
+func (s *ExecutionServer) PredictExecution(ctx context.Context, req *espb.PredictExecutionRequest) (*espb.PredictExecutionResponse, error) {
+	scheduler := s.env.GetSchedulerService()
+	if scheduler == nil {
+		return nil, status.FailedPreconditionErrorf("No scheduler service configured")
+	}
+	if req.GetActionDigest().GetHash() == "" {
+		return nil, status.InvalidArgumentError("An action_digest is required")
+	}
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, s.env)
+	if err != nil {
+		return nil, err
+	}
+	adInstanceDigest := digest.NewInstanceNameDigest(req.GetActionDigest(), req.GetInstanceName())
+	action := &repb.Action{}
+	if err := cachetools.ReadProtoFromCAS(ctx, s.cache, adInstanceDigest, action); err != nil {
+		return nil, err
+	}
+	cmdInstanceDigest := digest.NewInstanceNameDigest(action.GetCommandDigest(), req.GetInstanceName())
+	command := &repb.Command{}
+	if err := cachetools.ReadProtoFromCAS(ctx, s.cache, cmdInstanceDigest, command); err != nil {
+		return nil, err
+	}
+
+	rsp := &espb.PredictExecutionResponse{
+		TaskSize: tasksize.Estimate(command),
+	}
+	if !req.GetSkipCacheLookup() {
+		_, err := s.getActionResultFromCache(ctx, adInstanceDigest)
+		if err != nil && s.envPolicy != nil && !action.GetDoNotCache() {
+			// Predictions are read-only, so the normalized action is only
+			// looked up, rather than stored in the CAS like when executing.
+			nd, _, nerr := s.envPolicy.ComputeNormalizedActionDigest(req.GetInstanceName(), action, command)
+			if nerr == nil && nd != nil {
+				_, err = s.getActionResultFromCache(ctx, nd)
+			}
+		}
+		rsp.CacheHit = err == nil
+	}
+
+	metadata, err := s.schedulingMetadata(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+	rsp.Scheduling, err = scheduler.PredictScheduling(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
 // WaitExecution waits for an execution operation to complete. When the client initially
 // makes the request, the server immediately responds with the current status
 // of the execution. The server will leave the request stream open until the
@@ -431,15 +652,13 @@ type waitOpts struct {
 }
 
 func (s *ExecutionServer) getGroupIDForMetrics(ctx context.Context) string {
-	if a := s.env.GetAuthenticator(); a != nil {
-		user, err := a.AuthenticatedUser(ctx)
-		if err != nil {
-			log.Warningf("Could not determine groupID for metrics: %s", err)
-			return "unknown"
-		}
-		return user.GetGroupID()
+	if s.env.GetAuthenticator() == nil {
+		return ""
+	}
+	if groupID := request_info.FromContext(ctx).GroupID; groupID != "" {
+		return groupID
 	}
-	return ""
+	return "unknown"
 }
 
 func (s *ExecutionServer) waitExecution(req *repb.WaitExecutionRequest, stream streamLike, opts waitOpts) error {
@@ -525,6 +744,7 @@ func (s *ExecutionServer) PublishOperation(stream repb.Execution_PublishOperatio
 	lastWrite := time.Now()
 	taskID := ""
 	stage := repb.ExecutionStage_UNKNOWN
+	progress := &executionProgressTracker{env: s.env}
 	mu := sync.Mutex{}
 	// 80% of executions take < 10 seconds in total. So here, we delay
 	// writes to the database if pubsub.Publish is successful, in an
@@ -554,6 +774,10 @@ func (s *ExecutionServer) PublishOperation(stream repb.Execution_PublishOperatio
 			return err
 		}
 
+		// Let clients waiting on the execution know how much longer it is
+		// likely to take.
+		progress.update(ctx, op)
+
 		mu.Lock()
 		lastOp = op
 		taskID = op.GetName()
@@ -572,6 +796,9 @@ func (s *ExecutionServer) PublishOperation(stream repb.Execution_PublishOperatio
 					// Errors from updating the router should not be fatal.
 					log.Errorf("Failed to update task router for task %s: %s", taskID, err)
 				}
+				if err := s.cacheNormalizedActionResult(ctx, taskID, response); err != nil {
+					log.Warningf("Failed to cache normalized action result for task %s: %s", taskID, err)
+				}
 			}
 		}
 
@@ -603,6 +830,28 @@ func (s *ExecutionServer) PublishOperation(stream repb.Execution_PublishOperatio
 	}
 }
 
+// MarkExecutionFailed completes the given execution with the given error and
+// publishes the result to any clients waiting on it. It is used when an
+// execution fails before reaching an executor.
+func (s *ExecutionServer) MarkExecutionFailed(ctx context.Context, executionID string, reason error) error {
+	instanceName, d, err := digest.ExtractDigestFromUploadResourceName(executionID)
+	if err != nil {
+		return err
+	}
+	op, err := operation.AssembleFailed(repb.ExecutionStage_COMPLETED, executionID, digest.NewInstanceNameDigest(d, instanceName), reason)
+	if err != nil {
+		return err
+	}
+	data, err := proto.Marshal(op)
+	if err != nil {
+		return err
+	}
+	if err := s.streamPubSub.Publish(ctx, redisKeyForTaskStatusStream(executionID), base64.StdEncoding.EncodeToString(data)); err != nil {
+		return status.InternalErrorf("Error publishing task %q on stream pubsub: %s", executionID, err)
+	}
+	return s.updateExecution(ctx, executionID, repb.ExecutionStage_COMPLETED, op)
+}
+
 func (s *ExecutionServer) updateRouter(ctx context.Context, taskID string, executeResponse *repb.ExecuteResponse) error {
 	router := s.env.GetTaskRouter()
 	if router == nil {
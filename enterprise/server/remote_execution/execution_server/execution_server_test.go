@@ -0,0 +1,126 @@
+package execution_server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/envpolicy"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+// predictingScheduler returns a fixed prediction, recording the scheduling
+// metadata that it was asked to predict.
+type predictingScheduler struct {
+	*fakeScheduler
+	prediction *scpb.SchedulingPrediction
+	metadata   []*scpb.SchedulingMetadata
+}
+
+func (s *predictingScheduler) PredictScheduling(ctx context.Context, metadata *scpb.SchedulingMetadata) (*scpb.SchedulingPrediction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metadata = append(s.metadata, metadata)
+	return s.prediction, nil
+}
+
+func getPredictionEnv(t *testing.T) (*testenv.TestEnv, *ExecutionServer, *predictingScheduler) {
+	te, s, fake := getCacheWarmingEnv(t)
+	scheduler := &predictingScheduler{
+		fakeScheduler: fake,
+		prediction: &scpb.SchedulingPrediction{
+			Pool: []*scpb.SchedulingPrediction_Pool{{Os: "linux", Arch: "amd64", ExecutorCount: 2}},
+		},
+	}
+	te.SetSchedulerService(scheduler)
+	policy, err := envpolicy.New([]config.EnvNormalizationConfig{{Name: "TMPDIR", Action: "strip"}})
+	require.NoError(t, err)
+	s.envPolicy = policy
+	return te, s, scheduler
+}
+
+func predict(ctx context.Context, t *testing.T, s *ExecutionServer, d *repb.Digest, skipCacheLookup bool) *espb.PredictExecutionResponse {
+	rsp, err := s.PredictExecution(ctx, &espb.PredictExecutionRequest{
+		InstanceName:    testInstanceName,
+		ActionDigest:    d,
+		SkipCacheLookup: skipCacheLookup,
+	})
+	require.NoError(t, err)
+	return rsp
+}
+
+func cacheResult(ctx context.Context, t *testing.T, te *testenv.TestEnv, d *repb.Digest) {
+	result, err := proto.Marshal(&repb.ActionResult{})
+	require.NoError(t, err)
+	require.NoError(t, namespace.ActionCache(te.GetCache(), testInstanceName).Set(ctx, d, result))
+}
+
+func TestPredictExecution(t *testing.T) {
+	te, s, scheduler := getPredictionEnv(t)
+	ctx := groupContext(t, te)
+	cmd := &repb.Command{
+		Arguments: []string{"echo", "hello"},
+		Platform: &repb.Platform{Properties: []*repb.Platform_Property{
+			{Name: "OSFamily", Value: "linux"},
+		}},
+	}
+	d := uploadProto(ctx, t, te, &repb.Action{CommandDigest: uploadProto(ctx, t, te, cmd)})
+
+	rsp := predict(ctx, t, s, d, false)
+
+	assert.False(t, rsp.GetCacheHit())
+	assert.NotNil(t, rsp.GetTaskSize())
+	assert.True(t, proto.Equal(scheduler.prediction, rsp.GetScheduling()), "unexpected prediction %+v", rsp.GetScheduling())
+	require.Len(t, scheduler.metadata, 1)
+	assert.Equal(t, "linux", scheduler.metadata[0].GetOs())
+	assert.Equal(t, "GR1", scheduler.metadata[0].GetGroupId())
+	// Nothing is scheduled.
+	assert.Empty(t, scheduler.scheduledActions(t))
+
+	cacheResult(ctx, t, te, d)
+	assert.True(t, predict(ctx, t, s, d, false).GetCacheHit())
+	assert.False(t, predict(ctx, t, s, d, true).GetCacheHit())
+}
+
+func TestPredictExecution_NormalizedActionCached(t *testing.T) {
+	te, s, _ := getPredictionEnv(t)
+	ctx := groupContext(t, te)
+	cmd := &repb.Command{
+		Arguments: []string{"echo", "hello"},
+		EnvironmentVariables: []*repb.Command_EnvironmentVariable{
+			{Name: "TMPDIR", Value: "/tmp/abc"},
+		},
+	}
+	action := &repb.Action{CommandDigest: uploadProto(ctx, t, te, cmd)}
+	d := uploadProto(ctx, t, te, action)
+	nd, _, err := s.envPolicy.ComputeNormalizedActionDigest(testInstanceName, action, cmd)
+	require.NoError(t, err)
+	require.NotNil(t, nd)
+
+	assert.False(t, predict(ctx, t, s, d, false).GetCacheHit())
+
+	// A result cached for the normalized action is a hit.
+	cacheResult(ctx, t, te, nd.Digest)
+	assert.True(t, predict(ctx, t, s, d, false).GetCacheHit())
+
+	// Predicting doesn't store the normalized action in the CAS.
+	exists, err := namespace.CASCache(te.GetCache(), testInstanceName).Contains(ctx, nd.Digest)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// Normalized results aren't used for actions that may not be cached.
+	action.DoNotCache = true
+	d = uploadProto(ctx, t, te, action)
+	nd, _, err = s.envPolicy.ComputeNormalizedActionDigest(testInstanceName, action, cmd)
+	require.NoError(t, err)
+	cacheResult(ctx, t, te, nd.Digest)
+	assert.False(t, predict(ctx, t, s, d, false).GetCacheHit())
+}
@@ -0,0 +1,103 @@
+package execution_server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/lru"
+	"github.com/buildbuddy-io/buildbuddy/server/util/platform_policy"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/prometheus/client_golang/prometheus"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	// How long a group's platform property policy is cached for. Changes to
+	// the policy take up to this long to apply to new executions.
+	platformPolicyCacheTTL = 1 * time.Minute
+	// The maximum number of groups whose platform property policy is cached.
+	platformPolicyCacheSize = 10000
+)
+
+type platformPolicyCacheEntry struct {
+	policy       *platform_policy.Policy
+	expiresAfter time.Time
+}
+
+// platformPolicyCache caches the platform property policies of groups, so that
+// the group doesn't need to be looked up for every execution. Every entry has
+// a hard expiration time to pick up policy changes.
+type platformPolicyCache struct {
+	env environment.Env
+	lru *lru.LRU
+	mu  sync.Mutex
+}
+
+func newPlatformPolicyCache(env environment.Env) (*platformPolicyCache, error) {
+	l, err := lru.NewLRU(&lru.Config{
+		MaxSize: platformPolicyCacheSize,
+		SizeFn:  func(k, v interface{}) int64 { return 1 },
+	})
+	if err != nil {
+		return nil, status.InternalErrorf("error initializing platform policy cache: %s", err)
+	}
+	return &platformPolicyCache{env: env, lru: l}, nil
+}
+
+// get returns the platform property policy of the given group, or nil if it
+// has none.
+func (c *platformPolicyCache) get(ctx context.Context, groupID string) (*platform_policy.Policy, error) {
+	c.mu.Lock()
+	v, ok := c.lru.Get(groupID)
+	c.mu.Unlock()
+	if entry, isEntry := v.(*platformPolicyCacheEntry); ok && isEntry && time.Now().Before(entry.expiresAfter) {
+		return entry.policy, nil
+	}
+
+	group, err := c.env.GetUserDB().GetGroupByID(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := platform_policy.New(group.DefaultPlatformProperties, group.ForcedPlatformProperties)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.lru.Add(groupID, &platformPolicyCacheEntry{policy: policy, expiresAfter: time.Now().Add(platformPolicyCacheTTL)})
+	c.mu.Unlock()
+	return policy, nil
+}
+
+// applyPlatformPolicy applies the platform property policy of the
+// authenticated user's group, if any, to the command of an execution. Values
+// set by the command which the policy overrides are logged so that they can
+// be audited.
+func (s *ExecutionServer) applyPlatformPolicy(ctx context.Context, executionID string, command *repb.Command) error {
+	if s.platformPolicies == nil || s.env.GetAuthenticator() == nil {
+		return nil
+	}
+	u, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil || u.GetGroupID() == "" {
+		// Anonymous executions don't belong to a group with a policy.
+		return nil
+	}
+	policy, err := s.platformPolicies.get(ctx, u.GetGroupID())
+	if err != nil {
+		return status.UnavailableErrorf("Could not look up platform property policy: %s", err)
+	}
+	platform, overrides := policy.Apply(command.GetPlatform())
+	command.Platform = platform
+	for _, o := range overrides {
+		log.Infof("Platform property policy of group %s overrode %s=%q with %q for execution %q", u.GetGroupID(), o.Name, o.OldValue, o.NewValue, executionID)
+		metrics.RemoteExecutionPlatformPropertyOverrideCount.With(prometheus.Labels{
+			metrics.GroupID:               u.GetGroupID(),
+			metrics.PlatformPropertyLabel: o.Name,
+		}).Inc()
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package execution_server
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/operation"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	// How often to check for stale executions.
+	staleExecutionCheckInterval = 1 * time.Minute
+	// Maximum number of stale executions failed by a single check, so that a
+	// large backlog is worked off gradually.
+	maxStaleExecutionsPerCheck = 100
+)
+
+// StaleExecutionReason is the ErrorInfo reason for executions which were
+// failed because they didn't complete or report progress within the stale
+// execution timeout.
+const StaleExecutionReason = "STALE_EXECUTION"
+
+func (s *ExecutionServer) startStaleExecutionReaper(timeout time.Duration) {
+	shuttingDown := make(chan struct{})
+	s.env.GetHealthChecker().RegisterShutdownFunction(func(ctx context.Context) error {
+		close(shuttingDown)
+		return nil
+	})
+	go func() {
+		for {
+			select {
+			case <-shuttingDown:
+				return
+			case <-time.After(staleExecutionCheckInterval):
+				s.failStaleExecutions(context.Background(), timeout)
+			}
+		}
+	}()
+}
+
+// failStaleExecutions fails executions which haven't completed and haven't
+// been updated within the given timeout. Such executions are typically left
+// behind when the app or executor handling them goes away without reporting a
+// result, and would otherwise never complete.
+func (s *ExecutionServer) failStaleExecutions(ctx context.Context, timeout time.Duration) {
+	dbh := s.env.GetDBHandle()
+	if dbh == nil {
+		return
+	}
+	now := s.env.GetClock().Now()
+	var stale []*tables.Execution
+	err := dbh.WithContext(ctx).
+		Where("stage < ? AND updated_at_usec < ?", int64(repb.ExecutionStage_COMPLETED), timeutil.ToUsec(now.Add(-timeout))).
+		Order("updated_at_usec ASC").
+		Limit(maxStaleExecutionsPerCheck).
+		Find(&stale).Error
+	if err != nil {
+		log.Warningf("Could not fetch stale executions: %s", err)
+		return
+	}
+	for _, e := range stale {
+		if err := s.failStaleExecution(ctx, e, now); err != nil {
+			log.Warningf("Could not fail stale execution %q: %s", e.ExecutionID, err)
+		}
+	}
+}
+
+// failStaleExecution fails an execution that was found to be stale, notifying
+// any clients still waiting on it. The execution is failed with a single
+// conditional update, which only applies if the execution is still in the
+// stage and at the update time that it was found with. So an execution that
+// made progress or completed since it was found isn't failed, and only one
+// app fails each execution.
+func (s *ExecutionServer) failStaleExecution(ctx context.Context, e *tables.Execution, now time.Time) error {
+	stage := repb.ExecutionStage_Value(e.Stage)
+	lastUpdate := now.Sub(timeutil.FromUsec(e.UpdatedAtUsec)).Round(time.Second)
+	staleErr := status.UnavailableErrorf(
+		"Execution %q was in stage %s but did not complete or report progress for %s. "+
+			"The app or executor handling it may have been restarted.",
+		e.ExecutionID, stage, lastUpdate)
+	staleErr = status.WithErrorInfo(staleErr, StaleExecutionReason, map[string]string{
+		"stage":       stage.String(),
+		"last_update": lastUpdate.String(),
+	})
+
+	instanceName, d, err := digest.ExtractDigestFromUploadResourceName(e.ExecutionID)
+	if err != nil {
+		return err
+	}
+	op, err := operation.AssembleFailed(repb.ExecutionStage_COMPLETED, e.ExecutionID, digest.NewInstanceNameDigest(d, instanceName), staleErr)
+	if err != nil {
+		return err
+	}
+	st := operation.ExtractExecuteResponse(op).GetStatus()
+	columns := map[string]interface{}{
+		"stage":           int64(repb.ExecutionStage_COMPLETED),
+		"status_code":     st.GetCode(),
+		"status_message":  trimStatus(st.GetMessage()),
+		"updated_at_usec": timeutil.ToUsec(now),
+	}
+	if len(st.GetDetails()) > 0 {
+		if details, err := proto.Marshal(st.GetDetails()[0]); err == nil {
+			columns["serialized_status_details"] = details
+		}
+	}
+	res := s.env.GetDBHandle().WithContext(ctx).Model(&tables.Execution{}).
+		Where("execution_id = ? AND stage = ? AND updated_at_usec = ?", e.ExecutionID, e.Stage, e.UpdatedAtUsec).
+		UpdateColumns(columns)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		// Updated in the meantime.
+		return nil
+	}
+
+	log.Warningf("Failing stale execution: %s", staleErr)
+	metrics.RemoteExecutionStaleExecutionCount.With(prometheus.Labels{
+		metrics.GroupID:             e.GroupID,
+		metrics.ExecutionStageLabel: strings.ToLower(stage.String()),
+	}).Inc()
+	data, err := proto.Marshal(op)
+	if err != nil {
+		return err
+	}
+	if err := s.streamPubSub.Publish(ctx, redisKeyForTaskStatusStream(e.ExecutionID), base64.StdEncoding.EncodeToString(data)); err != nil {
+		return status.InternalErrorf("Error publishing task %q on stream pubsub: %s", e.ExecutionID, err)
+	}
+	return nil
+}
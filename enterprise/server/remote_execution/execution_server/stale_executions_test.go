@@ -0,0 +1,134 @@
+package execution_server
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/pubsub"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/operation"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/testredis"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/fakeclock"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	gstatus "google.golang.org/grpc/status"
+)
+
+const staleExecutionTimeout = time.Hour
+
+func getStaleExecutionEnv(t *testing.T) (*testenv.TestEnv, *ExecutionServer, *fakeclock.FakeClock) {
+	te := enterprise_testenv.GetCustomTestEnv(t, &enterprise_testenv.Options{
+		RedisTarget: testredis.Start(t),
+	})
+	clock := fakeclock.New(time.Now())
+	te.SetClock(clock)
+	s := &ExecutionServer{env: te, streamPubSub: pubsub.NewStreamPubSub(te.GetRemoteExecutionRedisPubSubClient())}
+	return te, s, clock
+}
+
+func createExecution(t *testing.T, te *testenv.TestEnv, hash string, stage repb.ExecutionStage_Value) string {
+	id, err := digest.UploadResourceName(&repb.Digest{Hash: strings.Repeat(hash, 64), SizeBytes: 1}, testInstanceName)
+	require.NoError(t, err)
+	err = te.GetDBHandle().Create(&tables.Execution{ExecutionID: id, GroupID: "GR1", Stage: int64(stage)}).Error
+	require.NoError(t, err)
+	return id
+}
+
+func getExecution(t *testing.T, te *testenv.TestEnv, id string) *tables.Execution {
+	e := &tables.Execution{}
+	require.NoError(t, te.GetDBHandle().Where("execution_id = ?", id).Take(e).Error)
+	return e
+}
+
+// reportProgress records that the execution was updated at the given time.
+func reportProgress(t *testing.T, te *testenv.TestEnv, id string, at time.Time) {
+	err := te.GetDBHandle().Model(&tables.Execution{}).Where("execution_id = ?", id).UpdateColumn("updated_at_usec", timeutil.ToUsec(at)).Error
+	require.NoError(t, err)
+}
+
+func TestFailStaleExecutions(t *testing.T) {
+	te, s, clock := getStaleExecutionEnv(t)
+	ctx := context.Background()
+	queued := createExecution(t, te, "a", repb.ExecutionStage_QUEUED)
+	executing := createExecution(t, te, "b", repb.ExecutionStage_EXECUTING)
+	completed := createExecution(t, te, "c", repb.ExecutionStage_COMPLETED)
+	subscriber := s.streamPubSub.SubscribeHead(ctx, redisKeyForTaskStatusStream(queued))
+	defer subscriber.Close()
+
+	// Nothing is stale before the timeout.
+	s.failStaleExecutions(ctx, staleExecutionTimeout)
+	assert.Equal(t, int64(repb.ExecutionStage_QUEUED), getExecution(t, te, queued).Stage)
+
+	// The executing execution keeps reporting progress.
+	clock.Advance(staleExecutionTimeout + time.Minute)
+	reportProgress(t, te, executing, clock.Now())
+	s.failStaleExecutions(ctx, staleExecutionTimeout)
+
+	e := getExecution(t, te, queued)
+	assert.Equal(t, int64(repb.ExecutionStage_COMPLETED), e.Stage)
+	assert.Equal(t, int32(codes.Unavailable), e.StatusCode)
+	assert.Contains(t, e.StatusMessage, "did not complete or report progress")
+	assert.NotEmpty(t, e.SerializedStatusDetails)
+	assert.Equal(t, int64(repb.ExecutionStage_EXECUTING), getExecution(t, te, executing).Stage)
+	assert.Equal(t, int32(0), getExecution(t, te, completed).StatusCode)
+
+	// Clients waiting on the failed execution are notified.
+	select {
+	case msg := <-subscriber.Chan():
+		op, err := operation.Decode(msg)
+		require.NoError(t, err)
+		assert.Equal(t, repb.ExecutionStage_COMPLETED, operation.ExtractStage(op))
+		err = gstatus.ErrorProto(operation.ExtractExecuteResponse(op).GetStatus())
+		assert.True(t, status.IsUnavailableError(err), "expected Unavailable, got %v", err)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for the failed operation")
+	}
+}
+
+func TestFailStaleExecution_UpdatedInTheMeantime(t *testing.T) {
+	te, s, clock := getStaleExecutionEnv(t)
+	ctx := context.Background()
+	id := createExecution(t, te, "a", repb.ExecutionStage_EXECUTING)
+	clock.Advance(staleExecutionTimeout + time.Minute)
+	stale := getExecution(t, te, id)
+
+	// The execution reports progress after it was found to be stale, but
+	// before it is failed.
+	reportProgress(t, te, id, clock.Now())
+	require.NoError(t, s.failStaleExecution(ctx, stale, clock.Now()))
+	e := getExecution(t, te, id)
+	assert.Equal(t, int64(repb.ExecutionStage_EXECUTING), e.Stage)
+	assert.Equal(t, int32(0), e.StatusCode)
+
+	// Likewise if it completed in the meantime, its result is kept.
+	stale = getExecution(t, te, id)
+	err := te.GetDBHandle().Model(&tables.Execution{}).Where("execution_id = ?", id).UpdateColumns(map[string]interface{}{
+		"stage":       int64(repb.ExecutionStage_COMPLETED),
+		"status_code": int32(codes.OK),
+	}).Error
+	require.NoError(t, err)
+	require.NoError(t, s.failStaleExecution(ctx, stale, clock.Now()))
+	e = getExecution(t, te, id)
+	assert.Equal(t, int64(repb.ExecutionStage_COMPLETED), e.Stage)
+	assert.Equal(t, int32(codes.OK), e.StatusCode)
+
+	// An execution can only be failed once, even if several apps find it.
+	id = createExecution(t, te, "b", repb.ExecutionStage_QUEUED)
+	clock.Advance(staleExecutionTimeout + time.Minute)
+	stale = getExecution(t, te, id)
+	require.NoError(t, s.failStaleExecution(ctx, stale, clock.Now()))
+	failedAt := getExecution(t, te, id).UpdatedAtUsec
+	clock.Advance(time.Minute)
+	require.NoError(t, s.failStaleExecution(ctx, stale, clock.Now()))
+	assert.Equal(t, failedAt, getExecution(t, te, id).UpdatedAtUsec)
+}
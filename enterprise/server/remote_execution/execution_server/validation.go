@@ -0,0 +1,149 @@
+package execution_server
+
+import (
+	"context"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/prometheus/client_golang/prometheus"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+// The reasons that Execute requests are rejected for, as reported by the
+// rejected_execute_request_count metric.
+const (
+	invalidActionDigestReason    = "invalid_action_digest"
+	missingActionReason          = "missing_action"
+	malformedActionReason        = "malformed_action"
+	invalidCommandDigestReason   = "invalid_command_digest"
+	missingCommandReason         = "missing_command"
+	malformedCommandReason       = "malformed_command"
+	emptyCommandReason           = "empty_command"
+	invalidInputRootDigestReason = "invalid_input_root_digest"
+	invalidPlatformReason        = "invalid_platform"
+	invalidTimeoutReason         = "invalid_timeout"
+)
+
+// requestRejection is an error rejecting an Execute request, along with the
+// reason it's counted under.
+type requestRejection struct {
+	reason string
+	err    error
+}
+
+func reject(reason string, err error) *requestRejection {
+	return &requestRejection{reason: reason, err: err}
+}
+
+// validateExecuteRequest fetches the action and command of an Execute request
+// and checks that they can be executed, so that malformed requests fail fast
+// rather than after being queued and picked up by an executor. Blobs which
+// are missing from the CAS are reported with FailedPrecondition errors, so that
+// clients upload them and retry, and anything malformed with InvalidArgument
+// errors.
+func (s *ExecutionServer) validateExecuteRequest(ctx context.Context, req *repb.ExecuteRequest) (*repb.Action, *repb.Command, error) {
+	action, command, rejection := s.checkExecuteRequest(ctx, req)
+	if rejection == nil {
+		return action, command, nil
+	}
+	// Errors reading from the cache aren't the request's fault.
+	if rejection.reason != "" {
+		metrics.RemoteExecutionRejectedExecuteRequestCount.With(prometheus.Labels{
+			metrics.GroupID:                s.getGroupIDForMetrics(ctx),
+			metrics.ExecuteRejectionReason: rejection.reason,
+		}).Inc()
+		log.Infof("Rejected Execute request for action %s/%d (%s): %s", req.GetActionDigest().GetHash(), req.GetActionDigest().GetSizeBytes(), rejection.reason, rejection.err)
+	}
+	return nil, nil, rejection.err
+}
+
+func (s *ExecutionServer) checkExecuteRequest(ctx context.Context, req *repb.ExecuteRequest) (*repb.Action, *repb.Command, *requestRejection) {
+	if _, err := digest.Validate(req.GetActionDigest()); err != nil {
+		return nil, nil, reject(invalidActionDigestReason, status.WrapError(err, "Invalid action digest"))
+	}
+	action := &repb.Action{}
+	if err := s.readProtoFromCAS(ctx, req.GetInstanceName(), req.GetActionDigest(), action); err != nil {
+		return nil, nil, readRejection(err, missingActionReason, malformedActionReason)
+	}
+
+	if _, err := digest.Validate(action.GetCommandDigest()); err != nil {
+		return nil, nil, reject(invalidCommandDigestReason, status.WrapError(err, "Invalid command digest"))
+	}
+	if _, err := digest.Validate(action.GetInputRootDigest()); err != nil {
+		return nil, nil, reject(invalidInputRootDigestReason, status.WrapError(err, "Invalid input root digest"))
+	}
+	if action.GetTimeout() != nil {
+		timeout, err := ptypes.Duration(action.GetTimeout())
+		if err != nil || timeout < 0 {
+			return nil, nil, reject(invalidTimeoutReason, status.InvalidArgumentErrorf("Invalid action timeout %s", proto.CompactTextString(action.GetTimeout())))
+		}
+		if s.maxActionTimeout > 0 && timeout > s.maxActionTimeout {
+			return nil, nil, reject(invalidTimeoutReason, status.InvalidArgumentErrorf("Action timeout %s exceeds the maximum of %s", timeout, s.maxActionTimeout))
+		}
+	}
+
+	command := &repb.Command{}
+	if err := s.readProtoFromCAS(ctx, req.GetInstanceName(), action.GetCommandDigest(), command); err != nil {
+		return nil, nil, readRejection(err, missingCommandReason, malformedCommandReason)
+	}
+	if len(command.GetArguments()) == 0 || command.GetArguments()[0] == "" {
+		return nil, nil, reject(emptyCommandReason, status.InvalidArgumentError("Command has no arguments"))
+	}
+	if err := validatePlatform(command.GetPlatform()); err != nil {
+		return nil, nil, reject(invalidPlatformReason, err)
+	}
+	return action, command, nil
+}
+
+func readRejection(err error, missingReason, malformedReason string) *requestRejection {
+	switch {
+	case status.IsFailedPreconditionError(err):
+		return reject(missingReason, err)
+	case status.IsInvalidArgumentError(err):
+		return reject(malformedReason, err)
+	default:
+		return &requestRejection{err: err}
+	}
+}
+
+// readProtoFromCAS reads a proto from the CAS of the given instance,
+// returning a FailedPrecondition error if it's missing, and an
+// InvalidArgument error if it can't be parsed.
+func (s *ExecutionServer) readProtoFromCAS(ctx context.Context, instanceName string, d *repb.Digest, out proto.Message) error {
+	data, err := namespace.CASCache(s.cache, instanceName).Get(ctx, d)
+	if err != nil {
+		if status.IsNotFoundError(err) {
+			return digest.MissingDigestError(d)
+		}
+		return err
+	}
+	if err := proto.Unmarshal(data, out); err != nil {
+		return status.InvalidArgumentErrorf("%s %s/%d could not be parsed: %s", proto.MessageName(out), d.GetHash(), d.GetSizeBytes(), err)
+	}
+	return nil
+}
+
+// validatePlatform checks that the platform's properties are well-formed: as
+// required by the remote execution API, each property must be named, and may
+// only be set once.
+func validatePlatform(plat *repb.Platform) error {
+	seen := make(map[string]bool, len(plat.GetProperties()))
+	for _, prop := range plat.GetProperties() {
+		if prop.GetName() == "" {
+			return status.InvalidArgumentErrorf("Platform property with value %q has no name", prop.GetValue())
+		}
+		if seen[prop.GetName()] {
+			return status.InvalidArgumentErrorf("Platform property %q is set more than once", prop.GetName())
+		}
+		seen[prop.GetName()] = true
+	}
+	_, err := platform.ParseRequirements(plat)
+	return err
+}
@@ -0,0 +1,96 @@
+package execution_server
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const testInstanceName = "test"
+
+func uploadProto(ctx context.Context, t *testing.T, te *testenv.TestEnv, msg proto.Message) *repb.Digest {
+	data, err := proto.Marshal(msg)
+	require.NoError(t, err)
+	return uploadBytes(ctx, t, te, data)
+}
+
+func uploadBytes(ctx context.Context, t *testing.T, te *testenv.TestEnv, data []byte) *repb.Digest {
+	d, err := digest.Compute(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.NoError(t, namespace.CASCache(te.GetCache(), testInstanceName).Set(ctx, d, data))
+	return d
+}
+
+func TestValidateExecuteRequest(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")))
+	ctx, err := te.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+	ctx, err = prefix.AttachUserPrefixToContext(ctx, te)
+	require.NoError(t, err)
+	s := &ExecutionServer{env: te, cache: te.GetCache(), maxActionTimeout: time.Hour}
+	inputRoot := uploadProto(ctx, t, te, &repb.Directory{})
+	validCommand := &repb.Command{
+		Arguments: []string{"echo", "hello"},
+		Platform: &repb.Platform{Properties: []*repb.Platform_Property{
+			{Name: "OSFamily", Value: "linux"},
+		}},
+	}
+	missing := &repb.Digest{Hash: "0000000000000000000000000000000000000000000000000000000000000001", SizeBytes: 10}
+	malformed := uploadBytes(ctx, t, te, []byte{0xff, 0xff, 0xff})
+
+	action := func(command *repb.Command, mutate func(a *repb.Action)) *repb.Digest {
+		a := &repb.Action{CommandDigest: uploadProto(ctx, t, te, command), InputRootDigest: inputRoot}
+		if mutate != nil {
+			mutate(a)
+		}
+		return uploadProto(ctx, t, te, a)
+	}
+	validate := func(actionDigest *repb.Digest) error {
+		_, _, err := s.validateExecuteRequest(ctx, &repb.ExecuteRequest{InstanceName: testInstanceName, ActionDigest: actionDigest})
+		return err
+	}
+
+	a, c, err := s.validateExecuteRequest(ctx, &repb.ExecuteRequest{InstanceName: testInstanceName, ActionDigest: action(validCommand, nil)})
+	require.NoError(t, err)
+	assert.Equal(t, inputRoot.GetHash(), a.GetInputRootDigest().GetHash())
+	assert.Equal(t, []string{"echo", "hello"}, c.GetArguments())
+
+	// Missing blobs are reported so that clients upload them.
+	err = validate(missing)
+	assert.True(t, status.IsFailedPreconditionError(err), "missing action: %v", err)
+	err = validate(uploadProto(ctx, t, te, &repb.Action{CommandDigest: missing, InputRootDigest: inputRoot}))
+	assert.True(t, status.IsFailedPreconditionError(err), "missing command: %v", err)
+
+	for name, actionDigest := range map[string]*repb.Digest{
+		"nil action digest":      nil,
+		"invalid action digest":  {Hash: "abc", SizeBytes: 1},
+		"malformed action":       malformed,
+		"malformed command":      uploadProto(ctx, t, te, &repb.Action{CommandDigest: malformed, InputRootDigest: inputRoot}),
+		"missing command digest": uploadProto(ctx, t, te, &repb.Action{InputRootDigest: inputRoot}),
+		"missing input root":     action(validCommand, func(a *repb.Action) { a.InputRootDigest = nil }),
+		"empty command":          action(&repb.Command{}, nil),
+		"negative timeout":       action(validCommand, func(a *repb.Action) { a.Timeout = ptypes.DurationProto(-time.Second) }),
+		"timeout over the limit": action(validCommand, func(a *repb.Action) { a.Timeout = ptypes.DurationProto(2 * time.Hour) }),
+		"unnamed property":       action(&repb.Command{Arguments: []string{"true"}, Platform: &repb.Platform{Properties: []*repb.Platform_Property{{Value: "x"}}}}, nil),
+		"duplicate property":     action(&repb.Command{Arguments: []string{"true"}, Platform: &repb.Platform{Properties: []*repb.Platform_Property{{Name: "Pool", Value: "a"}, {Name: "Pool", Value: "b"}}}}, nil),
+		"malformed requirement":  action(&repb.Command{Arguments: []string{"true"}, Platform: &repb.Platform{Properties: []*repb.Platform_Property{{Name: "min-memory", Value: "lots"}}}}, nil),
+	} {
+		err := validate(actionDigest)
+		assert.True(t, status.IsInvalidArgumentError(err), "%s: expected InvalidArgument, got %v", name, err)
+	}
+}
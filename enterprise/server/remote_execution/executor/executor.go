@@ -7,13 +7,16 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/crashdump"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/operation"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/runner"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/action_result_signing"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/resources"
 	"github.com/buildbuddy-io/buildbuddy/server/util/background"
 	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
@@ -57,6 +60,10 @@ type Executor struct {
 	runnerPool *runner.Pool
 	id         string
 	name       string
+	signer     *action_result_signing.Signer
+	// crashCollector captures crash reports for crashed actions. Nil if crash
+	// dumps are not enabled.
+	crashCollector *crashdump.Collector
 }
 
 type Options struct {
@@ -88,12 +95,21 @@ func NewExecutor(env environment.Env, id string, options *Options) (*Executor, e
 		name:       name,
 		runnerPool: runnerPool,
 	}
+	s.crashCollector = crashdump.NewCollector(&executorConfig.CrashDumps, env.GetByteStreamClient())
+	if keyFile := executorConfig.ActionResultSigningKeyFile; keyFile != "" {
+		signer, err := action_result_signing.NewSigner(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.signer = signer
+	}
 	if hc := env.GetHealthChecker(); hc != nil {
 		hc.RegisterShutdownFunction(runnerPool.Shutdown)
 	} else {
 		return nil, status.FailedPreconditionError("Missing health checker in env")
 	}
 	go s.runnerPool.WarmupDefaultImage()
+	s.runnerPool.StartJanitor()
 	return s, nil
 }
 
@@ -101,6 +117,15 @@ func (s *Executor) Name() string {
 	return s.name
 }
 
+// MetricsLabels returns the pool and platform labels of the executor metrics
+// recorded by this process.
+func MetricsLabels() prometheus.Labels {
+	return prometheus.Labels{
+		metrics.ExecutorPoolLabel:     resources.GetPoolName(),
+		metrics.ExecutorPlatformLabel: resources.GetOS() + "/" + resources.GetArch(),
+	}
+}
+
 func diffTimestamps(startPb, endPb *tspb.Timestamp) time.Duration {
 	start, _ := ptypes.Timestamp(startPb)
 	end, _ := ptypes.Timestamp(endPb)
@@ -111,12 +136,12 @@ func diffTimestampsToProto(startPb, endPb *tspb.Timestamp) *durationpb.Duration
 	return ptypes.DurationProto(diffTimestamps(startPb, endPb))
 }
 
-func logActionResult(taskID string, md *repb.ExecutedActionMetadata) {
+func logActionResult(ctx context.Context, taskID string, md *repb.ExecutedActionMetadata) {
 	workTime := diffTimestamps(md.GetWorkerStartTimestamp(), md.GetWorkerCompletedTimestamp())
 	fetchTime := diffTimestamps(md.GetInputFetchStartTimestamp(), md.GetInputFetchCompletedTimestamp())
 	execTime := diffTimestamps(md.GetExecutionStartTimestamp(), md.GetExecutionCompletedTimestamp())
 	uploadTime := diffTimestamps(md.GetOutputUploadStartTimestamp(), md.GetOutputUploadCompletedTimestamp())
-	log.Debugf("%q completed action %q [work: %02dms, fetch: %02dms, exec: %02dms, upload: %02dms]",
+	log.CtxDebugf(ctx, "%q completed action %q [work: %02dms, fetch: %02dms, exec: %02dms, upload: %02dms]",
 		md.GetWorker(), taskID, workTime.Milliseconds(), fetchTime.Milliseconds(),
 		execTime.Milliseconds(), uploadTime.Milliseconds())
 }
@@ -153,7 +178,7 @@ func (s *Executor) ExecuteTaskAndStreamResults(task *repb.ExecutionTask, stream
 	taskID := task.GetExecutionId()
 	adInstanceDigest := digest.NewInstanceNameDigest(req.GetActionDigest(), req.GetInstanceName())
 
-	ctx := stream.Context()
+	ctx := log.WithScope(stream.Context(), taskID, task.GetInvocationId())
 	acClient := s.env.GetActionCacheClient()
 
 	stateChangeFn := operation.GetStateChangeFunc(stream, taskID, adInstanceDigest)
@@ -235,15 +260,32 @@ func (s *Executor) ExecuteTaskAndStreamResults(task *repb.ExecutionTask, stream
 		}
 	}
 
+	crashReportDigest := s.captureCrashReport(ctx, taskID, r, req.GetInstanceName(), cmdResult)
+
 	// Only upload action outputs if the error is something that the client can
 	// use the action outputs to debug.
 	isActionableClientErr := gstatus.Code(cmdResult.Error) == codes.DeadlineExceeded
 	if cmdResult.Error != nil && !isActionableClientErr {
 		// These errors are failure-specific. Pass through unchanged.
 		log.Warningf("Task %q command finished with error: %s", taskID, cmdResult.Error)
+		if crashReportDigest != nil {
+			// Send the crash report along with the error so that it is
+			// referenced from the execution.
+			md.ExecutionCompletedTimestamp = ptypes.TimestampNow()
+			md.WorkerCompletedTimestamp = ptypes.TimestampNow()
+			rsp := operation.ExecuteResponseWithResult(nil, &espb.ExecutionSummary{
+				ExecutedActionMetadata: md,
+				CrashReportDigest:      crashReportDigest,
+			}, codes.OK)
+			rsp.Status = gstatus.Convert(cmdResult.Error).Proto()
+			if err := stateChangeFn(repb.ExecutionStage_COMPLETED, rsp); err != nil {
+				return err // CHECK (these errors should not happen).
+			}
+			return cmdResult.Error
+		}
 		return finishWithErrFn(cmdResult.Error)
 	} else {
-		log.Infof("Task %q command finished with error: %v", taskID, cmdResult.Error)
+		log.CtxInfof(ctx, "Task %q command finished with error: %v", taskID, cmdResult.Error)
 	}
 
 	ctx, cancel = background.ExtendContextForFinalization(ctx, uploadDeadlineExtension)
@@ -262,6 +304,11 @@ func (s *Executor) ExecuteTaskAndStreamResults(task *repb.ExecutionTask, stream
 	md.OutputUploadCompletedTimestamp = ptypes.TimestampNow()
 	md.WorkerCompletedTimestamp = ptypes.TimestampNow()
 	actionResult.ExecutionMetadata = md
+	if s.signer != nil {
+		if err := s.signer.Sign(adInstanceDigest.Digest, actionResult); err != nil {
+			return finishWithErrFn(status.InternalErrorf("Error signing action result: %s", err.Error()))
+		}
+	}
 
 	if !task.GetAction().GetDoNotCache() {
 		if err := cachetools.UploadActionResult(ctx, acClient, adInstanceDigest, actionResult); err != nil {
@@ -296,16 +343,42 @@ func (s *Executor) ExecuteTaskAndStreamResults(task *repb.ExecutionTask, stream
 			FileUploadDurationUsec: txInfo.TransferDuration.Microseconds(),
 		},
 		ExecutedActionMetadata: md,
+		CrashReportDigest:      crashReportDigest,
 	}
 	code := gstatus.Code(cmdResult.Error)
 	if err := stateChangeFn(repb.ExecutionStage_COMPLETED, operation.ExecuteResponseWithResult(actionResult, execSummary, code)); err != nil {
-		logActionResult(taskID, md)
+		logActionResult(ctx, taskID, md)
 		return finishWithErrFn(err) // CHECK (these errors should not happen).
 	}
 	finishedCleanly = true
 	return nil
 }
 
+// captureCrashReport uploads a crash report for the command if it crashed and
+// crash dumps are enabled, and returns the report's digest. Failing to capture
+// the report does not fail the task.
+func (s *Executor) captureCrashReport(ctx context.Context, taskID string, r *runner.CommandRunner, instanceName string, cmdResult *interfaces.CommandResult) *repb.Digest {
+	if s.crashCollector == nil {
+		return nil
+	}
+	crash := crashdump.DetectCrash(cmdResult)
+	if crash == nil {
+		return nil
+	}
+	log.CtxInfof(ctx, "Task %q crashed: %s", taskID, crash.Reason)
+	ctx, cancel := background.ExtendContextForFinalization(ctx, uploadDeadlineExtension)
+	defer cancel()
+	d, err := s.crashCollector.Capture(ctx, instanceName, r.Workspace.CommandWorkingDirectory(), cmdResult, crash)
+	if err != nil {
+		log.Warningf("Could not capture crash report for task %q: %s", taskID, err)
+		return nil
+	}
+	metrics.RemoteExecutionCrashReports.With(prometheus.Labels{
+		metrics.CrashSignalLabel: crash.Signal,
+	}).Inc()
+	return d
+}
+
 func observeStageDuration(stage string, start *timestamppb.Timestamp, end *timestamppb.Timestamp) {
 	startTime, err := ptypes.Timestamp(start)
 	if err != nil {
@@ -327,4 +400,7 @@ func observeStageDuration(stage string, start *timestamppb.Timestamp, end *times
 	metrics.RemoteExecutionExecutedActionMetadataDurationsUsec.With(prometheus.Labels{
 		metrics.ExecutedActionStageLabel: stage,
 	}).Observe(float64(duration / time.Microsecond))
+	labels := MetricsLabels()
+	labels[metrics.ExecutedActionStageLabel] = stage
+	metrics.ExecutorTaskStageDurationUsec.With(labels).Observe(float64(duration / time.Microsecond))
 }
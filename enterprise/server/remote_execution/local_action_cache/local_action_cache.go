@@ -0,0 +1,284 @@
+// Package local_action_cache caches action results on an executor, so that
+// actions which are executed over and over, such as tests that are retried
+// many times while bisecting a flake, don't each cost a lookup in the
+// central action cache.
+//
+// Cached results are only used for a limited time, after which they are
+// looked up in the central action cache again, and can optionally be
+// validated by checking that their outputs are still in the CAS.
+package local_action_cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/lru"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	defaultMaxSizeBytes = 100_000_000 // 100MB
+	defaultTTL          = 5 * time.Minute
+
+	hitEvent  = "hit"
+	missEvent = "miss"
+	// A cached result was found, but was expired or had missing outputs.
+	invalidEvent = "invalid"
+)
+
+// entry is a cached action result. Results cached on disk are read from
+// their file when they're used.
+type entry struct {
+	storedAt time.Time
+	size     int64
+	data     []byte
+}
+
+// ActionCacheClient is a repb.ActionCacheClient which looks up action results
+// in a local cache before the central action cache, and caches the
+// successful results that it gets from or uploads to the central action
+// cache.
+type ActionCacheClient struct {
+	repb.ActionCacheClient
+
+	casClient       repb.ContentAddressableStorageClient
+	clock           interfaces.Clock
+	ttl             time.Duration
+	dir             string
+	validateOutputs bool
+
+	mu  sync.Mutex
+	lru *lru.LRU
+}
+
+// New returns a client which caches the results of the given action cache
+// client. The CAS client is used to validate cached results, if configured.
+func New(c *config.LocalActionCacheConfig, clock interfaces.Clock, acClient repb.ActionCacheClient, casClient repb.ContentAddressableStorageClient) (*ActionCacheClient, error) {
+	maxSizeBytes := c.MaxSizeBytes
+	if maxSizeBytes == 0 {
+		maxSizeBytes = defaultMaxSizeBytes
+	}
+	ttl := defaultTTL
+	if c.TTLSeconds > 0 {
+		ttl = time.Duration(c.TTLSeconds) * time.Second
+	}
+	client := &ActionCacheClient{
+		ActionCacheClient: acClient,
+		casClient:         casClient,
+		clock:             clock,
+		ttl:               ttl,
+		dir:               c.Directory,
+		validateOutputs:   c.ValidateOutputs,
+	}
+	l, err := lru.NewLRU(&lru.Config{
+		MaxSize: maxSizeBytes,
+		SizeFn:  func(k, v interface{}) int64 { return v.(*entry).size },
+		OnEvict: client.onEvict,
+	})
+	if err != nil {
+		return nil, err
+	}
+	client.lru = l
+	if client.dir != "" {
+		if err := os.MkdirAll(client.dir, 0755); err != nil {
+			return nil, status.InternalErrorf("create local action cache directory: %s", err)
+		}
+		if err := client.loadFromDisk(); err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+func cacheKey(req *repb.GetActionResultRequest) string {
+	d := req.GetActionDigest()
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%d", req.GetInstanceName(), d.GetHash(), d.GetSizeBytes())))
+	return hex.EncodeToString(h[:])
+}
+
+func (c *ActionCacheClient) path(key string) string {
+	return filepath.Join(c.dir, key)
+}
+
+func (c *ActionCacheClient) onEvict(k, v interface{}) {
+	if c.dir == "" {
+		return
+	}
+	if err := os.Remove(c.path(k.(string))); err != nil && !os.IsNotExist(err) {
+		log.Warningf("Error removing locally cached action result: %s", err)
+	}
+}
+
+// loadFromDisk adds the results cached on disk by a previous run of the
+// executor, oldest first, so that the least recently stored are evicted
+// first.
+func (c *ActionCacheClient) loadFromDisk() error {
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return status.InternalErrorf("read local action cache directory: %s", err)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+	now := c.clock.Now()
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		if now.Sub(info.ModTime()) > c.ttl {
+			os.Remove(c.path(info.Name()))
+			continue
+		}
+		c.lru.Add(info.Name(), &entry{storedAt: info.ModTime(), size: info.Size()})
+	}
+	return nil
+}
+
+func (c *ActionCacheClient) lookup(key string) (*repb.ActionResult, error) {
+	c.mu.Lock()
+	v, ok := c.lru.Get(key)
+	c.mu.Unlock()
+	if !ok {
+		return nil, status.NotFoundError("not cached locally")
+	}
+	e := v.(*entry)
+	if c.clock.Now().Sub(e.storedAt) > c.ttl {
+		c.remove(key)
+		return nil, status.FailedPreconditionError("locally cached result expired")
+	}
+	data := e.data
+	if c.dir != "" {
+		var err error
+		if data, err = ioutil.ReadFile(c.path(key)); err != nil {
+			c.remove(key)
+			return nil, status.FailedPreconditionErrorf("read locally cached result: %s", err)
+		}
+	}
+	result := &repb.ActionResult{}
+	if err := proto.Unmarshal(data, result); err != nil {
+		c.remove(key)
+		return nil, status.FailedPreconditionErrorf("unmarshal locally cached result: %s", err)
+	}
+	return result, nil
+}
+
+func (c *ActionCacheClient) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Remove(key)
+}
+
+func (c *ActionCacheClient) store(key string, result *repb.ActionResult) {
+	// Failed actions may be flaky, so they're always run again.
+	if result.GetExitCode() != 0 {
+		return
+	}
+	data, err := proto.Marshal(result)
+	if err != nil {
+		return
+	}
+	e := &entry{storedAt: c.clock.Now(), size: int64(len(data))}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Replace rather than update any previous entry, so that the new entry
+	// is accounted for with its own size. This removes the previous entry's
+	// file, so the new one is written afterwards.
+	c.lru.Remove(key)
+	if c.dir != "" {
+		if err := ioutil.WriteFile(c.path(key), data, 0644); err != nil {
+			log.Warningf("Error caching action result locally: %s", err)
+			return
+		}
+	} else {
+		e.data = data
+	}
+	c.lru.Add(key, e)
+}
+
+// hasAllOutputs returns whether all of the outputs of the action result are
+// in the CAS.
+func (c *ActionCacheClient) hasAllOutputs(ctx context.Context, instanceName string, result *repb.ActionResult) (bool, error) {
+	req := &repb.FindMissingBlobsRequest{InstanceName: instanceName}
+	for _, f := range result.GetOutputFiles() {
+		req.BlobDigests = append(req.BlobDigests, f.GetDigest())
+	}
+	for _, d := range result.GetOutputDirectories() {
+		req.BlobDigests = append(req.BlobDigests, d.GetTreeDigest())
+	}
+	for _, d := range []*repb.Digest{result.GetStdoutDigest(), result.GetStderrDigest()} {
+		if d != nil {
+			req.BlobDigests = append(req.BlobDigests, d)
+		}
+	}
+	if len(req.BlobDigests) == 0 {
+		return true, nil
+	}
+	rsp, err := c.casClient.FindMissingBlobs(ctx, req)
+	if err != nil {
+		return false, err
+	}
+	return len(rsp.GetMissingBlobDigests()) == 0, nil
+}
+
+func recordEvent(eventType string) {
+	metrics.LocalActionCacheEvents.With(prometheus.Labels{
+		metrics.CacheEventTypeLabel: eventType,
+	}).Inc()
+}
+
+func (c *ActionCacheClient) GetActionResult(ctx context.Context, req *repb.GetActionResultRequest, opts ...grpc.CallOption) (*repb.ActionResult, error) {
+	key := cacheKey(req)
+	result, err := c.lookup(key)
+	if err == nil && c.validateOutputs {
+		ok, findErr := c.hasAllOutputs(ctx, req.GetInstanceName(), result)
+		if findErr != nil || !ok {
+			c.remove(key)
+			err = status.FailedPreconditionError("outputs of locally cached result are missing")
+		}
+	}
+	if err == nil {
+		recordEvent(hitEvent)
+		return result, nil
+	}
+	if status.IsNotFoundError(err) {
+		recordEvent(missEvent)
+	} else {
+		recordEvent(invalidEvent)
+	}
+
+	result, err = c.ActionCacheClient.GetActionResult(ctx, req, opts...)
+	if err != nil {
+		return nil, err
+	}
+	c.store(key, result)
+	return result, nil
+}
+
+func (c *ActionCacheClient) UpdateActionResult(ctx context.Context, req *repb.UpdateActionResultRequest, opts ...grpc.CallOption) (*repb.ActionResult, error) {
+	result, err := c.ActionCacheClient.UpdateActionResult(ctx, req, opts...)
+	if err != nil {
+		return nil, err
+	}
+	c.store(cacheKey(&repb.GetActionResultRequest{
+		InstanceName: req.GetInstanceName(),
+		ActionDigest: req.GetActionDigest(),
+	}), req.GetActionResult())
+	return result, nil
+}
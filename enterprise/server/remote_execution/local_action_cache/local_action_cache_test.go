@@ -0,0 +1,163 @@
+package local_action_cache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/local_action_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/fakeclock"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+// fakeActionCache is an action cache holding results by action hash, which
+// counts the lookups that reach it.
+type fakeActionCache struct {
+	repb.ActionCacheClient
+	results map[string]*repb.ActionResult
+	lookups int
+}
+
+func (f *fakeActionCache) GetActionResult(ctx context.Context, req *repb.GetActionResultRequest, opts ...grpc.CallOption) (*repb.ActionResult, error) {
+	f.lookups++
+	if r, ok := f.results[req.GetActionDigest().GetHash()]; ok {
+		return r, nil
+	}
+	return nil, status.NotFoundError("not found")
+}
+
+func (f *fakeActionCache) UpdateActionResult(ctx context.Context, req *repb.UpdateActionResultRequest, opts ...grpc.CallOption) (*repb.ActionResult, error) {
+	f.results[req.GetActionDigest().GetHash()] = req.GetActionResult()
+	return req.GetActionResult(), nil
+}
+
+// fakeCAS reports the given blobs as missing.
+type fakeCAS struct {
+	repb.ContentAddressableStorageClient
+	missing map[string]bool
+}
+
+func (f *fakeCAS) FindMissingBlobs(ctx context.Context, req *repb.FindMissingBlobsRequest, opts ...grpc.CallOption) (*repb.FindMissingBlobsResponse, error) {
+	rsp := &repb.FindMissingBlobsResponse{}
+	for _, d := range req.GetBlobDigests() {
+		if f.missing[d.GetHash()] {
+			rsp.MissingBlobDigests = append(rsp.MissingBlobDigests, d)
+		}
+	}
+	return rsp, nil
+}
+
+func request(hash string) *repb.GetActionResultRequest {
+	return &repb.GetActionResultRequest{
+		InstanceName: "default",
+		ActionDigest: &repb.Digest{Hash: hash, SizeBytes: 1},
+	}
+}
+
+func result(exitCode int32, outputHash string) *repb.ActionResult {
+	return &repb.ActionResult{
+		ExitCode: exitCode,
+		OutputFiles: []*repb.OutputFile{
+			{Path: "out", Digest: &repb.Digest{Hash: outputHash, SizeBytes: 1}},
+		},
+	}
+}
+
+func TestCachesSuccessfulResultsUntilTTL(t *testing.T) {
+	ctx := context.Background()
+	clock := fakeclock.New(time.Now())
+	ac := &fakeActionCache{results: map[string]*repb.ActionResult{
+		"pass": result(0, "out1"),
+		"fail": result(1, "out2"),
+	}}
+	c, err := local_action_cache.New(&config.LocalActionCacheConfig{TTLSeconds: 60}, clock, ac, &fakeCAS{})
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		r, err := c.GetActionResult(ctx, request("pass"))
+		require.NoError(t, err)
+		assert.Equal(t, "out1", r.GetOutputFiles()[0].GetDigest().GetHash())
+	}
+	assert.Equal(t, 1, ac.lookups, "repeated lookups should be served locally")
+
+	clock.Advance(2 * time.Minute)
+	_, err = c.GetActionResult(ctx, request("pass"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, ac.lookups, "expired results should be looked up again")
+
+	for i := 0; i < 2; i++ {
+		_, err = c.GetActionResult(ctx, request("fail"))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 4, ac.lookups, "failed results should not be cached")
+
+	_, err = c.GetActionResult(ctx, request("missing"))
+	assert.True(t, status.IsNotFoundError(err))
+}
+
+func TestCachesUploadedResults(t *testing.T) {
+	ctx := context.Background()
+	ac := &fakeActionCache{results: map[string]*repb.ActionResult{}}
+	c, err := local_action_cache.New(&config.LocalActionCacheConfig{}, fakeclock.New(time.Now()), ac, &fakeCAS{})
+	require.NoError(t, err)
+
+	_, err = c.UpdateActionResult(ctx, &repb.UpdateActionResultRequest{
+		InstanceName: "default",
+		ActionDigest: &repb.Digest{Hash: "pass", SizeBytes: 1},
+		ActionResult: result(0, "out1"),
+	})
+	require.NoError(t, err)
+	_, err = c.GetActionResult(ctx, request("pass"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, ac.lookups)
+}
+
+func TestValidateOutputs(t *testing.T) {
+	ctx := context.Background()
+	ac := &fakeActionCache{results: map[string]*repb.ActionResult{
+		"pass": result(0, "out1"),
+	}}
+	cas := &fakeCAS{missing: map[string]bool{}}
+	c, err := local_action_cache.New(&config.LocalActionCacheConfig{ValidateOutputs: true}, fakeclock.New(time.Now()), ac, cas)
+	require.NoError(t, err)
+
+	_, err = c.GetActionResult(ctx, request("pass"))
+	require.NoError(t, err)
+	_, err = c.GetActionResult(ctx, request("pass"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, ac.lookups)
+
+	// Once an output is evicted from the CAS, the central action cache is
+	// consulted instead.
+	cas.missing["out1"] = true
+	_, err = c.GetActionResult(ctx, request("pass"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, ac.lookups)
+}
+
+func TestDiskCacheSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	ac := &fakeActionCache{results: map[string]*repb.ActionResult{
+		"pass": result(0, "out1"),
+	}}
+	cfg := &config.LocalActionCacheConfig{Directory: dir}
+
+	c, err := local_action_cache.New(cfg, fakeclock.New(time.Now()), ac, &fakeCAS{})
+	require.NoError(t, err)
+	_, err = c.GetActionResult(ctx, request("pass"))
+	require.NoError(t, err)
+
+	c, err = local_action_cache.New(cfg, fakeclock.New(time.Now()), ac, &fakeCAS{})
+	require.NoError(t, err)
+	r, err := c.GetActionResult(ctx, request("pass"))
+	require.NoError(t, err)
+	assert.Equal(t, "out1", r.GetOutputFiles()[0].GetDigest().GetHash())
+	assert.Equal(t, 1, ac.lookups)
+}
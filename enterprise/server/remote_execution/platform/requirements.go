@@ -0,0 +1,380 @@
+package platform
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	// Executor attributes that platform requirements can constrain.
+	OSAttribute     = "os"
+	ArchAttribute   = "arch"
+	PoolAttribute   = "pool"
+	MemoryAttribute = "memory"
+	CPUAttribute    = "cpu"
+
+	// Platform properties which are matched against executor attributes when
+	// scheduling. The values of these properties may be plain values, which
+	// must match exactly, or expressions (see ParseRequirement).
+	OSFamilyPropertyName  = "OSFamily"
+	ArchPropertyName      = "Arch"
+	PoolPropertyName      = "Pool"
+	MinMemoryPropertyName = "min-memory"
+	MinCPUPropertyName    = "min-cpu"
+)
+
+// Operator is a comparison operator used in a platform requirement.
+type Operator string
+
+const (
+	Equal          Operator = "=="
+	NotEqual       Operator = "!="
+	In             Operator = "in"
+	NotIn          Operator = "not in"
+	GreaterOrEqual Operator = ">="
+	Greater        Operator = ">"
+	LessOrEqual    Operator = "<="
+	Less           Operator = "<"
+)
+
+// emptyValue denotes an empty value in a list of values, such as the name of
+// an unnamed pool.
+const emptyValue = `""`
+
+// Comparison operators, ordered so that operators which are a prefix of
+// another operator come after it.
+var comparisonOperators = []Operator{GreaterOrEqual, LessOrEqual, NotEqual, Equal, Greater, Less}
+
+// requirementProperties maps the platform properties that are matched against
+// executor attributes to the attribute that they constrain.
+var requirementProperties = []struct {
+	property  string
+	attribute string
+}{
+	{OSFamilyPropertyName, OSAttribute},
+	{ArchPropertyName, ArchAttribute},
+	{PoolPropertyName, PoolAttribute},
+	{MinMemoryPropertyName, MemoryAttribute},
+	{MinCPUPropertyName, CPUAttribute},
+}
+
+// ExecutorAttributes are the properties of an executor that platform
+// requirements are matched against.
+type ExecutorAttributes struct {
+	OS                    string
+	Arch                  string
+	Pool                  string
+	AssignableMemoryBytes int64
+	AssignableMilliCPU    int64
+}
+
+// Requirement is a constraint on an executor attribute which must hold for a
+// task to be scheduled on the executor.
+type Requirement struct {
+	Attribute string
+	Operator  Operator
+	// Values holds the operand of the comparison. Only set operators (In and
+	// NotIn) may have more than one value.
+	Values []string
+
+	// For numeric attributes, the operand in base units (bytes for memory,
+	// milli-CPU for CPU).
+	quantity int64
+}
+
+// String returns the requirement as an expression which can be parsed with
+// ParseRequirement.
+func (r *Requirement) String() string {
+	if r.Operator == In || r.Operator == NotIn {
+		values := make([]string, 0, len(r.Values))
+		for _, v := range r.Values {
+			if v == "" {
+				v = emptyValue
+			}
+			values = append(values, v)
+		}
+		return fmt.Sprintf("%s %s [%s]", r.Attribute, r.Operator, strings.Join(values, ", "))
+	}
+	value := r.Values[0]
+	if value == "" {
+		value = emptyValue
+	}
+	return fmt.Sprintf("%s %s %s", r.Attribute, r.Operator, value)
+}
+
+// ExactValue returns the only value that satisfies the requirement, if the
+// requirement is an equality (or a membership test against a single value).
+func (r *Requirement) ExactValue() (string, bool) {
+	if r.Operator == Equal || (r.Operator == In && len(r.Values) == 1) {
+		return r.Values[0], true
+	}
+	return "", false
+}
+
+// MatchesValue returns whether the given value of the requirement's
+// attribute satisfies the requirement. Numeric attribute values are given in
+// base units.
+func (r *Requirement) MatchesValue(value string) bool {
+	if isNumericAttribute(r.Attribute) {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return false
+		}
+		return r.matchesQuantity(n)
+	}
+	value = strings.ToLower(value)
+	switch r.Operator {
+	case Equal:
+		return value == r.Values[0]
+	case NotEqual:
+		return value != r.Values[0]
+	case In, NotIn:
+		for _, v := range r.Values {
+			if value == v {
+				return r.Operator == In
+			}
+		}
+		return r.Operator == NotIn
+	}
+	return false
+}
+
+func (r *Requirement) matchesQuantity(n int64) bool {
+	switch r.Operator {
+	case Equal:
+		return n == r.quantity
+	case NotEqual:
+		return n != r.quantity
+	case GreaterOrEqual:
+		return n >= r.quantity
+	case Greater:
+		return n > r.quantity
+	case LessOrEqual:
+		return n <= r.quantity
+	case Less:
+		return n < r.quantity
+	}
+	return false
+}
+
+// Matches returns whether the given executor satisfies the requirement.
+func (r *Requirement) Matches(attrs *ExecutorAttributes) bool {
+	switch r.Attribute {
+	case OSAttribute:
+		return r.MatchesValue(attrs.OS)
+	case ArchAttribute:
+		return r.MatchesValue(attrs.Arch)
+	case PoolAttribute:
+		return r.MatchesValue(attrs.Pool)
+	case MemoryAttribute:
+		return r.matchesQuantity(attrs.AssignableMemoryBytes)
+	case CPUAttribute:
+		return r.matchesQuantity(attrs.AssignableMilliCPU)
+	}
+	return false
+}
+
+// UnsatisfiedRequirements returns the requirements which the given executor
+// does not satisfy.
+func UnsatisfiedRequirements(reqs []*Requirement, attrs *ExecutorAttributes) []*Requirement {
+	var unsatisfied []*Requirement
+	for _, r := range reqs {
+		if !r.Matches(attrs) {
+			unsatisfied = append(unsatisfied, r)
+		}
+	}
+	return unsatisfied
+}
+
+// ParseRequirements returns the scheduling requirements specified by the
+// given platform.
+//
+// The "OSFamily", "Arch", and "Pool" properties may be set to a plain value,
+// which the executor's value must equal, or to an expression such as
+// "in [linux, ubuntu20]" or "!= darwin". The "min-memory" and "min-cpu"
+// properties are quantities such as "16g" or "500m" (CPU), and require at
+// least that much to be assignable on the executor unless a different
+// comparison operator is given, as in "<= 4".
+func ParseRequirements(plat *repb.Platform) ([]*Requirement, error) {
+	values := map[string]string{}
+	for _, prop := range plat.GetProperties() {
+		values[prop.GetName()] = strings.TrimSpace(prop.GetValue())
+	}
+	var reqs []*Requirement
+	for _, rp := range requirementProperties {
+		value := values[rp.property]
+		if value == "" {
+			continue
+		}
+		r, err := parseRequirementValue(rp.attribute, value)
+		if err != nil {
+			return nil, status.WrapErrorf(err, "invalid platform property %q", rp.property)
+		}
+		reqs = append(reqs, r)
+	}
+	return reqs, nil
+}
+
+// ParseRequirement parses a requirement expression of the form
+// "<attribute> <operator> <value>", such as "memory >= 16g" or
+// "os in [linux, ubuntu20]".
+func ParseRequirement(expr string) (*Requirement, error) {
+	expr = strings.TrimSpace(expr)
+	end := strings.IndexAny(expr, " <>=!")
+	if end <= 0 {
+		return nil, status.InvalidArgumentErrorf("invalid requirement %q: expected an attribute followed by an operator", expr)
+	}
+	r, err := parseRequirementValue(expr[:end], expr[end:])
+	if err != nil {
+		return nil, status.WrapErrorf(err, "invalid requirement %q", expr)
+	}
+	return r, nil
+}
+
+// ParseRequirementList parses each of the given requirement expressions.
+func ParseRequirementList(exprs []string) ([]*Requirement, error) {
+	reqs := make([]*Requirement, 0, len(exprs))
+	for _, expr := range exprs {
+		r, err := ParseRequirement(expr)
+		if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, r)
+	}
+	return reqs, nil
+}
+
+// parseRequirementValue parses the operator and operand constraining the
+// given attribute. If no operator is given, the value must be equal for
+// string attributes and at least the given quantity for numeric attributes.
+func parseRequirementValue(attribute, value string) (*Requirement, error) {
+	if !isStringAttribute(attribute) && !isNumericAttribute(attribute) {
+		return nil, status.InvalidArgumentErrorf("unknown attribute %q", attribute)
+	}
+	value = strings.TrimSpace(value)
+	r := &Requirement{Attribute: attribute}
+	lower := strings.ToLower(value)
+	switch {
+	case strings.HasPrefix(lower, string(NotIn)+" "):
+		r.Operator = NotIn
+		value = value[len(NotIn):]
+	case strings.HasPrefix(lower, string(In)+" "):
+		r.Operator = In
+		value = value[len(In):]
+	default:
+		for _, op := range comparisonOperators {
+			if strings.HasPrefix(value, string(op)) {
+				r.Operator = op
+				value = value[len(op):]
+				break
+			}
+		}
+	}
+	value = strings.TrimSpace(value)
+
+	if r.Operator == In || r.Operator == NotIn {
+		if isNumericAttribute(attribute) {
+			return nil, status.InvalidArgumentErrorf("operator %q is not supported for %q", r.Operator, attribute)
+		}
+		values, err := parseSet(value)
+		if err != nil {
+			return nil, err
+		}
+		r.Values = values
+		return r, nil
+	}
+	if value == "" {
+		return nil, status.InvalidArgumentError("missing value")
+	}
+	if isNumericAttribute(attribute) {
+		if r.Operator == "" {
+			r.Operator = GreaterOrEqual
+		}
+		q, err := parseQuantity(attribute, value)
+		if err != nil {
+			return nil, err
+		}
+		r.quantity = q
+		r.Values = []string{strings.ToLower(value)}
+		return r, nil
+	}
+	switch r.Operator {
+	case "":
+		r.Operator = Equal
+	case Equal, NotEqual:
+	default:
+		return nil, status.InvalidArgumentErrorf("operator %q is only supported for numeric attributes", r.Operator)
+	}
+	if value == emptyValue {
+		value = ""
+	}
+	r.Values = []string{strings.ToLower(value)}
+	return r, nil
+}
+
+// parseSet parses a bracketed, comma-separated list of values such as
+// "[linux, ubuntu20]". An empty value is written as "".
+func parseSet(value string) ([]string, error) {
+	if !strings.HasPrefix(value, "[") || !strings.HasSuffix(value, "]") {
+		return nil, status.InvalidArgumentErrorf("expected a list of values in brackets, got %q", value)
+	}
+	var values []string
+	for _, v := range strings.Split(value[1:len(value)-1], ",") {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if v == "" {
+			return nil, status.InvalidArgumentErrorf("empty value in list %q", value)
+		}
+		if v == emptyValue {
+			v = ""
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// parseQuantity parses a memory size in bytes, with an optional binary unit
+// suffix (e.g. "512m" or "16GB"), or a number of CPUs as milli-CPU, with an
+// optional "m" suffix for milli-CPU (e.g. "2" or "500m").
+func parseQuantity(attribute, value string) (int64, error) {
+	s := strings.ToLower(value)
+	multiplier := float64(1)
+	if attribute == CPUAttribute {
+		multiplier = 1000
+		if strings.HasSuffix(s, "m") {
+			s = strings.TrimSuffix(s, "m")
+			multiplier = 1
+		}
+	} else {
+		s = strings.TrimSuffix(strings.TrimSuffix(s, "b"), "i")
+		for i, unit := range []string{"k", "m", "g", "t"} {
+			if strings.HasSuffix(s, unit) {
+				s = strings.TrimSuffix(s, unit)
+				multiplier = math.Pow(1024, float64(i+1))
+				break
+			}
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0, status.InvalidArgumentErrorf("invalid %s quantity %q", attribute, value)
+	}
+	q := f * multiplier
+	if q > math.MaxInt64 {
+		return 0, status.InvalidArgumentErrorf("%s quantity %q is too large", attribute, value)
+	}
+	return int64(q), nil
+}
+
+func isStringAttribute(attribute string) bool {
+	return attribute == OSAttribute || attribute == ArchAttribute || attribute == PoolAttribute
+}
+
+func isNumericAttribute(attribute string) bool {
+	return attribute == MemoryAttribute || attribute == CPUAttribute
+}
@@ -0,0 +1,128 @@
+package platform_test
+
+import (
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const gb = 1024 * 1024 * 1024
+
+func TestParseRequirements(t *testing.T) {
+	for _, testCase := range []struct {
+		props    []*repb.Platform_Property
+		expected []string
+	}{
+		{nil, nil},
+		{[]*repb.Platform_Property{{Name: "OSFamily", Value: "Linux"}}, []string{"os == linux"}},
+		{[]*repb.Platform_Property{{Name: "OSFamily", Value: "in [linux, Ubuntu20]"}}, []string{"os in [linux, ubuntu20]"}},
+		{[]*repb.Platform_Property{{Name: "Arch", Value: "!= arm64"}}, []string{"arch != arm64"}},
+		{[]*repb.Platform_Property{{Name: "Pool", Value: "not in [gpu]"}}, []string{"pool not in [gpu]"}},
+		{[]*repb.Platform_Property{{Name: "Pool", Value: `in ["", gpu]`}}, []string{`pool in ["", gpu]`}},
+		{[]*repb.Platform_Property{{Name: "min-memory", Value: "16g"}}, []string{"memory >= 16g"}},
+		{[]*repb.Platform_Property{{Name: "min-memory", Value: ">=16GB"}}, []string{"memory >= 16gb"}},
+		{[]*repb.Platform_Property{{Name: "min-cpu", Value: "< 4"}}, []string{"cpu < 4"}},
+		{
+			[]*repb.Platform_Property{
+				{Name: "container-image", Value: "docker://alpine"},
+				{Name: "min-cpu", Value: "500m"},
+				{Name: "OSFamily", Value: "linux"},
+			},
+			[]string{"os == linux", "cpu >= 500m"},
+		},
+	} {
+		reqs, err := platform.ParseRequirements(&repb.Platform{Properties: testCase.props})
+		require.NoError(t, err)
+		var exprs []string
+		for _, r := range reqs {
+			exprs = append(exprs, r.String())
+		}
+		assert.Equal(t, testCase.expected, exprs)
+
+		// Requirements should round-trip through their string form.
+		for _, expr := range exprs {
+			r, err := platform.ParseRequirement(expr)
+			require.NoError(t, err)
+			assert.Equal(t, expr, r.String())
+		}
+	}
+}
+
+func TestParseRequirements_Invalid(t *testing.T) {
+	for _, prop := range []*repb.Platform_Property{
+		{Name: "OSFamily", Value: ">= linux"},
+		{Name: "OSFamily", Value: "in linux"},
+		{Name: "OSFamily", Value: "in [linux,]"},
+		{Name: "Pool", Value: "!="},
+		{Name: "min-memory", Value: "lots"},
+		{Name: "min-memory", Value: "-1g"},
+		{Name: "min-memory", Value: "in [1g, 2g]"},
+		{Name: "min-cpu", Value: "4 cores"},
+	} {
+		_, err := platform.ParseRequirements(&repb.Platform{Properties: []*repb.Platform_Property{prop}})
+		assert.True(t, status.IsInvalidArgumentError(err), "%s=%q: expected InvalidArgument, got %v", prop.Name, prop.Value, err)
+	}
+}
+
+func TestParseRequirement_Invalid(t *testing.T) {
+	for _, expr := range []string{"", "linux", ">= 4", "disk >= 10g", "os"} {
+		_, err := platform.ParseRequirement(expr)
+		assert.True(t, status.IsInvalidArgumentError(err), "%q: expected InvalidArgument, got %v", expr, err)
+	}
+}
+
+func TestRequirementMatches(t *testing.T) {
+	executor := &platform.ExecutorAttributes{
+		OS:                    "linux",
+		Arch:                  "amd64",
+		Pool:                  "",
+		AssignableMemoryBytes: 16 * gb,
+		AssignableMilliCPU:    4000,
+	}
+	for _, testCase := range []struct {
+		expr    string
+		matches bool
+	}{
+		{"os == linux", true},
+		{"os != linux", false},
+		{"os in [darwin, linux]", true},
+		{"os not in [darwin, linux]", false},
+		{"arch in [arm64]", false},
+		{`pool in ["", gpu]`, true},
+		{"pool == gpu", false},
+		{"memory >= 16g", true},
+		{"memory > 16g", false},
+		{"memory >= 16384m", true},
+		{"memory < 32gib", true},
+		{"cpu >= 4", true},
+		{"cpu >= 4500m", false},
+		{"cpu <= 0.5", false},
+	} {
+		r, err := platform.ParseRequirement(testCase.expr)
+		require.NoError(t, err)
+		assert.Equal(t, testCase.matches, r.Matches(executor), testCase.expr)
+	}
+}
+
+func TestUnsatisfiedRequirements(t *testing.T) {
+	reqs, err := platform.ParseRequirements(&repb.Platform{Properties: []*repb.Platform_Property{
+		{Name: "OSFamily", Value: "in [linux, ubuntu20]"},
+		{Name: "min-memory", Value: "16g"},
+		{Name: "min-cpu", Value: "8"},
+	}})
+	require.NoError(t, err)
+
+	unsatisfied := platform.UnsatisfiedRequirements(reqs, &platform.ExecutorAttributes{
+		OS:                    "ubuntu20",
+		AssignableMemoryBytes: 8 * gb,
+		AssignableMilliCPU:    8000,
+	})
+
+	require.Len(t, unsatisfied, 1)
+	assert.Equal(t, "memory >= 16g", unsatisfied[0].String())
+}
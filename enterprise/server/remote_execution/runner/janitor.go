@@ -0,0 +1,262 @@
+package runner
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/containers/docker"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+
+	dockertypes "github.com/docker/docker/api/types"
+	dockerfilters "github.com/docker/docker/api/types/filters"
+)
+
+const (
+	defaultJanitorInterval = 10 * time.Minute
+	defaultMinOrphanAge    = 1 * time.Hour
+
+	// Resource type labels for janitor metrics.
+	workspaceResourceLabel = "workspace"
+	containerResourceLabel = "container"
+	mountResourceLabel     = "mount"
+)
+
+// StartJanitor starts periodically cleaning up orphaned resources (see
+// CleanupOrphans) until the pool is shut down. The first cleanup happens
+// immediately, to clean up after a previous executor process that crashed.
+func (p *Pool) StartJanitor() {
+	cfg := p.env.GetConfigurator().GetExecutorConfig().Janitor
+	if cfg.Disable {
+		return
+	}
+	interval := defaultJanitorInterval
+	if cfg.IntervalSeconds > 0 {
+		interval = time.Duration(cfg.IntervalSeconds) * time.Second
+	}
+	go func() {
+		for {
+			if err := p.CleanupOrphans(context.Background()); err != nil {
+				log.Warningf("Janitor: %s", err)
+			}
+			select {
+			case <-p.janitorQuit:
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+// CleanupOrphans removes workspaces, containers, and mounts under the build
+// root that do not belong to any runner in the pool, such as those left
+// behind by tasks that crashed or by a previous executor process.
+//
+// A resource is only considered orphaned if it predates the pool, or if it
+// has not been used for the configured minimum orphan age, so that resources
+// being set up for a new runner are left alone.
+func (p *Pool) CleanupOrphans(ctx context.Context) error {
+	active, ok := p.activeWorkspaces()
+	if !ok {
+		// The pool is removing all of its runners anyway.
+		return nil
+	}
+	errs := []error{}
+
+	// Remove containers first, since they may be using workspaces and mounts.
+	if p.dockerClient != nil {
+		if err := p.removeOrphanedContainers(ctx, active); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := p.unmountOrphanedMounts(active); err != nil {
+		errs = append(errs, err)
+	}
+	if err := p.removeOrphanedWorkspaces(active); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return status.InternalErrorf("failed to clean up orphaned resources: %s", errSlice(errs))
+	}
+	return nil
+}
+
+// activeWorkspaces returns the workspace paths of all runners in the pool. It
+// returns false if the pool is shutting down.
+func (p *Pool) activeWorkspaces() (map[string]bool, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.isShuttingDown {
+		return nil, false
+	}
+	paths := make(map[string]bool, len(p.runners))
+	for _, r := range p.runners {
+		paths[r.Workspace.Path()] = true
+	}
+	return paths, true
+}
+
+func (p *Pool) minOrphanAge() time.Duration {
+	if s := p.env.GetConfigurator().GetExecutorConfig().Janitor.MinOrphanAgeSeconds; s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return defaultMinOrphanAge
+}
+
+// isOrphanAge returns whether a resource not owned by any runner, which was
+// last used at the given time, is old enough to be cleaned up.
+func (p *Pool) isOrphanAge(lastUsed time.Time) bool {
+	return lastUsed.Before(p.createdAt) || time.Since(lastUsed) >= p.minOrphanAge()
+}
+
+// workspaceForPath returns the path of the workspace directory directly under
+// root that contains path, or "" if path is not inside a workspace.
+func workspaceForPath(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	name := strings.Split(rel, string(filepath.Separator))[0]
+	// Workspaces are always named with a UUID; leave anything else alone.
+	if _, err := uuid.Parse(name); err != nil {
+		return ""
+	}
+	return filepath.Join(root, name)
+}
+
+// isOrphanedWorkspace returns whether the given workspace directory is not
+// used by any runner and is old enough to be cleaned up.
+func (p *Pool) isOrphanedWorkspace(active map[string]bool, path string) bool {
+	if active[path] {
+		return false
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	return p.isOrphanAge(info.ModTime())
+}
+
+func (p *Pool) removeOrphanedContainers(ctx context.Context, active map[string]bool) error {
+	containers, err := p.dockerClient.ContainerList(ctx, dockertypes.ContainerListOptions{
+		All:     true,
+		Size:    true,
+		Filters: dockerfilters.NewArgs(dockerfilters.Arg("name", docker.ContainerNamePrefix)),
+	})
+	if err != nil {
+		return status.UnavailableErrorf("failed to list docker containers: %s", err)
+	}
+	hostRoot := p.hostBuildRoot()
+	errs := []error{}
+	for _, c := range containers {
+		// Other executors may share the docker daemon, so only consider
+		// containers that mount a workspace from this executor's build root.
+		ws := ""
+		for _, m := range c.Mounts {
+			if hostWS := workspaceForPath(hostRoot, m.Source); hostWS != "" {
+				ws = filepath.Join(p.buildRoot, filepath.Base(hostWS))
+				break
+			}
+		}
+		if ws == "" || active[ws] || !p.isOrphanAge(time.Unix(c.Created, 0)) {
+			continue
+		}
+		log.Infof("Janitor: removing orphaned container %s (workspace %q)", c.ID, ws)
+		if err := p.dockerClient.ContainerRemove(ctx, c.ID, dockertypes.ContainerRemoveOptions{Force: true}); err != nil {
+			errs = append(errs, status.UnavailableErrorf("failed to remove container %s: %s", c.ID, err))
+			continue
+		}
+		recordJanitorRemoval(containerResourceLabel, c.SizeRw)
+	}
+	if len(errs) > 0 {
+		return errSlice(errs)
+	}
+	return nil
+}
+
+func (p *Pool) unmountOrphanedMounts(active map[string]bool) error {
+	mounts, err := listMounts()
+	if err != nil {
+		return status.UnavailableErrorf("failed to list mounts: %s", err)
+	}
+	// Unmount the deepest mounts first, since mounts may be nested.
+	sort.Slice(mounts, func(i, j int) bool { return len(mounts[i]) > len(mounts[j]) })
+	errs := []error{}
+	for _, m := range mounts {
+		ws := workspaceForPath(p.buildRoot, m)
+		if ws == "" || !p.isOrphanedWorkspace(active, ws) {
+			continue
+		}
+		log.Infof("Janitor: unmounting orphaned mount %q", m)
+		if err := unmount(m); err != nil {
+			errs = append(errs, status.UnavailableErrorf("failed to unmount %q: %s", m, err))
+			continue
+		}
+		recordJanitorRemoval(mountResourceLabel, 0)
+	}
+	if len(errs) > 0 {
+		return errSlice(errs)
+	}
+	return nil
+}
+
+func (p *Pool) removeOrphanedWorkspaces(active map[string]bool) error {
+	entries, err := os.ReadDir(p.buildRoot)
+	if err != nil {
+		return status.UnavailableErrorf("failed to read build root: %s", err)
+	}
+	// Never remove a workspace that still has something mounted in it, since
+	// that would remove the contents of the mounted filesystem.
+	mounted := map[string]bool{}
+	mounts, err := listMounts()
+	if err != nil {
+		return status.UnavailableErrorf("failed to list mounts: %s", err)
+	}
+	for _, m := range mounts {
+		if ws := workspaceForPath(p.buildRoot, m); ws != "" {
+			mounted[ws] = true
+		}
+	}
+	errs := []error{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(p.buildRoot, entry.Name())
+		if workspaceForPath(p.buildRoot, path) != path || mounted[path] || !p.isOrphanedWorkspace(active, path) {
+			continue
+		}
+		size, err := disk.DirSize(path)
+		if err != nil {
+			log.Warningf("Janitor: failed to compute size of orphaned workspace %q: %s", path, err)
+		}
+		log.Infof("Janitor: removing orphaned workspace %q (%d bytes)", path, size)
+		if err := os.RemoveAll(path); err != nil {
+			errs = append(errs, status.UnavailableErrorf("failed to remove workspace %q: %s", path, err))
+			continue
+		}
+		recordJanitorRemoval(workspaceResourceLabel, size)
+	}
+	if len(errs) > 0 {
+		return errSlice(errs)
+	}
+	return nil
+}
+
+func recordJanitorRemoval(resourceType string, reclaimedBytes int64) {
+	labels := prometheus.Labels{metrics.JanitorResourceTypeLabel: resourceType}
+	metrics.JanitorRemovedResources.With(labels).Inc()
+	metrics.JanitorReclaimedDiskBytes.With(labels).Add(float64(reclaimedBytes))
+}
@@ -0,0 +1,58 @@
+// +build linux
+
+package runner
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// listMounts returns the mount points visible to the executor.
+func listMounts() ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var mounts []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// See proc(5): the mount point is the 5th field.
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mounts = append(mounts, unescapeMountPath(fields[4]))
+	}
+	return mounts, s.Err()
+}
+
+// unescapeMountPath decodes the octal escapes (e.g. "\040" for a space) used
+// for special characters in mountinfo paths.
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+func unmount(path string) error {
+	// Lazily unmount so that a mount held open by a leaked process doesn't
+	// prevent cleanup.
+	return unix.Unmount(path, unix.MNT_DETACH)
+}
@@ -0,0 +1,17 @@
+// +build !linux
+
+package runner
+
+import (
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+// Leaked mounts are only detected on Linux.
+
+func listMounts() ([]string, error) {
+	return nil, nil
+}
+
+func unmount(path string) error {
+	return status.UnimplementedError("unmount is only supported on Linux")
+}
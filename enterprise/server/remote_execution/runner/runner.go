@@ -249,6 +249,11 @@ type Pool struct {
 	buildRoot        string
 	dockerClient     *dockerclient.Client
 	containerdSocket string
+	// createdAt is when the pool was created. Resources under the build root
+	// that predate the pool cannot belong to any of its runners.
+	createdAt time.Time
+	// janitorQuit is closed when the pool is shut down, to stop the janitor.
+	janitorQuit chan struct{}
 
 	maxRunnerCount            int
 	maxRunnerMemoryUsageBytes int64
@@ -305,6 +310,8 @@ func NewPool(env environment.Env) (*Pool, error) {
 		dockerClient:     dockerClient,
 		containerdSocket: containerdSocket,
 		buildRoot:        executorConfig.GetRootDirectory(),
+		createdAt:        time.Now(),
+		janitorQuit:      make(chan struct{}),
 		runners:          []*CommandRunner{},
 	}
 	p.setLimits(&executorConfig.RunnerPool)
@@ -704,6 +711,9 @@ func (p *Pool) pausedRunnerCount() int {
 // being added.
 func (p *Pool) Shutdown(ctx context.Context) error {
 	p.mu.Lock()
+	if !p.isShuttingDown {
+		close(p.janitorQuit)
+	}
 	p.isShuttingDown = true
 	runners := p.runners
 	p.runners = nil
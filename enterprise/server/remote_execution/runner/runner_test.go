@@ -362,3 +362,41 @@ func TestRunnerPool_ActiveRunnersTakenFromPool_RemovedOnShutdown(t *testing.T) {
 
 // TODO: Test mem limit. We currently don't compute mem usage for bare runners,
 // so there's not a great way to test this yet.
+
+func TestRunnerPool_CleanupOrphans_RemovesOnlyOrphanedWorkspaces(t *testing.T) {
+	env := newTestEnv(t)
+	buildRoot := env.GetConfigurator().GetExecutorConfig().GetRootDirectory()
+	// Simulate a workspace left behind by a previous executor process.
+	orphan := path.Join(buildRoot, newUUID(t))
+	err := os.MkdirAll(path.Join(orphan, "bazel-out"), 0755)
+	require.NoError(t, err)
+	past := time.Now().Add(-1 * time.Minute)
+	err = os.Chtimes(orphan, past, past)
+	require.NoError(t, err)
+	// Directories that aren't workspaces should be left alone.
+	notWorkspace := path.Join(buildRoot, "not-a-workspace")
+	err = os.MkdirAll(notWorkspace, 0755)
+	require.NoError(t, err)
+	err = os.Chtimes(notWorkspace, past, past)
+	require.NoError(t, err)
+
+	pool := newRunnerPool(t, env, noLimitsCfg)
+	ctx := withAuthenticatedUser(t, context.Background(), "US1")
+	active := mustGetNewRunner(t, ctx, pool, newTask())
+	paused := mustGetNewRunner(t, ctx, pool, newTask())
+	mustAdd(t, ctx, pool, paused)
+	// Workspaces created since the pool started may belong to runners that
+	// are still being set up, so they should be left alone too.
+	recent := path.Join(buildRoot, newUUID(t))
+	err = os.MkdirAll(recent, 0755)
+	require.NoError(t, err)
+
+	err = pool.CleanupOrphans(context.Background())
+
+	require.NoError(t, err)
+	assert.NoDirExists(t, orphan)
+	assert.DirExists(t, notWorkspace)
+	assert.DirExists(t, recent)
+	assert.DirExists(t, active.Workspace.Path())
+	assert.DirExists(t, paused.Workspace.Path())
+}
@@ -187,7 +187,13 @@ func (ws *Workspace) Clean() error {
 			// TODO: If we remove an output file whose path previously pointed to
 			// a directory, then we need to remove all `inputs` under that directory.
 		}
-		for _, outputDirPath := range cmd.GetOutputDirectories() {
+		// The output paths of v2.1 commands may be files or directories, so
+		// they're removed the same way as output directories, which works
+		// for either.
+		outputDirPaths := make([]string, 0, len(cmd.GetOutputDirectories())+len(cmd.GetOutputPaths()))
+		outputDirPaths = append(outputDirPaths, cmd.GetOutputDirectories()...)
+		outputDirPaths = append(outputDirPaths, cmd.GetOutputPaths()...)
+		for _, outputDirPath := range outputDirPaths {
 			if err := os.RemoveAll(filepath.Join(ws.Path(), outputDirPath)); err != nil && !os.IsNotExist(err) {
 				return status.UnavailableErrorf("Failed to clean workspace: %s", err)
 			}
@@ -139,3 +139,30 @@ func TestWorkspaceCleanup_PreserveWorkspace_PreservesAllFilesExceptOutputs(t *te
 		"expected all KEEPME filePaths (and no others) in the workspace after cleanup",
 	)
 }
+
+func TestWorkspaceCleanup_PreserveWorkspace_RemovesOutputPaths(t *testing.T) {
+	filePaths := []string{
+		"some_output_directory/DELETEME",
+		"some/nested/output/file/DELETEME",
+		"KEEPME",
+		"foo/KEEPME",
+	}
+	ws := newWorkspace(t, &workspace.Opts{Preserve: true})
+	ws.SetTask(&repb.ExecutionTask{
+		Command: &repb.Command{
+			OutputPaths: []string{
+				"some/nested/output/file/DELETEME",
+				"some_output_directory",
+			},
+		},
+	})
+	writeEmptyFiles(t, ws, filePaths)
+
+	err := ws.Clean()
+
+	require.NoError(t, err)
+	assert.Equal(
+		t, keepmePaths(filePaths), actualFilePaths(t, ws),
+		"expected all KEEPME filePaths (and no others) in the workspace after cleanup",
+	)
+}
@@ -0,0 +1,126 @@
+package routing_cache
+
+import (
+	"context"
+	"io"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+// Route directs cache traffic matching its instance name and group ID to a
+// backing cache. Empty fields match anything.
+type Route struct {
+	InstanceName string
+	GroupID      string
+	Cache        interfaces.Cache
+}
+
+// routingCache sends each request to the cache of the first route matching
+// the request's remote instance name and the authenticated group, falling
+// back to a default cache if no route matches.
+type routingCache struct {
+	env          environment.Env
+	routes       []Route
+	defaultCache interfaces.Cache
+
+	// The remote instance name, as determined from the first prefix applied
+	// to this cache (see the namespace package).
+	instanceName string
+	hasPrefix    bool
+	matchGroups  bool
+}
+
+func NewRoutingCache(env environment.Env, defaultCache interfaces.Cache, routes []Route) interfaces.Cache {
+	matchGroups := false
+	for _, r := range routes {
+		if r.GroupID != "" {
+			matchGroups = true
+		}
+	}
+	return &routingCache{
+		env:          env,
+		routes:       routes,
+		defaultCache: defaultCache,
+		matchGroups:  matchGroups,
+	}
+}
+
+func (c *routingCache) WithPrefix(prefix string) interfaces.Cache {
+	routes := make([]Route, 0, len(c.routes))
+	for _, r := range c.routes {
+		r.Cache = r.Cache.WithPrefix(prefix)
+		routes = append(routes, r)
+	}
+	clone := &routingCache{
+		env:          c.env,
+		routes:       routes,
+		defaultCache: c.defaultCache.WithPrefix(prefix),
+		instanceName: c.instanceName,
+		hasPrefix:    true,
+		matchGroups:  c.matchGroups,
+	}
+	if !c.hasPrefix && prefix != namespace.ACCachePrefix {
+		clone.instanceName = prefix
+	}
+	return clone
+}
+
+func (c *routingCache) cache(ctx context.Context) interfaces.Cache {
+	groupID := ""
+	if c.matchGroups {
+		if u, err := perms.AuthenticatedUser(ctx, c.env); err == nil {
+			groupID = u.GetGroupID()
+		}
+	}
+	for _, r := range c.routes {
+		if r.InstanceName != "" && r.InstanceName != c.instanceName {
+			continue
+		}
+		if r.GroupID != "" && r.GroupID != groupID {
+			continue
+		}
+		return r.Cache
+	}
+	return c.defaultCache
+}
+
+func (c *routingCache) Contains(ctx context.Context, d *repb.Digest) (bool, error) {
+	return c.cache(ctx).Contains(ctx, d)
+}
+
+func (c *routingCache) ContainsMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest]bool, error) {
+	return c.cache(ctx).ContainsMulti(ctx, digests)
+}
+
+func (c *routingCache) Get(ctx context.Context, d *repb.Digest) ([]byte, error) {
+	return c.cache(ctx).Get(ctx, d)
+}
+
+func (c *routingCache) GetMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest][]byte, error) {
+	return c.cache(ctx).GetMulti(ctx, digests)
+}
+
+func (c *routingCache) Set(ctx context.Context, d *repb.Digest, data []byte) error {
+	return c.cache(ctx).Set(ctx, d, data)
+}
+
+func (c *routingCache) SetMulti(ctx context.Context, kvs map[*repb.Digest][]byte) error {
+	return c.cache(ctx).SetMulti(ctx, kvs)
+}
+
+func (c *routingCache) Delete(ctx context.Context, d *repb.Digest) error {
+	return c.cache(ctx).Delete(ctx, d)
+}
+
+func (c *routingCache) Reader(ctx context.Context, d *repb.Digest, offset int64) (io.ReadCloser, error) {
+	return c.cache(ctx).Reader(ctx, d, offset)
+}
+
+func (c *routingCache) Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser, error) {
+	return c.cache(ctx).Writer(ctx, d)
+}
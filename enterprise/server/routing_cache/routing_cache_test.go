@@ -0,0 +1,85 @@
+package routing_cache_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/routing_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/stretchr/testify/require"
+)
+
+func newMemoryCache(t *testing.T) interfaces.Cache {
+	mc, err := memory_cache.NewMemoryCache(1_000_000)
+	require.NoError(t, err)
+	return mc
+}
+
+func getContext(t *testing.T, te *testenv.TestEnv, userID string) context.Context {
+	ctx := context.Background()
+	if userID != "" {
+		a := te.GetAuthenticator().(*testauth.TestAuthenticator)
+		authCtx, err := a.WithAuthenticatedUser(ctx, userID)
+		require.NoError(t, err)
+		ctx = authCtx
+	}
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te)
+	require.NoError(t, err)
+	return ctx
+}
+
+func TestRoutesByInstanceNameAndGroup(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1", "US2", "GR2")))
+
+	defaultCache := newMemoryCache(t)
+	ciCache := newMemoryCache(t)
+	groupCache := newMemoryCache(t)
+	rc := routing_cache.NewRoutingCache(te, defaultCache, []routing_cache.Route{
+		{InstanceName: "ci", Cache: ciCache},
+		{GroupID: "GR1", Cache: groupCache},
+	})
+
+	for _, tc := range []struct {
+		name         string
+		userID       string
+		instanceName string
+		ac           bool
+		want         interfaces.Cache
+	}{
+		{"CI instance CAS", "US2", "ci", false, ciCache},
+		{"CI instance AC", "US2", "ci", true, ciCache},
+		{"route by group CAS", "US1", "", false, groupCache},
+		{"route by group AC", "US1", "dev", true, groupCache},
+		{"instance route precedes group route", "US1", "ci", false, ciCache},
+		{"unmatched group", "US2", "dev", false, defaultCache},
+		{"unmatched AC with empty instance name", "US2", "", true, defaultCache},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := getContext(t, te, tc.userID)
+			ns := namespace.CASCache
+			if tc.ac {
+				ns = namespace.ActionCache
+			}
+			d, buf := testdigest.NewRandomDigestBuf(t, 100)
+			err := ns(rc, tc.instanceName).Set(ctx, d, buf)
+			require.NoError(t, err)
+
+			for _, c := range []interfaces.Cache{defaultCache, ciCache, groupCache} {
+				exists, err := ns(c, tc.instanceName).Contains(ctx, d)
+				require.NoError(t, err)
+				require.Equal(t, c == tc.want, exists)
+			}
+
+			rbuf, err := ns(rc, tc.instanceName).Get(ctx, d)
+			require.NoError(t, err)
+			require.Equal(t, buf, rbuf)
+		})
+	}
+}
@@ -0,0 +1,289 @@
+// Package executor_utilization records how much of the capacity of each
+// executor pool is used, hour by hour, so that fleets can be sized to match
+// the work they run.
+package executor_utilization
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+const (
+	period = time.Hour
+
+	// How often recorded usage is added to the stored records.
+	flushInterval = 1 * time.Minute
+	flushTimeout  = 10 * time.Second
+
+	// Records older than this are deleted.
+	retention = 90 * 24 * time.Hour
+
+	defaultLookback = 7 * 24 * time.Hour
+)
+
+type recordKey struct {
+	groupID         string
+	pool            string
+	periodStartUsec int64
+}
+
+type usage struct {
+	registeredExecutorUsec int64
+	capacityMilliCPUUsec   int64
+	busyMilliCPUUsec       int64
+	taskCount              int64
+}
+
+func (u *usage) merge(other *usage) {
+	u.registeredExecutorUsec += other.registeredExecutorUsec
+	u.capacityMilliCPUUsec += other.capacityMilliCPUUsec
+	u.busyMilliCPUUsec += other.busyMilliCPUUsec
+	u.taskCount += other.taskCount
+}
+
+// Recorder accumulates the usage of the executors connected to this
+// scheduler and periodically adds it to the hourly records, which are shared
+// by all schedulers.
+type Recorder struct {
+	env environment.Env
+
+	mu      sync.Mutex
+	pending map[recordKey]*usage
+}
+
+func NewRecorder(env environment.Env) *Recorder {
+	return &Recorder{
+		env:     env,
+		pending: make(map[recordKey]*usage),
+	}
+}
+
+// Start periodically flushes recorded usage, and deletes expired records,
+// until the server shuts down.
+func (r *Recorder) Start() {
+	shuttingDown := make(chan struct{})
+	r.env.GetHealthChecker().RegisterShutdownFunction(func(ctx context.Context) error {
+		close(shuttingDown)
+		return r.Flush(ctx)
+	})
+	go func() {
+		for {
+			select {
+			case <-shuttingDown:
+				return
+			case <-r.env.GetClock().After(flushInterval):
+				ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+				if err := r.Flush(ctx); err != nil {
+					log.Warningf("Error recording executor utilization: %s", err)
+				}
+				if err := r.deleteExpiredRecords(ctx); err != nil {
+					log.Warningf("Error deleting expired executor utilization: %s", err)
+				}
+				cancel()
+			}
+		}
+	}()
+}
+
+// pendingUsage returns the usage recorded since the last flush for the hour
+// containing t. The lock must be held.
+func (r *Recorder) pendingUsage(groupID, pool string, t time.Time) *usage {
+	key := recordKey{groupID: groupID, pool: pool, periodStartUsec: timeutil.ToUsec(t.Truncate(period))}
+	u, ok := r.pending[key]
+	if !ok {
+		u = &usage{}
+		r.pending[key] = u
+	}
+	return u
+}
+
+// add calls fn with the usage of each hour overlapping [start, end) and the
+// duration of the overlap.
+func (r *Recorder) add(groupID, pool string, start, end time.Time, fn func(u *usage, d time.Duration)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for start.Before(end) {
+		periodEnd := start.Truncate(period).Add(period)
+		if end.Before(periodEnd) {
+			periodEnd = end
+		}
+		fn(r.pendingUsage(groupID, pool, start), periodEnd.Sub(start))
+		start = periodEnd
+	}
+}
+
+// RecordRegistration records that an executor with the given assignable CPU
+// was registered in a pool from start until end.
+func (r *Recorder) RecordRegistration(groupID, pool string, assignableMilliCPU int64, start, end time.Time) {
+	r.add(groupID, pool, start, end, func(u *usage, d time.Duration) {
+		u.registeredExecutorUsec += d.Microseconds()
+		u.capacityMilliCPUUsec += assignableMilliCPU * d.Microseconds()
+	})
+}
+
+// RecordTask records that a task estimated to use the given CPU ran on an
+// executor of a pool from start until end. The task is counted in the hour
+// that it finished.
+func (r *Recorder) RecordTask(groupID, pool string, milliCPU int64, start, end time.Time) {
+	r.add(groupID, pool, start, end, func(u *usage, d time.Duration) {
+		u.busyMilliCPUUsec += milliCPU * d.Microseconds()
+	})
+	r.mu.Lock()
+	r.pendingUsage(groupID, pool, end).taskCount++
+	r.mu.Unlock()
+}
+
+// Flush adds the usage recorded since the last flush to the stored records.
+func (r *Recorder) Flush(ctx context.Context) error {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = make(map[recordKey]*usage)
+	r.mu.Unlock()
+
+	var lastErr error
+	for key, u := range pending {
+		if err := r.addToRecord(ctx, key, u); err != nil {
+			lastErr = err
+			// Keep the usage to retry on the next flush.
+			r.mu.Lock()
+			if existing, ok := r.pending[key]; ok {
+				existing.merge(u)
+			} else {
+				r.pending[key] = u
+			}
+			r.mu.Unlock()
+		}
+	}
+	return lastErr
+}
+
+func (r *Recorder) addToRecord(ctx context.Context, key recordKey, u *usage) error {
+	h := r.env.GetDBHandle()
+	update := func() (int64, error) {
+		result := h.WithContext(ctx).Exec(`
+			UPDATE ExecutorUtilization SET
+				registered_executor_usec = registered_executor_usec + ?,
+				capacity_milli_cpu_usec = capacity_milli_cpu_usec + ?,
+				busy_milli_cpu_usec = busy_milli_cpu_usec + ?,
+				task_count = task_count + ?
+			WHERE group_id = ? AND pool = ? AND period_start_usec = ?`,
+			u.registeredExecutorUsec, u.capacityMilliCPUUsec, u.busyMilliCPUUsec, u.taskCount,
+			key.groupID, key.pool, key.periodStartUsec)
+		return result.RowsAffected, result.Error
+	}
+	updated, err := update()
+	if err != nil || updated > 0 {
+		return err
+	}
+	err = h.WithContext(ctx).Create(&tables.ExecutorUtilization{
+		GroupID:                key.groupID,
+		Pool:                   key.pool,
+		PeriodStartUsec:        key.periodStartUsec,
+		RegisteredExecutorUsec: u.registeredExecutorUsec,
+		CapacityMilliCPUUsec:   u.capacityMilliCPUUsec,
+		BusyMilliCPUUsec:       u.busyMilliCPUUsec,
+		TaskCount:              u.taskCount,
+	}).Error
+	if err == nil {
+		return nil
+	}
+	// Another scheduler may have created the record first.
+	updated, updateErr := update()
+	if updateErr != nil || updated == 0 {
+		return err
+	}
+	return nil
+}
+
+func (r *Recorder) deleteExpiredRecords(ctx context.Context) error {
+	cutoff := r.env.GetClock().Now().Add(-retention)
+	return r.env.GetDBHandle().WithContext(ctx).Exec(`DELETE FROM ExecutorUtilization WHERE period_start_usec < ?`, timeutil.ToUsec(cutoff)).Error
+}
+
+func toProto(pool string, periodStartUsec int64, periodUsec int64, u *usage) *scpb.ExecutorUtilization {
+	p := &scpb.ExecutorUtilization{
+		Pool:            pool,
+		PeriodStartUsec: periodStartUsec,
+		TaskCount:       u.taskCount,
+	}
+	if periodUsec > 0 {
+		p.AverageExecutorCount = float64(u.registeredExecutorUsec) / float64(periodUsec)
+		p.AverageAssignableMilliCpu = float64(u.capacityMilliCPUUsec) / float64(periodUsec)
+		p.AverageBusyMilliCpu = float64(u.busyMilliCPUUsec) / float64(periodUsec)
+	}
+	if u.capacityMilliCPUUsec > 0 {
+		idle := 100 * (1 - float64(u.busyMilliCPUUsec)/float64(u.capacityMilliCPUUsec))
+		// Task sizes are estimates, so tasks may appear to use more CPU
+		// than was available.
+		if idle < 0 {
+			idle = 0
+		}
+		p.IdlePercent = idle
+	}
+	return p
+}
+
+// GetExecutorUtilization returns the hourly utilization of the group's
+// executor pools.
+func GetExecutorUtilization(ctx context.Context, env environment.Env, groupID string, req *scpb.GetExecutorUtilizationRequest) (*scpb.GetExecutorUtilizationResponse, error) {
+	now := env.GetClock().Now()
+	startUsec := timeutil.ToUsec(now.Add(-defaultLookback).Truncate(period))
+	if req.GetStartTimeUsec() != 0 {
+		startUsec = req.GetStartTimeUsec()
+	}
+	endUsec := timeutil.ToUsec(now)
+	if req.GetEndTimeUsec() != 0 {
+		endUsec = req.GetEndTimeUsec()
+	}
+
+	q := query_builder.NewQuery(`SELECT * FROM ExecutorUtilization`)
+	q.AddWhereClause("group_id = ?", groupID)
+	if req.GetPool() != "" {
+		q.AddWhereClause("pool = ?", req.GetPool())
+	}
+	q.AddWhereClause("period_start_usec >= ?", startUsec)
+	q.AddWhereClause("period_start_usec < ?", endUsec)
+	q.SetOrderBy("pool, period_start_usec" /*ascending=*/, true)
+	qStr, qArgs := q.Build()
+	var records []*tables.ExecutorUtilization
+	if err := env.GetDBHandle().WithContext(ctx).Raw(qStr, qArgs...).Scan(&records).Error; err != nil {
+		return nil, err
+	}
+
+	rsp := &scpb.GetExecutorUtilizationResponse{}
+	totals := make(map[string]*usage)
+	for _, rec := range records {
+		u := &usage{
+			registeredExecutorUsec: rec.RegisteredExecutorUsec,
+			capacityMilliCPUUsec:   rec.CapacityMilliCPUUsec,
+			busyMilliCPUUsec:       rec.BusyMilliCPUUsec,
+			taskCount:              rec.TaskCount,
+		}
+		rsp.HourlyUtilization = append(rsp.HourlyUtilization, toProto(rec.Pool, rec.PeriodStartUsec, period.Microseconds(), u))
+		total, ok := totals[rec.Pool]
+		if !ok {
+			total = &usage{}
+			totals[rec.Pool] = total
+		}
+		total.merge(u)
+	}
+	pools := make([]string, 0, len(totals))
+	for pool := range totals {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+	for _, pool := range pools {
+		rsp.PoolUtilization = append(rsp.PoolUtilization, toProto(pool, startUsec, endUsec-startUsec, totals[pool]))
+	}
+	return rsp, nil
+}
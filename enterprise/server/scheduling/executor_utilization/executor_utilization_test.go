@@ -0,0 +1,73 @@
+package executor_utilization_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/executor_utilization"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+func TestExecutorUtilization(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	clock := te.UseFakeClock()
+	ctx := context.Background()
+	hour := clock.Now().Truncate(time.Hour)
+	// Recorders of two schedulers add to the same records.
+	r1 := executor_utilization.NewRecorder(te)
+	r2 := executor_utilization.NewRecorder(te)
+
+	// An executor registered for the second half of the first hour and the
+	// first half of the second, and a task spanning both hours.
+	r1.RecordRegistration("GR1", "pool-a", 4000, hour.Add(-30*time.Minute), hour.Add(30*time.Minute))
+	r1.RecordTask("GR1", "pool-a", 2000, hour.Add(-10*time.Minute), hour.Add(10*time.Minute))
+	// Another executor registered for the second half of the second hour.
+	r2.RecordRegistration("GR1", "pool-a", 4000, hour.Add(30*time.Minute), hour.Add(60*time.Minute))
+	// Executors of other pools and groups.
+	r2.RecordRegistration("GR1", "pool-b", 1000, hour, hour.Add(60*time.Minute))
+	r2.RecordRegistration("GR2", "pool-a", 1000, hour, hour.Add(60*time.Minute))
+	require.NoError(t, r1.Flush(ctx))
+	require.NoError(t, r2.Flush(ctx))
+	// Flushing again doesn't count usage twice.
+	require.NoError(t, r1.Flush(ctx))
+
+	clock.Advance(time.Hour)
+	rsp, err := executor_utilization.GetExecutorUtilization(ctx, te, "GR1", &scpb.GetExecutorUtilizationRequest{
+		Pool:          "pool-a",
+		StartTimeUsec: hour.Add(-time.Hour).UnixNano() / 1000,
+		EndTimeUsec:   hour.Add(time.Hour).UnixNano() / 1000,
+	})
+	require.NoError(t, err)
+
+	require.Len(t, rsp.GetHourlyUtilization(), 2)
+	first := rsp.GetHourlyUtilization()[0]
+	assert.Equal(t, hour.Add(-time.Hour).UnixNano()/1000, first.GetPeriodStartUsec())
+	assert.InDelta(t, 0.5, first.GetAverageExecutorCount(), 0.001)
+	assert.InDelta(t, 2000, first.GetAverageAssignableMilliCpu(), 0.001)
+	assert.InDelta(t, 2000.0/6, first.GetAverageBusyMilliCpu(), 0.001)
+	assert.InDelta(t, 100*5.0/6, first.GetIdlePercent(), 0.001)
+	assert.Equal(t, int64(0), first.GetTaskCount(), "tasks should be counted in the hour they finished")
+
+	second := rsp.GetHourlyUtilization()[1]
+	assert.InDelta(t, 1, second.GetAverageExecutorCount(), 0.001)
+	assert.InDelta(t, 100*11.0/12, second.GetIdlePercent(), 0.001)
+	assert.Equal(t, int64(1), second.GetTaskCount())
+
+	require.Len(t, rsp.GetPoolUtilization(), 1)
+	total := rsp.GetPoolUtilization()[0]
+	assert.Equal(t, "pool-a", total.GetPool())
+	assert.InDelta(t, 0.75, total.GetAverageExecutorCount(), 0.001)
+	assert.InDelta(t, 100*(1-40000.0/360000), total.GetIdlePercent(), 0.001)
+
+	rsp, err = executor_utilization.GetExecutorUtilization(ctx, te, "GR1", &scpb.GetExecutorUtilizationRequest{})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetPoolUtilization(), 2)
+	assert.Equal(t, "pool-a", rsp.GetPoolUtilization()[0].GetPool())
+	assert.Equal(t, "pool-b", rsp.GetPoolUtilization()[1].GetPool())
+	assert.Equal(t, float64(100), rsp.GetPoolUtilization()[1].GetIdlePercent())
+}
@@ -111,9 +111,11 @@ func (q *PriorityTaskScheduler) EnqueueTaskReservation(ctx context.Context, req
 
 func propagateExecutionTaskValuesToContext(ctx context.Context, execTask *repb.ExecutionTask) context.Context {
 	ctx = context.WithValue(ctx, "x-buildbuddy-jwt", execTask.GetJwt())
-	rmd := &repb.RequestMetadata{
-		ToolInvocationId: execTask.GetInvocationId(),
+	rmd := &repb.RequestMetadata{}
+	if execTask.GetRequestMetadata() != nil {
+		rmd = proto.Clone(execTask.GetRequestMetadata()).(*repb.RequestMetadata)
 	}
+	rmd.ToolInvocationId = execTask.GetInvocationId()
 	if data, err := proto.Marshal(rmd); err == nil {
 		ctx = context.WithValue(ctx, "build.bazel.remote.execution.v2.requestmetadata-bin", string(data))
 	}
@@ -142,6 +144,7 @@ func (q *PriorityTaskScheduler) runTask(ctx context.Context, execTask *repb.Exec
 func (q *PriorityTaskScheduler) trackTask(res *scpb.EnqueueTaskReservationRequest, cancel *context.CancelFunc) {
 	q.activeTaskCancelFuncs[cancel] = struct{}{}
 	metrics.RemoteExecutionTasksExecuting.Set(float64(len(q.activeTaskCancelFuncs)))
+	metrics.ExecutorTasksInFlight.With(executor.MetricsLabels()).Set(float64(len(q.activeTaskCancelFuncs)))
 	if size := res.GetTaskSize(); size != nil {
 		q.ramBytesUsed += size.GetEstimatedMemoryBytes()
 		q.cpuMillisUsed += size.GetEstimatedMilliCpu()
@@ -153,6 +156,7 @@ func (q *PriorityTaskScheduler) trackTask(res *scpb.EnqueueTaskReservationReques
 func (q *PriorityTaskScheduler) untrackTask(res *scpb.EnqueueTaskReservationRequest, cancel *context.CancelFunc) {
 	delete(q.activeTaskCancelFuncs, cancel)
 	metrics.RemoteExecutionTasksExecuting.Set(float64(len(q.activeTaskCancelFuncs)))
+	metrics.ExecutorTasksInFlight.With(executor.MetricsLabels()).Set(float64(len(q.activeTaskCancelFuncs)))
 	if size := res.GetTaskSize(); size != nil {
 		q.ramBytesUsed -= size.GetEstimatedMemoryBytes()
 		q.cpuMillisUsed -= size.GetEstimatedMilliCpu()
@@ -192,6 +196,7 @@ func (q *PriorityTaskScheduler) handleTask() {
 
 	qLen := q.pq.Len()
 	metrics.RemoteExecutionQueueLength.Set(float64(qLen))
+	metrics.ExecutorQueueLength.With(executor.MetricsLabels()).Set(float64(qLen))
 	if qLen == 0 {
 		return
 	}
@@ -33,6 +33,8 @@ type Options struct {
 	NodeNameOverride string
 	// TESTING ONLY: overrides the API key sent by the client
 	APIKeyOverride string
+	// Capability holds the results of benchmarking the executor, if any.
+	Capability *scpb.ExecutorCapability
 }
 
 func makeExecutionNode(executorID string, options *Options) (*scpb.ExecutionNode, error) {
@@ -66,6 +68,7 @@ func makeExecutionNode(executorID string, options *Options) (*scpb.ExecutionNode
 		Pool:                  resources.GetPoolName(),
 		Version:               version.AppVersion(),
 		ExecutorId:            executorID,
+		Capability:            options.Capability,
 	}, nil
 }
 
@@ -0,0 +1,168 @@
+package scheduler_server_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/scheduler_server"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/fakeclock"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+type leaseEnv struct {
+	ctx    context.Context
+	s      *scheduler_server.SchedulerServer
+	client scpb.SchedulerClient
+	clock  *fakeclock.FakeClock
+	e      *fakeExecutor
+	rexec  *fakeRemoteExecutionService
+}
+
+// getLeaseEnv returns a scheduler whose task leases expire as the clock is
+// advanced, a client connected to it, and an executor which is assigned the
+// task "task1".
+func getLeaseEnv(t *testing.T) *leaseEnv {
+	env := getEnv(t)
+	clock := fakeclock.New(time.Now())
+	env.SetClock(clock)
+	rexec := &fakeRemoteExecutionService{failed: map[string]error{}}
+	env.SetRemoteExecutionService(rexec)
+	s := newScheduler(t, env)
+	e := startExecutor(t, env, "executor1", 16e9)
+	ctx := authenticatedContext(t, env)
+	require.NoError(t, scheduleTask(ctx, t, s, "task1"))
+	require.NotEmpty(t, e.reservations())
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := grpc.NewServer()
+	scpb.RegisterSchedulerServer(srv, s)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return &leaseEnv{ctx: ctx, s: s, client: scpb.NewSchedulerClient(conn), clock: clock, e: e, rexec: rexec}
+}
+
+// leaseTask claims the task, returning the lease stream and the lease ID.
+func leaseTask(ctx context.Context, t *testing.T, client scpb.SchedulerClient, taskID string) (scpb.Scheduler_LeaseTaskClient, string) {
+	stream, err := client.LeaseTask(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&scpb.LeaseTaskRequest{TaskId: taskID}))
+	rsp, err := stream.Recv()
+	require.NoError(t, err)
+	require.NotEmpty(t, rsp.GetSerializedTask())
+	require.NotEmpty(t, rsp.GetLeaseId())
+	return stream, rsp.GetLeaseId()
+}
+
+// advance advances the clock in steps of the interval at which leases are
+// checked, giving the scheduler a chance to expire leases after each step.
+func advance(clock *fakeclock.FakeClock, d time.Duration) {
+	for start := clock.Now(); clock.Since(start) < d; {
+		clock.Advance(5 * time.Second)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLeaseTask_ExpiredLeaseIsReEnqueued(t *testing.T) {
+	le := getLeaseEnv(t)
+	ctx, client, clock, e := le.ctx, le.client, le.clock, le.e
+	stream, _ := leaseTask(ctx, t, client, "task1")
+	enqueued := len(e.reservations())
+
+	// The executor stops renewing the lease, for example because it
+	// crashed, so the task is assigned again once the lease expires.
+	advance(clock, 25*time.Second)
+	assert.Eventually(t, func() bool {
+		return len(e.reservations()) > enqueued
+	}, 5*time.Second, 10*time.Millisecond)
+	enqueued = len(e.reservations())
+
+	// If the executor comes back, the task isn't re-enqueued a second time.
+	require.NoError(t, stream.Send(&scpb.LeaseTaskRequest{TaskId: "task1"}))
+	_, err := stream.Recv()
+	assert.Error(t, err)
+	assert.Len(t, e.reservations(), enqueued)
+}
+
+func TestLeaseTask_RenewedLeaseDoesNotExpire(t *testing.T) {
+	le := getLeaseEnv(t)
+	ctx, client, clock, e := le.ctx, le.client, le.clock, le.e
+	stream, _ := leaseTask(ctx, t, client, "task1")
+	enqueued := len(e.reservations())
+
+	for i := 0; i < 4; i++ {
+		advance(clock, 10*time.Second)
+		require.NoError(t, stream.Send(&scpb.LeaseTaskRequest{TaskId: "task1"}))
+		rsp, err := stream.Recv()
+		require.NoError(t, err)
+		assert.False(t, rsp.GetClosedCleanly())
+	}
+	assert.Len(t, e.reservations(), enqueued)
+
+	require.NoError(t, stream.Send(&scpb.LeaseTaskRequest{TaskId: "task1", Finalize: true}))
+	rsp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.True(t, rsp.GetClosedCleanly())
+
+	// The task is done, so its lease no longer expires.
+	advance(clock, 25*time.Second)
+	assert.Len(t, e.reservations(), enqueued)
+}
+
+func TestReEnqueueTask_WithLease(t *testing.T) {
+	le := getLeaseEnv(t)
+	ctx, s, client, e := le.ctx, le.s, le.client, le.e
+	stream, leaseID := leaseTask(ctx, t, client, "task1")
+	enqueued := len(e.reservations())
+
+	_, err := s.ReEnqueueTask(ctx, &scpb.ReEnqueueTaskRequest{TaskId: "task1", LeaseId: leaseID})
+	require.NoError(t, err)
+	assert.Greater(t, len(e.reservations()), enqueued)
+	enqueued = len(e.reservations())
+
+	// The lease is released, so it can neither be renewed nor used to
+	// re-enqueue the task again.
+	require.NoError(t, stream.Send(&scpb.LeaseTaskRequest{TaskId: "task1"}))
+	_, err = stream.Recv()
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+	_, err = s.ReEnqueueTask(ctx, &scpb.ReEnqueueTaskRequest{TaskId: "task1", LeaseId: leaseID})
+	assert.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition, got %v", err)
+	assert.Len(t, e.reservations(), enqueued)
+}
+
+func TestLeaseTask_ExpiredLeaseOfLastAttemptFailsTask(t *testing.T) {
+	le := getLeaseEnv(t)
+
+	// Every attempt's lease expires, until the task was attempted the
+	// maximum number of times.
+	for attempt := 1; attempt <= 5; attempt++ {
+		enqueued := len(le.e.reservations())
+		leaseTask(le.ctx, t, le.client, "task1")
+		advance(le.clock, 25*time.Second)
+		require.Eventually(t, func() bool {
+			return len(le.e.reservations()) > enqueued || le.rexec.failure("task1") != nil
+		}, 5*time.Second, 10*time.Millisecond, "attempt %d", attempt)
+		if attempt < 5 {
+			require.NoError(t, le.rexec.failure("task1"), "attempt %d", attempt)
+		}
+	}
+
+	// The task is failed and deleted, rather than left unclaimed.
+	err := le.rexec.failure("task1")
+	assert.True(t, status.IsResourceExhaustedError(err), "expected ResourceExhausted, got %v", err)
+	stream, err := le.client.LeaseTask(le.ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&scpb.LeaseTaskRequest{TaskId: "task1"}))
+	_, err = stream.Recv()
+	assert.Error(t, err)
+}
@@ -6,14 +6,18 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/executor_handle"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/executor_utilization"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/resources"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/util/background"
@@ -26,19 +30,28 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
 	"github.com/go-redis/redis/v8"
 	"github.com/golang/protobuf/proto"
+	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/peer"
 
 	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+	ctxpb "github.com/buildbuddy-io/buildbuddy/proto/context"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+	gstatus "google.golang.org/grpc/status"
 )
 
 const (
 	leaseInterval    = 10 * time.Second
 	leaseGracePeriod = 10 * time.Second
 
+	// How often each scheduler checks for task leases which were not renewed
+	// in time. Expired leases are released and the task is re-enqueued.
+	leaseExpirationCheckInterval = 5 * time.Second
+	// Maximum number of expired leases processed per check.
+	maxExpiredLeasesPerCheck = 100
+
 	// This number controls how many reservations the scheduler will
 	// enqueue (across executor nodes) for each task. Typically this
 	// is 2 -- we've increased it to 3 because each executor will
@@ -58,6 +71,10 @@ const (
 	// Number of unclaimed tasks to try to assign to a node that newly joined.
 	tasksToEnqueueOnJoin = 20
 
+	// Maximum number of executor pools described in the error for a task
+	// that no executor can run.
+	maxDiagnosticPools = 10
+
 	// Maximum task TTL in Redis.
 	taskTTL = 24 * time.Hour
 
@@ -68,6 +85,36 @@ const (
 	redisTaskAttempCountField = "attemptCount"
 	redisTaskClaimedField     = "claimed"
 
+	// Redis sorted set of task IDs with an active lease, scored by the
+	// time (in microseconds) at which the lease expires.
+	redisTaskLeasesKey = "taskLeases"
+
+	// Redis sorted set of queued (unclaimed) task IDs which have a maximum
+	// queue duration, scored by the time (in microseconds) at which the task
+	// times out.
+	redisTaskQueueDeadlinesKey = "taskQueueDeadlines"
+
+	// How often each scheduler checks for tasks which exceeded their maximum
+	// queue duration.
+	queueTimeoutCheckInterval = 5 * time.Second
+	// Maximum number of queue timeouts processed per check.
+	maxQueueTimeoutsPerCheck = 100
+
+	// Prefix of Redis lists holding the most recent queue durations (in
+	// microseconds) of tasks with the same scheduling metadata, used to
+	// predict how long new tasks will be queued for.
+	redisQueueDurationsKeyPrefix = "queueDurations"
+	// Number of recent queue durations kept per list.
+	maxQueueDurationSamples = 100
+	// Queue duration lists expire if no tasks are claimed for this long.
+	queueDurationSamplesTTL = 24 * time.Hour
+
+	// Redis hash of cordoned executor IDs, mapped to the ID of the group that
+	// owns the executor.
+	redisExecutorCordonsKey = "executorCordons"
+	// Redis hash of maintenance windows, keyed by "<groupID>/<windowID>".
+	redisMaintenanceWindowsKey = "maintenanceWindows"
+
 	// Maximum number of unclaimed task IDs we track per pool.
 	maxUnclaimedTasksTracked = 1000
 
@@ -82,6 +129,10 @@ const (
 
 	// How often we revalidate credentials for an open registration stream.
 	checkRegistrationCredentialsInterval = 5 * time.Minute
+
+	// How often the time that connected executors have been registered is
+	// recorded for utilization reports.
+	recordRegistrationInterval = 1 * time.Minute
 )
 
 var (
@@ -90,29 +141,82 @@ var (
 		Help:    "WorkQueue wait time [milliseconds]",
 		Buckets: prometheus.ExponentialBuckets(1, 2, 20),
 	})
-	// Claim field is set only if task exists & claim field is not present.
+	// Claim field is set to the lease ID only if task exists & claim field
+	// is not present. The lease expiry is recorded in the leases set, and the
+	// task no longer has a queue deadline.
 	redisAcquireClaim = redis.NewScript(`
 		if redis.call("exists", KEYS[1]) == 1 and redis.call("hexists", KEYS[1], "claimed") == 0 then 
-			return redis.call("hset", KEYS[1], "claimed", "1") 
+			redis.call("zadd", KEYS[2], ARGV[3], ARGV[1])
+			redis.call("zrem", KEYS[3], ARGV[1])
+			return redis.call("hset", KEYS[1], "claimed", ARGV[2]) 
+		else 
+			return 0 
+		end`)
+	// Lease expiry is extended only if the claim is still held by the lease.
+	redisRenewClaim = redis.NewScript(`
+		if redis.call("hget", KEYS[1], "claimed") == ARGV[2] then 
+			redis.call("zadd", KEYS[2], ARGV[3], ARGV[1])
+			return 1
 		else 
 			return 0 
 		end`)
-	// Claim field is removed only if it's present.
+	// Claim field is removed only if it's present and, if a lease ID is
+	// provided, only if it matches.
 	redisReleaseClaim = redis.NewScript(`
-		if redis.call("hget", KEYS[1], "claimed") == "1" then 
+		local claim = redis.call("hget", KEYS[1], "claimed")
+		if claim and (ARGV[2] == "" or claim == ARGV[2]) then 
+			redis.call("zrem", KEYS[2], ARGV[1])
 			return redis.call("hdel", KEYS[1], "claimed")
 		else 
 			return 0 
 		end`)
-	// Task deleted if claim field is present.
+	// Task deleted if claim field is present and, if a lease ID is provided,
+	// only if it matches.
 	redisDeleteClaimedTask = redis.NewScript(`
-		if redis.call("hget", KEYS[1], "claimed") == "1" then 
+		local claim = redis.call("hget", KEYS[1], "claimed")
+		if claim and (ARGV[2] == "" or claim == ARGV[2]) then 
+			redis.call("zrem", KEYS[2], ARGV[1])
 			return redis.call("del", KEYS[1]) 
 		else 
 			return 0 
 		end`)
+	// Claim field is removed if the lease expired before ARGV[2], or the task
+	// is deleted if it was already attempted ARGV[3] times, since it won't be
+	// re-enqueued. Returns 1 if the claim was removed or 2 if the task was
+	// deleted, only to the single caller that expired the lease.
+	redisExpireClaim = redis.NewScript(`
+		local expiry = redis.call("zscore", KEYS[2], ARGV[1])
+		if not expiry or tonumber(expiry) > tonumber(ARGV[2]) then
+			return 0
+		end
+		redis.call("zrem", KEYS[2], ARGV[1])
+		if redis.call("hexists", KEYS[1], "claimed") == 0 then
+			return 0
+		end
+		local attempts = tonumber(redis.call("hget", KEYS[1], "attemptCount") or "0")
+		if attempts >= tonumber(ARGV[3]) then
+			redis.call("del", KEYS[1])
+			return 2
+		end
+		return redis.call("hdel", KEYS[1], "claimed")`)
+	// Task deleted if its queue deadline passed before ARGV[2] and it is
+	// still unclaimed. Returns 1 only to the single caller that deleted it.
+	redisExpireQueuedTask = redis.NewScript(`
+		local deadline = redis.call("zscore", KEYS[2], ARGV[1])
+		if not deadline or tonumber(deadline) > tonumber(ARGV[2]) then
+			return 0
+		end
+		redis.call("zrem", KEYS[2], ARGV[1])
+		if redis.call("exists", KEYS[1]) == 1 and redis.call("hexists", KEYS[1], "claimed") == 0 then
+			return redis.call("del", KEYS[1])
+		end
+		return 0`)
 )
 
+// QueueTimeoutReason is the ErrorInfo reason for tasks which were failed
+// because no executor picked them up within the maximum queue duration.
+const QueueTimeoutReason = "QUEUE_TIMEOUT"
+
 func init() {
 	prometheus.MustRegister(queueWaitTimeMs)
 }
@@ -121,11 +225,19 @@ type executionNode struct {
 	host       string
 	port       int32
 	executorID string
+	// The group that owns the executor, if executor authorization is enabled.
+	groupID string
 	// Optional host:port of the scheduler to which the executor is connected. Only set for executors connecting using
 	// the "task streaming" API.
 	schedulerHostPort string
 	// Optional handle for locally connected executor that can be used to enqueue task reservations.
 	handle executor_handle.ExecutorHandle
+	// Resources assignable to tasks on the executor, used to match tasks'
+	// platform requirements.
+	assignableMemoryBytes int64
+	assignableMilliCPU    int64
+	// Grade from the executor's startup benchmark, or 0 if unknown.
+	capabilityGrade int32
 }
 
 func (en *executionNode) GetAddr() string {
@@ -153,6 +265,10 @@ func (en *executionNode) GetExecutorID() string {
 	return en.executorID
 }
 
+func (en *executionNode) GetCapabilityGrade() int32 {
+	return en.capabilityGrade
+}
+
 // TODO(bduffany): Expand interfaces.ExecutionNode interface to include all
 // executionNode functionality, then use interfaces.ExecutionNode everywhere.
 
@@ -188,6 +304,7 @@ type nodePool struct {
 	mu             sync.Mutex
 	lastFetch      time.Time
 	nodes          []*executionNode
+	cordons        *cordonState
 	key            nodePoolKey
 	unclaimedTasks *unclaimedTasksList
 	// Executors that are currently connected to this instance of the scheduler server.
@@ -232,10 +349,14 @@ func (np *nodePool) fetchExecutionNodes(ctx context.Context) ([]*executionNode,
 			return nil, err
 		}
 		node := &executionNode{
-			host:              en.Host,
-			port:              en.Port,
-			executorID:        en.ExecutorID,
-			schedulerHostPort: en.SchedulerHostPort,
+			host:                  en.Host,
+			port:                  en.Port,
+			executorID:            en.ExecutorID,
+			groupID:               en.GroupID,
+			schedulerHostPort:     en.SchedulerHostPort,
+			assignableMemoryBytes: en.AssignableMemoryBytes,
+			assignableMilliCPU:    en.AssignableMilliCPU,
+			capabilityGrade:       en.CapabilityGrade,
 		}
 		executionNodes = append(executionNodes, node)
 	}
@@ -245,7 +366,10 @@ func (np *nodePool) fetchExecutionNodes(ctx context.Context) ([]*executionNode,
 func (np *nodePool) RefreshNodes(ctx context.Context) error {
 	np.mu.Lock()
 	defer np.mu.Unlock()
-	if np.lastFetch.Unix() > time.Now().Add(-1*maxAllowedExecutionNodesStaleness).Unix() && len(np.nodes) > 0 {
+	// The app's clock is used, so that maintenance windows start and end
+	// according to the same clock that they're created with.
+	now := np.env.GetClock().Now()
+	if np.lastFetch.Unix() > now.Add(-1*maxAllowedExecutionNodesStaleness).Unix() && len(np.nodes) > 0 {
 		return nil
 	}
 	nodes, err := np.fetchExecutionNodes(ctx)
@@ -253,10 +377,41 @@ func (np *nodePool) RefreshNodes(ctx context.Context) error {
 		return err
 	}
 	np.nodes = nodes
-	np.lastFetch = time.Now()
+	np.lastFetch = now
+	cordons, err := fetchCordonState(ctx, np.env.GetRemoteExecutionRedisClient(), np.lastFetch)
+	if err != nil {
+		// Keep scheduling with the previous cordon state rather than failing.
+		log.Warningf("Could not fetch executor cordons for pool %+v: %s", np.key, err)
+	} else {
+		np.cordons = cordons
+	}
 	return nil
 }
 
+// IsCordoned returns whether the given node should not be assigned new tasks.
+func (np *nodePool) IsCordoned(node *executionNode) bool {
+	np.mu.Lock()
+	defer np.mu.Unlock()
+	return np.cordons.isCordoned(node.groupID, np.key.pool, node.GetExecutorID())
+}
+
+// uncordonedNodes returns the given nodes excluding any that are cordoned.
+func (np *nodePool) uncordonedNodes(nodes []*executionNode) []*executionNode {
+	np.mu.Lock()
+	cordons := np.cordons
+	np.mu.Unlock()
+	if cordons.empty() {
+		return nodes
+	}
+	out := make([]*executionNode, 0, len(nodes))
+	for _, node := range nodes {
+		if !cordons.isCordoned(node.groupID, np.key.pool, node.GetExecutorID()) {
+			out = append(out, node)
+		}
+	}
+	return out
+}
+
 func (np *nodePool) NodeCount(ctx context.Context) (int, error) {
 	if err := np.RefreshNodes(ctx); err != nil {
 		return 0, err
@@ -264,7 +419,25 @@ func (np *nodePool) NodeCount(ctx context.Context) (int, error) {
 	return len(np.nodes), nil
 }
 
-func (np *nodePool) AddConnectedExecutor(id string, handle executor_handle.ExecutorHandle) bool {
+// cachedNodes returns the pool's nodes as of when they were last fetched,
+// fetching them only if they never have been.
+func (np *nodePool) cachedNodes(ctx context.Context) ([]*executionNode, error) {
+	np.mu.Lock()
+	fetched := !np.lastFetch.IsZero()
+	nodes := np.nodes
+	np.mu.Unlock()
+	if fetched {
+		return nodes, nil
+	}
+	if err := np.RefreshNodes(ctx); err != nil {
+		return nil, err
+	}
+	np.mu.Lock()
+	defer np.mu.Unlock()
+	return np.nodes, nil
+}
+
+func (np *nodePool) AddConnectedExecutor(node *scpb.ExecutionNode, handle executor_handle.ExecutorHandle) bool {
 	np.mu.Lock()
 	defer np.mu.Unlock()
 	for _, e := range np.connectedExecutors {
@@ -273,8 +446,12 @@ func (np *nodePool) AddConnectedExecutor(id string, handle executor_handle.Execu
 		}
 	}
 	np.connectedExecutors = append(np.connectedExecutors, &executionNode{
-		executorID: id,
-		handle:     handle,
+		executorID:            node.GetExecutorId(),
+		groupID:               handle.GroupID(),
+		handle:                handle,
+		assignableMemoryBytes: node.GetAssignableMemoryBytes(),
+		assignableMilliCPU:    node.GetAssignableMilliCpu(),
+		capabilityGrade:       node.GetCapability().GetGrade(),
 	})
 	return true
 }
@@ -306,6 +483,142 @@ func (np *nodePool) FindConnectedExecutorByID(executorID string) *executionNode
 	return nil
 }
 
+// attributes returns the attributes of the given node in this pool, for
+// matching platform requirements.
+func (np *nodePool) attributes(node *executionNode) *platform.ExecutorAttributes {
+	return &platform.ExecutorAttributes{
+		OS:                    np.key.os,
+		Arch:                  np.key.arch,
+		Pool:                  np.key.pool,
+		AssignableMemoryBytes: node.assignableMemoryBytes,
+		AssignableMilliCPU:    node.assignableMilliCPU,
+	}
+}
+
+// matchingNodes returns the given nodes which satisfy all of the given
+// requirements.
+func (np *nodePool) matchingNodes(nodes []*executionNode, reqs []*platform.Requirement) []*executionNode {
+	if len(reqs) == 0 {
+		return nodes
+	}
+	out := make([]*executionNode, 0, len(nodes))
+	for _, node := range nodes {
+		if len(platform.UnsatisfiedRequirements(reqs, np.attributes(node))) == 0 {
+			out = append(out, node)
+		}
+	}
+	return out
+}
+
+// cordonState is a snapshot of the executors that should not be assigned new
+// tasks, either because they were cordoned explicitly or because they are
+// covered by an active maintenance window.
+type cordonState struct {
+	executorIDs map[string]struct{}
+	windows     []*groupMaintenanceWindow
+}
+
+type groupMaintenanceWindow struct {
+	groupID string
+	window  *scpb.MaintenanceWindow
+}
+
+func (c *cordonState) empty() bool {
+	return c == nil || (len(c.executorIDs) == 0 && len(c.windows) == 0)
+}
+
+func (c *cordonState) isCordoned(groupID, pool, executorID string) bool {
+	if c == nil {
+		return false
+	}
+	if _, ok := c.executorIDs[executorID]; ok {
+		return true
+	}
+	for _, w := range c.windows {
+		if w.groupID == groupID && windowCoversExecutor(w.window, pool, executorID) {
+			return true
+		}
+	}
+	return false
+}
+
+func windowCoversExecutor(w *scpb.MaintenanceWindow, pool, executorID string) bool {
+	if !strings.EqualFold(w.GetPool(), pool) {
+		return false
+	}
+	if len(w.GetExecutorId()) == 0 {
+		return true
+	}
+	for _, id := range w.GetExecutorId() {
+		if id == executorID {
+			return true
+		}
+	}
+	return false
+}
+
+func maintenanceWindowField(groupID, windowID string) string {
+	return groupID + "/" + windowID
+}
+
+// readMaintenanceWindows returns all maintenance windows which have not yet
+// ended. Windows that have ended are deleted.
+func readMaintenanceWindows(ctx context.Context, rdb *redis.Client, now time.Time) ([]*groupMaintenanceWindow, error) {
+	vals, err := rdb.HGetAll(ctx, redisMaintenanceWindowsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	nowUsec := timeutil.ToUsec(now)
+	var windows []*groupMaintenanceWindow
+	var ended []string
+	for field, val := range vals {
+		w := &scpb.MaintenanceWindow{}
+		if err := proto.Unmarshal([]byte(val), w); err != nil {
+			log.Warningf("Could not unmarshal maintenance window %q: %s", field, err)
+			continue
+		}
+		if w.GetEndTimeUsec() <= nowUsec {
+			ended = append(ended, field)
+			continue
+		}
+		windows = append(windows, &groupMaintenanceWindow{
+			groupID: strings.TrimSuffix(field, "/"+w.GetWindowId()),
+			window:  w,
+		})
+	}
+	if len(ended) > 0 {
+		if err := rdb.HDel(ctx, redisMaintenanceWindowsKey, ended...).Err(); err != nil {
+			log.Warningf("Could not delete ended maintenance windows: %s", err)
+		}
+	}
+	sort.Slice(windows, func(i, j int) bool {
+		return windows[i].window.GetStartTimeUsec() < windows[j].window.GetStartTimeUsec()
+	})
+	return windows, nil
+}
+
+func fetchCordonState(ctx context.Context, rdb *redis.Client, now time.Time) (*cordonState, error) {
+	ids, err := rdb.HKeys(ctx, redisExecutorCordonsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	windows, err := readMaintenanceWindows(ctx, rdb, now)
+	if err != nil {
+		return nil, err
+	}
+	state := &cordonState{executorIDs: make(map[string]struct{}, len(ids))}
+	for _, id := range ids {
+		state.executorIDs[id] = struct{}{}
+	}
+	nowUsec := timeutil.ToUsec(now)
+	for _, w := range windows {
+		if w.window.GetStartTimeUsec() <= nowUsec {
+			state.windows = append(state.windows, w)
+		}
+	}
+	return state, nil
+}
+
 // unclaimedTasksList maintains a subset of unclaimed task IDs that can be given out to newly registered executors.
 // Only the most recent maxUnclaimedTasksTracked task IDs are kept.
 type unclaimedTasksList struct {
@@ -351,6 +664,12 @@ func (l *unclaimedTasksList) removeTask(taskID string) {
 	l.taskList.Remove(e)
 }
 
+func (l *unclaimedTasksList) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.taskList.Len()
+}
+
 func (l *unclaimedTasksList) sample(n int) []string {
 	l.mu.Lock()
 	unclaimed := make([]string, 0, l.taskList.Len())
@@ -382,17 +701,18 @@ type persistedTask struct {
 
 type schedulerClient struct {
 	scpb.SchedulerClient
-	conn       *grpc.ClientConn
+	conn       *grpc_client.ClientConnPool
 	lastAccess time.Time
 }
 
 type schedulerClientCache struct {
-	mu      sync.Mutex
-	clients map[string]schedulerClient
+	mu       sync.Mutex
+	clients  map[string]schedulerClient
+	poolSize int
 }
 
-func newSchedulerClientCache() *schedulerClientCache {
-	cache := &schedulerClientCache{clients: make(map[string]schedulerClient)}
+func newSchedulerClientCache(poolSize int) *schedulerClientCache {
+	cache := &schedulerClientCache{clients: make(map[string]schedulerClient), poolSize: poolSize}
 	cache.startExpirer()
 	return cache
 }
@@ -421,7 +741,7 @@ func (c *schedulerClientCache) get(schedulerAddr string) (schedulerClient, error
 	if !ok {
 		log.Infof("Creating new scheduler client for %q", schedulerAddr)
 		// This is non-blocking so it's OK to hold the lock.
-		conn, err := grpc_client.DialTarget(schedulerAddr)
+		conn, err := grpc_client.DialTargetPooled(schedulerAddr, c.poolSize)
 		if err != nil {
 			return schedulerClient{}, status.UnavailableErrorf("could not dial scheduler: %s", err)
 		}
@@ -453,6 +773,12 @@ type SchedulerServer struct {
 	// If enabled, executors will be required to present an API key with appropriate capabilities in order to register.
 	requireExecutorAuthorization bool
 
+	// Records the capacity and usage of connected executors.
+	utilization *executor_utilization.Recorder
+
+	// The key that executor hosts are hashed with in snapshots.
+	snapshotHostHashKey []byte
+
 	mu    sync.RWMutex
 	pools map[nodePoolKey]*nodePool
 }
@@ -468,9 +794,17 @@ func NewSchedulerServerWithOptions(env environment.Env, options *Options) (*Sche
 
 	enableUserOwnedExecutors := false
 	requireExecutorAuthorization := false
+	configuredHostHashKey := ""
+	schedulerConnectionPoolSize := 0
 	if conf := env.GetConfigurator().GetRemoteExecutionConfig(); conf != nil {
 		enableUserOwnedExecutors = conf.EnableUserOwnedExecutors
 		requireExecutorAuthorization = conf.RequireExecutorAuthorization
+		configuredHostHashKey = conf.SnapshotHostHashKey
+		schedulerConnectionPoolSize = conf.SchedulerConnectionPoolSize
+	}
+	hostHashKey, err := snapshotHostHashKey(configuredHostHashKey)
+	if err != nil {
+		return nil, err
 	}
 
 	if options.RequireExecutorAuthorization {
@@ -493,10 +827,12 @@ func NewSchedulerServerWithOptions(env environment.Env, options *Options) (*Sche
 		pools:                        make(map[nodePoolKey]*nodePool),
 		rdb:                          env.GetRemoteExecutionRedisClient(),
 		taskRouter:                   taskRouter,
-		schedulerClientCache:         newSchedulerClientCache(),
+		schedulerClientCache:         newSchedulerClientCache(schedulerConnectionPoolSize),
 		shuttingDown:                 shuttingDown,
 		enableUserOwnedExecutors:     enableUserOwnedExecutors,
 		requireExecutorAuthorization: requireExecutorAuthorization,
+		utilization:                  executor_utilization.NewRecorder(env),
+		snapshotHostHashKey:          hostHashKey,
 	}
 	ownHostname, err := resources.GetMyHostname()
 	if err != nil {
@@ -512,6 +848,11 @@ func NewSchedulerServerWithOptions(env environment.Env, options *Options) (*Sche
 	if ownHostname != "" && ownPort != 0 {
 		s.ownHostPort = fmt.Sprintf("%s:%d", ownHostname, ownPort)
 	}
+	s.startLeaseExpirer()
+	s.startQueueTimeoutChecker()
+	if env.GetDBHandle() != nil {
+		s.utilization.Start()
+	}
 	return s, nil
 }
 
@@ -590,7 +931,7 @@ func (s *SchedulerServer) AddConnectedExecutor(ctx context.Context, handle execu
 	}
 
 	pool := s.getOrCreatePool(nodePoolKey)
-	newExecutor := pool.AddConnectedExecutor(node.GetExecutorId(), handle)
+	newExecutor := pool.AddConnectedExecutor(node, handle)
 	if !newExecutor {
 		return nil
 	}
@@ -598,9 +939,13 @@ func (s *SchedulerServer) AddConnectedExecutor(ctx context.Context, handle execu
 	log.Infof("Scheduler: registered worker node: %q %+v", addr, nodePoolKey)
 
 	en := &executionNode{
-		host:       node.GetHost(),
-		port:       node.GetPort(),
-		executorID: node.GetExecutorId(),
+		host:                  node.GetHost(),
+		port:                  node.GetPort(),
+		executorID:            node.GetExecutorId(),
+		groupID:               handle.GroupID(),
+		assignableMemoryBytes: node.GetAssignableMemoryBytes(),
+		assignableMilliCPU:    node.GetAssignableMilliCpu(),
+		capabilityGrade:       node.GetCapability().GetGrade(),
 	}
 	go func() {
 		if err := s.assignWorkToNode(ctx, handle, en, nodePoolKey); err != nil {
@@ -645,6 +990,7 @@ func (s *SchedulerServer) insertOrUpdateNode(ctx context.Context, executorHandle
 		OS:                    node.GetOs(),
 		Arch:                  node.GetArch(),
 		Pool:                  node.GetPool(),
+		CapabilityGrade:       node.GetCapability().GetGrade(),
 		SchedulerHostPort:     schedulerAddr,
 		GroupID:               groupID,
 		Version:               node.GetVersion(),
@@ -669,10 +1015,19 @@ func (s *SchedulerServer) insertOrUpdateNode(ctx context.Context, executorHandle
 
 func (s *SchedulerServer) processExecutorStream(ctx context.Context, handle executor_handle.ExecutorHandle) error {
 	var registeredNode *scpb.ExecutionNode
+	var registeredSince time.Time
+	recordRegistration := func() {
+		now := s.env.GetClock().Now()
+		if registeredNode != nil {
+			s.utilization.RecordRegistration(handle.GroupID(), registeredNode.GetPool(), registeredNode.GetAssignableMilliCpu(), registeredSince, now)
+		}
+		registeredSince = now
+	}
 	defer func() {
 		if registeredNode == nil {
 			return
 		}
+		recordRegistration()
 		s.RemoveConnectedExecutor(ctx, handle, registeredNode)
 	}()
 
@@ -694,6 +1049,9 @@ func (s *SchedulerServer) processExecutorStream(ctx context.Context, handle exec
 	}()
 
 	checkCredentialsTicker := time.NewTicker(checkRegistrationCredentialsInterval)
+	defer checkCredentialsTicker.Stop()
+	recordRegistrationTicker := time.NewTicker(recordRegistrationInterval)
+	defer recordRegistrationTicker.Stop()
 
 	for {
 		select {
@@ -708,7 +1066,12 @@ func (s *SchedulerServer) processExecutorStream(ctx context.Context, handle exec
 			if err := s.AddConnectedExecutor(ctx, handle, registration); err != nil {
 				return err
 			}
+			// Record the time registered with the previous registration,
+			// since the executor's pool or size may have changed.
+			recordRegistration()
 			registeredNode = registration
+		case <-recordRegistrationTicker.C:
+			recordRegistration()
 		case <-checkCredentialsTicker.C:
 			if _, err := s.authorizeExecutor(ctx); err != nil {
 				if status.IsPermissionDeniedError(err) || status.IsUnauthenticatedError(err) {
@@ -793,8 +1156,21 @@ func (s *SchedulerServer) assignWorkToNode(ctx context.Context, handle executor_
 		return nil
 	}
 
+	attrs := &platform.ExecutorAttributes{
+		OS:                    nodePoolKey.os,
+		Arch:                  nodePoolKey.arch,
+		Pool:                  nodePoolKey.pool,
+		AssignableMemoryBytes: node.assignableMemoryBytes,
+		AssignableMilliCPU:    node.assignableMilliCPU,
+	}
 	var reqs []*scpb.EnqueueTaskReservationRequest
 	for _, task := range tasks {
+		// Tasks with requirements may be tracked in several pools or need more
+		// resources than this node has, so skip any that it can't run.
+		platformReqs, err := platform.ParseRequirementList(task.metadata.GetRequirements())
+		if err != nil || len(platform.UnsatisfiedRequirements(platformReqs, attrs)) > 0 {
+			continue
+		}
 		req := &scpb.EnqueueTaskReservationRequest{
 			TaskId:   task.taskID,
 			TaskSize: task.metadata.GetTaskSize(),
@@ -838,7 +1214,7 @@ func (s *SchedulerServer) insertTask(ctx context.Context, taskID string, metadat
 	props := map[string]interface{}{
 		redisTaskProtoField:       serializedTask,
 		redisTaskMetadataField:    serializedMetadata,
-		redisTaskQueuedAtUsec:     timeutil.ToUsec(time.Now()),
+		redisTaskQueuedAtUsec:     timeutil.ToUsec(s.env.GetClock().Now()),
 		redisTaskAttempCountField: 0,
 	}
 	c, err := s.rdb.HSet(ctx, redisKeyForTask(taskID), props).Result()
@@ -855,12 +1231,49 @@ func (s *SchedulerServer) insertTask(ctx context.Context, taskID string, metadat
 	if !ok {
 		return status.DataLossErrorf("task %s disappeared before we could set TTL", taskID)
 	}
-	return nil
+	return s.setQueueDeadline(ctx, taskID, metadata, s.env.GetClock().Now())
+}
+
+// maxQueueDuration returns how long a task with the given metadata may be
+// queued for before it is failed, or 0 if there is no limit.
+func (s *SchedulerServer) maxQueueDuration(metadata *scpb.SchedulingMetadata) time.Duration {
+	cfg := s.env.GetConfigurator().GetRemoteExecutionConfig()
+	seconds := cfg.MaxQueueDurationSeconds
+	bestScore := 0
+	for _, o := range cfg.QueueTimeouts {
+		if (o.GroupID != "" && o.GroupID != metadata.GetGroupId()) || (o.Pool != "" && o.Pool != metadata.GetPool()) {
+			continue
+		}
+		// Prefer overrides matching the group over those matching the pool.
+		score := 1
+		if o.GroupID != "" {
+			score += 2
+		}
+		if o.Pool != "" {
+			score++
+		}
+		if score > bestScore {
+			bestScore = score
+			seconds = o.MaxQueueDurationSeconds
+		}
+	}
+	return time.Duration(seconds) * time.Second
 }
 
-func (s *SchedulerServer) deleteClaimedTask(ctx context.Context, taskID string) error {
+// setQueueDeadline records when the given task, queued at the given time,
+// should time out if it hasn't been claimed by then.
+func (s *SchedulerServer) setQueueDeadline(ctx context.Context, taskID string, metadata *scpb.SchedulingMetadata, queuedAt time.Time) error {
+	maxDuration := s.maxQueueDuration(metadata)
+	if maxDuration <= 0 {
+		return nil
+	}
+	deadlineUsec := timeutil.ToUsec(queuedAt.Add(maxDuration))
+	return s.rdb.ZAdd(ctx, redisTaskQueueDeadlinesKey, &redis.Z{Score: float64(deadlineUsec), Member: taskID}).Err()
+}
+
+func (s *SchedulerServer) deleteClaimedTask(ctx context.Context, taskID, leaseID string) error {
 	// The script will return 1 if the task is claimed & has been deleted.
-	r, err := redisDeleteClaimedTask.Run(ctx, s.rdb, []string{redisKeyForTask(taskID)}).Result()
+	r, err := redisDeleteClaimedTask.Run(ctx, s.rdb, []string{redisKeyForTask(taskID), redisTaskLeasesKey}, taskID, leaseID).Result()
 	if err != nil {
 		return err
 	}
@@ -870,9 +1283,9 @@ func (s *SchedulerServer) deleteClaimedTask(ctx context.Context, taskID string)
 	return nil
 }
 
-func (s *SchedulerServer) unclaimTask(ctx context.Context, taskID string) error {
+func (s *SchedulerServer) unclaimTask(ctx context.Context, taskID, leaseID string) error {
 	// The script will return 1 if the task is claimed & claim has been released.
-	r, err := redisReleaseClaim.Run(ctx, s.rdb, []string{redisKeyForTask(taskID)}).Result()
+	r, err := redisReleaseClaim.Run(ctx, s.rdb, []string{redisKeyForTask(taskID), redisTaskLeasesKey}, taskID, leaseID).Result()
 	if err != nil {
 		return err
 	}
@@ -882,8 +1295,12 @@ func (s *SchedulerServer) unclaimTask(ctx context.Context, taskID string) error
 	return nil
 }
 
-func (s *SchedulerServer) claimTask(ctx context.Context, taskID string, claimTime time.Time) error {
-	r, err := redisAcquireClaim.Run(ctx, s.rdb, []string{redisKeyForTask(taskID)}).Result()
+func leaseExpiryUsec(renewTime time.Time) int64 {
+	return timeutil.ToUsec(renewTime.Add(leaseInterval + leaseGracePeriod))
+}
+
+func (s *SchedulerServer) claimTask(ctx context.Context, taskID, leaseID string, claimTime time.Time) error {
+	r, err := redisAcquireClaim.Run(ctx, s.rdb, []string{redisKeyForTask(taskID), redisTaskLeasesKey, redisTaskQueueDeadlinesKey}, taskID, leaseID, leaseExpiryUsec(claimTime)).Result()
 	if err != nil {
 		return err
 	}
@@ -901,6 +1318,172 @@ func (s *SchedulerServer) claimTask(ctx context.Context, taskID string, claimTim
 	return nil
 }
 
+func (s *SchedulerServer) renewTaskLease(ctx context.Context, taskID, leaseID string, renewTime time.Time) error {
+	r, err := redisRenewClaim.Run(ctx, s.rdb, []string{redisKeyForTask(taskID), redisTaskLeasesKey}, taskID, leaseID, leaseExpiryUsec(renewTime)).Result()
+	if err != nil {
+		return err
+	}
+	if c, ok := r.(int64); !ok || c != 1 {
+		return status.NotFoundErrorf("lease for task %q is no longer held", taskID)
+	}
+	return nil
+}
+
+// expireTaskLeases releases the claim on any task whose lease was not renewed
+// before it expired, and re-enqueues the task. This makes recovery from an
+// executor (or scheduler) crash independent of any single LeaseTask stream
+// noticing that the executor went away.
+func (s *SchedulerServer) expireTaskLeases(ctx context.Context) {
+	nowUsec := timeutil.ToUsec(s.env.GetClock().Now())
+	taskIDs, err := s.rdb.ZRangeByScore(ctx, redisTaskLeasesKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   fmt.Sprintf("%d", nowUsec),
+		Count: maxExpiredLeasesPerCheck,
+	}).Result()
+	if err != nil {
+		log.Warningf("Could not fetch expired task leases: %s", err)
+		return
+	}
+	for _, taskID := range taskIDs {
+		r, err := redisExpireClaim.Run(ctx, s.rdb, []string{redisKeyForTask(taskID), redisTaskLeasesKey}, taskID, nowUsec, maxTaskAttemptCount).Result()
+		if err != nil {
+			log.Warningf("Could not expire lease for task %q: %s", taskID, err)
+			continue
+		}
+		switch c, _ := r.(int64); c {
+		case 1:
+			log.Warningf("Lease for task %q expired. Will ReEnqueue!", taskID)
+			if _, err := s.ReEnqueueTask(ctx, &scpb.ReEnqueueTaskRequest{TaskId: taskID}); err != nil {
+				log.Errorf("Could not re-enqueue task %q after lease expiry: %s", taskID, err)
+			}
+		case 2:
+			s.failExhaustedTask(ctx, taskID)
+		default:
+			// The lease was renewed, released, or expired by another
+			// scheduler in the meantime.
+		}
+	}
+}
+
+// failExhaustedTask fails a task which was deleted because the lease of its
+// last allowed attempt expired.
+func (s *SchedulerServer) failExhaustedTask(ctx context.Context, taskID string) {
+	err := status.ResourceExhaustedErrorf("Task %q was already attempted %d times, and the lease of its last attempt expired.", taskID, maxTaskAttemptCount)
+	log.Warningf("Failing task: %s", err)
+	rexec := s.env.GetRemoteExecutionService()
+	if rexec == nil {
+		return
+	}
+	if err := rexec.MarkExecutionFailed(ctx, taskID, err); err != nil {
+		log.Warningf("Could not mark task %q as failed: %s", taskID, err)
+	}
+}
+
+func (s *SchedulerServer) expireQueuedTasks(ctx context.Context) {
+	now := s.env.GetClock().Now()
+	nowUsec := timeutil.ToUsec(now)
+	taskIDs, err := s.rdb.ZRangeByScore(ctx, redisTaskQueueDeadlinesKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   fmt.Sprintf("%d", nowUsec),
+		Count: maxQueueTimeoutsPerCheck,
+	}).Result()
+	if err != nil {
+		log.Warningf("Could not fetch queue deadlines: %s", err)
+		return
+	}
+	for _, taskID := range taskIDs {
+		// Read the task before it is deleted, so that the failure can be
+		// reported with its queue stats.
+		task, err := s.readTask(ctx, taskID)
+		if err != nil && !status.IsNotFoundError(err) {
+			log.Warningf("Could not read timed out task %q: %s", taskID, err)
+			continue
+		}
+		r, err := redisExpireQueuedTask.Run(ctx, s.rdb, []string{redisKeyForTask(taskID), redisTaskQueueDeadlinesKey}, taskID, nowUsec).Result()
+		if err != nil {
+			log.Warningf("Could not expire queued task %q: %s", taskID, err)
+			continue
+		}
+		if c, ok := r.(int64); !ok || c != 1 || task == nil {
+			// The task was claimed, re-queued, or already timed out by
+			// another scheduler in the meantime.
+			continue
+		}
+		s.failQueuedTask(ctx, task, now)
+	}
+}
+
+// failQueuedTask fails a task which was deleted because it exceeded its
+// maximum queue duration.
+func (s *SchedulerServer) failQueuedTask(ctx context.Context, task *persistedTask, now time.Time) {
+	metadata := task.metadata
+	maxDuration := s.maxQueueDuration(metadata)
+	s.removeUnclaimedTask(metadata, task.taskID)
+
+	// Count the tasks waiting in, and executors registered to, the pools the
+	// task could have run in, to help explain the timeout.
+	queuedTasks, executors := 0, 0
+	if reqs, err := platform.ParseRequirementList(metadata.GetRequirements()); err == nil {
+		if pools, err := s.candidatePools(ctx, metadata, reqs); err == nil {
+			for _, np := range pools {
+				queuedTasks += np.unclaimedTasks.len()
+				n, _ := np.NodeCount(ctx)
+				executors += n
+			}
+		}
+	}
+
+	err := status.ResourceExhaustedErrorf(
+		"Task %q was not picked up by an executor within the maximum queue duration of %s (queued for %s). "+
+			"Executor pool %q currently has %d other queued task(s) and %d registered executor(s).",
+		task.taskID, maxDuration, now.Sub(task.queuedTimestamp).Round(time.Second), metadata.GetPool(), queuedTasks, executors)
+	err = status.WithErrorInfo(err, QueueTimeoutReason, map[string]string{
+		"pool":               metadata.GetPool(),
+		"max_queue_duration": maxDuration.String(),
+		"queued_tasks":       strconv.Itoa(queuedTasks),
+		"executors":          strconv.Itoa(executors),
+	})
+	log.Warningf("Failing task: %s", err)
+	metrics.RemoteExecutionQueueTimeoutCount.With(prometheus.Labels{
+		metrics.GroupID:           metadata.GetGroupId(),
+		metrics.ExecutorPoolLabel: metadata.GetPool(),
+	}).Inc()
+
+	rexec := s.env.GetRemoteExecutionService()
+	if rexec == nil {
+		return
+	}
+	if err := rexec.MarkExecutionFailed(ctx, task.taskID, err); err != nil {
+		log.Warningf("Could not mark timed out task %q as failed: %s", task.taskID, err)
+	}
+}
+
+func (s *SchedulerServer) startQueueTimeoutChecker() {
+	go func() {
+		for {
+			select {
+			case <-s.shuttingDown:
+				return
+			case <-s.env.GetClock().After(queueTimeoutCheckInterval):
+				s.expireQueuedTasks(context.Background())
+			}
+		}
+	}()
+}
+
+func (s *SchedulerServer) startLeaseExpirer() {
+	go func() {
+		for {
+			select {
+			case <-s.shuttingDown:
+				return
+			case <-s.env.GetClock().After(leaseExpirationCheckInterval):
+				s.expireTaskLeases(context.Background())
+			}
+		}
+	}()
+}
+
 func (s *SchedulerServer) readTasks(ctx context.Context, taskIDs []string) ([]*persistedTask, error) {
 	var tasks []*persistedTask
 
@@ -944,6 +1527,117 @@ func (s *SchedulerServer) getOrCreatePool(key nodePoolKey) *nodePool {
 	return nodePool
 }
 
+// constrainedAttributes returns the os, arch, and pool attributes which are
+// constrained by the given requirements rather than by exact values in the
+// scheduling metadata.
+func constrainedAttributes(reqs []*platform.Requirement) map[string]bool {
+	attrs := map[string]bool{}
+	for _, r := range reqs {
+		switch r.Attribute {
+		case platform.OSAttribute, platform.ArchAttribute, platform.PoolAttribute:
+			attrs[r.Attribute] = true
+		}
+	}
+	return attrs
+}
+
+// fetchPoolKeys returns the keys of all pools with registered executors that
+// are available to the given group.
+func (s *SchedulerServer) fetchPoolKeys(ctx context.Context, groupID string) ([]nodePoolKey, error) {
+	db := s.env.GetDBHandle()
+	if db == nil {
+		return nil, status.FailedPreconditionError("database not configured")
+	}
+	sql := `SELECT DISTINCT os, arch, pool FROM ExecutionNodes`
+	args := []interface{}{}
+	if groupID != "" {
+		sql += ` WHERE group_id = ?`
+		args = append(args, groupID)
+	}
+	rows, err := db.WithContext(ctx).Raw(sql, args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []nodePoolKey
+	for rows.Next() {
+		key := nodePoolKey{groupID: groupID}
+		if err := rows.Scan(&key.os, &key.arch, &key.pool); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// candidatePools returns the pools of executors which may be able to run a
+// task with the given scheduling metadata and requirements. This is the pool
+// selected by the exact os, arch, and pool in the metadata unless any of those
+// are constrained by requirements instead, in which case it is every pool
+// with registered executors whose attributes satisfy the requirements.
+func (s *SchedulerServer) candidatePools(ctx context.Context, metadata *scpb.SchedulingMetadata, reqs []*platform.Requirement) ([]*nodePool, error) {
+	key := nodePoolKey{
+		os:      metadata.GetOs(),
+		arch:    metadata.GetArch(),
+		pool:    metadata.GetPool(),
+		groupID: metadata.GetGroupId(),
+	}
+	constrained := constrainedAttributes(reqs)
+	if len(constrained) == 0 {
+		return []*nodePool{s.getOrCreatePool(key)}, nil
+	}
+	keys, err := s.fetchPoolKeys(ctx, key.groupID)
+	if err != nil {
+		return nil, err
+	}
+	var pools []*nodePool
+	for _, k := range keys {
+		if (!constrained[platform.OSAttribute] && k.os != key.os) ||
+			(!constrained[platform.ArchAttribute] && k.arch != key.arch) ||
+			(!constrained[platform.PoolAttribute] && k.pool != key.pool) {
+			continue
+		}
+		attrs := &platform.ExecutorAttributes{OS: k.os, Arch: k.arch, Pool: k.pool}
+		matches := true
+		for _, r := range reqs {
+			if constrained[r.Attribute] && !r.Matches(attrs) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			pools = append(pools, s.getOrCreatePool(k))
+		}
+	}
+	return pools, nil
+}
+
+// removeUnclaimedTask stops tracking the given task as unclaimed in all of
+// the pools that it may have been enqueued in.
+func (s *SchedulerServer) removeUnclaimedTask(metadata *scpb.SchedulingMetadata, taskID string) {
+	reqs, err := platform.ParseRequirementList(metadata.GetRequirements())
+	if err != nil || len(constrainedAttributes(reqs)) > 0 {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		for key, nodePool := range s.pools {
+			if key.groupID == metadata.GetGroupId() {
+				nodePool.unclaimedTasks.removeTask(taskID)
+			}
+		}
+		return
+	}
+	key := nodePoolKey{
+		os:      metadata.GetOs(),
+		arch:    metadata.GetArch(),
+		pool:    metadata.GetPool(),
+		groupID: metadata.GetGroupId(),
+	}
+	nodePool, ok := s.getPool(key)
+	if ok {
+		nodePool.unclaimedTasks.removeTask(taskID)
+	}
+}
+
 func (s *SchedulerServer) sampleUnclaimedTasks(ctx context.Context, count int, nodePoolKey nodePoolKey) ([]*persistedTask, error) {
 	nodePool, ok := s.getPool(nodePoolKey)
 	if !ok {
@@ -1029,16 +1723,35 @@ func (s *SchedulerServer) readTask(ctx context.Context, taskID string) (*persist
 // TODO(vadim): we should verify that the executor is authorized to read the task
 func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error {
 	ctx := stream.Context()
-	lastCheckin := time.Now()
+	lastCheckin := s.env.GetClock().Now()
 	claimed := false
 	closing := false
 	taskID := ""
+	leaseID := ""
+	// The task and when it was first claimed, for utilization reports.
+	var leasedTask *persistedTask
+	var leaseStart time.Time
 
 	executorID := "unknown"
 	if p, ok := peer.FromContext(ctx); ok {
 		executorID = p.Addr.String()
 	}
 
+	defer func() {
+		if leasedTask == nil {
+			return
+		}
+		// Executors are registered with the group of their API key, so
+		// attribute the task to the same group.
+		executorGroupID, err := s.authorizeExecutor(ctx)
+		if err != nil {
+			log.Debugf("LeaseTask %q could not determine executor group: %s", taskID, err)
+			return
+		}
+		md := leasedTask.metadata
+		s.utilization.RecordTask(executorGroupID, md.GetPool(), md.GetTaskSize().GetEstimatedMilliCpu(), leaseStart, s.env.GetClock().Now())
+	}()
+
 	// If we've exited our event loop and the task is still claimed, then
 	// the worker did not finish properly and we should re-enqueue it.
 	defer func() {
@@ -1048,7 +1761,7 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 		log.Warningf("LeaseTask %q exited event-loop with task still claimed. Will ReEnqueue!", taskID)
 		ctx, cancel := background.ExtendContextForFinalization(ctx, 3*time.Second)
 		defer cancel()
-		if _, err := s.ReEnqueueTask(ctx, &scpb.ReEnqueueTaskRequest{TaskId: taskID}); err != nil {
+		if _, err := s.ReEnqueueTask(ctx, &scpb.ReEnqueueTaskRequest{TaskId: taskID, LeaseId: leaseID}); err != nil {
 			log.Errorf("LeaseTask %q tried to re-enqueue task but failed with err: %s", taskID, err.Error())
 		} // Success case will be logged by ReEnqueueTask flow.
 	}()
@@ -1070,19 +1783,29 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 			return status.InvalidArgumentError("TaskId must be set and the same value for all requests")
 		}
 		taskID = req.GetTaskId()
-		if time.Since(lastCheckin) > (leaseInterval + leaseGracePeriod) {
-			log.Warningf("LeaseTask %q client went away after %s", taskID, time.Since(lastCheckin))
+		if s.env.GetClock().Since(lastCheckin) > (leaseInterval + leaseGracePeriod) {
+			log.Warningf("LeaseTask %q client went away after %s", taskID, s.env.GetClock().Since(lastCheckin))
 			break
 		}
 		rsp := &scpb.LeaseTaskResponse{
 			LeaseDurationSeconds: int64(leaseInterval.Seconds()),
 		}
-		if !claimed {
-			err = s.claimTask(ctx, taskID, time.Now())
+		if claimed {
+			if err := s.renewTaskLease(ctx, taskID, leaseID, s.env.GetClock().Now()); err != nil {
+				// The lease expired and the task may already have been
+				// handed to another executor, so don't re-enqueue it.
+				log.Warningf("LeaseTask %q could not renew lease: %s", taskID, err)
+				claimed = false
+				return err
+			}
+		} else {
+			leaseID = uuid.New().String()
+			err = s.claimTask(ctx, taskID, leaseID, s.env.GetClock().Now())
 			if err != nil {
 				return err
 			}
 			claimed = true
+			rsp.LeaseId = leaseID
 			task, err := s.readTask(ctx, req.GetTaskId())
 			if err != nil {
 				log.Errorf("LeaseTask %q error reading task %s", taskID, err.Error())
@@ -1090,34 +1813,33 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 			}
 
 			log.Infof("LeaseTask task %q successfully claimed by executor %q", taskID, executorID)
+			leasedTask = task
+			leaseStart = s.env.GetClock().Now()
 
-			key := nodePoolKey{
-				os:      task.metadata.GetOs(),
-				arch:    task.metadata.GetArch(),
-				pool:    task.metadata.GetPool(),
-				groupID: task.metadata.GetGroupId(),
-			}
-			nodePool, ok := s.getPool(key)
-			if ok {
-				nodePool.unclaimedTasks.removeTask(taskID)
-			}
+			s.removeUnclaimedTask(task.metadata, taskID)
 
 			// Prometheus: observe queue wait time.
-			ageInMillis := time.Since(task.queuedTimestamp).Milliseconds()
+			ageInMillis := s.env.GetClock().Since(task.queuedTimestamp).Milliseconds()
 			queueWaitTimeMs.Observe(float64(ageInMillis))
+			labels := schedulingMetricsLabels(task.metadata)
+			metrics.SchedulerTasksDequeued.With(labels).Inc()
+			metrics.SchedulerQueueWaitTimeUsec.With(labels).Observe(float64(s.env.GetClock().Since(task.queuedTimestamp).Microseconds()))
+			if err := s.recordQueueDuration(ctx, task.metadata, s.env.GetClock().Since(task.queuedTimestamp)); err != nil {
+				log.Warningf("LeaseTask %q could not record queue duration: %s", taskID, err)
+			}
 			rsp.SerializedTask = task.serializedTask
 		}
 
 		closing = req.GetFinalize()
 		if closing && claimed {
-			if err := s.deleteClaimedTask(ctx, taskID); err == nil {
+			if err := s.deleteClaimedTask(ctx, taskID, leaseID); err == nil {
 				claimed = false
 				log.Infof("LeaseTask task %q successfully finalized by %q", taskID, executorID)
 			}
 		}
 
 		rsp.ClosedCleanly = !claimed
-		lastCheckin = time.Now()
+		lastCheckin = s.env.GetClock().Now()
 		log.Debugf("LeaseTask SEND %q, req: %+v", taskID, rsp)
 		if err := stream.Send(rsp); err != nil {
 			return err
@@ -1144,22 +1866,36 @@ type enqueueTaskReservationOpts struct {
 }
 
 func (s *SchedulerServer) enqueueTaskReservations(ctx context.Context, enqueueRequest *scpb.EnqueueTaskReservationRequest, serializedTask []byte, opts enqueueTaskReservationOpts) error {
-	os := enqueueRequest.GetSchedulingMetadata().GetOs()
-	arch := enqueueRequest.GetSchedulingMetadata().GetArch()
-	pool := enqueueRequest.GetSchedulingMetadata().GetPool()
-	groupID := enqueueRequest.GetSchedulingMetadata().GetGroupId()
+	metadata := enqueueRequest.GetSchedulingMetadata()
+	os := metadata.GetOs()
+	arch := metadata.GetArch()
+	pool := metadata.GetPool()
+	groupID := metadata.GetGroupId()
 
 	key := nodePoolKey{os: os, arch: arch, pool: pool, groupID: groupID}
 
-	log.Infof("Enqueue task reservations for task %q with pool key %+v.", enqueueRequest.GetTaskId(), key)
+	log.Infof("Enqueue task reservations for task %q with pool key %+v and requirements %q.", enqueueRequest.GetTaskId(), key, metadata.GetRequirements())
 
-	nodeBalancer := s.getOrCreatePool(key)
-	nodeCount, _ := nodeBalancer.NodeCount(ctx)
+	reqs, err := platform.ParseRequirementList(metadata.GetRequirements())
+	if err != nil {
+		return err
+	}
+	nodeBalancers, err := s.candidatePools(ctx, metadata, reqs)
+	if err != nil {
+		return err
+	}
+	nodeCount := 0
+	for _, nodeBalancer := range nodeBalancers {
+		n, _ := nodeBalancer.NodeCount(ctx)
+		nodeCount += n
+	}
 	if nodeCount == 0 {
-		return status.UnavailableErrorf("No registered executors in pool %q with os %q with arch %q.", pool, os, arch)
+		return s.noMatchingExecutorsError(ctx, metadata, reqs, opts)
 	}
 
-	nodeBalancer.unclaimedTasks.addTask(enqueueRequest.GetTaskId())
+	for _, nodeBalancer := range nodeBalancers {
+		nodeBalancer.unclaimedTasks.addTask(enqueueRequest.GetTaskId())
+	}
 
 	probeCount := minInt(opts.numReplicas, nodeCount)
 	probesSent := 0
@@ -1178,7 +1914,14 @@ func (s *SchedulerServer) enqueueTaskReservations(ctx context.Context, enqueueRe
 
 	// Note: preferredNode may be nil if the executor ID isn't specified or if
 	// the executor is no longer connected.
-	preferredNode := nodeBalancer.FindConnectedExecutorByID(enqueueRequest.GetExecutorId())
+	var preferredNode *executionNode
+	for _, nodeBalancer := range nodeBalancers {
+		node := nodeBalancer.FindConnectedExecutorByID(enqueueRequest.GetExecutorId())
+		if node != nil && !nodeBalancer.IsCordoned(node) && len(nodeBalancer.matchingNodes([]*executionNode{node}, reqs)) > 0 {
+			preferredNode = node
+			break
+		}
+	}
 
 	attempts := 0
 	var nodes []*executionNode
@@ -1204,12 +1947,20 @@ func (s *SchedulerServer) enqueueTaskReservations(ctx context.Context, enqueueRe
 				// (in subsequent loop iterations) if the preferred node probe fails.
 				preferredNode = nil
 			} else {
-				nodes = nodeBalancer.nodes
-				if opts.alwaysScheduleLocally {
-					nodes = nodeBalancer.connectedExecutors
+				nodes = nil
+				for _, nodeBalancer := range nodeBalancers {
+					poolNodes := nodeBalancer.nodes
+					if opts.alwaysScheduleLocally {
+						poolNodes = nodeBalancer.connectedExecutors
+					}
+					poolNodes = nodeBalancer.matchingNodes(poolNodes, reqs)
+					if len(poolNodes) == 0 {
+						continue
+					}
+					nodes = append(nodes, nodeBalancer.uncordonedNodes(poolNodes)...)
 				}
 				if len(nodes) == 0 {
-					return status.UnavailableErrorf("No registered executors in pool %q with os %q with arch %q.", pool, os, arch)
+					return s.noMatchingExecutorsError(ctx, metadata, reqs, opts)
 				}
 				rankedNodes := s.taskRouter.RankNodes(ctx, cmd, remoteInstanceName, toNodeInterfaces(nodes))
 				nodes, err = fromNodeInterfaces(rankedNodes)
@@ -1273,6 +2024,139 @@ func (s *SchedulerServer) enqueueTaskReservations(ctx context.Context, enqueueRe
 	return nil
 }
 
+// allRequirements returns the given requirements along with equality
+// requirements for the exact os, arch, and pool in the scheduling metadata.
+func allRequirements(metadata *scpb.SchedulingMetadata, reqs []*platform.Requirement) []*platform.Requirement {
+	constrained := constrainedAttributes(reqs)
+	var all []*platform.Requirement
+	for _, exact := range []*platform.Requirement{
+		{Attribute: platform.OSAttribute, Operator: platform.Equal, Values: []string{metadata.GetOs()}},
+		{Attribute: platform.ArchAttribute, Operator: platform.Equal, Values: []string{metadata.GetArch()}},
+		{Attribute: platform.PoolAttribute, Operator: platform.Equal, Values: []string{metadata.GetPool()}},
+	} {
+		if !constrained[exact.Attribute] {
+			all = append(all, exact)
+		}
+	}
+	return append(all, reqs...)
+}
+
+func requirementsString(reqs []*platform.Requirement) string {
+	exprs := make([]string, 0, len(reqs))
+	for _, r := range reqs {
+		exprs = append(exprs, r.String())
+	}
+	return "[" + strings.Join(exprs, "; ") + "]"
+}
+
+// noExecutorsError returns the error for a task which can't be scheduled
+// because no registered executors match its scheduling metadata.
+func noExecutorsError(metadata *scpb.SchedulingMetadata, reqs []*platform.Requirement) error {
+	if len(reqs) == 0 {
+		return status.UnavailableErrorf("No registered executors in pool %q with os %q with arch %q.", metadata.GetPool(), metadata.GetOs(), metadata.GetArch())
+	}
+	return status.UnavailableErrorf("No registered executors satisfy the platform requirements %s.", requirementsString(allRequirements(metadata, reqs)))
+}
+
+// noMatchingExecutorsError returns the error for a task which no registered
+// executor can run.
+//
+// If the task's group has no executors registered at all, they may just not
+// have started yet, so an Unavailable error is returned and the client may
+// retry. The same goes for tasks whose matching executors are all cordoned or
+// in a maintenance window, since they will return to service. Otherwise the
+// task would be queued until an executor with different properties is
+// registered, which is unlikely to ever happen, so it fails fast with a
+// FailedPrecondition error that lists the requirements that no executor
+// satisfies along with the available executor pools.
+func (s *SchedulerServer) noMatchingExecutorsError(ctx context.Context, metadata *scpb.SchedulingMetadata, reqs []*platform.Requirement, opts enqueueTaskReservationOpts) error {
+	if opts.alwaysScheduleLocally {
+		// Only executors connected to this scheduler were considered.
+		return noExecutorsError(metadata, reqs)
+	}
+	keys, err := s.fetchPoolKeys(ctx, metadata.GetGroupId())
+	if err != nil {
+		log.Warningf("Could not fetch executor pools for diagnostics: %s", err)
+		return noExecutorsError(metadata, reqs)
+	}
+	if len(keys) == 0 {
+		return noExecutorsError(metadata, reqs)
+	}
+
+	all := allRequirements(metadata, reqs)
+	// Requirements which are unsatisfied by every registered executor.
+	unmatched := make(map[*platform.Requirement]bool, len(all))
+	for _, r := range all {
+		unmatched[r] = true
+	}
+	var pools []string
+	poolCount := 0
+	// Executors which satisfy all of the requirements, and so were only
+	// skipped because they are cordoned.
+	cordonedCount := 0
+	for _, key := range keys {
+		np := s.getOrCreatePool(key)
+		if err := np.RefreshNodes(ctx); err != nil {
+			log.Warningf("Could not refresh executor pool %+v for diagnostics: %s", key, err)
+			continue
+		}
+		np.mu.Lock()
+		nodes := np.nodes
+		np.mu.Unlock()
+		if len(nodes) == 0 {
+			continue
+		}
+		// Report the requirements unsatisfied by the closest matching node.
+		var closest []*platform.Requirement
+		for j, node := range nodes {
+			unsatisfied := platform.UnsatisfiedRequirements(all, np.attributes(node))
+			if len(unsatisfied) == 0 {
+				cordonedCount++
+			}
+			if j == 0 || len(unsatisfied) < len(closest) {
+				closest = unsatisfied
+			}
+			missing := make(map[*platform.Requirement]bool, len(unsatisfied))
+			for _, r := range unsatisfied {
+				missing[r] = true
+			}
+			for _, r := range all {
+				if !missing[r] {
+					delete(unmatched, r)
+				}
+			}
+		}
+		poolCount++
+		if len(pools) < maxDiagnosticPools {
+			pools = append(pools, fmt.Sprintf("pool %q (os %s, arch %s) with %d executor(s) does not satisfy %s", key.pool, key.os, key.arch, len(nodes), requirementsString(closest)))
+		}
+	}
+	if poolCount == 0 {
+		return noExecutorsError(metadata, reqs)
+	}
+	if cordonedCount > 0 {
+		return status.UnavailableErrorf("All %d executor(s) that satisfy the platform requirements %s are cordoned or in a maintenance window.", cordonedCount, requirementsString(all))
+	}
+	if poolCount > len(pools) {
+		pools = append(pools, fmt.Sprintf("and %d more pool(s)", poolCount-len(pools)))
+	}
+
+	var unmatchedReqs []*platform.Requirement
+	for _, r := range all {
+		if unmatched[r] {
+			unmatchedReqs = append(unmatchedReqs, r)
+		}
+	}
+	msg := "No registered executor can run this task. "
+	if len(unmatchedReqs) > 0 {
+		msg += fmt.Sprintf("No executor satisfies the platform requirements %s. ", requirementsString(unmatchedReqs))
+	} else {
+		msg += fmt.Sprintf("No single executor satisfies all of the platform requirements %s. ", requirementsString(all))
+	}
+	msg += "Available executor pools: " + strings.Join(pools, "; ") + "."
+	return status.FailedPreconditionError(msg)
+}
+
 func (s *SchedulerServer) ScheduleTask(ctx context.Context, req *scpb.ScheduleTaskRequest) (*scpb.ScheduleTaskResponse, error) {
 	if req.GetTaskId() == "" {
 		return nil, status.FailedPreconditionError("A task_id is required")
@@ -1304,9 +2188,111 @@ func (s *SchedulerServer) ScheduleTask(ctx context.Context, req *scpb.ScheduleTa
 	if err := s.enqueueTaskReservations(ctx, enqueueRequest, req.GetSerializedTask(), opts); err != nil {
 		return nil, err
 	}
+	metrics.SchedulerTasksEnqueued.With(schedulingMetricsLabels(metadata)).Inc()
 	return &scpb.ScheduleTaskResponse{}, nil
 }
 
+// schedulingMetricsLabels returns the pool and platform labels of scheduler
+// metrics for a task with the given scheduling metadata.
+func schedulingMetricsLabels(metadata *scpb.SchedulingMetadata) prometheus.Labels {
+	return prometheus.Labels{
+		metrics.ExecutorPoolLabel:     metadata.GetPool(),
+		metrics.ExecutorPlatformLabel: metadata.GetOs() + "/" + metadata.GetArch(),
+	}
+}
+
+// PredictScheduling predicts how a task with the given scheduling metadata
+// would be scheduled, without scheduling it.
+func (s *SchedulerServer) PredictScheduling(ctx context.Context, metadata *scpb.SchedulingMetadata) (*scpb.SchedulingPrediction, error) {
+	reqs, err := platform.ParseRequirementList(metadata.GetRequirements())
+	if err != nil {
+		return nil, err
+	}
+	pools, err := s.candidatePools(ctx, metadata, reqs)
+	if err != nil {
+		return nil, err
+	}
+	prediction := &scpb.SchedulingPrediction{EstimatedQueueDurationUsec: -1}
+	for _, np := range pools {
+		// Predictions may be requested far more often than tasks are
+		// scheduled, so the nodes last fetched for scheduling are reused.
+		nodes, err := np.cachedNodes(ctx)
+		if err != nil {
+			return nil, err
+		}
+		nodes = np.matchingNodes(nodes, reqs)
+		if len(nodes) == 0 {
+			continue
+		}
+		prediction.Pool = append(prediction.Pool, &scpb.SchedulingPrediction_Pool{
+			Os:              np.key.os,
+			Arch:            np.key.arch,
+			Name:            np.key.pool,
+			ExecutorCount:   int32(len(nodes)),
+			QueuedTaskCount: int32(np.unclaimedTasks.len()),
+		})
+	}
+	if len(prediction.GetPool()) == 0 {
+		err := s.noMatchingExecutorsError(ctx, metadata, reqs, enqueueTaskReservationOpts{})
+		prediction.UnschedulableReason = gstatus.Convert(err).Message()
+		return prediction, nil
+	}
+
+	durations, err := s.recentQueueDurations(ctx, metadata)
+	if err != nil {
+		log.Warningf("Could not fetch recent queue durations: %s", err)
+	}
+	if len(durations) > 0 {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		prediction.EstimatedQueueDurationUsec = durations[len(durations)/2].Microseconds()
+		prediction.QueueDurationSampleCount = int32(len(durations))
+	}
+	return prediction, nil
+}
+
+// queueDurationsKey returns the key of the Redis list of recent queue
+// durations for tasks with the given scheduling metadata.
+func queueDurationsKey(metadata *scpb.SchedulingMetadata) string {
+	return strings.Join([]string{
+		redisQueueDurationsKeyPrefix,
+		metadata.GetGroupId(),
+		metadata.GetOs(),
+		metadata.GetArch(),
+		metadata.GetPool(),
+		strings.Join(metadata.GetRequirements(), ";"),
+	}, "/")
+}
+
+// recordQueueDuration records how long a task with the given scheduling
+// metadata was queued for before being claimed by an executor.
+func (s *SchedulerServer) recordQueueDuration(ctx context.Context, metadata *scpb.SchedulingMetadata, d time.Duration) error {
+	key := queueDurationsKey(metadata)
+	pipe := s.rdb.TxPipeline()
+	pipe.LPush(ctx, key, d.Microseconds())
+	pipe.LTrim(ctx, key, 0, maxQueueDurationSamples-1)
+	pipe.Expire(ctx, key, queueDurationSamplesTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// recentQueueDurations returns the most recently recorded queue durations of
+// tasks with the given scheduling metadata.
+func (s *SchedulerServer) recentQueueDurations(ctx context.Context, metadata *scpb.SchedulingMetadata) ([]time.Duration, error) {
+	vals, err := s.rdb.LRange(ctx, queueDurationsKey(metadata), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	durations := make([]time.Duration, 0, len(vals))
+	for _, v := range vals {
+		usec, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			continue
+		}
+		durations = append(durations, time.Duration(usec)*time.Microsecond)
+	}
+	return durations, nil
+}
+
 func (s *SchedulerServer) EnqueueTaskReservation(ctx context.Context, req *scpb.EnqueueTaskReservationRequest) (*scpb.EnqueueTaskReservationResponse, error) {
 	// TODO(vadim): verify user is authorized to use executor pool
 
@@ -1330,12 +2316,20 @@ func (s *SchedulerServer) ReEnqueueTask(ctx context.Context, req *scpb.ReEnqueue
 		return nil, err
 	}
 	if task.attemptCount >= maxTaskAttemptCount {
-		if err := s.deleteClaimedTask(ctx, req.GetTaskId()); err != nil {
+		if err := s.deleteClaimedTask(ctx, req.GetTaskId(), req.GetLeaseId()); err != nil {
 			return nil, err
 		}
 		return nil, status.ResourceExhaustedErrorf("Task already attempted %d times.", task.attemptCount)
 	}
-	_ = s.unclaimTask(ctx, req.GetTaskId()) // ignore error -- it's fine if it's already unclaimed.
+	if err := s.unclaimTask(ctx, req.GetTaskId(), req.GetLeaseId()); err != nil && req.GetLeaseId() != "" {
+		// The lease was already released and the task may have been claimed
+		// by a different executor since; re-enqueueing would run it twice.
+		return nil, status.FailedPreconditionErrorf("Lease %q for task %q is no longer held", req.GetLeaseId(), req.GetTaskId())
+	}
+	// The task is queued again, so give it a fresh queue deadline.
+	if err := s.setQueueDeadline(ctx, req.GetTaskId(), task.metadata, s.env.GetClock().Now()); err != nil {
+		log.Warningf("Could not set queue deadline for task %q: %s", req.GetTaskId(), err)
+	}
 	log.Debugf("ReEnqueueTask RPC for task %q", req.GetTaskId())
 	enqueueRequest := &scpb.EnqueueTaskReservationRequest{
 		TaskId:             req.GetTaskId(),
@@ -1350,6 +2344,7 @@ func (s *SchedulerServer) ReEnqueueTask(ctx context.Context, req *scpb.ReEnqueue
 		log.Errorf("ReEnqueueTask failed for task %q: %s", req.GetTaskId(), err.Error())
 		return nil, err
 	}
+	metrics.SchedulerTasksEnqueued.With(schedulingMetricsLabels(task.metadata)).Inc()
 	log.Debugf("ReEnqueueTask RPC succeeded for task %q", req.GetTaskId())
 	return &scpb.ReEnqueueTaskResponse{}, nil
 }
@@ -1382,6 +2377,11 @@ func (s *SchedulerServer) GetExecutionNodes(ctx context.Context, req *scpb.GetEx
 	}
 	defer rows.Close()
 
+	cordons, err := fetchCordonState(ctx, s.rdb, s.env.GetClock().Now())
+	if err != nil {
+		return nil, err
+	}
+
 	executionNodes := make([]*scpb.ExecutionNode, 0)
 	for rows.Next() {
 		en := tables.ExecutionNode{}
@@ -1397,6 +2397,7 @@ func (s *SchedulerServer) GetExecutionNodes(ctx context.Context, req *scpb.GetEx
 			Arch:                  en.Arch,
 			Pool:                  en.Pool,
 			ExecutorId:            en.ExecutorID,
+			Cordoned:              cordons.isCordoned(en.GroupID, en.Pool, en.ExecutorID),
 		}
 		executionNodes = append(executionNodes, node)
 	}
@@ -1406,6 +2407,148 @@ func (s *SchedulerServer) GetExecutionNodes(ctx context.Context, req *scpb.GetEx
 	}, nil
 }
 
+// authorizeExecutorAdmin returns the ID of the group whose executors may be
+// managed by the authenticated user.
+func (s *SchedulerServer) authorizeExecutorAdmin(ctx context.Context, reqCtx *ctxpb.RequestContext) (string, error) {
+	groupID, err := perms.AuthenticateSelectedGroupID(ctx, s.env, reqCtx)
+	if err != nil {
+		return "", err
+	}
+	// If executor auth is not enabled, executors do not belong to any group, so
+	// only server admins may manage them.
+	if !s.requireExecutorAuthorization {
+		u, err := perms.AuthenticatedUser(ctx, s.env)
+		if err != nil {
+			return "", err
+		}
+		if !u.IsAdmin() {
+			return "", status.PermissionDeniedError("Only server admins may manage shared executors")
+		}
+		return "", nil
+	}
+	return groupID, nil
+}
+
+func (s *SchedulerServer) CordonExecutor(ctx context.Context, req *scpb.CordonExecutorRequest) (*scpb.CordonExecutorResponse, error) {
+	executorID := req.GetExecutorId()
+	if executorID == "" {
+		return nil, status.InvalidArgumentError("An executor_id is required")
+	}
+	groupID, err := s.authorizeExecutorAdmin(ctx, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+
+	if !req.GetCordoned() {
+		ownerGroupID, err := s.rdb.HGet(ctx, redisExecutorCordonsKey, executorID).Result()
+		if err == redis.Nil {
+			return &scpb.CordonExecutorResponse{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ownerGroupID != groupID {
+			return nil, status.NotFoundErrorf("Executor %q not found", executorID)
+		}
+		if err := s.rdb.HDel(ctx, redisExecutorCordonsKey, executorID).Err(); err != nil {
+			return nil, err
+		}
+		log.Infof("Uncordoned executor %q", executorID)
+		return &scpb.CordonExecutorResponse{}, nil
+	}
+
+	db := s.env.GetDBHandle()
+	if db == nil {
+		return nil, status.FailedPreconditionError("database not configured")
+	}
+	var count int64
+	err = db.WithContext(ctx).Model(&tables.ExecutionNode{}).Where("executor_id = ? AND group_id = ?", executorID, groupID).Count(&count).Error
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, status.NotFoundErrorf("Executor %q not found", executorID)
+	}
+	if err := s.rdb.HSet(ctx, redisExecutorCordonsKey, executorID, groupID).Err(); err != nil {
+		return nil, err
+	}
+	log.Infof("Cordoned executor %q", executorID)
+	return &scpb.CordonExecutorResponse{}, nil
+}
+
+func (s *SchedulerServer) CreateMaintenanceWindow(ctx context.Context, req *scpb.CreateMaintenanceWindowRequest) (*scpb.CreateMaintenanceWindowResponse, error) {
+	w := req.GetMaintenanceWindow()
+	if w == nil {
+		return nil, status.InvalidArgumentError("A maintenance_window is required")
+	}
+	if w.GetStartTimeUsec() <= 0 || w.GetEndTimeUsec() <= w.GetStartTimeUsec() {
+		return nil, status.InvalidArgumentError("The maintenance window must have a start time before its end time")
+	}
+	if w.GetEndTimeUsec() <= timeutil.ToUsec(s.env.GetClock().Now()) {
+		return nil, status.InvalidArgumentError("The maintenance window has already ended")
+	}
+	groupID, err := s.authorizeExecutorAdmin(ctx, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+
+	w = proto.Clone(w).(*scpb.MaintenanceWindow)
+	w.WindowId = uuid.New().String()
+	b, err := proto.Marshal(w)
+	if err != nil {
+		return nil, status.InternalErrorf("failed to marshal maintenance window: %s", err)
+	}
+	if err := s.rdb.HSet(ctx, redisMaintenanceWindowsKey, maintenanceWindowField(groupID, w.GetWindowId()), b).Err(); err != nil {
+		return nil, err
+	}
+	log.Infof("Created maintenance window %q for pool %q", w.GetWindowId(), w.GetPool())
+	return &scpb.CreateMaintenanceWindowResponse{WindowId: w.GetWindowId()}, nil
+}
+
+func (s *SchedulerServer) DeleteMaintenanceWindow(ctx context.Context, req *scpb.DeleteMaintenanceWindowRequest) (*scpb.DeleteMaintenanceWindowResponse, error) {
+	if req.GetWindowId() == "" {
+		return nil, status.InvalidArgumentError("A window_id is required")
+	}
+	groupID, err := s.authorizeExecutorAdmin(ctx, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	n, err := s.rdb.HDel(ctx, redisMaintenanceWindowsKey, maintenanceWindowField(groupID, req.GetWindowId())).Result()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, status.NotFoundErrorf("Maintenance window %q not found", req.GetWindowId())
+	}
+	return &scpb.DeleteMaintenanceWindowResponse{}, nil
+}
+
+func (s *SchedulerServer) GetExecutorUtilization(ctx context.Context, req *scpb.GetExecutorUtilizationRequest) (*scpb.GetExecutorUtilizationResponse, error) {
+	groupID, err := s.authorizeExecutorAdmin(ctx, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	return executor_utilization.GetExecutorUtilization(ctx, s.env, groupID, req)
+}
+
+func (s *SchedulerServer) GetMaintenanceWindows(ctx context.Context, req *scpb.GetMaintenanceWindowsRequest) (*scpb.GetMaintenanceWindowsResponse, error) {
+	groupID, err := s.authorizeExecutorAdmin(ctx, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	windows, err := readMaintenanceWindows(ctx, s.rdb, s.env.GetClock().Now())
+	if err != nil {
+		return nil, err
+	}
+	rsp := &scpb.GetMaintenanceWindowsResponse{}
+	for _, w := range windows {
+		if w.groupID == groupID {
+			rsp.MaintenanceWindow = append(rsp.MaintenanceWindow, w.window)
+		}
+	}
+	return rsp, nil
+}
+
 // extractRoutingProps deserializes the given task and returns the properties
 // needed to route the task (command and remote instance name).
 func extractRoutingProps(serializedTask []byte) (*repb.Command, string, error) {
@@ -0,0 +1,486 @@
+package scheduler_server_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/scheduler_server"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/task_router"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/testredis"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/fakeclock"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+const (
+	testUserID  = "US1"
+	testGroupID = "GR1"
+)
+
+// fakeExecutor records the task reservations enqueued on it.
+type fakeExecutor struct {
+	id   string
+	host string
+	port int32
+
+	mu      sync.Mutex
+	taskIDs []string
+}
+
+func (e *fakeExecutor) EnqueueTaskReservation(ctx context.Context, req *scpb.EnqueueTaskReservationRequest) (*scpb.EnqueueTaskReservationResponse, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.taskIDs = append(e.taskIDs, req.GetTaskId())
+	return &scpb.EnqueueTaskReservationResponse{}, nil
+}
+
+func (e *fakeExecutor) reservations() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string{}, e.taskIDs...)
+}
+
+func getEnv(t *testing.T) *testenv.TestEnv {
+	env := enterprise_testenv.GetCustomTestEnv(t, &enterprise_testenv.Options{
+		RedisTarget: testredis.Start(t),
+	})
+	env.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers(testUserID, testGroupID)))
+	router, err := task_router.New(env)
+	require.NoError(t, err)
+	env.SetTaskRouter(router)
+	return env
+}
+
+func newScheduler(t *testing.T, env *testenv.TestEnv) *scheduler_server.SchedulerServer {
+	s, err := scheduler_server.NewSchedulerServerWithOptions(env, &scheduler_server.Options{RequireExecutorAuthorization: true})
+	require.NoError(t, err)
+	return s
+}
+
+// startExecutor starts an executor that can be sent task reservations, and
+// registers it with the given memory in the default linux/amd64 pool.
+func startExecutor(t *testing.T, env *testenv.TestEnv, id string, memoryBytes int64) *fakeExecutor {
+	return startExecutorInPool(t, env, id, "", memoryBytes)
+}
+
+func startExecutorInPool(t *testing.T, env *testenv.TestEnv, id, pool string, memoryBytes int64) *fakeExecutor {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	e := &fakeExecutor{
+		id:   id,
+		host: "127.0.0.1",
+		port: int32(lis.Addr().(*net.TCPAddr).Port),
+	}
+	srv := grpc.NewServer()
+	scpb.RegisterQueueExecutorServer(srv, e)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	err = env.GetDBHandle().Create(&tables.ExecutionNode{
+		Host:                  e.host,
+		Port:                  e.port,
+		ExecutorID:            id,
+		GroupID:               testGroupID,
+		OS:                    "linux",
+		Arch:                  "amd64",
+		Pool:                  pool,
+		AssignableMemoryBytes: memoryBytes,
+		AssignableMilliCPU:    4000,
+		Perms:                 perms.GROUP_READ | perms.GROUP_WRITE,
+	}).Error
+	require.NoError(t, err)
+	return e
+}
+
+func authenticatedContext(t *testing.T, env *testenv.TestEnv) context.Context {
+	ctx, err := env.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), testUserID)
+	require.NoError(t, err)
+	return ctx
+}
+
+func scheduleTask(ctx context.Context, t *testing.T, s *scheduler_server.SchedulerServer, taskID string, requirements ...string) error {
+	return scheduleTaskInPool(ctx, t, s, taskID, "", requirements...)
+}
+
+func scheduleTaskInPool(ctx context.Context, t *testing.T, s *scheduler_server.SchedulerServer, taskID, pool string, requirements ...string) error {
+	task, err := proto.Marshal(&repb.ExecutionTask{ExecutionId: taskID})
+	require.NoError(t, err)
+	_, err = s.ScheduleTask(ctx, &scpb.ScheduleTaskRequest{
+		TaskId: taskID,
+		Metadata: &scpb.SchedulingMetadata{
+			Os:           "linux",
+			Arch:         "amd64",
+			Pool:         pool,
+			GroupId:      testGroupID,
+			TaskSize:     &scpb.TaskSize{},
+			Requirements: requirements,
+		},
+		SerializedTask: task,
+	})
+	return err
+}
+
+func cordon(ctx context.Context, t *testing.T, s *scheduler_server.SchedulerServer, executorID string, cordoned bool) {
+	_, err := s.CordonExecutor(ctx, &scpb.CordonExecutorRequest{
+		RequestContext: testauth.RequestContext(testUserID, testGroupID),
+		ExecutorId:     executorID,
+		Cordoned:       cordoned,
+	})
+	require.NoError(t, err)
+}
+
+func TestScheduleTask_NoExecutors(t *testing.T) {
+	env := getEnv(t)
+	s := newScheduler(t, env)
+	ctx := authenticatedContext(t, env)
+
+	err := scheduleTask(ctx, t, s, "task1")
+	assert.True(t, status.IsUnavailableError(err), "expected Unavailable, got %v", err)
+}
+
+func TestScheduleTask_ConstraintMismatch(t *testing.T) {
+	env := getEnv(t)
+	s := newScheduler(t, env)
+	ctx := authenticatedContext(t, env)
+	e := startExecutor(t, env, "executor1", 16e9)
+
+	err := scheduleTask(ctx, t, s, "task1", "memory >= 64g")
+	assert.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition, got %v", err)
+	assert.Contains(t, err.Error(), "memory >= 64g")
+	assert.Empty(t, e.reservations())
+}
+
+func TestScheduleTask_AllMatchingExecutorsCordoned(t *testing.T) {
+	env := getEnv(t)
+	s := newScheduler(t, env)
+	ctx := authenticatedContext(t, env)
+	e1 := startExecutor(t, env, "executor1", 16e9)
+	e2 := startExecutor(t, env, "executor2", 64e9)
+	cordon(ctx, t, s, "executor2", true)
+
+	// The only executor with enough memory is cordoned, which is temporary,
+	// so the task may be retried rather than failing the build.
+	err := scheduleTask(ctx, t, s, "task1", "memory >= 32g")
+	assert.True(t, status.IsUnavailableError(err), "expected Unavailable, got %v", err)
+	assert.Empty(t, e1.reservations())
+	assert.Empty(t, e2.reservations())
+
+	require.NoError(t, scheduleTask(ctx, t, s, "task2"))
+	assert.Contains(t, e1.reservations(), "task2")
+	assert.Empty(t, e2.reservations())
+}
+
+// refreshNodes advances the clock past the time that the scheduler caches
+// executors and their cordons for.
+func refreshNodes(clock *fakeclock.FakeClock) {
+	clock.Advance(time.Minute)
+}
+
+func TestScheduleTask_CordonedExecutorDrainsAndReturnsToService(t *testing.T) {
+	env := getEnv(t)
+	clock := fakeclock.New(time.Now())
+	env.SetClock(clock)
+	s := newScheduler(t, env)
+	ctx := authenticatedContext(t, env)
+	e1 := startExecutor(t, env, "executor1", 16e9)
+	require.NoError(t, scheduleTask(ctx, t, s, "task1"))
+	require.Contains(t, e1.reservations(), "task1")
+
+	e2 := startExecutor(t, env, "executor2", 16e9)
+	cordon(ctx, t, s, "executor1", true)
+	refreshNodes(clock)
+
+	// New tasks skip the cordoned executor, which keeps the tasks it already
+	// has so that it can drain them.
+	for _, taskID := range []string{"task2", "task3", "task4"} {
+		require.NoError(t, scheduleTask(ctx, t, s, taskID))
+		assert.Contains(t, e2.reservations(), taskID)
+		assert.NotContains(t, e1.reservations(), taskID)
+	}
+	assert.Contains(t, e1.reservations(), "task1")
+
+	// Once uncordoned, the executor is assigned new tasks again.
+	cordon(ctx, t, s, "executor1", false)
+	cordon(ctx, t, s, "executor2", true)
+	refreshNodes(clock)
+	require.NoError(t, scheduleTask(ctx, t, s, "task5"))
+	assert.Contains(t, e1.reservations(), "task5")
+	assert.NotContains(t, e2.reservations(), "task5")
+}
+
+func TestScheduleTask_MaintenanceWindow(t *testing.T) {
+	env := getEnv(t)
+	clock := fakeclock.New(time.Now())
+	env.SetClock(clock)
+	s := newScheduler(t, env)
+	ctx := authenticatedContext(t, env)
+	e1 := startExecutor(t, env, "executor1", 16e9)
+	e2 := startExecutor(t, env, "executor2", 16e9)
+
+	now := clock.Now()
+	_, err := s.CreateMaintenanceWindow(ctx, &scpb.CreateMaintenanceWindowRequest{
+		RequestContext: testauth.RequestContext(testUserID, testGroupID),
+		MaintenanceWindow: &scpb.MaintenanceWindow{
+			ExecutorId:    []string{"executor1"},
+			StartTimeUsec: timeutil.ToUsec(now.Add(time.Hour)),
+			EndTimeUsec:   timeutil.ToUsec(now.Add(2 * time.Hour)),
+		},
+	})
+	require.NoError(t, err)
+	cordon(ctx, t, s, "executor2", true)
+
+	// Until the window starts, the executor is assigned tasks as usual.
+	require.NoError(t, scheduleTask(ctx, t, s, "task1"))
+	assert.Contains(t, e1.reservations(), "task1")
+
+	// During the window it isn't, even when no other executor can run the
+	// task.
+	clock.Advance(time.Hour)
+	refreshNodes(clock)
+	err = scheduleTask(ctx, t, s, "task2")
+	assert.True(t, status.IsUnavailableError(err), "expected Unavailable, got %v", err)
+	cordon(ctx, t, s, "executor2", false)
+	refreshNodes(clock)
+	require.NoError(t, scheduleTask(ctx, t, s, "task3"))
+	assert.Contains(t, e2.reservations(), "task3")
+	assert.NotContains(t, e1.reservations(), "task2")
+	assert.NotContains(t, e1.reservations(), "task3")
+
+	// Once the window ends, the executor returns to service.
+	clock.Advance(time.Hour)
+	cordon(ctx, t, s, "executor2", true)
+	refreshNodes(clock)
+	require.NoError(t, scheduleTask(ctx, t, s, "task4"))
+	assert.Contains(t, e1.reservations(), "task4")
+}
+
+func predictScheduling(ctx context.Context, t *testing.T, s *scheduler_server.SchedulerServer, requirements ...string) *scpb.SchedulingPrediction {
+	prediction, err := s.PredictScheduling(ctx, &scpb.SchedulingMetadata{
+		Os:           "linux",
+		Arch:         "amd64",
+		GroupId:      testGroupID,
+		TaskSize:     &scpb.TaskSize{},
+		Requirements: requirements,
+	})
+	require.NoError(t, err)
+	return prediction
+}
+
+func TestPredictScheduling(t *testing.T) {
+	env := getEnv(t)
+	clock := fakeclock.New(time.Now())
+	env.SetClock(clock)
+	s := newScheduler(t, env)
+	ctx := authenticatedContext(t, env)
+
+	prediction := predictScheduling(ctx, t, s)
+	assert.Empty(t, prediction.GetPool())
+	assert.NotEmpty(t, prediction.GetUnschedulableReason())
+
+	e1 := startExecutor(t, env, "executor1", 16e9)
+	refreshNodes(clock)
+	require.NoError(t, scheduleTask(ctx, t, s, "task1"))
+	prediction = predictScheduling(ctx, t, s)
+	require.Len(t, prediction.GetPool(), 1)
+	assert.Equal(t, "linux", prediction.GetPool()[0].GetOs())
+	assert.Equal(t, "amd64", prediction.GetPool()[0].GetArch())
+	assert.Equal(t, int32(1), prediction.GetPool()[0].GetExecutorCount())
+	assert.Empty(t, prediction.GetUnschedulableReason())
+
+	// Predicting doesn't schedule anything, nor does it fetch executors
+	// again: it reuses the ones last fetched for scheduling.
+	startExecutor(t, env, "executor2", 64e9)
+	refreshNodes(clock)
+	prediction = predictScheduling(ctx, t, s)
+	require.Len(t, prediction.GetPool(), 1)
+	assert.Equal(t, int32(1), prediction.GetPool()[0].GetExecutorCount())
+	assert.Equal(t, []string{"task1"}, uniqueTaskIDs(e1.reservations()))
+
+	require.NoError(t, scheduleTask(ctx, t, s, "task2"))
+	prediction = predictScheduling(ctx, t, s)
+	require.Len(t, prediction.GetPool(), 1)
+	assert.Equal(t, int32(2), prediction.GetPool()[0].GetExecutorCount())
+
+	// Only executors meeting the requirements are counted.
+	prediction = predictScheduling(ctx, t, s, "memory >= 32g")
+	require.Len(t, prediction.GetPool(), 1)
+	assert.Equal(t, int32(1), prediction.GetPool()[0].GetExecutorCount())
+	prediction = predictScheduling(ctx, t, s, "memory >= 128g")
+	assert.Empty(t, prediction.GetPool())
+	assert.Contains(t, prediction.GetUnschedulableReason(), "memory >= 128g")
+}
+
+// uniqueTaskIDs returns the given task IDs without duplicates, since the
+// scheduler may send an executor more than one reservation for a task.
+func uniqueTaskIDs(taskIDs []string) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, id := range taskIDs {
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// fakeRemoteExecutionService records the executions marked as failed.
+type fakeRemoteExecutionService struct {
+	interfaces.RemoteExecutionService
+
+	mu     sync.Mutex
+	failed map[string]error
+}
+
+func (r *fakeRemoteExecutionService) MarkExecutionFailed(ctx context.Context, executionID string, reason error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failed[executionID] = reason
+	return nil
+}
+
+func (r *fakeRemoteExecutionService) failure(executionID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failed[executionID]
+}
+
+// getQueueTimeoutEnv returns a scheduler whose queue timeouts are checked
+// as the returned clock is advanced, with an executor in the default pool and
+// one in the "gpu" pool which never claim the tasks that they are assigned.
+func getQueueTimeoutEnv(t *testing.T, maxQueueDurationSeconds string, overrides ...config.QueueTimeoutConfig) (context.Context, *scheduler_server.SchedulerServer, *fakeclock.FakeClock, *fakeRemoteExecutionService) {
+	env := getEnv(t)
+	clock := fakeclock.New(time.Now())
+	env.SetClock(clock)
+	rexec := &fakeRemoteExecutionService{failed: map[string]error{}}
+	env.SetRemoteExecutionService(rexec)
+	setFlag(t, "remote_execution.max_queue_duration_seconds", maxQueueDurationSeconds)
+	env.GetConfigurator().GetRemoteExecutionConfig().QueueTimeouts = overrides
+	s := newScheduler(t, env)
+	startExecutor(t, env, "executor1", 16e9)
+	startExecutorInPool(t, env, "executor2", "gpu", 16e9)
+	return authenticatedContext(t, env), s, clock, rexec
+}
+
+// advanceUntilFailed advances the clock by the interval at which queue
+// timeouts are checked until the task is failed, or until the given duration
+// has passed, returning how long it took.
+func advanceUntilFailed(clock *fakeclock.FakeClock, rexec *fakeRemoteExecutionService, taskID string, max time.Duration) time.Duration {
+	start := clock.Now()
+	for clock.Since(start) < max {
+		clock.Advance(5 * time.Second)
+		// Give the queue timeout checker a chance to run.
+		for i := 0; i < 10 && rexec.failure(taskID) == nil; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		if rexec.failure(taskID) != nil {
+			break
+		}
+	}
+	return clock.Since(start)
+}
+
+func TestQueueTimeout(t *testing.T) {
+	ctx, s, clock, rexec := getQueueTimeoutEnv(t, "60")
+	require.NoError(t, scheduleTask(ctx, t, s, "task1"))
+
+	elapsed := advanceUntilFailed(clock, rexec, "task1", 5*time.Minute)
+
+	err := rexec.failure("task1")
+	require.Error(t, err)
+	assert.GreaterOrEqual(t, int64(elapsed), int64(time.Minute))
+	assert.True(t, status.IsResourceExhaustedError(err), "expected ResourceExhausted, got %v", err)
+	assert.Contains(t, err.Error(), "maximum queue duration of 1m0s")
+	assert.Contains(t, err.Error(), "1 registered executor(s)")
+}
+
+func TestQueueTimeout_Disabled(t *testing.T) {
+	ctx, s, clock, rexec := getQueueTimeoutEnv(t, "0")
+	require.NoError(t, scheduleTask(ctx, t, s, "task1"))
+
+	advanceUntilFailed(clock, rexec, "task1", 5*time.Minute)
+
+	assert.NoError(t, rexec.failure("task1"))
+}
+
+func TestQueueTimeout_Overrides(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		pool      string
+		overrides []config.QueueTimeoutConfig
+		want      time.Duration
+	}{
+		{
+			name:      "OtherGroup",
+			overrides: []config.QueueTimeoutConfig{{GroupID: "GR2", MaxQueueDurationSeconds: 120}},
+			want:      time.Minute,
+		},
+		{
+			name:      "OtherPool",
+			overrides: []config.QueueTimeoutConfig{{Pool: "gpu", MaxQueueDurationSeconds: 120}},
+			want:      time.Minute,
+		},
+		{
+			name:      "Pool",
+			pool:      "gpu",
+			overrides: []config.QueueTimeoutConfig{{Pool: "gpu", MaxQueueDurationSeconds: 120}},
+			want:      2 * time.Minute,
+		},
+		{
+			name: "GroupWinsOverPool",
+			pool: "gpu",
+			overrides: []config.QueueTimeoutConfig{
+				{GroupID: testGroupID, MaxQueueDurationSeconds: 180},
+				{Pool: "gpu", MaxQueueDurationSeconds: 120},
+			},
+			want: 3 * time.Minute,
+		},
+		{
+			name: "GroupAndPoolWinOverGroup",
+			pool: "gpu",
+			overrides: []config.QueueTimeoutConfig{
+				{GroupID: testGroupID, Pool: "gpu", MaxQueueDurationSeconds: 120},
+				{GroupID: testGroupID, MaxQueueDurationSeconds: 180},
+			},
+			want: 2 * time.Minute,
+		},
+		{
+			name:      "DisabledForGroup",
+			overrides: []config.QueueTimeoutConfig{{GroupID: testGroupID, MaxQueueDurationSeconds: 0}},
+			want:      0,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, s, clock, rexec := getQueueTimeoutEnv(t, "60", test.overrides...)
+			require.NoError(t, scheduleTaskInPool(ctx, t, s, "task1", test.pool))
+
+			elapsed := advanceUntilFailed(clock, rexec, "task1", 5*time.Minute)
+
+			err := rexec.failure("task1")
+			if test.want == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.GreaterOrEqual(t, int64(elapsed), int64(test.want))
+			assert.Contains(t, err.Error(), "maximum queue duration of "+test.want.String())
+		})
+	}
+}
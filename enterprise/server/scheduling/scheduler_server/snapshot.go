@@ -0,0 +1,284 @@
+package scheduler_server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+	"github.com/go-redis/redis/v8"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/uuid"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+const (
+	// Directory of the blobstore that scheduler snapshots are written to.
+	snapshotBlobDir = "scheduler_snapshots"
+
+	// Maximum number of tasks whose details are included in a snapshot.
+	maxSnapshotTasks = 10000
+)
+
+// snapshotHostHashKey returns the key that executor hosts are hashed with in
+// snapshots: the configured key, or a random one if none is configured.
+func snapshotHostHashKey(configured string) ([]byte, error) {
+	if configured != "" {
+		return []byte(configured), nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, status.InternalErrorf("could not generate snapshot host hash key: %s", err)
+	}
+	return key, nil
+}
+
+// hashHost returns a stable identifier for the host which doesn't reveal it.
+// The host is hashed with a secret key, since executor hosts are few and
+// easily guessed, so that a plain hash of them could be reversed.
+func hashHost(key []byte, host string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(host))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// redactedTask returns the parts of a persisted task which are safe to
+// include in a snapshot. The task itself is never included, since its command
+// and environment may contain user data and it carries the credentials that
+// the executor uses to run it.
+func redactedTask(task *persistedTask) *scpb.SnapshotTask {
+	st := &scpb.SnapshotTask{
+		TaskId:       task.taskID,
+		QueuedAtUsec: timeutil.ToUsec(task.queuedTimestamp),
+		AttemptCount: task.attemptCount,
+		SchedulingMetadata: &scpb.SchedulingMetadata{
+			TaskSize:     task.metadata.GetTaskSize(),
+			Os:           task.metadata.GetOs(),
+			Arch:         task.metadata.GetArch(),
+			Pool:         task.metadata.GetPool(),
+			GroupId:      task.metadata.GetGroupId(),
+			Requirements: task.metadata.GetRequirements(),
+		},
+	}
+	et := &repb.ExecutionTask{}
+	if err := proto.Unmarshal(task.serializedTask, et); err != nil {
+		log.Warningf("Could not unmarshal task %q for snapshot: %s", task.taskID, err)
+		return st
+	}
+	st.InvocationId = et.GetInvocationId()
+	st.ActionMnemonic = et.GetRequestMetadata().GetActionMnemonic()
+	return st
+}
+
+// redactedExecutor returns the registration of the executor as included in a
+// snapshot.
+func (s *SchedulerServer) redactedExecutor(en *tables.ExecutionNode, cordons *cordonState) *scpb.SnapshotExecutor {
+	return &scpb.SnapshotExecutor{
+		ExecutorId:            en.ExecutorID,
+		HostHash:              hashHost(s.snapshotHostHashKey, en.Host),
+		Port:                  en.Port,
+		GroupId:               en.GroupID,
+		Os:                    en.OS,
+		Arch:                  en.Arch,
+		Pool:                  en.Pool,
+		Version:               en.Version,
+		AssignableMemoryBytes: en.AssignableMemoryBytes,
+		AssignableMilliCpu:    en.AssignableMilliCPU,
+		CapabilityGrade:       en.CapabilityGrade,
+		SchedulerHostPort:     en.SchedulerHostPort,
+		LastUpdateUsec:        en.UpdatedAtUsec,
+		Cordoned:              cordons.isCordoned(en.GroupID, en.Pool, en.ExecutorID),
+	}
+}
+
+// snapshotPools returns the pools known to this scheduler, with their queues
+// and connected executors as of a single point in time.
+func (s *SchedulerServer) snapshotPools() []*scpb.SnapshotPool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pools := make([]*scpb.SnapshotPool, 0, len(s.pools))
+	for key, np := range s.pools {
+		sp := &scpb.SnapshotPool{
+			GroupId: key.groupID,
+			Os:      key.os,
+			Arch:    key.arch,
+			Pool:    key.pool,
+		}
+		np.mu.Lock()
+		for _, node := range np.connectedExecutors {
+			sp.ConnectedExecutorId = append(sp.ConnectedExecutorId, node.GetExecutorID())
+		}
+		np.mu.Unlock()
+		sp.UnclaimedTaskId = np.unclaimedTasks.sample(maxUnclaimedTasksTracked)
+		sort.Strings(sp.UnclaimedTaskId)
+		pools = append(pools, sp)
+	}
+	sort.Slice(pools, func(i, j int) bool {
+		a, b := pools[i], pools[j]
+		if a.GetGroupId() != b.GetGroupId() {
+			return a.GetGroupId() < b.GetGroupId()
+		}
+		if a.GetPool() != b.GetPool() {
+			return a.GetPool() < b.GetPool()
+		}
+		if a.GetOs() != b.GetOs() {
+			return a.GetOs() < b.GetOs()
+		}
+		return a.GetArch() < b.GetArch()
+	})
+	return pools
+}
+
+// takeSnapshot captures the state of the schedulers. The task leases, queue
+// deadlines and cordons are read from Redis in a single transaction, so that
+// they are consistent with each other. This scheduler's pools are captured
+// right after the transaction, so tasks may have been claimed or queued in
+// between, and task details and executor registrations are read afterwards.
+func (s *SchedulerServer) takeSnapshot(ctx context.Context) (*scpb.SchedulerSnapshot, error) {
+	if s.rdb == nil {
+		return nil, status.FailedPreconditionError("redis client not set")
+	}
+	now := s.env.GetClock().Now()
+	snapshot := &scpb.SchedulerSnapshot{
+		CaptureTimeUsec:   timeutil.ToUsec(now),
+		SchedulerHostPort: s.ownHostPort,
+	}
+
+	var leases, deadlines *redis.ZSliceCmd
+	var cordoned *redis.StringSliceCmd
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		leases = pipe.ZRangeWithScores(ctx, redisTaskLeasesKey, 0, -1)
+		deadlines = pipe.ZRangeWithScores(ctx, redisTaskQueueDeadlinesKey, 0, -1)
+		cordoned = pipe.HKeys(ctx, redisExecutorCordonsKey)
+		return nil
+	})
+	if err != nil {
+		return nil, status.InternalErrorf("could not read scheduler state from redis: %s", err)
+	}
+	snapshot.Pool = s.snapshotPools()
+
+	snapshot.CordonedExecutorId = cordoned.Val()
+	sort.Strings(snapshot.CordonedExecutorId)
+	windows, err := readMaintenanceWindows(ctx, s.rdb, now)
+	if err != nil {
+		return nil, status.InternalErrorf("could not read maintenance windows: %s", err)
+	}
+	cordons := &cordonState{executorIDs: make(map[string]struct{}, len(snapshot.CordonedExecutorId))}
+	for _, id := range snapshot.CordonedExecutorId {
+		cordons.executorIDs[id] = struct{}{}
+	}
+	for _, w := range windows {
+		snapshot.MaintenanceWindow = append(snapshot.MaintenanceWindow, w.window)
+		if w.window.GetStartTimeUsec() <= snapshot.GetCaptureTimeUsec() {
+			cordons.windows = append(cordons.windows, w)
+		}
+	}
+
+	// Tasks that are leased, have a queue deadline, or are queued in one of
+	// this scheduler's pools, in the order they were found.
+	tasks := make(map[string]*scpb.SnapshotTask)
+	var taskIDs []string
+	addTask := func(taskID string) *scpb.SnapshotTask {
+		t, ok := tasks[taskID]
+		if !ok {
+			t = &scpb.SnapshotTask{TaskId: taskID}
+			tasks[taskID] = t
+			taskIDs = append(taskIDs, taskID)
+		}
+		return t
+	}
+	for _, z := range leases.Val() {
+		addTask(fmt.Sprint(z.Member)).LeaseExpiryUsec = int64(z.Score)
+	}
+	for _, z := range deadlines.Val() {
+		addTask(fmt.Sprint(z.Member)).QueueDeadlineUsec = int64(z.Score)
+	}
+	for _, p := range snapshot.GetPool() {
+		for _, taskID := range p.GetUnclaimedTaskId() {
+			addTask(taskID)
+		}
+	}
+	if len(taskIDs) > maxSnapshotTasks {
+		log.Warningf("Scheduler snapshot includes details of only %d of %d tasks", maxSnapshotTasks, len(taskIDs))
+	}
+	for i, taskID := range taskIDs {
+		t := tasks[taskID]
+		if i >= maxSnapshotTasks {
+			t.DetailsMissing = true
+			snapshot.Task = append(snapshot.Task, t)
+			continue
+		}
+		task, err := s.readTask(ctx, taskID)
+		if err != nil {
+			if !status.IsNotFoundError(err) {
+				log.Warningf("Could not read task %q for snapshot: %s", taskID, err)
+			}
+			t.DetailsMissing = true
+			snapshot.Task = append(snapshot.Task, t)
+			continue
+		}
+		rt := redactedTask(task)
+		rt.LeaseExpiryUsec = t.GetLeaseExpiryUsec()
+		rt.QueueDeadlineUsec = t.GetQueueDeadlineUsec()
+		snapshot.Task = append(snapshot.Task, rt)
+	}
+
+	nodes, err := s.GetAllExecutionNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range nodes {
+		snapshot.Executor = append(snapshot.Executor, s.redactedExecutor(&nodes[i], cordons))
+	}
+	sort.Slice(snapshot.Executor, func(i, j int) bool {
+		return snapshot.Executor[i].GetExecutorId() < snapshot.Executor[j].GetExecutorId()
+	})
+	return snapshot, nil
+}
+
+// ExportSchedulerSnapshot writes a snapshot of the state of the schedulers to
+// the blobstore, for analysis of incidents after the fact. Since the snapshot
+// covers the executors and tasks of all groups, only server admins may export
+// it.
+func (s *SchedulerServer) ExportSchedulerSnapshot(ctx context.Context, req *scpb.ExportSchedulerSnapshotRequest) (*scpb.ExportSchedulerSnapshotResponse, error) {
+	u, err := perms.AuthenticatedUser(ctx, s.env)
+	if err != nil {
+		return nil, err
+	}
+	if !u.IsAdmin() {
+		return nil, status.PermissionDeniedError("Only server admins may export scheduler snapshots")
+	}
+	bs := s.env.GetBlobstore()
+	if bs == nil {
+		return nil, status.FailedPreconditionError("blobstore not configured")
+	}
+	snapshot, err := s.takeSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	data, err := proto.Marshal(snapshot)
+	if err != nil {
+		return nil, status.InternalErrorf("could not marshal scheduler snapshot: %s", err)
+	}
+	blobName := path.Join(snapshotBlobDir, fmt.Sprintf("%s-%s", timeutil.FromUsec(snapshot.GetCaptureTimeUsec()).UTC().Format("20060102-150405"), uuid.New().String()))
+	if _, err := bs.WriteBlob(ctx, blobName, data); err != nil {
+		return nil, status.UnavailableErrorf("could not write scheduler snapshot: %s", err)
+	}
+	log.Infof("Exported scheduler snapshot with %d tasks and %d executors to %q", len(snapshot.GetTask()), len(snapshot.GetExecutor()), blobName)
+	return &scpb.ExportSchedulerSnapshotResponse{
+		BlobName:      blobName,
+		TaskCount:     int64(len(snapshot.GetTask())),
+		ExecutorCount: int64(len(snapshot.GetExecutor())),
+	}, nil
+}
@@ -0,0 +1,136 @@
+package scheduler_server_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/scheduler_server"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+)
+
+// adminAuthenticator authenticates test users as server admins.
+type adminAuthenticator struct {
+	*testauth.TestAuthenticator
+}
+
+type adminUser struct {
+	interfaces.UserInfo
+}
+
+func (u *adminUser) IsAdmin() bool { return true }
+
+func (a *adminAuthenticator) AuthenticatedUser(ctx context.Context) (interfaces.UserInfo, error) {
+	u, err := a.TestAuthenticator.AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &adminUser{u}, nil
+}
+
+func setFlag(t *testing.T, name, value string) {
+	original := flag.Lookup(name).Value.String()
+	require.NoError(t, flag.Set(name, value))
+	t.Cleanup(func() {
+		flag.Set(name, original)
+	})
+}
+
+func exportSnapshot(ctx context.Context, t *testing.T, env *testenv.TestEnv, s *scheduler_server.SchedulerServer) *scpb.SchedulerSnapshot {
+	rsp, err := s.ExportSchedulerSnapshot(ctx, &scpb.ExportSchedulerSnapshotRequest{})
+	require.NoError(t, err)
+	data, err := env.GetBlobstore().ReadBlob(ctx, rsp.GetBlobName())
+	require.NoError(t, err)
+	snapshot := &scpb.SchedulerSnapshot{}
+	require.NoError(t, proto.Unmarshal(data, snapshot))
+	return snapshot
+}
+
+func TestExportSchedulerSnapshot_RequiresAdmin(t *testing.T) {
+	env := getEnv(t)
+	s := newScheduler(t, env)
+	ctx := authenticatedContext(t, env)
+
+	_, err := s.ExportSchedulerSnapshot(ctx, &scpb.ExportSchedulerSnapshotRequest{})
+	assert.Error(t, err)
+}
+
+func TestExportSchedulerSnapshot_Redaction(t *testing.T) {
+	env := getEnv(t)
+	ctx := authenticatedContext(t, env)
+	env.SetAuthenticator(&adminAuthenticator{env.GetAuthenticator().(*testauth.TestAuthenticator)})
+	setFlag(t, "remote_execution.snapshot_host_hash_key", "test-key")
+	s := newScheduler(t, env)
+	e := startExecutor(t, env, "executor1", 16e9)
+
+	task, err := proto.Marshal(&repb.ExecutionTask{
+		ExecutionId:  "task1",
+		InvocationId: "invocation1",
+		Jwt:          "secret-jwt",
+		Command: &repb.Command{
+			Arguments: []string{"echo", "secret-argument"},
+			EnvironmentVariables: []*repb.Command_EnvironmentVariable{
+				{Name: "TOKEN", Value: "secret-env-value"},
+			},
+		},
+		RequestMetadata: &repb.RequestMetadata{ActionMnemonic: "Genrule"},
+	})
+	require.NoError(t, err)
+	_, err = s.ScheduleTask(ctx, &scpb.ScheduleTaskRequest{
+		TaskId: "task1",
+		Metadata: &scpb.SchedulingMetadata{
+			Os:       "linux",
+			Arch:     "amd64",
+			GroupId:  testGroupID,
+			TaskSize: &scpb.TaskSize{},
+		},
+		SerializedTask: task,
+	})
+	require.NoError(t, err)
+
+	snapshot := exportSnapshot(ctx, t, env, s)
+
+	require.Len(t, snapshot.GetTask(), 1)
+	st := snapshot.GetTask()[0]
+	assert.Equal(t, "task1", st.GetTaskId())
+	assert.Equal(t, "invocation1", st.GetInvocationId())
+	assert.Equal(t, "Genrule", st.GetActionMnemonic())
+	assert.Equal(t, testGroupID, st.GetSchedulingMetadata().GetGroupId())
+
+	// The executor's host is replaced by a hash keyed with the configured
+	// key, rather than a plain hash which could be reversed by hashing
+	// likely hosts.
+	require.Len(t, snapshot.GetExecutor(), 1)
+	mac := hmac.New(sha256.New, []byte("test-key"))
+	mac.Write([]byte(e.host))
+	assert.Equal(t, hex.EncodeToString(mac.Sum(nil))[:16], snapshot.GetExecutor()[0].GetHostHash())
+	plain := sha256.Sum256([]byte(e.host))
+	assert.NotEqual(t, hex.EncodeToString(plain[:])[:16], snapshot.GetExecutor()[0].GetHostHash())
+
+	// None of the task's command, environment or credentials, nor the
+	// executor's host, appear anywhere in the snapshot.
+	data, err := proto.Marshal(snapshot)
+	require.NoError(t, err)
+	for _, secret := range []string{"secret-jwt", "secret-argument", "TOKEN", "secret-env-value", e.host} {
+		assert.NotContains(t, string(data), secret)
+	}
+
+	// Hashes can be compared across snapshots taken by schedulers with the
+	// same key, but not with different keys.
+	other := exportSnapshot(ctx, t, env, newScheduler(t, env))
+	assert.Equal(t, snapshot.GetExecutor()[0].GetHostHash(), other.GetExecutor()[0].GetHostHash())
+	setFlag(t, "remote_execution.snapshot_host_hash_key", "other-key")
+	other = exportSnapshot(ctx, t, env, newScheduler(t, env))
+	assert.NotEqual(t, snapshot.GetExecutor()[0].GetHostHash(), other.GetExecutor()[0].GetHostHash())
+}
@@ -21,6 +21,7 @@ type TaskLeaser struct {
 	env        environment.Env
 	log        *log.Logger
 	taskID     string
+	leaseID    string
 	quit       chan struct{}
 	mu         sync.Mutex // protects stream
 	stream     scpb.Scheduler_LeaseTaskClient
@@ -57,12 +58,16 @@ func (t *TaskLeaser) pingServer() ([]byte, error) {
 		return nil, err
 	}
 	t.ttl = time.Duration(rsp.GetLeaseDurationSeconds()) * time.Second
+	if rsp.GetLeaseId() != "" {
+		t.leaseID = rsp.GetLeaseId()
+	}
 	return rsp.GetSerializedTask(), nil
 }
 
 func (t *TaskLeaser) reEnqueueTask(ctx context.Context) error {
 	req := &scpb.ReEnqueueTaskRequest{
-		TaskId: t.taskID,
+		TaskId:  t.taskID,
+		LeaseId: t.leaseID,
 	}
 	if apiKey := t.env.GetConfigurator().GetExecutorConfig().APIKey; apiKey != "" {
 		ctx = metadata.AppendToOutgoingContext(ctx, auth.APIKeyHeader, apiKey)
@@ -77,7 +82,9 @@ func (t *TaskLeaser) keepLease(ctx context.Context) {
 			select {
 			case <-t.quit:
 				return
-			case <-time.After(t.ttl):
+			// Renew well before the lease expires so that a slow round trip
+			// doesn't cause the scheduler to expire the lease.
+			case <-time.After(t.ttl / 2):
 				if _, err := t.pingServer(); err != nil {
 					t.log.Warningf("Error updating lease for task: %q: %s", t.taskID, err.Error())
 					t.cancelFunc()
@@ -4,13 +4,18 @@ import (
 	"context"
 	"crypto/sha256"
 	"fmt"
+	"math"
 	"math/rand"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/tasksize"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/bazel_request"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
@@ -36,11 +41,27 @@ const (
 	// bigger than the number of probes, in case any of the nodes go down or
 	// a probe fails.
 	workflowsPreferredNodeLimit = 6
+
+	// Affinity keys that can be configured for an executor pool. Tasks with
+	// the same affinity key value are preferentially routed to the executors
+	// that most recently completed a task with that value.
+	targetLabelAffinityKey         = "target_label"
+	persistentWorkerKeyAffinityKey = "persistent_worker_key"
+
+	// The capability grade assumed for executors that haven't reported one,
+	// which is the middle of the 1-5 range.
+	defaultCapabilityGrade = 3
+
+	poolPropertyName                = "Pool"
+	persistentWorkerKeyPropertyName = "persistentWorkerKey"
 )
 
 type taskRouter struct {
 	env environment.Env
 	rdb *redis.Client
+	// affinityByPool maps lowercase pool names to their affinity routing
+	// config. The default pool is keyed by the empty string.
+	affinityByPool map[string]config.AffinityRoutingConfig
 }
 
 func New(env environment.Env) (interfaces.TaskRouter, error) {
@@ -48,30 +69,64 @@ func New(env environment.Env) (interfaces.TaskRouter, error) {
 	if rdb == nil {
 		return nil, status.FailedPreconditionError("Redis is required for task router")
 	}
+	affinityByPool := map[string]config.AffinityRoutingConfig{}
+	if rec := env.GetConfigurator().GetRemoteExecutionConfig(); rec != nil {
+		for _, c := range rec.AffinityRouting {
+			if c.Key != targetLabelAffinityKey && c.Key != persistentWorkerKeyAffinityKey {
+				return nil, status.InvalidArgumentErrorf("invalid affinity routing key %q for pool %q", c.Key, c.Pool)
+			}
+			affinityByPool[normalizePoolName(c.Pool)] = c
+		}
+	}
 	return &taskRouter{
-		env: env,
-		rdb: rdb,
+		env:            env,
+		rdb:            rdb,
+		affinityByPool: affinityByPool,
 	}, nil
 }
 
+// shuffleByCapability randomly orders the given nodes such that nodes with a
+// higher capability grade are proportionally more likely to come first. This
+// spreads heavy tasks toward faster executors without sending all of them to
+// the fastest one.
+func shuffleByCapability(nodes []interfaces.ExecutionNode) {
+	// Weighted random sampling without replacement (Efraimidis-Spirakis):
+	// order by u^(1/w) for u uniform in (0, 1).
+	keys := make(map[interfaces.ExecutionNode]float64, len(nodes))
+	for _, node := range nodes {
+		weight := float64(node.GetCapabilityGrade())
+		if weight <= 0 {
+			weight = defaultCapabilityGrade
+		}
+		keys[node] = math.Pow(rand.Float64(), 1/weight)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return keys[nodes[i]] > keys[nodes[j]]
+	})
+}
+
 // RankNodes returns the input nodes ordered by their affinity to the given
 // routing properties.
 func (tr *taskRouter) RankNodes(ctx context.Context, cmd *repb.Command, remoteInstanceName string, nodes []interfaces.ExecutionNode) []interfaces.ExecutionNode {
 	nodes = copyNodes(nodes)
 
-	rand.Shuffle(len(nodes), func(i, j int) {
-		nodes[i], nodes[j] = nodes[j], nodes[i]
-	})
+	if cmd != nil && tasksize.IsHeavy(tasksize.Estimate(cmd)) {
+		shuffleByCapability(nodes)
+	} else {
+		rand.Shuffle(len(nodes), func(i, j int) {
+			nodes[i], nodes[j] = nodes[j], nodes[i]
+		})
+	}
 
 	if cmd == nil {
 		return nodes
 	}
-	preferredNodeLimit := getPreferredNodeLimit(cmd)
+	preferredNodeLimit, affinityValue := tr.routingParams(ctx, cmd)
 	if preferredNodeLimit == 0 {
 		return nodes
 	}
 
-	key, err := tr.routingKey(ctx, cmd, remoteInstanceName)
+	key, err := tr.routingKey(ctx, cmd, remoteInstanceName, affinityValue)
 	if err != nil {
 		log.Errorf("Failed to compute routing key: %s", err)
 		return nodes
@@ -113,11 +168,11 @@ func (tr *taskRouter) RankNodes(ctx context.Context, cmd *repb.Command, remoteIn
 // future tasks with those properties are more likely to be fulfilled by the
 // given node.
 func (tr *taskRouter) MarkComplete(ctx context.Context, cmd *repb.Command, remoteInstanceName, executorID string) {
-	nodeListMaxLength := getPreferredNodeLimit(cmd)
+	nodeListMaxLength, affinityValue := tr.routingParams(ctx, cmd)
 	if nodeListMaxLength == 0 {
 		return
 	}
-	key, err := tr.routingKey(ctx, cmd, remoteInstanceName)
+	key, err := tr.routingKey(ctx, cmd, remoteInstanceName, affinityValue)
 	if err != nil {
 		log.Errorf("Failed to compute routing key: %s", err)
 		return
@@ -137,22 +192,43 @@ func (tr *taskRouter) MarkComplete(ctx context.Context, cmd *repb.Command, remot
 	}
 }
 
-// getPreferredNodeLimit returns the max number of nodes that should be stored
-// in the preferred executors list for each task key, as well as the max number
-// of preferred nodes that should be returned by RankNodes.
-func getPreferredNodeLimit(cmd *repb.Command) int {
+// routingParams returns the max number of nodes that should be stored in the
+// preferred executors list for each task key, as well as the max number of
+// preferred nodes that should be returned by RankNodes. If the task is routed
+// by an affinity key configured for its pool, the value of that key is also
+// returned.
+func (tr *taskRouter) routingParams(ctx context.Context, cmd *repb.Command) (int, string) {
 	isRunnerRecyclingEnabled := platform.IsTrue(platform.FindValue(cmd.GetPlatform(), platform.RecycleRunnerPropertyName))
-	if !isRunnerRecyclingEnabled {
-		return 0
+	if isRunnerRecyclingEnabled {
+		workflowID := platform.FindValue(cmd.GetPlatform(), platform.WorkflowIDPropertyName)
+		if workflowID != "" {
+			return workflowsPreferredNodeLimit, ""
+		}
+		return defaultPreferredNodeLimit, ""
+	}
+
+	c, ok := tr.affinityByPool[normalizePoolName(findValueIgnoreCase(cmd.GetPlatform(), poolPropertyName))]
+	if !ok {
+		return 0, ""
+	}
+	value := ""
+	switch c.Key {
+	case targetLabelAffinityKey:
+		value = bazel_request.GetRequestMetadata(ctx).GetTargetId()
+	case persistentWorkerKeyAffinityKey:
+		value = findValueIgnoreCase(cmd.GetPlatform(), persistentWorkerKeyPropertyName)
 	}
-	workflowID := platform.FindValue(cmd.GetPlatform(), platform.WorkflowIDPropertyName)
-	if workflowID != "" {
-		return workflowsPreferredNodeLimit
+	if value == "" {
+		return 0, ""
 	}
-	return defaultPreferredNodeLimit
+	limit := c.PreferredNodeLimit
+	if limit <= 0 {
+		limit = defaultPreferredNodeLimit
+	}
+	return limit, value
 }
 
-func (tr *taskRouter) routingKey(ctx context.Context, cmd *repb.Command, remoteInstanceName string) (string, error) {
+func (tr *taskRouter) routingKey(ctx context.Context, cmd *repb.Command, remoteInstanceName, affinityValue string) (string, error) {
 	parts := []string{"task_route"}
 
 	if u, err := perms.AuthenticatedUser(ctx, tr.env); err == nil {
@@ -175,9 +251,30 @@ func (tr *taskRouter) routingKey(ctx context.Context, cmd *repb.Command, remoteI
 	}
 	parts = append(parts, fmt.Sprintf("%x", sha256.Sum256(b)))
 
+	if affinityValue != "" {
+		parts = append(parts, "affinity", fmt.Sprintf("%x", sha256.Sum256([]byte(affinityValue))))
+	}
+
 	return strings.Join(parts, "/"), nil
 }
 
+func normalizePoolName(pool string) string {
+	pool = strings.ToLower(strings.TrimSpace(pool))
+	if pool == platform.DefaultPoolValue {
+		return ""
+	}
+	return pool
+}
+
+func findValueIgnoreCase(plat *repb.Platform, name string) string {
+	for _, prop := range plat.GetProperties() {
+		if strings.EqualFold(prop.GetName(), name) {
+			return strings.TrimSpace(prop.GetValue())
+		}
+	}
+	return ""
+}
+
 func copyNodes(nodes []interfaces.ExecutionNode) []interfaces.ExecutionNode {
 	out := make([]interfaces.ExecutionNode, len(nodes))
 	copy(out, nodes)
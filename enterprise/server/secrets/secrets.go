@@ -0,0 +1,253 @@
+// Package secrets stores secrets owned by groups, such as the credentials of
+// integrations, encrypted with AES-GCM under a master key. The master key is
+// either configured directly, or configured encrypted by AWS KMS and
+// decrypted by KMS when the server starts.
+package secrets
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	secpb "github.com/buildbuddy-io/buildbuddy/proto/secrets"
+)
+
+const (
+	masterKeyLength = 32
+
+	// Encrypted values start with this prefix, followed by the base64-encoded
+	// nonce and ciphertext. The version allows the format to change later.
+	encryptedPrefix = "enc1:"
+
+	maxSecretValueLength = 64 * 1024
+)
+
+var (
+	secretNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,128}$`)
+)
+
+// IsConfigured returns whether a master key is configured, without which
+// secrets can't be stored.
+func IsConfigured(c *config.SecretsConfig) bool {
+	return c.MasterKey != "" || c.AWSKMS.EncryptedMasterKey != ""
+}
+
+type SecretService struct {
+	env  environment.Env
+	aead cipher.AEAD
+}
+
+func NewSecretService(ctx context.Context, env environment.Env) (*SecretService, error) {
+	key, err := masterKey(ctx, env.GetConfigurator().GetSecretsConfig())
+	if err != nil {
+		return nil, err
+	}
+	return newSecretService(env, key)
+}
+
+func newSecretService(env environment.Env, key []byte) (*SecretService, error) {
+	if len(key) != masterKeyLength {
+		return nil, status.InvalidArgumentErrorf("the secrets master key must be %d bytes long, but is %d", masterKeyLength, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, status.InternalErrorf("failed to create secrets cipher: %s", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, status.InternalErrorf("failed to create secrets cipher: %s", err)
+	}
+	return &SecretService{env: env, aead: aead}, nil
+}
+
+func masterKey(ctx context.Context, c *config.SecretsConfig) ([]byte, error) {
+	if c.MasterKey != "" && c.AWSKMS.EncryptedMasterKey != "" {
+		return nil, status.InvalidArgumentError("only one of secrets.master_key and secrets.aws_kms.encrypted_master_key may be set")
+	}
+	if c.MasterKey != "" {
+		key, err := base64.StdEncoding.DecodeString(c.MasterKey)
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("secrets.master_key is not valid base64: %s", err)
+		}
+		return key, nil
+	}
+	if c.AWSKMS.EncryptedMasterKey != "" {
+		return decryptWithAWSKMS(ctx, &c.AWSKMS)
+	}
+	return nil, status.FailedPreconditionError("no secrets master key is configured")
+}
+
+func decryptWithAWSKMS(ctx context.Context, c *config.AWSKMSKeyConfig) ([]byte, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(c.EncryptedMasterKey)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("secrets.aws_kms.encrypted_master_key is not valid base64: %s", err)
+	}
+	var creds *credentials.Credentials
+	if c.CredentialsProfile != "" {
+		creds = credentials.NewSharedCredentials("", c.CredentialsProfile)
+	}
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String(c.Region),
+		Credentials: creds,
+	})
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to create AWS session: %s", err)
+	}
+	// The ciphertext identifies the KMS key that it was encrypted with.
+	rsp, err := kms.New(sess).DecryptWithContext(ctx, &kms.DecryptInput{CiphertextBlob: ciphertext})
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to decrypt the secrets master key with AWS KMS: %s", err)
+	}
+	return rsp.Plaintext, nil
+}
+
+// encrypt encrypts the plaintext, authenticating it along with the associated
+// data so that the ciphertext can't be moved to where other data is expected.
+func (s *SecretService) encrypt(plaintext string, associatedData []byte) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", status.InternalErrorf("failed to generate nonce: %s", err)
+	}
+	sealed := s.aead.Seal(nonce, nonce, []byte(plaintext), associatedData)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *SecretService) decrypt(ciphertext string, associatedData []byte) (string, error) {
+	if !strings.HasPrefix(ciphertext, encryptedPrefix) {
+		return "", status.DataLossError("value is not encrypted")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(ciphertext, encryptedPrefix))
+	if err != nil || len(sealed) < s.aead.NonceSize() {
+		return "", status.DataLossError("encrypted value is malformed")
+	}
+	nonceSize := s.aead.NonceSize()
+	plaintext, err := s.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], associatedData)
+	if err != nil {
+		// Most likely, the master key was changed.
+		return "", status.DataLossErrorf("failed to decrypt value: %s", err)
+	}
+	return string(plaintext), nil
+}
+
+// Encrypt encrypts a credential for storage outside of the secrets table.
+// Empty values are left empty, so that callers can still tell whether a
+// credential was set.
+func (s *SecretService) Encrypt(plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	return s.encrypt(plaintext, nil)
+}
+
+// Decrypt decrypts a value returned by Encrypt. Values which aren't encrypted,
+// because they were stored before secrets were configured, are returned as
+// they are.
+func (s *SecretService) Decrypt(ciphertext string) (string, error) {
+	if !strings.HasPrefix(ciphertext, encryptedPrefix) {
+		return ciphertext, nil
+	}
+	return s.decrypt(ciphertext, nil)
+}
+
+// secretAssociatedData binds the value of a secret to its group and name.
+func secretAssociatedData(groupID, name string) []byte {
+	return []byte(groupID + "/" + name)
+}
+
+func (s *SecretService) GetSecretValue(ctx context.Context, groupID, name string) (string, error) {
+	secret := &tables.Secret{}
+	err := s.env.GetDBHandle().Raw(`SELECT * FROM Secrets WHERE group_id = ? AND name = ?`, groupID, name).Take(secret).Error
+	if err != nil {
+		if db.IsRecordNotFound(err) {
+			return "", status.NotFoundErrorf("secret %q not found", name)
+		}
+		return "", err
+	}
+	return s.decrypt(secret.Value, secretAssociatedData(groupID, name))
+}
+
+func (s *SecretService) GetSecrets(ctx context.Context, req *secpb.GetSecretsRequest) (*secpb.GetSecretsResponse, error) {
+	groupID, err := perms.AuthenticateSelectedGroupID(ctx, s.env, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	var secrets []*tables.Secret
+	err = s.env.GetDBHandle().Raw(`SELECT name, created_at_usec, updated_at_usec FROM Secrets WHERE group_id = ? ORDER BY name`, groupID).Scan(&secrets).Error
+	if err != nil {
+		return nil, err
+	}
+	rsp := &secpb.GetSecretsResponse{}
+	for _, secret := range secrets {
+		rsp.Secret = append(rsp.Secret, &secpb.Secret{
+			Name:          secret.Name,
+			CreatedAtUsec: secret.CreatedAtUsec,
+			UpdatedAtUsec: secret.UpdatedAtUsec,
+		})
+	}
+	return rsp, nil
+}
+
+func (s *SecretService) UpdateSecret(ctx context.Context, req *secpb.UpdateSecretRequest) (*secpb.UpdateSecretResponse, error) {
+	groupID, err := perms.AuthenticateSelectedGroupID(ctx, s.env, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	name := req.GetName()
+	if !secretNameRegexp.MatchString(name) {
+		return nil, status.InvalidArgumentErrorf("invalid secret name %q: names may only contain letters, digits, '_', '-', and '.', and must be at most 128 characters long", name)
+	}
+	if req.GetValue() == "" {
+		return nil, status.InvalidArgumentError("a secret value is required")
+	}
+	if len(req.GetValue()) > maxSecretValueLength {
+		return nil, status.InvalidArgumentErrorf("secret values must be at most %d bytes long", maxSecretValueLength)
+	}
+	value, err := s.encrypt(req.GetValue(), secretAssociatedData(groupID, name))
+	if err != nil {
+		return nil, err
+	}
+	err = s.env.GetDBHandle().Transaction(ctx, func(tx *db.DB) error {
+		var existing tables.Secret
+		if err := tx.Where("group_id = ? AND name = ?", groupID, name).First(&existing).Error; err != nil {
+			if db.IsRecordNotFound(err) {
+				return tx.Create(&tables.Secret{GroupID: groupID, Name: name, Value: value}).Error
+			}
+			return err
+		}
+		return tx.Model(&existing).Where("group_id = ? AND name = ?", groupID, name).Updates(&tables.Secret{Value: value}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &secpb.UpdateSecretResponse{}, nil
+}
+
+func (s *SecretService) DeleteSecret(ctx context.Context, req *secpb.DeleteSecretRequest) (*secpb.DeleteSecretResponse, error) {
+	groupID, err := perms.AuthenticateSelectedGroupID(ctx, s.env, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	result := s.env.GetDBHandle().Exec(`DELETE FROM Secrets WHERE group_id = ? AND name = ?`, groupID, req.GetName())
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, status.NotFoundErrorf("secret %q not found", req.GetName())
+	}
+	return &secpb.DeleteSecretResponse{}, nil
+}
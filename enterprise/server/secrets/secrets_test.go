@@ -0,0 +1,122 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	secpb "github.com/buildbuddy-io/buildbuddy/proto/secrets"
+)
+
+func newTestService(t *testing.T) (*SecretService, *testenv.TestEnv) {
+	te := enterprise_testenv.GetCustomTestEnv(t, &enterprise_testenv.Options{})
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1", "US2", "GR2")))
+	ss, err := newSecretService(te, bytes.Repeat([]byte{1}, masterKeyLength))
+	require.NoError(t, err)
+	return ss, te
+}
+
+func authContext(t *testing.T, te *testenv.TestEnv, userID string) context.Context {
+	ctx, err := te.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), userID)
+	require.NoError(t, err)
+	return ctx
+}
+
+func TestSecrets(t *testing.T) {
+	ss, te := newTestService(t)
+	ctx := authContext(t, te, "US1")
+	reqCtx := testauth.RequestContext("US1", "GR1")
+
+	_, err := ss.UpdateSecret(ctx, &secpb.UpdateSecretRequest{RequestContext: reqCtx, Name: "slack_url", Value: "https://hooks.slack.com/1"})
+	require.NoError(t, err)
+	_, err = ss.UpdateSecret(ctx, &secpb.UpdateSecretRequest{RequestContext: reqCtx, Name: "api.token", Value: "old"})
+	require.NoError(t, err)
+	_, err = ss.UpdateSecret(ctx, &secpb.UpdateSecretRequest{RequestContext: reqCtx, Name: "api.token", Value: "new"})
+	require.NoError(t, err)
+
+	rsp, err := ss.GetSecrets(ctx, &secpb.GetSecretsRequest{RequestContext: reqCtx})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetSecret(), 2)
+	assert.Equal(t, "api.token", rsp.GetSecret()[0].GetName())
+	assert.Equal(t, "slack_url", rsp.GetSecret()[1].GetName())
+
+	value, err := ss.GetSecretValue(ctx, "GR1", "api.token")
+	require.NoError(t, err)
+	assert.Equal(t, "new", value)
+
+	// Values are stored encrypted.
+	var stored string
+	err = te.GetDBHandle().Raw(`SELECT value FROM Secrets WHERE group_id = ? AND name = ?`, "GR1", "api.token").Row().Scan(&stored)
+	require.NoError(t, err)
+	assert.NotContains(t, stored, "new")
+
+	// Other groups can't see the secrets.
+	ctx2 := authContext(t, te, "US2")
+	_, err = ss.GetSecrets(ctx2, &secpb.GetSecretsRequest{RequestContext: reqCtx})
+	assert.Error(t, err)
+	rsp, err = ss.GetSecrets(ctx2, &secpb.GetSecretsRequest{RequestContext: testauth.RequestContext("US2", "GR2")})
+	require.NoError(t, err)
+	assert.Empty(t, rsp.GetSecret())
+	_, err = ss.GetSecretValue(ctx, "GR2", "api.token")
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+
+	_, err = ss.DeleteSecret(ctx, &secpb.DeleteSecretRequest{RequestContext: reqCtx, Name: "api.token"})
+	require.NoError(t, err)
+	_, err = ss.GetSecretValue(ctx, "GR1", "api.token")
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+	_, err = ss.DeleteSecret(ctx, &secpb.DeleteSecretRequest{RequestContext: reqCtx, Name: "api.token"})
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+}
+
+func TestUpdateSecretValidatesRequest(t *testing.T) {
+	ss, te := newTestService(t)
+	ctx := authContext(t, te, "US1")
+	reqCtx := testauth.RequestContext("US1", "GR1")
+
+	for _, name := range []string{"", "has space", "slash/name"} {
+		_, err := ss.UpdateSecret(ctx, &secpb.UpdateSecretRequest{RequestContext: reqCtx, Name: name, Value: "v"})
+		assert.True(t, status.IsInvalidArgumentError(err), "name %q: expected InvalidArgument, got %v", name, err)
+	}
+	_, err := ss.UpdateSecret(ctx, &secpb.UpdateSecretRequest{RequestContext: reqCtx, Name: "empty"})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	ss, te := newTestService(t)
+
+	ciphertext, err := ss.Encrypt("token")
+	require.NoError(t, err)
+	assert.NotContains(t, ciphertext, "token")
+	plaintext, err := ss.Decrypt(ciphertext)
+	require.NoError(t, err)
+	assert.Equal(t, "token", plaintext)
+
+	// Empty and unencrypted values are returned as they are.
+	ciphertext, err = ss.Encrypt("")
+	require.NoError(t, err)
+	assert.Equal(t, "", ciphertext)
+	plaintext, err = ss.Decrypt("legacy-token")
+	require.NoError(t, err)
+	assert.Equal(t, "legacy-token", plaintext)
+
+	// Values encrypted with another key can't be decrypted.
+	other, err := newSecretService(te, bytes.Repeat([]byte{2}, masterKeyLength))
+	require.NoError(t, err)
+	ciphertext, err = other.Encrypt("token")
+	require.NoError(t, err)
+	_, err = ss.Decrypt(ciphertext)
+	assert.True(t, status.IsDataLossError(err), "expected DataLoss, got %v", err)
+}
+
+func TestMasterKeyMustBe32Bytes(t *testing.T) {
+	te := enterprise_testenv.GetCustomTestEnv(t, &enterprise_testenv.Options{})
+	_, err := newSecretService(te, []byte("short"))
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+}
@@ -14,6 +14,11 @@ const (
 	// otherwise determine the size for.
 	DefaultMemEstimate = int64(400 * 1e6)
 	DefaultCPUEstimate = int64(600)
+
+	// Tasks estimated to need at least this much memory and CPU are
+	// considered heavy, and are preferentially scheduled on faster executors.
+	heavyMemThreshold = int64(300 * 1e6)
+	heavyCPUThreshold = int64(1000)
 )
 
 func testSize(testSize string) (int64, int64) {
@@ -55,3 +60,9 @@ func Estimate(cmd *repb.Command) *scpb.TaskSize {
 		EstimatedMilliCpu:    cpuEstimate,
 	}
 }
+
+// IsHeavy returns whether a task of the given size should be preferentially
+// scheduled on executors with a higher capability grade.
+func IsHeavy(size *scpb.TaskSize) bool {
+	return size.GetEstimatedMemoryBytes() >= heavyMemThreshold && size.GetEstimatedMilliCpu() >= heavyCPUThreshold
+}
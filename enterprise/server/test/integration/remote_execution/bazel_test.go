@@ -0,0 +1,91 @@
+package remote_execution_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/test/integration/remote_execution/rbetest"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testbazel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+var (
+	// chainedGenrulesWorkspace has two actions, one of which consumes the
+	// output of the other.
+	chainedGenrulesWorkspace = map[string]string{
+		"WORKSPACE": `workspace(name = "integration_test")`,
+		"BUILD": `
+genrule(name = "hello_txt", outs = ["hello.txt"], cmd_bash = "echo 'Hello' > $@")
+genrule(name = "hello_world_txt", srcs = [":hello_txt"], outs = ["hello_world.txt"], cmd_bash = "cat $< > $@ && echo 'world' >> $@")
+`,
+	}
+	// failingGenruleWorkspace has an action which always fails.
+	failingGenruleWorkspace = map[string]string{
+		"WORKSPACE": `workspace(name = "integration_test")`,
+		"BUILD":     `genrule(name = "fail_txt", outs = ["fail.txt"], cmd_bash = "exit 1")`,
+	}
+)
+
+func TestBazelBuild_RemoteExecution(t *testing.T) {
+	rbe := rbetest.NewRBETestEnv(t)
+	rbe.AddBuildBuddyServer()
+	rbe.AddExecutors(2)
+	ws := testbazel.MakeTempWorkspace(t, chainedGenrulesWorkspace)
+
+	result := rbe.RunBazel(ws, "build", "//:hello_world_txt")
+
+	require.NoError(t, result.Error)
+	assert.Contains(t, result.Stderr, "Build completed successfully")
+	assert.Equal(t, 2, result.RemoteExecutions(), "both actions should be executed remotely")
+	assert.Equal(t, 0, result.RemoteCacheHits(), "initial build shouldn't be cached")
+
+	inv := rbe.GetInvocation(result.InvocationID)
+	assert.Equal(t, inpb.Invocation_COMPLETE_INVOCATION_STATUS, inv.GetInvocationStatus())
+	assert.True(t, inv.GetSuccess(), "invocation should be successful")
+	assert.Equal(t, "build", inv.GetCommand())
+	assert.Equal(t, []string{"//:hello_world_txt"}, inv.GetPattern())
+}
+
+func TestBazelBuild_SecondBuildIsCached(t *testing.T) {
+	rbe := rbetest.NewRBETestEnv(t)
+	rbe.AddBuildBuddyServer()
+	rbe.AddExecutor()
+	ws := testbazel.MakeTempWorkspace(t, chainedGenrulesWorkspace)
+
+	result := rbe.RunBazel(ws, "build", "//:hello_world_txt")
+	require.NoError(t, result.Error)
+	require.Equal(t, 2, result.RemoteExecutions(), "sanity check: initial build should be executed remotely")
+
+	// Clear the local cache so that the outputs have to come from the remote
+	// cache.
+	testbazel.Clean(context.Background(), t, ws)
+
+	result = rbe.RunBazel(ws, "build", "//:hello_world_txt")
+
+	require.NoError(t, result.Error)
+	assert.Equal(t, 2, result.RemoteCacheHits(), "second build should be served from the remote cache")
+	assert.Equal(t, 0, result.RemoteExecutions(), "second build should not execute any actions")
+
+	inv := rbe.GetInvocation(result.InvocationID)
+	assert.True(t, inv.GetSuccess(), "invocation should be successful")
+	assert.Equal(t, int64(2), inv.GetCacheStats().GetActionCacheHits(), "action cache hits should be recorded for the invocation")
+}
+
+func TestBazelBuild_FailedAction(t *testing.T) {
+	rbe := rbetest.NewRBETestEnv(t)
+	rbe.AddBuildBuddyServer()
+	rbe.AddExecutor()
+	ws := testbazel.MakeTempWorkspace(t, failingGenruleWorkspace)
+
+	result := rbe.RunBazel(ws, "build", "//:fail_txt")
+
+	require.Error(t, result.Error)
+	assert.Contains(t, result.Stderr, "Build did NOT complete successfully")
+
+	inv := rbe.GetInvocation(result.InvocationID)
+	assert.Equal(t, inpb.Invocation_COMPLETE_INVOCATION_STATUS, inv.GetInvocationStatus())
+	assert.False(t, inv.GetSuccess(), "invocation should not be successful")
+}
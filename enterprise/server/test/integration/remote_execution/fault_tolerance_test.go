@@ -0,0 +1,96 @@
+package remote_execution_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/test/integration/remote_execution/rbetest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecutorKilledMidAction(t *testing.T) {
+	rbe := rbetest.NewRBETestEnv(t)
+
+	rbe.AddBuildBuddyServer()
+	doomed := rbe.AddSingleTaskExecutorWithOptions(&rbetest.ExecutorOptions{Name: "doomedExecutor"})
+
+	cmd := rbe.ExecuteControlledCommand("command1")
+	cmd.WaitStarted()
+
+	// Kill the executor while the command is running on it. The command
+	// should be retried on the new executor.
+	rbe.AddExecutorWithOptions(&rbetest.ExecutorOptions{Name: "newExecutor"})
+	rbe.KillExecutor(doomed)
+	cmd.WaitStartedTimes(2)
+
+	cmd.Exit(3)
+	res := cmd.WaitThroughFaults()
+	assert.Equal(t, "newExecutor", res.Executor, "command should have been retried on the new executor")
+	assert.Equal(t, 3, res.ExitCode, "exit code of the retried command should be propagated")
+}
+
+func TestDroppedSchedulerConnections(t *testing.T) {
+	rbe := rbetest.NewRBETestEnv(t)
+
+	rbe.AddBuildBuddyServers(2)
+	executors := rbe.AddExecutors(3)
+
+	var cmds []*rbetest.Command
+	for i := 0; i < 10; i++ {
+		cmd := rbe.ExecuteCustomCommand("sh", "-c", fmt.Sprintf("sleep 2 && echo 'hello from command %d'", i))
+		cmds = append(cmds, cmd)
+	}
+	for _, cmd := range cmds {
+		cmd.WaitAccepted()
+	}
+
+	// Repeatedly drop the connections of all executors while the commands
+	// run. Commands whose tasks are interrupted may be retried, but each
+	// should complete exactly as if nothing happened.
+	for i := 0; i < 3; i++ {
+		for _, e := range executors {
+			rbe.DropSchedulerConnections(e)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	for i, cmd := range cmds {
+		res := cmd.WaitThroughFaults()
+		assert.Equal(t, 0, res.ExitCode, "exit code should be propagated")
+		assert.Equal(t, fmt.Sprintf("hello from command %d\n", i), res.Stdout, "stdout should be propagated")
+		assert.Equal(t, "", res.Stderr, "stderr should be empty")
+	}
+}
+
+func TestBuildBuddyServerRestart(t *testing.T) {
+	rbe := rbetest.NewRBETestEnv(t)
+
+	restarted := rbe.AddBuildBuddyServer()
+	rbe.AddBuildBuddyServer()
+	rbe.AddExecutors(3)
+
+	var cmds []*rbetest.Command
+	for i := 0; i < 10; i++ {
+		cmd := rbe.ExecuteCustomCommand("sh", "-c", fmt.Sprintf("sleep 1 && echo 'hello from command %d'", i))
+		cmds = append(cmds, cmd)
+	}
+	for _, cmd := range cmds {
+		cmd.WaitAccepted()
+	}
+
+	// Restart one of the servers while the commands run. Clients and
+	// executors connected to it have to reconnect.
+	rbe.RestartBuildBuddyServer(restarted)
+
+	for i, cmd := range cmds {
+		res := cmd.WaitThroughFaults()
+		assert.Equal(t, 0, res.ExitCode, "exit code should be propagated")
+		assert.Equal(t, fmt.Sprintf("hello from command %d\n", i), res.Stdout, "stdout should be propagated")
+	}
+
+	// The restarted server should keep scheduling new work.
+	cmd := rbe.ExecuteCustomCommand("sh", "-c", "echo 'hello after restart'")
+	res := cmd.WaitThroughFaults()
+	assert.Equal(t, "hello after restart\n", res.Stdout, "stdout should be propagated")
+}
@@ -0,0 +1,237 @@
+package rbeclient
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/histogram"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/ptypes"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
+	gstatus "google.golang.org/grpc/status"
+)
+
+// LoadGeneratorOpts configures a LoadGenerator.
+type LoadGeneratorOpts struct {
+	// NumExecutions is the total number of executions. The actions are
+	// executed in round-robin order. Defaults to the number of actions.
+	NumExecutions int
+	// Concurrency is the maximum number of executions in flight at once.
+	// Defaults to 1.
+	Concurrency int
+	// QPS is the maximum number of executions started per second. Executions
+	// are started as fast as the concurrency allows if unset.
+	QPS float64
+	// ExecutionTimeout is how long to wait for each execution to finish after
+	// starting it. Executions are waited on indefinitely if unset.
+	ExecutionTimeout time.Duration
+}
+
+// LoadGenerator executes a set of prepared actions repeatedly to put load on
+// the executors, and aggregates the results.
+type LoadGenerator struct {
+	actions []*Command
+	opts    LoadGeneratorOpts
+}
+
+// NewLoadGenerator returns a load generator that executes the given actions,
+// which must have been prepared with PrepareCommand but not started. The
+// actions are only used as templates, so each may be executed many times.
+func NewLoadGenerator(actions []*Command, opts *LoadGeneratorOpts) (*LoadGenerator, error) {
+	if len(actions) == 0 {
+		return nil, status.InvalidArgumentError("at least one action is required to generate load")
+	}
+	o := *opts
+	if o.NumExecutions == 0 {
+		o.NumExecutions = len(actions)
+	}
+	if o.Concurrency == 0 {
+		o.Concurrency = 1
+	}
+	if o.NumExecutions < 0 || o.Concurrency < 0 || o.QPS < 0 || o.ExecutionTimeout < 0 {
+		return nil, status.InvalidArgumentError("load generator options must not be negative")
+	}
+	return &LoadGenerator{actions: actions, opts: o}, nil
+}
+
+// Run executes the actions and waits for all of the executions to finish. An
+// error is returned only if the context is done before all of the executions
+// were started; execution failures are reported in the stats.
+func (g *LoadGenerator) Run(ctx context.Context) (*LoadStats, error) {
+	var ticker *time.Ticker
+	if g.opts.QPS > 0 {
+		ticker = time.NewTicker(time.Duration(float64(time.Second) / g.opts.QPS))
+		defer ticker.Stop()
+	}
+
+	startTime := time.Now()
+	results := make([]*CommandResult, g.opts.NumExecutions)
+	inFlight := make(chan struct{}, g.opts.Concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < g.opts.NumExecutions; i++ {
+		if ticker != nil {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				wg.Wait()
+				return nil, status.CanceledErrorf("load generation stopped after starting %d of %d executions: %s", i, g.opts.NumExecutions, ctx.Err())
+			}
+		}
+		select {
+		case inFlight <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return nil, status.CanceledErrorf("load generation stopped after starting %d of %d executions: %s", i, g.opts.NumExecutions, ctx.Err())
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+			results[i] = g.execute(ctx, i)
+		}(i)
+	}
+	wg.Wait()
+
+	stats := ComputeLoadStats(results)
+	stats.Duration = time.Since(startTime)
+	return stats, nil
+}
+
+// execute executes the i-th action and waits for it to finish.
+func (g *LoadGenerator) execute(ctx context.Context, i int) *CommandResult {
+	action := g.actions[i%len(g.actions)]
+	cmd := action.newExecution(fmt.Sprintf("%s [execution %d]", action.Name, i))
+	if g.opts.ExecutionTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.opts.ExecutionTimeout)
+		defer cancel()
+	}
+	failed := func(err error) *CommandResult {
+		log.Debugf("Command %q failed: %s", cmd.Name, err)
+		return &CommandResult{
+			CommandName:  cmd.Name,
+			InstanceName: cmd.InstanceName(),
+			Stage:        repb.ExecutionStage_COMPLETED,
+			Err:          err,
+		}
+	}
+	if err := cmd.Start(ctx); err != nil {
+		return failed(err)
+	}
+	res, err := cmd.Wait(ctx)
+	if err != nil {
+		return failed(err)
+	}
+	return res
+}
+
+// LoadStats are the aggregated results of many executions.
+type LoadStats struct {
+	// Results are the results of the individual executions.
+	Results []*CommandResult
+	// Duration is the wall time taken to run all of the executions.
+	Duration time.Duration
+
+	NumExecutions int
+	NumErrors     int
+	// ExitCodes is the number of executions that finished with each exit
+	// code. Executions that failed with an error are not included.
+	ExitCodes map[int]int
+	// ErrorCodes is the number of executions that failed with an error of
+	// each gRPC status code, such as "DeadlineExceeded".
+	ErrorCodes map[string]int
+
+	// Latency percentiles, in milliseconds, of executions that finished
+	// without an error. Queue time is the time from being queued on the
+	// server to starting on a worker, execution time is the time spent
+	// running the command on the worker and total time is the time from
+	// sending the Execute request to receiving the result.
+	QueueTimeMillis     histogram.Percentiles
+	ExecutionTimeMillis histogram.Percentiles
+	TotalTimeMillis     histogram.Percentiles
+}
+
+// ComputeLoadStats aggregates the given execution results.
+func ComputeLoadStats(results []*CommandResult) *LoadStats {
+	stats := &LoadStats{
+		Results:       results,
+		NumExecutions: len(results),
+		ExitCodes:     make(map[int]int),
+		ErrorCodes:    make(map[string]int),
+	}
+	queueHist := histogram.New()
+	execHist := histogram.New()
+	totalHist := histogram.New()
+	for _, res := range results {
+		if res.Err != nil {
+			stats.NumErrors++
+			stats.ErrorCodes[gstatus.Code(res.Err).String()]++
+			continue
+		}
+		stats.ExitCodes[res.ExitCode]++
+		totalHist.Add(res.LocalStats.Total.Milliseconds())
+		if d, ok := timestampDiff(res.RemoteStats.GetQueuedTimestamp(), res.RemoteStats.GetWorkerStartTimestamp()); ok {
+			queueHist.Add(d.Milliseconds())
+		}
+		if d, ok := timestampDiff(res.RemoteStats.GetExecutionStartTimestamp(), res.RemoteStats.GetExecutionCompletedTimestamp()); ok {
+			execHist.Add(d.Milliseconds())
+		}
+	}
+	stats.QueueTimeMillis = queueHist.Percentiles()
+	stats.ExecutionTimeMillis = execHist.Percentiles()
+	stats.TotalTimeMillis = totalHist.Percentiles()
+	return stats
+}
+
+// timestampDiff returns the duration between the given timestamps, and
+// whether both of them are valid.
+func timestampDiff(startPb, endPb *tspb.Timestamp) (time.Duration, bool) {
+	if startPb == nil || endPb == nil {
+		return 0, false
+	}
+	start, err := ptypes.Timestamp(startPb)
+	if err != nil {
+		return 0, false
+	}
+	end, err := ptypes.Timestamp(endPb)
+	if err != nil {
+		return 0, false
+	}
+	return end.Sub(start), true
+}
+
+func (s *LoadStats) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d executions in %s, %d errors\n", s.NumExecutions, s.Duration, s.NumErrors)
+	formatPercentiles := func(name string, p histogram.Percentiles) {
+		fmt.Fprintf(&b, "%s: p50 %d ms, p95 %d ms, p99 %d ms\n", name, p.P50, p.P95, p.P99)
+	}
+	formatPercentiles("Queue time", s.QueueTimeMillis)
+	formatPercentiles("Execution time", s.ExecutionTimeMillis)
+	formatPercentiles("Total time", s.TotalTimeMillis)
+
+	exitCodes := make([]int, 0, len(s.ExitCodes))
+	for c := range s.ExitCodes {
+		exitCodes = append(exitCodes, c)
+	}
+	sort.Ints(exitCodes)
+	for _, c := range exitCodes {
+		fmt.Fprintf(&b, "Exit code %d: %d\n", c, s.ExitCodes[c])
+	}
+	errorCodes := make([]string, 0, len(s.ErrorCodes))
+	for c := range s.ErrorCodes {
+		errorCodes = append(errorCodes, c)
+	}
+	sort.Strings(errorCodes)
+	for _, c := range errorCodes {
+		fmt.Fprintf(&b, "Error %s: %d\n", c, s.ErrorCodes[c])
+	}
+	return b.String()
+}
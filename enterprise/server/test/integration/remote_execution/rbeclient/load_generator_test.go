@@ -0,0 +1,81 @@
+package rbeclient
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
+)
+
+func finishedResult(exitCode int, queueTime, execTime, total time.Duration) *CommandResult {
+	queued := time.Unix(1000, 0)
+	workerStart := queued.Add(queueTime)
+	execStart := workerStart.Add(10 * time.Millisecond)
+	return &CommandResult{
+		Stage:      repb.ExecutionStage_COMPLETED,
+		ExitCode:   exitCode,
+		LocalStats: LocalStats{Total: total},
+		RemoteStats: &repb.ExecutedActionMetadata{
+			QueuedTimestamp:             mustTimestamp(queued),
+			WorkerStartTimestamp:        mustTimestamp(workerStart),
+			ExecutionStartTimestamp:     mustTimestamp(execStart),
+			ExecutionCompletedTimestamp: mustTimestamp(execStart.Add(execTime)),
+		},
+	}
+}
+
+func mustTimestamp(t time.Time) *tspb.Timestamp {
+	ts, err := ptypes.TimestampProto(t)
+	if err != nil {
+		panic(err)
+	}
+	return ts
+}
+
+func TestComputeLoadStats(t *testing.T) {
+	var results []*CommandResult
+	for i := 1; i <= 100; i++ {
+		exitCode := 0
+		if i%10 == 0 {
+			exitCode = 1
+		}
+		d := time.Duration(i) * time.Millisecond
+		results = append(results, finishedResult(exitCode, d, 2*d, 3*d))
+	}
+	results = append(results,
+		&CommandResult{Stage: repb.ExecutionStage_COMPLETED, Err: status.DeadlineExceededError("timed out")},
+		&CommandResult{Stage: repb.ExecutionStage_COMPLETED, Err: status.DeadlineExceededError("timed out")},
+		&CommandResult{Stage: repb.ExecutionStage_COMPLETED, Err: status.UnavailableError("no executors")},
+	)
+
+	stats := ComputeLoadStats(results)
+
+	assert.Equal(t, 103, stats.NumExecutions)
+	assert.Equal(t, 3, stats.NumErrors)
+	assert.Equal(t, map[int]int{0: 90, 1: 10}, stats.ExitCodes)
+	assert.Equal(t, map[string]int{"DeadlineExceeded": 2, "Unavailable": 1}, stats.ErrorCodes)
+	assert.Equal(t, int64(50), stats.QueueTimeMillis.P50)
+	assert.Equal(t, int64(95), stats.QueueTimeMillis.P95)
+	assert.Equal(t, int64(99), stats.QueueTimeMillis.P99)
+	assert.Equal(t, int64(100), stats.ExecutionTimeMillis.P50)
+	assert.Equal(t, int64(190), stats.ExecutionTimeMillis.P95)
+	assert.Equal(t, int64(150), stats.TotalTimeMillis.P50)
+	assert.Equal(t, int64(297), stats.TotalTimeMillis.P99)
+}
+
+func TestComputeLoadStatsWithoutRemoteStats(t *testing.T) {
+	stats := ComputeLoadStats([]*CommandResult{
+		{Stage: repb.ExecutionStage_COMPLETED, LocalStats: LocalStats{Total: 5 * time.Millisecond}},
+	})
+
+	assert.Equal(t, 0, stats.NumErrors)
+	assert.Equal(t, map[int]int{0: 1}, stats.ExitCodes)
+	assert.Equal(t, int64(0), stats.QueueTimeMillis.P50)
+	assert.Equal(t, int64(0), stats.ExecutionTimeMillis.P50)
+	assert.Equal(t, int64(5), stats.TotalTimeMillis.P50)
+}
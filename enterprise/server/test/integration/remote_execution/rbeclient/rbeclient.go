@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,29 +16,54 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/retry"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/sync/errgroup"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	bspb "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc/codes"
 	gstatus "google.golang.org/grpc/status"
 )
 
+const (
+	// Default number of concurrent CAS requests made to download the outputs
+	// of a command.
+	defaultMaxConcurrentDownloads = 8
+
+	// Outputs are downloaded in batches of at most this many bytes using
+	// BatchReadBlobs. Larger outputs are downloaded using bytestream.
+	gRPCMaxSize = int64(4000000)
+)
+
 type GRPCClientSource interface {
 	GetRemoteExecutionClient() repb.ExecutionClient
 	GetByteStreamClient() bspb.ByteStreamClient
+	GetContentAddressableStorageClient() repb.ContentAddressableStorageClient
 }
 
 type Client struct {
-	gRPClientSource GRPCClientSource
+	gRPClientSource        GRPCClientSource
+	maxConcurrentDownloads int
 }
 
 func New(gRPCClientSource GRPCClientSource) *Client {
 	return &Client{
-		gRPClientSource: gRPCClientSource,
+		gRPClientSource:        gRPCClientSource,
+		maxConcurrentDownloads: defaultMaxConcurrentDownloads,
 	}
 }
 
+// SetMaxConcurrentDownloads sets the maximum number of concurrent CAS requests
+// made when downloading the outputs of a command.
+func (c *Client) SetMaxConcurrentDownloads(n int) {
+	if n < 1 {
+		n = 1
+	}
+	c.maxConcurrentDownloads = n
+}
+
 // LocalStats tracks execution stats from the client's perspective.
 type LocalStats struct {
 	// Time to issue Execute RPC to server.
@@ -94,6 +121,21 @@ type Command struct {
 	opName string
 }
 
+// InstanceName returns the instance name that the command is executed against.
+func (c *Command) InstanceName() string {
+	return c.actionDigest.GetInstanceName()
+}
+
+// newExecution returns a new handle for executing the same action as the
+// command, which can be started independently of it.
+func (c *Command) newExecution(name string) *Command {
+	return &Command{
+		Name:             name,
+		gRPCClientSource: c.gRPCClientSource,
+		actionDigest:     c.actionDigest,
+	}
+}
+
 func (c *Command) StatusChannel() <-chan *CommandResult {
 	return c.status
 }
@@ -114,7 +156,12 @@ func (c *Command) Start(ctx context.Context) error {
 
 	beforeExecuteTime := time.Now()
 	ctx, cancel := context.WithCancel(ctx)
-	stream, err := executionClient.Execute(ctx, req)
+	var stream repb.Execution_ExecuteClient
+	err := retry.Do(ctx, retry.DefaultOptions(), func() error {
+		var err error
+		stream, err = executionClient.Execute(ctx, req)
+		return err
+	})
 	if err != nil {
 		cancel()
 		return status.UnknownErrorf("unable to request action execution for command %q: %s", c.Name, err)
@@ -131,6 +178,24 @@ func (c *Command) Start(ctx context.Context) error {
 	return nil
 }
 
+// Wait blocks until the command has finished executing and returns the final result. The command must have been started.
+func (c *Command) Wait(ctx context.Context) (*CommandResult, error) {
+	for {
+		select {
+		case res, ok := <-c.StatusChannel():
+			if !ok {
+				return nil, status.InternalErrorf("command %q did not send a result", c.Name)
+			}
+			if res.Stage != repb.ExecutionStage_COMPLETED {
+				continue
+			}
+			return res, nil
+		case <-ctx.Done():
+			return nil, status.DeadlineExceededErrorf("command %q did not finish: %s", c.Name, ctx.Err())
+		}
+	}
+}
+
 func (c *Command) ReplaceWaitUsingWaitExecutionAPI(ctx context.Context) error {
 	if c.opName == "" {
 		return status.FailedPreconditionErrorf("Operation name for command is not known. Did you wait for command to be accepted?")
@@ -145,7 +210,12 @@ func (c *Command) ReplaceWaitUsingWaitExecutionAPI(ctx context.Context) error {
 	req := &repb.WaitExecutionRequest{
 		Name: c.opName,
 	}
-	stream, err := executionClient.WaitExecution(ctx, req)
+	var stream repb.Execution_WaitExecutionClient
+	err := retry.Do(ctx, retry.DefaultOptions(), func() error {
+		var err error
+		stream, err = executionClient.WaitExecution(ctx, req)
+		return err
+	})
 	if err != nil {
 		return status.UnavailableErrorf("unable to request WaitExecution for command %q using operation %q: %v", c.Name, c.opName, err)
 	}
@@ -250,15 +320,19 @@ func (c *Command) processUpdatesAsync(stream repb.Execution_ExecuteClient, name
 }
 
 func (c *Client) PrepareCommand(ctx context.Context, instanceName string, name string, inputRootDigest *repb.Digest, commandProto *repb.Command) (*Command, error) {
+	return c.prepareCommand(ctx, instanceName, name, inputRootDigest, commandProto, &repb.Action{})
+}
+
+// prepareCommand uploads the command and an action for it to the CAS. Fields of
+// the given action other than the command and input root digests are kept.
+func (c *Client) prepareCommand(ctx context.Context, instanceName string, name string, inputRootDigest *repb.Digest, commandProto *repb.Command, action *repb.Action) (*Command, error) {
 	commandDigest, err := cachetools.UploadProto(ctx, c.gRPClientSource.GetByteStreamClient(), instanceName, commandProto)
 	if err != nil {
 		return nil, status.UnknownErrorf("unable to upload command %q to CAS: %s", name, err)
 	}
 
-	action := &repb.Action{
-		CommandDigest:   commandDigest,
-		InputRootDigest: inputRootDigest,
-	}
+	action.CommandDigest = commandDigest
+	action.InputRootDigest = inputRootDigest
 	actionDigest, err := cachetools.UploadProto(ctx, c.gRPClientSource.GetByteStreamClient(), instanceName, action)
 	if err != nil {
 		return nil, status.UnknownErrorf("unable to upload action for command %q to CAS: %s", name, err)
@@ -273,6 +347,194 @@ func (c *Client) PrepareCommand(ctx context.Context, instanceName string, name s
 	return command, nil
 }
 
+// RunCommandOpts are options for commands executed with RunCommand.
+type RunCommandOpts struct {
+	// Name is a local name for the command, to aid debugging. Defaults to the
+	// command arguments.
+	Name string
+	// InstanceName is the remote instance name that the command is executed
+	// against. Inputs are uploaded under the same instance name.
+	InstanceName string
+	// InputRootDir is the path to a local dir whose contents are uploaded and
+	// used as the input root of the command. The input root is empty if unset.
+	InputRootDir string
+	// PlatformProperties are the platform properties of the command, such as
+	// "container-image" or "OSFamily".
+	PlatformProperties map[string]string
+	// EnvironmentVariables are set in the environment of the command.
+	EnvironmentVariables map[string]string
+	// OutputFiles and OutputDirectories are the paths of the outputs of the
+	// command, relative to the working directory.
+	OutputFiles       []string
+	OutputDirectories []string
+	// Timeout is the execution timeout of the command. The server default is
+	// used if unset.
+	Timeout time.Duration
+	// DoNotCache prevents the result of the command from being cached.
+	DoNotCache bool
+}
+
+// RunCommand uploads the inputs of the command with the given arguments and
+// starts executing it. The returned command can be waited on as if it were
+// prepared with PrepareCommand and then started.
+//
+// The env is only used to upload the inputs, and must provide bytestream and
+// CAS clients.
+func (c *Client) RunCommand(ctx context.Context, env environment.Env, args []string, opts *RunCommandOpts) (*Command, error) {
+	name := opts.Name
+	if name == "" {
+		name = strings.Join(args, " ")
+	}
+
+	var inputRootDigest *repb.Digest
+	if opts.InputRootDir != "" {
+		d, err := cachetools.UploadDirectoryToCAS(ctx, env, opts.InstanceName, opts.InputRootDir)
+		if err != nil {
+			return nil, status.UnavailableErrorf("unable to upload input root of command %q: %s", name, err)
+		}
+		inputRootDigest = d
+	} else {
+		d, err := cachetools.UploadProto(ctx, c.gRPClientSource.GetByteStreamClient(), opts.InstanceName, &repb.Directory{})
+		if err != nil {
+			return nil, status.UnavailableErrorf("unable to upload input root of command %q: %s", name, err)
+		}
+		inputRootDigest = d
+	}
+
+	command := &repb.Command{
+		Arguments:         args,
+		OutputFiles:       opts.OutputFiles,
+		OutputDirectories: opts.OutputDirectories,
+		Platform:          &repb.Platform{},
+	}
+	// The REAPI requires platform properties and environment variables to be
+	// sorted by name.
+	for _, k := range sortedKeys(opts.PlatformProperties) {
+		command.Platform.Properties = append(command.Platform.Properties, &repb.Platform_Property{Name: k, Value: opts.PlatformProperties[k]})
+	}
+	for _, k := range sortedKeys(opts.EnvironmentVariables) {
+		command.EnvironmentVariables = append(command.EnvironmentVariables, &repb.Command_EnvironmentVariable{Name: k, Value: opts.EnvironmentVariables[k]})
+	}
+
+	action := &repb.Action{DoNotCache: opts.DoNotCache}
+	if opts.Timeout > 0 {
+		action.Timeout = ptypes.DurationProto(opts.Timeout)
+	}
+
+	cmd, err := c.prepareCommand(ctx, opts.InstanceName, name, inputRootDigest, command, action)
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(ctx); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// PrepareCommandForInstanceNames prepares the same command for execution against each of the given instance names.
+// The input root must already be present in the CAS under every instance name. The returned commands are in the same
+// order as instanceNames.
+func (c *Client) PrepareCommandForInstanceNames(ctx context.Context, instanceNames []string, name string, inputRootDigest *repb.Digest, commandProto *repb.Command) ([]*Command, error) {
+	if len(instanceNames) == 0 {
+		return nil, status.InvalidArgumentErrorf("at least one instance name is required to prepare command %q", name)
+	}
+	cmds := make([]*Command, 0, len(instanceNames))
+	for _, instanceName := range instanceNames {
+		cmd, err := c.PrepareCommand(ctx, instanceName, fmt.Sprintf("%s [instance %q]", name, instanceName), inputRootDigest, commandProto)
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+// ExecuteAll starts all of the given commands in parallel and waits for them to finish. Results are returned in the
+// same order as cmds. An error is returned only if a command could not be started or did not report a final result;
+// execution failures are reported via CommandResult.Err.
+func ExecuteAll(ctx context.Context, cmds []*Command) ([]*CommandResult, error) {
+	results := make([]*CommandResult, len(cmds))
+	eg, ctx := errgroup.WithContext(ctx)
+	for i, cmd := range cmds {
+		i, cmd := i, cmd
+		eg.Go(func() error {
+			if err := cmd.Start(ctx); err != nil {
+				return err
+			}
+			res, err := cmd.Wait(ctx)
+			if err != nil {
+				return err
+			}
+			res.InstanceName = cmd.InstanceName()
+			results[i] = res
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// CompareResults checks that all of the given results have the same outcome: the same exit code and the same stdout,
+// stderr and output digests. Execution metadata such as the executor and timing stats is not compared. Results for
+// different instance names are expected to match when the same action is executed against each of them.
+func CompareResults(results []*CommandResult) error {
+	if len(results) < 2 {
+		return nil
+	}
+	expected := results[0]
+	for _, res := range results[1:] {
+		if (expected.Err == nil) != (res.Err == nil) {
+			return status.FailedPreconditionErrorf("command %q failed with %v, but command %q failed with %v", expected.CommandName, expected.Err, res.CommandName, res.Err)
+		}
+		if expected.ExitCode != res.ExitCode {
+			return status.FailedPreconditionErrorf("command %q exited with code %d, but command %q exited with code %d", expected.CommandName, expected.ExitCode, res.CommandName, res.ExitCode)
+		}
+		expectedOutputs := resultOutputs(expected.ActionResult)
+		outputs := resultOutputs(res.ActionResult)
+		for path, d := range expectedOutputs {
+			if outputs[path] != d {
+				return status.FailedPreconditionErrorf("output %q of command %q has digest %q, but command %q has digest %q", path, expected.CommandName, d, res.CommandName, outputs[path])
+			}
+		}
+		for path := range outputs {
+			if _, ok := expectedOutputs[path]; !ok {
+				return status.FailedPreconditionErrorf("command %q produced output %q, but command %q did not", res.CommandName, path, expected.CommandName)
+			}
+		}
+	}
+	return nil
+}
+
+// resultOutputs returns the outputs of an action result (including stdout and stderr) as a map from output path to
+// digest hash.
+func resultOutputs(ar *repb.ActionResult) map[string]string {
+	outputs := make(map[string]string)
+	if d := ar.GetStdoutDigest(); d != nil {
+		outputs["<stdout>"] = d.GetHash()
+	}
+	if d := ar.GetStderrDigest(); d != nil {
+		outputs["<stderr>"] = d.GetHash()
+	}
+	for _, f := range ar.GetOutputFiles() {
+		outputs[f.GetPath()] = f.GetDigest().GetHash()
+	}
+	for _, d := range ar.GetOutputDirectories() {
+		outputs[d.GetPath()] = d.GetTreeDigest().GetHash()
+	}
+	return outputs
+}
+
 func (c *Client) GetStdoutAndStderr(ctx context.Context, res *CommandResult) (string, string, error) {
 	stdout := ""
 	if res.ActionResult.GetStdoutDigest() != nil {
@@ -300,20 +562,8 @@ func (c *Client) GetStdoutAndStderr(ctx context.Context, res *CommandResult) (st
 }
 
 func (c *Client) DownloadActionOutputs(ctx context.Context, env environment.Env, res *CommandResult, rootDir string) error {
-	for _, out := range res.ActionResult.OutputFiles {
-		path := filepath.Join(rootDir, out.GetPath())
-		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
-			return err
-		}
-		d := digest.NewInstanceNameDigest(out.GetDigest(), res.InstanceName)
-		f, err := os.Create(path)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		if err := cachetools.GetBlob(ctx, c.gRPClientSource.GetByteStreamClient(), d, f); err != nil {
-			return err
-		}
+	if err := c.downloadOutputFiles(ctx, res.InstanceName, rootDir, res.ActionResult.GetOutputFiles()); err != nil {
+		return err
 	}
 
 	for _, dir := range res.ActionResult.OutputDirectories {
@@ -331,7 +581,164 @@ func (c *Client) DownloadActionOutputs(ctx context.Context, env environment.Env,
 		}
 	}
 
-	// TODO: Download symlinks
+	var symlinks []*repb.OutputSymlink
+	symlinks = append(symlinks, res.ActionResult.GetOutputFileSymlinks()...)
+	symlinks = append(symlinks, res.ActionResult.GetOutputDirectorySymlinks()...)
+	for _, link := range symlinks {
+		path := filepath.Join(rootDir, link.GetPath())
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			return err
+		}
+		if err := os.Symlink(link.GetTarget(), path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// outputFileMap is a map of digests to the output files with the contents
+// addressed by the digest.
+type outputFileMap map[digest.Key][]*repb.OutputFile
+
+// downloadOutputFiles downloads the given output files to rootDir. Each digest
+// is only downloaded once. Small files are downloaded in batches using
+// BatchReadBlobs and large ones using bytestream, with at most
+// maxConcurrentDownloads requests in flight.
+func (c *Client) downloadOutputFiles(ctx context.Context, instanceName, rootDir string, outputs []*repb.OutputFile) error {
+	filesToFetch := make(outputFileMap)
+	for _, out := range outputs {
+		path := filepath.Join(rootDir, out.GetPath())
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			return err
+		}
+		dk := digest.NewKey(out.GetDigest())
+		filesToFetch[dk] = append(filesToFetch[dk], out)
+	}
+
+	eg, ctx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, c.maxConcurrentDownloads)
+	download := func(fn func() error) {
+		eg.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			defer func() { <-sem }()
+			return fn()
+		})
+	}
+
+	req := &repb.BatchReadBlobsRequest{InstanceName: instanceName}
+	currentBatchRequestSize := int64(0)
+	for dk, files := range filesToFetch {
+		d := dk.ToDigest()
+
+		// Write empty files directly.
+		if digest.IsEmptyHash(d.GetHash()) {
+			for _, out := range files {
+				if err := writeOutputFile(rootDir, out, nil); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		// Files exceeding the gRPC max size never fit in a batch, so they're
+		// downloaded using bytestream.
+		size := d.GetSizeBytes()
+		if size > gRPCMaxSize {
+			files := files
+			download(func() error {
+				return c.bytestreamReadOutputFiles(ctx, instanceName, rootDir, d, files)
+			})
+			continue
+		}
+
+		// If the digest would push the current batch over the gRPC max size,
+		// dispatch the batch and start a new one.
+		if currentBatchRequestSize+size > gRPCMaxSize {
+			batch := req
+			download(func() error {
+				return c.batchReadOutputFiles(ctx, rootDir, batch, filesToFetch)
+			})
+			req = &repb.BatchReadBlobsRequest{InstanceName: instanceName}
+			currentBatchRequestSize = 0
+		}
+		req.Digests = append(req.Digests, d)
+		currentBatchRequestSize += size
+	}
+	if len(req.Digests) > 0 {
+		download(func() error {
+			return c.batchReadOutputFiles(ctx, rootDir, req, filesToFetch)
+		})
+	}
+	return eg.Wait()
+}
+
+func (c *Client) batchReadOutputFiles(ctx context.Context, rootDir string, req *repb.BatchReadBlobsRequest, filesToFetch outputFileMap) error {
+	rsp, err := c.gRPClientSource.GetContentAddressableStorageClient().BatchReadBlobs(ctx, req)
+	if err != nil {
+		return err
+	}
+	for _, blobResponse := range rsp.GetResponses() {
+		if blobResponse.GetStatus().GetCode() != int32(codes.OK) {
+			return digest.MissingDigestError(blobResponse.GetDigest())
+		}
+		files, ok := filesToFetch[digest.NewKey(blobResponse.GetDigest())]
+		if !ok {
+			return status.InternalErrorf("Fetched unrequested output: %q", blobResponse.GetDigest())
+		}
+		for _, out := range files {
+			if err := writeOutputFile(rootDir, out, blobResponse.GetData()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
+// bytestreamReadOutputFiles downloads the given digest using bytestream into
+// the first of the given output files and copies it to the rest.
+func (c *Client) bytestreamReadOutputFiles(ctx context.Context, instanceName, rootDir string, d *repb.Digest, files []*repb.OutputFile) error {
+	if len(files) == 0 {
+		return nil
+	}
+	first := files[0]
+	f, err := os.OpenFile(filepath.Join(rootDir, first.GetPath()), os.O_RDWR|os.O_CREATE|os.O_TRUNC, outputFileMode(first))
+	if err != nil {
+		return err
+	}
+	if err := cachetools.GetBlob(ctx, c.gRPClientSource.GetByteStreamClient(), digest.NewInstanceNameDigest(d, instanceName), f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if len(files) == 1 {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(rootDir, first.GetPath()))
+	if err != nil {
+		return err
+	}
+	for _, out := range files[1:] {
+		if err := writeOutputFile(rootDir, out, data); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+func outputFileMode(out *repb.OutputFile) os.FileMode {
+	if out.GetIsExecutable() {
+		return 0755
+	}
+	return 0644
+}
+
+func writeOutputFile(rootDir string, out *repb.OutputFile, data []byte) error {
+	return os.WriteFile(filepath.Join(rootDir, out.GetPath()), data, outputFileMode(out))
+}
@@ -0,0 +1,91 @@
+package rbetest
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testbazel"
+	"github.com/buildbuddy-io/buildbuddy/server/util/bazel"
+	"github.com/stretchr/testify/assert"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	guuid "github.com/google/uuid"
+)
+
+var (
+	// Bazel summarizes how the actions of a build were run in a line like
+	// "INFO: 3 processes: 1 remote cache hit, 1 internal, 1 remote."
+	remoteCacheHitsRegexp  = regexp.MustCompile(`(\d+) remote cache hits?\b`)
+	remoteExecutionsRegexp = regexp.MustCompile(`(\d+) remote\s*[,.]`)
+)
+
+// BazelInvocation is the result of running the pinned Bazel binary against
+// the test environment.
+type BazelInvocation struct {
+	*bazel.InvocationResult
+}
+
+// RemoteCacheHits returns the number of actions which Bazel reported as
+// remote cache hits.
+func (i *BazelInvocation) RemoteCacheHits() int {
+	return countFromSummary(remoteCacheHitsRegexp, i.Stderr)
+}
+
+// RemoteExecutions returns the number of actions which Bazel reported as
+// executed remotely.
+func (i *BazelInvocation) RemoteExecutions() int {
+	return countFromSummary(remoteExecutionsRegexp, i.Stderr)
+}
+
+func countFromSummary(re *regexp.Regexp, stderr string) int {
+	m := re.FindStringSubmatch(stderr)
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(m[1])
+	return n
+}
+
+// BazelFlags returns the flags needed for Bazel to send build events to the
+// server, use its cache and execute actions on its executors.
+func (s *BuildBuddyServer) BazelFlags() []string {
+	return []string{
+		fmt.Sprintf("--bes_backend=grpc://localhost:%d", s.port),
+		fmt.Sprintf("--remote_executor=grpc://localhost:%d", s.port),
+		"--bes_upload_mode=wait_for_upload_complete",
+	}
+}
+
+// RunBazel runs a Bazel command in the given workspace, with build events,
+// cache requests and actions sent to the first BuildBuddy server of the
+// environment. Use testbazel.MakeTempWorkspace to create the workspace.
+//
+// Blocks until the command has finished and all of its build events have
+// been uploaded, so that the invocation can be looked up right away.
+func (r *Env) RunBazel(workspaceDir string, subCommand string, args ...string) *BazelInvocation {
+	if len(r.buildBuddyServers) == 0 {
+		assert.FailNow(r.t, "a BuildBuddy server must be added before running Bazel")
+	}
+	iid := guuid.New().String()
+	bazelArgs := append([]string{fmt.Sprintf("--invocation_id=%s", iid)}, r.buildBuddyServers[0].BazelFlags()...)
+	bazelArgs = append(bazelArgs, args...)
+	result := testbazel.Invoke(context.Background(), r.t, workspaceDir, subCommand, bazelArgs...)
+	result.InvocationID = iid
+	return &BazelInvocation{InvocationResult: result}
+}
+
+// GetInvocation looks up an invocation which was run with RunBazel.
+func (r *Env) GetInvocation(iid string) *inpb.Invocation {
+	rsp, err := r.buildBuddyServers[0].buildBuddyServiceClient.GetInvocation(context.Background(), &inpb.GetInvocationRequest{
+		Lookup: &inpb.InvocationLookup{InvocationId: iid},
+	})
+	if err != nil {
+		assert.FailNowf(r.t, fmt.Sprintf("could not look up invocation %q", iid), err.Error())
+	}
+	if len(rsp.GetInvocation()) != 1 {
+		assert.FailNow(r.t, fmt.Sprintf("expected 1 invocation for %q, got %d", iid, len(rsp.GetInvocation())))
+	}
+	return rsp.GetInvocation()[0]
+}
@@ -0,0 +1,238 @@
+package rbetest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/app"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	// How long to wait for commands to complete when faults are injected.
+	// Recovering from some faults takes until the lease of the affected task
+	// expires.
+	faultWaitTimeout = 2 * time.Minute
+)
+
+// faultProxy is a TCP proxy between an executor and a BuildBuddy server,
+// which can sever the connections between them.
+type faultProxy struct {
+	port       int
+	targetPort int
+	listener   net.Listener
+
+	mu sync.Mutex
+	// While down, connections are refused, as if the executor was unreachable.
+	down  bool
+	conns map[net.Conn]struct{}
+}
+
+func newFaultProxy(t *testing.T, targetPort int) *faultProxy {
+	port := app.FreePort(t)
+	lis, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		assert.FailNowf(t, fmt.Sprintf("could not listen on port %d", port), err.Error())
+	}
+	p := &faultProxy{
+		port:       port,
+		targetPort: targetPort,
+		listener:   lis,
+		conns:      make(map[net.Conn]struct{}),
+	}
+	t.Cleanup(func() {
+		lis.Close()
+		p.dropConnections()
+	})
+	go p.serve()
+	return p
+}
+
+func (p *faultProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.forward(conn)
+	}
+}
+
+func (p *faultProxy) forward(client net.Conn) {
+	server, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", p.targetPort))
+	if err != nil {
+		// The server is down, e.g. because it's being restarted.
+		client.Close()
+		return
+	}
+	p.mu.Lock()
+	if p.down {
+		p.mu.Unlock()
+		client.Close()
+		server.Close()
+		return
+	}
+	p.conns[client] = struct{}{}
+	p.conns[server] = struct{}{}
+	p.mu.Unlock()
+
+	go func() {
+		io.Copy(server, client)
+		p.close(client, server)
+	}()
+	go func() {
+		io.Copy(client, server)
+		p.close(client, server)
+	}()
+}
+
+func (p *faultProxy) close(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+		delete(p.conns, c)
+	}
+}
+
+// dropConnections severs all connections through the proxy. New connections
+// are accepted right away.
+func (p *faultProxy) dropConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for c := range p.conns {
+		c.Close()
+		delete(p.conns, c)
+	}
+}
+
+// setDown severs all connections through the proxy and refuses new ones
+// until it's brought up again.
+func (p *faultProxy) setDown(down bool) {
+	p.mu.Lock()
+	p.down = down
+	p.mu.Unlock()
+	if down {
+		p.dropConnections()
+	}
+}
+
+// KillExecutor abruptly stops an executor, as if its process crashed: its
+// connections to the BuildBuddy server are severed without unregistering it
+// or finishing the tasks it's running. Blocks until the scheduler notices
+// that the executor is gone.
+func (r *Env) KillExecutor(executor *Executor) {
+	if _, ok := r.executors[executor.hostPort]; !ok {
+		assert.FailNow(r.t, fmt.Sprintf("Executor %q not in executor map", executor.hostPort))
+	}
+	log.Infof("Killing executor %q", executor.hostPort)
+	executor.proxy.setDown(true)
+	executor.grpcServer.Stop()
+	executor.cancelRegistration()
+	delete(r.executors, executor.hostPort)
+	r.waitForExecutorRegistration()
+}
+
+// DropSchedulerConnections severs an executor's connections to its
+// BuildBuddy server, as if the network between them failed briefly. The
+// executor may reconnect right away.
+func (r *Env) DropSchedulerConnections(executor *Executor) {
+	log.Infof("Dropping connections of executor %q", executor.hostPort)
+	executor.proxy.dropConnections()
+}
+
+// RestartBuildBuddyServer stops a BuildBuddy server and starts it again on
+// the same port, with newly set up services. Streams to the server are
+// broken, and clients have to reconnect.
+func (r *Env) RestartBuildBuddyServer(server *BuildBuddyServer) {
+	log.Infof("Restarting BuildBuddy server on port %d", server.port)
+	server.grpcServer.Stop()
+	server.setUpServices()
+	server.start()
+}
+
+// WaitThroughFaults blocks until the command has finished executing, like
+// Wait, but tolerates faults injected while it runs: if its stream to the
+// server breaks, it reconnects using the WaitExecution API, as Bazel does.
+func (c *Command) WaitThroughFaults() *CommandResult {
+	deadline := time.Now().Add(faultWaitTimeout)
+	for {
+		select {
+		case res, ok := <-c.StatusChannel():
+			if !ok {
+				assert.FailNow(c.env.t, fmt.Sprintf("command %q did not send a result", c.Name))
+			}
+			if res.Stage != repb.ExecutionStage_COMPLETED {
+				continue
+			}
+			if status.IsAbortedError(res.Err) {
+				// The stream to the server broke.
+				c.reconnect(deadline)
+				continue
+			}
+			if res.Err != nil {
+				assert.FailNowf(c.env.t, fmt.Sprintf("command %q did not finish succesfully", c.Name), res.Err.Error())
+			}
+			ctx := c.env.WithUserID(context.Background(), c.userID)
+			stdout, stderr, err := c.rbeClient.GetStdoutAndStderr(ctx, res)
+			if err != nil {
+				assert.FailNowf(c.env.t, "could not fetch outputs", err.Error())
+			}
+			return &CommandResult{
+				CommandResult: res,
+				Stdout:        stdout,
+				Stderr:        stderr,
+			}
+		case <-time.After(time.Until(deadline)):
+			assert.FailNow(c.env.t, fmt.Sprintf("command %q did not finish within timeout", c.Name))
+			return nil
+		}
+	}
+}
+
+// reconnect waits for the command's execution using the WaitExecution API,
+// retrying until the server is reachable again.
+func (c *Command) reconnect(deadline time.Time) {
+	for {
+		ctx := context.Background()
+		if c.userID != "" {
+			ctx = c.env.WithUserID(ctx, c.userID)
+		}
+		err := c.Command.ReplaceWaitUsingWaitExecutionAPI(ctx)
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			assert.FailNow(c.env.t, fmt.Sprintf("could not reconnect to command %q", c.Name), err.Error())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// WaitStartedTimes blocks until the command has started running n times, e.g.
+// because it was retried after the executor running it was killed.
+func (c *ControlledCommand) WaitStartedTimes(n int) {
+	deadline := time.Now().Add(faultWaitTimeout)
+	for time.Now().Before(deadline) {
+		if c.controller.startCount(c.Name) >= n {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.FailNow(c.t, fmt.Sprintf("command %q did not start running %d times within timeout", c.Name, n))
+}
+
+func (c *testCommandController) startCount(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.startedCommands[name]
+}
@@ -26,12 +26,14 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/test/integration/remote_execution/rbeclient"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/testredis"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_metrics_collector"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_server"
 	"github.com/buildbuddy-io/buildbuddy/server/buildbuddy_server"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/action_cache_server"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/byte_stream_server"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/capabilities_server"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/content_addressable_storage_server"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/app"
@@ -67,6 +69,10 @@ const (
 	defaultInstanceName = ""
 
 	defaultWaitTimeout = 20 * time.Second
+
+	// Clients dial more than one connection to the server, so that tests
+	// exercise pooled connections.
+	clientConnPoolSize = 2
 )
 
 // Env is an integration test environment for Remote Build Execution.
@@ -102,25 +108,25 @@ func (r *Env) GetContentAddressableStorageClient() repb.ContentAddressableStorag
 	return r.buildBuddyServers[rand.Intn(len(r.buildBuddyServers))].casClient
 }
 
-func (r *Env) uploadInputRoot(ctx context.Context, rootDir string) *repb.Digest {
+func (r *Env) uploadInputRoot(ctx context.Context, instanceName string, rootDir string) *repb.Digest {
 	r.testEnv.SetByteStreamClient(r.GetByteStreamClient())
 	r.testEnv.SetContentAddressableStorageClient(r.GetContentAddressableStorageClient())
 
-	digest, err := cachetools.UploadDirectoryToCAS(ctx, r.testEnv, "" /*=instanceName*/, rootDir)
+	digest, err := cachetools.UploadDirectoryToCAS(ctx, r.testEnv, instanceName, rootDir)
 	if err != nil {
 		assert.FailNow(r.t, err.Error())
 	}
 	return digest
 }
 
-func (r *Env) setupRootDirectoryWithTestCommandBinary(ctx context.Context) *repb.Digest {
+func (r *Env) setupRootDirectoryWithTestCommandBinary(ctx context.Context, instanceName string) *repb.Digest {
 	rfp, err := bazel.Runfile(testCommandBinaryRunfilePath)
 	if err != nil {
 		assert.FailNow(r.t, "unable to find test binary in runfiles", err.Error())
 	}
 	rootDir := testfs.MakeTempDir(r.t)
 	testfs.CopyFile(r.t, rfp, rootDir, testCommandBinaryName)
-	return r.uploadInputRoot(ctx, rootDir)
+	return r.uploadInputRoot(ctx, instanceName, rootDir)
 }
 
 // NewRBETestEnv sets up components required for testing Remote Build Execution.
@@ -177,9 +183,11 @@ func (e *buildBuddyServerEnv) GetSchedulerClient() scpb.SchedulerClient {
 }
 
 type BuildBuddyServer struct {
-	t    *testing.T
-	env  *buildBuddyServerEnv
-	port int
+	t          *testing.T
+	env        *buildBuddyServerEnv
+	opts       *BuildBuddyServerOptions
+	port       int
+	grpcServer *grpc.Server
 
 	schedulerServer         *scheduler_server.SchedulerServer
 	executionServer         repb.ExecutionServer
@@ -198,37 +206,16 @@ func newBuildBuddyServer(t *testing.T, env *buildBuddyServerEnv, opts *BuildBudd
 	port := app.FreePort(t)
 	opts.SchedulerServerOptions.LocalPortOverride = int32(port)
 
-	env.SetAuthenticator(env.rbeEnv.newTestAuthenticator())
-	router, err := task_router.New(env)
-	require.NoError(t, err, "could not set up TaskRouter")
-	env.SetTaskRouter(router)
-	scheduler, err := scheduler_server.NewSchedulerServerWithOptions(env, &opts.SchedulerServerOptions)
-	require.NoError(t, err, "could not set up SchedulerServer")
-	executionServer, err := execution_server.NewExecutionServer(env)
-	require.NoError(t, err, "could not set up ExecutionServer")
-	env.SetRemoteExecutionService(executionServer)
-	buildBuddyServiceServer, err := buildbuddy_server.NewBuildBuddyServer(env, nil /*=sslService*/)
-	require.NoError(t, err, "could not set up BuildBuddyServiceServer")
-	buildEventServer, err := build_event_server.NewBuildEventProtocolServer(env)
-	require.NoError(t, err, "could not set up BuildEventProtocolServer")
-	env.SetBuildEventHandler(build_event_handler.NewBuildEventHandler(env))
-
-	if opts.EnvModifier != nil {
-		opts.EnvModifier(env.TestEnv)
-	}
-
 	server := &BuildBuddyServer{
-		t:                       t,
-		env:                     env,
-		port:                    port,
-		schedulerServer:         scheduler,
-		executionServer:         executionServer,
-		buildBuddyServiceServer: buildBuddyServiceServer,
-		buildEventServer:        buildEventServer,
+		t:    t,
+		env:  env,
+		opts: opts,
+		port: port,
 	}
+	server.setUpServices()
 	server.start()
 
-	clientConn, err := grpc_client.DialTarget(fmt.Sprintf("grpc://localhost:%d", port))
+	clientConn, err := grpc_client.DialTargetPooled(fmt.Sprintf("grpc://localhost:%d", port), clientConnPoolSize)
 	if err != nil {
 		assert.FailNowf(t, "could not connect to BuildBuddy server", err.Error())
 	}
@@ -242,12 +229,38 @@ func newBuildBuddyServer(t *testing.T, env *buildBuddyServerEnv, opts *BuildBudd
 	return server
 }
 
+// setUpServices sets up the server's services, which hold no state other than
+// what is stored in the shared DB and Redis.
+func (s *BuildBuddyServer) setUpServices() {
+	env := s.env
+	env.SetAuthenticator(env.rbeEnv.newTestAuthenticator())
+	router, err := task_router.New(env)
+	require.NoError(s.t, err, "could not set up TaskRouter")
+	env.SetTaskRouter(router)
+	s.schedulerServer, err = scheduler_server.NewSchedulerServerWithOptions(env, &s.opts.SchedulerServerOptions)
+	require.NoError(s.t, err, "could not set up SchedulerServer")
+	executionServer, err := execution_server.NewExecutionServer(env)
+	require.NoError(s.t, err, "could not set up ExecutionServer")
+	env.SetRemoteExecutionService(executionServer)
+	s.executionServer = executionServer
+	s.buildBuddyServiceServer, err = buildbuddy_server.NewBuildBuddyServer(env, nil /*=sslService*/)
+	require.NoError(s.t, err, "could not set up BuildBuddyServiceServer")
+	s.buildEventServer, err = build_event_server.NewBuildEventProtocolServer(env)
+	require.NoError(s.t, err, "could not set up BuildEventProtocolServer")
+	env.SetBuildEventHandler(build_event_handler.NewBuildEventHandler(env))
+
+	if s.opts.EnvModifier != nil {
+		s.opts.EnvModifier(env.TestEnv)
+	}
+}
+
 func (s *BuildBuddyServer) start() {
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
 	if err != nil {
 		assert.FailNow(s.t, fmt.Sprintf("could not listen on port %d", s.port), err.Error())
 	}
 	grpcServer, grpcServerRunFunc := s.env.GRPCServer(lis)
+	s.grpcServer = grpcServer
 
 	// Configure services needed by remote execution.
 
@@ -275,6 +288,8 @@ func (s *BuildBuddyServer) start() {
 	}
 	repb.RegisterActionCacheServer(grpcServer, acServer)
 
+	repb.RegisterCapabilitiesServer(grpcServer, capabilities_server.NewCapabilitiesServer(s.env /*supportCAS=*/, true /*supportRemoteExec=*/, true))
+
 	go grpcServerRunFunc()
 }
 
@@ -286,8 +301,9 @@ type testCommandController struct {
 	t    *testing.T
 	port int
 	mu   sync.Mutex
-	// Commands that were ever connected, even if they are not connected now.
-	startedCommands map[string]bool
+	// Commands that were ever connected, even if they are not connected now,
+	// mapped to the number of times they connected.
+	startedCommands map[string]int
 	// Channels to instruct waiters that a command has started.
 	commandStartWaiters map[string]chan struct{}
 	// Commands that are currently connected.
@@ -298,11 +314,19 @@ func (c *testCommandController) RegisterCommand(req *retpb.RegisterCommandReques
 	opChannel := make(chan *retpb.ControllerToCommandRequest)
 	log.Printf("Test command registering: %s", req.GetCommandName())
 	c.mu.Lock()
-	c.startedCommands[req.GetCommandName()] = true
+	c.startedCommands[req.GetCommandName()]++
 	if ch, ok := c.commandStartWaiters[req.GetCommandName()]; ok {
 		close(ch)
 		delete(c.commandStartWaiters, req.GetCommandName())
 	}
+	if previous, ok := c.connectedCommands[req.GetCommandName()]; ok {
+		// The command was retried, e.g. because the executor running it was
+		// killed. Its previous attempt would have been killed along with the
+		// executor, so make it exit.
+		go func() {
+			previous <- &retpb.ControllerToCommandRequest{ExitOp: &retpb.ExitOp{ExitCode: 1}}
+		}()
+	}
 	c.connectedCommands[req.GetCommandName()] = opChannel
 	c.mu.Unlock()
 
@@ -357,7 +381,7 @@ func newTestCommandController(t *testing.T) *testCommandController {
 	controller := &testCommandController{
 		t:                   t,
 		port:                port,
-		startedCommands:     make(map[string]bool),
+		startedCommands:     make(map[string]int),
 		commandStartWaiters: make(map[string]chan struct{}),
 		connectedCommands:   make(map[string]chan *retpb.ControllerToCommandRequest),
 	}
@@ -387,6 +411,9 @@ type Executor struct {
 	hostPort           string
 	grpcServer         *grpc.Server
 	cancelRegistration context.CancelFunc
+	// All of the executor's connections to its BuildBuddy server go through
+	// this proxy, so that faults can be injected into them.
+	proxy *faultProxy
 }
 
 // Stop unregisters the executor from the BuildBuddy server.
@@ -410,6 +437,10 @@ func (r *Env) AddBuildBuddyServerWithOptions(opts *BuildBuddyServerOptions) *Bui
 	env := &buildBuddyServerEnv{TestEnv: enterprise_testenv.GetCustomTestEnv(r.t, envOpts), rbeEnv: r}
 	// We're using an in-memory SQLite database so we need to make sure all servers share the same handle.
 	env.SetDBHandle(r.testEnv.GetDBHandle())
+	// Collects the cache stats of invocations.
+	mc, err := memory_metrics_collector.NewMemoryMetricsCollector()
+	require.NoError(r.t, err, "could not set up MetricsCollector")
+	env.SetMetricsCollector(mc)
 
 	server := newBuildBuddyServer(r.t, env, opts)
 	r.buildBuddyServers = append(r.buildBuddyServers, server)
@@ -489,7 +520,8 @@ func (r *Env) addExecutor(options *ExecutorOptions) *Executor {
 		buildBuddyServer = r.buildBuddyServers[rand.Intn(len(r.buildBuddyServers))]
 	}
 
-	clientConn, err := grpc_client.DialTarget(fmt.Sprintf("grpc://localhost:%d", buildBuddyServer.port))
+	proxy := newFaultProxy(r.t, buildBuddyServer.port)
+	clientConn, err := grpc_client.DialTarget(fmt.Sprintf("grpc://localhost:%d", proxy.port))
 	if err != nil {
 		assert.FailNowf(r.t, "could not create client to BuildBuddy server", err.Error())
 	}
@@ -582,6 +614,7 @@ func (r *Env) addExecutor(options *ExecutorOptions) *Executor {
 		hostPort:           fmt.Sprintf("localhost:%d", executorPort),
 		grpcServer:         executorGRPCServer,
 		cancelRegistration: cancel,
+		proxy:              proxy,
 	}
 	r.executors[executor.hostPort] = executor
 	return executor
@@ -752,7 +785,7 @@ func (r *Env) ExecuteControlledCommand(name string) *ControlledCommand {
 		assert.FailNowf(r.t, "could not attach user prefix", err.Error())
 	}
 
-	inputRootDigest := r.setupRootDirectoryWithTestCommandBinary(ctx)
+	inputRootDigest := r.setupRootDirectoryWithTestCommandBinary(ctx, defaultInstanceName)
 
 	cmd, err := r.rbeClient.PrepareCommand(ctx, defaultInstanceName, name, inputRootDigest, minimalCommand(args...))
 	if err != nil {
@@ -792,9 +825,12 @@ type ExecuteOpts struct {
 	InputRootDir string
 	// UserID is the ID of the authenticated user that should execute the command.
 	UserID string
+	// InstanceName is the remote instance name that the command should be
+	// executed against. Inputs are uploaded under the same instance name.
+	InstanceName string
 }
 
-func (r *Env) Execute(command *repb.Command, opts *ExecuteOpts) *Command {
+func (r *Env) executeContext(opts *ExecuteOpts) context.Context {
 	ctx := context.Background()
 	if opts.UserID != "" {
 		ctx = r.WithUserID(ctx, opts.UserID)
@@ -804,16 +840,22 @@ func (r *Env) Execute(command *repb.Command, opts *ExecuteOpts) *Command {
 	if err != nil {
 		assert.FailNowf(r.t, "could not attach user prefix", err.Error())
 	}
+	return ctx
+}
 
-	var inputRootDigest *repb.Digest
+func (r *Env) prepareInputRoot(ctx context.Context, instanceName string, opts *ExecuteOpts) *repb.Digest {
 	if opts.InputRootDir != "" {
-		inputRootDigest = r.uploadInputRoot(ctx, opts.InputRootDir)
-	} else {
-		inputRootDigest = r.setupRootDirectoryWithTestCommandBinary(ctx)
+		return r.uploadInputRoot(ctx, instanceName, opts.InputRootDir)
 	}
+	return r.setupRootDirectoryWithTestCommandBinary(ctx, instanceName)
+}
+
+func (r *Env) Execute(command *repb.Command, opts *ExecuteOpts) *Command {
+	ctx := r.executeContext(opts)
+	inputRootDigest := r.prepareInputRoot(ctx, opts.InstanceName, opts)
 
 	name := strings.Join(command.GetArguments(), " ")
-	cmd, err := r.rbeClient.PrepareCommand(ctx, defaultInstanceName, name, inputRootDigest, command)
+	cmd, err := r.rbeClient.PrepareCommand(ctx, opts.InstanceName, name, inputRootDigest, command)
 	if err != nil {
 		assert.FailNowf(r.t, fmt.Sprintf("unable to request action execution for command %q", name), err.Error())
 	}
@@ -825,6 +867,65 @@ func (r *Env) Execute(command *repb.Command, opts *ExecuteOpts) *Command {
 	return &Command{r, cmd, r.rbeClient, opts.UserID}
 }
 
+// RunCommand executes the command with the given arguments using the
+// high-level rbeclient API, uploading the inputs from opts.InputRootDir.
+func (r *Env) RunCommand(args []string, opts *rbeclient.RunCommandOpts) *Command {
+	ctx := r.executeContext(&ExecuteOpts{})
+	r.testEnv.SetByteStreamClient(r.GetByteStreamClient())
+	r.testEnv.SetContentAddressableStorageClient(r.GetContentAddressableStorageClient())
+
+	cmd, err := r.rbeClient.RunCommand(ctx, r.testEnv, args, opts)
+	if err != nil {
+		assert.FailNow(r.t, fmt.Sprintf("Could not execute command %q", strings.Join(args, " ")), err.Error())
+	}
+	return &Command{r, cmd, r.rbeClient, "" /*=userID*/}
+}
+
+// ExecuteOnInstanceNames executes the same command against each of the given
+// instance names in parallel and waits for all of them to finish. The
+// InstanceName field of opts is ignored. Results are returned in the same order
+// as instanceNames.
+func (r *Env) ExecuteOnInstanceNames(command *repb.Command, opts *ExecuteOpts, instanceNames []string) []*CommandResult {
+	ctx := r.executeContext(opts)
+
+	// The input root digest doesn't depend on the instance name, but the
+	// inputs need to be present in the CAS under each instance name.
+	var inputRootDigest *repb.Digest
+	for _, instanceName := range instanceNames {
+		inputRootDigest = r.prepareInputRoot(ctx, instanceName, opts)
+	}
+
+	name := strings.Join(command.GetArguments(), " ")
+	cmds, err := r.rbeClient.PrepareCommandForInstanceNames(ctx, instanceNames, name, inputRootDigest, command)
+	if err != nil {
+		assert.FailNowf(r.t, fmt.Sprintf("unable to request action execution for command %q", name), err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultWaitTimeout)
+	defer cancel()
+	results, err := rbeclient.ExecuteAll(ctx, cmds)
+	if err != nil {
+		assert.FailNow(r.t, fmt.Sprintf("Could not execute command %q on instance names %v", name, instanceNames), err.Error())
+	}
+
+	commandResults := make([]*CommandResult, 0, len(results))
+	for _, res := range results {
+		if res.Err != nil {
+			assert.FailNowf(r.t, fmt.Sprintf("command %q did not finish succesfully", res.CommandName), res.Err.Error())
+		}
+		stdout, stderr, err := r.rbeClient.GetStdoutAndStderr(ctx, res)
+		if err != nil {
+			assert.FailNowf(r.t, "could not fetch outputs", err.Error())
+		}
+		commandResults = append(commandResults, &CommandResult{
+			CommandResult: res,
+			Stdout:        stdout,
+			Stderr:        stderr,
+		})
+	}
+	return commandResults
+}
+
 func minimalCommand(args ...string) *repb.Command {
 	return &repb.Command{
 		Arguments: args,
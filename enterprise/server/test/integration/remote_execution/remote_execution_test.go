@@ -6,8 +6,10 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/scheduler_server"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/test/integration/remote_execution/rbeclient"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/test/integration/remote_execution/rbetest"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
 	"github.com/stretchr/testify/assert"
@@ -259,6 +261,36 @@ func TestManySimpleCommandsWithMultipleExecutors(t *testing.T) {
 	}
 }
 
+func TestSimpleCommandOnMultipleInstanceNames(t *testing.T) {
+	rbe := rbetest.NewRBETestEnv(t)
+
+	rbe.AddBuildBuddyServer()
+	rbe.AddExecutors(3)
+
+	instanceNames := []string{"", "instance-a", "instance-b"}
+	cmd := &repb.Command{
+		Arguments:   []string{"sh", "-c", "echo hello && echo bye >&2 && mkdir out && echo foo > out/foo.txt"},
+		OutputFiles: []string{"out/foo.txt"},
+		Platform: &repb.Platform{
+			Properties: []*repb.Platform_Property{
+				{Name: "container-image", Value: "none"},
+			},
+		},
+	}
+	results := rbe.ExecuteOnInstanceNames(cmd, &rbetest.ExecuteOpts{}, instanceNames)
+
+	require.Len(t, results, len(instanceNames))
+	var commandResults []*rbeclient.CommandResult
+	for i, res := range results {
+		assert.Equal(t, instanceNames[i], res.InstanceName, "results should be returned in instance name order")
+		assert.Equal(t, 0, res.ExitCode, "exit code should be propagated")
+		assert.Equal(t, "hello\n", res.Stdout, "stdout should be propagated")
+		assert.Equal(t, "bye\n", res.Stderr, "stderr should be propagated")
+		commandResults = append(commandResults, res.CommandResult)
+	}
+	assert.NoError(t, rbeclient.CompareResults(commandResults), "results should match across instance names")
+}
+
 func TestBasicActionIO(t *testing.T) {
 	tmpDir := testfs.MakeTempDir(t)
 	testfs.WriteAllFileContents(t, tmpDir, map[string]string{
@@ -316,6 +348,112 @@ func TestBasicActionIO(t *testing.T) {
 	})
 }
 
+func TestOutputPathsActionIO(t *testing.T) {
+	rbe := rbetest.NewRBETestEnv(t)
+	rbe.AddBuildBuddyServer()
+	rbe.AddExecutor()
+
+	cmd := rbe.Execute(&repb.Command{
+		Arguments: []string{
+			"sh", "-c", strings.Join([]string{
+				`set -e`,
+				// Output paths may be files or directories, so only their
+				// parent directories are created by the executor.
+				`mkdir out_dir`,
+				`printf 'Hello world' > out_dir/hello_world.output`,
+				`printf 'Hello BB' > out_files_dir/hello_bb.output`,
+			}, "\n"),
+		},
+		OutputPaths: []string{
+			"missing.output",
+			"out_dir",
+			"out_files_dir/hello_bb.output",
+		},
+	}, &rbetest.ExecuteOpts{})
+	res := cmd.Wait()
+
+	require.Equal(t, 0, res.ExitCode)
+	require.Len(t, res.ActionResult.GetOutputFiles(), 1)
+	require.Len(t, res.ActionResult.GetOutputDirectories(), 1)
+
+	outDir := rbe.DownloadOutputsToNewTempDir(res)
+
+	testfs.AssertExactFileContents(t, outDir, map[string]string{
+		"out_dir/hello_world.output":    "Hello world",
+		"out_files_dir/hello_bb.output": "Hello BB",
+	})
+}
+
+func TestRunCommand(t *testing.T) {
+	rbe := rbetest.NewRBETestEnv(t)
+	rbe.AddBuildBuddyServer()
+	rbe.AddExecutor()
+
+	inputRoot := testfs.MakeTempDir(t)
+	testfs.WriteAllFileContents(t, inputRoot, map[string]string{
+		"greeting.input":       "Hello",
+		"child/farewell.input": "Goodbye",
+	})
+
+	cmd := rbe.RunCommand([]string{"sh", "-c", strings.Join([]string{
+		`set -e`,
+		`cat greeting.input child/farewell.input`,
+		`printf "$NAME" > out/name.output`,
+	}, "\n")}, &rbeclient.RunCommandOpts{
+		InputRootDir:         inputRoot,
+		PlatformProperties:   map[string]string{"container-image": "none"},
+		EnvironmentVariables: map[string]string{"NAME": "BuildBuddy"},
+		OutputFiles:          []string{"out/name.output"},
+		Timeout:              1 * time.Minute,
+		DoNotCache:           true,
+	})
+	res := cmd.Wait()
+
+	require.Equal(t, 0, res.ExitCode)
+	require.Equal(t, "HelloGoodbye", res.Stdout)
+
+	outDir := rbe.DownloadOutputsToNewTempDir(res)
+
+	testfs.AssertExactFileContents(t, outDir, map[string]string{
+		"out/name.output": "BuildBuddy",
+	})
+}
+
+func TestManyOutputFilesActionIO(t *testing.T) {
+	rbe := rbetest.NewRBETestEnv(t)
+	rbe.AddBuildBuddyServer()
+	rbe.AddExecutor()
+
+	script := []string{`set -e`}
+	outputFiles := []string{}
+	contents := map[string]string{}
+	for i := 0; i < 50; i++ {
+		// Every other file has the same contents, so that some digests are
+		// shared by several outputs.
+		path := fmt.Sprintf("out/%d.output", i)
+		content := fmt.Sprintf("output %d", i%25)
+		script = append(script, fmt.Sprintf(`printf '%s' > %s`, content, path))
+		outputFiles = append(outputFiles, path)
+		contents[path] = content
+	}
+	script = append(script, `touch out/empty.output`, `head -c 5000000 /dev/zero > out/large.output`)
+	outputFiles = append(outputFiles, "out/empty.output", "out/large.output")
+	contents["out/empty.output"] = ""
+	contents["out/large.output"] = string(make([]byte, 5000000))
+
+	cmd := rbe.Execute(&repb.Command{
+		Arguments:   []string{"sh", "-c", strings.Join(script, "\n")},
+		OutputFiles: outputFiles,
+	}, &rbetest.ExecuteOpts{})
+	res := cmd.Wait()
+
+	require.Equal(t, 0, res.ExitCode)
+
+	outDir := rbe.DownloadOutputsToNewTempDir(res)
+
+	testfs.AssertExactFileContents(t, outDir, contents)
+}
+
 func TestComplexActionIO(t *testing.T) {
 	t.Skip() // TODO: De-flake and re-enable.
 
@@ -10,10 +10,14 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/task_router"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/testredis"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/util/bazel_request"
+	"github.com/golang/protobuf/proto"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 )
@@ -172,6 +176,85 @@ func TestTaskRouter_MarkComplete_DoesNotAffectOtherRemoteInstances(t *testing.T)
 	requireNotAlwaysRanked(0, executorID1, t, router, ctx, cmd, instanceName2)
 }
 
+func TestTaskRouter_AffinityRouting_PersistentWorkerKey(t *testing.T) {
+	env := newTestEnv(t)
+	setAffinityRouting(t, env, config.AffinityRoutingConfig{Pool: "workers", Key: "persistent_worker_key"})
+	router := newTaskRouter(t, env)
+	ctx := withAuthUser(t, context.Background(), env, "US1")
+	cmd := &repb.Command{
+		Platform: &repb.Platform{
+			Properties: []*repb.Platform_Property{
+				{Name: "Pool", Value: "workers"},
+				{Name: "persistentWorkerKey", Value: "javac-abc123"},
+			},
+		},
+	}
+	instanceName := "test-instance"
+
+	router.MarkComplete(ctx, cmd, instanceName, executorID1)
+
+	nodes := sequentiallyNumberedNodes(100)
+	ranked := router.RankNodes(ctx, cmd, instanceName, nodes)
+
+	require.ElementsMatch(t, nodes, ranked)
+	require.Equal(t, executorID1, ranked[0].GetExecutorID())
+
+	// Tasks for other workers should not be affected.
+	otherCmd := &repb.Command{
+		Platform: &repb.Platform{
+			Properties: []*repb.Platform_Property{
+				{Name: "Pool", Value: "workers"},
+				{Name: "persistentWorkerKey", Value: "scalac-def456"},
+			},
+		},
+	}
+	requireNotAlwaysRanked(0, executorID1, t, router, ctx, otherCmd, instanceName)
+}
+
+func TestTaskRouter_AffinityRouting_TargetLabel(t *testing.T) {
+	env := newTestEnv(t)
+	setAffinityRouting(t, env, config.AffinityRoutingConfig{Key: "target_label", PreferredNodeLimit: 2})
+	router := newTaskRouter(t, env)
+	ctx := withAuthUser(t, context.Background(), env, "US1")
+	cmd := &repb.Command{}
+	instanceName := "test-instance"
+
+	fooCtx := withTargetID(t, ctx, "//foo:bar")
+	router.MarkComplete(fooCtx, cmd, instanceName, executorID1)
+	router.MarkComplete(fooCtx, cmd, instanceName, executorID2)
+
+	nodes := sequentiallyNumberedNodes(100)
+	ranked := router.RankNodes(fooCtx, cmd, instanceName, nodes)
+
+	require.ElementsMatch(t, nodes, ranked)
+	require.Equal(t, executorID2, ranked[0].GetExecutorID())
+	require.Equal(t, executorID1, ranked[1].GetExecutorID())
+
+	// Other targets and requests without a target label should not be
+	// affected.
+	requireNotAlwaysRanked(0, executorID2, t, router, withTargetID(t, ctx, "//baz:qux"), cmd, instanceName)
+	requireNotAlwaysRanked(0, executorID2, t, router, ctx, cmd, instanceName)
+}
+
+func TestTaskRouter_AffinityRouting_DoesNotAffectOtherPools(t *testing.T) {
+	env := newTestEnv(t)
+	setAffinityRouting(t, env, config.AffinityRoutingConfig{Pool: "workers", Key: "persistent_worker_key"})
+	router := newTaskRouter(t, env)
+	ctx := withAuthUser(t, context.Background(), env, "US1")
+	cmd := &repb.Command{
+		Platform: &repb.Platform{
+			Properties: []*repb.Platform_Property{
+				{Name: "persistentWorkerKey", Value: "javac-abc123"},
+			},
+		},
+	}
+	instanceName := "test-instance"
+
+	router.MarkComplete(ctx, cmd, instanceName, executorID1)
+
+	requireNotAlwaysRanked(0, executorID1, t, router, ctx, cmd, instanceName)
+}
+
 // requireNotAlwaysRanked requires that the task router does not
 // deterministically assign the given rank to the given executor ID.
 func requireNotAlwaysRanked(rank int, executorID string, t *testing.T, router interfaces.TaskRouter, ctx context.Context, cmd *repb.Command, instanceName string) {
@@ -230,6 +313,19 @@ func withAuthUser(t *testing.T, ctx context.Context, env environment.Env, userID
 	return ctx
 }
 
+func setAffinityRouting(t *testing.T, env environment.Env, c ...config.AffinityRoutingConfig) {
+	rec := env.GetConfigurator().GetRemoteExecutionConfig()
+	require.NotNil(t, rec)
+	rec.AffinityRouting = c
+	t.Cleanup(func() { rec.AffinityRouting = nil })
+}
+
+func withTargetID(t *testing.T, ctx context.Context, targetID string) context.Context {
+	b, err := proto.Marshal(&repb.RequestMetadata{TargetId: targetID})
+	require.NoError(t, err)
+	return metadata.NewIncomingContext(ctx, metadata.Pairs(bazel_request.RequestMetadataKey, string(b)))
+}
+
 func sequentiallyNumberedNodes(n int) []interfaces.ExecutionNode {
 	nodes := make([]interfaces.ExecutionNode, 0, n)
 	for i := 0; i < n; i++ {
@@ -240,4 +336,5 @@ func sequentiallyNumberedNodes(n int) []interfaces.ExecutionNode {
 
 type testNode struct{ id int }
 
-func (n *testNode) GetExecutorID() string { return fmt.Sprintf("%d", n.id) }
+func (n *testNode) GetExecutorID() string     { return fmt.Sprintf("%d", n.id) }
+func (n *testNode) GetCapabilityGrade() int32 { return 0 }
@@ -27,6 +27,7 @@ const (
 type FakeProvider struct {
 	RegisteredWebhookURL  string
 	UnregisteredWebhookID string
+	Statuses              []*interfaces.CommitStatus
 }
 
 func NewFakeProvider() *FakeProvider {
@@ -50,6 +51,10 @@ func (p *FakeProvider) UnregisterWebhook(ctx context.Context, accessToken, repoU
 	p.UnregisteredWebhookID = webhookID
 	return nil
 }
+func (p *FakeProvider) CreateStatus(ctx context.Context, accessToken, repoURL, commitSHA string, status *interfaces.CommitStatus) error {
+	p.Statuses = append(p.Statuses, status)
+	return nil
+}
 
 // MakeTempRepo initializes a Git repository with the given file contents, and
 // creates an initial commit of those files. Contents are specified as a map of
@@ -0,0 +1,175 @@
+package ldap
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+// LDAP messages are encoded with the Basic Encoding Rules (BER), which are
+// looser than the DER that encoding/asn1 accepts: for example, servers like
+// Active Directory send lengths that aren't minimally encoded. So messages are
+// encoded and decoded by hand here, which only needs the handful of types used
+// by LDAP.
+
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x30
+	tagSet         = 0x31
+
+	classApplication = 0x40
+	classContext     = 0x80
+	constructed      = 0x20
+
+	// The largest message that is read from a server.
+	maxPacketLength = 16 * 1024 * 1024
+)
+
+// packet is a decoded BER element. Its tag is a single byte, since LDAP only
+// uses tag numbers below 31.
+type packet struct {
+	tag     byte
+	content []byte
+}
+
+func encodeLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func encode(tag byte, content []byte) []byte {
+	b := append([]byte{tag}, encodeLength(len(content))...)
+	return append(b, content...)
+}
+
+func encodeConstructed(tag byte, children ...[]byte) []byte {
+	var content []byte
+	for _, c := range children {
+		content = append(content, c...)
+	}
+	return encode(tag, content)
+}
+
+func encodeInt(tag byte, v int64) []byte {
+	// Two's complement, big-endian, in as few bytes as possible.
+	b := []byte{byte(v)}
+	for v >>= 8; !(v == 0 && b[0] < 0x80) && !(v == -1 && b[0] >= 0x80); v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	return encode(tag, b)
+}
+
+func encodeString(tag byte, s string) []byte {
+	return encode(tag, []byte(s))
+}
+
+func encodeBool(b bool) []byte {
+	if b {
+		return encode(tagBoolean, []byte{0xff})
+	}
+	return encode(tagBoolean, []byte{0x00})
+}
+
+// readLength reads a definite length. LDAP doesn't allow indefinite lengths.
+func readLength(r io.ByteReader) (int, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b < 0x80 {
+		return int(b), nil
+	}
+	numBytes := int(b & 0x7f)
+	if numBytes == 0 || numBytes > 4 {
+		return 0, status.InvalidArgumentErrorf("unsupported BER length encoding 0x%x", b)
+	}
+	n := 0
+	for i := 0; i < numBytes; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		n = n<<8 | int(b)
+	}
+	return n, nil
+}
+
+// readPacket reads the next element from a stream.
+func readPacket(r *bufio.Reader) (*packet, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	n, err := readLength(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxPacketLength {
+		return nil, status.ResourceExhaustedErrorf("LDAP message of %d bytes exceeds the limit of %d bytes", n, maxPacketLength)
+	}
+	p := &packet{tag: tag, content: make([]byte, n)}
+	if _, err := io.ReadFull(r, p.content); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+type byteReader struct {
+	b []byte
+}
+
+func (r *byteReader) ReadByte() (byte, error) {
+	if len(r.b) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	b := r.b[0]
+	r.b = r.b[1:]
+	return b, nil
+}
+
+// children decodes the elements contained in a constructed element.
+func (p *packet) children() ([]*packet, error) {
+	var children []*packet
+	r := &byteReader{b: p.content}
+	for len(r.b) > 0 {
+		tag, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		n, err := readLength(r)
+		if err != nil {
+			return nil, err
+		}
+		if n > len(r.b) {
+			return nil, status.InvalidArgumentError("truncated BER element")
+		}
+		children = append(children, &packet{tag: tag, content: r.b[:n]})
+		r.b = r.b[n:]
+	}
+	return children, nil
+}
+
+func (p *packet) int() (int64, error) {
+	if len(p.content) == 0 || len(p.content) > 8 {
+		return 0, status.InvalidArgumentErrorf("invalid BER integer of %d bytes", len(p.content))
+	}
+	v := int64(int8(p.content[0]))
+	for _, b := range p.content[1:] {
+		v = v<<8 | int64(b)
+	}
+	return v, nil
+}
+
+func (p *packet) string() string {
+	return string(p.content)
+}
@@ -0,0 +1,195 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+const (
+	filterAnd      = classContext | constructed | 0
+	filterOr       = classContext | constructed | 1
+	filterNot      = classContext | constructed | 2
+	filterEquality = classContext | constructed | 3
+	filterPresent  = classContext | 7
+)
+
+// Filter is a search filter, such as (&(objectClass=person)(uid=alice)).
+//
+// Filters built with Equal match their value literally, so values supplied by
+// users, like usernames, should be passed to Equal rather than formatted into
+// a string for ParseFilter.
+type Filter struct {
+	ber []byte
+}
+
+// And returns a filter which matches entries that match all of the filters.
+func And(filters ...Filter) Filter {
+	return Filter{ber: encodeConstructed(filterAnd, filterBERs(filters)...)}
+}
+
+// Or returns a filter which matches entries that match any of the filters.
+func Or(filters ...Filter) Filter {
+	return Filter{ber: encodeConstructed(filterOr, filterBERs(filters)...)}
+}
+
+// Not returns a filter which matches entries that don't match the filter.
+func Not(filter Filter) Filter {
+	return Filter{ber: encodeConstructed(filterNot, filter.ber)}
+}
+
+// Equal returns a filter which matches entries whose attribute has the value.
+func Equal(attribute, value string) Filter {
+	return Filter{ber: encodeConstructed(filterEquality, encodeString(tagOctetString, attribute), encodeString(tagOctetString, value))}
+}
+
+// Present returns a filter which matches entries that have the attribute.
+func Present(attribute string) Filter {
+	return Filter{ber: encodeString(filterPresent, attribute)}
+}
+
+func filterBERs(filters []Filter) [][]byte {
+	bers := make([][]byte, 0, len(filters))
+	for _, f := range filters {
+		bers = append(bers, f.ber)
+	}
+	return bers
+}
+
+// ParseFilter parses a filter in the string representation of RFC 4515. Only
+// the &, | and ! operators and equality and presence matches (such as
+// (objectClass=person) and (mail=*)) are supported. The outer parentheses may
+// be left out.
+func ParseFilter(s string) (Filter, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "(") {
+		s = "(" + s + ")"
+	}
+	p := &filterParser{s: s}
+	f, err := p.parseFilter()
+	if err != nil {
+		return Filter{}, err
+	}
+	if p.pos != len(p.s) {
+		return Filter{}, p.errorf("unexpected trailing characters")
+	}
+	return f, nil
+}
+
+type filterParser struct {
+	s   string
+	pos int
+}
+
+func (p *filterParser) errorf(msg string) error {
+	return status.InvalidArgumentErrorf("invalid LDAP filter %q at position %d: %s", p.s, p.pos, msg)
+}
+
+func (p *filterParser) consume(c byte) bool {
+	if p.pos < len(p.s) && p.s[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) parseFilter() (Filter, error) {
+	if !p.consume('(') {
+		return Filter{}, p.errorf("expected '('")
+	}
+	var f Filter
+	var err error
+	switch {
+	case p.consume('&'):
+		var filters []Filter
+		filters, err = p.parseFilterList()
+		f = And(filters...)
+	case p.consume('|'):
+		var filters []Filter
+		filters, err = p.parseFilterList()
+		f = Or(filters...)
+	case p.consume('!'):
+		f, err = p.parseFilter()
+		f = Not(f)
+	default:
+		f, err = p.parseItem()
+	}
+	if err != nil {
+		return Filter{}, err
+	}
+	if !p.consume(')') {
+		return Filter{}, p.errorf("expected ')'")
+	}
+	return f, nil
+}
+
+func (p *filterParser) parseFilterList() ([]Filter, error) {
+	var filters []Filter
+	for p.pos < len(p.s) && p.s[p.pos] == '(' {
+		f, err := p.parseFilter()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	if len(filters) == 0 {
+		return nil, p.errorf("expected at least one filter")
+	}
+	return filters, nil
+}
+
+func (p *filterParser) parseItem() (Filter, error) {
+	end := strings.IndexAny(p.s[p.pos:], "=()")
+	if end <= 0 || p.s[p.pos+end] != '=' {
+		return Filter{}, p.errorf("expected an attribute followed by '='")
+	}
+	attribute := p.s[p.pos : p.pos+end]
+	if strings.ContainsAny(attribute[len(attribute)-1:], "<>~:") {
+		return Filter{}, p.errorf("only equality and presence matches are supported")
+	}
+	p.pos += end + 1
+
+	end = strings.IndexAny(p.s[p.pos:], "()")
+	if end < 0 {
+		return Filter{}, p.errorf("expected ')'")
+	}
+	rawValue := p.s[p.pos : p.pos+end]
+	if rawValue == "*" {
+		p.pos += end
+		return Present(attribute), nil
+	}
+	if strings.Contains(rawValue, "*") {
+		return Filter{}, p.errorf("substring matches are not supported")
+	}
+	value, err := p.unescape(rawValue)
+	if err != nil {
+		return Filter{}, err
+	}
+	p.pos += end
+	return Equal(attribute, value), nil
+}
+
+// unescape decodes the \XX hex escapes in a filter value.
+func (p *filterParser) unescape(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return "", p.errorf("incomplete escape sequence")
+		}
+		decoded, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", p.errorf("invalid escape sequence")
+		}
+		b.Write(decoded)
+		i += 2
+	}
+	return b.String(), nil
+}
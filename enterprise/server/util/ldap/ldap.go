@@ -0,0 +1,372 @@
+// Package ldap is a minimal LDAP v3 client, which supports the StartTLS,
+// simple bind and search operations needed to authenticate users against a
+// directory such as OpenLDAP or Active Directory.
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+const (
+	defaultPort    = "389"
+	defaultTLSPort = "636"
+
+	// How long an operation may take if its context has no deadline.
+	defaultTimeout = 10 * time.Second
+
+	opBindRequest           = classApplication | constructed | 0
+	opBindResponse          = classApplication | constructed | 1
+	opUnbindRequest         = classApplication | 2
+	opSearchRequest         = classApplication | constructed | 3
+	opSearchResultEntry     = classApplication | constructed | 4
+	opSearchResultDone      = classApplication | constructed | 5
+	opSearchResultReference = classApplication | constructed | 19
+	opExtendedRequest       = classApplication | constructed | 23
+	opExtendedResponse      = classApplication | constructed | 24
+
+	authSimple          = classContext | 0
+	extendedRequestName = classContext | 0
+
+	// The OID of the StartTLS extended operation (RFC 4511 section 4.14).
+	startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+	ldapVersion = 3
+
+	scopeWholeSubtree = 2
+	neverDerefAliases = 0
+
+	resultSuccess            = 0
+	resultNoSuchObject       = 32
+	resultInvalidCredentials = 49
+)
+
+// Conn is a connection to an LDAP server. It runs one operation at a time, and
+// is not safe for concurrent use.
+type Conn struct {
+	conn          net.Conn
+	r             *bufio.Reader
+	host          string
+	lastMessageID int64
+}
+
+// Dial connects to the server at the given URL, such as
+// ldaps://ldap.example.com. Connections to ldaps:// URLs are made over TLS
+// with the given config, which is required for them. If the config has no
+// ServerName, the URL's host is verified.
+func Dial(ctx context.Context, rawURL string, tlsConfig *tls.Config) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid LDAP URL %q: %s", rawURL, err)
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "ldap":
+		if port == "" {
+			port = defaultPort
+		}
+	case "ldaps":
+		if port == "" {
+			port = defaultTLSPort
+		}
+		if tlsConfig == nil {
+			return nil, status.InvalidArgumentErrorf("connecting to LDAP URL %q requires a TLS config", rawURL)
+		}
+	default:
+		return nil, status.InvalidArgumentErrorf("invalid LDAP URL %q: scheme must be ldap or ldaps", rawURL)
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+
+	dialer := &net.Dialer{Timeout: defaultTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, status.UnavailableErrorf("could not connect to LDAP server %s: %s", addr, err)
+	}
+	c := &Conn{conn: conn, r: bufio.NewReader(conn), host: u.Hostname()}
+	if u.Scheme == "ldaps" {
+		if err := c.handshake(ctx, tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// handshake switches the connection over to TLS.
+func (c *Conn) handshake(ctx context.Context, tlsConfig *tls.Config) error {
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = c.host
+	}
+	tlsConn := tls.Client(c.conn, tlsConfig)
+	setDeadline(ctx, tlsConn)
+	if err := tlsConn.Handshake(); err != nil {
+		return status.UnavailableErrorf("TLS handshake with LDAP server %s failed: %s", c.host, err)
+	}
+	c.conn = tlsConn
+	c.r = bufio.NewReader(tlsConn)
+	return nil
+}
+
+// StartTLS upgrades a connection made to an ldap:// URL to TLS, with the
+// given config, so that binds don't send passwords in plain text. It must be
+// called before any other operation.
+func (c *Conn) StartTLS(ctx context.Context, tlsConfig *tls.Config) error {
+	if tlsConfig == nil {
+		return status.InvalidArgumentError("StartTLS requires a TLS config")
+	}
+	if _, ok := c.conn.(*tls.Conn); ok {
+		return status.FailedPreconditionError("LDAP connection already uses TLS")
+	}
+	setDeadline(ctx, c.conn)
+	id, err := c.send(encodeConstructed(opExtendedRequest, encodeString(extendedRequestName, startTLSOID)))
+	if err != nil {
+		return err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != opExtendedResponse {
+		return status.InternalErrorf("unexpected LDAP response 0x%x to StartTLS request", op.tag)
+	}
+	if err := resultError(op); err != nil {
+		return status.UnavailableErrorf("LDAP server %s refused StartTLS: %s", c.host, err)
+	}
+	return c.handshake(ctx, tlsConfig)
+}
+
+func setDeadline(ctx context.Context, conn net.Conn) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultTimeout)
+	}
+	conn.SetDeadline(deadline)
+}
+
+// Close unbinds and closes the connection.
+func (c *Conn) Close() error {
+	c.send(encode(opUnbindRequest, nil))
+	return c.conn.Close()
+}
+
+func (c *Conn) send(op []byte) (int64, error) {
+	c.lastMessageID++
+	msg := encodeConstructed(tagSequence, encodeInt(tagInteger, c.lastMessageID), op)
+	if _, err := c.conn.Write(msg); err != nil {
+		return 0, status.UnavailableErrorf("could not send LDAP request: %s", err)
+	}
+	return c.lastMessageID, nil
+}
+
+// receive returns the operation of the next message, which must be a response
+// to the request with the given message ID.
+func (c *Conn) receive(messageID int64) (*packet, error) {
+	msg, err := readPacket(c.r)
+	if err != nil {
+		return nil, status.UnavailableErrorf("could not read LDAP response: %s", err)
+	}
+	children, err := msg.children()
+	if err != nil {
+		return nil, err
+	}
+	if msg.tag != tagSequence || len(children) < 2 {
+		return nil, status.InternalError("malformed LDAP message")
+	}
+	id, err := children[0].int()
+	if err != nil {
+		return nil, err
+	}
+	if id == 0 {
+		// The server is about to close the connection (RFC 4511 section 4.4).
+		return nil, status.UnavailableError("LDAP server sent an unsolicited notification")
+	}
+	if id != messageID {
+		return nil, status.InternalErrorf("received LDAP response to message %d, expected %d", id, messageID)
+	}
+	return children[1], nil
+}
+
+// resultError returns the error described by an LDAPResult, or nil if it was
+// successful.
+func resultError(op *packet) error {
+	fields, err := op.children()
+	if err != nil {
+		return err
+	}
+	if len(fields) < 3 {
+		return status.InternalError("malformed LDAP result")
+	}
+	code, err := fields[0].int()
+	if err != nil {
+		return err
+	}
+	message := fields[2].string()
+	switch code {
+	case resultSuccess:
+		return nil
+	case resultInvalidCredentials:
+		return status.UnauthenticatedErrorf("LDAP invalid credentials: %s", message)
+	case resultNoSuchObject:
+		return status.NotFoundErrorf("LDAP no such object: %s", message)
+	default:
+		return status.UnknownErrorf("LDAP result code %d: %s", code, message)
+	}
+}
+
+// Bind authenticates the connection as the given DN. Binding with an empty DN
+// and password is anonymous. A DN with an empty password is rejected, since
+// many servers treat it as an anonymous bind which succeeds regardless of the
+// DN (RFC 4513 section 5.1.2).
+func (c *Conn) Bind(ctx context.Context, dn, password string) error {
+	if password == "" && dn != "" {
+		return status.UnauthenticatedError("LDAP bind requires a password")
+	}
+	setDeadline(ctx, c.conn)
+	id, err := c.send(encodeConstructed(opBindRequest,
+		encodeInt(tagInteger, ldapVersion),
+		encodeString(tagOctetString, dn),
+		encodeString(authSimple, password),
+	))
+	if err != nil {
+		return err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != opBindResponse {
+		return status.InternalErrorf("unexpected LDAP response 0x%x to bind request", op.tag)
+	}
+	return resultError(op)
+}
+
+// SearchRequest describes a search of the subtree under BaseDN.
+type SearchRequest struct {
+	BaseDN string
+	Filter Filter
+	// The attributes to return. If empty, all user attributes are returned.
+	Attributes []string
+	// The maximum number of entries to return. If zero, the server's limit
+	// applies.
+	SizeLimit int
+}
+
+// Entry is an entry returned by a search.
+type Entry struct {
+	DN string
+	// The attribute values, keyed by the lowercased attribute names, since
+	// attribute names are case-insensitive.
+	attributes map[string][]string
+}
+
+// NewEntry returns an entry with the given attributes.
+func NewEntry(dn string, attributes map[string][]string) *Entry {
+	e := &Entry{DN: dn, attributes: make(map[string][]string, len(attributes))}
+	for name, values := range attributes {
+		e.attributes[strings.ToLower(name)] = values
+	}
+	return e
+}
+
+// GetAttributeValues returns all values of the attribute.
+func (e *Entry) GetAttributeValues(name string) []string {
+	return e.attributes[strings.ToLower(name)]
+}
+
+// GetAttributeValue returns the first value of the attribute, or "" if it has
+// none.
+func (e *Entry) GetAttributeValue(name string) string {
+	values := e.GetAttributeValues(name)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func parseEntry(op *packet) (*Entry, error) {
+	fields, err := op.children()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) < 2 {
+		return nil, status.InternalError("malformed LDAP search result entry")
+	}
+	attributes, err := fields[1].children()
+	if err != nil {
+		return nil, err
+	}
+	e := &Entry{DN: fields[0].string(), attributes: make(map[string][]string, len(attributes))}
+	for _, a := range attributes {
+		typeAndValues, err := a.children()
+		if err != nil {
+			return nil, err
+		}
+		if len(typeAndValues) < 2 {
+			return nil, status.InternalError("malformed LDAP attribute")
+		}
+		values, err := typeAndValues[1].children()
+		if err != nil {
+			return nil, err
+		}
+		name := strings.ToLower(typeAndValues[0].string())
+		for _, v := range values {
+			e.attributes[name] = append(e.attributes[name], v.string())
+		}
+	}
+	return e, nil
+}
+
+// Search returns the entries that match the request. Referrals to other
+// servers are not followed.
+func (c *Conn) Search(ctx context.Context, req *SearchRequest) ([]*Entry, error) {
+	attributes := make([][]byte, 0, len(req.Attributes))
+	for _, a := range req.Attributes {
+		attributes = append(attributes, encodeString(tagOctetString, a))
+	}
+	setDeadline(ctx, c.conn)
+	id, err := c.send(encodeConstructed(opSearchRequest,
+		encodeString(tagOctetString, req.BaseDN),
+		encodeInt(tagEnumerated, scopeWholeSubtree),
+		encodeInt(tagEnumerated, neverDerefAliases),
+		encodeInt(tagInteger, int64(req.SizeLimit)),
+		encodeInt(tagInteger, 0 /*=timeLimit*/),
+		encodeBool(false /*=typesOnly*/),
+		req.Filter.ber,
+		encodeConstructed(tagSequence, attributes...),
+	))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*Entry
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case opSearchResultEntry:
+			e, err := parseEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+		case opSearchResultReference:
+			continue
+		case opSearchResultDone:
+			if err := resultError(op); err != nil {
+				return nil, err
+			}
+			return entries, nil
+		default:
+			return nil, status.InternalErrorf("unexpected LDAP response 0x%x to search request", op.tag)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntRoundTrip(t *testing.T) {
+	for _, v := range []int64{0, 1, 127, 128, 255, 256, 65535, -1, -128, -129, 1 << 40} {
+		b := encodeInt(tagInteger, v)
+		p, err := readPacket(bufio.NewReader(bytes.NewReader(b)))
+		require.NoError(t, err)
+		got, err := p.int()
+		require.NoError(t, err)
+		assert.Equal(t, v, got, "encoding %x", b)
+	}
+}
+
+func TestNonMinimalLength(t *testing.T) {
+	// Active Directory sends lengths in the long form even when they're short.
+	p, err := readPacket(bufio.NewReader(bytes.NewReader([]byte{tagOctetString, 0x84, 0, 0, 0, 3, 'a', 'b', 'c'})))
+	require.NoError(t, err)
+	assert.Equal(t, "abc", p.string())
+
+	long := encodeString(tagOctetString, string(make([]byte, 300)))
+	p, err = readPacket(bufio.NewReader(bytes.NewReader(long)))
+	require.NoError(t, err)
+	assert.Len(t, p.content, 300)
+}
+
+func TestParseFilter(t *testing.T) {
+	for s, want := range map[string]Filter{
+		"(objectClass=person)": Equal("objectClass", "person"),
+		"objectClass=person":   Equal("objectClass", "person"),
+		"(mail=*)":             Present("mail"),
+		`(cn=a\2ab\29)`:        Equal("cn", "a*b)"),
+		"(&(objectClass=person)(!(memberOf=cn=admins,dc=example,dc=com)))": And(
+			Equal("objectClass", "person"),
+			Not(Equal("memberOf", "cn=admins,dc=example,dc=com")),
+		),
+		"(|(uid=a)(uid=b))": Or(Equal("uid", "a"), Equal("uid", "b")),
+	} {
+		got, err := ParseFilter(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, want, got, s)
+	}
+
+	for _, s := range []string{
+		"(cn=a*)",
+		"(uidNumber>=1000)",
+		"(&)",
+		"(cn=a",
+		"(cn=a))",
+		`(cn=a\2)`,
+		"(=a)",
+	} {
+		_, err := ParseFilter(s)
+		assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument parsing %q, got %v", s, err)
+	}
+}
+
+// fakeServer is an LDAP server which accepts binds with the given passwords,
+// and responds to every search with all of its entries.
+type fakeServer struct {
+	lis       net.Listener
+	scheme    string
+	passwords map[string]string
+	entries   []*Entry
+	// If set, StartTLS requests are accepted with this config.
+	startTLSConfig *tls.Config
+
+	mu            sync.Mutex
+	lastSearchDN  string
+	lastSearchBER []byte
+	lastBindTLS   bool
+}
+
+func startFakeServer(t *testing.T, passwords map[string]string, entries []*Entry) *fakeServer {
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	return serveFake(t, &fakeServer{lis: lis, scheme: "ldap", passwords: passwords, entries: entries})
+}
+
+// startFakeTLSServer starts a server for ldaps:// URLs, and returns a pool
+// that trusts its certificate.
+func startFakeTLSServer(t *testing.T, passwords map[string]string) (*fakeServer, *x509.CertPool) {
+	serverConfig, roots := selfSignedTLSConfig(t)
+	lis, err := tls.Listen("tcp", "localhost:0", serverConfig)
+	require.NoError(t, err)
+	return serveFake(t, &fakeServer{lis: lis, scheme: "ldaps", passwords: passwords}), roots
+}
+
+// startFakeStartTLSServer starts a server for ldap:// URLs which accepts
+// StartTLS requests with the given config.
+func startFakeStartTLSServer(t *testing.T, passwords map[string]string, tlsConfig *tls.Config) *fakeServer {
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	return serveFake(t, &fakeServer{lis: lis, scheme: "ldap", passwords: passwords, startTLSConfig: tlsConfig})
+}
+
+func serveFake(t *testing.T, s *fakeServer) *fakeServer {
+	t.Cleanup(func() { s.lis.Close() })
+	lis := s.lis
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) url() string {
+	return s.scheme + "://" + s.lis.Addr().String()
+}
+
+// selfSignedTLSConfig returns a server config with a self-signed certificate
+// for the loopback address, and a pool containing the certificate.
+func selfSignedTLSConfig(t *testing.T) (*tls.Config, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, roots
+}
+
+const resultProtocolError = 2
+
+func result(op byte, code int64) []byte {
+	return encodeConstructed(op, encodeInt(tagEnumerated, code), encodeString(tagOctetString, ""), encodeString(tagOctetString, ""))
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		msg, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		children, err := msg.children()
+		if err != nil {
+			return
+		}
+		id, _ := children[0].int()
+		op := children[1]
+		var responses [][]byte
+		switch op.tag {
+		case opBindRequest:
+			fields, _ := op.children()
+			dn, password := fields[1].string(), fields[2].string()
+			code := int64(resultInvalidCredentials)
+			if want, ok := s.passwords[dn]; ok && want == password {
+				code = resultSuccess
+			}
+			_, isTLS := conn.(*tls.Conn)
+			s.mu.Lock()
+			s.lastBindTLS = isTLS
+			s.mu.Unlock()
+			responses = append(responses, result(opBindResponse, code))
+		case opExtendedRequest:
+			fields, _ := op.children()
+			if s.startTLSConfig == nil || len(fields) < 1 || fields[0].string() != startTLSOID {
+				responses = append(responses, result(opExtendedResponse, resultProtocolError))
+				break
+			}
+			if _, err := conn.Write(encodeConstructed(tagSequence, encodeInt(tagInteger, id), result(opExtendedResponse, resultSuccess))); err != nil {
+				return
+			}
+			tlsConn := tls.Server(conn, s.startTLSConfig)
+			conn, r = tlsConn, bufio.NewReader(tlsConn)
+			continue
+		case opSearchRequest:
+			fields, _ := op.children()
+			s.mu.Lock()
+			s.lastSearchDN = fields[0].string()
+			s.lastSearchBER = encode(fields[6].tag, fields[6].content)
+			s.mu.Unlock()
+			for _, e := range s.entries {
+				var attributes [][]byte
+				for name, values := range e.attributes {
+					var encodedValues [][]byte
+					for _, v := range values {
+						encodedValues = append(encodedValues, encodeString(tagOctetString, v))
+					}
+					attributes = append(attributes, encodeConstructed(tagSequence, encodeString(tagOctetString, name), encodeConstructed(tagSet, encodedValues...)))
+				}
+				responses = append(responses, encodeConstructed(opSearchResultEntry, encodeString(tagOctetString, e.DN), encodeConstructed(tagSequence, attributes...)))
+			}
+			responses = append(responses, result(opSearchResultDone, resultSuccess))
+		default:
+			return
+		}
+		for _, rsp := range responses {
+			if _, err := conn.Write(encodeConstructed(tagSequence, encodeInt(tagInteger, id), rsp)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestBind(t *testing.T) {
+	ctx := context.Background()
+	s := startFakeServer(t, map[string]string{"cn=admin,dc=example,dc=com": "secret"}, nil)
+	c, err := Dial(ctx, s.url(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.NoError(t, c.Bind(ctx, "cn=admin,dc=example,dc=com", "secret"))
+
+	err = c.Bind(ctx, "cn=admin,dc=example,dc=com", "wrong")
+	assert.True(t, status.IsUnauthenticatedError(err), "expected Unauthenticated, got %v", err)
+
+	// An empty password must not fall back to an anonymous bind.
+	err = c.Bind(ctx, "cn=admin,dc=example,dc=com", "")
+	assert.True(t, status.IsUnauthenticatedError(err), "expected Unauthenticated, got %v", err)
+}
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+	alice := NewEntry("uid=alice,ou=people,dc=example,dc=com", map[string][]string{
+		"mail":     {"alice@example.com"},
+		"memberOf": {"cn=eng,ou=groups,dc=example,dc=com", "cn=ops,ou=groups,dc=example,dc=com"},
+	})
+	s := startFakeServer(t, nil, []*Entry{alice})
+	c, err := Dial(ctx, s.url(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+
+	filter := And(Equal("objectClass", "person"), Equal("uid", "alice"))
+	entries, err := c.Search(ctx, &SearchRequest{
+		BaseDN:     "ou=people,dc=example,dc=com",
+		Filter:     filter,
+		Attributes: []string{"mail", "memberOf"},
+	})
+	require.NoError(t, err)
+
+	require.Len(t, entries, 1)
+	assert.Equal(t, alice.DN, entries[0].DN)
+	assert.Equal(t, "alice@example.com", entries[0].GetAttributeValue("MAIL"))
+	assert.ElementsMatch(t, alice.GetAttributeValues("memberof"), entries[0].GetAttributeValues("memberOf"))
+	assert.Equal(t, "", entries[0].GetAttributeValue("cn"))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.Equal(t, "ou=people,dc=example,dc=com", s.lastSearchDN)
+	assert.Equal(t, filter.ber, s.lastSearchBER)
+}
+
+func TestDialInvalidURL(t *testing.T) {
+	_, err := Dial(context.Background(), "http://ldap.example.com", nil)
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+
+	_, err = Dial(context.Background(), "ldaps://ldap.example.com", nil)
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+}
+
+func TestDialTLS(t *testing.T) {
+	ctx := context.Background()
+	s, roots := startFakeTLSServer(t, map[string]string{"cn=admin,dc=example,dc=com": "secret"})
+
+	// The server's certificate isn't trusted by default.
+	_, err := Dial(ctx, s.url(), &tls.Config{})
+	assert.True(t, status.IsUnavailableError(err), "expected Unavailable, got %v", err)
+
+	// Nor is it valid for other names.
+	_, err = Dial(ctx, s.url(), &tls.Config{RootCAs: roots, ServerName: "ldap.example.com"})
+	assert.True(t, status.IsUnavailableError(err), "expected Unavailable, got %v", err)
+
+	c, err := Dial(ctx, s.url(), &tls.Config{RootCAs: roots})
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Bind(ctx, "cn=admin,dc=example,dc=com", "secret"))
+}
+
+func TestStartTLS(t *testing.T) {
+	ctx := context.Background()
+	serverConfig, roots := selfSignedTLSConfig(t)
+	s := startFakeStartTLSServer(t, map[string]string{"cn=admin,dc=example,dc=com": "secret"}, serverConfig)
+
+	c, err := Dial(ctx, s.url(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.StartTLS(ctx, &tls.Config{RootCAs: roots}))
+	require.NoError(t, c.Bind(ctx, "cn=admin,dc=example,dc=com", "secret"))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.True(t, s.lastBindTLS, "bind should have been sent over TLS")
+}
+
+func TestStartTLSUntrustedCertificate(t *testing.T) {
+	ctx := context.Background()
+	serverConfig, _ := selfSignedTLSConfig(t)
+	s := startFakeStartTLSServer(t, nil, serverConfig)
+
+	c, err := Dial(ctx, s.url(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+	err = c.StartTLS(ctx, &tls.Config{})
+	assert.True(t, status.IsUnavailableError(err), "expected Unavailable, got %v", err)
+}
+
+func TestStartTLSUnsupported(t *testing.T) {
+	ctx := context.Background()
+	s := startFakeServer(t, nil, nil)
+
+	c, err := Dial(ctx, s.url(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+	err = c.StartTLS(ctx, &tls.Config{})
+	assert.True(t, status.IsUnavailableError(err), "expected Unavailable, got %v", err)
+}
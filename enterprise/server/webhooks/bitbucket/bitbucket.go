@@ -2,27 +2,45 @@ package bitbucket
 
 import (
 	"context"
-	"encoding/json"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/fieldgetter"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_data"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_util"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	gitutil "github.com/buildbuddy-io/buildbuddy/server/util/git"
 )
 
 const (
 	expectedUserAgent = "Bitbucket-Webhooks/2.0"
 	repoBaseURL       = "https://bitbucket.org/"
+	apiBaseURL        = "https://api.bitbucket.org/2.0/"
 )
 
-type bitbucketGitProvider struct{}
+var (
+	// Bitbucket event names to listen for on the webhook.
+	eventsToReceive = []string{"repo:push", "pullrequest:created", "pullrequest:updated"}
+
+	// Bitbucket build states, by commit status state.
+	buildStates = map[string]string{
+		"pending": "INPROGRESS",
+		"success": "SUCCESSFUL",
+		"failure": "FAILED",
+		"error":   "FAILED",
+	}
+)
+
+type bitbucketGitProvider struct {
+	// apiBaseURL is the URL of the REST API, ending with a slash.
+	apiBaseURL string
+}
 
 func NewProvider() interfaces.GitProvider {
-	return &bitbucketGitProvider{}
+	return &bitbucketGitProvider{apiBaseURL: apiBaseURL}
 }
 
 func (*bitbucketGitProvider) ParseWebhookData(r *http.Request) (*interfaces.WebhookData, error) {
@@ -32,7 +50,7 @@ func (*bitbucketGitProvider) ParseWebhookData(r *http.Request) (*interfaces.Webh
 	switch eventName := r.Header.Get("X-Event-Key"); eventName {
 	case "repo:push":
 		payload := &PushEventPayload{}
-		if err := unmarshalBody(r, payload); err != nil {
+		if err := webhook_util.UnmarshalBody(r, payload); err != nil {
 			return nil, status.InvalidArgumentErrorf("failed to unmarshal push event payload: %s", err)
 		}
 		v, err := fieldgetter.ExtractValues(
@@ -62,7 +80,7 @@ func (*bitbucketGitProvider) ParseWebhookData(r *http.Request) (*interfaces.Webh
 		}, nil
 	case "pullrequest:created", "pullrequest:updated":
 		payload := &PullRequestEventPayload{}
-		if err := unmarshalBody(r, payload); err != nil {
+		if err := webhook_util.UnmarshalBody(r, payload); err != nil {
 			return nil, status.InvalidArgumentErrorf("failed to unmarshal %q event payload: %s", eventName, err)
 		}
 		v, err := fieldgetter.ExtractValues(
@@ -93,27 +111,79 @@ func (*bitbucketGitProvider) ParseWebhookData(r *http.Request) (*interfaces.Webh
 }
 
 func (*bitbucketGitProvider) MatchRepoURL(u *url.URL) bool {
-	return u.Host == "bitbucket.com"
+	return u.Host == "bitbucket.org"
 }
 
 func (*bitbucketGitProvider) MatchWebhookRequest(r *http.Request) bool {
 	return r.Header.Get("X-Event-Key") != ""
 }
 
-func (*bitbucketGitProvider) RegisterWebhook(ctx context.Context, accessToken, repoURL, webhookURL string) (string, error) {
-	return "", status.UnimplementedError("Not implemented")
+// RegisterWebhook registers the given webhook to the repo and returns the ID of
+// the registered webhook.
+func (p *bitbucketGitProvider) RegisterWebhook(ctx context.Context, accessToken, repoURL, webhookURL string) (string, error) {
+	repoPath, err := repoPath(repoURL)
+	if err != nil {
+		return "", err
+	}
+	hook := &Webhook{
+		Description: "BuildBuddy",
+		URL:         webhookURL,
+		Active:      true,
+		Events:      eventsToReceive,
+	}
+	created := &Webhook{}
+	if err := p.apiRequest(ctx, "POST", accessToken, repoPath+"/hooks", hook, created); err != nil {
+		return "", err
+	}
+	if created.UUID == "" {
+		return "", status.UnknownError("Bitbucket returned invalid response from hooks API (missing uuid field).")
+	}
+	return created.UUID, nil
 }
 
-func (*bitbucketGitProvider) UnregisterWebhook(ctx context.Context, accessToken, repoURL, webhookID string) error {
-	return status.UnimplementedError("Not implemented")
+// UnregisterWebhook removes the webhook from the Git repo.
+func (p *bitbucketGitProvider) UnregisterWebhook(ctx context.Context, accessToken, repoURL, webhookID string) error {
+	repoPath, err := repoPath(repoURL)
+	if err != nil {
+		return err
+	}
+	return p.apiRequest(ctx, "DELETE", accessToken, repoPath+"/hooks/"+url.PathEscape(webhookID), nil, nil)
 }
 
-func unmarshalBody(r *http.Request, payload interface{}) error {
-	b, err := ioutil.ReadAll(r.Body)
+// CreateStatus creates a build status for the commit.
+func (p *bitbucketGitProvider) CreateStatus(ctx context.Context, accessToken, repoURL, commitSHA string, cs *interfaces.CommitStatus) error {
+	repoPath, err := repoPath(repoURL)
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(b, payload)
+	state, ok := buildStates[cs.State]
+	if !ok {
+		return status.InvalidArgumentErrorf("unknown commit status state %q", cs.State)
+	}
+	buildStatus := &BuildStatus{
+		Key:         cs.Context,
+		Name:        cs.Context,
+		State:       state,
+		URL:         cs.TargetURL,
+		Description: cs.Description,
+	}
+	return p.apiRequest(ctx, "POST", accessToken, repoPath+"/commit/"+commitSHA+"/statuses/build", buildStatus, nil)
+}
+
+// repoPath returns the path of the repo in the API, like
+// "repositories/workspace/repo_slug".
+func repoPath(repoURL string) (string, error) {
+	ownerRepo, err := gitutil.OwnerRepoFromRepoURL(repoURL)
+	if err != nil {
+		return "", status.WrapError(err, "Failed to parse workspace/repo from Bitbucket URL")
+	}
+	return "repositories/" + ownerRepo, nil
+}
+
+// apiRequest sends a request to the Bitbucket API. See
+// webhook_util.APIRequest.
+func (p *bitbucketGitProvider) apiRequest(ctx context.Context, method, accessToken, path string, body, rsp interface{}) error {
+	return webhook_util.APIRequest(ctx, "Bitbucket", method, p.apiBaseURL+path, accessToken, body, rsp)
 }
 
 // PushEventPayload represents a subset of Bitbucket's Push event schema.
@@ -178,3 +248,24 @@ type RepositoryLink struct {
 type CommitDetails struct {
 	Hash string `json:"hash"`
 }
+
+// Webhook represents a subset of Bitbucket's Webhook subscription schema.
+// See https://developer.atlassian.com/cloud/bitbucket/rest/api-group-repositories/#api-repositories-workspace-repo-slug-hooks-post
+type Webhook struct {
+	UUID        string   `json:"uuid,omitempty"`
+	Description string   `json:"description"`
+	URL         string   `json:"url"`
+	Active      bool     `json:"active"`
+	Events      []string `json:"events"`
+}
+
+// BuildStatus represents Bitbucket's Commit status schema, for build
+// statuses.
+// See https://developer.atlassian.com/cloud/bitbucket/rest/api-group-commit-statuses/#api-repositories-workspace-repo-slug-commit-commit-statuses-build-post
+type BuildStatus struct {
+	Key         string `json:"key"`
+	Name        string `json:"name"`
+	State       string `json:"state"`
+	URL         string `json:"url"`
+	Description string `json:"description"`
+}
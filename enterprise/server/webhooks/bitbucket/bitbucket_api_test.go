@@ -0,0 +1,140 @@
+package bitbucket
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testRepoURL     = "https://bitbucket.org/buildbuddy/buildbuddy-ci-playground"
+	testAccessToken = "TOKEN"
+)
+
+// fakeAPI records the requests sent to it and replies with the given status
+// code and JSON response.
+type fakeAPI struct {
+	t        *testing.T
+	code     int
+	response interface{}
+
+	method string
+	path   string
+	body   map[string]interface{}
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	assert.Equal(f.t, "Bearer "+testAccessToken, r.Header.Get("Authorization"))
+	f.method = r.Method
+	f.path = r.URL.Path
+	f.body = nil
+	if r.ContentLength > 0 {
+		require.NoError(f.t, json.NewDecoder(r.Body).Decode(&f.body))
+	}
+	w.WriteHeader(f.code)
+	if f.response != nil {
+		json.NewEncoder(w).Encode(f.response)
+	}
+}
+
+func newTestProvider(t *testing.T, code int, response interface{}) (*bitbucketGitProvider, *fakeAPI) {
+	api := &fakeAPI{t: t, code: code, response: response}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	return &bitbucketGitProvider{apiBaseURL: server.URL + "/"}, api
+}
+
+func TestRegisterWebhook(t *testing.T) {
+	p, api := newTestProvider(t, http.StatusCreated, &Webhook{UUID: "{hook-uuid}"})
+
+	id, err := p.RegisterWebhook(context.Background(), testAccessToken, testRepoURL, "https://app.buildbuddy.io/webhooks/workflow/abc")
+
+	require.NoError(t, err)
+	assert.Equal(t, "{hook-uuid}", id)
+	assert.Equal(t, "POST", api.method)
+	assert.Equal(t, "/repositories/buildbuddy/buildbuddy-ci-playground/hooks", api.path)
+	assert.Equal(t, "https://app.buildbuddy.io/webhooks/workflow/abc", api.body["url"])
+	assert.Equal(t, true, api.body["active"])
+	assert.ElementsMatch(t, []interface{}{"repo:push", "pullrequest:created", "pullrequest:updated"}, api.body["events"])
+}
+
+func TestRegisterWebhook_MissingUUID(t *testing.T) {
+	p, _ := newTestProvider(t, http.StatusCreated, &Webhook{})
+
+	_, err := p.RegisterWebhook(context.Background(), testAccessToken, testRepoURL, "https://app.buildbuddy.io/webhooks/workflow/abc")
+
+	assert.True(t, status.IsUnknownError(err), "unexpected error %v", err)
+}
+
+func TestRegisterWebhook_PermissionDenied(t *testing.T) {
+	p, _ := newTestProvider(t, http.StatusForbidden, map[string]string{"error": "forbidden"})
+
+	_, err := p.RegisterWebhook(context.Background(), testAccessToken, testRepoURL, "https://app.buildbuddy.io/webhooks/workflow/abc")
+
+	assert.True(t, status.IsPermissionDeniedError(err), "unexpected error %v", err)
+	assert.Contains(t, err.Error(), "Bitbucket API request failed")
+}
+
+func TestUnregisterWebhook(t *testing.T) {
+	p, api := newTestProvider(t, http.StatusNoContent, nil)
+
+	err := p.UnregisterWebhook(context.Background(), testAccessToken, testRepoURL, "{hook-uuid}")
+
+	require.NoError(t, err)
+	assert.Equal(t, "DELETE", api.method)
+	assert.Equal(t, "/repositories/buildbuddy/buildbuddy-ci-playground/hooks/{hook-uuid}", api.path)
+}
+
+func TestUnregisterWebhook_NotFound(t *testing.T) {
+	p, _ := newTestProvider(t, http.StatusNotFound, nil)
+
+	err := p.UnregisterWebhook(context.Background(), testAccessToken, testRepoURL, "{hook-uuid}")
+
+	assert.True(t, status.IsNotFoundError(err), "unexpected error %v", err)
+}
+
+func TestCreateStatus(t *testing.T) {
+	p, api := newTestProvider(t, http.StatusCreated, nil)
+
+	err := p.CreateStatus(context.Background(), testAccessToken, testRepoURL, "a4822151d5d2", &interfaces.CommitStatus{
+		State:       "failure",
+		Context:     "Test all targets",
+		TargetURL:   "https://app.buildbuddy.io/invocation/123",
+		Description: "Failed",
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, "POST", api.method)
+	assert.Equal(t, "/repositories/buildbuddy/buildbuddy-ci-playground/commit/a4822151d5d2/statuses/build", api.path)
+	assert.Equal(t, map[string]interface{}{
+		"key":         "Test all targets",
+		"name":        "Test all targets",
+		"state":       "FAILED",
+		"url":         "https://app.buildbuddy.io/invocation/123",
+		"description": "Failed",
+	}, api.body)
+}
+
+func TestCreateStatus_UnknownState(t *testing.T) {
+	p, api := newTestProvider(t, http.StatusCreated, nil)
+
+	err := p.CreateStatus(context.Background(), testAccessToken, testRepoURL, "a4822151d5d2", &interfaces.CommitStatus{State: "bogus"})
+
+	assert.True(t, status.IsInvalidArgumentError(err), "unexpected error %v", err)
+	assert.Empty(t, api.method)
+}
+
+func TestCreateStatus_Unauthenticated(t *testing.T) {
+	p, _ := newTestProvider(t, http.StatusUnauthorized, nil)
+
+	err := p.CreateStatus(context.Background(), testAccessToken, testRepoURL, "a4822151d5d2", &interfaces.CommitStatus{State: "success"})
+
+	assert.True(t, status.IsUnauthenticatedError(err), "unexpected error %v", err)
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/bitbucket"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/bitbucket/test_data"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -53,3 +54,62 @@ func TestParseRequest_ValidPullRequestEvent_Success(t *testing.T) {
 		SHA:          "a4822151d5d2",
 	}, data)
 }
+
+func TestParseRequest_UnexpectedUserAgent_Error(t *testing.T) {
+	req := webhookRequest(t, "repo:push", test_data.PushEvent)
+	req.Header.Set("User-Agent", "curl/7.64.1")
+
+	data, err := bitbucket.NewProvider().ParseWebhookData(req)
+
+	assert.True(t, status.IsUnimplementedError(err), "unexpected error %v", err)
+	assert.Nil(t, data)
+}
+
+func TestParseRequest_TagPushEvent_Ignored(t *testing.T) {
+	payload := `{
+		"push": {"changes": [{"new": {"type": "tag", "name": "v1.0", "target": {"hash": "f3307f36e35d1820c78b642cc8dfec6bf28a6230"}}}]},
+		"repository": {"links": {"html": {"href": "https://bitbucket.org/buildbuddy/buildbuddy-ci-playground"}}}
+	}`
+	req := webhookRequest(t, "repo:push", []byte(payload))
+
+	data, err := bitbucket.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+}
+
+func TestParseRequest_ForkPullRequestEvent_Untrusted(t *testing.T) {
+	payload := `{"pullrequest": {
+		"source": {
+			"branch": {"name": "feature"},
+			"commit": {"hash": "a4822151d5d2"},
+			"repository": {"uuid": "{fork}", "links": {"html": {"href": "https://bitbucket.org/someone/buildbuddy-ci-playground"}}}
+		},
+		"destination": {
+			"branch": {"name": "main"},
+			"repository": {"uuid": "{upstream}", "links": {"html": {"href": "https://bitbucket.org/buildbuddy/buildbuddy-ci-playground"}}}
+		}
+	}}`
+	req := webhookRequest(t, "pullrequest:created", []byte(payload))
+
+	data, err := bitbucket.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &interfaces.WebhookData{
+		EventName:    "pull_request",
+		PushedBranch: "feature",
+		TargetBranch: "main",
+		RepoURL:      "https://bitbucket.org/someone/buildbuddy-ci-playground",
+		IsTrusted:    false,
+		SHA:          "a4822151d5d2",
+	}, data)
+}
+
+func TestParseRequest_UnknownEvent_Ignored(t *testing.T) {
+	req := webhookRequest(t, "repo:fork", []byte(`{}`))
+
+	data, err := bitbucket.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+}
@@ -83,6 +83,25 @@ func (*githubGitProvider) UnregisterWebhook(ctx context.Context, accessToken, re
 	return nil
 }
 
+// CreateStatus creates a commit status on the repo.
+func (*githubGitProvider) CreateStatus(ctx context.Context, accessToken, repoURL, commitSHA string, cs *interfaces.CommitStatus) error {
+	owner, repo, err := parseOwnerRepo(repoURL)
+	if err != nil {
+		return err
+	}
+	client := newGitHubClient(ctx, accessToken)
+	_, _, err = client.Repositories.CreateStatus(ctx, owner, repo, commitSHA, &gh.RepoStatus{
+		State:       &cs.State,
+		TargetURL:   &cs.TargetURL,
+		Description: &cs.Description,
+		Context:     &cs.Context,
+	})
+	if err != nil {
+		return gitHubErrorToStatus(err)
+	}
+	return nil
+}
+
 func gitHubErrorToStatus(err error) error {
 	return status.InternalErrorf("%s", err)
 }
@@ -0,0 +1,261 @@
+package gitlab
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/fieldgetter"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_data"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_util"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	gitutil "github.com/buildbuddy-io/buildbuddy/server/util/git"
+)
+
+const (
+	// The "after" SHA of pushes which delete a branch.
+	zeroSHA = "0000000000000000000000000000000000000000"
+)
+
+var (
+	gitlabURL = flag.String("gitlab.url", "https://gitlab.com", "The URL of the GitLab instance hosting workflow repos, for use with self-managed GitLab. ** Enterprise only **")
+
+	// GitLab commit status states, by commit status state.
+	commitStatusStates = map[string]string{
+		"pending": "running",
+		"success": "success",
+		"failure": "failed",
+		"error":   "failed",
+	}
+)
+
+type gitlabGitProvider struct {
+	// host is the host of the GitLab instance, like "gitlab.com".
+	host string
+	// apiBaseURL is the URL of the instance's REST API, ending with a slash.
+	apiBaseURL string
+}
+
+func NewProvider() interfaces.GitProvider {
+	baseURL := strings.TrimSuffix(*gitlabURL, "/")
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		log.Printf("Invalid gitlab.url %q: %s", baseURL, err)
+		u = &url.URL{}
+	}
+	return &gitlabGitProvider{
+		host:       u.Host,
+		apiBaseURL: baseURL + "/api/v4/",
+	}
+}
+
+func (*gitlabGitProvider) ParseWebhookData(r *http.Request) (*interfaces.WebhookData, error) {
+	switch eventName := r.Header.Get("X-Gitlab-Event"); eventName {
+	case "Push Hook":
+		payload := &PushEventPayload{}
+		if err := webhook_util.UnmarshalBody(r, payload); err != nil {
+			return nil, status.InvalidArgumentErrorf("failed to unmarshal push event payload: %s", err)
+		}
+		v, err := fieldgetter.ExtractValues(
+			payload,
+			"After",
+			"Ref",
+			"Project.GitHTTPURL",
+		)
+		if err != nil {
+			return nil, err
+		}
+		if v["After"] == zeroSHA {
+			log.Printf("Ignoring push event for deleted branch %q", v["Ref"])
+			return nil, nil
+		}
+		branch := strings.TrimPrefix(v["Ref"], "refs/heads/")
+		return &interfaces.WebhookData{
+			EventName:    webhook_data.EventName.Push,
+			PushedBranch: branch,
+			TargetBranch: branch,
+			RepoURL:      v["Project.GitHTTPURL"],
+			// The push handler will not receive events from forked repositories,
+			// so if a commit was pushed to this repo then it is trusted.
+			IsTrusted: true,
+			SHA:       v["After"],
+		}, nil
+	case "Merge Request Hook":
+		payload := &MergeRequestEventPayload{}
+		if err := webhook_util.UnmarshalBody(r, payload); err != nil {
+			return nil, status.InvalidArgumentErrorf("failed to unmarshal %q event payload: %s", eventName, err)
+		}
+		v, err := fieldgetter.ExtractValues(
+			payload,
+			"ObjectAttributes.Action",
+			"ObjectAttributes.SourceBranch",
+			"ObjectAttributes.TargetBranch",
+			"ObjectAttributes.LastCommit.ID",
+			"ObjectAttributes.Source.GitHTTPURL",
+			"ObjectAttributes.SourceProjectID",
+			"ObjectAttributes.TargetProjectID",
+		)
+		if err != nil {
+			return nil, err
+		}
+		// Only build when the MR is opened or pushed to. Other updates, such as
+		// changes to the title, don't set oldrev.
+		action := v["ObjectAttributes.Action"]
+		if !(action == "open" || action == "reopen" || (action == "update" && payload.ObjectAttributes.OldRev != "")) {
+			return nil, nil
+		}
+		isFork := v["ObjectAttributes.SourceProjectID"] != v["ObjectAttributes.TargetProjectID"]
+		return &interfaces.WebhookData{
+			EventName:    webhook_data.EventName.PullRequest,
+			PushedBranch: v["ObjectAttributes.SourceBranch"],
+			TargetBranch: v["ObjectAttributes.TargetBranch"],
+			RepoURL:      v["ObjectAttributes.Source.GitHTTPURL"],
+			IsTrusted:    !isFork,
+			SHA:          v["ObjectAttributes.LastCommit.ID"],
+		}, nil
+	default:
+		log.Printf("Ignoring webhook event: %s", eventName)
+		return nil, nil
+	}
+}
+
+func (p *gitlabGitProvider) MatchRepoURL(u *url.URL) bool {
+	return p.host != "" && u.Host == p.host
+}
+
+func (*gitlabGitProvider) MatchWebhookRequest(r *http.Request) bool {
+	return r.Header.Get("X-Gitlab-Event") != ""
+}
+
+// RegisterWebhook registers the given webhook to the project and returns the
+// ID of the registered webhook.
+func (p *gitlabGitProvider) RegisterWebhook(ctx context.Context, accessToken, repoURL, webhookURL string) (string, error) {
+	projectPath, err := projectPath(repoURL)
+	if err != nil {
+		return "", err
+	}
+	hook := &ProjectHook{
+		URL:                 webhookURL,
+		PushEvents:          true,
+		MergeRequestsEvents: true,
+	}
+	created := &ProjectHook{}
+	if err := p.apiRequest(ctx, "POST", accessToken, projectPath+"/hooks", hook, created); err != nil {
+		return "", err
+	}
+	if created.ID == 0 {
+		return "", status.UnknownError("GitLab returned invalid response from hooks API (missing id field).")
+	}
+	return fmt.Sprintf("%d", created.ID), nil
+}
+
+// UnregisterWebhook removes the webhook from the project.
+func (p *gitlabGitProvider) UnregisterWebhook(ctx context.Context, accessToken, repoURL, webhookID string) error {
+	projectPath, err := projectPath(repoURL)
+	if err != nil {
+		return err
+	}
+	return p.apiRequest(ctx, "DELETE", accessToken, projectPath+"/hooks/"+url.PathEscape(webhookID), nil, nil)
+}
+
+// CreateStatus creates a commit status for the commit.
+func (p *gitlabGitProvider) CreateStatus(ctx context.Context, accessToken, repoURL, commitSHA string, cs *interfaces.CommitStatus) error {
+	projectPath, err := projectPath(repoURL)
+	if err != nil {
+		return err
+	}
+	state, ok := commitStatusStates[cs.State]
+	if !ok {
+		return status.InvalidArgumentErrorf("unknown commit status state %q", cs.State)
+	}
+	commitStatus := &CommitStatus{
+		State:       state,
+		Name:        cs.Context,
+		TargetURL:   cs.TargetURL,
+		Description: cs.Description,
+	}
+	return p.apiRequest(ctx, "POST", accessToken, projectPath+"/statuses/"+commitSHA, commitStatus, nil)
+}
+
+// projectPath returns the path of the project in the API, like
+// "projects/group%2Fproject". Projects may be nested in subgroups, so the
+// whole path after the host identifies the project.
+func projectPath(repoURL string) (string, error) {
+	path, err := gitutil.OwnerRepoFromRepoURL(repoURL)
+	if err != nil {
+		return "", status.WrapError(err, "Failed to parse project path from GitLab URL")
+	}
+	if !strings.Contains(path, "/") {
+		return "", status.InvalidArgumentErrorf("Invalid GitLab project path %q", path)
+	}
+	return "projects/" + url.QueryEscape(path), nil
+}
+
+// apiRequest sends a request to the GitLab API. See webhook_util.APIRequest.
+func (p *gitlabGitProvider) apiRequest(ctx context.Context, method, accessToken, path string, body, rsp interface{}) error {
+	return webhook_util.APIRequest(ctx, "GitLab", method, p.apiBaseURL+path, accessToken, body, rsp)
+}
+
+// PushEventPayload represents a subset of GitLab's Push event schema.
+// See https://docs.gitlab.com/ee/user/project/integrations/webhook_events.html#push-events
+type PushEventPayload struct {
+	// After is the SHA of the branch's head after the push.
+	After   string   `json:"after"`
+	Ref     string   `json:"ref"`
+	Project *Project `json:"project"`
+}
+
+// MergeRequestEventPayload represents a subset of GitLab's Merge request
+// event schema.
+// See https://docs.gitlab.com/ee/user/project/integrations/webhook_events.html#merge-request-events
+type MergeRequestEventPayload struct {
+	ObjectAttributes *MergeRequestAttributes `json:"object_attributes"`
+	Project          *Project                `json:"project"`
+}
+type MergeRequestAttributes struct {
+	Action          string      `json:"action"`
+	SourceBranch    string      `json:"source_branch"`
+	TargetBranch    string      `json:"target_branch"`
+	SourceProjectID int64       `json:"source_project_id"`
+	TargetProjectID int64       `json:"target_project_id"`
+	Source          *Project    `json:"source"`
+	Target          *Project    `json:"target"`
+	LastCommit      *CommitInfo `json:"last_commit"`
+	// OldRev is the SHA of the source branch's previous head, which is only
+	// set for updates that pushed commits.
+	OldRev string `json:"oldrev"`
+}
+
+// Project represents a subset of GitLab's Project schema, which is a common
+// entity used in multiple webhook events.
+type Project struct {
+	WebURL     string `json:"web_url"`
+	GitHTTPURL string `json:"git_http_url"`
+}
+type CommitInfo struct {
+	ID string `json:"id"`
+}
+
+// ProjectHook represents a subset of GitLab's Project hook schema.
+// See https://docs.gitlab.com/ee/api/projects.html#add-project-hook
+type ProjectHook struct {
+	ID                  int64  `json:"id,omitempty"`
+	URL                 string `json:"url"`
+	PushEvents          bool   `json:"push_events"`
+	MergeRequestsEvents bool   `json:"merge_requests_events"`
+}
+
+// CommitStatus represents GitLab's Commit status schema.
+// See https://docs.gitlab.com/ee/api/commits.html#post-the-build-status-to-a-commit
+type CommitStatus struct {
+	State       string `json:"state"`
+	Name        string `json:"name"`
+	TargetURL   string `json:"target_url"`
+	Description string `json:"description"`
+}
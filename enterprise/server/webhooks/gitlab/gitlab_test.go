@@ -0,0 +1,146 @@
+package gitlab_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/gitlab"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/gitlab/test_data"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func webhookRequest(t *testing.T, eventType string, payload []byte) *http.Request {
+	req, err := http.NewRequest("POST", "https://buildbuddy.io/webhooks/foo", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Gitlab-Event", eventType)
+	req.Header.Add("Content-Type", "application/json")
+	return req
+}
+
+func TestParseRequest_ValidPushEvent_Success(t *testing.T) {
+	req := webhookRequest(t, "Push Hook", test_data.PushEvent)
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &interfaces.WebhookData{
+		EventName:    "push",
+		PushedBranch: "main",
+		TargetBranch: "main",
+		RepoURL:      "https://gitlab.com/buildbuddy/buildbuddy-ci-playground.git",
+		IsTrusted:    true,
+		SHA:          "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+	}, data)
+}
+
+func TestParseRequest_BranchDeletedPushEvent_Ignored(t *testing.T) {
+	payload := strings.Replace(string(test_data.PushEvent), `"after":"da1560886d4f094c3e6c9ef40349f7d38b5d27d7"`, `"after":"0000000000000000000000000000000000000000"`, 1)
+	req := webhookRequest(t, "Push Hook", []byte(payload))
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+}
+
+func TestParseRequest_ValidMergeRequestEvent_Success(t *testing.T) {
+	req := webhookRequest(t, "Merge Request Hook", test_data.MergeRequestEvent)
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &interfaces.WebhookData{
+		EventName:    "pull_request",
+		PushedBranch: "test-1623352780",
+		TargetBranch: "main",
+		RepoURL:      "https://gitlab.com/buildbuddy/buildbuddy-ci-playground.git",
+		IsTrusted:    true,
+		SHA:          "7c5a3e1d2b64f2de5a1fbd7eb0b4a4b7e6dc9e50",
+	}, data)
+}
+
+func TestParseRequest_MergeRequestUpdateWithoutPush_Ignored(t *testing.T) {
+	payload := strings.Replace(string(test_data.MergeRequestEvent), `"oldrev":"3b5c1f6f0d1c2b64a9b8d8f1c0e5a6b7c8d9e0f1"`, `"oldrev":""`, 1)
+	req := webhookRequest(t, "Merge Request Hook", []byte(payload))
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+}
+
+func setFlag(t *testing.T, name, value string) {
+	original := flag.Lookup(name).Value.String()
+	require.NoError(t, flag.Set(name, value))
+	t.Cleanup(func() {
+		flag.Set(name, original)
+	})
+}
+
+func TestMatchRepoURL(t *testing.T) {
+	p := gitlab.NewProvider()
+	assert.True(t, p.MatchRepoURL(&url.URL{Scheme: "https", Host: "gitlab.com", Path: "/buildbuddy/buildbuddy-ci-playground"}))
+	assert.False(t, p.MatchRepoURL(&url.URL{Scheme: "https", Host: "gitlab.example.com", Path: "/buildbuddy/buildbuddy-ci-playground"}))
+
+	setFlag(t, "gitlab.url", "https://gitlab.example.com/")
+	p = gitlab.NewProvider()
+	assert.True(t, p.MatchRepoURL(&url.URL{Scheme: "https", Host: "gitlab.example.com", Path: "/buildbuddy/buildbuddy-ci-playground"}))
+	assert.False(t, p.MatchRepoURL(&url.URL{Scheme: "https", Host: "gitlab.com", Path: "/buildbuddy/buildbuddy-ci-playground"}))
+}
+
+func TestRegisterWebhook_ConfiguredURL(t *testing.T) {
+	var method, path string
+	var hook map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.EscapedPath()
+		assert.Equal(t, "Bearer TOKEN", r.Header.Get("Authorization"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&hook))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id": 42}`))
+	}))
+	defer server.Close()
+	setFlag(t, "gitlab.url", server.URL)
+
+	id, err := gitlab.NewProvider().RegisterWebhook(context.Background(), "TOKEN", server.URL+"/buildbuddy/buildbuddy-ci-playground.git", "https://app.buildbuddy.io/webhooks/workflow/abc")
+
+	require.NoError(t, err)
+	assert.Equal(t, "42", id)
+	assert.Equal(t, "POST", method)
+	assert.Equal(t, "/api/v4/projects/buildbuddy%2Fbuildbuddy-ci-playground/hooks", path)
+	assert.Equal(t, "https://app.buildbuddy.io/webhooks/workflow/abc", hook["url"])
+	assert.Equal(t, true, hook["push_events"])
+	assert.Equal(t, true, hook["merge_requests_events"])
+}
+
+func TestCreateStatus_ConfiguredURL(t *testing.T) {
+	var path string
+	var commitStatus map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.EscapedPath()
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&commitStatus))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	setFlag(t, "gitlab.url", server.URL)
+
+	err := gitlab.NewProvider().CreateStatus(context.Background(), "TOKEN", server.URL+"/buildbuddy/buildbuddy-ci-playground.git", "da1560886d4f", &interfaces.CommitStatus{
+		State:   "pending",
+		Context: "Test all targets",
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, "/api/v4/projects/buildbuddy%2Fbuildbuddy-ci-playground/statuses/da1560886d4f", path)
+	assert.Equal(t, "running", commitStatus["state"])
+	assert.Equal(t, "Test all targets", commitStatus["name"])
+}
@@ -0,0 +1,9 @@
+package test_data
+
+import _ "embed"
+
+//go:embed push_event.txt
+var PushEvent []byte
+
+//go:embed merge_request_event.txt
+var MergeRequestEvent []byte
@@ -0,0 +1,74 @@
+package webhook_util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+// APIRequest sends a request to the REST API of a Git provider, with the
+// JSON-encoded body if it's not nil, and decodes the JSON response into rsp if
+// it's not nil. providerName is used in error messages, like "GitLab".
+func APIRequest(ctx context.Context, providerName, method, url, accessToken string, body, rsp interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return status.UnavailableErrorf("%s API request failed: %s", providerName, err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return status.UnavailableErrorf("failed to read %s API response: %s", providerName, err)
+	}
+	if res.StatusCode >= 300 {
+		return HTTPErrorToStatus(res.StatusCode, "%s API request failed: %s: %s", providerName, res.Status, b)
+	}
+	if rsp == nil {
+		return nil
+	}
+	return json.Unmarshal(b, rsp)
+}
+
+// HTTPErrorToStatus returns an error with the status matching the HTTP status
+// code.
+func HTTPErrorToStatus(code int, format string, args ...interface{}) error {
+	switch code {
+	case http.StatusUnauthorized:
+		return status.UnauthenticatedErrorf(format, args...)
+	case http.StatusForbidden:
+		return status.PermissionDeniedErrorf(format, args...)
+	case http.StatusNotFound:
+		return status.NotFoundErrorf(format, args...)
+	default:
+		return status.UnknownErrorf(format, args...)
+	}
+}
+
+// UnmarshalBody decodes the JSON body of the webhook request into payload.
+func UnmarshalBody(r *http.Request, payload interface{}) error {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, payload)
+}
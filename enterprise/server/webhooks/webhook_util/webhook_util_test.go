@@ -0,0 +1,85 @@
+package webhook_util_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_util"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type payload struct {
+	Name string `json:"name"`
+}
+
+func TestAPIRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/things", r.URL.Path)
+		assert.Equal(t, "Bearer TOKEN", r.Header.Get("Authorization"))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"name": "request"}`, string(b))
+		json.NewEncoder(w).Encode(&payload{Name: "response"})
+	}))
+	defer server.Close()
+
+	rsp := &payload{}
+	err := webhook_util.APIRequest(context.Background(), "Test", "POST", server.URL+"/things", "TOKEN", &payload{Name: "request"}, rsp)
+
+	require.NoError(t, err)
+	assert.Equal(t, "response", rsp.Name)
+}
+
+func TestAPIRequest_NoBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "DELETE", r.Method)
+		assert.Empty(t, r.Header.Get("Content-Type"))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	err := webhook_util.APIRequest(context.Background(), "Test", "DELETE", server.URL+"/things/1", "TOKEN", nil, nil)
+
+	require.NoError(t, err)
+}
+
+func TestAPIRequest_HTTPErrors(t *testing.T) {
+	for _, test := range []struct {
+		code    int
+		isError func(error) bool
+	}{
+		{http.StatusUnauthorized, status.IsUnauthenticatedError},
+		{http.StatusForbidden, status.IsPermissionDeniedError},
+		{http.StatusNotFound, status.IsNotFoundError},
+		{http.StatusInternalServerError, status.IsUnknownError},
+		{http.StatusMultipleChoices, status.IsUnknownError},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "some details", test.code)
+		}))
+
+		err := webhook_util.APIRequest(context.Background(), "Test", "GET", server.URL, "TOKEN", nil, &payload{})
+
+		assert.True(t, test.isError(err), "HTTP %d: unexpected error %v", test.code, err)
+		assert.Contains(t, err.Error(), "Test API request failed")
+		assert.Contains(t, err.Error(), "some details")
+		server.Close()
+	}
+}
+
+func TestAPIRequest_Unavailable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	err := webhook_util.APIRequest(context.Background(), "Test", "GET", server.URL, "TOKEN", nil, nil)
+
+	assert.True(t, status.IsUnavailableError(err), "unexpected error %v", err)
+}
@@ -0,0 +1,273 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"golang.org/x/oauth2"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	uidpb "github.com/buildbuddy-io/buildbuddy/proto/user_id"
+	wfpb "github.com/buildbuddy-io/buildbuddy/proto/workflow"
+	gitutil "github.com/buildbuddy-io/buildbuddy/server/util/git"
+	githubapi "github.com/google/go-github/github"
+)
+
+const (
+	// The maximum number of commits that can be bisected. This is the number
+	// of commits that GitHub returns when comparing two commits.
+	maxBisectCommits = 250
+
+	// How often to check whether a bisect step's invocation has completed.
+	bisectStepPollInterval = 10 * time.Second
+
+	// How long a single bisect step may take before the bisect is given up.
+	bisectStepTimeout = 3 * time.Hour
+)
+
+// bisectTag returns the tag attached to the invocations run by a bisect.
+func bisectTag(bisectID string) string {
+	return "bisect-" + strings.ToLower(bisectID)
+}
+
+// StartBisect starts searching for the first commit between a good and a bad
+// commit at which a workflow action fails. The action is run at one commit at
+// a time, halving the range of candidate commits with each run.
+func (ws *workflowService) StartBisect(ctx context.Context, req *wfpb.StartBisectRequest) (*wfpb.StartBisectResponse, error) {
+	if req.GetWorkflowId() == "" {
+		return nil, status.InvalidArgumentError("Missing workflow_id")
+	}
+	if req.GetActionName() == "" {
+		return nil, status.InvalidArgumentError("Missing action_name")
+	}
+	if req.GetBranch() == "" {
+		return nil, status.InvalidArgumentError("Missing branch")
+	}
+	if req.GetGoodCommitSha() == "" || req.GetBadCommitSha() == "" {
+		return nil, status.InvalidArgumentError("Missing good_commit_sha or bad_commit_sha")
+	}
+	if err := ws.checkStartWorkflowPreconditions(ctx); err != nil {
+		return nil, err
+	}
+	wf, err := ws.lookupWorkflowForRead(ctx, req.GetWorkflowId())
+	if err != nil {
+		return nil, err
+	}
+	commits, err := listCommitsBetween(ctx, wf, req.GetGoodCommitSha(), req.GetBadCommitSha())
+	if err != nil {
+		return nil, err
+	}
+	key, err := ws.apiKeyForWorkflow(ctx, wf)
+	if err != nil {
+		return nil, err
+	}
+
+	bisectID, err := tables.PrimaryKeyForTable("WorkflowBisects")
+	if err != nil {
+		return nil, status.InternalError(err.Error())
+	}
+	permissions := perms.GroupAuthPermissions(wf.GroupID)
+	b := &tables.WorkflowBisect{
+		BisectID:      bisectID,
+		WorkflowID:    wf.WorkflowID,
+		UserID:        permissions.UserID,
+		GroupID:       permissions.GroupID,
+		Perms:         permissions.Perms,
+		ActionName:    req.GetActionName(),
+		Branch:        req.GetBranch(),
+		GoodCommitSHA: req.GetGoodCommitSha(),
+		BadCommitSHA:  req.GetBadCommitSha(),
+		Status:        int64(wfpb.Bisect_RUNNING),
+	}
+	if err := ws.env.GetDBHandle().Create(b).Error; err != nil {
+		return nil, err
+	}
+
+	// The bisect outlives the request, so it runs with the workflow's own
+	// credentials, as workflows triggered by webhooks do.
+	bisectCtx := ws.env.GetAuthenticator().AuthContextFromAPIKey(ws.bgCtx, key.Value)
+	go ws.runBisect(bisectCtx, b, wf, commits)
+
+	return &wfpb.StartBisectResponse{BisectId: bisectID}, nil
+}
+
+// listCommitsBetween returns the commits after the good commit up to and
+// including the bad commit, oldest first.
+func listCommitsBetween(ctx context.Context, wf *tables.Workflow, good, bad string) ([]string, error) {
+	if !isGitHubURL(wf.RepoURL) {
+		return nil, status.UnimplementedError("Bisecting is only supported for GitHub repos")
+	}
+	ownerRepo, err := gitutil.OwnerRepoFromRepoURL(wf.RepoURL)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(ownerRepo, "/", 2)
+	if len(parts) != 2 {
+		return nil, status.InvalidArgumentErrorf("Invalid GitHub repo URL %q", wf.RepoURL)
+	}
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: wf.AccessToken})
+	client := githubapi.NewClient(oauth2.NewClient(ctx, ts))
+	cmp, _, err := client.Repositories.CompareCommits(ctx, parts[0], parts[1], good, bad)
+	if err != nil {
+		return nil, status.UnavailableErrorf("Failed to compare commits %q and %q: %s", good, bad, err)
+	}
+	if cmp.GetStatus() != "ahead" {
+		return nil, status.InvalidArgumentErrorf("Commit %q is not a descendant of commit %q", bad, good)
+	}
+	if cmp.GetTotalCommits() > maxBisectCommits || len(cmp.Commits) < cmp.GetTotalCommits() {
+		return nil, status.InvalidArgumentErrorf("Cannot bisect more than %d commits", maxBisectCommits)
+	}
+	commits := make([]string, 0, len(cmp.Commits))
+	for _, c := range cmp.Commits {
+		commits = append(commits, c.GetSHA())
+	}
+	return commits, nil
+}
+
+// runBisect runs the bisect to completion, recording its outcome.
+func (ws *workflowService) runBisect(ctx context.Context, b *tables.WorkflowBisect, wf *tables.Workflow, commits []string) {
+	// The bad commit is known to fail, so the first failing commit is the
+	// first commit after the last passing one. Commits before lo pass and
+	// commits from hi on fail.
+	lo, hi := -1, len(commits)-1
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		passed, err := ws.runBisectStep(ctx, b, wf, commits[mid])
+		if err != nil {
+			log.Warningf("Bisect %q failed at commit %q: %s", b.BisectID, commits[mid], err)
+			ws.finishBisect(b, wfpb.Bisect_ERROR, "", err.Error())
+			return
+		}
+		if passed {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	ws.finishBisect(b, wfpb.Bisect_DONE, commits[hi], "")
+}
+
+// runBisectStep runs the bisected action at the given commit and returns
+// whether it passed.
+func (ws *workflowService) runBisectStep(ctx context.Context, b *tables.WorkflowBisect, wf *tables.Workflow, commitSHA string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, bisectStepTimeout)
+	defer cancel()
+
+	iid, err := ws.runWorkflowAction(ctx, wf, b.ActionName, b.Branch, commitSHA)
+	if err != nil {
+		return false, err
+	}
+	if err := ws.env.GetInvocationDB().AddInvocationTags(ctx, iid, []string{bisectTag(b.BisectID)}); err != nil {
+		return false, err
+	}
+	for {
+		ti, err := ws.env.GetInvocationDB().LookupInvocation(ctx, iid)
+		if err != nil {
+			return false, err
+		}
+		switch inpb.Invocation_InvocationStatus(ti.InvocationStatus) {
+		case inpb.Invocation_COMPLETE_INVOCATION_STATUS:
+			return ti.Success, nil
+		case inpb.Invocation_DISCONNECTED_INVOCATION_STATUS:
+			return false, status.UnavailableErrorf("Invocation %q disconnected before completing", iid)
+		}
+		select {
+		case <-ctx.Done():
+			return false, status.DeadlineExceededErrorf("Invocation %q did not complete: %s", iid, ctx.Err())
+		case <-time.After(bisectStepPollInterval):
+		}
+	}
+}
+
+func (ws *workflowService) finishBisect(b *tables.WorkflowBisect, s wfpb.Bisect_Status, firstFailingCommitSHA, errMsg string) {
+	err := ws.env.GetDBHandle().Model(b).Where("bisect_id = ?", b.BisectID).Updates(map[string]interface{}{
+		"status":                   int64(s),
+		"first_failing_commit_sha": firstFailingCommitSHA,
+		"error":                    errMsg,
+	}).Error
+	if err != nil {
+		log.Errorf("Failed to record outcome of bisect %q: %s", b.BisectID, err)
+	}
+}
+
+// GetBisect returns the progress of a bisect, including each of the runs of
+// the bisected action so far.
+func (ws *workflowService) GetBisect(ctx context.Context, req *wfpb.GetBisectRequest) (*wfpb.GetBisectResponse, error) {
+	if req.GetBisectId() == "" {
+		return nil, status.InvalidArgumentError("Missing bisect_id")
+	}
+	if err := ws.checkPreconditions(ctx); err != nil {
+		return nil, err
+	}
+	user, err := perms.AuthenticatedUser(ctx, ws.env)
+	if err != nil {
+		return nil, err
+	}
+	b := &tables.WorkflowBisect{}
+	if err := ws.env.GetDBHandle().Raw(`SELECT * FROM WorkflowBisects WHERE bisect_id = ?`, req.GetBisectId()).Take(b).Error; err != nil {
+		if db.IsRecordNotFound(err) {
+			return nil, status.NotFoundError("Bisect not found")
+		}
+		return nil, err
+	}
+	acl := perms.ToACLProto(&uidpb.UserId{Id: b.UserID}, b.GroupID, b.Perms)
+	if err := perms.AuthorizeRead(&user, acl); err != nil {
+		return nil, err
+	}
+
+	rows, err := ws.env.GetDBHandle().Raw(`
+		SELECT i.* FROM Invocations AS i
+		JOIN InvocationTags AS t ON t.invocation_id = i.invocation_id
+		WHERE t.tag = ? AND i.group_id = ?
+		ORDER BY i.created_at_usec ASC`, bisectTag(b.BisectID), b.GroupID).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	bisect := &wfpb.Bisect{
+		BisectId:              b.BisectID,
+		WorkflowId:            b.WorkflowID,
+		ActionName:            b.ActionName,
+		Branch:                b.Branch,
+		GoodCommitSha:         b.GoodCommitSHA,
+		BadCommitSha:          b.BadCommitSHA,
+		Status:                wfpb.Bisect_Status(b.Status),
+		FirstFailingCommitSha: b.FirstFailingCommitSHA,
+		Error:                 b.Error,
+	}
+	for rows.Next() {
+		ti := &tables.Invocation{}
+		if err := ws.env.GetDBHandle().ScanRows(rows, ti); err != nil {
+			return nil, err
+		}
+		bisect.Step = append(bisect.Step, &wfpb.BisectStep{
+			CommitSha:    ti.CommitSHA,
+			InvocationId: ti.InvocationID,
+			Result:       bisectStepResult(ti),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return &wfpb.GetBisectResponse{Bisect: bisect}, nil
+}
+
+func bisectStepResult(ti *tables.Invocation) wfpb.BisectStep_Result {
+	switch inpb.Invocation_InvocationStatus(ti.InvocationStatus) {
+	case inpb.Invocation_COMPLETE_INVOCATION_STATUS:
+		if ti.Success {
+			return wfpb.BisectStep_PASSED
+		}
+		return wfpb.BisectStep_FAILED
+	case inpb.Invocation_DISCONNECTED_INVOCATION_STATUS:
+		return wfpb.BisectStep_FAILED
+	default:
+		return wfpb.BisectStep_RUNNING
+	}
+}
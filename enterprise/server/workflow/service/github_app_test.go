@@ -0,0 +1,37 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitHubAppWorkflowsOfLinkedGroupOnly(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	ws := NewWorkflowService(te)
+	ctx := context.Background()
+	for _, row := range []interface{}{
+		&tables.GitHubAppInstallation{InstallationID: 42, GroupID: "GROUP1"},
+		&tables.Workflow{WorkflowID: "WF1", GroupID: "GROUP1", RepoURL: "https://github.com/owner/repo", WebhookID: "1", GithubAppInstallationID: 42},
+		&tables.Workflow{WorkflowID: "WF2", GroupID: "GROUP1", RepoURL: "https://github.com/owner/other-repo", WebhookID: "2", GithubAppInstallationID: 42},
+		// Another group's workflow for the same repo and installation, which
+		// was created without linking the installation.
+		&tables.Workflow{WorkflowID: "WF3", GroupID: "GROUP2", RepoURL: "https://github.com/owner/repo", WebhookID: "3", GithubAppInstallationID: 42},
+		&tables.Workflow{WorkflowID: "WF4", GroupID: "GROUP1", RepoURL: "https://github.com/owner/repo", WebhookID: "4"},
+	} {
+		require.NoError(t, te.GetDBHandle().Create(row).Error)
+	}
+
+	workflows, err := ws.gitHubAppWorkflows(ctx, 42, "https://github.com/Owner/Repo")
+	require.NoError(t, err)
+	require.Len(t, workflows, 1)
+	assert.Equal(t, "WF1", workflows[0].WorkflowID)
+
+	workflows, err = ws.gitHubAppWorkflows(ctx, 7, "https://github.com/owner/repo")
+	require.NoError(t, err)
+	assert.Empty(t, workflows)
+}
@@ -0,0 +1,298 @@
+package service
+
+import (
+	"context"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/cron"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	uidpb "github.com/buildbuddy-io/buildbuddy/proto/user_id"
+	wfpb "github.com/buildbuddy-io/buildbuddy/proto/workflow"
+)
+
+const (
+	// How often to check for scheduled runs that are due. This is the
+	// granularity of cron schedules.
+	scheduleCheckInterval = 1 * time.Minute
+
+	// Maximum number of scheduled runs started by a single check, so that a
+	// large backlog is worked off gradually.
+	maxScheduledRunsPerCheck = 100
+)
+
+// scheduleTag returns the tag attached to the invocations run by a schedule.
+func scheduleTag(scheduleID string) string {
+	return "schedule-" + strings.ToLower(scheduleID)
+}
+
+// nextRunUsec returns when the schedule next runs after t.
+func nextRunUsec(s *cron.Schedule, t time.Time) int64 {
+	next := s.Next(t)
+	if next.IsZero() {
+		return math.MaxInt64
+	}
+	return timeutil.ToUsec(next)
+}
+
+func (ws *workflowService) CreateWorkflowSchedule(ctx context.Context, req *wfpb.CreateWorkflowScheduleRequest) (*wfpb.CreateWorkflowScheduleResponse, error) {
+	if err := ws.checkPreconditions(ctx); err != nil {
+		return nil, err
+	}
+	s := req.GetSchedule()
+	if s.GetWorkflowId() == "" {
+		return nil, status.InvalidArgumentError("Missing workflow_id")
+	}
+	if s.GetActionName() == "" {
+		return nil, status.InvalidArgumentError("Missing action_name")
+	}
+	if s.GetBranch() == "" {
+		return nil, status.InvalidArgumentError("Missing branch")
+	}
+	sched, err := cron.Parse(s.GetCronSpec())
+	if err != nil {
+		return nil, err
+	}
+	next := nextRunUsec(sched, time.Now().UTC())
+	if next == math.MaxInt64 {
+		return nil, status.InvalidArgumentErrorf("cron schedule %q never runs", s.GetCronSpec())
+	}
+	wf, err := ws.lookupWorkflowForRead(ctx, s.GetWorkflowId())
+	if err != nil {
+		return nil, err
+	}
+
+	scheduleID, err := tables.PrimaryKeyForTable("WorkflowSchedules")
+	if err != nil {
+		return nil, status.InternalError(err.Error())
+	}
+	permissions := perms.GroupAuthPermissions(wf.GroupID)
+	row := &tables.WorkflowSchedule{
+		ScheduleID:        scheduleID,
+		WorkflowID:        wf.WorkflowID,
+		UserID:            permissions.UserID,
+		GroupID:           permissions.GroupID,
+		Perms:             permissions.Perms,
+		ActionName:        s.GetActionName(),
+		Branch:            s.GetBranch(),
+		CronSpec:          s.GetCronSpec(),
+		ConcurrencyPolicy: int64(s.GetConcurrencyPolicy()),
+		NextRunUsec:       next,
+	}
+	if err := ws.env.GetDBHandle().Create(row).Error; err != nil {
+		return nil, err
+	}
+	return &wfpb.CreateWorkflowScheduleResponse{Schedule: scheduleToProto(row)}, nil
+}
+
+func (ws *workflowService) DeleteWorkflowSchedule(ctx context.Context, req *wfpb.DeleteWorkflowScheduleRequest) (*wfpb.DeleteWorkflowScheduleResponse, error) {
+	if err := ws.checkPreconditions(ctx); err != nil {
+		return nil, err
+	}
+	if req.GetScheduleId() == "" {
+		return nil, status.InvalidArgumentError("Missing schedule_id")
+	}
+	user, err := perms.AuthenticatedUser(ctx, ws.env)
+	if err != nil {
+		return nil, err
+	}
+	err = ws.env.GetDBHandle().Transaction(ctx, func(tx *db.DB) error {
+		row := &tables.WorkflowSchedule{}
+		if err := tx.Raw(`SELECT * FROM WorkflowSchedules WHERE schedule_id = ?`, req.GetScheduleId()).Take(row).Error; err != nil {
+			if db.IsRecordNotFound(err) {
+				return status.NotFoundError("Schedule not found")
+			}
+			return err
+		}
+		acl := perms.ToACLProto(&uidpb.UserId{Id: row.UserID}, row.GroupID, row.Perms)
+		if err := perms.AuthorizeWrite(&user, acl); err != nil {
+			return err
+		}
+		return tx.Exec(`DELETE FROM WorkflowSchedules WHERE schedule_id = ?`, req.GetScheduleId()).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &wfpb.DeleteWorkflowScheduleResponse{}, nil
+}
+
+func (ws *workflowService) GetWorkflowSchedules(ctx context.Context, req *wfpb.GetWorkflowSchedulesRequest) (*wfpb.GetWorkflowSchedulesResponse, error) {
+	if err := ws.checkPreconditions(ctx); err != nil {
+		return nil, err
+	}
+	groupID, err := perms.AuthenticateSelectedGroupID(ctx, ws.env, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+
+	q := query_builder.NewQuery(`SELECT * FROM WorkflowSchedules`)
+	q.AddWhereClause(`group_id = ?`, groupID)
+	if req.GetWorkflowId() != "" {
+		q.AddWhereClause(`workflow_id = ?`, req.GetWorkflowId())
+	}
+	if err := perms.AddPermissionsCheckToQuery(ctx, ws.env, q); err != nil {
+		return nil, err
+	}
+	q.SetOrderBy("created_at_usec" /*ascending=*/, true)
+	qStr, qArgs := q.Build()
+	rows, err := ws.env.GetDBHandle().Raw(qStr, qArgs...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rsp := &wfpb.GetWorkflowSchedulesResponse{}
+	for rows.Next() {
+		row := &tables.WorkflowSchedule{}
+		if err := ws.env.GetDBHandle().ScanRows(rows, row); err != nil {
+			return nil, err
+		}
+		rsp.Schedule = append(rsp.Schedule, scheduleToProto(row))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+func scheduleToProto(row *tables.WorkflowSchedule) *wfpb.WorkflowSchedule {
+	return &wfpb.WorkflowSchedule{
+		ScheduleId:        row.ScheduleID,
+		WorkflowId:        row.WorkflowID,
+		ActionName:        row.ActionName,
+		Branch:            row.Branch,
+		CronSpec:          row.CronSpec,
+		ConcurrencyPolicy: wfpb.WorkflowSchedule_ConcurrencyPolicy(row.ConcurrencyPolicy),
+		NextRunUsec:       row.NextRunUsec,
+		LastRunUsec:       row.LastRunUsec,
+		LastInvocationId:  row.LastInvocationID,
+		LastError:         row.LastError,
+	}
+}
+
+// runSchedules periodically starts the scheduled runs that are due, until the
+// server shuts down.
+func (ws *workflowService) runSchedules() {
+	for {
+		select {
+		case <-ws.bgCtx.Done():
+			return
+		case <-time.After(scheduleCheckInterval):
+			ws.startDueScheduledRuns(ws.bgCtx, time.Now().UTC())
+		}
+	}
+}
+
+// startDueScheduledRuns starts the runs of schedules that are due at the
+// given time. Each due run is claimed by advancing the schedule's next run
+// time, so that it is only started by one app.
+func (ws *workflowService) startDueScheduledRuns(ctx context.Context, now time.Time) {
+	if err := ws.checkStartWorkflowPreconditions(ctx); err != nil {
+		return
+	}
+	dbh := ws.env.GetDBHandle()
+	var due []*tables.WorkflowSchedule
+	err := dbh.WithContext(ctx).
+		Where("next_run_usec <= ?", timeutil.ToUsec(now)).
+		Order("next_run_usec ASC").
+		Limit(maxScheduledRunsPerCheck).
+		Find(&due).Error
+	if err != nil {
+		log.Warningf("Could not fetch due workflow schedules: %s", err)
+		return
+	}
+	for _, s := range due {
+		sched, err := cron.Parse(s.CronSpec)
+		if err != nil {
+			log.Warningf("Workflow schedule %q has an invalid cron spec: %s", s.ScheduleID, err)
+			continue
+		}
+		res := dbh.WithContext(ctx).Model(&tables.WorkflowSchedule{}).
+			Where("schedule_id = ? AND next_run_usec = ?", s.ScheduleID, s.NextRunUsec).
+			UpdateColumns(map[string]interface{}{
+				"next_run_usec": nextRunUsec(sched, now),
+				"last_run_usec": timeutil.ToUsec(now),
+			})
+		if res.Error != nil {
+			log.Warningf("Could not claim run of workflow schedule %q: %s", s.ScheduleID, res.Error)
+			continue
+		}
+		if res.RowsAffected == 0 {
+			continue
+		}
+		go func(s *tables.WorkflowSchedule) {
+			iid, err := ws.startScheduledRun(ctx, s)
+			if err != nil {
+				log.Warningf("Could not start run of workflow schedule %q: %s", s.ScheduleID, err)
+			}
+			ws.recordScheduledRun(s.ScheduleID, iid, err)
+		}(s)
+	}
+}
+
+// startScheduledRun runs the schedule's action at the head of its branch and
+// returns the invocation ID of the run.
+func (ws *workflowService) startScheduledRun(ctx context.Context, s *tables.WorkflowSchedule) (string, error) {
+	wf := &tables.Workflow{}
+	if err := ws.env.GetDBHandle().Raw(`SELECT * FROM Workflows WHERE workflow_id = ?`, s.WorkflowID).Take(wf).Error; err != nil {
+		return "", err
+	}
+	if err := ws.populateAccessToken(ctx, wf); err != nil {
+		return "", err
+	}
+	key, err := ws.apiKeyForWorkflow(ctx, wf)
+	if err != nil {
+		return "", err
+	}
+	ctx = ws.env.GetAuthenticator().AuthContextFromAPIKey(ctx, key.Value)
+
+	if wfpb.WorkflowSchedule_ConcurrencyPolicy(s.ConcurrencyPolicy) == wfpb.WorkflowSchedule_SKIP_IF_RUNNING && s.LastInvocationID != "" {
+		ti, err := ws.env.GetInvocationDB().LookupInvocation(ctx, s.LastInvocationID)
+		if err != nil && !db.IsRecordNotFound(err) {
+			return "", err
+		}
+		if err == nil && ti.InvocationStatus == int64(inpb.Invocation_PARTIAL_INVOCATION_STATUS) {
+			return "", status.FailedPreconditionErrorf("Skipped because the previous run (%s) has not finished", s.LastInvocationID)
+		}
+	}
+
+	rdl := ws.env.GetRepoDownloader()
+	if rdl == nil {
+		return "", status.FailedPreconditionError("Repo downloader not configured")
+	}
+	commitSHA, err := rdl.ResolveBranch(ctx, wf.RepoURL, wf.Username, wf.AccessToken, s.Branch)
+	if err != nil {
+		return "", err
+	}
+	iid, err := ws.runWorkflowAction(ctx, wf, s.ActionName, s.Branch, commitSHA)
+	if err != nil {
+		return "", err
+	}
+	if err := ws.env.GetInvocationDB().AddInvocationTags(ctx, iid, []string{scheduleTag(s.ScheduleID)}); err != nil {
+		return iid, err
+	}
+	return iid, nil
+}
+
+func (ws *workflowService) recordScheduledRun(scheduleID, iid string, runErr error) {
+	updates := map[string]interface{}{"last_error": ""}
+	if runErr != nil {
+		updates["last_error"] = runErr.Error()
+	}
+	if iid != "" {
+		updates["last_invocation_id"] = iid
+	}
+	err := ws.env.GetDBHandle().Model(&tables.WorkflowSchedule{}).Where("schedule_id = ?", scheduleID).UpdateColumns(updates).Error
+	if err != nil {
+		log.Errorf("Failed to record run of workflow schedule %q: %s", scheduleID, err)
+	}
+}
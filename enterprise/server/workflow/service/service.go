@@ -41,6 +41,9 @@ import (
 
 const (
 	workflowsImage = "docker://gcr.io/flame-public/buildbuddy-ci-runner:v2.2.7"
+
+	// The username that GitHub App installation tokens are used with.
+	gitHubAppUsername = "x-access-token"
 )
 
 var (
@@ -64,12 +67,26 @@ func instanceName(wd *interfaces.WebhookData) string {
 
 type workflowService struct {
 	env environment.Env
+
+	// The parent context of work that outlives requests, such as bisects and
+	// scheduled runs. Canceled on shutdown.
+	bgCtx            context.Context
+	cancelBackground context.CancelFunc
 }
 
 func NewWorkflowService(env environment.Env) *workflowService {
-	return &workflowService{
+	ws := &workflowService{
 		env: env,
 	}
+	ws.bgCtx, ws.cancelBackground = context.WithCancel(context.Background())
+	if hc := env.GetHealthChecker(); hc != nil {
+		hc.RegisterShutdownFunction(func(ctx context.Context) error {
+			ws.cancelBackground()
+			return nil
+		})
+	}
+	go ws.runSchedules()
+	return ws
 }
 
 // getWebhookURL takes a webhookID and returns a fully qualified URL, on this
@@ -140,15 +157,34 @@ func (ws *workflowService) CreateWorkflow(ctx context.Context, req *wfpb.CreateW
 	}
 	username := repoReq.GetUsername()
 	accessToken := repoReq.GetAccessToken()
+	installationID := int64(0)
 
-	// If no access token is provided explicitly, try getting the token from the
-	// group.
+	// If no access token is provided explicitly, try authenticating as the
+	// GitHub App if it's installed on the repo and the installation is linked
+	// to the group, or else getting the token from the group.
 	if accessToken == "" && isGitHubURL(repoURL) {
-		token, err := ws.gitHubTokenForAuthorizedGroup(ctx, req.GetRequestContext())
-		if err != nil {
-			return nil, err
+		if app := ws.env.GetGitHubApp(); app != nil {
+			id, err := app.GetInstallationID(ctx, groupID, repoURL)
+			if err != nil && !status.IsNotFoundError(err) {
+				return nil, err
+			}
+			if err == nil {
+				token, err := app.GetInstallationToken(ctx, groupID, id)
+				if err != nil {
+					return nil, err
+				}
+				installationID = id
+				username = gitHubAppUsername
+				accessToken = token
+			}
+		}
+		if installationID == 0 {
+			token, err := ws.gitHubTokenForAuthorizedGroup(ctx, req.GetRequestContext())
+			if err != nil {
+				return nil, err
+			}
+			accessToken = token
 		}
-		accessToken = token
 	}
 
 	if err := ws.testRepo(ctx, repoURL, username, accessToken); err != nil {
@@ -166,12 +202,26 @@ func (ws *workflowService) CreateWorkflow(ctx context.Context, req *wfpb.CreateW
 
 	rsp := &wfpb.CreateWorkflowResponse{}
 
-	providerWebhookID, err := provider.RegisterWebhook(ctx, accessToken, repoURL, webhookURL)
-	if err != nil && !status.IsUnimplementedError(err) {
-		return nil, err
-	}
-	rsp.WebhookRegistered = (providerWebhookID != "")
+	providerWebhookID := ""
+	storedAccessToken := ""
+	if installationID != 0 {
+		// The repo's events are delivered to the App's webhook, and
+		// installation tokens are created whenever the workflow runs, since
+		// they expire.
+		rsp.WebhookRegistered = true
+		username = ""
+	} else {
+		providerWebhookID, err = provider.RegisterWebhook(ctx, accessToken, repoURL, webhookURL)
+		if err != nil && !status.IsUnimplementedError(err) {
+			return nil, err
+		}
+		rsp.WebhookRegistered = (providerWebhookID != "")
 
+		storedAccessToken, err = ws.encryptAccessToken(accessToken)
+		if err != nil {
+			return nil, err
+		}
+	}
 	err = ws.env.GetDBHandle().Transaction(ctx, func(tx *db.DB) error {
 		workflowID, err := tables.PrimaryKeyForTable("Workflows")
 		if err != nil {
@@ -180,16 +230,17 @@ func (ws *workflowService) CreateWorkflow(ctx context.Context, req *wfpb.CreateW
 		rsp.Id = workflowID
 		rsp.WebhookUrl = webhookURL
 		wf := &tables.Workflow{
-			WorkflowID:           workflowID,
-			UserID:               permissions.UserID,
-			GroupID:              permissions.GroupID,
-			Perms:                permissions.Perms,
-			Name:                 req.GetName(),
-			RepoURL:              repoURL,
-			Username:             username,
-			AccessToken:          accessToken,
-			WebhookID:            webhookID,
-			GitProviderWebhookID: providerWebhookID,
+			WorkflowID:              workflowID,
+			UserID:                  permissions.UserID,
+			GroupID:                 permissions.GroupID,
+			Perms:                   permissions.Perms,
+			Name:                    req.GetName(),
+			RepoURL:                 repoURL,
+			Username:                username,
+			AccessToken:             storedAccessToken,
+			WebhookID:               webhookID,
+			GitProviderWebhookID:    providerWebhookID,
+			GithubAppInstallationID: installationID,
 		}
 		return tx.Create(wf).Error
 	})
@@ -220,11 +271,17 @@ func (ws *workflowService) DeleteWorkflow(ctx context.Context, req *wfpb.DeleteW
 		if err := perms.AuthorizeWrite(&authenticatedUser, acl); err != nil {
 			return err
 		}
+		if err := tx.Exec(`DELETE FROM WorkflowSchedules WHERE workflow_id = ?`, req.GetId()).Error; err != nil {
+			return err
+		}
 		return tx.Exec(`DELETE FROM Workflows WHERE workflow_id = ?`, req.GetId()).Error
 	})
 	if err != nil {
 		return nil, err
 	}
+	if err := ws.populateAccessToken(ctx, &wf); err != nil {
+		return nil, err
+	}
 	if wf.GitProviderWebhookID != "" {
 		const errMsg = "Failed to remove the webhook from the repo; it may need to be removed manually via the repo's settings page"
 
@@ -243,6 +300,45 @@ func (ws *workflowService) DeleteWorkflow(ctx context.Context, req *wfpb.DeleteW
 	return &wfpb.DeleteWorkflowResponse{}, nil
 }
 
+// encryptAccessToken returns the form that a workflow's access token is stored
+// in: encrypted, if secrets are configured.
+func (ws *workflowService) encryptAccessToken(accessToken string) (string, error) {
+	if ss := ws.env.GetSecretService(); ss != nil {
+		return ss.Encrypt(accessToken)
+	}
+	return accessToken, nil
+}
+
+// populateAccessToken replaces the stored access token of a workflow read from
+// the DB with a token that can access its repo: a new installation token, for
+// workflows that authenticate as the GitHub App, or else the stored token
+// itself.
+func (ws *workflowService) populateAccessToken(ctx context.Context, wf *tables.Workflow) error {
+	if wf.GithubAppInstallationID != 0 {
+		app := ws.env.GetGitHubApp()
+		if app == nil {
+			return status.FailedPreconditionError("the workflow authenticates as the GitHub App, which is not configured")
+		}
+		token, err := app.GetInstallationToken(ctx, wf.GroupID, wf.GithubAppInstallationID)
+		if err != nil {
+			return status.WrapError(err, "failed to create GitHub App installation token")
+		}
+		wf.Username = gitHubAppUsername
+		wf.AccessToken = token
+		return nil
+	}
+	ss := ws.env.GetSecretService()
+	if ss == nil {
+		return nil
+	}
+	accessToken, err := ss.Decrypt(wf.AccessToken)
+	if err != nil {
+		return status.WrapError(err, "failed to decrypt workflow access token")
+	}
+	wf.AccessToken = accessToken
+	return nil
+}
+
 func (ws *workflowService) providerForRepo(u *url.URL) (interfaces.GitProvider, error) {
 	for _, provider := range ws.env.GetGitProviders() {
 		if provider.MatchRepoURL(u) {
@@ -318,6 +414,20 @@ func (ws *workflowService) ExecuteWorkflow(ctx context.Context, req *wfpb.Execut
 		return nil, status.InvalidArgumentError("Missing action_name")
 	}
 
+	wf, err := ws.lookupWorkflowForRead(ctx, req.GetWorkflowId())
+	if err != nil {
+		return nil, err
+	}
+	invocationID, err := ws.runWorkflowAction(ctx, wf, req.GetActionName(), req.GetBranch(), req.GetCommitSha())
+	if err != nil {
+		return nil, err
+	}
+	return &wfpb.ExecuteWorkflowResponse{InvocationId: invocationID}, nil
+}
+
+// lookupWorkflowForRead returns the workflow with the given ID, if the
+// authenticated user is allowed to read it.
+func (ws *workflowService) lookupWorkflowForRead(ctx context.Context, workflowID string) (*tables.Workflow, error) {
 	// Authenticate
 	user, err := perms.AuthenticatedUser(ctx, ws.env)
 	if err != nil {
@@ -327,8 +437,8 @@ func (ws *workflowService) ExecuteWorkflow(ctx context.Context, req *wfpb.Execut
 	// Lookup workflow
 	wf := &tables.Workflow{}
 	err = ws.env.GetDBHandle().Raw(
-		`SELECT workflow_id, group_id, repo_url, access_token, perms FROM Workflows WHERE workflow_id = ?`,
-		req.GetWorkflowId(),
+		`SELECT workflow_id, group_id, repo_url, access_token, github_app_installation_id, perms FROM Workflows WHERE workflow_id = ?`,
+		workflowID,
 	).Take(wf).Error
 	if err != nil {
 		if db.IsRecordNotFound(err) {
@@ -342,37 +452,43 @@ func (ws *workflowService) ExecuteWorkflow(ctx context.Context, req *wfpb.Execut
 	if err := perms.AuthorizeRead(&user, wfACL); err != nil {
 		return nil, err
 	}
+	if err := ws.populateAccessToken(ctx, wf); err != nil {
+		return nil, err
+	}
+	return wf, nil
+}
 
-	// Execute
+// runWorkflowAction runs the named action of the workflow at the given commit
+// and returns the invocation ID of the run once its invocation is created.
+func (ws *workflowService) runWorkflowAction(ctx context.Context, wf *tables.Workflow, actionName, branch, commitSHA string) (string, error) {
 	// TODO: Refactor to avoid using this WebhookData struct in the case of manual
 	// workflow execution, since there are no webhooks involved when executing a
 	// workflow manually.
 	wd := &interfaces.WebhookData{
-		PushedBranch: req.GetBranch(),
-		TargetBranch: req.GetBranch(),
+		PushedBranch: branch,
+		TargetBranch: branch,
 		RepoURL:      wf.RepoURL,
-		SHA:          req.GetCommitSha(),
+		SHA:          commitSHA,
 		IsTrusted:    true,
 	}
 	invocationUUID, err := guuid.NewRandom()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	invocationID := invocationUUID.String()
 	extraCIRunnerArgs := []string{
-		fmt.Sprintf("--action_name=%s", req.GetActionName()),
+		fmt.Sprintf("--action_name=%s", actionName),
 		fmt.Sprintf("--invocation_id=%s", invocationID),
 	}
 
 	executionID, err := ws.executeWorkflow(ctx, wf, wd, extraCIRunnerArgs)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	if err := ws.waitForWorkflowInvocationCreated(ctx, executionID, invocationID); err != nil {
-		return nil, err
+		return "", err
 	}
-
-	return &wfpb.ExecuteWorkflowResponse{InvocationId: invocationID}, nil
+	return invocationID, nil
 }
 
 func (ws *workflowService) waitForWorkflowInvocationCreated(ctx context.Context, executionID, invocationID string) error {
@@ -466,6 +582,9 @@ func (ws *workflowService) gitHubTokenForAuthorizedGroup(ctx context.Context, re
 	if g.GithubToken == "" {
 		return "", status.FailedPreconditionError("The selected group does not have a GitHub account linked")
 	}
+	if ss := ws.env.GetSecretService(); ss != nil {
+		return ss.Decrypt(g.GithubToken)
+	}
 	return g.GithubToken, nil
 }
 
@@ -501,6 +620,9 @@ func (ws *workflowService) readWorkflowForWebhook(ctx context.Context, webhookID
 	if err := ws.env.GetDBHandle().ReadRow(tw, `webhook_id = ?`, webhookID); err != nil {
 		return nil, err
 	}
+	if err := ws.populateAccessToken(ctx, tw); err != nil {
+		return nil, err
+	}
 	return tw, nil
 }
 
@@ -680,6 +802,55 @@ func (ws *workflowService) startWorkflow(webhookID string, r *http.Request) erro
 	return err
 }
 
+// gitHubAppWorkflows returns the workflows of the repo that were created with
+// the installation of the GitHub App. Only the workflows of the group that the
+// installation is linked to are returned.
+func (ws *workflowService) gitHubAppWorkflows(ctx context.Context, installationID int64, repoURL string) ([]*tables.Workflow, error) {
+	ownerRepo, err := gitutil.OwnerRepoFromRepoURL(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	var workflows []*tables.Workflow
+	err = ws.env.GetDBHandle().Raw(`
+		SELECT w.* FROM Workflows w
+		JOIN GitHubAppInstallations i ON i.installation_id = w.github_app_installation_id AND i.group_id = w.group_id
+		WHERE w.github_app_installation_id = ?`, installationID).Scan(&workflows).Error
+	if err != nil {
+		return nil, err
+	}
+	var repoWorkflows []*tables.Workflow
+	for _, wf := range workflows {
+		// The installation may have access to several of the group's repos.
+		wfOwnerRepo, err := gitutil.OwnerRepoFromRepoURL(wf.RepoURL)
+		if err == nil && strings.EqualFold(wfOwnerRepo, ownerRepo) {
+			repoWorkflows = append(repoWorkflows, wf)
+		}
+	}
+	return repoWorkflows, nil
+}
+
+func (ws *workflowService) StartGitHubAppWorkflows(ctx context.Context, installationID int64, repoURL string, wd *interfaces.WebhookData) error {
+	if err := ws.checkStartWorkflowPreconditions(ctx); err != nil {
+		return err
+	}
+	workflows, err := ws.gitHubAppWorkflows(ctx, installationID, repoURL)
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for _, wf := range workflows {
+		if err := ws.populateAccessToken(ctx, wf); err != nil {
+			lastErr = err
+			continue
+		}
+		if _, err := ws.executeWorkflow(ctx, wf, wd, nil /*=extraCIRunnerArgs*/); err != nil {
+			log.Warningf("Failed to start workflow %s: %s", wf.WorkflowID, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
 // starts a CI runner execution and returns the execution ID.
 func (ws *workflowService) executeWorkflow(ctx context.Context, wf *tables.Workflow, wd *interfaces.WebhookData, extraCIRunnerArgs []string) (string, error) {
 	key, err := ws.apiKeyForWorkflow(ctx, wf)
@@ -22,6 +22,7 @@ import (
 
 	workflow "github.com/buildbuddy-io/buildbuddy/enterprise/server/workflow/service"
 	bbspb "github.com/buildbuddy-io/buildbuddy/proto/buildbuddy_service"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
 	wfpb "github.com/buildbuddy-io/buildbuddy/proto/workflow"
 )
 
@@ -194,3 +195,133 @@ func TestList(t *testing.T) {
 		WebhookUrl: "http://localhost:8080/webhooks/workflow/WHID3",
 	}}, rsp.GetWorkflow(), protocmp.Transform()))
 }
+
+func TestGetBisect(t *testing.T) {
+	ctx := context.Background()
+	te := newTestEnv(t)
+
+	clientConn := runBBServer(ctx, te, t)
+	bbClient := bbspb.NewBuildBuddyServiceClient(clientConn)
+
+	bisect := &tables.WorkflowBisect{
+		BisectID:              "WB1",
+		WorkflowID:            "WF1",
+		UserID:                "GROUP1",
+		GroupID:               "GROUP1",
+		Perms:                 48,
+		ActionName:            "Test all targets",
+		Branch:                "main",
+		GoodCommitSHA:         "good",
+		BadCommitSHA:          "bad",
+		Status:                int64(wfpb.Bisect_DONE),
+		FirstFailingCommitSHA: "commit2",
+	}
+	err := te.GetDBHandle().Create(bisect).Error
+	require.NoError(t, err)
+	for i, inv := range []*tables.Invocation{
+		{InvocationID: "IID1", CommitSHA: "commit1", InvocationStatus: int64(inpb.Invocation_COMPLETE_INVOCATION_STATUS), Success: true},
+		{InvocationID: "IID2", CommitSHA: "commit2", InvocationStatus: int64(inpb.Invocation_COMPLETE_INVOCATION_STATUS), Success: false},
+		{InvocationID: "IID3", CommitSHA: "commit3", InvocationStatus: int64(inpb.Invocation_PARTIAL_INVOCATION_STATUS)},
+	} {
+		inv.GroupID = "GROUP1"
+		inv.Perms = 48
+		inv.InvocationPK = int64(i)
+		err := te.GetDBHandle().Create(inv).Error
+		require.NoError(t, err)
+		err = te.GetDBHandle().Model(inv).UpdateColumn("created_at_usec", int64(i)).Error
+		require.NoError(t, err)
+		err = te.GetInvocationDB().AddInvocationTags(ctx, inv.InvocationID, []string{"bisect-wb1"})
+		require.NoError(t, err)
+	}
+
+	req := &wfpb.GetBisectRequest{
+		RequestContext: testauth.RequestContext("USER1", "GROUP1"),
+		BisectId:       "WB1",
+	}
+	ctx1 := metadata.AppendToOutgoingContext(ctx, testauth.APIKeyHeader, "USER1")
+	rsp, err := bbClient.GetBisect(ctx1, req)
+	require.NoError(t, err)
+	assert.Empty(t, cmp.Diff(&wfpb.Bisect{
+		BisectId:              "WB1",
+		WorkflowId:            "WF1",
+		ActionName:            "Test all targets",
+		Branch:                "main",
+		GoodCommitSha:         "good",
+		BadCommitSha:          "bad",
+		Status:                wfpb.Bisect_DONE,
+		FirstFailingCommitSha: "commit2",
+		Step: []*wfpb.BisectStep{
+			{CommitSha: "commit1", InvocationId: "IID1", Result: wfpb.BisectStep_PASSED},
+			{CommitSha: "commit2", InvocationId: "IID2", Result: wfpb.BisectStep_FAILED},
+			{CommitSha: "commit3", InvocationId: "IID3", Result: wfpb.BisectStep_RUNNING},
+		},
+	}, rsp.GetBisect(), protocmp.Transform()))
+
+	// Bisects of other groups can't be read.
+	ctx2 := metadata.AppendToOutgoingContext(ctx, testauth.APIKeyHeader, "USER2")
+	_, err = bbClient.GetBisect(ctx2, req)
+	assert.Error(t, err)
+}
+
+func TestSchedules(t *testing.T) {
+	ctx := context.Background()
+	te := newTestEnv(t)
+
+	clientConn := runBBServer(ctx, te, t)
+	bbClient := bbspb.NewBuildBuddyServiceClient(clientConn)
+
+	wf := &tables.Workflow{
+		WorkflowID: "WF1",
+		UserID:     "GROUP1",
+		GroupID:    "GROUP1",
+		Perms:      48,
+		RepoURL:    "file:///ANY",
+	}
+	err := te.GetDBHandle().Create(wf).Error
+	require.NoError(t, err)
+
+	ctx1 := metadata.AppendToOutgoingContext(ctx, testauth.APIKeyHeader, "USER1")
+	createReq := &wfpb.CreateWorkflowScheduleRequest{
+		RequestContext: testauth.RequestContext("USER1", "GROUP1"),
+		Schedule: &wfpb.WorkflowSchedule{
+			WorkflowId: "WF1",
+			ActionName: "Test all targets",
+			Branch:     "main",
+			CronSpec:   "0 3 * * *",
+		},
+	}
+	createRsp, err := bbClient.CreateWorkflowSchedule(ctx1, createReq)
+	require.NoError(t, err)
+	schedule := createRsp.GetSchedule()
+	assert.NotEmpty(t, schedule.GetScheduleId())
+	assert.Greater(t, schedule.GetNextRunUsec(), int64(0))
+
+	createReq.Schedule.CronSpec = "0 25 * * *"
+	_, err = bbClient.CreateWorkflowSchedule(ctx1, createReq)
+	assert.Error(t, err, "invalid cron spec should be rejected")
+
+	getReq := &wfpb.GetWorkflowSchedulesRequest{
+		RequestContext: testauth.RequestContext("USER1", "GROUP1"),
+		WorkflowId:     "WF1",
+	}
+	getRsp, err := bbClient.GetWorkflowSchedules(ctx1, getReq)
+	require.NoError(t, err)
+	assert.Empty(t, cmp.Diff([]*wfpb.WorkflowSchedule{schedule}, getRsp.GetSchedule(), protocmp.Transform()))
+
+	// Schedules of other groups can't be deleted.
+	ctx2 := metadata.AppendToOutgoingContext(ctx, testauth.APIKeyHeader, "USER2")
+	deleteReq := &wfpb.DeleteWorkflowScheduleRequest{
+		RequestContext: testauth.RequestContext("USER2", "GROUP2"),
+		ScheduleId:     schedule.GetScheduleId(),
+	}
+	_, err = bbClient.DeleteWorkflowSchedule(ctx2, deleteReq)
+	assert.Error(t, err)
+
+	deleteReq.RequestContext = testauth.RequestContext("USER1", "GROUP1")
+	_, err = bbClient.DeleteWorkflowSchedule(ctx1, deleteReq)
+	require.NoError(t, err)
+
+	getRsp, err = bbClient.GetWorkflowSchedules(ctx1, getReq)
+	require.NoError(t, err)
+	assert.Empty(t, getRsp.GetSchedule())
+}
@@ -0,0 +1,156 @@
+package blobstore
+
+import (
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+const (
+	// DefaultBackendID is the ID of the configured backend if it isn't given
+	// one explicitly.
+	DefaultBackendID = "default"
+
+	invocationIDPlaceholder = "{invocation_id}"
+	groupIDPlaceholder      = "{group_id}"
+	datePlaceholder         = "{date}"
+
+	// Used for {group_id} when an invocation has no group.
+	anonymousGroupPathSegment = "anon"
+)
+
+// Backends implements interfaces.BlobstoreBackends.
+type Backends struct {
+	writeBackendID  string
+	legacyBackendID string
+	backends        map[string]interfaces.Blobstore
+}
+
+// NewBackends returns backends which write to the given blobstore. Blobs
+// without a backend ID are read from the backend with legacyBackendID, or
+// from the write backend if it is empty.
+func NewBackends(writeBackendID string, write interfaces.Blobstore, legacyBackendID string) *Backends {
+	if writeBackendID == "" {
+		writeBackendID = DefaultBackendID
+	}
+	if legacyBackendID == "" {
+		legacyBackendID = writeBackendID
+	}
+	return &Backends{
+		writeBackendID:  writeBackendID,
+		legacyBackendID: legacyBackendID,
+		backends:        map[string]interfaces.Blobstore{writeBackendID: write},
+	}
+}
+
+// Add registers an additional backend which can be read from.
+func (b *Backends) Add(backendID string, bs interfaces.Blobstore) error {
+	if backendID == "" {
+		return status.InvalidArgumentError("blobstore backend ID must not be empty")
+	}
+	if _, ok := b.backends[backendID]; ok {
+		return status.AlreadyExistsErrorf("blobstore backend %q is configured more than once", backendID)
+	}
+	b.backends[backendID] = bs
+	return nil
+}
+
+func (b *Backends) WriteBackendID() string {
+	return b.writeBackendID
+}
+
+// LegacyBackendID returns the ID of the backend holding blobs written before
+// backend IDs were recorded.
+func (b *Backends) LegacyBackendID() string {
+	return b.legacyBackendID
+}
+
+func (b *Backends) Get(backendID string) (interfaces.Blobstore, error) {
+	if backendID == "" {
+		backendID = b.legacyBackendID
+	}
+	bs, ok := b.backends[backendID]
+	if !ok {
+		return nil, status.NotFoundErrorf("blobstore backend %q is not configured", backendID)
+	}
+	return bs, nil
+}
+
+// GetConfiguredBackends returns the given blobstore, along with any
+// additional backends specified in the config.
+func GetConfiguredBackends(c *config.Configurator, write interfaces.Blobstore) (*Backends, error) {
+	if err := validateBlobPathTemplate(c.GetStorageBlobPathTemplate()); err != nil {
+		return nil, err
+	}
+	b := NewBackends(c.GetStorageBackendID(), write, c.GetStorageLegacyBackendID())
+	for _, bc := range c.GetStorageAdditionalBackends() {
+		bc := bc
+		bs, err := newBlobstore(bc.Disk.RootDirectory, &bc.GCS, &bc.AwsS3, c.GetStorageCompression())
+		if err != nil {
+			return nil, err
+		}
+		if bs == nil {
+			return nil, status.InvalidArgumentErrorf("no storage configured for blobstore backend %q", bc.ID)
+		}
+		if err := b.Add(bc.ID, bs); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := b.Get(""); err != nil {
+		return nil, status.InvalidArgumentErrorf("legacy_backend_id: %s", err)
+	}
+	if archiveID := c.GetStorageArchiveConfig().BackendID; archiveID != "" {
+		if archiveID == b.WriteBackendID() {
+			return nil, status.InvalidArgumentError("archive.backend_id must be one of the additional_backends, not the backend that invocations are written to")
+		}
+		if _, err := b.Get(archiveID); err != nil {
+			return nil, status.InvalidArgumentErrorf("archive.backend_id: %s", err)
+		}
+	}
+	return b, nil
+}
+
+// ForBackend returns the blobstore with the given backend ID, as recorded on
+// an invocation.
+func ForBackend(env environment.Env, backendID string) (interfaces.Blobstore, error) {
+	if backends := env.GetBlobstoreBackends(); backends != nil {
+		return backends.Get(backendID)
+	}
+	return env.GetBlobstore(), nil
+}
+
+// WriteBackendID returns the ID to record on invocations written to the
+// environment's blobstore.
+func WriteBackendID(env environment.Env) string {
+	if backends := env.GetBlobstoreBackends(); backends != nil {
+		return backends.WriteBackendID()
+	}
+	return ""
+}
+
+func validateBlobPathTemplate(template string) error {
+	if template != "" && !strings.Contains(template, invocationIDPlaceholder) {
+		return status.InvalidArgumentErrorf("blob_path_template %q must contain %s", template, invocationIDPlaceholder)
+	}
+	return nil
+}
+
+// InvocationBlobPath returns the path under which the blobs for a new
+// invocation should be stored, by expanding the configured blob path template.
+func InvocationBlobPath(template, invocationID, groupID string, created time.Time) string {
+	if template == "" || validateBlobPathTemplate(template) != nil {
+		return invocationID
+	}
+	if groupID == "" {
+		groupID = anonymousGroupPathSegment
+	}
+	return strings.NewReplacer(
+		invocationIDPlaceholder, invocationID,
+		groupIDPlaceholder, groupID,
+		datePlaceholder, created.UTC().Format("2006-01-02"),
+	).Replace(template)
+}
@@ -0,0 +1,76 @@
+package blobstore_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newDiskBlobStore(t *testing.T) *blobstore.DiskBlobStore {
+	dir, err := ioutil.TempDir("", "blobstore_test_*")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	bs, err := blobstore.NewDiskBlobStore(dir)
+	require.NoError(t, err)
+	return bs
+}
+
+func TestBackends(t *testing.T) {
+	ctx := context.Background()
+	oldBS := newDiskBlobStore(t)
+	newBS := newDiskBlobStore(t)
+	_, err := oldBS.WriteBlob(ctx, "iid-1", []byte("old"))
+	require.NoError(t, err)
+
+	b := blobstore.NewBackends("new", newBS, "old")
+	require.NoError(t, b.Add("old", oldBS))
+	assert.Error(t, b.Add("new", oldBS), "duplicate IDs should be rejected")
+
+	assert.Equal(t, "new", b.WriteBackendID())
+
+	bs, err := b.Get("new")
+	require.NoError(t, err)
+	assert.Same(t, newBS, bs)
+
+	// Invocations without a backend ID were written to the legacy backend.
+	bs, err = b.Get("")
+	require.NoError(t, err)
+	data, err := bs.ReadBlob(ctx, "iid-1")
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(data))
+
+	_, err = b.Get("unknown")
+	assert.Error(t, err)
+}
+
+func TestBackends_DefaultIDs(t *testing.T) {
+	bs := newDiskBlobStore(t)
+	b := blobstore.NewBackends("", bs, "")
+	assert.Equal(t, blobstore.DefaultBackendID, b.WriteBackendID())
+	legacy, err := b.Get("")
+	require.NoError(t, err)
+	assert.Same(t, bs, legacy)
+}
+
+func TestInvocationBlobPath(t *testing.T) {
+	created := time.Date(2021, 3, 4, 23, 0, 0, 0, time.FixedZone("PST", -8*60*60))
+	for _, tc := range []struct {
+		template, groupID, want string
+	}{
+		{"", "GR1", "iid"},
+		{"{date}/{invocation_id}", "GR1", "2021-03-05/iid"},
+		{"{group_id}/{date}/{invocation_id}", "GR1", "GR1/2021-03-05/iid"},
+		{"{group_id}/{invocation_id}", "", "anon/iid"},
+		// Templates that don't include the invocation ID would make
+		// invocations overwrite each other, so they are ignored.
+		{"{date}", "GR1", "iid"},
+	} {
+		assert.Equal(t, tc.want, blobstore.InvocationBlobPath(tc.template, "iid", tc.groupID, created), tc.template)
+	}
+}
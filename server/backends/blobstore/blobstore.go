@@ -2,7 +2,6 @@ package blobstore
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
 	"fmt"
 	"io/ioutil"
@@ -22,6 +21,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/retry"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/prometheus/client_golang/prometheus"
 	"google.golang.org/api/option"
@@ -35,25 +35,113 @@ const (
 	diskLabel  = "disk"
 	gcsLabel   = "gcs"
 	awsS3Label = "aws_s3"
+
+	// Remote blobstores fail requests immediately after this many consecutive
+	// failures, for breakerOpenDuration, so that callers fail fast during an
+	// outage instead of piling up requests.
+	breakerFailureThreshold = 10
+	breakerOpenDuration     = 5 * time.Second
 )
 
 // Returns whatever blobstore is specified in the config.
 func GetConfiguredBlobstore(c *config.Configurator) (interfaces.Blobstore, error) {
-	if c.GetStorageDiskRootDir() != "" {
-		return NewDiskBlobStore(c.GetStorageDiskRootDir())
+	bs, err := newBlobstore(c.GetStorageDiskRootDir(), c.GetStorageGCSConfig(), c.GetStorageAWSS3Config(), c.GetStorageCompression())
+	if err != nil {
+		return nil, err
+	}
+	if bs == nil {
+		return nil, fmt.Errorf("No storage backend configured -- please specify at least one in the config")
+	}
+	return bs, nil
+}
+
+// newBlobstore returns the blobstore for whichever of the given backend
+// configs is set, or nil if none are. Blobs are written with the given
+// compression.
+func newBlobstore(diskRootDir string, gcsConfig *config.GCSConfig, awsConfig *config.AwsS3Config, compression string) (interfaces.Blobstore, error) {
+	if err := validateCompression(compression); err != nil {
+		return nil, err
 	}
-	if gcsConfig := c.GetStorageGCSConfig(); gcsConfig != nil && gcsConfig.Bucket != "" {
+	if diskRootDir != "" {
+		bs, err := NewDiskBlobStore(diskRootDir)
+		if err != nil {
+			return nil, err
+		}
+		bs.compression = compression
+		return bs, nil
+	}
+	if gcsConfig != nil && gcsConfig.Bucket != "" {
 		opts := make([]option.ClientOption, 0)
 		if gcsConfig.CredentialsFile != "" {
 			opts = append(opts, option.WithCredentialsFile(gcsConfig.CredentialsFile))
 		}
-		return NewGCSBlobStore(gcsConfig.Bucket, gcsConfig.ProjectID, opts...)
+		bs, err := NewGCSBlobStore(gcsConfig.Bucket, gcsConfig.ProjectID, opts...)
+		if err != nil {
+			return nil, err
+		}
+		bs.storageClass = gcsConfig.StorageClass
+		bs.compression = compression
+		return newCircuitBreakingBlobstore(bs, gcsLabel+":"+gcsConfig.Bucket), nil
+	}
+	if awsConfig != nil && awsConfig.Bucket != "" {
+		bs, err := NewAwsS3BlobStore(awsConfig)
+		if err != nil {
+			return nil, err
+		}
+		bs.compression = compression
+		return newCircuitBreakingBlobstore(bs, awsS3Label+":"+awsConfig.Bucket), nil
 	}
+	return nil, nil
+}
+
+// circuitBreakingBlobstore is a remote blobstore whose requests fail
+// immediately while it is failing repeatedly.
+type circuitBreakingBlobstore struct {
+	bs interfaces.Blobstore
+	cb *retry.CircuitBreaker
+}
 
-	if awsConfig := c.GetStorageAWSS3Config(); awsConfig != nil && awsConfig.Bucket != "" {
-		return NewAwsS3BlobStore(awsConfig)
+func newCircuitBreakingBlobstore(bs interfaces.Blobstore, name string) *circuitBreakingBlobstore {
+	return &circuitBreakingBlobstore{
+		bs: bs,
+		cb: retry.NewCircuitBreaker("blobstore "+name, breakerFailureThreshold, breakerOpenDuration),
 	}
-	return nil, fmt.Errorf("No storage backend configured -- please specify at least one in the config")
+}
+
+func (c *circuitBreakingBlobstore) BlobExists(ctx context.Context, blobName string) (bool, error) {
+	exists := false
+	err := c.cb.Do(func() error {
+		var err error
+		exists, err = c.bs.BlobExists(ctx, blobName)
+		return err
+	})
+	return exists, err
+}
+
+func (c *circuitBreakingBlobstore) ReadBlob(ctx context.Context, blobName string) ([]byte, error) {
+	var b []byte
+	err := c.cb.Do(func() error {
+		var err error
+		b, err = c.bs.ReadBlob(ctx, blobName)
+		return err
+	})
+	return b, err
+}
+
+func (c *circuitBreakingBlobstore) WriteBlob(ctx context.Context, blobName string, data []byte) (int, error) {
+	n := 0
+	err := c.cb.Do(func() error {
+		var err error
+		n, err = c.bs.WriteBlob(ctx, blobName, data)
+		return err
+	})
+	return n, err
+}
+
+func (c *circuitBreakingBlobstore) DeleteBlob(ctx context.Context, blobName string) error {
+	return c.cb.Do(func() error {
+		return c.bs.DeleteBlob(ctx, blobName)
+	})
 }
 
 func recordWriteMetrics(typeLabel string, startTime time.Time, size int, err error) {
@@ -115,6 +203,8 @@ func recordDeleteMetrics(typeLabel string, startTime time.Time, err error) {
 // files.
 type DiskBlobStore struct {
 	rootDir string
+	// The compression that blobs are written with, or empty for gzip.
+	compression string
 }
 
 func NewDiskBlobStore(rootDir string) (*DiskBlobStore, error) {
@@ -126,50 +216,6 @@ func NewDiskBlobStore(rootDir string) (*DiskBlobStore, error) {
 	}, nil
 }
 
-func decompress(in []byte, err error) ([]byte, error) {
-	if err != nil {
-		return in, err
-	}
-
-	var buf bytes.Buffer
-	// Write instead of using NewBuffer because if this is not a gzip file
-	// we want to return "in" directly later, and NewBuffer would take
-	// ownership of it.
-	if _, err := buf.Write(in); err != nil {
-		return nil, err
-	}
-	zr, err := gzip.NewReader(&buf)
-	if err == gzip.ErrHeader {
-		// Compatibility hack: if we got a header error it means this
-		// is probably an uncompressed record written before we were
-		// compressing. Just read it as-is.
-		return in, nil
-	}
-	if err != nil {
-		return nil, err
-	}
-	rsp, err := ioutil.ReadAll(zr)
-	if err != nil {
-		return nil, err
-	}
-	if err := zr.Close(); err != nil {
-		return nil, err
-	}
-	return rsp, nil
-}
-
-func compress(in []byte) ([]byte, error) {
-	var buf bytes.Buffer
-	zr := gzip.NewWriter(&buf)
-	if _, err := zr.Write(in); err != nil {
-		return nil, err
-	}
-	if err := zr.Close(); err != nil {
-		return nil, err
-	}
-	return ioutil.ReadAll(&buf)
-}
-
 func (d *DiskBlobStore) blobPath(blobName string) (string, error) {
 	// Probably could be more careful here but we are generating these ourselves
 	// for now.
@@ -185,7 +231,7 @@ func (d *DiskBlobStore) WriteBlob(ctx context.Context, blobName string, data []b
 		return 0, err
 	}
 
-	compressedData, err := compress(data)
+	compressedData, err := compress(d.compression, data)
 	if err != nil {
 		return 0, err
 	}
@@ -230,6 +276,11 @@ type GCSBlobStore struct {
 	gcsClient    *storage.Client
 	bucketHandle *storage.BucketHandle
 	projectID    string
+	// The storage class that blobs are written with, or empty for the
+	// bucket's default.
+	storageClass string
+	// The compression that blobs are written with, or empty for gzip.
+	compression string
 }
 
 func NewGCSBlobStore(bucketName, projectID string, opts ...option.ClientOption) (*GCSBlobStore, error) {
@@ -275,8 +326,9 @@ func (g *GCSBlobStore) ReadBlob(ctx context.Context, blobName string) ([]byte, e
 
 func (g *GCSBlobStore) WriteBlob(ctx context.Context, blobName string, data []byte) (int, error) {
 	writer := g.bucketHandle.Object(blobName).NewWriter(ctx)
+	writer.StorageClass = g.storageClass
 	defer writer.Close()
-	compressedData, err := compress(data)
+	compressedData, err := compress(g.compression, data)
 	if err != nil {
 		return 0, err
 	}
@@ -310,6 +362,10 @@ type AwsS3BlobStore struct {
 	bucket     *string
 	downloader *s3manager.Downloader
 	uploader   *s3manager.Uploader
+	// The storage class that blobs are written with, or nil for STANDARD.
+	storageClass *string
+	// The compression that blobs are written with, or empty for gzip.
+	compression string
 }
 
 func NewAwsS3BlobStore(awsConfig *config.AwsS3Config) (*AwsS3BlobStore, error) {
@@ -340,6 +396,9 @@ func NewAwsS3BlobStore(awsConfig *config.AwsS3Config) (*AwsS3BlobStore, error) {
 		downloader: s3manager.NewDownloader(sess),
 		uploader:   s3manager.NewUploader(sess),
 	}
+	if awsConfig.StorageClass != "" {
+		awsBlobStore.storageClass = aws.String(awsConfig.StorageClass)
+	}
 
 	// S3 access points can't modify or delete buckets
 	// https://github.com/awsdocs/amazon-s3-developer-guide/blob/master/doc_source/access-points.md
@@ -402,7 +461,7 @@ func (a *AwsS3BlobStore) download(ctx context.Context, blobName string) ([]byte,
 }
 
 func (a *AwsS3BlobStore) WriteBlob(ctx context.Context, blobName string, data []byte) (int, error) {
-	compressedData, err := compress(data)
+	compressedData, err := compress(a.compression, data)
 	if err != nil {
 		return 0, err
 	}
@@ -414,9 +473,10 @@ func (a *AwsS3BlobStore) WriteBlob(ctx context.Context, blobName string, data []
 
 func (a *AwsS3BlobStore) upload(ctx context.Context, blobName string, compressedData []byte) (int, error) {
 	uploadParams := &s3manager.UploadInput{
-		Bucket: a.bucket,
-		Key:    aws.String(blobName),
-		Body:   bytes.NewReader(compressedData),
+		Bucket:       a.bucket,
+		Key:          aws.String(blobName),
+		Body:         bytes.NewReader(compressedData),
+		StorageClass: a.storageClass,
 	}
 	if _, err := a.uploader.UploadWithContext(ctx, uploadParams); err != nil {
 		return -1, err
@@ -0,0 +1,79 @@
+package blobstore_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/teststorage"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskBlobStoreConformance(t *testing.T) {
+	teststorage.RunBlobstoreTests(t, func(t *testing.T) interfaces.Blobstore {
+		return newDiskBlobStore(t)
+	})
+}
+
+func TestWriteAheadBlobstoreConformance(t *testing.T) {
+	teststorage.RunBlobstoreTests(t, func(t *testing.T) interfaces.Blobstore {
+		wal, err := blobstore.NewWriteAheadBlobstore(newDiskBlobStore(t), newWriteAheadLogDir(t))
+		require.NoError(t, err)
+		return wal
+	})
+}
+
+func TestReadBlobDecompressesAnyFormat(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	bs, err := blobstore.NewDiskBlobStore(dir)
+	require.NoError(t, err)
+	data := []byte(strings.Repeat("INFO: Build completed successfully\n", 100))
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, err = zw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	enc, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+
+	blobs := map[string][]byte{
+		"uncompressed": data,
+		"gzip":         gz.Bytes(),
+		"zstd":         enc.EncodeAll(data, nil),
+	}
+	for name, b := range blobs {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), b, 0644))
+		read, err := bs.ReadBlob(ctx, name)
+		require.NoError(t, err, name)
+		assert.Equal(t, data, read, name)
+	}
+}
+
+func TestWriteBlobCompresses(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	bs, err := blobstore.NewDiskBlobStore(dir)
+	require.NoError(t, err)
+	data := []byte(strings.Repeat("INFO: Build completed successfully\n", 100))
+
+	n, err := bs.WriteBlob(ctx, "blob", data)
+	require.NoError(t, err)
+	assert.Less(t, n, len(data)/10)
+	stored, err := ioutil.ReadFile(filepath.Join(dir, "blob"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x1f, 0x8b}, stored[:2], "blobs should be gzipped by default")
+
+	read, err := bs.ReadBlob(ctx, "blob")
+	require.NoError(t, err)
+	assert.Equal(t, data, read)
+}
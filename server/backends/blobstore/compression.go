@@ -0,0 +1,127 @@
+package blobstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// Values of the storage.compression config option.
+
+	GzipCompression = "gzip"
+	ZstdCompression = "zstd"
+	NoCompression   = "none"
+)
+
+var (
+	// The magic numbers that compressed blobs start with, which identify how
+	// to decompress them.
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+	// The encoder and decoder are safe for concurrent use with EncodeAll and
+	// DecodeAll, so they are shared by all blobstores.
+	zstdEncoder = mustNewZstdEncoder()
+	zstdDecoder = mustNewZstdDecoder()
+)
+
+func mustNewZstdEncoder() *zstd.Encoder {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		panic(err)
+	}
+	return enc
+}
+
+func mustNewZstdDecoder() *zstd.Decoder {
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		panic(err)
+	}
+	return dec
+}
+
+// validateCompression returns an error if blobs can't be written with the
+// given compression.
+func validateCompression(compression string) error {
+	switch compression {
+	case "", GzipCompression, ZstdCompression, NoCompression:
+		return nil
+	default:
+		return status.InvalidArgumentErrorf("unknown storage compression %q: must be one of %q, %q or %q", compression, GzipCompression, ZstdCompression, NoCompression)
+	}
+}
+
+// compress compresses a blob with the given compression, which defaults to
+// gzip.
+func compress(compression string, in []byte) ([]byte, error) {
+	switch compression {
+	case "", GzipCompression:
+		return gzipCompress(in)
+	case ZstdCompression:
+		return zstdEncoder.EncodeAll(in, make([]byte, 0, len(in)/4)), nil
+	case NoCompression:
+		return in, nil
+	default:
+		return nil, validateCompression(compression)
+	}
+}
+
+func gzipCompress(in []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zr := gzip.NewWriter(&buf)
+	if _, err := zr.Write(in); err != nil {
+		return nil, err
+	}
+	if err := zr.Close(); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(&buf)
+}
+
+// decompress decompresses a blob that was read with the given error. The
+// compression is detected from the blob's magic number, so that blobs can be
+// read regardless of the compression configured when they were written. Blobs
+// without a known magic number are returned as-is, since they were written
+// uncompressed.
+func decompress(in []byte, err error) ([]byte, error) {
+	if err != nil {
+		return in, err
+	}
+	if bytes.HasPrefix(in, zstdMagic) {
+		out, err := zstdDecoder.DecodeAll(in, nil)
+		if err != nil {
+			return nil, status.DataLossErrorf("failed to decompress zstd blob: %s", err)
+		}
+		return out, nil
+	}
+	if bytes.HasPrefix(in, gzipMagic) {
+		return gzipDecompress(in)
+	}
+	return in, nil
+}
+
+func gzipDecompress(in []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(in))
+	if err == gzip.ErrHeader {
+		// Compatibility hack: if we got a header error it means this
+		// is probably an uncompressed record written before we were
+		// compressing. Just read it as-is.
+		return in, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	if err := zr.Close(); err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
@@ -0,0 +1,297 @@
+package blobstore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+const (
+	// How often to try persisting the blobs in the write-ahead log.
+	writeAheadLogPersistInterval = 10 * time.Second
+)
+
+// WriteAheadBlobstore implements interfaces.WriteAheadBlobstore by writing
+// blobs to a local directory when writing them to the underlying blobstore
+// fails. The blobs are read from the local directory until they are
+// persisted to the underlying blobstore in the background.
+type WriteAheadBlobstore struct {
+	bs  interfaces.Blobstore
+	dir string
+
+	mu sync.Mutex
+	// The blobs in the write-ahead log, mapped to the sequence number of
+	// their latest write, so that blobs which are written again while
+	// they're being persisted are not dropped.
+	pending  map[string]int64
+	writeSeq int64
+	// Whether the underlying blobstore is unavailable. While it is, writes
+	// go straight to the write-ahead log.
+	degraded bool
+}
+
+// NewWriteAheadBlobstore returns a blobstore which writes to the given
+// blobstore, falling back to the given directory while it is unavailable.
+// Blobs left in the directory by a previous run are persisted once Start is
+// called.
+func NewWriteAheadBlobstore(bs interfaces.Blobstore, dir string) (*WriteAheadBlobstore, error) {
+	if err := disk.EnsureDirectoryExists(dir); err != nil {
+		return nil, err
+	}
+	w := &WriteAheadBlobstore{
+		bs:      bs,
+		dir:     dir,
+		pending: make(map[string]int64),
+	}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(path, ".tmp") {
+			// Left over from an interrupted write.
+			disk.DeleteLocalFileIfExists(path)
+			return nil
+		}
+		blobName, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		w.writeSeq++
+		w.pending[filepath.ToSlash(blobName)] = w.writeSeq
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(w.pending) > 0 {
+		log.Infof("Found %d blobs in write-ahead log %q which are not yet persisted", len(w.pending), dir)
+	}
+	metrics.BlobstoreWriteAheadLogPendingCount.Set(float64(len(w.pending)))
+	return w, nil
+}
+
+// Start persists the blobs in the write-ahead log in the background until
+// the server shuts down. onPersisted, if set, is called with the name of each
+// blob once it is persisted.
+func (w *WriteAheadBlobstore) Start(hc interfaces.HealthChecker, onPersisted func(ctx context.Context, blobName string)) {
+	shuttingDown := make(chan struct{})
+	hc.RegisterShutdownFunction(func(ctx context.Context) error {
+		close(shuttingDown)
+		return nil
+	})
+	go func() {
+		for {
+			select {
+			case <-shuttingDown:
+				return
+			case <-time.After(writeAheadLogPersistInterval):
+				if err := w.PersistPendingWrites(context.Background(), onPersisted); err != nil {
+					log.Warningf("Blobstore is still unavailable, %d blobs are not yet persisted: %s", w.pendingCount(), err)
+				}
+			}
+		}
+	}()
+}
+
+func (w *WriteAheadBlobstore) localPath(blobName string) (string, error) {
+	if strings.Contains(blobName, "..") {
+		return "", status.InvalidArgumentErrorf("blobName (%s) must not contain ../", blobName)
+	}
+	return filepath.Join(w.dir, blobName), nil
+}
+
+func (w *WriteAheadBlobstore) pendingCount() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.pending)
+}
+
+func (w *WriteAheadBlobstore) HasPendingWrites(prefix string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for blobName := range w.pending {
+		if strings.HasPrefix(blobName, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeLocal writes the blob to the write-ahead log. The caller must hold
+// w.mu.
+func (w *WriteAheadBlobstore) writeLocal(ctx context.Context, blobName string, data []byte) (int, error) {
+	path, err := w.localPath(blobName)
+	if err != nil {
+		return 0, err
+	}
+	n, err := disk.WriteFile(ctx, path, data)
+	if err != nil {
+		return 0, err
+	}
+	w.writeSeq++
+	w.pending[blobName] = w.writeSeq
+	metrics.BlobstoreWriteAheadLogWriteCount.Inc()
+	metrics.BlobstoreWriteAheadLogPendingCount.Set(float64(len(w.pending)))
+	return n, nil
+}
+
+func (w *WriteAheadBlobstore) WriteBlob(ctx context.Context, blobName string, data []byte) (int, error) {
+	w.mu.Lock()
+	_, isPending := w.pending[blobName]
+	if isPending || w.degraded {
+		// Write to the log even if the blobstore is available again, so
+		// that the pending blob doesn't overwrite this newer one once it's
+		// persisted.
+		defer w.mu.Unlock()
+		return w.writeLocal(ctx, blobName, data)
+	}
+	w.mu.Unlock()
+
+	n, err := w.bs.WriteBlob(ctx, blobName, data)
+	if err == nil || ctx.Err() != nil {
+		return n, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.degraded {
+		log.Warningf("Writing to the blobstore failed, writing blobs to write-ahead log %q until it recovers: %s", w.dir, err)
+		w.degraded = true
+	}
+	return w.writeLocal(ctx, blobName, data)
+}
+
+func (w *WriteAheadBlobstore) ReadBlob(ctx context.Context, blobName string) ([]byte, error) {
+	w.mu.Lock()
+	if _, ok := w.pending[blobName]; ok {
+		defer w.mu.Unlock()
+		path, err := w.localPath(blobName)
+		if err != nil {
+			return nil, err
+		}
+		return disk.ReadFile(ctx, path)
+	}
+	w.mu.Unlock()
+	return w.bs.ReadBlob(ctx, blobName)
+}
+
+func (w *WriteAheadBlobstore) BlobExists(ctx context.Context, blobName string) (bool, error) {
+	w.mu.Lock()
+	_, ok := w.pending[blobName]
+	w.mu.Unlock()
+	if ok {
+		return true, nil
+	}
+	return w.bs.BlobExists(ctx, blobName)
+}
+
+func (w *WriteAheadBlobstore) DeleteBlob(ctx context.Context, blobName string) error {
+	w.mu.Lock()
+	_, wasPending := w.pending[blobName]
+	if wasPending {
+		path, err := w.localPath(blobName)
+		if err != nil {
+			w.mu.Unlock()
+			return err
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			w.mu.Unlock()
+			return err
+		}
+		delete(w.pending, blobName)
+		metrics.BlobstoreWriteAheadLogPendingCount.Set(float64(len(w.pending)))
+	}
+	w.mu.Unlock()
+
+	err := w.bs.DeleteBlob(ctx, blobName)
+	if wasPending {
+		// The blob may never have reached the blobstore.
+		return nil
+	}
+	return err
+}
+
+// PersistPendingWrites writes the blobs in the write-ahead log to the
+// underlying blobstore, and removes them from the log. It stops at the first
+// blob that can't be written, since the blobstore is likely still
+// unavailable.
+func (w *WriteAheadBlobstore) PersistPendingWrites(ctx context.Context, onPersisted func(ctx context.Context, blobName string)) error {
+	w.mu.Lock()
+	blobNames := make([]string, 0, len(w.pending))
+	for blobName := range w.pending {
+		blobNames = append(blobNames, blobName)
+	}
+	w.mu.Unlock()
+	// Persist blobs in name order, so that the chunks of each invocation are
+	// persisted in sequence.
+	sort.Strings(blobNames)
+
+	for _, blobName := range blobNames {
+		persisted, err := w.persist(ctx, blobName)
+		if err != nil {
+			return err
+		}
+		if persisted && onPersisted != nil {
+			onPersisted(ctx, blobName)
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.degraded && len(w.pending) == 0 {
+		log.Infof("All blobs in write-ahead log %q are persisted, writing to the blobstore again", w.dir)
+		w.degraded = false
+	}
+	return nil
+}
+
+// persist writes a single blob from the write-ahead log to the underlying
+// blobstore. It returns whether the blob was removed from the log.
+func (w *WriteAheadBlobstore) persist(ctx context.Context, blobName string) (bool, error) {
+	path, err := w.localPath(blobName)
+	if err != nil {
+		return false, err
+	}
+	w.mu.Lock()
+	seq, ok := w.pending[blobName]
+	if !ok {
+		// Deleted in the meantime.
+		w.mu.Unlock()
+		return false, nil
+	}
+	data, err := disk.ReadFile(ctx, path)
+	w.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := w.bs.WriteBlob(ctx, blobName, data); err != nil {
+		return false, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.pending[blobName] != seq {
+		// Written again or deleted while it was being persisted; the newer
+		// version is persisted by a later call.
+		return false, nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	delete(w.pending, blobName)
+	metrics.BlobstoreWriteAheadLogPendingCount.Set(float64(len(w.pending)))
+	return true, nil
+}
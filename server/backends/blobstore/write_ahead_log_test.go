@@ -0,0 +1,95 @@
+package blobstore_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyBlobstore fails all writes while unavailable is set.
+type flakyBlobstore struct {
+	*blobstore.DiskBlobStore
+	unavailable bool
+}
+
+func (f *flakyBlobstore) WriteBlob(ctx context.Context, blobName string, data []byte) (int, error) {
+	if f.unavailable {
+		return 0, status.UnavailableError("blobstore is down")
+	}
+	return f.DiskBlobStore.WriteBlob(ctx, blobName, data)
+}
+
+func newWriteAheadLogDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "write_ahead_log_test_*")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestWriteAheadBlobstore(t *testing.T) {
+	ctx := context.Background()
+	inner := &flakyBlobstore{DiskBlobStore: newDiskBlobStore(t)}
+	dir := newWriteAheadLogDir(t)
+	wal, err := blobstore.NewWriteAheadBlobstore(inner, dir)
+	require.NoError(t, err)
+
+	_, err = wal.WriteBlob(ctx, "iid-1/chunks/iid-1-0.chunk", []byte("persisted"))
+	require.NoError(t, err)
+	assert.False(t, wal.HasPendingWrites("iid-1"))
+
+	inner.unavailable = true
+	_, err = wal.WriteBlob(ctx, "iid-1/chunks/iid-1-1.chunk", []byte("pending"))
+	require.NoError(t, err, "writes should succeed while the blobstore is down")
+	assert.True(t, wal.HasPendingWrites("iid-1"))
+	assert.False(t, wal.HasPendingWrites("iid-2"))
+
+	data, err := wal.ReadBlob(ctx, "iid-1/chunks/iid-1-1.chunk")
+	require.NoError(t, err)
+	assert.Equal(t, "pending", string(data))
+	_, err = inner.ReadBlob(ctx, "iid-1/chunks/iid-1-1.chunk")
+	assert.True(t, status.IsNotFoundError(err), "blob should not be persisted yet")
+
+	// Blobs that are still pending are picked up again after a restart.
+	wal, err = blobstore.NewWriteAheadBlobstore(inner, dir)
+	require.NoError(t, err)
+	assert.True(t, wal.HasPendingWrites("iid-1"))
+
+	var persisted []string
+	onPersisted := func(ctx context.Context, blobName string) { persisted = append(persisted, blobName) }
+	assert.Error(t, wal.PersistPendingWrites(ctx, onPersisted))
+	assert.Empty(t, persisted)
+
+	inner.unavailable = false
+	require.NoError(t, wal.PersistPendingWrites(ctx, onPersisted))
+	assert.Equal(t, []string{"iid-1/chunks/iid-1-1.chunk"}, persisted)
+	assert.False(t, wal.HasPendingWrites("iid-1"))
+
+	data, err = inner.ReadBlob(ctx, "iid-1/chunks/iid-1-1.chunk")
+	require.NoError(t, err)
+	assert.Equal(t, "pending", string(data))
+	data, err = wal.ReadBlob(ctx, "iid-1/chunks/iid-1-1.chunk")
+	require.NoError(t, err)
+	assert.Equal(t, "pending", string(data))
+}
+
+func TestWriteAheadBlobstore_DeletePending(t *testing.T) {
+	ctx := context.Background()
+	inner := &flakyBlobstore{DiskBlobStore: newDiskBlobStore(t), unavailable: true}
+	wal, err := blobstore.NewWriteAheadBlobstore(inner, newWriteAheadLogDir(t))
+	require.NoError(t, err)
+
+	_, err = wal.WriteBlob(ctx, "iid-1/chunks/iid-1-0.chunk", []byte("pending"))
+	require.NoError(t, err)
+	require.NoError(t, wal.DeleteBlob(ctx, "iid-1/chunks/iid-1-0.chunk"))
+	assert.False(t, wal.HasPendingWrites("iid-1"))
+
+	exists, err := wal.BlobExists(ctx, "iid-1/chunks/iid-1-0.chunk")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
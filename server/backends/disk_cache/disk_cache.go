@@ -21,6 +21,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/statusz"
+	"github.com/buildbuddy-io/buildbuddy/server/util/toucher"
 	"golang.org/x/sync/errgroup"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
@@ -34,14 +35,21 @@ const (
 	// janitorCheckPeriod is how often the janitor thread will wake up to
 	// check the cache size.
 	janitorCheckPeriod = 100 * time.Millisecond
+
+	// atimeUpdateInterval is the minimum interval between updates of a
+	// file's atime when it is read.
+	atimeUpdateInterval = 1 * time.Minute
 )
 
 // We keep a record (in memory) of file atime (Last Access Time) and size, and
 // when our cache reaches maxSize we remove the oldest files. Rather than
 // serialize this ledger, we regenerate it from scratch on startup by looking
-// at the filesystem.
+// at the filesystem. Reads update file atimes in the background, since the
+// filesystem may be mounted with noatime or relatime, so that recently used
+// files are still treated as recently used after a restart.
 type DiskCache struct {
 	l            *lru.LRU
+	toucher      *toucher.Toucher
 	mu           *sync.RWMutex
 	fileChannel  chan *fileRecord
 	rootDir      string
@@ -98,9 +106,14 @@ func NewDiskCache(rootDir string, maxSizeBytes int64) (*DiskCache, error) {
 	if err != nil {
 		return nil, err
 	}
+	t, err := toucher.New(touchFiles, &toucher.Opts{MinTouchInterval: atimeUpdateInterval})
+	if err != nil {
+		return nil, err
+	}
 	notMappedBool := false
 	c := &DiskCache{
 		l:            l,
+		toucher:      t,
 		rootDir:      rootDir,
 		mu:           &sync.RWMutex{},
 		fileChannel:  make(chan *fileRecord),
@@ -144,6 +157,7 @@ func (c *DiskCache) WithPrefix(prefix string) interfaces.Cache {
 
 	return &DiskCache{
 		l:            c.l,
+		toucher:      c.toucher,
 		rootDir:      c.rootDir,
 		mu:           c.mu,
 		prefix:       newPrefix,
@@ -258,6 +272,36 @@ func (c *DiskCache) key(ctx context.Context, d *repb.Digest) (string, error) {
 	return filepath.Join(c.rootDir, userPrefix+c.prefix+hash), nil
 }
 
+// touchFiles sets the atime of the given files to the current time.
+func touchFiles(ctx context.Context, paths []string) {
+	now := time.Now()
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			// The file may have been evicted in the meantime.
+			continue
+		}
+		if err := os.Chtimes(path, now, info.ModTime()); err != nil {
+			log.Debugf("Could not update atime of %q: %s", path, err)
+		}
+	}
+}
+
+// markUsed moves the file with the given path to the front of the LRU, if
+// present, and schedules an update of its atime.
+// NB: Callers are responsible for locking the LRU before calling this function.
+func (c *DiskCache) markUsed(k string) bool {
+	v, ok := c.l.Get(k)
+	if !ok {
+		return false
+	}
+	if fr, ok := v.(*fileRecord); ok {
+		fr.lastUse = time.Now().UnixNano()
+	}
+	c.toucher.Touch(k)
+	return true
+}
+
 // Adds a single file, using the provided path, to the LRU.
 // NB: Callers are responsible for locking the LRU before calling this function.
 func (c *DiskCache) addFileToLRUIfExists(k string) bool {
@@ -271,8 +315,10 @@ func (c *DiskCache) addFileToLRUIfExists(k string) bool {
 			return false
 		}
 		record := makeRecord(k, info)
+		record.lastUse = time.Now().UnixNano()
 		c.fileChannel <- record
 		c.l.Add(record.key, record)
+		c.toucher.Touch(k)
 		return true
 	}
 	return false
@@ -298,7 +344,7 @@ func (c *DiskCache) Contains(ctx context.Context, d *repb.Digest) (bool, error)
 	// if necessary and applicable.
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	_, ok := c.l.Get(k)
+	ok := c.markUsed(k)
 
 	if !ok && !*c.diskIsMapped {
 		// OK if we're here it means the disk contents are still being loaded
@@ -352,9 +398,7 @@ func (c *DiskCache) Get(ctx context.Context, d *repb.Digest) ([]byte, error) {
 		return nil, status.NotFoundErrorf("DiskCache missing file: %s", err)
 	}
 
-	if c.l.Contains(k) {
-		c.l.Get(k) // mark the file as used.
-	} else if !*c.diskIsMapped {
+	if !c.markUsed(k) && !*c.diskIsMapped {
 		c.addFileToLRUIfExists(k)
 	}
 	return buf, nil
@@ -445,7 +489,7 @@ func (c *DiskCache) Reader(ctx context.Context, d *repb.Digest, offset int64) (i
 		c.l.Remove(k) // remove it just in case
 		return nil, status.NotFoundErrorf("DiskCache missing file: %s", err)
 	} else {
-		c.l.Get(k) // mark the file as used.
+		c.markUsed(k)
 	}
 	return r, nil
 }
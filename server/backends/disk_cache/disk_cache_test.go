@@ -7,6 +7,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"syscall"
 	"testing"
 	"time"
 
@@ -16,9 +18,12 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/teststorage"
 	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/sync/errgroup"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
@@ -442,3 +447,50 @@ func TestZeroLengthFiles(t *testing.T) {
 		t.Fatalf("%q was not found in cache.", goodDigest.GetHash())
 	}
 }
+
+func getAtime(t *testing.T, path string) time.Time {
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	value := reflect.ValueOf(info.Sys().(*syscall.Stat_t)).Elem()
+	for _, name := range []string{"Atim", "Atimespec"} {
+		if f := value.FieldByName(name); f.IsValid() {
+			ts := f.Interface().(syscall.Timespec)
+			return time.Unix(ts.Sec, ts.Nsec)
+		}
+	}
+	t.Fatal("Could not determine atime")
+	return time.Time{}
+}
+
+func TestReadUpdatesAtime(t *testing.T) {
+	maxSizeBytes := int64(100_000_000) // 100MB
+	rootDir := getTmpDir(t)
+	ctx := getAnonContext(t)
+	dc, err := disk_cache.NewDiskCache(rootDir, maxSizeBytes)
+	require.NoError(t, err)
+
+	d, buf := testdigest.NewRandomDigestBuf(t, 1000)
+	require.NoError(t, dc.Set(ctx, d, buf))
+	path := filepath.Join(rootDir, "ANON", d.GetHash())
+	old := time.Now().Add(-24 * time.Hour)
+	require.NoError(t, os.Chtimes(path, old, old))
+
+	_, err = dc.Get(ctx, d)
+	require.NoError(t, err)
+
+	// The atime is updated in the background, and the mtime is preserved.
+	assert.Eventually(t, func() bool {
+		return getAtime(t, path).After(old.Add(time.Hour))
+	}, 10*time.Second, 50*time.Millisecond)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.True(t, info.ModTime().Equal(old), "mtime changed to %s", info.ModTime())
+}
+
+func TestConformance(t *testing.T) {
+	teststorage.RunCacheTests(t, getAnonContext(t), func(t *testing.T) interfaces.Cache {
+		dc, err := disk_cache.NewDiskCache(getTmpDir(t), 1_000_000_000) // 1GB
+		require.NoError(t, err)
+		return dc
+	})
+}
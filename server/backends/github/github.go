@@ -11,10 +11,12 @@ import (
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/random"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 )
 
 const (
@@ -60,6 +62,15 @@ type GithubClient struct {
 	client      *http.Client
 	githubToken string
 	tokenLookup sync.Once
+
+	// Set for clients that authenticate as an installation of the GitHub App,
+	// which report check runs rather than commit statuses.
+	app            interfaces.GitHubApp
+	groupID        string
+	installationID int64
+	// The IDs of the check runs created by the client, by status context.
+	checkRunIDs map[string]int64
+	mu          sync.Mutex
 }
 
 func NewGithubClient(env environment.Env, token string) *GithubClient {
@@ -70,6 +81,20 @@ func NewGithubClient(env environment.Env, token string) *GithubClient {
 	}
 }
 
+// NewGithubAppClient returns a client which authenticates as an installation
+// of the GitHub App that's linked to the group, with tokens that are created
+// as needed.
+func NewGithubAppClient(env environment.Env, app interfaces.GitHubApp, groupID string, installationID int64) *GithubClient {
+	return &GithubClient{
+		env:            env,
+		client:         &http.Client{},
+		app:            app,
+		groupID:        groupID,
+		installationID: installationID,
+		checkRunIDs:    make(map[string]int64),
+	}
+}
+
 func (c *GithubClient) Link(w http.ResponseWriter, r *http.Request) {
 	githubConfig := c.env.GetConfigurator().GetGithubConfig()
 	if githubConfig == nil {
@@ -154,9 +179,19 @@ func (c *GithubClient) Link(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	githubToken := accessTokenResponse.AccessToken
+	if ss := c.env.GetSecretService(); ss != nil {
+		githubToken, err = ss.Encrypt(githubToken)
+		if err != nil {
+			log.Warningf("Error encrypting GitHub token: %s", err)
+			http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+			return
+		}
+	}
+
 	err = dbHandle.Exec(
 		"UPDATE Groups SET github_token = ? WHERE group_id = ?",
-		accessTokenResponse.AccessToken, groupID).Error
+		githubToken, groupID).Error
 	if err != nil {
 		log.Warningf("Error linking github account to user: %v", err)
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
@@ -176,6 +211,10 @@ func (c *GithubClient) CreateStatus(ctx context.Context, ownerRepo string, commi
 		return nil // We can't create a status without an owner/repo and a commit SHA.
 	}
 
+	if c.app != nil {
+		return c.createCheckRun(ctx, ownerRepo, commitSHA, payload)
+	}
+
 	var err error
 	c.tokenLookup.Do(func() {
 		err = c.populateTokenIfNecessary(ctx)
@@ -203,6 +242,88 @@ func (c *GithubClient) CreateStatus(ctx context.Context, ownerRepo string, commi
 	return err
 }
 
+// checkRun is the body of requests to GitHub's check runs API.
+type checkRun struct {
+	Name       string          `json:"name,omitempty"`
+	HeadSHA    string          `json:"head_sha,omitempty"`
+	DetailsURL string          `json:"details_url,omitempty"`
+	Status     string          `json:"status"`
+	Conclusion string          `json:"conclusion,omitempty"`
+	Output     *checkRunOutput `json:"output,omitempty"`
+}
+
+type checkRunOutput struct {
+	Title   string `json:"title"`
+	Summary string `json:"summary"`
+}
+
+// createCheckRun reports a status as a check run, which is created for the
+// first status with a given context and updated by later ones.
+func (c *GithubClient) createCheckRun(ctx context.Context, ownerRepo string, commitSHA string, payload *GithubStatusPayload) error {
+	token, err := c.app.GetInstallationToken(ctx, c.groupID, c.installationID)
+	if err != nil {
+		return err
+	}
+
+	run := &checkRun{
+		DetailsURL: payload.TargetURL,
+		Status:     "completed",
+		Output:     &checkRunOutput{Title: payload.Description, Summary: payload.Description},
+	}
+	switch payload.State {
+	case PendingState:
+		run.Status = "in_progress"
+	case SuccessState:
+		run.Conclusion = "success"
+	default:
+		run.Conclusion = "failure"
+	}
+
+	c.mu.Lock()
+	id, ok := c.checkRunIDs[payload.Context]
+	c.mu.Unlock()
+	method := "POST"
+	url := fmt.Sprintf("https://api.github.com/repos/%s/check-runs", ownerRepo)
+	if ok {
+		method = "PATCH"
+		url = fmt.Sprintf("%s/%d", url, id)
+	} else {
+		run.Name = payload.Context
+		run.HeadSHA = commitSHA
+	}
+	body := new(bytes.Buffer)
+	json.NewEncoder(body).Encode(run)
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "token "+token)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	rsp, err := c.client.Do(req)
+	if err != nil {
+		log.Warningf("Error posting Github check run: %v", err)
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(rsp.Body)
+		return status.UnavailableErrorf("failed to post Github check run: %s: %s", rsp.Status, msg)
+	}
+	if !ok {
+		created := struct {
+			ID int64 `json:"id"`
+		}{}
+		if err := json.NewDecoder(rsp.Body).Decode(&created); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.checkRunIDs[payload.Context] = created.ID
+		c.mu.Unlock()
+	}
+	return nil
+}
+
 func (c *GithubClient) populateTokenIfNecessary(ctx context.Context) error {
 	if c.githubToken != "" {
 		return nil
@@ -236,6 +357,12 @@ func (c *GithubClient) populateTokenIfNecessary(ctx context.Context) error {
 	}
 
 	c.githubToken = group.GithubToken
+	if ss := c.env.GetSecretService(); ss != nil {
+		c.githubToken, err = ss.Decrypt(group.GithubToken)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,91 @@
+package invocation_cache
+
+import (
+	"sync"
+
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/lru"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+const (
+	hitLabel  = "hit"
+	missLabel = "miss"
+)
+
+type entry struct {
+	invocation    *inpb.Invocation
+	updatedAtUsec int64
+	sizeBytes     int64
+}
+
+// InvocationCache is a size-bounded, in-memory LRU of fully parsed
+// invocations. Entries are keyed by invocation ID and are only returned if
+// the invocation's UpdatedAtUsec still matches the value seen when the entry
+// was added, so stale entries written by other apps are never served.
+type InvocationCache struct {
+	l    *lru.LRU
+	lock sync.Mutex
+}
+
+func sizeFn(key interface{}, value interface{}) int64 {
+	size := int64(0)
+	if k, ok := key.(string); ok {
+		size += int64(len(k))
+	}
+	if v, ok := value.(*entry); ok {
+		size += v.sizeBytes
+	}
+	return size
+}
+
+func NewInvocationCache(maxSizeBytes int64) (*InvocationCache, error) {
+	l, err := lru.NewLRU(&lru.Config{MaxSize: maxSizeBytes, SizeFn: sizeFn})
+	if err != nil {
+		return nil, err
+	}
+	return &InvocationCache{l: l}, nil
+}
+
+// Get returns a copy of the cached invocation, if it is present and was
+// last updated at updatedAtUsec.
+func (c *InvocationCache) Get(invocationID string, updatedAtUsec int64) (*inpb.Invocation, bool) {
+	c.lock.Lock()
+	v, ok := c.l.Get(invocationID)
+	c.lock.Unlock()
+	if ok {
+		e := v.(*entry)
+		if e.updatedAtUsec == updatedAtUsec {
+			metrics.InvocationCacheEvents.With(prometheus.Labels{metrics.CacheEventTypeLabel: hitLabel}).Inc()
+			return proto.Clone(e.invocation).(*inpb.Invocation), true
+		}
+		c.Invalidate(invocationID)
+	}
+	metrics.InvocationCacheEvents.With(prometheus.Labels{metrics.CacheEventTypeLabel: missLabel}).Inc()
+	return nil, false
+}
+
+func (c *InvocationCache) Add(invocation *inpb.Invocation) {
+	e := &entry{
+		invocation:    proto.Clone(invocation).(*inpb.Invocation),
+		updatedAtUsec: invocation.GetUpdatedAtUsec(),
+		sizeBytes:     int64(proto.Size(invocation)),
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// The LRU does not re-compute the size of an existing key when it is
+	// replaced, so remove any previous entry first.
+	c.l.Remove(invocation.GetInvocationId())
+	c.l.Add(invocation.GetInvocationId(), e)
+	metrics.InvocationCacheSizeBytes.Set(float64(c.l.Size()))
+}
+
+func (c *InvocationCache) Invalidate(invocationID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.l.Remove(invocationID)
+	metrics.InvocationCacheSizeBytes.Set(float64(c.l.Size()))
+}
@@ -0,0 +1,79 @@
+package invocation_cache_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/invocation_cache"
+	"github.com/stretchr/testify/assert"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+func TestGetAdd(t *testing.T) {
+	ic, err := invocation_cache.NewInvocationCache(1000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv := &inpb.Invocation{InvocationId: "abc", UpdatedAtUsec: 100, Command: "build"}
+	ic.Add(inv)
+
+	cached, ok := ic.Get("abc", 100)
+	assert.True(t, ok)
+	assert.Equal(t, "build", cached.GetCommand())
+
+	// Mutating the returned copy must not affect the cache.
+	cached.Command = "test"
+	cached, ok = ic.Get("abc", 100)
+	assert.True(t, ok)
+	assert.Equal(t, "build", cached.GetCommand())
+
+	_, ok = ic.Get("def", 100)
+	assert.False(t, ok)
+}
+
+func TestStaleEntryIsNotReturned(t *testing.T) {
+	ic, err := invocation_cache.NewInvocationCache(1000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic.Add(&inpb.Invocation{InvocationId: "abc", UpdatedAtUsec: 100})
+
+	_, ok := ic.Get("abc", 200)
+	assert.False(t, ok)
+	// The stale entry should have been dropped.
+	_, ok = ic.Get("abc", 100)
+	assert.False(t, ok)
+}
+
+func TestInvalidate(t *testing.T) {
+	ic, err := invocation_cache.NewInvocationCache(1000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic.Add(&inpb.Invocation{InvocationId: "abc", UpdatedAtUsec: 100})
+	ic.Invalidate("abc")
+
+	_, ok := ic.Get("abc", 100)
+	assert.False(t, ok)
+}
+
+func TestEviction(t *testing.T) {
+	ic, err := invocation_cache.NewInvocationCache(10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		ic.Add(&inpb.Invocation{
+			InvocationId:  fmt.Sprintf("inv-%d", i),
+			UpdatedAtUsec: 100,
+			ConsoleBuffer: strings.Repeat("x", 2000),
+		})
+	}
+
+	_, ok := ic.Get("inv-0", 100)
+	assert.False(t, ok, "oldest invocation should have been evicted")
+	_, ok = ic.Get("inv-9", 100)
+	assert.True(t, ok, "newest invocation should still be cached")
+}
@@ -2,6 +2,7 @@ package invocationdb
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
@@ -106,7 +107,8 @@ func (d *InvocationDB) UpdateInvocationACL(ctx context.Context, authenticatedUse
 
 func (d *InvocationDB) LookupInvocation(ctx context.Context, invocationID string) (*tables.Invocation, error) {
 	ti := &tables.Invocation{}
-	if err := d.h.Raw(`SELECT * FROM Invocations WHERE invocation_id = ?`, invocationID).Take(ti).Error; err != nil {
+	// Trashed invocations are looked up as though they were deleted.
+	if err := d.h.Raw(`SELECT * FROM Invocations WHERE invocation_id = ? AND deleted_at_usec = 0`, invocationID).Take(ti).Error; err != nil {
 		return nil, err
 	}
 	if ti.Perms&perms.OTHERS_READ == 0 {
@@ -125,6 +127,7 @@ func (d *InvocationDB) LookupGroupFromInvocation(ctx context.Context, invocation
 	ti := &tables.Group{}
 	q := query_builder.NewQuery(`SELECT * FROM ` + "`Groups`" + ` as g JOIN Invocations as i ON g.group_id = i.group_id`)
 	q = q.AddWhereClause(`i.invocation_id = ?`, invocationID)
+	q = q.AddWhereClause(`i.deleted_at_usec = 0`)
 	if err := perms.AddPermissionsCheckToQueryWithTableAlias(ctx, d.env, q, "i"); err != nil {
 		return nil, err
 	}
@@ -136,11 +139,101 @@ func (d *InvocationDB) LookupGroupFromInvocation(ctx context.Context, invocation
 	return ti, nil
 }
 
-func (d *InvocationDB) LookupExpiredInvocations(ctx context.Context, cutoffTime time.Time, limit int) ([]*tables.Invocation, error) {
-	cutoffUsec := timeutil.ToUsec(cutoffTime)
-	rows, err := d.h.Raw(`SELECT * FROM Invocations as i
-                                   WHERE i.created_at_usec < ?
-                                   LIMIT ?`, cutoffUsec, limit).Rows()
+func (d *InvocationDB) LookupExpiredInvocations(ctx context.Context, cutoffTime time.Time, retainedTags []string, limit int) ([]*tables.Invocation, error) {
+	q := query_builder.NewQuery(`SELECT * FROM Invocations as i`)
+	q.AddWhereClause(`i.created_at_usec < ?`, timeutil.ToUsec(cutoffTime))
+	addRetainedTagsClause(q, retainedTags)
+	q.SetLimit(int64(limit))
+	return d.lookupInvocations(q)
+}
+
+func (d *InvocationDB) LookupExpiredTaggedInvocations(ctx context.Context, tag string, cutoffTime time.Time, retainedTags []string, limit int) ([]*tables.Invocation, error) {
+	q := query_builder.NewQuery(`SELECT * FROM Invocations as i`)
+	q.AddWhereClause(`i.invocation_id IN (SELECT invocation_id FROM InvocationTags WHERE tag = ?)`, tag)
+	q.AddWhereClause(`i.created_at_usec < ?`, timeutil.ToUsec(cutoffTime))
+	addRetainedTagsClause(q, retainedTags)
+	q.SetLimit(int64(limit))
+	return d.lookupInvocations(q)
+}
+
+func (d *InvocationDB) LookupExpiredGroupInvocations(ctx context.Context, groupID string, cutoffTime time.Time, limit int) ([]*tables.Invocation, error) {
+	q := query_builder.NewQuery(`SELECT * FROM Invocations as i`)
+	q.AddWhereClause(`i.group_id = ?`, groupID)
+	q.AddWhereClause(`i.created_at_usec < ?`, timeutil.ToUsec(cutoffTime))
+	q.SetLimit(int64(limit))
+	return d.lookupInvocations(q)
+}
+
+func (d *InvocationDB) LookupExcessGroupInvocations(ctx context.Context, groupID string, maxTotalBytes int64, limit int) ([]*tables.Invocation, error) {
+	var total struct{ Bytes int64 }
+	err := d.h.Raw(`SELECT COALESCE(SUM(stored_event_bytes), 0) AS bytes FROM Invocations WHERE group_id = ?`, groupID).Take(&total).Error
+	if err != nil {
+		return nil, err
+	}
+	excess := total.Bytes - maxTotalBytes
+	if excess <= 0 {
+		return nil, nil
+	}
+	q := query_builder.NewQuery(`SELECT * FROM Invocations as i`)
+	q.AddWhereClause(`i.group_id = ?`, groupID)
+	q.AddWhereClause(`i.stored_event_bytes > 0`)
+	q.SetOrderBy("i.created_at_usec" /*ascending=*/, true)
+	q.SetLimit(int64(limit))
+	oldest, err := d.lookupInvocations(q)
+	if err != nil {
+		return nil, err
+	}
+	var excessInvocations []*tables.Invocation
+	for _, ti := range oldest {
+		if excess <= 0 {
+			break
+		}
+		excessInvocations = append(excessInvocations, ti)
+		excess -= ti.StoredEventBytes
+	}
+	return excessInvocations, nil
+}
+
+func (d *InvocationDB) LookupTrashedInvocations(ctx context.Context, groupID string, limit int) ([]*tables.Invocation, error) {
+	q := query_builder.NewQuery(`SELECT * FROM Invocations as i`)
+	q.AddWhereClause(`i.group_id = ?`, groupID)
+	q.AddWhereClause(`i.deleted_at_usec != 0`)
+	if err := perms.AddPermissionsCheckToQueryWithTableAlias(ctx, d.env, q, "i"); err != nil {
+		return nil, err
+	}
+	q.SetOrderBy("i.deleted_at_usec" /*ascending=*/, false)
+	q.SetLimit(int64(limit))
+	return d.lookupInvocations(q)
+}
+
+func (d *InvocationDB) LookupExpiredTrashedInvocations(ctx context.Context, cutoffTime time.Time, limit int) ([]*tables.Invocation, error) {
+	q := query_builder.NewQuery(`SELECT * FROM Invocations as i`)
+	q.AddWhereClause(`i.deleted_at_usec != 0`)
+	q.AddWhereClause(`i.deleted_at_usec < ?`, timeutil.ToUsec(cutoffTime))
+	q.SetLimit(int64(limit))
+	return d.lookupInvocations(q)
+}
+
+// addRetainedTagsClause excludes invocations with any of the given tags.
+func addRetainedTagsClause(q *query_builder.Query, retainedTags []string) {
+	if len(retainedTags) == 0 {
+		return
+	}
+	args := make([]interface{}, 0, len(retainedTags))
+	for _, tag := range retainedTags {
+		args = append(args, tag)
+	}
+	q.AddWhereClause(`i.invocation_id NOT IN (SELECT invocation_id FROM InvocationTags WHERE tag IN `+placeholders(len(retainedTags))+`)`, args...)
+}
+
+// placeholders returns a parenthesized list of n query placeholders.
+func placeholders(n int) string {
+	return "(" + strings.TrimSuffix(strings.Repeat("?, ", n), ", ") + ")"
+}
+
+func (d *InvocationDB) lookupInvocations(q *query_builder.Query) ([]*tables.Invocation, error) {
+	queryStr, args := q.Build()
+	rows, err := d.h.Raw(queryStr, args...).Rows()
 	if err != nil {
 		return nil, err
 	}
@@ -178,26 +271,211 @@ func (d *InvocationDB) FillCounts(ctx context.Context, stat *telpb.TelemetryStat
 }
 
 func (d *InvocationDB) DeleteInvocation(ctx context.Context, invocationID string) error {
-	ti := &tables.Invocation{InvocationID: invocationID}
-	return d.h.Delete(ti).Error
+	return d.h.Transaction(ctx, func(tx *db.DB) error {
+		ti := &tables.Invocation{InvocationID: invocationID}
+		if err := tx.Delete(ti).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`DELETE FROM Executions WHERE invocation_id = ?`, invocationID).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`DELETE FROM InvocationBuildMetadata WHERE invocation_id = ?`, invocationID).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`DELETE FROM InvocationFailures WHERE invocation_id = ?`, invocationID).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`DELETE FROM InvocationCustomEventStreams WHERE invocation_id = ?`, invocationID).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`DELETE FROM InvocationTags WHERE invocation_id = ?`, invocationID).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`DELETE FROM BenchmarkResults WHERE invocation_id = ?`, invocationID).Error; err != nil {
+			return err
+		}
+		return tx.Exec(`DELETE FROM TargetCoverage WHERE invocation_id = ?`, invocationID).Error
+	})
 }
 
-func (d *InvocationDB) DeleteInvocationWithPermsCheck(ctx context.Context, authenticatedUser *interfaces.UserInfo, invocationID string) error {
+func (d *InvocationDB) InsertInvocationBuildMetadata(ctx context.Context, invocationID string, metadata map[string]string) error {
+	if len(metadata) == 0 {
+		return nil
+	}
 	return d.h.Transaction(ctx, func(tx *db.DB) error {
 		var in tables.Invocation
-		if err := tx.Raw(`SELECT user_id, group_id, perms FROM Invocations WHERE invocation_id = ?`, invocationID).Take(&in).Error; err != nil {
+		if err := tx.Raw(`SELECT group_id FROM Invocations WHERE invocation_id = ?`, invocationID).Take(&in).Error; err != nil {
 			return err
 		}
-		acl := perms.ToACLProto(&uidpb.UserId{Id: in.UserID}, in.GroupID, in.Perms)
-		if err := perms.AuthorizeWrite(authenticatedUser, acl); err != nil {
+		if err := tx.Exec(`DELETE FROM InvocationBuildMetadata WHERE invocation_id = ?`, invocationID).Error; err != nil {
 			return err
 		}
-		if err := tx.Exec(`DELETE FROM Invocations WHERE invocation_id = ?`, invocationID).Error; err != nil {
+		for k, v := range metadata {
+			md := &tables.InvocationBuildMetadata{
+				InvocationID:  invocationID,
+				MetadataKey:   k,
+				GroupID:       in.GroupID,
+				MetadataValue: v,
+			}
+			if err := tx.Create(md).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *InvocationDB) InsertInvocationFailures(ctx context.Context, invocationID string, failures []*tables.InvocationFailure) error {
+	return d.h.Transaction(ctx, func(tx *db.DB) error {
+		var in tables.Invocation
+		if err := tx.Raw(`SELECT group_id FROM Invocations WHERE invocation_id = ?`, invocationID).Take(&in).Error; err != nil {
 			return err
 		}
-		if err := tx.Exec(`DELETE FROM Executions WHERE invocation_id = ?`, invocationID).Error; err != nil {
+		if err := tx.Exec(`DELETE FROM InvocationFailures WHERE invocation_id = ?`, invocationID).Error; err != nil {
+			return err
+		}
+		for _, f := range failures {
+			f.InvocationID = invocationID
+			f.GroupID = in.GroupID
+			if err := tx.Create(f).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *InvocationDB) InsertOrUpdateCustomEventStream(ctx context.Context, stream *tables.InvocationCustomEventStream) error {
+	return d.h.Transaction(ctx, func(tx *db.DB) error {
+		if err := tx.Exec(`DELETE FROM InvocationCustomEventStreams WHERE invocation_id = ? AND stream_id = ?`, stream.InvocationID, stream.StreamID).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(stream).Error; err != nil {
 			return err
 		}
+		// Bump the invocation's update time so that cached copies of it,
+		// which don't include the new events, are not used.
+		return tx.Exec(`UPDATE Invocations SET updated_at_usec = ? WHERE invocation_id = ?`, timeutil.ToUsec(time.Now()), stream.InvocationID).Error
+	})
+}
+
+func (d *InvocationDB) LookupCustomEventStreams(ctx context.Context, invocationID string) ([]*tables.InvocationCustomEventStream, error) {
+	rows, err := d.h.Raw(`SELECT * FROM InvocationCustomEventStreams WHERE invocation_id = ? ORDER BY stream_id`, invocationID).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var streams []*tables.InvocationCustomEventStream
+	for rows.Next() {
+		s := &tables.InvocationCustomEventStream{}
+		if err := d.h.ScanRows(rows, s); err != nil {
+			return nil, err
+		}
+		streams = append(streams, s)
+	}
+	return streams, rows.Err()
+}
+
+func (d *InvocationDB) AddInvocationTags(ctx context.Context, invocationID string, tags []string) error {
+	if len(tags) == 0 {
 		return nil
+	}
+	return d.h.Transaction(ctx, func(tx *db.DB) error {
+		for _, tag := range tags {
+			if err := tx.Exec(`DELETE FROM InvocationTags WHERE invocation_id = ? AND tag = ?`, invocationID, tag).Error; err != nil {
+				return err
+			}
+			if err := tx.Create(&tables.InvocationTag{InvocationID: invocationID, Tag: tag}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *InvocationDB) RemoveInvocationTags(ctx context.Context, invocationID string, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	args := []interface{}{invocationID}
+	for _, tag := range tags {
+		args = append(args, tag)
+	}
+	return d.h.Exec(`DELETE FROM InvocationTags WHERE invocation_id = ? AND tag IN `+placeholders(len(tags)), args...).Error
+}
+
+func (d *InvocationDB) LookupInvocationTags(ctx context.Context, invocationIDs []string) (map[string][]string, error) {
+	tagsByInvocation := make(map[string][]string, len(invocationIDs))
+	if len(invocationIDs) == 0 {
+		return tagsByInvocation, nil
+	}
+	args := make([]interface{}, 0, len(invocationIDs))
+	for _, iid := range invocationIDs {
+		args = append(args, iid)
+	}
+	rows, err := d.h.Raw(`SELECT * FROM InvocationTags WHERE invocation_id IN `+placeholders(len(invocationIDs))+` ORDER BY tag`, args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t := &tables.InvocationTag{}
+		if err := d.h.ScanRows(rows, t); err != nil {
+			return nil, err
+		}
+		tagsByInvocation[t.InvocationID] = append(tagsByInvocation[t.InvocationID], t.Tag)
+	}
+	return tagsByInvocation, rows.Err()
+}
+
+// lookupInvocationForWrite returns the ACL fields of an invocation, if the
+// authenticated user may modify it.
+func lookupInvocationForWrite(tx *db.DB, authenticatedUser *interfaces.UserInfo, invocationID string) (*tables.Invocation, error) {
+	in := &tables.Invocation{}
+	if err := tx.Raw(`SELECT user_id, group_id, perms, deleted_at_usec FROM Invocations WHERE invocation_id = ?`, invocationID).Take(in).Error; err != nil {
+		return nil, err
+	}
+	if err := perms.AuthorizeWrite(authenticatedUser, getACL(in)); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+func (d *InvocationDB) TrashInvocationWithPermsCheck(ctx context.Context, authenticatedUser *interfaces.UserInfo, invocationID string) error {
+	return d.h.Transaction(ctx, func(tx *db.DB) error {
+		in, err := lookupInvocationForWrite(tx, authenticatedUser, invocationID)
+		if err != nil {
+			return err
+		}
+		if in.DeletedAtUsec != 0 {
+			return status.NotFoundErrorf("Invocation %q is already in the trash", invocationID)
+		}
+		return tx.Exec(`UPDATE Invocations SET deleted_at_usec = ? WHERE invocation_id = ?`, timeutil.ToUsec(d.env.GetClock().Now()), invocationID).Error
 	})
 }
+
+func (d *InvocationDB) RestoreInvocationWithPermsCheck(ctx context.Context, authenticatedUser *interfaces.UserInfo, invocationID string) error {
+	return d.h.Transaction(ctx, func(tx *db.DB) error {
+		in, err := lookupInvocationForWrite(tx, authenticatedUser, invocationID)
+		if err != nil {
+			return err
+		}
+		if in.DeletedAtUsec == 0 {
+			return status.NotFoundErrorf("Invocation %q is not in the trash", invocationID)
+		}
+		return tx.Exec(`UPDATE Invocations SET deleted_at_usec = 0 WHERE invocation_id = ?`, invocationID).Error
+	})
+}
+
+// LookupInvocationForWrite returns an invocation, including one that is in
+// the trash, if the authenticated user may modify it.
+func (d *InvocationDB) LookupInvocationForWrite(ctx context.Context, authenticatedUser *interfaces.UserInfo, invocationID string) (*tables.Invocation, error) {
+	ti := &tables.Invocation{}
+	if err := d.h.Raw(`SELECT * FROM Invocations WHERE invocation_id = ?`, invocationID).Take(ti).Error; err != nil {
+		return nil, err
+	}
+	if err := perms.AuthorizeWrite(authenticatedUser, getACL(ti)); err != nil {
+		return nil, err
+	}
+	return ti, nil
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/teststorage"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 
@@ -234,3 +235,13 @@ func TestLRU(t *testing.T) {
 		}
 	}
 }
+
+func TestConformance(t *testing.T) {
+	teststorage.RunCacheTests(t, getAnonContext(t), func(t *testing.T) interfaces.Cache {
+		mc, err := memory_cache.NewMemoryCache(1_000_000_000) // 1GB
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mc
+	})
+}
@@ -0,0 +1,59 @@
+package memory_kvstore
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+const (
+	maxNumEntries = 100000
+)
+
+type value struct {
+	value     string
+	expiresAt time.Time
+}
+
+// MemoryKeyValStore is a KeyValStore for apps that run alone, since the
+// values it stores aren't shared with other apps.
+type MemoryKeyValStore struct {
+	l  *lru.Cache
+	mu sync.Mutex
+}
+
+func NewMemoryKeyValStore() (*MemoryKeyValStore, error) {
+	l, err := lru.New(maxNumEntries)
+	if err != nil {
+		return nil, err
+	}
+	return &MemoryKeyValStore{
+		l: l,
+	}, nil
+}
+
+func (m *MemoryKeyValStore) SetValue(ctx context.Context, key, val string, expiration time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.l.Add(key, &value{value: val, expiresAt: time.Now().Add(expiration)})
+	return nil
+}
+
+func (m *MemoryKeyValStore) GetValue(ctx context.Context, key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if existingValIface, ok := m.l.Get(key); ok {
+		if existingVal, ok := existingValIface.(*value); ok {
+			if time.Now().Before(existingVal.expiresAt) {
+				return existingVal.value, nil
+			}
+			m.l.Remove(key)
+		}
+	}
+
+	return "", nil
+}
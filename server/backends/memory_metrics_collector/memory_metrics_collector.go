@@ -3,6 +3,7 @@ package memory_metrics_collector
 import (
 	"context"
 	"sync"
+	"time"
 
 	lru "github.com/hashicorp/golang-lru"
 )
@@ -45,6 +46,13 @@ func (m *MemoryMetricsCollector) IncrementCount(ctx context.Context, counterName
 
 }
 
+// IncrementCountWithExpiry increments the counter like IncrementCount. The
+// expiration is ignored, since counters are evicted once there are too many
+// of them anyway, and don't outlive the app.
+func (m *MemoryMetricsCollector) IncrementCountWithExpiry(ctx context.Context, counterName string, n int64, expiration time.Duration) (int64, error) {
+	return m.IncrementCount(ctx, counterName, n)
+}
+
 func (m *MemoryMetricsCollector) ReadCount(ctx context.Context, counterName string) (int64, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -57,3 +65,32 @@ func (m *MemoryMetricsCollector) ReadCount(ctx context.Context, counterName stri
 
 	return 0, nil
 }
+
+func (m *MemoryMetricsCollector) IncrementMapCount(ctx context.Context, key, field string, n int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existingValIface, _ := m.l.Get(key)
+	counts, ok := existingValIface.(map[string]int64)
+	if !ok {
+		counts = make(map[string]int64)
+		m.l.Add(key, counts)
+	}
+	counts[field] += n
+	return counts[field], nil
+}
+
+func (m *MemoryMetricsCollector) ReadMapCounts(ctx context.Context, key string) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := make(map[string]int64)
+	if existingValIface, ok := m.l.Get(key); ok {
+		if existingVal, ok := existingValIface.(map[string]int64); ok {
+			for field, n := range existingVal {
+				counts[field] = n
+			}
+		}
+	}
+	return counts, nil
+}
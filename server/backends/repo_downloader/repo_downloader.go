@@ -3,7 +3,9 @@ package repo_downloader
 import (
 	"context"
 
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
 
 	gitutil "github.com/buildbuddy-io/buildbuddy/server/util/git"
 	git "github.com/go-git/go-git/v5"
@@ -29,3 +31,26 @@ func (d *gitRepoDownloader) TestRepoAccess(ctx context.Context, repoURL, usernam
 	_, err = remote.List(&git.ListOptions{})
 	return err
 }
+
+func (d *gitRepoDownloader) ResolveBranch(ctx context.Context, repoURL, username, accessToken, branch string) (string, error) {
+	authURL, err := gitutil.AuthRepoURL(repoURL, username, accessToken)
+	if err != nil {
+		return "", err
+	}
+
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: repoURL,
+		URLs: []string{authURL},
+	})
+	refs, err := remote.List(&git.ListOptions{})
+	if err != nil {
+		return "", err
+	}
+	name := plumbing.NewBranchReferenceName(branch)
+	for _, ref := range refs {
+		if ref.Name() == name {
+			return ref.Hash().String(), nil
+		}
+	}
+	return "", status.NotFoundErrorf("branch %q not found in repo %q", branch, gitutil.StripRepoURLCredentials(repoURL))
+}
@@ -83,7 +83,9 @@ func NewSlackWebhook(callbackURL string, bbURL string) *SlackWebhook {
 	}
 }
 
-func (w *SlackWebhook) slackPayloadFromInvocation(invocation *inpb.Invocation) *Payload {
+// PayloadFromInvocation returns the message posted about a completed
+// invocation.
+func (w *SlackWebhook) PayloadFromInvocation(invocation *inpb.Invocation) *Payload {
 	a := Attachment{}
 
 	statusText := ""
@@ -110,7 +112,7 @@ func (w *SlackWebhook) slackPayloadFromInvocation(invocation *inpb.Invocation) *
 }
 
 func (w *SlackWebhook) NotifyComplete(ctx context.Context, invocation *inpb.Invocation) error {
-	payload := w.slackPayloadFromInvocation(invocation)
+	payload := w.PayloadFromInvocation(invocation)
 	buf := new(bytes.Buffer)
 	json.NewEncoder(buf).Encode(payload)
 	_, err := http.Post(w.callbackURL, "application/json; charset=utf-8", buf)
@@ -0,0 +1,291 @@
+// Package blob_migrator copies invocation blobs from one blobstore backend to
+// another, so that storage can be migrated without downtime.
+//
+// Each invocation is migrated by copying all of its blobs, including its
+// render model and custom event streams, to the destination backend,
+// verifying the copies, and then updating the invocation's rows to point at
+// the destination. Until the rows are updated the invocation is read from the
+// source backend, so a migration can be interrupted and resumed at any point.
+package blob_migrator
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+const (
+	defaultBatchSize = 100
+)
+
+type Options struct {
+	// The IDs of the backends to migrate from and to.
+	FromBackendID string
+	ToBackendID   string
+
+	// The maximum number of bytes to copy per second, or 0 for no limit.
+	MaxBytesPerSecond int64
+
+	// How many invocations to look up at a time.
+	BatchSize int
+
+	// If set, blobs are deleted from the source backend once an invocation
+	// has been switched over to the destination backend.
+	DeleteSource bool
+
+	// If set, blobs are copied and verified, but invocations are not
+	// switched over to the destination backend.
+	DryRun bool
+}
+
+// Stats summarizes the progress of a migration.
+type Stats struct {
+	Invocations int64
+	Blobs       int64
+	Bytes       int64
+	Failures    int64
+}
+
+type Migrator struct {
+	h        *db.DBHandle
+	opts     Options
+	from     interfaces.Blobstore
+	to       interfaces.Blobstore
+	throttle *throttle
+
+	// Whether rows without a backend ID are stored in the source backend.
+	fromLegacy bool
+}
+
+func New(h *db.DBHandle, backends *blobstore.Backends, opts Options) (*Migrator, error) {
+	if opts.FromBackendID == "" || opts.ToBackendID == "" {
+		return nil, status.InvalidArgumentError("both the source and destination backend IDs are required")
+	}
+	if opts.FromBackendID == opts.ToBackendID {
+		return nil, status.InvalidArgumentError("the source and destination backends must be different")
+	}
+	from, err := backends.Get(opts.FromBackendID)
+	if err != nil {
+		return nil, err
+	}
+	to, err := backends.Get(opts.ToBackendID)
+	if err != nil {
+		return nil, err
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	return &Migrator{
+		h:          h,
+		opts:       opts,
+		from:       from,
+		to:         to,
+		throttle:   newThrottle(opts.MaxBytesPerSecond),
+		fromLegacy: backends.LegacyBackendID() == opts.FromBackendID,
+	}, nil
+}
+
+// Run migrates all completed invocations stored in the source backend. An
+// invocation which fails to migrate is logged and skipped, so that it can be
+// retried by running the migration again.
+func (m *Migrator) Run(ctx context.Context) (*Stats, error) {
+	stats := &Stats{}
+	lastInvocationID := ""
+	for {
+		batch, err := m.nextBatch(ctx, lastInvocationID)
+		if err != nil {
+			return stats, err
+		}
+		if len(batch) == 0 {
+			return stats, nil
+		}
+		for _, ti := range batch {
+			if err := m.migrateInvocation(ctx, ti, stats); err != nil {
+				if ctx.Err() != nil {
+					return stats, ctx.Err()
+				}
+				log.Warningf("Failed to migrate invocation %s: %s", ti.InvocationID, err)
+				stats.Failures++
+				continue
+			}
+			stats.Invocations++
+		}
+		lastInvocationID = batch[len(batch)-1].InvocationID
+		log.Infof("Migrated %d invocations (%d blobs, %d bytes), %d failures", stats.Invocations, stats.Blobs, stats.Bytes, stats.Failures)
+	}
+}
+
+func (m *Migrator) nextBatch(ctx context.Context, afterInvocationID string) ([]*tables.Invocation, error) {
+	q := m.h.WithContext(ctx).Where("invocation_id > ? AND invocation_status <> ?", afterInvocationID, int64(inpb.Invocation_PARTIAL_INVOCATION_STATUS))
+	if m.fromLegacy {
+		q = q.Where("(blob_backend_id = ? OR blob_backend_id = '')", m.opts.FromBackendID)
+	} else {
+		q = q.Where("blob_backend_id = ?", m.opts.FromBackendID)
+	}
+	var batch []*tables.Invocation
+	if err := q.Order("invocation_id").Limit(m.opts.BatchSize).Find(&batch).Error; err != nil {
+		return nil, status.InternalErrorf("failed to look up invocations: %s", err)
+	}
+	return batch, nil
+}
+
+// blobNames returns the names of all blobs stored for an invocation in the
+// source backend, including its render model and the given custom event
+// streams.
+func (m *Migrator) blobNames(ctx context.Context, ti *tables.Invocation, streams []*tables.InvocationCustomEventStream) ([]string, error) {
+	path := ti.BlobID
+	if path == "" {
+		path = ti.InvocationID
+	}
+	names, err := build_event_handler.InvocationBlobNames(ctx, m.from, path, true /*=includeRenderModel*/)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range streams {
+		streamNames, err := build_event_handler.InvocationBlobNames(ctx, m.from, s.BlobID, false /*=includeRenderModel*/)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, streamNames...)
+	}
+	return names, nil
+}
+
+// customEventStreams returns the invocation's custom event streams that are
+// stored in the source backend.
+func (m *Migrator) customEventStreams(ctx context.Context, iid string) ([]*tables.InvocationCustomEventStream, error) {
+	q := m.h.WithContext(ctx).Where("invocation_id = ?", iid)
+	if m.fromLegacy {
+		q = q.Where("(blob_backend_id = ? OR blob_backend_id = '')", m.opts.FromBackendID)
+	} else {
+		q = q.Where("blob_backend_id = ?", m.opts.FromBackendID)
+	}
+	var streams []*tables.InvocationCustomEventStream
+	if err := q.Find(&streams).Error; err != nil {
+		return nil, status.InternalErrorf("failed to look up custom event streams: %s", err)
+	}
+	return streams, nil
+}
+
+func (m *Migrator) migrateInvocation(ctx context.Context, ti *tables.Invocation, stats *Stats) error {
+	streams, err := m.customEventStreams(ctx, ti.InvocationID)
+	if err != nil {
+		return err
+	}
+	names, err := m.blobNames(ctx, ti, streams)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		n, err := m.copyBlob(ctx, name)
+		if err != nil {
+			return err
+		}
+		stats.Blobs++
+		stats.Bytes += int64(n)
+	}
+	if m.opts.DryRun {
+		return nil
+	}
+
+	// Only switch the invocation over if it hasn't changed since it was
+	// looked up, in case it was concurrently deleted or migrated.
+	err = m.h.Transaction(ctx, func(tx *db.DB) error {
+		res := tx.Model(&tables.Invocation{}).
+			Where("invocation_id = ? AND blob_backend_id = ?", ti.InvocationID, ti.BlobBackendID).
+			UpdateColumn("blob_backend_id", m.opts.ToBackendID)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return status.AbortedError("invocation was modified during migration")
+		}
+		for _, s := range streams {
+			err := tx.Model(&tables.InvocationCustomEventStream{}).
+				Where("invocation_id = ? AND stream_id = ? AND blob_backend_id = ?", s.InvocationID, s.StreamID, s.BlobBackendID).
+				UpdateColumn("blob_backend_id", m.opts.ToBackendID).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if status.IsAbortedError(err) {
+			return err
+		}
+		return status.InternalErrorf("failed to update invocation: %s", err)
+	}
+
+	if m.opts.DeleteSource {
+		for _, name := range names {
+			if err := m.from.DeleteBlob(ctx, name); err != nil {
+				log.Warningf("Failed to delete migrated blob %q: %s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// copyBlob copies a blob to the destination backend and verifies that it can
+// be read back. It returns the size of the blob.
+func (m *Migrator) copyBlob(ctx context.Context, name string) (int, error) {
+	data, err := m.from.ReadBlob(ctx, name)
+	if err != nil {
+		return 0, status.UnavailableErrorf("failed to read %q: %s", name, err)
+	}
+	if err := m.throttle.wait(ctx, len(data)); err != nil {
+		return 0, err
+	}
+	if _, err := m.to.WriteBlob(ctx, name, data); err != nil {
+		return 0, status.UnavailableErrorf("failed to write %q: %s", name, err)
+	}
+	copied, err := m.to.ReadBlob(ctx, name)
+	if err != nil {
+		return 0, status.UnavailableErrorf("failed to read back %q: %s", name, err)
+	}
+	if !bytes.Equal(data, copied) {
+		return 0, status.DataLossErrorf("copy of %q does not match the original", name)
+	}
+	return len(data), nil
+}
+
+// throttle limits the average rate at which bytes are copied.
+type throttle struct {
+	bytesPerSecond int64
+	start          time.Time
+	bytes          int64
+}
+
+func newThrottle(bytesPerSecond int64) *throttle {
+	return &throttle{bytesPerSecond: bytesPerSecond, start: time.Now()}
+}
+
+// wait blocks until n more bytes can be copied without exceeding the limit.
+func (t *throttle) wait(ctx context.Context, n int) error {
+	if t.bytesPerSecond <= 0 {
+		return nil
+	}
+	t.bytes += int64(n)
+	target := time.Duration(float64(t.bytes) / float64(t.bytesPerSecond) * float64(time.Second))
+	delay := target - time.Since(t.start)
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
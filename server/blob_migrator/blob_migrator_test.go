@@ -0,0 +1,166 @@
+package blob_migrator_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
+	"github.com/buildbuddy-io/buildbuddy/server/blob_migrator"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/protofile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+func newDiskBlobStore(t *testing.T) *blobstore.DiskBlobStore {
+	dir, err := ioutil.TempDir("", "blob_migrator_test_*")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	bs, err := blobstore.NewDiskBlobStore(dir)
+	require.NoError(t, err)
+	return bs
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	oldBS := newDiskBlobStore(t)
+	newBS := newDiskBlobStore(t)
+	backends := blobstore.NewBackends("new", newBS, "old")
+	require.NoError(t, backends.Add("old", oldBS))
+
+	invocations := []*tables.Invocation{
+		// Written before backend IDs were recorded.
+		{InvocationID: "iid-1", InvocationPK: 1, InvocationStatus: int64(inpb.Invocation_COMPLETE_INVOCATION_STATUS)},
+		{InvocationID: "iid-2", InvocationPK: 2, BlobID: "2021-03-04/iid-2", BlobBackendID: "old", InvocationStatus: int64(inpb.Invocation_COMPLETE_INVOCATION_STATUS)},
+		// Still in progress, so not migrated.
+		{InvocationID: "iid-3", InvocationPK: 3, BlobBackendID: "old", InvocationStatus: int64(inpb.Invocation_PARTIAL_INVOCATION_STATUS)},
+	}
+	for _, ti := range invocations {
+		require.NoError(t, te.GetDBHandle().Create(ti).Error)
+		path := ti.BlobID
+		if path == "" {
+			path = ti.InvocationID
+		}
+		for i := 0; i < 3; i++ {
+			_, err := oldBS.WriteBlob(ctx, protofile.ChunkName(path, i), []byte(ti.InvocationID))
+			require.NoError(t, err)
+		}
+	}
+
+	m, err := blob_migrator.New(te.GetDBHandle(), backends, blob_migrator.Options{
+		FromBackendID: "old",
+		ToBackendID:   "new",
+		BatchSize:     1,
+		DeleteSource:  true,
+	})
+	require.NoError(t, err)
+	stats, err := m.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, &blob_migrator.Stats{Invocations: 2, Blobs: 6, Bytes: 30}, stats)
+
+	for _, tc := range []struct {
+		iid, path, wantBackendID string
+	}{
+		{"iid-1", "iid-1", "new"},
+		{"iid-2", "2021-03-04/iid-2", "new"},
+		{"iid-3", "iid-3", "old"},
+	} {
+		ti := &tables.Invocation{}
+		require.NoError(t, te.GetDBHandle().Where("invocation_id = ?", tc.iid).First(ti).Error)
+		assert.Equal(t, tc.wantBackendID, ti.BlobBackendID, tc.iid)
+
+		migrated, err := newBS.BlobExists(ctx, protofile.ChunkName(tc.path, 2))
+		require.NoError(t, err)
+		assert.Equal(t, tc.wantBackendID == "new", migrated, tc.iid)
+		remaining, err := oldBS.BlobExists(ctx, protofile.ChunkName(tc.path, 0))
+		require.NoError(t, err)
+		assert.Equal(t, tc.wantBackendID == "old", remaining, tc.iid)
+	}
+}
+
+func TestRun_RenderModelAndCustomEvents(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	oldBS := newDiskBlobStore(t)
+	newBS := newDiskBlobStore(t)
+	backends := blobstore.NewBackends("new", newBS, "")
+	require.NoError(t, backends.Add("old", oldBS))
+
+	ti := &tables.Invocation{InvocationID: "iid-1", BlobID: "iid-1", BlobBackendID: "old", InvocationStatus: int64(inpb.Invocation_COMPLETE_INVOCATION_STATUS)}
+	require.NoError(t, te.GetDBHandle().Create(ti).Error)
+	stream := &tables.InvocationCustomEventStream{InvocationID: "iid-1", StreamID: "build/tool", BlobID: "iid-1/custom_events/abc", BlobBackendID: "old"}
+	require.NoError(t, te.GetDBHandle().Create(stream).Error)
+	blobs := []string{
+		protofile.ChunkName("iid-1", 0),
+		"iid-1/render_model",
+		protofile.ChunkName("iid-1/custom_events/abc", 0),
+	}
+	for _, name := range blobs {
+		_, err := oldBS.WriteBlob(ctx, name, []byte("data"))
+		require.NoError(t, err)
+	}
+
+	m, err := blob_migrator.New(te.GetDBHandle(), backends, blob_migrator.Options{
+		FromBackendID: "old",
+		ToBackendID:   "new",
+		DeleteSource:  true,
+	})
+	require.NoError(t, err)
+	stats, err := m.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, &blob_migrator.Stats{Invocations: 1, Blobs: 3, Bytes: 12}, stats)
+
+	for _, name := range blobs {
+		migrated, err := newBS.BlobExists(ctx, name)
+		require.NoError(t, err)
+		assert.True(t, migrated, name)
+		remaining, err := oldBS.BlobExists(ctx, name)
+		require.NoError(t, err)
+		assert.False(t, remaining, name)
+	}
+	require.NoError(t, te.GetDBHandle().Where("invocation_id = ?", "iid-1").First(stream).Error)
+	assert.Equal(t, "new", stream.BlobBackendID)
+}
+
+func TestRun_DryRun(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	oldBS := newDiskBlobStore(t)
+	newBS := newDiskBlobStore(t)
+	backends := blobstore.NewBackends("new", newBS, "")
+	require.NoError(t, backends.Add("old", oldBS))
+
+	ti := &tables.Invocation{InvocationID: "iid-1", BlobBackendID: "old", InvocationStatus: int64(inpb.Invocation_COMPLETE_INVOCATION_STATUS)}
+	require.NoError(t, te.GetDBHandle().Create(ti).Error)
+	_, err := oldBS.WriteBlob(ctx, protofile.ChunkName("iid-1", 0), []byte("data"))
+	require.NoError(t, err)
+
+	m, err := blob_migrator.New(te.GetDBHandle(), backends, blob_migrator.Options{
+		FromBackendID: "old",
+		ToBackendID:   "new",
+		DryRun:        true,
+	})
+	require.NoError(t, err)
+	stats, err := m.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stats.Blobs)
+
+	require.NoError(t, te.GetDBHandle().Where("invocation_id = ?", "iid-1").First(ti).Error)
+	assert.Equal(t, "old", ti.BlobBackendID)
+}
+
+func TestNew_InvalidOptions(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	backends := blobstore.NewBackends("new", newDiskBlobStore(t), "")
+
+	_, err := blob_migrator.New(te.GetDBHandle(), backends, blob_migrator.Options{FromBackendID: "new", ToBackendID: "new"})
+	assert.Error(t, err)
+	_, err = blob_migrator.New(te.GetDBHandle(), backends, blob_migrator.Options{FromBackendID: "unknown", ToBackendID: "new"})
+	assert.Error(t, err)
+}
@@ -41,6 +41,7 @@ var (
 // in full (that data lives in blobstore).
 type BEValues struct {
 	valuesMap               map[string]string
+	buildMetadata           map[string]string
 	invocationID            string
 	sawWorkspaceStatusEvent bool
 	buildStartTime          time.Time
@@ -50,6 +51,7 @@ func NewBEValues(invocationID string) *BEValues {
 	return &BEValues{
 		invocationID:            invocationID,
 		valuesMap:               make(map[string]string, 0),
+		buildMetadata:           make(map[string]string, 0),
 		sawWorkspaceStatusEvent: false,
 	}
 }
@@ -103,6 +105,11 @@ func (v *BEValues) ActionName() string {
 	return v.getStringValue(actionNameFieldName)
 }
 
+// BuildMetadata returns all key/value pairs passed via --build_metadata.
+func (v *BEValues) BuildMetadata() map[string]string {
+	return v.buildMetadata
+}
+
 func (v *BEValues) WorkspaceIsLoaded() bool {
 	return v.sawWorkspaceStatusEvent
 }
@@ -164,6 +171,11 @@ func (v *BEValues) populateWorkspaceInfoFromStructuredCommandLine(commandLine *c
 
 func (v *BEValues) populateWorkspaceInfoFromBuildMetadata(metadata *build_event_stream.BuildMetadata) {
 	for mdKey, mdVal := range metadata.Metadata {
+		if mdKey == "REPO_URL" {
+			v.buildMetadata[mdKey] = gitutil.StripRepoURLCredentials(mdVal)
+		} else {
+			v.buildMetadata[mdKey] = mdVal
+		}
 		if fieldName := buildMetadataFieldMapping[mdKey]; fieldName != "" {
 			v.setStringValue(fieldName, mdVal)
 		}
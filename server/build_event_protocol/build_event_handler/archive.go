@@ -0,0 +1,233 @@
+package build_event_handler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/protofile"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+	"github.com/prometheus/client_golang/prometheus"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	gstatus "google.golang.org/grpc/status"
+)
+
+const (
+	// How long an app may take to restore an archived invocation. Once it
+	// has passed, the next lookup of the invocation restores it again, in
+	// case the app restoring it went away.
+	restoreTimeout = 10 * time.Minute
+
+	archiveOperation = "archive"
+	restoreOperation = "restore"
+)
+
+// ArchiveInvocation moves the blobs of a completed invocation to the archive
+// backend with the given ID. It fails with an Aborted error if the
+// invocation was modified in the meantime.
+func ArchiveInvocation(ctx context.Context, env environment.Env, ti *tables.Invocation, archiveBackendID string) error {
+	archive, err := blobstore.ForBackend(env, archiveBackendID)
+	if err != nil {
+		return err
+	}
+	err = moveInvocation(ctx, env, ti, archiveBackendID, archive, inpb.Invocation_ARCHIVED)
+	recordArchiveOperation(archiveOperation, err)
+	return err
+}
+
+// restoreArchivedInvocation starts moving the blobs of an archived
+// invocation back to the blobstore that new invocations are written to,
+// unless it's already being restored. The invocation is returned without its
+// events until then.
+func restoreArchivedInvocation(env environment.Env, ti *tables.Invocation) {
+	if env.GetDBHandle() == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), restoreTimeout)
+	nowUsec := timeutil.ToUsec(env.GetClock().Now())
+	res := env.GetDBHandle().WithContext(ctx).Model(&tables.Invocation{}).
+		Where("invocation_id = ? AND (archive_status = ? OR (archive_status = ? AND archive_status_usec < ?))",
+			ti.InvocationID, int64(inpb.Invocation_ARCHIVED), int64(inpb.Invocation_RESTORING), nowUsec-restoreTimeout.Microseconds()).
+		UpdateColumns(map[string]interface{}{
+			"archive_status":      int64(inpb.Invocation_RESTORING),
+			"archive_status_usec": nowUsec,
+		})
+	if res.Error != nil || res.RowsAffected == 0 {
+		// Already being restored by another lookup.
+		cancel()
+		if res.Error != nil {
+			log.Warningf("Could not start restoring archived invocation %s: %s", ti.InvocationID, res.Error)
+		}
+		return
+	}
+	claimed := *ti
+	claimed.ArchiveStatus = int64(inpb.Invocation_RESTORING)
+	go func() {
+		defer cancel()
+		err := moveInvocation(ctx, env, &claimed, blobstore.WriteBackendID(env), env.GetBlobstore(), inpb.Invocation_NOT_ARCHIVED)
+		recordArchiveOperation(restoreOperation, err)
+		if err != nil {
+			log.Warningf("Could not restore archived invocation %s: %s", ti.InvocationID, err)
+			return
+		}
+		if ic := env.GetInvocationCache(); ic != nil {
+			ic.Invalidate(ti.InvocationID)
+		}
+	}()
+}
+
+func recordArchiveOperation(operation string, err error) {
+	metrics.InvocationArchiveCount.With(prometheus.Labels{
+		metrics.InvocationArchiveOperationLabel: operation,
+		metrics.StatusLabel:                     fmt.Sprintf("%d", gstatus.Code(err)),
+	}).Inc()
+}
+
+// invocationBlobs are the blobs stored in one backend for an invocation.
+type invocationBlobs struct {
+	bs    interfaces.Blobstore
+	names []string
+}
+
+// moveInvocation copies the blobs of an invocation, including its render
+// model and custom event streams, to another backend, and then switches the
+// invocation over to it with the given archive status, as long as it hasn't
+// changed since it was looked up. The blobs are only deleted from where they
+// were once the invocation has been switched over, so that it can always be
+// read.
+func moveInvocation(ctx context.Context, env environment.Env, ti *tables.Invocation, toBackendID string, to interfaces.Blobstore, archiveStatus inpb.Invocation_ArchiveStatus) error {
+	if env.GetDBHandle() == nil {
+		return status.FailedPreconditionError("moving invocations requires a database")
+	}
+	blobPath := ti.BlobID
+	if blobPath == "" {
+		blobPath = ti.InvocationID
+	}
+	var moved []*invocationBlobs
+	if ti.BlobBackendID != toBackendID {
+		blobs, err := listInvocationBlobs(ctx, env, ti.BlobBackendID, blobPath, true /*=includeRenderModel*/)
+		if err != nil {
+			return err
+		}
+		moved = append(moved, blobs)
+	}
+	streams, err := env.GetInvocationDB().LookupCustomEventStreams(ctx, ti.InvocationID)
+	if err != nil {
+		return err
+	}
+	var movedStreams []*tables.InvocationCustomEventStream
+	for _, s := range streams {
+		if s.BlobBackendID == toBackendID {
+			continue
+		}
+		blobs, err := listInvocationBlobs(ctx, env, s.BlobBackendID, s.BlobID, false /*=includeRenderModel*/)
+		if err != nil {
+			return err
+		}
+		moved = append(moved, blobs)
+		movedStreams = append(movedStreams, s)
+	}
+	for _, blobs := range moved {
+		for _, name := range blobs.names {
+			data, err := blobs.bs.ReadBlob(ctx, name)
+			if err != nil {
+				return status.UnavailableErrorf("failed to read %q: %s", name, err)
+			}
+			if _, err := to.WriteBlob(ctx, name, data); err != nil {
+				return status.UnavailableErrorf("failed to write %q: %s", name, err)
+			}
+		}
+	}
+
+	err = env.GetDBHandle().Transaction(ctx, func(tx *db.DB) error {
+		res := tx.Model(&tables.Invocation{}).
+			Where("invocation_id = ? AND blob_backend_id = ? AND archive_status = ?", ti.InvocationID, ti.BlobBackendID, ti.ArchiveStatus).
+			UpdateColumns(map[string]interface{}{
+				"blob_backend_id":     toBackendID,
+				"archive_status":      int64(archiveStatus),
+				"archive_status_usec": timeutil.ToUsec(env.GetClock().Now()),
+			})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return status.AbortedErrorf("invocation %s was modified while it was moved", ti.InvocationID)
+		}
+		for _, s := range movedStreams {
+			err := tx.Model(&tables.InvocationCustomEventStream{}).
+				Where("invocation_id = ? AND stream_id = ?", s.InvocationID, s.StreamID).
+				UpdateColumn("blob_backend_id", toBackendID).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if status.IsAbortedError(err) {
+			return err
+		}
+		return status.InternalErrorf("failed to update invocation %s: %s", ti.InvocationID, err)
+	}
+
+	for _, blobs := range moved {
+		for _, name := range blobs.names {
+			if err := blobs.bs.DeleteBlob(ctx, name); err != nil {
+				log.Warningf("Could not delete moved blob %q: %s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// listInvocationBlobs returns the blobs stored under the given path in a
+// backend (see InvocationBlobNames).
+func listInvocationBlobs(ctx context.Context, env environment.Env, backendID, blobPath string, includeRenderModel bool) (*invocationBlobs, error) {
+	bs, err := blobstore.ForBackend(env, backendID)
+	if err != nil {
+		return nil, err
+	}
+	names, err := InvocationBlobNames(ctx, bs, blobPath, includeRenderModel)
+	if err != nil {
+		return nil, err
+	}
+	return &invocationBlobs{bs: bs, names: names}, nil
+}
+
+// InvocationBlobNames returns the names of the chunks stored under the given
+// path of an invocation or of one of its custom event streams, along with the
+// render model stored next to an invocation's chunks if requested.
+func InvocationBlobNames(ctx context.Context, bs interfaces.Blobstore, blobPath string, includeRenderModel bool) ([]string, error) {
+	var names []string
+	for i := 0; ; i++ {
+		name := protofile.ChunkName(blobPath, i)
+		exists, err := bs.BlobExists(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			break
+		}
+		names = append(names, name)
+	}
+	if includeRenderModel {
+		name := renderModelBlobPath(blobPath)
+		exists, err := bs.BlobExists(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
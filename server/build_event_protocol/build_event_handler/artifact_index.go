@@ -0,0 +1,349 @@
+package build_event_handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/retention"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/protofile"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+	"github.com/golang/protobuf/proto"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	defaultDeduplicationLookbackDays = 7
+	defaultDeduplicationInvocations  = 100
+	maxDeduplicationInvocations      = 1000
+	maxDuplicatedArtifactsInReport   = 20
+)
+
+// artifactIndexCache returns the cache that artifact indexes stored by
+// reference are kept in, or nil if there is no cache. Indexes that the cache
+// has evicted are read from their retention class, if any.
+func artifactIndexCache(env environment.Env) interfaces.Cache {
+	c := env.GetCache()
+	if c == nil {
+		return nil
+	}
+	if rs := env.GetRetentionStore(); rs != nil {
+		c = rs.Cache(c)
+	}
+	return namespace.CASCache(c, "")
+}
+
+// formatDigest formats a digest as "<hash>/<size_bytes>", as artifact index
+// references and reported artifacts are.
+func formatDigest(d *repb.Digest) string {
+	return fmt.Sprintf("%s/%d", d.GetHash(), d.GetSizeBytes())
+}
+
+func parseDigest(ref string) (*repb.Digest, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 2 {
+		return nil, status.InvalidArgumentErrorf("invalid digest %q", ref)
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid digest %q", ref)
+	}
+	return &repb.Digest{Hash: parts[0], SizeBytes: size}, nil
+}
+
+// storeArtifactIndexByReference stores the file set of a named_set_of_files
+// event in the cache of the invocation's group, if artifact indexes are
+// stored by reference, and returns the event to store in the invocation in
+// its place. Identical file sets, such as those of targets that didn't
+// change between builds, are then only stored once. Other events, and file
+// sets that couldn't be stored, are returned as is.
+func (e *EventChannel) storeArtifactIndexByReference(ctx context.Context, event *inpb.InvocationEvent) *inpb.InvocationEvent {
+	fileSet := event.GetBuildEvent().GetNamedSetOfFiles()
+	if fileSet == nil || !e.env.GetConfigurator().GetStorageArtifactIndexByReference() {
+		return event
+	}
+	c := artifactIndexCache(e.env)
+	if c == nil {
+		return event
+	}
+	b, err := proto.Marshal(fileSet)
+	if err != nil {
+		return event
+	}
+	d, err := digest.Compute(bytes.NewReader(b))
+	if err != nil {
+		return event
+	}
+	ctx = prefix.AttachGroupPrefixToContext(ctx, e.groupID)
+	if err := c.Set(ctx, d, b); err != nil {
+		log.Warningf("Could not store artifact index of invocation %s by reference: %s", e.beValues.InvocationID(), err)
+		return event
+	}
+	if err := retention.Retain(ctx, c, retention.ArtifactIndex, d); err != nil {
+		log.Warningf("Could not retain artifact index of invocation %s: %s", e.beValues.InvocationID(), err)
+	}
+	be := event.GetBuildEvent()
+	return &inpb.InvocationEvent{
+		EventTime:      event.EventTime,
+		SequenceNumber: event.SequenceNumber,
+		BuildEvent: &build_event_stream.BuildEvent{
+			Id:          be.Id,
+			Children:    be.Children,
+			LastMessage: be.LastMessage,
+		},
+		ArtifactIndexRef: formatDigest(d),
+	}
+}
+
+// readArtifactIndex reads a file set stored by reference in the cache of the
+// given group.
+func readArtifactIndex(ctx context.Context, env environment.Env, groupID, ref string) (*build_event_stream.NamedSetOfFiles, error) {
+	c := artifactIndexCache(env)
+	if c == nil {
+		return nil, status.UnavailableError("artifact indexes stored by reference require a cache")
+	}
+	d, err := parseDigest(ref)
+	if err != nil {
+		return nil, err
+	}
+	b, err := c.Get(prefix.AttachGroupPrefixToContext(ctx, groupID), d)
+	if err != nil {
+		return nil, err
+	}
+	fileSet := &build_event_stream.NamedSetOfFiles{}
+	if err := proto.Unmarshal(b, fileSet); err != nil {
+		return nil, status.DataLossErrorf("invalid artifact index %q: %s", ref, err)
+	}
+	return fileSet, nil
+}
+
+// resolveArtifactIndex fills in the file set of an event whose file set was
+// stored by reference. If the file set can't be read, such as because the
+// cache evicted it, the event is left without one.
+func resolveArtifactIndex(ctx context.Context, env environment.Env, groupID, iid string, event *inpb.InvocationEvent) {
+	if event.GetArtifactIndexRef() == "" || event.GetBuildEvent() == nil {
+		return
+	}
+	fileSet, err := readArtifactIndex(ctx, env, groupID, event.GetArtifactIndexRef())
+	if err != nil {
+		log.Warningf("Could not read artifact index %q of invocation %s: %s", event.GetArtifactIndexRef(), iid, err)
+		return
+	}
+	event.BuildEvent.Payload = &build_event_stream.BuildEvent_NamedSetOfFiles{NamedSetOfFiles: fileSet}
+	event.ArtifactIndexRef = ""
+}
+
+// fileDigest returns the digest of a file referenced by a build event, or
+// nil if it isn't stored by digest.
+func fileDigest(f *build_event_stream.File) *repb.Digest {
+	if contents := f.GetContents(); contents != nil {
+		d, err := digest.Compute(bytes.NewReader(contents))
+		if err != nil {
+			return nil
+		}
+		return d
+	}
+	u, err := url.Parse(f.GetUri())
+	if err != nil || u.Scheme != "bytestream" {
+		return nil
+	}
+	_, d, err := digest.ExtractDigestFromDownloadResourceName(strings.TrimPrefix(u.Path, "/"))
+	if err != nil {
+		return nil
+	}
+	return d
+}
+
+type artifactStats struct {
+	name            string
+	digest          *repb.Digest
+	invocationCount int64
+}
+
+// deduplicationReport accumulates the artifacts and artifact indexes of the
+// analyzed invocations.
+type deduplicationReport struct {
+	rsp           *inpb.GetArtifactDeduplicationReportResponse
+	artifacts     map[string]*artifactStats
+	uniqueIndexes map[string]bool
+}
+
+// addInvocation reads the events of an invocation and adds its artifacts and
+// artifact indexes to the report.
+func (r *deduplicationReport) addInvocation(ctx context.Context, env environment.Env, ti *tables.Invocation) error {
+	bs, err := blobstore.ForBackend(env, ti.BlobBackendID)
+	if err != nil {
+		return err
+	}
+	blobPath := ti.BlobID
+	if blobPath == "" {
+		blobPath = ti.InvocationID
+	}
+	seen := make(map[string]bool)
+	pr := protofile.NewBufferedProtoReader(bs, blobPath)
+	for {
+		event := &inpb.InvocationEvent{}
+		err := pr.ReadProto(ctx, event)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var fileSet *build_event_stream.NamedSetOfFiles
+		if ref := event.GetArtifactIndexRef(); ref != "" {
+			r.rsp.ReferencedArtifactIndexCount++
+			r.addIndex(ref)
+			fileSet, err = readArtifactIndex(ctx, env, ti.GroupID, ref)
+			if err != nil {
+				log.Debugf("Could not read artifact index %q of invocation %s: %s", ref, ti.InvocationID, err)
+			}
+		} else if fileSet = event.GetBuildEvent().GetNamedSetOfFiles(); fileSet != nil {
+			b, err := proto.Marshal(fileSet)
+			if err != nil {
+				return err
+			}
+			d, err := digest.Compute(bytes.NewReader(b))
+			if err != nil {
+				return err
+			}
+			r.rsp.ArtifactIndexBytes += int64(len(b))
+			r.addIndex(formatDigest(d))
+		} else {
+			continue
+		}
+		r.rsp.ArtifactIndexCount++
+		for _, f := range fileSet.GetFiles() {
+			d := fileDigest(f)
+			if d == nil {
+				continue
+			}
+			key := formatDigest(d)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			r.rsp.ArtifactCount++
+			r.rsp.ArtifactBytes += d.GetSizeBytes()
+			a, ok := r.artifacts[key]
+			if !ok {
+				// Invocations are added most recent first.
+				a = &artifactStats{name: f.GetName(), digest: d}
+				r.artifacts[key] = a
+				r.rsp.UniqueArtifactCount++
+				r.rsp.UniqueArtifactBytes += d.GetSizeBytes()
+			}
+			a.invocationCount++
+		}
+	}
+	r.rsp.InvocationCount++
+	return nil
+}
+
+func (r *deduplicationReport) addIndex(ref string) {
+	if r.uniqueIndexes[ref] {
+		return
+	}
+	r.uniqueIndexes[ref] = true
+	r.rsp.UniqueArtifactIndexCount++
+	if d, err := parseDigest(ref); err == nil {
+		r.rsp.UniqueArtifactIndexBytes += d.GetSizeBytes()
+	}
+}
+
+// GetArtifactDeduplicationReport reports how much of the artifacts, and the
+// artifact indexes, of the selected group's recent invocations are
+// duplicated across invocations, by digest.
+func GetArtifactDeduplicationReport(ctx context.Context, env environment.Env, req *inpb.GetArtifactDeduplicationReportRequest) (*inpb.GetArtifactDeduplicationReportResponse, error) {
+	groupID, err := perms.AuthenticateSelectedGroupID(ctx, env, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	if env.GetDBHandle() == nil {
+		return nil, status.UnimplementedError("Not implemented")
+	}
+	lookbackDays := req.GetLookbackWindowDays()
+	if lookbackDays <= 0 {
+		lookbackDays = defaultDeduplicationLookbackDays
+	}
+	limit := int(req.GetMaxInvocations())
+	if limit <= 0 {
+		limit = defaultDeduplicationInvocations
+	}
+	if limit > maxDeduplicationInvocations {
+		limit = maxDeduplicationInvocations
+	}
+	cutoff := env.GetClock().Now().Add(-time.Duration(lookbackDays) * 24 * time.Hour)
+
+	var invocations []*tables.Invocation
+	err = env.GetDBHandle().WithContext(ctx).
+		Where("group_id = ? AND created_at_usec >= ? AND invocation_status <> ? AND archive_status = ?",
+			groupID, timeutil.ToUsec(cutoff), int64(inpb.Invocation_PARTIAL_INVOCATION_STATUS), int64(inpb.Invocation_NOT_ARCHIVED)).
+		Order("created_at_usec DESC").
+		Limit(limit).
+		Find(&invocations).Error
+	if err != nil {
+		return nil, status.InternalErrorf("failed to look up invocations: %s", err)
+	}
+
+	r := &deduplicationReport{
+		rsp:           &inpb.GetArtifactDeduplicationReportResponse{},
+		artifacts:     make(map[string]*artifactStats),
+		uniqueIndexes: make(map[string]bool),
+	}
+	for _, ti := range invocations {
+		if err := r.addInvocation(ctx, env, ti); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			log.Warningf("Could not analyze the artifacts of invocation %s: %s", ti.InvocationID, err)
+		}
+	}
+
+	var duplicated []*artifactStats
+	for _, a := range r.artifacts {
+		if a.invocationCount > 1 {
+			duplicated = append(duplicated, a)
+		}
+	}
+	extraBytes := func(a *artifactStats) int64 {
+		return a.digest.GetSizeBytes() * (a.invocationCount - 1)
+	}
+	sort.Slice(duplicated, func(i, j int) bool {
+		if extraBytes(duplicated[i]) != extraBytes(duplicated[j]) {
+			return extraBytes(duplicated[i]) > extraBytes(duplicated[j])
+		}
+		return duplicated[i].digest.GetHash() < duplicated[j].digest.GetHash()
+	})
+	if len(duplicated) > maxDuplicatedArtifactsInReport {
+		duplicated = duplicated[:maxDuplicatedArtifactsInReport]
+	}
+	for _, a := range duplicated {
+		r.rsp.DuplicatedArtifact = append(r.rsp.DuplicatedArtifact, &inpb.DuplicatedArtifact{
+			Name:            a.name,
+			Digest:          formatDigest(a.digest),
+			SizeBytes:       a.digest.GetSizeBytes(),
+			InvocationCount: a.invocationCount,
+		})
+	}
+	return r.rsp, nil
+}
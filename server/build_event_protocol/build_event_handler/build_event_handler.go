@@ -7,17 +7,23 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/accumulator"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_status_reporter"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/event_compat"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/event_parser"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/redact"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/target_tracker"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/hit_tracker"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/client_version"
+	"github.com/buildbuddy-io/buildbuddy/server/util/failure_clusters"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/protofile"
@@ -39,16 +45,58 @@ import (
 
 const (
 	defaultChunkFileSizeBytes = 1000 * 100 // 100KB
+
+	// The build metadata key holding the branch that an invocation built.
+	gitBranchMetadataKey = "GIT_BRANCH"
 )
 
 type BuildEventHandler struct {
-	env environment.Env
+	env     environment.Env
+	shedder *loadShedder
+	// Set if groups may forward their build events to their own server.
+	forwarding *forwardingClients
+	// How often the DB rows of in-progress invocations are updated.
+	checkpointInterval time.Duration
+	// Set if build events are handled by a pool of workers rather than on
+	// the streams that received them.
+	workers *eventWorkers
+	// Redacts secrets from build events before they're stored.
+	redactor *redact.Redactor
 }
 
 func NewBuildEventHandler(env environment.Env) *BuildEventHandler {
-	return &BuildEventHandler{
-		env: env,
+	b := &BuildEventHandler{
+		env:                env,
+		shedder:            newLoadShedder(env.GetConfigurator().GetAppMaxConcurrentBuildEvents()),
+		checkpointInterval: defaultCheckpointInterval,
+	}
+	if interval := env.GetConfigurator().GetAppInvocationCheckpointInterval(); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			log.Errorf("Invalid app.invocation_checkpoint_interval %q, using the default of %s", interval, defaultCheckpointInterval)
+		} else {
+			b.checkpointInterval = d
+		}
+	}
+	if env.GetConfigurator().GetBuildEventProxyEnableGroupForwarding() {
+		b.forwarding = newForwardingClients(env)
+	}
+	if n := env.GetConfigurator().GetAppBuildEventWorkers(); n > 0 {
+		b.workers = newEventWorkers(n, env.GetConfigurator().GetAppBuildEventWorkerQueueSize())
+	}
+	b.redactor = newRedactor(env)
+	return b
+}
+
+// newRedactor returns a redactor for the configured secrets. If the config is
+// invalid, only well-known secrets are redacted.
+func newRedactor(env environment.Env) *redact.Redactor {
+	redactor, err := redact.NewRedactor(env.GetConfigurator().GetStorageRedactionConfig())
+	if err != nil {
+		log.Errorf("Only redacting well-known secrets from build events: %s", err)
+		redactor, _ = redact.NewRedactor(nil)
 	}
+	return redactor
 }
 
 func (b *BuildEventHandler) OpenChannel(ctx context.Context, iid string) interfaces.BuildEventChannel {
@@ -57,13 +105,24 @@ func (b *BuildEventHandler) OpenChannel(ctx context.Context, iid string) interfa
 		chunkFileSizeBytes = defaultChunkFileSizeBytes
 	}
 	buildEventAccumulator := accumulator.NewBEValues(iid)
+	versionPolicy, err := client_version.NewPolicyFromConfig(b.env.GetConfigurator())
+	if err != nil {
+		log.Errorf("Not enforcing client versions: %s", err)
+	}
 	return &EventChannel{
 		env:                     b.env,
 		ctx:                     ctx,
-		pw:                      protofile.NewBufferedProtoWriter(b.env.GetBlobstore(), iid, chunkFileSizeBytes),
+		iid:                     iid,
+		chunkFileSizeBytes:      chunkFileSizeBytes,
 		beValues:                buildEventAccumulator,
 		statusReporter:          build_status_reporter.NewBuildStatusReporter(b.env, buildEventAccumulator),
 		targetTracker:           target_tracker.NewTargetTracker(b.env, buildEventAccumulator),
+		versionPolicy:           versionPolicy,
+		shedder:                 b.shedder,
+		forwarding:              b.forwarding,
+		workers:                 b.workers,
+		redactor:                b.redactor,
+		progress:                progressTracker{interval: b.checkpointInterval},
 		hasReceivedStartedEvent: false,
 		eventsBeforeStarted:     make([]*inpb.InvocationEvent, 0),
 	}
@@ -85,6 +144,24 @@ func isStartedEvent(bazelBuildEvent *build_event_stream.BuildEvent) bool {
 	return false
 }
 
+// warningEvent returns a progress event which shows the given warning in the
+// invocation's console output, at the time of the event that caused it. Like
+// every stored event, it's given a sequence number of its own once it's
+// processed (see nextSequenceNumber).
+func warningEvent(event *inpb.InvocationEvent, warning string) *inpb.InvocationEvent {
+	return &inpb.InvocationEvent{
+		EventTime: event.EventTime,
+		BuildEvent: &build_event_stream.BuildEvent{
+			Payload: &build_event_stream.BuildEvent_Progress{
+				Progress: &build_event_stream.Progress{
+					// Formatted the same way as Bazel's own warnings.
+					Stderr: fmt.Sprintf("\x1b[35mWARNING: \x1b[0m%s\n", warning),
+				},
+			},
+		},
+	}
+}
+
 func isWorkspaceStatusEvent(bazelBuildEvent *build_event_stream.BuildEvent) bool {
 	switch bazelBuildEvent.Payload.(type) {
 	case *build_event_stream.BuildEvent_WorkspaceStatus:
@@ -102,24 +179,88 @@ func readBazelEvent(obe *pepb.OrderedBuildEvent, out *build_event_stream.BuildEv
 }
 
 type EventChannel struct {
-	ctx                     context.Context
-	env                     environment.Env
-	pw                      *protofile.BufferedProtoWriter
+	ctx                context.Context
+	env                environment.Env
+	iid                string
+	chunkFileSizeBytes int
+	// The path that events are written to in the blobstore. It is only
+	// known once the invocation has been authenticated, since it may include
+	// the invocation's group.
+	blobPath string
+	pw       *protofile.BufferedProtoWriter
+	groupID  string
+	// The sequence number of the last event processed. Events are
+	// renumbered as they're processed, rather than keeping Bazel's sequence
+	// numbers, since warnings are added between Bazel's events.
+	lastSequenceNumber int64
+	// The number of events and bytes of events stored so far.
+	storedEvents int64
+	storedBytes  int64
+	// Set once events are dropped because the invocation exceeded its
+	// storage limits, along with the last dropped event and the number of
+	// dropped events that a truncation marker has been stored for.
+	truncation              *inpb.InvocationTruncation
+	lastDroppedEvent        *inpb.InvocationEvent
+	markedDroppedEventCount int64
 	beValues                *accumulator.BEValues
 	statusReporter          *build_status_reporter.BuildStatusReporter
 	targetTracker           *target_tracker.TargetTracker
+	versionPolicy           *client_version.Policy
+	// Upgrades the events of older Bazel versions, once the version is known
+	// from the started event.
+	eventUpgrader           *event_compat.Upgrader
 	eventsBeforeStarted     []*inpb.InvocationEvent
 	hasReceivedStartedEvent bool
+	// Custom events received on the stream, which are stored once the
+	// stream completes.
+	customEvents []*inpb.CustomInvocationEvent
+	uploadLag    uploadLagTracker
+	progress     progressTracker
+	shedder      *loadShedder
+	redactor     *redact.Redactor
+	// Progress events whose handling was deferred because the app was
+	// overloaded.
+	deferredEvents []*inpb.InvocationEvent
+	// The stream that events are forwarded on to the build event protocol
+	// server of the invocation's group, if it has one. Until it's known
+	// whether it does, the events to forward are held on to.
+	forwarding         *forwardingClients
+	forwardingTarget   string
+	forwardingClient   *forwardingClient
+	forwardingStream   pepb.PublishBuildEvent_PublishBuildToolEventStreamClient
+	forwardingResolved bool
+	unforwardedEvents  []*pepb.PublishBuildToolEventStreamRequest
+	// Set if events are handled by a pool of workers, in which case
+	// HandleEvent queues them up, and the invocation is only marked
+	// disconnected or finalized once they have been handled. The first
+	// error handling them is returned by the next call to HandleEvent or
+	// FinalizeInvocation.
+	workers       *eventWorkers
+	pendingEvents sync.WaitGroup
+	mu            sync.Mutex // protects workerErr
+	workerErr     error
+}
+
+func (e *EventChannel) flush(ctx context.Context) error {
+	if e.pw == nil {
+		// No events have been written yet.
+		return nil
+	}
+	return e.pw.Flush(ctx)
 }
 
 func (e *EventChannel) fillInvocationFromEvents(ctx context.Context, iid string, invocation *inpb.Invocation) error {
-	pr := protofile.NewBufferedProtoReader(e.env.GetBlobstore(), iid)
 	parser := event_parser.NewStreamingEventParser()
 	parser.FillInvocation(invocation)
+	if e.pw == nil {
+		return nil
+	}
+	pr := protofile.NewBufferedProtoReader(e.env.GetBlobstore(), e.blobPath)
 	for {
 		event := &inpb.InvocationEvent{}
 		err := pr.ReadProto(ctx, event)
 		if err == nil {
+			resolveArtifactIndex(ctx, e.env, e.groupID, iid, event)
 			parser.ParseEvent(event)
 		} else if err == io.EOF {
 			break
@@ -142,9 +283,21 @@ func (e *EventChannel) writeCompletedBlob(ctx context.Context, blobID string, in
 }
 
 func (e *EventChannel) MarkInvocationDisconnected(ctx context.Context, iid string) error {
+	e.pendingEvents.Wait()
+	e.closeForwardingStream()
+	if err := e.processDeferredEvents(iid); err != nil {
+		return err
+	}
+	if e.isCustomEventStream() {
+		// The invocation is still owned by Bazel's stream.
+		return nil
+	}
 	e.statusReporter.ReportDisconnect(ctx)
 
-	if err := e.pw.Flush(ctx); err != nil {
+	if err := e.writeTruncationMarker(ctx); err != nil {
+		return err
+	}
+	if err := e.flush(ctx); err != nil {
 		return err
 	}
 	invocation := &inpb.Invocation{
@@ -156,9 +309,20 @@ func (e *EventChannel) MarkInvocationDisconnected(ctx context.Context, iid strin
 	if err != nil {
 		return err
 	}
+	e.uploadLag.fillInvocation(invocation)
+	e.progress.fillInvocation(invocation)
 
-	ti := tableInvocationFromProto(invocation, iid)
-	return e.env.GetInvocationDB().InsertOrUpdateInvocation(ctx, ti)
+	ti := tableInvocationFromProto(invocation, e.blobPath)
+	if e.pw != nil {
+		ti.EventStreamChecksum = e.pw.Checksum()
+	}
+	ti.StoredEventBytes = e.storedBytes
+	if err := e.env.GetInvocationDB().InsertOrUpdateInvocation(ctx, ti); err != nil {
+		return err
+	}
+	e.writeRenderModel(ctx, invocation)
+	e.markPendingPersist(ctx, iid)
+	return nil
 }
 
 func fillInvocationFromCacheStats(cacheStats *capb.CacheStats, ti *tables.Invocation) {
@@ -175,6 +339,10 @@ func fillInvocationFromCacheStats(cacheStats *capb.CacheStats, ti *tables.Invoca
 	ti.DownloadThroughputBytesPerSecond = cacheStats.GetDownloadThroughputBytesPerSecond()
 	ti.UploadThroughputBytesPerSecond = cacheStats.GetUploadThroughputBytesPerSecond()
 	ti.TotalCachedActionExecUsec = cacheStats.GetTotalCachedActionExecUsec()
+	if lookups := ti.ActionCacheHits + ti.ActionCacheMisses; lookups > 0 {
+		ti.ActionCacheHitRate = float64(ti.ActionCacheHits) / float64(lookups)
+	}
+	ti.TotalTransferSizeBytes = ti.TotalDownloadSizeBytes + ti.TotalUploadSizeBytes
 }
 
 func invocationStatusLabel(ti *tables.Invocation) string {
@@ -202,13 +370,41 @@ func recordInvocationMetrics(ti *tables.Invocation) {
 	}).Observe(float64(ti.DurationUsec))
 }
 
+// extractFailures returns the distinct failures printed to the invocation's
+// console, so that they can be clustered with those of other invocations.
+func extractFailures(invocation *inpb.Invocation) []*tables.InvocationFailure {
+	var failures []*tables.InvocationFailure
+	for _, f := range failure_clusters.Extract(invocation.GetConsoleBuffer()) {
+		failures = append(failures, &tables.InvocationFailure{
+			Fingerprint: f.Fingerprint,
+			Label:       f.Label,
+			Snippet:     f.Snippet,
+		})
+	}
+	return failures
+}
+
 func md5Int64(text string) int64 {
 	hash := md5.Sum([]byte(text))
 	return int64(binary.BigEndian.Uint64(hash[:8]))
 }
 
 func (e *EventChannel) FinalizeInvocation(iid string) error {
-	if err := e.pw.Flush(e.ctx); err != nil {
+	e.pendingEvents.Wait()
+	if err := e.getWorkerErr(); err != nil {
+		return err
+	}
+	e.closeForwardingStream()
+	if e.isCustomEventStream() {
+		return e.writeCustomEvents(e.ctx, iid)
+	}
+	if err := e.processDeferredEvents(iid); err != nil {
+		return err
+	}
+	if err := e.writeTruncationMarker(e.ctx); err != nil {
+		return err
+	}
+	if err := e.flush(e.ctx); err != nil {
 		return err
 	}
 	invocation := &inpb.Invocation{
@@ -219,15 +415,38 @@ func (e *EventChannel) FinalizeInvocation(iid string) error {
 	if err != nil {
 		return err
 	}
+	e.uploadLag.fillInvocation(invocation)
+	e.progress.fillInvocation(invocation)
 
-	ti := tableInvocationFromProto(invocation, iid)
-	if cacheStats := hit_tracker.CollectCacheStats(e.ctx, e.env, iid); cacheStats != nil {
+	ti := tableInvocationFromProto(invocation, e.blobPath)
+	if e.pw != nil {
+		ti.EventStreamChecksum = e.pw.Checksum()
+	}
+	ti.StoredEventBytes = e.storedBytes
+	cacheStats := hit_tracker.CollectCacheStats(e.ctx, e.env, iid)
+	if cacheStats != nil {
 		fillInvocationFromCacheStats(cacheStats, ti)
 	}
 	recordInvocationMetrics(ti)
 	if err := e.env.GetInvocationDB().InsertOrUpdateInvocation(e.ctx, ti); err != nil {
 		return err
 	}
+	if err := e.env.GetInvocationDB().InsertInvocationBuildMetadata(e.ctx, iid, e.beValues.BuildMetadata()); err != nil {
+		log.Warningf("Error recording build metadata for invocation %s: %s", iid, err)
+	}
+	if err := e.env.GetInvocationDB().AddInvocationTags(e.ctx, iid, invocation.Tag); err != nil {
+		log.Warningf("Error recording tags for invocation %s: %s", iid, err)
+	}
+	if !invocation.GetSuccess() {
+		if err := e.env.GetInvocationDB().InsertInvocationFailures(e.ctx, iid, extractFailures(invocation)); err != nil {
+			log.Warningf("Error recording failures for invocation %s: %s", iid, err)
+		}
+	}
+	if err := e.writeCustomEvents(e.ctx, iid); err != nil {
+		log.Warningf("Error recording custom events for invocation %s: %s", iid, err)
+	}
+	e.writeRenderModel(e.ctx, invocation)
+	e.markPendingPersist(e.ctx, iid)
 
 	// Notify our webhooks, if we have any.
 	for _, hook := range e.env.GetWebhooks() {
@@ -240,6 +459,23 @@ func (e *EventChannel) FinalizeInvocation(iid string) error {
 			}
 		}()
 	}
+	if router := e.env.GetNotificationRouter(); router != nil {
+		branch := e.beValues.BuildMetadata()[gitBranchMetadataKey]
+		go func() {
+			if err := router.NotifyInvocationComplete(context.Background(), e.groupID, branch, invocation); err != nil {
+				log.Warningf("Error sending notifications for invocation %s: %s", iid, err)
+			}
+		}()
+	}
+	e.checkCacheHitRate(e.ctx, invocation, cacheStats)
+	for _, hook := range e.env.GetBuildEventHooks() {
+		hook := hook // copy loopvar to local var for closure capture
+		go func() {
+			if err := hook.OnInvocationFinished(context.Background(), invocation); err != nil {
+				log.Warningf("Error calling build event hook for invocation %s: %s", iid, err)
+			}
+		}()
+	}
 	if searcher := e.env.GetInvocationSearchService(); searcher != nil {
 		go func() {
 			if err := searcher.IndexInvocation(context.Background(), invocation); err != nil {
@@ -247,12 +483,59 @@ func (e *EventChannel) FinalizeInvocation(iid string) error {
 			}
 		}()
 	}
+	if index := e.env.GetConsoleLogIndex(); index != nil {
+		go func() {
+			if err := index.IndexConsoleLog(context.Background(), e.groupID, invocation); err != nil {
+				log.Warningf("Error indexing console log of invocation %s: %s", iid, err)
+			}
+		}()
+	}
 	return nil
 }
 
 func (e *EventChannel) HandleEvent(event *pepb.PublishBuildToolEventStreamRequest) error {
+	if e.workers == nil {
+		return e.processEvent(event, e.shedder.begin())
+	}
+	if err := e.getWorkerErr(); err != nil {
+		return err
+	}
+	// Queued events count towards the app's load, so that it sheds load
+	// once the workers fall behind.
+	done := e.shedder.begin()
+	e.pendingEvents.Add(1)
+	e.workers.submit(e.iid, func() {
+		defer e.pendingEvents.Done()
+		if e.getWorkerErr() != nil {
+			// The stream is failing, so there's no point handling the
+			// events after the one that failed.
+			done()
+			return
+		}
+		if err := e.processEvent(event, done); err != nil {
+			e.mu.Lock()
+			e.workerErr = err
+			e.mu.Unlock()
+		}
+	})
+	return nil
+}
+
+func (e *EventChannel) getWorkerErr() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.workerErr
+}
+
+// processEvent handles and forwards an event, calling done once it has been
+// handled.
+func (e *EventChannel) processEvent(event *pepb.PublishBuildToolEventStreamRequest, done func()) error {
 	tStart := time.Now()
 	err := e.handleEvent(event)
+	done()
+	if err == nil {
+		e.forwardEvent(event)
+	}
 	duration := time.Since(tStart)
 	labels := prometheus.Labels{
 		metrics.StatusLabel: fmt.Sprintf("%d", gstatus.Code(err)),
@@ -270,12 +553,16 @@ func (e *EventChannel) handleEvent(event *pepb.PublishBuildToolEventStreamReques
 	if isFinalEvent(event.OrderedBuildEvent) {
 		return nil
 	}
+	if isCustomEvent(event.OrderedBuildEvent) {
+		return e.collectCustomEvent(event.OrderedBuildEvent)
+	}
 
 	var bazelBuildEvent build_event_stream.BuildEvent
 	if err := readBazelEvent(event.OrderedBuildEvent, &bazelBuildEvent); err != nil {
 		log.Warningf("error reading bazel event: %s", err)
 		return err
 	}
+	e.uploadLag.observe(&bazelBuildEvent, event.OrderedBuildEvent.Event.EventTime, time.Now())
 
 	invocationEvent := &inpb.InvocationEvent{
 		EventTime:      event.OrderedBuildEvent.Event.EventTime,
@@ -283,6 +570,8 @@ func (e *EventChannel) handleEvent(event *pepb.PublishBuildToolEventStreamReques
 		SequenceNumber: event.OrderedBuildEvent.SequenceNumber,
 	}
 
+	versionWarning := ""
+
 	// If this is the first event, keep track of the project ID and save any notification keywords.
 	if isStartedEvent(&bazelBuildEvent) {
 		e.hasReceivedStartedEvent = true
@@ -291,13 +580,25 @@ func (e *EventChannel) handleEvent(event *pepb.PublishBuildToolEventStreamReques
 			InvocationID:     iid,
 			InvocationPK:     md5Int64(iid),
 			InvocationStatus: int64(inpb.Invocation_PARTIAL_INVOCATION_STATUS),
+			BazelVersion:     bazelBuildEvent.GetStarted().GetBuildToolVersion(),
 		}
 
+		warning, err := e.versionPolicy.Check(ti.BazelVersion)
+		if err != nil {
+			return err
+		}
+		versionWarning = warning
+		e.eventUpgrader = event_compat.NewUpgrader(ti.BazelVersion)
+
+		// The API key is read from the options before the event is redacted,
+		// which happens before anything else sees it, including the hooks
+		// called below.
+		options, err := extractOptionsFromStartedBuildEvent(&bazelBuildEvent)
+		if err != nil {
+			return err
+		}
+		e.redactor.RedactEvent(&bazelBuildEvent)
 		if auth := e.env.GetAuthenticator(); auth != nil {
-			options, err := extractOptionsFromStartedBuildEvent(&bazelBuildEvent)
-			if err != nil {
-				return err
-			}
 			if apiKey := auth.ParseAPIKeyFromString(options); apiKey != "" {
 				e.ctx = auth.AuthContextFromAPIKey(e.ctx, apiKey)
 				authError := e.ctx.Value(interfaces.AuthContextUserErrorKey)
@@ -310,9 +611,31 @@ func (e *EventChannel) handleEvent(event *pepb.PublishBuildToolEventStreamReques
 			}
 		}
 
+		groupID := ""
+		if u, err := perms.AuthenticatedUser(e.ctx, e.env); err == nil {
+			groupID = u.GetGroupID()
+		}
+		e.groupID = groupID
+		e.statusReporter.SetGroupID(groupID)
+		if e.shedder.shouldShed(invocationStartPriority(groupID, options)) {
+			return overloadedError()
+		}
+		if err := e.checkGroupQuota(e.ctx); err != nil {
+			return err
+		}
+		e.blobPath = blobstore.InvocationBlobPath(e.env.GetConfigurator().GetStorageBlobPathTemplate(), iid, groupID, time.Now())
+		e.pw = protofile.NewBufferedProtoWriter(e.env.GetBlobstore(), e.blobPath, e.chunkFileSizeBytes)
+		ti.BlobID = e.blobPath
+		ti.BlobBackendID = blobstore.WriteBackendID(e.env)
+
 		if err := e.env.GetInvocationDB().InsertOrUpdateInvocation(e.ctx, ti); err != nil {
 			return err
 		}
+		for _, hook := range e.env.GetBuildEventHooks() {
+			if err := hook.OnInvocationStarted(e.ctx, iid, invocationEvent); err != nil {
+				log.Warningf("Error calling build event hook for invocation %s: %s", iid, err)
+			}
+		}
 	} else if !e.hasReceivedStartedEvent {
 		e.eventsBeforeStarted = append(e.eventsBeforeStarted, invocationEvent)
 		if len(e.eventsBeforeStarted) > 10 {
@@ -330,30 +653,72 @@ func (e *EventChannel) handleEvent(event *pepb.PublishBuildToolEventStreamReques
 	}
 	e.eventsBeforeStarted = nil
 
-	// Process regular events.
-	return e.processSingleEvent(invocationEvent, iid)
+	// Process regular events, deferring progress events if overloaded.
+	if e.deferProgressEvent(invocationEvent) {
+		return nil
+	}
+	if !e.shedder.overloaded(progressPriority) {
+		if err := e.processDeferredEvents(iid); err != nil {
+			return err
+		}
+	}
+	if err := e.processSingleEvent(invocationEvent, iid); err != nil {
+		return err
+	}
+	if versionWarning != "" {
+		return e.processSingleEvent(warningEvent(invocationEvent, versionWarning), iid)
+	}
+	return nil
+}
+
+// nextSequenceNumber returns the sequence number of the next event stored
+// for the invocation.
+func (e *EventChannel) nextSequenceNumber() int64 {
+	e.lastSequenceNumber++
+	return e.lastSequenceNumber
 }
 
 func (e *EventChannel) processSingleEvent(event *inpb.InvocationEvent, iid string) error {
+	event.SequenceNumber = e.nextSequenceNumber()
+	for _, shim := range e.eventUpgrader.Upgrade(event.BuildEvent) {
+		metrics.BuildEventHandlerUpgradedEvents.With(prometheus.Labels{metrics.BuildEventShimLabel: shim}).Inc()
+	}
+	// Secrets are redacted before the event is seen by anything else, so
+	// that they're never stored or passed to hooks.
+	e.redactor.RedactEvent(event.BuildEvent)
 	e.beValues.AddEvent(event.BuildEvent) // in-memory structure to hold common values we want from the event.
 
 	if e.env.GetConfigurator().EnableTargetTracking() {
 		e.targetTracker.TrackTargetsForEvent(e.ctx, event.BuildEvent)
 	}
 	e.statusReporter.ReportStatusForEvent(e.ctx, event.BuildEvent)
+	for _, hook := range e.env.GetBuildEventHooks() {
+		if err := hook.OnBuildEvent(e.ctx, iid, event); err != nil {
+			log.Warningf("Error calling build event hook for invocation %s: %s", iid, err)
+		}
+	}
 
-	// For everything else, just save the event to our buffer and keep on chugging.
-	err := e.pw.WriteProtoToStream(e.ctx, event)
-	if err != nil {
+	// Sizing an event walks all of its fields, so it's only done once.
+	size := int64(proto.Size(event))
+	if err := e.recordGroupUsage(e.ctx, size); err != nil {
 		return err
 	}
 
+	// For everything else, just save the event to our buffer and keep on chugging.
+	if e.applyStorageQuota(event, size) {
+		if err := e.pw.WriteProtoToStream(e.ctx, e.storeArtifactIndexByReference(e.ctx, event)); err != nil {
+			return err
+		}
+	}
+	e.updateProgress(e.ctx, iid, event.BuildEvent)
+
 	// Small optimization: Flush the event stream after the workspace status event. Most of the
 	// command line options and workspace info has come through by then, so we have
 	// something to show the user. Flushing the proto file here allows that when the
-	// client fetches status for the incomplete build. Also flush if we haven't in over a minute.
-	if isWorkspaceStatusEvent(event.BuildEvent) || e.pw.TimeSinceLastWrite().Minutes() > 1 {
-		if err := e.pw.Flush(e.ctx); err != nil {
+	// client fetches status for the incomplete build. After that, the event stream is
+	// flushed whenever the invocation is checkpointed.
+	if isWorkspaceStatusEvent(event.BuildEvent) {
+		if err := e.flush(e.ctx); err != nil {
 			return err
 		}
 	}
@@ -365,6 +730,12 @@ func (e *EventChannel) processSingleEvent(event *inpb.InvocationEvent, iid strin
 			return err
 		}
 	}
+	if event.BuildEvent.GetBuildToolLogs() != nil {
+		e.retainTimingProfile(e.ctx, event.BuildEvent, iid)
+	}
+	if warning := e.applyCacheNamespaceOverride(e.ctx, event.BuildEvent, iid); warning != "" {
+		return e.processSingleEvent(warningEvent(event, warning), iid)
+	}
 
 	return nil
 }
@@ -395,9 +766,28 @@ func extractOptionsFromStartedBuildEvent(event *build_event_stream.BuildEvent) (
 }
 
 func LookupInvocation(env environment.Env, ctx context.Context, iid string) (*inpb.Invocation, error) {
+	invocation, _, err := lookupInvocation(env, ctx, iid, nil)
+	return invocation, err
+}
+
+// LookupInvocationPage looks up an invocation like LookupInvocation, but only
+// returns a page of its events, starting at the given page token. It returns
+// the token of the next page, or "" if there are no more events.
+func LookupInvocationPage(env environment.Env, ctx context.Context, iid, pageToken string, pageSize int) (*inpb.Invocation, string, error) {
+	page, err := parseEventPage(pageToken, pageSize)
+	if err != nil {
+		return nil, "", err
+	}
+	return lookupInvocation(env, ctx, iid, page)
+}
+
+// lookupInvocation looks up an invocation with all of its events, or only the
+// given page of them if page is set, in which case the next page token is
+// returned too.
+func lookupInvocation(env environment.Env, ctx context.Context, iid string, page *eventPage) (*inpb.Invocation, string, error) {
 	ti, err := env.GetInvocationDB().LookupInvocation(ctx, iid)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	// If this is an incomplete invocation, attempt to fill cache stats
@@ -411,22 +801,119 @@ func LookupInvocation(env environment.Env, ctx context.Context, iid string) (*in
 
 	invocation := TableInvocationToProto(ti)
 
+	// The tags of completed invocations are recorded when they're finalized
+	// and may be changed afterwards, so they're read from the DB rather than
+	// from the invocation's events.
+	var storedTags []string
+	hasStoredTags := false
+	if ti.InvocationStatus != int64(inpb.Invocation_PARTIAL_INVOCATION_STATUS) {
+		if tagsByInvocation, err := env.GetInvocationDB().LookupInvocationTags(ctx, []string{iid}); err != nil {
+			log.Warningf("Error reading tags for invocation %s: %s", iid, err)
+		} else {
+			storedTags = tagsByInvocation[iid]
+			hasStoredTags = true
+		}
+	}
+
+	// Completed invocations no longer change (apart from their ACL and tags,
+	// which are re-applied from the DB above), so they can be served from the
+	// in-memory cache rather than re-parsed from the blobstore. Pages of
+	// events are always read from the blobstore, as they're used for
+	// invocations too large to hold on to.
+	ic := env.GetInvocationCache()
+	cacheable := ic != nil && ti.InvocationStatus != int64(inpb.Invocation_PARTIAL_INVOCATION_STATUS) && page == nil
+	if cacheable {
+		if cached, ok := ic.Get(iid, ti.UpdatedAtUsec); ok {
+			cached.ReadPermission = invocation.ReadPermission
+			cached.Acl = invocation.Acl
+			if hasStoredTags {
+				cached.Tag = storedTags
+			}
+			return cached, "", nil
+		}
+	}
+
+	// Archived invocations are returned without their events while they're
+	// being restored.
+	if ti.ArchiveStatus != int64(inpb.Invocation_NOT_ARCHIVED) {
+		restoreArchivedInvocation(env, ti)
+		invocation.ArchiveStatus = inpb.Invocation_RESTORING
+		if hasStoredTags {
+			invocation.Tag = storedTags
+		}
+		return invocation, "", nil
+	}
+
+	bs, err := blobstore.ForBackend(env, ti.BlobBackendID)
+	if err != nil {
+		return nil, "", err
+	}
+	blobPath := ti.BlobID
+	if blobPath == "" {
+		blobPath = iid
+	}
 	parser := event_parser.NewStreamingEventParser()
-	pr := protofile.NewBufferedProtoReader(env.GetBlobstore(), iid)
+	pr := protofile.NewBufferedProtoReader(bs, blobPath)
+	if ti.InvocationStatus != int64(inpb.Invocation_PARTIAL_INVOCATION_STATUS) {
+		pr.VerifyChecksum(ti.EventStreamChecksum)
+	}
+	// The whole event stream is parsed even if only a page of it is returned,
+	// since the invocation's details are filled in (and redacted) from all
+	// of its events.
+	eventCount := 0
 	for {
 		event := &inpb.InvocationEvent{}
 		err := pr.ReadProto(ctx, event)
 		if err == nil {
-			parser.ParseEvent(event)
+			if page.contains(eventCount) {
+				resolveArtifactIndex(ctx, env, ti.GroupID, iid, event)
+				parser.ParseEvent(event)
+			} else {
+				parser.ParseEventWithoutStoring(event)
+			}
+			eventCount++
 		} else if err == io.EOF {
 			break
 		} else {
+			if status.IsDataLossError(err) {
+				metrics.InvocationCorruptedEventStreamCount.Inc()
+				log.Errorf("Invocation %s's build events are corrupted: %s", iid, err)
+				return nil, "", status.DataLossErrorf("The build events of invocation %s are corrupted.", iid)
+			}
 			log.Warningf("Error reading proto from log: %s", err)
-			return nil, err
+			return nil, "", err
 		}
 	}
+	// The target counts of in-progress invocations are written to the DB more
+	// often than their events are flushed to the blobstore, so the DB's counts
+	// are used if they're further along. Likewise, their duration so far is
+	// only known from the DB, since they have no finished event yet.
+	dbProgress := invocation.Progress
+	dbDurationUsec := invocation.DurationUsec
 	parser.FillInvocation(invocation)
-	return invocation, nil
+	if ti.InvocationStatus == int64(inpb.Invocation_PARTIAL_INVOCATION_STATUS) {
+		if dbProgress.GetCompletedTargetCount() > invocation.GetProgress().GetCompletedTargetCount() {
+			invocation.Progress = dbProgress
+		}
+		if invocation.DurationUsec == 0 {
+			invocation.DurationUsec = dbDurationUsec
+		}
+	}
+	if invocation.SlowBuildEventUpload {
+		invocation.Warning = append(invocation.Warning, slowBuildEventUploadWarning(invocation))
+	}
+	if hasStoredTags {
+		invocation.Tag = storedTags
+	}
+	customEvents, err := readCustomEvents(ctx, env, iid)
+	if err != nil {
+		log.Warningf("Error reading custom events for invocation %s: %s", iid, err)
+	}
+	invocation.CustomEvent = customEvents
+	if cacheable {
+		ic.Add(invocation)
+	}
+	return invocation, page.nextPageToken(eventCount), nil
 }
 
 // TODO(siggisim): pull this out somewhere central
@@ -448,14 +935,25 @@ func tableInvocationFromProto(p *inpb.Invocation, blobID string) *tables.Invocat
 	i.Host = p.Host
 	i.RepoURL = p.RepoUrl
 	i.CommitSHA = p.CommitSha
+	i.PullRequestNumber = p.PullRequestNumber
 	i.Role = p.Role
+	i.BazelVersion = p.BazelVersion
 	i.Command = p.Command
 	if p.Pattern != nil {
 		i.Pattern = truncatedJoin(p.Pattern, 3)
 	}
 	i.ActionCount = p.ActionCount
+	i.ConfiguredTargetCount = p.GetProgress().GetConfiguredTargetCount()
+	i.CompletedTargetCount = p.GetProgress().GetCompletedTargetCount()
+	i.FailedTargetCount = p.GetProgress().GetFailedTargetCount()
+	i.EventCount = p.EventCount
+	i.MaxBuildEventUploadLagUsec = p.MaxBuildEventUploadLagUsec
+	i.MeanBuildEventUploadLagUsec = p.MeanBuildEventUploadLagUsec
+	i.BuildEventUploadTailUsec = p.BuildEventUploadTailUsec
+	i.SlowBuildEventUpload = p.SlowBuildEventUpload
 	i.BlobID = blobID
 	i.InvocationStatus = int64(p.InvocationStatus)
+	i.ParserVersion = event_parser.Version
 	if p.ReadPermission == inpb.InvocationPermission_PUBLIC {
 		i.Perms = perms.OTHERS_READ
 	}
@@ -471,12 +969,24 @@ func TableInvocationToProto(i *tables.Invocation) *inpb.Invocation {
 	out.Host = i.Host
 	out.RepoUrl = i.RepoURL
 	out.CommitSha = i.CommitSHA
+	out.PullRequestNumber = i.PullRequestNumber
 	out.Role = i.Role
+	out.BazelVersion = i.BazelVersion
 	out.Command = i.Command
 	if i.Pattern != "" {
 		out.Pattern = strings.Split(i.Pattern, ", ")
 	}
 	out.ActionCount = i.ActionCount
+	out.Progress = event_parser.ToProgressProto(i.ConfiguredTargetCount, i.CompletedTargetCount, i.InvocationStatus == int64(inpb.Invocation_COMPLETE_INVOCATION_STATUS))
+	out.Progress.FailedTargetCount = i.FailedTargetCount
+	out.EventCount = i.EventCount
+	out.DeletedAtUsec = i.DeletedAtUsec
+	out.MaxBuildEventUploadLagUsec = i.MaxBuildEventUploadLagUsec
+	out.MeanBuildEventUploadLagUsec = i.MeanBuildEventUploadLagUsec
+	out.BuildEventUploadTailUsec = i.BuildEventUploadTailUsec
+	out.SlowBuildEventUpload = i.SlowBuildEventUpload
+	out.PendingPersist = i.PendingPersist
+	out.ArchiveStatus = inpb.Invocation_ArchiveStatus(i.ArchiveStatus)
 	// BlobID is not present in output client proto.
 	out.InvocationStatus = inpb.Invocation_InvocationStatus(i.InvocationStatus)
 	out.CreatedAtUsec = i.Model.CreatedAtUsec
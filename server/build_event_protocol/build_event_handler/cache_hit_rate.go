@@ -0,0 +1,231 @@
+package build_event_handler
+
+import (
+	"context"
+	"sort"
+
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/golang/protobuf/proto"
+
+	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+const (
+	defaultHitRateAlarmMinDrop        = 0.2
+	defaultHitRateAlarmMinInvocations = 5
+	defaultHitRateAlarmMinLookups     = 100
+	defaultHitRateAlarmWindow         = 10
+
+	// The number of newly missed mnemonics included in an alarm.
+	maxNewlyMissedMnemonics = 5
+	// The number of mnemonics whose misses are tracked in a baseline, and
+	// the average number of misses below which a mnemonic is forgotten.
+	maxBaselineMnemonics      = 100
+	minBaselineMnemonicMisses = 0.5
+)
+
+type hitRateAlarmOptions struct {
+	minDrop        float64
+	minInvocations int64
+	minLookups     int64
+	window         int64
+}
+
+func hitRateAlarmOptionsFromConfig(c *config.CacheHitRateAlarmsConfig) *hitRateAlarmOptions {
+	opts := &hitRateAlarmOptions{
+		minDrop:        c.MinDrop,
+		minInvocations: c.MinInvocations,
+		minLookups:     c.MinActionCacheLookups,
+		window:         c.Window,
+	}
+	if opts.minDrop <= 0 {
+		opts.minDrop = defaultHitRateAlarmMinDrop
+	}
+	if opts.minInvocations <= 0 {
+		opts.minInvocations = defaultHitRateAlarmMinInvocations
+	}
+	if opts.minLookups <= 0 {
+		opts.minLookups = defaultHitRateAlarmMinLookups
+	}
+	if opts.window <= 0 {
+		opts.window = defaultHitRateAlarmWindow
+	}
+	return opts
+}
+
+func actionCacheHitRate(stats *capb.CacheStats) float64 {
+	lookups := stats.GetActionCacheHits() + stats.GetActionCacheMisses()
+	if lookups == 0 {
+		return 0
+	}
+	return float64(stats.GetActionCacheHits()) / float64(lookups)
+}
+
+// compareToBaseline returns the drop in the hit rate of the invocation with
+// the given stats from the baseline, or nil if it isn't large enough to raise
+// an alarm.
+func compareToBaseline(baseline *capb.CacheHitRateBaseline, stats *capb.CacheStats, opts *hitRateAlarmOptions) *capb.CacheHitRateDrop {
+	if baseline.GetInvocationCount() < opts.minInvocations {
+		return nil
+	}
+	hitRate := actionCacheHitRate(stats)
+	if baseline.GetActionCacheHitRate()-hitRate < opts.minDrop {
+		return nil
+	}
+	drop := &capb.CacheHitRateDrop{
+		BaselineHitRate: baseline.GetActionCacheHitRate(),
+		HitRate:         hitRate,
+	}
+	for mnemonic, misses := range stats.GetActionCacheMissesByMnemonic() {
+		baselineMisses := baseline.GetActionCacheMissesByMnemonic()[mnemonic]
+		if float64(misses)-baselineMisses < 1 {
+			continue
+		}
+		drop.NewlyMissedMnemonic = append(drop.NewlyMissedMnemonic, &capb.CacheHitRateDrop_MnemonicMisses{
+			Mnemonic:       mnemonic,
+			Misses:         misses,
+			BaselineMisses: baselineMisses,
+		})
+	}
+	increase := func(m *capb.CacheHitRateDrop_MnemonicMisses) float64 {
+		return float64(m.GetMisses()) - m.GetBaselineMisses()
+	}
+	sort.Slice(drop.NewlyMissedMnemonic, func(i, j int) bool {
+		a, b := drop.NewlyMissedMnemonic[i], drop.NewlyMissedMnemonic[j]
+		if increase(a) != increase(b) {
+			return increase(a) > increase(b)
+		}
+		return a.GetMnemonic() < b.GetMnemonic()
+	})
+	if len(drop.NewlyMissedMnemonic) > maxNewlyMissedMnemonics {
+		drop.NewlyMissedMnemonic = drop.NewlyMissedMnemonic[:maxNewlyMissedMnemonics]
+	}
+	return drop
+}
+
+// foldIntoBaseline updates the moving averages of the baseline with the stats
+// of an invocation. Until the baseline has seen a window of invocations, it's
+// their plain average, so that it settles quickly.
+func foldIntoBaseline(baseline *capb.CacheHitRateBaseline, stats *capb.CacheStats, opts *hitRateAlarmOptions) {
+	weight := 2 / float64(opts.window+1)
+	if w := 1 / float64(baseline.GetInvocationCount()+1); w > weight {
+		weight = w
+	}
+	baseline.InvocationCount++
+	baseline.ActionCacheHitRate += weight * (actionCacheHitRate(stats) - baseline.GetActionCacheHitRate())
+
+	misses := make(map[string]float64, len(baseline.GetActionCacheMissesByMnemonic()))
+	for mnemonic, avg := range baseline.GetActionCacheMissesByMnemonic() {
+		misses[mnemonic] = avg
+	}
+	for mnemonic := range stats.GetActionCacheMissesByMnemonic() {
+		if _, ok := misses[mnemonic]; !ok {
+			misses[mnemonic] = 0
+		}
+	}
+	mnemonics := make([]string, 0, len(misses))
+	for mnemonic, avg := range misses {
+		avg += weight * (float64(stats.GetActionCacheMissesByMnemonic()[mnemonic]) - avg)
+		if avg < minBaselineMnemonicMisses {
+			delete(misses, mnemonic)
+			continue
+		}
+		misses[mnemonic] = avg
+		mnemonics = append(mnemonics, mnemonic)
+	}
+	if len(mnemonics) > maxBaselineMnemonics {
+		sort.Slice(mnemonics, func(i, j int) bool {
+			return misses[mnemonics[i]] > misses[mnemonics[j]]
+		})
+		for _, mnemonic := range mnemonics[maxBaselineMnemonics:] {
+			delete(misses, mnemonic)
+		}
+	}
+	baseline.ActionCacheMissesByMnemonic = misses
+}
+
+// updateCacheHitRateBaseline folds the stats of an invocation into the
+// baseline of its group's repo and branch, and returns the drop in its hit
+// rate from the baseline if it should raise an alarm.
+func updateCacheHitRateBaseline(ctx context.Context, env environment.Env, groupID, repoURL, branch string, stats *capb.CacheStats, opts *hitRateAlarmOptions) (*capb.CacheHitRateDrop, error) {
+	var drop *capb.CacheHitRateDrop
+	err := env.GetDBHandle().Transaction(ctx, func(tx *db.DB) error {
+		row := &tables.CacheHitRateBaseline{}
+		err := tx.Where("group_id = ? AND repo_url = ? AND branch = ?", groupID, repoURL, branch).First(row).Error
+		exists := err == nil
+		if err != nil && !db.IsRecordNotFound(err) {
+			return err
+		}
+		baseline := &capb.CacheHitRateBaseline{}
+		if exists {
+			if err := proto.Unmarshal(row.SerializedBaseline, baseline); err != nil {
+				log.Warningf("Discarding unreadable cache hit rate baseline of %s@%s: %s", repoURL, branch, err)
+				baseline = &capb.CacheHitRateBaseline{}
+			}
+		}
+		drop = compareToBaseline(baseline, stats, opts)
+		foldIntoBaseline(baseline, stats, opts)
+		data, err := proto.Marshal(baseline)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return tx.Create(&tables.CacheHitRateBaseline{
+				GroupID:            groupID,
+				RepoURL:            repoURL,
+				Branch:             branch,
+				SerializedBaseline: data,
+			}).Error
+		}
+		return tx.Model(row).Where("group_id = ? AND repo_url = ? AND branch = ?", groupID, repoURL, branch).Updates(&tables.CacheHitRateBaseline{SerializedBaseline: data}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if drop != nil {
+		drop.RepoUrl = repoURL
+		drop.Branch = branch
+	}
+	return drop, nil
+}
+
+// checkCacheHitRate compares the action cache hit rate of a completed
+// invocation with the rolling hit rate of its repo and branch, and sends
+// cache_hit_rate_drop notifications if it dropped, which usually means that a
+// change to the toolchain or rules broke caching.
+func (e *EventChannel) checkCacheHitRate(ctx context.Context, invocation *inpb.Invocation, stats *capb.CacheStats) {
+	conf := e.env.GetConfigurator().GetIntegrationsNotificationsConfig().CacheHitRateAlarms
+	if !conf.Enabled || stats == nil || e.groupID == "" || invocation.GetRepoUrl() == "" {
+		return
+	}
+	opts := hitRateAlarmOptionsFromConfig(&conf)
+	if stats.GetActionCacheHits()+stats.GetActionCacheMisses() < opts.minLookups {
+		return
+	}
+	iid := invocation.GetInvocationId()
+	branch := e.beValues.BuildMetadata()[gitBranchMetadataKey]
+	drop, err := updateCacheHitRateBaseline(ctx, e.env, e.groupID, invocation.GetRepoUrl(), branch, stats, opts)
+	if err != nil {
+		log.Warningf("Error updating cache hit rate baseline for invocation %s: %s", iid, err)
+		return
+	}
+	if drop == nil {
+		return
+	}
+	log.Infof("Action cache hit rate of invocation %s dropped to %.2f from %.2f", iid, drop.GetHitRate(), drop.GetBaselineHitRate())
+	router := e.env.GetNotificationRouter()
+	if router == nil {
+		return
+	}
+	groupID := e.groupID
+	go func() {
+		if err := router.NotifyCacheHitRateDrop(context.Background(), groupID, invocation, drop); err != nil {
+			log.Warningf("Error sending cache hit rate notifications for invocation %s: %s", iid, err)
+		}
+	}()
+}
@@ -0,0 +1,41 @@
+package build_event_handler
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+)
+
+// applyCacheNamespaceOverride checks the cache namespace requested by the
+// invocation's build metadata, if any, against the policy of the
+// invocation's group, and directs the invocation's cache requests to that
+// namespace if it is allowed. It returns a warning to show in the invocation
+// if the namespace couldn't be used.
+func (e *EventChannel) applyCacheNamespaceOverride(ctx context.Context, event *build_event_stream.BuildEvent, iid string) string {
+	ns, ok := event.GetBuildMetadata().GetMetadata()[namespace.OverrideMetadataKey]
+	if !ok || ns == "" {
+		return ""
+	}
+	warning := fmt.Sprintf("Cache namespace %q could not be used, so this invocation is using the main cache.", ns)
+	userDB := e.env.GetUserDB()
+	if userDB == nil || e.groupID == "" {
+		return warning + " Cache namespaces are only available to authenticated organizations."
+	}
+	group, err := userDB.GetGroupByID(ctx, e.groupID)
+	if err != nil {
+		log.Warningf("Could not look up cache namespace policy for invocation %s: %s", iid, err)
+		return warning
+	}
+	if err := namespace.CheckOverrideAllowed(group.AllowedCacheNamespaces, ns); err != nil {
+		return warning + " The namespace must be added to the organization's allowed cache namespaces."
+	}
+	if err := namespace.SetInvocationOverride(ctx, e.env, e.groupID, iid, ns); err != nil {
+		log.Warningf("Could not set cache namespace for invocation %s: %s", iid, err)
+		return warning
+	}
+	log.Infof("Invocation %s is using cache namespace %q", iid, ns)
+	return ""
+}
@@ -0,0 +1,281 @@
+package build_event_handler
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/protofile"
+	"github.com/buildbuddy-io/buildbuddy/server/util/random"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/ptypes"
+
+	bepb "github.com/buildbuddy-io/buildbuddy/proto/build_events"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
+	uidpb "github.com/buildbuddy-io/buildbuddy/proto/user_id"
+)
+
+const (
+	// The maximum number of custom events accepted on a single stream.
+	maxCustomEventsPerStream = 10000
+
+	// The maximum number of custom event streams stored for an invocation,
+	// checked when events are added individually (see AddCustomEvent).
+	maxCustomEventStreamsPerInvocation = 1000
+
+	// Events added individually are each stored as a stream of their own,
+	// with a stream ID starting with this prefix.
+	addedCustomEventStreamPrefix = "added/"
+)
+
+// isCustomEvent returns whether the given event is a custom event published
+// by a tool other than Bazel (see inpb.CustomEvent).
+// customEventMessage is only used to check the type of events, so that doing
+// so doesn't allocate.
+var customEventMessage = &inpb.CustomEvent{}
+
+func isCustomEvent(obe *pepb.OrderedBuildEvent) bool {
+	switch buildEvent := obe.GetEvent().GetEvent().(type) {
+	case *bepb.BuildEvent_BazelEvent:
+		return ptypes.Is(buildEvent.BazelEvent, customEventMessage)
+	}
+	return false
+}
+
+func customEventStreamID(id *bepb.StreamId) string {
+	return id.GetBuildId() + "/" + id.GetComponent().String()
+}
+
+// collectCustomEvent buffers a custom event until the stream completes.
+func (e *EventChannel) collectCustomEvent(obe *pepb.OrderedBuildEvent) error {
+	if len(e.customEvents) >= maxCustomEventsPerStream {
+		return status.ResourceExhaustedErrorf("Too many custom events in stream (limit is %d)", maxCustomEventsPerStream)
+	}
+	event := &inpb.CustomEvent{}
+	if err := ptypes.UnmarshalAny(obe.GetEvent().GetBazelEvent(), event); err != nil {
+		return status.InvalidArgumentErrorf("Invalid custom event: %s", err)
+	}
+	e.redactor.RedactCustomEvent(event)
+	e.customEvents = append(e.customEvents, &inpb.CustomInvocationEvent{
+		EventTime:      obe.GetEvent().GetEventTime(),
+		StreamId:       customEventStreamID(obe.GetStreamId()),
+		SequenceNumber: obe.GetSequenceNumber(),
+		Event:          event,
+	})
+	return nil
+}
+
+// isCustomEventStream returns whether the channel is for a stream of custom
+// events, rather than for Bazel's own stream. Custom event streams don't
+// update the status of the invocation.
+func (e *EventChannel) isCustomEventStream() bool {
+	return !e.hasReceivedStartedEvent && len(e.eventsBeforeStarted) == 0 && len(e.customEvents) > 0
+}
+
+// authorizeInvocationWrite checks that the authenticated user may add custom
+// events and tags to the given invocation. Anonymous invocations aren't owned
+// by anybody, so nobody may add to them.
+func authorizeInvocationWrite(ctx context.Context, env environment.Env, ti *tables.Invocation) error {
+	if ti.GroupID == "" {
+		return status.PermissionDeniedError("Anonymous invocations can't be modified.")
+	}
+	u, err := perms.AuthenticatedUser(ctx, env)
+	if err != nil {
+		return err
+	}
+	return perms.AuthorizeWrite(&u, perms.ToACLProto(&uidpb.UserId{Id: ti.UserID}, ti.GroupID, ti.Perms))
+}
+
+// lookupInvocationForCustomEvents returns the invocation that custom events
+// are being added to, if the authenticated user may add events to it. If the
+// invocation hasn't been started by Bazel's own stream yet, an Unavailable
+// error is returned so that the client retries.
+func lookupInvocationForCustomEvents(ctx context.Context, env environment.Env, iid string) (*tables.Invocation, error) {
+	ti, err := env.GetInvocationDB().LookupInvocation(ctx, iid)
+	if err != nil {
+		if db.IsRecordNotFound(err) {
+			return nil, status.UnavailableErrorf("Invocation %q has not started yet", iid)
+		}
+		return nil, err
+	}
+	if err := authorizeInvocationWrite(ctx, env, ti); err != nil {
+		return nil, err
+	}
+	return ti, nil
+}
+
+// writeCustomEvents stores the custom events received on the stream alongside
+// the invocation's Bazel events.
+func (e *EventChannel) writeCustomEvents(ctx context.Context, iid string) error {
+	if len(e.customEvents) == 0 {
+		return nil
+	}
+	ti, err := lookupInvocationForCustomEvents(ctx, e.env, iid)
+	if err != nil {
+		return err
+	}
+
+	// Events are normally received in order, but the protocol doesn't
+	// require it.
+	sort.SliceStable(e.customEvents, func(i, j int) bool {
+		return e.customEvents[i].GetSequenceNumber() < e.customEvents[j].GetSequenceNumber()
+	})
+	var events []*inpb.CustomInvocationEvent
+	for i, event := range e.customEvents {
+		if i > 0 && event.GetSequenceNumber() == e.customEvents[i-1].GetSequenceNumber() {
+			continue
+		}
+		events = append(events, event)
+	}
+	return writeCustomEventStream(ctx, e.env, ti, events[0].GetStreamId(), events, e.chunkFileSizeBytes)
+}
+
+// AddCustomEvent stores a single custom event for the given invocation, as
+// though it had been published on a stream of its own. The event's time is
+// the time it was added. Secrets are redacted from it as from streamed events.
+func AddCustomEvent(ctx context.Context, env environment.Env, iid string, event *inpb.CustomEvent) (*inpb.CustomInvocationEvent, error) {
+	ti, err := lookupInvocationForCustomEvents(ctx, env, iid)
+	if err != nil {
+		return nil, err
+	}
+	streams, err := env.GetInvocationDB().LookupCustomEventStreams(ctx, iid)
+	if err != nil {
+		return nil, err
+	}
+	if len(streams) >= maxCustomEventStreamsPerInvocation {
+		return nil, status.ResourceExhaustedErrorf("Too many custom event streams for invocation (limit is %d)", maxCustomEventStreamsPerInvocation)
+	}
+	streamID, err := random.RandomString(16)
+	if err != nil {
+		return nil, err
+	}
+	invocationEvent := &inpb.CustomInvocationEvent{
+		EventTime:      ptypes.TimestampNow(),
+		StreamId:       addedCustomEventStreamPrefix + streamID,
+		SequenceNumber: 1,
+		Event:          event,
+	}
+	newRedactor(env).RedactCustomEvent(invocationEvent.Event)
+	chunkFileSizeBytes := env.GetConfigurator().GetStorageChunkFileSizeBytes()
+	if chunkFileSizeBytes == 0 {
+		chunkFileSizeBytes = defaultChunkFileSizeBytes
+	}
+	events := []*inpb.CustomInvocationEvent{invocationEvent}
+	if err := writeCustomEventStream(ctx, env, ti, invocationEvent.GetStreamId(), events, chunkFileSizeBytes); err != nil {
+		return nil, err
+	}
+	return invocationEvent, nil
+}
+
+// LookupCustomEvents returns the custom events stored for the given
+// invocation, if the authenticated user may read it.
+func LookupCustomEvents(ctx context.Context, env environment.Env, iid string) ([]*inpb.CustomInvocationEvent, error) {
+	// LookupInvocation checks that the invocation is readable.
+	if _, err := env.GetInvocationDB().LookupInvocation(ctx, iid); err != nil {
+		return nil, err
+	}
+	return readCustomEvents(ctx, env, iid)
+}
+
+// writeCustomEventStream writes the given events, which must be ordered by
+// sequence number, as the contents of the given stream.
+func writeCustomEventStream(ctx context.Context, env environment.Env, ti *tables.Invocation, streamID string, events []*inpb.CustomInvocationEvent, chunkFileSizeBytes int) error {
+	invocationBlobPath := ti.BlobID
+	if invocationBlobPath == "" {
+		invocationBlobPath = ti.InvocationID
+	}
+	// The stream ID is chosen by the client, so don't use it in the path.
+	blobPath := path.Join(invocationBlobPath, "custom_events", fmt.Sprintf("%x", md5.Sum([]byte(streamID))))
+	bs, err := blobstore.ForBackend(env, ti.BlobBackendID)
+	if err != nil {
+		return err
+	}
+	pw := protofile.NewBufferedProtoWriter(bs, blobPath, chunkFileSizeBytes)
+	for _, event := range events {
+		if err := pw.WriteProtoToStream(ctx, event); err != nil {
+			return err
+		}
+	}
+	if err := pw.Flush(ctx); err != nil {
+		return err
+	}
+	return env.GetInvocationDB().InsertOrUpdateCustomEventStream(ctx, &tables.InvocationCustomEventStream{
+		InvocationID:  ti.InvocationID,
+		StreamID:      streamID,
+		BlobID:        blobPath,
+		BlobBackendID: ti.BlobBackendID,
+		EventCount:    int64(len(events)),
+	})
+}
+
+// readCustomEvents returns the custom events stored for the given invocation,
+// ordered by event time and by sequence number within each stream.
+func readCustomEvents(ctx context.Context, env environment.Env, iid string) ([]*inpb.CustomInvocationEvent, error) {
+	streams, err := env.GetInvocationDB().LookupCustomEventStreams(ctx, iid)
+	if err != nil {
+		return nil, err
+	}
+	eventsByStream := make([][]*inpb.CustomInvocationEvent, 0, len(streams))
+	total := 0
+	for _, s := range streams {
+		bs, err := blobstore.ForBackend(env, s.BlobBackendID)
+		if err != nil {
+			return nil, err
+		}
+		var events []*inpb.CustomInvocationEvent
+		pr := protofile.NewBufferedProtoReader(bs, s.BlobID)
+		for {
+			event := &inpb.CustomInvocationEvent{}
+			err := pr.ReadProto(ctx, event)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, event)
+		}
+		eventsByStream = append(eventsByStream, events)
+		total += len(events)
+	}
+	return mergeCustomEvents(eventsByStream, total), nil
+}
+
+// mergeCustomEvents merges the given streams of events, each of which is
+// ordered by sequence number, into a single list ordered by event time. The
+// order of events within each stream is preserved even if their event times
+// are not.
+func mergeCustomEvents(streams [][]*inpb.CustomInvocationEvent, total int) []*inpb.CustomInvocationEvent {
+	merged := make([]*inpb.CustomInvocationEvent, 0, total)
+	for len(merged) < total {
+		next := -1
+		for i, events := range streams {
+			if len(events) == 0 {
+				continue
+			}
+			if next < 0 || eventTimeBefore(events[0], streams[next][0]) {
+				next = i
+			}
+		}
+		merged = append(merged, streams[next][0])
+		streams[next] = streams[next][1:]
+	}
+	return merged
+}
+
+func eventTimeBefore(a, b *inpb.CustomInvocationEvent) bool {
+	at, bt := a.GetEventTime(), b.GetEventTime()
+	if at.GetSeconds() != bt.GetSeconds() {
+		return at.GetSeconds() < bt.GetSeconds()
+	}
+	return at.GetNanos() < bt.GetNanos()
+}
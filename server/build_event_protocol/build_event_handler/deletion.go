@@ -0,0 +1,102 @@
+package build_event_handler
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/prometheus/client_golang/prometheus"
+
+	gstatus "google.golang.org/grpc/status"
+)
+
+const (
+	// Reasons that invocations are permanently deleted, recorded in the
+	// deletion metrics.
+	TTLDeletionReason          = "ttl"
+	TagTTLDeletionReason       = "tag_ttl"
+	GroupMaxAgeDeletionReason  = "group_max_age"
+	GroupMaxSizeDeletionReason = "group_max_size"
+	TrashDeletionReason        = "trash"
+	ManualDeletionReason       = "manual"
+)
+
+// DeleteInvocationWithPermsCheck permanently deletes an invocation, including
+// one that is in the trash, if the authenticated user may modify it.
+func DeleteInvocationWithPermsCheck(ctx context.Context, env environment.Env, authenticatedUser *interfaces.UserInfo, invocationID string) error {
+	ti, err := env.GetInvocationDB().LookupInvocationForWrite(ctx, authenticatedUser, invocationID)
+	if err != nil {
+		return err
+	}
+	return DeleteInvocation(ctx, env, ti, ManualDeletionReason)
+}
+
+// DeleteInvocation permanently deletes an invocation: its database rows and
+// its blobs, including its render model and custom event streams. The rows
+// are deleted first, in a single transaction, so that the invocation is never
+// visible with only some of its blobs. They are deleted even if the blobs
+// can't be, in which case the blobs are left behind and an error is returned.
+func DeleteInvocation(ctx context.Context, env environment.Env, ti *tables.Invocation, reason string) error {
+	err := deleteInvocation(ctx, env, ti)
+	metrics.InvocationDeletionCount.With(prometheus.Labels{
+		metrics.InvocationDeletionReasonLabel: reason,
+		metrics.StatusLabel:                   fmt.Sprintf("%d", gstatus.Code(err)),
+	}).Inc()
+	if err == nil {
+		metrics.InvocationDeletedEventBytes.With(prometheus.Labels{
+			metrics.InvocationDeletionReasonLabel: reason,
+		}).Add(float64(ti.StoredEventBytes))
+	}
+	return err
+}
+
+func deleteInvocation(ctx context.Context, env environment.Env, ti *tables.Invocation) error {
+	blobPath := ti.BlobID
+	if blobPath == "" {
+		blobPath = ti.InvocationID
+	}
+	// The blobs are listed before the rows are deleted, since the custom
+	// event streams' rows are needed to find theirs.
+	var blobs []*invocationBlobs
+	var listErr error
+	if b, err := listInvocationBlobs(ctx, env, ti.BlobBackendID, blobPath, true /*=includeRenderModel*/); err != nil {
+		listErr = err
+	} else {
+		blobs = append(blobs, b)
+	}
+	streams, err := env.GetInvocationDB().LookupCustomEventStreams(ctx, ti.InvocationID)
+	if err != nil {
+		listErr = err
+	}
+	for _, s := range streams {
+		b, err := listInvocationBlobs(ctx, env, s.BlobBackendID, s.BlobID, false /*=includeRenderModel*/)
+		if err != nil {
+			listErr = err
+			continue
+		}
+		blobs = append(blobs, b)
+	}
+
+	if err := env.GetInvocationDB().DeleteInvocation(ctx, ti.InvocationID); err != nil {
+		return status.InternalErrorf("failed to delete invocation %s: %s", ti.InvocationID, err)
+	}
+	if ic := env.GetInvocationCache(); ic != nil {
+		ic.Invalidate(ti.InvocationID)
+	}
+
+	if listErr != nil {
+		return status.UnavailableErrorf("failed to list blobs of invocation %s: %s", ti.InvocationID, listErr)
+	}
+	for _, b := range blobs {
+		for _, name := range b.names {
+			if err := b.bs.DeleteBlob(ctx, name); err != nil {
+				return status.UnavailableErrorf("failed to delete %q of invocation %s: %s", name, ti.InvocationID, err)
+			}
+		}
+	}
+	return nil
+}
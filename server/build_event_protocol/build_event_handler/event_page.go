@@ -0,0 +1,63 @@
+package build_event_handler
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+const (
+	eventPageTokenOffsetPrefix = "offset_"
+
+	// The number of events returned per page if the page size isn't
+	// specified, and the largest page size allowed.
+	defaultEventPageSize = 1000
+	maxEventPageSize     = 10000
+)
+
+// eventPage is a range of an invocation's events. A nil page includes all of
+// them.
+type eventPage struct {
+	offset int
+	size   int
+}
+
+// parseEventPage returns the page of events starting at the given page token,
+// which is the first page if it's empty.
+func parseEventPage(pageToken string, pageSize int) (*eventPage, error) {
+	if pageSize < 0 {
+		return nil, status.InvalidArgumentError("Page size must not be negative")
+	}
+	page := &eventPage{size: pageSize}
+	if page.size == 0 {
+		page.size = defaultEventPageSize
+	}
+	if page.size > maxEventPageSize {
+		page.size = maxEventPageSize
+	}
+	if strings.HasPrefix(pageToken, eventPageTokenOffsetPrefix) {
+		offset, err := strconv.Atoi(strings.TrimPrefix(pageToken, eventPageTokenOffsetPrefix))
+		if err != nil || offset < 0 {
+			return nil, status.InvalidArgumentError("Error parsing pagination token")
+		}
+		page.offset = offset
+	} else if pageToken != "" {
+		return nil, status.InvalidArgumentError("Invalid pagination token")
+	}
+	return page, nil
+}
+
+// contains returns whether the event with the given index is in the page.
+func (p *eventPage) contains(index int) bool {
+	return p == nil || index >= p.offset && index < p.offset+p.size
+}
+
+// nextPageToken returns the token of the page following this one, or "" if
+// there are no events after it.
+func (p *eventPage) nextPageToken(eventCount int) string {
+	if p == nil || eventCount <= p.offset+p.size {
+		return ""
+	}
+	return eventPageTokenOffsetPrefix + strconv.Itoa(p.offset+p.size)
+}
@@ -0,0 +1,216 @@
+package build_event_handler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_proxy"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/redact"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
+)
+
+const (
+	// The maximum number of events that are held on to until it's known
+	// whether the invocation's group forwards its events. Bazel sends the
+	// started event first, so only a few are expected.
+	maxUnforwardedEvents = 100
+
+	// How long the connection to a build event protocol server is kept open
+	// once no streams are being forwarded to it. This is longer than the
+	// forwarded streams take to wind down once all of their events have been
+	// sent.
+	forwardingClientIdleTimeout = 5 * time.Minute
+)
+
+// forwardingClients holds a client for each build event protocol server that
+// groups forward their build events to, so that connections are shared by
+// their invocations. Clients are closed once they have gone unused for a
+// while, since groups may change their servers at any time.
+type forwardingClients struct {
+	env         environment.Env
+	idleTimeout time.Duration
+	mu          sync.Mutex
+	clients     map[string]*forwardingClient
+}
+
+type forwardingClient struct {
+	client *build_event_proxy.BuildEventProxyClient
+	// The number of streams being forwarded with the client.
+	refs int
+	// Set while the client is unused, to close it once it has been idle for
+	// too long.
+	idleTimer *time.Timer
+}
+
+func newForwardingClients(env environment.Env) *forwardingClients {
+	return &forwardingClients{
+		env:         env,
+		idleTimeout: forwardingClientIdleTimeout,
+		clients:     make(map[string]*forwardingClient),
+	}
+}
+
+// acquire returns the client for the given target, which must be released
+// once the stream forwarded with it is closed.
+func (f *forwardingClients) acquire(target string) *forwardingClient {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.clients[target]
+	if !ok {
+		c = &forwardingClient{client: build_event_proxy.NewForwardingClient(f.env, target)}
+		f.clients[target] = c
+	}
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+		c.idleTimer = nil
+	}
+	c.refs++
+	return c
+}
+
+func (f *forwardingClients) release(target string, c *forwardingClient) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c.refs--
+	if c.refs > 0 {
+		return
+	}
+	c.idleTimer = time.AfterFunc(f.idleTimeout, func() {
+		f.closeIfIdle(target, c)
+	})
+}
+
+func (f *forwardingClients) closeIfIdle(target string, c *forwardingClient) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c.refs > 0 || f.clients[target] != c {
+		return
+	}
+	delete(f.clients, target)
+	if err := c.client.Close(); err != nil {
+		log.Warningf("Error closing connection to build event protocol server %q: %s", target, err)
+	}
+}
+
+// forwardEvent passes the event on to the build event protocol server of the
+// invocation's group, if it has one. Forwarding is best effort: events are
+// buffered and sent asynchronously, and are dropped if the server can't keep
+// up, so that it never fails or slows down the invocation.
+func (e *EventChannel) forwardEvent(event *pepb.PublishBuildToolEventStreamRequest) {
+	if e.forwarding == nil {
+		return
+	}
+	if !e.forwardingResolved {
+		if !e.hasReceivedStartedEvent {
+			// The invocation's group isn't known yet.
+			if len(e.unforwardedEvents) < maxUnforwardedEvents {
+				e.unforwardedEvents = append(e.unforwardedEvents, event)
+			}
+			return
+		}
+		e.forwardingResolved = true
+		e.openForwardingStream()
+		if e.forwardingStream != nil {
+			for _, event := range e.unforwardedEvents {
+				e.forwardingStream.Send(redactForForwarding(e.redactor, event))
+			}
+		}
+		e.unforwardedEvents = nil
+	}
+	if e.forwardingStream == nil {
+		return
+	}
+	e.forwardingStream.Send(redactForForwarding(e.redactor, event))
+	if isFinalEvent(event.OrderedBuildEvent) {
+		e.closeForwardingStream()
+	}
+}
+
+// bazelEventMessage is only used to check the type of events.
+var bazelEventMessage = &build_event_stream.BuildEvent{}
+
+// redactForForwarding returns a copy of the event with the same secrets
+// redacted from it as from the events that are stored, so that they aren't
+// passed on to servers that they weren't meant for. Both Bazel's events and
+// custom events are redacted.
+func redactForForwarding(redactor *redact.Redactor, event *pepb.PublishBuildToolEventStreamRequest) *pepb.PublishBuildToolEventStreamRequest {
+	bazelEvent := event.GetOrderedBuildEvent().GetEvent().GetBazelEvent()
+	if bazelEvent == nil {
+		return event
+	}
+	var message proto.Message
+	switch {
+	case ptypes.Is(bazelEvent, bazelEventMessage):
+		buildEvent := &build_event_stream.BuildEvent{}
+		if err := ptypes.UnmarshalAny(bazelEvent, buildEvent); err != nil {
+			return event
+		}
+		redactor.RedactEvent(buildEvent)
+		message = buildEvent
+	case ptypes.Is(bazelEvent, customEventMessage):
+		customEvent := &inpb.CustomEvent{}
+		if err := ptypes.UnmarshalAny(bazelEvent, customEvent); err != nil {
+			return event
+		}
+		redactor.RedactCustomEvent(customEvent)
+		message = customEvent
+	default:
+		return event
+	}
+	redactedAny, err := ptypes.MarshalAny(message)
+	if err != nil {
+		return event
+	}
+	redacted := proto.Clone(event).(*pepb.PublishBuildToolEventStreamRequest)
+	redacted.GetOrderedBuildEvent().GetEvent().GetBazelEvent().Value = redactedAny.Value
+	return redacted
+}
+
+func (e *EventChannel) openForwardingStream() {
+	if e.groupID == "" || e.env.GetUserDB() == nil {
+		return
+	}
+	group, err := e.env.GetUserDB().GetGroupByID(e.ctx, e.groupID)
+	if err != nil {
+		log.Warningf("Could not look up build event forwarding target of group %s: %s", e.groupID, err)
+		return
+	}
+	target := group.BESForwardingTarget
+	if target == "" {
+		return
+	}
+	// The hosts that may be forwarded to may have changed since the target
+	// was set.
+	if err := build_event_proxy.CheckForwardingTarget(target, e.env.GetConfigurator().GetBuildEventProxyAllowedForwardingHosts()); err != nil {
+		log.Warningf("Not forwarding build events of group %s: %s", e.groupID, err)
+		return
+	}
+	c := e.forwarding.acquire(target)
+	stream, err := c.client.PublishBuildToolEventStream(e.ctx, grpc.WaitForReady(false))
+	if err != nil {
+		e.forwarding.release(target, c)
+		log.Warningf("Could not forward build events of group %s: %s", e.groupID, err)
+		return
+	}
+	e.forwardingTarget = target
+	e.forwardingClient = c
+	e.forwardingStream = stream
+}
+
+func (e *EventChannel) closeForwardingStream() {
+	if e.forwardingStream == nil {
+		return
+	}
+	e.forwardingStream.CloseSend()
+	e.forwardingStream = nil
+	e.forwarding.release(e.forwardingTarget, e.forwardingClient)
+	e.forwardingClient = nil
+}
@@ -0,0 +1,118 @@
+package build_event_handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/redact"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	bepb "github.com/buildbuddy-io/buildbuddy/proto/build_events"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
+)
+
+func bazelEventRequest(t *testing.T, event *build_event_stream.BuildEvent) *pepb.PublishBuildToolEventStreamRequest {
+	anyEvent, err := ptypes.MarshalAny(event)
+	require.NoError(t, err)
+	return &pepb.PublishBuildToolEventStreamRequest{
+		OrderedBuildEvent: &pepb.OrderedBuildEvent{
+			SequenceNumber: 1,
+			StreamId:       &bepb.StreamId{InvocationId: "invocation"},
+			Event: &bepb.BuildEvent{
+				Event: &bepb.BuildEvent_BazelEvent{BazelEvent: anyEvent},
+			},
+		},
+	}
+}
+
+func TestRedactForForwarding(t *testing.T) {
+	redactor, err := redact.NewRedactor(nil)
+	require.NoError(t, err)
+	options := "--remote_header=x-buildbuddy-api-key=abc123 --bes_backend=grpcs://bes.example.com"
+	event := bazelEventRequest(t, &build_event_stream.BuildEvent{
+		Payload: &build_event_stream.BuildEvent_Started{
+			Started: &build_event_stream.BuildStarted{OptionsDescription: options},
+		},
+	})
+
+	redacted := redactForForwarding(redactor, event)
+
+	forwarded := &build_event_stream.BuildEvent{}
+	require.NoError(t, ptypes.UnmarshalAny(redacted.GetOrderedBuildEvent().GetEvent().GetBazelEvent(), forwarded))
+	assert.Equal(t, "--remote_header=<REDACTED> --bes_backend=grpcs://bes.example.com", forwarded.GetStarted().GetOptionsDescription())
+	assert.Equal(t, int64(1), redacted.GetOrderedBuildEvent().GetSequenceNumber())
+	assert.Equal(t, "invocation", redacted.GetOrderedBuildEvent().GetStreamId().GetInvocationId())
+
+	// The event that was received is left as is.
+	received := &build_event_stream.BuildEvent{}
+	require.NoError(t, ptypes.UnmarshalAny(event.GetOrderedBuildEvent().GetEvent().GetBazelEvent(), received))
+	assert.Equal(t, options, received.GetStarted().GetOptionsDescription())
+
+	// Custom events are redacted too.
+	anyEvent, err := ptypes.MarshalAny(&inpb.CustomEvent{
+		Message:    "Deploying with x-buildbuddy-api-key=abc123",
+		Properties: map[string]string{"DEPLOY_TOKEN": "abc123"},
+	})
+	require.NoError(t, err)
+	custom := &pepb.PublishBuildToolEventStreamRequest{
+		OrderedBuildEvent: &pepb.OrderedBuildEvent{
+			Event: &bepb.BuildEvent{Event: &bepb.BuildEvent_BazelEvent{BazelEvent: anyEvent}},
+		},
+	}
+	forwardedCustom := &inpb.CustomEvent{}
+	require.NoError(t, ptypes.UnmarshalAny(redactForForwarding(redactor, custom).GetOrderedBuildEvent().GetEvent().GetBazelEvent(), forwardedCustom))
+	assert.Equal(t, "Deploying with x-buildbuddy-api-key=<REDACTED>", forwardedCustom.GetMessage())
+	assert.Equal(t, "<REDACTED>", forwardedCustom.GetProperties()["DEPLOY_TOKEN"])
+
+	// Other events are forwarded as they are.
+	anyEvent, err = ptypes.MarshalAny(&inpb.InvocationEvent{})
+	require.NoError(t, err)
+	other := &pepb.PublishBuildToolEventStreamRequest{
+		OrderedBuildEvent: &pepb.OrderedBuildEvent{
+			Event: &bepb.BuildEvent{Event: &bepb.BuildEvent_BazelEvent{BazelEvent: anyEvent}},
+		},
+	}
+	assert.Same(t, other, redactForForwarding(redactor, other))
+}
+
+func TestForwardingClientsAreClosedWhenIdle(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	f := newForwardingClients(te)
+	f.idleTimeout = 50 * time.Millisecond
+	clientCount := func() int {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return len(f.clients)
+	}
+
+	c1 := f.acquire("grpcs://bes.example.com")
+	c2 := f.acquire("grpcs://bes.example.com")
+	assert.Same(t, c1, c2)
+	f.release("grpcs://bes.example.com", c1)
+
+	// The client is kept open while a stream is still using it.
+	time.Sleep(2 * f.idleTimeout)
+	assert.Equal(t, 1, clientCount())
+
+	// Reusing the client before it's closed keeps it open.
+	f.release("grpcs://bes.example.com", c2)
+	c3 := f.acquire("grpcs://bes.example.com")
+	assert.Same(t, c1, c3)
+	time.Sleep(2 * f.idleTimeout)
+	assert.Equal(t, 1, clientCount())
+
+	f.release("grpcs://bes.example.com", c3)
+	require.Eventually(t, func() bool {
+		return clientCount() == 0
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// A new client is created for the next stream.
+	c4 := f.acquire("grpcs://bes.example.com")
+	assert.NotSame(t, c1, c4)
+	f.release("grpcs://bes.example.com", c4)
+}
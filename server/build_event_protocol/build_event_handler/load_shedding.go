@@ -0,0 +1,140 @@
+package build_event_handler
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/prometheus/client_golang/prometheus"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+// shedPriority orders the kinds of build event work that can be shed under
+// load. Work with a lower priority is shed first. Finalizing invocations is
+// never shed, so that builds which already started can always finish.
+type shedPriority int
+
+const (
+	// Progress events are deferred rather than dropped: they're handled once
+	// the load drops, or when the invocation is finalized.
+	progressPriority shedPriority = iota
+	anonymousStartPriority
+	startPriority
+	ciStartPriority
+)
+
+// The fraction of the maximum number of concurrently handled build events
+// above which work of each priority is shed.
+var shedThresholds = map[shedPriority]float64{
+	progressPriority:       0.5,
+	anonymousStartPriority: 0.75,
+	startPriority:          0.9,
+	ciStartPriority:        1,
+}
+
+var shedPriorityLabels = map[shedPriority]string{
+	progressPriority:       "progress",
+	anonymousStartPriority: "anonymous_start",
+	startPriority:          "start",
+	ciStartPriority:        "ci_start",
+}
+
+// The maximum number of progress events deferred per invocation. Further
+// progress events are handled right away, to bound memory usage.
+const maxDeferredEvents = 1000
+
+// loadShedder tracks how many build events are being handled at once across
+// all of the app's build event streams.
+type loadShedder struct {
+	maxInFlight int64
+	inFlight    int64 // accessed atomically
+}
+
+func newLoadShedder(maxInFlight int) *loadShedder {
+	return &loadShedder{maxInFlight: int64(maxInFlight)}
+}
+
+// begin records that an event is being handled. The returned func must be
+// called once it has been handled.
+func (s *loadShedder) begin() func() {
+	if s == nil {
+		return func() {}
+	}
+	atomic.AddInt64(&s.inFlight, 1)
+	return func() { atomic.AddInt64(&s.inFlight, -1) }
+}
+
+// overloaded returns whether work of the given priority should be shed, given
+// the other events being handled.
+func (s *loadShedder) overloaded(p shedPriority) bool {
+	if s == nil || s.maxInFlight <= 0 {
+		return false
+	}
+	// Don't count the event being checked.
+	others := atomic.LoadInt64(&s.inFlight) - 1
+	return float64(others) >= shedThresholds[p]*float64(s.maxInFlight)
+}
+
+// shouldShed is like overloaded, but also counts the work as shed.
+func (s *loadShedder) shouldShed(p shedPriority) bool {
+	if !s.overloaded(p) {
+		return false
+	}
+	metrics.BuildEventShedCount.With(prometheus.Labels{
+		metrics.BuildEventShedPriorityLabel: shedPriorityLabels[p],
+	}).Inc()
+	return true
+}
+
+// invocationStartPriority returns the priority of starting a new invocation.
+// CI invocations are identified by their --build_metadata=ROLE=CI option,
+// since their build metadata event isn't received until later.
+func invocationStartPriority(groupID, options string) shedPriority {
+	if strings.Contains(options, "--build_metadata=ROLE=CI") {
+		return ciStartPriority
+	}
+	if groupID == "" {
+		return anonymousStartPriority
+	}
+	return startPriority
+}
+
+func overloadedError() error {
+	return status.UnavailableError("BuildBuddy is handling too many build events right now. Please try again later.")
+}
+
+func isProgressEvent(event *build_event_stream.BuildEvent) bool {
+	_, ok := event.GetPayload().(*build_event_stream.BuildEvent_Progress)
+	return ok
+}
+
+// deferProgressEvent defers handling the given event if it's a progress event
+// and progress events are being shed. It returns whether the event was
+// deferred.
+func (e *EventChannel) deferProgressEvent(event *inpb.InvocationEvent) bool {
+	if !isProgressEvent(event.BuildEvent) || len(e.deferredEvents) >= maxDeferredEvents {
+		return false
+	}
+	if !e.shedder.shouldShed(progressPriority) {
+		return false
+	}
+	e.deferredEvents = append(e.deferredEvents, event)
+	return true
+}
+
+// processDeferredEvents handles the progress events that were deferred while
+// the app was overloaded.
+func (e *EventChannel) processDeferredEvents(iid string) error {
+	for len(e.deferredEvents) > 0 {
+		event := e.deferredEvents[0]
+		e.deferredEvents = e.deferredEvents[1:]
+		if err := e.processSingleEvent(event, iid); err != nil {
+			return err
+		}
+	}
+	e.deferredEvents = nil
+	return nil
+}
@@ -0,0 +1,71 @@
+package build_event_handler
+
+import (
+	"context"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+)
+
+// markPendingPersist marks the invocation as pending-persist if some of its
+// blobs were written to the blobstore's write-ahead log and are not yet
+// persisted.
+func (e *EventChannel) markPendingPersist(ctx context.Context, iid string) {
+	wal, ok := e.env.GetBlobstore().(interfaces.WriteAheadBlobstore)
+	if !ok || !wal.HasPendingWrites(e.blobPath) {
+		return
+	}
+	err := e.env.GetDBHandle().WithContext(ctx).Model(&tables.Invocation{}).
+		Where("invocation_id = ?", iid).
+		UpdateColumn("pending_persist", true).Error
+	if err != nil {
+		log.Warningf("Could not mark invocation %s as pending persist: %s", iid, err)
+		return
+	}
+	// The blobs may have been persisted in the meantime, in which case
+	// nothing else would clear the mark.
+	clearPendingPersist(ctx, e.env, wal, e.blobPath)
+}
+
+// OnBlobPersisted is called once a blob that was written to the blobstore's
+// write-ahead log is persisted. It clears the pending-persist mark of the
+// invocation that the blob belongs to, once all of its blobs are persisted.
+func OnBlobPersisted(ctx context.Context, env environment.Env, blobName string) {
+	wal, ok := env.GetBlobstore().(interfaces.WriteAheadBlobstore)
+	if !ok || env.GetDBHandle() == nil {
+		return
+	}
+	// Blobs are stored under the invocation's blob ID, so it is one of the
+	// blob name's path prefixes.
+	var blobIDs []string
+	parts := strings.Split(blobName, "/")
+	for i := range parts {
+		blobIDs = append(blobIDs, strings.Join(parts[:i+1], "/"))
+	}
+	var pendingBlobIDs []string
+	err := env.GetDBHandle().WithContext(ctx).Model(&tables.Invocation{}).
+		Where("pending_persist = ? AND blob_id IN (?)", true, blobIDs).
+		Pluck("blob_id", &pendingBlobIDs).Error
+	if err != nil {
+		log.Warningf("Could not look up invocation of persisted blob %q: %s", blobName, err)
+		return
+	}
+	for _, blobID := range pendingBlobIDs {
+		clearPendingPersist(ctx, env, wal, blobID)
+	}
+}
+
+func clearPendingPersist(ctx context.Context, env environment.Env, wal interfaces.WriteAheadBlobstore, blobID string) {
+	if wal.HasPendingWrites(blobID) {
+		return
+	}
+	err := env.GetDBHandle().WithContext(ctx).Model(&tables.Invocation{}).
+		Where("blob_id = ? AND pending_persist = ?", blobID, true).
+		UpdateColumn("pending_persist", false).Error
+	if err != nil {
+		log.Warningf("Could not clear pending persist mark of invocations with blob ID %q: %s", blobID, err)
+	}
+}
@@ -0,0 +1,82 @@
+package build_event_handler
+
+import (
+	"context"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/event_parser"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+const (
+	// How often the DB row of an in-progress invocation is checkpointed, so
+	// that invocation lists can show how far along it is, unless
+	// app.invocation_checkpoint_interval is set.
+	defaultCheckpointInterval = 30 * time.Second
+)
+
+// progressTracker counts the targets and events of an in-progress invocation,
+// and remembers when they were last checkpointed.
+type progressTracker struct {
+	interval        time.Duration
+	progress        event_parser.TargetProgress
+	eventCount      int64
+	writtenProgress event_parser.TargetProgress
+	writtenCount    int64
+	lastWrittenTime time.Time
+}
+
+// fillInvocation sets the event count of a finalized invocation.
+func (t *progressTracker) fillInvocation(invocation *inpb.Invocation) {
+	invocation.EventCount = t.eventCount
+}
+
+// updateProgress counts the event, and checkpoints the invocation's target
+// counts, event count and duration so far to the DB if they changed and
+// weren't written recently. The events received so far are flushed to the
+// blobstore first, so that looking up the in-progress invocation returns the
+// events that were counted. The row written when the invocation started
+// counts as the first checkpoint. Checkpoints are best effort, so failing to
+// write one doesn't fail the invocation.
+func (e *EventChannel) updateProgress(ctx context.Context, iid string, event *build_event_stream.BuildEvent) {
+	t := &e.progress
+	t.progress.AddEvent(event)
+	t.eventCount++
+	now := e.env.GetClock().Now()
+	if t.lastWrittenTime.IsZero() {
+		t.lastWrittenTime = now
+		return
+	}
+	if t.progress == t.writtenProgress && t.eventCount == t.writtenCount {
+		return
+	}
+	if now.Sub(t.lastWrittenTime) < t.interval {
+		return
+	}
+	if err := e.flush(ctx); err != nil {
+		log.Warningf("Error flushing events of invocation %s: %s", iid, err)
+		return
+	}
+	ti := &tables.Invocation{
+		InvocationID:          iid,
+		InvocationStatus:      int64(inpb.Invocation_PARTIAL_INVOCATION_STATUS),
+		ConfiguredTargetCount: t.progress.ConfiguredTargetCount,
+		CompletedTargetCount:  t.progress.CompletedTargetCount,
+		FailedTargetCount:     t.progress.FailedTargetCount,
+		EventCount:            t.eventCount,
+	}
+	if startTime := e.beValues.StartTime(); !startTime.IsZero() && now.After(startTime) {
+		ti.DurationUsec = now.Sub(startTime).Microseconds()
+	}
+	if err := e.env.GetInvocationDB().InsertOrUpdateInvocation(ctx, ti); err != nil {
+		log.Warningf("Error checkpointing invocation %s: %s", iid, err)
+		return
+	}
+	t.writtenProgress = t.progress
+	t.writtenCount = t.eventCount
+	t.lastWrittenTime = now
+}
@@ -0,0 +1,270 @@
+package build_event_handler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+	"github.com/golang/protobuf/proto"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	usagepb "github.com/buildbuddy-io/buildbuddy/proto/usage"
+)
+
+const (
+	// ErrorInfo reasons for build event streams rejected due to quotas.
+	GroupEventBytesQuotaExceededReason = "GROUP_EVENT_BYTES_QUOTA_EXCEEDED"
+
+	// Reasons recorded on invocations whose events were truncated.
+	MaxInvocationBytesTruncationReason  = "MAX_INVOCATION_BYTES"
+	MaxInvocationEventsTruncationReason = "MAX_INVOCATION_EVENTS"
+
+	// The resource limited by the group build event quota, in usage
+	// statuses.
+	GroupEventBytesResource = "build_event_bytes"
+
+	groupEventBytesCounterPrefix = "event_bytes/"
+	groupEventBytesDescription   = "daily build event bytes"
+	groupEventBytesPeriod        = 24 * time.Hour
+	// How long the counter of a day's usage is kept after it was last
+	// incremented. It's only read during its day, so this just leaves
+	// plenty of slack for clock skew between apps.
+	groupEventBytesCounterExpiration = 2 * groupEventBytesPeriod
+)
+
+// isSummaryEvent returns whether an event is needed to show an invocation's
+// summary, and should be stored even once the invocation's storage quota has
+// been exceeded.
+func isSummaryEvent(event *build_event_stream.BuildEvent) bool {
+	switch event.GetPayload().(type) {
+	case *build_event_stream.BuildEvent_Started,
+		*build_event_stream.BuildEvent_UnstructuredCommandLine,
+		*build_event_stream.BuildEvent_StructuredCommandLine,
+		*build_event_stream.BuildEvent_OptionsParsed,
+		*build_event_stream.BuildEvent_WorkspaceStatus,
+		*build_event_stream.BuildEvent_WorkspaceInfo,
+		*build_event_stream.BuildEvent_BuildMetadata,
+		*build_event_stream.BuildEvent_Finished,
+		*build_event_stream.BuildEvent_BuildMetrics,
+		*build_event_stream.BuildEvent_BuildToolLogs,
+		*build_event_stream.BuildEvent_WorkflowConfigured:
+		return true
+	}
+	return false
+}
+
+// groupEventBytesCounterName returns the name of the counter tracking the
+// bytes of build events uploaded by a group on the given day.
+func groupEventBytesCounterName(groupID string, t time.Time) string {
+	return groupEventBytesCounterPrefix + groupID + "/" + t.UTC().Format("2006-01-02")
+}
+
+func groupQuotaExceededError(groupID string, limit int64) error {
+	err := status.ResourceExhaustedErrorf("Build events were rejected because this organization has uploaded more than its daily limit of %d bytes of build events. Uploads will be accepted again tomorrow (UTC).", limit)
+	err = status.WithErrorInfo(err, GroupEventBytesQuotaExceededReason, map[string]string{"group_id": groupID})
+	return status.WithQuotaFailure(err, "group:"+groupID, groupEventBytesDescription)
+}
+
+// groupEventBytesWarningThreshold returns the usage at which groups are
+// warned that they're approaching the given limit.
+func groupEventBytesWarningThreshold(env environment.Env, limit int64) int64 {
+	return int64(float64(limit) * env.GetConfigurator().GetStorageGroupEventBytesWarningFraction())
+}
+
+// groupEventBytesUsage returns the status of a group's build event usage so
+// far on the day of the given time, including when it's projected to reach
+// the limit if it keeps uploading build events at the same rate.
+func groupEventBytesUsage(env environment.Env, usage, limit int64, now time.Time) *usagepb.UsageLimit {
+	start := now.UTC().Truncate(groupEventBytesPeriod)
+	end := start.Add(groupEventBytesPeriod)
+	u := &usagepb.UsageLimit{
+		Resource:         GroupEventBytesResource,
+		Description:      groupEventBytesDescription,
+		Usage:            usage,
+		WarningThreshold: groupEventBytesWarningThreshold(env, limit),
+		Limit:            limit,
+		State:            usagepb.UsageState_OK_USAGE_STATE,
+		PeriodStartUsec:  timeutil.ToUsec(start),
+		PeriodEndUsec:    timeutil.ToUsec(end),
+	}
+	elapsed := now.Sub(start)
+	if usage > 0 && usage < limit && elapsed > 0 {
+		remaining := time.Duration(float64(limit-usage) / float64(usage) * float64(elapsed))
+		if projected := now.Add(remaining); projected.Before(end) {
+			u.ProjectedLimitUsec = timeutil.ToUsec(projected)
+		}
+	}
+	resets := end.Format("15:04 MST")
+	switch {
+	case usage >= limit:
+		u.State = usagepb.UsageState_EXCEEDED_USAGE_STATE
+		u.Message = fmt.Sprintf("This organization has uploaded more than its daily limit of %d bytes of build events, so its build event streams are rejected until the limit resets at %s.", limit, resets)
+	case u.WarningThreshold < limit && usage >= u.WarningThreshold:
+		u.State = usagepb.UsageState_WARNING_USAGE_STATE
+		u.Message = fmt.Sprintf("This organization has uploaded %d of its daily limit of %d bytes of build events. Once the limit is reached, its build event streams will be rejected until the limit resets at %s.", usage, limit, resets)
+	}
+	return u
+}
+
+// GetUsageStatus returns the group's usage of each resource with a configured
+// limit.
+func GetUsageStatus(ctx context.Context, env environment.Env, groupID string) ([]*usagepb.UsageLimit, error) {
+	limit := env.GetConfigurator().GetStorageMaxGroupDailyEventBytes()
+	mc := env.GetMetricsCollector()
+	if limit <= 0 || mc == nil {
+		return nil, nil
+	}
+	now := env.GetClock().Now()
+	n, err := mc.ReadCount(ctx, groupEventBytesCounterName(groupID, now))
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to read build event usage: %s", err)
+	}
+	return []*usagepb.UsageLimit{groupEventBytesUsage(env, n, limit, now)}, nil
+}
+
+// notifyGroupUsage notifies the group when an upload of the given size made
+// its usage cross the warning threshold or the limit. Usage is counted
+// atomically, so each is crossed by exactly one upload per day.
+func (e *EventChannel) notifyGroupUsage(usage, eventBytes, limit int64, now time.Time) {
+	router := e.env.GetNotificationRouter()
+	if router == nil {
+		return
+	}
+	u := groupEventBytesUsage(e.env, usage, limit, now)
+	prev := usage - eventBytes
+	crossedLimit := prev < limit && usage >= limit
+	crossedWarning := u.WarningThreshold < limit && prev < u.WarningThreshold && usage >= u.WarningThreshold
+	if !crossedLimit && !crossedWarning {
+		return
+	}
+	groupID := e.groupID
+	go func() {
+		if err := router.NotifyUsageWarning(context.Background(), groupID, u); err != nil {
+			log.Warningf("Error sending usage notifications for group %q: %s", groupID, err)
+		}
+	}()
+}
+
+// groupEventBytesLimit returns the daily build event quota of the
+// invocation's group, or 0 if it has none. Anonymous invocations have no
+// group, and aren't subject to a quota, since any one of their uploaders
+// could use up a quota that they all shared. They're only limited by the
+// storage limits of each invocation.
+func (e *EventChannel) groupEventBytesLimit() int64 {
+	if e.groupID == "" {
+		return 0
+	}
+	return e.env.GetConfigurator().GetStorageMaxGroupDailyEventBytes()
+}
+
+// checkGroupQuota returns an error if the invocation's group has already
+// exceeded its daily build event quota.
+func (e *EventChannel) checkGroupQuota(ctx context.Context) error {
+	limit := e.groupEventBytesLimit()
+	mc := e.env.GetMetricsCollector()
+	if limit <= 0 || mc == nil {
+		return nil
+	}
+	n, err := mc.ReadCount(ctx, groupEventBytesCounterName(e.groupID, e.env.GetClock().Now()))
+	if err != nil {
+		// Metrics collectors aren't durable, so fail open rather than
+		// rejecting builds when they're unavailable.
+		log.Warningf("Failed to read build event quota for group %q: %s", e.groupID, err)
+		return nil
+	}
+	if n >= limit {
+		return groupQuotaExceededError(e.groupID, limit)
+	}
+	return nil
+}
+
+// recordGroupUsage adds an event to the group's daily build event usage,
+// notifying the group as it approaches its quota, and returns an error if
+// that exceeds the group's quota.
+func (e *EventChannel) recordGroupUsage(ctx context.Context, eventBytes int64) error {
+	limit := e.groupEventBytesLimit()
+	mc := e.env.GetMetricsCollector()
+	if limit <= 0 || mc == nil {
+		return nil
+	}
+	now := e.env.GetClock().Now()
+	n, err := mc.IncrementCountWithExpiry(ctx, groupEventBytesCounterName(e.groupID, now), eventBytes, groupEventBytesCounterExpiration)
+	if err != nil {
+		log.Warningf("Failed to record build event quota usage for group %q: %s", e.groupID, err)
+		return nil
+	}
+	e.notifyGroupUsage(n, eventBytes, limit, now)
+	if n > limit {
+		return groupQuotaExceededError(e.groupID, limit)
+	}
+	return nil
+}
+
+// exceededStorageLimit returns the reason for not storing an event of the
+// given size, or "" if it fits within the invocation's storage limits.
+func (e *EventChannel) exceededStorageLimit(size int64) string {
+	c := e.env.GetConfigurator()
+	if limit := c.GetStorageMaxInvocationEvents(); limit > 0 && e.storedEvents >= limit {
+		return MaxInvocationEventsTruncationReason
+	}
+	if limit := c.GetStorageMaxInvocationBytes(); limit > 0 && e.storedBytes+size > limit {
+		return MaxInvocationBytesTruncationReason
+	}
+	return ""
+}
+
+// applyStorageQuota returns whether the given event of the given size should
+// be stored, given how much has already been stored for the invocation. Once
+// the invocation's storage limits are exceeded, only summary events are
+// stored, and the dropped events are accounted for in a truncation marker
+// (see writeTruncationMarker).
+func (e *EventChannel) applyStorageQuota(event *inpb.InvocationEvent, size int64) bool {
+	if !isSummaryEvent(event.BuildEvent) {
+		if e.truncation == nil {
+			if reason := e.exceededStorageLimit(size); reason != "" {
+				e.truncation = &inpb.InvocationTruncation{Reason: reason}
+				log.Infof("Invocation %s exceeded its storage limits (%s); dropping further build events", e.beValues.InvocationID(), reason)
+			}
+		}
+		if e.truncation != nil {
+			e.truncation.DroppedEventCount++
+			e.truncation.DroppedEventBytes += size
+			e.lastDroppedEvent = event
+			return false
+		}
+	}
+	e.storedEvents++
+	e.storedBytes += size
+	return true
+}
+
+// writeTruncationMarker stores a marker event recording how many events have
+// been dropped, so that consumers of the invocation know that its events are
+// partial. A marker is only stored if events were dropped since the last
+// one, and the last marker in the stream has the totals.
+func (e *EventChannel) writeTruncationMarker(ctx context.Context) error {
+	if e.truncation == nil || e.truncation.DroppedEventCount == e.markedDroppedEventCount {
+		return nil
+	}
+	e.markedDroppedEventCount = e.truncation.DroppedEventCount
+	marker := warningEvent(e.lastDroppedEvent, truncationWarning(e.env, e.truncation))
+	marker.SequenceNumber = e.nextSequenceNumber()
+	marker.Truncation = proto.Clone(e.truncation).(*inpb.InvocationTruncation)
+	return e.pw.WriteProtoToStream(ctx, marker)
+}
+
+func truncationWarning(env environment.Env, t *inpb.InvocationTruncation) string {
+	limit := ""
+	switch t.GetReason() {
+	case MaxInvocationEventsTruncationReason:
+		limit = fmt.Sprintf("%d stored build events", env.GetConfigurator().GetStorageMaxInvocationEvents())
+	default:
+		limit = fmt.Sprintf("%d bytes of stored build events", env.GetConfigurator().GetStorageMaxInvocationBytes())
+	}
+	return fmt.Sprintf("This invocation has exceeded the limit of %s. %d build events (%d bytes) were not stored, so only the build's summary is shown after this point.", limit, t.GetDroppedEventCount(), t.GetDroppedEventBytes())
+}
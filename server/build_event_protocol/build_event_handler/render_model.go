@@ -0,0 +1,250 @@
+package build_event_handler
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/failure_clusters"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/proto"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+// renderModelBlobPath returns the path of the blob holding the render model
+// of the invocation whose events are stored at the given path.
+func renderModelBlobPath(invocationBlobPath string) string {
+	return path.Join(invocationBlobPath, "render_model")
+}
+
+func isFailedTestStatus(s build_event_stream.TestStatus) bool {
+	switch s {
+	case build_event_stream.TestStatus_NO_STATUS, build_event_stream.TestStatus_PASSED, build_event_stream.TestStatus_FLAKY:
+		return false
+	}
+	return true
+}
+
+// splitPackage returns the path of the tree node holding the package of the
+// given label: the external repository, if any, followed by the segments of
+// the package path.
+func splitPackage(label string) []string {
+	pkg := label
+	if i := strings.Index(pkg, ":"); i >= 0 {
+		pkg = pkg[:i]
+	}
+	var segments []string
+	if i := strings.Index(pkg, "//"); i >= 0 {
+		if repo := pkg[:i]; repo != "" {
+			segments = append(segments, repo)
+		}
+		pkg = pkg[i+2:]
+	}
+	for _, s := range strings.Split(pkg, "/") {
+		if s != "" {
+			segments = append(segments, s)
+		}
+	}
+	return segments
+}
+
+// renderedTargets returns the targets that were completed, or failed before
+// they could be, by label.
+func renderedTargets(events []*inpb.InvocationEvent) map[string]*inpb.RenderedTarget {
+	targets := make(map[string]*inpb.RenderedTarget)
+	configured := make(map[string]*build_event_stream.TargetConfigured)
+	get := func(label string) *inpb.RenderedTarget {
+		t, ok := targets[label]
+		if !ok {
+			t = &inpb.RenderedTarget{Label: label, Success: true}
+			targets[label] = t
+		}
+		return t
+	}
+	for _, e := range events {
+		event := e.GetBuildEvent()
+		switch p := event.GetPayload().(type) {
+		case *build_event_stream.BuildEvent_Configured:
+			configured[event.GetId().GetTargetConfigured().GetLabel()] = p.Configured
+		case *build_event_stream.BuildEvent_Completed:
+			t := get(event.GetId().GetTargetCompleted().GetLabel())
+			t.Success = t.Success && p.Completed.GetSuccess()
+		case *build_event_stream.BuildEvent_Aborted:
+			if p.Aborted.GetReason() == build_event_stream.Aborted_SKIPPED {
+				continue
+			}
+			label := event.GetId().GetTargetConfigured().GetLabel()
+			if label == "" {
+				label = event.GetId().GetTargetCompleted().GetLabel()
+			}
+			if label != "" {
+				get(label).Success = false
+			}
+		case *build_event_stream.BuildEvent_TestSummary:
+			t := get(event.GetId().GetTestSummary().GetLabel())
+			t.Test = true
+			t.TestStatus = p.TestSummary.GetOverallStatus()
+			t.TestDurationUsec = p.TestSummary.GetTotalRunDurationMillis() * 1000
+		}
+	}
+	for label, t := range targets {
+		if c, ok := configured[label]; ok {
+			t.RuleType = c.GetTargetKind()
+			if c.GetTestSize() != build_event_stream.TestSize_UNKNOWN || strings.HasSuffix(strings.TrimSuffix(c.GetTargetKind(), " rule"), "_test") {
+				t.Test = true
+			}
+		}
+	}
+	return targets
+}
+
+// buildTargetTree groups the given targets into a tree of packages.
+func buildTargetTree(targets map[string]*inpb.RenderedTarget) *inpb.TargetTreeNode {
+	root := &inpb.TargetTreeNode{}
+	children := make(map[*inpb.TargetTreeNode]map[string]*inpb.TargetTreeNode)
+	for _, t := range targets {
+		node := root
+		for _, name := range splitPackage(t.GetLabel()) {
+			if children[node] == nil {
+				children[node] = make(map[string]*inpb.TargetTreeNode)
+			}
+			child, ok := children[node][name]
+			if !ok {
+				child = &inpb.TargetTreeNode{Name: name}
+				children[node][name] = child
+				node.Child = append(node.Child, child)
+			}
+			node = child
+		}
+		node.Target = append(node.Target, t)
+	}
+	countTargets(root)
+	return root
+}
+
+// countTargets sorts the children and targets of the node and its
+// descendants, and counts their targets.
+func countTargets(node *inpb.TargetTreeNode) {
+	sort.Slice(node.Child, func(i, j int) bool { return node.Child[i].GetName() < node.Child[j].GetName() })
+	sort.Slice(node.Target, func(i, j int) bool { return node.Target[i].GetLabel() < node.Target[j].GetLabel() })
+	node.TargetCount = int64(len(node.Target))
+	node.FailedTargetCount = 0
+	for _, t := range node.Target {
+		if !t.GetSuccess() || isFailedTestStatus(t.GetTestStatus()) {
+			node.FailedTargetCount++
+		}
+	}
+	for _, child := range node.Child {
+		countTargets(child)
+		node.TargetCount += child.GetTargetCount()
+		node.FailedTargetCount += child.GetFailedTargetCount()
+	}
+}
+
+// buildRenderModel precomputes what the invocation page shows from the
+// invocation's events and console log.
+func buildRenderModel(invocation *inpb.Invocation) *inpb.InvocationRenderModel {
+	console := invocation.GetConsoleBuffer()
+	model := &inpb.InvocationRenderModel{
+		TargetTree:       buildTargetTree(renderedTargets(invocation.GetEvent())),
+		ConsoleSizeBytes: int64(len(console)),
+	}
+	// The offset of each line of the console log.
+	var lineOffsets []int64
+	if console != "" {
+		lineOffsets = append(lineOffsets, 0)
+		for i := 0; i < len(console); i++ {
+			if console[i] == '\n' && i+1 < len(console) {
+				lineOffsets = append(lineOffsets, int64(i+1))
+			}
+		}
+	}
+	model.ConsoleLineCount = int64(len(lineOffsets))
+	for _, f := range failure_clusters.Extract(console) {
+		rendered := &inpb.RenderedFailure{
+			Label:       f.Label,
+			Snippet:     f.Snippet,
+			ConsoleLine: int64(f.Line),
+		}
+		if f.Line < len(lineOffsets) {
+			rendered.ConsoleOffsetBytes = lineOffsets[f.Line]
+		}
+		model.Failure = append(model.Failure, rendered)
+	}
+	return model
+}
+
+// writeRenderModel stores the render model of a finalized invocation next to
+// its events. Failing to store it only makes the invocation page slower to
+// load, so errors are logged rather than returned.
+func (e *EventChannel) writeRenderModel(ctx context.Context, invocation *inpb.Invocation) {
+	if e.pw == nil {
+		return
+	}
+	data, err := proto.Marshal(buildRenderModel(invocation))
+	if err == nil {
+		_, err = e.env.GetBlobstore().WriteBlob(ctx, renderModelBlobPath(e.blobPath), data)
+	}
+	if err != nil {
+		log.Warningf("Error writing render model of invocation %s: %s", invocation.GetInvocationId(), err)
+	}
+}
+
+// LookupInvocationRenderModel returns the invocation, without its events,
+// along with its render model. Completed invocations are served from the DB
+// and their stored render model, without reading their events. The render
+// models of in-progress invocations, and of invocations finalized before
+// render models were stored, are built from their events instead. Archived
+// invocations are restored, and returned with an empty render model until
+// they are.
+func LookupInvocationRenderModel(env environment.Env, ctx context.Context, iid string) (*inpb.GetInvocationRenderModelResponse, error) {
+	ti, err := env.GetInvocationDB().LookupInvocation(ctx, iid)
+	if err != nil {
+		return nil, err
+	}
+	if ti.InvocationStatus != int64(inpb.Invocation_PARTIAL_INVOCATION_STATUS) && ti.ArchiveStatus == int64(inpb.Invocation_NOT_ARCHIVED) {
+		blobPath := ti.BlobID
+		if blobPath == "" {
+			blobPath = iid
+		}
+		bs, err := blobstore.ForBackend(env, ti.BlobBackendID)
+		if err != nil {
+			return nil, err
+		}
+		data, err := bs.ReadBlob(ctx, renderModelBlobPath(blobPath))
+		if err == nil {
+			model := &inpb.InvocationRenderModel{}
+			if err := proto.Unmarshal(data, model); err != nil {
+				return nil, status.DataLossErrorf("The render model of invocation %s is corrupted.", iid)
+			}
+			invocation := TableInvocationToProto(ti)
+			if tagsByInvocation, err := env.GetInvocationDB().LookupInvocationTags(ctx, []string{iid}); err != nil {
+				log.Warningf("Error reading tags for invocation %s: %s", iid, err)
+			} else {
+				invocation.Tag = tagsByInvocation[iid]
+			}
+			return &inpb.GetInvocationRenderModelResponse{Invocation: invocation, RenderModel: model}, nil
+		}
+		if !status.IsNotFoundError(err) {
+			log.Warningf("Error reading render model of invocation %s: %s", iid, err)
+		}
+	}
+
+	invocation, err := LookupInvocation(env, ctx, iid)
+	if err != nil {
+		return nil, err
+	}
+	model := buildRenderModel(invocation)
+	// Copy the invocation rather than modifying it, since it may be shared
+	// with the invocation cache.
+	invocation = proto.Clone(invocation).(*inpb.Invocation)
+	invocation.Event = nil
+	invocation.ConsoleBuffer = ""
+	return &inpb.GetInvocationRenderModelResponse{Invocation: invocation, RenderModel: model}, nil
+}
@@ -0,0 +1,100 @@
+package build_event_handler
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/accumulator"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/event_parser"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/protofile"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+// ReplayInvocation re-parses the stored events of a finished invocation and
+// re-populates the database rows derived from them, such as after fixing a
+// bug in the event parser or adding a column.
+//
+// Only the invocation's columns that are parsed from its events are updated;
+// its permissions, cache stats and upload lag are kept as is. Its build
+// metadata and failures are replaced. Its tags are left alone, since they may
+// have been changed since the invocation finished.
+func ReplayInvocation(ctx context.Context, env environment.Env, ti *tables.Invocation) error {
+	if ti.InvocationStatus == int64(inpb.Invocation_PARTIAL_INVOCATION_STATUS) {
+		return status.FailedPreconditionErrorf("invocation %s is still in progress", ti.InvocationID)
+	}
+	bs, err := blobstore.ForBackend(env, ti.BlobBackendID)
+	if err != nil {
+		return err
+	}
+	blobPath := ti.BlobID
+	if blobPath == "" {
+		blobPath = ti.InvocationID
+	}
+
+	parser := event_parser.NewStreamingEventParser()
+	beValues := accumulator.NewBEValues(ti.InvocationID)
+	pr := protofile.NewBufferedProtoReader(bs, blobPath)
+	numEvents := 0
+	for {
+		event := &inpb.InvocationEvent{}
+		err := pr.ReadProto(ctx, event)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return status.UnavailableErrorf("failed to read events of invocation %s: %s", ti.InvocationID, err)
+		}
+		parser.ParseEvent(event)
+		beValues.AddEvent(event.GetBuildEvent())
+		numEvents++
+	}
+	if numEvents == 0 {
+		return status.NotFoundErrorf("no events were found for invocation %s", ti.InvocationID)
+	}
+	invocation := &inpb.Invocation{
+		InvocationId:     ti.InvocationID,
+		InvocationStatus: inpb.Invocation_InvocationStatus(ti.InvocationStatus),
+	}
+	parser.FillInvocation(invocation)
+	parsed := tableInvocationFromProto(invocation, blobPath)
+
+	// Updated by column rather than from the struct, so that columns which
+	// are now parsed as zero values are cleared too.
+	err = env.GetDBHandle().WithContext(ctx).Model(&tables.Invocation{}).Where("invocation_id = ?", ti.InvocationID).Updates(map[string]interface{}{
+		"success":                 parsed.Success,
+		"user":                    parsed.User,
+		"duration_usec":           parsed.DurationUsec,
+		"host":                    parsed.Host,
+		"repo_url":                parsed.RepoURL,
+		"commit_sha":              parsed.CommitSHA,
+		"pull_request_number":     parsed.PullRequestNumber,
+		"role":                    parsed.Role,
+		"bazel_version":           parsed.BazelVersion,
+		"command":                 parsed.Command,
+		"pattern":                 parsed.Pattern,
+		"action_count":            parsed.ActionCount,
+		"configured_target_count": parsed.ConfiguredTargetCount,
+		"completed_target_count":  parsed.CompletedTargetCount,
+		"parser_version":          parsed.ParserVersion,
+		// Invalidates copies of the invocation cached before the replay.
+		"updated_at_usec": timeutil.ToUsec(time.Now()),
+	}).Error
+	if err != nil {
+		return status.InternalErrorf("failed to update invocation %s: %s", ti.InvocationID, err)
+	}
+	if err := env.GetInvocationDB().InsertInvocationBuildMetadata(ctx, ti.InvocationID, beValues.BuildMetadata()); err != nil {
+		return err
+	}
+	var failures []*tables.InvocationFailure
+	if !invocation.GetSuccess() {
+		failures = extractFailures(invocation)
+	}
+	return env.GetInvocationDB().InsertInvocationFailures(ctx, ti.InvocationID, failures)
+}
@@ -0,0 +1,47 @@
+package build_event_handler
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/retention"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+// retainTimingProfile copies the timing profile uploaded by the invocation
+// into its retention class, if any, so that it outlives the invocation's
+// ordinary outputs in the cache. Like the UI, it treats the build tool logs
+// uploaded to the cache as the timing profile. Profiles uploaded to other
+// caches are not found, and are ignored.
+func (e *EventChannel) retainTimingProfile(ctx context.Context, event *build_event_stream.BuildEvent, iid string) {
+	rs := e.env.GetRetentionStore()
+	cache := e.env.GetCache()
+	if rs == nil || cache == nil {
+		return
+	}
+	for _, f := range event.GetBuildToolLogs().GetLog() {
+		u, err := url.Parse(f.GetUri())
+		if err != nil || u.Scheme != "bytestream" {
+			continue
+		}
+		instanceName, d, err := digest.ExtractDigestFromDownloadResourceName(strings.TrimPrefix(u.Path, "/"))
+		if err != nil {
+			continue
+		}
+		ctx, err := prefix.AttachUserPrefixToContext(ctx, e.env)
+		if err != nil {
+			log.Warningf("Could not retain timing profile of invocation %s: %s", iid, err)
+			return
+		}
+		err = retention.Retain(ctx, namespace.CASCache(rs.Cache(cache), instanceName), retention.TimingProfile, d)
+		if err != nil && !status.IsNotFoundError(err) {
+			log.Warningf("Could not retain timing profile of invocation %s: %s", iid, err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package build_event_handler
+
+import (
+	"context"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/tags"
+)
+
+// UpdateInvocationTags adds tags to and removes tags from an invocation, and
+// returns its resulting tags. Tags are shown on the invocation once it has
+// completed.
+func UpdateInvocationTags(ctx context.Context, env environment.Env, iid string, addTags, removeTags []string) ([]string, error) {
+	addTags, err := normalizeTags(addTags)
+	if err != nil {
+		return nil, err
+	}
+	removeTags, err = normalizeTags(removeTags)
+	if err != nil {
+		return nil, err
+	}
+
+	idb := env.GetInvocationDB()
+	ti, err := idb.LookupInvocation(ctx, iid)
+	if err != nil {
+		if db.IsRecordNotFound(err) {
+			return nil, status.NotFoundErrorf("Invocation %q not found", iid)
+		}
+		return nil, err
+	}
+	if err := authorizeInvocationWrite(ctx, env, ti); err != nil {
+		return nil, err
+	}
+
+	tagsByInvocation, err := idb.LookupInvocationTags(ctx, []string{iid})
+	if err != nil {
+		return nil, err
+	}
+	updated := make(map[string]bool)
+	for _, tag := range tagsByInvocation[iid] {
+		updated[tag] = true
+	}
+	for _, tag := range removeTags {
+		delete(updated, tag)
+	}
+	for _, tag := range addTags {
+		updated[tag] = true
+	}
+	if len(updated) > tags.MaxTagsPerInvocation {
+		return nil, status.InvalidArgumentErrorf("Invocations may have at most %d tags", tags.MaxTagsPerInvocation)
+	}
+
+	if err := idb.RemoveInvocationTags(ctx, iid, removeTags); err != nil {
+		return nil, err
+	}
+	if err := idb.AddInvocationTags(ctx, iid, addTags); err != nil {
+		return nil, err
+	}
+	tagsByInvocation, err = idb.LookupInvocationTags(ctx, []string{iid})
+	if err != nil {
+		return nil, err
+	}
+	return tagsByInvocation[iid], nil
+}
+
+func normalizeTags(in []string) ([]string, error) {
+	out := make([]string, 0, len(in))
+	for _, tag := range in {
+		tag = tags.Normalize(tag)
+		if err := tags.Validate(tag); err != nil {
+			return nil, err
+		}
+		out = append(out, tag)
+	}
+	return out, nil
+}
@@ -0,0 +1,110 @@
+package build_event_handler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/prometheus/client_golang/prometheus"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
+)
+
+const (
+	// Uploading build events after the build finished is considered a
+	// bottleneck if it took at least this long, and at least
+	// slowUploadMinFraction of the invocation's duration (including the
+	// upload).
+	slowUploadMinTail     = 10 * time.Second
+	slowUploadMinFraction = 0.1
+
+	// The code of the warning shown for invocations with slow uploads.
+	SlowBuildEventUploadCode = "SLOW_BUILD_EVENT_UPLOAD"
+)
+
+// uploadLagTracker measures how long after Bazel created each build event it
+// was received.
+type uploadLagTracker struct {
+	count    int64
+	totalLag time.Duration
+	maxLag   time.Duration
+
+	buildFinishedTime time.Time
+	lastReceivedTime  time.Time
+}
+
+// observe records that the given event, created by Bazel at eventTime, was
+// received at receivedTime.
+func (t *uploadLagTracker) observe(event *build_event_stream.BuildEvent, eventTime *tspb.Timestamp, receivedTime time.Time) {
+	if eventTime == nil {
+		return
+	}
+	createdTime, err := ptypes.Timestamp(eventTime)
+	if err != nil {
+		return
+	}
+	lag := receivedTime.Sub(createdTime)
+	if lag < 0 {
+		// Bazel's clock is ahead of ours.
+		lag = 0
+	}
+	t.count++
+	t.totalLag += lag
+	if lag > t.maxLag {
+		t.maxLag = lag
+	}
+	metrics.BuildEventUploadLagUsec.Observe(float64(lag.Microseconds()))
+
+	if event.GetFinished() != nil {
+		t.buildFinishedTime = createdTime
+	}
+	if receivedTime.After(t.lastReceivedTime) {
+		t.lastReceivedTime = receivedTime
+	}
+}
+
+// uploadTail returns how long after the build finished the last event was
+// received, or 0 if the build hasn't finished.
+func (t *uploadLagTracker) uploadTail() time.Duration {
+	if t.buildFinishedTime.IsZero() {
+		return 0
+	}
+	tail := t.lastReceivedTime.Sub(t.buildFinishedTime)
+	if tail < 0 {
+		return 0
+	}
+	return tail
+}
+
+// fillInvocation sets the upload lag fields of the given invocation, whose
+// duration must already be set.
+func (t *uploadLagTracker) fillInvocation(invocation *inpb.Invocation) {
+	if t.count == 0 {
+		return
+	}
+	invocation.MaxBuildEventUploadLagUsec = t.maxLag.Microseconds()
+	invocation.MeanBuildEventUploadLagUsec = (t.totalLag / time.Duration(t.count)).Microseconds()
+	tail := t.uploadTail()
+	invocation.BuildEventUploadTailUsec = tail.Microseconds()
+	total := time.Duration(invocation.GetDurationUsec())*time.Microsecond + tail
+	invocation.SlowBuildEventUpload = tail >= slowUploadMinTail && float64(tail) >= slowUploadMinFraction*float64(total)
+	if invocation.SlowBuildEventUpload {
+		metrics.SlowBuildEventUploadCount.With(prometheus.Labels{
+			metrics.BazelCommand: invocation.GetCommand(),
+		}).Inc()
+	}
+}
+
+// slowBuildEventUploadWarning returns the warning shown for an invocation
+// whose build events were slow to upload.
+func slowBuildEventUploadWarning(invocation *inpb.Invocation) *inpb.InvocationWarning {
+	tail := time.Duration(invocation.GetBuildEventUploadTailUsec()) * time.Microsecond
+	return &inpb.InvocationWarning{
+		Code:    SlowBuildEventUploadCode,
+		Flag:    "bes_upload_mode",
+		Message: fmt.Sprintf("Bazel spent %s after the build finished waiting for build events to upload. Setting --bes_upload_mode=fully_async lets Bazel exit without waiting for the upload to complete.", tail.Round(time.Second)),
+	}
+}
@@ -0,0 +1,47 @@
+package build_event_handler
+
+import (
+	"hash/fnv"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+)
+
+// eventWorkers is a fixed pool of workers which build events are handled on.
+// Each invocation's events are handled by the same worker, so they're handled
+// in the order they were received, while the events of different invocations
+// are handled in parallel.
+type eventWorkers struct {
+	queues []chan *eventTask
+}
+
+type eventTask struct {
+	run      func()
+	enqueued time.Time
+}
+
+func newEventWorkers(numWorkers, queueSize int) *eventWorkers {
+	w := &eventWorkers{queues: make([]chan *eventTask, numWorkers)}
+	for i := range w.queues {
+		q := make(chan *eventTask, queueSize)
+		w.queues[i] = q
+		go func() {
+			for task := range q {
+				metrics.BuildEventHandlerQueueLength.Dec()
+				metrics.BuildEventHandlerQueueWaitUsec.Observe(float64(time.Since(task.enqueued).Microseconds()))
+				task.run()
+			}
+		}()
+	}
+	return w
+}
+
+// submit queues up a func to run on the worker of the given invocation. If
+// the worker's queue is full, it blocks until there's room, which holds back
+// the streams sending events faster than they can be handled.
+func (w *eventWorkers) submit(iid string, run func()) {
+	h := fnv.New32a()
+	h.Write([]byte(iid))
+	metrics.BuildEventHandlerQueueLength.Inc()
+	w.queues[h.Sum32()%uint32(len(w.queues))] <- &eventTask{run: run, enqueued: time.Now()}
+}
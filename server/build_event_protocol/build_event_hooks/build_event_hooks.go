@@ -0,0 +1,82 @@
+// Package build_event_hooks provides a registration point for custom
+// interfaces.BuildEventHook implementations.
+//
+// To add a hook to a deployment, compile in a package which registers it from
+// an init function:
+//
+//	func init() {
+//		build_event_hooks.Register(build_event_hooks.ForEventTypes(&myHook{}, &build_event_stream.BuildEvent_Completed{}))
+//	}
+//
+// All registered hooks are installed in the environment at startup.
+package build_event_hooks
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+var (
+	mu         sync.Mutex
+	registered []interfaces.BuildEventHook
+)
+
+// Register adds a hook to be installed at startup. It should be called from
+// an init function.
+func Register(hook interfaces.BuildEventHook) {
+	mu.Lock()
+	defer mu.Unlock()
+	registered = append(registered, hook)
+}
+
+// Registered returns all hooks added with Register, in registration order.
+func Registered() []interfaces.BuildEventHook {
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]interfaces.BuildEventHook{}, registered...)
+}
+
+// NoopHook implements interfaces.BuildEventHook by doing nothing. It can be
+// embedded in hooks that only need to implement some of the methods.
+type NoopHook struct{}
+
+func (*NoopHook) OnInvocationStarted(ctx context.Context, invocationID string, event *inpb.InvocationEvent) error {
+	return nil
+}
+
+func (*NoopHook) OnBuildEvent(ctx context.Context, invocationID string, event *inpb.InvocationEvent) error {
+	return nil
+}
+
+func (*NoopHook) OnInvocationFinished(ctx context.Context, invocation *inpb.Invocation) error {
+	return nil
+}
+
+type filteredHook struct {
+	interfaces.BuildEventHook
+	payloadTypes map[reflect.Type]bool
+}
+
+func (h *filteredHook) OnBuildEvent(ctx context.Context, invocationID string, event *inpb.InvocationEvent) error {
+	if !h.payloadTypes[reflect.TypeOf(event.GetBuildEvent().GetPayload())] {
+		return nil
+	}
+	return h.BuildEventHook.OnBuildEvent(ctx, invocationID, event)
+}
+
+// ForEventTypes returns a hook which only passes build events to the given
+// hook's OnBuildEvent if their payload has one of the given types, such as
+// &build_event_stream.BuildEvent_Progress{}. Invocation start and finish are
+// always passed through.
+func ForEventTypes(hook interfaces.BuildEventHook, payloads ...interface{}) interfaces.BuildEventHook {
+	types := make(map[reflect.Type]bool, len(payloads))
+	for _, p := range payloads {
+		types[reflect.TypeOf(p)] = true
+	}
+	return &filteredHook{BuildEventHook: hook, payloadTypes: types}
+}
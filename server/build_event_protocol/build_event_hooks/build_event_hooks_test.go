@@ -0,0 +1,57 @@
+package build_event_hooks_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_hooks"
+	"github.com/stretchr/testify/assert"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+type recordingHook struct {
+	build_event_hooks.NoopHook
+	started int
+	events  []*inpb.InvocationEvent
+}
+
+func (h *recordingHook) OnInvocationStarted(ctx context.Context, invocationID string, event *inpb.InvocationEvent) error {
+	h.started++
+	return nil
+}
+
+func (h *recordingHook) OnBuildEvent(ctx context.Context, invocationID string, event *inpb.InvocationEvent) error {
+	h.events = append(h.events, event)
+	return nil
+}
+
+func TestForEventTypes(t *testing.T) {
+	ctx := context.Background()
+	rec := &recordingHook{}
+	hook := build_event_hooks.ForEventTypes(rec, &build_event_stream.BuildEvent_Progress{}, &build_event_stream.BuildEvent_Finished{})
+
+	started := &inpb.InvocationEvent{BuildEvent: &build_event_stream.BuildEvent{Payload: &build_event_stream.BuildEvent_Started{}}}
+	progress := &inpb.InvocationEvent{BuildEvent: &build_event_stream.BuildEvent{Payload: &build_event_stream.BuildEvent_Progress{}}}
+	finished := &inpb.InvocationEvent{BuildEvent: &build_event_stream.BuildEvent{Payload: &build_event_stream.BuildEvent_Finished{}}}
+
+	assert.NoError(t, hook.OnInvocationStarted(ctx, "iid", started))
+	for _, e := range []*inpb.InvocationEvent{started, progress, finished} {
+		assert.NoError(t, hook.OnBuildEvent(ctx, "iid", e))
+	}
+	assert.NoError(t, hook.OnInvocationFinished(ctx, &inpb.Invocation{}))
+
+	assert.Equal(t, 1, rec.started)
+	assert.Equal(t, []*inpb.InvocationEvent{progress, finished}, rec.events)
+}
+
+func TestRegister(t *testing.T) {
+	before := len(build_event_hooks.Registered())
+	hook := &recordingHook{}
+	build_event_hooks.Register(hook)
+
+	hooks := build_event_hooks.Registered()
+	assert.Len(t, hooks, before+1)
+	assert.Same(t, hook, hooks[len(hooks)-1])
+}
@@ -2,23 +2,157 @@ package build_event_proxy
 
 import (
 	"context"
+	"net"
+	"net/url"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_client"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/golang/protobuf/ptypes/empty"
 	"google.golang.org/grpc"
 
 	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
 )
 
+const (
+	// How long to wait for the proxy host to acknowledge the rest of a
+	// stream's events once all of them have been sent.
+	streamCloseTimeout = 1 * time.Minute
+)
+
+// NormalizeTarget validates a build event protocol server URL that build
+// events may be forwarded to, such as "grpcs://bes.example.com:443", and
+// returns it with surrounding whitespace removed. An empty target is valid.
+func NormalizeTarget(target string) (string, error) {
+	target = strings.TrimSpace(target)
+	if target == "" {
+		return "", nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", status.InvalidArgumentErrorf("invalid build event protocol server URL %q: %s", target, err)
+	}
+	if u.Scheme != "grpc" && u.Scheme != "grpcs" {
+		return "", status.InvalidArgumentErrorf("invalid build event protocol server URL %q: the scheme must be grpc or grpcs", target)
+	}
+	if u.Host == "" {
+		return "", status.InvalidArgumentErrorf("invalid build event protocol server URL %q: a host is required", target)
+	}
+	return target, nil
+}
+
+// CheckForwardingTarget returns an error unless an organization may forward
+// its build events to the given target. If allowedHosts is set, the target's
+// host must be one of them, or, for entries such as "*.example.com", a
+// subdomain of one of them.
+func CheckForwardingTarget(target string, allowedHosts []string) error {
+	if len(allowedHosts) == 0 {
+		return nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return status.InvalidArgumentErrorf("invalid build event protocol server URL %q: %s", target, err)
+	}
+	if !IsAllowedHost(u.Hostname(), allowedHosts) {
+		return status.PermissionDeniedErrorf("build events may not be forwarded to %q", u.Hostname())
+	}
+	return nil
+}
+
+// IsAllowedHost returns whether the host is one of allowedHosts, or, for
+// entries such as "*.example.com", a subdomain of one of them.
+func IsAllowedHost(host string, allowedHosts []string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range allowedHosts {
+		allowed = strings.ToLower(allowed)
+		if strings.HasPrefix(allowed, "*.") {
+			if strings.HasSuffix(host, allowed[1:]) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// nonPublicNetworks are the networks that organizations may not forward build
+// events to, unless the app only allows forwarding to certain hosts.
+var nonPublicNetworks = parseCIDRs(
+	"0.0.0.0/8",      // "This" network
+	"10.0.0.0/8",     // Private
+	"100.64.0.0/10",  // Carrier-grade NAT
+	"127.0.0.0/8",    // Loopback
+	"169.254.0.0/16", // Link-local, including cloud metadata servers
+	"172.16.0.0/12",  // Private
+	"192.168.0.0/16", // Private
+	"::/128",         // Unspecified
+	"::1/128",        // Loopback
+	"fc00::/7",       // Unique local
+	"fe80::/10",      // Link-local
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func isPublicIP(ip net.IP) bool {
+	if ip.IsMulticast() {
+		return false
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// DialPublicAddress connects to the given host and port, unless the host
+// resolves to an address that isn't public. The check is made on the
+// addresses that are connected to, so that it can't be sidestepped by a host
+// whose DNS records change after it was checked.
+func DialPublicAddress(ctx context.Context, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, status.UnavailableErrorf("could not resolve %q: %s", host, err)
+	}
+	if len(ips) == 0 {
+		return nil, status.UnavailableErrorf("could not resolve %q", host)
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip.IP) {
+			return nil, status.PermissionDeniedErrorf("%q may not be connected to, since it resolves to the non-public address %s", host, ip.IP)
+		}
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", net.JoinHostPort(ips[0].IP.String(), port))
+}
+
 type BuildEventProxyClient struct {
 	client          pepb.PublishBuildEventClient
+	conn            *grpc.ClientConn
 	rootCtx         context.Context
 	target          string
+	dialOptions     []grpc.DialOption
 	eventBufferSize int
-	clientMux       sync.Mutex // PROTECTS(client)
+	clientMux       sync.Mutex // PROTECTS(client, conn)
 }
 
 func (c *BuildEventProxyClient) reconnectIfNecessary() {
@@ -27,22 +161,40 @@ func (c *BuildEventProxyClient) reconnectIfNecessary() {
 	}
 	c.clientMux.Lock()
 	defer c.clientMux.Unlock()
-	conn, err := grpc_client.DialTarget(c.target)
+	conn, err := grpc_client.DialTargetWithOptions(c.target, true, c.dialOptions...)
 	if err != nil {
 		log.Warningf("Unable to connect to proxy host '%s': %s", c.target, err)
 		c.client = nil
 		return
 	}
+	c.conn = conn
 	c.client = pepb.NewPublishBuildEventClient(conn)
 }
 
 func NewBuildEventProxyClient(env environment.Env, target string) *BuildEventProxyClient {
+	return newBuildEventProxyClient(env, target)
+}
+
+// NewForwardingClient returns a client for the build event protocol server
+// that an organization forwards its build events to. Unless the app only
+// allows forwarding to certain hosts (see CheckForwardingTarget), the client
+// refuses to connect to non-public addresses, so that organizations can't
+// use forwarding to reach the app's own network.
+func NewForwardingClient(env environment.Env, target string) *BuildEventProxyClient {
+	if len(env.GetConfigurator().GetBuildEventProxyAllowedForwardingHosts()) > 0 {
+		return newBuildEventProxyClient(env, target)
+	}
+	return newBuildEventProxyClient(env, target, grpc.WithContextDialer(DialPublicAddress))
+}
+
+func newBuildEventProxyClient(env environment.Env, target string, dialOptions ...grpc.DialOption) *BuildEventProxyClient {
 	bufferSize := 100
 	if configuredBufferSize := env.GetConfigurator().GetBuildEventProxyBufferSize(); configuredBufferSize != 0 {
 		bufferSize = configuredBufferSize
 	}
 	c := &BuildEventProxyClient{
 		target:          target,
+		dialOptions:     dialOptions,
 		rootCtx:         context.Background(),
 		eventBufferSize: bufferSize,
 	}
@@ -50,6 +202,20 @@ func NewBuildEventProxyClient(env environment.Env, target string) *BuildEventPro
 	return c
 }
 
+// Close closes the client's connection, cutting off any streams that are
+// still being forwarded on it.
+func (c *BuildEventProxyClient) Close() error {
+	c.clientMux.Lock()
+	defer c.clientMux.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	c.client = nil
+	return err
+}
+
 func (c *BuildEventProxyClient) PublishLifecycleEvent(_ context.Context, req *pepb.PublishLifecycleEventRequest, opts ...grpc.CallOption) (*empty.Empty, error) {
 	c.reconnectIfNecessary()
 	go func() {
@@ -74,6 +240,8 @@ func (c *BuildEventProxyClient) newAsyncStreamProxy(ctx context.Context, opts ..
 	}
 	// Start a goroutine that will open the stream and pass along events.
 	go func() {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
 		stream, err := c.client.PublishBuildToolEventStream(ctx, opts...)
 		if err != nil {
 			log.Warningf("Error opening BES stream to proxy: %s", err.Error())
@@ -81,6 +249,18 @@ func (c *BuildEventProxyClient) newAsyncStreamProxy(ctx context.Context, opts ..
 		}
 		asp.PublishBuildEvent_PublishBuildToolEventStreamClient = stream
 
+		// Read the proxy host's acks as they come in, so that it isn't
+		// blocked on sending them.
+		recvDone := make(chan struct{})
+		go func() {
+			defer close(recvDone)
+			for {
+				if _, err := stream.Recv(); err != nil {
+					return
+				}
+			}
+		}()
+
 		// `range` *copies* the values it returns into the loopvar, and
 		// copies of protos are not permitted, so rather than range over the
 		// channel we read from the channel inside of an outer loop.
@@ -96,6 +276,11 @@ func (c *BuildEventProxyClient) newAsyncStreamProxy(ctx context.Context, opts ..
 			}
 		}
 		stream.CloseSend()
+		select {
+		case <-recvDone:
+		case <-time.After(streamCloseTimeout):
+			log.Warningf("Timed out waiting for proxy host to close BES stream")
+		}
 	}()
 	return asp
 }
@@ -121,5 +306,8 @@ func (asp *asyncStreamProxy) CloseSend() error {
 
 func (c *BuildEventProxyClient) PublishBuildToolEventStream(_ context.Context, opts ...grpc.CallOption) (pepb.PublishBuildEvent_PublishBuildToolEventStreamClient, error) {
 	c.reconnectIfNecessary()
+	if c.client == nil {
+		return nil, status.UnavailableErrorf("not connected to proxy host '%s'", c.target)
+	}
 	return c.newAsyncStreamProxy(c.rootCtx, opts...), nil
 }
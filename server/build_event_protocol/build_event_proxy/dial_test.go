@@ -0,0 +1,49 @@
+package build_event_proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	for _, tc := range []struct {
+		ip     string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.20.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.100.0.1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"::1", false},
+		{"::", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+	} {
+		assert.Equal(t, tc.public, isPublicIP(net.ParseIP(tc.ip)), tc.ip)
+	}
+}
+
+func TestDialPublicAddressRefusesLoopback(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+	_, port, err := net.SplitHostPort(lis.Addr().String())
+	require.NoError(t, err)
+
+	for _, host := range []string{"127.0.0.1", "localhost"} {
+		_, err := DialPublicAddress(context.Background(), net.JoinHostPort(host, port))
+		assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied for %s, got %v", host, err)
+	}
+}
@@ -9,8 +9,11 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/backends/github"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/accumulator"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/target"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
 
 	gitutil "github.com/buildbuddy-io/buildbuddy/server/util/git"
@@ -18,7 +21,7 @@ import (
 
 type BuildStatusReporter struct {
 	env                   environment.Env
-	githubClient          *github.GithubClient
+	statusClient          commitStatusClient
 	buildEventAccumulator *accumulator.BEValues
 	groups                map[string]*GroupStatus
 	inFlight              map[string]bool
@@ -28,6 +31,41 @@ type BuildStatusReporter struct {
 	statusNameSuffix          string
 	payloads                  []*github.GithubStatusPayload
 	shouldReportStatusPerTest bool
+	groupID                   string
+	// Labels of the targets which failed to build or whose tests failed.
+	failedLabels map[string]bool
+	// Labels of the targets quarantined by the group, loaded when first
+	// needed.
+	quarantinedLabels map[string]bool
+}
+
+// commitStatusClient reports the statuses of the commit being built.
+type commitStatusClient interface {
+	CreateStatus(ctx context.Context, ownerRepo string, commitSHA string, payload *github.GithubStatusPayload) error
+}
+
+// gitProviderStatusClient reports statuses to a git provider other than
+// GitHub, with the access token of the workflow that started the build.
+type gitProviderStatusClient struct {
+	provider    interfaces.GitProvider
+	accessToken string
+	repoURL     string
+}
+
+func (c *gitProviderStatusClient) CreateStatus(ctx context.Context, ownerRepo string, commitSHA string, payload *github.GithubStatusPayload) error {
+	if c.accessToken == "" || commitSHA == "" {
+		return nil // We can't create a status without credentials and a commit SHA.
+	}
+	err := c.provider.CreateStatus(ctx, c.accessToken, c.repoURL, commitSHA, &interfaces.CommitStatus{
+		Context:     payload.Context,
+		State:       string(payload.State),
+		TargetURL:   payload.TargetURL,
+		Description: payload.Description,
+	})
+	if err != nil {
+		log.Warningf("Error posting commit status: %s", err)
+	}
+	return err
 }
 
 type GroupStatus struct {
@@ -54,15 +92,112 @@ func NewBuildStatusReporter(env environment.Env, buildEventAccumulator *accumula
 		buildEventAccumulator:     buildEventAccumulator,
 		payloads:                  make([]*github.GithubStatusPayload, 0),
 		inFlight:                  make(map[string]bool),
+		failedLabels:              make(map[string]bool),
+	}
+}
+
+// SetGroupID sets the group that the invocation belongs to, whose quarantined
+// targets don't fail the reported status.
+func (r *BuildStatusReporter) SetGroupID(groupID string) {
+	r.groupID = groupID
+}
+
+// isQuarantined returns whether failures of the given target should not fail
+// the reported status.
+func (r *BuildStatusReporter) isQuarantined(ctx context.Context, label string) bool {
+	if r.quarantinedLabels == nil {
+		labels, err := target.QuarantinedLabels(ctx, r.env, r.groupID)
+		if err != nil {
+			log.Warningf("Failed to look up quarantined targets for group %q: %s", r.groupID, err)
+			labels = make(map[string]bool)
+		}
+		r.quarantinedLabels = labels
+	}
+	return r.quarantinedLabels[label]
+}
+
+// onlyQuarantinedTargetsFailed returns whether targets failed and all of them
+// are quarantined.
+func (r *BuildStatusReporter) onlyQuarantinedTargetsFailed(ctx context.Context) bool {
+	if len(r.failedLabels) == 0 {
+		return false
+	}
+	for label := range r.failedLabels {
+		if !r.isQuarantined(ctx, label) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupWorkflow returns the workflow that started the build, if any, with its
+// access token decrypted.
+func (r *BuildStatusReporter) lookupWorkflow() (*tables.Workflow, error) {
+	workflowID := r.buildEventAccumulator.WorkflowID()
+	db := r.env.GetDBHandle()
+	if workflowID == "" || db == nil {
+		return nil, nil
+	}
+	workflow := &tables.Workflow{}
+	if err := db.Raw(`SELECT * from Workflows WHERE workflow_id = ?`, workflowID).Take(workflow).Error; err != nil {
+		return nil, nil
+	}
+	if ss := r.env.GetSecretService(); ss != nil {
+		accessToken, err := ss.Decrypt(workflow.AccessToken)
+		if err != nil {
+			return nil, status.WrapErrorf(err, "failed to decrypt access token of workflow %s", workflowID)
+		}
+		workflow.AccessToken = accessToken
 	}
+	return workflow, nil
 }
 
-func (r *BuildStatusReporter) initGHClient(ctx context.Context) *github.GithubClient {
-	if workflowID := r.buildEventAccumulator.WorkflowID(); workflowID != "" {
-		if db := r.env.GetDBHandle(); db != nil {
-			workflow := &tables.Workflow{}
-			if err := db.Raw(`SELECT * from Workflows WHERE workflow_id = ?`, workflowID).Take(workflow).Error; err == nil {
-				return github.NewGithubClient(r.env, workflow.AccessToken)
+// nonGitHubProvider returns the git provider of the repo, if it's hosted
+// somewhere other than GitHub.
+func (r *BuildStatusReporter) nonGitHubProvider(repoURL string) interfaces.GitProvider {
+	u, err := gitutil.ParseRepoURL(repoURL)
+	if err != nil || u.Host == "github.com" {
+		return nil
+	}
+	for _, provider := range r.env.GetGitProviders() {
+		if provider.MatchRepoURL(u) {
+			return provider
+		}
+	}
+	return nil
+}
+
+func (r *BuildStatusReporter) initStatusClient(ctx context.Context) commitStatusClient {
+	repoURL := r.buildEventAccumulator.RepoURL()
+	workflow, err := r.lookupWorkflow()
+	if err != nil {
+		log.Warningf("Error looking up workflow: %s", err)
+		return github.NewGithubClient(r.env, "")
+	}
+
+	// Statuses are only reported to other providers for workflows, since
+	// there are no other credentials for them.
+	if provider := r.nonGitHubProvider(repoURL); provider != nil {
+		client := &gitProviderStatusClient{provider: provider, repoURL: repoURL}
+		if workflow != nil {
+			client.accessToken = workflow.AccessToken
+		}
+		return client
+	}
+
+	app := r.env.GetGitHubApp()
+	if workflow != nil {
+		if workflow.GithubAppInstallationID != 0 && app != nil {
+			return github.NewGithubAppClient(r.env, app, workflow.GroupID, workflow.GithubAppInstallationID)
+		}
+		return github.NewGithubClient(r.env, workflow.AccessToken)
+	}
+	// Builds of repos that the GitHub App is installed on report their
+	// statuses as the App, if the installation is linked to the build's group.
+	if app != nil {
+		if u, err := gitutil.ParseRepoURL(repoURL); err == nil && u.Host == "github.com" {
+			if installationID, err := app.GetInstallationID(ctx, r.groupID, repoURL); err == nil {
+				return github.NewGithubAppClient(r.env, app, r.groupID, installationID)
 			}
 		}
 	}
@@ -74,10 +209,13 @@ func (r *BuildStatusReporter) ReportStatusForEvent(ctx context.Context, event *b
 		return
 	}
 
-	// TODO: support other providers than just GitHub
 	var githubPayload *github.GithubStatusPayload
 
 	switch event.Payload.(type) {
+	case *build_event_stream.BuildEvent_Completed:
+		if !event.GetCompleted().GetSuccess() {
+			r.failedLabels[r.labelFromEvent(event)] = true
+		}
 	case *build_event_stream.BuildEvent_WorkspaceStatus:
 		githubPayload = r.githubPayloadFromWorkspaceStatusEvent(event)
 
@@ -86,14 +224,17 @@ func (r *BuildStatusReporter) ReportStatusForEvent(ctx context.Context, event *b
 			githubPayload = r.githubPayloadFromConfiguredEvent(event)
 		}
 	case *build_event_stream.BuildEvent_TestSummary:
+		if s := event.GetTestSummary().GetOverallStatus(); s != build_event_stream.TestStatus_PASSED && s != build_event_stream.TestStatus_FLAKY {
+			r.failedLabels[r.labelFromEvent(event)] = true
+		}
 		if r.shouldReportStatusPerTest {
-			githubPayload = r.githubPayloadFromTestSummaryEvent(event)
+			githubPayload = r.githubPayloadFromTestSummaryEvent(ctx, event)
 		}
 	case *build_event_stream.BuildEvent_Aborted:
 		githubPayload = r.githubPayloadFromAbortedEvent(event)
 
 	case *build_event_stream.BuildEvent_Finished:
-		githubPayload = r.githubPayloadFromFinishedEvent(event)
+		githubPayload = r.githubPayloadFromFinishedEvent(ctx, event)
 	}
 
 	if githubPayload != nil {
@@ -113,8 +254,8 @@ func (r *BuildStatusReporter) flushPayloadsIfWorkspaceLoaded(ctx context.Context
 	if !r.buildEventAccumulator.WorkspaceIsLoaded() {
 		return // If we haven't loaded the workspace, we can't flush payloads yet.
 	}
-	if r.githubClient == nil {
-		r.githubClient = r.initGHClient(ctx)
+	if r.statusClient == nil {
+		r.statusClient = r.initStatusClient(ctx)
 	}
 
 	for _, payload := range r.payloads {
@@ -128,11 +269,11 @@ func (r *BuildStatusReporter) flushPayloadsIfWorkspaceLoaded(ctx context.Context
 		repoURL := r.buildEventAccumulator.RepoURL()
 		ownerRepo, err := gitutil.OwnerRepoFromRepoURL(repoURL)
 		if err != nil {
-			log.Warningf("Failed to report GitHub status: %s", err)
+			log.Warningf("Failed to report commit status: %s", err)
 			break
 		}
 		commitSHA := r.buildEventAccumulator.CommitSHA()
-		r.githubClient.CreateStatus(ctx, ownerRepo, commitSHA, r.appendStatusNameSuffix(payload))
+		r.statusClient.CreateStatus(ctx, ownerRepo, commitSHA, r.appendStatusNameSuffix(payload))
 	}
 
 	r.payloads = make([]*github.GithubStatusPayload, 0)
@@ -168,9 +309,14 @@ func (r *BuildStatusReporter) githubPayloadFromConfiguredEvent(event *build_even
 	return github.NewGithubStatusPayload(label, r.targetURL(label), "Running...", github.PendingState)
 }
 
-func (r *BuildStatusReporter) githubPayloadFromTestSummaryEvent(event *build_event_stream.BuildEvent) *github.GithubStatusPayload {
+func (r *BuildStatusReporter) githubPayloadFromTestSummaryEvent(ctx context.Context, event *build_event_stream.BuildEvent) *github.GithubStatusPayload {
 	passed := event.GetTestSummary().OverallStatus == build_event_stream.TestStatus_PASSED
 	label := r.labelFromEvent(event)
+	description := descriptionFromOverallStatus(event.GetTestSummary().OverallStatus)
+	if !passed && r.isQuarantined(ctx, label) {
+		passed = true
+		description += " (quarantined)"
+	}
 	groupStatus := r.groupStatusFromLabel(label)
 	if groupStatus != nil {
 		if passed {
@@ -180,8 +326,6 @@ func (r *BuildStatusReporter) githubPayloadFromTestSummaryEvent(event *build_eve
 		}
 	}
 
-	description := descriptionFromOverallStatus(event.GetTestSummary().OverallStatus)
-
 	if groupStatus != nil && groupStatus.numFailed == 1 {
 		return github.NewGithubStatusPayload(groupStatus.name, r.groupURL(label), description, github.FailureState)
 	}
@@ -197,14 +341,21 @@ func (r *BuildStatusReporter) githubPayloadFromTestSummaryEvent(event *build_eve
 	return github.NewGithubStatusPayload(label, r.targetURL(label), description, github.FailureState)
 }
 
-func (r *BuildStatusReporter) githubPayloadFromFinishedEvent(event *build_event_stream.BuildEvent) *github.GithubStatusPayload {
+func (r *BuildStatusReporter) githubPayloadFromFinishedEvent(ctx context.Context, event *build_event_stream.BuildEvent) *github.GithubStatusPayload {
+	success := event.GetFinished().GetExitCode().GetCode() == 0
 	description := descriptionFromExitCodeName(event.GetFinished().ExitCode.Name)
+	if !success && isTargetFailureExitCode(event.GetFinished().ExitCode.Name) && r.onlyQuarantinedTargetsFailed(ctx) {
+		// The invocation is still recorded as failed, but CI isn't blocked
+		// on targets that are known to be broken.
+		success = true
+		description = fmt.Sprintf("Successful except %d quarantined %s", len(r.failedLabels), pluralize("target", len(r.failedLabels)))
+	}
 	startTime := r.buildEventAccumulator.StartTime()
 	endTime := timeutil.FromMillis(event.GetFinished().GetFinishTimeMillis())
 	if !startTime.IsZero() && endTime.After(startTime) {
 		description = fmt.Sprintf("%s in %s", description, timeutil.ShortFormatDuration(endTime.Sub(startTime)))
 	}
-	if event.GetFinished().OverallSuccess {
+	if success {
 		return github.NewGithubStatusPayload(r.invocationLabel(), r.invocationURL(), description, github.SuccessState)
 	}
 
@@ -322,6 +473,20 @@ func descriptionFromOverallStatus(overallStatus build_event_stream.TestStatus) s
 	}
 }
 
+// isTargetFailureExitCode returns whether Bazel exited with the given code
+// because targets failed to build or their tests failed, as opposed to, say,
+// the build being interrupted.
+func isTargetFailureExitCode(exitCodeName string) bool {
+	return exitCodeName == "BUILD_FAILURE" || exitCodeName == "TESTS_FAILED"
+}
+
+func pluralize(noun string, count int) string {
+	if count == 1 {
+		return noun
+	}
+	return noun + "s"
+}
+
 func descriptionFromExitCodeName(exitCodeName string) string {
 	if exitCodeName == "OK" {
 		return "Successful"
@@ -0,0 +1,119 @@
+// Package event_compat upgrades build events sent by older Bazel versions,
+// which report some fields in locations that have since been deprecated, so
+// that the rest of the app only needs to read the current locations.
+package event_compat
+
+import (
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/util/client_version"
+)
+
+// shim moves fields of an event from a legacy location to the current one.
+// Shims only fill in fields that are missing from the current location, so
+// applying them to an event that is already up to date is a no-op.
+type shim struct {
+	name string
+	// The first Bazel version which reports the fields in the current
+	// location. The shim is only applied to older versions.
+	fixedIn string
+	upgrade func(event *build_event_stream.BuildEvent) bool
+}
+
+var shims = []*shim{
+	{
+		name:    "finished_exit_code",
+		fixedIn: "1.0.0",
+		upgrade: upgradeFinishedExitCode,
+	},
+	{
+		name:    "action_completed_id",
+		fixedIn: "1.0.0",
+		upgrade: upgradeActionCompletedID,
+	},
+}
+
+// upgradeFinishedExitCode sets the exit code of BuildFinished events which
+// only report the deprecated overall_success field.
+func upgradeFinishedExitCode(event *build_event_stream.BuildEvent) bool {
+	finished := event.GetFinished()
+	if finished == nil || finished.ExitCode != nil {
+		return false
+	}
+	if finished.OverallSuccess {
+		finished.ExitCode = &build_event_stream.BuildFinished_ExitCode{Name: "SUCCESS", Code: 0}
+	} else {
+		finished.ExitCode = &build_event_stream.BuildFinished_ExitCode{Name: "BUILD_FAILURE", Code: 1}
+	}
+	return true
+}
+
+// upgradeActionCompletedID sets the label and configuration of the IDs of
+// ActionExecuted events that only report them in the deprecated fields of the
+// event itself.
+func upgradeActionCompletedID(event *build_event_stream.BuildEvent) bool {
+	action := event.GetAction()
+	id := event.GetId().GetActionCompleted()
+	if action == nil || id == nil {
+		return false
+	}
+	upgraded := false
+	if id.Label == "" && action.Label != "" {
+		id.Label = action.Label
+		upgraded = true
+	}
+	if id.Configuration == nil && action.Configuration != nil {
+		id.Configuration = action.Configuration
+		upgraded = true
+	}
+	return upgraded
+}
+
+// Upgrader upgrades the build events of an invocation.
+type Upgrader struct {
+	shims []*shim
+}
+
+// NewUpgrader returns an upgrader for the events of the given Bazel version,
+// as reported by the BuildStarted event. Versions that can't be parsed are
+// assumed to be current, except for an empty version, which is assumed to be
+// old. Returns nil if no shims apply, in which case events are left as-is.
+func NewUpgrader(bazelVersion string) *Upgrader {
+	var v *client_version.Version
+	if bazelVersion != "" {
+		parsed, err := client_version.Parse(bazelVersion)
+		if err != nil {
+			return nil
+		}
+		v = parsed
+	}
+	u := &Upgrader{}
+	for _, s := range shims {
+		fixedIn, err := client_version.Parse(s.fixedIn)
+		if err != nil {
+			continue
+		}
+		if v == nil || v.Compare(fixedIn) < 0 {
+			u.shims = append(u.shims, s)
+		}
+	}
+	if len(u.shims) == 0 {
+		return nil
+	}
+	return u
+}
+
+// Upgrade moves any fields of the event that are in a legacy location to the
+// current one, modifying it in place. It returns the names of the shims that
+// changed the event.
+func (u *Upgrader) Upgrade(event *build_event_stream.BuildEvent) []string {
+	if u == nil || event == nil {
+		return nil
+	}
+	var applied []string
+	for _, s := range u.shims {
+		if s.upgrade(event) {
+			applied = append(applied, s.name)
+		}
+	}
+	return applied
+}
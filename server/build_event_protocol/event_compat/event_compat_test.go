@@ -0,0 +1,74 @@
+package event_compat_test
+
+import (
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/event_compat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func finishedEvent(success bool) *build_event_stream.BuildEvent {
+	return &build_event_stream.BuildEvent{
+		Payload: &build_event_stream.BuildEvent_Finished{
+			Finished: &build_event_stream.BuildFinished{OverallSuccess: success},
+		},
+	}
+}
+
+func actionEvent() *build_event_stream.BuildEvent {
+	return &build_event_stream.BuildEvent{
+		Id: &build_event_stream.BuildEventId{
+			Id: &build_event_stream.BuildEventId_ActionCompleted{
+				ActionCompleted: &build_event_stream.BuildEventId_ActionCompletedId{PrimaryOutput: "bazel-out/foo"},
+			},
+		},
+		Payload: &build_event_stream.BuildEvent_Action{
+			Action: &build_event_stream.ActionExecuted{
+				Label:         "//:foo",
+				Configuration: &build_event_stream.BuildEventId_ConfigurationId{Id: "abc"},
+			},
+		},
+	}
+}
+
+func TestUpgradesLegacyEvents(t *testing.T) {
+	for _, version := range []string{"0.29.1", "0.5.0rc2", ""} {
+		u := event_compat.NewUpgrader(version)
+		require.NotNil(t, u, "version %q", version)
+
+		succeeded := finishedEvent(true)
+		assert.Equal(t, []string{"finished_exit_code"}, u.Upgrade(succeeded))
+		assert.Equal(t, int32(0), succeeded.GetFinished().GetExitCode().GetCode())
+		assert.Equal(t, "SUCCESS", succeeded.GetFinished().GetExitCode().GetName())
+
+		failed := finishedEvent(false)
+		assert.Equal(t, []string{"finished_exit_code"}, u.Upgrade(failed))
+		assert.Equal(t, int32(1), failed.GetFinished().GetExitCode().GetCode())
+
+		action := actionEvent()
+		assert.Equal(t, []string{"action_completed_id"}, u.Upgrade(action))
+		assert.Equal(t, "//:foo", action.GetId().GetActionCompleted().GetLabel())
+		assert.Equal(t, "abc", action.GetId().GetActionCompleted().GetConfiguration().GetId())
+		assert.Equal(t, "bazel-out/foo", action.GetId().GetActionCompleted().GetPrimaryOutput())
+
+		// Events that are already up to date are left as-is.
+		assert.Empty(t, u.Upgrade(action))
+		interrupted := finishedEvent(false)
+		interrupted.GetFinished().ExitCode = &build_event_stream.BuildFinished_ExitCode{Name: "INTERRUPTED", Code: 8}
+		assert.Empty(t, u.Upgrade(interrupted))
+		assert.Equal(t, int32(8), interrupted.GetFinished().GetExitCode().GetCode())
+	}
+}
+
+func TestDoesNotUpgradeCurrentEvents(t *testing.T) {
+	for _, version := range []string{"1.0.0", "4.1.0", "5.0.0-pre.20210708.4", "development version"} {
+		u := event_compat.NewUpgrader(version)
+		assert.Nil(t, u, "version %q", version)
+
+		event := finishedEvent(true)
+		assert.Empty(t, u.Upgrade(event))
+		assert.Nil(t, event.GetFinished().GetExitCode())
+	}
+}
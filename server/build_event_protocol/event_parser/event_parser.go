@@ -2,17 +2,28 @@ package event_parser
 
 import (
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
 	"github.com/buildbuddy-io/buildbuddy/proto/command_line"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/flag_analyzer"
 	"github.com/buildbuddy-io/buildbuddy/server/terminal"
+	"github.com/buildbuddy-io/buildbuddy/server/util/tags"
 
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
 	gitutil "github.com/buildbuddy-io/buildbuddy/server/util/git"
 )
 
+// Version is the version of the event parser that invocations are parsed
+// with, which is recorded on each invocation. Increment it whenever a change
+// to the parser, or to the invocation columns populated from its output,
+// should be applied to invocations that have already been parsed. Recent
+// invocations are then re-parsed in the background if storage.reparse is
+// enabled.
+const Version = 2
+
 const (
 	envVarPrefix              = "--"
 	envVarOptionName          = "client_env"
@@ -107,6 +118,7 @@ func isAllowedEnvVar(variableName string, allowedEnvVars []string) bool {
 type StreamingEventParser struct {
 	screenWriter           *terminal.ScreenWriter
 	command                string
+	bazelVersion           string
 	buildMetadata          []map[string]string
 	events                 []*inpb.InvocationEvent
 	structuredCommandLines []*command_line.CommandLine
@@ -118,6 +130,8 @@ type StreamingEventParser struct {
 	endTimeMillis          int64
 	actionCount            int64
 	success                bool
+	truncation             *inpb.InvocationTruncation
+	progress               TargetProgress
 }
 
 func NewStreamingEventParser() *StreamingEventParser {
@@ -136,6 +150,23 @@ func NewStreamingEventParser() *StreamingEventParser {
 
 func (sep *StreamingEventParser) ParseEvent(event *inpb.InvocationEvent) {
 	sep.events = append(sep.events, event)
+	sep.parseEvent(event)
+}
+
+// ParseEventWithoutStoring parses the event like ParseEvent, but doesn't
+// include it in the events of the filled invocation, so that it can be
+// garbage collected. This allows filling the details of an invocation while
+// only holding on to some of its events.
+func (sep *StreamingEventParser) ParseEventWithoutStoring(event *inpb.InvocationEvent) {
+	sep.parseEvent(event)
+}
+
+func (sep *StreamingEventParser) parseEvent(event *inpb.InvocationEvent) {
+	if event.Truncation != nil {
+		// The last truncation marker has the totals.
+		sep.truncation = event.Truncation
+	}
+	sep.progress.AddEvent(event.BuildEvent)
 	switch p := event.BuildEvent.Payload.(type) {
 	case *build_event_stream.BuildEvent_Progress:
 		{
@@ -155,6 +186,7 @@ func (sep *StreamingEventParser) ParseEvent(event *inpb.InvocationEvent) {
 			p.Started.OptionsDescription = stripURLSecrets(p.Started.OptionsDescription)
 			sep.startTimeMillis = p.Started.StartTimeMillis
 			sep.command = p.Started.Command
+			sep.bazelVersion = p.Started.BuildToolVersion
 			for _, child := range event.BuildEvent.Children {
 				// Here we are then. Knee-deep.
 				switch c := child.Id.(type) {
@@ -262,10 +294,13 @@ func (sep *StreamingEventParser) ParseEvent(event *inpb.InvocationEvent) {
 
 func (sep *StreamingEventParser) FillInvocation(invocation *inpb.Invocation) {
 	invocation.Command = sep.command
+	invocation.BazelVersion = sep.bazelVersion
 	invocation.Pattern = sep.pattern
 	invocation.Event = sep.events
 	invocation.Success = sep.success
 	invocation.ActionCount = sep.actionCount
+	invocation.Truncation = sep.truncation
+	invocation.Progress = sep.progress.Proto()
 
 	// Fill invocation in a deterministic order:
 	// - Environment variables
@@ -284,6 +319,7 @@ func (sep *StreamingEventParser) FillInvocation(invocation *inpb.Invocation) {
 	for _, workflowConfigured := range sep.workflowConfigurations {
 		fillInvocationFromWorkflowConfigured(workflowConfigured, invocation)
 	}
+	invocation.Warning = flag_analyzer.Analyze(sep.structuredCommandLines)
 
 	buildDuration := time.Duration(int64(0))
 	if sep.endTimeMillis != undefinedTimestamp && sep.startTimeMillis != undefinedTimestamp {
@@ -347,6 +383,22 @@ func fillInvocationFromStructuredCommandLine(commandLine *command_line.CommandLi
 	if sha, ok := envVarMap["CI_COMMIT_SHA"]; ok && sha != "" {
 		invocation.CommitSha = sha
 	}
+	for _, name := range []string{"CIRCLE_PR_NUMBER", "BUILDKITE_PULL_REQUEST", "TRAVIS_PULL_REQUEST", "CI_MERGE_REQUEST_IID"} {
+		if n, ok := parsePullRequestNumber(envVarMap[name]); ok {
+			invocation.PullRequestNumber = n
+		}
+	}
+}
+
+// parsePullRequestNumber parses a pull request number. Some CI platforms set
+// their pull request variables to "false" for builds of branches, which are
+// ignored along with anything else that isn't a pull request number.
+func parsePullRequestNumber(value string) (int64, bool) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return n, true
 }
 
 func fillInvocationFromWorkspaceStatus(workspaceStatus *build_event_stream.WorkspaceStatus, invocation *inpb.Invocation) {
@@ -369,6 +421,10 @@ func fillInvocationFromWorkspaceStatus(workspaceStatus *build_event_stream.Works
 			invocation.RepoUrl = gitutil.StripRepoURLCredentials(item.Value)
 		case "COMMIT_SHA":
 			invocation.CommitSha = item.Value
+		case "PULL_REQUEST_NUMBER":
+			if n, ok := parsePullRequestNumber(item.Value); ok {
+				invocation.PullRequestNumber = n
+			}
 		}
 	}
 }
@@ -380,6 +436,9 @@ func fillInvocationFromBuildMetadata(metadata map[string]string, invocation *inp
 	if url, ok := metadata["REPO_URL"]; ok && url != "" {
 		invocation.RepoUrl = gitutil.StripRepoURLCredentials(url)
 	}
+	if n, ok := parsePullRequestNumber(metadata["PULL_REQUEST_NUMBER"]); ok {
+		invocation.PullRequestNumber = n
+	}
 	if user, ok := metadata["USER"]; ok && user != "" {
 		invocation.User = user
 	}
@@ -389,6 +448,9 @@ func fillInvocationFromBuildMetadata(metadata map[string]string, invocation *inp
 	if role, ok := metadata["ROLE"]; ok && role != "" {
 		invocation.Role = role
 	}
+	if tagList, ok := metadata["TAGS"]; ok && tagList != "" {
+		invocation.Tag = tags.Parse(tagList)
+	}
 	if visibility, ok := metadata["VISIBILITY"]; ok && visibility == "PUBLIC" {
 		invocation.ReadPermission = inpb.InvocationPermission_PUBLIC
 	}
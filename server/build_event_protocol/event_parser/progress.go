@@ -0,0 +1,83 @@
+package event_parser
+
+import (
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+// TargetProgress counts the targets that Bazel has configured and completed,
+// to estimate how far along an in-progress invocation is.
+type TargetProgress struct {
+	ConfiguredTargetCount int64
+	CompletedTargetCount  int64
+	FailedTargetCount     int64
+	finished              bool
+}
+
+// AddEvent updates the counts from a build event.
+func (p *TargetProgress) AddEvent(event *build_event_stream.BuildEvent) {
+	switch event.GetPayload().(type) {
+	case *build_event_stream.BuildEvent_Configured:
+		// A target is completed once for each configuration that it's built
+		// in, and each of those is announced as a child of its configured
+		// event.
+		n := int64(0)
+		for _, child := range event.GetChildren() {
+			if child.GetTargetCompleted() != nil {
+				n++
+			}
+		}
+		if n == 0 {
+			n = 1
+		}
+		p.ConfiguredTargetCount += n
+	case *build_event_stream.BuildEvent_Completed:
+		p.CompletedTargetCount++
+		if !event.GetCompleted().GetSuccess() {
+			p.FailedTargetCount++
+		}
+	case *build_event_stream.BuildEvent_Aborted:
+		// Targets that fail analysis, or are skipped, are never completed.
+		failed := event.GetAborted().GetReason() != build_event_stream.Aborted_SKIPPED
+		if event.GetId().GetTargetConfigured() != nil {
+			p.ConfiguredTargetCount++
+			p.CompletedTargetCount++
+		} else if event.GetId().GetTargetCompleted() != nil {
+			p.CompletedTargetCount++
+		} else {
+			failed = false
+		}
+		if failed {
+			p.FailedTargetCount++
+		}
+	case *build_event_stream.BuildEvent_Finished:
+		p.finished = true
+	}
+}
+
+// Proto returns the progress of the invocation that the events were from.
+func (p *TargetProgress) Proto() *inpb.InvocationProgress {
+	progress := ToProgressProto(p.ConfiguredTargetCount, p.CompletedTargetCount, p.finished)
+	progress.FailedTargetCount = p.FailedTargetCount
+	return progress
+}
+
+// ToProgressProto returns the progress of an invocation with the given target
+// counts, such as those stored in the DB.
+func ToProgressProto(configured, completed int64, finished bool) *inpb.InvocationProgress {
+	percent := int32(0)
+	if finished {
+		percent = 100
+	} else if configured > 0 {
+		percent = int32(completed * 100 / configured)
+		if percent > 99 {
+			percent = 99
+		}
+	}
+	return &inpb.InvocationProgress{
+		ConfiguredTargetCount: configured,
+		CompletedTargetCount:  completed,
+		PercentComplete:       percent,
+	}
+}
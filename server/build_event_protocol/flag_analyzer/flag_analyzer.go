@@ -0,0 +1,152 @@
+package flag_analyzer
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/command_line"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+const (
+	// Warning codes. These are part of the API, so they must not be changed.
+	MissingRemoteDownloadMinimalCode = "MISSING_REMOTE_DOWNLOAD_MINIMAL"
+	LowJobsCode                      = "LOW_JOBS"
+	ConflictingCacheFlagsCode        = "CONFLICTING_CACHE_FLAGS"
+	UnusedRemoteCacheCode            = "UNUSED_REMOTE_CACHE"
+
+	// With remote execution, most of the time spent by each job is waiting on
+	// the network, so far more jobs than local cores should be used.
+	MinRemoteExecutionJobs = 50
+	minLocalJobs           = 2
+
+	// The label of the command line that includes the options set in bazelrc
+	// files, as Bazel reports it.
+	CanonicalCommandLineLabel = "canonical"
+)
+
+// options holds the value of each option set on a command line. Options set
+// more than once take the last value.
+type options map[string]string
+
+func (o options) isSet(name string) bool {
+	v, ok := o[name]
+	return ok && v != ""
+}
+
+// isFalse returns whether the boolean option with the given name was
+// explicitly disabled.
+func (o options) isFalse(name string) bool {
+	v, ok := o[name]
+	if !ok {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	return err == nil && !b
+}
+
+// CommandOptions returns the value of each option set for a command, from
+// the canonical command line, which includes options set in bazelrc files and
+// the options that expansion flags such as --remote_download_minimal expand
+// to. If there is no canonical command line, the last command line is used.
+func CommandOptions(commandLines []*command_line.CommandLine) map[string]string {
+	return commandOptions(commandLines)
+}
+
+func commandOptions(commandLines []*command_line.CommandLine) options {
+	var cl *command_line.CommandLine
+	for _, c := range commandLines {
+		if cl == nil || c.GetCommandLineLabel() == CanonicalCommandLineLabel {
+			cl = c
+		}
+	}
+	opts := options{}
+	for _, section := range cl.GetSections() {
+		for _, option := range section.GetOptionList().GetOption() {
+			opts[option.GetOptionName()] = option.GetOptionValue()
+		}
+	}
+	return opts
+}
+
+// SkipsIntermediateDownloads returns whether the given command options avoid
+// downloading intermediate outputs from the remote cache ("Build without the
+// Bytes").
+func SkipsIntermediateDownloads(opts map[string]string) bool {
+	o := options(opts)
+	downloads := o["remote_download_outputs"]
+	return downloads == "minimal" || downloads == "toplevel" || o.isSet("remote_download_minimal") || o.isSet("remote_download_toplevel")
+}
+
+func host(target string) string {
+	if !strings.Contains(target, "://") {
+		target = "grpc://" + target
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// Analyze checks the command lines reported by an invocation for common
+// misconfigurations, and returns a warning for each one found.
+func Analyze(commandLines []*command_line.CommandLine) []*inpb.InvocationWarning {
+	if len(commandLines) == 0 {
+		return nil
+	}
+	opts := commandOptions(commandLines)
+	usesRemoteExecution := opts.isSet("remote_executor")
+	usesRemoteCache := usesRemoteExecution || opts.isSet("remote_cache")
+
+	var warnings []*inpb.InvocationWarning
+
+	if usesRemoteCache {
+		if !SkipsIntermediateDownloads(opts) {
+			warnings = append(warnings, &inpb.InvocationWarning{
+				Code:    MissingRemoteDownloadMinimalCode,
+				Flag:    "remote_download_minimal",
+				Message: "All build outputs are downloaded from the remote cache. Setting --remote_download_minimal (or --remote_download_toplevel) avoids downloading intermediate outputs, which can make builds significantly faster.",
+			})
+		}
+	}
+
+	if jobs, err := strconv.Atoi(opts["jobs"]); err == nil {
+		if usesRemoteExecution && jobs < MinRemoteExecutionJobs {
+			warnings = append(warnings, &inpb.InvocationWarning{
+				Code:    LowJobsCode,
+				Flag:    "jobs",
+				Message: fmt.Sprintf("--jobs=%d limits how many actions are executed remotely in parallel. With remote execution, --jobs=%d or higher is recommended.", jobs, MinRemoteExecutionJobs),
+			})
+		} else if !usesRemoteExecution && jobs < minLocalJobs {
+			warnings = append(warnings, &inpb.InvocationWarning{
+				Code:    LowJobsCode,
+				Flag:    "jobs",
+				Message: fmt.Sprintf("--jobs=%d prevents actions from being executed in parallel.", jobs),
+			})
+		}
+	}
+
+	if usesRemoteExecution && opts.isSet("remote_cache") {
+		if cacheHost, executorHost := host(opts["remote_cache"]), host(opts["remote_executor"]); cacheHost != executorHost {
+			warnings = append(warnings, &inpb.InvocationWarning{
+				Code:    ConflictingCacheFlagsCode,
+				Flag:    "remote_cache",
+				Message: fmt.Sprintf("--remote_cache (%s) and --remote_executor (%s) point to different servers, but remote execution requires inputs and outputs to be stored in the executor's cache. --remote_cache can be removed.", cacheHost, executorHost),
+			})
+		}
+	}
+
+	if usesRemoteCache && !usesRemoteExecution && opts.isFalse("remote_accept_cached") && opts.isFalse("remote_upload_local_results") {
+		warnings = append(warnings, &inpb.InvocationWarning{
+			Code:    UnusedRemoteCacheCode,
+			Flag:    "remote_cache",
+			Message: "--noremote_accept_cached and --noremote_upload_local_results are both set, so the remote cache is neither read from nor written to.",
+		})
+	}
+
+	return warnings
+}
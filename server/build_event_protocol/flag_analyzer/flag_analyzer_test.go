@@ -0,0 +1,103 @@
+package flag_analyzer_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/command_line"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/flag_analyzer"
+	"github.com/stretchr/testify/assert"
+)
+
+// commandLine returns a command line with the given options, each of the
+// form "name=value".
+func commandLine(label string, flags ...string) *command_line.CommandLine {
+	options := []*command_line.Option{}
+	for _, f := range flags {
+		parts := strings.SplitN(f, "=", 2)
+		options = append(options, &command_line.Option{
+			CombinedForm: "--" + f,
+			OptionName:   parts[0],
+			OptionValue:  parts[1],
+		})
+	}
+	return &command_line.CommandLine{
+		CommandLineLabel: label,
+		Sections: []*command_line.CommandLineSection{{
+			SectionLabel: "command options",
+			SectionType: &command_line.CommandLineSection_OptionList{
+				OptionList: &command_line.OptionList{Option: options},
+			},
+		}},
+	}
+}
+
+func warningCodes(commandLines ...*command_line.CommandLine) []string {
+	codes := []string{}
+	for _, w := range flag_analyzer.Analyze(commandLines) {
+		codes = append(codes, w.GetCode())
+	}
+	return codes
+}
+
+func TestAnalyze(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		flags []string
+		want  []string
+	}{
+		{
+			name:  "no remote",
+			flags: []string{"jobs=8"},
+			want:  []string{},
+		},
+		{
+			name:  "well configured remote execution",
+			flags: []string{"remote_executor=grpcs://remote.buildbuddy.io", "remote_download_outputs=minimal", "jobs=100"},
+			want:  []string{},
+		},
+		{
+			name:  "remote cache without minimal downloads",
+			flags: []string{"remote_cache=grpcs://remote.buildbuddy.io"},
+			want:  []string{flag_analyzer.MissingRemoteDownloadMinimalCode},
+		},
+		{
+			name:  "remote execution with few jobs",
+			flags: []string{"remote_executor=grpcs://remote.buildbuddy.io", "remote_download_outputs=toplevel", "jobs=8"},
+			want:  []string{flag_analyzer.LowJobsCode},
+		},
+		{
+			name:  "local build with one job",
+			flags: []string{"jobs=1"},
+			want:  []string{flag_analyzer.LowJobsCode},
+		},
+		{
+			name:  "cache and executor on different hosts",
+			flags: []string{"remote_executor=grpcs://remote.buildbuddy.io", "remote_cache=grpcs://cache.example.com", "remote_download_outputs=minimal"},
+			want:  []string{flag_analyzer.ConflictingCacheFlagsCode},
+		},
+		{
+			name:  "cache and executor on same host",
+			flags: []string{"remote_executor=grpcs://remote.buildbuddy.io", "remote_cache=remote.buildbuddy.io", "remote_download_outputs=minimal"},
+			want:  []string{},
+		},
+		{
+			name:  "unused remote cache",
+			flags: []string{"remote_cache=grpcs://remote.buildbuddy.io", "remote_download_outputs=minimal", "remote_accept_cached=false", "remote_upload_local_results=0"},
+			want:  []string{flag_analyzer.UnusedRemoteCacheCode},
+		},
+	} {
+		assert.Equal(t, tc.want, warningCodes(commandLine("canonical", tc.flags...)), tc.name)
+	}
+}
+
+func TestAnalyze_UsesCanonicalCommandLine(t *testing.T) {
+	// The original command line only has the expansion flag, which the
+	// canonical command line expands.
+	original := commandLine("original", "remote_cache=grpcs://remote.buildbuddy.io", "remote_download_minimal=")
+	canonical := commandLine("canonical", "remote_cache=grpcs://remote.buildbuddy.io", "remote_download_outputs=minimal")
+	assert.Empty(t, warningCodes(original, canonical))
+
+	canonical = commandLine("canonical", "remote_cache=grpcs://remote.buildbuddy.io")
+	assert.Equal(t, []string{flag_analyzer.MissingRemoteDownloadMinimalCode}, warningCodes(canonical, original))
+}
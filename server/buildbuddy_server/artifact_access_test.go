@@ -0,0 +1,52 @@
+package buildbuddy_server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAccessLog records the artifact accesses, by invocation ID.
+type fakeAccessLog struct {
+	interfaces.AccessLogService
+	artifacts map[string][]string
+}
+
+func (l *fakeAccessLog) RecordArtifactAccess(ctx context.Context, invocationID, artifactName string) {
+	l.artifacts[invocationID] = append(l.artifacts[invocationID], artifactName)
+}
+
+func TestRecordArtifactAccessRequiresReadAccess(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1", "US2", "GR2")))
+	al := &fakeAccessLog{artifacts: make(map[string][]string)}
+	te.SetAccessLogService(al)
+	require.NoError(t, te.GetDBHandle().Create(&tables.Invocation{
+		InvocationID: "inv-1",
+		InvocationPK: 1,
+		UserID:       "US1",
+		GroupID:      "GR1",
+		Perms:        perms.GROUP_READ | perms.GROUP_WRITE,
+	}).Error)
+	s, err := NewBuildBuddyServer(te, nil)
+	require.NoError(t, err)
+
+	// Users can't log downloads of invocations they can't read, or which
+	// don't exist.
+	ctx2 := testauth.WithAuthenticatedUserInfo(context.Background(), &testauth.TestUser{UserID: "US2", GroupID: "GR2", AllowedGroups: []string{"GR2"}})
+	s.recordArtifactAccess(ctx2, "inv-1", "test.log")
+	s.recordArtifactAccess(ctx2, "inv-2", "test.log")
+	s.recordArtifactAccess(context.Background(), "inv-1", "test.log")
+	assert.Empty(t, al.artifacts)
+
+	ctx1 := testauth.WithAuthenticatedUserInfo(context.Background(), &testauth.TestUser{UserID: "US1", GroupID: "GR1", AllowedGroups: []string{"GR1"}})
+	s.recordArtifactAccess(ctx1, "inv-1", "test.log")
+	assert.Equal(t, map[string][]string{"inv-1": {"test.log"}}, al.artifacts)
+}
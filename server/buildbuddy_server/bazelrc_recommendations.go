@@ -0,0 +1,215 @@
+package buildbuddy_server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/command_line"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/flag_analyzer"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/protofile"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	bzpb "github.com/buildbuddy-io/buildbuddy/proto/bazel_config"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+const (
+	// The number of the group's most recent invocations whose options are
+	// compared against the recommendations.
+	bazelrcSampleSize = 20
+
+	// Command lines are reported at the start of an invocation, so only its
+	// first events are read.
+	bazelrcMaxEventsRead = 100
+
+	// Uploads and downloads of large outputs can take longer than Bazel's
+	// default timeout of 60 seconds.
+	recommendedRemoteTimeoutSeconds = 3600
+)
+
+// bazelrcRecommendation is an option that the group's invocations are
+// recommended to set.
+type bazelrcRecommendation struct {
+	option *bzpb.ConfigOption
+	reason string
+	// followedBy returns whether an invocation with the given options already
+	// follows the recommendation.
+	followedBy func(opts map[string]string) bool
+}
+
+func hasValue(flagName, value string) func(opts map[string]string) bool {
+	return func(opts map[string]string) bool {
+		return strings.TrimSuffix(opts[flagName], "/") == strings.TrimSuffix(value, "/")
+	}
+}
+
+func hasMinValue(flagName string, min int) func(opts map[string]string) bool {
+	return func(opts map[string]string) bool {
+		v, err := strconv.Atoi(opts[flagName])
+		return err == nil && v >= min
+	}
+}
+
+// bazelrcRecommendations returns the options recommended for this instance.
+// They are derived from the same config as GetBazelConfig, so that only
+// features which this instance supports are recommended. Remote cache
+// compression is not recommended, since the cache doesn't accept compressed
+// blobs.
+func bazelrcRecommendations(configOptions []*bzpb.ConfigOption) []*bazelrcRecommendation {
+	reasons := map[string]string{
+		"bes_results_url": "Prints a link to each build's results on BuildBuddy.",
+		"bes_backend":     "Streams build events to BuildBuddy, so that builds can be viewed and searched.",
+		"remote_cache":    "Shares build outputs between machines through BuildBuddy's remote cache.",
+		"remote_executor": "Executes actions on BuildBuddy's executors.",
+	}
+	var recommendations []*bazelrcRecommendation
+	usesRemoteCache, usesRemoteExecution := false, false
+	for _, o := range configOptions {
+		recommendations = append(recommendations, &bazelrcRecommendation{
+			option:     o,
+			reason:     reasons[o.GetFlagName()],
+			followedBy: hasValue(o.GetFlagName(), o.GetFlagValue()),
+		})
+		switch o.GetFlagName() {
+		case "remote_cache":
+			usesRemoteCache = true
+		case "remote_executor":
+			usesRemoteExecution = true
+		}
+	}
+	if usesRemoteCache || usesRemoteExecution {
+		recommendations = append(recommendations, &bazelrcRecommendation{
+			option:     makeConfigOption("build", "remote_download_outputs", "minimal"),
+			reason:     "Avoids downloading intermediate outputs from the remote cache (\"Build without the Bytes\"), which can make builds significantly faster.",
+			followedBy: flag_analyzer.SkipsIntermediateDownloads,
+		}, &bazelrcRecommendation{
+			option:     makeConfigOption("build", "remote_timeout", strconv.Itoa(recommendedRemoteTimeoutSeconds)),
+			reason:     "Gives large uploads and downloads enough time to complete.",
+			followedBy: hasMinValue("remote_timeout", recommendedRemoteTimeoutSeconds),
+		})
+	}
+	if usesRemoteExecution {
+		recommendations = append(recommendations, &bazelrcRecommendation{
+			option:     makeConfigOption("build", "jobs", strconv.Itoa(flag_analyzer.MinRemoteExecutionJobs)),
+			reason:     "Executes enough actions remotely in parallel to make use of the executors.",
+			followedBy: hasMinValue("jobs", flag_analyzer.MinRemoteExecutionJobs),
+		})
+	}
+	return recommendations
+}
+
+// readCommandOptions returns the options that an invocation was run with, or
+// nil if its command lines weren't found.
+func (s *BuildBuddyServer) readCommandOptions(ctx context.Context, ti *tables.Invocation) (map[string]string, error) {
+	bs, err := blobstore.ForBackend(s.env, ti.BlobBackendID)
+	if err != nil {
+		return nil, err
+	}
+	blobPath := ti.BlobID
+	if blobPath == "" {
+		blobPath = ti.InvocationID
+	}
+	pr := protofile.NewBufferedProtoReader(bs, blobPath)
+	var commandLines []*command_line.CommandLine
+	// Only the command lines are kept, so the same event is read into each
+	// time. Unmarshaling resets it, leaving the kept command lines intact.
+	event := &inpb.InvocationEvent{}
+	for i := 0; i < bazelrcMaxEventsRead; i++ {
+		err := pr.ReadProto(ctx, event)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		cl := event.GetBuildEvent().GetStructuredCommandLine()
+		if cl == nil {
+			continue
+		}
+		commandLines = append(commandLines, cl)
+		if cl.GetCommandLineLabel() == flag_analyzer.CanonicalCommandLineLabel {
+			break
+		}
+	}
+	if len(commandLines) == 0 {
+		return nil, nil
+	}
+	return flag_analyzer.CommandOptions(commandLines), nil
+}
+
+// sampleCommandOptions returns the options that the group's most recent
+// invocations were run with.
+func (s *BuildBuddyServer) sampleCommandOptions(ctx context.Context, groupID string) ([]map[string]string, error) {
+	dbh := s.env.GetDBHandle()
+	if dbh == nil {
+		return nil, nil
+	}
+	var invocations []*tables.Invocation
+	err := dbh.WithContext(ctx).
+		Where("group_id = ? AND invocation_status = ?", groupID, int64(inpb.Invocation_COMPLETE_INVOCATION_STATUS)).
+		Order("created_at_usec DESC").
+		Limit(bazelrcSampleSize).
+		Find(&invocations).Error
+	if err != nil {
+		return nil, status.InternalErrorf("failed to look up recent invocations: %s", err)
+	}
+	var sampled []map[string]string
+	for _, ti := range invocations {
+		opts, err := s.readCommandOptions(ctx, ti)
+		if err != nil {
+			log.Warningf("Error reading command line of invocation %s: %s", ti.InvocationID, err)
+			continue
+		}
+		if opts != nil {
+			sampled = append(sampled, opts)
+		}
+	}
+	return sampled, nil
+}
+
+func (s *BuildBuddyServer) GetBazelrcRecommendations(ctx context.Context, req *bzpb.GetBazelrcRecommendationsRequest) (*bzpb.GetBazelrcRecommendationsResponse, error) {
+	groupID, err := perms.AuthenticateSelectedGroupID(ctx, s.env, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	configRsp, err := s.GetBazelConfig(ctx, &bzpb.GetBazelConfigRequest{
+		RequestContext: req.GetRequestContext(),
+		Host:           req.GetHost(),
+		Protocol:       req.GetProtocol(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	sampled, err := s.sampleCommandOptions(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := &bzpb.GetBazelrcRecommendationsResponse{
+		SampledInvocationCount: int64(len(sampled)),
+	}
+	var bazelrc strings.Builder
+	for _, r := range bazelrcRecommendations(configRsp.GetConfigOption()) {
+		observed := int64(0)
+		for _, opts := range sampled {
+			if r.followedBy(opts) {
+				observed++
+			}
+		}
+		rsp.Recommendation = append(rsp.Recommendation, &bzpb.BazelrcRecommendation{
+			ConfigOption:            r.option,
+			Reason:                  r.reason,
+			ObservedInvocationCount: observed,
+		})
+		fmt.Fprintln(&bazelrc, r.option.GetBody())
+	}
+	rsp.Bazelrc = bazelrc.String()
+	return rsp, nil
+}
@@ -0,0 +1,120 @@
+package buildbuddy_server_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/proto/command_line"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/flag_analyzer"
+	"github.com/buildbuddy-io/buildbuddy/server/buildbuddy_server"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/protofile"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	bzpb "github.com/buildbuddy-io/buildbuddy/proto/bazel_config"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+var lastInvocationPK int64
+
+func commandLine(label string, options map[string]string) *command_line.CommandLine {
+	var opts []*command_line.Option
+	for name, value := range options {
+		opts = append(opts, &command_line.Option{OptionName: name, OptionValue: value})
+	}
+	return &command_line.CommandLine{
+		CommandLineLabel: label,
+		Sections: []*command_line.CommandLineSection{{
+			SectionType: &command_line.CommandLineSection_OptionList{
+				OptionList: &command_line.OptionList{Option: opts},
+			},
+		}},
+	}
+}
+
+// writeInvocation writes a completed invocation of the group, whose canonical
+// command line sets the given options.
+func writeInvocation(t *testing.T, te *testenv.TestEnv, iid, groupID string, options map[string]string) {
+	ctx := context.Background()
+	w := protofile.NewBufferedProtoWriter(te.GetBlobstore(), iid, 1024)
+	for _, cl := range []*command_line.CommandLine{
+		commandLine("original", nil),
+		commandLine(flag_analyzer.CanonicalCommandLineLabel, options),
+	} {
+		event := &inpb.InvocationEvent{
+			BuildEvent: &build_event_stream.BuildEvent{
+				Payload: &build_event_stream.BuildEvent_StructuredCommandLine{StructuredCommandLine: cl},
+			},
+		}
+		require.NoError(t, w.WriteProtoToStream(ctx, event))
+	}
+	require.NoError(t, w.Flush(ctx))
+	lastInvocationPK++
+	require.NoError(t, te.GetDBHandle().Create(&tables.Invocation{
+		InvocationID:     iid,
+		InvocationPK:     lastInvocationPK,
+		GroupID:          groupID,
+		BlobID:           iid,
+		InvocationStatus: int64(inpb.Invocation_COMPLETE_INVOCATION_STATUS),
+	}).Error)
+}
+
+func observedCount(rsp *bzpb.GetBazelrcRecommendationsResponse, flagName string) int64 {
+	for _, r := range rsp.GetRecommendation() {
+		if r.GetConfigOption().GetFlagName() == flagName {
+			return r.GetObservedInvocationCount()
+		}
+	}
+	return -1
+}
+
+func TestGetBazelrcRecommendations_SamplesSelectedGroup(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")))
+	minimal := map[string]string{"remote_download_outputs": "minimal"}
+	writeInvocation(t, te, "inv-1", "GR1", minimal)
+	writeInvocation(t, te, "inv-2", "GR1", nil)
+	writeInvocation(t, te, "inv-3", "GR2", minimal)
+	writeInvocation(t, te, "inv-4", "", minimal)
+
+	// A user signed in to the web UI, whose claims carry the groups they
+	// belong to rather than a single group.
+	user := &testauth.TestUser{UserID: "US1", AllowedGroups: []string{"GR1"}}
+	ctx := testauth.WithAuthenticatedUserInfo(context.Background(), user)
+	s, err := buildbuddy_server.NewBuildBuddyServer(te, nil)
+	require.NoError(t, err)
+
+	rsp, err := s.GetBazelrcRecommendations(ctx, &bzpb.GetBazelrcRecommendationsRequest{
+		RequestContext: testauth.RequestContext("US1", "GR1"),
+		Host:           "app.example.com",
+		Protocol:       "https:",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), rsp.GetSampledInvocationCount())
+	assert.Equal(t, int64(1), observedCount(rsp, "remote_download_outputs"))
+	assert.Contains(t, rsp.GetBazelrc(), "build --remote_download_outputs=minimal")
+}
+
+func TestGetBazelrcRecommendations_RequiresGroupAccess(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")))
+	writeInvocation(t, te, "inv-1", "GR2", nil)
+
+	user := &testauth.TestUser{UserID: "US1", AllowedGroups: []string{"GR1"}}
+	ctx := testauth.WithAuthenticatedUserInfo(context.Background(), user)
+	s, err := buildbuddy_server.NewBuildBuddyServer(te, nil)
+	require.NoError(t, err)
+
+	_, err = s.GetBazelrcRecommendations(ctx, &bzpb.GetBazelrcRecommendationsRequest{
+		RequestContext: testauth.RequestContext("US1", "GR2"),
+	})
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+
+	_, err = s.GetBazelrcRecommendations(ctx, &bzpb.GetBazelrcRecommendationsRequest{})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+}
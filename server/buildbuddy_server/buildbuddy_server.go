@@ -10,24 +10,37 @@ import (
 	"strings"
 
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_proxy"
 	"github.com/buildbuddy-io/buildbuddy/server/bytestream"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_grpc_log"
 	"github.com/buildbuddy-io/buildbuddy/server/ssl"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/target"
 	"github.com/buildbuddy-io/buildbuddy/server/util/capabilities"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/platform_policy"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/golang/protobuf/proto"
 
+	alpb "github.com/buildbuddy-io/buildbuddy/proto/access_log"
 	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
 	bzpb "github.com/buildbuddy-io/buildbuddy/proto/bazel_config"
 	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
 	grpb "github.com/buildbuddy-io/buildbuddy/proto/group"
+	ianpb "github.com/buildbuddy-io/buildbuddy/proto/instance_name_alias"
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	iepb "github.com/buildbuddy-io/buildbuddy/proto/invocation_export"
+	nfpb "github.com/buildbuddy-io/buildbuddy/proto/notification"
+	rgpb "github.com/buildbuddy-io/buildbuddy/proto/remote_grpc_log"
 	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+	secpb "github.com/buildbuddy-io/buildbuddy/proto/secrets"
+	sespb "github.com/buildbuddy-io/buildbuddy/proto/session"
 	trpb "github.com/buildbuddy-io/buildbuddy/proto/target"
+	usagepb "github.com/buildbuddy-io/buildbuddy/proto/usage"
 	uspb "github.com/buildbuddy-io/buildbuddy/proto/user"
 	wfpb "github.com/buildbuddy-io/buildbuddy/proto/workflow"
 	requestcontext "github.com/buildbuddy-io/buildbuddy/server/util/request_context"
@@ -38,6 +51,9 @@ import (
 const (
 	bytestreamProtocolPrefix  = "bytestream://"
 	actioncacheProtocolPrefix = "actioncache://"
+
+	// The most trashed invocations returned by GetTrashedInvocations.
+	maxTrashedInvocationsCount = 100
 )
 
 type BuildBuddyServer struct {
@@ -59,7 +75,7 @@ func (s *BuildBuddyServer) getConfiguredAPIKey() string {
 	return ""
 }
 
-func (s *BuildBuddyServer) redactAPIKeys(ctx context.Context, rsp *inpb.GetInvocationResponse) error {
+func (s *BuildBuddyServer) redactAPIKeys(ctx context.Context, rsp proto.Message) error {
 	proto.DiscardUnknown(rsp)
 	txt := proto.MarshalTextString(rsp)
 
@@ -97,15 +113,42 @@ func (s *BuildBuddyServer) GetInvocation(ctx context.Context, req *inpb.GetInvoc
 		return nil, status.InvalidArgumentErrorf("GetInvocationRequest must contain a valid invocation_id")
 	}
 
-	inv, err := build_event_handler.LookupInvocation(s.env, ctx, req.GetLookup().GetInvocationId())
+	var inv *inpb.Invocation
+	var nextPageToken string
+	var err error
+	if req.GetPageSize() != 0 || req.GetPageToken() != "" {
+		inv, nextPageToken, err = build_event_handler.LookupInvocationPage(s.env, ctx, req.GetLookup().GetInvocationId(), req.GetPageToken(), int(req.GetPageSize()))
+	} else {
+		inv, err = build_event_handler.LookupInvocation(s.env, ctx, req.GetLookup().GetInvocationId())
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	// Accesses are recorded once per lookup, rather than once per page.
+	if al := s.env.GetAccessLogService(); al != nil && req.GetPageToken() == "" {
+		al.RecordInvocationAccess(ctx, inv)
+	}
+
 	rsp := &inpb.GetInvocationResponse{
 		Invocation: []*inpb.Invocation{
 			inv,
 		},
+		NextPageToken: nextPageToken,
+	}
+	if err := s.redactAPIKeys(ctx, rsp); err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+func (s *BuildBuddyServer) GetInvocationRenderModel(ctx context.Context, req *inpb.GetInvocationRenderModelRequest) (*inpb.GetInvocationRenderModelResponse, error) {
+	if req.GetInvocationId() == "" {
+		return nil, status.InvalidArgumentErrorf("GetInvocationRenderModelRequest must contain a valid invocation_id")
+	}
+	rsp, err := build_event_handler.LookupInvocationRenderModel(s.env, ctx, req.GetInvocationId())
+	if err != nil {
+		return nil, err
 	}
 	if err := s.redactAPIKeys(ctx, rsp); err != nil {
 		return nil, err
@@ -127,6 +170,20 @@ func (s *BuildBuddyServer) SearchInvocation(ctx context.Context, req *inpb.Searc
 	return searcher.QueryInvocations(ctx, req)
 }
 
+func (s *BuildBuddyServer) GetBaselineInvocation(ctx context.Context, req *inpb.GetBaselineInvocationRequest) (*inpb.GetBaselineInvocationResponse, error) {
+	if searcher := s.env.GetInvocationSearchService(); searcher != nil {
+		return searcher.GetBaselineInvocation(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) GetRelatedInvocations(ctx context.Context, req *inpb.GetRelatedInvocationsRequest) (*inpb.GetRelatedInvocationsResponse, error) {
+	if searcher := s.env.GetInvocationSearchService(); searcher != nil {
+		return searcher.GetRelatedInvocations(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
 func (s *BuildBuddyServer) UpdateInvocation(ctx context.Context, req *inpb.UpdateInvocationRequest) (*inpb.UpdateInvocationResponse, error) {
 	auth := s.env.GetAuthenticator()
 	if auth == nil {
@@ -141,6 +198,9 @@ func (s *BuildBuddyServer) UpdateInvocation(ctx context.Context, req *inpb.Updat
 	if err := db.UpdateInvocationACL(ctx, &authenticatedUser, req.GetInvocationId(), req.GetAcl()); err != nil {
 		return nil, err
 	}
+	if ic := s.env.GetInvocationCache(); ic != nil {
+		ic.Invalidate(req.GetInvocationId())
+	}
 	return &inpb.UpdateInvocationResponse{}, nil
 }
 
@@ -155,11 +215,55 @@ func (s *BuildBuddyServer) DeleteInvocation(ctx context.Context, req *inpb.Delet
 	}
 
 	db := s.env.GetInvocationDB()
-	if err := db.DeleteInvocationWithPermsCheck(ctx, &authenticatedUser, req.GetInvocationId()); err != nil {
+	rsp := &inpb.DeleteInvocationResponse{}
+	if s.env.GetConfigurator().GetStorageTrashRetentionSeconds() > 0 && !req.GetPermanent() {
+		if err := db.TrashInvocationWithPermsCheck(ctx, &authenticatedUser, req.GetInvocationId()); err != nil {
+			return nil, err
+		}
+		rsp.Trashed = true
+	} else if err := build_event_handler.DeleteInvocationWithPermsCheck(ctx, s.env, &authenticatedUser, req.GetInvocationId()); err != nil {
+		return nil, err
+	}
+	if ic := s.env.GetInvocationCache(); ic != nil {
+		ic.Invalidate(req.GetInvocationId())
+	}
+
+	return rsp, nil
+}
+
+func (s *BuildBuddyServer) RestoreInvocation(ctx context.Context, req *inpb.RestoreInvocationRequest) (*inpb.RestoreInvocationResponse, error) {
+	auth := s.env.GetAuthenticator()
+	if auth == nil {
+		return nil, status.UnimplementedError("Not Implemented")
+	}
+	authenticatedUser, err := auth.AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.env.GetInvocationDB().RestoreInvocationWithPermsCheck(ctx, &authenticatedUser, req.GetInvocationId()); err != nil {
 		return nil, err
 	}
+	return &inpb.RestoreInvocationResponse{}, nil
+}
 
-	return &inpb.DeleteInvocationResponse{}, nil
+func (s *BuildBuddyServer) GetTrashedInvocations(ctx context.Context, req *inpb.GetTrashedInvocationsRequest) (*inpb.GetTrashedInvocationsResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := perms.AuthorizeGroupAccess(ctx, s.env, groupID); err != nil {
+		return nil, err
+	}
+	count := int(req.GetCount())
+	if count <= 0 || count > maxTrashedInvocationsCount {
+		count = maxTrashedInvocationsCount
+	}
+	trashed, err := s.env.GetInvocationDB().LookupTrashedInvocations(ctx, groupID, count)
+	if err != nil {
+		return nil, err
+	}
+	rsp := &inpb.GetTrashedInvocationsResponse{}
+	for _, ti := range trashed {
+		rsp.Invocation = append(rsp.Invocation, build_event_handler.TableInvocationToProto(ti))
+	}
+	return rsp, nil
 }
 
 func makeGroups(grps []*tables.Group) []*grpb.Group {
@@ -177,6 +281,13 @@ func makeGroups(grps []*tables.Group) []*grpb.Group {
 			UrlIdentifier:          urlIdentifier,
 			SharingEnabled:         g.SharingEnabled,
 			UseGroupOwnedExecutors: g.UseGroupOwnedExecutors,
+			AllowedCacheNamespaces: g.AllowedCacheNamespaces,
+			CacheWarmingEnabled:    g.CacheWarmingEnabled,
+			ConsoleLogIndexEnabled: g.ConsoleLogIndexEnabled,
+
+			DefaultPlatformProperties: g.DefaultPlatformProperties,
+			ForcedPlatformProperties:  g.ForcedPlatformProperties,
+			BesForwardingTarget:       g.BESForwardingTarget,
 		})
 	}
 	return r
@@ -292,12 +403,37 @@ func (s *BuildBuddyServer) CreateGroup(ctx context.Context, req *grpb.CreateGrou
 		groupOwnedDomain = userEmailDomain
 	}
 
+	allowedCacheNamespaces, err := namespace.ParseAllowedNamespaces(req.GetAllowedCacheNamespaces())
+	if err != nil {
+		return nil, err
+	}
+
+	defaultPlatformProperties, err := platform_policy.NormalizeProperties(req.GetDefaultPlatformProperties())
+	if err != nil {
+		return nil, err
+	}
+	forcedPlatformProperties, err := platform_policy.NormalizeProperties(req.GetForcedPlatformProperties())
+	if err != nil {
+		return nil, err
+	}
+	besForwardingTarget, err := s.besForwardingTarget(req.GetBesForwardingTarget(), "")
+	if err != nil {
+		return nil, err
+	}
+
 	group := &tables.Group{
 		UserID:                 user.UserID,
 		Name:                   groupName,
 		OwnedDomain:            groupOwnedDomain,
 		SharingEnabled:         req.GetSharingEnabled(),
 		UseGroupOwnedExecutors: req.GetUseGroupOwnedExecutors(),
+		AllowedCacheNamespaces: strings.Join(allowedCacheNamespaces, ","),
+		CacheWarmingEnabled:    req.GetCacheWarmingEnabled(),
+		ConsoleLogIndexEnabled: req.GetConsoleLogIndexEnabled(),
+
+		DefaultPlatformProperties: defaultPlatformProperties,
+		ForcedPlatformProperties:  forcedPlatformProperties,
+		BESForwardingTarget:       besForwardingTarget,
 	}
 	urlIdentifier := strings.TrimSpace(req.GetUrlIdentifier())
 
@@ -367,12 +503,49 @@ func (s *BuildBuddyServer) UpdateGroup(ctx context.Context, req *grpb.UpdateGrou
 	}
 	group.SharingEnabled = req.GetSharingEnabled()
 	group.UseGroupOwnedExecutors = req.GetUseGroupOwnedExecutors()
+	allowedCacheNamespaces, err := namespace.ParseAllowedNamespaces(req.GetAllowedCacheNamespaces())
+	if err != nil {
+		return nil, err
+	}
+	group.AllowedCacheNamespaces = strings.Join(allowedCacheNamespaces, ",")
+	group.CacheWarmingEnabled = req.GetCacheWarmingEnabled()
+	group.ConsoleLogIndexEnabled = req.GetConsoleLogIndexEnabled()
+	if group.DefaultPlatformProperties, err = platform_policy.NormalizeProperties(req.GetDefaultPlatformProperties()); err != nil {
+		return nil, err
+	}
+	if group.ForcedPlatformProperties, err = platform_policy.NormalizeProperties(req.GetForcedPlatformProperties()); err != nil {
+		return nil, err
+	}
+	if group.BESForwardingTarget, err = s.besForwardingTarget(req.GetBesForwardingTarget(), group.BESForwardingTarget); err != nil {
+		return nil, err
+	}
 	if _, err := userDB.InsertOrUpdateGroup(ctx, group); err != nil {
 		return nil, err
 	}
 	return &grpb.UpdateGroupResponse{}, nil
 }
 
+// besForwardingTarget validates the build event protocol server that a group's
+// build events are forwarded to. A group may only set a new one if the app
+// allows forwarding, and allows forwarding to its host, but an existing one
+// may be kept.
+func (s *BuildBuddyServer) besForwardingTarget(target, previousTarget string) (string, error) {
+	target, err := build_event_proxy.NormalizeTarget(target)
+	if err != nil {
+		return "", err
+	}
+	if target == "" || target == previousTarget {
+		return target, nil
+	}
+	if !s.env.GetConfigurator().GetBuildEventProxyEnableGroupForwarding() {
+		return "", status.FailedPreconditionError("Forwarding build events to an organization's own server is not enabled.")
+	}
+	if err := build_event_proxy.CheckForwardingTarget(target, s.env.GetConfigurator().GetBuildEventProxyAllowedForwardingHosts()); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
 func (s *BuildBuddyServer) JoinGroup(ctx context.Context, req *grpb.JoinGroupRequest) (*grpb.JoinGroupResponse, error) {
 	auth := s.env.GetAuthenticator()
 	userDB := s.env.GetUserDB()
@@ -421,10 +594,11 @@ func (s *BuildBuddyServer) GetApiKeys(ctx context.Context, req *akpb.GetApiKeysR
 	}
 	for _, k := range tableKeys {
 		rsp.ApiKey = append(rsp.ApiKey, &akpb.ApiKey{
-			Id:         k.APIKeyID,
-			Value:      k.Value,
-			Label:      k.Label,
-			Capability: capabilities.FromInt(k.Capabilities),
+			Id:           k.APIKeyID,
+			Value:        k.Value,
+			Label:        k.Label,
+			Capability:   capabilities.FromInt(k.Capabilities),
+			LastUsedUsec: k.LastUsedUsec,
 		})
 	}
 	return rsp, nil
@@ -453,25 +627,28 @@ func (s *BuildBuddyServer) CreateApiKey(ctx context.Context, req *akpb.CreateApi
 	}, nil
 }
 
-func (s *BuildBuddyServer) authorizeAPIKeyWrite(ctx context.Context, apiKeyID string) error {
+func (s *BuildBuddyServer) authorizeAPIKeyWrite(ctx context.Context, apiKeyID string) (*tables.APIKey, error) {
 	if apiKeyID == "" {
-		return status.InvalidArgumentError("API key ID is required")
+		return nil, status.InvalidArgumentError("API key ID is required")
 	}
 	user, err := perms.AuthenticatedUser(ctx, s.env)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	userDB := s.env.GetUserDB()
 	if userDB == nil {
-		return status.UnimplementedError("Not Implemented")
+		return nil, status.UnimplementedError("Not Implemented")
 	}
 	// Check that the user belongs to the group that owns the requested API key.
 	key, err := userDB.GetAPIKey(ctx, apiKeyID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	acl := perms.ToACLProto( /* userID= */ nil, key.GroupID, key.Perms)
-	return perms.AuthorizeWrite(&user, acl)
+	if err := perms.AuthorizeWrite(&user, acl); err != nil {
+		return nil, err
+	}
+	return key, nil
 }
 
 func (s *BuildBuddyServer) UpdateApiKey(ctx context.Context, req *akpb.UpdateApiKeyRequest) (*akpb.UpdateApiKeyResponse, error) {
@@ -479,7 +656,8 @@ func (s *BuildBuddyServer) UpdateApiKey(ctx context.Context, req *akpb.UpdateApi
 	if userDB == nil {
 		return nil, status.UnimplementedError("Not Implemented")
 	}
-	if err := s.authorizeAPIKeyWrite(ctx, req.GetId()); err != nil {
+	key, err := s.authorizeAPIKeyWrite(ctx, req.GetId())
+	if err != nil {
 		return nil, err
 	}
 	tk := &tables.APIKey{
@@ -490,6 +668,9 @@ func (s *BuildBuddyServer) UpdateApiKey(ctx context.Context, req *akpb.UpdateApi
 	if err := userDB.UpdateAPIKey(ctx, tk); err != nil {
 		return nil, err
 	}
+	if auth := s.env.GetAuthenticator(); auth != nil {
+		auth.InvalidateAPIKey(key.Value)
+	}
 	return &akpb.UpdateApiKeyResponse{}, nil
 }
 
@@ -498,15 +679,105 @@ func (s *BuildBuddyServer) DeleteApiKey(ctx context.Context, req *akpb.DeleteApi
 	if userDB == nil {
 		return nil, status.UnimplementedError("Not Implemented")
 	}
-	if err := s.authorizeAPIKeyWrite(ctx, req.GetId()); err != nil {
+	key, err := s.authorizeAPIKeyWrite(ctx, req.GetId())
+	if err != nil {
 		return nil, err
 	}
+	// Servers cache API keys for a while, so the key is denylisted to revoke
+	// it immediately.
+	if authDB := s.env.GetAuthDB(); authDB != nil {
+		if err := authDB.RevokeToken(ctx, key.Value); err != nil {
+			return nil, err
+		}
+	}
 	if err := userDB.DeleteAPIKey(ctx, req.GetId()); err != nil {
 		return nil, err
 	}
+	if auth := s.env.GetAuthenticator(); auth != nil {
+		auth.InvalidateAPIKey(key.Value)
+	}
 	return &akpb.DeleteApiKeyResponse{}, nil
 }
 
+// authorizeSessionAccess checks that the authenticated user may manage the
+// sessions of the given user: users may manage their own sessions, and admins
+// may manage anyone's.
+func authorizeSessionAccess(user interfaces.UserInfo, userID string) error {
+	if userID != user.GetUserID() && !user.IsAdmin() {
+		return status.PermissionDeniedError("You don't have access to this user's sessions.")
+	}
+	return nil
+}
+
+func (s *BuildBuddyServer) GetSessions(ctx context.Context, req *sespb.GetSessionsRequest) (*sespb.GetSessionsResponse, error) {
+	authDB := s.env.GetAuthDB()
+	if authDB == nil {
+		return nil, status.UnimplementedError("Not Implemented")
+	}
+	user, err := perms.AuthenticatedUser(ctx, s.env)
+	if err != nil {
+		return nil, err
+	}
+	userID := req.GetUserId()
+	if userID == "" {
+		userID = user.GetUserID()
+	}
+	if err := authorizeSessionAccess(user, userID); err != nil {
+		return nil, err
+	}
+	sessions, err := authDB.GetUserSessions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	rsp := &sespb.GetSessionsResponse{
+		Session: make([]*sespb.Session, 0, len(sessions)),
+	}
+	for _, ts := range sessions {
+		rsp.Session = append(rsp.Session, &sespb.Session{
+			Id:            ts.SessionID,
+			UserId:        userID,
+			UserAgent:     ts.UserAgent,
+			IpAddress:     ts.IPAddress,
+			CreatedAtUsec: ts.CreatedAtUsec,
+			LastUsedUsec:  ts.LastUsedUsec,
+		})
+	}
+	return rsp, nil
+}
+
+func (s *BuildBuddyServer) RevokeSession(ctx context.Context, req *sespb.RevokeSessionRequest) (*sespb.RevokeSessionResponse, error) {
+	authDB := s.env.GetAuthDB()
+	userDB := s.env.GetUserDB()
+	if authDB == nil || userDB == nil {
+		return nil, status.UnimplementedError("Not Implemented")
+	}
+	if req.GetSessionId() == "" {
+		return nil, status.InvalidArgumentError("Session ID is required")
+	}
+	user, err := perms.AuthenticatedUser(ctx, s.env)
+	if err != nil {
+		return nil, err
+	}
+	session, err := authDB.GetSession(ctx, req.GetSessionId())
+	if err != nil {
+		return nil, err
+	}
+	if !user.IsAdmin() {
+		// Check that the session belongs to the authenticated user.
+		u, err := userDB.GetUser(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if u.SubID != session.SubID {
+			return nil, status.PermissionDeniedError("You don't have access to this session.")
+		}
+	}
+	if err := authDB.RevokeSession(ctx, req.GetSessionId()); err != nil {
+		return nil, err
+	}
+	return &sespb.RevokeSessionResponse{}, nil
+}
+
 func getEmailDomain(email string) string {
 	chunks := strings.Split(email, "@")
 	return chunks[len(chunks)-1]
@@ -670,6 +941,47 @@ func (s *BuildBuddyServer) GetTrend(ctx context.Context, req *inpb.GetTrendReque
 	return nil, status.UnimplementedError("Not implemented")
 }
 
+func (s *BuildBuddyServer) GetBuildMetadataKeys(ctx context.Context, req *inpb.GetBuildMetadataKeysRequest) (*inpb.GetBuildMetadataKeysResponse, error) {
+	if iss := s.env.GetInvocationStatService(); iss != nil {
+		return iss.GetBuildMetadataKeys(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) GetClientVersions(ctx context.Context, req *inpb.GetClientVersionsRequest) (*inpb.GetClientVersionsResponse, error) {
+	if iss := s.env.GetInvocationStatService(); iss != nil {
+		return iss.GetClientVersions(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) GetHomeStats(ctx context.Context, req *inpb.GetHomeStatsRequest) (*inpb.GetHomeStatsResponse, error) {
+	if iss := s.env.GetInvocationStatService(); iss != nil {
+		return iss.GetHomeStats(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) GetFailureClusters(ctx context.Context, req *inpb.GetFailureClustersRequest) (*inpb.GetFailureClustersResponse, error) {
+	if iss := s.env.GetInvocationStatService(); iss != nil {
+		return iss.GetFailureClusters(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) SearchConsoleLog(ctx context.Context, req *inpb.SearchConsoleLogRequest) (*inpb.SearchConsoleLogResponse, error) {
+	if index := s.env.GetConsoleLogIndex(); index != nil {
+		return index.SearchConsoleLog(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+// GetArtifactDeduplicationReport reports how much of the artifacts of the
+// selected group's recent invocations are duplicated across invocations.
+func (s *BuildBuddyServer) GetArtifactDeduplicationReport(ctx context.Context, req *inpb.GetArtifactDeduplicationReportRequest) (*inpb.GetArtifactDeduplicationReportResponse, error) {
+	return build_event_handler.GetArtifactDeduplicationReport(ctx, s.env, req)
+}
+
 func (s *BuildBuddyServer) GetExecution(ctx context.Context, req *espb.GetExecutionRequest) (*espb.GetExecutionResponse, error) {
 	if es := s.env.GetExecutionService(); es != nil {
 		return es.GetExecution(ctx, req)
@@ -677,6 +989,20 @@ func (s *BuildBuddyServer) GetExecution(ctx context.Context, req *espb.GetExecut
 	return nil, status.UnimplementedError("Not implemented")
 }
 
+func (s *BuildBuddyServer) GetExecutionProgress(ctx context.Context, req *espb.GetExecutionProgressRequest) (*espb.GetExecutionProgressResponse, error) {
+	if es := s.env.GetExecutionService(); es != nil {
+		return es.GetExecutionProgress(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) PredictExecution(ctx context.Context, req *espb.PredictExecutionRequest) (*espb.PredictExecutionResponse, error) {
+	if rexec := s.env.GetRemoteExecutionService(); rexec != nil {
+		return rexec.PredictExecution(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
 func (s *BuildBuddyServer) GetExecutionNodes(ctx context.Context, req *scpb.GetExecutionNodesRequest) (*scpb.GetExecutionNodesResponse, error) {
 	if ss := s.env.GetSchedulerService(); ss != nil {
 		res, err := ss.GetExecutionNodes(ctx, req)
@@ -685,10 +1011,152 @@ func (s *BuildBuddyServer) GetExecutionNodes(ctx context.Context, req *scpb.GetE
 	return nil, status.UnimplementedError("Not implemented")
 }
 
+func (s *BuildBuddyServer) CordonExecutor(ctx context.Context, req *scpb.CordonExecutorRequest) (*scpb.CordonExecutorResponse, error) {
+	if ss := s.env.GetSchedulerService(); ss != nil {
+		return ss.CordonExecutor(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) CreateMaintenanceWindow(ctx context.Context, req *scpb.CreateMaintenanceWindowRequest) (*scpb.CreateMaintenanceWindowResponse, error) {
+	if ss := s.env.GetSchedulerService(); ss != nil {
+		return ss.CreateMaintenanceWindow(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) DeleteMaintenanceWindow(ctx context.Context, req *scpb.DeleteMaintenanceWindowRequest) (*scpb.DeleteMaintenanceWindowResponse, error) {
+	if ss := s.env.GetSchedulerService(); ss != nil {
+		return ss.DeleteMaintenanceWindow(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) GetMaintenanceWindows(ctx context.Context, req *scpb.GetMaintenanceWindowsRequest) (*scpb.GetMaintenanceWindowsResponse, error) {
+	if ss := s.env.GetSchedulerService(); ss != nil {
+		return ss.GetMaintenanceWindows(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) GetExecutorUtilization(ctx context.Context, req *scpb.GetExecutorUtilizationRequest) (*scpb.GetExecutorUtilizationResponse, error) {
+	if ss := s.env.GetSchedulerService(); ss != nil {
+		return ss.GetExecutorUtilization(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) ExportSchedulerSnapshot(ctx context.Context, req *scpb.ExportSchedulerSnapshotRequest) (*scpb.ExportSchedulerSnapshotResponse, error) {
+	if ss := s.env.GetSchedulerService(); ss != nil {
+		return ss.ExportSchedulerSnapshot(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) CreateInstanceNameAlias(ctx context.Context, req *ianpb.CreateInstanceNameAliasRequest) (*ianpb.CreateInstanceNameAliasResponse, error) {
+	if as := s.env.GetInstanceNameAliasService(); as != nil {
+		return as.CreateInstanceNameAlias(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) ExpireInstanceNameAlias(ctx context.Context, req *ianpb.ExpireInstanceNameAliasRequest) (*ianpb.ExpireInstanceNameAliasResponse, error) {
+	if as := s.env.GetInstanceNameAliasService(); as != nil {
+		return as.ExpireInstanceNameAlias(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) GetInstanceNameAliases(ctx context.Context, req *ianpb.GetInstanceNameAliasesRequest) (*ianpb.GetInstanceNameAliasesResponse, error) {
+	if as := s.env.GetInstanceNameAliasService(); as != nil {
+		return as.GetInstanceNameAliases(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) AnalyzeRemoteGrpcLog(ctx context.Context, req *rgpb.AnalyzeRemoteGrpcLogRequest) (*rgpb.AnalyzeRemoteGrpcLogResponse, error) {
+	return remote_grpc_log.AnalyzeLog(ctx, s.env, req)
+}
+
 func (s *BuildBuddyServer) GetTarget(ctx context.Context, req *trpb.GetTargetRequest) (*trpb.GetTargetResponse, error) {
 	return target.GetTarget(ctx, s.env, req)
 }
 
+func (s *BuildBuddyServer) GetQuarantinedTargets(ctx context.Context, req *trpb.GetQuarantinedTargetsRequest) (*trpb.GetQuarantinedTargetsResponse, error) {
+	return target.GetQuarantinedTargets(ctx, s.env, req)
+}
+
+func (s *BuildBuddyServer) QuarantineTarget(ctx context.Context, req *trpb.QuarantineTargetRequest) (*trpb.QuarantineTargetResponse, error) {
+	return target.QuarantineTarget(ctx, s.env, req)
+}
+
+func (s *BuildBuddyServer) UnquarantineTarget(ctx context.Context, req *trpb.UnquarantineTargetRequest) (*trpb.UnquarantineTargetResponse, error) {
+	return target.UnquarantineTarget(ctx, s.env, req)
+}
+
+func (s *BuildBuddyServer) SendTestNotification(ctx context.Context, req *nfpb.SendTestNotificationRequest) (*nfpb.SendTestNotificationResponse, error) {
+	if router := s.env.GetNotificationRouter(); router != nil {
+		return router.SendTestNotification(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+// GetUsageStatus returns the selected group's usage of each resource with a
+// configured limit, so that its members can be warned as it approaches them.
+func (s *BuildBuddyServer) GetUsageStatus(ctx context.Context, req *usagepb.GetUsageStatusRequest) (*usagepb.GetUsageStatusResponse, error) {
+	groupID, err := perms.AuthenticateSelectedGroupID(ctx, s.env, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	limits, err := build_event_handler.GetUsageStatus(ctx, s.env, groupID)
+	if err != nil {
+		return nil, err
+	}
+	return &usagepb.GetUsageStatusResponse{Limit: limits}, nil
+}
+
+func (s *BuildBuddyServer) GetSecrets(ctx context.Context, req *secpb.GetSecretsRequest) (*secpb.GetSecretsResponse, error) {
+	if ss := s.env.GetSecretService(); ss != nil {
+		return ss.GetSecrets(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) UpdateSecret(ctx context.Context, req *secpb.UpdateSecretRequest) (*secpb.UpdateSecretResponse, error) {
+	if ss := s.env.GetSecretService(); ss != nil {
+		return ss.UpdateSecret(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) DeleteSecret(ctx context.Context, req *secpb.DeleteSecretRequest) (*secpb.DeleteSecretResponse, error) {
+	if ss := s.env.GetSecretService(); ss != nil {
+		return ss.DeleteSecret(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) CreateExportJob(ctx context.Context, req *iepb.CreateExportJobRequest) (*iepb.CreateExportJobResponse, error) {
+	if es := s.env.GetInvocationExportService(); es != nil {
+		return es.CreateExportJob(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) GetExportJob(ctx context.Context, req *iepb.GetExportJobRequest) (*iepb.GetExportJobResponse, error) {
+	if es := s.env.GetInvocationExportService(); es != nil {
+		return es.GetExportJob(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) GetAccessLog(ctx context.Context, req *alpb.GetAccessLogRequest) (*alpb.GetAccessLogResponse, error) {
+	if al := s.env.GetAccessLogService(); al != nil {
+		return al.GetAccessLog(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
 func (s *BuildBuddyServer) CreateWorkflow(ctx context.Context, req *wfpb.CreateWorkflowRequest) (*wfpb.CreateWorkflowResponse, error) {
 	if wfs := s.env.GetWorkflowService(); wfs != nil {
 		return wfs.CreateWorkflow(ctx, req)
@@ -720,6 +1188,41 @@ func (s *BuildBuddyServer) GetRepos(ctx context.Context, req *wfpb.GetReposReque
 	return nil, status.UnimplementedError("Not implemented")
 }
 
+func (s *BuildBuddyServer) StartBisect(ctx context.Context, req *wfpb.StartBisectRequest) (*wfpb.StartBisectResponse, error) {
+	if wfs := s.env.GetWorkflowService(); wfs != nil {
+		return wfs.StartBisect(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) GetBisect(ctx context.Context, req *wfpb.GetBisectRequest) (*wfpb.GetBisectResponse, error) {
+	if wfs := s.env.GetWorkflowService(); wfs != nil {
+		return wfs.GetBisect(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) CreateWorkflowSchedule(ctx context.Context, req *wfpb.CreateWorkflowScheduleRequest) (*wfpb.CreateWorkflowScheduleResponse, error) {
+	if wfs := s.env.GetWorkflowService(); wfs != nil {
+		return wfs.CreateWorkflowSchedule(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) DeleteWorkflowSchedule(ctx context.Context, req *wfpb.DeleteWorkflowScheduleRequest) (*wfpb.DeleteWorkflowScheduleResponse, error) {
+	if wfs := s.env.GetWorkflowService(); wfs != nil {
+		return wfs.DeleteWorkflowSchedule(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) GetWorkflowSchedules(ctx context.Context, req *wfpb.GetWorkflowSchedulesRequest) (*wfpb.GetWorkflowSchedulesResponse, error) {
+	if wfs := s.env.GetWorkflowService(); wfs != nil {
+		return wfs.GetWorkflowSchedules(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
 type bsLookup struct {
 	URL      *url.URL
 	Filename string
@@ -807,4 +1310,21 @@ func (s *BuildBuddyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
+
+	s.recordArtifactAccess(r.Context(), params.Get("invocation_id"), lookup.Filename)
+}
+
+// recordArtifactAccess records the download of an artifact of the invocation
+// in its group's access log. The invocation ID is taken from the request, so
+// the download is only recorded if the user may read the invocation, so that
+// users can't add entries to the access logs of other groups.
+func (s *BuildBuddyServer) recordArtifactAccess(ctx context.Context, invocationID, artifactName string) {
+	al := s.env.GetAccessLogService()
+	if al == nil || invocationID == "" {
+		return
+	}
+	if _, err := s.env.GetInvocationDB().LookupInvocation(ctx, invocationID); err != nil {
+		return
+	}
+	al.RecordArtifactAccess(ctx, invocationID, artifactName)
 }
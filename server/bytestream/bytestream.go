@@ -59,7 +59,7 @@ func streamFromUrl(ctx context.Context, url *url.URL, grpcs bool, callback func(
 
 	if url.Scheme == "actioncache" {
 		acClient := repb.NewActionCacheClient(conn)
-		instanceName, d, err := digest.ExtractDigestFromActionCacheResourceName(strings.TrimPrefix(url.RequestURI(), "/"))
+		instanceName, d, err := digest.ExtractDigestFromActionCacheResourceName(strings.TrimPrefix(url.Path, "/"))
 		if err != nil {
 			return err
 		}
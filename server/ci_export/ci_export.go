@@ -0,0 +1,239 @@
+// Package ci_export posts a summary of each completed invocation back to the
+// CI build that ran it: as an annotation of a Buildkite build, or as the
+// description of a Jenkins build.
+//
+// CI jobs identify their build with build metadata, by passing the CI
+// system's environment variables to Bazel:
+//
+//	# Buildkite
+//	--build_metadata=BUILDKITE_ORGANIZATION_SLUG=$BUILDKITE_ORGANIZATION_SLUG
+//	--build_metadata=BUILDKITE_PIPELINE_SLUG=$BUILDKITE_PIPELINE_SLUG
+//	--build_metadata=BUILDKITE_BUILD_NUMBER=$BUILDKITE_BUILD_NUMBER
+//
+//	# Jenkins
+//	--build_metadata=BUILD_URL=$BUILD_URL
+//
+// Since the metadata is supplied by clients, builds are only updated if they
+// belong to the configured Buildkite organization or Jenkins server.
+package ci_export
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+const (
+	buildkiteOrgKey      = "BUILDKITE_ORGANIZATION_SLUG"
+	buildkitePipelineKey = "BUILDKITE_PIPELINE_SLUG"
+	buildkiteBuildKey    = "BUILDKITE_BUILD_NUMBER"
+	jenkinsBuildURLKey   = "BUILD_URL"
+
+	defaultBuildkiteAPIURL = "https://api.buildkite.com"
+
+	// The most failed targets listed in a summary.
+	maxFailedLabels = 20
+
+	requestTimeout = 10 * time.Second
+)
+
+// IsConfigured returns whether builds of any CI system can be updated.
+func IsConfigured(c *config.CIExportConfig) bool {
+	return c.Buildkite.APIToken != "" || c.Jenkins.URL != ""
+}
+
+// Exporter implements interfaces.Webhook by posting invocation summaries to
+// the CI builds identified by their build metadata.
+type Exporter struct {
+	config *config.CIExportConfig
+	appURL string
+	client *http.Client
+	// Overridden by tests.
+	buildkiteAPIURL string
+}
+
+func NewExporter(c *config.CIExportConfig, appURL string) *Exporter {
+	return &Exporter{
+		config:          c,
+		appURL:          appURL,
+		client:          &http.Client{Timeout: requestTimeout},
+		buildkiteAPIURL: defaultBuildkiteAPIURL,
+	}
+}
+
+// summary is the outcome of an invocation, as reported to CI systems.
+type summary struct {
+	success      bool
+	command      string
+	url          string
+	failedLabels []string
+}
+
+func (s *summary) title() string {
+	if s.success {
+		return fmt.Sprintf("bazel %s succeeded", s.command)
+	}
+	return fmt.Sprintf("bazel %s failed", s.command)
+}
+
+// markdown formats the summary for Buildkite annotations.
+func (s *summary) markdown() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "**%s** · [View invocation on BuildBuddy](%s)\n", s.title(), s.url)
+	if len(s.failedLabels) > 0 {
+		b.WriteString("\nFailed targets:\n\n")
+		for _, label := range s.failedLabels {
+			fmt.Fprintf(b, "- `%s`\n", label)
+		}
+	}
+	return b.String()
+}
+
+// text formats the summary for Jenkins build descriptions, which are plain
+// text unless the Jenkins server allows HTML.
+func (s *summary) text() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%s: %s", s.title(), s.url)
+	if len(s.failedLabels) > 0 {
+		fmt.Fprintf(b, "\nFailed targets: %s", strings.Join(s.failedLabels, ", "))
+	}
+	return b.String()
+}
+
+// summarize returns the build metadata of the invocation, and a summary
+// of its outcome.
+func (e *Exporter) summarize(invocation *inpb.Invocation) (map[string]string, *summary) {
+	metadata := make(map[string]string)
+	failed := make(map[string]bool)
+	for _, event := range invocation.GetEvent() {
+		be := event.GetBuildEvent()
+		switch p := be.GetPayload().(type) {
+		case *build_event_stream.BuildEvent_BuildMetadata:
+			for k, v := range p.BuildMetadata.GetMetadata() {
+				metadata[k] = v
+			}
+		case *build_event_stream.BuildEvent_Completed:
+			if !p.Completed.GetSuccess() {
+				failed[be.GetId().GetTargetCompleted().GetLabel()] = true
+			}
+		case *build_event_stream.BuildEvent_TestSummary:
+			if s := p.TestSummary.GetOverallStatus(); s != build_event_stream.TestStatus_PASSED && s != build_event_stream.TestStatus_FLAKY {
+				failed[be.GetId().GetTestSummary().GetLabel()] = true
+			}
+		}
+	}
+	delete(failed, "")
+	labels := make([]string, 0, len(failed))
+	for label := range failed {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	if len(labels) > maxFailedLabels {
+		more := len(labels) - maxFailedLabels
+		labels = append(labels[:maxFailedLabels], fmt.Sprintf("and %d more", more))
+	}
+	return metadata, &summary{
+		success:      invocation.GetSuccess(),
+		command:      invocation.GetCommand(),
+		url:          e.appURL + "/invocation/" + invocation.GetInvocationId(),
+		failedLabels: labels,
+	}
+}
+
+func (e *Exporter) NotifyComplete(ctx context.Context, invocation *inpb.Invocation) error {
+	metadata, s := e.summarize(invocation)
+	var lastErr error
+	if e.config.Buildkite.APIToken != "" && metadata[buildkiteBuildKey] != "" {
+		if err := e.annotateBuildkiteBuild(ctx, metadata, invocation.GetInvocationId(), s); err != nil {
+			lastErr = err
+		}
+	}
+	if e.config.Jenkins.URL != "" && metadata[jenkinsBuildURLKey] != "" {
+		if err := e.describeJenkinsBuild(ctx, metadata, s); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+type buildkiteAnnotation struct {
+	Body    string `json:"body"`
+	Style   string `json:"style"`
+	Context string `json:"context"`
+}
+
+func (e *Exporter) annotateBuildkiteBuild(ctx context.Context, metadata map[string]string, invocationID string, s *summary) error {
+	org := metadata[buildkiteOrgKey]
+	if org != e.config.Buildkite.Organization {
+		return nil
+	}
+	pipeline := metadata[buildkitePipelineKey]
+	if pipeline == "" {
+		return status.InvalidArgumentErrorf("invocation %s is missing the %s build metadata", invocationID, buildkitePipelineKey)
+	}
+	annotation := &buildkiteAnnotation{
+		Body:  s.markdown(),
+		Style: "success",
+		// Each invocation of the build gets its own annotation.
+		Context: "buildbuddy-" + invocationID,
+	}
+	if !s.success {
+		annotation.Style = "error"
+	}
+	body, err := json.Marshal(annotation)
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("%s/v2/organizations/%s/pipelines/%s/builds/%s/annotations",
+		e.buildkiteAPIURL, url.PathEscape(org), url.PathEscape(pipeline), url.PathEscape(metadata[buildkiteBuildKey]))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+e.config.Buildkite.APIToken)
+	req.Header.Set("Content-Type", "application/json")
+	return e.do(req)
+}
+
+func (e *Exporter) describeJenkinsBuild(ctx context.Context, metadata map[string]string, s *summary) error {
+	buildURL := metadata[jenkinsBuildURLKey]
+	if !strings.HasPrefix(buildURL, strings.TrimSuffix(e.config.Jenkins.URL, "/")+"/") {
+		return nil
+	}
+	form := url.Values{"description": {s.text()}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(buildURL, "/")+"/submitDescription", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	// Requests authenticated with an API token don't need a CSRF crumb.
+	req.SetBasicAuth(e.config.Jenkins.User, e.config.Jenkins.APIToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return e.do(req)
+}
+
+func (e *Exporter) do(req *http.Request) error {
+	rsp, err := e.client.Do(req)
+	if err != nil {
+		return status.UnavailableErrorf("%s %s: %s", req.Method, req.URL, err)
+	}
+	defer rsp.Body.Close()
+	// Jenkins redirects to the build page once the description is set.
+	if rsp.StatusCode >= 400 {
+		body, _ := ioutil.ReadAll(rsp.Body)
+		return status.UnavailableErrorf("%s %s: %s: %s", req.Method, req.URL, rsp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
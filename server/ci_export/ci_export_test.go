@@ -0,0 +1,168 @@
+package ci_export
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+type request struct {
+	path          string
+	authorization string
+	body          string
+}
+
+// recorder records the requests made to a test server.
+type recorder struct {
+	mu       sync.Mutex
+	requests []*request
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, &request{
+		path:          req.URL.EscapedPath(),
+		authorization: req.Header.Get("Authorization"),
+		body:          string(body),
+	})
+}
+
+func newServer(t *testing.T) (*httptest.Server, *recorder) {
+	rec := &recorder{}
+	server := httptest.NewServer(rec)
+	t.Cleanup(server.Close)
+	return server, rec
+}
+
+func invocation(success bool, metadata map[string]string, failedTests ...string) *inpb.Invocation {
+	inv := &inpb.Invocation{
+		InvocationId: "IID",
+		Command:      "test",
+		Success:      success,
+		Event: []*inpb.InvocationEvent{{
+			BuildEvent: &build_event_stream.BuildEvent{
+				Payload: &build_event_stream.BuildEvent_BuildMetadata{
+					BuildMetadata: &build_event_stream.BuildMetadata{Metadata: metadata},
+				},
+			},
+		}},
+	}
+	for _, label := range failedTests {
+		inv.Event = append(inv.Event, &inpb.InvocationEvent{
+			BuildEvent: &build_event_stream.BuildEvent{
+				Id: &build_event_stream.BuildEventId{
+					Id: &build_event_stream.BuildEventId_TestSummary{
+						TestSummary: &build_event_stream.BuildEventId_TestSummaryId{Label: label},
+					},
+				},
+				Payload: &build_event_stream.BuildEvent_TestSummary{
+					TestSummary: &build_event_stream.TestSummary{OverallStatus: build_event_stream.TestStatus_FAILED},
+				},
+			},
+		})
+	}
+	return inv
+}
+
+func buildkiteMetadata(org string) map[string]string {
+	return map[string]string{
+		"BUILDKITE_ORGANIZATION_SLUG": org,
+		"BUILDKITE_PIPELINE_SLUG":     "main",
+		"BUILDKITE_BUILD_NUMBER":      "42",
+	}
+}
+
+func TestBuildkiteAnnotation(t *testing.T) {
+	server, rec := newServer(t)
+	e := NewExporter(&config.CIExportConfig{
+		Buildkite: config.BuildkiteExportConfig{APIToken: "bk-token", Organization: "acme"},
+	}, "https://app.buildbuddy.io")
+	e.buildkiteAPIURL = server.URL
+
+	err := e.NotifyComplete(context.Background(), invocation(false, buildkiteMetadata("acme"), "//b:test", "//a:test"))
+	require.NoError(t, err)
+
+	require.Len(t, rec.requests, 1)
+	req := rec.requests[0]
+	assert.Equal(t, "/v2/organizations/acme/pipelines/main/builds/42/annotations", req.path)
+	assert.Equal(t, "Bearer bk-token", req.authorization)
+	annotation := &buildkiteAnnotation{}
+	require.NoError(t, json.Unmarshal([]byte(req.body), annotation))
+	assert.Equal(t, "error", annotation.Style)
+	assert.Equal(t, "buildbuddy-IID", annotation.Context)
+	assert.Equal(t, "**bazel test failed** · [View invocation on BuildBuddy](https://app.buildbuddy.io/invocation/IID)\n\nFailed targets:\n\n- `//a:test`\n- `//b:test`\n", annotation.Body)
+}
+
+func TestBuildkiteIgnoresOtherOrganizations(t *testing.T) {
+	server, rec := newServer(t)
+	e := NewExporter(&config.CIExportConfig{
+		Buildkite: config.BuildkiteExportConfig{APIToken: "bk-token", Organization: "acme"},
+	}, "https://app.buildbuddy.io")
+	e.buildkiteAPIURL = server.URL
+
+	require.NoError(t, e.NotifyComplete(context.Background(), invocation(true, buildkiteMetadata("other"))))
+	require.NoError(t, e.NotifyComplete(context.Background(), invocation(true, map[string]string{})))
+
+	assert.Empty(t, rec.requests)
+}
+
+func TestJenkinsDescription(t *testing.T) {
+	server, rec := newServer(t)
+	e := NewExporter(&config.CIExportConfig{
+		Jenkins: config.JenkinsExportConfig{URL: server.URL, User: "bb", APIToken: "jenkins-token"},
+	}, "https://app.buildbuddy.io")
+
+	err := e.NotifyComplete(context.Background(), invocation(true, map[string]string{"BUILD_URL": server.URL + "/job/app/7/"}))
+	require.NoError(t, err)
+
+	require.Len(t, rec.requests, 1)
+	req := rec.requests[0]
+	assert.Equal(t, "/job/app/7/submitDescription", req.path)
+	assert.Equal(t, "Basic YmI6amVua2lucy10b2tlbg==", req.authorization)
+	form, err := url.ParseQuery(req.body)
+	require.NoError(t, err)
+	assert.Equal(t, "bazel test succeeded: https://app.buildbuddy.io/invocation/IID", form.Get("description"))
+}
+
+func TestJenkinsIgnoresOtherServers(t *testing.T) {
+	server, rec := newServer(t)
+	other, otherRec := newServer(t)
+	e := NewExporter(&config.CIExportConfig{
+		Jenkins: config.JenkinsExportConfig{URL: server.URL, User: "bb", APIToken: "jenkins-token"},
+	}, "https://app.buildbuddy.io")
+
+	err := e.NotifyComplete(context.Background(), invocation(true, map[string]string{"BUILD_URL": other.URL + "/job/app/7/"}))
+	require.NoError(t, err)
+
+	assert.Empty(t, rec.requests)
+	assert.Empty(t, otherRec.requests)
+}
+
+func TestFailedTargetsAreTruncated(t *testing.T) {
+	e := NewExporter(&config.CIExportConfig{}, "https://app.buildbuddy.io")
+	var labels []string
+	for i := 0; i < maxFailedLabels+5; i++ {
+		labels = append(labels, fmt.Sprintf("//pkg:test_%02d", i))
+	}
+
+	_, s := e.summarize(invocation(false, nil, labels...))
+
+	require.Len(t, s.failedLabels, maxFailedLabels+1)
+	assert.Equal(t, "//pkg:test_00", s.failedLabels[0])
+	assert.Equal(t, "and 5 more", s.failedLabels[maxFailedLabels])
+}
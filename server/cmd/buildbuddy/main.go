@@ -4,6 +4,8 @@ import (
 	"flag"
 
 	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/invocation_archiver"
+	"github.com/buildbuddy-io/buildbuddy/server/invocation_replay"
 	"github.com/buildbuddy-io/buildbuddy/server/janitor"
 	"github.com/buildbuddy-io/buildbuddy/server/libmain"
 	"github.com/buildbuddy-io/buildbuddy/server/telemetry"
@@ -40,5 +42,13 @@ func main() {
 	cleanupService.Start()
 	defer cleanupService.Stop()
 
+	reparser := invocation_replay.NewBackfiller(env)
+	reparser.Start()
+	defer reparser.Stop()
+
+	archiver := invocation_archiver.NewArchiver(env)
+	archiver.Start()
+	defer archiver.Stop()
+
 	libmain.StartAndRunServices(env) // Does not return
 }
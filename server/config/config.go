@@ -3,6 +3,7 @@ package config
 import (
 	"flag"
 	"fmt"
+	"math"
 	"os"
 	"reflect"
 	"strings"
@@ -28,35 +29,51 @@ type generalConfig struct {
 	Database        DatabaseConfig        `yaml:"database"`
 	Cache           cacheConfig           `yaml:"cache"`
 	Executor        ExecutorConfig        `yaml:"executor"`
+	Monitoring      MonitoringConfig      `yaml:"monitoring"`
+	Secrets         SecretsConfig         `yaml:"secrets"`
+	AccessLog       AccessLogConfig       `yaml:"access_log"`
+	Export          ExportConfig          `yaml:"export"`
 }
 
 type appConfig struct {
-	BuildBuddyURL             string   `yaml:"build_buddy_url" usage:"The external URL where your BuildBuddy instance can be found."`
-	EventsAPIURL              string   `yaml:"events_api_url" usage:"Overrides the default build event protocol gRPC address shown by BuildBuddy on the configuration screen."`
-	CacheAPIURL               string   `yaml:"cache_api_url" usage:"Overrides the default remote cache protocol gRPC address shown by BuildBuddy on the configuration screen."`
-	RemoteExecutionAPIURL     string   `yaml:"remote_execution_api_url" usage:"Overrides the default remote execution protocol gRPC address shown by BuildBuddy on the configuration screen."`
-	LogLevel                  string   `yaml:"log_level" usage:"The desired log level. Logs with a level >= this level will be emitted. One of {'fatal', 'error', 'warn', 'info', 'debug'}"`
-	GRPCMaxRecvMsgSizeBytes   int      `yaml:"grpc_max_recv_msg_size_bytes" usage:"Configures the max GRPC receive message size [bytes]"`
-	GRPCOverHTTPPortEnabled   bool     `yaml:"grpc_over_http_port_enabled" usage:"Cloud-Only"`
-	AddUserToDomainGroup      bool     `yaml:"add_user_to_domain_group" usage:"Cloud-Only"`
-	DefaultToDenseMode        bool     `yaml:"default_to_dense_mode" usage:"Enables the dense UI mode by default."`
-	CreateGroupPerUser        bool     `yaml:"create_group_per_user" usage:"Cloud-Only"`
-	EnableTargetTracking      bool     `yaml:"enable_target_tracking" usage:"Cloud-Only"`
-	EnableStructuredLogging   bool     `yaml:"enable_structured_logging" usage:"If true, log messages will be json-formatted."`
-	LogIncludeShortFileName   bool     `yaml:"log_include_short_file_name" usage:"If true, log messages will include shortened originating file name."`
-	NoDefaultUserGroup        bool     `yaml:"no_default_user_group" usage:"Cloud-Only"`
-	LogEnableGCPLoggingFormat bool     `yaml:"log_enable_gcp_logging_format" usage:"If true, the output structured logs will be compatible with format expected by GCP Logging."`
-	LogErrorStackTraces       bool     `yaml:"log_error_stack_traces" usage:"If true, stack traces will be printed for errors that have them."`
-	TraceProjectID            string   `yaml:"trace_project_id" usage:"Optional GCP project ID to export traces to. If not specified, determined from default credentials or metadata server if running on GCP."`
-	TraceServiceName          string   `yaml:"trace_service_name" usage:"Name of the service to associate with traces."`
-	TraceFraction             float64  `yaml:"trace_fraction" usage:"Fraction of requests to sample for tracing."`
-	TraceFractionOverrides    []string `yaml:"trace_fraction_overrides" usage:"Tracing fraction override based on name in format name=fraction."`
-	IgnoreForcedTracingHeader bool     `yaml:"ignore_forced_tracing_header" usage:"If set, we will not honor the forced tracing header."`
+	BuildBuddyURL                string   `yaml:"build_buddy_url" usage:"The external URL where your BuildBuddy instance can be found."`
+	EventsAPIURL                 string   `yaml:"events_api_url" usage:"Overrides the default build event protocol gRPC address shown by BuildBuddy on the configuration screen."`
+	CacheAPIURL                  string   `yaml:"cache_api_url" usage:"Overrides the default remote cache protocol gRPC address shown by BuildBuddy on the configuration screen."`
+	RemoteExecutionAPIURL        string   `yaml:"remote_execution_api_url" usage:"Overrides the default remote execution protocol gRPC address shown by BuildBuddy on the configuration screen."`
+	LogLevel                     string   `yaml:"log_level" usage:"The desired log level. Logs with a level >= this level will be emitted. One of {'fatal', 'error', 'warn', 'info', 'debug'}"`
+	GRPCMaxRecvMsgSizeBytes      int      `yaml:"grpc_max_recv_msg_size_bytes" usage:"Configures the max GRPC receive message size [bytes]"`
+	GRPCMaxSendMsgSizeBytes      int      `yaml:"grpc_max_send_msg_size_bytes" usage:"Configures the max GRPC send message size [bytes]"`
+	GRPCInitialWindowSize        int      `yaml:"grpc_initial_window_size_bytes" usage:"Configures the initial GRPC per-stream flow control window size [bytes]. Values below 64KB are ignored."`
+	GRPCInitialConnWindowSize    int      `yaml:"grpc_initial_conn_window_size_bytes" usage:"Configures the initial GRPC per-connection flow control window size [bytes]. Values below 64KB are ignored."`
+	GRPCOverHTTPPortEnabled      bool     `yaml:"grpc_over_http_port_enabled" usage:"Cloud-Only"`
+	AddUserToDomainGroup         bool     `yaml:"add_user_to_domain_group" usage:"Cloud-Only"`
+	DefaultToDenseMode           bool     `yaml:"default_to_dense_mode" usage:"Enables the dense UI mode by default."`
+	CreateGroupPerUser           bool     `yaml:"create_group_per_user" usage:"Cloud-Only"`
+	EnableTargetTracking         bool     `yaml:"enable_target_tracking" usage:"Cloud-Only"`
+	EnableStructuredLogging      bool     `yaml:"enable_structured_logging" usage:"If true, log messages will be json-formatted."`
+	LogIncludeShortFileName      bool     `yaml:"log_include_short_file_name" usage:"If true, log messages will include shortened originating file name."`
+	NoDefaultUserGroup           bool     `yaml:"no_default_user_group" usage:"Cloud-Only"`
+	LogEnableGCPLoggingFormat    bool     `yaml:"log_enable_gcp_logging_format" usage:"If true, the output structured logs will be compatible with format expected by GCP Logging."`
+	LogErrorStackTraces          bool     `yaml:"log_error_stack_traces" usage:"If true, stack traces will be printed for errors that have them."`
+	TraceProjectID               string   `yaml:"trace_project_id" usage:"Optional GCP project ID to export traces to. If not specified, determined from default credentials or metadata server if running on GCP."`
+	TraceServiceName             string   `yaml:"trace_service_name" usage:"Name of the service to associate with traces."`
+	TraceFraction                float64  `yaml:"trace_fraction" usage:"Fraction of requests to sample for tracing."`
+	TraceFractionOverrides       []string `yaml:"trace_fraction_overrides" usage:"Tracing fraction override based on name in format name=fraction."`
+	IgnoreForcedTracingHeader    bool     `yaml:"ignore_forced_tracing_header" usage:"If set, we will not honor the forced tracing header."`
+	MinBazelVersion              string   `yaml:"min_bazel_version" usage:"If set, requests from Bazel versions older than this are rejected."`
+	RecommendedBazelVersion      string   `yaml:"recommended_bazel_version" usage:"If set, invocations from Bazel versions older than this are shown a deprecation warning."`
+	MaxConcurrentBuildEvents     int      `yaml:"max_concurrent_build_events" usage:"If set, the app sheds load once this many build events are being handled at once: progress events are handled later, and new build event streams are rejected, anonymous ones first and CI ones last."`
+	InternalCallDeadlineFraction float64  `yaml:"internal_call_deadline_fraction" usage:"The fraction of a request's remaining time that the internal calls made to serve it (to the blobstore, database, and backing cache) may take, leaving the rest to handle their results. Defaults to 0.9."`
+	InvocationCheckpointInterval string   `yaml:"invocation_checkpoint_interval" usage:"How often the stored details and build events of an in-progress invocation, such as its duration so far and number of build events, are updated (default: '30s')."`
+	BuildEventWorkers            int      `yaml:"build_event_workers" usage:"If set, build events are handled by this many workers rather than on the streams that received them: events of different invocations are handled in parallel, and those of each invocation in order."`
+	BuildEventWorkerQueueSize    int      `yaml:"build_event_worker_queue_size" usage:"The number of build events queued up for each build event worker before the streams sending it more events wait. Defaults to 100."`
 }
 
 type buildEventProxy struct {
-	Hosts      []string `yaml:"hosts" usage:"The list of hosts to pass build events onto."`
-	BufferSize int      `yaml:"buffer_size" usage:"The number of build events to buffer locally when proxying build events."`
+	Hosts                  []string `yaml:"hosts" usage:"The list of hosts to pass build events onto."`
+	BufferSize             int      `yaml:"buffer_size" usage:"The number of build events to buffer locally when proxying build events."`
+	EnableGroupForwarding  bool     `yaml:"enable_group_forwarding" usage:"If true, organizations may forward their build event streams to a build event protocol server of their own, configured in their organization settings."`
+	AllowedForwardingHosts []string `yaml:"allowed_forwarding_hosts" usage:"If set, organizations may only forward their build event streams to these hosts, or, for entries such as '*.example.com', their subdomains. Otherwise, they may forward them to any host with a public address."`
 }
 
 type DatabaseConfig struct {
@@ -70,11 +87,87 @@ type DatabaseConfig struct {
 }
 
 type storageConfig struct {
-	Disk               DiskConfig  `yaml:"disk"`
-	GCS                GCSConfig   `yaml:"gcs"`
-	AwsS3              AwsS3Config `yaml:"aws_s3"`
-	TTLSeconds         int         `yaml:"ttl_seconds" usage:"The time, in seconds, to keep invocations before deletion"`
-	ChunkFileSizeBytes int         `yaml:"chunk_file_size_bytes" usage:"How many bytes to buffer in memory before flushing a chunk of build protocol data to disk."`
+	Disk                     DiskConfig               `yaml:"disk"`
+	GCS                      GCSConfig                `yaml:"gcs"`
+	AwsS3                    AwsS3Config              `yaml:"aws_s3"`
+	TTLSeconds               int                      `yaml:"ttl_seconds" usage:"The time, in seconds, to keep invocations before deletion"`
+	TagRetention             []TagRetentionConfig     `yaml:"tag_retention"`
+	GroupRetention           []GroupRetentionConfig   `yaml:"group_retention"`
+	TrashRetentionSeconds    int                      `yaml:"trash_retention_seconds" usage:"If set, invocations deleted by users are moved to the trash, where they can be restored for this many seconds before they are permanently deleted."`
+	Compression              string                   `yaml:"compression" usage:"How blobs are compressed when they're written: gzip, zstd, or none. Defaults to gzip. Blobs are read regardless of how they were compressed, so this can be changed at any time."`
+	ChunkFileSizeBytes       int                      `yaml:"chunk_file_size_bytes" usage:"How many bytes to buffer in memory before flushing a chunk of build protocol data to disk."`
+	InvocationCacheSizeBytes int64                    `yaml:"invocation_cache_size_bytes" usage:"How many bytes of parsed invocations to keep in memory. Set to 0 to disable the invocation cache."`
+	BackendID                string                   `yaml:"backend_id" usage:"An ID for the storage backend configured above, which is recorded on each invocation written to it. When switching to a new backend, give it a new ID and list the previous backend under additional_backends so that existing invocations can still be read."`
+	LegacyBackendID          string                   `yaml:"legacy_backend_id" usage:"The ID of the backend holding invocations that were written before backend IDs were recorded. Defaults to backend_id."`
+	BlobPathTemplate         string                   `yaml:"blob_path_template" usage:"The path under which each new invocation's blobs are stored. May contain {invocation_id} (required), {group_id}, and {date} (as YYYY-MM-DD). Defaults to {invocation_id}."`
+	AdditionalBackends       []BlobstoreBackendConfig `yaml:"additional_backends"`
+	MaxInvocationBytes       int64                    `yaml:"max_invocation_bytes" usage:"The maximum number of bytes of build events stored for each invocation. Once exceeded, only the events needed to show the invocation's summary are stored. 0 means no limit."`
+	MaxInvocationEvents      int64                    `yaml:"max_invocation_events" usage:"The maximum number of build events stored for each invocation. Once exceeded, only the events needed to show the invocation's summary are stored. 0 means no limit."`
+	MaxGroupDailyEventBytes  int64                    `yaml:"max_group_daily_event_bytes" usage:"The maximum number of bytes of build events that each group may upload per day (UTC). Once exceeded, the group's build event streams are rejected until the next day. Anonymous build events aren't limited. 0 means no limit."`
+	ArtifactIndexByReference bool                     `yaml:"artifact_index_by_reference" usage:"If true, the artifact indexes (named_set_of_files events) of new invocations are stored once in the cache, by digest, and invocations refer to them rather than storing copies. Indexes that the cache has evicted are lost unless a retention class keeps the artifact_index kind."`
+	GroupEventBytesWarning   float64                  `yaml:"group_event_bytes_warning_fraction" usage:"The fraction of max_group_daily_event_bytes at which groups are warned that they're approaching the limit, through the usage status API and usage_warning notifications. Defaults to 0.8. 1 disables warnings."`
+	WriteAheadLogDir         string                   `yaml:"write_ahead_log_dir" usage:"A local directory that blobs are written to when writing them to the storage backend fails. They're persisted to the backend once it recovers, so that builds keep succeeding during storage outages. If unset, failed writes fail the build event stream."`
+	ConsoleLogIndex          ConsoleLogIndexConfig    `yaml:"console_log_index"`
+	Reparse                  ReparseConfig            `yaml:"reparse"`
+	Archive                  ArchiveConfig            `yaml:"archive"`
+	Redaction                RedactionConfig          `yaml:"redaction"`
+}
+
+// RedactionConfig configures the redaction of secrets from build events before
+// they're stored, in addition to the well-known secrets that are always
+// redacted.
+type RedactionConfig struct {
+	Patterns       []string `yaml:"patterns" usage:"Regular expressions whose matches are replaced with <REDACTED> wherever they appear in build events, such as the format of an internal token."`
+	SensitiveFlags []string `yaml:"sensitive_flags" usage:"Bazel flags whose values are redacted from command lines, in addition to the header flags such as remote_header."`
+	AllowedEnvVars []string `yaml:"allowed_env_vars" usage:"Environment variables, workspace status keys and build metadata keys which are never redacted, even though their names look like they hold secrets. A trailing * matches any suffix."`
+}
+
+// ArchiveConfig configures the archiving of old invocations to a cheaper
+// storage backend, from which they're restored when they're looked up.
+type ArchiveConfig struct {
+	BackendID           string `yaml:"backend_id" usage:"The ID of the backend in additional_backends that old invocations are moved to, typically a bucket with a cold storage class. If unset, invocations are not archived."`
+	ArchiveAfterSeconds int64  `yaml:"archive_after_seconds" usage:"Invocations are archived once they were created, and last restored, at least this long ago. Defaults to 7776000 (90 days)."`
+	IntervalSeconds     int64  `yaml:"interval_seconds" usage:"How often to look for invocations to archive. Defaults to 600."`
+	BatchSize           int    `yaml:"batch_size" usage:"The maximum number of invocations archived by each app every interval. Defaults to 100."`
+}
+
+// ReparseConfig configures the background re-parsing of invocations that were
+// parsed by an older version of the event parser.
+type ReparseConfig struct {
+	Enabled         bool  `yaml:"enabled" usage:"If true, recent invocations that were parsed by an older version of the event parser are re-parsed from their stored events in the background, so that fields added to the parser are filled in for them."`
+	MaxAgeSeconds   int64 `yaml:"max_age_seconds" usage:"Only invocations created at most this long ago are re-parsed. Defaults to 604800 (7 days)."`
+	IntervalSeconds int64 `yaml:"interval_seconds" usage:"How often to look for invocations to re-parse. Defaults to 60."`
+	BatchSize       int   `yaml:"batch_size" usage:"The maximum number of invocations re-parsed by each app every interval. Defaults to 100."`
+}
+
+// ConsoleLogIndexConfig configures the index of console logs, which groups
+// can enable in their organization settings.
+type ConsoleLogIndexConfig struct {
+	RetentionDays         int64 `yaml:"retention_days" usage:"How many days the console log of each invocation stays searchable. Defaults to 7."`
+	MaxLinesPerInvocation int64 `yaml:"max_lines_per_invocation" usage:"The maximum number of lines indexed from each invocation's console log. Lines after that aren't searchable. Defaults to 10000."`
+}
+
+// TagRetentionConfig overrides how long invocations with a tag are kept.
+type TagRetentionConfig struct {
+	Tag        string `yaml:"tag" usage:"The tag that this retention rule applies to."`
+	TTLSeconds int    `yaml:"ttl_seconds" usage:"The time, in seconds, to keep invocations with the tag before deletion, instead of storage.ttl_seconds. 0 means that they are kept forever. If an invocation has several tags with retention rules, it is kept for the longest of their TTLs."`
+}
+
+// GroupRetentionConfig limits how much of a group's invocation history is
+// kept.
+type GroupRetentionConfig struct {
+	GroupID       string `yaml:"group_id" usage:"The group that this retention rule applies to."`
+	MaxAgeSeconds int64  `yaml:"max_age_seconds" usage:"The time, in seconds, after which the group's invocations are deleted, even if ttl_seconds or a tag_retention rule would keep them for longer. 0 means no limit."`
+	MaxTotalBytes int64  `yaml:"max_total_bytes" usage:"The maximum total size of the build events stored for the group's invocations. Once exceeded, its oldest invocations are deleted. 0 means no limit."`
+}
+
+// BlobstoreBackendConfig configures a storage backend which is only read
+// from, such as one which invocations are being migrated away from.
+type BlobstoreBackendConfig struct {
+	ID    string      `yaml:"id" usage:"The ID recorded on invocations written to this backend."`
+	Disk  DiskConfig  `yaml:"disk"`
+	GCS   GCSConfig   `yaml:"gcs"`
+	AwsS3 AwsS3Config `yaml:"aws_s3"`
 }
 
 type DiskConfig struct {
@@ -85,22 +178,163 @@ type GCSConfig struct {
 	Bucket          string `yaml:"bucket" usage:"The name of the GCS bucket to store build artifact files in."`
 	CredentialsFile string `yaml:"credentials_file" usage:"A path to a JSON credentials file that will be used to authenticate to GCS."`
 	ProjectID       string `yaml:"project_id" usage:"The Google Cloud project ID of the project owning the above credentials and GCS bucket."`
+	StorageClass    string `yaml:"storage_class" usage:"The storage class that blobs are written with, such as COLDLINE. Defaults to the bucket's default storage class."`
 }
 
 type AwsS3Config struct {
 	Region             string `yaml:"region" usage:"The AWS region."`
 	Bucket             string `yaml:"bucket" usage:"The AWS S3 bucket to store files in."`
 	CredentialsProfile string `yaml:"credentials_profile" usage:"A custom credentials profile to use."`
+	StorageClass       string `yaml:"storage_class" usage:"The storage class that blobs are written with, such as GLACIER_IR. Defaults to STANDARD."`
 }
 
 type integrationsConfig struct {
-	Slack SlackConfig `yaml:"slack"`
+	Slack         SlackConfig         `yaml:"slack"`
+	Notifications NotificationsConfig `yaml:"notifications"`
+	CIExport      CIExportConfig      `yaml:"ci_export"`
+	Promotion     PromotionConfig     `yaml:"promotion"`
 }
 
 type SlackConfig struct {
 	WebhookURL string `yaml:"webhook_url" usage:"A Slack webhook url to post build update messages to."`
 }
 
+// NotificationsConfig configures where notifications about completed
+// invocations are sent. Each rule selects the invocations it applies to and
+// the destinations they are sent to.
+type NotificationsConfig struct {
+	Destinations       []NotificationDestinationConfig `yaml:"destinations" usage:"The places notifications can be sent to."`
+	Rules              []NotificationRuleConfig        `yaml:"rules" usage:"Rules selecting which invocations are notified to which destinations."`
+	SMTP               SMTPConfig                      `yaml:"smtp" usage:"The mail server used to send email notifications."`
+	CacheHitRateAlarms CacheHitRateAlarmsConfig        `yaml:"cache_hit_rate_alarms"`
+	MaxAttempts        int                             `yaml:"max_attempts" usage:"The maximum number of times each notification is attempted, including the first attempt, while a destination fails with a retryable error, such as a network error or a 429 or 5xx response. Defaults to 4."`
+}
+
+// CacheHitRateAlarmsConfig configures alarms raised when the action cache hit
+// rate of an invocation drops well below the recent hit rate of its repo and
+// branch, which usually means that a change broke caching.
+type CacheHitRateAlarmsConfig struct {
+	Enabled               bool    `yaml:"enabled" usage:"If true, the rolling action cache hit rate of each repo and branch is tracked, and cache_hit_rate_drop notifications are sent when an invocation's hit rate drops below it."`
+	MinDrop               float64 `yaml:"min_drop" usage:"How far below the rolling hit rate an invocation's hit rate must be to raise an alarm, as a fraction. Defaults to 0.2, i.e. 20 percentage points."`
+	MinInvocations        int64   `yaml:"min_invocations" usage:"The number of invocations of a repo and branch that are tracked before alarms are raised for it. Defaults to 5."`
+	MinActionCacheLookups int64   `yaml:"min_action_cache_lookups" usage:"Invocations with fewer action cache lookups than this are ignored, since their hit rate is too noisy. Defaults to 100."`
+	Window                int64   `yaml:"window" usage:"The approximate number of recent invocations the rolling hit rate is averaged over. Defaults to 10."`
+}
+
+type NotificationDestinationConfig struct {
+	Name                string   `yaml:"name" usage:"The name rules use to refer to this destination."`
+	Type                string   `yaml:"type" usage:"The kind of destination: slack, webhook, email, or pagerduty."`
+	URL                 string   `yaml:"url" usage:"The URL to post to, for slack and webhook destinations. Overrides the PagerDuty Events API URL for pagerduty destinations."`
+	EmailAddresses      []string `yaml:"email_addresses" usage:"The addresses to send mail to, for email destinations."`
+	PagerDutyRoutingKey string   `yaml:"pagerduty_routing_key" usage:"The integration key of the PagerDuty service, for pagerduty destinations."`
+	Secret              string   `yaml:"secret" usage:"The name of a secret holding the url (slack, webhook) or routing key (pagerduty) of the destination, used instead of the url or pagerduty_routing_key. It's looked up in the secrets of the group whose invocation is notified. ** Enterprise only **"`
+	Fields              []string `yaml:"fields" usage:"If set, only these top-level fields of the JSON payload are posted, for webhook destinations."`
+}
+
+type NotificationRuleConfig struct {
+	Name                    string   `yaml:"name" usage:"The name of the rule."`
+	GroupIDs                []string `yaml:"group_ids" usage:"If set, only invocations from these groups match."`
+	RepoURLs                []string `yaml:"repo_urls" usage:"If set, only invocations of these repos match."`
+	Branches                []string `yaml:"branches" usage:"If set, only invocations of these branches, as set by the GIT_BRANCH build metadata, match."`
+	Statuses                []string `yaml:"statuses" usage:"If set, only invocations with these outcomes match: success or failure."`
+	Roles                   []string `yaml:"roles" usage:"If set, only invocations with these roles, as set by the ROLE build metadata, match, such as CI or CI_RUNNER. An empty role matches invocations without one, such as local builds."`
+	Tags                    []string `yaml:"tags" usage:"If set, only invocations with at least one of these tags match."`
+	Events                  []string `yaml:"events" usage:"The events that the rule notifies: invocation_complete, cache_hit_rate_drop, usage_warning, or any of them. Defaults to invocation_complete."`
+	Destinations            []string `yaml:"destinations" usage:"The names of the destinations matching invocations are sent to."`
+	MaxNotificationsPerHour int      `yaml:"max_notifications_per_hour" usage:"The maximum number of notifications this rule sends in an hour. Unlimited if 0."`
+}
+
+type SMTPConfig struct {
+	Address  string `yaml:"address" usage:"The host:port of the SMTP server."`
+	Username string `yaml:"username" usage:"The username to authenticate to the SMTP server with, if any."`
+	Password string `yaml:"password" usage:"The password to authenticate to the SMTP server with, if any."`
+	From     string `yaml:"from" usage:"The address email notifications are sent from."`
+}
+
+// CIExportConfig configures posting summaries of invocations back to the CI
+// builds that ran them. CI jobs identify their build with build metadata.
+type CIExportConfig struct {
+	Buildkite BuildkiteExportConfig `yaml:"buildkite"`
+	Jenkins   JenkinsExportConfig   `yaml:"jenkins"`
+}
+
+type BuildkiteExportConfig struct {
+	APIToken     string `yaml:"api_token" usage:"A Buildkite API access token with the write_builds scope, used to annotate builds."`
+	Organization string `yaml:"organization" usage:"The slug of the Buildkite organization whose builds are annotated. Builds of other organizations are ignored."`
+}
+
+type JenkinsExportConfig struct {
+	URL      string `yaml:"url" usage:"The base URL of the Jenkins server whose builds are described. Builds on other servers are ignored."`
+	User     string `yaml:"user" usage:"The Jenkins user to authenticate as."`
+	APIToken string `yaml:"api_token" usage:"An API token of the Jenkins user."`
+}
+
+// PromotionConfig configures pushing the outputs of release invocations to
+// external registries and buckets. Each rule selects the invocations it
+// applies to, and which of their outputs are pushed to which destinations.
+type PromotionConfig struct {
+	Destinations []PromotionDestinationConfig `yaml:"destinations" usage:"The registries and buckets artifacts can be promoted to. ** Enterprise only **"`
+	Rules        []PromotionRuleConfig        `yaml:"rules" usage:"Rules selecting which outputs of which invocations are promoted to which destinations. ** Enterprise only **"`
+}
+
+type PromotionDestinationConfig struct {
+	Name               string `yaml:"name" usage:"The name rules use to refer to this destination."`
+	Type               string `yaml:"type" usage:"The kind of destination: registry, s3, gcs, or artifactory."`
+	URL                string `yaml:"url" usage:"The image repository to push to, like registry.example.com/team/app, for registry destinations. The URL of the repository to upload to, for artifactory destinations."`
+	Bucket             string `yaml:"bucket" usage:"The bucket to upload to, for s3 and gcs destinations."`
+	PathPrefix         string `yaml:"path_prefix" usage:"The path files are uploaded under, for s3, gcs, and artifactory destinations. Files are uploaded to <path_prefix>/<version>/<file name>."`
+	Region             string `yaml:"region" usage:"The AWS region of the bucket, for s3 destinations."`
+	CredentialsProfile string `yaml:"credentials_profile" usage:"A custom AWS credentials profile to use, for s3 destinations."`
+	CredentialsFile    string `yaml:"credentials_file" usage:"A path to a JSON credentials file to authenticate with, for gcs destinations."`
+	Username           string `yaml:"username" usage:"The user to authenticate as, for registry and artifactory destinations."`
+	Password           string `yaml:"password" usage:"The password or access token to authenticate with, for registry and artifactory destinations."`
+}
+
+type PromotionRuleConfig struct {
+	Name      string                    `yaml:"name" usage:"The name of the rule."`
+	GroupIDs  []string                  `yaml:"group_ids" usage:"If set, only invocations from these groups match."`
+	Branches  []string                  `yaml:"branches" usage:"If set, only invocations of these branches, as set by the GIT_BRANCH build metadata, match."`
+	Tags      []string                  `yaml:"tags" usage:"Only successful invocations with at least one of these tags match. Defaults to release."`
+	Artifacts []PromotionArtifactConfig `yaml:"artifacts" usage:"The outputs promoted from matching invocations."`
+}
+
+type PromotionArtifactConfig struct {
+	Target      string `yaml:"target" usage:"The label of the target whose default outputs are promoted."`
+	Files       string `yaml:"files" usage:"If set, only the outputs whose file names match this glob pattern, like *.tar, are promoted."`
+	Destination string `yaml:"destination" usage:"The name of the destination the outputs are promoted to."`
+}
+
+// SecretsConfig configures how secrets, such as the credentials used by
+// integrations, are encrypted at rest. Exactly one of the master key and the
+// KMS-encrypted master key should be set.
+type SecretsConfig struct {
+	MasterKey string          `yaml:"master_key" usage:"The base64-encoded 32-byte AES key secrets are encrypted with. ** Enterprise only **"`
+	AWSKMS    AWSKMSKeyConfig `yaml:"aws_kms"`
+}
+
+// AccessLogConfig configures the recording of who viewed which invocations
+// and artifacts, for security review.
+type AccessLogConfig struct {
+	Enabled    bool    `yaml:"enabled" usage:"If true, views of invocations and downloads of their artifacts are recorded, and can be queried with the GetAccessLog API. ** Enterprise only **"`
+	SampleRate float64 `yaml:"sample_rate" usage:"The fraction of accesses that are recorded, between 0 and 1. Defaults to 1, which records every access. ** Enterprise only **"`
+}
+
+// ExportConfig configures the export of invocation records to files, for
+// bulk analysis.
+type ExportConfig struct {
+	Enabled       bool   `yaml:"enabled" usage:"If true, the records of invocations matching a search can be exported to CSV or Parquet files with the CreateExportJob API. ** Enterprise only **"`
+	URLSigningKey string `yaml:"url_signing_key" usage:"The secret that export download URLs are signed with. Must be the same for all apps. If unset, a random key is used, and download URLs only work on the app that created them. ** Enterprise only **"`
+	MaxRows       int64  `yaml:"max_rows" usage:"The most rows that a single export may contain. Defaults to 1,000,000. ** Enterprise only **"`
+}
+
+// AWSKMSKeyConfig configures a master key which is itself encrypted by AWS
+// KMS, and decrypted by KMS when the server starts.
+type AWSKMSKeyConfig struct {
+	Region             string `yaml:"region" usage:"The AWS region of the KMS key. ** Enterprise only **"`
+	EncryptedMasterKey string `yaml:"encrypted_master_key" usage:"The base64-encoded ciphertext of a 32-byte AES key, as returned by KMS Encrypt. ** Enterprise only **"`
+	CredentialsProfile string `yaml:"credentials_profile" usage:"A custom credentials profile to use. ** Enterprise only **"`
+}
+
 type GCSCacheConfig struct {
 	Bucket          string `yaml:"bucket" usage:"The name of the GCS bucket to store cache files in."`
 	CredentialsFile string `yaml:"credentials_file" usage:"A path to a JSON credentials file that will be used to authenticate to GCS."`
@@ -130,21 +364,68 @@ type RedisCacheConfig struct {
 }
 
 type cacheConfig struct {
-	Disk             DiskConfig             `yaml:"disk"`
-	RedisTarget      string                 `yaml:"redis_target" usage:"A redis target for improved Caching/RBE performance. Target can be provided as either a redis connection URI or a host:port pair. URI schemas supported: redis[s]://[[USER][:PASSWORD]@][HOST][:PORT][/DATABASE] or unix://[[USER][:PASSWORD]@]SOCKET_PATH[?db=DATABASE] ** Enterprise only **"`
-	S3               S3CacheConfig          `yaml:"s3"`
-	GCS              GCSCacheConfig         `yaml:"gcs"`
-	MemcacheTargets  []string               `yaml:"memcache_targets" usage:"Deprecated. Use Redis Target instead."`
-	Redis            RedisCacheConfig       `yaml:"redis"`
-	DistributedCache DistributedCacheConfig `yaml:"distributed_cache"`
-	MaxSizeBytes     int64                  `yaml:"max_size_bytes" usage:"How big to allow the cache to be (in bytes)."`
-	InMemory         bool                   `yaml:"in_memory" usage:"Whether or not to use the in_memory cache."`
+	Disk               DiskConfig             `yaml:"disk"`
+	RedisTarget        string                 `yaml:"redis_target" usage:"A redis target for improved Caching/RBE performance. Target can be provided as either a redis connection URI or a host:port pair. URI schemas supported: redis[s]://[[USER][:PASSWORD]@][HOST][:PORT][/DATABASE] or unix://[[USER][:PASSWORD]@]SOCKET_PATH[?db=DATABASE] ** Enterprise only **"`
+	S3                 S3CacheConfig          `yaml:"s3"`
+	GCS                GCSCacheConfig         `yaml:"gcs"`
+	MemcacheTargets    []string               `yaml:"memcache_targets" usage:"Deprecated. Use Redis Target instead."`
+	Redis              RedisCacheConfig       `yaml:"redis"`
+	DistributedCache   DistributedCacheConfig `yaml:"distributed_cache"`
+	MaxSizeBytes       int64                  `yaml:"max_size_bytes" usage:"How big to allow the cache to be (in bytes)."`
+	ReadChunkSizeBytes int64                  `yaml:"read_chunk_size_bytes" usage:"The size of each chunk streamed back to bytestream readers [bytes]. Must be less than the client's max receive message size."`
+	InMemory           bool                   `yaml:"in_memory" usage:"Whether or not to use the in_memory cache."`
+	Routes             []CacheRouteConfig     `yaml:"routes"`
+
+	ActionResultVerificationKeyFiles []string `yaml:"action_result_verification_key_files" usage:"Paths to PEM-encoded Ed25519 public keys of the executors whose action result signatures are trusted. If set, action results returned by the action cache report whether they were signed by a trusted executor."`
+	SharedReadMinSizeBytes           int64    `yaml:"shared_read_min_size_bytes" usage:"Concurrent bytestream reads of the same blob that are at least this large share a single read from the backing cache, buffered in a temporary file. Defaults to 16MB. Set to a negative value to disable."`
+
+	RetentionClasses []RetentionClassConfig `yaml:"retention_classes"`
+	DeltaUploads     DeltaUploadsConfig     `yaml:"delta_uploads"`
+	DigestMigration  DigestMigrationConfig  `yaml:"digest_migration"`
+}
+
+// DigestMigrationConfig copies the blobs of the CAS that are in use from their
+// SHA256 digests to their BLAKE3 digests, while clients switch from SHA256 to
+// BLAKE3.
+type DigestMigrationConfig struct {
+	Enabled   bool `yaml:"enabled" usage:"If true, SHA256 blobs that are written to or read from the CAS are re-hashed in the background and also stored under their BLAKE3 digests, so that clients switching to BLAKE3 find the blobs that are in use."`
+	QueueSize int  `yaml:"queue_size" usage:"The maximum number of blobs waiting to be copied. Blobs that are used while the queue is full are not copied until they are used again. Defaults to 10000."`
+	Workers   int  `yaml:"workers" usage:"The number of blobs copied concurrently. Defaults to 4."`
+}
+
+// DeltaUploadsConfig lets clients upload large blobs that change slightly
+// between builds as the differences from a blob already in the cache.
+type DeltaUploadsConfig struct {
+	Enabled          bool  `yaml:"enabled" usage:"If true, clients may upload blobs as a delta against a blob that is already in the CAS. The server advertises this in its cache capabilities, and reconstructs the blobs when they are read."`
+	MinBlobSizeBytes int64 `yaml:"min_blob_size_bytes" usage:"Blobs smaller than this may not be uploaded as deltas. Defaults to 1MB."`
+	MaxBlobSizeBytes int64 `yaml:"max_blob_size_bytes" usage:"Blobs larger than this may not be uploaded as deltas. Blobs are reconstructed in memory when read, so this bounds the memory used by each read. Defaults to 128MB."`
+	MaxChainLength   int   `yaml:"max_chain_length" usage:"The maximum number of deltas that may be applied to reconstruct a blob, counting deltas whose base is itself stored as a delta. Uploads that would exceed it are rejected, so that clients upload the full blob. Defaults to 4."`
+}
+
+// RetentionClassConfig keeps copies of blobs that are valuable for debugging,
+// such as action logs, separately from the cache, so that they are not
+// evicted along with ordinary outputs.
+type RetentionClassConfig struct {
+	Name          string   `yaml:"name" usage:"The name of the retention class."`
+	Kinds         []string `yaml:"kinds" usage:"The kinds of blobs kept in this class. Any of {'stdout', 'stderr', 'timing_profile', 'promoted', 'artifact_index'}"`
+	MaxSizeBytes  int64    `yaml:"max_size_bytes" usage:"How big to allow this class to be (in bytes). Once full, its least recently used blobs are evicted."`
+	RootDirectory string   `yaml:"root_directory" usage:"The directory to store this class's blobs in. It must not be inside the cache's root directory. If unset, they are kept in memory."`
+}
+
+// CacheRouteConfig directs cache traffic for a remote instance name and/or
+// group to one of the configured backing caches. Routes are matched in order
+// and traffic that matches no route goes to the default cache.
+type CacheRouteConfig struct {
+	InstanceName string `yaml:"instance_name" usage:"The remote instance name to match. If empty, all instance names match."`
+	GroupID      string `yaml:"group_id" usage:"The group ID to match. If empty, all groups match."`
+	Backend      string `yaml:"backend" usage:"The backing cache that matching traffic is routed to. One of {'local', 'gcs', 's3'}"`
 }
 
 type authConfig struct {
 	JWTKey               string          `yaml:"jwt_key" usage:"The key to use when signing JWT tokens."`
 	APIKeyGroupCacheTTL  string          `yaml:"api_key_group_cache_ttl" usage:"Override for the TTL for API Key to Group caching. Set to '0' to disable cache."`
 	OauthProviders       []OauthProvider `yaml:"oauth_providers"`
+	LDAPProviders        []LDAPProvider  `yaml:"ldap_providers"`
 	EnableAnonymousUsage bool            `yaml:"enable_anonymous_usage" usage:"If true, unauthenticated build uploads will still be allowed but won't be associated with your organization."`
 }
 
@@ -154,6 +435,25 @@ type OauthProvider struct {
 	ClientSecret string `yaml:"client_secret" usage:"The oauth client secret."`
 }
 
+type LDAPProvider struct {
+	URL               string             `yaml:"url" usage:"The URL of the LDAP server. Ex: ldaps://ldap.example.com"`
+	BindDN            string             `yaml:"bind_dn" usage:"The DN of the account used to search for users. If empty, users are searched for anonymously."`
+	BindPassword      string             `yaml:"bind_password" usage:"The password of the account used to search for users."`
+	BaseDN            string             `yaml:"base_dn" usage:"The DN of the subtree that users are searched for in. Ex: ou=people,dc=example,dc=com"`
+	UserFilter        string             `yaml:"user_filter" usage:"A filter that users must match to log in, in addition to their username. Ex: (objectClass=person)"`
+	UsernameAttribute string             `yaml:"username_attribute" usage:"The attribute that users log in with. Defaults to uid; use sAMAccountName for Active Directory."`
+	EmailAttribute    string             `yaml:"email_attribute" usage:"The attribute containing users' email addresses. Defaults to mail."`
+	GroupAttribute    string             `yaml:"group_attribute" usage:"The attribute listing the DNs of the LDAP groups that users are members of. Defaults to memberOf."`
+	GroupMappings     []LDAPGroupMapping `yaml:"group_mappings"`
+	CACertFile        string             `yaml:"ca_cert_file" usage:"Path to a PEM encoded file of the certificate authorities that the LDAP server's certificate is verified with. If empty, the system's certificate authorities are used."`
+	StartTLS          bool               `yaml:"start_tls" usage:"If true, connections to ldap:// URLs are upgraded to TLS with StartTLS before binding."`
+}
+
+type LDAPGroupMapping struct {
+	LDAPGroup string `yaml:"ldap_group" usage:"The DN of an LDAP group. Ex: cn=engineering,ou=groups,dc=example,dc=com"`
+	GroupID   string `yaml:"group_id" usage:"The ID of the BuildBuddy organization that members of the LDAP group are added to, and non-members are removed from."`
+}
+
 type SSLConfig struct {
 	CertFile         string   `yaml:"cert_file" usage:"Path to a PEM encoded certificate file to use for TLS if not using ACME."`
 	KeyFile          string   `yaml:"key_file" usage:"Path to a PEM encoded key file to use for TLS if not using ACME."`
@@ -167,36 +467,90 @@ type SSLConfig struct {
 }
 
 type RemoteExecutionConfig struct {
-	DefaultPoolName               string `yaml:"default_pool_name" usage:"The default executor pool to use if one is not specified."`
-	EnableWorkflows               bool   `yaml:"enable_workflows" usage:"Whether to enable BuildBuddy workflows."`
-	WorkflowsPoolName             string `yaml:"workflows_pool_name" usage:"The executor pool to use for workflow actions. Defaults to the default executor pool if not specified."`
-	WorkflowsDefaultImage         string `yaml:"workflows_default_image" usage:"The default docker image to use for running workflows."`
-	WorkflowsCIRunnerDebug        bool   `yaml:"workflows_ci_runner_debug" usage:"Whether to run the CI runner in debug mode."`
-	WorkflowsCIRunnerBazelCommand string `yaml:"workflows_ci_runner_bazel_command" usage:"Bazel command to be used by the CI runner."`
-	RedisTarget                   string `yaml:"redis_target" usage:"A Redis target for storing remote execution state. Required for remote execution. To ease migration, the redis target from the cache config will be used if this value is not specified."`
-	SharedExecutorPoolGroupID     string `yaml:"shared_executor_pool_group_id" usage:"Group ID that owns the shared executor pool."`
-	RedisPubSubPoolSize           int    `yaml:"redis_pubsub_pool_size" usage:"Maximum number of connections used for waiting for execution updates."`
-	EnableRemoteExec              bool   `yaml:"enable_remote_exec" usage:"If true, enable remote-exec. ** Enterprise only **"`
-	RequireExecutorAuthorization  bool   `yaml:"require_executor_authorization" usage:"If true, executors connecting to this server must provide a valid executor API key."`
-	EnableUserOwnedExecutors      bool   `yaml:"enable_user_owned_executors" usage:"If enabled, users can register their own executors with the scheduler."`
-	EnableExecutorKeyCreation     bool   `yaml:"enable_executor_key_creation" usage:"If enabled, UI will allow executor keys to be created."`
+	DefaultPoolName               string                   `yaml:"default_pool_name" usage:"The default executor pool to use if one is not specified."`
+	EnableWorkflows               bool                     `yaml:"enable_workflows" usage:"Whether to enable BuildBuddy workflows."`
+	WorkflowsPoolName             string                   `yaml:"workflows_pool_name" usage:"The executor pool to use for workflow actions. Defaults to the default executor pool if not specified."`
+	WorkflowsDefaultImage         string                   `yaml:"workflows_default_image" usage:"The default docker image to use for running workflows."`
+	WorkflowsCIRunnerDebug        bool                     `yaml:"workflows_ci_runner_debug" usage:"Whether to run the CI runner in debug mode."`
+	WorkflowsCIRunnerBazelCommand string                   `yaml:"workflows_ci_runner_bazel_command" usage:"Bazel command to be used by the CI runner."`
+	RedisTarget                   string                   `yaml:"redis_target" usage:"A Redis target for storing remote execution state. Required for remote execution. To ease migration, the redis target from the cache config will be used if this value is not specified."`
+	SharedExecutorPoolGroupID     string                   `yaml:"shared_executor_pool_group_id" usage:"Group ID that owns the shared executor pool."`
+	RedisPubSubPoolSize           int                      `yaml:"redis_pubsub_pool_size" usage:"Maximum number of connections used for waiting for execution updates."`
+	EnableRemoteExec              bool                     `yaml:"enable_remote_exec" usage:"If true, enable remote-exec. ** Enterprise only **"`
+	RequireExecutorAuthorization  bool                     `yaml:"require_executor_authorization" usage:"If true, executors connecting to this server must provide a valid executor API key."`
+	EnableUserOwnedExecutors      bool                     `yaml:"enable_user_owned_executors" usage:"If enabled, users can register their own executors with the scheduler."`
+	EnableExecutorKeyCreation     bool                     `yaml:"enable_executor_key_creation" usage:"If enabled, UI will allow executor keys to be created."`
+	AffinityRouting               []AffinityRoutingConfig  `yaml:"affinity_routing"`
+	EnvNormalization              []EnvNormalizationConfig `yaml:"env_normalization"`
+	MaxQueueDurationSeconds       int64                    `yaml:"max_queue_duration_seconds" usage:"If set, tasks that aren't picked up by an executor within this many seconds of being queued are failed with a ResourceExhausted error."`
+	QueueTimeouts                 []QueueTimeoutConfig     `yaml:"queue_timeouts"`
+	MaxActionTimeoutSeconds       int64                    `yaml:"max_action_timeout_seconds" usage:"If set, Execute requests for actions with a timeout longer than this many seconds are rejected with an InvalidArgument error."`
+	StaleExecutionTimeoutSeconds  int64                    `yaml:"stale_execution_timeout_seconds" usage:"If set, executions that haven't completed or reported progress for this many seconds are failed, so that clients waiting on them don't wait forever. Should be longer than the maximum queue duration."`
+	CacheWarming                  CacheWarmingConfig       `yaml:"cache_warming"`
+	SnapshotHostHashKey           string                   `yaml:"snapshot_host_hash_key" usage:"The secret that executor hosts are hashed with in scheduler snapshots, so that hosts can be told apart without being revealed. Should be the same for all apps, so that snapshots taken on different apps can be compared. If unset, a random key is used. ** Enterprise only **"`
+	SchedulerConnectionPoolSize   int                      `yaml:"scheduler_connection_pool_size" usage:"The number of connections to open to each other app when forwarding scheduling requests to it. Defaults to 1. ** Enterprise only **"`
+}
+
+// CacheWarmingConfig configures the job which warms the action cache of groups
+// that enabled cache warming, by re-running the actions that most often
+// missed the cache recently. Actions are re-run only if their results are no
+// longer cached, for example because they were evicted.
+type CacheWarmingConfig struct {
+	Schedule           string `yaml:"schedule" usage:"A cron schedule (in UTC) for warming the cache, e.g. '0 4 * * *' for every day at 4:00. Should be during off-peak hours. Cache warming is disabled if empty."`
+	LookbackHours      int64  `yaml:"lookback_hours" usage:"How many hours of recent executions to analyze when picking the actions to re-run. Defaults to 24."`
+	MaxActionsPerGroup int    `yaml:"max_actions_per_group" usage:"The maximum number of actions re-run for each group per cache warming run. Defaults to 100."`
+}
+
+// QueueTimeoutConfig overrides the maximum queue duration for tasks in a
+// particular group and/or executor pool. The most specific matching override
+// applies: one matching both the group and the pool, then the group, then the
+// pool.
+type QueueTimeoutConfig struct {
+	GroupID                 string `yaml:"group_id" usage:"The group whose tasks this override applies to. Empty for all groups."`
+	Pool                    string `yaml:"pool" usage:"The executor pool whose tasks this override applies to. Empty for all pools."`
+	MaxQueueDurationSeconds int64  `yaml:"max_queue_duration_seconds" usage:"The maximum number of seconds that matching tasks may be queued for. 0 disables the queue timeout for matching tasks."`
+}
+
+// AffinityRoutingConfig configures the task router to prefer executors that
+// previously ran tasks sharing the same affinity key within a pool, so that
+// repeated builds land on executors with warm caches and live workers.
+type AffinityRoutingConfig struct {
+	Pool               string `yaml:"pool" usage:"The executor pool to apply affinity routing to. Empty for the default pool."`
+	Key                string `yaml:"key" usage:"The task property to route by. One of {'target_label', 'persistent_worker_key'}"`
+	PreferredNodeLimit int    `yaml:"preferred_node_limit" usage:"The max number of executors remembered and preferred for each key value. Defaults to 1."`
+}
+
+type EnvNormalizationConfig struct {
+	Name   string `yaml:"name" usage:"The name of the environment variable to normalize. A trailing '*' matches any variable with the preceding prefix."`
+	Action string `yaml:"action" usage:"What to do with matching variables when looking up cached results. One of {'strip', 'replace'}"`
+	Value  string `yaml:"value" usage:"The value to replace matching variables with, if action is 'replace'."`
 }
 
 type ExecutorConfig struct {
-	AppTarget               string           `yaml:"app_target" usage:"The GRPC url of a buildbuddy app server."`
-	RootDirectory           string           `yaml:"root_directory" usage:"The root directory to use for build files."`
-	LocalCacheDirectory     string           `yaml:"local_cache_directory" usage:"A local on-disk cache directory. Must be on the same device (disk partition, Docker volume, etc.) as the configured root_directory, since files are hard-linked to this cache for performance reasons. Otherwise, 'Invalid cross-device link' errors may result."`
-	LocalCacheSizeBytes     int64            `yaml:"local_cache_size_bytes" usage:"The maximum size, in bytes, to use for the local on-disk cache"`
-	DisableLocalCache       bool             `yaml:"disable_local_cache" usage:"If true, a local file cache will not be used."`
-	DockerSocket            string           `yaml:"docker_socket" usage:"If set, run execution commands in docker using the provided socket."`
-	APIKey                  string           `yaml:"api_key" usage:"API Key used to authorize the executor with the BuildBuddy app server."`
-	ContainerdSocket        string           `yaml:"containerd_socket" usage:"(UNSTABLE) If set, run execution commands in containerd using the provided socket."`
-	DockerMountMode         string           `yaml:"docker_mount_mode" usage:"Sets the mount mode of volumes mounted to docker images. Useful if running on SELinux https://www.projectatomic.io/blog/2015/06/using-volumes-with-docker-can-cause-problems-with-selinux/"`
-	RunnerPool              RunnerPoolConfig `yaml:"runner_pool"`
-	DockerNetHost           bool             `yaml:"docker_net_host" usage:"Sets --net=host on the docker command. Intended for local development only."`
-	DisableWorkStreaming    bool             `yaml:"disable_work_streaming" usage:"If true, revert to the older non-streaming API for receiving work."`
-	DockerSiblingContainers bool             `yaml:"docker_sibling_containers" usage:"If set, mount the configured Docker socket to containers spawned for each action, to enable Docker-out-of-Docker (DooD). Takes effect only if docker_socket is also set. Should not be set by executors that can run untrusted code."`
-	DefaultXCodeVersion     string           `yaml:"default_xcode_version" usage:"Sets the default XCode version number to use if an action doesn't specify one. If not set, /Applications/Xcode.app/ is used."`
+	AppTarget                    string                 `yaml:"app_target" usage:"The GRPC url of a buildbuddy app server."`
+	RootDirectory                string                 `yaml:"root_directory" usage:"The root directory to use for build files."`
+	LocalCacheDirectory          string                 `yaml:"local_cache_directory" usage:"A local on-disk cache directory. Must be on the same device (disk partition, Docker volume, etc.) as the configured root_directory, since files are hard-linked to this cache for performance reasons. Otherwise, 'Invalid cross-device link' errors may result."`
+	LocalCacheSizeBytes          int64                  `yaml:"local_cache_size_bytes" usage:"The maximum size, in bytes, to use for the local on-disk cache"`
+	DisableLocalCache            bool                   `yaml:"disable_local_cache" usage:"If true, a local file cache will not be used."`
+	DockerSocket                 string                 `yaml:"docker_socket" usage:"If set, run execution commands in docker using the provided socket."`
+	APIKey                       string                 `yaml:"api_key" usage:"API Key used to authorize the executor with the BuildBuddy app server."`
+	ContainerdSocket             string                 `yaml:"containerd_socket" usage:"(UNSTABLE) If set, run execution commands in containerd using the provided socket."`
+	DockerMountMode              string                 `yaml:"docker_mount_mode" usage:"Sets the mount mode of volumes mounted to docker images. Useful if running on SELinux https://www.projectatomic.io/blog/2015/06/using-volumes-with-docker-can-cause-problems-with-selinux/"`
+	RunnerPool                   RunnerPoolConfig       `yaml:"runner_pool"`
+	DockerNetHost                bool                   `yaml:"docker_net_host" usage:"Sets --net=host on the docker command. Intended for local development only."`
+	DisableWorkStreaming         bool                   `yaml:"disable_work_streaming" usage:"If true, revert to the older non-streaming API for receiving work."`
+	DockerSiblingContainers      bool                   `yaml:"docker_sibling_containers" usage:"If set, mount the configured Docker socket to containers spawned for each action, to enable Docker-out-of-Docker (DooD). Takes effect only if docker_socket is also set. Should not be set by executors that can run untrusted code."`
+	DefaultXCodeVersion          string                 `yaml:"default_xcode_version" usage:"Sets the default XCode version number to use if an action doesn't specify one. If not set, /Applications/Xcode.app/ is used."`
+	Janitor                      JanitorConfig          `yaml:"janitor"`
+	DisableStartupBenchmark      bool                   `yaml:"disable_startup_benchmark" usage:"If true, skip benchmarking the executor's CPU, disk, and cache connection at startup. Benchmark results let the scheduler prefer faster executors for heavy actions."`
+	ActionResultSigningKeyFile   string                 `yaml:"action_result_signing_key_file" usage:"Path to a PEM-encoded Ed25519 private key with which to sign the action results produced by this executor, so that the action cache can tell them apart from results uploaded by clients."`
+	MaxCASUploadBytesPerSecond   int64                  `yaml:"max_cas_upload_bytes_per_second" usage:"If set, limits how fast this executor uploads action outputs to the CAS, in bytes per second."`
+	MaxCASDownloadBytesPerSecond int64                  `yaml:"max_cas_download_bytes_per_second" usage:"If set, limits how fast this executor downloads action inputs from the CAS, in bytes per second."`
+	FallbackCacheTargets         []string               `yaml:"fallback_cache_targets" usage:"The GRPC urls of caches, such as in other regions, to read from when the app target's cache is unavailable. Tried in order. Uploads always go to the app target."`
+	AppConnectionPoolSize        int                    `yaml:"app_connection_pool_size" usage:"The number of connections to open to the app target for scheduling and other non-cache RPCs. Defaults to 1."`
+	CacheConnectionPoolSize      int                    `yaml:"cache_connection_pool_size" usage:"The number of connections to open to each cache target, including fallback caches. RPCs are spread across them, so that large transfers don't hold up others sharing a connection. Defaults to 1."`
+	LocalActionCache             LocalActionCacheConfig `yaml:"local_action_cache"`
+	CrashDumps                   CrashDumpConfig        `yaml:"crash_dumps"`
 }
 
 func (c *ExecutorConfig) GetAppTarget() string {
@@ -239,17 +593,64 @@ type RunnerPoolConfig struct {
 	MaxRunnerMemoryUsageBytes int64 `yaml:"max_runner_memory_usage_bytes" usage:"Maximum memory usage for a recycled runner; runners exceeding this threshold are not recycled. Defaults to 1/10 of total RAM allocated to the executor. (Only supported for Docker-based executors)."`
 }
 
+type LocalActionCacheConfig struct {
+	Enabled         bool   `yaml:"enabled" usage:"If true, successful action results are cached on the executor, and looked up there before the central action cache. Reduces the load on the action cache from actions that are executed over and over, such as repeated test runs."`
+	MaxSizeBytes    int64  `yaml:"max_size_bytes" usage:"The maximum size of the cached action results, in bytes. Defaults to 100MB."`
+	Directory       string `yaml:"directory" usage:"If set, cached action results are stored in this directory, so that they survive executor restarts. Otherwise, they are kept in memory."`
+	TTLSeconds      int    `yaml:"ttl_seconds" usage:"How long a cached action result is used before it is looked up in the central action cache again. Defaults to 300 (5 minutes)."`
+	ValidateOutputs bool   `yaml:"validate_outputs" usage:"If true, a cached action result is only used if all of its outputs are still in the CAS, which costs a FindMissingBlobs call per hit."`
+}
+
+type CrashDumpConfig struct {
+	Enabled                bool  `yaml:"enabled" usage:"If true, debugging information is captured when an action crashes (is killed by a signal such as SIGSEGV, or by the OOM killer), uploaded to the CAS, and referenced from the execution."`
+	DmesgLines             int   `yaml:"dmesg_lines" usage:"The maximum number of kernel log lines mentioning the crash to capture from dmesg. Defaults to 50."`
+	MaxLogBytes            int64 `yaml:"max_log_bytes" usage:"The maximum number of bytes from the end of the crashed action's stdout and stderr (each) to capture. Defaults to 64KB."`
+	MaxCoreDumpUploadBytes int64 `yaml:"max_core_dump_upload_bytes" usage:"Core dumps up to this size are uploaded to the CAS. Larger core dumps are only described by their path and size. Defaults to 0 (no core dumps are uploaded)."`
+}
+
+type JanitorConfig struct {
+	Disable             bool `yaml:"disable" usage:"If true, workspaces, containers, and mounts left behind by crashed tasks are not cleaned up while the executor is running."`
+	IntervalSeconds     int  `yaml:"interval_seconds" usage:"How often to look for orphaned workspaces, containers, and mounts. Defaults to 600 (10 minutes)."`
+	MinOrphanAgeSeconds int  `yaml:"min_orphan_age_seconds" usage:"How long a workspace, container, or mount must have been unused by any task before it is cleaned up. Defaults to 3600 (1 hour)."`
+}
+
 type APIConfig struct {
 	APIKey    string `yaml:"api_key" usage:"The default API key to use for on-prem enterprise deploys with a single organization/group."`
 	EnableAPI bool   `yaml:"enable_api" usage:"Whether or not to enable the BuildBuddy API."`
 }
 
+type MonitoringConfig struct {
+	PushGatewayURL             string   `yaml:"push_gateway_url" usage:"If set, metrics are periodically pushed to the Prometheus Pushgateway at this URL, for deployments that can't be scraped. Ex: 'http://pushgateway.example.com:9091'"`
+	PushIntervalSeconds        int      `yaml:"push_interval_seconds" usage:"How often to push metrics to the Pushgateway. Defaults to 15."`
+	PushJobName                string   `yaml:"push_job_name" usage:"The job name that pushed metrics are grouped under. Defaults to 'buildbuddy' for apps and 'buildbuddy-executor' for executors."`
+	PushLabels                 []string `yaml:"push_labels" usage:"Additional labels that pushed metrics are grouped under, in the format name=value. Unless an 'instance' label is given, the hostname is used as the instance."`
+	PushBasicAuthUsername      string   `yaml:"push_basic_auth_username" usage:"The username used to authenticate with the Pushgateway, if it requires basic auth."`
+	PushBasicAuthPassword      string   `yaml:"push_basic_auth_password" usage:"The password used to authenticate with the Pushgateway, if it requires basic auth."`
+	StatsDAddress              string   `yaml:"statsd_address" usage:"If set, metrics are periodically sent to the StatsD or DogStatsD agent listening for UDP packets at this address. Ex: 'localhost:8125'"`
+	StatsDFlushIntervalSeconds int      `yaml:"statsd_flush_interval_seconds" usage:"How often to send metrics to the StatsD agent. Defaults to 10."`
+	StatsDPrefix               string   `yaml:"statsd_prefix" usage:"A prefix added to the names of metrics sent to the StatsD agent. Ex: 'onprem.'"`
+	StatsDDogStatsD            bool     `yaml:"statsd_dogstatsd" usage:"If true, metric labels are sent to the StatsD agent as DogStatsD tags. Otherwise, label values are appended to metric names."`
+	StatsDTags                 []string `yaml:"statsd_tags" usage:"Tags added to all metrics sent to the StatsD agent, in the format name:value. Requires statsd_dogstatsd."`
+}
+
 type GithubConfig struct {
-	ClientID            string `yaml:"client_id" usage:"The client ID of your GitHub Oauth App. ** Enterprise only **"`
-	ClientSecret        string `yaml:"client_secret" usage:"The client secret of your GitHub Oauth App. ** Enterprise only **"`
-	AccessToken         string `yaml:"access_token" usage:"The GitHub access token used to post GitHub commit statuses. ** Enterprise only **"`
-	StatusNameSuffix    string `yaml:"status_name_suffix" usage:"Suffix to be appended to all reported GitHub status names. Useful for differentiating BuildBuddy deployments. For example: '(dev)' ** Enterprise only **"`
-	StatusPerTestTarget bool   `yaml:"status_per_test_target" usage:"If true, report status per test target. ** Enterprise only **"`
+	ClientID            string          `yaml:"client_id" usage:"The client ID of your GitHub Oauth App. ** Enterprise only **"`
+	ClientSecret        string          `yaml:"client_secret" usage:"The client secret of your GitHub Oauth App. ** Enterprise only **"`
+	AccessToken         string          `yaml:"access_token" usage:"The GitHub access token used to post GitHub commit statuses. ** Enterprise only **"`
+	StatusNameSuffix    string          `yaml:"status_name_suffix" usage:"Suffix to be appended to all reported GitHub status names. Useful for differentiating BuildBuddy deployments. For example: '(dev)' ** Enterprise only **"`
+	StatusPerTestTarget bool            `yaml:"status_per_test_target" usage:"If true, report status per test target. ** Enterprise only **"`
+	App                 GithubAppConfig `yaml:"app"`
+}
+
+// GithubAppConfig configures a GitHub App, which workflows and status reporting
+// authenticate as instead of with long-lived user tokens.
+type GithubAppConfig struct {
+	ID            int64  `yaml:"id" usage:"The ID of your GitHub App. ** Enterprise only **"`
+	PrivateKey    string `yaml:"private_key" usage:"The PEM-encoded private key of your GitHub App. ** Enterprise only **"`
+	WebhookSecret string `yaml:"webhook_secret" usage:"The secret that GitHub signs your GitHub App's webhook deliveries with. ** Enterprise only **"`
+	Slug          string `yaml:"slug" usage:"The URL-friendly name of your GitHub App, as in https://github.com/apps/<slug>. ** Enterprise only **"`
+	ClientID      string `yaml:"client_id" usage:"The client ID of your GitHub App, which users authorize to link its installations to their organization. ** Enterprise only **"`
+	ClientSecret  string `yaml:"client_secret" usage:"The client secret of your GitHub App. ** Enterprise only **"`
 }
 
 type OrgConfig struct {
@@ -311,7 +712,7 @@ func defineFlagsForMembers(parentStructNames []string, T reflect.Value) {
 		default:
 			// We know this is not flag compatible and it's here for
 			// long-term support reasons, so don't warn about it.
-			if fqFieldName != "auth.oauth_providers" {
+			if fqFieldName != "auth.oauth_providers" && fqFieldName != "auth.ldap_providers" && fqFieldName != "remote_execution.affinity_routing" && fqFieldName != "remote_execution.env_normalization" && fqFieldName != "cache.routes" && fqFieldName != "storage.additional_backends" && fqFieldName != "remote_execution.queue_timeouts" && fqFieldName != "storage.tag_retention" && fqFieldName != "storage.group_retention" && fqFieldName != "integrations.notifications.destinations" && fqFieldName != "integrations.notifications.rules" && fqFieldName != "cache.retention_classes" {
 				log.Printf("Skipping flag: --%s, kind: %s", fqFieldName, f.Type().Kind())
 			}
 			continue
@@ -375,10 +776,42 @@ func (c *Configurator) GetStorageTTLSeconds() int {
 	return c.gc.Storage.TTLSeconds
 }
 
+func (c *Configurator) GetStorageTagRetention() []TagRetentionConfig {
+	return c.gc.Storage.TagRetention
+}
+
+func (c *Configurator) GetStorageGroupRetention() []GroupRetentionConfig {
+	return c.gc.Storage.GroupRetention
+}
+
+func (c *Configurator) GetStorageTrashRetentionSeconds() int {
+	return c.gc.Storage.TrashRetentionSeconds
+}
+
+func (c *Configurator) GetStorageReparseConfig() *ReparseConfig {
+	return &c.gc.Storage.Reparse
+}
+
+func (c *Configurator) GetStorageRedactionConfig() *RedactionConfig {
+	return &c.gc.Storage.Redaction
+}
+
+func (c *Configurator) GetStorageArchiveConfig() *ArchiveConfig {
+	return &c.gc.Storage.Archive
+}
+
+func (c *Configurator) GetStorageInvocationCacheSizeBytes() int64 {
+	return c.gc.Storage.InvocationCacheSizeBytes
+}
+
 func (c *Configurator) GetStorageChunkFileSizeBytes() int {
 	return c.gc.Storage.ChunkFileSizeBytes
 }
 
+func (c *Configurator) GetStorageCompression() string {
+	return c.gc.Storage.Compression
+}
+
 func (c *Configurator) GetStorageDiskRootDir() string {
 	return c.gc.Storage.Disk.RootDirectory
 }
@@ -391,6 +824,53 @@ func (c *Configurator) GetStorageAWSS3Config() *AwsS3Config {
 	return &c.gc.Storage.AwsS3
 }
 
+func (c *Configurator) GetStorageBackendID() string {
+	return c.gc.Storage.BackendID
+}
+
+func (c *Configurator) GetStorageLegacyBackendID() string {
+	return c.gc.Storage.LegacyBackendID
+}
+
+func (c *Configurator) GetStorageBlobPathTemplate() string {
+	return c.gc.Storage.BlobPathTemplate
+}
+
+func (c *Configurator) GetStorageAdditionalBackends() []BlobstoreBackendConfig {
+	return c.gc.Storage.AdditionalBackends
+}
+
+func (c *Configurator) GetStorageMaxInvocationBytes() int64 {
+	return c.gc.Storage.MaxInvocationBytes
+}
+
+func (c *Configurator) GetStorageMaxInvocationEvents() int64 {
+	return c.gc.Storage.MaxInvocationEvents
+}
+
+func (c *Configurator) GetStorageConsoleLogIndexConfig() *ConsoleLogIndexConfig {
+	return &c.gc.Storage.ConsoleLogIndex
+}
+
+func (c *Configurator) GetStorageMaxGroupDailyEventBytes() int64 {
+	return c.gc.Storage.MaxGroupDailyEventBytes
+}
+
+func (c *Configurator) GetStorageGroupEventBytesWarningFraction() float64 {
+	if f := c.gc.Storage.GroupEventBytesWarning; f > 0 && f <= 1 {
+		return f
+	}
+	return 0.8
+}
+
+func (c *Configurator) GetStorageArtifactIndexByReference() bool {
+	return c.gc.Storage.ArtifactIndexByReference
+}
+
+func (c *Configurator) GetStorageWriteAheadLogDir() string {
+	return c.gc.Storage.WriteAheadLogDir
+}
+
 func (c *Configurator) GetDatabaseConfig() *DatabaseConfig {
 	return &c.gc.Database
 }
@@ -451,6 +931,40 @@ func (c *Configurator) GetAppLogEnableGCPLoggingFormat() bool {
 	return c.gc.App.LogEnableGCPLoggingFormat
 }
 
+func (c *Configurator) GetAppMinBazelVersion() string {
+	return c.gc.App.MinBazelVersion
+}
+
+func (c *Configurator) GetAppMaxConcurrentBuildEvents() int {
+	return c.gc.App.MaxConcurrentBuildEvents
+}
+
+func (c *Configurator) GetAppInvocationCheckpointInterval() string {
+	return c.gc.App.InvocationCheckpointInterval
+}
+
+func (c *Configurator) GetAppBuildEventWorkers() int {
+	return c.gc.App.BuildEventWorkers
+}
+
+func (c *Configurator) GetAppBuildEventWorkerQueueSize() int {
+	if n := c.gc.App.BuildEventWorkerQueueSize; n > 0 {
+		return n
+	}
+	return 100
+}
+
+func (c *Configurator) GetAppInternalCallDeadlineFraction() float64 {
+	if f := c.gc.App.InternalCallDeadlineFraction; f > 0 && f <= 1 {
+		return f
+	}
+	return 0.9
+}
+
+func (c *Configurator) GetAppRecommendedBazelVersion() string {
+	return c.gc.App.RecommendedBazelVersion
+}
+
 func (c *Configurator) GetGRPCOverHTTPPortEnabled() bool {
 	return c.gc.App.GRPCOverHTTPPortEnabled
 }
@@ -468,6 +982,23 @@ func (c *Configurator) GetGRPCMaxRecvMsgSizeBytes() int {
 	return n
 }
 
+func (c *Configurator) GetGRPCMaxSendMsgSizeBytes() int {
+	n := c.gc.App.GRPCMaxSendMsgSizeBytes
+	if n == 0 {
+		// Match the default used by grpc-go.
+		return math.MaxInt32
+	}
+	return n
+}
+
+func (c *Configurator) GetGRPCInitialWindowSize() int32 {
+	return int32(c.gc.App.GRPCInitialWindowSize)
+}
+
+func (c *Configurator) GetGRPCInitialConnWindowSize() int32 {
+	return int32(c.gc.App.GRPCInitialConnWindowSize)
+}
+
 func (c *Configurator) EnableTargetTracking() bool {
 	return c.gc.App.EnableTargetTracking
 }
@@ -476,6 +1007,18 @@ func (c *Configurator) GetIntegrationsSlackConfig() *SlackConfig {
 	return &c.gc.Integrations.Slack
 }
 
+func (c *Configurator) GetIntegrationsNotificationsConfig() *NotificationsConfig {
+	return &c.gc.Integrations.Notifications
+}
+
+func (c *Configurator) GetIntegrationsCIExportConfig() *CIExportConfig {
+	return &c.gc.Integrations.CIExport
+}
+
+func (c *Configurator) GetIntegrationsPromotionConfig() *PromotionConfig {
+	return &c.gc.Integrations.Promotion
+}
+
 func (c *Configurator) GetBuildEventProxyHosts() []string {
 	return c.gc.BuildEventProxy.Hosts
 }
@@ -484,10 +1027,55 @@ func (c *Configurator) GetBuildEventProxyBufferSize() int {
 	return c.gc.BuildEventProxy.BufferSize
 }
 
+func (c *Configurator) GetBuildEventProxyEnableGroupForwarding() bool {
+	return c.gc.BuildEventProxy.EnableGroupForwarding
+}
+
+func (c *Configurator) GetBuildEventProxyAllowedForwardingHosts() []string {
+	return c.gc.BuildEventProxy.AllowedForwardingHosts
+}
+
 func (c *Configurator) GetCacheMaxSizeBytes() int64 {
 	return c.gc.Cache.MaxSizeBytes
 }
 
+func (c *Configurator) GetCacheReadChunkSizeBytes() int64 {
+	n := c.gc.Cache.ReadChunkSizeBytes
+	if n == 0 {
+		// Keep under the default grpc-go limit of ~4MB (1024 * 1024 * 4).
+		return (1024 * 1024 * 4) - 100
+	}
+	return n
+}
+
+func (c *Configurator) GetCacheSharedReadMinSizeBytes() int64 {
+	n := c.gc.Cache.SharedReadMinSizeBytes
+	if n == 0 {
+		return 16 * 1024 * 1024
+	}
+	return n
+}
+
+func (c *Configurator) GetCacheDeltaUploadsConfig() *DeltaUploadsConfig {
+	return &c.gc.Cache.DeltaUploads
+}
+
+func (c *Configurator) GetCacheDigestMigrationConfig() *DigestMigrationConfig {
+	return &c.gc.Cache.DigestMigration
+}
+
+func (c *Configurator) GetCacheActionResultVerificationKeyFiles() []string {
+	return c.gc.Cache.ActionResultVerificationKeyFiles
+}
+
+func (c *Configurator) GetCacheRoutes() []CacheRouteConfig {
+	return c.gc.Cache.Routes
+}
+
+func (c *Configurator) GetCacheRetentionClasses() []RetentionClassConfig {
+	return c.gc.Cache.RetentionClasses
+}
+
 func (c *Configurator) GetCacheDiskConfig() *DiskConfig {
 	if c.gc.Cache.Disk.RootDirectory != "" {
 		return &c.gc.Cache.Disk
@@ -540,7 +1128,7 @@ func (c *Configurator) GetCacheInMemory() bool {
 }
 
 func (c *Configurator) GetAnonymousUsageEnabled() bool {
-	return len(c.gc.Auth.OauthProviders) == 0 || c.gc.Auth.EnableAnonymousUsage
+	return (len(c.gc.Auth.OauthProviders) == 0 && len(c.gc.Auth.LDAPProviders) == 0) || c.gc.Auth.EnableAnonymousUsage
 }
 
 func (c *Configurator) GetAuthJWTKey() string {
@@ -557,10 +1145,26 @@ func (c *Configurator) GetAuthOauthProviders() []OauthProvider {
 	return op
 }
 
+func (c *Configurator) GetAuthLDAPProviders() []LDAPProvider {
+	return c.gc.Auth.LDAPProviders
+}
+
 func (c *Configurator) GetAuthAPIKeyGroupCacheTTL() string {
 	return c.gc.Auth.APIKeyGroupCacheTTL
 }
 
+func (c *Configurator) GetSecretsConfig() *SecretsConfig {
+	return &c.gc.Secrets
+}
+
+func (c *Configurator) GetAccessLogConfig() *AccessLogConfig {
+	return &c.gc.AccessLog
+}
+
+func (c *Configurator) GetExportConfig() *ExportConfig {
+	return &c.gc.Export
+}
+
 func (c *Configurator) GetSSLConfig() *SSLConfig {
 	if c.gc.SSL.EnableSSL {
 		return &c.gc.SSL
@@ -595,6 +1199,10 @@ func (c *Configurator) GetAPIConfig() *APIConfig {
 	return nil
 }
 
+func (c *Configurator) GetMonitoringConfig() *MonitoringConfig {
+	return &c.gc.Monitoring
+}
+
 func (c *Configurator) GetGithubConfig() *GithubConfig {
 	if c.gc.Github == (GithubConfig{}) {
 		return nil
@@ -603,6 +1211,12 @@ func (c *Configurator) GetGithubConfig() *GithubConfig {
 	if cs := os.Getenv("BB_GITHUB_CLIENT_SECRET"); cs != "" {
 		ghc.ClientSecret = cs
 	}
+	if pk := os.Getenv("BB_GITHUB_APP_PRIVATE_KEY"); pk != "" {
+		ghc.App.PrivateKey = pk
+	}
+	if cs := os.Getenv("BB_GITHUB_APP_CLIENT_SECRET"); cs != "" {
+		ghc.App.ClientSecret = cs
+	}
 	return &ghc
 }
 
@@ -39,19 +39,28 @@ type Env interface {
 	GetStaticFilesystem() fs.FS
 	GetAppFilesystem() fs.FS
 	GetBlobstore() interfaces.Blobstore
+	GetBlobstoreBackends() interfaces.BlobstoreBackends
 	GetInvocationDB() interfaces.InvocationDB
+	GetInvocationCache() interfaces.InvocationCache
 	GetHealthChecker() interfaces.HealthChecker
+	GetClock() interfaces.Clock
 	GetAuthenticator() interfaces.Authenticator
 	SetAuthenticator(a interfaces.Authenticator)
 	GetWebhooks() []interfaces.Webhook
+	GetNotificationRouter() interfaces.NotificationRouter
+	GetBuildEventHooks() []interfaces.BuildEventHook
 	GetBuildEventHandler() interfaces.BuildEventHandler
 	GetBuildEventProxyClients() []pepb.PublishBuildEventClient
 	GetCache() interfaces.Cache
+	GetRetentionStore() interfaces.RetentionStore
+	GetDigestMigrator() interfaces.DigestMigrator
+	GetInstanceNameAliasService() interfaces.InstanceNameAliasService
 	GetUserDB() interfaces.UserDB
 	GetAuthDB() interfaces.AuthDB
 	GetInvocationStatService() interfaces.InvocationStatService
 	GetExecutionService() interfaces.ExecutionService
 	GetInvocationSearchService() interfaces.InvocationSearchService
+	GetConsoleLogIndex() interfaces.ConsoleLogIndex
 	GetSplashPrinter() interfaces.SplashPrinter
 	GetActionCacheClient() repb.ActionCacheClient
 	GetByteStreamClient() bspb.ByteStreamClient
@@ -67,7 +76,12 @@ type Env interface {
 	GetRemoteExecutionRedisClient() *redis.Client
 	GetRemoteExecutionRedisPubSubClient() *redis.Client
 	GetMetricsCollector() interfaces.MetricsCollector
+	GetKeyValStore() interfaces.KeyValStore
 	GetRepoDownloader() interfaces.RepoDownloader
 	GetWorkflowService() interfaces.WorkflowService
 	GetGitProviders() interfaces.GitProviders
+	GetSecretService() interfaces.SecretService
+	GetAccessLogService() interfaces.AccessLogService
+	GetInvocationExportService() interfaces.InvocationExportService
+	GetGitHubApp() interfaces.GitHubApp
 }
@@ -93,7 +93,20 @@ type HTTPHandlers struct {
 	RequestHandler http.Handler
 }
 
+// ErrorWriter writes an error returned by an RPC to the HTTP response.
+type ErrorWriter func(w http.ResponseWriter, r *http.Request, err error)
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
 func GenerateHTTPHandlers(server interface{}) (*HTTPHandlers, error) {
+	return GenerateHTTPHandlersWithErrorWriter(server, writeError)
+}
+
+// GenerateHTTPHandlersWithErrorWriter is like GenerateHTTPHandlers, but
+// writes the errors returned by RPCs with the given ErrorWriter.
+func GenerateHTTPHandlersWithErrorWriter(server interface{}, writeRPCError ErrorWriter) (*HTTPHandlers, error) {
 	if reflect.ValueOf(server).Type().Kind() != reflect.Ptr {
 		return nil, fmt.Errorf("GenerateHTTPHandlers must be called with a pointer to an RPC service implementation")
 	}
@@ -144,7 +157,7 @@ func GenerateHTTPHandlers(server interface{}) (*HTTPHandlers, error) {
 		rspArr := method.Call(args)
 		if rspArr[1].Interface() != nil {
 			err, _ := rspArr[1].Interface().(error)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeRPCError(w, r, err)
 			return
 		}
 
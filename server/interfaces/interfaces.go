@@ -9,16 +9,23 @@ import (
 
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 
+	alpb "github.com/buildbuddy-io/buildbuddy/proto/access_log"
 	aclpb "github.com/buildbuddy-io/buildbuddy/proto/acl"
 	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
 	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
+	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
 	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
 	grpb "github.com/buildbuddy-io/buildbuddy/proto/group"
+	ianpb "github.com/buildbuddy-io/buildbuddy/proto/instance_name_alias"
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	iepb "github.com/buildbuddy-io/buildbuddy/proto/invocation_export"
+	nfpb "github.com/buildbuddy-io/buildbuddy/proto/notification"
 	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+	secpb "github.com/buildbuddy-io/buildbuddy/proto/secrets"
 	telpb "github.com/buildbuddy-io/buildbuddy/proto/telemetry"
+	usagepb "github.com/buildbuddy-io/buildbuddy/proto/usage"
 	wfpb "github.com/buildbuddy-io/buildbuddy/proto/workflow"
 )
 
@@ -100,6 +107,10 @@ type Authenticator interface {
 
 	// Returns a context containing the given API key.
 	AuthContextFromAPIKey(ctx context.Context, apiKey string) context.Context
+
+	// Drops any cached authorization of the given API key, so that changes to
+	// it, such as revocation, take effect immediately.
+	InvalidateAPIKey(apiKey string)
 }
 
 type BuildEventChannel interface {
@@ -123,6 +134,29 @@ type Blobstore interface {
 	DeleteBlob(ctx context.Context, blobName string) error
 }
 
+// A WriteAheadBlobstore is a Blobstore which keeps accepting writes while its
+// underlying storage is unavailable, and persists them once it recovers.
+type WriteAheadBlobstore interface {
+	Blobstore
+
+	// HasPendingWrites returns whether any blob whose name starts with the
+	// given prefix was written but is not yet persisted.
+	HasPendingWrites(prefix string) bool
+}
+
+// BlobstoreBackends holds all of the configured blobstores, keyed by ID, so
+// that invocation blobs can be read from whichever backend they were written
+// to.
+type BlobstoreBackends interface {
+	// WriteBackendID returns the ID of the backend that new blobs are
+	// written to.
+	WriteBackendID() string
+
+	// Get returns the backend with the given ID. The empty ID refers to the
+	// backend holding blobs written before backend IDs were recorded.
+	Get(backendID string) (Blobstore, error)
+}
+
 // Similar to a blobstore, a cache allows for reading and writing data, but
 // additionally it is responsible for deleting data that is past TTL to keep to
 // a manageable size.
@@ -149,18 +183,99 @@ type Cache interface {
 	Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser, error)
 }
 
+// A RetentionStore keeps copies of blobs that are valuable for debugging, such
+// as action logs, for longer than the cache keeps ordinary outputs.
+type RetentionStore interface {
+	// Cache returns a cache which reads blobs from c, falling back to the
+	// retained copies of blobs that c has evicted.
+	Cache(c Cache) Cache
+}
+
+// A DigestMigrator copies blobs of the CAS from their SHA256 digests to their
+// BLAKE3 digests while clients switch digest functions, so that clients which
+// have switched find the blobs that are in use.
+type DigestMigrator interface {
+	// CASCache returns a cache which serves the given SHA256 CAS of the
+	// instance, and which copies the blobs written to or read from it to
+	// their BLAKE3 digests in the background.
+	CASCache(cache Cache, instanceName string) Cache
+}
+
+// An InstanceNameAliasService maps remote instance names that a group retired
+// to the instance names that replace them.
+type InstanceNameAliasService interface {
+	// Resolve returns the instance name that requests for the given instance
+	// name should be served from, along with the retired instance names whose
+	// cache entries should still be found by those requests.
+	Resolve(ctx context.Context, instanceName string) (primary string, fallbacks []string, err error)
+
+	CreateInstanceNameAlias(ctx context.Context, req *ianpb.CreateInstanceNameAliasRequest) (*ianpb.CreateInstanceNameAliasResponse, error)
+	ExpireInstanceNameAlias(ctx context.Context, req *ianpb.ExpireInstanceNameAliasRequest) (*ianpb.ExpireInstanceNameAliasResponse, error)
+	GetInstanceNameAliases(ctx context.Context, req *ianpb.GetInstanceNameAliasesRequest) (*ianpb.GetInstanceNameAliasesResponse, error)
+}
+
 type InvocationDB interface {
 	// Invocations API
 	InsertOrUpdateInvocation(ctx context.Context, in *tables.Invocation) error
 	UpdateInvocationACL(ctx context.Context, authenticatedUser *UserInfo, invocationID string, acl *aclpb.ACL) error
 	LookupInvocation(ctx context.Context, invocationID string) (*tables.Invocation, error)
 	LookupGroupFromInvocation(ctx context.Context, invocationID string) (*tables.Group, error)
-	LookupExpiredInvocations(ctx context.Context, cutoffTime time.Time, limit int) ([]*tables.Invocation, error)
+	// LookupExpiredInvocations returns invocations created before the cutoff
+	// time, other than those with any of the retained tags.
+	LookupExpiredInvocations(ctx context.Context, cutoffTime time.Time, retainedTags []string, limit int) ([]*tables.Invocation, error)
+	// LookupExpiredTaggedInvocations is like LookupExpiredInvocations, but
+	// only returns invocations with the given tag.
+	LookupExpiredTaggedInvocations(ctx context.Context, tag string, cutoffTime time.Time, retainedTags []string, limit int) ([]*tables.Invocation, error)
+	// LookupExpiredGroupInvocations returns invocations of the group created
+	// before the cutoff time, regardless of their tags.
+	LookupExpiredGroupInvocations(ctx context.Context, groupID string, cutoffTime time.Time, limit int) ([]*tables.Invocation, error)
+	// LookupExcessGroupInvocations returns the group's oldest invocations
+	// that must be deleted for the total size of its stored build events to
+	// fit within the given limit, up to the given number of invocations.
+	LookupExcessGroupInvocations(ctx context.Context, groupID string, maxTotalBytes int64, limit int) ([]*tables.Invocation, error)
+	// DeleteInvocation deletes the database rows of an invocation. Use
+	// build_event_handler.DeleteInvocation to delete its blobs too.
 	DeleteInvocation(ctx context.Context, invocationID string) error
-	DeleteInvocationWithPermsCheck(ctx context.Context, authenticatedUser *UserInfo, invocationID string) error
+	// LookupInvocationForWrite returns an invocation, including one that is
+	// in the trash, if the authenticated user may modify it.
+	LookupInvocationForWrite(ctx context.Context, authenticatedUser *UserInfo, invocationID string) (*tables.Invocation, error)
+	// TrashInvocationWithPermsCheck moves an invocation to the trash, which
+	// hides it from lookups until it's restored or purged.
+	TrashInvocationWithPermsCheck(ctx context.Context, authenticatedUser *UserInfo, invocationID string) error
+	RestoreInvocationWithPermsCheck(ctx context.Context, authenticatedUser *UserInfo, invocationID string) error
+	// LookupTrashedInvocations returns a group's trashed invocations, most
+	// recently trashed first.
+	LookupTrashedInvocations(ctx context.Context, groupID string, limit int) ([]*tables.Invocation, error)
+	// LookupExpiredTrashedInvocations returns invocations that were moved to
+	// the trash before the cutoff time.
+	LookupExpiredTrashedInvocations(ctx context.Context, cutoffTime time.Time, limit int) ([]*tables.Invocation, error)
+	InsertInvocationBuildMetadata(ctx context.Context, invocationID string, metadata map[string]string) error
+	// InsertInvocationFailures records the failures printed by an invocation,
+	// replacing any recorded before.
+	InsertInvocationFailures(ctx context.Context, invocationID string, failures []*tables.InvocationFailure) error
+	// InsertOrUpdateCustomEventStream records a stream of custom events for
+	// an invocation, marking the invocation as updated.
+	InsertOrUpdateCustomEventStream(ctx context.Context, stream *tables.InvocationCustomEventStream) error
+	LookupCustomEventStreams(ctx context.Context, invocationID string) ([]*tables.InvocationCustomEventStream, error)
+	AddInvocationTags(ctx context.Context, invocationID string, tags []string) error
+	RemoveInvocationTags(ctx context.Context, invocationID string, tags []string) error
+	// LookupInvocationTags returns the tags of each of the given invocations,
+	// keyed by invocation ID.
+	LookupInvocationTags(ctx context.Context, invocationIDs []string) (map[string][]string, error)
 	FillCounts(ctx context.Context, log *telpb.TelemetryStat) error
 }
 
+// An InvocationCache holds recently parsed invocations in memory so that
+// repeated lookups don't need to re-read and re-parse them from the
+// blobstore.
+type InvocationCache interface {
+	// Get returns the cached invocation if present and if it was last
+	// updated at updatedAtUsec.
+	Get(invocationID string, updatedAtUsec int64) (*inpb.Invocation, bool)
+	Add(invocation *inpb.Invocation)
+	Invalidate(invocationID string)
+}
+
 type APIKeyGroup interface {
 	GetCapabilities() int32
 	GetGroupID() string
@@ -172,6 +287,23 @@ type AuthDB interface {
 	ReadToken(ctx context.Context, subID string) (*tables.Token, error)
 	GetAPIKeyGroupFromAPIKey(ctx context.Context, apiKey string) (APIKeyGroup, error)
 	GetAPIKeyGroupFromBasicAuth(ctx context.Context, login, pass string) (APIKeyGroup, error)
+	UpdateAPIKeyLastUsed(ctx context.Context, apiKey string, lastUsedUsec int64) error
+
+	// Sessions API
+	InsertSession(ctx context.Context, s *tables.Session) error
+	// UpdateSessionLastUsed records that the session with the given token
+	// hash was used with the given login token. It returns NotFound if there
+	// is no such session.
+	UpdateSessionLastUsed(ctx context.Context, tokenHash, loginTokenHash string, lastUsedUsec int64) error
+	GetSession(ctx context.Context, sessionID string) (*tables.Session, error)
+	GetUserSessions(ctx context.Context, userID string) ([]*tables.Session, error)
+	// RevokeSession deletes the session, and adds its session and login
+	// tokens to the denylist.
+	RevokeSession(ctx context.Context, sessionID string) error
+
+	// Token denylist API
+	RevokeToken(ctx context.Context, token string) error
+	GetRevokedTokenHashes(ctx context.Context) ([]string, error)
 }
 
 type UserDB interface {
@@ -208,21 +340,115 @@ type UserDB interface {
 	DeleteAPIKey(ctx context.Context, apiKeyID string) error
 }
 
+// A SecretService stores secrets owned by groups, such as the credentials
+// used by integrations, encrypted at rest.
+type SecretService interface {
+	GetSecrets(ctx context.Context, req *secpb.GetSecretsRequest) (*secpb.GetSecretsResponse, error)
+	UpdateSecret(ctx context.Context, req *secpb.UpdateSecretRequest) (*secpb.UpdateSecretResponse, error)
+	DeleteSecret(ctx context.Context, req *secpb.DeleteSecretRequest) (*secpb.DeleteSecretResponse, error)
+
+	// GetSecretValue returns the decrypted value of a group's secret. The
+	// caller is not authorized, so the value must only be used on behalf of
+	// the group.
+	GetSecretValue(ctx context.Context, groupID, name string) (string, error)
+
+	// Encrypt and Decrypt protect credentials that are stored outside of the
+	// secrets table, such as the access tokens of workflows. Decrypt returns
+	// values which were stored before they were encrypted unchanged.
+	Encrypt(plaintext string) (string, error)
+	Decrypt(ciphertext string) (string, error)
+}
+
+// An AccessLogService records who viewed which invocations and downloaded
+// which of their artifacts, so that groups can review access to their builds.
+type AccessLogService interface {
+	// RecordInvocationAccess records that the authenticated user, if any,
+	// viewed the invocation. Failures are logged rather than returned, so
+	// that they don't prevent the access.
+	RecordInvocationAccess(ctx context.Context, invocation *inpb.Invocation)
+
+	// RecordArtifactAccess records that the authenticated user, if any,
+	// downloaded the named artifact of the invocation.
+	RecordArtifactAccess(ctx context.Context, invocationID, artifactName string)
+
+	GetAccessLog(ctx context.Context, req *alpb.GetAccessLogRequest) (*alpb.GetAccessLogResponse, error)
+}
+
+// An InvocationExportService exports the records of the invocations matching
+// a search to files, which are written in the background and downloaded
+// through signed URLs.
+type InvocationExportService interface {
+	CreateExportJob(ctx context.Context, req *iepb.CreateExportJobRequest) (*iepb.CreateExportJobResponse, error)
+	GetExportJob(ctx context.Context, req *iepb.GetExportJobRequest) (*iepb.GetExportJobResponse, error)
+
+	// ServeHTTP serves the downloads of exported files through signed URLs.
+	ServeHTTP(w http.ResponseWriter, r *http.Request)
+}
+
 // A webhook can be called when a build is completed.
 type Webhook interface {
 	NotifyComplete(ctx context.Context, invocation *inpb.Invocation) error
 }
 
+// A NotificationRouter sends notifications about completed invocations, drops
+// in their cache hit rate, and groups approaching their usage limits, to the
+// destinations selected by the configured routing rules.
+type NotificationRouter interface {
+	// NotifyInvocationComplete notifies the destinations of every rule
+	// matching the invocation. The branch is the one the invocation built,
+	// or "" if unknown.
+	NotifyInvocationComplete(ctx context.Context, groupID, branch string, invocation *inpb.Invocation) error
+	// NotifyCacheHitRateDrop notifies the destinations of every rule which
+	// selects cache_hit_rate_drop events and matches the invocation.
+	NotifyCacheHitRateDrop(ctx context.Context, groupID string, invocation *inpb.Invocation, drop *capb.CacheHitRateDrop) error
+	// NotifyUsageWarning notifies the destinations of every rule which
+	// selects usage_warning events and matches the group.
+	NotifyUsageWarning(ctx context.Context, groupID string, usage *usagepb.UsageLimit) error
+	SendTestNotification(ctx context.Context, req *nfpb.SendTestNotificationRequest) (*nfpb.SendTestNotificationResponse, error)
+}
+
+// A BuildEventHook is notified as invocations are processed, allowing
+// deployments to compile in site-specific integrations without modifying the
+// build event handler. Errors returned by hooks are logged, but do not affect
+// the invocation.
+type BuildEventHook interface {
+	// OnInvocationStarted is called with the started event of each
+	// invocation, after the invocation has been authenticated.
+	OnInvocationStarted(ctx context.Context, invocationID string, event *inpb.InvocationEvent) error
+
+	// OnBuildEvent is called with every event of each invocation, in order,
+	// except that progress events may be delayed while the app is shedding
+	// load. It is called synchronously while handling the build event stream, so it
+	// should return quickly.
+	OnBuildEvent(ctx context.Context, invocationID string, event *inpb.InvocationEvent) error
+
+	// OnInvocationFinished is called once an invocation is complete and has
+	// been written to the database.
+	OnInvocationFinished(ctx context.Context, invocation *inpb.Invocation) error
+}
+
 // Allows aggregating invocation statistics.
 type InvocationStatService interface {
 	GetInvocationStat(ctx context.Context, req *inpb.GetInvocationStatRequest) (*inpb.GetInvocationStatResponse, error)
 	GetTrend(ctx context.Context, req *inpb.GetTrendRequest) (*inpb.GetTrendResponse, error)
+	GetBuildMetadataKeys(ctx context.Context, req *inpb.GetBuildMetadataKeysRequest) (*inpb.GetBuildMetadataKeysResponse, error)
+	GetClientVersions(ctx context.Context, req *inpb.GetClientVersionsRequest) (*inpb.GetClientVersionsResponse, error)
+	GetHomeStats(ctx context.Context, req *inpb.GetHomeStatsRequest) (*inpb.GetHomeStatsResponse, error)
+	GetFailureClusters(ctx context.Context, req *inpb.GetFailureClustersRequest) (*inpb.GetFailureClustersResponse, error)
 }
 
 // Allows searching invocations.
 type InvocationSearchService interface {
 	IndexInvocation(ctx context.Context, invocation *inpb.Invocation) error
 	QueryInvocations(ctx context.Context, req *inpb.SearchInvocationRequest) (*inpb.SearchInvocationResponse, error)
+	GetBaselineInvocation(ctx context.Context, req *inpb.GetBaselineInvocationRequest) (*inpb.GetBaselineInvocationResponse, error)
+	GetRelatedInvocations(ctx context.Context, req *inpb.GetRelatedInvocationsRequest) (*inpb.GetRelatedInvocationsResponse, error)
+}
+
+// Indexes the console logs of invocations so that they can be searched.
+type ConsoleLogIndex interface {
+	IndexConsoleLog(ctx context.Context, groupID string, invocation *inpb.Invocation) error
+	SearchConsoleLog(ctx context.Context, req *inpb.SearchConsoleLogRequest) (*inpb.SearchConsoleLogResponse, error)
 }
 
 type ApiService interface {
@@ -236,6 +462,38 @@ type WorkflowService interface {
 	GetWorkflows(ctx context.Context, req *wfpb.GetWorkflowsRequest) (*wfpb.GetWorkflowsResponse, error)
 	ExecuteWorkflow(ctx context.Context, req *wfpb.ExecuteWorkflowRequest) (*wfpb.ExecuteWorkflowResponse, error)
 	GetRepos(ctx context.Context, req *wfpb.GetReposRequest) (*wfpb.GetReposResponse, error)
+	StartBisect(ctx context.Context, req *wfpb.StartBisectRequest) (*wfpb.StartBisectResponse, error)
+	GetBisect(ctx context.Context, req *wfpb.GetBisectRequest) (*wfpb.GetBisectResponse, error)
+	CreateWorkflowSchedule(ctx context.Context, req *wfpb.CreateWorkflowScheduleRequest) (*wfpb.CreateWorkflowScheduleResponse, error)
+	DeleteWorkflowSchedule(ctx context.Context, req *wfpb.DeleteWorkflowScheduleRequest) (*wfpb.DeleteWorkflowScheduleResponse, error)
+	GetWorkflowSchedules(ctx context.Context, req *wfpb.GetWorkflowSchedulesRequest) (*wfpb.GetWorkflowSchedulesResponse, error)
+	ServeHTTP(w http.ResponseWriter, r *http.Request)
+
+	// StartGitHubAppWorkflows starts the workflows of the repo that an event
+	// received by the GitHub App is from, which were created with the given
+	// installation of the App by the group that it's linked to.
+	StartGitHubAppWorkflows(ctx context.Context, installationID int64, repoURL string, wd *WebhookData) error
+}
+
+// A GitHubApp authenticates to GitHub as the installations of a GitHub App,
+// with short-lived installation tokens rather than long-lived user tokens.
+type GitHubApp interface {
+	// GetInstallationID returns the ID of the App's installation that has
+	// access to the repo, or a NotFound error if the App isn't installed on
+	// it or the installation isn't linked to the group.
+	GetInstallationID(ctx context.Context, groupID, repoURL string) (int64, error)
+
+	// GetInstallationToken returns a token of the installation, which is
+	// valid for at least a few more minutes, or a PermissionDenied error if
+	// the installation isn't linked to the group.
+	GetInstallationToken(ctx context.Context, groupID string, installationID int64) (string, error)
+
+	// Link handles the flow which links an installation of the App to a
+	// group, once a member of the group has shown that they can access the
+	// installation on GitHub.
+	Link(w http.ResponseWriter, r *http.Request)
+
+	// ServeHTTP handles the deliveries of the App's webhook.
 	ServeHTTP(w http.ResponseWriter, r *http.Request)
 }
 
@@ -264,7 +522,26 @@ type GitProvider interface {
 	// UnregisterWebhook unregisters the webhook with the given ID from the repo.
 	UnregisterWebhook(ctx context.Context, accessToken, repoURL, webhookID string) error
 
-	// TODO(bduffany): CreateStatus, ListRepos
+	// CreateStatus reports the status of a CI job for the given commit, which
+	// replaces the status previously reported with the same context.
+	CreateStatus(ctx context.Context, accessToken, repoURL, commitSHA string, status *CommitStatus) error
+
+	// TODO(bduffany): ListRepos
+}
+
+// CommitStatus is the status of a CI job for a commit, as shown by git
+// providers.
+type CommitStatus struct {
+	// Context identifies the CI job, such as "bazel test //...".
+	Context string
+
+	// State is one of "pending", "success", "failure", or "error".
+	State string
+
+	// TargetURL links to the results of the CI job.
+	TargetURL string
+
+	Description string
 }
 
 // WebhookData represents the data extracted from a Webhook event.
@@ -327,6 +604,14 @@ type RemoteExecutionService interface {
 	Execute(req *repb.ExecuteRequest, stream repb.Execution_ExecuteServer) error
 	WaitExecution(req *repb.WaitExecutionRequest, stream repb.Execution_WaitExecutionServer) error
 	PublishOperation(stream repb.Execution_PublishOperationServer) error
+
+	// MarkExecutionFailed completes an execution that failed before it could
+	// be run by an executor, notifying any clients waiting on it.
+	MarkExecutionFailed(ctx context.Context, executionID string, reason error) error
+
+	// PredictExecution predicts whether executing an action would be served
+	// from the action cache and, if not, how it would be scheduled.
+	PredictExecution(ctx context.Context, req *espb.PredictExecutionRequest) (*espb.PredictExecutionResponse, error)
 }
 
 type FileCache interface {
@@ -342,17 +627,32 @@ type SchedulerService interface {
 	EnqueueTaskReservation(ctx context.Context, req *scpb.EnqueueTaskReservationRequest) (*scpb.EnqueueTaskReservationResponse, error)
 	ReEnqueueTask(ctx context.Context, req *scpb.ReEnqueueTaskRequest) (*scpb.ReEnqueueTaskResponse, error)
 	GetExecutionNodes(ctx context.Context, req *scpb.GetExecutionNodesRequest) (*scpb.GetExecutionNodesResponse, error)
+	CordonExecutor(ctx context.Context, req *scpb.CordonExecutorRequest) (*scpb.CordonExecutorResponse, error)
+	CreateMaintenanceWindow(ctx context.Context, req *scpb.CreateMaintenanceWindowRequest) (*scpb.CreateMaintenanceWindowResponse, error)
+	DeleteMaintenanceWindow(ctx context.Context, req *scpb.DeleteMaintenanceWindowRequest) (*scpb.DeleteMaintenanceWindowResponse, error)
+	GetMaintenanceWindows(ctx context.Context, req *scpb.GetMaintenanceWindowsRequest) (*scpb.GetMaintenanceWindowsResponse, error)
+	GetExecutorUtilization(ctx context.Context, req *scpb.GetExecutorUtilizationRequest) (*scpb.GetExecutorUtilizationResponse, error)
+	ExportSchedulerSnapshot(ctx context.Context, req *scpb.ExportSchedulerSnapshotRequest) (*scpb.ExportSchedulerSnapshotResponse, error)
 	GetGroupIDAndDefaultPoolForUser(ctx context.Context) (string, string, error)
+
+	// PredictScheduling predicts how a task with the given scheduling
+	// metadata would be scheduled, without scheduling it.
+	PredictScheduling(ctx context.Context, metadata *scpb.SchedulingMetadata) (*scpb.SchedulingPrediction, error)
 }
 
 type ExecutionService interface {
 	GetExecution(ctx context.Context, req *espb.GetExecutionRequest) (*espb.GetExecutionResponse, error)
+	GetExecutionProgress(ctx context.Context, req *espb.GetExecutionProgressRequest) (*espb.GetExecutionProgressResponse, error)
 }
 
 type ExecutionNode interface {
 	// GetExecutorID returns the ID for this execution node that uniquely identifies
 	// it within a node pool.
 	GetExecutorID() string
+
+	// GetCapabilityGrade returns the grade from 1 (slowest) to 5 (fastest)
+	// that the node earned in its startup benchmark, or 0 if unknown.
+	GetCapabilityGrade() int32
 }
 
 // TaskRouter decides which execution nodes should execute a task.
@@ -368,6 +668,9 @@ type TaskRouter interface {
 	// suitability are returned in random order (for load balancing purposes).
 	//
 	// If an error occurs, the input nodes should be returned in random order.
+	//
+	// Pools configured for affinity routing by target label read the target
+	// from the Bazel request metadata attached to the context.
 	RankNodes(ctx context.Context, cmd *repb.Command, remoteInstanceName string, nodes []ExecutionNode) []ExecutionNode
 
 	// MarkComplete notifies the router that the command has been completed by the
@@ -432,12 +735,33 @@ type PubSub interface {
 // redis), so they should *not* be used in critical path code.
 type MetricsCollector interface {
 	IncrementCount(ctx context.Context, counterName string, n int64) (int64, error)
+	// IncrementCountWithExpiry is like IncrementCount, but the counter is
+	// deleted once it hasn't been incremented for the given duration.
+	IncrementCountWithExpiry(ctx context.Context, counterName string, n int64, expiration time.Duration) (int64, error)
 	ReadCount(ctx context.Context, counterName string) (int64, error)
+
+	// IncrementMapCount increments the count of the given field of the map of
+	// counts stored under the given key, and ReadMapCounts returns all of the
+	// counts stored under it.
+	IncrementMapCount(ctx context.Context, key, field string, n int64) (int64, error)
+	ReadMapCounts(ctx context.Context, key string) (map[string]int64, error)
+}
+
+// A KeyValStore stores small values which expire, and which are shared by all
+// of the apps.
+type KeyValStore interface {
+	// SetValue stores a value which expires after the given duration.
+	SetValue(ctx context.Context, key, value string, expiration time.Duration) error
+	// GetValue returns the stored value, or "" if there is none.
+	GetValue(ctx context.Context, key string) (string, error)
 }
 
 // A RepoDownloader allows testing a git-repo to see if it's downloadable.
 type RepoDownloader interface {
 	TestRepoAccess(ctx context.Context, repoURL, username, accessToken string) error
+	// ResolveBranch returns the SHA of the commit at the head of the given
+	// branch.
+	ResolveBranch(ctx context.Context, repoURL, username, accessToken, branch string) (string, error)
 }
 
 type Checker interface {
@@ -452,6 +776,19 @@ func (f CheckerFunc) Check(ctx context.Context) error {
 	return f(ctx)
 }
 
+// A Clock tells the current time and waits for time to pass. Code whose
+// behavior depends on the passage of time, such as timeouts, leases, and
+// retention, should use the environment's clock rather than the time package,
+// so that tests can control time.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+
+	// After returns a channel which receives the current time once the given
+	// duration has elapsed.
+	After(d time.Duration) <-chan time.Time
+}
+
 type HealthChecker interface {
 	// AddHealthCheck adds a healthcheck -- the server's readiness is dependent on all
 	// registered heathchecks passing.
@@ -0,0 +1,131 @@
+// Package invocation_archiver moves old invocations to a cheaper storage
+// backend in the background. Archived invocations are restored to regular
+// storage the next time they're looked up.
+package invocation_archiver
+
+import (
+	"context"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+const (
+	defaultArchiveAfter = 90 * 24 * time.Hour
+	defaultInterval     = 10 * time.Minute
+	defaultBatchSize    = 100
+)
+
+// Archiver archives invocations that were created, and last restored, long
+// enough ago. Every app runs one; an invocation that is archived by several
+// apps at once is only switched over to the archive by one of them.
+type Archiver struct {
+	env          environment.Env
+	backendID    string
+	archiveAfter time.Duration
+	interval     time.Duration
+	batchSize    int
+
+	quit chan struct{}
+}
+
+// NewArchiver returns an Archiver if archiving is enabled in the config, or
+// nil otherwise.
+func NewArchiver(env environment.Env) *Archiver {
+	c := env.GetConfigurator().GetStorageArchiveConfig()
+	if c.BackendID == "" || env.GetDBHandle() == nil {
+		return nil
+	}
+	a := &Archiver{
+		env:          env,
+		backendID:    c.BackendID,
+		archiveAfter: time.Duration(c.ArchiveAfterSeconds) * time.Second,
+		interval:     time.Duration(c.IntervalSeconds) * time.Second,
+		batchSize:    c.BatchSize,
+	}
+	if a.archiveAfter <= 0 {
+		a.archiveAfter = defaultArchiveAfter
+	}
+	if a.interval <= 0 {
+		a.interval = defaultInterval
+	}
+	if a.batchSize <= 0 {
+		a.batchSize = defaultBatchSize
+	}
+	return a
+}
+
+// Archive archives a batch of old invocations, oldest first, and returns how
+// many were archived.
+func (a *Archiver) Archive(ctx context.Context) (int, error) {
+	cutoffUsec := timeutil.ToUsec(a.env.GetClock().Now().Add(-a.archiveAfter))
+	var batch []*tables.Invocation
+	err := a.env.GetDBHandle().WithContext(ctx).
+		Where("archive_status = ? AND invocation_status <> ? AND created_at_usec < ? AND archive_status_usec < ?",
+			int64(inpb.Invocation_NOT_ARCHIVED), int64(inpb.Invocation_PARTIAL_INVOCATION_STATUS), cutoffUsec, cutoffUsec).
+		Order("created_at_usec ASC").
+		Limit(a.batchSize).
+		Find(&batch).Error
+	if err != nil {
+		return 0, status.InternalErrorf("failed to look up invocations to archive: %s", err)
+	}
+	archived := 0
+	for _, ti := range batch {
+		if err := build_event_handler.ArchiveInvocation(ctx, a.env, ti, a.backendID); err != nil {
+			if ctx.Err() != nil {
+				return archived, ctx.Err()
+			}
+			// Invocations modified in the meantime, such as ones archived by
+			// another app, are skipped. Others are retried next time.
+			if !status.IsAbortedError(err) {
+				log.Warningf("Failed to archive invocation %s: %s", ti.InvocationID, err)
+			}
+			continue
+		}
+		archived++
+	}
+	return archived, nil
+}
+
+func (a *Archiver) Start() {
+	if a == nil {
+		return
+	}
+	a.quit = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-a.quit
+		cancel()
+	}()
+	go func() {
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				n, err := a.Archive(ctx)
+				if err != nil {
+					log.Warningf("Error archiving old invocations: %s", err)
+				} else if n > 0 {
+					log.Infof("Archived %d invocations to backend %q", n, a.backendID)
+				}
+			case <-a.quit:
+				return
+			}
+		}
+	}()
+}
+
+func (a *Archiver) Stop() {
+	if a == nil || a.quit == nil {
+		return
+	}
+	close(a.quit)
+}
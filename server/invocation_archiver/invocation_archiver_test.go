@@ -0,0 +1,96 @@
+package invocation_archiver_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
+	"github.com/buildbuddy-io/buildbuddy/server/invocation_archiver"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/protofile"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+func TestArchiveAndRestore(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	assert.Nil(t, invocation_archiver.NewArchiver(te), "archiver should be disabled by default")
+
+	archiveBS, err := blobstore.NewDiskBlobStore(t.TempDir())
+	require.NoError(t, err)
+	backends := blobstore.NewBackends("hot", te.GetBlobstore(), "")
+	require.NoError(t, backends.Add("archive", archiveBS))
+	te.SetBlobstoreBackends(backends)
+	flags.Set(t, "storage.archive.backend_id", "archive")
+	flags.Set(t, "storage.archive.archive_after_seconds", "3600")
+	clock := te.UseFakeClock()
+
+	for i, ti := range []*tables.Invocation{
+		{InvocationID: "old", InvocationStatus: int64(inpb.Invocation_COMPLETE_INVOCATION_STATUS)},
+		{InvocationID: "recent", InvocationStatus: int64(inpb.Invocation_COMPLETE_INVOCATION_STATUS)},
+		// Still in progress, so not archived.
+		{InvocationID: "in-progress", InvocationStatus: int64(inpb.Invocation_PARTIAL_INVOCATION_STATUS)},
+	} {
+		ti.InvocationPK = int64(i + 1)
+		ti.BlobBackendID = "hot"
+		ti.Perms = perms.OTHERS_READ
+		require.NoError(t, te.GetDBHandle().Create(ti).Error)
+		w := protofile.NewBufferedProtoWriter(te.GetBlobstore(), ti.InvocationID, 1024)
+		started := &build_event_stream.BuildEvent{Payload: &build_event_stream.BuildEvent_Started{Started: &build_event_stream.BuildStarted{Command: "test"}}}
+		require.NoError(t, w.WriteProtoToStream(ctx, &inpb.InvocationEvent{BuildEvent: started}))
+		require.NoError(t, w.Flush(ctx))
+	}
+	err = te.GetDBHandle().Model(&tables.Invocation{}).Where("invocation_id IN (?)", []string{"old", "in-progress"}).
+		UpdateColumn("created_at_usec", timeutil.ToUsec(clock.Now().Add(-2*time.Hour))).Error
+	require.NoError(t, err)
+
+	a := invocation_archiver.NewArchiver(te)
+	require.NotNil(t, a)
+	n, err := a.Archive(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	ti := &tables.Invocation{}
+	require.NoError(t, te.GetDBHandle().Where("invocation_id = ?", "old").Take(ti).Error)
+	assert.Equal(t, "archive", ti.BlobBackendID)
+	assert.Equal(t, int64(inpb.Invocation_ARCHIVED), ti.ArchiveStatus)
+	archived, err := archiveBS.BlobExists(ctx, protofile.ChunkName("old", 0))
+	require.NoError(t, err)
+	assert.True(t, archived)
+	stillHot, err := te.GetBlobstore().BlobExists(ctx, protofile.ChunkName("old", 0))
+	require.NoError(t, err)
+	assert.False(t, stillHot)
+
+	// Looking up the archived invocation restores it in the background.
+	invocation, err := build_event_handler.LookupInvocation(te, ctx, "old")
+	require.NoError(t, err)
+	assert.Equal(t, inpb.Invocation_RESTORING, invocation.ArchiveStatus)
+	assert.Empty(t, invocation.Event)
+	require.Eventually(t, func() bool {
+		invocation, err = build_event_handler.LookupInvocation(te, ctx, "old")
+		require.NoError(t, err)
+		return invocation.ArchiveStatus == inpb.Invocation_NOT_ARCHIVED
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "test", invocation.Command)
+	require.NoError(t, te.GetDBHandle().Where("invocation_id = ?", "old").Take(ti).Error)
+	assert.Equal(t, "hot", ti.BlobBackendID)
+
+	// Restored invocations aren't archived again right away.
+	n, err = a.Archive(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	clock.Advance(2 * time.Hour)
+	n, err = a.Archive(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
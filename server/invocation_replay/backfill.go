@@ -0,0 +1,134 @@
+package invocation_replay
+
+import (
+	"context"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/event_parser"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+const (
+	defaultBackfillMaxAge   = 7 * 24 * time.Hour
+	defaultBackfillInterval = 1 * time.Minute
+)
+
+// Backfiller re-parses recent invocations that were parsed by an older version
+// of the event parser, in the background. Every app runs one; an invocation
+// is claimed by the app that re-parses it, so that apps don't duplicate work.
+type Backfiller struct {
+	env       environment.Env
+	maxAge    time.Duration
+	interval  time.Duration
+	batchSize int
+
+	quit chan struct{}
+}
+
+// NewBackfiller returns a Backfiller if re-parsing is enabled in the config,
+// or nil otherwise.
+func NewBackfiller(env environment.Env) *Backfiller {
+	c := env.GetConfigurator().GetStorageReparseConfig()
+	if !c.Enabled || env.GetDBHandle() == nil {
+		return nil
+	}
+	b := &Backfiller{
+		env:       env,
+		maxAge:    time.Duration(c.MaxAgeSeconds) * time.Second,
+		interval:  time.Duration(c.IntervalSeconds) * time.Second,
+		batchSize: c.BatchSize,
+	}
+	if b.maxAge <= 0 {
+		b.maxAge = defaultBackfillMaxAge
+	}
+	if b.interval <= 0 {
+		b.interval = defaultBackfillInterval
+	}
+	if b.batchSize <= 0 {
+		b.batchSize = defaultBatchSize
+	}
+	return b
+}
+
+// Backfill re-parses a batch of outdated invocations, most recent first, and
+// returns how many were re-parsed.
+func (b *Backfiller) Backfill(ctx context.Context) (int, error) {
+	minCreatedAtUsec := timeutil.ToUsec(b.env.GetClock().Now().Add(-b.maxAge))
+	var batch []*tables.Invocation
+	err := b.env.GetDBHandle().WithContext(ctx).
+		Where("parser_version < ? AND invocation_status <> ? AND created_at_usec >= ?", event_parser.Version, int64(inpb.Invocation_PARTIAL_INVOCATION_STATUS), minCreatedAtUsec).
+		Order("created_at_usec DESC").
+		Limit(b.batchSize).
+		Find(&batch).Error
+	if err != nil {
+		return 0, status.InternalErrorf("failed to look up outdated invocations: %s", err)
+	}
+	reparsed := 0
+	for _, ti := range batch {
+		// Claim the invocation before re-parsing it. Invocations that fail to
+		// re-parse stay claimed, rather than being retried forever; they can
+		// be replayed with the invocation_replay tool.
+		res := b.env.GetDBHandle().WithContext(ctx).Model(&tables.Invocation{}).
+			Where("invocation_id = ? AND parser_version = ?", ti.InvocationID, ti.ParserVersion).
+			UpdateColumn("parser_version", event_parser.Version)
+		if res.Error != nil {
+			return reparsed, status.InternalErrorf("failed to claim invocation %s: %s", ti.InvocationID, res.Error)
+		}
+		if res.RowsAffected == 0 {
+			// Claimed by another app.
+			continue
+		}
+		if err := build_event_handler.ReplayInvocation(ctx, b.env, ti); err != nil {
+			if ctx.Err() != nil {
+				return reparsed, ctx.Err()
+			}
+			log.Warningf("Failed to re-parse invocation %s: %s", ti.InvocationID, err)
+			continue
+		}
+		reparsed++
+	}
+	return reparsed, nil
+}
+
+func (b *Backfiller) Start() {
+	if b == nil {
+		return
+	}
+	b.quit = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-b.quit
+		cancel()
+	}()
+	go func() {
+		ticker := time.NewTicker(b.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				n, err := b.Backfill(ctx)
+				if err != nil {
+					log.Warningf("Error re-parsing outdated invocations: %s", err)
+				} else if n > 0 {
+					log.Infof("Re-parsed %d invocations with event parser version %d", n, event_parser.Version)
+				}
+			case <-b.quit:
+				return
+			}
+		}
+	}()
+}
+
+func (b *Backfiller) Stop() {
+	if b == nil || b.quit == nil {
+		return
+	}
+	close(b.quit)
+}
@@ -0,0 +1,58 @@
+package invocation_replay_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/event_parser"
+	"github.com/buildbuddy-io/buildbuddy/server/invocation_replay"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+func TestBackfill(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	assert.Nil(t, invocation_replay.NewBackfiller(te), "backfiller should be disabled by default")
+
+	flags.Set(t, "storage.reparse.enabled", "true")
+	flags.Set(t, "storage.reparse.max_age_seconds", "3600")
+	clock := te.UseFakeClock()
+
+	for i, iid := range []string{"old", "outdated", "current"} {
+		require.NoError(t, te.GetDBHandle().Create(&tables.Invocation{InvocationID: iid, InvocationPK: int64(i + 1), InvocationStatus: int64(inpb.Invocation_COMPLETE_INVOCATION_STATUS)}).Error)
+		writeEvents(t, te, iid,
+			&build_event_stream.BuildEvent{Payload: &build_event_stream.BuildEvent_Started{Started: &build_event_stream.BuildStarted{Command: "test"}}},
+		)
+	}
+	// Only recent invocations are re-parsed, based on their creation time.
+	err := te.GetDBHandle().Model(&tables.Invocation{}).Where("invocation_id = ?", "old").UpdateColumn("created_at_usec", timeutil.ToUsec(clock.Now().Add(-2*time.Hour))).Error
+	require.NoError(t, err)
+	err = te.GetDBHandle().Model(&tables.Invocation{}).Where("invocation_id = ?", "current").UpdateColumn("parser_version", event_parser.Version).Error
+	require.NoError(t, err)
+
+	b := invocation_replay.NewBackfiller(te)
+	require.NotNil(t, b)
+	n, err := b.Backfill(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	for iid, command := range map[string]string{"old": "", "outdated": "test", "current": ""} {
+		ti := &tables.Invocation{}
+		require.NoError(t, te.GetDBHandle().Where("invocation_id = ?", iid).Take(ti).Error)
+		assert.Equal(t, command, ti.Command, "command of %q", iid)
+	}
+
+	// Re-parsed invocations aren't re-parsed again.
+	n, err = b.Backfill(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
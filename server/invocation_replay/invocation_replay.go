@@ -0,0 +1,129 @@
+// Package invocation_replay re-runs event parsing for invocations whose raw
+// events are stored in the blobstore, and re-populates the database rows
+// derived from them. This picks up event parser fixes and newly added columns
+// for invocations that finished before the change was deployed.
+//
+// Invocations are replayed in order of invocation ID, and each one is
+// replayed independently, so a backfill can be interrupted and resumed from
+// the last invocation that it reported as replayed.
+package invocation_replay
+
+import (
+	"context"
+
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+const (
+	defaultBatchSize = 100
+)
+
+type Options struct {
+	// If set, only these invocations are replayed. Otherwise, all finished
+	// invocations are replayed.
+	InvocationIDs []string
+
+	// If set, only invocations with a greater ID than this are replayed, to
+	// resume an interrupted backfill.
+	AfterInvocationID string
+
+	// How many invocations to look up at a time.
+	BatchSize int
+}
+
+// Stats summarizes the progress of a replay.
+type Stats struct {
+	Invocations int64
+	Failures    int64
+
+	// The ID of the last invocation that was replayed or failed, which a
+	// backfill can be resumed after.
+	LastInvocationID string
+}
+
+type Replayer struct {
+	env  environment.Env
+	opts Options
+}
+
+func New(env environment.Env, opts Options) (*Replayer, error) {
+	if env.GetDBHandle() == nil {
+		return nil, status.FailedPreconditionError("database not configured")
+	}
+	if len(opts.InvocationIDs) > 0 && opts.AfterInvocationID != "" {
+		return nil, status.InvalidArgumentError("invocation IDs and an invocation ID to resume after can't both be set")
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	return &Replayer{env: env, opts: opts}, nil
+}
+
+// Run replays the selected invocations. An invocation which fails to replay
+// is logged and skipped, so that it can be retried by replaying it again.
+func (r *Replayer) Run(ctx context.Context) (*Stats, error) {
+	stats := &Stats{LastInvocationID: r.opts.AfterInvocationID}
+	if len(r.opts.InvocationIDs) > 0 {
+		var invocations []*tables.Invocation
+		if err := r.env.GetDBHandle().WithContext(ctx).Where("invocation_id IN ?", r.opts.InvocationIDs).Order("invocation_id").Find(&invocations).Error; err != nil {
+			return stats, status.InternalErrorf("failed to look up invocations: %s", err)
+		}
+		found := make(map[string]struct{}, len(invocations))
+		for _, ti := range invocations {
+			found[ti.InvocationID] = struct{}{}
+		}
+		for _, iid := range r.opts.InvocationIDs {
+			if _, ok := found[iid]; !ok {
+				log.Warningf("Invocation %s was not found", iid)
+				stats.Failures++
+			}
+		}
+		return stats, r.replayBatch(ctx, invocations, stats)
+	}
+
+	for {
+		batch, err := r.nextBatch(ctx, stats.LastInvocationID)
+		if err != nil {
+			return stats, err
+		}
+		if len(batch) == 0 {
+			return stats, nil
+		}
+		if err := r.replayBatch(ctx, batch, stats); err != nil {
+			return stats, err
+		}
+		log.Infof("Replayed %d invocations, %d failures, up to invocation %s", stats.Invocations, stats.Failures, stats.LastInvocationID)
+	}
+}
+
+func (r *Replayer) replayBatch(ctx context.Context, batch []*tables.Invocation, stats *Stats) error {
+	for _, ti := range batch {
+		err := build_event_handler.ReplayInvocation(ctx, r.env, ti)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		stats.LastInvocationID = ti.InvocationID
+		if err != nil {
+			log.Warningf("Failed to replay invocation %s: %s", ti.InvocationID, err)
+			stats.Failures++
+			continue
+		}
+		stats.Invocations++
+	}
+	return nil
+}
+
+func (r *Replayer) nextBatch(ctx context.Context, afterInvocationID string) ([]*tables.Invocation, error) {
+	q := r.env.GetDBHandle().WithContext(ctx).Where("invocation_id > ? AND invocation_status <> ?", afterInvocationID, int64(inpb.Invocation_PARTIAL_INVOCATION_STATUS))
+	var batch []*tables.Invocation
+	if err := q.Order("invocation_id").Limit(r.opts.BatchSize).Find(&batch).Error; err != nil {
+		return nil, status.InternalErrorf("failed to look up invocations: %s", err)
+	}
+	return batch, nil
+}
@@ -0,0 +1,87 @@
+package invocation_replay_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/invocation_replay"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/protofile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+func writeEvents(t *testing.T, te *testenv.TestEnv, path string, events ...*build_event_stream.BuildEvent) {
+	ctx := context.Background()
+	w := protofile.NewBufferedProtoWriter(te.GetBlobstore(), path, 1024)
+	for _, e := range events {
+		require.NoError(t, w.WriteProtoToStream(ctx, &inpb.InvocationEvent{BuildEvent: e}))
+	}
+	require.NoError(t, w.Flush(ctx))
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+
+	invocations := []*tables.Invocation{
+		// Parsed with a stale parser that didn't record the command or the
+		// build's failure.
+		{InvocationID: "iid-1", InvocationPK: 1, Success: true, InvocationStatus: int64(inpb.Invocation_COMPLETE_INVOCATION_STATUS)},
+		{InvocationID: "iid-2", InvocationPK: 2, BlobID: "2021-03-04/iid-2", Command: "build", InvocationStatus: int64(inpb.Invocation_COMPLETE_INVOCATION_STATUS)},
+		// Still in progress, so not replayed.
+		{InvocationID: "iid-3", InvocationPK: 3, InvocationStatus: int64(inpb.Invocation_PARTIAL_INVOCATION_STATUS)},
+		// Has no stored events, so fails to replay.
+		{InvocationID: "iid-4", InvocationPK: 4, InvocationStatus: int64(inpb.Invocation_COMPLETE_INVOCATION_STATUS)},
+	}
+	for _, ti := range invocations {
+		require.NoError(t, te.GetDBHandle().Create(ti).Error)
+	}
+	writeEvents(t, te, "iid-1",
+		&build_event_stream.BuildEvent{Payload: &build_event_stream.BuildEvent_Started{Started: &build_event_stream.BuildStarted{Command: "test"}}},
+		&build_event_stream.BuildEvent{Payload: &build_event_stream.BuildEvent_BuildMetadata{BuildMetadata: &build_event_stream.BuildMetadata{Metadata: map[string]string{"VISIBILITY": "PUBLIC"}}}},
+		&build_event_stream.BuildEvent{Payload: &build_event_stream.BuildEvent_Finished{Finished: &build_event_stream.BuildFinished{ExitCode: &build_event_stream.BuildFinished_ExitCode{Code: 3}}}},
+	)
+	writeEvents(t, te, "2021-03-04/iid-2",
+		&build_event_stream.BuildEvent{Payload: &build_event_stream.BuildEvent_Started{Started: &build_event_stream.BuildStarted{Command: "test"}}},
+		&build_event_stream.BuildEvent{Payload: &build_event_stream.BuildEvent_Finished{Finished: &build_event_stream.BuildFinished{ExitCode: &build_event_stream.BuildFinished_ExitCode{}}}},
+	)
+
+	r, err := invocation_replay.New(te, invocation_replay.Options{BatchSize: 1})
+	require.NoError(t, err)
+	stats, err := r.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), stats.Invocations)
+	assert.Equal(t, int64(1), stats.Failures)
+	assert.Equal(t, "iid-4", stats.LastInvocationID)
+
+	ti := &tables.Invocation{}
+	require.NoError(t, te.GetDBHandle().Where("invocation_id = ?", "iid-1").Take(ti).Error)
+	assert.Equal(t, "test", ti.Command)
+	assert.False(t, ti.Success)
+	var metadata []*tables.InvocationBuildMetadata
+	require.NoError(t, te.GetDBHandle().Where("invocation_id = ?", "iid-1").Find(&metadata).Error)
+	require.Len(t, metadata, 1)
+	assert.Equal(t, "VISIBILITY", metadata[0].MetadataKey)
+
+	ti = &tables.Invocation{}
+	require.NoError(t, te.GetDBHandle().Where("invocation_id = ?", "iid-2").Take(ti).Error)
+	assert.Equal(t, "test", ti.Command)
+	assert.True(t, ti.Success)
+
+	// Replaying a single invocation.
+	require.NoError(t, te.GetDBHandle().Model(&tables.Invocation{}).Where("invocation_id = ?", "iid-1").Update("command", "").Error)
+	r, err = invocation_replay.New(te, invocation_replay.Options{InvocationIDs: []string{"iid-1", "iid-5"}})
+	require.NoError(t, err)
+	stats, err = r.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stats.Invocations)
+	assert.Equal(t, int64(1), stats.Failures)
+	ti = &tables.Invocation{}
+	require.NoError(t, te.GetDBHandle().Where("invocation_id = ?", "iid-1").Take(ti).Error)
+	assert.Equal(t, "test", ti.Command)
+}
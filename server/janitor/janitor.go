@@ -5,9 +5,11 @@ import (
 	"flag"
 	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/tags"
 )
 
 var (
@@ -22,46 +24,131 @@ type Janitor struct {
 
 	env environment.Env
 	ttl time.Duration
+	// Rules overriding the TTL of invocations with certain tags.
+	tagRetention []tagRetentionRule
+	// Rules limiting how much of certain groups' invocations are kept.
+	groupRetention []groupRetentionRule
+	// How long trashed invocations are kept before they're deleted.
+	trashRetention time.Duration
+}
+
+// tagRetentionRule overrides the TTL of invocations with a tag. A TTL of 0
+// means that they're kept forever.
+type tagRetentionRule struct {
+	tag string
+	ttl time.Duration
+}
+
+// groupRetentionRule limits how long a group's invocations are kept, and the
+// total size of their build events. 0 means no limit.
+type groupRetentionRule struct {
+	groupID       string
+	maxAge        time.Duration
+	maxTotalBytes int64
 }
 
 func NewJanitor(env environment.Env) *Janitor {
+	var tagRetention []tagRetentionRule
+	for _, rc := range env.GetConfigurator().GetStorageTagRetention() {
+		tagRetention = append(tagRetention, tagRetentionRule{
+			tag: tags.Normalize(rc.Tag),
+			ttl: time.Duration(rc.TTLSeconds) * time.Second,
+		})
+	}
+	var groupRetention []groupRetentionRule
+	for _, rc := range env.GetConfigurator().GetStorageGroupRetention() {
+		groupRetention = append(groupRetention, groupRetentionRule{
+			groupID:       rc.GroupID,
+			maxAge:        time.Duration(rc.MaxAgeSeconds) * time.Second,
+			maxTotalBytes: rc.MaxTotalBytes,
+		})
+	}
 	return &Janitor{
-		env: env,
-		ttl: time.Duration(env.GetConfigurator().GetStorageTTLSeconds()) * time.Second,
+		env:            env,
+		ttl:            time.Duration(env.GetConfigurator().GetStorageTTLSeconds()) * time.Second,
+		tagRetention:   tagRetention,
+		groupRetention: groupRetention,
+		trashRetention: time.Duration(env.GetConfigurator().GetStorageTrashRetentionSeconds()) * time.Second,
 	}
 }
 
-func (j *Janitor) deleteInvocation(invocation *tables.Invocation) {
-	ctx := context.Background()
-	if err := j.env.GetBlobstore().DeleteBlob(ctx, invocation.BlobID); err != nil && *logDeletionErrors {
-		log.Warningf("Error deleting blob (%s): %s", invocation.BlobID, err)
+// retainedTags returns the tags of invocations that must be kept for longer
+// than the given TTL, where 0 means forever.
+func (j *Janitor) retainedTags(ttl time.Duration) []string {
+	var retained []string
+	for _, r := range j.tagRetention {
+		if ttl == 0 || r.ttl == 0 || r.ttl > ttl {
+			retained = append(retained, r.tag)
+		}
 	}
+	return retained
+}
 
-	// Try to delete the row too, even if blob deletion failed.
-	if err := j.env.GetInvocationDB().DeleteInvocation(ctx, invocation.InvocationID); err != nil && *logDeletionErrors {
+func (j *Janitor) deleteInvocation(invocation *tables.Invocation, reason string) {
+	if err := build_event_handler.DeleteInvocation(context.Background(), j.env, invocation, reason); err != nil && *logDeletionErrors {
 		log.Warningf("Error deleting invocation (%s): %s", invocation.InvocationID, err)
 	}
 }
 
 func (j *Janitor) deleteExpiredInvocations() {
 	ctx := context.Background()
-	cutoff := time.Now().Add(-1 * j.ttl)
-	expired, err := j.env.GetInvocationDB().LookupExpiredInvocations(ctx, cutoff, 10)
-	if err != nil && *logDeletionErrors {
-		log.Warningf("Error finding expired deletions: %s", err)
+	if j.ttl > 0 {
+		// Invocations with a tag retention rule are deleted by that rule
+		// instead.
+		allRuleTags := j.retainedTags(0)
+		expired, err := j.env.GetInvocationDB().LookupExpiredInvocations(ctx, j.env.GetClock().Now().Add(-1*j.ttl), allRuleTags, 10)
+		j.deleteInvocations(expired, err, build_event_handler.TTLDeletionReason)
+	}
+	for _, r := range j.tagRetention {
+		if r.ttl == 0 {
+			continue
+		}
+		expired, err := j.env.GetInvocationDB().LookupExpiredTaggedInvocations(ctx, r.tag, j.env.GetClock().Now().Add(-1*r.ttl), j.retainedTags(r.ttl), 10)
+		j.deleteInvocations(expired, err, build_event_handler.TagTTLDeletionReason)
+	}
+	if j.trashRetention > 0 {
+		expired, err := j.env.GetInvocationDB().LookupExpiredTrashedInvocations(ctx, j.env.GetClock().Now().Add(-1*j.trashRetention), 10)
+		j.deleteInvocations(expired, err, build_event_handler.TrashDeletionReason)
+	}
+	for _, r := range j.groupRetention {
+		if r.maxAge > 0 {
+			expired, err := j.env.GetInvocationDB().LookupExpiredGroupInvocations(ctx, r.groupID, j.env.GetClock().Now().Add(-1*r.maxAge), 10)
+			j.deleteInvocations(expired, err, build_event_handler.GroupMaxAgeDeletionReason)
+		}
+		if r.maxTotalBytes > 0 {
+			excess, err := j.env.GetInvocationDB().LookupExcessGroupInvocations(ctx, r.groupID, r.maxTotalBytes, 10)
+			j.deleteInvocations(excess, err, build_event_handler.GroupMaxSizeDeletionReason)
+		}
+	}
+}
+
+func (j *Janitor) deleteInvocations(expired []*tables.Invocation, err error, reason string) {
+	if err != nil {
+		if *logDeletionErrors {
+			log.Warningf("Error finding expired deletions: %s", err)
+		}
 		return
 	}
 
 	for _, exp := range expired {
-		j.deleteInvocation(exp)
+		j.deleteInvocation(exp, reason)
+	}
+}
+
+func (j *Janitor) hasExpiringTags() bool {
+	for _, r := range j.tagRetention {
+		if r.ttl > 0 {
+			return true
+		}
 	}
+	return false
 }
 
 func (j *Janitor) Start() {
 	j.ticker = time.NewTicker(*cleanupInterval)
 	j.quit = make(chan struct{})
 
-	if j.ttl == 0 {
+	if j.ttl == 0 && !j.hasExpiringTags() && j.trashRetention == 0 && len(j.groupRetention) == 0 {
 		log.Infof("Configured TTL was 0; disabling invocation janitor")
 		return
 	}
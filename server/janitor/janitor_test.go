@@ -0,0 +1,129 @@
+package janitor
+
+import (
+	"context"
+	"hash/fnv"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/protofile"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteExpiredInvocations(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	clock := te.UseFakeClock()
+	err := te.GetInvocationDB().InsertOrUpdateInvocation(ctx, &tables.Invocation{InvocationID: "IID1", BlobID: "IID1"})
+	require.NoError(t, err)
+	_, err = te.GetBlobstore().WriteBlob(ctx, protofile.ChunkName("IID1", 0), []byte("events"))
+	require.NoError(t, err)
+
+	j := NewJanitor(te)
+	j.ttl = 24 * time.Hour
+
+	clock.Advance(23 * time.Hour)
+	j.deleteExpiredInvocations()
+	_, err = te.GetInvocationDB().LookupInvocation(ctx, "IID1")
+	assert.NoError(t, err, "invocation should be kept until its TTL elapsed")
+
+	clock.Advance(2 * time.Hour)
+	j.deleteExpiredInvocations()
+	_, err = te.GetInvocationDB().LookupInvocation(ctx, "IID1")
+	assert.Error(t, err, "invocation should be deleted once its TTL elapsed")
+	exists, err := te.GetBlobstore().BlobExists(ctx, protofile.ChunkName("IID1", 0))
+	require.NoError(t, err)
+	assert.False(t, exists, "invocation's blobs should be deleted along with it")
+}
+
+func TestPurgeTrashedInvocations(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	clock := te.UseFakeClock()
+	err := te.GetInvocationDB().InsertOrUpdateInvocation(ctx, &tables.Invocation{InvocationID: "IID1", BlobID: "IID1"})
+	require.NoError(t, err)
+	err = te.GetDBHandle().Exec(`UPDATE Invocations SET deleted_at_usec = ? WHERE invocation_id = ?`, timeutil.ToUsec(clock.Now()), "IID1").Error
+	require.NoError(t, err)
+
+	j := NewJanitor(te)
+	j.trashRetention = 7 * 24 * time.Hour
+
+	countInvocations := func() int64 {
+		var count int64
+		err := te.GetDBHandle().Model(&tables.Invocation{}).Where("invocation_id = ?", "IID1").Count(&count).Error
+		require.NoError(t, err)
+		return count
+	}
+
+	clock.Advance(6 * 24 * time.Hour)
+	j.deleteExpiredInvocations()
+	assert.Equal(t, int64(1), countInvocations(), "trashed invocation should be kept until the trash retention elapsed")
+
+	clock.Advance(2 * 24 * time.Hour)
+	j.deleteExpiredInvocations()
+	assert.Equal(t, int64(0), countInvocations(), "trashed invocation should be purged once the trash retention elapsed")
+}
+
+// insertGroupInvocation inserts a completed invocation of the group, created
+// the given time ago, with the given size of stored build events.
+func insertGroupInvocation(t *testing.T, te *testenv.TestEnv, iid, groupID string, age time.Duration, storedEventBytes int64) {
+	pk := fnv.New64a()
+	pk.Write([]byte(iid))
+	err := te.GetDBHandle().Create(&tables.Invocation{
+		InvocationID:     iid,
+		InvocationPK:     int64(pk.Sum64()),
+		BlobID:           iid,
+		GroupID:          groupID,
+		StoredEventBytes: storedEventBytes,
+	}).Error
+	require.NoError(t, err)
+	err = te.GetDBHandle().Exec(`UPDATE Invocations SET created_at_usec = ? WHERE invocation_id = ?`, timeutil.ToUsec(te.GetClock().Now().Add(-age)), iid).Error
+	require.NoError(t, err)
+}
+
+func remainingInvocations(t *testing.T, te *testenv.TestEnv) []string {
+	var iids []string
+	err := te.GetDBHandle().Model(&tables.Invocation{}).Order("invocation_id").Pluck("invocation_id", &iids).Error
+	require.NoError(t, err)
+	return iids
+}
+
+func TestGroupRetentionMaxAge(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.UseFakeClock()
+	insertGroupInvocation(t, te, "IID1", "GR1", 2*time.Hour, 100)
+	insertGroupInvocation(t, te, "IID2", "GR1", 30*time.Minute, 100)
+	insertGroupInvocation(t, te, "IID3", "GR2", 2*time.Hour, 100)
+
+	j := NewJanitor(te)
+	j.groupRetention = []groupRetentionRule{{groupID: "GR1", maxAge: time.Hour}}
+	j.deleteExpiredInvocations()
+
+	assert.Equal(t, []string{"IID2", "IID3"}, remainingInvocations(t, te))
+}
+
+func TestGroupRetentionMaxTotalBytes(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.UseFakeClock()
+	insertGroupInvocation(t, te, "IID1", "GR1", 3*time.Hour, 100)
+	insertGroupInvocation(t, te, "IID2", "GR1", 2*time.Hour, 100)
+	insertGroupInvocation(t, te, "IID3", "GR1", time.Hour, 100)
+	// Invocations that are still in progress have no stored size yet, and
+	// are never deleted to make room.
+	insertGroupInvocation(t, te, "IID4", "GR1", 4*time.Hour, 0)
+	insertGroupInvocation(t, te, "IID5", "GR2", 4*time.Hour, 1000)
+
+	j := NewJanitor(te)
+	j.groupRetention = []groupRetentionRule{{groupID: "GR1", maxTotalBytes: 150}}
+	j.deleteExpiredInvocations()
+
+	assert.Equal(t, []string{"IID3", "IID4", "IID5"}, remainingInvocations(t, te))
+
+	// Once within the limit, nothing else is deleted.
+	j.deleteExpiredInvocations()
+	assert.Equal(t, []string{"IID3", "IID4", "IID5"}, remainingInvocations(t, te))
+}
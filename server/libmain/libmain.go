@@ -12,19 +12,24 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/disk_cache"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/github"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/invocation_cache"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/invocationdb"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_kvstore"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_metrics_collector"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/repo_downloader"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/slack"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_handler"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_hooks"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_proxy"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_server"
 	"github.com/buildbuddy-io/buildbuddy/server/buildbuddy_server"
+	"github.com/buildbuddy-io/buildbuddy/server/ci_export"
 	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/http/protolet"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/notifications"
 	"github.com/buildbuddy-io/buildbuddy/server/nullauth"
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_asset/fetch_server"
@@ -33,10 +38,15 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/byte_stream_server"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/capabilities_server"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/content_addressable_storage_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest_migration"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/instance_name_alias"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/retention"
 	"github.com/buildbuddy-io/buildbuddy/server/splash"
 	"github.com/buildbuddy-io/buildbuddy/server/ssl"
 	"github.com/buildbuddy-io/buildbuddy/server/static"
+	"github.com/buildbuddy-io/buildbuddy/server/util/api_error"
 	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/deadline"
 	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_server"
 	"github.com/buildbuddy-io/buildbuddy/server/util/healthcheck"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
@@ -149,6 +159,17 @@ func GetConfiguredEnvironmentOrDie(configurator *config.Configurator, healthChec
 	if err != nil {
 		log.Fatalf("Error configuring blobstore: %s", err)
 	}
+	// Blobstore calls are given the budget of the request being served, so
+	// that they fail fast once the client has given up.
+	bs = deadline.Blobstore(bs)
+	var wal *blobstore.WriteAheadBlobstore
+	if dir := configurator.GetStorageWriteAheadLogDir(); dir != "" {
+		wal, err = blobstore.NewWriteAheadBlobstore(bs, dir)
+		if err != nil {
+			log.Fatalf("Error configuring blobstore write-ahead log: %s", err)
+		}
+		bs = wal
+	}
 	dbHandle, err := db.GetConfiguredDatabase(configurator, healthChecker)
 	if err != nil {
 		log.Fatalf("Error configuring database: %s", err)
@@ -158,7 +179,24 @@ func GetConfiguredEnvironmentOrDie(configurator *config.Configurator, healthChec
 	configureFilesystemsOrDie(realEnv)
 	realEnv.SetDBHandle(dbHandle)
 	realEnv.SetBlobstore(bs)
+	blobstoreBackends, err := blobstore.GetConfiguredBackends(configurator, bs)
+	if err != nil {
+		log.Fatalf("Error configuring blobstore backends: %s", err)
+	}
+	realEnv.SetBlobstoreBackends(blobstoreBackends)
 	realEnv.SetInvocationDB(invocationdb.NewInvocationDB(realEnv, dbHandle))
+	if wal != nil {
+		wal.Start(healthChecker, func(ctx context.Context, blobName string) {
+			build_event_handler.OnBlobPersisted(ctx, realEnv, blobName)
+		})
+	}
+	if cacheSizeBytes := configurator.GetStorageInvocationCacheSizeBytes(); cacheSizeBytes > 0 {
+		ic, err := invocation_cache.NewInvocationCache(cacheSizeBytes)
+		if err != nil {
+			log.Fatalf("Error configuring invocation cache: %s", err)
+		}
+		realEnv.SetInvocationCache(ic)
+	}
 	realEnv.SetAuthenticator(&nullauth.NullAuthenticator{})
 
 	webhooks := make([]interfaces.Webhook, 0)
@@ -168,7 +206,18 @@ func GetConfiguredEnvironmentOrDie(configurator *config.Configurator, healthChec
 			webhooks = append(webhooks, slack.NewSlackWebhook(sc.WebhookURL, appURL))
 		}
 	}
+	if cc := configurator.GetIntegrationsCIExportConfig(); ci_export.IsConfigured(cc) {
+		webhooks = append(webhooks, ci_export.NewExporter(cc, appURL))
+	}
 	realEnv.SetWebhooks(webhooks)
+	if nc := configurator.GetIntegrationsNotificationsConfig(); len(nc.Rules) > 0 {
+		router, err := notifications.NewRouter(realEnv, nc, appURL)
+		if err != nil {
+			log.Fatalf("Error configuring notifications: %s", err)
+		}
+		realEnv.SetNotificationRouter(router)
+	}
+	realEnv.SetBuildEventHooks(build_event_hooks.Registered())
 
 	buildEventProxyClients := make([]pepb.PublishBuildEventClient, 0)
 	for _, target := range configurator.GetBuildEventProxyHosts() {
@@ -180,6 +229,26 @@ func GetConfiguredEnvironmentOrDie(configurator *config.Configurator, healthChec
 	realEnv.SetBuildEventProxyClients(buildEventProxyClients)
 	realEnv.SetBuildEventHandler(build_event_handler.NewBuildEventHandler(realEnv))
 
+	realEnv.SetInstanceNameAliasService(instance_name_alias.NewService(realEnv))
+
+	// Retention classes are set up before the cache, so that the cache's
+	// statusz section replaces those of any disk-backed classes.
+	if classes := configurator.GetCacheRetentionClasses(); len(classes) > 0 {
+		rs, err := retention.NewStore(classes)
+		if err != nil {
+			log.Fatalf("Error configuring cache retention classes: %s", err)
+		}
+		realEnv.SetRetentionStore(rs)
+	}
+
+	if configurator.GetCacheDigestMigrationConfig().Enabled {
+		m, err := digest_migration.NewMigrator(realEnv)
+		if err != nil {
+			log.Fatalf("Error configuring digest migration: %s", err)
+		}
+		realEnv.SetDigestMigrator(m)
+	}
+
 	// If configured, enable the cache.
 	var cache interfaces.Cache
 	if configurator.GetCacheInMemory() {
@@ -212,6 +281,11 @@ func GetConfiguredEnvironmentOrDie(configurator *config.Configurator, healthChec
 		log.Fatalf("Error configuring in-memory metrics collector: %s", err.Error())
 	}
 	realEnv.SetMetricsCollector(collector)
+	keyValStore, err := memory_kvstore.NewMemoryKeyValStore()
+	if err != nil {
+		log.Fatalf("Error configuring in-memory key value store: %s", err.Error())
+	}
+	realEnv.SetKeyValStore(keyValStore)
 	realEnv.SetRepoDownloader(repo_downloader.NewRepoDownloader())
 	return realEnv
 }
@@ -268,7 +342,7 @@ func StartBuildEventServicesOrDie(env environment.Env, grpcServer *grpc.Server)
 	}
 	// Register to handle GetCapabilities messages, which tell the client
 	// that this server supports CAS functionality.
-	capabilitiesServer := capabilities_server.NewCapabilitiesServer( /*supportCAS=*/ enableCache /*supportRemoteExec=*/, enableRemoteExec)
+	capabilitiesServer := capabilities_server.NewCapabilitiesServer(env /*supportCAS=*/, enableCache /*supportRemoteExec=*/, enableRemoteExec)
 	repb.RegisterCapabilitiesServer(grpcServer, capabilitiesServer)
 }
 
@@ -351,6 +425,9 @@ func StartAndRunServices(env environment.Env) {
 	}
 
 	monitoring.StartMonitoringHandler(fmt.Sprintf("%s:%d", *listen, *monitoringPort))
+	if err := monitoring.StartMetricsExporters(env, "buildbuddy"); err != nil {
+		log.Fatalf("Could not start exporting metrics: %s", err)
+	}
 
 	grpcServer := StartGRPCServiceOrDie(env, buildBuddyServer, GRPCPort, nil)
 
@@ -386,7 +463,7 @@ func StartAndRunServices(env environment.Env) {
 	// Register API as an HTTP service.
 	apiConfig := env.GetConfigurator().GetAPIConfig()
 	if api := env.GetAPIService(); apiConfig != nil && apiConfig.EnableAPI && api != nil {
-		apiProtoHandlers, err := protolet.GenerateHTTPHandlers(api)
+		apiProtoHandlers, err := protolet.GenerateHTTPHandlersWithErrorWriter(api, api_error.WriteHTTPError)
 		if err != nil {
 			log.Fatalf("Error initializing RPC over HTTP handlers for API: %s", err)
 		}
@@ -399,6 +476,16 @@ func StartAndRunServices(env environment.Env) {
 		mux.Handle("/webhooks/workflow/", httpfilters.WrapExternalHandler(env, wfs))
 	}
 
+	if es := env.GetInvocationExportService(); es != nil {
+		// Download URLs are signed, so the requests aren't authenticated.
+		mux.Handle("/export/download", httpfilters.WrapExternalHandler(env, es))
+	}
+
+	if app := env.GetGitHubApp(); app != nil {
+		mux.Handle("/webhooks/github/app", httpfilters.WrapExternalHandler(env, app))
+		mux.Handle("/auth/github/app/link/", httpfilters.WrapAuthenticatedExternalHandler(env, http.HandlerFunc(app.Link)))
+	}
+
 	handler := http.Handler(mux)
 	if env.GetConfigurator().GetGRPCOverHTTPPortEnabled() {
 		handler = httpfilters.ServeGRPCOverHTTPPort(grpcServer, mux)
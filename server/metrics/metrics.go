@@ -33,9 +33,24 @@ const (
 	/// Cache event type: `hit`, `miss`, or `upload`.
 	CacheEventTypeLabel = "cache_event_type"
 
+	/// Source of an action result uploaded to the action cache: `local` for
+	/// results of actions executed by the client itself (such as with Bazel's
+	/// `--remote_upload_local_results`), or `remote` for results of actions
+	/// executed by BuildBuddy executors.
+	ActionResultSourceLabel = "source"
+
+	/// Outcome of an action result upload: `stored`, `invalid` if the result
+	/// was rejected because it was malformed or referenced outputs missing
+	/// from the CAS, or `read_only` if the result was ignored because the
+	/// API key isn't allowed to write to the cache.
+	ActionResultUploadOutcomeLabel = "outcome"
+
 	/// Process exit code of an executed action.
 	ExitCodeLabel = "exit_code"
 
+	/// Name of the signal that killed a crashed action, such as `SIGSEGV`.
+	CrashSignalLabel = "signal"
+
 	/// SQL query before substituting template parameters.
 	SQLQueryTemplateLabel = "sql_query_template"
 
@@ -89,6 +104,70 @@ const (
 	/// Reason for a runner not being added to the runner pool.
 	RunnerPoolFailedRecycleReason = "reason"
 
+	/// Environment variable name pattern, as configured in
+	/// `remote_execution.env_normalization`.
+	EnvironmentVariableLabel = "env_var"
+
+	/// Type of resource cleaned up by the executor janitor: `workspace`,
+	/// `container`, or `mount`.
+	JanitorResourceTypeLabel = "resource_type"
+
+	/// Remote execution executor pool name.
+	ExecutorPoolLabel = "pool"
+
+	/// Executor OS and architecture, as `os/arch`, such as `linux/amd64`.
+	ExecutorPlatformLabel = "platform"
+
+	/// Stage that a remote execution was last known to be in: `unknown`,
+	/// `cache_check`, `queued`, or `executing`.
+	ExecutionStageLabel = "execution_stage"
+
+	/// Kind of build event work shed under load: `progress` (deferred),
+	/// `anonymous_start`, `start`, or `ci_start` (rejected).
+	BuildEventShedPriorityLabel = "priority"
+
+	/// Platform property name, as configured in an organization's platform
+	/// property policy.
+	PlatformPropertyLabel = "platform_property"
+
+	/// Reason an Execute request was rejected before being queued, such as
+	/// `missing_action`, `malformed_command`, `invalid_platform`, or
+	/// `invalid_timeout`.
+	ExecuteRejectionReason = "reason"
+
+	/// Direction of a cache transfer: `upload` or `download`.
+	TransferDirectionLabel = "direction"
+
+	/// Name of a cache endpoint that a cache client fails over between, such
+	/// as its target.
+	CacheEndpointLabel = "endpoint"
+
+	/// Operation moving an invocation between regular and archive storage:
+	/// `archive` or `restore`.
+	InvocationArchiveOperationLabel = "operation"
+
+	/// Why an invocation was permanently deleted: `ttl`, `tag_ttl`,
+	/// `group_max_age`, `group_max_size`, `trash` (it was in the trash for
+	/// longer than the trash retention), or `manual` (deleted through the API).
+	InvocationDeletionReasonLabel = "deletion_reason"
+
+	/// Outcome of copying a SHA256 blob to its BLAKE3 digest: `copied`,
+	/// `already_copied`, `dropped` (the queue was full), or `failed`.
+	DigestMigrationOutcomeLabel = "outcome"
+
+	/// Name of a shim that moved fields of a build event sent by an older
+	/// Bazel version to their current location, such as `finished_exit_code`
+	/// or `action_completed_id`.
+	BuildEventShimLabel = "shim"
+
+	/// Name of a notification destination, as configured in
+	/// `integrations.notifications.destinations`.
+	NotificationDestinationLabel = "destination"
+
+	/// Event that a notification is about: `invocation_complete`,
+	/// `cache_hit_rate_drop`, or `usage_warning`.
+	NotificationEventLabel = "notification_event"
+
 	// GroupID associated with the request.
 	GroupID = "group_id"
 )
@@ -166,6 +245,137 @@ var (
 	/// sum(rate(buildbuddy_invocation_build_event_count[5m]))
 	/// ```
 
+	BuildEventShedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "invocation",
+		Name:      "build_event_shed_count",
+		Help:      "Number of build events whose handling was deferred, or build event streams that were rejected, because too many build events were being handled at once.",
+	}, []string{
+		BuildEventShedPriorityLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Rejected build event streams per second, by priority
+	/// sum by (priority) (rate(buildbuddy_invocation_build_event_shed_count{priority!="progress"}[5m]))
+	/// ```
+
+	InvocationCacheEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "invocation",
+		Name:      "cache_events",
+		Help:      "Number of lookups of parsed invocations in the in-memory invocation cache.",
+	}, []string{
+		CacheEventTypeLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Invocation cache hit rate
+	/// sum(rate(buildbuddy_invocation_cache_events{cache_event_type="hit"}[5m]))
+	///   /
+	/// sum(rate(buildbuddy_invocation_cache_events[5m]))
+	/// ```
+
+	InvocationCorruptedEventStreamCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "invocation",
+		Name:      "corrupted_event_stream_count",
+		Help:      "Number of times that an invocation's stored build events didn't match the checksum recorded when they were written, which indicates that the blobstore or a proxy in front of it corrupted them.",
+	})
+
+	InvocationCacheSizeBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "invocation",
+		Name:      "cache_size_bytes",
+		Help:      "Approximate size of the parsed invocations held in the in-memory invocation cache, in **bytes**.",
+	})
+
+	InvocationArchiveCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "invocation",
+		Name:      "archive_count",
+		Help:      "Number of invocations moved to archive storage, or restored from it, if `storage.archive` is configured.",
+	}, []string{
+		InvocationArchiveOperationLabel,
+		StatusLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Archived invocations restored per second, because they were looked up
+	/// sum(rate(buildbuddy_invocation_archive_count{operation="restore",status="0"}[5m]))
+	/// ```
+
+	InvocationDeletionCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "invocation",
+		Name:      "deletion_count",
+		Help:      "Number of invocations permanently deleted, along with their blobs, by the retention janitor or through the API.",
+	}, []string{
+		InvocationDeletionReasonLabel,
+		StatusLabel,
+	})
+
+	InvocationDeletedEventBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "invocation",
+		Name:      "deleted_event_bytes",
+		Help:      "Bytes of stored build events of permanently deleted invocations, in **bytes**.",
+	}, []string{
+		InvocationDeletionReasonLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Invocations deleted per second because their group exceeded its
+	/// # storage limit
+	/// sum(rate(buildbuddy_invocation_deletion_count{deletion_reason="group_max_size",status="0"}[5m]))
+	///
+	/// # Invocations whose deletion failed, by reason
+	/// sum by (deletion_reason) (increase(buildbuddy_invocation_deletion_count{status!="0"}[1h]))
+	/// ```
+
+	BuildEventUploadLagUsec = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: bbNamespace,
+		Subsystem: "invocation",
+		Name:      "build_event_upload_lag_usec",
+		Buckets:   prometheus.ExponentialBuckets(1, 10, 9),
+		Help:      "The time between Bazel creating each build event and BuildBuddy receiving it, in **microseconds**. Includes any clock skew between Bazel's host and BuildBuddy.",
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # 95th percentile build event upload lag
+	/// histogram_quantile(
+	///   0.95,
+	///   sum(rate(buildbuddy_invocation_build_event_upload_lag_usec_bucket[5m])) by (le)
+	/// )
+	/// ```
+
+	SlowBuildEventUploadCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "invocation",
+		Name:      "slow_build_event_upload_count",
+		Help:      "Number of invocations where uploading build events to BuildBuddy took a significant part of the invocation's duration, after the build itself had finished.",
+	}, []string{
+		BazelCommand,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Fraction of invocations bottlenecked by build event upload
+	/// sum(rate(buildbuddy_invocation_slow_build_event_upload_count[5m]))
+	///   /
+	/// sum(rate(buildbuddy_invocation_count[5m]))
+	/// ```
+
 	/// ## Remote cache metrics
 	///
 	/// NOTE: Cache metrics are recorded at the end of each invocation,
@@ -255,6 +465,126 @@ var (
 	/// )
 	/// ```
 
+	ActionResultUploads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "action_result_uploads",
+		Help:      "Number of action results uploaded to the action cache.",
+	}, []string{
+		ActionResultSourceLabel,
+		ActionResultUploadOutcomeLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Fraction of stored action results that were executed locally
+	/// sum(rate(buildbuddy_remote_cache_action_result_uploads{outcome="stored",source="local"}[5m]))
+	///   /
+	/// sum(rate(buildbuddy_remote_cache_action_result_uploads{outcome="stored"}[5m]))
+	/// ```
+
+	CacheClientTransferThroughputBytesPerSecond = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "client_transfer_throughput_bytes_per_second",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+		Help:      "Throughput of each CAS transfer made by a cache client, such as an executor, in **bytes per second**. A transfer is a single ByteStream read or write, or a single batch request.",
+	}, []string{
+		TransferDirectionLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Median upload throughput of executors
+	/// histogram_quantile(
+	///   0.5,
+	///   sum(rate(buildbuddy_remote_cache_client_transfer_throughput_bytes_per_second_bucket{direction="upload"}[5m])) by (le)
+	/// )
+	/// ```
+
+	CacheClientThrottledDurationUsec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "client_throttled_duration_usec",
+		Help:      "Total time that CAS transfers made by a cache client waited on its configured bandwidth limits, in **microseconds**.",
+	}, []string{
+		TransferDirectionLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Fraction of time that uploads are throttled
+	/// sum(rate(buildbuddy_remote_cache_client_throttled_duration_usec{direction="upload"}[5m])) / 1e6
+	/// ```
+
+	CacheClientFallbackReads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "client_fallback_reads",
+		Help:      "Number of cache reads that a cache client sent to a fallback endpoint, because the endpoints before it were unhealthy or failed the read.",
+	}, []string{
+		CacheEndpointLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Rate of reads served by each fallback endpoint
+	/// sum by (endpoint) (rate(buildbuddy_remote_cache_client_fallback_reads[5m]))
+	/// ```
+
+	CacheClientEndpointHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "client_endpoint_healthy",
+		Help:      "Whether a cache client considers a cache endpoint healthy (1) or is failing reads over from it (0).",
+	}, []string{
+		CacheEndpointLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Number of clients failing over from each endpoint
+	/// count by (endpoint) (buildbuddy_remote_cache_client_endpoint_healthy == 0)
+	/// ```
+
+	DigestMigrationBlobs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "digest_migration_blobs",
+		Help:      "Number of SHA256 blobs in use that were handled by the digest migration, if `cache.digest_migration` is enabled.",
+	}, []string{
+		DigestMigrationOutcomeLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Fraction of the blobs in use that were already copied to their BLAKE3
+	/// # digests, which approaches 1 as the migration completes
+	/// sum(rate(buildbuddy_remote_cache_digest_migration_blobs{outcome="already_copied"}[1h]))
+	///   /
+	/// sum(rate(buildbuddy_remote_cache_digest_migration_blobs{outcome=~"copied|already_copied"}[1h]))
+	/// ```
+
+	DigestMigrationCopiedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "digest_migration_copied_bytes",
+		Help:      "Number of bytes of SHA256 blobs copied to their BLAKE3 digests by the digest migration.",
+	})
+
+	DigestMigrationQueueLength = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "digest_migration_queue_length",
+		Help:      "Number of blobs waiting to be copied by the digest migration.",
+	})
+
 	/// ## Remote execution metrics
 
 	RemoteExecutionCount = promauto.NewCounterVec(prometheus.CounterOpts{
@@ -273,6 +603,22 @@ var (
 	/// sum(rate(buildbuddy_remote_execution_count[5m]))
 	/// ```
 
+	RemoteExecutionCrashReports = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "crash_reports",
+		Help:      "Number of crash reports captured for actions that crashed on an executor.",
+	}, []string{
+		CrashSignalLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Rate of segfaulting actions
+	/// sum(rate(buildbuddy_remote_execution_crash_reports{signal="SIGSEGV"}[5m]))
+	/// ```
+
 	RemoteExecutionExecutedActionMetadataDurationsUsec = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: bbNamespace,
 		Subsystem: "remote_execution",
@@ -308,6 +654,90 @@ var (
 	/// )
 	/// ```
 
+	RemoteExecutionQueueTimeoutCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "queue_timeout_count",
+		Help:      "Number of tasks failed because no executor picked them up within the maximum queue duration.",
+	}, []string{
+		GroupID,
+		ExecutorPoolLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Queue timeouts per second, by pool
+	/// sum by (pool) (rate(buildbuddy_remote_execution_queue_timeout_count[5m]))
+	/// ```
+
+	RemoteExecutionStaleExecutionCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "stale_execution_count",
+		Help:      "Number of executions failed because they didn't complete or report progress within the stale execution timeout.",
+	}, []string{
+		GroupID,
+		ExecutionStageLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Stale executions failed per hour, by the stage they were stuck in
+	/// sum by (execution_stage) (increase(buildbuddy_remote_execution_stale_execution_count[1h]))
+	/// ```
+
+	RemoteExecutionRejectedExecuteRequestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "rejected_execute_request_count",
+		Help:      "Number of Execute requests rejected before being queued, because their action or command was missing or malformed.",
+	}, []string{
+		GroupID,
+		ExecuteRejectionReason,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Rejected Execute requests per hour, by reason
+	/// sum by (reason) (increase(buildbuddy_remote_execution_rejected_execute_request_count[1h]))
+	/// ```
+
+	RemoteExecutionPlatformPropertyOverrideCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "platform_property_override_count",
+		Help:      "Number of executions whose platform property value was replaced by their organization's forced platform properties.",
+	}, []string{
+		GroupID,
+		PlatformPropertyLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Overridden platform property values per hour, by property
+	/// sum by (platform_property) (increase(buildbuddy_remote_execution_platform_property_override_count[1h]))
+	/// ```
+
+	RemoteExecutionCacheWarmingCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "cache_warming_count",
+		Help:      "Number of actions re-run to warm the action cache.",
+	}, []string{
+		GroupID,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Actions re-run to warm the cache per day, by group
+	/// sum by (group_id) (increase(buildbuddy_remote_execution_cache_warming_count[1d]))
+	/// ```
+
 	RemoteExecutionQueueLength = promauto.NewGauge(prometheus.GaugeOpts{
 		Namespace: bbNamespace,
 		Subsystem: "remote_execution",
@@ -462,6 +892,168 @@ var (
 		Help:      "Total disk usage of pooled command runners, in **bytes**.",
 	})
 
+	EnvNormalizationCacheHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "env_normalization_cache_hits",
+		Help:      "Number of action cache hits that were only possible because of environment variable normalization, by the normalized environment variable. Variables with high counts are the ones that most often break caching.",
+	}, []string{
+		EnvironmentVariableLabel,
+	})
+
+	JanitorRemovedResources = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "janitor_removed_resources",
+		Help:      "Number of orphaned workspaces, containers, and mounts removed by the executor janitor.",
+	}, []string{
+		JanitorResourceTypeLabel,
+	})
+
+	JanitorReclaimedDiskBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "janitor_reclaimed_disk_bytes",
+		Help:      "Disk space reclaimed by the executor janitor, in **bytes**.",
+	}, []string{
+		JanitorResourceTypeLabel,
+	})
+
+	LocalActionCacheEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_execution",
+		Name:      "local_action_cache_events",
+		Help:      "Number of lookups in executors' local action caches, by whether the result was a `hit`, a `miss`, or `invalid` because it expired or its outputs were missing.",
+	}, []string{
+		CacheEventTypeLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Local action cache hit rate
+	/// sum(rate(buildbuddy_remote_execution_local_action_cache_events{cache_event_type="hit"}[5m]))
+	///   /
+	/// sum(rate(buildbuddy_remote_execution_local_action_cache_events[5m]))
+	/// ```
+
+	/// ## Scheduler metrics
+	///
+	/// The scheduler queues the tasks of execution requests until an executor
+	/// in a matching pool claims them. Tasks are labeled by the pool and
+	/// platform that they were queued for.
+
+	SchedulerTasksEnqueued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "scheduler",
+		Name:      "tasks_enqueued",
+		Help:      "Number of tasks queued for execution, including tasks queued again after an executor failed to finish them.",
+	}, []string{
+		ExecutorPoolLabel,
+		ExecutorPlatformLabel,
+	})
+
+	SchedulerTasksDequeued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "scheduler",
+		Name:      "tasks_dequeued",
+		Help:      "Number of queued tasks claimed by an executor.",
+	}, []string{
+		ExecutorPoolLabel,
+		ExecutorPlatformLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Rate at which tasks are queued faster than they are claimed, by pool
+	/// sum by (pool) (rate(buildbuddy_scheduler_tasks_enqueued[5m]))
+	///   -
+	/// sum by (pool) (rate(buildbuddy_scheduler_tasks_dequeued[5m]))
+	/// ```
+
+	SchedulerQueueWaitTimeUsec = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: bbNamespace,
+		Subsystem: "scheduler",
+		Name:      "queue_wait_time_usec",
+		Buckets:   prometheus.ExponentialBuckets(1, 10, 10),
+		Help:      "Time that tasks spent queued before being claimed by an executor, in **microseconds**.",
+	}, []string{
+		ExecutorPoolLabel,
+		ExecutorPlatformLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # p90 queue wait time, by pool
+	/// histogram_quantile(
+	///   0.9,
+	///   sum(rate(buildbuddy_scheduler_queue_wait_time_usec_bucket[5m])) by (le, pool)
+	/// )
+	/// ```
+
+	/// ## Executor metrics
+	///
+	/// These metrics are recorded by each executor, and are labeled by the
+	/// pool and platform of the executor.
+
+	ExecutorQueueLength = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "executor",
+		Name:      "queue_length",
+		Help:      "Number of task reservations waiting in the executor's queue.",
+	}, []string{
+		ExecutorPoolLabel,
+		ExecutorPlatformLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Task reservations waiting per executor, by pool
+	/// avg by (pool) (buildbuddy_executor_queue_length)
+	/// ```
+
+	ExecutorTasksInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "executor",
+		Name:      "tasks_in_flight",
+		Help:      "Number of tasks that the executor is currently running.",
+	}, []string{
+		ExecutorPoolLabel,
+		ExecutorPlatformLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Tasks running per executor, by pool
+	/// avg by (pool) (buildbuddy_executor_tasks_in_flight)
+	/// ```
+
+	ExecutorTaskStageDurationUsec = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: bbNamespace,
+		Subsystem: "executor",
+		Name:      "task_stage_duration_usec",
+		Buckets:   prometheus.ExponentialBuckets(1, 10, 9),
+		Help:      "Time spent in each stage of task execution on the executor, in **microseconds**. Queries should filter or group by the `stage` label, taking care not to aggregate different stages.",
+	}, []string{
+		ExecutorPoolLabel,
+		ExecutorPlatformLabel,
+		ExecutedActionStageLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Median input fetch duration, by pool
+	/// histogram_quantile(
+	///   0.5,
+	///   sum(rate(buildbuddy_executor_task_stage_duration_usec_bucket{stage="input_fetch"}[5m])) by (le, pool)
+	/// )
+	/// ```
+
 	/// ## Blobstore metrics
 	///
 	/// "Blobstore" refers to the backing storage that BuildBuddy uses to
@@ -558,6 +1150,52 @@ var (
 		BlobstoreTypeLabel,
 	})
 
+	BlobstoreWriteAheadLogWriteCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "blobstore",
+		Name:      "write_ahead_log_write_count",
+		Help:      "Number of files written to the local write-ahead log because the blobstore was unavailable.",
+	})
+
+	BlobstoreWriteAheadLogPendingCount = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "blobstore",
+		Name:      "write_ahead_log_pending_count",
+		Help:      "Number of files in the local write-ahead log which are not yet persisted to the blobstore.",
+	})
+
+	/// ## Notification metrics
+
+	NotificationDeliveryCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "notification",
+		Name:      "delivery_count",
+		Help:      "Number of notifications sent to destinations, by the status of their last attempt.",
+	}, []string{
+		NotificationDestinationLabel,
+		NotificationEventLabel,
+		StatusLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Fraction of notifications that couldn't be delivered, by destination
+	/// sum by (destination) (rate(buildbuddy_notification_delivery_count{status!="0"}[5m]))
+	///   /
+	/// sum by (destination) (rate(buildbuddy_notification_delivery_count[5m]))
+	/// ```
+
+	NotificationDeliveryAttemptCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "notification",
+		Name:      "delivery_attempt_count",
+		Help:      "Number of attempts to send notifications to destinations, including retries.",
+	}, []string{
+		NotificationDestinationLabel,
+		StatusLabel,
+	})
+
 	/// # SQL metrics
 	///
 	/// The following metrics are for monitoring the SQL database configured
@@ -781,6 +1419,54 @@ var (
 		StatusLabel,
 	})
 
+	BuildEventHandlerQueueLength = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: bbNamespace,
+		Subsystem: "build_event_handler",
+		Name:      "queue_length",
+		Help:      "The number of build events waiting to be handled by a build event worker, if `app.build_event_workers` is set.",
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Build events waiting for a worker, per app instance
+	/// sum by (pod_name) (buildbuddy_build_event_handler_queue_length)
+	/// ```
+
+	BuildEventHandlerQueueWaitUsec = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: bbNamespace,
+		Subsystem: "build_event_handler",
+		Name:      "queue_wait_usec",
+		Buckets:   prometheus.ExponentialBuckets(1, 10, 9),
+		Help:      "The time that each build event waited for a build event worker, in **microseconds**.",
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Median time that build events wait for a worker
+	/// histogram_quantile(
+	///   0.5,
+	///   sum(rate(buildbuddy_build_event_handler_queue_wait_usec_bucket[5m])) by (le)
+	/// )
+	/// ```
+
+	BuildEventHandlerUpgradedEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "build_event_handler",
+		Name:      "upgraded_events",
+		Help:      "The number of build events sent by older Bazel versions whose fields were moved from a deprecated location to the current one.",
+	}, []string{
+		BuildEventShimLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # Build events that still need upgrading, by shim
+	/// sum by (shim) (rate(buildbuddy_build_event_handler_upgraded_events[1h]))
+	/// ```
+
 	/// ### Webhooks
 	///
 	/// Webhooks are HTTP endpoints exposed by BuildBuddy server which allow it to
@@ -796,6 +1482,39 @@ var (
 		WebhookEventName,
 	})
 
+	/// ### Auth
+	///
+	/// API keys are looked up on every authenticated request, so the groups
+	/// and capabilities they grant are cached in memory for a short while.
+
+	AuthAPIKeyCacheLookupCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "auth",
+		Name:      "api_key_cache_lookup_count",
+		Help:      "Number of API key lookups in the in-memory API key cache.",
+	}, []string{
+		CacheEventTypeLabel,
+	})
+
+	/// #### Examples
+	///
+	/// ```promql
+	/// # API key cache hit rate
+	/// sum(rate(buildbuddy_auth_api_key_cache_lookup_count{cache_event_type="hit"}[5m]))
+	///   /
+	/// sum(rate(buildbuddy_auth_api_key_cache_lookup_count[5m]))
+	/// ```
+
+	AuthAPIKeyLookupDurationUsec = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: bbNamespace,
+		Subsystem: "auth",
+		Name:      "api_key_lookup_duration_usec",
+		Buckets:   prometheus.ExponentialBuckets(1, 10, 9),
+		Help:      "Duration of API key lookups that missed the API key cache, in **microseconds**.",
+	}, []string{
+		StatusLabel,
+	})
+
 	/// ### Cache
 	///
 	/// "Cache" refers to the cache backend(s) that BuildBuddy uses to
@@ -0,0 +1,1049 @@
+// Package notifications sends notifications about completed invocations,
+// about drops in their cache hit rate, and about groups approaching their
+// usage limits, to Slack, webhooks, email, and PagerDuty, as directed by the
+// routing rules in the integrations.notifications config section.
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/slack"
+	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/build_event_proxy"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/retry"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/prometheus/client_golang/prometheus"
+
+	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	nfpb "github.com/buildbuddy-io/buildbuddy/proto/notification"
+	usagepb "github.com/buildbuddy-io/buildbuddy/proto/usage"
+	gstatus "google.golang.org/grpc/status"
+)
+
+const (
+	slackDestinationType     = "slack"
+	webhookDestinationType   = "webhook"
+	emailDestinationType     = "email"
+	pagerDutyDestinationType = "pagerduty"
+
+	successStatus = "success"
+	failureStatus = "failure"
+
+	invocationCompleteEvent = "invocation_complete"
+	cacheHitRateDropEvent   = "cache_hit_rate_drop"
+	usageWarningEvent       = "usage_warning"
+
+	defaultPagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+	// The window over which a rule's max_notifications_per_hour is enforced.
+	throttleWindow = time.Hour
+
+	requestTimeout = 10 * time.Second
+
+	// How often, and how patiently, notifications are retried while a
+	// destination fails with a retryable error.
+	defaultMaxAttempts  = 4
+	initialRetryBackoff = 1 * time.Second
+	maxRetryBackoff     = 30 * time.Second
+
+	// The maximum number of failed test labels listed in webhook payloads.
+	maxFailedTestLabels = 50
+)
+
+// notification is a single notification about an invocation, sent to a
+// destination on behalf of a rule.
+type notification struct {
+	rule       string
+	groupID    string
+	branch     string
+	invocation *inpb.Invocation
+	url        string
+	event      string
+	// The drop in the cache hit rate of the invocation, for
+	// cache_hit_rate_drop notifications.
+	drop *capb.CacheHitRateDrop
+	// The usage of the group, for usage_warning notifications, which aren't
+	// about an invocation.
+	usage *usagepb.UsageLimit
+	// Test notifications are sent by SendTestNotification rather than by a
+	// completed invocation.
+	test bool
+}
+
+func (n *notification) status() string {
+	if n.invocation.GetSuccess() {
+		return successStatus
+	}
+	return failureStatus
+}
+
+func (n *notification) summary() string {
+	if n.test {
+		return "Test notification from BuildBuddy"
+	}
+	if n.usage != nil {
+		if n.usage.GetState() == usagepb.UsageState_EXCEEDED_USAGE_STATE {
+			return fmt.Sprintf("Organization %s has exceeded its limit of %d %s", n.groupID, n.usage.GetLimit(), n.usage.GetDescription())
+		}
+		return fmt.Sprintf("Organization %s has used %s of its limit of %d %s", n.groupID, percent(float64(n.usage.GetUsage())/float64(n.usage.GetLimit())), n.usage.GetLimit(), n.usage.GetDescription())
+	}
+	what := n.invocation.GetRepoUrl()
+	if what == "" {
+		what = strings.Join(n.invocation.GetPattern(), " ")
+	}
+	if n.branch != "" {
+		what += "@" + n.branch
+	}
+	if n.drop != nil {
+		return fmt.Sprintf("Action cache hit rate of %s dropped from %s to %s", what, percent(n.drop.GetBaselineHitRate()), percent(n.drop.GetHitRate()))
+	}
+	verb := "succeeded"
+	if !n.invocation.GetSuccess() {
+		verb = "failed"
+	}
+	return fmt.Sprintf("bazel %s %s %s", n.invocation.GetCommand(), what, verb)
+}
+
+func percent(rate float64) string {
+	return fmt.Sprintf("%.0f%%", rate*100)
+}
+
+// subject describes what the notification is about, for logging.
+func (n *notification) subject() string {
+	if n.usage != nil {
+		return fmt.Sprintf("usage of group %s", n.groupID)
+	}
+	return "invocation " + n.invocation.GetInvocationId()
+}
+
+// usageDetails describes the group's usage, e.g. "Projected to reach the
+// limit at: 2021-06-01 18:00 UTC".
+func (n *notification) usageDetails() []string {
+	u := n.usage
+	lines := []string{
+		fmt.Sprintf("Usage: %d of %d %s", u.GetUsage(), u.GetLimit(), u.GetDescription()),
+	}
+	if u.GetProjectedLimitUsec() > 0 {
+		lines = append(lines, "Projected to reach the limit at: "+formatUsec(u.GetProjectedLimitUsec()))
+	}
+	lines = append(lines, "Usage resets at: "+formatUsec(u.GetPeriodEndUsec()))
+	if u.GetMessage() != "" {
+		lines = append(lines, u.GetMessage())
+	}
+	return lines
+}
+
+func formatUsec(usec int64) string {
+	return time.Unix(0, usec*int64(time.Microsecond)).UTC().Format("2006-01-02 15:04 MST")
+}
+
+// newlyMissedMnemonics describes the mnemonics which missed the action cache
+// more often than usual, e.g. "GoCompile: 120 misses (usually 2)".
+func (n *notification) newlyMissedMnemonics() []string {
+	var lines []string
+	for _, m := range n.drop.GetNewlyMissedMnemonic() {
+		lines = append(lines, fmt.Sprintf("%s: %d misses (usually %.0f)", m.GetMnemonic(), m.GetMisses(), m.GetBaselineMisses()))
+	}
+	return lines
+}
+
+type destination interface {
+	notify(ctx context.Context, n *notification) error
+}
+
+// credential is the URL or key of a destination, which is either configured
+// directly or read from a secret of the group whose invocation is notified.
+type credential struct {
+	env    environment.Env
+	value  string
+	secret string
+	// The client to post to the credential's URL with.
+	client *http.Client
+}
+
+func newCredential(env environment.Env, value, secret string) *credential {
+	c := &credential{env: env, value: value, secret: secret, client: http.DefaultClient}
+	if secret != "" {
+		c.client = newSecretURLClient(env.GetConfigurator().GetBuildEventProxyAllowedForwardingHosts())
+	}
+	return c
+}
+
+// newSecretURLClient returns a client for posting to URLs read from secrets.
+// Since any member of a group may set its secrets, the client refuses to
+// connect to non-public addresses, unless the host is one of allowedHosts, so
+// that groups can't use notifications to reach the app's own network.
+func newSecretURLClient(allowedHosts []string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			if build_event_proxy.IsAllowedHost(host, allowedHosts) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			}
+			return build_event_proxy.DialPublicAddress(ctx, addr)
+		},
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}}
+}
+
+func (c *credential) get(ctx context.Context, n *notification) (string, error) {
+	if c.secret == "" {
+		return c.value, nil
+	}
+	ss := c.env.GetSecretService()
+	if ss == nil {
+		return "", status.FailedPreconditionErrorf("secret %q can't be read, since secrets are not configured", c.secret)
+	}
+	return ss.GetSecretValue(ctx, n.groupID, c.secret)
+}
+
+type slackDestination struct {
+	appURL string
+	url    *credential
+}
+
+func (d *slackDestination) notify(ctx context.Context, n *notification) error {
+	url, err := d.url.get(ctx, n)
+	if err != nil {
+		return err
+	}
+	if n.drop == nil && n.usage == nil {
+		return postJSON(ctx, d.url.client, url, slack.NewSlackWebhook(url, d.appURL).PayloadFromInvocation(n.invocation))
+	}
+	a := slack.Attachment{}
+	if n.usage != nil {
+		a.AddField(slack.Field{
+			Title: "Usage",
+			Value: strings.Join(n.usageDetails(), "\n"),
+		})
+	}
+	if mnemonics := n.newlyMissedMnemonics(); len(mnemonics) > 0 {
+		a.AddField(slack.Field{
+			Title: "Newly missed mnemonics",
+			Value: strings.Join(mnemonics, "\n"),
+		})
+	}
+	a.AddAction(slack.Action{
+		Type:  "button",
+		Text:  "See on BuildBuddy!",
+		Url:   n.url,
+		Style: "primary",
+	})
+	return postJSON(ctx, d.url.client, url, &slack.Payload{
+		Text:        n.summary(),
+		Attachments: []slack.Attachment{a},
+	})
+}
+
+// webhookPayload is the JSON body posted to webhook destinations.
+type webhookPayload struct {
+	Rule             string                   `json:"rule"`
+	Event            string                   `json:"event"`
+	Test             bool                     `json:"test,omitempty"`
+	InvocationID     string                   `json:"invocation_id"`
+	InvocationURL    string                   `json:"invocation_url"`
+	GroupID          string                   `json:"group_id"`
+	Status           string                   `json:"status"`
+	RepoURL          string                   `json:"repo_url,omitempty"`
+	Branch           string                   `json:"branch,omitempty"`
+	CommitSHA        string                   `json:"commit_sha,omitempty"`
+	Command          string                   `json:"command"`
+	Pattern          []string                 `json:"pattern,omitempty"`
+	User             string                   `json:"user,omitempty"`
+	Host             string                   `json:"host,omitempty"`
+	Role             string                   `json:"role,omitempty"`
+	Tags             []string                 `json:"tags,omitempty"`
+	DurationUsec     int64                    `json:"duration_usec"`
+	Targets          *webhookTargetSummary    `json:"targets,omitempty"`
+	Tests            *webhookTestSummary      `json:"tests,omitempty"`
+	CacheHitRateDrop *webhookCacheHitRateDrop `json:"cache_hit_rate_drop,omitempty"`
+	UsageWarning     *webhookUsageWarning     `json:"usage_warning,omitempty"`
+}
+
+// webhookPayloadFields returns the names of the top-level fields of webhook
+// payloads.
+func webhookPayloadFields() map[string]bool {
+	fields := make(map[string]bool)
+	t := reflect.TypeOf(webhookPayload{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		fields[name] = true
+	}
+	return fields
+}
+
+type webhookTargetSummary struct {
+	Configured int64 `json:"configured"`
+	Completed  int64 `json:"completed"`
+	Failed     int64 `json:"failed"`
+}
+
+// webhookTestSummary counts the tests of an invocation by their overall
+// status, such as PASSED or FLAKY, and lists the labels of those that failed.
+type webhookTestSummary struct {
+	Total        int            `json:"total"`
+	StatusCounts map[string]int `json:"status_counts"`
+	FailedLabels []string       `json:"failed_labels,omitempty"`
+	// Set if there were more failed tests than are listed.
+	FailedLabelsTruncated bool `json:"failed_labels_truncated,omitempty"`
+}
+
+func isFailedTestStatus(s build_event_stream.TestStatus) bool {
+	switch s {
+	case build_event_stream.TestStatus_NO_STATUS, build_event_stream.TestStatus_PASSED, build_event_stream.TestStatus_FLAKY:
+		return false
+	}
+	return true
+}
+
+// testSummary summarizes the test results reported by the invocation's
+// events, or returns nil if it didn't run any tests.
+func testSummary(inv *inpb.Invocation) *webhookTestSummary {
+	var summary *webhookTestSummary
+	for _, e := range inv.GetEvent() {
+		ts := e.GetBuildEvent().GetTestSummary()
+		if ts == nil {
+			continue
+		}
+		if summary == nil {
+			summary = &webhookTestSummary{StatusCounts: make(map[string]int)}
+		}
+		summary.Total++
+		summary.StatusCounts[ts.GetOverallStatus().String()]++
+		if isFailedTestStatus(ts.GetOverallStatus()) {
+			if len(summary.FailedLabels) < maxFailedTestLabels {
+				summary.FailedLabels = append(summary.FailedLabels, e.GetBuildEvent().GetId().GetTestSummary().GetLabel())
+			} else {
+				summary.FailedLabelsTruncated = true
+			}
+		}
+	}
+	if summary != nil {
+		sort.Strings(summary.FailedLabels)
+	}
+	return summary
+}
+
+type webhookUsageWarning struct {
+	Resource           string `json:"resource"`
+	Description        string `json:"description"`
+	State              string `json:"state"`
+	Usage              int64  `json:"usage"`
+	WarningThreshold   int64  `json:"warning_threshold"`
+	Limit              int64  `json:"limit"`
+	Message            string `json:"message,omitempty"`
+	PeriodEndUsec      int64  `json:"period_end_usec"`
+	ProjectedLimitUsec int64  `json:"projected_limit_usec,omitempty"`
+}
+
+type webhookCacheHitRateDrop struct {
+	BaselineHitRate      float64                  `json:"baseline_hit_rate"`
+	HitRate              float64                  `json:"hit_rate"`
+	NewlyMissedMnemonics []*webhookMnemonicMisses `json:"newly_missed_mnemonics,omitempty"`
+}
+
+type webhookMnemonicMisses struct {
+	Mnemonic       string  `json:"mnemonic"`
+	Misses         int64   `json:"misses"`
+	BaselineMisses float64 `json:"baseline_misses"`
+}
+
+type webhookDestination struct {
+	url *credential
+	// The top-level fields of the payload that are posted, or all of them
+	// if empty.
+	fields map[string]bool
+}
+
+func (d *webhookDestination) notify(ctx context.Context, n *notification) error {
+	url, err := d.url.get(ctx, n)
+	if err != nil {
+		return err
+	}
+	inv := n.invocation
+	payload := &webhookPayload{
+		Rule:          n.rule,
+		Event:         n.event,
+		Test:          n.test,
+		InvocationID:  inv.GetInvocationId(),
+		InvocationURL: n.url,
+		GroupID:       n.groupID,
+		Status:        n.status(),
+		RepoURL:       inv.GetRepoUrl(),
+		Branch:        n.branch,
+		CommitSHA:     inv.GetCommitSha(),
+		Command:       inv.GetCommand(),
+		Pattern:       inv.GetPattern(),
+		User:          inv.GetUser(),
+		Host:          inv.GetHost(),
+		Role:          inv.GetRole(),
+		Tags:          inv.GetTag(),
+		DurationUsec:  inv.GetDurationUsec(),
+	}
+	if n.event == invocationCompleteEvent && !n.test {
+		if p := inv.GetProgress(); p != nil {
+			payload.Targets = &webhookTargetSummary{
+				Configured: p.GetConfiguredTargetCount(),
+				Completed:  p.GetCompletedTargetCount(),
+				Failed:     p.GetFailedTargetCount(),
+			}
+		}
+		payload.Tests = testSummary(inv)
+	}
+	if n.drop != nil {
+		payload.CacheHitRateDrop = &webhookCacheHitRateDrop{
+			BaselineHitRate: n.drop.GetBaselineHitRate(),
+			HitRate:         n.drop.GetHitRate(),
+		}
+		for _, m := range n.drop.GetNewlyMissedMnemonic() {
+			payload.CacheHitRateDrop.NewlyMissedMnemonics = append(payload.CacheHitRateDrop.NewlyMissedMnemonics, &webhookMnemonicMisses{
+				Mnemonic:       m.GetMnemonic(),
+				Misses:         m.GetMisses(),
+				BaselineMisses: m.GetBaselineMisses(),
+			})
+		}
+	}
+	if u := n.usage; u != nil {
+		payload.UsageWarning = &webhookUsageWarning{
+			Resource:           u.GetResource(),
+			Description:        u.GetDescription(),
+			State:              u.GetState().String(),
+			Usage:              u.GetUsage(),
+			WarningThreshold:   u.GetWarningThreshold(),
+			Limit:              u.GetLimit(),
+			Message:            u.GetMessage(),
+			PeriodEndUsec:      u.GetPeriodEndUsec(),
+			ProjectedLimitUsec: u.GetProjectedLimitUsec(),
+		}
+	}
+	if len(d.fields) == 0 {
+		return postJSON(ctx, d.url.client, url, payload)
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	selected := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(b, &selected); err != nil {
+		return err
+	}
+	for name := range selected {
+		if !d.fields[name] {
+			delete(selected, name)
+		}
+	}
+	return postJSON(ctx, d.url.client, url, selected)
+}
+
+type emailDestination struct {
+	smtp       *config.SMTPConfig
+	recipients []string
+}
+
+func (d *emailDestination) notify(ctx context.Context, n *notification) error {
+	inv := n.invocation
+	body := &bytes.Buffer{}
+	fmt.Fprintf(body, "From: %s\r\n", d.smtp.From)
+	fmt.Fprintf(body, "To: %s\r\n", strings.Join(d.recipients, ", "))
+	fmt.Fprintf(body, "Subject: [BuildBuddy] %s\r\n", n.summary())
+	fmt.Fprintf(body, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	if n.usage != nil {
+		for _, line := range n.usageDetails() {
+			fmt.Fprintf(body, "%s\r\n", line)
+		}
+		fmt.Fprintf(body, "\r\n%s\r\n", n.url)
+		return d.send(body.Bytes())
+	}
+	if n.drop != nil {
+		fmt.Fprintf(body, "Action cache hit rate: %s (usually %s)\r\n", percent(n.drop.GetHitRate()), percent(n.drop.GetBaselineHitRate()))
+	} else {
+		fmt.Fprintf(body, "Status: %s\r\n", n.status())
+	}
+	if inv.GetRepoUrl() != "" {
+		fmt.Fprintf(body, "Repo: %s\r\n", inv.GetRepoUrl())
+	}
+	if n.branch != "" {
+		fmt.Fprintf(body, "Branch: %s\r\n", n.branch)
+	}
+	if inv.GetCommitSha() != "" {
+		fmt.Fprintf(body, "Commit: %s\r\n", inv.GetCommitSha())
+	}
+	fmt.Fprintf(body, "User: %s@%s\r\n", inv.GetUser(), inv.GetHost())
+	fmt.Fprintf(body, "Duration: %s\r\n", time.Duration(inv.GetDurationUsec())*time.Microsecond)
+	if mnemonics := n.newlyMissedMnemonics(); len(mnemonics) > 0 {
+		fmt.Fprintf(body, "\r\nNewly missed mnemonics:\r\n")
+		for _, m := range mnemonics {
+			fmt.Fprintf(body, "  %s\r\n", m)
+		}
+	}
+	fmt.Fprintf(body, "\r\n%s\r\n", n.url)
+	return d.send(body.Bytes())
+}
+
+func (d *emailDestination) send(msg []byte) error {
+	var auth smtp.Auth
+	if d.smtp.Username != "" {
+		host := strings.Split(d.smtp.Address, ":")[0]
+		auth = smtp.PlainAuth("", d.smtp.Username, d.smtp.Password, host)
+	}
+	return smtp.SendMail(d.smtp.Address, auth, d.smtp.From, d.recipients, msg)
+}
+
+// pagerDutyEvent is an event of the PagerDuty Events API v2.
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+	Links       []*pagerDutyLink  `json:"links,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"`
+	CustomDetails map[string]string `json:"custom_details,omitempty"`
+}
+
+type pagerDutyLink struct {
+	Href string `json:"href"`
+	Text string `json:"text"`
+}
+
+type pagerDutyDestination struct {
+	url        string
+	routingKey *credential
+}
+
+// notify triggers an alert when an invocation fails, and resolves it once an
+// invocation of the same repo and branch succeeds. Cache hit rate drops and
+// usage warnings trigger warnings, which aren't resolved automatically.
+func (d *pagerDutyDestination) notify(ctx context.Context, n *notification) error {
+	routingKey, err := d.routingKey.get(ctx, n)
+	if err != nil {
+		return err
+	}
+	if n.usage != nil {
+		return postJSON(ctx, http.DefaultClient, d.url, d.usageEvent(routingKey, n))
+	}
+	inv := n.invocation
+	event := &pagerDutyEvent{
+		RoutingKey:  routingKey,
+		EventAction: "trigger",
+		DedupKey:    strings.Join([]string{"buildbuddy", n.rule, inv.GetRepoUrl(), n.branch}, "/"),
+	}
+	if n.test {
+		event.DedupKey = "buildbuddy/test/" + inv.GetInvocationId()
+	} else if n.drop != nil {
+		event.DedupKey = strings.Join([]string{"buildbuddy", n.rule, "cache-hit-rate", inv.GetRepoUrl(), n.branch}, "/")
+	} else if inv.GetSuccess() {
+		event.EventAction = "resolve"
+		return postJSON(ctx, http.DefaultClient, d.url, event)
+	}
+	severity := "error"
+	if n.test {
+		severity = "info"
+	} else if n.drop != nil {
+		severity = "warning"
+	}
+	event.Payload = &pagerDutyPayload{
+		Summary:  n.summary(),
+		Source:   inv.GetHost(),
+		Severity: severity,
+		CustomDetails: map[string]string{
+			"invocation_id": inv.GetInvocationId(),
+			"repo_url":      inv.GetRepoUrl(),
+			"branch":        n.branch,
+			"commit_sha":    inv.GetCommitSha(),
+			"user":          inv.GetUser(),
+		},
+	}
+	if n.drop != nil {
+		event.Payload.CustomDetails["hit_rate"] = percent(n.drop.GetHitRate())
+		event.Payload.CustomDetails["baseline_hit_rate"] = percent(n.drop.GetBaselineHitRate())
+		event.Payload.CustomDetails["newly_missed_mnemonics"] = strings.Join(n.newlyMissedMnemonics(), "\n")
+	}
+	if event.Payload.Source == "" {
+		event.Payload.Source = "buildbuddy"
+	}
+	event.Links = []*pagerDutyLink{{Href: n.url, Text: "View invocation on BuildBuddy"}}
+	return postJSON(ctx, http.DefaultClient, d.url, event)
+}
+
+// usageEvent returns the event for a usage warning. A group's warnings for
+// the same resource share an alert, which becomes an error once the limit is
+// exceeded.
+func (d *pagerDutyDestination) usageEvent(routingKey string, n *notification) *pagerDutyEvent {
+	u := n.usage
+	severity := "warning"
+	if u.GetState() == usagepb.UsageState_EXCEEDED_USAGE_STATE {
+		severity = "error"
+	}
+	details := map[string]string{
+		"group_id":      n.groupID,
+		"resource":      u.GetResource(),
+		"usage":         fmt.Sprintf("%d", u.GetUsage()),
+		"limit":         fmt.Sprintf("%d", u.GetLimit()),
+		"usage_resets":  formatUsec(u.GetPeriodEndUsec()),
+		"usage_message": u.GetMessage(),
+	}
+	if u.GetProjectedLimitUsec() > 0 {
+		details["projected_limit"] = formatUsec(u.GetProjectedLimitUsec())
+	}
+	return &pagerDutyEvent{
+		RoutingKey:  routingKey,
+		EventAction: "trigger",
+		DedupKey:    strings.Join([]string{"buildbuddy", n.rule, "usage", n.groupID, u.GetResource()}, "/"),
+		Payload: &pagerDutyPayload{
+			Summary:       n.summary(),
+			Source:        "buildbuddy",
+			Severity:      severity,
+			CustomDetails: details,
+		},
+		Links: []*pagerDutyLink{{Href: n.url, Text: "View usage on BuildBuddy"}},
+	}
+}
+
+func postJSON(ctx context.Context, client *http.Client, url string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	rsp, err := client.Do(req)
+	if err != nil {
+		// Refused connections won't succeed if retried.
+		if cause := errors.Unwrap(err); status.IsPermissionDeniedError(cause) {
+			return cause
+		}
+		return status.UnavailableErrorf("POST %s: %s", url, err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(rsp.Body)
+		msg := fmt.Sprintf("POST %s: %s: %s", url, rsp.Status, strings.TrimSpace(string(body)))
+		// Other client errors won't succeed if retried.
+		if rsp.StatusCode != http.StatusTooManyRequests && rsp.StatusCode < 500 {
+			return status.FailedPreconditionError(msg)
+		}
+		err := status.UnavailableError(msg)
+		if seconds, perr := strconv.Atoi(rsp.Header.Get("Retry-After")); perr == nil && seconds >= 0 {
+			delay := time.Duration(seconds) * time.Second
+			if delay > maxRetryBackoff {
+				delay = maxRetryBackoff
+			}
+			err = status.WithRetryInfo(err, delay)
+		}
+		return err
+	}
+	return nil
+}
+
+type rule struct {
+	name                    string
+	groupIDs                map[string]bool
+	repoURLs                map[string]bool
+	branches                map[string]bool
+	statuses                map[string]bool
+	roles                   map[string]bool
+	tags                    map[string]bool
+	events                  map[string]bool
+	destinations            []string
+	maxNotificationsPerHour int
+
+	mu       sync.Mutex
+	sentTime []time.Time
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+// matchesAny returns whether the value is in the set, treating an empty set as
+// matching everything.
+func matchesAny(set map[string]bool, value string) bool {
+	return len(set) == 0 || set[value]
+}
+
+// matches returns whether the rule applies to the notification. Rules only
+// notify completed invocations unless they select other events, and their
+// statuses only apply to completed invocations.
+func (r *rule) matches(n *notification) bool {
+	if len(r.events) == 0 {
+		if n.event != invocationCompleteEvent {
+			return false
+		}
+	} else if !r.events[n.event] {
+		return false
+	}
+	if n.event == invocationCompleteEvent && !matchesAny(r.statuses, n.status()) {
+		return false
+	}
+	// Usage warnings are about a whole group, so only the rule's groups
+	// apply to them.
+	if n.event == usageWarningEvent {
+		return matchesAny(r.groupIDs, n.groupID)
+	}
+	if !matchesAny(r.groupIDs, n.groupID) || !matchesAny(r.repoURLs, n.invocation.GetRepoUrl()) || !matchesAny(r.branches, n.branch) || !matchesAny(r.roles, n.invocation.GetRole()) {
+		return false
+	}
+	if len(r.tags) == 0 {
+		return true
+	}
+	for _, tag := range n.invocation.GetTag() {
+		if r.tags[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// allow records a notification sent at the given time, unless the rule has
+// already sent as many notifications as it may in the past hour.
+func (r *rule) allow(now time.Time) bool {
+	if r.maxNotificationsPerHour <= 0 {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cutoff := now.Add(-throttleWindow)
+	i := 0
+	for i < len(r.sentTime) && !r.sentTime[i].After(cutoff) {
+		i++
+	}
+	r.sentTime = r.sentTime[i:]
+	if len(r.sentTime) >= r.maxNotificationsPerHour {
+		return false
+	}
+	r.sentTime = append(r.sentTime, now)
+	return true
+}
+
+// Router sends notifications about completed invocations, drops in their
+// cache hit rate, and groups approaching their usage limits, to the
+// destinations of each rule they match.
+type Router struct {
+	env          environment.Env
+	appURL       string
+	destinations map[string]destination
+	rules        []*rule
+	retryOptions *retry.Options
+}
+
+// NewRouter returns a Router for the given config, or an error if the config
+// is invalid.
+func NewRouter(env environment.Env, c *config.NotificationsConfig, appURL string) (*Router, error) {
+	r := &Router{
+		env:          env,
+		appURL:       appURL,
+		destinations: make(map[string]destination, len(c.Destinations)),
+		retryOptions: &retry.Options{
+			MaxAttempts:    c.MaxAttempts,
+			InitialBackoff: initialRetryBackoff,
+			MaxBackoff:     maxRetryBackoff,
+			Multiplier:     2,
+		},
+	}
+	if r.retryOptions.MaxAttempts <= 0 {
+		r.retryOptions.MaxAttempts = defaultMaxAttempts
+	}
+	for _, dc := range c.Destinations {
+		if dc.Name == "" {
+			return nil, status.InvalidArgumentError("notification destinations must have a name")
+		}
+		if _, ok := r.destinations[dc.Name]; ok {
+			return nil, status.InvalidArgumentErrorf("duplicate notification destination %q", dc.Name)
+		}
+		d, err := newDestination(env, c, &dc, appURL)
+		if err != nil {
+			return nil, err
+		}
+		r.destinations[dc.Name] = d
+	}
+	for _, rc := range c.Rules {
+		if len(rc.Destinations) == 0 {
+			return nil, status.InvalidArgumentErrorf("notification rule %q has no destinations", rc.Name)
+		}
+		for _, name := range rc.Destinations {
+			if _, ok := r.destinations[name]; !ok {
+				return nil, status.InvalidArgumentErrorf("notification rule %q refers to unknown destination %q", rc.Name, name)
+			}
+		}
+		for _, s := range rc.Statuses {
+			if s != successStatus && s != failureStatus {
+				return nil, status.InvalidArgumentErrorf("notification rule %q has invalid status %q: must be %q or %q", rc.Name, s, successStatus, failureStatus)
+			}
+		}
+		for _, e := range rc.Events {
+			if e != invocationCompleteEvent && e != cacheHitRateDropEvent && e != usageWarningEvent {
+				return nil, status.InvalidArgumentErrorf("notification rule %q has invalid event %q: must be %q, %q, or %q", rc.Name, e, invocationCompleteEvent, cacheHitRateDropEvent, usageWarningEvent)
+			}
+		}
+		r.rules = append(r.rules, &rule{
+			name:                    rc.Name,
+			groupIDs:                toSet(rc.GroupIDs),
+			repoURLs:                toSet(rc.RepoURLs),
+			branches:                toSet(rc.Branches),
+			statuses:                toSet(rc.Statuses),
+			roles:                   toSet(rc.Roles),
+			tags:                    toSet(rc.Tags),
+			events:                  toSet(rc.Events),
+			destinations:            rc.Destinations,
+			maxNotificationsPerHour: rc.MaxNotificationsPerHour,
+		})
+	}
+	return r, nil
+}
+
+func newDestination(env environment.Env, c *config.NotificationsConfig, dc *config.NotificationDestinationConfig, appURL string) (destination, error) {
+	if len(dc.Fields) > 0 {
+		if dc.Type != webhookDestinationType {
+			return nil, status.InvalidArgumentErrorf("notification destination %q has fields, which are only supported by webhook destinations", dc.Name)
+		}
+		known := webhookPayloadFields()
+		for _, f := range dc.Fields {
+			if !known[f] {
+				return nil, status.InvalidArgumentErrorf("notification destination %q has unknown field %q", dc.Name, f)
+			}
+		}
+	}
+	switch dc.Type {
+	case slackDestinationType, webhookDestinationType:
+		if dc.URL == "" && dc.Secret == "" {
+			return nil, status.InvalidArgumentErrorf("notification destination %q requires a url or a secret", dc.Name)
+		}
+		url := newCredential(env, dc.URL, dc.Secret)
+		if dc.Type == slackDestinationType {
+			return &slackDestination{url: url, appURL: appURL}, nil
+		}
+		return &webhookDestination{url: url, fields: toSet(dc.Fields)}, nil
+	case emailDestinationType:
+		if len(dc.EmailAddresses) == 0 {
+			return nil, status.InvalidArgumentErrorf("notification destination %q requires email_addresses", dc.Name)
+		}
+		if c.SMTP.Address == "" || c.SMTP.From == "" {
+			return nil, status.InvalidArgumentErrorf("notification destination %q requires integrations.notifications.smtp to be configured", dc.Name)
+		}
+		return &emailDestination{smtp: &c.SMTP, recipients: dc.EmailAddresses}, nil
+	case pagerDutyDestinationType:
+		if dc.PagerDutyRoutingKey == "" && dc.Secret == "" {
+			return nil, status.InvalidArgumentErrorf("notification destination %q requires a pagerduty_routing_key or a secret", dc.Name)
+		}
+		url := dc.URL
+		if url == "" {
+			url = defaultPagerDutyEventsURL
+		}
+		routingKey := newCredential(env, dc.PagerDutyRoutingKey, dc.Secret)
+		return &pagerDutyDestination{url: url, routingKey: routingKey}, nil
+	default:
+		return nil, status.InvalidArgumentErrorf("notification destination %q has unknown type %q", dc.Name, dc.Type)
+	}
+}
+
+func (r *Router) invocationURL(iid string) string {
+	return r.appURL + "/invocation/" + iid
+}
+
+// send sends the notification to each named destination, retrying while
+// they fail with retryable errors, and returns the last error encountered.
+func (r *Router) send(ctx context.Context, n *notification, destinations []string) error {
+	var lastErr error
+	for _, name := range destinations {
+		err := retry.Do(ctx, r.retryOptions, func() error {
+			err := r.destinations[name].notify(ctx, n)
+			metrics.NotificationDeliveryAttemptCount.With(prometheus.Labels{
+				metrics.NotificationDestinationLabel: name,
+				metrics.StatusLabel:                  fmt.Sprintf("%d", gstatus.Code(err)),
+			}).Inc()
+			return err
+		})
+		metrics.NotificationDeliveryCount.With(prometheus.Labels{
+			metrics.NotificationDestinationLabel: name,
+			metrics.NotificationEventLabel:       n.event,
+			metrics.StatusLabel:                  fmt.Sprintf("%d", gstatus.Code(err)),
+		}).Inc()
+		if err != nil {
+			log.Warningf("Error sending notification for %s to %q: %s", n.subject(), name, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (r *Router) NotifyInvocationComplete(ctx context.Context, groupID, branch string, invocation *inpb.Invocation) error {
+	return r.notify(ctx, &notification{
+		groupID:    groupID,
+		branch:     branch,
+		invocation: invocation,
+		url:        r.invocationURL(invocation.GetInvocationId()),
+		event:      invocationCompleteEvent,
+	})
+}
+
+func (r *Router) NotifyCacheHitRateDrop(ctx context.Context, groupID string, invocation *inpb.Invocation, drop *capb.CacheHitRateDrop) error {
+	return r.notify(ctx, &notification{
+		groupID:    groupID,
+		branch:     drop.GetBranch(),
+		invocation: invocation,
+		url:        r.invocationURL(invocation.GetInvocationId()),
+		event:      cacheHitRateDropEvent,
+		drop:       drop,
+	})
+}
+
+// NotifyUsageWarning notifies the destinations of every rule which selects
+// usage_warning events and matches the group.
+func (r *Router) NotifyUsageWarning(ctx context.Context, groupID string, usage *usagepb.UsageLimit) error {
+	return r.notify(ctx, &notification{
+		groupID: groupID,
+		url:     r.appURL + "/settings/",
+		event:   usageWarningEvent,
+		usage:   usage,
+	})
+}
+
+// notify sends the notification on behalf of each rule matching it.
+func (r *Router) notify(ctx context.Context, template *notification) error {
+	now := r.env.GetClock().Now()
+	var lastErr error
+	// Each destination is notified at most once per event, on behalf of the
+	// first rule which matched it.
+	notified := make(map[string]bool)
+	for _, rule := range r.rules {
+		n := *template
+		n.rule = rule.name
+		if !rule.matches(&n) {
+			continue
+		}
+		var destinations []string
+		for _, name := range rule.destinations {
+			if !notified[name] {
+				destinations = append(destinations, name)
+			}
+		}
+		if len(destinations) == 0 {
+			continue
+		}
+		if !rule.allow(now) {
+			log.Debugf("Not sending notification for %s: rule %q is throttled", n.subject(), rule.name)
+			continue
+		}
+		for _, name := range destinations {
+			notified[name] = true
+		}
+		if err := r.send(ctx, &n, destinations); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// SendTestNotification sends a test notification to a destination, or to all
+// of a rule's destinations. Since rules and destinations are configured for
+// the whole server, users may only test rules scoped to their group, and the
+// destinations of those rules. Server admins may test any of them.
+func (r *Router) SendTestNotification(ctx context.Context, req *nfpb.SendTestNotificationRequest) (*nfpb.SendTestNotificationResponse, error) {
+	groupID, err := perms.AuthenticateSelectedGroupID(ctx, r.env, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	u, err := perms.AuthenticatedUser(ctx, r.env)
+	if err != nil {
+		return nil, err
+	}
+	canTest := func(rule *rule) bool {
+		return u.IsAdmin() || rule.groupIDs[groupID]
+	}
+
+	var ruleName string
+	var destinations []string
+	switch {
+	case req.GetRule() != "":
+		for _, rule := range r.rules {
+			if rule.name == req.GetRule() && canTest(rule) {
+				ruleName = rule.name
+				destinations = rule.destinations
+				break
+			}
+		}
+		if ruleName == "" {
+			return nil, status.NotFoundErrorf("notification rule %q not found", req.GetRule())
+		}
+	case req.GetDestination() != "":
+		name := req.GetDestination()
+		if _, ok := r.destinations[name]; ok && u.IsAdmin() {
+			destinations = []string{name}
+		}
+		for _, rule := range r.rules {
+			if len(destinations) > 0 {
+				break
+			}
+			for _, d := range rule.destinations {
+				if d == name && canTest(rule) {
+					destinations = []string{name}
+					break
+				}
+			}
+		}
+		if len(destinations) == 0 {
+			return nil, status.NotFoundErrorf("notification destination %q not found", name)
+		}
+	default:
+		return nil, status.InvalidArgumentError("a destination or rule is required")
+	}
+
+	invocation := &inpb.Invocation{
+		InvocationId: fmt.Sprintf("test-%d", r.env.GetClock().Now().UnixNano()),
+		Success:      true,
+		Command:      "test",
+		User:         u.GetUserID(),
+		Host:         "buildbuddy",
+	}
+	n := &notification{
+		rule:       ruleName,
+		groupID:    groupID,
+		invocation: invocation,
+		url:        r.appURL,
+		event:      invocationCompleteEvent,
+		test:       true,
+	}
+	if err := r.send(ctx, n, destinations); err != nil {
+		return nil, status.UnavailableErrorf("Error sending test notification: %s", err)
+	}
+	return &nfpb.SendTestNotificationResponse{Destination: destinations}, nil
+}
@@ -0,0 +1,512 @@
+package notifications_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/notifications"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	capb "github.com/buildbuddy-io/buildbuddy/proto/cache"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	nfpb "github.com/buildbuddy-io/buildbuddy/proto/notification"
+	usagepb "github.com/buildbuddy-io/buildbuddy/proto/usage"
+)
+
+const repoURL = "https://github.com/example/example"
+
+// receiver records the payloads posted to each path of a test server.
+type receiver struct {
+	mu       sync.Mutex
+	payloads map[string][]map[string]interface{}
+}
+
+func startReceiver(t *testing.T) (*receiver, string) {
+	r := &receiver{payloads: make(map[string][]map[string]interface{})}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		payload := make(map[string]interface{})
+		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.mu.Lock()
+		r.payloads[req.URL.Path] = append(r.payloads[req.URL.Path], payload)
+		r.mu.Unlock()
+	}))
+	t.Cleanup(server.Close)
+	return r, server.URL
+}
+
+func (r *receiver) take(path string) []map[string]interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := r.payloads[path]
+	delete(r.payloads, path)
+	return p
+}
+
+func testConfig(url string) *config.NotificationsConfig {
+	return &config.NotificationsConfig{
+		Destinations: []config.NotificationDestinationConfig{
+			{Name: "ci", Type: "webhook", URL: url + "/ci"},
+			{Name: "release", Type: "webhook", URL: url + "/release"},
+			{Name: "oncall", Type: "pagerduty", URL: url + "/pagerduty", PagerDutyRoutingKey: "KEY"},
+		},
+		Rules: []config.NotificationRuleConfig{
+			{
+				Name:                    "main-failures",
+				GroupIDs:                []string{"GR1"},
+				RepoURLs:                []string{repoURL},
+				Branches:                []string{"main"},
+				Statuses:                []string{"failure"},
+				Destinations:            []string{"ci", "oncall"},
+				MaxNotificationsPerHour: 2,
+			},
+			{
+				Name:         "releases",
+				Tags:         []string{"release", "nightly"},
+				Destinations: []string{"ci", "release"},
+			},
+		},
+	}
+}
+
+func TestNotifyInvocationComplete(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	clock := te.UseFakeClock()
+	r, url := startReceiver(t)
+	router, err := notifications.NewRouter(te, testConfig(url), "http://localhost:8080")
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	failed := &inpb.Invocation{InvocationId: "IID1", RepoUrl: repoURL, Command: "test"}
+	err = router.NotifyInvocationComplete(ctx, "GR1", "main", failed)
+	require.NoError(t, err)
+	ci := r.take("/ci")
+	require.Len(t, ci, 1)
+	assert.Equal(t, "main-failures", ci[0]["rule"])
+	assert.Equal(t, "failure", ci[0]["status"])
+	assert.Equal(t, "main", ci[0]["branch"])
+	assert.Equal(t, "http://localhost:8080/invocation/IID1", ci[0]["invocation_url"])
+	pd := r.take("/pagerduty")
+	require.Len(t, pd, 1)
+	assert.Equal(t, "trigger", pd[0]["event_action"])
+	assert.Equal(t, "KEY", pd[0]["routing_key"])
+	assert.Empty(t, r.take("/release"))
+
+	// Invocations of other branches and groups don't match.
+	err = router.NotifyInvocationComplete(ctx, "GR1", "feature", failed)
+	require.NoError(t, err)
+	err = router.NotifyInvocationComplete(ctx, "GR2", "main", failed)
+	require.NoError(t, err)
+	assert.Empty(t, r.take("/ci"))
+
+	// A tagged invocation matching both rules is only sent once to the
+	// destination they share.
+	tagged := &inpb.Invocation{InvocationId: "IID2", RepoUrl: repoURL, Command: "test", Tag: []string{"nightly"}}
+	err = router.NotifyInvocationComplete(ctx, "GR1", "main", tagged)
+	require.NoError(t, err)
+	assert.Len(t, r.take("/ci"), 1)
+	assert.Len(t, r.take("/pagerduty"), 1)
+	assert.Len(t, r.take("/release"), 1)
+
+	// The first rule has now sent two notifications this hour, so it is
+	// throttled until an hour after the first.
+	err = router.NotifyInvocationComplete(ctx, "GR1", "main", failed)
+	require.NoError(t, err)
+	assert.Empty(t, r.take("/ci"))
+	clock.Advance(time.Hour)
+	err = router.NotifyInvocationComplete(ctx, "GR1", "main", failed)
+	require.NoError(t, err)
+	assert.Len(t, r.take("/ci"), 1)
+	r.take("/pagerduty")
+}
+
+func TestPagerDutyResolvesOnSuccess(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	r, url := startReceiver(t)
+	c := testConfig(url)
+	c.Rules[0].Statuses = nil
+	router, err := notifications.NewRouter(te, c, "http://localhost:8080")
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	err = router.NotifyInvocationComplete(ctx, "GR1", "main", &inpb.Invocation{InvocationId: "IID1", RepoUrl: repoURL})
+	require.NoError(t, err)
+	err = router.NotifyInvocationComplete(ctx, "GR1", "main", &inpb.Invocation{InvocationId: "IID2", RepoUrl: repoURL, Success: true})
+	require.NoError(t, err)
+
+	pd := r.take("/pagerduty")
+	require.Len(t, pd, 2)
+	assert.Equal(t, "trigger", pd[0]["event_action"])
+	assert.Equal(t, "resolve", pd[1]["event_action"])
+	assert.Equal(t, pd[0]["dedup_key"], pd[1]["dedup_key"])
+}
+
+func TestNotifyCacheHitRateDrop(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	r, url := startReceiver(t)
+	c := testConfig(url)
+	c.Rules = append(c.Rules, config.NotificationRuleConfig{
+		Name:         "cache-alarms",
+		RepoURLs:     []string{repoURL},
+		Events:       []string{"cache_hit_rate_drop"},
+		Destinations: []string{"release", "oncall"},
+	})
+	router, err := notifications.NewRouter(te, c, "http://localhost:8080")
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// Drops are only sent to rules which select them, and the statuses of
+	// rules don't apply to them.
+	invocation := &inpb.Invocation{InvocationId: "IID1", RepoUrl: repoURL, Command: "build", Success: true}
+	drop := &capb.CacheHitRateDrop{
+		RepoUrl:         repoURL,
+		Branch:          "main",
+		BaselineHitRate: 0.9,
+		HitRate:         0.4,
+		NewlyMissedMnemonic: []*capb.CacheHitRateDrop_MnemonicMisses{
+			{Mnemonic: "CppCompile", Misses: 50},
+		},
+	}
+	err = router.NotifyCacheHitRateDrop(ctx, "GR1", invocation, drop)
+	require.NoError(t, err)
+	assert.Empty(t, r.take("/ci"))
+	release := r.take("/release")
+	require.Len(t, release, 1)
+	assert.Equal(t, "cache-alarms", release[0]["rule"])
+	assert.Equal(t, "cache_hit_rate_drop", release[0]["event"])
+	assert.Equal(t, "main", release[0]["branch"])
+	hitRateDrop := release[0]["cache_hit_rate_drop"].(map[string]interface{})
+	assert.Equal(t, 0.4, hitRateDrop["hit_rate"])
+	assert.Equal(t, "CppCompile", hitRateDrop["newly_missed_mnemonics"].([]interface{})[0].(map[string]interface{})["mnemonic"])
+	pd := r.take("/pagerduty")
+	require.Len(t, pd, 1)
+	assert.Equal(t, "warning", pd[0]["payload"].(map[string]interface{})["severity"])
+	assert.Equal(t, "Action cache hit rate of "+repoURL+"@main dropped from 90% to 40%", pd[0]["payload"].(map[string]interface{})["summary"])
+
+	// Rules which select drops don't notify completed invocations.
+	err = router.NotifyInvocationComplete(ctx, "GR1", "feature", &inpb.Invocation{InvocationId: "IID2", RepoUrl: repoURL})
+	require.NoError(t, err)
+	assert.Empty(t, r.take("/release"))
+	assert.Empty(t, r.take("/pagerduty"))
+}
+
+func TestNotifyUsageWarning(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	r, url := startReceiver(t)
+	c := testConfig(url)
+	c.Rules = append(c.Rules, config.NotificationRuleConfig{
+		Name:         "usage-alarms",
+		GroupIDs:     []string{"GR1"},
+		RepoURLs:     []string{repoURL},
+		Events:       []string{"usage_warning"},
+		Destinations: []string{"release", "oncall"},
+	})
+	router, err := notifications.NewRouter(te, c, "http://localhost:8080")
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// Usage warnings are only sent to rules which select them, and the
+	// repos of rules don't apply to them.
+	usage := &usagepb.UsageLimit{
+		Resource:           "build_event_bytes",
+		Description:        "daily build event bytes",
+		Usage:              850,
+		WarningThreshold:   800,
+		Limit:              1000,
+		State:              usagepb.UsageState_WARNING_USAGE_STATE,
+		PeriodEndUsec:      time.Date(2021, 6, 2, 0, 0, 0, 0, time.UTC).UnixNano() / 1000,
+		ProjectedLimitUsec: time.Date(2021, 6, 1, 18, 0, 0, 0, time.UTC).UnixNano() / 1000,
+	}
+	err = router.NotifyUsageWarning(ctx, "GR1", usage)
+	require.NoError(t, err)
+	assert.Empty(t, r.take("/ci"))
+	release := r.take("/release")
+	require.Len(t, release, 1)
+	assert.Equal(t, "usage-alarms", release[0]["rule"])
+	assert.Equal(t, "usage_warning", release[0]["event"])
+	assert.Equal(t, "GR1", release[0]["group_id"])
+	warning := release[0]["usage_warning"].(map[string]interface{})
+	assert.Equal(t, "WARNING_USAGE_STATE", warning["state"])
+	assert.Equal(t, float64(850), warning["usage"])
+	assert.Equal(t, float64(1000), warning["limit"])
+	pd := r.take("/pagerduty")
+	require.Len(t, pd, 1)
+	payload := pd[0]["payload"].(map[string]interface{})
+	assert.Equal(t, "warning", payload["severity"])
+	assert.Equal(t, "Organization GR1 has used 85% of its limit of 1000 daily build event bytes", payload["summary"])
+	assert.Equal(t, "2021-06-01 18:00 UTC", payload["custom_details"].(map[string]interface{})["projected_limit"])
+	assert.Equal(t, "buildbuddy/usage-alarms/usage/GR1/build_event_bytes", pd[0]["dedup_key"])
+
+	// Exceeding the limit escalates the same alert.
+	usage.Usage = 1000
+	usage.State = usagepb.UsageState_EXCEEDED_USAGE_STATE
+	usage.ProjectedLimitUsec = 0
+	err = router.NotifyUsageWarning(ctx, "GR1", usage)
+	require.NoError(t, err)
+	pd = r.take("/pagerduty")
+	require.Len(t, pd, 1)
+	assert.Equal(t, "error", pd[0]["payload"].(map[string]interface{})["severity"])
+	assert.Equal(t, "buildbuddy/usage-alarms/usage/GR1/build_event_bytes", pd[0]["dedup_key"])
+	require.Len(t, r.take("/release"), 1)
+
+	// Other groups aren't notified.
+	err = router.NotifyUsageWarning(ctx, "GR2", usage)
+	require.NoError(t, err)
+	assert.Empty(t, r.take("/release"))
+	assert.Empty(t, r.take("/pagerduty"))
+}
+
+func testSummaryEvent(label string, s build_event_stream.TestStatus) *inpb.InvocationEvent {
+	return &inpb.InvocationEvent{
+		BuildEvent: &build_event_stream.BuildEvent{
+			Id: &build_event_stream.BuildEventId{
+				Id: &build_event_stream.BuildEventId_TestSummary{
+					TestSummary: &build_event_stream.BuildEventId_TestSummaryId{Label: label},
+				},
+			},
+			Payload: &build_event_stream.BuildEvent_TestSummary{
+				TestSummary: &build_event_stream.TestSummary{OverallStatus: s},
+			},
+		},
+	}
+}
+
+func TestWebhookPayloadSummaries(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	r, url := startReceiver(t)
+	c := &config.NotificationsConfig{
+		Destinations: []config.NotificationDestinationConfig{
+			{Name: "deploy", Type: "webhook", URL: url + "/deploy", Fields: []string{"invocation_id", "invocation_url", "status", "duration_usec", "targets", "tests"}},
+		},
+		Rules: []config.NotificationRuleConfig{
+			{Name: "ci", Roles: []string{"CI"}, Destinations: []string{"deploy"}},
+		},
+	}
+	router, err := notifications.NewRouter(te, c, "http://localhost:8080")
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	invocation := &inpb.Invocation{
+		InvocationId: "IID1",
+		RepoUrl:      repoURL,
+		Command:      "test",
+		Role:         "CI",
+		DurationUsec: 5000000,
+		Progress: &inpb.InvocationProgress{
+			ConfiguredTargetCount: 10,
+			CompletedTargetCount:  10,
+			FailedTargetCount:     2,
+		},
+		Event: []*inpb.InvocationEvent{
+			testSummaryEvent("//:c_test", build_event_stream.TestStatus_TIMEOUT),
+			testSummaryEvent("//:a_test", build_event_stream.TestStatus_PASSED),
+			testSummaryEvent("//:b_test", build_event_stream.TestStatus_FLAKY),
+			testSummaryEvent("//:d_test", build_event_stream.TestStatus_FAILED),
+		},
+	}
+	err = router.NotifyInvocationComplete(ctx, "GR1", "main", invocation)
+	require.NoError(t, err)
+	deploy := r.take("/deploy")
+	require.Len(t, deploy, 1)
+	assert.Equal(t, map[string]interface{}{
+		"invocation_id":  "IID1",
+		"invocation_url": "http://localhost:8080/invocation/IID1",
+		"status":         "failure",
+		"duration_usec":  float64(5000000),
+		"targets": map[string]interface{}{
+			"configured": float64(10),
+			"completed":  float64(10),
+			"failed":     float64(2),
+		},
+		"tests": map[string]interface{}{
+			"total": float64(4),
+			"status_counts": map[string]interface{}{
+				"PASSED":  float64(1),
+				"FLAKY":   float64(1),
+				"TIMEOUT": float64(1),
+				"FAILED":  float64(1),
+			},
+			"failed_labels": []interface{}{"//:c_test", "//:d_test"},
+		},
+	}, deploy[0])
+
+	// Local invocations, which have no role, don't match the rule.
+	invocation.Role = ""
+	err = router.NotifyInvocationComplete(ctx, "GR1", "main", invocation)
+	require.NoError(t, err)
+	assert.Empty(t, r.take("/deploy"))
+}
+
+// startFlakyServer starts a server which fails the given number of requests
+// with the given status code, before succeeding, and counts the requests.
+func startFlakyServer(t *testing.T, code int) (url string, failures, requests *int32) {
+	failures, requests = new(int32), new(int32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(requests, 1)
+		if atomic.AddInt32(failures, -1) >= 0 {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "failed", code)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, failures, requests
+}
+
+func TestRetriesRetryableErrors(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	unavailableURL, unavailableFailures, unavailableRequests := startFlakyServer(t, http.StatusServiceUnavailable)
+	notFoundURL, notFoundFailures, notFoundRequests := startFlakyServer(t, http.StatusNotFound)
+	c := &config.NotificationsConfig{
+		Destinations: []config.NotificationDestinationConfig{
+			{Name: "unavailable", Type: "webhook", URL: unavailableURL},
+			{Name: "not-found", Type: "webhook", URL: notFoundURL},
+		},
+		Rules: []config.NotificationRuleConfig{
+			{Name: "unavailable", Destinations: []string{"unavailable"}},
+			{Name: "not-found", Destinations: []string{"not-found"}},
+		},
+		MaxAttempts: 3,
+	}
+	router, err := notifications.NewRouter(te, c, "http://localhost:8080")
+	require.NoError(t, err)
+	ctx := context.Background()
+	invocation := &inpb.Invocation{InvocationId: "IID1", Command: "build"}
+
+	// Unavailable destinations are retried until they succeed, or run out
+	// of attempts, while other client errors aren't retried.
+	atomic.StoreInt32(unavailableFailures, 2)
+	atomic.StoreInt32(notFoundFailures, 1)
+	err = router.NotifyInvocationComplete(ctx, "GR1", "", invocation)
+	assert.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition, got %v", err)
+	assert.Equal(t, int32(3), atomic.SwapInt32(unavailableRequests, 0))
+	assert.Equal(t, int32(1), atomic.SwapInt32(notFoundRequests, 0))
+
+	atomic.StoreInt32(unavailableFailures, 3)
+	atomic.StoreInt32(notFoundFailures, 0)
+	err = router.NotifyInvocationComplete(ctx, "GR1", "", invocation)
+	assert.True(t, status.IsUnavailableError(err), "expected Unavailable, got %v", err)
+	assert.Equal(t, int32(3), atomic.SwapInt32(unavailableRequests, 0))
+	assert.Equal(t, int32(1), atomic.SwapInt32(notFoundRequests, 0))
+}
+
+// fakeSecretService holds secrets in memory, keyed by group ID and name.
+type fakeSecretService struct {
+	interfaces.SecretService
+	secrets map[string]map[string]string
+}
+
+func (s *fakeSecretService) GetSecretValue(ctx context.Context, groupID, name string) (string, error) {
+	if v, ok := s.secrets[groupID][name]; ok {
+		return v, nil
+	}
+	return "", status.NotFoundErrorf("secret %q not found", name)
+}
+
+func TestDestinationSecrets(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	r, url := startReceiver(t)
+	c := &config.NotificationsConfig{
+		Destinations: []config.NotificationDestinationConfig{
+			{Name: "group-webhook", Type: "webhook", Secret: "webhook_url"},
+			{Name: "group-pagerduty", Type: "pagerduty", URL: url + "/pagerduty", Secret: "pagerduty_key"},
+		},
+		Rules: []config.NotificationRuleConfig{
+			{Name: "all", Destinations: []string{"group-webhook", "group-pagerduty"}},
+		},
+	}
+	router, err := notifications.NewRouter(te, c, "http://localhost:8080")
+	require.NoError(t, err)
+	ctx := context.Background()
+	failed := &inpb.Invocation{InvocationId: "IID1", RepoUrl: repoURL, Command: "test"}
+
+	// Secrets can't be read until they're configured.
+	err = router.NotifyInvocationComplete(ctx, "GR1", "main", failed)
+	assert.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition, got %v", err)
+
+	te.SetSecretService(&fakeSecretService{secrets: map[string]map[string]string{
+		"GR1": {"webhook_url": url + "/gr1", "pagerduty_key": "GR1KEY"},
+	}})
+	// The webhook's URL was read from a secret, so it may not point at the
+	// app's own network, unlike the configured PagerDuty URL.
+	err = router.NotifyInvocationComplete(ctx, "GR1", "main", failed)
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+	assert.Empty(t, r.take("/gr1"))
+	pd := r.take("/pagerduty")
+	require.Len(t, pd, 1)
+	assert.Equal(t, "GR1KEY", pd[0]["routing_key"])
+
+	// Groups without the secrets aren't notified.
+	err = router.NotifyInvocationComplete(ctx, "GR2", "main", failed)
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+	assert.Empty(t, r.take("/pagerduty"))
+}
+
+func TestNewRouterRejectsInvalidConfig(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	for name, mutate := range map[string]func(c *config.NotificationsConfig){
+		"unknown destination": func(c *config.NotificationsConfig) { c.Rules[0].Destinations = []string{"nope"} },
+		"unknown type":        func(c *config.NotificationsConfig) { c.Destinations[0].Type = "carrier_pigeon" },
+		"invalid status":      func(c *config.NotificationsConfig) { c.Rules[0].Statuses = []string{"flaky"} },
+		"invalid event":       func(c *config.NotificationsConfig) { c.Rules[0].Events = []string{"invocation_started"} },
+		"webhook without url": func(c *config.NotificationsConfig) { c.Destinations[0].URL = "" },
+		"unknown field":       func(c *config.NotificationsConfig) { c.Destinations[0].Fields = []string{"invocation_idd"} },
+		"fields of pagerduty": func(c *config.NotificationsConfig) { c.Destinations[2].Fields = []string{"invocation_id"} },
+		"email without smtp": func(c *config.NotificationsConfig) {
+			c.Destinations[0] = config.NotificationDestinationConfig{Name: "ci", Type: "email", EmailAddresses: []string{"ci@example.com"}}
+		},
+	} {
+		c := testConfig("http://localhost")
+		mutate(c)
+		_, err := notifications.NewRouter(te, c, "")
+		assert.True(t, status.IsInvalidArgumentError(err), "%s: expected InvalidArgument, got %v", name, err)
+	}
+}
+
+func TestSendTestNotification(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")))
+	ctx, err := te.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+	reqCtx := testauth.RequestContext("US1", "GR1")
+	r, url := startReceiver(t)
+	router, err := notifications.NewRouter(te, testConfig(url), "http://localhost:8080")
+	require.NoError(t, err)
+
+	rsp, err := router.SendTestNotification(ctx, &nfpb.SendTestNotificationRequest{RequestContext: reqCtx, Rule: "main-failures"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ci", "oncall"}, rsp.GetDestination())
+	ci := r.take("/ci")
+	require.Len(t, ci, 1)
+	assert.Equal(t, true, ci[0]["test"])
+	pd := r.take("/pagerduty")
+	require.Len(t, pd, 1)
+	assert.Equal(t, "info", pd[0]["payload"].(map[string]interface{})["severity"])
+
+	rsp, err = router.SendTestNotification(ctx, &nfpb.SendTestNotificationRequest{RequestContext: reqCtx, Destination: "ci"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ci"}, rsp.GetDestination())
+	assert.Len(t, r.take("/ci"), 1)
+
+	// Rules which aren't scoped to the user's group, and destinations only
+	// they use, may only be tested by server admins.
+	_, err = router.SendTestNotification(ctx, &nfpb.SendTestNotificationRequest{RequestContext: reqCtx, Rule: "releases"})
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+	_, err = router.SendTestNotification(ctx, &nfpb.SendTestNotificationRequest{RequestContext: reqCtx, Destination: "release"})
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+	assert.Empty(t, r.take("/release"))
+}
@@ -0,0 +1,36 @@
+package notifications
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecretURLClientRefusesNonPublicHosts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	localhostURL := "http://" + net.JoinHostPort("localhost", u.Port())
+
+	for _, target := range []string{server.URL, localhostURL} {
+		err := postJSON(context.Background(), newSecretURLClient(nil), target, "{}")
+		assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied for %s, got %v", target, err)
+
+		err = postJSON(context.Background(), newSecretURLClient([]string{"example.com"}), target, "{}")
+		assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied for %s, got %v", target, err)
+	}
+
+	// Allowed hosts may be connected to, whatever their address.
+	err = postJSON(context.Background(), newSecretURLClient([]string{u.Hostname()}), server.URL, "{}")
+	assert.NoError(t, err)
+	err = postJSON(context.Background(), newSecretURLClient([]string{"localhost"}), localhostURL, "{}")
+	assert.NoError(t, err)
+}
@@ -47,6 +47,8 @@ func (a *NullAuthenticator) AuthContextFromAPIKey(ctx context.Context, apiKey st
 	return ctx
 }
 
+func (a *NullAuthenticator) InvalidateAPIKey(apiKey string) {}
+
 func (a *NullAuthenticator) AuthenticateGRPCRequest(ctx context.Context) (interfaces.UserInfo, error) {
 	return nil, nil
 }
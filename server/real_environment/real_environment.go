@@ -8,6 +8,7 @@ import (
 
 	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/clock"
 	"github.com/buildbuddy-io/buildbuddy/server/util/db"
 
 	bspb "google.golang.org/genproto/googleapis/bytestream"
@@ -37,20 +38,31 @@ type RealEnv struct {
 	schedulerService                 interfaces.SchedulerService
 	taskRouter                       interfaces.TaskRouter
 	healthChecker                    interfaces.HealthChecker
+	clock                            interfaces.Clock
 	workflowService                  interfaces.WorkflowService
 	gitProviders                     interfaces.GitProviders
+	secretService                    interfaces.SecretService
+	accessLogService                 interfaces.AccessLogService
+	invocationExportService          interfaces.InvocationExportService
+	gitHubApp                        interfaces.GitHubApp
 	staticFilesystem                 fs.FS
 	appFilesystem                    fs.FS
 	blobstore                        interfaces.Blobstore
+	blobstoreBackends                interfaces.BlobstoreBackends
 	invocationDB                     interfaces.InvocationDB
+	invocationCache                  interfaces.InvocationCache
 	authenticator                    interfaces.Authenticator
 	repoDownloader                   interfaces.RepoDownloader
 	executionService                 interfaces.ExecutionService
 	cache                            interfaces.Cache
+	retentionStore                   interfaces.RetentionStore
+	digestMigrator                   interfaces.DigestMigrator
+	instanceNameAliasService         interfaces.InstanceNameAliasService
 	userDB                           interfaces.UserDB
 	authDB                           interfaces.AuthDB
 	buildEventHandler                interfaces.BuildEventHandler
 	invocationSearchService          interfaces.InvocationSearchService
+	consoleLogIndex                  interfaces.ConsoleLogIndex
 	invocationStatService            interfaces.InvocationStatService
 	splashPrinter                    interfaces.SplashPrinter
 	actionCacheClient                repb.ActionCacheClient
@@ -59,6 +71,7 @@ type RealEnv struct {
 	remoteExecutionClient            repb.ExecutionClient
 	contentAddressableStorageClient  repb.ContentAddressableStorageClient
 	metricsCollector                 interfaces.MetricsCollector
+	keyValStore                      interfaces.KeyValStore
 	APIService                       interfaces.ApiService
 	fileCache                        interfaces.FileCache
 	remoteExecutionService           interfaces.RemoteExecutionService
@@ -70,12 +83,15 @@ type RealEnv struct {
 	remoteExecutionRedisPubSubClient *redis.Client
 	buildEventProxyClients           []pepb.PublishBuildEventClient
 	webhooks                         []interfaces.Webhook
+	notificationRouter               interfaces.NotificationRouter
+	buildEventHooks                  []interfaces.BuildEventHook
 }
 
 func NewRealEnv(c *config.Configurator, h interfaces.HealthChecker) *RealEnv {
 	return &RealEnv{
 		configurator:  c,
 		healthChecker: h,
+		clock:         clock.Real(),
 
 		executionClients: make(map[string]*executionClientConfig, 0),
 	}
@@ -90,6 +106,15 @@ func (r *RealEnv) GetHealthChecker() interfaces.HealthChecker {
 	return r.healthChecker
 }
 
+func (r *RealEnv) GetClock() interfaces.Clock {
+	return r.clock
+}
+
+// SetClock replaces the real clock, e.g. with a fake one in tests.
+func (r *RealEnv) SetClock(c interfaces.Clock) {
+	r.clock = c
+}
+
 // Optional -- may not be set depending on environment configuration.
 func (r *RealEnv) SetDBHandle(h *db.DBHandle) {
 	r.dbHandle = h
@@ -118,6 +143,12 @@ func (r *RealEnv) GetBlobstore() interfaces.Blobstore {
 func (r *RealEnv) SetBlobstore(bs interfaces.Blobstore) {
 	r.blobstore = bs
 }
+func (r *RealEnv) GetBlobstoreBackends() interfaces.BlobstoreBackends {
+	return r.blobstoreBackends
+}
+func (r *RealEnv) SetBlobstoreBackends(b interfaces.BlobstoreBackends) {
+	r.blobstoreBackends = b
+}
 
 func (r *RealEnv) GetInvocationDB() interfaces.InvocationDB {
 	return r.invocationDB
@@ -125,6 +156,12 @@ func (r *RealEnv) GetInvocationDB() interfaces.InvocationDB {
 func (r *RealEnv) SetInvocationDB(idb interfaces.InvocationDB) {
 	r.invocationDB = idb
 }
+func (r *RealEnv) GetInvocationCache() interfaces.InvocationCache {
+	return r.invocationCache
+}
+func (r *RealEnv) SetInvocationCache(ic interfaces.InvocationCache) {
+	r.invocationCache = ic
+}
 
 func (r *RealEnv) GetWebhooks() []interfaces.Webhook {
 	return r.webhooks
@@ -132,6 +169,19 @@ func (r *RealEnv) GetWebhooks() []interfaces.Webhook {
 func (r *RealEnv) SetWebhooks(wh []interfaces.Webhook) {
 	r.webhooks = wh
 }
+func (r *RealEnv) GetNotificationRouter() interfaces.NotificationRouter {
+	return r.notificationRouter
+}
+func (r *RealEnv) SetNotificationRouter(nr interfaces.NotificationRouter) {
+	r.notificationRouter = nr
+}
+
+func (r *RealEnv) GetBuildEventHooks() []interfaces.BuildEventHook {
+	return r.buildEventHooks
+}
+func (r *RealEnv) SetBuildEventHooks(hooks []interfaces.BuildEventHook) {
+	r.buildEventHooks = hooks
+}
 
 func (r *RealEnv) GetBuildEventHandler() interfaces.BuildEventHandler {
 	return r.buildEventHandler
@@ -146,6 +196,12 @@ func (r *RealEnv) GetInvocationSearchService() interfaces.InvocationSearchServic
 func (r *RealEnv) SetInvocationSearchService(s interfaces.InvocationSearchService) {
 	r.invocationSearchService = s
 }
+func (r *RealEnv) GetConsoleLogIndex() interfaces.ConsoleLogIndex {
+	return r.consoleLogIndex
+}
+func (r *RealEnv) SetConsoleLogIndex(i interfaces.ConsoleLogIndex) {
+	r.consoleLogIndex = i
+}
 
 func (r *RealEnv) GetBuildEventProxyClients() []pepb.PublishBuildEventClient {
 	return r.buildEventProxyClients
@@ -160,6 +216,24 @@ func (r *RealEnv) GetCache() interfaces.Cache {
 func (r *RealEnv) SetCache(c interfaces.Cache) {
 	r.cache = c
 }
+func (r *RealEnv) GetRetentionStore() interfaces.RetentionStore {
+	return r.retentionStore
+}
+func (r *RealEnv) SetRetentionStore(rs interfaces.RetentionStore) {
+	r.retentionStore = rs
+}
+func (r *RealEnv) GetDigestMigrator() interfaces.DigestMigrator {
+	return r.digestMigrator
+}
+func (r *RealEnv) SetDigestMigrator(m interfaces.DigestMigrator) {
+	r.digestMigrator = m
+}
+func (r *RealEnv) GetInstanceNameAliasService() interfaces.InstanceNameAliasService {
+	return r.instanceNameAliasService
+}
+func (r *RealEnv) SetInstanceNameAliasService(s interfaces.InstanceNameAliasService) {
+	r.instanceNameAliasService = s
+}
 
 func (r *RealEnv) GetAuthenticator() interfaces.Authenticator {
 	return r.authenticator
@@ -267,6 +341,12 @@ func (r *RealEnv) SetMetricsCollector(c interfaces.MetricsCollector) {
 func (r *RealEnv) GetMetricsCollector() interfaces.MetricsCollector {
 	return r.metricsCollector
 }
+func (r *RealEnv) SetKeyValStore(s interfaces.KeyValStore) {
+	r.keyValStore = s
+}
+func (r *RealEnv) GetKeyValStore() interfaces.KeyValStore {
+	return r.keyValStore
+}
 func (r *RealEnv) SetExecutionService(e interfaces.ExecutionService) {
 	r.executionService = e
 }
@@ -291,6 +371,30 @@ func (r *RealEnv) GetGitProviders() interfaces.GitProviders {
 func (r *RealEnv) SetGitProviders(gp interfaces.GitProviders) {
 	r.gitProviders = gp
 }
+func (r *RealEnv) GetSecretService() interfaces.SecretService {
+	return r.secretService
+}
+func (r *RealEnv) SetSecretService(s interfaces.SecretService) {
+	r.secretService = s
+}
+func (r *RealEnv) GetAccessLogService() interfaces.AccessLogService {
+	return r.accessLogService
+}
+func (r *RealEnv) SetAccessLogService(s interfaces.AccessLogService) {
+	r.accessLogService = s
+}
+func (r *RealEnv) GetInvocationExportService() interfaces.InvocationExportService {
+	return r.invocationExportService
+}
+func (r *RealEnv) SetInvocationExportService(s interfaces.InvocationExportService) {
+	r.invocationExportService = s
+}
+func (r *RealEnv) GetGitHubApp() interfaces.GitHubApp {
+	return r.gitHubApp
+}
+func (r *RealEnv) SetGitHubApp(a interfaces.GitHubApp) {
+	r.gitHubApp = a
+}
 
 func (r *RealEnv) SetCacheRedisClient(redisClient *redis.Client) {
 	r.cacheRedisClient = redisClient
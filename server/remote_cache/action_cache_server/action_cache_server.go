@@ -8,14 +8,21 @@ import (
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/action_result_signing"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/delta"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/hit_tracker"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/retention"
 	"github.com/buildbuddy-io/buildbuddy/server/util/capabilities"
+	"github.com/buildbuddy-io/buildbuddy/server/util/deadline"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/golang/protobuf/proto"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/sync/errgroup"
 
 	akpb "github.com/buildbuddy-io/buildbuddy/proto/api_key"
@@ -23,8 +30,10 @@ import (
 )
 
 type ActionCacheServer struct {
-	env   environment.Env
-	cache interfaces.Cache
+	env        environment.Env
+	cache      interfaces.Cache
+	verifier   *action_result_signing.Verifier
+	namespaces *namespace.OverrideResolver
 }
 
 func NewActionCacheServer(env environment.Env) (*ActionCacheServer, error) {
@@ -32,18 +41,46 @@ func NewActionCacheServer(env environment.Env) (*ActionCacheServer, error) {
 	if cache == nil {
 		return nil, fmt.Errorf("A cache is required to enable the ActionCacheServer")
 	}
+	// Cache calls are given the budget of the request being served, so that
+	// they fail fast once the client has given up.
+	cache = deadline.Cache(cache)
+	// Blobs kept by retention classes remain readable after the cache has
+	// evicted them.
+	if rs := env.GetRetentionStore(); rs != nil {
+		cache = rs.Cache(cache)
+	}
+	// Blobs uploaded as deltas are reconstructed when read.
+	cache = delta.Cache(env, cache)
+	verifier, err := action_result_signing.NewVerifier(env.GetConfigurator().GetCacheActionResultVerificationKeyFiles())
+	if err != nil {
+		return nil, err
+	}
+	namespaces, err := namespace.NewOverrideResolver(env)
+	if err != nil {
+		return nil, err
+	}
 	return &ActionCacheServer{
-		env:   env,
-		cache: cache,
+		env:        env,
+		cache:      cache,
+		verifier:   verifier,
+		namespaces: namespaces,
 	}, nil
 }
 
-func (s *ActionCacheServer) getCache(instanceName string) interfaces.Cache {
-	return namespace.ActionCache(s.cache, instanceName)
+func (s *ActionCacheServer) getCache(ctx context.Context, instanceName string, digestFunction repb.DigestFunction_Value) (interfaces.Cache, error) {
+	cache, err := s.namespaces.InvocationCache(ctx, s.cache)
+	if err != nil {
+		return nil, err
+	}
+	return namespace.DigestFunctionCache(namespace.AliasedActionCache(ctx, s.env, cache, instanceName), digestFunction), nil
 }
 
-func (s *ActionCacheServer) getCASCache(instanceName string) interfaces.Cache {
-	return namespace.CASCache(s.cache, instanceName)
+func (s *ActionCacheServer) getCASCache(ctx context.Context, instanceName string, digestFunction repb.DigestFunction_Value) (interfaces.Cache, error) {
+	cache, err := s.namespaces.InvocationCache(ctx, s.cache)
+	if err != nil {
+		return nil, err
+	}
+	return namespace.DigestFunctionCache(namespace.AliasedCASCache(ctx, s.env, cache, instanceName), digestFunction), nil
 }
 
 func checkFilesExist(ctx context.Context, cache interfaces.Cache, digests []*repb.Digest) error {
@@ -104,6 +141,46 @@ func ValidateActionResult(ctx context.Context, cache interfaces.Cache, r *repb.A
 	return checkFilesExist(ctx, cache, outputFileDigests)
 }
 
+// validateActionResultDigests returns an error if any of the digests that the
+// action result refers to are malformed.
+func validateActionResultDigests(r *repb.ActionResult) error {
+	for _, f := range r.GetOutputFiles() {
+		if _, err := digest.Validate(f.GetDigest()); err != nil {
+			return status.InvalidArgumentErrorf("Output file %q has an invalid digest: %s", f.GetPath(), err)
+		}
+	}
+	for _, d := range r.GetOutputDirectories() {
+		if _, err := digest.Validate(d.GetTreeDigest()); err != nil {
+			return status.InvalidArgumentErrorf("Output directory %q has an invalid tree digest: %s", d.GetPath(), err)
+		}
+	}
+	for name, d := range map[string]*repb.Digest{"stdout": r.GetStdoutDigest(), "stderr": r.GetStderrDigest()} {
+		if d == nil {
+			continue
+		}
+		if _, err := digest.Validate(d); err != nil {
+			return status.InvalidArgumentErrorf("The %s digest is invalid: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// actionResultSource returns whether the action result was produced by a
+// BuildBuddy executor or by the client executing the action itself.
+func actionResultSource(r *repb.ActionResult) string {
+	if r.GetExecutionMetadata().GetExecutorId() != "" {
+		return "remote"
+	}
+	return "local"
+}
+
+func countActionResultUpload(r *repb.ActionResult, outcome string) {
+	metrics.ActionResultUploads.With(prometheus.Labels{
+		metrics.ActionResultSourceLabel:        actionResultSource(r),
+		metrics.ActionResultUploadOutcomeLabel: outcome,
+	}).Inc()
+}
+
 func setWorkerMetadata(ar *repb.ActionResult) {
 	if ar.ExecutionMetadata == nil {
 		ar.ExecutionMetadata = &repb.ExecutedActionMetadata{
@@ -112,6 +189,19 @@ func setWorkerMetadata(ar *repb.ActionResult) {
 	}
 }
 
+// retainLogs copies the stdout and stderr of the action into their retention
+// classes, if any, so that they outlive the action's outputs.
+func retainLogs(ctx context.Context, casCache interfaces.Cache, r *repb.ActionResult) {
+	for kind, d := range map[retention.Kind]*repb.Digest{retention.Stdout: r.GetStdoutDigest(), retention.Stderr: r.GetStderrDigest()} {
+		if d == nil {
+			continue
+		}
+		if err := retention.Retain(ctx, casCache, kind, d); err != nil {
+			log.Warningf("Could not retain %s (%s) of action result: %s", kind, d, err)
+		}
+	}
+}
+
 // Retrieve a cached execution result.
 //
 // Implementations SHOULD ensure that any blobs referenced from the
@@ -132,13 +222,22 @@ func (s *ActionCacheServer) GetActionResult(ctx context.Context, req *repb.GetAc
 	if err != nil {
 		return nil, err
 	}
+	if err := digest.ValidateDigestFunction(req.GetDigestFunction()); err != nil {
+		return nil, err
+	}
 	ctx, err = prefix.AttachUserPrefixToContext(ctx, s.env)
 	if err != nil {
 		return nil, err
 	}
 
-	cache := s.getCache(req.GetInstanceName())
-	casCache := s.getCASCache(req.GetInstanceName())
+	cache, err := s.getCache(ctx, req.GetInstanceName(), req.GetDigestFunction())
+	if err != nil {
+		return nil, err
+	}
+	casCache, err := s.getCASCache(ctx, req.GetInstanceName(), req.GetDigestFunction())
+	if err != nil {
+		return nil, err
+	}
 
 	ht := hit_tracker.NewHitTracker(ctx, s.env, true)
 	// Fetch the "ActionResult" object which enumerates all the files in the action.
@@ -158,6 +257,7 @@ func (s *ActionCacheServer) GetActionResult(ctx context.Context, req *repb.GetAc
 	if err := ValidateActionResult(ctx, casCache, rsp); err != nil {
 		return nil, status.NotFoundErrorf("ActionResult (%s) not found: %s", d, err)
 	}
+	s.verifier.SetStatus(d, rsp)
 	return rsp, nil
 }
 
@@ -188,6 +288,9 @@ func (s *ActionCacheServer) UpdateActionResult(ctx context.Context, req *repb.Up
 	if err != nil {
 		return nil, err
 	}
+	if err := digest.ValidateDigestFunction(req.GetDigestFunction()); err != nil {
+		return nil, err
+	}
 	ctx, err = prefix.AttachUserPrefixToContext(ctx, s.env)
 	if err != nil {
 		return nil, err
@@ -199,18 +302,49 @@ func (s *ActionCacheServer) UpdateActionResult(ctx context.Context, req *repb.Up
 	}
 	// For read-only API keys, pretend the request succeeded so bazel doesn't error out.
 	if !canWrite {
+		countActionResultUpload(req.ActionResult, "read_only")
 		return req.ActionResult, nil
 	}
 
+	// Results of actions that were executed locally (e.g. with
+	// --remote_upload_local_results) are only as trustworthy as the client
+	// that uploaded them, so make sure that they are well-formed and that
+	// their outputs were uploaded first, rather than storing results that
+	// would be treated as misses when read.
+	if err := validateActionResultDigests(req.ActionResult); err != nil {
+		countActionResultUpload(req.ActionResult, "invalid")
+		return nil, err
+	}
+	casCache, err := s.getCASCache(ctx, req.GetInstanceName(), req.GetDigestFunction())
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateActionResult(ctx, casCache, req.ActionResult); err != nil {
+		countActionResultUpload(req.ActionResult, "invalid")
+		if status.IsNotFoundError(err) {
+			return nil, status.FailedPreconditionErrorf("ActionResult refers to outputs which are missing from the CAS: %s", err)
+		}
+		return nil, err
+	}
+
 	ht := hit_tracker.NewHitTracker(ctx, s.env, true)
 	d := req.GetActionDigest()
 	uploadTracker := ht.TrackUpload(d)
-	cache := s.getCache(req.GetInstanceName())
+	cache, err := s.getCache(ctx, req.GetInstanceName(), req.GetDigestFunction())
+	if err != nil {
+		return nil, err
+	}
 
 	// Context: https://github.com/bazelbuild/remote-apis/pull/131
 	// More: https://github.com/buchgr/bazel-remote/commit/7de536f47bf163fb96bc1e38ffd5e444e2bcaa00
 	setWorkerMetadata(req.ActionResult)
 
+	// The signature is stored with the result, and verified again whenever
+	// the result is read, since the trusted keys may change.
+	if s.verifier.SetStatus(d, req.ActionResult) == repb.ActionResultSignatureStatus_INVALID_SIGNATURE {
+		log.Warningf("ActionResult (%s) uploaded by executor %q has an invalid signature", d, req.ActionResult.GetExecutionMetadata().GetExecutorId())
+	}
+
 	blob, err := proto.Marshal(req.ActionResult)
 	if err != nil {
 		return nil, err
@@ -220,5 +354,7 @@ func (s *ActionCacheServer) UpdateActionResult(ctx context.Context, req *repb.Up
 		return nil, err
 	}
 	uploadTracker.Close()
+	retainLogs(ctx, casCache, req.ActionResult)
+	countActionResultUpload(req.ActionResult, "stored")
 	return req.ActionResult, nil
 }
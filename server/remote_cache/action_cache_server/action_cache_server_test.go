@@ -0,0 +1,81 @@
+package action_cache_server_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/action_cache_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/content_addressable_storage_server"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+func runACServer(ctx context.Context, t *testing.T, env *testenv.TestEnv) (repb.ActionCacheClient, repb.ContentAddressableStorageClient) {
+	acServer, err := action_cache_server.NewActionCacheServer(env)
+	require.NoError(t, err)
+	casServer, err := content_addressable_storage_server.NewContentAddressableStorageServer(env)
+	require.NoError(t, err)
+
+	grpcServer, runFunc := env.LocalGRPCServer()
+	repb.RegisterActionCacheServer(grpcServer, acServer)
+	repb.RegisterContentAddressableStorageServer(grpcServer, casServer)
+	go runFunc()
+
+	clientConn, err := env.LocalGRPCConn(ctx)
+	require.NoError(t, err)
+	return repb.NewActionCacheClient(clientConn), repb.NewContentAddressableStorageClient(clientConn)
+}
+
+func TestUpdateActionResult_LocalResult(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te)
+	require.NoError(t, err)
+	acClient, casClient := runACServer(ctx, t, te)
+
+	actionDigest, _ := testdigest.NewRandomDigestBuf(t, 100)
+	outputDigest, output := testdigest.NewRandomDigestBuf(t, 100)
+	result := &repb.ActionResult{
+		OutputFiles: []*repb.OutputFile{{Path: "out.txt", Digest: outputDigest}},
+	}
+	req := &repb.UpdateActionResultRequest{ActionDigest: actionDigest, ActionResult: result}
+
+	// The output hasn't been uploaded yet.
+	_, err = acClient.UpdateActionResult(ctx, req)
+	assert.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition, got %v", err)
+	_, err = acClient.GetActionResult(ctx, &repb.GetActionResultRequest{ActionDigest: actionDigest})
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+
+	_, err = casClient.BatchUpdateBlobs(ctx, &repb.BatchUpdateBlobsRequest{
+		Requests: []*repb.BatchUpdateBlobsRequest_Request{{Digest: outputDigest, Data: output}},
+	})
+	require.NoError(t, err)
+
+	_, err = acClient.UpdateActionResult(ctx, req)
+	require.NoError(t, err)
+	rsp, err := acClient.GetActionResult(ctx, &repb.GetActionResultRequest{ActionDigest: actionDigest})
+	require.NoError(t, err)
+	assert.Equal(t, "out.txt", rsp.GetOutputFiles()[0].GetPath())
+	assert.NotEmpty(t, rsp.GetExecutionMetadata().GetWorker())
+}
+
+func TestUpdateActionResult_InvalidDigest(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te)
+	require.NoError(t, err)
+	acClient, _ := runACServer(ctx, t, te)
+
+	actionDigest, _ := testdigest.NewRandomDigestBuf(t, 100)
+	_, err = acClient.UpdateActionResult(ctx, &repb.UpdateActionResultRequest{
+		ActionDigest: actionDigest,
+		ActionResult: &repb.ActionResult{
+			OutputFiles: []*repb.OutputFile{{Path: "out.txt", Digest: &repb.Digest{Hash: "not-a-hash", SizeBytes: 3}}},
+		},
+	})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+}
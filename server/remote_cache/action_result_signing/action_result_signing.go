@@ -0,0 +1,158 @@
+// Package action_result_signing signs the action results produced by
+// executors, so that the action cache can tell them apart from results
+// uploaded by clients.
+//
+// An executor signs the SHA256 hash of the action digest and the
+// deterministically-marshaled action result, with the signature and
+// signature status fields cleared, using an Ed25519 private key. The action
+// cache verifies the signature against the public keys it trusts.
+package action_result_signing
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/proto"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const signatureContext = "buildbuddy-action-result-v1\x00"
+
+// Signer signs action results with an executor's private key.
+type Signer struct {
+	key ed25519.PrivateKey
+}
+
+// NewSigner returns a signer using the PEM-encoded PKCS #8 Ed25519 private
+// key in the given file, as generated by
+// `openssl genpkey -algorithm ed25519`.
+func NewSigner(keyFile string) (*Signer, error) {
+	block, err := readPEMFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("could not parse action result signing key %q: %s", keyFile, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, status.InvalidArgumentErrorf("action result signing key %q is not an Ed25519 key", keyFile)
+	}
+	return &Signer{key: edKey}, nil
+}
+
+// Sign signs the result of the action with the given digest, setting the
+// signature in the result's execution metadata.
+func (s *Signer) Sign(actionDigest *repb.Digest, r *repb.ActionResult) error {
+	if r.ExecutionMetadata == nil {
+		r.ExecutionMetadata = &repb.ExecutedActionMetadata{}
+	}
+	payload, err := signedPayload(actionDigest, r)
+	if err != nil {
+		return err
+	}
+	r.ExecutionMetadata.ActionResultSignature = ed25519.Sign(s.key, payload)
+	return nil
+}
+
+// Verifier checks action result signatures against a set of trusted public
+// keys.
+type Verifier struct {
+	keys []ed25519.PublicKey
+}
+
+// NewVerifier returns a verifier trusting the PEM-encoded PKIX Ed25519
+// public keys in the given files, as generated by `openssl pkey -pubout`.
+// It returns nil if no files are given.
+func NewVerifier(keyFiles []string) (*Verifier, error) {
+	if len(keyFiles) == 0 {
+		return nil, nil
+	}
+	v := &Verifier{}
+	for _, keyFile := range keyFiles {
+		block, err := readPEMFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("could not parse action result verification key %q: %s", keyFile, err)
+		}
+		edKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, status.InvalidArgumentErrorf("action result verification key %q is not an Ed25519 key", keyFile)
+		}
+		v.keys = append(v.keys, edKey)
+	}
+	return v, nil
+}
+
+// Verify returns the signature status of the result of the action with the
+// given digest. A nil verifier returns UNKNOWN_SIGNATURE_STATUS.
+func (v *Verifier) Verify(actionDigest *repb.Digest, r *repb.ActionResult) repb.ActionResultSignatureStatus {
+	if v == nil {
+		return repb.ActionResultSignatureStatus_UNKNOWN_SIGNATURE_STATUS
+	}
+	signature := r.GetExecutionMetadata().GetActionResultSignature()
+	if len(signature) == 0 {
+		return repb.ActionResultSignatureStatus_UNSIGNED
+	}
+	payload, err := signedPayload(actionDigest, r)
+	if err != nil {
+		return repb.ActionResultSignatureStatus_INVALID_SIGNATURE
+	}
+	for _, key := range v.keys {
+		if ed25519.Verify(key, payload, signature) {
+			return repb.ActionResultSignatureStatus_VERIFIED
+		}
+	}
+	return repb.ActionResultSignatureStatus_INVALID_SIGNATURE
+}
+
+// SetStatus verifies the result's signature and records the outcome in the
+// result's execution metadata, replacing any status set by the uploader.
+func (v *Verifier) SetStatus(actionDigest *repb.Digest, r *repb.ActionResult) repb.ActionResultSignatureStatus {
+	s := v.Verify(actionDigest, r)
+	if r.ExecutionMetadata != nil {
+		r.ExecutionMetadata.ActionResultSignatureStatus = s
+	}
+	return s
+}
+
+// signedPayload returns the hash that is signed for the given action result.
+func signedPayload(actionDigest *repb.Digest, r *repb.ActionResult) ([]byte, error) {
+	unsigned := proto.Clone(r).(*repb.ActionResult)
+	if unsigned.ExecutionMetadata != nil {
+		unsigned.ExecutionMetadata.ActionResultSignature = nil
+		unsigned.ExecutionMetadata.ActionResultSignatureStatus = repb.ActionResultSignatureStatus_UNKNOWN_SIGNATURE_STATUS
+	}
+	buf := proto.NewBuffer(nil)
+	buf.SetDeterministic(true)
+	if err := buf.Marshal(unsigned); err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write([]byte(signatureContext))
+	h.Write([]byte(actionDigest.GetHash()))
+	h.Write([]byte{0})
+	h.Write(buf.Bytes())
+	return h.Sum(nil), nil
+}
+
+func readPEMFile(path string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("could not read key file %q: %s", path, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, status.InvalidArgumentErrorf("key file %q does not contain a PEM block", path)
+	}
+	return block, nil
+}
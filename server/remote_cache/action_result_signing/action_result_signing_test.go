@@ -0,0 +1,106 @@
+package action_result_signing_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/action_result_signing"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+// writeKeyPair writes a new key pair to PEM files and returns their paths.
+func writeKeyPair(t *testing.T, dir, name string) (privateKeyFile, publicKeyFile string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	require.NoError(t, err)
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	require.NoError(t, err)
+
+	privateKeyFile = filepath.Join(dir, name+".pem")
+	publicKeyFile = filepath.Join(dir, name+".pub.pem")
+	err = ioutil.WriteFile(privateKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0600)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(publicKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644)
+	require.NoError(t, err)
+	return privateKeyFile, publicKeyFile
+}
+
+func newResult(t *testing.T) *repb.ActionResult {
+	d, _ := testdigest.NewRandomDigestBuf(t, 100)
+	return &repb.ActionResult{
+		OutputFiles:       []*repb.OutputFile{{Path: "out", Digest: d}},
+		ExitCode:          0,
+		ExecutionMetadata: &repb.ExecutedActionMetadata{Worker: "worker", ExecutorId: "executor"},
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	dir := t.TempDir()
+	trustedKey, trustedPub := writeKeyPair(t, dir, "trusted")
+	untrustedKey, _ := writeKeyPair(t, dir, "untrusted")
+
+	signer, err := action_result_signing.NewSigner(trustedKey)
+	require.NoError(t, err)
+	untrustedSigner, err := action_result_signing.NewSigner(untrustedKey)
+	require.NoError(t, err)
+	verifier, err := action_result_signing.NewVerifier([]string{trustedPub})
+	require.NoError(t, err)
+
+	actionDigest, _ := testdigest.NewRandomDigestBuf(t, 100)
+	otherActionDigest, _ := testdigest.NewRandomDigestBuf(t, 100)
+
+	r := newResult(t)
+	assert.Equal(t, repb.ActionResultSignatureStatus_UNSIGNED, verifier.Verify(actionDigest, r))
+
+	require.NoError(t, signer.Sign(actionDigest, r))
+	assert.Equal(t, repb.ActionResultSignatureStatus_VERIFIED, verifier.SetStatus(actionDigest, r))
+	assert.Equal(t, repb.ActionResultSignatureStatus_VERIFIED, r.GetExecutionMetadata().GetActionResultSignatureStatus())
+	// The status set by SetStatus isn't part of the signed content.
+	assert.Equal(t, repb.ActionResultSignatureStatus_VERIFIED, verifier.Verify(actionDigest, r))
+
+	// Results can't be reused for other actions.
+	assert.Equal(t, repb.ActionResultSignatureStatus_INVALID_SIGNATURE, verifier.Verify(otherActionDigest, r))
+
+	// Tampering with the result invalidates the signature.
+	r.ExitCode = 1
+	assert.Equal(t, repb.ActionResultSignatureStatus_INVALID_SIGNATURE, verifier.Verify(actionDigest, r))
+
+	r = newResult(t)
+	require.NoError(t, untrustedSigner.Sign(actionDigest, r))
+	assert.Equal(t, repb.ActionResultSignatureStatus_INVALID_SIGNATURE, verifier.Verify(actionDigest, r))
+}
+
+func TestNilVerifier(t *testing.T) {
+	verifier, err := action_result_signing.NewVerifier(nil)
+	require.NoError(t, err)
+	assert.Nil(t, verifier)
+
+	actionDigest, _ := testdigest.NewRandomDigestBuf(t, 100)
+	r := newResult(t)
+	// Statuses set by uploaders are cleared.
+	r.ExecutionMetadata.ActionResultSignatureStatus = repb.ActionResultSignatureStatus_VERIFIED
+	assert.Equal(t, repb.ActionResultSignatureStatus_UNKNOWN_SIGNATURE_STATUS, verifier.SetStatus(actionDigest, r))
+	assert.Equal(t, repb.ActionResultSignatureStatus_UNKNOWN_SIGNATURE_STATUS, r.GetExecutionMetadata().GetActionResultSignatureStatus())
+}
+
+func TestInvalidKeyFiles(t *testing.T) {
+	dir := t.TempDir()
+	privateKey, publicKey := writeKeyPair(t, dir, "key")
+
+	_, err := action_result_signing.NewSigner(publicKey)
+	assert.Error(t, err)
+	_, err = action_result_signing.NewVerifier([]string{privateKey})
+	assert.Error(t, err)
+	_, err = action_result_signing.NewSigner(filepath.Join(dir, "missing.pem"))
+	assert.Error(t, err)
+}
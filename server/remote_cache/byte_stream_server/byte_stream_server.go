@@ -2,16 +2,17 @@ package byte_stream_server
 
 import (
 	"context"
-	"crypto/sha256"
 	"fmt"
 	"hash"
 	"io"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/delta"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/hit_tracker"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/shared_reader"
 	"github.com/buildbuddy-io/buildbuddy/server/util/capabilities"
 	"github.com/buildbuddy-io/buildbuddy/server/util/devnull"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
@@ -22,14 +23,14 @@ import (
 	bspb "google.golang.org/genproto/googleapis/bytestream"
 )
 
-const (
-	// Keep under the limit of ~4MB (1024 * 1024 * 4).
-	readBufSizeBytes = (1024 * 1024 * 4) - 100
-)
-
 type ByteStreamServer struct {
-	env   environment.Env
-	cache interfaces.Cache
+	env        environment.Env
+	cache      interfaces.Cache
+	namespaces *namespace.OverrideResolver
+	// Concurrent reads of blobs at least sharedReadMinSizeBytes large share
+	// a single read from the cache. Nil if disabled.
+	sharedReads            *shared_reader.Group
+	sharedReadMinSizeBytes int64
 }
 
 func NewByteStreamServer(env environment.Env) (*ByteStreamServer, error) {
@@ -37,14 +38,65 @@ func NewByteStreamServer(env environment.Env) (*ByteStreamServer, error) {
 	if cache == nil {
 		return nil, status.FailedPreconditionError("A cache is required to enable the ByteStreamServer")
 	}
-	return &ByteStreamServer{
-		env:   env,
-		cache: cache,
-	}, nil
+	// Blobs kept by retention classes remain readable after the cache has
+	// evicted them.
+	if rs := env.GetRetentionStore(); rs != nil {
+		cache = rs.Cache(cache)
+	}
+	// Blobs uploaded as deltas are reconstructed when read.
+	cache = delta.Cache(env, cache)
+	namespaces, err := namespace.NewOverrideResolver(env)
+	if err != nil {
+		return nil, err
+	}
+	s := &ByteStreamServer{
+		env:        env,
+		cache:      cache,
+		namespaces: namespaces,
+	}
+	if n := env.GetConfigurator().GetCacheSharedReadMinSizeBytes(); n > 0 {
+		s.sharedReads = shared_reader.NewGroup()
+		s.sharedReadMinSizeBytes = n
+	}
+	return s, nil
+}
+
+func (s *ByteStreamServer) getCache(ctx context.Context, instanceName string, digestFunction repb.DigestFunction_Value) (interfaces.Cache, error) {
+	cache, err := s.namespaces.InvocationCache(ctx, s.cache)
+	if err != nil {
+		return nil, err
+	}
+	cache = namespace.AliasedCASCache(ctx, s.env, cache, instanceName)
+	if digestFunction == repb.DigestFunction_BLAKE3 {
+		return namespace.DigestFunctionCache(cache, digestFunction), nil
+	}
+	// While SHA256 blobs are being migrated, the blobs that clients use are
+	// also copied to their BLAKE3 digests.
+	if m := s.env.GetDigestMigrator(); m != nil {
+		return m.CASCache(cache, instanceName), nil
+	}
+	return cache, nil
 }
 
-func (s *ByteStreamServer) getCache(instanceName string) interfaces.Cache {
-	return namespace.CASCache(s.cache, instanceName)
+// reader returns a reader for the given blob. Large blobs are read through
+// the shared reader group, so that concurrent reads of the same blob are
+// served from a single read of the cache.
+func (s *ByteStreamServer) reader(ctx context.Context, cache interfaces.Cache, instanceName string, d *repb.Digest, offset int64) (io.ReadCloser, error) {
+	if s.sharedReads == nil || d.GetSizeBytes() < s.sharedReadMinSizeBytes {
+		return cache.Reader(ctx, d, offset)
+	}
+	userPrefix, err := prefix.UserPrefixFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ns, err := s.namespaces.InvocationOverride(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%s/%s/%s/%s/%d", userPrefix, ns, instanceName, d.GetHash(), d.GetSizeBytes())
+	return s.sharedReads.Reader(ctx, key, offset, func(ctx context.Context) (io.ReadCloser, error) {
+		return cache.Reader(ctx, d, 0)
+	})
 }
 
 func minInt64(a, b int64) int64 {
@@ -85,22 +137,26 @@ func (s *ByteStreamServer) Read(req *bspb.ReadRequest, stream bspb.ByteStream_Re
 	if err := checkReadPreconditions(req); err != nil {
 		return err
 	}
-	instanceName, d, err := digest.ExtractDigestFromDownloadResourceName(req.GetResourceName())
+	rn, err := digest.ParseDownloadResourceName(req.GetResourceName())
 	if err != nil {
 		return err
 	}
+	instanceName, d := rn.GetInstanceName(), rn.Digest
 	ctx, err := prefix.AttachUserPrefixToContext(stream.Context(), s.env)
 	if err != nil {
 		return err
 	}
 
 	ht := hit_tracker.NewHitTracker(ctx, s.env, false)
-	cache := s.getCache(instanceName)
-	if d.GetHash() == digest.EmptySha256 {
+	cache, err := s.getCache(ctx, instanceName, rn.GetDigestFunction())
+	if err != nil {
+		return err
+	}
+	if digest.IsEmptyHash(d.GetHash()) {
 		ht.TrackEmptyHit()
 		return nil
 	}
-	reader, err := cache.Reader(ctx, d, req.ReadOffset)
+	reader, err := s.reader(ctx, cache, instanceName, d, req.ReadOffset)
 	if err != nil {
 		ht.TrackMiss(d)
 		return err
@@ -109,7 +165,7 @@ func (s *ByteStreamServer) Read(req *bspb.ReadRequest, stream bspb.ByteStream_Re
 
 	downloadTracker := ht.TrackDownload(d)
 
-	bufSize := int64(readBufSizeBytes)
+	bufSize := s.env.GetConfigurator().GetCacheReadChunkSizeBytes()
 	if d.GetSizeBytes() > 0 && d.GetSizeBytes() < bufSize {
 		bufSize = d.GetSizeBytes()
 	}
@@ -151,6 +207,9 @@ type writeState struct {
 	activeResourceName string
 	bytesWritten       int64
 	alreadyExists      bool
+	// Whether the data written is a BlobDelta which reconstructs the blob,
+	// rather than the blob itself. Deltas are verified by their writer.
+	isDelta bool
 }
 
 func checkInitialPreconditions(req *bspb.WriteRequest) error {
@@ -176,19 +235,33 @@ func checkSubsequentPreconditions(req *bspb.WriteRequest, ws *writeState) error
 }
 
 func (s *ByteStreamServer) initStreamState(ctx context.Context, req *bspb.WriteRequest) (*writeState, error) {
-	instanceName, d, err := digest.ExtractDigestFromUploadResourceName(req.ResourceName)
+	rn, err := digest.ParseUploadResourceName(req.ResourceName)
 	if err != nil {
 		return nil, err
 	}
+	d := rn.Digest
 	ctx, err = prefix.AttachUserPrefixToContext(ctx, s.env)
 	if err != nil {
 		return nil, err
 	}
-	cache := s.getCache(instanceName)
+	cache, err := s.getCache(ctx, rn.GetInstanceName(), rn.GetDigestFunction())
+	if err != nil {
+		return nil, err
+	}
 
 	ws := &writeState{
 		activeResourceName: req.ResourceName,
 		d:                  d,
+		isDelta:            digest.IsDeltaUploadResourceName(req.ResourceName),
+	}
+	// Deltas are verified against the SHA256 digest of the blob that they
+	// reconstruct.
+	if ws.isDelta && rn.GetDigestFunction() != repb.DigestFunction_SHA256 {
+		return nil, status.UnimplementedErrorf("Delta uploads of %s digests are not supported", rn.GetDigestFunction())
+	}
+	checksum, err := digest.HashFunction(rn.GetDigestFunction())
+	if err != nil {
+		return nil, err
 	}
 
 	// The protocol says it is *optional* to allow overwriting, but does
@@ -204,15 +277,17 @@ func (s *ByteStreamServer) initStreamState(ctx context.Context, req *bspb.WriteR
 		return nil, err
 	}
 	var wc io.WriteCloser
-	if d.GetHash() != digest.EmptySha256 && !exists {
-		wc, err = cache.Writer(ctx, d)
-		if err != nil {
-			return nil, err
-		}
-	} else {
+	if digest.IsEmptyHash(d.GetHash()) || exists {
 		wc = devnull.NewWriteCloser()
+	} else if ws.isDelta {
+		wc, err = delta.Writer(ctx, cache, d)
+	} else {
+		wc, err = cache.Writer(ctx, d)
 	}
-	ws.checksum = sha256.New()
+	if err != nil {
+		return nil, err
+	}
+	ws.checksum = checksum
 	ws.writer = wc
 	ws.alreadyExists = exists
 	if exists {
@@ -234,6 +309,9 @@ func (w *writeState) Write(buf []byte) error {
 }
 
 func (w *writeState) Close() error {
+	if w.isDelta {
+		return w.writer.Close()
+	}
 	// Verify that digest length and hash match.
 	computedDigest := fmt.Sprintf("%x", w.checksum.Sum(nil))
 	if computedDigest != w.d.GetHash() {
@@ -4,15 +4,20 @@ import (
 	"bytes"
 	"context"
 	"io"
+	"sync"
 	"testing"
 
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/delta"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/random"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"google.golang.org/grpc"
 
@@ -133,6 +138,45 @@ func TestRPCRead(t *testing.T) {
 	}
 }
 
+func TestRPCConcurrentLargeReads(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	clientConn := runByteStreamServer(ctx, te, t)
+	bsClient := bspb.NewByteStreamClient(clientConn)
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Large enough to be read through the shared reader.
+	d, buf := testdigest.NewRandomDigestBuf(t, 20*1024*1024)
+	if err := te.GetCache().Set(ctx, d, buf); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var out bytes.Buffer
+			if err := readBlob(ctx, bsClient, digest.NewInstanceNameDigest(d, ""), &out); err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(out.Bytes(), buf) {
+				t.Errorf("read %d bytes that don't match the %d byte blob", out.Len(), len(buf))
+			}
+		}()
+	}
+	wg.Wait()
+
+	missing, _ := testdigest.NewRandomDigestBuf(t, 20*1024*1024)
+	err = readBlob(ctx, bsClient, digest.NewInstanceNameDigest(missing, ""), &bytes.Buffer{})
+	if !status.IsNotFoundError(err) {
+		t.Errorf("got %v; want NotFound", err)
+	}
+}
+
 func TestRPCWrite(t *testing.T) {
 	ctx := context.Background()
 	te := testenv.GetTestEnv(t)
@@ -183,3 +227,33 @@ func TestRPCTooLongWrite(t *testing.T) {
 		t.Fatalf("Expected data loss error but got %s", err)
 	}
 }
+
+func TestRPCDeltaWrite(t *testing.T) {
+	flags.Set(t, "cache.delta_uploads.enabled", "true")
+	flags.Set(t, "cache.delta_uploads.min_blob_size_bytes", "1")
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	clientConn := runByteStreamServer(ctx, te, t)
+	bsClient := bspb.NewByteStreamClient(clientConn)
+
+	baseDigest, base := testdigest.NewRandomDigestBuf(t, 100_000)
+	_, err := cachetools.UploadFromReader(ctx, bsClient, digest.NewInstanceNameDigest(baseDigest, "instance"), bytes.NewReader(base))
+	require.NoError(t, err)
+	target := append([]byte("header"), base...)
+	targetDigest, err := digest.Compute(bytes.NewReader(target))
+	require.NoError(t, err)
+
+	// Test that a delta upload is reconstructed on read.
+	blobDelta := delta.Encode(baseDigest, base, target)
+	ind := digest.NewInstanceNameDigest(targetDigest, "instance")
+	_, err = cachetools.UploadDelta(ctx, bsClient, ind, blobDelta)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, readBlob(ctx, bsClient, ind, &buf))
+	assert.Equal(t, target, buf.Bytes())
+
+	// Test that a delta against a base in another instance is rejected.
+	ind = digest.NewInstanceNameDigest(targetDigest, "other")
+	_, err = cachetools.UploadDelta(ctx, bsClient, ind, blobDelta)
+	assert.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition but got %v", err)
+}
@@ -3,6 +3,7 @@ package cachetools
 import (
 	"bytes"
 	"context"
+	"flag"
 	"fmt"
 	"io"
 	"os"
@@ -12,6 +13,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/util/retry"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/golang/protobuf/proto"
 	"golang.org/x/sync/errgroup"
@@ -23,9 +25,9 @@ import (
 	gstatus "google.golang.org/grpc/status"
 )
 
-const (
-	uploadBufSizeBytes = 1000000 // 1MB
-	gRPCMaxSize        = int64(4000000)
+var (
+	uploadBufSizeBytes = flag.Int("cache_client_upload_chunk_size_bytes", 1000000, "The size of each chunk sent when uploading blobs via bytestream [bytes].")
+	gRPCMaxSize        = flag.Int64("cache_client_max_batch_size_bytes", 4000000, "The max total size of a BatchUpdateBlobs request [bytes]. Blobs larger than this are uploaded via bytestream.")
 )
 
 // TODO(tylerw): This could probably go into util/ and be used by the BuildBuddy
@@ -88,21 +90,64 @@ func UploadFromReader(ctx context.Context, bsClient bspb.ByteStreamClient, ad *d
 	if ad.Digest.GetHash() == digest.EmptySha256 {
 		return ad.Digest, nil
 	}
-	resourceName, err := digest.UploadResourceName(ad.Digest, ad.GetInstanceName())
+	attempt := 0
+	err := retry.Do(ctx, retry.DefaultOptions(), func() error {
+		attempt++
+		if attempt > 1 {
+			// Start over from the beginning, since we don't know how much of
+			// the previous attempt was committed.
+			if _, err := in.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		resourceName, err := digest.UploadResourceName(ad.Digest, ad.GetInstanceName())
+		if err != nil {
+			return err
+		}
+		return uploadFromReader(ctx, bsClient, resourceName, in)
+	})
 	if err != nil {
 		return nil, err
 	}
-	stream, err := bsClient.Write(ctx)
+	return ad.Digest, nil
+}
+
+// UploadDelta uploads the blob with the given digest as a delta against a
+// blob that is already in the cache. Servers advertise support for deltas in
+// the delta_capabilities of their cache capabilities.
+func UploadDelta(ctx context.Context, bsClient bspb.ByteStreamClient, ad *digest.InstanceNameDigest, delta *repb.BlobDelta) (*repb.Digest, error) {
+	if bsClient == nil {
+		return nil, status.FailedPreconditionError("ByteStreamClient not configured")
+	}
+	buf, err := proto.Marshal(delta)
+	if err != nil {
+		return nil, err
+	}
+	err = retry.Do(ctx, retry.DefaultOptions(), func() error {
+		resourceName, err := digest.DeltaUploadResourceName(ad.Digest, ad.GetInstanceName())
+		if err != nil {
+			return err
+		}
+		return uploadFromReader(ctx, bsClient, resourceName, bytes.NewReader(buf))
+	})
 	if err != nil {
 		return nil, err
 	}
+	return ad.Digest, nil
+}
 
-	buf := make([]byte, uploadBufSizeBytes)
+func uploadFromReader(ctx context.Context, bsClient bspb.ByteStreamClient, resourceName string, in io.Reader) error {
+	stream, err := bsClient.Write(ctx)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, *uploadBufSizeBytes)
 	bytesUploaded := int64(0)
 	for {
 		n, err := in.Read(buf)
 		if err != nil && err != io.EOF {
-			return nil, err
+			return err
 		}
 		readDone := err == io.EOF
 
@@ -116,7 +161,7 @@ func UploadFromReader(ctx context.Context, bsClient bspb.ByteStreamClient, ad *d
 			if err == io.EOF {
 				break
 			}
-			return nil, err
+			return err
 		}
 		bytesUploaded += int64(n)
 		if readDone {
@@ -125,10 +170,7 @@ func UploadFromReader(ctx context.Context, bsClient bspb.ByteStreamClient, ad *d
 
 	}
 	_, err = stream.CloseAndRecv()
-	if err != nil {
-		return nil, err
-	}
-	return ad.Digest, nil
+	return err
 }
 
 func GetActionResult(ctx context.Context, acClient repb.ActionCacheClient, ad *digest.InstanceNameDigest) (*repb.ActionResult, error) {
@@ -139,7 +181,13 @@ func GetActionResult(ctx context.Context, acClient repb.ActionCacheClient, ad *d
 		ActionDigest: ad.Digest,
 		InstanceName: ad.GetInstanceName(),
 	}
-	return acClient.GetActionResult(ctx, req)
+	var rsp *repb.ActionResult
+	err := retry.Do(ctx, retry.DefaultOptions(), func() error {
+		var err error
+		rsp, err = acClient.GetActionResult(ctx, req)
+		return err
+	})
+	return rsp, err
 }
 
 func UploadActionResult(ctx context.Context, acClient repb.ActionCacheClient, ad *digest.InstanceNameDigest, ar *repb.ActionResult) error {
@@ -151,8 +199,10 @@ func UploadActionResult(ctx context.Context, acClient repb.ActionCacheClient, ad
 		ActionDigest: ad.Digest,
 		ActionResult: ar,
 	}
-	_, err := acClient.UpdateActionResult(ctx, req)
-	return err
+	return retry.Do(ctx, retry.DefaultOptions(), func() error {
+		_, err := acClient.UpdateActionResult(ctx, req)
+		return err
+	})
 }
 
 func UploadProto(ctx context.Context, bsClient bspb.ByteStreamClient, instanceName string, in proto.Message) (*repb.Digest, error) {
@@ -326,7 +376,7 @@ func (ul *BatchCASUploader) Upload(d *repb.Digest, r io.ReadSeekCloser) error {
 
 	r.Seek(0, 0)
 
-	if d.GetSizeBytes() > gRPCMaxSize {
+	if d.GetSizeBytes() > *gRPCMaxSize {
 		ul.eg.Go(func() error {
 			defer r.Close()
 			_, err := UploadFromReader(ul.ctx, ul.byteStreamClient, digest.NewInstanceNameDigest(d, ul.instanceName), r)
@@ -335,7 +385,7 @@ func (ul *BatchCASUploader) Upload(d *repb.Digest, r io.ReadSeekCloser) error {
 		return nil
 	}
 
-	if ul.unsentBatchSize+d.GetSizeBytes() > gRPCMaxSize {
+	if ul.unsentBatchSize+d.GetSizeBytes() > *gRPCMaxSize {
 		ul.flushCurrentBatch()
 	}
 	b, err := io.ReadAll(r)
@@ -389,16 +439,20 @@ func (ul *BatchCASUploader) flushCurrentBatch() {
 	ul.unsentBatchReq = &repb.BatchUpdateBlobsRequest{InstanceName: ul.instanceName}
 	ul.unsentBatchSize = 0
 	ul.eg.Go(func() error {
-		rsp, err := ul.casClient.BatchUpdateBlobs(ul.ctx, req)
-		if err != nil {
-			return err
-		}
-		for _, fileResponse := range rsp.GetResponses() {
-			if fileResponse.GetStatus().GetCode() != int32(codes.OK) {
-				return gstatus.Error(codes.Code(fileResponse.GetStatus().GetCode()), fmt.Sprintf("Error uploading file: %v", fileResponse.GetDigest()))
+		return retry.Do(ul.ctx, retry.DefaultOptions(), func() error {
+			rsp, err := ul.casClient.BatchUpdateBlobs(ul.ctx, req)
+			if err != nil {
+				return err
 			}
-		}
-		return nil
+			for _, fileResponse := range rsp.GetResponses() {
+				if fileResponse.GetStatus().GetCode() != int32(codes.OK) {
+					// Keep any details from the server, so that the error can
+					// be retried if appropriate.
+					return status.WrapError(gstatus.ErrorProto(fileResponse.GetStatus()), fmt.Sprintf("Error uploading file: %v", fileResponse.GetDigest()))
+				}
+			}
+			return nil
+		})
 	})
 }
 
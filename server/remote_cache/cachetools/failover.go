@@ -0,0 +1,268 @@
+package cachetools
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+)
+
+const (
+	// The number of consecutive failed reads after which an endpoint is
+	// considered unhealthy, and reads are sent to the next endpoint instead.
+	failoverThreshold = 3
+
+	// How long reads avoid an unhealthy endpoint before trying it again.
+	unhealthyDuration = 30 * time.Second
+)
+
+var (
+	// The RPCs that only read from the cache, and so may be served by any
+	// endpoint. FindMissingBlobs is left out, since its result decides which
+	// blobs are uploaded, and uploads always go to the primary endpoint.
+	readMethods = map[string]struct{}{
+		"/google.bytestream.ByteStream/Read":                                        {},
+		"/build.bazel.remote.execution.v2.ContentAddressableStorage/BatchReadBlobs": {},
+		"/build.bazel.remote.execution.v2.ContentAddressableStorage/GetTree":        {},
+		"/build.bazel.remote.execution.v2.ActionCache/GetActionResult":              {},
+		"/build.bazel.remote.execution.v2.Capabilities/GetCapabilities":             {},
+	}
+)
+
+// Endpoint is a cache server that a FailoverConn sends RPCs to.
+type Endpoint struct {
+	// Name identifies the endpoint in logs and metrics, such as its target.
+	Name string
+	Conn grpc.ClientConnInterface
+}
+
+type endpointHealth struct {
+	consecutiveFailures int
+	unhealthyUntil      time.Time
+}
+
+// FailoverConn is a grpc.ClientConnInterface which sends cache RPCs to a
+// primary endpoint, and fails reads over to fallback endpoints (such as a
+// cache in another region) when it is unavailable.
+//
+// Reads that fail with a retryable error are retried on the next endpoint.
+// After failoverThreshold consecutive failed reads, an endpoint is skipped
+// altogether for unhealthyDuration, so that reads don't wait on it during a
+// sustained outage. Writes always go to the primary endpoint, so that blobs
+// aren't scattered across caches.
+type FailoverConn struct {
+	endpoints []Endpoint
+	now       func() time.Time
+
+	mu     sync.Mutex
+	health []endpointHealth
+}
+
+// NewFailoverConn returns a FailoverConn which prefers the endpoints in the
+// given order. The first endpoint is the primary.
+func NewFailoverConn(primary Endpoint, fallbacks ...Endpoint) *FailoverConn {
+	endpoints := append([]Endpoint{primary}, fallbacks...)
+	for _, e := range endpoints {
+		metrics.CacheClientEndpointHealthy.With(prometheus.Labels{
+			metrics.CacheEndpointLabel: e.Name,
+		}).Set(1)
+	}
+	return &FailoverConn{
+		endpoints: endpoints,
+		now:       time.Now,
+		health:    make([]endpointHealth, len(endpoints)),
+	}
+}
+
+// candidates returns the indexes of the endpoints to try a read on, in order:
+// the healthy endpoints first, then the unhealthy ones as a last resort.
+func (c *FailoverConn) candidates() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	healthy := make([]int, 0, len(c.endpoints))
+	var unhealthy []int
+	for i, h := range c.health {
+		if now.Before(h.unhealthyUntil) {
+			unhealthy = append(unhealthy, i)
+		} else {
+			healthy = append(healthy, i)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (c *FailoverConn) recordSuccess(i int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := &c.health[i]
+	if h.consecutiveFailures >= failoverThreshold {
+		log.Infof("Cache endpoint %q is healthy again", c.endpoints[i].Name)
+		metrics.CacheClientEndpointHealthy.With(prometheus.Labels{
+			metrics.CacheEndpointLabel: c.endpoints[i].Name,
+		}).Set(1)
+	}
+	*h = endpointHealth{}
+}
+
+func (c *FailoverConn) recordFailure(i int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := &c.health[i]
+	h.consecutiveFailures++
+	if h.consecutiveFailures < failoverThreshold {
+		return
+	}
+	if h.consecutiveFailures == failoverThreshold {
+		log.Warningf("Cache endpoint %q failed %d reads in a row, failing over for %s: %s", c.endpoints[i].Name, h.consecutiveFailures, unhealthyDuration, err)
+		metrics.CacheClientEndpointHealthy.With(prometheus.Labels{
+			metrics.CacheEndpointLabel: c.endpoints[i].Name,
+		}).Set(0)
+	}
+	// Failures past the threshold come from reads that tried the endpoint
+	// again after it was skipped, so it's skipped for a while longer.
+	h.unhealthyUntil = c.now().Add(unhealthyDuration)
+}
+
+func (c *FailoverConn) recordAttempt(i int) {
+	if i == 0 {
+		return
+	}
+	metrics.CacheClientFallbackReads.With(prometheus.Labels{
+		metrics.CacheEndpointLabel: c.endpoints[i].Name,
+	}).Inc()
+}
+
+// isFailoverError returns whether a read that failed with the given error
+// might succeed on another endpoint.
+func isFailoverError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return status.IsUnavailableError(err) || status.IsDeadlineExceededError(err) || status.IsResourceExhaustedError(err)
+}
+
+func (c *FailoverConn) Invoke(ctx context.Context, method string, args interface{}, reply interface{}, opts ...grpc.CallOption) error {
+	if _, ok := readMethods[method]; !ok {
+		return c.endpoints[0].Conn.Invoke(ctx, method, args, reply, opts...)
+	}
+	var err error
+	for _, i := range c.candidates() {
+		c.recordAttempt(i)
+		err = c.endpoints[i].Conn.Invoke(ctx, method, args, reply, opts...)
+		if err == nil || !isFailoverError(ctx, err) {
+			if err == nil {
+				c.recordSuccess(i)
+			}
+			return err
+		}
+		c.recordFailure(i, err)
+	}
+	return err
+}
+
+func (c *FailoverConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	_, ok := readMethods[method]
+	// Only server-streaming reads, like ByteStream.Read, can be retried: their
+	// single request can be sent again to another endpoint as long as no
+	// response was received yet.
+	if !ok || desc.ClientStreams || !desc.ServerStreams {
+		return c.endpoints[0].Conn.NewStream(ctx, desc, method, opts...)
+	}
+	s := &failoverClientStream{
+		conn:       c,
+		ctx:        ctx,
+		desc:       desc,
+		method:     method,
+		opts:       opts,
+		candidates: c.candidates(),
+	}
+	if err := s.next(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// failoverClientStream is a server-streaming read which is moved to the next
+// endpoint if it fails before receiving its first response.
+type failoverClientStream struct {
+	grpc.ClientStream
+	conn   *FailoverConn
+	ctx    context.Context
+	desc   *grpc.StreamDesc
+	method string
+	opts   []grpc.CallOption
+
+	candidates []int
+	current    int
+	req        interface{}
+	closedSend bool
+	received   bool
+}
+
+// next opens the stream on the next candidate endpoint, and replays the
+// request if it was already sent.
+func (s *failoverClientStream) next() error {
+	var err error
+	for len(s.candidates) > 0 {
+		s.current, s.candidates = s.candidates[0], s.candidates[1:]
+		s.conn.recordAttempt(s.current)
+		var stream grpc.ClientStream
+		stream, err = s.conn.endpoints[s.current].Conn.NewStream(s.ctx, s.desc, s.method, s.opts...)
+		if err == nil && s.req != nil {
+			err = stream.SendMsg(s.req)
+		}
+		if err == nil && s.closedSend {
+			err = stream.CloseSend()
+		}
+		if err == nil {
+			s.ClientStream = stream
+			return nil
+		}
+		if !isFailoverError(s.ctx, err) {
+			return err
+		}
+		s.conn.recordFailure(s.current, err)
+	}
+	return err
+}
+
+func (s *failoverClientStream) SendMsg(m interface{}) error {
+	s.req = m
+	return s.ClientStream.SendMsg(m)
+}
+
+func (s *failoverClientStream) CloseSend() error {
+	s.closedSend = true
+	return s.ClientStream.CloseSend()
+}
+
+func (s *failoverClientStream) RecvMsg(m interface{}) error {
+	for {
+		err := s.ClientStream.RecvMsg(m)
+		if s.received {
+			return err
+		}
+		if err == nil || err == io.EOF {
+			s.received = true
+			s.conn.recordSuccess(s.current)
+			return err
+		}
+		if !isFailoverError(s.ctx, err) {
+			return err
+		}
+		s.conn.recordFailure(s.current, err)
+		if len(s.candidates) == 0 || s.req == nil {
+			return err
+		}
+		if nextErr := s.next(); nextErr != nil {
+			return nextErr
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package cachetools
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+)
+
+type fakeConn struct {
+	err   error
+	calls int
+}
+
+func (c *fakeConn) Invoke(ctx context.Context, method string, args interface{}, reply interface{}, opts ...grpc.CallOption) error {
+	c.calls++
+	return c.err
+}
+
+func (c *fakeConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	c.calls++
+	return &fakeStream{ctx: ctx, err: c.err}, nil
+}
+
+// fakeStream responds to a ByteStream read with a single chunk, or fails it
+// with err.
+type fakeStream struct {
+	grpc.ClientStream
+	ctx  context.Context
+	err  error
+	sent bool
+}
+
+func (s *fakeStream) Context() context.Context    { return s.ctx }
+func (s *fakeStream) SendMsg(m interface{}) error { return nil }
+func (s *fakeStream) CloseSend() error            { return nil }
+func (s *fakeStream) RecvMsg(m interface{}) error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.sent {
+		return io.EOF
+	}
+	s.sent = true
+	m.(*bspb.ReadResponse).Data = []byte("hello")
+	return nil
+}
+
+func newTestFailoverConn(primary, fallback *fakeConn) (*FailoverConn, *time.Time) {
+	now := time.Now()
+	c := NewFailoverConn(Endpoint{Name: "primary", Conn: primary}, Endpoint{Name: "fallback", Conn: fallback})
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func getActionResult(c *FailoverConn) error {
+	_, err := repb.NewActionCacheClient(c).GetActionResult(context.Background(), &repb.GetActionResultRequest{})
+	return err
+}
+
+func TestReadFailsOver(t *testing.T) {
+	primary := &fakeConn{err: status.UnavailableError("down")}
+	fallback := &fakeConn{}
+	c, _ := newTestFailoverConn(primary, fallback)
+
+	require.NoError(t, getActionResult(c))
+	assert.Equal(t, 1, primary.calls)
+	assert.Equal(t, 1, fallback.calls)
+}
+
+func TestReadDoesNotFailOverOnMiss(t *testing.T) {
+	primary := &fakeConn{err: status.NotFoundError("miss")}
+	fallback := &fakeConn{}
+	c, _ := newTestFailoverConn(primary, fallback)
+
+	err := getActionResult(c)
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+	assert.Equal(t, 0, fallback.calls)
+}
+
+func TestUnhealthyEndpointIsSkipped(t *testing.T) {
+	primary := &fakeConn{err: status.UnavailableError("down")}
+	fallback := &fakeConn{}
+	c, now := newTestFailoverConn(primary, fallback)
+
+	for i := 0; i < failoverThreshold; i++ {
+		require.NoError(t, getActionResult(c))
+	}
+	assert.Equal(t, failoverThreshold, primary.calls)
+
+	// The primary is skipped once it's unhealthy.
+	require.NoError(t, getActionResult(c))
+	assert.Equal(t, failoverThreshold, primary.calls)
+
+	// It's tried again after a while, and used again once it recovers.
+	*now = now.Add(unhealthyDuration)
+	primary.err = nil
+	require.NoError(t, getActionResult(c))
+	require.NoError(t, getActionResult(c))
+	assert.Equal(t, failoverThreshold+2, primary.calls)
+	assert.Equal(t, failoverThreshold+1, fallback.calls)
+}
+
+func TestWritesGoToPrimary(t *testing.T) {
+	primary := &fakeConn{err: status.UnavailableError("down")}
+	fallback := &fakeConn{}
+	c, _ := newTestFailoverConn(primary, fallback)
+
+	_, err := repb.NewActionCacheClient(c).UpdateActionResult(context.Background(), &repb.UpdateActionResultRequest{})
+	assert.True(t, status.IsUnavailableError(err), "expected Unavailable, got %v", err)
+	_, err = repb.NewContentAddressableStorageClient(c).FindMissingBlobs(context.Background(), &repb.FindMissingBlobsRequest{})
+	assert.True(t, status.IsUnavailableError(err), "expected Unavailable, got %v", err)
+	assert.Equal(t, 0, fallback.calls)
+}
+
+func TestByteStreamReadFailsOver(t *testing.T) {
+	primary := &fakeConn{err: status.UnavailableError("down")}
+	fallback := &fakeConn{}
+	c, _ := newTestFailoverConn(primary, fallback)
+
+	stream, err := bspb.NewByteStreamClient(c).Read(context.Background(), &bspb.ReadRequest{})
+	require.NoError(t, err)
+	rsp, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(rsp.GetData()))
+	_, err = stream.Recv()
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 1, primary.calls)
+	assert.Equal(t, 1, fallback.calls)
+}
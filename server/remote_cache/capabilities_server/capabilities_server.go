@@ -4,17 +4,23 @@ import (
 	"context"
 	"math"
 
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/delta"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	smpb "github.com/buildbuddy-io/buildbuddy/proto/semver"
 )
 
 type CapabilitiesServer struct {
+	env               environment.Env
 	supportCAS        bool
 	supportRemoteExec bool
 }
 
-func NewCapabilitiesServer(supportCAS, supportRemoteExec bool) *CapabilitiesServer {
+func NewCapabilitiesServer(env environment.Env, supportCAS, supportRemoteExec bool) *CapabilitiesServer {
 	return &CapabilitiesServer{
+		env:               env,
 		supportCAS:        supportCAS,
 		supportRemoteExec: supportRemoteExec,
 	}
@@ -28,7 +34,9 @@ func (s *CapabilitiesServer) GetCapabilities(ctx context.Context, req *repb.GetC
 	}
 	if s.supportCAS {
 		c.CacheCapabilities = &repb.CacheCapabilities{
-			DigestFunction: []repb.DigestFunction_Value{repb.DigestFunction_SHA256},
+			// Remote execution only supports SHA256, but BLAKE3 digests may
+			// be used with the cache alone.
+			DigestFunction: digest.SupportedDigestFunctions(),
 			ActionCacheUpdateCapabilities: &repb.ActionCacheUpdateCapabilities{
 				UpdateEnabled: true,
 			},
@@ -42,6 +50,7 @@ func (s *CapabilitiesServer) GetCapabilities(ctx context.Context, req *repb.GetC
 			},
 			MaxBatchTotalSizeBytes:      0, // Default to protocol limit.
 			SymlinkAbsolutePathStrategy: repb.SymlinkAbsolutePathStrategy_ALLOWED,
+			DeltaCapabilities:           delta.Capabilities(s.env),
 		}
 	}
 	if s.supportRemoteExec {
@@ -2,7 +2,6 @@ package content_addressable_storage_server
 
 import (
 	"context"
-	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
 	"os"
@@ -11,10 +10,12 @@ import (
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/delta"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/hit_tracker"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
 	"github.com/buildbuddy-io/buildbuddy/server/util/capabilities"
+	"github.com/buildbuddy-io/buildbuddy/server/util/deadline"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
@@ -31,8 +32,9 @@ import (
 const gRPCMaxSize = int64(4194304 - 2000)
 
 type ContentAddressableStorageServer struct {
-	env   environment.Env
-	cache interfaces.Cache
+	env        environment.Env
+	cache      interfaces.Cache
+	namespaces *namespace.OverrideResolver
 }
 
 func NewContentAddressableStorageServer(env environment.Env) (*ContentAddressableStorageServer, error) {
@@ -40,14 +42,42 @@ func NewContentAddressableStorageServer(env environment.Env) (*ContentAddressabl
 	if cache == nil {
 		return nil, fmt.Errorf("A cache is required to enable the ContentAddressableStorageServer")
 	}
+	// Cache calls are given the budget of the request being served, so that
+	// they fail fast once the client has given up.
+	cache = deadline.Cache(cache)
+	// Blobs kept by retention classes remain readable after the cache has
+	// evicted them.
+	if rs := env.GetRetentionStore(); rs != nil {
+		cache = rs.Cache(cache)
+	}
+	// Blobs uploaded as deltas are reconstructed when read.
+	cache = delta.Cache(env, cache)
+	namespaces, err := namespace.NewOverrideResolver(env)
+	if err != nil {
+		return nil, err
+	}
 	return &ContentAddressableStorageServer{
-		env:   env,
-		cache: cache,
+		env:        env,
+		cache:      cache,
+		namespaces: namespaces,
 	}, nil
 }
 
-func (s *ContentAddressableStorageServer) getCache(instanceName string) interfaces.Cache {
-	return namespace.CASCache(s.cache, instanceName)
+func (s *ContentAddressableStorageServer) getCache(ctx context.Context, instanceName string, digestFunction repb.DigestFunction_Value) (interfaces.Cache, error) {
+	cache, err := s.namespaces.InvocationCache(ctx, s.cache)
+	if err != nil {
+		return nil, err
+	}
+	cache = namespace.AliasedCASCache(ctx, s.env, cache, instanceName)
+	if digestFunction == repb.DigestFunction_BLAKE3 {
+		return namespace.DigestFunctionCache(cache, digestFunction), nil
+	}
+	// While SHA256 blobs are being migrated, the blobs that clients use are
+	// also copied to their BLAKE3 digests.
+	if m := s.env.GetDigestMigrator(); m != nil {
+		return m.CASCache(cache, instanceName), nil
+	}
+	return cache, nil
 }
 
 // Determine if blobs are present in the CAS.
@@ -58,14 +88,20 @@ func (s *ContentAddressableStorageServer) getCache(instanceName string) interfac
 // There are no method-specific errors.
 func (s *ContentAddressableStorageServer) FindMissingBlobs(ctx context.Context, req *repb.FindMissingBlobsRequest) (*repb.FindMissingBlobsResponse, error) {
 	rsp := &repb.FindMissingBlobsResponse{}
+	if err := digest.ValidateDigestFunction(req.GetDigestFunction()); err != nil {
+		return nil, err
+	}
 	ctx, err := prefix.AttachUserPrefixToContext(ctx, s.env)
 	if err != nil {
 		return nil, err
 	}
-	cache := s.getCache(req.GetInstanceName())
+	cache, err := s.getCache(ctx, req.GetInstanceName(), req.GetDigestFunction())
+	if err != nil {
+		return nil, err
+	}
 	digestsToLookup := make([]*repb.Digest, 0, len(req.GetBlobDigests()))
 	for _, d := range req.GetBlobDigests() {
-		if d.GetHash() == digest.EmptySha256 {
+		if digest.IsEmptyHash(d.GetHash()) {
 			continue
 		}
 		if d.GetHash() == digest.EmptyHash {
@@ -112,6 +148,9 @@ func (s *ContentAddressableStorageServer) FindMissingBlobs(ctx context.Context,
 // provided data.
 func (s *ContentAddressableStorageServer) BatchUpdateBlobs(ctx context.Context, req *repb.BatchUpdateBlobsRequest) (*repb.BatchUpdateBlobsResponse, error) {
 	rsp := &repb.BatchUpdateBlobsResponse{}
+	if err := digest.ValidateDigestFunction(req.GetDigestFunction()); err != nil {
+		return nil, err
+	}
 	ctx, err := prefix.AttachUserPrefixToContext(ctx, s.env)
 	if err != nil {
 		return nil, err
@@ -132,7 +171,10 @@ func (s *ContentAddressableStorageServer) BatchUpdateBlobs(ctx context.Context,
 		return rsp, nil
 	}
 
-	cache := s.getCache(req.GetInstanceName())
+	cache, err := s.getCache(ctx, req.GetInstanceName(), req.GetDigestFunction())
+	if err != nil {
+		return nil, err
+	}
 	rsp.Responses = make([]*repb.BatchUpdateBlobsResponse_Response, 0, len(req.Requests))
 
 	ht := hit_tracker.NewHitTracker(ctx, s.env, false)
@@ -148,7 +190,7 @@ func (s *ContentAddressableStorageServer) BatchUpdateBlobs(ctx context.Context,
 		// so doing 100-1000 or so in this loop is fine.
 		defer uploadTracker.Close()
 
-		if uploadDigest.GetHash() == digest.EmptySha256 {
+		if digest.IsEmptyHash(uploadDigest.GetHash()) {
 			rsp.Responses = append(rsp.Responses, &repb.BatchUpdateBlobsResponse_Response{
 				Digest: uploadDigest,
 				Status: &statuspb.Status{Code: int32(codes.OK)},
@@ -157,7 +199,10 @@ func (s *ContentAddressableStorageServer) BatchUpdateBlobs(ctx context.Context,
 			// write empty files.
 			continue
 		}
-		checksum := sha256.New()
+		checksum, err := digest.HashFunction(req.GetDigestFunction())
+		if err != nil {
+			return nil, err
+		}
 		checksum.Write(uploadRequest.GetData())
 		computedDigest := fmt.Sprintf("%x", checksum.Sum(nil))
 		if computedDigest != uploadDigest.GetHash() {
@@ -218,7 +263,13 @@ func (s *ContentAddressableStorageServer) BatchReadBlobs(ctx context.Context, re
 	if err != nil {
 		return nil, err
 	}
-	cache := s.getCache(req.GetInstanceName())
+	if err := digest.ValidateDigestFunction(req.GetDigestFunction()); err != nil {
+		return nil, err
+	}
+	cache, err := s.getCache(ctx, req.GetInstanceName(), req.GetDigestFunction())
+	if err != nil {
+		return nil, err
+	}
 	cacheRequest := make([]*repb.Digest, 0, len(req.Digests))
 	rsp.Responses = make([]*repb.BatchReadBlobsResponse_Response, 0, len(req.Digests))
 	ht := hit_tracker.NewHitTracker(ctx, s.env, false)
@@ -231,13 +282,13 @@ func (s *ContentAddressableStorageServer) BatchReadBlobs(ctx context.Context, re
 		// defers are preetty cheap: https://tpaschalis.github.io/defer-internals/
 		// so doing 100-1000 or so in this loop is fine.
 		defer downloadTracker.Close()
-		if readDigest.GetHash() != digest.EmptySha256 {
+		if !digest.IsEmptyHash(readDigest.GetHash()) {
 			cacheRequest = append(cacheRequest, readDigest)
 		}
 	}
 	cacheRsp, err := cache.GetMulti(ctx, cacheRequest)
 	for _, d := range req.GetDigests() {
-		if d.GetHash() == digest.EmptySha256 {
+		if digest.IsEmptyHash(d.GetHash()) {
 			rsp.Responses = append(rsp.Responses, &repb.BatchReadBlobsResponse_Response{
 				Digest: d,
 				Status: &statuspb.Status{Code: int32(codes.OK)},
@@ -374,7 +425,7 @@ func (s *ContentAddressableStorageServer) fetchDirectory(ctx context.Context, ca
 	subdirDigests := make([]*repb.Digest, 0, len(dir.Directories))
 	for _, dirNode := range dir.Directories {
 		d := dirNode.GetDigest()
-		if d.GetHash() == digest.EmptySha256 {
+		if digest.IsEmptyHash(d.GetHash()) {
 			continue
 		}
 		subdirDigests = append(subdirDigests, d)
@@ -429,15 +480,21 @@ func (s *ContentAddressableStorageServer) GetTree(req *repb.GetTreeRequest, stre
 	if req.RootDigest == nil {
 		return fmt.Errorf("RootDigest is required to GetTree")
 	}
-	if req.GetRootDigest().GetHash() == digest.EmptySha256 {
+	if digest.IsEmptyHash(req.GetRootDigest().GetHash()) {
 		return nil
 	}
+	if err := digest.ValidateDigestFunction(req.GetDigestFunction()); err != nil {
+		return err
+	}
 
 	ctx, err := prefix.AttachUserPrefixToContext(stream.Context(), s.env)
 	if err != nil {
 		return err
 	}
-	cache := s.getCache(req.GetInstanceName())
+	cache, err := s.getCache(ctx, req.GetInstanceName(), req.GetDigestFunction())
+	if err != nil {
+		return err
+	}
 	rootDir, err := s.fetchDir(ctx, cache, req.GetRootDigest())
 	if err != nil {
 		return err
@@ -1,16 +1,20 @@
 package content_addressable_storage_server_test
 
 import (
+	"bytes"
 	"context"
 	"testing"
 
 	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_cache"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/content_addressable_storage_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
@@ -151,3 +155,56 @@ func TestMalevolentCache(t *testing.T) {
 	assert.Equal(t, d.GetHash(), set.GetResponses()[0].GetDigest().GetHash())
 	assert.Equal(t, int32(gcodes.OK), set.GetResponses()[0].GetStatus().GetCode())
 }
+
+func TestBlake3Blobs(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te)
+	require.NoError(t, err)
+	casClient := repb.NewContentAddressableStorageClient(runCASServer(ctx, te, t))
+
+	buf := []byte("hello blake3")
+	d, err := digest.ComputeWithFunction(bytes.NewReader(buf), repb.DigestFunction_BLAKE3)
+	require.NoError(t, err)
+	sha256Digest, err := digest.Compute(bytes.NewReader(buf))
+	require.NoError(t, err)
+
+	rsp, err := casClient.BatchUpdateBlobs(ctx, &repb.BatchUpdateBlobsRequest{
+		DigestFunction: repb.DigestFunction_BLAKE3,
+		Requests: []*repb.BatchUpdateBlobsRequest_Request{
+			{Digest: d, Data: buf},
+			// The SHA256 digest doesn't match the BLAKE3 hash of the data.
+			{Digest: sha256Digest, Data: buf},
+		},
+	})
+	require.NoError(t, err)
+	codes := map[string]int32{}
+	for _, r := range rsp.GetResponses() {
+		codes[r.GetDigest().GetHash()] = r.GetStatus().GetCode()
+	}
+	assert.Equal(t, map[string]int32{d.GetHash(): int32(gcodes.OK), sha256Digest.GetHash(): int32(gcodes.DataLoss)}, codes)
+
+	// BLAKE3 blobs are only found by requests for BLAKE3 digests.
+	missing, err := casClient.FindMissingBlobs(ctx, &repb.FindMissingBlobsRequest{
+		DigestFunction: repb.DigestFunction_BLAKE3,
+		BlobDigests:    []*repb.Digest{d},
+	})
+	require.NoError(t, err)
+	assert.Empty(t, missing.GetMissingBlobDigests())
+	missing, err = casClient.FindMissingBlobs(ctx, &repb.FindMissingBlobsRequest{BlobDigests: []*repb.Digest{d}})
+	require.NoError(t, err)
+	assert.Len(t, missing.GetMissingBlobDigests(), 1)
+
+	readRsp, err := casClient.BatchReadBlobs(ctx, &repb.BatchReadBlobsRequest{
+		DigestFunction: repb.DigestFunction_BLAKE3,
+		Digests:        []*repb.Digest{d},
+	})
+	require.NoError(t, err)
+	require.Len(t, readRsp.GetResponses(), 1)
+	assert.Equal(t, buf, readRsp.GetResponses()[0].GetData())
+
+	_, err = casClient.FindMissingBlobs(ctx, &repb.FindMissingBlobsRequest{
+		DigestFunction: repb.DigestFunction_MD5,
+		BlobDigests:    []*repb.Digest{d},
+	})
+	assert.True(t, status.IsUnimplementedError(err), "expected Unimplemented, got %v", err)
+}
@@ -0,0 +1,416 @@
+// Package delta stores blobs which were uploaded as the differences from
+// another blob in the CAS, such as large archives that change slightly
+// between builds. Only the delta is stored, and the blob is reconstructed
+// from its base whenever it is read through a cache returned by Cache.
+package delta
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/proto"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	// Prefix of the part of the cache holding deltas, keyed by the digest of
+	// the blob they reconstruct.
+	deltaCachePrefix = "deltas"
+
+	defaultMinBlobSizeBytes = 1024 * 1024
+	defaultMaxBlobSizeBytes = 128 * 1024 * 1024
+	defaultMaxChainLength   = 4
+
+	// Size of the blocks of the base blob which Encode looks for in the
+	// target blob.
+	encodeBlockSize = 2048
+	// Multiplier of the rolling hash used by Encode.
+	rollingHashMultiplier = 16777619
+)
+
+type options struct {
+	minBlobSizeBytes int64
+	maxBlobSizeBytes int64
+	maxChainLength   int
+}
+
+func getOptions(env environment.Env) (*options, bool) {
+	conf := env.GetConfigurator().GetCacheDeltaUploadsConfig()
+	if !conf.Enabled {
+		return nil, false
+	}
+	opts := &options{
+		minBlobSizeBytes: conf.MinBlobSizeBytes,
+		maxBlobSizeBytes: conf.MaxBlobSizeBytes,
+		maxChainLength:   conf.MaxChainLength,
+	}
+	if opts.minBlobSizeBytes <= 0 {
+		opts.minBlobSizeBytes = defaultMinBlobSizeBytes
+	}
+	if opts.maxBlobSizeBytes <= 0 {
+		opts.maxBlobSizeBytes = defaultMaxBlobSizeBytes
+	}
+	if opts.maxChainLength <= 0 {
+		opts.maxChainLength = defaultMaxChainLength
+	}
+	return opts, true
+}
+
+// Capabilities returns the delta capabilities advertised to clients, or nil
+// if delta uploads are disabled.
+func Capabilities(env environment.Env) *repb.DeltaCapabilities {
+	opts, ok := getOptions(env)
+	if !ok {
+		return nil
+	}
+	return &repb.DeltaCapabilities{
+		MinBlobSizeBytes: opts.minBlobSizeBytes,
+		MaxBlobSizeBytes: opts.maxBlobSizeBytes,
+	}
+}
+
+// Cache returns a cache which reads blobs from c, falling back to
+// reconstructing blobs which were uploaded as deltas. Deltas are written to it
+// with Writer. If delta uploads are disabled, c is returned as is.
+func Cache(env environment.Env, c interfaces.Cache) interfaces.Cache {
+	opts, ok := getOptions(env)
+	if !ok {
+		return c
+	}
+	return &deltaCache{
+		cache:  c,
+		deltas: c.WithPrefix(deltaCachePrefix),
+		opts:   opts,
+	}
+}
+
+// Apply reconstructs a blob by applying the delta to its base. The
+// reconstructed blob may be at most maxSizeBytes long.
+func Apply(base []byte, delta *repb.BlobDelta, maxSizeBytes int64) ([]byte, error) {
+	var out bytes.Buffer
+	for _, in := range delta.GetInstruction() {
+		var data []byte
+		switch k := in.GetKind().(type) {
+		case *repb.DeltaInstruction_Copy_:
+			offset, length := k.Copy.GetOffset(), k.Copy.GetLength()
+			if offset < 0 || length < 0 || offset+length > int64(len(base)) {
+				return nil, status.InvalidArgumentErrorf("Delta copies [%d, %d) of a base blob of %d bytes", offset, offset+length, len(base))
+			}
+			data = base[offset : offset+length]
+		case *repb.DeltaInstruction_Insert:
+			data = k.Insert
+		default:
+			return nil, status.InvalidArgumentError("Delta has an instruction of unknown kind")
+		}
+		if int64(out.Len()+len(data)) > maxSizeBytes {
+			return nil, status.InvalidArgumentErrorf("Delta reconstructs a blob larger than %d bytes", maxSizeBytes)
+		}
+		out.Write(data)
+	}
+	return out.Bytes(), nil
+}
+
+// Encode returns a delta which reconstructs target from base, the blob with
+// the given digest. Blocks of the base are found in the target wherever they
+// occur, so that the delta stays small when data is inserted or removed.
+func Encode(baseDigest *repb.Digest, base, target []byte) *repb.BlobDelta {
+	delta := &repb.BlobDelta{BaseDigest: baseDigest}
+	copyFrom := func(offset, length int64) {
+		n := len(delta.Instruction)
+		if n > 0 {
+			if c := delta.Instruction[n-1].GetCopy(); c != nil && c.GetOffset()+c.GetLength() == offset {
+				c.Length += length
+				return
+			}
+		}
+		delta.Instruction = append(delta.Instruction, &repb.DeltaInstruction{
+			Kind: &repb.DeltaInstruction_Copy_{Copy: &repb.DeltaInstruction_Copy{Offset: offset, Length: length}},
+		})
+	}
+	insert := func(data []byte) {
+		if len(data) > 0 {
+			delta.Instruction = append(delta.Instruction, &repb.DeltaInstruction{
+				Kind: &repb.DeltaInstruction_Insert{Insert: data},
+			})
+		}
+	}
+	if len(base) < encodeBlockSize || len(target) < encodeBlockSize {
+		insert(target)
+		return delta
+	}
+
+	// The offsets of the blocks of the base, by their hash.
+	blocks := make(map[uint32]int)
+	for offset := len(base) - len(base)%encodeBlockSize - encodeBlockSize; offset >= 0; offset -= encodeBlockSize {
+		blocks[blockHash(base[offset:offset+encodeBlockSize])] = offset
+	}
+	// The weight of the byte leaving the rolling hash's window.
+	var outWeight uint32 = 1
+	for i := 1; i < encodeBlockSize; i++ {
+		outWeight *= rollingHashMultiplier
+	}
+
+	pending := 0
+	i := 0
+	h := blockHash(target[:encodeBlockSize])
+	for i+encodeBlockSize <= len(target) {
+		if offset, ok := blocks[h]; ok && bytes.Equal(base[offset:offset+encodeBlockSize], target[i:i+encodeBlockSize]) {
+			length := encodeBlockSize
+			for offset+length < len(base) && i+length < len(target) && base[offset+length] == target[i+length] {
+				length++
+			}
+			insert(target[pending:i])
+			copyFrom(int64(offset), int64(length))
+			i += length
+			pending = i
+			if i+encodeBlockSize <= len(target) {
+				h = blockHash(target[i : i+encodeBlockSize])
+			}
+			continue
+		}
+		if i+encodeBlockSize < len(target) {
+			h = (h-uint32(target[i])*outWeight)*rollingHashMultiplier + uint32(target[i+encodeBlockSize])
+		}
+		i++
+	}
+	insert(target[pending:])
+	return delta
+}
+
+func blockHash(block []byte) uint32 {
+	var h uint32
+	for _, b := range block {
+		h = h*rollingHashMultiplier + uint32(b)
+	}
+	return h
+}
+
+// Writer returns a writer for a serialized BlobDelta which reconstructs the
+// blob with the given digest. The delta is verified and stored when the writer
+// is closed. c must be a cache returned by Cache.
+func Writer(ctx context.Context, c interfaces.Cache, d *repb.Digest) (io.WriteCloser, error) {
+	dc, ok := c.(*deltaCache)
+	if !ok {
+		return nil, status.UnimplementedError("Delta uploads are not enabled")
+	}
+	if d.GetSizeBytes() < dc.opts.minBlobSizeBytes || d.GetSizeBytes() > dc.opts.maxBlobSizeBytes {
+		return nil, status.InvalidArgumentErrorf("Only blobs of %d to %d bytes may be uploaded as deltas", dc.opts.minBlobSizeBytes, dc.opts.maxBlobSizeBytes)
+	}
+	return &deltaWriter{ctx: ctx, cache: dc, d: d}, nil
+}
+
+type deltaWriter struct {
+	ctx   context.Context
+	cache *deltaCache
+	d     *repb.Digest
+	buf   bytes.Buffer
+}
+
+func (w *deltaWriter) Write(p []byte) (int, error) {
+	// A delta larger than the blob it reconstructs saves nothing.
+	if int64(w.buf.Len()+len(p)) > w.d.GetSizeBytes() {
+		return 0, status.InvalidArgumentErrorf("Delta is larger than the %d byte blob it reconstructs", w.d.GetSizeBytes())
+	}
+	return w.buf.Write(p)
+}
+
+func (w *deltaWriter) Close() error {
+	delta := &repb.BlobDelta{}
+	if err := proto.Unmarshal(w.buf.Bytes(), delta); err != nil {
+		return status.InvalidArgumentErrorf("Could not parse delta: %s", err)
+	}
+	return w.cache.setDelta(w.ctx, w.d, delta)
+}
+
+type deltaCache struct {
+	cache interfaces.Cache
+	// The deltas of blobs which were uploaded as deltas, keyed by the digest
+	// of the blob.
+	deltas interfaces.Cache
+	opts   *options
+}
+
+func (c *deltaCache) WithPrefix(prefix string) interfaces.Cache {
+	return &deltaCache{
+		cache:  c.cache.WithPrefix(prefix),
+		deltas: c.deltas.WithPrefix(prefix),
+		opts:   c.opts,
+	}
+}
+
+// setDelta verifies that the delta reconstructs the blob with the given
+// digest and stores it.
+func (c *deltaCache) setDelta(ctx context.Context, d *repb.Digest, delta *repb.BlobDelta) error {
+	baseDigest := delta.GetBaseDigest()
+	if baseDigest.GetHash() == d.GetHash() {
+		return status.InvalidArgumentError("A blob can't be uploaded as a delta against itself")
+	}
+	// The base must be reconstructable with one fewer delta than the limit,
+	// leaving room for this one.
+	base, err := c.get(ctx, baseDigest, 1)
+	if status.IsNotFoundError(err) {
+		return status.FailedPreconditionErrorf("Base blob %s/%d of the delta is not in the cache", baseDigest.GetHash(), baseDigest.GetSizeBytes())
+	}
+	if err != nil {
+		return err
+	}
+	data, err := Apply(base, delta, d.GetSizeBytes())
+	if err != nil {
+		return err
+	}
+	if computed := fmt.Sprintf("%x", sha256.Sum256(data)); computed != d.GetHash() || int64(len(data)) != d.GetSizeBytes() {
+		return status.DataLossErrorf("Delta reconstructs a blob of %d bytes with checksum %q, expected %d bytes with checksum %q", len(data), computed, d.GetSizeBytes(), d.GetHash())
+	}
+	buf, err := proto.Marshal(delta)
+	if err != nil {
+		return err
+	}
+	return c.deltas.Set(ctx, d, buf)
+}
+
+// get returns the contents of the blob, reconstructing it from its delta if
+// the cache doesn't have it. depth is the number of deltas already being
+// applied by the caller.
+func (c *deltaCache) get(ctx context.Context, d *repb.Digest, depth int) ([]byte, error) {
+	data, err := c.cache.Get(ctx, d)
+	if !status.IsNotFoundError(err) {
+		return data, err
+	}
+	buf, deltaErr := c.deltas.Get(ctx, d)
+	if deltaErr != nil {
+		return nil, err
+	}
+	if depth >= c.opts.maxChainLength {
+		return nil, status.FailedPreconditionErrorf("Blob %s/%d is reconstructed from more than %d deltas", d.GetHash(), d.GetSizeBytes(), c.opts.maxChainLength)
+	}
+	delta := &repb.BlobDelta{}
+	if err := proto.Unmarshal(buf, delta); err != nil {
+		return nil, status.DataLossErrorf("Stored delta of blob %s/%d is corrupted: %s", d.GetHash(), d.GetSizeBytes(), err)
+	}
+	base, err := c.get(ctx, delta.GetBaseDigest(), depth+1)
+	if err != nil {
+		return nil, err
+	}
+	return Apply(base, delta, d.GetSizeBytes())
+}
+
+// containsDelta returns whether the blob can be reconstructed from a stored
+// delta, which requires its base to still be in the cache.
+func (c *deltaCache) containsDelta(ctx context.Context, d *repb.Digest, depth int) (bool, error) {
+	if depth >= c.opts.maxChainLength {
+		return false, nil
+	}
+	buf, err := c.deltas.Get(ctx, d)
+	if status.IsNotFoundError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	delta := &repb.BlobDelta{}
+	if err := proto.Unmarshal(buf, delta); err != nil {
+		return false, nil
+	}
+	exists, err := c.cache.Contains(ctx, delta.GetBaseDigest())
+	if err != nil || exists {
+		return exists, err
+	}
+	return c.containsDelta(ctx, delta.GetBaseDigest(), depth+1)
+}
+
+func (c *deltaCache) Contains(ctx context.Context, d *repb.Digest) (bool, error) {
+	exists, err := c.cache.Contains(ctx, d)
+	if err != nil || exists {
+		return exists, err
+	}
+	return c.containsDelta(ctx, d, 0)
+}
+
+func (c *deltaCache) ContainsMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest]bool, error) {
+	foundMap, err := c.cache.ContainsMulti(ctx, digests)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range digests {
+		if foundMap[d] {
+			continue
+		}
+		exists, err := c.containsDelta(ctx, d, 0)
+		if err != nil {
+			return nil, err
+		}
+		foundMap[d] = exists
+	}
+	return foundMap, nil
+}
+
+func (c *deltaCache) Get(ctx context.Context, d *repb.Digest) ([]byte, error) {
+	return c.get(ctx, d, 0)
+}
+
+func (c *deltaCache) GetMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest][]byte, error) {
+	foundMap, err := c.cache.GetMulti(ctx, digests)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range digests {
+		if _, ok := foundMap[d]; ok {
+			continue
+		}
+		data, err := c.get(ctx, d, 0)
+		if status.IsNotFoundError(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		foundMap[d] = data
+	}
+	return foundMap, nil
+}
+
+func (c *deltaCache) Set(ctx context.Context, d *repb.Digest, data []byte) error {
+	return c.cache.Set(ctx, d, data)
+}
+
+func (c *deltaCache) SetMulti(ctx context.Context, kvs map[*repb.Digest][]byte) error {
+	return c.cache.SetMulti(ctx, kvs)
+}
+
+// Delete deletes the blob from the cache along with its delta, if any.
+func (c *deltaCache) Delete(ctx context.Context, d *repb.Digest) error {
+	if err := c.cache.Delete(ctx, d); err != nil && !status.IsNotFoundError(err) {
+		return err
+	}
+	if err := c.deltas.Delete(ctx, d); err != nil && !status.IsNotFoundError(err) {
+		return err
+	}
+	return nil
+}
+
+func (c *deltaCache) Reader(ctx context.Context, d *repb.Digest, offset int64) (io.ReadCloser, error) {
+	r, err := c.cache.Reader(ctx, d, offset)
+	if !status.IsNotFoundError(err) {
+		return r, err
+	}
+	data, err := c.get(ctx, d, 0)
+	if err != nil {
+		return nil, err
+	}
+	if offset > int64(len(data)) {
+		return nil, status.OutOfRangeErrorf("Offset %d is past the end of the %d byte blob", offset, len(data))
+	}
+	return ioutil.NopCloser(bytes.NewReader(data[offset:])), nil
+}
+
+func (c *deltaCache) Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser, error) {
+	return c.cache.Writer(ctx, d)
+}
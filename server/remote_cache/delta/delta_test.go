@@ -0,0 +1,187 @@
+package delta_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/delta"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+func setup(t *testing.T) (context.Context, *testenv.TestEnv) {
+	flags.Set(t, "auth.enable_anonymous_usage", "true")
+	flags.Set(t, "cache.delta_uploads.enabled", "true")
+	flags.Set(t, "cache.delta_uploads.min_blob_size_bytes", "1")
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers()))
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te)
+	require.NoError(t, err)
+	return ctx, te
+}
+
+func computeDigest(t *testing.T, data []byte) *repb.Digest {
+	d, err := digest.Compute(bytes.NewReader(data))
+	require.NoError(t, err)
+	return d
+}
+
+// modify returns a copy of data with a few bytes changed and inserted in the
+// middle, like a rebuilt archive with one changed file.
+func modify(t *testing.T, data []byte) []byte {
+	_, inserted := testdigest.NewRandomDigestBuf(t, 500)
+	out := append([]byte{}, data[:len(data)/2]...)
+	out = append(out, inserted...)
+	out = append(out, data[len(data)/2:]...)
+	out[len(out)/4] ^= 0xff
+	return out
+}
+
+func writeDelta(ctx context.Context, c interfaces.Cache, d *repb.Digest, blobDelta *repb.BlobDelta) error {
+	buf, err := proto.Marshal(blobDelta)
+	if err != nil {
+		return err
+	}
+	w, err := delta.Writer(ctx, c, d)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func TestEncodeApply(t *testing.T) {
+	baseDigest, base := testdigest.NewRandomDigestBuf(t, 100_000)
+	target := modify(t, base)
+
+	d := delta.Encode(baseDigest, base, target)
+	assert.True(t, proto.Equal(baseDigest, d.GetBaseDigest()))
+	data, err := delta.Apply(base, d, int64(len(target)))
+	require.NoError(t, err)
+	assert.Equal(t, target, data)
+	buf, err := proto.Marshal(d)
+	require.NoError(t, err)
+	assert.Less(t, len(buf), 10_000, "delta should be much smaller than the blob")
+
+	_, err = delta.Apply(base, d, int64(len(target)-1))
+	assert.True(t, status.IsInvalidArgumentError(err), "reconstructed blob is too large")
+	_, err = delta.Apply(base[:len(base)/2], d, int64(len(target)))
+	assert.True(t, status.IsInvalidArgumentError(err), "copies are out of range")
+
+	// Blobs too small to share blocks are inserted whole.
+	small := []byte("hello")
+	data, err = delta.Apply(base, delta.Encode(baseDigest, base, small), 100)
+	require.NoError(t, err)
+	assert.Equal(t, small, data)
+}
+
+func TestDeltaCache(t *testing.T) {
+	ctx, te := setup(t)
+	c := delta.Cache(te, te.GetCache()).WithPrefix("instance")
+	baseDigest, base := testdigest.NewRandomDigestBuf(t, 100_000)
+	target := modify(t, base)
+	targetDigest := computeDigest(t, target)
+	require.NoError(t, c.Set(ctx, baseDigest, base))
+
+	require.NoError(t, writeDelta(ctx, c, targetDigest, delta.Encode(baseDigest, base, target)))
+
+	exists, err := te.GetCache().WithPrefix("instance").Contains(ctx, targetDigest)
+	require.NoError(t, err)
+	assert.False(t, exists, "only the delta should be stored")
+	exists, err = c.Contains(ctx, targetDigest)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	data, err := c.Get(ctx, targetDigest)
+	require.NoError(t, err)
+	assert.Equal(t, target, data)
+	r, err := c.Reader(ctx, targetDigest, 10)
+	require.NoError(t, err)
+	data, err = io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, target[10:], data)
+	blobs, err := c.GetMulti(ctx, []*repb.Digest{baseDigest, targetDigest})
+	require.NoError(t, err)
+	assert.Equal(t, map[*repb.Digest][]byte{baseDigest: base, targetDigest: target}, blobs)
+
+	// Deltas are only readable from the instance they were uploaded to.
+	exists, err = delta.Cache(te, te.GetCache()).WithPrefix("other").Contains(ctx, targetDigest)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// Once the base is evicted, the blob can't be reconstructed.
+	require.NoError(t, c.Delete(ctx, baseDigest))
+	found, err := c.ContainsMulti(ctx, []*repb.Digest{baseDigest, targetDigest})
+	require.NoError(t, err)
+	assert.Equal(t, map[*repb.Digest]bool{baseDigest: false, targetDigest: false}, found)
+	_, err = c.Get(ctx, targetDigest)
+	assert.True(t, status.IsNotFoundError(err))
+}
+
+func TestInvalidDeltas(t *testing.T) {
+	ctx, te := setup(t)
+	c := delta.Cache(te, te.GetCache())
+	baseDigest, base := testdigest.NewRandomDigestBuf(t, 10_000)
+	target := modify(t, base)
+	require.NoError(t, c.Set(ctx, baseDigest, base))
+
+	otherDigest, _ := testdigest.NewRandomDigestBuf(t, int64(len(target)))
+	err := writeDelta(ctx, c, otherDigest, delta.Encode(baseDigest, base, target))
+	assert.True(t, status.IsDataLossError(err), "delta doesn't reconstruct the digest")
+
+	missingDigest, _ := testdigest.NewRandomDigestBuf(t, 10_000)
+	err = writeDelta(ctx, c, computeDigest(t, target), delta.Encode(missingDigest, base, target))
+	assert.True(t, status.IsFailedPreconditionError(err), "base is missing")
+
+	exists, err := c.Contains(ctx, computeDigest(t, target))
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestMaxChainLength(t *testing.T) {
+	ctx, te := setup(t)
+	flags.Set(t, "cache.delta_uploads.max_chain_length", "2")
+	c := delta.Cache(te, te.GetCache())
+	d, data := testdigest.NewRandomDigestBuf(t, 10_000)
+	require.NoError(t, c.Set(ctx, d, data))
+
+	// Two versions may be stored as deltas of the previous version.
+	for i := 0; i < 2; i++ {
+		next := modify(t, data)
+		nextDigest := computeDigest(t, next)
+		require.NoError(t, writeDelta(ctx, c, nextDigest, delta.Encode(d, data, next)))
+		d, data = nextDigest, next
+	}
+	got, err := c.Get(ctx, d)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	next := modify(t, data)
+	err = writeDelta(ctx, c, computeDigest(t, next), delta.Encode(d, data, next))
+	assert.True(t, status.IsFailedPreconditionError(err), "a third delta would exceed the chain length")
+}
+
+func TestDisabled(t *testing.T) {
+	flags.Set(t, "auth.enable_anonymous_usage", "true")
+	te := testenv.GetTestEnv(t)
+	ctx := context.Background()
+	assert.Nil(t, delta.Capabilities(te))
+	c := delta.Cache(te, te.GetCache())
+	_, err := delta.Writer(ctx, c, &repb.Digest{Hash: digest.EmptySha256, SizeBytes: 1})
+	assert.True(t, status.IsUnimplementedError(err))
+}
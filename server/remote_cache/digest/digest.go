@@ -5,12 +5,14 @@ import (
 	"context"
 	"crypto/sha256"
 	"fmt"
+	"hash"
 	"io"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 
+	"github.com/buildbuddy-io/buildbuddy/server/util/blake3"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/golang/protobuf/proto"
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
@@ -25,9 +27,24 @@ import (
 const (
 	hashKeyLength = 64
 	EmptySha256   = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	EmptyBlake3   = "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"
 	EmptyHash     = ""
 )
 
+const (
+	uploadsSegment         = "uploads"
+	blobsSegment           = "blobs"
+	compressedBlobsSegment = "compressed-blobs"
+	actionCacheSegment     = "ac"
+	// Trailing segment of upload resource names whose data is a delta against
+	// another blob rather than the blob itself.
+	deltaSegment = "delta"
+
+	// The identity compressor is the only one we support; blobs written or
+	// read with it are byte-for-byte identical to uncompressed blobs.
+	identityCompressor = "identity"
+)
+
 var (
 	// Cache keys must be:
 	//  - lower case
@@ -35,18 +52,45 @@ var (
 	//  - a sha256 sum
 	hashKeyRegex = regexp.MustCompile("^[a-f0-9]{64}$")
 
-	// Matches:
-	// - "blobs/469db13020c60f8bdf9c89aa4e9a449914db23139b53a24d064f967a51057868/39120"
-	// - "blobs/ac/469db13020c60f8bdf9c89aa4e9a449914db23139b53a24d064f967a51057868/39120"
-	// - "uploads/2042a8f9-eade-4271-ae58-f5f6f5a32555/blobs/8afb02ca7aace3ae5cd8748ac589e2e33022b1a4bfd22d5d234c5887e270fe9c/17997850"
-	uploadRegex      = regexp.MustCompile("^(?:(?:(?P<instance_name>.*)/)?uploads/(?P<uuid>[a-f0-9-]{36})/)?blobs/(?P<hash>[a-f0-9]{64})/(?P<size>\\d+)")
-	downloadRegex    = regexp.MustCompile("^(?:(?P<instance_name>.*)/)?blobs/(?P<hash>[a-f0-9]{64})/(?P<size>\\d+)")
-	actionCacheRegex = regexp.MustCompile("^(?:(?P<instance_name>.*)/)?blobs/ac/(?P<hash>[a-f0-9]{64})/(?P<size>\\d+)")
+	// Path segments that the remote APIs reserve, and which therefore can't
+	// appear in an instance name.
+	reservedInstanceNameSegments = map[string]bool{
+		"blobs":            true,
+		"uploads":          true,
+		"actions":          true,
+		"actionResults":    true,
+		"operations":       true,
+		"capabilities":     true,
+		"compressed-blobs": true,
+	}
+
+	// Resource name segments naming the digest function of a blob, which
+	// follow "blobs/" for digest functions other than SHA256. Only BLAKE3
+	// is supported.
+	digestFunctionSegments = map[string]repb.DigestFunction_Value{
+		"blake3": repb.DigestFunction_BLAKE3,
+		"sha1":   repb.DigestFunction_SHA1,
+		"md5":    repb.DigestFunction_MD5,
+		"vso":    repb.DigestFunction_VSO,
+		"sha384": repb.DigestFunction_SHA384,
+		"sha512": repb.DigestFunction_SHA512,
+	}
+
+	// Hex-encoded hash lengths of digest functions defined by the remote
+	// execution API other than SHA256. Hashes with these lengths are well
+	// formed but not supported.
+	unsupportedHashLengths = map[int]string{
+		32:  "MD5",
+		40:  "SHA1",
+		96:  "SHA384",
+		128: "SHA512",
+	}
 )
 
 type InstanceNameDigest struct {
 	*repb.Digest
-	instanceName string
+	instanceName   string
+	digestFunction repb.DigestFunction_Value
 }
 
 func NewInstanceNameDigest(d *repb.Digest, instanceName string) *InstanceNameDigest {
@@ -60,6 +104,16 @@ func (i *InstanceNameDigest) GetInstanceName() string {
 	return i.instanceName
 }
 
+// GetDigestFunction returns the digest function that the digest was computed
+// with, which is SHA256 unless another was named by the resource name it was
+// parsed from.
+func (i *InstanceNameDigest) GetDigestFunction() repb.DigestFunction_Value {
+	if i.digestFunction == repb.DigestFunction_UNKNOWN {
+		return repb.DigestFunction_SHA256
+	}
+	return i.digestFunction
+}
+
 // Key is a representation of a digest that can be used as a map key.
 type Key struct {
 	Hash      string
@@ -78,7 +132,7 @@ func Validate(d *repb.Digest) (string, error) {
 		return "", status.InvalidArgumentError("Invalid (nil) Digest")
 	}
 	if d.SizeBytes == int64(0) {
-		if d.Hash == EmptySha256 {
+		if IsEmptyHash(d.Hash) {
 			return "", status.OK()
 		}
 		return "", status.InvalidArgumentError("Invalid (zero-length) SHA256 hash")
@@ -102,8 +156,50 @@ func ComputeForMessage(in proto.Message) (*repb.Digest, error) {
 	return Compute(bytes.NewReader(data))
 }
 
+// SupportedDigestFunctions returns the digest functions of the digests that
+// the cache accepts.
+func SupportedDigestFunctions() []repb.DigestFunction_Value {
+	return []repb.DigestFunction_Value{repb.DigestFunction_SHA256, repb.DigestFunction_BLAKE3}
+}
+
+// ValidateDigestFunction returns an Unimplemented error if digests of the
+// given digest function are not supported. UNKNOWN is treated as SHA256, the
+// digest function of clients that don't specify one.
+func ValidateDigestFunction(digestFunction repb.DigestFunction_Value) error {
+	_, err := HashFunction(digestFunction)
+	return err
+}
+
+// IsEmptyHash returns whether the hash is that of the empty blob, for any
+// supported digest function.
+func IsEmptyHash(hash string) bool {
+	return hash == EmptySha256 || hash == EmptyBlake3
+}
+
+// HashFunction returns a new hash of the given digest function. UNKNOWN is
+// treated as SHA256.
+func HashFunction(digestFunction repb.DigestFunction_Value) (hash.Hash, error) {
+	switch digestFunction {
+	case repb.DigestFunction_UNKNOWN, repb.DigestFunction_SHA256:
+		return sha256.New(), nil
+	case repb.DigestFunction_BLAKE3:
+		return blake3.New(), nil
+	default:
+		return nil, status.UnimplementedErrorf("Digest function %s is not supported", digestFunction)
+	}
+}
+
 func Compute(in io.Reader) (*repb.Digest, error) {
-	h := sha256.New()
+	return ComputeWithFunction(in, repb.DigestFunction_SHA256)
+}
+
+// ComputeWithFunction is like Compute, but computes the digest with the given
+// digest function.
+func ComputeWithFunction(in io.Reader, digestFunction repb.DigestFunction_Value) (*repb.Digest, error) {
+	h, err := HashFunction(digestFunction)
+	if err != nil {
+		return nil, err
+	}
 	// Read file in 32KB chunks (default)
 	n, err := io.Copy(h, in)
 	if err != nil {
@@ -138,49 +234,238 @@ func UploadResourceName(d *repb.Digest, instanceName string) (string, error) {
 	return fmt.Sprintf("%s/uploads/%s/blobs/%s/%d", instanceName, u.String(), d.GetHash(), d.GetSizeBytes()), nil
 }
 
-func extractDigest(resourceName string, matcher *regexp.Regexp) (string, *repb.Digest, error) {
-	match := matcher.FindStringSubmatch(resourceName)
-	result := make(map[string]string, len(match))
-	for i, name := range matcher.SubexpNames() {
-		if i != 0 && name != "" && i < len(match) {
-			result[name] = match[i]
+// DeltaUploadResourceName returns a resource name for uploading the blob with
+// the given digest as a BlobDelta.
+func DeltaUploadResourceName(d *repb.Digest, instanceName string) (string, error) {
+	resourceName, err := UploadResourceName(d, instanceName)
+	if err != nil {
+		return "", err
+	}
+	return resourceName + "/" + deltaSegment, nil
+}
+
+// resourceNameKind identifies which of the resource name forms defined by the
+// remote APIs is being parsed.
+type resourceNameKind int
+
+const (
+	uploadResourceName resourceNameKind = iota
+	downloadResourceName
+	actionCacheResourceName
+)
+
+func malformedResourceNameError(resourceName, reason string) error {
+	return status.InvalidArgumentErrorf("Malformed resource name %q: %s", resourceName, reason)
+}
+
+func unsupportedResourceNameError(resourceName, reason string) error {
+	return status.UnimplementedErrorf("Unsupported resource name %q: %s", resourceName, reason)
+}
+
+// IsMalformedResourceNameError returns whether err was returned because a
+// resource name could not be parsed.
+func IsMalformedResourceNameError(err error) bool {
+	return status.IsInvalidArgumentError(err)
+}
+
+// IsUnsupportedResourceNameError returns whether err was returned because a
+// resource name was well formed, but uses a feature (such as a compressor or
+// digest function) that is not supported.
+func IsUnsupportedResourceNameError(err error) bool {
+	return status.IsUnimplementedError(err)
+}
+
+// parseHash checks that hash is a lowercase hex-encoded hash produced by a
+// supported digest function.
+func parseHash(resourceName, hash string) error {
+	for _, c := range hash {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return malformedResourceNameError(resourceName, "hash must be lowercase hex")
+		}
+	}
+	if len(hash) == hashKeyLength {
+		return nil
+	}
+	if fn, ok := unsupportedHashLengths[len(hash)]; ok {
+		return unsupportedResourceNameError(resourceName, fmt.Sprintf("%s digests are not supported", fn))
+	}
+	return malformedResourceNameError(resourceName, fmt.Sprintf("hash length was %d, expected %d", len(hash), hashKeyLength))
+}
+
+// parseSize parses a non-negative decimal size, without a sign.
+func parseSize(resourceName, size string) (int64, error) {
+	if size == "" {
+		return 0, malformedResourceNameError(resourceName, "missing size")
+	}
+	for _, c := range size {
+		if c < '0' || c > '9' {
+			return 0, malformedResourceNameError(resourceName, "size must be a non-negative integer")
+		}
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, malformedResourceNameError(resourceName, "size is out of range")
+	}
+	return n, nil
+}
+
+// parseResourceName parses one of the following resource name forms,
+// depending on kind:
+//
+//   - upload: "{instance_name}/uploads/{uuid}/blobs/{hash}/{size}{/optional_metadata}"
+//   - download: "{instance_name}/blobs/{hash}/{size}"
+//   - action cache: "{instance_name}/blobs/ac/{hash}/{size}"
+//
+// "blobs/" may also be given as "compressed-blobs/{compressor}/" for uploads
+// and downloads, and may be followed by the lowercase name of the digest
+// function, such as "blake3/", for digests not computed with SHA256. The
+// instance name is optional, and may be preceded by a slash for compatibility
+// with names built from an empty instance name.
+//
+// Resource names that don't match the expected form are rejected with an
+// InvalidArgument error, and well-formed names which use an unsupported
+// compressor or digest function are rejected with an Unimplemented error.
+func parseResourceName(resourceName string, kind resourceNameKind) (*InstanceNameDigest, error) {
+	parts := strings.Split(strings.TrimPrefix(resourceName, "/"), "/")
+
+	// The instance name is everything before the first reserved segment.
+	i := 0
+	for ; i < len(parts); i++ {
+		if reservedInstanceNameSegments[parts[i]] {
+			break
+		}
+		if parts[i] == "" {
+			return nil, malformedResourceNameError(resourceName, "instance name contains an empty segment")
+		}
+	}
+	instanceName := strings.Join(parts[:i], "/")
+	rest := parts[i:]
+
+	if kind == uploadResourceName {
+		if len(rest) < 2 || rest[0] != uploadsSegment {
+			return nil, malformedResourceNameError(resourceName, `expected "uploads/{uuid}"`)
+		}
+		if rest[1] == "" {
+			return nil, malformedResourceNameError(resourceName, "missing upload ID")
 		}
+		rest = rest[2:]
 	}
-	hash, hashOK := result["hash"]
-	sizeStr, sizeOK := result["size"]
-	if !hashOK || !sizeOK {
-		return "", nil, status.InvalidArgumentErrorf("Unparsable resource name: %s", resourceName)
+
+	if len(rest) == 0 {
+		return nil, malformedResourceNameError(resourceName, `expected "blobs/"`)
 	}
-	if hash == "" {
-		return "", nil, status.InvalidArgumentErrorf("Unparsable resource name (empty hash?): %s", resourceName)
+	switch rest[0] {
+	case blobsSegment:
+		rest = rest[1:]
+		if kind == actionCacheResourceName {
+			if len(rest) == 0 || rest[0] != actionCacheSegment {
+				return nil, malformedResourceNameError(resourceName, `expected "blobs/ac/"`)
+			}
+			rest = rest[1:]
+		}
+	case compressedBlobsSegment:
+		if kind == actionCacheResourceName {
+			return nil, malformedResourceNameError(resourceName, `expected "blobs/ac/"`)
+		}
+		if len(rest) < 2 || rest[1] == "" {
+			return nil, malformedResourceNameError(resourceName, "missing compressor")
+		}
+		if rest[1] != identityCompressor {
+			return nil, unsupportedResourceNameError(resourceName, fmt.Sprintf("compressor %q is not supported", rest[1]))
+		}
+		rest = rest[2:]
+	default:
+		return nil, malformedResourceNameError(resourceName, `expected "blobs/"`)
 	}
-	sizeBytes, err := strconv.ParseInt(sizeStr, 10, 0)
+
+	// Hashes are hex, so they can't be mistaken for a digest function name.
+	digestFunction := repb.DigestFunction_SHA256
+	if len(rest) > 0 && kind != actionCacheResourceName {
+		if fn, ok := digestFunctionSegments[rest[0]]; ok {
+			if fn != repb.DigestFunction_BLAKE3 {
+				return nil, unsupportedResourceNameError(resourceName, fmt.Sprintf("digest function %q is not supported", rest[0]))
+			}
+			digestFunction = fn
+			rest = rest[1:]
+		}
+	}
+
+	if len(rest) < 2 {
+		return nil, malformedResourceNameError(resourceName, `expected "{hash}/{size}"`)
+	}
+	// Only uploads may have trailing metadata, which we ignore.
+	if len(rest) > 2 && kind != uploadResourceName {
+		return nil, malformedResourceNameError(resourceName, "unexpected trailing segments")
+	}
+	if err := parseHash(resourceName, rest[0]); err != nil {
+		return nil, err
+	}
+	sizeBytes, err := parseSize(resourceName, rest[1])
 	if err != nil {
-		return "", nil, err
+		return nil, err
+	}
+	d := &repb.Digest{Hash: rest[0], SizeBytes: sizeBytes}
+	if _, err := Validate(d); err != nil {
+		return nil, malformedResourceNameError(resourceName, gstatus.Convert(err).Message())
 	}
+	return &InstanceNameDigest{Digest: d, instanceName: instanceName, digestFunction: digestFunction}, nil
+}
+
+// ParseUploadResourceName parses a ByteStream resource name of the form
+// "{instance_name}/uploads/{uuid}/blobs/{hash}/{size}". See
+// parseResourceName for the errors returned.
+func ParseUploadResourceName(resourceName string) (*InstanceNameDigest, error) {
+	return parseResourceName(resourceName, uploadResourceName)
+}
 
-	// Set the instance name, if one was present.
-	instanceName := ""
-	if in, ok := result["instance_name"]; ok {
-		instanceName = in
+// IsDeltaUploadResourceName returns whether the resource name is that of an
+// upload whose data is a BlobDelta, of the form
+// "{instance_name}/uploads/{uuid}/blobs/{hash}/{size}/delta".
+func IsDeltaUploadResourceName(resourceName string) bool {
+	if !strings.HasSuffix(resourceName, "/"+deltaSegment) {
+		return false
 	}
+	blobName := strings.TrimSuffix(resourceName, "/"+deltaSegment)
+	d, err := ParseUploadResourceName(blobName)
+	if err != nil {
+		return false
+	}
+	// The delta segment must directly follow the digest.
+	return strings.HasSuffix(blobName, fmt.Sprintf("/%s/%d", d.GetHash(), d.GetSizeBytes()))
+}
 
-	return instanceName, &repb.Digest{
-		Hash:      hash,
-		SizeBytes: sizeBytes,
-	}, nil
+// ParseDownloadResourceName parses a ByteStream resource name of the form
+// "{instance_name}/blobs/{hash}/{size}". See parseResourceName for the errors
+// returned.
+func ParseDownloadResourceName(resourceName string) (*InstanceNameDigest, error) {
+	return parseResourceName(resourceName, downloadResourceName)
+}
+
+// ParseActionCacheResourceName parses a resource name of the form
+// "{instance_name}/blobs/ac/{hash}/{size}". See parseResourceName for the
+// errors returned.
+func ParseActionCacheResourceName(resourceName string) (*InstanceNameDigest, error) {
+	return parseResourceName(resourceName, actionCacheResourceName)
+}
+
+func extractDigest(resourceName string, kind resourceNameKind) (string, *repb.Digest, error) {
+	d, err := parseResourceName(resourceName, kind)
+	if err != nil {
+		return "", nil, err
+	}
+	return d.GetInstanceName(), d.Digest, nil
 }
 
 func ExtractDigestFromUploadResourceName(resourceName string) (string, *repb.Digest, error) {
-	return extractDigest(resourceName, uploadRegex)
+	return extractDigest(resourceName, uploadResourceName)
 }
 
 func ExtractDigestFromDownloadResourceName(resourceName string) (string, *repb.Digest, error) {
-	return extractDigest(resourceName, downloadRegex)
+	return extractDigest(resourceName, downloadResourceName)
 }
 
 func ExtractDigestFromActionCacheResourceName(resourceName string) (string, *repb.Digest, error) {
-	return extractDigest(resourceName, actionCacheRegex)
+	return extractDigest(resourceName, actionCacheResourceName)
 }
 
 func IsCacheDebuggingEnabled(ctx context.Context) bool {
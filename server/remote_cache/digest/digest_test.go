@@ -1,7 +1,8 @@
 package digest
 
 import (
-	"regexp"
+	"math/rand"
+	"strings"
 	"testing"
 
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
@@ -17,49 +18,49 @@ import (
 func TestExtractDigest(t *testing.T) {
 	cases := []struct {
 		wantError        error
-		matcher          *regexp.Regexp
+		kind             resourceNameKind
 		wantDigest       *repb.Digest
 		resourceName     string
 		wantInstanceName string
 	}{
 		{ // download, bad hash
 			resourceName:     "my_instance_name/blobs/invalid_hash/1234",
-			matcher:          downloadRegex,
+			kind:             downloadResourceName,
 			wantInstanceName: "",
 			wantDigest:       nil,
 			wantError:        status.InvalidArgumentError(""),
 		},
 		{ // download, missing size
 			resourceName:     "/blobs/072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d/",
-			matcher:          downloadRegex,
+			kind:             downloadResourceName,
 			wantInstanceName: "",
 			wantDigest:       nil,
 			wantError:        status.InvalidArgumentError(""),
 		},
 		{ // download, resource with instance name
 			resourceName:     "my_instance_name/blobs/072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d/1234",
-			matcher:          downloadRegex,
+			kind:             downloadResourceName,
 			wantInstanceName: "my_instance_name",
 			wantDigest:       &repb.Digest{Hash: "072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d", SizeBytes: 1234},
 			wantError:        nil,
 		},
 		{ // download, resource without instance name
 			resourceName:     "/blobs/072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d/1234",
-			matcher:          downloadRegex,
+			kind:             downloadResourceName,
 			wantInstanceName: "",
 			wantDigest:       &repb.Digest{Hash: "072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d", SizeBytes: 1234},
 			wantError:        nil,
 		},
 		{ // upload, UUID and instance name
 			resourceName:     "instance_name/uploads/2148e1f1-aacc-41eb-a31c-22b6da7c7ac1/blobs/072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d/1234",
-			matcher:          uploadRegex,
+			kind:             uploadResourceName,
 			wantInstanceName: "instance_name",
 			wantDigest:       &repb.Digest{Hash: "072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d", SizeBytes: 1234},
 			wantError:        nil,
 		},
 	}
 	for _, tc := range cases {
-		gotInstanceName, gotDigest, gotErr := extractDigest(tc.resourceName, tc.matcher)
+		gotInstanceName, gotDigest, gotErr := extractDigest(tc.resourceName, tc.kind)
 		if gstatus.Code(gotErr) != gstatus.Code(tc.wantError) {
 			t.Errorf("extractDigest(%q) returned %v; want %v", tc.resourceName, gotErr, tc.wantError)
 			continue
@@ -72,3 +73,184 @@ func TestExtractDigest(t *testing.T) {
 		}
 	}
 }
+
+const testHash = "072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d"
+
+func TestParseResourceName(t *testing.T) {
+	cases := []struct {
+		name             string
+		resourceName     string
+		kind             resourceNameKind
+		wantInstanceName string
+		wantSize         int64
+		wantBlake3       bool
+		wantMalformed    bool
+		wantUnsupported  bool
+	}{
+		{name: "download without instance name", resourceName: "blobs/" + testHash + "/1234", kind: downloadResourceName, wantSize: 1234},
+		{name: "download with nested instance name", resourceName: "a/b/c/blobs/" + testHash + "/1", kind: downloadResourceName, wantInstanceName: "a/b/c", wantSize: 1},
+		{name: "download of empty blob", resourceName: "blobs/" + EmptySha256 + "/0", kind: downloadResourceName},
+		{name: "download with identity compressor", resourceName: "foo/compressed-blobs/identity/" + testHash + "/5", kind: downloadResourceName, wantInstanceName: "foo", wantSize: 5},
+		{name: "upload with metadata", resourceName: "foo/uploads/2148e1f1-aacc-41eb-a31c-22b6da7c7ac1/blobs/" + testHash + "/5/some/metadata", kind: uploadResourceName, wantInstanceName: "foo", wantSize: 5},
+		{name: "upload without instance name", resourceName: "/uploads/2148e1f1-aacc-41eb-a31c-22b6da7c7ac1/blobs/" + testHash + "/5", kind: uploadResourceName, wantSize: 5},
+		{name: "action cache", resourceName: "foo/blobs/ac/" + testHash + "/5", kind: actionCacheResourceName, wantInstanceName: "foo", wantSize: 5},
+		{name: "download with BLAKE3 digest", resourceName: "foo/blobs/blake3/" + testHash + "/5", kind: downloadResourceName, wantInstanceName: "foo", wantSize: 5, wantBlake3: true},
+		{name: "download of empty BLAKE3 blob", resourceName: "blobs/blake3/" + EmptyBlake3 + "/0", kind: downloadResourceName, wantBlake3: true},
+		{name: "compressed download with BLAKE3 digest", resourceName: "compressed-blobs/identity/blake3/" + testHash + "/5", kind: downloadResourceName, wantSize: 5, wantBlake3: true},
+		{name: "upload with BLAKE3 digest and metadata", resourceName: "uploads/2148e1f1-aacc-41eb-a31c-22b6da7c7ac1/blobs/blake3/" + testHash + "/5/meta", kind: uploadResourceName, wantSize: 5, wantBlake3: true},
+
+		{name: "download with trailing segments", resourceName: "blobs/" + testHash + "/1234/junk", kind: downloadResourceName, wantMalformed: true},
+		{name: "download with trailing characters", resourceName: "blobs/" + testHash + "/1234junk", kind: downloadResourceName, wantMalformed: true},
+		{name: "download with uppercase hash", resourceName: "blobs/" + strings.ToUpper(testHash) + "/1234", kind: downloadResourceName, wantMalformed: true},
+		{name: "download with negative size", resourceName: "blobs/" + testHash + "/-1", kind: downloadResourceName, wantMalformed: true},
+		{name: "download with signed size", resourceName: "blobs/" + testHash + "/+1", kind: downloadResourceName, wantMalformed: true},
+		{name: "download with overflowing size", resourceName: "blobs/" + testHash + "/99999999999999999999", kind: downloadResourceName, wantMalformed: true},
+		{name: "download with zero size and non-empty hash", resourceName: "blobs/" + testHash + "/0", kind: downloadResourceName, wantMalformed: true},
+		{name: "download with empty instance name segment", resourceName: "a//b/blobs/" + testHash + "/1", kind: downloadResourceName, wantMalformed: true},
+		{name: "download with reserved instance name segment", resourceName: "a/operations/blobs/" + testHash + "/1", kind: downloadResourceName, wantMalformed: true},
+		{name: "upload without uploads prefix", resourceName: "blobs/" + testHash + "/1", kind: uploadResourceName, wantMalformed: true},
+		{name: "upload without upload ID", resourceName: "uploads//blobs/" + testHash + "/1", kind: uploadResourceName, wantMalformed: true},
+		{name: "upload parsed as download", resourceName: "foo/uploads/2148e1f1-aacc-41eb-a31c-22b6da7c7ac1/blobs/" + testHash + "/5", kind: downloadResourceName, wantMalformed: true},
+		{name: "action cache without ac", resourceName: "foo/blobs/" + testHash + "/5", kind: actionCacheResourceName, wantMalformed: true},
+		{name: "empty", resourceName: "", kind: downloadResourceName, wantMalformed: true},
+		{name: "download with digest function and no digest", resourceName: "blobs/blake3/5", kind: downloadResourceName, wantMalformed: true},
+		{name: "action cache with digest function", resourceName: "blobs/ac/blake3/" + testHash + "/5", kind: actionCacheResourceName, wantMalformed: true},
+
+		{name: "download with zstd compressor", resourceName: "compressed-blobs/zstd/" + testHash + "/5", kind: downloadResourceName, wantUnsupported: true},
+		{name: "download with SHA1 hash", resourceName: "blobs/" + testHash[:40] + "/5", kind: downloadResourceName, wantUnsupported: true},
+		{name: "download with SHA512 hash", resourceName: "blobs/" + testHash + testHash + "/5", kind: downloadResourceName, wantUnsupported: true},
+		{name: "download with SHA384 digest function", resourceName: "blobs/sha384/" + testHash + "/5", kind: downloadResourceName, wantUnsupported: true},
+	}
+	for _, tc := range cases {
+		d, err := parseResourceName(tc.resourceName, tc.kind)
+		if tc.wantMalformed || tc.wantUnsupported {
+			if tc.wantMalformed && !IsMalformedResourceNameError(err) {
+				t.Errorf("%s: parseResourceName(%q) returned %v; want malformed error", tc.name, tc.resourceName, err)
+			}
+			if tc.wantUnsupported && !IsUnsupportedResourceNameError(err) {
+				t.Errorf("%s: parseResourceName(%q) returned %v; want unsupported error", tc.name, tc.resourceName, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: parseResourceName(%q) returned error %v", tc.name, tc.resourceName, err)
+			continue
+		}
+		if d.GetInstanceName() != tc.wantInstanceName {
+			t.Errorf("%s: got instance name %q; want %q", tc.name, d.GetInstanceName(), tc.wantInstanceName)
+		}
+		if d.GetSizeBytes() != tc.wantSize {
+			t.Errorf("%s: got size %d; want %d", tc.name, d.GetSizeBytes(), tc.wantSize)
+		}
+		wantDigestFunction := repb.DigestFunction_SHA256
+		if tc.wantBlake3 {
+			wantDigestFunction = repb.DigestFunction_BLAKE3
+		}
+		if d.GetDigestFunction() != wantDigestFunction {
+			t.Errorf("%s: got digest function %s; want %s", tc.name, d.GetDigestFunction(), wantDigestFunction)
+		}
+	}
+}
+
+func TestIsDeltaUploadResourceName(t *testing.T) {
+	d := &repb.Digest{Hash: testHash, SizeBytes: 5}
+	name, err := DeltaUploadResourceName(d, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsDeltaUploadResourceName(name) {
+		t.Errorf("IsDeltaUploadResourceName(%q) = false; want true", name)
+	}
+	instanceName, parsed, err := ExtractDigestFromUploadResourceName(name)
+	if err != nil || instanceName != "foo" || parsed.GetHash() != testHash || parsed.GetSizeBytes() != 5 {
+		t.Errorf("ExtractDigestFromUploadResourceName(%q) = %q, %v, %v", name, instanceName, parsed, err)
+	}
+	for _, name := range []string{
+		"foo/uploads/2148e1f1-aacc-41eb-a31c-22b6da7c7ac1/blobs/" + testHash + "/5",
+		"foo/uploads/2148e1f1-aacc-41eb-a31c-22b6da7c7ac1/blobs/" + testHash + "/5/other/delta",
+		"foo/blobs/" + testHash + "/5/delta",
+	} {
+		if IsDeltaUploadResourceName(name) {
+			t.Errorf("IsDeltaUploadResourceName(%q) = true; want false", name)
+		}
+	}
+}
+
+func TestResourceNameRoundTrip(t *testing.T) {
+	for _, instanceName := range []string{"", "foo", "foo/bar"} {
+		d := &repb.Digest{Hash: testHash, SizeBytes: 1234}
+		gotInstanceName, gotDigest, err := ExtractDigestFromDownloadResourceName(DownloadResourceName(d, instanceName))
+		if err != nil || gotInstanceName != instanceName || gotDigest.GetHash() != d.GetHash() || gotDigest.GetSizeBytes() != d.GetSizeBytes() {
+			t.Errorf("download round trip of %q: got (%q, %v, %v)", instanceName, gotInstanceName, gotDigest, err)
+		}
+		uploadName, err := UploadResourceName(d, instanceName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotInstanceName, gotDigest, err = ExtractDigestFromUploadResourceName(uploadName)
+		if err != nil || gotInstanceName != instanceName || gotDigest.GetHash() != d.GetHash() || gotDigest.GetSizeBytes() != d.GetSizeBytes() {
+			t.Errorf("upload round trip of %q: got (%q, %v, %v)", instanceName, gotInstanceName, gotDigest, err)
+		}
+	}
+}
+
+// TestParseResourceName_Fuzz parses randomly mutated resource names, and
+// checks that parsing never panics, only fails with malformed or unsupported
+// errors, and only succeeds with valid digests.
+func TestParseResourceName_Fuzz(t *testing.T) {
+	seeds := []string{
+		"foo/uploads/2148e1f1-aacc-41eb-a31c-22b6da7c7ac1/blobs/" + testHash + "/1234",
+		"foo/uploads/2148e1f1-aacc-41eb-a31c-22b6da7c7ac1/compressed-blobs/zstd/" + testHash + "/1234/meta",
+		"foo/bar/blobs/" + testHash + "/1234",
+		"/blobs/ac/" + testHash + "/1234",
+	}
+	alphabet := []string{"/", "0", "9", "a", "F", "-", "+", "blobs", "uploads", "ac", "compressed-blobs", "identity", ""}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		name := seeds[rng.Intn(len(seeds))]
+		for j := rng.Intn(4); j >= 0; j-- {
+			pos := rng.Intn(len(name) + 1)
+			end := pos + rng.Intn(len(name)-pos+1)/4
+			name = name[:pos] + alphabet[rng.Intn(len(alphabet))] + name[end:]
+		}
+		for _, kind := range []resourceNameKind{uploadResourceName, downloadResourceName, actionCacheResourceName} {
+			d, err := parseResourceName(name, kind)
+			if err != nil {
+				if !IsMalformedResourceNameError(err) && !IsUnsupportedResourceNameError(err) {
+					t.Fatalf("parseResourceName(%q) returned unexpected error %v", name, err)
+				}
+				continue
+			}
+			if _, err := Validate(d.Digest); err != nil {
+				t.Fatalf("parseResourceName(%q) returned invalid digest %v: %s", name, d.Digest, err)
+			}
+			for _, segment := range strings.Split(d.GetInstanceName(), "/") {
+				if reservedInstanceNameSegments[segment] {
+					t.Fatalf("parseResourceName(%q) returned instance name %q with reserved segment", name, d.GetInstanceName())
+				}
+			}
+		}
+	}
+}
+
+func TestComputeWithFunction(t *testing.T) {
+	for _, tc := range []struct {
+		digestFunction repb.DigestFunction_Value
+		want           string
+	}{
+		{repb.DigestFunction_UNKNOWN, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{repb.DigestFunction_SHA256, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{repb.DigestFunction_BLAKE3, "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"},
+	} {
+		d, err := ComputeWithFunction(strings.NewReader("abc"), tc.digestFunction)
+		if err != nil {
+			t.Fatalf("ComputeWithFunction(%s) returned error %v", tc.digestFunction, err)
+		}
+		if d.GetHash() != tc.want || d.GetSizeBytes() != 3 {
+			t.Errorf("ComputeWithFunction(%s) = %v; want hash %q and size 3", tc.digestFunction, d, tc.want)
+		}
+	}
+	if _, err := ComputeWithFunction(strings.NewReader("abc"), repb.DigestFunction_MD5); !status.IsUnimplementedError(err) {
+		t.Errorf("ComputeWithFunction(MD5) returned %v; want Unimplemented error", err)
+	}
+}
@@ -0,0 +1,406 @@
+// Package digest_migration helps clients switch from SHA256 to BLAKE3 digests
+// without starting over with a cold cache. While the migration is enabled,
+// SHA256 blobs that are written to or read from the CAS are re-hashed in the
+// background and copied to their BLAKE3 digests, so that by the time clients
+// switch, the blobs that they use are already stored under both digests.
+//
+// The CAS serves both digest functions throughout: requests say which digest
+// function their digests were computed with, and are served from the entries
+// of that digest function. Once nearly all of the blobs in use are found to
+// be copied already, clients can switch to BLAKE3 and the migration can be
+// disabled.
+//
+// Action cache entries are not migrated: an action's digest depends on the
+// digests of all of its inputs, so it can't be recomputed from the entry.
+package digest_migration
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/util/background"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/lru"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/statusz"
+	"github.com/prometheus/client_golang/prometheus"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	defaultQueueSize = 10000
+	defaultWorkers   = 4
+
+	// The number of copied blobs that are remembered, so that blobs which
+	// are used repeatedly aren't re-hashed every time.
+	copiedBlobsCacheSize = 100000
+
+	// How long copying a blob may take, once it is taken off the queue.
+	copyTimeout = 5 * time.Minute
+
+	copiedOutcome        = "copied"
+	alreadyCopiedOutcome = "already_copied"
+	droppedOutcome       = "dropped"
+	failedOutcome        = "failed"
+)
+
+var statuszTemplate = template.Must(template.New("digest_migration").Parse(`
+<table>
+  <tr><td>Blobs copied</td><td>{{.Copied}}</td></tr>
+  <tr><td>Bytes copied</td><td>{{.CopiedBytes}}</td></tr>
+  <tr><td>Blobs already copied</td><td>{{.AlreadyCopied}}</td></tr>
+  <tr><td>Blobs dropped (queue full)</td><td>{{.Dropped}}</td></tr>
+  <tr><td>Blobs failed</td><td>{{.Failed}}</td></tr>
+  <tr><td>Queue length</td><td>{{.QueueLength}}</td></tr>
+  <tr><td>Blobs in use that were already copied</td><td>{{printf "%.1f%%" .AlreadyCopiedPercent}}</td></tr>
+</table>`))
+
+// Progress summarizes what the migrator has done since it started.
+type Progress struct {
+	Copied        int64
+	CopiedBytes   int64
+	AlreadyCopied int64
+	Dropped       int64
+	Failed        int64
+	QueueLength   int
+
+	// The percentage of the blobs taken off the queue that had already
+	// been copied. It approaches 100% as the blobs in use are migrated.
+	AlreadyCopiedPercent float64
+}
+
+// copyTask is a SHA256 blob waiting to be copied to its BLAKE3 digest.
+type copyTask struct {
+	// The context of the request that used the blob, which holds the user
+	// prefix of its cache entries.
+	ctx   context.Context
+	cache interfaces.Cache
+	d     *repb.Digest
+	key   string
+}
+
+// Migrator copies the SHA256 blobs that are in use to their BLAKE3 digests.
+type Migrator struct {
+	queue chan *copyTask
+	quit  chan struct{}
+	wg    sync.WaitGroup
+
+	mu sync.Mutex // PROTECTS(pending, copied, progress)
+	// The keys of the blobs on the queue, so that a blob is queued once.
+	pending map[string]struct{}
+	// The keys of the blobs that were recently copied.
+	copied   *lru.LRU
+	progress Progress
+}
+
+// NewMigrator returns a Migrator configured by cache.digest_migration, and
+// starts copying blobs. It stops when the server shuts down.
+func NewMigrator(env environment.Env) (*Migrator, error) {
+	conf := env.GetConfigurator().GetCacheDigestMigrationConfig()
+	queueSize := conf.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	workers := conf.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	copied, err := lru.NewLRU(&lru.Config{
+		MaxSize: copiedBlobsCacheSize,
+		SizeFn:  func(k, v interface{}) int64 { return 1 },
+	})
+	if err != nil {
+		return nil, err
+	}
+	m := &Migrator{
+		queue:   make(chan *copyTask, queueSize),
+		quit:    make(chan struct{}),
+		pending: make(map[string]struct{}),
+		copied:  copied,
+	}
+	for i := 0; i < workers; i++ {
+		m.wg.Add(1)
+		go m.work()
+	}
+	env.GetHealthChecker().RegisterShutdownFunction(func(ctx context.Context) error {
+		m.Stop()
+		return nil
+	})
+	statusz.AddSection("digest_migration", "Copying of SHA256 blobs to their BLAKE3 digests", m)
+	return m, nil
+}
+
+// Stop stops copying blobs, waiting for the blobs being copied. Blobs on the
+// queue are not copied.
+func (m *Migrator) Stop() {
+	m.mu.Lock()
+	select {
+	case <-m.quit:
+	default:
+		close(m.quit)
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+// Progress returns what the migrator has done since it started.
+func (m *Migrator) Progress() Progress {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := m.progress
+	p.QueueLength = len(m.queue)
+	if n := p.Copied + p.AlreadyCopied; n > 0 {
+		p.AlreadyCopiedPercent = 100 * float64(p.AlreadyCopied) / float64(n)
+	}
+	return p
+}
+
+func (m *Migrator) Statusz(ctx context.Context) string {
+	buf := &strings.Builder{}
+	if err := statuszTemplate.Execute(buf, m.Progress()); err != nil {
+		return template.HTMLEscapeString(err.Error())
+	}
+	return buf.String()
+}
+
+// CASCache returns a cache which serves the given SHA256 CAS of the instance,
+// and which queues the blobs written to or read from it to be copied to their
+// BLAKE3 digests.
+func (m *Migrator) CASCache(cache interfaces.Cache, instanceName string) interfaces.Cache {
+	return &migratingCache{m: m, cache: cache, namespace: instanceName}
+}
+
+// enqueue queues the blob to be copied, unless it is already queued or was
+// recently copied. Blobs used while the queue is full are dropped, and are
+// queued again the next time that they are used.
+func (m *Migrator) enqueue(ctx context.Context, cache interfaces.Cache, namespace string, d *repb.Digest) {
+	if d.GetSizeBytes() == 0 {
+		return
+	}
+	userPrefix, err := prefix.UserPrefixFromContext(ctx)
+	if err != nil {
+		return
+	}
+	key := fmt.Sprintf("%s/%s/%s/%d", userPrefix, namespace, d.GetHash(), d.GetSizeBytes())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.pending[key]; ok || m.copied.Contains(key) {
+		return
+	}
+	select {
+	case <-m.quit:
+		return
+	default:
+	}
+	select {
+	case m.queue <- &copyTask{ctx: ctx, cache: cache, d: d, key: key}:
+		m.pending[key] = struct{}{}
+		metrics.DigestMigrationQueueLength.Set(float64(len(m.queue)))
+	default:
+		m.progress.Dropped++
+		countBlob(droppedOutcome)
+	}
+}
+
+func (m *Migrator) work() {
+	defer m.wg.Done()
+	for {
+		select {
+		case <-m.quit:
+			return
+		case t := <-m.queue:
+			metrics.DigestMigrationQueueLength.Set(float64(len(m.queue)))
+			outcome, err := m.copyBlob(t)
+			if err != nil {
+				log.Debugf("Could not copy blob %s/%d to its BLAKE3 digest: %s", t.d.GetHash(), t.d.GetSizeBytes(), err)
+				outcome = failedOutcome
+			}
+			m.finish(t, outcome)
+		}
+	}
+}
+
+func (m *Migrator) finish(t *copyTask, outcome string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.pending, t.key)
+	switch outcome {
+	case copiedOutcome:
+		m.progress.Copied++
+		m.progress.CopiedBytes += t.d.GetSizeBytes()
+		metrics.DigestMigrationCopiedBytes.Add(float64(t.d.GetSizeBytes()))
+		m.copied.Add(t.key, true)
+	case alreadyCopiedOutcome:
+		m.progress.AlreadyCopied++
+		m.copied.Add(t.key, true)
+	case failedOutcome:
+		m.progress.Failed++
+	}
+	countBlob(outcome)
+}
+
+func countBlob(outcome string) {
+	metrics.DigestMigrationBlobs.With(prometheus.Labels{
+		metrics.DigestMigrationOutcomeLabel: outcome,
+	}).Inc()
+}
+
+// copyBlob re-hashes the blob and writes it to its BLAKE3 digest, unless it
+// is already stored there. The blob is read twice rather than held in
+// memory, since blobs may be large.
+func (m *Migrator) copyBlob(t *copyTask) (string, error) {
+	ctx, cancel := background.ExtendContextForFinalization(t.ctx, copyTimeout)
+	defer cancel()
+
+	r, err := t.cache.Reader(ctx, t.d, 0)
+	if err != nil {
+		return "", err
+	}
+	d, err := digest.ComputeWithFunction(r, repb.DigestFunction_BLAKE3)
+	r.Close()
+	if err != nil {
+		return "", err
+	}
+	if d.GetSizeBytes() != t.d.GetSizeBytes() {
+		return "", status.DataLossErrorf("read %d bytes, but %d were expected", d.GetSizeBytes(), t.d.GetSizeBytes())
+	}
+
+	target := namespace.DigestFunctionCache(t.cache, repb.DigestFunction_BLAKE3)
+	exists, err := target.Contains(ctx, d)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return alreadyCopiedOutcome, nil
+	}
+
+	r, err = t.cache.Reader(ctx, t.d, 0)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	w, err := target.Writer(ctx, d)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return copiedOutcome, nil
+}
+
+// migratingCache is a SHA256 CAS whose blobs are queued to be copied to their
+// BLAKE3 digests when they are written or read.
+type migratingCache struct {
+	m     *Migrator
+	cache interfaces.Cache
+	// Identifies the part of the cache that the blobs are stored in, along
+	// with the user prefix of requests, so that copies of the same blob in
+	// different instances are tracked separately.
+	namespace string
+}
+
+func (c *migratingCache) WithPrefix(prefix string) interfaces.Cache {
+	return &migratingCache{m: c.m, cache: c.cache.WithPrefix(prefix), namespace: c.namespace + "/" + prefix}
+}
+
+func (c *migratingCache) enqueue(ctx context.Context, d *repb.Digest) {
+	c.m.enqueue(ctx, c.cache, c.namespace, d)
+}
+
+func (c *migratingCache) Contains(ctx context.Context, d *repb.Digest) (bool, error) {
+	return c.cache.Contains(ctx, d)
+}
+
+func (c *migratingCache) ContainsMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest]bool, error) {
+	return c.cache.ContainsMulti(ctx, digests)
+}
+
+func (c *migratingCache) Get(ctx context.Context, d *repb.Digest) ([]byte, error) {
+	data, err := c.cache.Get(ctx, d)
+	if err == nil {
+		c.enqueue(ctx, d)
+	}
+	return data, err
+}
+
+func (c *migratingCache) GetMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest][]byte, error) {
+	found, err := c.cache.GetMulti(ctx, digests)
+	if err == nil {
+		for d := range found {
+			c.enqueue(ctx, d)
+		}
+	}
+	return found, err
+}
+
+func (c *migratingCache) Set(ctx context.Context, d *repb.Digest, data []byte) error {
+	if err := c.cache.Set(ctx, d, data); err != nil {
+		return err
+	}
+	c.enqueue(ctx, d)
+	return nil
+}
+
+func (c *migratingCache) SetMulti(ctx context.Context, kvs map[*repb.Digest][]byte) error {
+	if err := c.cache.SetMulti(ctx, kvs); err != nil {
+		return err
+	}
+	for d := range kvs {
+		c.enqueue(ctx, d)
+	}
+	return nil
+}
+
+func (c *migratingCache) Delete(ctx context.Context, d *repb.Digest) error {
+	return c.cache.Delete(ctx, d)
+}
+
+func (c *migratingCache) Reader(ctx context.Context, d *repb.Digest, offset int64) (io.ReadCloser, error) {
+	r, err := c.cache.Reader(ctx, d, offset)
+	if err == nil {
+		c.enqueue(ctx, d)
+	}
+	return r, err
+}
+
+func (c *migratingCache) Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser, error) {
+	w, err := c.cache.Writer(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	return &migratingWriter{WriteCloser: w, ctx: ctx, c: c, d: d}, nil
+}
+
+// migratingWriter queues the blob that it writes once it is committed.
+type migratingWriter struct {
+	io.WriteCloser
+	ctx context.Context
+	c   *migratingCache
+	d   *repb.Digest
+}
+
+func (w *migratingWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	w.c.enqueue(w.ctx, w.d)
+	return nil
+}
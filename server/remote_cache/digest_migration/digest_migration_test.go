@@ -0,0 +1,125 @@
+package digest_migration
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+func newMigrator(t *testing.T, te *testenv.TestEnv) *Migrator {
+	m, err := NewMigrator(te)
+	require.NoError(t, err)
+	t.Cleanup(m.Stop)
+	return m
+}
+
+// waitForBLAKE3Copy waits for the blob to be stored under its BLAKE3 digest
+// in the given SHA256 CAS.
+func waitForBLAKE3Copy(t *testing.T, ctx context.Context, cas interfaces.Cache, buf []byte) {
+	d, err := digest.ComputeWithFunction(bytes.NewReader(buf), repb.DigestFunction_BLAKE3)
+	require.NoError(t, err)
+	target := namespace.DigestFunctionCache(cas, repb.DigestFunction_BLAKE3)
+	require.Eventually(t, func() bool {
+		data, err := target.Get(ctx, d)
+		return err == nil && bytes.Equal(buf, data)
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func waitForQueue(t *testing.T, m *Migrator) {
+	require.Eventually(t, func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return len(m.pending) == 0
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestCopiesWrittenAndReadBlobs(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te)
+	require.NoError(t, err)
+	m := newMigrator(t, te)
+	cas := namespace.CASCache(te.GetCache(), "instance")
+	mc := m.CASCache(cas, "instance")
+
+	written, writtenBuf := testdigest.NewRandomDigestBuf(t, 100)
+	require.NoError(t, mc.Set(ctx, written, writtenBuf))
+	waitForBLAKE3Copy(t, ctx, cas, writtenBuf)
+
+	streamed, streamedBuf := testdigest.NewRandomDigestBuf(t, 1000)
+	w, err := mc.Writer(ctx, streamed)
+	require.NoError(t, err)
+	_, err = w.Write(streamedBuf)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	waitForBLAKE3Copy(t, ctx, cas, streamedBuf)
+
+	// Blobs written before the migration started are copied once they're
+	// read.
+	read, readBuf := testdigest.NewRandomDigestBuf(t, 100)
+	require.NoError(t, cas.Set(ctx, read, readBuf))
+	_, err = mc.GetMulti(ctx, []*repb.Digest{read})
+	require.NoError(t, err)
+	waitForBLAKE3Copy(t, ctx, cas, readBuf)
+
+	// Blobs that were copied recently aren't re-hashed when used again.
+	_, err = mc.Get(ctx, read)
+	require.NoError(t, err)
+	waitForQueue(t, m)
+	p := m.Progress()
+	assert.Equal(t, int64(3), p.Copied)
+	assert.Equal(t, int64(1200), p.CopiedBytes)
+	assert.Equal(t, int64(0), p.AlreadyCopied)
+
+	// A migrator that doesn't remember copying them finds them already
+	// copied.
+	other := newMigrator(t, te)
+	_, err = other.CASCache(cas, "instance").Get(ctx, read)
+	require.NoError(t, err)
+	waitForQueue(t, other)
+	p = other.Progress()
+	assert.Equal(t, int64(0), p.Copied)
+	assert.Equal(t, int64(1), p.AlreadyCopied)
+	assert.Equal(t, 100.0, p.AlreadyCopiedPercent)
+}
+
+func TestTracksInstancesSeparately(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te)
+	require.NoError(t, err)
+	m := newMigrator(t, te)
+
+	d, buf := testdigest.NewRandomDigestBuf(t, 100)
+	for _, instanceName := range []string{"a", "b"} {
+		cas := namespace.CASCache(te.GetCache(), instanceName)
+		require.NoError(t, m.CASCache(cas, instanceName).Set(ctx, d, buf))
+		waitForBLAKE3Copy(t, ctx, cas, buf)
+	}
+}
+
+func TestMissingBlobsAreNotQueued(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te)
+	require.NoError(t, err)
+	m := newMigrator(t, te)
+	mc := m.CASCache(namespace.CASCache(te.GetCache(), ""), "")
+
+	d, _ := testdigest.NewRandomDigestBuf(t, 100)
+	_, err = mc.Get(ctx, d)
+	require.Error(t, err)
+	_, err = mc.Reader(ctx, d, 0)
+	require.Error(t, err)
+	waitForQueue(t, m)
+	assert.Equal(t, Progress{}, m.Progress())
+}
@@ -88,6 +88,12 @@ func counterName(actionCache bool, ct counterType, iid string) string {
 	return iid + "-" + rawCounterName(actionCache, ct)
 }
 
+// missesByMnemonicKey is the key of the invocation's map of action cache
+// misses by action mnemonic.
+func missesByMnemonicKey(iid string) string {
+	return iid + "-action-cache-misses-by-mnemonic"
+}
+
 type HitTracker struct {
 	c           interfaces.MetricsCollector
 	ctx         context.Context
@@ -129,7 +135,19 @@ func (h *HitTracker) TrackMiss(d *repb.Digest) error {
 		metrics.CacheTypeLabel:      h.cacheTypeLabel(),
 		metrics.CacheEventTypeLabel: missLabel,
 	}).Inc()
-	_, err := h.c.IncrementCount(h.ctx, h.counterName(Miss), 1)
+	if _, err := h.c.IncrementCount(h.ctx, h.counterName(Miss), 1); err != nil {
+		return err
+	}
+	if !h.actionCache {
+		return nil
+	}
+	// Bazel sends the mnemonic of the action that the lookup is for, which
+	// shows which kinds of actions a drop in the hit rate came from.
+	mnemonic := bazel_request.GetRequestMetadata(h.ctx).GetActionMnemonic()
+	if mnemonic == "" {
+		return nil
+	}
+	_, err := h.c.IncrementMapCount(h.ctx, missesByMnemonicKey(h.iid), mnemonic, 1)
 	return err
 }
 
@@ -280,5 +298,7 @@ func CollectCacheStats(ctx context.Context, env environment.Env, iid string) *ca
 
 	cs.TotalCachedActionExecUsec, _ = c.ReadCount(ctx, counterName(false, CachedActionExecUsec, iid))
 
+	cs.ActionCacheMissesByMnemonic, _ = c.ReadMapCounts(ctx, missesByMnemonicKey(iid))
+
 	return cs
 }
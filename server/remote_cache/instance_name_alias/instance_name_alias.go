@@ -0,0 +1,219 @@
+// Package instance_name_alias lets groups rename their remote instances. An
+// alias maps a retired instance name to the instance name that replaces it:
+// while the alias is active, cache requests for either name are served from
+// the replacement, falling back to the entries stored under the retired name,
+// so that cached results and the outputs of historical invocations remain
+// reachable after the rename.
+package instance_name_alias
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/timeutil"
+
+	ianpb "github.com/buildbuddy-io/buildbuddy/proto/instance_name_alias"
+)
+
+const (
+	// How long a group's aliases are cached before they are read from the
+	// database again. Changes made through other servers take up to this long
+	// to take effect on this one.
+	refreshInterval = 30 * time.Second
+
+	maxInstanceNameLength = 512
+)
+
+type groupAliases struct {
+	fetchedAt time.Time
+	aliases   []*tables.InstanceNameAlias
+}
+
+type Service struct {
+	env environment.Env
+
+	mu     sync.Mutex
+	groups map[string]*groupAliases
+}
+
+func NewService(env environment.Env) *Service {
+	return &Service{
+		env:    env,
+		groups: make(map[string]*groupAliases),
+	}
+}
+
+func isActive(a *tables.InstanceNameAlias, nowUsec int64) bool {
+	return a.ExpiresAtUsec == 0 || a.ExpiresAtUsec > nowUsec
+}
+
+// aliases returns all of the group's aliases, including expired ones, ordered
+// by retired instance name.
+func (s *Service) aliases(ctx context.Context, groupID string) ([]*tables.InstanceNameAlias, error) {
+	now := s.env.GetClock().Now()
+	s.mu.Lock()
+	ga, ok := s.groups[groupID]
+	s.mu.Unlock()
+	if ok && now.Sub(ga.fetchedAt) < refreshInterval {
+		return ga.aliases, nil
+	}
+	var aliases []*tables.InstanceNameAlias
+	err := s.env.GetDBHandle().WithContext(ctx).Raw(`SELECT * FROM InstanceNameAliases WHERE group_id = ? ORDER BY retired_instance_name`, groupID).Scan(&aliases).Error
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.groups[groupID] = &groupAliases{fetchedAt: now, aliases: aliases}
+	s.mu.Unlock()
+	return aliases, nil
+}
+
+func (s *Service) invalidate(groupID string) {
+	s.mu.Lock()
+	delete(s.groups, groupID)
+	s.mu.Unlock()
+}
+
+// Resolve returns the instance name that requests for the given instance name
+// should be served from, along with the retired instance names that alias to
+// it. Requests which aren't made on behalf of a group aren't aliased.
+func (s *Service) Resolve(ctx context.Context, instanceName string) (string, []string, error) {
+	u, err := perms.AuthenticatedUser(ctx, s.env)
+	if err != nil || u.GetGroupID() == "" {
+		return instanceName, nil, nil
+	}
+	aliases, err := s.aliases(ctx, u.GetGroupID())
+	if err != nil {
+		return instanceName, nil, err
+	}
+	nowUsec := timeutil.ToUsec(s.env.GetClock().Now())
+	primary := instanceName
+	for _, a := range aliases {
+		if a.RetiredInstanceName == instanceName && isActive(a, nowUsec) {
+			primary = a.ReplacementInstanceName
+			break
+		}
+	}
+	var fallbacks []string
+	for _, a := range aliases {
+		if a.ReplacementInstanceName == primary && isActive(a, nowUsec) {
+			fallbacks = append(fallbacks, a.RetiredInstanceName)
+		}
+	}
+	return primary, fallbacks, nil
+}
+
+func (s *Service) CreateInstanceNameAlias(ctx context.Context, req *ianpb.CreateInstanceNameAliasRequest) (*ianpb.CreateInstanceNameAliasResponse, error) {
+	groupID, err := perms.AuthenticateSelectedGroupID(ctx, s.env, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	retired := req.GetAlias().GetRetiredInstanceName()
+	replacement := req.GetAlias().GetReplacementInstanceName()
+	if retired == replacement {
+		return nil, status.InvalidArgumentError("the retired and replacement instance names must differ")
+	}
+	if len(retired) > maxInstanceNameLength || len(replacement) > maxInstanceNameLength {
+		return nil, status.InvalidArgumentErrorf("instance names must be at most %d characters long", maxInstanceNameLength)
+	}
+	nowUsec := timeutil.ToUsec(s.env.GetClock().Now())
+	expiresAtUsec := req.GetAlias().GetExpiresAtUsec()
+	if expiresAtUsec != 0 && expiresAtUsec <= nowUsec {
+		return nil, status.InvalidArgumentError("expires_at_usec must be in the future")
+	}
+	err = s.env.GetDBHandle().Transaction(ctx, func(tx *db.DB) error {
+		var existing []*tables.InstanceNameAlias
+		if err := tx.Raw(`SELECT * FROM InstanceNameAliases WHERE group_id = ?`, groupID).Scan(&existing).Error; err != nil {
+			return err
+		}
+		// Aliases are resolved in a single step, so they can't be chained:
+		// aliases to a name which is itself retired must be re-pointed at its
+		// replacement first.
+		var expired *tables.InstanceNameAlias
+		for _, a := range existing {
+			if a.RetiredInstanceName == retired && !isActive(a, nowUsec) {
+				expired = a
+			}
+			if !isActive(a, nowUsec) {
+				continue
+			}
+			if a.RetiredInstanceName == retired {
+				return status.AlreadyExistsErrorf("instance name %q is already aliased to %q", retired, a.ReplacementInstanceName)
+			}
+			if a.RetiredInstanceName == replacement {
+				return status.FailedPreconditionErrorf("instance name %q is retired in favor of %q", replacement, a.ReplacementInstanceName)
+			}
+			if a.ReplacementInstanceName == retired {
+				return status.FailedPreconditionErrorf("instance name %q is aliased to %q, which must be aliased to %q first", a.RetiredInstanceName, retired, replacement)
+			}
+		}
+		if expired != nil {
+			return tx.Exec(`UPDATE InstanceNameAliases SET replacement_instance_name = ?, expires_at_usec = ?, created_at_usec = ?, updated_at_usec = ? WHERE group_id = ? AND retired_instance_name = ?`,
+				replacement, expiresAtUsec, nowUsec, nowUsec, groupID, retired).Error
+		}
+		return tx.Create(&tables.InstanceNameAlias{
+			GroupID:                 groupID,
+			RetiredInstanceName:     retired,
+			ReplacementInstanceName: replacement,
+			ExpiresAtUsec:           expiresAtUsec,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.invalidate(groupID)
+	return &ianpb.CreateInstanceNameAliasResponse{}, nil
+}
+
+func (s *Service) ExpireInstanceNameAlias(ctx context.Context, req *ianpb.ExpireInstanceNameAliasRequest) (*ianpb.ExpireInstanceNameAliasResponse, error) {
+	groupID, err := perms.AuthenticateSelectedGroupID(ctx, s.env, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	nowUsec := timeutil.ToUsec(s.env.GetClock().Now())
+	expiresAtUsec := req.GetExpiresAtUsec()
+	if expiresAtUsec == 0 {
+		expiresAtUsec = nowUsec
+	}
+	result := s.env.GetDBHandle().WithContext(ctx).Exec(`UPDATE InstanceNameAliases SET expires_at_usec = ?, updated_at_usec = ? WHERE group_id = ? AND retired_instance_name = ?`, expiresAtUsec, nowUsec, groupID, req.GetRetiredInstanceName())
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, status.NotFoundErrorf("instance name %q is not aliased", req.GetRetiredInstanceName())
+	}
+	s.invalidate(groupID)
+	return &ianpb.ExpireInstanceNameAliasResponse{}, nil
+}
+
+func (s *Service) GetInstanceNameAliases(ctx context.Context, req *ianpb.GetInstanceNameAliasesRequest) (*ianpb.GetInstanceNameAliasesResponse, error) {
+	groupID, err := perms.AuthenticateSelectedGroupID(ctx, s.env, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	var aliases []*tables.InstanceNameAlias
+	err = s.env.GetDBHandle().WithContext(ctx).Raw(`SELECT * FROM InstanceNameAliases WHERE group_id = ? ORDER BY retired_instance_name`, groupID).Scan(&aliases).Error
+	if err != nil {
+		return nil, err
+	}
+	nowUsec := timeutil.ToUsec(s.env.GetClock().Now())
+	rsp := &ianpb.GetInstanceNameAliasesResponse{}
+	for _, a := range aliases {
+		if !req.GetIncludeExpired() && !isActive(a, nowUsec) {
+			continue
+		}
+		rsp.Alias = append(rsp.Alias, &ianpb.InstanceNameAlias{
+			RetiredInstanceName:     a.RetiredInstanceName,
+			ReplacementInstanceName: a.ReplacementInstanceName,
+			CreatedAtUsec:           a.CreatedAtUsec,
+			ExpiresAtUsec:           a.ExpiresAtUsec,
+		})
+	}
+	return rsp, nil
+}
@@ -0,0 +1,129 @@
+package instance_name_alias_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/instance_name_alias"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ianpb "github.com/buildbuddy-io/buildbuddy/proto/instance_name_alias"
+)
+
+func authContext(t *testing.T, te *testenv.TestEnv, userID string) context.Context {
+	ctx, err := te.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), userID)
+	require.NoError(t, err)
+	return ctx
+}
+
+func createAlias(ctx context.Context, s *instance_name_alias.Service, retired, replacement string, expiresAtUsec int64) error {
+	_, err := s.CreateInstanceNameAlias(ctx, &ianpb.CreateInstanceNameAliasRequest{
+		RequestContext: testauth.RequestContext("US1", "GR1"),
+		Alias: &ianpb.InstanceNameAlias{
+			RetiredInstanceName:     retired,
+			ReplacementInstanceName: replacement,
+			ExpiresAtUsec:           expiresAtUsec,
+		},
+	})
+	return err
+}
+
+func TestResolve(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	clock := te.UseFakeClock()
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1", "US2", "GR2")))
+	s := instance_name_alias.NewService(te)
+	ctx := authContext(t, te, "US1")
+
+	require.NoError(t, createAlias(ctx, s, "old", "new", 0))
+	require.NoError(t, createAlias(ctx, s, "older", "new", clock.Now().Add(time.Hour).UnixMicro()))
+
+	for _, name := range []string{"old", "older", "new"} {
+		primary, fallbacks, err := s.Resolve(ctx, name)
+		require.NoError(t, err)
+		assert.Equal(t, "new", primary, name)
+		assert.Equal(t, []string{"old", "older"}, fallbacks, name)
+	}
+	primary, fallbacks, err := s.Resolve(ctx, "unrelated")
+	require.NoError(t, err)
+	assert.Equal(t, "unrelated", primary)
+	assert.Empty(t, fallbacks)
+
+	// Other groups' instance names aren't aliased.
+	primary, fallbacks, err = s.Resolve(authContext(t, te, "US2"), "old")
+	require.NoError(t, err)
+	assert.Equal(t, "old", primary)
+	assert.Empty(t, fallbacks)
+
+	// Once an alias expires, the retired name is no longer redirected.
+	clock.Advance(2 * time.Hour)
+	primary, fallbacks, err = s.Resolve(ctx, "older")
+	require.NoError(t, err)
+	assert.Equal(t, "older", primary)
+	assert.Empty(t, fallbacks)
+	_, fallbacks, err = s.Resolve(ctx, "new")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"old"}, fallbacks)
+
+	_, err = s.ExpireInstanceNameAlias(ctx, &ianpb.ExpireInstanceNameAliasRequest{
+		RequestContext:      testauth.RequestContext("US1", "GR1"),
+		RetiredInstanceName: "old",
+	})
+	require.NoError(t, err)
+	primary, fallbacks, err = s.Resolve(ctx, "old")
+	require.NoError(t, err)
+	assert.Equal(t, "old", primary)
+	assert.Empty(t, fallbacks)
+
+	rsp, err := s.GetInstanceNameAliases(ctx, &ianpb.GetInstanceNameAliasesRequest{RequestContext: testauth.RequestContext("US1", "GR1")})
+	require.NoError(t, err)
+	assert.Empty(t, rsp.GetAlias())
+	rsp, err = s.GetInstanceNameAliases(ctx, &ianpb.GetInstanceNameAliasesRequest{RequestContext: testauth.RequestContext("US1", "GR1"), IncludeExpired: true})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetAlias(), 2)
+	assert.Equal(t, "old", rsp.GetAlias()[0].GetRetiredInstanceName())
+	assert.Equal(t, "older", rsp.GetAlias()[1].GetRetiredInstanceName())
+
+	// An expired alias may be replaced.
+	require.NoError(t, createAlias(ctx, s, "old", "newer", 0))
+	primary, _, err = s.Resolve(ctx, "old")
+	require.NoError(t, err)
+	assert.Equal(t, "newer", primary)
+}
+
+func TestCreateInvalidAliases(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1", "US2", "GR2")))
+	s := instance_name_alias.NewService(te)
+	ctx := authContext(t, te, "US1")
+
+	require.NoError(t, createAlias(ctx, s, "b", "c", 0))
+
+	err := createAlias(ctx, s, "a", "a", 0)
+	assert.True(t, status.IsInvalidArgumentError(err), "self alias")
+	err = createAlias(ctx, s, "b", "d", 0)
+	assert.True(t, status.IsAlreadyExistsError(err), "already aliased")
+	err = createAlias(ctx, s, "a", "b", 0)
+	assert.True(t, status.IsFailedPreconditionError(err), "replacement is retired")
+	err = createAlias(ctx, s, "c", "d", 0)
+	assert.True(t, status.IsFailedPreconditionError(err), "retired name is a replacement")
+	err = createAlias(ctx, s, "a", "c", 1)
+	assert.True(t, status.IsInvalidArgumentError(err), "already expired")
+
+	_, err = s.CreateInstanceNameAlias(authContext(t, te, "US2"), &ianpb.CreateInstanceNameAliasRequest{
+		RequestContext: testauth.RequestContext("US2", "GR1"),
+		Alias:          &ianpb.InstanceNameAlias{RetiredInstanceName: "x", ReplacementInstanceName: "y"},
+	})
+	assert.Error(t, err, "other groups can't create aliases")
+
+	_, err = s.ExpireInstanceNameAlias(ctx, &ianpb.ExpireInstanceNameAliasRequest{
+		RequestContext:      testauth.RequestContext("US1", "GR1"),
+		RetiredInstanceName: "missing",
+	})
+	assert.True(t, status.IsNotFoundError(err))
+}
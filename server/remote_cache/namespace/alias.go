@@ -0,0 +1,188 @@
+package namespace
+
+import (
+	"context"
+	"io"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+// AliasedCASCache returns the CAS of the given remote instance, taking the
+// group's instance name aliases into account: blobs are stored under the
+// instance name that replaces it, if it was retired, and are also read from
+// the retired instance names that alias to that one.
+func AliasedCASCache(ctx context.Context, env environment.Env, cache interfaces.Cache, instanceName string) interfaces.Cache {
+	primary, fallbacks := resolveAlias(ctx, env, instanceName)
+	return newFallbackCache(CASCache(cache, primary), fallbacks, func(name string) interfaces.Cache {
+		return CASCache(cache, name)
+	})
+}
+
+// AliasedActionCache is like AliasedCASCache, but returns the action cache of
+// the given remote instance.
+func AliasedActionCache(ctx context.Context, env environment.Env, cache interfaces.Cache, instanceName string) interfaces.Cache {
+	primary, fallbacks := resolveAlias(ctx, env, instanceName)
+	return newFallbackCache(ActionCache(cache, primary), fallbacks, func(name string) interfaces.Cache {
+		return ActionCache(cache, name)
+	})
+}
+
+func resolveAlias(ctx context.Context, env environment.Env, instanceName string) (string, []string) {
+	as := env.GetInstanceNameAliasService()
+	if as == nil {
+		return instanceName, nil
+	}
+	primary, fallbacks, err := as.Resolve(ctx, instanceName)
+	if err != nil {
+		// Serve the instance name as requested rather than failing the
+		// request, as if it weren't aliased.
+		log.Warningf("Could not resolve aliases of instance name %q: %s", instanceName, err)
+		return instanceName, nil
+	}
+	return primary, fallbacks
+}
+
+func newFallbackCache(primary interfaces.Cache, fallbackNames []string, cacheForName func(string) interfaces.Cache) interfaces.Cache {
+	if len(fallbackNames) == 0 {
+		return primary
+	}
+	fallbacks := make([]interfaces.Cache, 0, len(fallbackNames))
+	for _, name := range fallbackNames {
+		fallbacks = append(fallbacks, cacheForName(name))
+	}
+	return &fallbackCache{primary: primary, fallbacks: fallbacks}
+}
+
+// fallbackCache writes to the primary cache, and reads from the primary cache
+// falling back to each of the fallback caches in turn.
+type fallbackCache struct {
+	primary   interfaces.Cache
+	fallbacks []interfaces.Cache
+}
+
+func (c *fallbackCache) WithPrefix(prefix string) interfaces.Cache {
+	fallbacks := make([]interfaces.Cache, 0, len(c.fallbacks))
+	for _, fc := range c.fallbacks {
+		fallbacks = append(fallbacks, fc.WithPrefix(prefix))
+	}
+	return &fallbackCache{
+		primary:   c.primary.WithPrefix(prefix),
+		fallbacks: fallbacks,
+	}
+}
+
+func (c *fallbackCache) Contains(ctx context.Context, d *repb.Digest) (bool, error) {
+	exists, err := c.primary.Contains(ctx, d)
+	if err != nil || exists {
+		return exists, err
+	}
+	for _, fc := range c.fallbacks {
+		if exists, err := fc.Contains(ctx, d); err == nil && exists {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *fallbackCache) ContainsMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest]bool, error) {
+	foundMap, err := c.primary.ContainsMulti(ctx, digests)
+	if err != nil {
+		return nil, err
+	}
+	for _, fc := range c.fallbacks {
+		stillMissing := make([]*repb.Digest, 0)
+		for _, d := range digests {
+			if !foundMap[d] {
+				stillMissing = append(stillMissing, d)
+			}
+		}
+		if len(stillMissing) == 0 {
+			break
+		}
+		fallbackFoundMap, err := fc.ContainsMulti(ctx, stillMissing)
+		if err != nil {
+			continue
+		}
+		for d, found := range fallbackFoundMap {
+			if found {
+				foundMap[d] = true
+			}
+		}
+	}
+	return foundMap, nil
+}
+
+func (c *fallbackCache) Get(ctx context.Context, d *repb.Digest) ([]byte, error) {
+	data, err := c.primary.Get(ctx, d)
+	if !status.IsNotFoundError(err) {
+		return data, err
+	}
+	for _, fc := range c.fallbacks {
+		if data, err := fc.Get(ctx, d); err == nil {
+			return data, nil
+		}
+	}
+	return nil, err
+}
+
+func (c *fallbackCache) GetMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest][]byte, error) {
+	foundMap, err := c.primary.GetMulti(ctx, digests)
+	if err != nil {
+		return nil, err
+	}
+	for _, fc := range c.fallbacks {
+		stillMissing := make([]*repb.Digest, 0)
+		for _, d := range digests {
+			if _, ok := foundMap[d]; !ok {
+				stillMissing = append(stillMissing, d)
+			}
+		}
+		if len(stillMissing) == 0 {
+			break
+		}
+		fallbackFoundMap, err := fc.GetMulti(ctx, stillMissing)
+		if err != nil {
+			continue
+		}
+		for d, data := range fallbackFoundMap {
+			foundMap[d] = data
+		}
+	}
+	return foundMap, nil
+}
+
+func (c *fallbackCache) Set(ctx context.Context, d *repb.Digest, data []byte) error {
+	return c.primary.Set(ctx, d, data)
+}
+
+func (c *fallbackCache) SetMulti(ctx context.Context, kvs map[*repb.Digest][]byte) error {
+	return c.primary.SetMulti(ctx, kvs)
+}
+
+// Delete only deletes the blob from the primary cache: entries stored under
+// retired instance names are left as they were.
+func (c *fallbackCache) Delete(ctx context.Context, d *repb.Digest) error {
+	return c.primary.Delete(ctx, d)
+}
+
+func (c *fallbackCache) Reader(ctx context.Context, d *repb.Digest, offset int64) (io.ReadCloser, error) {
+	r, err := c.primary.Reader(ctx, d, offset)
+	if !status.IsNotFoundError(err) {
+		return r, err
+	}
+	for _, fc := range c.fallbacks {
+		if r, err := fc.Reader(ctx, d, offset); err == nil {
+			return r, nil
+		}
+	}
+	return nil, err
+}
+
+func (c *fallbackCache) Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser, error) {
+	return c.primary.Writer(ctx, d)
+}
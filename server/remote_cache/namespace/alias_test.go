@@ -0,0 +1,67 @@
+package namespace_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/instance_name_alias"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ianpb "github.com/buildbuddy-io/buildbuddy/proto/instance_name_alias"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+func TestAliasedCache(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")))
+	as := instance_name_alias.NewService(te)
+	te.SetInstanceNameAliasService(as)
+	ctx, err := te.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+	ctx, err = prefix.AttachUserPrefixToContext(ctx, te)
+	require.NoError(t, err)
+
+	// Entries stored before the rename.
+	oldDigest, oldBuf := testdigest.NewRandomDigestBuf(t, 100)
+	require.NoError(t, namespace.CASCache(te.GetCache(), "old").Set(ctx, oldDigest, oldBuf))
+	require.NoError(t, namespace.ActionCache(te.GetCache(), "old").Set(ctx, oldDigest, oldBuf))
+
+	_, err = as.CreateInstanceNameAlias(ctx, &ianpb.CreateInstanceNameAliasRequest{
+		RequestContext: testauth.RequestContext("US1", "GR1"),
+		Alias:          &ianpb.InstanceNameAlias{RetiredInstanceName: "old", ReplacementInstanceName: "new"},
+	})
+	require.NoError(t, err)
+
+	// Writes to either name are stored under the replacement.
+	newDigest, newBuf := testdigest.NewRandomDigestBuf(t, 100)
+	require.NoError(t, namespace.AliasedCASCache(ctx, te, te.GetCache(), "old").Set(ctx, newDigest, newBuf))
+	exists, err := namespace.CASCache(te.GetCache(), "new").Contains(ctx, newDigest)
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	// Reads of either name find the entries stored under both.
+	for _, name := range []string{"old", "new"} {
+		cas := namespace.AliasedCASCache(ctx, te, te.GetCache(), name)
+		found, err := cas.ContainsMulti(ctx, []*repb.Digest{oldDigest, newDigest})
+		require.NoError(t, err)
+		assert.Equal(t, map[*repb.Digest]bool{oldDigest: true, newDigest: true}, found, name)
+		data, err := cas.Get(ctx, oldDigest)
+		require.NoError(t, err)
+		assert.Equal(t, oldBuf, data, name)
+
+		data, err = namespace.AliasedActionCache(ctx, te, te.GetCache(), name).Get(ctx, oldDigest)
+		require.NoError(t, err)
+		assert.Equal(t, oldBuf, data, name)
+	}
+
+	// Unrelated instance names are unaffected.
+	exists, err = namespace.AliasedCASCache(ctx, te, te.GetCache(), "other").Contains(ctx, oldDigest)
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
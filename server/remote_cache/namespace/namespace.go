@@ -2,10 +2,20 @@ package namespace
 
 import (
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 )
 
 const (
-	acCachePrefix = "ac"
+	// ACCachePrefix is the prefix under which action cache entries are
+	// stored, after the remote instance name (if any).
+	ACCachePrefix = "ac"
+
+	// The prefix under which entries keyed by BLAKE3 digests are stored,
+	// after the CAS or action cache prefix. Like the resource names of these
+	// blobs, it contains "blobs", which no instance name may contain, so it
+	// can't collide with the entries of another instance.
+	blake3CachePrefix = "blobs/blake3"
 )
 
 func CASCache(cache interfaces.Cache, instanceName string) interfaces.Cache {
@@ -21,5 +31,16 @@ func ActionCache(cache interfaces.Cache, instanceName string) interfaces.Cache {
 	if instanceName != "" {
 		c = c.WithPrefix(instanceName)
 	}
-	return c.WithPrefix(acCachePrefix)
+	return c.WithPrefix(ACCachePrefix)
+}
+
+// DigestFunctionCache returns the part of the given CAS or action cache
+// holding entries keyed by digests of the given digest function. Entries
+// keyed by SHA256 digests are stored without a prefix, as they were before
+// other digest functions were supported.
+func DigestFunctionCache(cache interfaces.Cache, digestFunction repb.DigestFunction_Value) interfaces.Cache {
+	if digestFunction == repb.DigestFunction_BLAKE3 {
+		return cache.WithPrefix(blake3CachePrefix)
+	}
+	return cache
 }
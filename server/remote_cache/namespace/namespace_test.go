@@ -0,0 +1,38 @@
+package namespace_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+func TestDigestFunctionCache(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te)
+	require.NoError(t, err)
+
+	d, buf := testdigest.NewRandomDigestBuf(t, 100)
+	cas := namespace.CASCache(te.GetCache(), "")
+	require.NoError(t, namespace.DigestFunctionCache(cas, repb.DigestFunction_BLAKE3).Set(ctx, d, buf))
+
+	data, err := namespace.DigestFunctionCache(cas, repb.DigestFunction_BLAKE3).Get(ctx, d)
+	require.NoError(t, err)
+	assert.Equal(t, buf, data)
+
+	// SHA256 entries are stored as before, and are kept apart from BLAKE3
+	// entries of every instance.
+	assert.Equal(t, cas, namespace.DigestFunctionCache(cas, repb.DigestFunction_SHA256))
+	for _, instanceName := range []string{"", "blake3"} {
+		exists, err := namespace.CASCache(te.GetCache(), instanceName).Contains(ctx, d)
+		require.NoError(t, err)
+		assert.False(t, exists, instanceName)
+	}
+}
@@ -0,0 +1,171 @@
+package namespace
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/bazel_request"
+	"github.com/buildbuddy-io/buildbuddy/server/util/lru"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+const (
+	// OverrideMetadataKey is the build metadata key with which an invocation
+	// requests that its cache entries be kept in a separate cache namespace,
+	// e.g. --build_metadata=CACHE_NAMESPACE=experimental-toolchain.
+	OverrideMetadataKey = "CACHE_NAMESPACE"
+
+	// The prefix under which namespaced cache entries are stored, before the
+	// remote instance name (if any).
+	overrideCachePrefix = "cache-namespace"
+
+	overrideKeyPrefix = "cache-namespace/"
+	// How long an invocation's cache requests keep using its namespace.
+	overrideExpiration = 24 * time.Hour
+
+	// How long resolved namespaces are remembered, so that every cache
+	// request of an invocation doesn't have to look up its namespace.
+	// Invocations without a namespace aren't remembered, since their build
+	// metadata selecting one may not have been received yet, and they must
+	// stop using the main cache as soon as it has been.
+	resolvedOverrideTTL  = 5 * time.Minute
+	maxResolvedOverrides = 10000
+)
+
+var namespaceRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,63}$`)
+
+// ParseAllowedNamespaces parses a group's comma-separated list of allowed
+// cache namespaces.
+func ParseAllowedNamespaces(allowed string) ([]string, error) {
+	var namespaces []string
+	for _, ns := range strings.Split(allowed, ",") {
+		ns = strings.TrimSpace(ns)
+		if ns == "" {
+			continue
+		}
+		if !namespaceRegexp.MatchString(ns) {
+			return nil, status.InvalidArgumentErrorf("Invalid cache namespace %q: namespaces may contain up to 64 letters, numbers, dots, underscores or hyphens, and must start with a letter or number", ns)
+		}
+		namespaces = append(namespaces, ns)
+	}
+	return namespaces, nil
+}
+
+// CheckOverrideAllowed returns an error if the given cache namespace isn't in
+// the group's comma-separated list of allowed namespaces.
+func CheckOverrideAllowed(allowed, namespace string) error {
+	namespaces, err := ParseAllowedNamespaces(allowed)
+	if err != nil {
+		return err
+	}
+	for _, ns := range namespaces {
+		if ns == namespace {
+			return nil
+		}
+	}
+	return status.PermissionDeniedErrorf("Cache namespace %q is not allowed for this organization", namespace)
+}
+
+func overrideKey(groupID, invocationID string) string {
+	return overrideKeyPrefix + groupID + "/" + invocationID
+}
+
+// SetInvocationOverride records that the cache requests made by the given
+// invocation of the given group should use the given cache namespace. The
+// namespace must already have been checked against the group's policy.
+func SetInvocationOverride(ctx context.Context, env environment.Env, groupID, invocationID, namespace string) error {
+	kvs := env.GetKeyValStore()
+	if kvs == nil {
+		return status.UnimplementedError("Cache namespace overrides require a key value store")
+	}
+	if groupID == "" || invocationID == "" {
+		return status.InvalidArgumentError("Cache namespace overrides require an authenticated group and an invocation ID")
+	}
+	return kvs.SetValue(ctx, overrideKey(groupID, invocationID), namespace, overrideExpiration)
+}
+
+type resolvedOverride struct {
+	namespace string
+	expiresAt time.Time
+}
+
+// OverrideResolver looks up the cache namespaces of the invocations making
+// cache requests, remembering them for a while.
+type OverrideResolver struct {
+	env environment.Env
+
+	mu       sync.Mutex
+	resolved *lru.LRU
+}
+
+func NewOverrideResolver(env environment.Env) (*OverrideResolver, error) {
+	l, err := lru.NewLRU(&lru.Config{
+		MaxSize: maxResolvedOverrides,
+		SizeFn:  func(k, v interface{}) int64 { return 1 },
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &OverrideResolver{env: env, resolved: l}, nil
+}
+
+// InvocationOverride returns the cache namespace which the invocation making
+// the request asked to use, or "" if it should use the main cache.
+func (r *OverrideResolver) InvocationOverride(ctx context.Context) (string, error) {
+	kvs := r.env.GetKeyValStore()
+	invocationID := bazel_request.GetInvocationID(ctx)
+	if kvs == nil || invocationID == "" {
+		return "", nil
+	}
+	u, err := perms.AuthenticatedUser(ctx, r.env)
+	if err != nil || u.GetGroupID() == "" {
+		return "", nil
+	}
+	key := overrideKey(u.GetGroupID(), invocationID)
+	now := time.Now()
+	r.mu.Lock()
+	v, ok := r.resolved.Get(key)
+	r.mu.Unlock()
+	if ok && now.Before(v.(*resolvedOverride).expiresAt) {
+		return v.(*resolvedOverride).namespace, nil
+	}
+	ns, err := kvs.GetValue(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if ns == "" {
+		return "", nil
+	}
+	r.mu.Lock()
+	r.resolved.Add(key, &resolvedOverride{namespace: ns, expiresAt: now.Add(resolvedOverrideTTL)})
+	r.mu.Unlock()
+	return ns, nil
+}
+
+// InvocationCache returns the part of the cache used by the invocation making
+// the request: the cache namespace that it asked to use, if any, or else the
+// whole cache. If the namespace can't be looked up, an Unavailable error is
+// returned rather than the whole cache, which the invocation asked not to
+// read or write.
+func (r *OverrideResolver) InvocationCache(ctx context.Context, cache interfaces.Cache) (interfaces.Cache, error) {
+	ns, err := r.InvocationOverride(ctx)
+	if err != nil {
+		return nil, status.UnavailableErrorf("Could not look up the cache namespace of invocation %q: %s", bazel_request.GetInvocationID(ctx), err)
+	}
+	return OverrideCache(cache, ns), nil
+}
+
+// OverrideCache returns the part of the cache used by invocations which asked
+// to use the given cache namespace, or the whole cache if it's "".
+func OverrideCache(cache interfaces.Cache, namespace string) interfaces.Cache {
+	if namespace == "" {
+		return cache
+	}
+	return cache.WithPrefix(overrideCachePrefix + "/" + namespace)
+}
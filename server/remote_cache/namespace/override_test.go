@@ -0,0 +1,180 @@
+package namespace_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_kvstore"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/namespace"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/bazel_request"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+func TestParseAllowedNamespaces(t *testing.T) {
+	namespaces, err := namespace.ParseAllowedNamespaces(" experimental, asan,, v2.1_test ")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"experimental", "asan", "v2.1_test"}, namespaces)
+
+	namespaces, err = namespace.ParseAllowedNamespaces("")
+	require.NoError(t, err)
+	assert.Empty(t, namespaces)
+
+	for _, invalid := range []string{"has space", "../escape", "-leading-hyphen", "a/b"} {
+		_, err := namespace.ParseAllowedNamespaces(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestCheckOverrideAllowed(t *testing.T) {
+	assert.NoError(t, namespace.CheckOverrideAllowed("experimental,asan", "asan"))
+	assert.Error(t, namespace.CheckOverrideAllowed("experimental,asan", "tsan"))
+	assert.Error(t, namespace.CheckOverrideAllowed("", "experimental"))
+}
+
+func invocationContext(t *testing.T, te *testenv.TestEnv, userID, invocationID string) context.Context {
+	ctx, err := te.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), userID)
+	require.NoError(t, err)
+	rmd, err := proto.Marshal(&repb.RequestMetadata{ToolInvocationId: invocationID})
+	require.NoError(t, err)
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(bazel_request.RequestMetadataKey, string(rmd)))
+	ctx, err = prefix.AttachUserPrefixToContext(ctx, te)
+	require.NoError(t, err)
+	return ctx
+}
+
+// countingKeyValStore counts the lookups of the values that it stores, and
+// fails them if err is set.
+type countingKeyValStore struct {
+	interfaces.KeyValStore
+	gets int
+	err  error
+}
+
+func (s *countingKeyValStore) GetValue(ctx context.Context, key string) (string, error) {
+	s.gets++
+	if s.err != nil {
+		return "", s.err
+	}
+	return s.KeyValStore.GetValue(ctx, key)
+}
+
+func getEnv(t *testing.T) (*testenv.TestEnv, *countingKeyValStore) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1", "US2", "GR2")))
+	kvs, err := memory_kvstore.NewMemoryKeyValStore()
+	require.NoError(t, err)
+	counting := &countingKeyValStore{KeyValStore: kvs}
+	te.SetKeyValStore(counting)
+	return te, counting
+}
+
+func TestInvocationCache(t *testing.T) {
+	te, _ := getEnv(t)
+	r, err := namespace.NewOverrideResolver(te)
+	require.NoError(t, err)
+
+	ctx := invocationContext(t, te, "US1", "iid-1")
+	err = namespace.SetInvocationOverride(ctx, te, "GR1", "iid-1", "experimental")
+	require.NoError(t, err)
+
+	ns, err := r.InvocationOverride(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "experimental", ns)
+
+	invocationCASCache := func(ctx context.Context) interfaces.Cache {
+		cache, err := r.InvocationCache(ctx, te.GetCache())
+		require.NoError(t, err)
+		return namespace.CASCache(cache, "")
+	}
+
+	d, buf := testdigest.NewRandomDigestBuf(t, 100)
+	err = invocationCASCache(ctx).Set(ctx, d, buf)
+	require.NoError(t, err)
+
+	// The invocation reads its own writes.
+	contains, err := invocationCASCache(ctx).Contains(ctx, d)
+	require.NoError(t, err)
+	assert.True(t, contains)
+
+	// Other invocations of the group use the main cache, which doesn't
+	// contain the blob.
+	otherCtx := invocationContext(t, te, "US1", "iid-2")
+	contains, err = invocationCASCache(otherCtx).Contains(otherCtx, d)
+	require.NoError(t, err)
+	assert.False(t, contains)
+
+	// Other groups can't use the invocation's namespace by reusing its ID.
+	otherGroupCtx := invocationContext(t, te, "US2", "iid-1")
+	ns, err = r.InvocationOverride(otherGroupCtx)
+	require.NoError(t, err)
+	assert.Equal(t, "", ns)
+}
+
+func TestInvocationOverrideIsLookedUpOnce(t *testing.T) {
+	te, kvs := getEnv(t)
+	r, err := namespace.NewOverrideResolver(te)
+	require.NoError(t, err)
+
+	ctx := invocationContext(t, te, "US1", "iid-1")
+	err = namespace.SetInvocationOverride(ctx, te, "GR1", "iid-1", "experimental")
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		ns, err := r.InvocationOverride(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "experimental", ns)
+	}
+	assert.Equal(t, 1, kvs.gets)
+}
+
+func TestInvocationOverrideIsUsedAsSoonAsItIsSet(t *testing.T) {
+	te, _ := getEnv(t)
+	r, err := namespace.NewOverrideResolver(te)
+	require.NoError(t, err)
+
+	// Requests made before the build metadata is received use the main
+	// cache.
+	ctx := invocationContext(t, te, "US1", "iid-1")
+	ns, err := r.InvocationOverride(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "", ns)
+
+	// Requests made right after it is received use the namespace, even on
+	// servers which looked up the invocation before.
+	err = namespace.SetInvocationOverride(ctx, te, "GR1", "iid-1", "experimental")
+	require.NoError(t, err)
+	ns, err = r.InvocationOverride(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "experimental", ns)
+}
+
+func TestInvocationCacheFailsIfOverrideCantBeLookedUp(t *testing.T) {
+	te, kvs := getEnv(t)
+	r, err := namespace.NewOverrideResolver(te)
+	require.NoError(t, err)
+	kvs.err = status.UnavailableError("redis is down")
+
+	// The request must fail rather than fall back to the main cache, which
+	// the invocation may have asked not to use.
+	ctx := invocationContext(t, te, "US1", "iid-1")
+	_, err = r.InvocationCache(ctx, te.GetCache())
+	assert.True(t, status.IsUnavailableError(err), "expected Unavailable, got %v", err)
+
+	// Anonymous requests can't select a namespace, so they don't look one up.
+	anonCtx, err := prefix.AttachUserPrefixToContext(context.Background(), te)
+	require.NoError(t, err)
+	cache, err := r.InvocationCache(anonCtx, te.GetCache())
+	require.NoError(t, err)
+	assert.Equal(t, te.GetCache(), cache)
+}
@@ -0,0 +1,290 @@
+// Package retention keeps copies of blobs that are valuable for debugging but
+// small, such as the stdout and stderr of actions and the timing profiles of
+// invocations, in stores separate from the cache. Ordinary outputs then can't
+// evict them, and they remain readable through the cache after it has evicted
+// its own copies.
+package retention
+
+import (
+	"context"
+	"io"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/disk_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+// Kind is a kind of blob that may be retained.
+type Kind string
+
+const (
+	Stdout        Kind = "stdout"
+	Stderr        Kind = "stderr"
+	TimingProfile Kind = "timing_profile"
+	// Promoted blobs are release artifacts that were promoted to long-term
+	// storage through the API.
+	Promoted Kind = "promoted"
+	// Artifact indexes are the file sets of invocations that are stored by
+	// reference in the cache rather than in the invocations.
+	ArtifactIndex Kind = "artifact_index"
+)
+
+var kinds = map[Kind]struct{}{Stdout: {}, Stderr: {}, TimingProfile: {}, Promoted: {}, ArtifactIndex: {}}
+
+// Store keeps the blobs of each retention class in its own cache.
+type Store struct {
+	// The store of each kind of retained blob.
+	stores map[Kind]interfaces.Cache
+	// Every store, in the order the classes are configured.
+	all []interfaces.Cache
+}
+
+// NewStore returns a Store for the given retention classes. Classes with a
+// root directory keep their blobs on disk; the others keep them in memory.
+func NewStore(classes []config.RetentionClassConfig) (*Store, error) {
+	s := &Store{stores: make(map[Kind]interfaces.Cache)}
+	names := make(map[string]struct{}, len(classes))
+	for _, class := range classes {
+		if class.Name == "" {
+			return nil, status.InvalidArgumentError("Retention classes must have a name")
+		}
+		if _, ok := names[class.Name]; ok {
+			return nil, status.InvalidArgumentErrorf("Retention class %q is configured more than once", class.Name)
+		}
+		names[class.Name] = struct{}{}
+		if class.MaxSizeBytes <= 0 {
+			return nil, status.InvalidArgumentErrorf("Retention class %q must have a max_size_bytes greater than 0", class.Name)
+		}
+		if len(class.Kinds) == 0 {
+			return nil, status.InvalidArgumentErrorf("Retention class %q must retain at least one kind of blob", class.Name)
+		}
+		for _, k := range class.Kinds {
+			if _, ok := kinds[Kind(k)]; !ok {
+				return nil, status.InvalidArgumentErrorf("Retention class %q has unknown kind %q", class.Name, k)
+			}
+			if _, ok := s.stores[Kind(k)]; ok {
+				return nil, status.InvalidArgumentErrorf("Kind %q is retained by more than one retention class", k)
+			}
+		}
+
+		var c interfaces.Cache
+		var err error
+		if class.RootDirectory != "" {
+			c, err = disk_cache.NewDiskCache(class.RootDirectory, class.MaxSizeBytes)
+		} else {
+			c, err = memory_cache.NewMemoryCache(class.MaxSizeBytes)
+		}
+		if err != nil {
+			return nil, status.InternalErrorf("Error configuring retention class %q: %s", class.Name, err)
+		}
+		for _, k := range class.Kinds {
+			s.stores[Kind(k)] = c
+		}
+		s.all = append(s.all, c)
+	}
+	return s, nil
+}
+
+// Cache returns a cache which reads blobs from c, falling back to the retained
+// copies of blobs that c has evicted. Blobs are copied from it into their
+// retention class with Retain.
+func (s *Store) Cache(c interfaces.Cache) interfaces.Cache {
+	return &retainingCache{
+		cache:  c,
+		stores: s.stores,
+		all:    s.all,
+	}
+}
+
+// Retain copies a blob of the given kind from c into its retention class, if
+// c is a cache returned by a Store and the kind is retained. Blobs that are
+// already retained are left as is.
+func Retain(ctx context.Context, c interfaces.Cache, kind Kind, d *repb.Digest) error {
+	rc, ok := c.(*retainingCache)
+	if !ok {
+		return nil
+	}
+	return rc.retain(ctx, kind, d)
+}
+
+// IsRetained returns whether blobs of the given kind are retained by c, a
+// cache returned by a Store.
+func IsRetained(c interfaces.Cache, kind Kind) bool {
+	rc, ok := c.(*retainingCache)
+	if !ok {
+		return false
+	}
+	_, ok = rc.stores[kind]
+	return ok
+}
+
+type retainingCache struct {
+	cache  interfaces.Cache
+	stores map[Kind]interfaces.Cache
+	all    []interfaces.Cache
+}
+
+func (c *retainingCache) WithPrefix(prefix string) interfaces.Cache {
+	stores := make(map[Kind]interfaces.Cache, len(c.stores))
+	all := make([]interfaces.Cache, 0, len(c.all))
+	prefixed := make(map[interfaces.Cache]interfaces.Cache, len(c.all))
+	for _, store := range c.all {
+		prefixed[store] = store.WithPrefix(prefix)
+		all = append(all, prefixed[store])
+	}
+	for k, store := range c.stores {
+		stores[k] = prefixed[store]
+	}
+	return &retainingCache{
+		cache:  c.cache.WithPrefix(prefix),
+		stores: stores,
+		all:    all,
+	}
+}
+
+func (c *retainingCache) retain(ctx context.Context, kind Kind, d *repb.Digest) error {
+	store, ok := c.stores[kind]
+	if !ok || d.GetSizeBytes() == 0 {
+		return nil
+	}
+	if exists, err := store.Contains(ctx, d); err != nil || exists {
+		return err
+	}
+	r, err := c.cache.Reader(ctx, d, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := store.Writer(ctx, d)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (c *retainingCache) Contains(ctx context.Context, d *repb.Digest) (bool, error) {
+	exists, err := c.cache.Contains(ctx, d)
+	if err != nil || exists {
+		return exists, err
+	}
+	for _, store := range c.all {
+		if exists, err := store.Contains(ctx, d); err == nil && exists {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *retainingCache) ContainsMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest]bool, error) {
+	foundMap, err := c.cache.ContainsMulti(ctx, digests)
+	if err != nil {
+		return nil, err
+	}
+	for _, store := range c.all {
+		stillMissing := make([]*repb.Digest, 0)
+		for _, d := range digests {
+			if !foundMap[d] {
+				stillMissing = append(stillMissing, d)
+			}
+		}
+		if len(stillMissing) == 0 {
+			break
+		}
+		storeFoundMap, err := store.ContainsMulti(ctx, stillMissing)
+		if err != nil {
+			continue
+		}
+		for d, found := range storeFoundMap {
+			if found {
+				foundMap[d] = true
+			}
+		}
+	}
+	return foundMap, nil
+}
+
+func (c *retainingCache) Get(ctx context.Context, d *repb.Digest) ([]byte, error) {
+	data, err := c.cache.Get(ctx, d)
+	if !status.IsNotFoundError(err) {
+		return data, err
+	}
+	for _, store := range c.all {
+		if data, err := store.Get(ctx, d); err == nil {
+			return data, nil
+		}
+	}
+	return nil, err
+}
+
+func (c *retainingCache) GetMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest][]byte, error) {
+	foundMap, err := c.cache.GetMulti(ctx, digests)
+	if err != nil {
+		return nil, err
+	}
+	for _, store := range c.all {
+		stillMissing := make([]*repb.Digest, 0)
+		for _, d := range digests {
+			if _, ok := foundMap[d]; !ok {
+				stillMissing = append(stillMissing, d)
+			}
+		}
+		if len(stillMissing) == 0 {
+			break
+		}
+		storeFoundMap, err := store.GetMulti(ctx, stillMissing)
+		if err != nil {
+			continue
+		}
+		for d, data := range storeFoundMap {
+			foundMap[d] = data
+		}
+	}
+	return foundMap, nil
+}
+
+func (c *retainingCache) Set(ctx context.Context, d *repb.Digest, data []byte) error {
+	return c.cache.Set(ctx, d, data)
+}
+
+func (c *retainingCache) SetMulti(ctx context.Context, kvs map[*repb.Digest][]byte) error {
+	return c.cache.SetMulti(ctx, kvs)
+}
+
+// Delete deletes the blob from the cache and any retention class that has a
+// copy of it.
+func (c *retainingCache) Delete(ctx context.Context, d *repb.Digest) error {
+	if err := c.cache.Delete(ctx, d); err != nil {
+		return err
+	}
+	for _, store := range c.all {
+		if err := store.Delete(ctx, d); err != nil && !status.IsNotFoundError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *retainingCache) Reader(ctx context.Context, d *repb.Digest, offset int64) (io.ReadCloser, error) {
+	r, err := c.cache.Reader(ctx, d, offset)
+	if !status.IsNotFoundError(err) {
+		return r, err
+	}
+	for _, store := range c.all {
+		if r, err := store.Reader(ctx, d, offset); err == nil {
+			return r, nil
+		}
+	}
+	return nil, err
+}
+
+func (c *retainingCache) Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser, error) {
+	return c.cache.Writer(ctx, d)
+}
@@ -0,0 +1,133 @@
+package retention_test
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/retention"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+func getAnonContext(t *testing.T) context.Context {
+	flags.Set(t, "auth.enable_anonymous_usage", "true")
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers()))
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te)
+	require.NoError(t, err)
+	return ctx
+}
+
+func newStore(t *testing.T) *retention.Store {
+	s, err := retention.NewStore([]config.RetentionClassConfig{
+		{Name: "logs", Kinds: []string{"stdout", "stderr"}, MaxSizeBytes: 1_000_000},
+	})
+	require.NoError(t, err)
+	return s
+}
+
+func TestRetainedBlobsOutliveEviction(t *testing.T) {
+	ctx := getAnonContext(t)
+	mc, err := memory_cache.NewMemoryCache(1_000_000)
+	require.NoError(t, err)
+	base := mc.WithPrefix("instance")
+	c := newStore(t).Cache(mc).WithPrefix("instance")
+
+	stdout, stdoutData := testdigest.NewRandomDigestBuf(t, 100)
+	profile, profileData := testdigest.NewRandomDigestBuf(t, 100)
+	output, outputData := testdigest.NewRandomDigestBuf(t, 100)
+	for d, data := range map[*repb.Digest][]byte{stdout: stdoutData, profile: profileData, output: outputData} {
+		require.NoError(t, c.Set(ctx, d, data))
+	}
+	require.NoError(t, retention.Retain(ctx, c, retention.Stdout, stdout))
+	// Timing profiles aren't retained by any class.
+	require.NoError(t, retention.Retain(ctx, c, retention.TimingProfile, profile))
+
+	// Simulate the cache evicting everything.
+	for _, d := range []*repb.Digest{stdout, profile, output} {
+		require.NoError(t, base.Delete(ctx, d))
+	}
+
+	data, err := c.Get(ctx, stdout)
+	require.NoError(t, err)
+	assert.Equal(t, stdoutData, data)
+	r, err := c.Reader(ctx, stdout, 10)
+	require.NoError(t, err)
+	data, err = io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, stdoutData[10:], data)
+	exists, err := c.Contains(ctx, stdout)
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	found, err := c.ContainsMulti(ctx, []*repb.Digest{stdout, profile, output})
+	require.NoError(t, err)
+	assert.Equal(t, map[*repb.Digest]bool{stdout: true, profile: false, output: false}, found)
+	blobs, err := c.GetMulti(ctx, []*repb.Digest{stdout, profile, output})
+	require.NoError(t, err)
+	assert.Equal(t, map[*repb.Digest][]byte{stdout: stdoutData}, blobs)
+	_, err = c.Get(ctx, output)
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+
+	// Retained blobs are kept under the same prefix as the cache's copy.
+	_, err = c.WithPrefix("other").Get(ctx, stdout)
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+
+	// Deleting the blob through the cache deletes the retained copy too.
+	require.NoError(t, c.Delete(ctx, stdout))
+	_, err = c.Get(ctx, stdout)
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+}
+
+func TestRetainIgnoresOtherCaches(t *testing.T) {
+	ctx := getAnonContext(t)
+	mc, err := memory_cache.NewMemoryCache(1_000_000)
+	require.NoError(t, err)
+	d, _ := testdigest.NewRandomDigestBuf(t, 100)
+	assert.NoError(t, retention.Retain(ctx, mc, retention.Stdout, d))
+
+	c := newStore(t).Cache(mc)
+	err = retention.Retain(ctx, c, retention.Stdout, d)
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+}
+
+func TestNewStoreRejectsInvalidClasses(t *testing.T) {
+	for name, classes := range map[string][]config.RetentionClassConfig{
+		"no name":      {{Kinds: []string{"stdout"}, MaxSizeBytes: 1000}},
+		"no size":      {{Name: "logs", Kinds: []string{"stdout"}}},
+		"no kinds":     {{Name: "logs", MaxSizeBytes: 1000}},
+		"unknown kind": {{Name: "logs", Kinds: []string{"binaries"}, MaxSizeBytes: 1000}},
+		"duplicate name": {
+			{Name: "logs", Kinds: []string{"stdout"}, MaxSizeBytes: 1000},
+			{Name: "logs", Kinds: []string{"stderr"}, MaxSizeBytes: 1000},
+		},
+		"kind in two classes": {
+			{Name: "logs", Kinds: []string{"stdout"}, MaxSizeBytes: 1000},
+			{Name: "more-logs", Kinds: []string{"stdout"}, MaxSizeBytes: 1000},
+		},
+	} {
+		_, err := retention.NewStore(classes)
+		assert.True(t, status.IsInvalidArgumentError(err), "%s: expected InvalidArgument, got %v", name, err)
+	}
+}
+
+func TestIsRetained(t *testing.T) {
+	mc, err := memory_cache.NewMemoryCache(1_000_000)
+	require.NoError(t, err)
+	c := newStore(t).Cache(mc).WithPrefix("instance")
+	assert.True(t, retention.IsRetained(c, retention.Stdout))
+	assert.False(t, retention.IsRetained(c, retention.Promoted))
+	assert.False(t, retention.IsRetained(mc, retention.Stdout))
+}
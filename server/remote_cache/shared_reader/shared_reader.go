@@ -0,0 +1,277 @@
+// Package shared_reader serves concurrent readers of the same blob from a
+// single read of the backing cache.
+//
+// When many clients fetch the same large blob at once, such as executors
+// fetching a toolchain needed by every action of a build, each reader would
+// otherwise open its own stream from the backing cache. Instead, the first
+// reader's stream is copied into a temporary spill file, and every reader,
+// including ones that join while the stream is in progress, reads from that
+// file at its own pace.
+package shared_reader
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+)
+
+const (
+	// The size of the buffer used to copy from the backing cache into the
+	// spill file.
+	copyBufSize = 1024 * 1024
+)
+
+// OpenFunc opens a reader for the whole blob from the backing cache.
+type OpenFunc func(ctx context.Context) (io.ReadCloser, error)
+
+// Group tracks the reads in progress, keyed by blob.
+type Group struct {
+	mu    sync.Mutex // protects(reads)
+	reads map[string]*sharedRead
+}
+
+func NewGroup() *Group {
+	return &Group{reads: make(map[string]*sharedRead)}
+}
+
+// sharedRead is a single read from the backing cache, buffered in a spill
+// file for all of its readers.
+type sharedRead struct {
+	g      *Group
+	key    string
+	file   *os.File
+	cancel context.CancelFunc
+
+	mu      sync.Mutex // protects(all fields below)
+	cond    *sync.Cond
+	opened  bool
+	written int64
+	done    bool
+	err     error
+	refs    int
+}
+
+// Reader returns a reader for the blob with the given key, starting at the
+// given offset. If the blob is already being read, the reader shares that
+// read. Otherwise, open is called to start a new read.
+//
+// Keys must identify the blob as well as everything that determines where
+// it is read from, such as the user prefix and instance name, since readers
+// with the same key are served the same data.
+func (g *Group) Reader(ctx context.Context, key string, offset int64, open OpenFunc) (io.ReadCloser, error) {
+	g.mu.Lock()
+	r := g.reads[key]
+	if r == nil || !r.acquire() {
+		var err error
+		r, err = g.startRead(ctx, key, open)
+		if err != nil {
+			g.mu.Unlock()
+			return nil, err
+		}
+		g.reads[key] = r
+	}
+	g.mu.Unlock()
+
+	// Wait for the backing cache to be opened, so that errors such as a
+	// missing blob are returned here rather than from the first Read.
+	r.mu.Lock()
+	for !r.opened {
+		r.cond.Wait()
+	}
+	err := r.err
+	r.mu.Unlock()
+	if err != nil {
+		r.release()
+		return nil, err
+	}
+
+	rd := &reader{ctx: ctx, r: r, offset: offset, closed: make(chan struct{})}
+	// Wake the reader if its context is canceled while it waits for data.
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.mu.Lock()
+			r.cond.Broadcast()
+			r.mu.Unlock()
+		case <-rd.closed:
+		}
+	}()
+	return rd, nil
+}
+
+// startRead starts a new read from the backing cache. The group must be
+// locked.
+func (g *Group) startRead(ctx context.Context, key string, open OpenFunc) (*sharedRead, error) {
+	file, err := ioutil.TempFile("", "shared-read-*")
+	if err != nil {
+		return nil, err
+	}
+	// Unlink the spill file right away; it stays readable while open and is
+	// cleaned up automatically once closed.
+	if err := os.Remove(file.Name()); err != nil {
+		log.Warningf("Could not remove spill file %q: %s", file.Name(), err)
+	}
+	// The read outlives the request that started it, so it must only be
+	// canceled when all of its readers are gone.
+	readCtx, cancel := context.WithCancel(detachedContext{ctx})
+	r := &sharedRead{
+		g:      g,
+		key:    key,
+		file:   file,
+		cancel: cancel,
+		refs:   1,
+	}
+	r.cond = sync.NewCond(&r.mu)
+	go r.copy(readCtx, open)
+	return r, nil
+}
+
+// copy copies the blob from the backing cache into the spill file.
+func (r *sharedRead) copy(ctx context.Context, open OpenFunc) {
+	rc, err := open(ctx)
+	r.mu.Lock()
+	r.opened = true
+	r.cond.Broadcast()
+	r.mu.Unlock()
+	if err != nil {
+		r.finish(err)
+		return
+	}
+	defer rc.Close()
+
+	buf := make([]byte, copyBufSize)
+	var off int64
+	for {
+		n, readErr := rc.Read(buf)
+		if n > 0 {
+			if _, err := r.file.WriteAt(buf[:n], off); err != nil {
+				r.finish(err)
+				return
+			}
+			off += int64(n)
+			r.mu.Lock()
+			r.written = off
+			r.cond.Broadcast()
+			r.mu.Unlock()
+		}
+		if readErr == io.EOF {
+			r.finish(nil)
+			return
+		}
+		if readErr != nil {
+			r.finish(readErr)
+			return
+		}
+	}
+}
+
+func (r *sharedRead) finish(err error) {
+	r.mu.Lock()
+	r.done = true
+	r.err = err
+	r.cond.Broadcast()
+	closeFile := r.refs == 0
+	r.mu.Unlock()
+	if closeFile {
+		r.file.Close()
+	}
+	// Later readers start a new read rather than joining a finished one, so
+	// that failed reads are retried.
+	r.g.remove(r)
+}
+
+// acquire adds a reader to the read, unless all of its readers are already
+// gone.
+func (r *sharedRead) acquire() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.refs == 0 {
+		return false
+	}
+	r.refs++
+	return true
+}
+
+// release removes a reader from the read, canceling it if no readers are
+// left.
+func (r *sharedRead) release() {
+	r.mu.Lock()
+	r.refs--
+	last := r.refs == 0
+	closeFile := last && r.done
+	r.mu.Unlock()
+	if !last {
+		return
+	}
+	r.cancel()
+	if closeFile {
+		r.file.Close()
+	}
+	r.g.remove(r)
+}
+
+func (g *Group) remove(r *sharedRead) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.reads[r.key] == r {
+		delete(g.reads, r.key)
+	}
+}
+
+type reader struct {
+	ctx       context.Context
+	r         *sharedRead
+	offset    int64
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (rd *reader) Read(p []byte) (int, error) {
+	r := rd.r
+	r.mu.Lock()
+	for rd.offset >= r.written && !r.done && rd.ctx.Err() == nil {
+		r.cond.Wait()
+	}
+	if rd.offset < r.written {
+		n := r.written - rd.offset
+		r.mu.Unlock()
+		if int64(len(p)) < n {
+			n = int64(len(p))
+		}
+		read, err := r.file.ReadAt(p[:n], rd.offset)
+		rd.offset += int64(read)
+		return read, err
+	}
+	defer r.mu.Unlock()
+	if err := rd.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	return 0, io.EOF
+}
+
+func (rd *reader) Close() error {
+	rd.closeOnce.Do(func() {
+		close(rd.closed)
+		rd.r.release()
+	})
+	return nil
+}
+
+// detachedContext carries the values of its parent context, such as the
+// authenticated user, but not its deadline or cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
@@ -0,0 +1,144 @@
+package shared_reader_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/shared_reader"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingBackend serves a blob through a pipe, so that tests control how
+// far the backend read has progressed.
+type blockingBackend struct {
+	opens int32
+	pr    *io.PipeReader
+	pw    *io.PipeWriter
+}
+
+func newBlockingBackend() *blockingBackend {
+	pr, pw := io.Pipe()
+	return &blockingBackend{pr: pr, pw: pw}
+}
+
+func (b *blockingBackend) open(ctx context.Context) (io.ReadCloser, error) {
+	atomic.AddInt32(&b.opens, 1)
+	go func() {
+		<-ctx.Done()
+		b.pr.CloseWithError(ctx.Err())
+	}()
+	return b.pr, nil
+}
+
+func TestConcurrentReadersShareBackendRead(t *testing.T) {
+	ctx := context.Background()
+	g := shared_reader.NewGroup()
+	backend := newBlockingBackend()
+	blob := bytes.Repeat([]byte("0123456789"), 100_000)
+
+	// Start the first readers before any data is available.
+	var readers []io.ReadCloser
+	for i := 0; i < 5; i++ {
+		r, err := g.Reader(ctx, "key", 0, backend.open)
+		require.NoError(t, err)
+		readers = append(readers, r)
+	}
+	_, err := backend.pw.Write(blob[:len(blob)/2])
+	require.NoError(t, err)
+
+	// Readers that join mid-stream, including at an offset, still get all
+	// of the data they ask for.
+	r, err := g.Reader(ctx, "key", 0, backend.open)
+	require.NoError(t, err)
+	readers = append(readers, r)
+	offsetReader, err := g.Reader(ctx, "key", 10, backend.open)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	results := make([][]byte, len(readers)+1)
+	for i, r := range append(readers, offsetReader) {
+		i, r := i, r
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer r.Close()
+			b, err := ioutil.ReadAll(r)
+			assert.NoError(t, err)
+			results[i] = b
+		}()
+	}
+	_, err = backend.pw.Write(blob[len(blob)/2:])
+	require.NoError(t, err)
+	require.NoError(t, backend.pw.Close())
+	wg.Wait()
+
+	for i := 0; i < len(readers); i++ {
+		assert.Equal(t, blob, results[i], "reader %d", i)
+	}
+	assert.Equal(t, blob[10:], results[len(readers)])
+	assert.Equal(t, int32(1), atomic.LoadInt32(&backend.opens))
+
+	// Once the read has finished, new readers start a new one.
+	other := newBlockingBackend()
+	r, err = g.Reader(ctx, "key", 0, other.open)
+	require.NoError(t, err)
+	defer r.Close()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&other.opens))
+}
+
+func TestOpenError(t *testing.T) {
+	g := shared_reader.NewGroup()
+	_, err := g.Reader(context.Background(), "key", 0, func(ctx context.Context) (io.ReadCloser, error) {
+		return nil, status.NotFoundError("not found")
+	})
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+}
+
+func TestBackendReadCanceledWhenAllReadersClose(t *testing.T) {
+	g := shared_reader.NewGroup()
+	backend := newBlockingBackend()
+	r1, err := g.Reader(context.Background(), "key", 0, backend.open)
+	require.NoError(t, err)
+	r2, err := g.Reader(context.Background(), "key", 0, backend.open)
+	require.NoError(t, err)
+
+	r1.Close()
+	// The backend read continues for the remaining reader.
+	_, err = backend.pw.Write([]byte("data"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(r2, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(buf))
+
+	r2.Close()
+	// Writes fail once the backend read is canceled.
+	assert.Eventually(t, func() bool {
+		_, err := backend.pw.Write([]byte("more"))
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReaderContextCanceled(t *testing.T) {
+	g := shared_reader.NewGroup()
+	backend := newBlockingBackend()
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := g.Reader(ctx, "key", 0, backend.open)
+	require.NoError(t, err)
+	defer r.Close()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, err = r.Read(make([]byte, 10))
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,518 @@
+// Package remote_grpc_log analyzes the logs written by bazel's
+// --remote_grpc_log flag against the server's own records of an invocation,
+// to diagnose where the time spent on, and the failures of, remote calls
+// occurred: in the client, the network or the server.
+package remote_grpc_log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/hit_tracker"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/codes"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	rlpb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution_log"
+	rgpb "github.com/buildbuddy-io/buildbuddy/proto/remote_grpc_log"
+)
+
+const (
+	// The maximum size of a log, after it's decompressed.
+	maxLogSizeBytes = 1_000_000_000 // 1GB
+
+	// Execution time that isn't accounted for by the server, or transfer
+	// time that isn't accounted for by the cache, is reported once it's at
+	// least this share of the time seen by the client...
+	unaccountedThreshold = 0.25
+	// ...and at least this long.
+	minUnaccountedUsec = 1_000_000
+
+	// Queueing is reported once executions spent at least this share of
+	// their time waiting for an executor.
+	queuedThreshold = 0.5
+)
+
+// ParseLog parses the length-delimited log entries of a log written by
+// --remote_grpc_log, which may be gzipped.
+func ParseLog(data []byte) ([]*rlpb.LogEntry, error) {
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid gzipped log: %s", err)
+		}
+		defer zr.Close()
+		r := &limitedReader{r: zr, n: maxLogSizeBytes}
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid gzipped log: %s", err)
+		}
+	}
+	entries := make([]*rlpb.LogEntry, 0)
+	for len(data) > 0 {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || size > uint64(len(data)-n) {
+			return nil, status.InvalidArgumentErrorf("invalid log: truncated entry %d", len(entries))
+		}
+		entry := &rlpb.LogEntry{}
+		if err := proto.Unmarshal(data[n:n+int(size)], entry); err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid log: entry %d: %s", len(entries), err)
+		}
+		entries = append(entries, entry)
+		data = data[n+int(size):]
+	}
+	return entries, nil
+}
+
+// limitedReader is an io.Reader which fails once more than n bytes are read
+// from r.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, status.ResourceExhaustedErrorf("log is larger than %d bytes", maxLogSizeBytes)
+	}
+	return n, err
+}
+
+// ServerRecords are the server's records of the invocation that a log was
+// recorded for.
+type ServerRecords struct {
+	// The executions of the invocation.
+	Executions []*tables.Execution
+
+	// The total time that the cache spent serving the invocation's downloads
+	// and uploads.
+	TransferUsec int64
+}
+
+func durationUsec(e *rlpb.LogEntry) int64 {
+	start, end := e.GetStartTime(), e.GetEndTime()
+	if start == nil || end == nil {
+		return 0
+	}
+	usec := (end.GetSeconds()-start.GetSeconds())*1_000_000 + int64(end.GetNanos()-start.GetNanos())/1_000
+	if usec < 0 {
+		return 0
+	}
+	return usec
+}
+
+func startUsec(e *rlpb.LogEntry) int64 {
+	return e.GetStartTime().GetSeconds()*1_000_000 + int64(e.GetStartTime().GetNanos())/1_000
+}
+
+func endUsec(e *rlpb.LogEntry) int64 {
+	return e.GetEndTime().GetSeconds()*1_000_000 + int64(e.GetEndTime().GetNanos())/1_000
+}
+
+// shortMethodName returns the service and method of a full method name,
+// without the package.
+// ex: "build.bazel.remote.execution.v2.Execution/Execute" -> "Execution/Execute"
+func shortMethodName(methodName string) string {
+	methodName = strings.TrimPrefix(methodName, "/")
+	service := methodName
+	if i := strings.LastIndex(service, "/"); i >= 0 {
+		service = service[:i]
+	}
+	if i := strings.LastIndex(service, "."); i >= 0 {
+		return methodName[i+1:]
+	}
+	return methodName
+}
+
+func isExecution(method string) bool {
+	return method == "Execution/Execute" || method == "Execution/WaitExecution"
+}
+
+func isTransfer(method string) bool {
+	switch method {
+	case "ByteStream/Read", "ByteStream/Write", "ContentAddressableStorage/BatchReadBlobs", "ContentAddressableStorage/BatchUpdateBlobs":
+		return true
+	}
+	return false
+}
+
+// isError returns whether the call failed. Action cache misses are logged as
+// NOT_FOUND, but aren't errors.
+func isError(method string, code codes.Code) bool {
+	if code == codes.OK {
+		return false
+	}
+	return !(method == "ActionCache/GetActionResult" && code == codes.NotFound)
+}
+
+func percentile(sorted []int64, p int) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// errorLocation returns where calls that failed with the given code most
+// likely failed. Executions that failed with UNAVAILABLE or DEADLINE_EXCEEDED
+// are attributed to the server if it has a record of them, since the request
+// must have reached it.
+func errorLocation(code codes.Code, reachedServer bool) rgpb.Location {
+	switch code {
+	case codes.Canceled, codes.Unauthenticated, codes.PermissionDenied, codes.InvalidArgument, codes.OutOfRange:
+		return rgpb.Location_CLIENT
+	case codes.Unavailable, codes.DeadlineExceeded:
+		if reachedServer {
+			return rgpb.Location_SERVER
+		}
+		return rgpb.Location_NETWORK
+	default:
+		return rgpb.Location_SERVER
+	}
+}
+
+func errorDescription(count int64, method string, code codes.Code, location rgpb.Location) string {
+	calls := "calls"
+	if count == 1 {
+		calls = "call"
+	}
+	d := fmt.Sprintf("%d %s %s failed with %s", count, method, calls, codeName(code))
+	switch {
+	case code == codes.Canceled:
+		return d + ": bazel cancelled them, such as when the build was interrupted or failed"
+	case location == rgpb.Location_CLIENT:
+		return d + ": check bazel's remote flags and credentials"
+	case location == rgpb.Location_NETWORK:
+		return d + " without reaching the server: check proxies, load balancers and connectivity between bazel and the server"
+	default:
+		return d + " in the server"
+	}
+}
+
+// codeName returns the name of a gRPC status code as it's defined in
+// google.rpc.Code, which is how bazel reports it.
+// ex: codes.DeadlineExceeded -> "DEADLINE_EXCEEDED"
+func codeName(code codes.Code) string {
+	if code == codes.Canceled {
+		return "CANCELLED"
+	}
+	var b strings.Builder
+	for i, r := range code.String() {
+		if i > 0 && r >= 'A' && r <= 'Z' {
+			b.WriteByte('_')
+		}
+		b.WriteRune(r)
+	}
+	return strings.ToUpper(b.String())
+}
+
+type errorKey struct {
+	method string
+	code   codes.Code
+}
+
+// Analyze diagnoses the calls in a log. If the server's records of the
+// invocation are given, the time spent on the calls is divided between the
+// server and the network.
+func Analyze(entries []*rlpb.LogEntry, records *ServerRecords) *rgpb.Diagnosis {
+	diagnosis := &rgpb.Diagnosis{
+		CallCount:          int64(len(entries)),
+		ExecutionBreakdown: &rgpb.ExecutionBreakdown{},
+		TransferBreakdown:  &rgpb.TransferBreakdown{},
+	}
+	if records == nil {
+		records = &ServerRecords{}
+	}
+
+	// The executions recorded by the server, by action digest hash.
+	executions := make(map[string][]*tables.Execution)
+	for _, ex := range records.Executions {
+		_, d, err := digest.ExtractDigestFromUploadResourceName(ex.ExecutionID)
+		if err != nil {
+			continue
+		}
+		executions[d.GetHash()] = append(executions[d.GetHash()], ex)
+	}
+
+	// The span of the execution calls of each action, as seen by the client.
+	type span struct{ start, end int64 }
+	actionSpans := make(map[string]*span)
+	var actionIDs []string
+
+	durations := make(map[string][]int64)
+	stats := make(map[string]*rgpb.MethodStats)
+	errorCounts := make(map[errorKey]int64)
+	reachedServer := make(map[errorKey]bool)
+	var minStart, maxEnd int64
+	for _, e := range entries {
+		method := shortMethodName(e.GetMethodName())
+		s, ok := stats[method]
+		if !ok {
+			s = &rgpb.MethodStats{MethodName: method}
+			stats[method] = s
+		}
+		d := durationUsec(e)
+		s.CallCount++
+		s.TotalDurationUsec += d
+		durations[method] = append(durations[method], d)
+		if e.GetStartTime() != nil && (minStart == 0 || startUsec(e) < minStart) {
+			minStart = startUsec(e)
+		}
+		if e.GetEndTime() != nil && endUsec(e) > maxEnd {
+			maxEnd = endUsec(e)
+		}
+
+		actionID := e.GetMetadata().GetActionId()
+		if code := codes.Code(e.GetStatus().GetCode()); isError(method, code) {
+			s.ErrorCount++
+			k := errorKey{method, code}
+			errorCounts[k]++
+			if isExecution(method) && len(executions[actionID]) > 0 {
+				reachedServer[k] = true
+			}
+		}
+		if isTransfer(method) {
+			diagnosis.TransferBreakdown.ClientDurationUsec += d
+		}
+		if isExecution(method) && actionID != "" && e.GetStartTime() != nil && e.GetEndTime() != nil {
+			sp, ok := actionSpans[actionID]
+			if !ok {
+				sp = &span{start: startUsec(e), end: endUsec(e)}
+				actionSpans[actionID] = sp
+				actionIDs = append(actionIDs, actionID)
+			}
+			if startUsec(e) < sp.start {
+				sp.start = startUsec(e)
+			}
+			if endUsec(e) > sp.end {
+				sp.end = endUsec(e)
+			}
+		}
+	}
+	if maxEnd > minStart {
+		diagnosis.DurationUsec = maxEnd - minStart
+	}
+
+	for method, s := range stats {
+		sorted := durations[method]
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		s.P50DurationUsec = percentile(sorted, 50)
+		s.P95DurationUsec = percentile(sorted, 95)
+		s.MaxDurationUsec = sorted[len(sorted)-1]
+		diagnosis.MethodStats = append(diagnosis.MethodStats, s)
+	}
+	sort.Slice(diagnosis.MethodStats, func(i, j int) bool {
+		a, b := diagnosis.MethodStats[i], diagnosis.MethodStats[j]
+		if a.TotalDurationUsec != b.TotalDurationUsec {
+			return a.TotalDurationUsec > b.TotalDurationUsec
+		}
+		return a.MethodName < b.MethodName
+	})
+
+	eb := diagnosis.ExecutionBreakdown
+	eb.ActionCount = int64(len(actionIDs))
+	for _, actionID := range actionIDs {
+		// Retried actions are executed more than once, so the server's
+		// latest record of the action is used.
+		matches := executions[actionID]
+		if len(matches) == 0 {
+			continue
+		}
+		ex := matches[len(matches)-1]
+		for _, m := range matches {
+			if m.QueuedTimestampUsec > ex.QueuedTimestampUsec {
+				ex = m
+			}
+		}
+		sp := actionSpans[actionID]
+		eb.MatchedActionCount++
+		eb.ClientDurationUsec += sp.end - sp.start
+		serverUsec := int64(0)
+		if ex.QueuedTimestampUsec > 0 && ex.WorkerStartTimestampUsec > ex.QueuedTimestampUsec {
+			eb.ServerQueuedUsec += ex.WorkerStartTimestampUsec - ex.QueuedTimestampUsec
+		}
+		if ex.QueuedTimestampUsec > 0 && ex.WorkerCompletedTimestampUsec > ex.QueuedTimestampUsec {
+			serverUsec = ex.WorkerCompletedTimestampUsec - ex.QueuedTimestampUsec
+		}
+		eb.ServerInputFetchUsec += positive(ex.InputFetchCompletedTimestampUsec - ex.InputFetchStartTimestampUsec)
+		eb.ServerExecutionUsec += positive(ex.ExecutionCompletedTimestampUsec - ex.ExecutionStartTimestampUsec)
+		eb.ServerOutputUploadUsec += positive(ex.OutputUploadCompletedTimestampUsec - ex.OutputUploadStartTimestampUsec)
+		eb.UnaccountedUsec += positive(sp.end - sp.start - serverUsec)
+	}
+	diagnosis.TransferBreakdown.ServerDurationUsec = records.TransferUsec
+
+	diagnosis.Finding = findings(diagnosis, errorCounts, reachedServer, records)
+	return diagnosis
+}
+
+func positive(usec int64) int64 {
+	if usec < 0 {
+		return 0
+	}
+	return usec
+}
+
+// findings returns the errors in the log, most frequent first, followed by
+// the timing problems.
+func findings(diagnosis *rgpb.Diagnosis, errorCounts map[errorKey]int64, reachedServer map[errorKey]bool, records *ServerRecords) []*rgpb.Finding {
+	var errorKeys []errorKey
+	for k := range errorCounts {
+		errorKeys = append(errorKeys, k)
+	}
+	sort.Slice(errorKeys, func(i, j int) bool {
+		a, b := errorKeys[i], errorKeys[j]
+		if errorCounts[a] != errorCounts[b] {
+			return errorCounts[a] > errorCounts[b]
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	var findings []*rgpb.Finding
+	for _, k := range errorKeys {
+		location := errorLocation(k.code, reachedServer[k])
+		findings = append(findings, &rgpb.Finding{
+			Location:    location,
+			MethodName:  k.method,
+			Code:        int32(k.code),
+			CallCount:   errorCounts[k],
+			Description: errorDescription(errorCounts[k], k.method, k.code, location),
+		})
+	}
+
+	eb := diagnosis.ExecutionBreakdown
+	if eb.ClientDurationUsec > 0 {
+		if float64(eb.ServerQueuedUsec) >= queuedThreshold*float64(eb.ClientDurationUsec) {
+			findings = append(findings, &rgpb.Finding{
+				Location:  rgpb.Location_SERVER,
+				CallCount: eb.MatchedActionCount,
+				Description: fmt.Sprintf("Remote executions spent %d%% of their time waiting for an executor: add executors or check for platform requirements that few executors satisfy",
+					eb.ServerQueuedUsec*100/eb.ClientDurationUsec),
+			})
+		}
+		if eb.UnaccountedUsec >= minUnaccountedUsec && float64(eb.UnaccountedUsec) >= unaccountedThreshold*float64(eb.ClientDurationUsec) {
+			findings = append(findings, &rgpb.Finding{
+				Location:  rgpb.Location_NETWORK,
+				CallCount: eb.MatchedActionCount,
+				Description: fmt.Sprintf("%d%% of the time that bazel spent on remote executions isn't accounted for by the server: it was spent between bazel and the server",
+					eb.UnaccountedUsec*100/eb.ClientDurationUsec),
+			})
+		}
+	}
+	if eb.ActionCount > eb.MatchedActionCount && len(records.Executions) > 0 {
+		findings = append(findings, &rgpb.Finding{
+			Location:    rgpb.Location_NETWORK,
+			CallCount:   eb.ActionCount - eb.MatchedActionCount,
+			Description: fmt.Sprintf("The server has no record of %d of the %d actions that bazel tried to execute remotely", eb.ActionCount-eb.MatchedActionCount, eb.ActionCount),
+		})
+	}
+
+	tb := diagnosis.TransferBreakdown
+	if records.TransferUsec > 0 {
+		unaccounted := tb.ClientDurationUsec - tb.ServerDurationUsec
+		if unaccounted >= minUnaccountedUsec && float64(unaccounted) >= unaccountedThreshold*float64(tb.ClientDurationUsec) {
+			findings = append(findings, &rgpb.Finding{
+				Location: rgpb.Location_NETWORK,
+				Description: fmt.Sprintf("%d%% of the time that bazel spent transferring blobs isn't accounted for by the cache: check the bandwidth between bazel and the server",
+					unaccounted*100/tb.ClientDurationUsec),
+			})
+		}
+	}
+	return findings
+}
+
+// mostCommonInvocationID returns the invocation that most of the logged calls
+// were made for.
+func mostCommonInvocationID(entries []*rlpb.LogEntry) string {
+	counts := make(map[string]int)
+	best := ""
+	for _, e := range entries {
+		iid := e.GetMetadata().GetToolInvocationId()
+		if iid == "" {
+			continue
+		}
+		counts[iid]++
+		if counts[iid] > counts[best] || (counts[iid] == counts[best] && iid < best) {
+			best = iid
+		}
+	}
+	return best
+}
+
+func lookupServerRecords(ctx context.Context, env environment.Env, iid string) (*ServerRecords, error) {
+	ti, err := env.GetInvocationDB().LookupInvocation(ctx, iid)
+	if err != nil {
+		return nil, err
+	}
+	records := &ServerRecords{TransferUsec: ti.TotalDownloadUsec + ti.TotalUploadUsec}
+	if ti.InvocationStatus == int64(inpb.Invocation_PARTIAL_INVOCATION_STATUS) {
+		if cacheStats := hit_tracker.CollectCacheStats(ctx, env, iid); cacheStats != nil {
+			records.TransferUsec = cacheStats.GetTotalDownloadUsec() + cacheStats.GetTotalUploadUsec()
+		}
+	}
+
+	q := query_builder.NewQuery(`SELECT * FROM Executions as e`)
+	q.AddWhereClause(`e.invocation_id = ?`, iid)
+	if err := perms.AddPermissionsCheckToQueryWithTableAlias(ctx, env, q, "e"); err != nil {
+		return nil, err
+	}
+	queryStr, args := q.Build()
+	if err := env.GetDBHandle().WithContext(ctx).Raw(queryStr, args...).Scan(&records.Executions).Error; err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// AnalyzeLog parses an uploaded log and diagnoses it against the server's
+// records of the invocation that it was recorded for.
+func AnalyzeLog(ctx context.Context, env environment.Env, req *rgpb.AnalyzeRemoteGrpcLogRequest) (*rgpb.AnalyzeRemoteGrpcLogResponse, error) {
+	if env.GetInvocationDB() == nil || env.GetDBHandle() == nil {
+		return nil, status.FailedPreconditionError("database not configured")
+	}
+	entries, err := ParseLog(req.GetLog())
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, status.InvalidArgumentError("the log is empty")
+	}
+
+	iid := req.GetInvocationId()
+	var records *ServerRecords
+	if iid != "" {
+		if records, err = lookupServerRecords(ctx, env, iid); err != nil {
+			return nil, err
+		}
+	} else if iid = mostCommonInvocationID(entries); iid != "" {
+		// The invocation may not have been recorded by this server, such as
+		// when bazel's build events were sent elsewhere, in which case the
+		// log is analyzed on its own.
+		if records, err = lookupServerRecords(ctx, env, iid); err != nil {
+			log.Infof("Analyzing remote gRPC log without the records of invocation %s: %s", iid, err)
+			iid = ""
+		}
+	}
+
+	diagnosis := Analyze(entries, records)
+	diagnosis.InvocationId = iid
+	return &rgpb.AnalyzeRemoteGrpcLogResponse{Diagnosis: diagnosis}, nil
+}
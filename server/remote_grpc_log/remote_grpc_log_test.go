@@ -0,0 +1,159 @@
+package remote_grpc_log_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/remote_grpc_log"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rlpb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution_log"
+	rgpb "github.com/buildbuddy-io/buildbuddy/proto/remote_grpc_log"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+)
+
+var start = time.Unix(1_600_000_000, 0)
+
+func entry(method, actionID string, code codes.Code, startOffset, duration time.Duration) *rlpb.LogEntry {
+	ts := func(t time.Time) *tspb.Timestamp {
+		return &tspb.Timestamp{Seconds: t.Unix(), Nanos: int32(t.Nanosecond())}
+	}
+	return &rlpb.LogEntry{
+		Metadata: &repb.RequestMetadata{
+			ToolInvocationId: "test-invocation-id",
+			ActionId:         actionID,
+		},
+		Status:     &statuspb.Status{Code: int32(code)},
+		MethodName: method,
+		StartTime:  ts(start.Add(startOffset)),
+		EndTime:    ts(start.Add(startOffset + duration)),
+	}
+}
+
+func writeLog(t *testing.T, entries []*rlpb.LogEntry) []byte {
+	buf := &bytes.Buffer{}
+	for _, e := range entries {
+		b, err := proto.Marshal(e)
+		require.NoError(t, err)
+		size := make([]byte, binary.MaxVarintLen64)
+		buf.Write(size[:binary.PutUvarint(size, uint64(len(b)))])
+		buf.Write(b)
+	}
+	return buf.Bytes()
+}
+
+func TestParseLog(t *testing.T) {
+	entries := []*rlpb.LogEntry{
+		entry("build.bazel.remote.execution.v2.ActionCache/GetActionResult", "a1", codes.NotFound, 0, time.Second),
+		entry("google.bytestream.ByteStream/Write", "a1", codes.OK, time.Second, time.Second),
+	}
+	data := writeLog(t, entries)
+
+	parsed, err := remote_grpc_log.ParseLog(data)
+	require.NoError(t, err)
+	require.Len(t, parsed, 2)
+	assert.True(t, proto.Equal(entries[1], parsed[1]))
+
+	zipped := &bytes.Buffer{}
+	zw := gzip.NewWriter(zipped)
+	_, err = zw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	parsed, err = remote_grpc_log.ParseLog(zipped.Bytes())
+	require.NoError(t, err)
+	assert.Len(t, parsed, 2)
+
+	_, err = remote_grpc_log.ParseLog(data[:len(data)-1])
+	assert.Error(t, err)
+}
+
+func execution(actionHash string, queued, workerStart, workerCompleted time.Duration) *tables.Execution {
+	return &tables.Execution{
+		ExecutionID:                  "uploads/ba6b2d32-1a5c-4bc4-86c6-8f1e2b3c4d5e/blobs/" + actionHash + "/100",
+		QueuedTimestampUsec:          start.Add(queued).UnixNano() / 1000,
+		WorkerStartTimestampUsec:     start.Add(workerStart).UnixNano() / 1000,
+		WorkerCompletedTimestampUsec: start.Add(workerCompleted).UnixNano() / 1000,
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	hash1 := "072d9dd55aacaa829d7d1cc9ec8c4b5180ef49acac4a3c2f3ca16a3db134982d"
+	hash2 := "8bc7b5d4b1cd7f5e9ba8a0d6b7e0b0a2b8c3d9e0f1a2b3c4d5e6f7a8b9c0d1e2"
+	entries := []*rlpb.LogEntry{
+		entry("build.bazel.remote.execution.v2.ActionCache/GetActionResult", hash1, codes.NotFound, 0, time.Second),
+		entry("build.bazel.remote.execution.v2.Execution/Execute", hash1, codes.OK, time.Second, 10*time.Second),
+		entry("build.bazel.remote.execution.v2.Execution/Execute", hash2, codes.Unavailable, time.Second, time.Second),
+		entry("build.bazel.remote.execution.v2.Execution/Execute", hash2, codes.Unavailable, 3*time.Second, time.Second),
+		entry("google.bytestream.ByteStream/Read", hash1, codes.OK, 11*time.Second, 4*time.Second),
+	}
+	records := &remote_grpc_log.ServerRecords{
+		// The server only spent 4s of the 10s that bazel waited on the
+		// execution.
+		Executions:   []*tables.Execution{execution(hash1, 2*time.Second, 3*time.Second, 6*time.Second)},
+		TransferUsec: 3_500_000,
+	}
+
+	d := remote_grpc_log.Analyze(entries, records)
+	assert.Equal(t, int64(5), d.GetCallCount())
+	assert.Equal(t, int64(15_000_000), d.GetDurationUsec())
+
+	require.Len(t, d.GetMethodStats(), 3)
+	execute := d.GetMethodStats()[0]
+	assert.Equal(t, "Execution/Execute", execute.GetMethodName())
+	assert.Equal(t, int64(3), execute.GetCallCount())
+	assert.Equal(t, int64(2), execute.GetErrorCount())
+	assert.Equal(t, int64(10_000_000), execute.GetMaxDurationUsec())
+	assert.Equal(t, int64(1_000_000), execute.GetP50DurationUsec())
+	getActionResult := d.GetMethodStats()[2]
+	assert.Equal(t, "ActionCache/GetActionResult", getActionResult.GetMethodName())
+	assert.Equal(t, int64(0), getActionResult.GetErrorCount(), "cache misses aren't errors")
+
+	eb := d.GetExecutionBreakdown()
+	assert.Equal(t, int64(2), eb.GetActionCount())
+	assert.Equal(t, int64(1), eb.GetMatchedActionCount())
+	assert.Equal(t, int64(10_000_000), eb.GetClientDurationUsec())
+	assert.Equal(t, int64(1_000_000), eb.GetServerQueuedUsec())
+	assert.Equal(t, int64(6_000_000), eb.GetUnaccountedUsec())
+
+	tb := d.GetTransferBreakdown()
+	assert.Equal(t, int64(4_000_000), tb.GetClientDurationUsec())
+	assert.Equal(t, int64(3_500_000), tb.GetServerDurationUsec())
+
+	require.Len(t, d.GetFinding(), 3)
+	assert.Equal(t, rgpb.Location_NETWORK, d.GetFinding()[0].GetLocation())
+	assert.Equal(t, "Execution/Execute", d.GetFinding()[0].GetMethodName())
+	assert.Equal(t, int32(codes.Unavailable), d.GetFinding()[0].GetCode())
+	assert.Equal(t, int64(2), d.GetFinding()[0].GetCallCount())
+	assert.Contains(t, d.GetFinding()[0].GetDescription(), "UNAVAILABLE")
+	// 6s of the 10s execution wasn't accounted for by the server.
+	assert.Equal(t, rgpb.Location_NETWORK, d.GetFinding()[1].GetLocation())
+	assert.Contains(t, d.GetFinding()[1].GetDescription(), "60%")
+	// The server has no record of the second action.
+	assert.Equal(t, rgpb.Location_NETWORK, d.GetFinding()[2].GetLocation())
+	assert.Equal(t, int64(1), d.GetFinding()[2].GetCallCount())
+}
+
+func TestAnalyzeWithoutServerRecords(t *testing.T) {
+	entries := []*rlpb.LogEntry{
+		entry("build.bazel.remote.execution.v2.Execution/Execute", "a1", codes.Canceled, 0, time.Second),
+		entry("build.bazel.remote.execution.v2.Execution/Execute", "a2", codes.DeadlineExceeded, 0, time.Second),
+	}
+
+	d := remote_grpc_log.Analyze(entries, nil)
+	assert.Equal(t, int64(2), d.GetExecutionBreakdown().GetActionCount())
+	assert.Equal(t, int64(0), d.GetExecutionBreakdown().GetMatchedActionCount())
+	require.Len(t, d.GetFinding(), 2)
+	assert.Equal(t, rgpb.Location_CLIENT, d.GetFinding()[0].GetLocation())
+	assert.Contains(t, d.GetFinding()[0].GetDescription(), "CANCELLED")
+	assert.Equal(t, rgpb.Location_NETWORK, d.GetFinding()[1].GetLocation())
+	assert.Contains(t, d.GetFinding()[1].GetDescription(), "DEADLINE_EXCEEDED")
+}
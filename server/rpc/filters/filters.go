@@ -2,10 +2,15 @@ package filters
 
 import (
 	"context"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/api_error"
+	"github.com/buildbuddy-io/buildbuddy/server/util/client_version"
+	"github.com/buildbuddy-io/buildbuddy/server/util/deadline"
+	"github.com/buildbuddy-io/buildbuddy/server/util/reliability"
 	"github.com/buildbuddy-io/buildbuddy/server/util/uuid"
 	"github.com/golang/protobuf/proto"
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
@@ -14,9 +19,20 @@ import (
 
 	bblog "github.com/buildbuddy-io/buildbuddy/server/util/log"
 	requestcontext "github.com/buildbuddy-io/buildbuddy/server/util/request_context"
+	requestinfo "github.com/buildbuddy-io/buildbuddy/server/util/request_info"
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 )
 
+const (
+	// warningHeader is the response header used to send warnings to clients,
+	// such as that their version is deprecated.
+	warningHeader = "x-buildbuddy-warning"
+
+	// apiMethodPrefix is the prefix of the full method names of the external
+	// API's RPCs.
+	apiMethodPrefix = "/api.v1.ApiService/"
+)
+
 var (
 	headerContextKeys map[string]string
 
@@ -74,6 +90,18 @@ func addAuthToContext(env environment.Env, ctx context.Context) context.Context
 	return ctx
 }
 
+// addRequestInfoToContext records who made the request in the context. It must
+// be called after the request has been authenticated.
+func addRequestInfoToContext(env environment.Env, ctx context.Context) context.Context {
+	var user requestinfo.Identity
+	if auth := env.GetAuthenticator(); auth != nil {
+		if u, err := auth.AuthenticatedUser(ctx); err == nil {
+			user = u
+		}
+	}
+	return requestinfo.WithInfo(ctx, requestinfo.New(ctx, user))
+}
+
 func addRequestIdToContext(ctx context.Context) context.Context {
 	if rctx, err := uuid.SetInContext(ctx); err == nil {
 		return rctx
@@ -132,6 +160,125 @@ func requestIDUnaryServerInterceptor() grpc.UnaryServerInterceptor {
 	return contextReplacingUnaryServerInterceptor(addRequestIdToContext)
 }
 
+// requestInfoStreamServerInterceptor is a server interceptor that makes the
+// caller's identity and client details available via request_info.
+func requestInfoStreamServerInterceptor(env environment.Env) grpc.StreamServerInterceptor {
+	ctxFn := func(ctx context.Context) context.Context {
+		return addRequestInfoToContext(env, ctx)
+	}
+	return contextReplacingStreamServerInterceptor(ctxFn)
+}
+
+// requestInfoUnaryServerInterceptor is a server interceptor that makes the
+// caller's identity and client details available via request_info.
+func requestInfoUnaryServerInterceptor(env environment.Env) grpc.UnaryServerInterceptor {
+	ctxFn := func(ctx context.Context) context.Context {
+		return addRequestInfoToContext(env, ctx)
+	}
+	return contextReplacingUnaryServerInterceptor(ctxFn)
+}
+
+func clientVersionPolicy(env environment.Env) *client_version.Policy {
+	policy, err := client_version.NewPolicyFromConfig(env.GetConfigurator())
+	if err != nil {
+		bblog.Errorf("Not enforcing client versions: %s", err)
+		return nil
+	}
+	return policy
+}
+
+// checkClientVersion rejects requests from clients which are too old to be
+// supported, and sends a warning header to clients which are deprecated.
+func checkClientVersion(ctx context.Context, policy *client_version.Policy) error {
+	clientVersion := requestinfo.FromContext(ctx).ClientVersion
+	warning, err := policy.Check(client_version.BazelVersion(clientVersion))
+	if err != nil {
+		return err
+	}
+	if warning != "" {
+		if err := grpc.SetHeader(ctx, metadata.Pairs(warningHeader, warning)); err != nil {
+			bblog.Debugf("Could not send client version warning: %s", err)
+		}
+	}
+	return nil
+}
+
+// clientVersionStreamServerInterceptor is a server interceptor that enforces
+// the configured client version policy.
+func clientVersionStreamServerInterceptor(env environment.Env) grpc.StreamServerInterceptor {
+	policy := clientVersionPolicy(env)
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := checkClientVersion(stream.Context(), policy); err != nil {
+			return err
+		}
+		return handler(srv, stream)
+	}
+}
+
+// clientVersionUnaryServerInterceptor is a server interceptor that enforces
+// the configured client version policy.
+func clientVersionUnaryServerInterceptor(env environment.Env) grpc.UnaryServerInterceptor {
+	policy := clientVersionPolicy(env)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := checkClientVersion(ctx, policy); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// apiErrorStreamServerInterceptor is a server interceptor that converts the
+// errors returned by the external API to the API's error model.
+func apiErrorStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		err := handler(srv, stream)
+		if strings.HasPrefix(info.FullMethod, apiMethodPrefix) {
+			return api_error.Normalize(err)
+		}
+		return err
+	}
+}
+
+// apiErrorUnaryServerInterceptor is a server interceptor that converts the
+// errors returned by the external API to the API's error model.
+func apiErrorUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		r, err := handler(ctx, req)
+		if strings.HasPrefix(info.FullMethod, apiMethodPrefix) {
+			return r, api_error.Normalize(err)
+		}
+		return r, err
+	}
+}
+
+// deadlineBudgetStreamServerInterceptor is a server interceptor that records
+// the budget for the internal calls made to serve a request, and rejects
+// requests which arrive too close to their deadline to be served.
+func deadlineBudgetStreamServerInterceptor(env environment.Env) grpc.StreamServerInterceptor {
+	fraction := env.GetConfigurator().GetAppInternalCallDeadlineFraction()
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := deadline.WithBudget(stream.Context(), fraction)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &wrappedServerStreamWithContext{stream, ctx})
+	}
+}
+
+// deadlineBudgetUnaryServerInterceptor is a server interceptor that records
+// the budget for the internal calls made to serve a request, and rejects
+// requests which arrive too close to their deadline to be served.
+func deadlineBudgetUnaryServerInterceptor(env environment.Env) grpc.UnaryServerInterceptor {
+	fraction := env.GetConfigurator().GetAppInternalCallDeadlineFraction()
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := deadline.WithBudget(ctx, fraction)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
 // requestContextProtoUnaryServerInterceptor is a server interceptor that
 // copies the request context from the request message into the context.
 func requestContextProtoUnaryServerInterceptor() grpc.UnaryServerInterceptor {
@@ -165,6 +312,28 @@ func logRequestStreamServerInterceptor() grpc.StreamServerInterceptor {
 	}
 }
 
+// reliabilityUnaryServerInterceptor records the outcome and latency of each
+// request for reliability reporting.
+func reliabilityUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		r, err := handler(ctx, req)
+		reliability.Record(info.FullMethod, time.Since(start), err)
+		return r, err
+	}
+}
+
+// reliabilityStreamServerInterceptor records the outcome and latency of each
+// request for reliability reporting.
+func reliabilityStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, stream)
+		reliability.Record(info.FullMethod, time.Since(start), err)
+		return err
+	}
+}
+
 // copyHeadersStreamInterceptor is a server interceptor that copies certain
 // headers present in the grpc metadata into the context.
 func copyHeadersStreamServerInterceptor() grpc.StreamServerInterceptor {
@@ -191,20 +360,30 @@ func setHeadersStreamClientInterceptor() grpc.StreamClientInterceptor {
 
 func GetUnaryInterceptor(env environment.Env) grpc.ServerOption {
 	return grpc.ChainUnaryInterceptor(
+		apiErrorUnaryServerInterceptor(),
 		requestIDUnaryServerInterceptor(),
-		logRequestUnaryServerInterceptor(),
 		requestContextProtoUnaryServerInterceptor(),
 		authUnaryServerInterceptor(env),
 		copyHeadersUnaryServerInterceptor(),
+		requestInfoUnaryServerInterceptor(env),
+		logRequestUnaryServerInterceptor(),
+		reliabilityUnaryServerInterceptor(),
+		clientVersionUnaryServerInterceptor(env),
+		deadlineBudgetUnaryServerInterceptor(env),
 	)
 }
 
 func GetStreamInterceptor(env environment.Env) grpc.ServerOption {
 	return grpc.ChainStreamInterceptor(
+		apiErrorStreamServerInterceptor(),
 		requestIDStreamServerInterceptor(),
-		logRequestStreamServerInterceptor(),
 		authStreamServerInterceptor(env),
 		copyHeadersStreamServerInterceptor(),
+		requestInfoStreamServerInterceptor(env),
+		logRequestStreamServerInterceptor(),
+		reliabilityStreamServerInterceptor(),
+		clientVersionStreamServerInterceptor(env),
+		deadlineBudgetStreamServerInterceptor(env),
 	)
 }
 
@@ -86,6 +86,9 @@ func serveIndexTemplate(env environment.Env, tpl *template.Template, version str
 	for _, provider := range env.GetConfigurator().GetAuthOauthProviders() {
 		issuers = append(issuers, provider.IssuerURL)
 	}
+	for _, provider := range env.GetConfigurator().GetAuthLDAPProviders() {
+		issuers = append(issuers, provider.URL)
+	}
 
 	userOwnedExecutorsEnabled := false
 	executorKeyCreationEnabled := false
@@ -1,6 +1,7 @@
 package tables
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"time"
 
@@ -116,6 +117,68 @@ type Invocation struct {
 	DownloadThroughputBytesPerSecond int64
 	InvocationPK                     int64 `gorm:"uniqueIndex:invocation_invocation_pk"`
 	Success                          bool
+	BazelVersion                     string
+	MaxBuildEventUploadLagUsec       int64
+	MeanBuildEventUploadLagUsec      int64
+	BuildEventUploadTailUsec         int64
+	SlowBuildEventUpload             bool
+
+	// The ID of the blobstore backend that the invocation's events are
+	// stored in. BlobID holds their path within that backend.
+	BlobBackendID string
+
+	// Whether some of the invocation's blobs were written to an app's local
+	// write-ahead log while the blobstore was unavailable, and are not yet
+	// persisted to the blobstore.
+	PendingPersist bool
+
+	// The number of the pull request that the invocation was for, or 0 if
+	// unknown.
+	PullRequestNumber int64 `gorm:"index:pull_request_number_index"`
+
+	// The version of the event parser that the invocation was parsed with,
+	// or 0 if it was parsed before versions were recorded.
+	ParserVersion int64 `gorm:"index:parser_version_index"`
+
+	// The number of targets that were configured and completed, which are
+	// updated periodically while the invocation is in progress to estimate
+	// how far along it is.
+	ConfiguredTargetCount int64
+	CompletedTargetCount  int64
+	FailedTargetCount     int64
+
+	// The number of build events received for the invocation, which is
+	// updated periodically while the invocation is in progress, along with
+	// its duration so far.
+	EventCount int64
+
+	// The number of bytes of build events stored for the invocation, which
+	// counts towards its group's storage.group_retention limit. 0 for
+	// invocations that haven't completed, or were written before it was
+	// recorded.
+	StoredEventBytes int64
+
+	// Denormalized from the cache stats above, so that invocations can be
+	// sorted by them using an index.
+	ActionCacheHitRate     float64
+	TotalTransferSizeBytes int64
+
+	// When the invocation was moved to the trash, or 0 if it isn't in the
+	// trash. Trashed invocations are hidden until they're restored, and
+	// are deleted once storage.trash_retention_seconds have passed.
+	DeletedAtUsec int64 `gorm:"default:0;index:invocation_deleted_at_usec_index"`
+
+	// The CRC-32C checksum, as hex, of the invocation's stored build events,
+	// which is verified when they are read. Empty for invocations that
+	// haven't completed, or were written before checksums were recorded.
+	EventStreamChecksum string
+
+	// Whether the invocation's blobs were moved to the archive backend, as
+	// an inpb.Invocation_ArchiveStatus, and when that last changed.
+	// Invocations are only archived again once they were restored for
+	// longer than storage.archive.archive_after_seconds.
+	ArchiveStatus     int64 `gorm:"default:0;index:invocation_archive_status_index"`
+	ArchiveStatusUsec int64
 }
 
 func (i *Invocation) TableName() string {
@@ -174,6 +237,31 @@ type Group struct {
 	// If enabled, builds for this group will always use their own executors instead of the installation-wide shared
 	// executors.
 	UseGroupOwnedExecutors bool
+
+	// Comma-separated list of the cache namespaces which invocations of this
+	// group may use instead of the group's main cache.
+	AllowedCacheNamespaces string
+
+	// If enabled, the action cache is warmed ahead of this group's builds by
+	// re-running frequently missed actions during off-peak hours.
+	CacheWarmingEnabled bool
+
+	// When the action cache was last warmed for this group.
+	LastCacheWarmingUsec int64
+
+	// If enabled, the console logs of this group's invocations are indexed
+	// so that they can be searched.
+	ConsoleLogIndexEnabled bool
+
+	// Comma-separated name=value platform properties which are added to this
+	// group's remote executions if they aren't set, and which replace any
+	// value set by them, respectively.
+	DefaultPlatformProperties string
+	ForcedPlatformProperties  string
+
+	// A build event protocol server that this group's build event streams
+	// are also forwarded to, such as "grpcs://bes.example.com:443".
+	BESForwardingTarget string
 }
 
 func (g *Group) TableName() string {
@@ -262,12 +350,120 @@ type APIKey struct {
 	// NOTE: If the default is changed, a DB migration may be required to
 	// migrate old DB rows to reflect the new default.
 	Capabilities int32 `gorm:"default:1"`
+	// When the key was last used to authenticate. Updated at most once a
+	// minute per server.
+	LastUsedUsec int64
 }
 
 func (k *APIKey) TableName() string {
 	return "APIKeys"
 }
 
+// Session is a web login. Browsers keep a session token in a cookie alongside
+// their login token, so that users can list their logins and revoke them.
+type Session struct {
+	// The ID that the session is listed and revoked by.
+	SessionID string `gorm:"primaryKey"`
+	// The subscriber ID of the logged in user, since sessions start before
+	// new users are created.
+	SubID string `gorm:"index:session_sub_id_index"`
+	// The hash of the session token. The token itself is only known to the
+	// browser.
+	TokenHash string `gorm:"uniqueIndex:session_token_hash_index"`
+	// The hash of the login token (JWT) that the session was last used with,
+	// which is revoked along with the session.
+	LoginTokenHash string
+	UserAgent      string
+	IPAddress      string
+	// When the session was last used. Updated at most once a minute per
+	// server.
+	LastUsedUsec int64
+	Model
+}
+
+func (s *Session) TableName() string {
+	return "Sessions"
+}
+
+// RevokedToken is a credential on the denylist, such as the token of a
+// revoked session or of a deleted API key. Credentials are denylisted, rather
+// than only deleted, so that servers reject them right away even if they have
+// cached them.
+type RevokedToken struct {
+	TokenHash string `gorm:"primaryKey"`
+	// When the token is removed from the denylist, because it would no longer
+	// be accepted anyway.
+	ExpiresAtUsec int64 `gorm:"index:revoked_token_expires_at_usec_index"`
+	Model
+}
+
+func (t *RevokedToken) TableName() string {
+	return "RevokedTokens"
+}
+
+// Secret is a named credential owned by a group, such as the URL of a Slack
+// webhook. Its value is encrypted with the server's master key.
+type Secret struct {
+	GroupID string `gorm:"primaryKey"`
+	Name    string `gorm:"primaryKey"`
+	// The encrypted value of the secret.
+	Value string
+	Model
+}
+
+func (s *Secret) TableName() string {
+	return "Secrets"
+}
+
+// AccessLogEntry records that a user viewed an invocation or downloaded one
+// of its artifacts.
+type AccessLogEntry struct {
+	AccessLogEntryID string `gorm:"primaryKey"`
+	// The group that owns the invocation.
+	GroupID string `gorm:"index:access_log_group_time_index,priority:1"`
+	// Empty if the access was anonymous.
+	UserID         string
+	InvocationID   string `gorm:"index:access_log_invocation_id_index"`
+	ResourceType   int32
+	ArtifactName   string
+	AccessTimeUsec int64 `gorm:"index:access_log_group_time_index,priority:2"`
+	SampleRate     float64
+	Model
+}
+
+func (a *AccessLogEntry) TableName() string {
+	return "AccessLogEntries"
+}
+
+// ExportJob is an export of the records of the invocations matching a search
+// to a file in the blobstore.
+type ExportJob struct {
+	ExportJobID string `gorm:"primaryKey"`
+	UserID      string
+	GroupID     string `gorm:"index:export_job_group_id"`
+	Perms       int
+	RecordType  int32
+	Format      int32
+	Status      int32
+	// The name of the file in the blobstore. Only set once the export is
+	// done.
+	BlobName  string
+	RowCount  int64
+	SizeBytes int64
+	Error     string `gorm:"type:text;"`
+	Model
+}
+
+func (j *ExportJob) TableName() string {
+	return "ExportJobs"
+}
+
+// TokenHash returns the hash that a credential is stored under in the Sessions
+// and RevokedTokens tables.
+func TokenHash(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
 type Execution struct {
 	// The subscriber ID, a concatenated string of the
 	// auth Issuer ID and the subcriber ID string.
@@ -284,7 +480,7 @@ type Execution struct {
 	SerializedOperation []byte `gorm:"size:max"` // deprecated
 	Model
 
-	Stage int64
+	Stage int64 `gorm:"index:executions_stage"`
 
 	// IOStats
 	FileDownloadCount        int64
@@ -308,6 +504,19 @@ type Execution struct {
 
 	StatusCode   int32
 	CachedResult bool
+
+	// The target and mnemonic of the executed action, from the request
+	// metadata. Used to estimate the duration of later executions.
+	TargetID       string `gorm:"index:executions_target_id"`
+	ActionMnemonic string
+
+	// The executor pool that the execution was scheduled on.
+	Pool string `gorm:"index:executions_pool"`
+
+	// The digest of the crash report captured by the executor, if the action
+	// crashed.
+	CrashReportHash      string
+	CrashReportSizeBytes int64
 }
 
 func (t *Execution) TableName() string {
@@ -353,12 +562,38 @@ type ExecutionNode struct {
 	UserID                string
 	Perms                 int
 	ExecutorID            string
+	// CapabilityGrade is the grade (1-5) the executor earned in its startup
+	// benchmark, or 0 if it was not benchmarked.
+	CapabilityGrade int32
 }
 
 func (n *ExecutionNode) TableName() string {
 	return "ExecutionNodes"
 }
 
+// ExecutorUtilization records how much of the executor capacity of a pool was
+// registered and how much of it was assigned to tasks during an hour. The
+// schedulers that executors are connected to add to the totals.
+type ExecutorUtilization struct {
+	GroupID         string `gorm:"primaryKey;default:''"`
+	Pool            string `gorm:"primaryKey;default:''"`
+	PeriodStartUsec int64  `gorm:"primaryKey;autoIncrement:false"`
+	// The total time that executors were registered, summed over executors.
+	RegisteredExecutorUsec int64
+	// The assignable milli-CPU of the registered executors multiplied by the
+	// time they were registered.
+	CapacityMilliCPUUsec int64
+	// The estimated milli-CPU of the tasks that were run multiplied by the
+	// time they ran.
+	BusyMilliCPUUsec int64
+	TaskCount        int64
+	Model
+}
+
+func (u *ExecutorUtilization) TableName() string {
+	return "ExecutorUtilization"
+}
+
 type ExecutionTask struct {
 	TaskID         string `gorm:"primaryKey"`
 	Arch           string
@@ -438,12 +673,287 @@ type Workflow struct {
 	// registering the webhook. This will only be set for the case where we
 	// successfully auto-registered the webhook.
 	GitProviderWebhookID string
+	// GithubAppInstallationID is the ID of the GitHub App installation that
+	// the workflow authenticates as, and receives events through, if any.
+	// Such workflows don't store an access token, since a short-lived one is
+	// created whenever needed.
+	GithubAppInstallationID int64 `gorm:"index:workflow_github_app_installation_id"`
 }
 
 func (wf *Workflow) TableName() string {
 	return "Workflows"
 }
 
+// GitHubAppInstallation links an installation of the GitHub App to the group
+// that may build the repos it has access to. It's linked by a member of the
+// group who can access the installation on GitHub.
+type GitHubAppInstallation struct {
+	InstallationID int64  `gorm:"primaryKey;autoIncrement:false"`
+	GroupID        string `gorm:"index:github_app_installation_group_id"`
+	Model
+}
+
+func (i *GitHubAppInstallation) TableName() string {
+	return "GitHubAppInstallations"
+}
+
+// WorkflowBisect is a search for the first commit at which a workflow action
+// fails, by running the action at commits between a passing and a failing
+// commit. The runs themselves are found through the invocations tagged with
+// the bisect ID.
+type WorkflowBisect struct {
+	BisectID              string `gorm:"primaryKey"`
+	WorkflowID            string `gorm:"index:workflow_bisect_workflow_id"`
+	UserID                string
+	GroupID               string `gorm:"index:workflow_bisect_group_id"`
+	Perms                 int
+	ActionName            string
+	Branch                string
+	GoodCommitSHA         string
+	BadCommitSHA          string
+	Status                int64
+	FirstFailingCommitSHA string
+	Error                 string `gorm:"type:text;"`
+	Model
+}
+
+func (b *WorkflowBisect) TableName() string {
+	return "WorkflowBisects"
+}
+
+// WorkflowSchedule is a workflow action that is run periodically. The runs
+// are found through the invocations tagged with the schedule ID.
+type WorkflowSchedule struct {
+	ScheduleID        string `gorm:"primaryKey"`
+	WorkflowID        string `gorm:"index:workflow_schedule_workflow_id"`
+	UserID            string
+	GroupID           string `gorm:"index:workflow_schedule_group_id"`
+	Perms             int
+	ActionName        string
+	Branch            string
+	CronSpec          string
+	ConcurrencyPolicy int64
+	NextRunUsec       int64 `gorm:"index:workflow_schedule_next_run_usec"`
+	LastRunUsec       int64
+	LastInvocationID  string
+	LastError         string `gorm:"type:text;"`
+	Model
+}
+
+func (s *WorkflowSchedule) TableName() string {
+	return "WorkflowSchedules"
+}
+
+// InvocationBuildMetadata holds the --build_metadata key/value pairs
+// reported by each invocation, so that they can be aggregated per group.
+type InvocationBuildMetadata struct {
+	InvocationID  string `gorm:"primaryKey"`
+	MetadataKey   string `gorm:"primaryKey"`
+	GroupID       string `gorm:"index:build_metadata_group_id"`
+	MetadataValue string
+	Model
+}
+
+func (m *InvocationBuildMetadata) TableName() string {
+	return "InvocationBuildMetadata"
+}
+
+// InvocationTag is a tag attached to an invocation, such as "release" or
+// "nightly".
+type InvocationTag struct {
+	InvocationID string `gorm:"primaryKey"`
+	Tag          string `gorm:"primaryKey;index:invocation_tag_index"`
+	Model
+}
+
+func (t *InvocationTag) TableName() string {
+	return "InvocationTags"
+}
+
+// BenchmarkResult is a single measurement reported by a benchmark that ran in
+// an invocation, such as its time per operation.
+type BenchmarkResult struct {
+	// A hash of the invocation ID, package, name, and unit, so that adding
+	// the same output twice doesn't duplicate results.
+	ResultID         string `gorm:"primaryKey"`
+	GroupID          string `gorm:"index:benchmark_result_group_id"`
+	InvocationID     string `gorm:"index:benchmark_result_invocation_id"`
+	RepoURL          string
+	CommitSHA        string
+	Branch           string
+	BenchmarkPackage string
+	BenchmarkName    string `gorm:"index:benchmark_result_name"`
+	Unit             string
+	Value            float64
+	Iterations       int64
+	Model
+}
+
+func (r *BenchmarkResult) TableName() string {
+	return "BenchmarkResults"
+}
+
+// TargetCoverage is the code coverage measured by a target's tests in an
+// invocation. The coverage of all of the invocation's targets combined is
+// stored with an empty label.
+type TargetCoverage struct {
+	// A hash of the invocation ID and label, so that adding the same
+	// invocation's coverage twice doesn't duplicate results.
+	CoverageID     string `gorm:"primaryKey"`
+	GroupID        string `gorm:"index:target_coverage_group_id"`
+	InvocationID   string `gorm:"index:target_coverage_invocation_id"`
+	RepoURL        string
+	CommitSHA      string `gorm:"index:target_coverage_commit_sha"`
+	Branch         string
+	Label          string
+	LinesFound     int64
+	LinesHit       int64
+	FunctionsFound int64
+	FunctionsHit   int64
+	BranchesFound  int64
+	BranchesHit    int64
+	Model
+}
+
+func (c *TargetCoverage) TableName() string {
+	return "TargetCoverage"
+}
+
+// ConsoleLogLine is a line of an invocation's console log, stored for
+// searching console logs.
+type ConsoleLogLine struct {
+	InvocationID string `gorm:"primaryKey"`
+	// The line's position in the console log, starting from 1.
+	LineNumber int64  `gorm:"primaryKey;autoIncrement:false"`
+	GroupID    string `gorm:"index:console_log_line_group_id"`
+	Line       string `gorm:"type:text;"`
+	Model
+}
+
+func (l *ConsoleLogLine) TableName() string {
+	return "ConsoleLogLines"
+}
+
+// ConsoleLogToken records that a word occurs in a line of an invocation's
+// console log. Lines are found by looking up the tokens of the searched text.
+type ConsoleLogToken struct {
+	GroupID      string `gorm:"primaryKey"`
+	Token        string `gorm:"primaryKey"`
+	InvocationID string `gorm:"primaryKey"`
+	LineNumber   int64  `gorm:"primaryKey;autoIncrement:false"`
+	Model
+}
+
+func (t *ConsoleLogToken) TableName() string {
+	return "ConsoleLogTokens"
+}
+
+// InvocationFailure is a failure printed by a failed invocation. Failures
+// with the same fingerprint likely share a root cause, so they are counted
+// together to find the causes that break the most builds.
+type InvocationFailure struct {
+	InvocationID string `gorm:"primaryKey"`
+	Fingerprint  string `gorm:"primaryKey;index:invocation_failure_fingerprint_index"`
+	GroupID      string `gorm:"index:invocation_failure_group_index"`
+	Label        string
+	Snippet      string `gorm:"type:text;"`
+	Model
+}
+
+func (f *InvocationFailure) TableName() string {
+	return "InvocationFailures"
+}
+
+// QuarantinedTarget is a target whose failures don't fail the status
+// reported to GitHub for a group's CI builds, such as a known-flaky test.
+type QuarantinedTarget struct {
+	GroupID string `gorm:"primaryKey"`
+	Label   string `gorm:"primaryKey"`
+	UserID  string
+	Reason  string `gorm:"type:text;"`
+	Model
+}
+
+func (t *QuarantinedTarget) TableName() string {
+	return "QuarantinedTargets"
+}
+
+// ArtifactPromotion records an output of an invocation that was pushed to an
+// external registry or bucket, so that released artifacts can be traced back
+// to the build that produced them. Failed pushes are recorded with their
+// error.
+type ArtifactPromotion struct {
+	PromotionID  string `gorm:"primaryKey"`
+	GroupID      string `gorm:"index:artifact_promotion_group_id"`
+	InvocationID string `gorm:"index:artifact_promotion_invocation_id"`
+	RuleName     string
+	TargetLabel  string
+	FileName     string
+	// The hex-encoded SHA-256 digest of the file.
+	Digest      string
+	SizeBytes   int64
+	Destination string
+	// Where the artifact was pushed, like "gs://bucket/path/file" or
+	// "registry.example.com/app@sha256:...". Empty if the push failed.
+	PushedURI string `gorm:"type:text;"`
+	Version   string
+	RepoURL   string
+	CommitSHA string
+	Error     string `gorm:"type:text;"`
+	Model
+}
+
+func (p *ArtifactPromotion) TableName() string {
+	return "ArtifactPromotions"
+}
+
+// InstanceNameAlias maps a remote instance name that a group retired to the
+// instance name that replaces it.
+type InstanceNameAlias struct {
+	GroupID                 string `gorm:"primaryKey"`
+	RetiredInstanceName     string `gorm:"primaryKey"`
+	ReplacementInstanceName string
+	// When the alias expires, or 0 if it doesn't.
+	ExpiresAtUsec int64
+	Model
+}
+
+func (a *InstanceNameAlias) TableName() string {
+	return "InstanceNameAliases"
+}
+
+// CacheHitRateBaseline holds the rolling action cache stats of the
+// invocations of a group's repo and branch, as a serialized
+// cache.CacheHitRateBaseline proto.
+type CacheHitRateBaseline struct {
+	GroupID            string `gorm:"primaryKey"`
+	RepoURL            string `gorm:"primaryKey"`
+	Branch             string `gorm:"primaryKey"`
+	SerializedBaseline []byte `gorm:"size:max"`
+	Model
+}
+
+func (b *CacheHitRateBaseline) TableName() string {
+	return "CacheHitRateBaselines"
+}
+
+// InvocationCustomEventStream records a build event stream of custom events
+// (published by a tool other than Bazel) that was received for an
+// invocation, and where its events are stored.
+type InvocationCustomEventStream struct {
+	InvocationID string `gorm:"primaryKey"`
+	// Identifies the stream within the invocation, as "<build_id>/<component>".
+	StreamID      string `gorm:"primaryKey"`
+	BlobID        string
+	BlobBackendID string
+	EventCount    int64
+	Model
+}
+
+func (s *InvocationCustomEventStream) TableName() string {
+	return "InvocationCustomEventStreams"
+}
+
 type PostAutoMigrateLogic func() error
 
 // Manual migration called before auto-migration.
@@ -543,6 +1053,11 @@ func PostAutoMigrate(db *gorm.DB) error {
 		"invocations_stats_host_index":        "(`group_id`, `host`, `action_count`, `duration_usec`, `updated_at_usec`, `success`, `invocation_status`)",
 		"invocations_stats_repo_index":        "(`group_id`, `repo_url`, `action_count`, `duration_usec`, `updated_at_usec`, `success`, `invocation_status`)",
 		"invocations_stats_commit_index":      "(`group_id`, `commit_sha`, `action_count`, `duration_usec`, `updated_at_usec`, `success`, `invocation_status`)",
+		// Used to sort invocation search results.
+		"invocations_sort_duration_index":       "(`group_id`, `duration_usec`, `updated_at_usec`)",
+		"invocations_sort_cache_hit_rate_index": "(`group_id`, `action_cache_hit_rate`, `updated_at_usec`)",
+		"invocations_sort_failed_targets_index": "(`group_id`, `failed_target_count`, `updated_at_usec`)",
+		"invocations_sort_transfer_size_index":  "(`group_id`, `total_transfer_size_bytes`, `updated_at_usec`)",
 	}
 	m := db.Migrator()
 	if m.HasTable("Invocations") {
@@ -575,4 +1090,25 @@ func init() {
 	registerTable("TA", &Target{})
 	registerTable("TS", &TargetStatus{})
 	registerTable("WF", &Workflow{})
+	registerTable("BM", &InvocationBuildMetadata{})
+	registerTable("CS", &InvocationCustomEventStream{})
+	registerTable("IG", &InvocationTag{})
+	registerTable("BR", &BenchmarkResult{})
+	registerTable("TC", &TargetCoverage{})
+	registerTable("WB", &WorkflowBisect{})
+	registerTable("WS", &WorkflowSchedule{})
+	registerTable("GI", &GitHubAppInstallation{})
+	registerTable("LL", &ConsoleLogLine{})
+	registerTable("LT", &ConsoleLogToken{})
+	registerTable("IF", &InvocationFailure{})
+	registerTable("QT", &QuarantinedTarget{})
+	registerTable("EU", &ExecutorUtilization{})
+	registerTable("SE", &Session{})
+	registerTable("RT", &RevokedToken{})
+	registerTable("SC", &Secret{})
+	registerTable("AP", &ArtifactPromotion{})
+	registerTable("IA", &InstanceNameAlias{})
+	registerTable("HB", &CacheHitRateBaseline{})
+	registerTable("AL", &AccessLogEntry{})
+	registerTable("EJ", &ExportJob{})
 }
@@ -0,0 +1,135 @@
+package target
+
+import (
+	"context"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	trpb "github.com/buildbuddy-io/buildbuddy/proto/target"
+)
+
+const (
+	// The maximum number of targets a group can quarantine.
+	maxQuarantinedTargets = 1000
+)
+
+func validateLabel(label string) error {
+	if label == "" {
+		return status.InvalidArgumentError("label is required")
+	}
+	if !strings.HasPrefix(label, "//") && !strings.HasPrefix(label, "@") {
+		return status.InvalidArgumentErrorf("%q is not an absolute label", label)
+	}
+	return nil
+}
+
+func GetQuarantinedTargets(ctx context.Context, env environment.Env, req *trpb.GetQuarantinedTargetsRequest) (*trpb.GetQuarantinedTargetsResponse, error) {
+	if env.GetDBHandle() == nil {
+		return nil, status.FailedPreconditionError("database not configured")
+	}
+	groupID, err := perms.AuthenticateSelectedGroupID(ctx, env, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	var targets []*tables.QuarantinedTarget
+	err = env.GetDBHandle().WithContext(ctx).Raw(`SELECT * FROM QuarantinedTargets WHERE group_id = ? ORDER BY label`, groupID).Scan(&targets).Error
+	if err != nil {
+		return nil, err
+	}
+	rsp := &trpb.GetQuarantinedTargetsResponse{}
+	for _, t := range targets {
+		rsp.QuarantinedTarget = append(rsp.QuarantinedTarget, &trpb.QuarantinedTarget{
+			Label:         t.Label,
+			Reason:        t.Reason,
+			UserId:        t.UserID,
+			CreatedAtUsec: t.CreatedAtUsec,
+		})
+	}
+	return rsp, nil
+}
+
+// QuarantineTarget adds a target to the group's quarantine list, or updates
+// the reason it was quarantined for.
+func QuarantineTarget(ctx context.Context, env environment.Env, req *trpb.QuarantineTargetRequest) (*trpb.QuarantineTargetResponse, error) {
+	if env.GetDBHandle() == nil {
+		return nil, status.FailedPreconditionError("database not configured")
+	}
+	groupID, err := perms.AuthenticateSelectedGroupID(ctx, env, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	if err := validateLabel(req.GetLabel()); err != nil {
+		return nil, err
+	}
+	user, err := perms.AuthenticatedUser(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+	var count int64
+	err = env.GetDBHandle().WithContext(ctx).Model(&tables.QuarantinedTarget{}).Where("group_id = ? AND label != ?", groupID, req.GetLabel()).Count(&count).Error
+	if err != nil {
+		return nil, err
+	}
+	if count >= maxQuarantinedTargets {
+		return nil, status.ResourceExhaustedErrorf("A group can't quarantine more than %d targets", maxQuarantinedTargets)
+	}
+	err = env.GetDBHandle().Transaction(ctx, func(tx *db.DB) error {
+		if err := tx.Exec(`DELETE FROM QuarantinedTargets WHERE group_id = ? AND label = ?`, groupID, req.GetLabel()).Error; err != nil {
+			return err
+		}
+		return tx.Create(&tables.QuarantinedTarget{
+			GroupID: groupID,
+			Label:   req.GetLabel(),
+			UserID:  user.GetUserID(),
+			Reason:  req.GetReason(),
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &trpb.QuarantineTargetResponse{}, nil
+}
+
+func UnquarantineTarget(ctx context.Context, env environment.Env, req *trpb.UnquarantineTargetRequest) (*trpb.UnquarantineTargetResponse, error) {
+	if env.GetDBHandle() == nil {
+		return nil, status.FailedPreconditionError("database not configured")
+	}
+	groupID, err := perms.AuthenticateSelectedGroupID(ctx, env, req.GetRequestContext())
+	if err != nil {
+		return nil, err
+	}
+	if err := validateLabel(req.GetLabel()); err != nil {
+		return nil, err
+	}
+	result := env.GetDBHandle().WithContext(ctx).Exec(`DELETE FROM QuarantinedTargets WHERE group_id = ? AND label = ?`, groupID, req.GetLabel())
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, status.NotFoundErrorf("%s is not quarantined", req.GetLabel())
+	}
+	return &trpb.UnquarantineTargetResponse{}, nil
+}
+
+// QuarantinedLabels returns the labels of the targets quarantined by the
+// given group.
+func QuarantinedLabels(ctx context.Context, env environment.Env, groupID string) (map[string]bool, error) {
+	labels := make(map[string]bool)
+	if env.GetDBHandle() == nil || groupID == "" {
+		return labels, nil
+	}
+	var targets []*tables.QuarantinedTarget
+	err := env.GetDBHandle().WithContext(ctx).Raw(`SELECT label FROM QuarantinedTargets WHERE group_id = ?`, groupID).Scan(&targets).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range targets {
+		labels[t.Label] = true
+	}
+	return labels, nil
+}
@@ -0,0 +1,70 @@
+package target_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/target"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	trpb "github.com/buildbuddy-io/buildbuddy/proto/target"
+)
+
+func TestQuarantineTarget(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")))
+	ctx, err := te.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(context.Background(), "US1")
+	require.NoError(t, err)
+	reqCtx := testauth.RequestContext("US1", "GR1")
+
+	for _, label := range []string{"//b:flaky_test", "//a:flaky_test"} {
+		_, err := target.QuarantineTarget(ctx, te, &trpb.QuarantineTargetRequest{
+			RequestContext: reqCtx,
+			Label:          label,
+			Reason:         "flaky",
+		})
+		require.NoError(t, err)
+	}
+	// Quarantining a target again updates its reason.
+	_, err = target.QuarantineTarget(ctx, te, &trpb.QuarantineTargetRequest{
+		RequestContext: reqCtx,
+		Label:          "//b:flaky_test",
+		Reason:         "times out on CI",
+	})
+	require.NoError(t, err)
+
+	rsp, err := target.GetQuarantinedTargets(ctx, te, &trpb.GetQuarantinedTargetsRequest{RequestContext: reqCtx})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetQuarantinedTarget(), 2)
+	assert.Equal(t, "//a:flaky_test", rsp.GetQuarantinedTarget()[0].GetLabel())
+	assert.Equal(t, "//b:flaky_test", rsp.GetQuarantinedTarget()[1].GetLabel())
+	assert.Equal(t, "times out on CI", rsp.GetQuarantinedTarget()[1].GetReason())
+	assert.Equal(t, "US1", rsp.GetQuarantinedTarget()[1].GetUserId())
+
+	labels, err := target.QuarantinedLabels(ctx, te, "GR1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"//a:flaky_test": true, "//b:flaky_test": true}, labels)
+	labels, err = target.QuarantinedLabels(ctx, te, "GR2")
+	require.NoError(t, err)
+	assert.Empty(t, labels, "quarantined targets should be per-group")
+
+	_, err = target.UnquarantineTarget(ctx, te, &trpb.UnquarantineTargetRequest{RequestContext: reqCtx, Label: "//a:flaky_test"})
+	require.NoError(t, err)
+	_, err = target.UnquarantineTarget(ctx, te, &trpb.UnquarantineTargetRequest{RequestContext: reqCtx, Label: "//a:flaky_test"})
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+	labels, err = target.QuarantinedLabels(ctx, te, "GR1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"//b:flaky_test": true}, labels)
+
+	_, err = target.QuarantineTarget(ctx, te, &trpb.QuarantineTargetRequest{RequestContext: reqCtx, Label: "flaky_test"})
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+	_, err = target.QuarantineTarget(ctx, te, &trpb.QuarantineTargetRequest{
+		RequestContext: testauth.RequestContext("US1", "GR2"),
+		Label:          "//a:flaky_test",
+	})
+	assert.Error(t, err, "users should not be able to quarantine targets of other groups")
+}
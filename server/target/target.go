@@ -85,6 +85,7 @@ func readTargets(ctx context.Context, env environment.Env, req *trpb.GetTargetRe
                                      JOIN Invocations AS i ON ts.invocation_pk = i.invocation_pk`)
 	q.AddWhereClause("i.group_id = ?", req.GetRequestContext().GetGroupId())
 	q.AddWhereClause("t.group_id = ?", req.GetRequestContext().GetGroupId())
+	q.AddWhereClause("i.deleted_at_usec = 0")
 	// Adds user / permissions to targets (t) table.
 	if err := perms.AddPermissionsCheckToQueryWithTableAlias(ctx, env, q, "t"); err != nil {
 		return nil, err
@@ -0,0 +1,16 @@
+package remote_api_conformance_test
+
+import (
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/buildbuddy"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/reapi_conformance"
+)
+
+func TestConformance(t *testing.T) {
+	app := buildbuddy.Run(t)
+
+	reapi_conformance.RunTest(t, app.GRPCConn(t), &reapi_conformance.Options{
+		KnownFailures: reapi_conformance.KnownFailures,
+	})
+}
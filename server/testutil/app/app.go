@@ -112,6 +112,12 @@ func (a *App) RemoteCacheBazelFlags() []string {
 }
 
 func (a *App) BuildBuddyServiceClient(t *testing.T) bbspb.BuildBuddyServiceClient {
+	return bbspb.NewBuildBuddyServiceClient(a.GRPCConn(t))
+}
+
+// GRPCConn returns a connection to the App's gRPC port, which is closed at
+// the end of the test.
+func (a *App) GRPCConn(t *testing.T) *grpc.ClientConn {
 	conn, err := grpc.Dial(fmt.Sprintf("localhost:%d", a.gRPCPort), grpc.WithInsecure())
 	if err != nil {
 		t.Fatal(err)
@@ -119,7 +125,7 @@ func (a *App) BuildBuddyServiceClient(t *testing.T) bbspb.BuildBuddyServiceClien
 	t.Cleanup(func() {
 		conn.Close()
 	})
-	return bbspb.NewBuildBuddyServiceClient(conn)
+	return conn
 }
 
 func runfile(t *testing.T, path string) string {
@@ -0,0 +1,87 @@
+// Package fakeclock provides a clock whose time only passes when a test
+// advances it, so that behavior depending on timeouts, leases, or retention
+// can be tested deterministically and without waiting.
+package fakeclock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type waiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+// FakeClock implements interfaces.Clock. Its time only moves when Advance is
+// called.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*waiter
+	// Notified whenever a waiter is added.
+	waitersChanged *sync.Cond
+}
+
+// New returns a fake clock which is stopped at the given time.
+func New(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.waitersChanged = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, &waiter{deadline: c.now.Add(d), ch: ch})
+	c.waitersChanged.Broadcast()
+	return ch
+}
+
+// Advance moves the clock forward by the given duration, firing the channels
+// returned by After whose duration has elapsed, earliest first.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	sort.SliceStable(c.waiters, func(i, j int) bool {
+		return c.waiters[i].deadline.Before(c.waiters[j].deadline)
+	})
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.deadline.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = pending
+}
+
+// BlockUntilWaiters blocks until at least n goroutines are waiting on channels
+// returned by After. Tests can call this before Advance to make sure that the
+// code under test is waiting for the time being advanced past. Channels which
+// are no longer received from still count until their duration elapses.
+func (c *FakeClock) BlockUntilWaiters(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.waiters) < n {
+		c.waitersChanged.Wait()
+	}
+}
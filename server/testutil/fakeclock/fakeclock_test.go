@@ -0,0 +1,52 @@
+package fakeclock_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/fakeclock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdvance(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	c := fakeclock.New(start)
+	assert.Equal(t, start, c.Now())
+
+	short := c.After(1 * time.Second)
+	long := c.After(1 * time.Minute)
+
+	c.Advance(30 * time.Second)
+	assert.Equal(t, 30*time.Second, c.Since(start))
+	select {
+	case now := <-short:
+		assert.Equal(t, start.Add(30*time.Second), now)
+	default:
+		assert.FailNow(t, "elapsed timer should have fired")
+	}
+	select {
+	case <-long:
+		assert.FailNow(t, "timer should not fire before its duration elapsed")
+	default:
+	}
+
+	c.Advance(30 * time.Second)
+	select {
+	case <-long:
+	default:
+		assert.FailNow(t, "elapsed timer should have fired")
+	}
+}
+
+func TestBlockUntilWaiters(t *testing.T) {
+	c := fakeclock.New(time.Unix(1600000000, 0))
+	done := make(chan struct{})
+	go func() {
+		<-c.After(1 * time.Hour)
+		close(done)
+	}()
+
+	c.BlockUntilWaiters(1)
+	c.Advance(1 * time.Hour)
+	<-done
+}
@@ -0,0 +1,554 @@
+// Package reapi_conformance checks that a server implements the caching parts
+// of the remote execution API (REAPI) the way the spec requires: the
+// Capabilities, ContentAddressableStorage, ActionCache and ByteStream
+// services.
+//
+// Each check exercises one requirement of the spec against a running server,
+// over a plain gRPC connection, so that the same checks can run against an
+// in-process server in unit tests and against a real app in integration tests.
+package reapi_conformance
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	guuid "github.com/google/uuid"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	gstatus "google.golang.org/grpc/status"
+)
+
+const (
+	// The name of the report written to the test's undeclared outputs
+	// directory, if Bazel provides one.
+	reportFileName = "reapi_conformance.json"
+)
+
+// KnownFailures are the checks that BuildBuddy is known to fail, by name,
+// along with why. Remove a check from here once BuildBuddy conforms to it.
+var KnownFailures = map[string]string{
+	"batch_update_digest_mismatch":     "Digest mismatches are reported as DATA_LOSS.",
+	"bytestream_write_digest_mismatch": "Digest mismatches are reported as DATA_LOSS.",
+	"bytestream_read_offset":           "ByteStream.Read ignores the read limit.",
+}
+
+type Options struct {
+	// The instance name that requests are made with.
+	InstanceName string
+
+	// Checks that the server is known to fail, by name, along with why.
+	// They are reported, but don't fail the test. A known failure which
+	// passes does, so that the list is kept up to date.
+	KnownFailures map[string]string
+}
+
+// Result is the outcome of a single conformance check.
+type Result struct {
+	// The name of the check, such as "bytestream_read_missing".
+	Name string `json:"name"`
+	// A description of the spec requirement that the check exercises.
+	Requirement string `json:"requirement"`
+	// Empty if the check passed.
+	Failure string `json:"failure,omitempty"`
+	// Why the server is known to fail the check, if it is.
+	KnownFailure string        `json:"known_failure,omitempty"`
+	Duration     time.Duration `json:"duration_nanos"`
+}
+
+func (r *Result) Passed() bool {
+	return r.Failure == ""
+}
+
+type check struct {
+	name        string
+	requirement string
+	run         func(ctx context.Context, c *client) error
+}
+
+var checks = []check{
+	{"capabilities", "GetCapabilities returns the cache capabilities, including SHA256 as a digest function.", checkCapabilities},
+	{"find_missing_blobs", "FindMissingBlobs returns exactly the requested digests that are not in the CAS.", checkFindMissingBlobs},
+	{"batch_update_and_read", "Blobs uploaded with BatchUpdateBlobs can be read back with BatchReadBlobs.", checkBatchUpdateAndRead},
+	{"batch_read_missing", "BatchReadBlobs returns NOT_FOUND for each missing blob, without failing the whole request.", checkBatchReadMissing},
+	{"batch_update_digest_mismatch", "BatchUpdateBlobs returns INVALID_ARGUMENT for a blob that doesn't match its digest.", checkBatchUpdateDigestMismatch},
+	{"bytestream_write_and_read", "Blobs written with ByteStream.Write can be read back with ByteStream.Read and found in the CAS.", checkByteStreamWriteAndRead},
+	{"bytestream_read_offset", "ByteStream.Read honors the read offset and read limit.", checkByteStreamReadOffset},
+	{"bytestream_read_missing", "ByteStream.Read returns NOT_FOUND for a missing blob.", checkByteStreamReadMissing},
+	{"bytestream_write_existing", "ByteStream.Write of a blob that already exists reports its full size as committed.", checkByteStreamWriteExisting},
+	{"bytestream_write_digest_mismatch", "ByteStream.Write returns INVALID_ARGUMENT for data that doesn't match the digest.", checkByteStreamWriteDigestMismatch},
+	{"action_cache_miss", "GetActionResult returns NOT_FOUND for an action that isn't cached.", checkActionCacheMiss},
+	{"action_cache_update_and_get", "A result stored with UpdateActionResult is returned by GetActionResult.", checkActionCacheUpdateAndGet},
+	{"get_tree", "GetTree returns the root directory and all of its descendants.", checkGetTree},
+}
+
+// Run runs all conformance checks against the server at the other end of
+// the given connection.
+func Run(ctx context.Context, conn *grpc.ClientConn, opts *Options) []*Result {
+	c := &client{
+		instanceName: opts.InstanceName,
+		cap:          repb.NewCapabilitiesClient(conn),
+		cas:          repb.NewContentAddressableStorageClient(conn),
+		ac:           repb.NewActionCacheClient(conn),
+		bs:           bspb.NewByteStreamClient(conn),
+	}
+	results := make([]*Result, 0, len(checks))
+	for _, chk := range checks {
+		start := time.Now()
+		r := &Result{Name: chk.name, Requirement: chk.requirement, KnownFailure: opts.KnownFailures[chk.name]}
+		if err := chk.run(ctx, c); err != nil {
+			r.Failure = err.Error()
+		}
+		r.Duration = time.Since(start)
+		results = append(results, r)
+	}
+	return results
+}
+
+// RunTest runs all conformance checks as subtests of the given test, which
+// fail for each check that the server unexpectedly fails or passes. The
+// results are also written as JSON to the test's undeclared outputs
+// directory, if Bazel provides one.
+func RunTest(t *testing.T, conn *grpc.ClientConn, opts *Options) []*Result {
+	results := Run(context.Background(), conn, opts)
+	for _, r := range results {
+		r := r
+		t.Run(r.Name, func(t *testing.T) {
+			switch {
+			case r.Passed() && r.KnownFailure != "":
+				t.Errorf("%s\nThe check passed, but is listed as a known failure (%s).", r.Requirement, r.KnownFailure)
+			case !r.Passed() && r.KnownFailure != "":
+				t.Logf("Known failure (%s): %s", r.KnownFailure, r.Failure)
+			case !r.Passed():
+				t.Errorf("%s\n%s", r.Requirement, r.Failure)
+			}
+		})
+	}
+	if dir := os.Getenv("TEST_UNDECLARED_OUTPUTS_DIR"); dir != "" {
+		if err := WriteReport(filepath.Join(dir, reportFileName), results); err != nil {
+			t.Errorf("Failed to write conformance report: %s", err)
+		}
+	}
+	return results
+}
+
+// WriteReport writes the given results as JSON to the given path.
+func WriteReport(path string, results []*Result) error {
+	b, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+type client struct {
+	instanceName string
+	cap          repb.CapabilitiesClient
+	cas          repb.ContentAddressableStorageClient
+	ac           repb.ActionCacheClient
+	bs           bspb.ByteStreamClient
+}
+
+// newBlob returns a blob that no other check, or earlier run, has uploaded.
+func newBlob() ([]byte, *repb.Digest) {
+	data := []byte("reapi-conformance-" + guuid.New().String())
+	d, err := digest.Compute(bytes.NewReader(data))
+	if err != nil {
+		// Computing the digest of an in-memory buffer can't fail.
+		panic(err)
+	}
+	return data, d
+}
+
+// The resource names are built as described by the spec rather than with the
+// digest package, so that the checks don't depend on the code they check.
+func (c *client) downloadResourceName(d *repb.Digest) string {
+	return c.resourceName(fmt.Sprintf("blobs/%s/%d", d.GetHash(), d.GetSizeBytes()))
+}
+
+func (c *client) uploadResourceName(d *repb.Digest) string {
+	return c.resourceName(fmt.Sprintf("uploads/%s/blobs/%s/%d", guuid.New().String(), d.GetHash(), d.GetSizeBytes()))
+}
+
+func (c *client) resourceName(suffix string) string {
+	if c.instanceName == "" {
+		return suffix
+	}
+	return strings.TrimSuffix(c.instanceName, "/") + "/" + suffix
+}
+
+func (c *client) upload(ctx context.Context, blobs ...[]byte) ([]*repb.Digest, error) {
+	req := &repb.BatchUpdateBlobsRequest{InstanceName: c.instanceName}
+	var digests []*repb.Digest
+	for _, data := range blobs {
+		d, err := digest.Compute(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		digests = append(digests, d)
+		req.Requests = append(req.Requests, &repb.BatchUpdateBlobsRequest_Request{Digest: d, Data: data})
+	}
+	rsp, err := c.cas.BatchUpdateBlobs(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("BatchUpdateBlobs failed: %s", err)
+	}
+	for _, r := range rsp.GetResponses() {
+		if code := codes.Code(r.GetStatus().GetCode()); code != codes.OK {
+			return nil, fmt.Errorf("BatchUpdateBlobs failed for %s: %s", r.GetDigest().GetHash(), code)
+		}
+	}
+	return digests, nil
+}
+
+func (c *client) write(ctx context.Context, resourceName string, data []byte) (*bspb.WriteResponse, error) {
+	stream, err := c.bs.Write(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = stream.Send(&bspb.WriteRequest{
+		ResourceName: resourceName,
+		Data:         data,
+		FinishWrite:  true,
+	})
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	// If the server ended the stream early, its status is returned here.
+	return stream.CloseAndRecv()
+}
+
+func (c *client) read(ctx context.Context, req *bspb.ReadRequest) ([]byte, error) {
+	stream, err := c.bs.Read(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for {
+		rsp, err := stream.Recv()
+		if err == io.EOF {
+			return buf.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(rsp.GetData())
+	}
+}
+
+func expectCode(err error, want codes.Code) error {
+	if got := gstatus.Code(err); got != want {
+		return fmt.Errorf("expected %s, got %s (%v)", want, got, err)
+	}
+	return nil
+}
+
+func checkCapabilities(ctx context.Context, c *client) error {
+	rsp, err := c.cap.GetCapabilities(ctx, &repb.GetCapabilitiesRequest{InstanceName: c.instanceName})
+	if err != nil {
+		return fmt.Errorf("GetCapabilities failed: %s", err)
+	}
+	cc := rsp.GetCacheCapabilities()
+	if cc == nil {
+		return fmt.Errorf("no cache capabilities were returned")
+	}
+	hasSHA256 := false
+	for _, f := range cc.GetDigestFunction() {
+		if f == repb.DigestFunction_SHA256 {
+			hasSHA256 = true
+		}
+	}
+	if !hasSHA256 {
+		return fmt.Errorf("SHA256 is not a supported digest function: %v", cc.GetDigestFunction())
+	}
+	if rsp.GetLowApiVersion().GetMajor() > 2 || rsp.GetHighApiVersion().GetMajor() < 2 {
+		return fmt.Errorf("API version 2 is not supported: low %v, high %v", rsp.GetLowApiVersion(), rsp.GetHighApiVersion())
+	}
+	return nil
+}
+
+func checkFindMissingBlobs(ctx context.Context, c *client) error {
+	present, _ := newBlob()
+	digests, err := c.upload(ctx, present)
+	if err != nil {
+		return err
+	}
+	_, missing := newBlob()
+	rsp, err := c.cas.FindMissingBlobs(ctx, &repb.FindMissingBlobsRequest{
+		InstanceName: c.instanceName,
+		BlobDigests:  []*repb.Digest{digests[0], missing},
+	})
+	if err != nil {
+		return fmt.Errorf("FindMissingBlobs failed: %s", err)
+	}
+	if len(rsp.GetMissingBlobDigests()) != 1 || !proto.Equal(rsp.GetMissingBlobDigests()[0], missing) {
+		return fmt.Errorf("expected only %s to be missing, got %v", missing.GetHash(), rsp.GetMissingBlobDigests())
+	}
+	return nil
+}
+
+func checkBatchUpdateAndRead(ctx context.Context, c *client) error {
+	data1, _ := newBlob()
+	data2, _ := newBlob()
+	digests, err := c.upload(ctx, data1, data2)
+	if err != nil {
+		return err
+	}
+	rsp, err := c.cas.BatchReadBlobs(ctx, &repb.BatchReadBlobsRequest{InstanceName: c.instanceName, Digests: digests})
+	if err != nil {
+		return fmt.Errorf("BatchReadBlobs failed: %s", err)
+	}
+	want := map[string][]byte{digests[0].GetHash(): data1, digests[1].GetHash(): data2}
+	if len(rsp.GetResponses()) != len(want) {
+		return fmt.Errorf("expected %d responses, got %d", len(want), len(rsp.GetResponses()))
+	}
+	for _, r := range rsp.GetResponses() {
+		if code := codes.Code(r.GetStatus().GetCode()); code != codes.OK {
+			return fmt.Errorf("reading %s failed: %s", r.GetDigest().GetHash(), code)
+		}
+		if !bytes.Equal(r.GetData(), want[r.GetDigest().GetHash()]) {
+			return fmt.Errorf("read the wrong data for %s", r.GetDigest().GetHash())
+		}
+	}
+	return nil
+}
+
+func checkBatchReadMissing(ctx context.Context, c *client) error {
+	_, missing := newBlob()
+	rsp, err := c.cas.BatchReadBlobs(ctx, &repb.BatchReadBlobsRequest{InstanceName: c.instanceName, Digests: []*repb.Digest{missing}})
+	if err != nil {
+		return fmt.Errorf("BatchReadBlobs failed: %s", err)
+	}
+	if len(rsp.GetResponses()) != 1 {
+		return fmt.Errorf("expected 1 response, got %d", len(rsp.GetResponses()))
+	}
+	if code := codes.Code(rsp.GetResponses()[0].GetStatus().GetCode()); code != codes.NotFound {
+		return fmt.Errorf("expected NotFound, got %s", code)
+	}
+	return nil
+}
+
+func checkBatchUpdateDigestMismatch(ctx context.Context, c *client) error {
+	_, d := newBlob()
+	other, _ := newBlob()
+	rsp, err := c.cas.BatchUpdateBlobs(ctx, &repb.BatchUpdateBlobsRequest{
+		InstanceName: c.instanceName,
+		Requests:     []*repb.BatchUpdateBlobsRequest_Request{{Digest: d, Data: other}},
+	})
+	if err != nil {
+		return fmt.Errorf("BatchUpdateBlobs failed: %s", err)
+	}
+	if len(rsp.GetResponses()) != 1 {
+		return fmt.Errorf("expected 1 response, got %d", len(rsp.GetResponses()))
+	}
+	if code := codes.Code(rsp.GetResponses()[0].GetStatus().GetCode()); code != codes.InvalidArgument {
+		return fmt.Errorf("expected InvalidArgument, got %s", code)
+	}
+	return nil
+}
+
+func checkByteStreamWriteAndRead(ctx context.Context, c *client) error {
+	data, d := newBlob()
+	rsp, err := c.write(ctx, c.uploadResourceName(d), data)
+	if err != nil {
+		return fmt.Errorf("Write failed: %s", err)
+	}
+	if rsp.GetCommittedSize() != d.GetSizeBytes() {
+		return fmt.Errorf("expected a committed size of %d, got %d", d.GetSizeBytes(), rsp.GetCommittedSize())
+	}
+	got, err := c.read(ctx, &bspb.ReadRequest{ResourceName: c.downloadResourceName(d)})
+	if err != nil {
+		return fmt.Errorf("Read failed: %s", err)
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("read %q, expected %q", got, data)
+	}
+	missing, err := c.cas.FindMissingBlobs(ctx, &repb.FindMissingBlobsRequest{InstanceName: c.instanceName, BlobDigests: []*repb.Digest{d}})
+	if err != nil {
+		return fmt.Errorf("FindMissingBlobs failed: %s", err)
+	}
+	if len(missing.GetMissingBlobDigests()) != 0 {
+		return fmt.Errorf("written blob is missing from the CAS")
+	}
+	return nil
+}
+
+func checkByteStreamReadOffset(ctx context.Context, c *client) error {
+	data, _ := newBlob()
+	digests, err := c.upload(ctx, data)
+	if err != nil {
+		return err
+	}
+	got, err := c.read(ctx, &bspb.ReadRequest{ResourceName: c.downloadResourceName(digests[0]), ReadOffset: 5, ReadLimit: 10})
+	if err != nil {
+		return fmt.Errorf("Read failed: %s", err)
+	}
+	if want := data[5:15]; !bytes.Equal(got, want) {
+		return fmt.Errorf("read %q, expected %q", got, want)
+	}
+	return nil
+}
+
+func checkByteStreamReadMissing(ctx context.Context, c *client) error {
+	_, d := newBlob()
+	_, err := c.read(ctx, &bspb.ReadRequest{ResourceName: c.downloadResourceName(d)})
+	return expectCode(err, codes.NotFound)
+}
+
+func checkByteStreamWriteExisting(ctx context.Context, c *client) error {
+	data, _ := newBlob()
+	digests, err := c.upload(ctx, data)
+	if err != nil {
+		return err
+	}
+	d := digests[0]
+	// Only send the first byte; the server may end the upload early since
+	// it already has the blob, but must report all of it as committed.
+	stream, err := c.bs.Write(ctx)
+	if err != nil {
+		return fmt.Errorf("Write failed: %s", err)
+	}
+	err = stream.Send(&bspb.WriteRequest{ResourceName: c.uploadResourceName(d), Data: data[:1]})
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("Write failed: %s", err)
+	}
+	if err == nil {
+		err = stream.Send(&bspb.WriteRequest{WriteOffset: 1, Data: data[1:], FinishWrite: true})
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("Write failed: %s", err)
+		}
+	}
+	rsp, err := stream.CloseAndRecv()
+	if err != nil {
+		return fmt.Errorf("Write failed: %s", err)
+	}
+	if rsp.GetCommittedSize() != d.GetSizeBytes() {
+		return fmt.Errorf("expected a committed size of %d, got %d", d.GetSizeBytes(), rsp.GetCommittedSize())
+	}
+	return nil
+}
+
+func checkByteStreamWriteDigestMismatch(ctx context.Context, c *client) error {
+	_, d := newBlob()
+	// Data of the same size as the digest, so that only its hash is wrong.
+	other, _ := newBlob()
+	_, err := c.write(ctx, c.uploadResourceName(d), other)
+	return expectCode(err, codes.InvalidArgument)
+}
+
+func checkActionCacheMiss(ctx context.Context, c *client) error {
+	_, d := newBlob()
+	_, err := c.ac.GetActionResult(ctx, &repb.GetActionResultRequest{InstanceName: c.instanceName, ActionDigest: d})
+	return expectCode(err, codes.NotFound)
+}
+
+func checkActionCacheUpdateAndGet(ctx context.Context, c *client) error {
+	stdout, _ := newBlob()
+	command := &repb.Command{Arguments: []string{"echo", string(stdout)}}
+	commandBytes, err := proto.Marshal(command)
+	if err != nil {
+		return err
+	}
+	commandDigests, err := c.upload(ctx, commandBytes)
+	if err != nil {
+		return err
+	}
+	actionBytes, err := proto.Marshal(&repb.Action{CommandDigest: commandDigests[0]})
+	if err != nil {
+		return err
+	}
+	// The spec requires the action and its command to be uploaded before
+	// its result.
+	actionDigests, err := c.upload(ctx, actionBytes)
+	if err != nil {
+		return err
+	}
+	outputDigests, err := c.upload(ctx, stdout)
+	if err != nil {
+		return err
+	}
+	result := &repb.ActionResult{
+		ExitCode:     0,
+		StdoutDigest: outputDigests[0],
+		OutputFiles:  []*repb.OutputFile{{Path: "out.txt", Digest: outputDigests[0]}},
+	}
+	_, err = c.ac.UpdateActionResult(ctx, &repb.UpdateActionResultRequest{
+		InstanceName: c.instanceName,
+		ActionDigest: actionDigests[0],
+		ActionResult: result,
+	})
+	if err != nil {
+		return fmt.Errorf("UpdateActionResult failed: %s", err)
+	}
+	got, err := c.ac.GetActionResult(ctx, &repb.GetActionResultRequest{InstanceName: c.instanceName, ActionDigest: actionDigests[0]})
+	if err != nil {
+		return fmt.Errorf("GetActionResult failed: %s", err)
+	}
+	if !proto.Equal(got.GetStdoutDigest(), result.GetStdoutDigest()) || len(got.GetOutputFiles()) != 1 || got.GetOutputFiles()[0].GetPath() != "out.txt" {
+		return fmt.Errorf("got action result %+v, expected %+v", got, result)
+	}
+	return nil
+}
+
+func checkGetTree(ctx context.Context, c *client) error {
+	file, _ := newBlob()
+	fileDigests, err := c.upload(ctx, file)
+	if err != nil {
+		return err
+	}
+	child := &repb.Directory{Files: []*repb.FileNode{{Name: "file.txt", Digest: fileDigests[0]}}}
+	childBytes, err := proto.Marshal(child)
+	if err != nil {
+		return err
+	}
+	childDigests, err := c.upload(ctx, childBytes)
+	if err != nil {
+		return err
+	}
+	root := &repb.Directory{Directories: []*repb.DirectoryNode{{Name: "child", Digest: childDigests[0]}}}
+	rootBytes, err := proto.Marshal(root)
+	if err != nil {
+		return err
+	}
+	rootDigests, err := c.upload(ctx, rootBytes)
+	if err != nil {
+		return err
+	}
+	stream, err := c.cas.GetTree(ctx, &repb.GetTreeRequest{InstanceName: c.instanceName, RootDigest: rootDigests[0]})
+	if err != nil {
+		return fmt.Errorf("GetTree failed: %s", err)
+	}
+	var dirs []*repb.Directory
+	for {
+		rsp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("GetTree failed: %s", err)
+		}
+		dirs = append(dirs, rsp.GetDirectories()...)
+	}
+	foundRoot, foundChild := false, false
+	for _, dir := range dirs {
+		foundRoot = foundRoot || proto.Equal(dir, root)
+		foundChild = foundChild || proto.Equal(dir, child)
+	}
+	if !foundRoot || !foundChild {
+		return fmt.Errorf("expected the root and child directories, got %d directories: %v", len(dirs), dirs)
+	}
+	return nil
+}
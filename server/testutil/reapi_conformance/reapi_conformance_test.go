@@ -0,0 +1,45 @@
+package reapi_conformance_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/action_cache_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/byte_stream_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/capabilities_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/content_addressable_storage_server"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/reapi_conformance"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/stretchr/testify/require"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+)
+
+func TestConformance(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	casServer, err := content_addressable_storage_server.NewContentAddressableStorageServer(te)
+	require.NoError(t, err)
+	bsServer, err := byte_stream_server.NewByteStreamServer(te)
+	require.NoError(t, err)
+	acServer, err := action_cache_server.NewActionCacheServer(te)
+	require.NoError(t, err)
+
+	grpcServer, runFunc := te.LocalGRPCServer()
+	repb.RegisterContentAddressableStorageServer(grpcServer, casServer)
+	bspb.RegisterByteStreamServer(grpcServer, bsServer)
+	repb.RegisterActionCacheServer(grpcServer, acServer)
+	repb.RegisterCapabilitiesServer(grpcServer, capabilities_server.NewCapabilitiesServer(te, true /*=supportCAS*/, false /*=supportRemoteExec*/))
+	go runFunc()
+	conn, err := te.LocalGRPCConn(context.Background())
+	require.NoError(t, err)
+
+	for _, instanceName := range []string{"", "conformance/instance"} {
+		t.Run("instance_name="+instanceName, func(t *testing.T) {
+			reapi_conformance.RunTest(t, conn, &reapi_conformance.Options{
+				InstanceName:  instanceName,
+				KnownFailures: reapi_conformance.KnownFailures,
+			})
+		})
+	}
+}
@@ -176,6 +176,8 @@ func (a *TestAuthenticator) AuthContextFromAPIKey(ctx context.Context, apiKey st
 	return context.WithValue(ctx, testAuthenticationHeader, a.testUsers[apiKey])
 }
 
+func (a *TestAuthenticator) InvalidateAPIKey(apiKey string) {}
+
 func (a *TestAuthenticator) WithAuthenticatedUser(ctx context.Context, userID string) (context.Context, error) {
 	userInfo, ok := a.testUsers[userID]
 	if !ok {
@@ -9,12 +9,14 @@ import (
 	"path/filepath"
 	"testing"
 	"text/template"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/invocationdb"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_cache"
 	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/fakeclock"
 	"github.com/buildbuddy-io/buildbuddy/server/util/db"
 	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_client"
 	"github.com/buildbuddy-io/buildbuddy/server/util/healthcheck"
@@ -89,6 +91,14 @@ func (te *TestEnv) LocalGRPCConn(ctx context.Context) (*grpc.ClientConn, error)
 	return grpc.DialContext(ctx, "bufnet", dialOptions...)
 }
 
+// UseFakeClock replaces the environment's clock with a fake one, stopped at
+// the current time, and returns it so that the test can advance it.
+func (te *TestEnv) UseFakeClock() *fakeclock.FakeClock {
+	c := fakeclock.New(time.Now())
+	te.SetClock(c)
+	return c
+}
+
 // GRPCServer starts a gRPC server with standard BuildBuddy filters that uses the given listener.
 func (te *TestEnv) GRPCServer(lis net.Listener) (*grpc.Server, func()) {
 	grpcOptions := []grpc.ServerOption{
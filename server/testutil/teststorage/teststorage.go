@@ -0,0 +1,353 @@
+// Package teststorage contains conformance tests that every Blobstore and
+// Cache implementation is expected to pass, so that backends can be swapped
+// without changing behavior. A backend's tests run them against freshly
+// constructed instances of the backend.
+package teststorage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	// The size of the objects written by the large object tests. This is
+	// bigger than the chunk sizes used by the cache and blobstore clients.
+	largeObjectSizeBytes = 16 * 1024 * 1024
+
+	concurrentWriters = 16
+)
+
+var objectSizes = []int64{1, 10, 1000, 100 * 1000, 1000 * 1000}
+
+func randomBytes(t testing.TB, n int) []byte {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	require.NoError(t, err)
+	return b
+}
+
+// RunBlobstoreTests runs the blobstore conformance tests, each against a
+// new Blobstore returned by newBlobstore.
+func RunBlobstoreTests(t *testing.T, newBlobstore func(t *testing.T) interfaces.Blobstore) {
+	ctx := context.Background()
+
+	t.Run("ReadAfterWrite", func(t *testing.T) {
+		bs := newBlobstore(t)
+		for _, size := range objectSizes {
+			name := fmt.Sprintf("read-after-write-%d", size)
+			data := randomBytes(t, int(size))
+			_, err := bs.WriteBlob(ctx, name, data)
+			require.NoError(t, err)
+
+			exists, err := bs.BlobExists(ctx, name)
+			require.NoError(t, err)
+			assert.True(t, exists, "%s should exist after being written", name)
+			got, err := bs.ReadBlob(ctx, name)
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(data, got), "%s should read back the bytes written", name)
+		}
+	})
+
+	t.Run("NestedNames", func(t *testing.T) {
+		bs := newBlobstore(t)
+		name := "group/2021/invocation/chunk-0"
+		_, err := bs.WriteBlob(ctx, name, []byte("nested"))
+		require.NoError(t, err)
+		got, err := bs.ReadBlob(ctx, name)
+		require.NoError(t, err)
+		assert.Equal(t, "nested", string(got))
+	})
+
+	t.Run("Overwrite", func(t *testing.T) {
+		bs := newBlobstore(t)
+		_, err := bs.WriteBlob(ctx, "overwrite", []byte("first version, which is longer"))
+		require.NoError(t, err)
+		_, err = bs.WriteBlob(ctx, "overwrite", []byte("second"))
+		require.NoError(t, err)
+		got, err := bs.ReadBlob(ctx, "overwrite")
+		require.NoError(t, err)
+		assert.Equal(t, "second", string(got), "the last write should win")
+	})
+
+	t.Run("EmptyBlob", func(t *testing.T) {
+		bs := newBlobstore(t)
+		_, err := bs.WriteBlob(ctx, "empty", []byte{})
+		require.NoError(t, err)
+		got, err := bs.ReadBlob(ctx, "empty")
+		require.NoError(t, err)
+		assert.Empty(t, got)
+	})
+
+	t.Run("MissingBlob", func(t *testing.T) {
+		bs := newBlobstore(t)
+		exists, err := bs.BlobExists(ctx, "missing")
+		require.NoError(t, err)
+		assert.False(t, exists)
+		_, err = bs.ReadBlob(ctx, "missing")
+		assert.True(t, status.IsNotFoundError(err), "reading a missing blob should return NotFound, got %v", err)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		bs := newBlobstore(t)
+		_, err := bs.WriteBlob(ctx, "deleted", []byte("data"))
+		require.NoError(t, err)
+		_, err = bs.WriteBlob(ctx, "kept", []byte("data"))
+		require.NoError(t, err)
+		require.NoError(t, bs.DeleteBlob(ctx, "deleted"))
+
+		exists, err := bs.BlobExists(ctx, "deleted")
+		require.NoError(t, err)
+		assert.False(t, exists)
+		_, err = bs.ReadBlob(ctx, "deleted")
+		assert.True(t, status.IsNotFoundError(err), "reading a deleted blob should return NotFound, got %v", err)
+		exists, err = bs.BlobExists(ctx, "kept")
+		require.NoError(t, err)
+		assert.True(t, exists, "deleting a blob should not affect others")
+	})
+
+	t.Run("LargeObject", func(t *testing.T) {
+		bs := newBlobstore(t)
+		data := randomBytes(t, largeObjectSizeBytes)
+		_, err := bs.WriteBlob(ctx, "large", data)
+		require.NoError(t, err)
+		got, err := bs.ReadBlob(ctx, "large")
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(data, got), "large blob should read back the bytes written")
+	})
+
+	t.Run("ConcurrentWriters", func(t *testing.T) {
+		bs := newBlobstore(t)
+		versions := make([][]byte, concurrentWriters)
+		for i := range versions {
+			versions[i] = randomBytes(t, 100*1000)
+		}
+		var eg errgroup.Group
+		for i := 0; i < concurrentWriters; i++ {
+			i := i
+			eg.Go(func() error {
+				// Each writer writes its own blob, and all of them write the
+				// same shared blob.
+				if _, err := bs.WriteBlob(ctx, fmt.Sprintf("writer-%d", i), versions[i]); err != nil {
+					return err
+				}
+				_, err := bs.WriteBlob(ctx, "shared", versions[i])
+				return err
+			})
+		}
+		require.NoError(t, eg.Wait())
+
+		for i := 0; i < concurrentWriters; i++ {
+			got, err := bs.ReadBlob(ctx, fmt.Sprintf("writer-%d", i))
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(versions[i], got), "writer-%d should read back the bytes written", i)
+		}
+		// Concurrent writes of the same blob must not interleave: it holds
+		// exactly one of the versions written.
+		got, err := bs.ReadBlob(ctx, "shared")
+		require.NoError(t, err)
+		matched := false
+		for _, v := range versions {
+			matched = matched || bytes.Equal(v, got)
+		}
+		assert.True(t, matched, "shared blob should hold one of the versions written")
+	})
+}
+
+// RunCacheTests runs the cache conformance tests, each against a new Cache
+// returned by newCache. The context is used for all cache operations, and
+// must be authorized to use the cache.
+func RunCacheTests(t *testing.T, ctx context.Context, newCache func(t *testing.T) interfaces.Cache) {
+	readAll := func(t *testing.T, c interfaces.Cache, d *repb.Digest, offset int64) []byte {
+		r, err := c.Reader(ctx, d, offset)
+		require.NoError(t, err)
+		defer r.Close()
+		b, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		return b
+	}
+
+	t.Run("ReadAfterWrite", func(t *testing.T) {
+		c := newCache(t)
+		for _, size := range objectSizes {
+			d, data := testdigest.NewRandomDigestBuf(t, size)
+			require.NoError(t, c.Set(ctx, d, data))
+
+			exists, err := c.Contains(ctx, d)
+			require.NoError(t, err)
+			assert.True(t, exists, "%s should exist after being written", d.GetHash())
+			got, err := c.Get(ctx, d)
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(data, got), "Get(%s) should return the bytes written", d.GetHash())
+			assert.True(t, bytes.Equal(data, readAll(t, c, d, 0)), "Reader(%s) should return the bytes written", d.GetHash())
+			assert.True(t, bytes.Equal(data[size/2:], readAll(t, c, d, size/2)), "Reader(%s) should start at the given offset", d.GetHash())
+		}
+	})
+
+	t.Run("WriterThenRead", func(t *testing.T) {
+		c := newCache(t)
+		d, data := testdigest.NewRandomDigestBuf(t, 1000*1000)
+		w, err := c.Writer(ctx, d)
+		require.NoError(t, err)
+		// Write in several chunks, as the ByteStream server does.
+		for offset := 0; offset < len(data); offset += 64 * 1024 {
+			end := offset + 64*1024
+			if end > len(data) {
+				end = len(data)
+			}
+			_, err := w.Write(data[offset:end])
+			require.NoError(t, err)
+		}
+		require.NoError(t, w.Close())
+		got, err := c.Get(ctx, d)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(data, got), "Get should return the bytes streamed to Writer")
+	})
+
+	t.Run("MultiOperations", func(t *testing.T) {
+		c := newCache(t)
+		kvs := make(map[*repb.Digest][]byte)
+		for i := 0; i < 10; i++ {
+			d, data := testdigest.NewRandomDigestBuf(t, 100)
+			kvs[d] = data
+		}
+		require.NoError(t, c.SetMulti(ctx, kvs))
+		missing, _ := testdigest.NewRandomDigestBuf(t, 100)
+		digests := []*repb.Digest{missing}
+		for d := range kvs {
+			digests = append(digests, d)
+		}
+
+		found, err := c.ContainsMulti(ctx, digests)
+		require.NoError(t, err)
+		for d := range kvs {
+			assert.True(t, found[d], "ContainsMulti should find %s", d.GetHash())
+		}
+		assert.False(t, found[missing], "ContainsMulti should not find a missing digest")
+		got, err := c.GetMulti(ctx, digests)
+		require.NoError(t, err)
+		for d, data := range kvs {
+			assert.True(t, bytes.Equal(data, got[d]), "GetMulti should return the bytes written for %s", d.GetHash())
+		}
+		_, ok := got[missing]
+		assert.False(t, ok, "GetMulti should omit missing digests")
+	})
+
+	t.Run("Overwrite", func(t *testing.T) {
+		c := newCache(t)
+		// Action cache entries are keyed by the digest of the action, so the
+		// same digest may be written with different contents.
+		d, _ := testdigest.NewRandomDigestBuf(t, 100)
+		require.NoError(t, c.Set(ctx, d, []byte("first version, which is longer")))
+		require.NoError(t, c.Set(ctx, d, []byte("second")))
+		got, err := c.Get(ctx, d)
+		require.NoError(t, err)
+		assert.Equal(t, "second", string(got), "the last write should win")
+	})
+
+	t.Run("MissingDigest", func(t *testing.T) {
+		c := newCache(t)
+		d, _ := testdigest.NewRandomDigestBuf(t, 100)
+		exists, err := c.Contains(ctx, d)
+		require.NoError(t, err)
+		assert.False(t, exists)
+		_, err = c.Get(ctx, d)
+		assert.True(t, status.IsNotFoundError(err), "Get of a missing digest should return NotFound, got %v", err)
+		_, err = c.Reader(ctx, d, 0)
+		assert.True(t, status.IsNotFoundError(err), "Reader of a missing digest should return NotFound, got %v", err)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		c := newCache(t)
+		d, data := testdigest.NewRandomDigestBuf(t, 100)
+		require.NoError(t, c.Set(ctx, d, data))
+		require.NoError(t, c.Delete(ctx, d))
+		exists, err := c.Contains(ctx, d)
+		require.NoError(t, err)
+		assert.False(t, exists)
+		_, err = c.Get(ctx, d)
+		assert.True(t, status.IsNotFoundError(err), "Get of a deleted digest should return NotFound, got %v", err)
+	})
+
+	t.Run("PrefixIsolation", func(t *testing.T) {
+		c := newCache(t)
+		ac := c.WithPrefix("ac")
+		d, data := testdigest.NewRandomDigestBuf(t, 100)
+		require.NoError(t, ac.Set(ctx, d, data))
+		exists, err := c.WithPrefix("other").Contains(ctx, d)
+		require.NoError(t, err)
+		assert.False(t, exists, "entries should not be visible under another prefix")
+		got, err := c.WithPrefix("ac").Get(ctx, d)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(data, got), "entries should be visible to other caches with the same prefix")
+	})
+
+	t.Run("LargeObject", func(t *testing.T) {
+		c := newCache(t)
+		d, r := testdigest.NewRandomDigestReader(t, largeObjectSizeBytes)
+		w, err := c.Writer(ctx, d)
+		require.NoError(t, err)
+		_, err = io.Copy(w, r)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		_, err = r.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(data, readAll(t, c, d, 0)), "large object should read back the bytes written")
+	})
+
+	t.Run("ConcurrentWriters", func(t *testing.T) {
+		c := newCache(t)
+		d, data := testdigest.NewRandomDigestBuf(t, 100*1000)
+		var digests []*repb.Digest
+		var blobs [][]byte
+		for i := 0; i < concurrentWriters; i++ {
+			d, b := testdigest.NewRandomDigestBuf(t, 10*1000)
+			digests = append(digests, d)
+			blobs = append(blobs, b)
+		}
+		var eg errgroup.Group
+		for i := 0; i < concurrentWriters; i++ {
+			i := i
+			eg.Go(func() error {
+				// Clients often upload the same blob concurrently, so every
+				// writer also writes the shared digest.
+				if err := c.Set(ctx, digests[i], blobs[i]); err != nil {
+					return err
+				}
+				w, err := c.Writer(ctx, d)
+				if err != nil {
+					return err
+				}
+				if _, err := w.Write(data); err != nil {
+					return err
+				}
+				return w.Close()
+			})
+		}
+		require.NoError(t, eg.Wait())
+
+		for i, d := range digests {
+			got, err := c.Get(ctx, d)
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(blobs[i], got), "Get(%s) should return the bytes written", d.GetHash())
+		}
+		got, err := c.Get(ctx, d)
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(data, got), "concurrent writes of the same digest should not corrupt it")
+	})
+}
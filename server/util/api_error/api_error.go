@@ -0,0 +1,256 @@
+// Package api_error implements the error model of the external API.
+//
+// Every error returned by the API carries an ErrorInfo detail whose reason is
+// the name of an apipb.Error_Reason, so that clients can branch on the reason
+// instead of parsing messages. Its metadata says whether the request may be
+// retried, and a Help detail links to the documentation of the reasons.
+// Handlers attach specific reasons with New and the helpers below, and
+// Normalize, applied to every API response, fills in a reason derived from
+// the status code for errors which don't have one.
+package api_error
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/buildbuddy-io/buildbuddy/server/http/protolet"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+
+	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
+	gstatus "google.golang.org/grpc/status"
+)
+
+const (
+	// HelpURL documents the error reasons returned by the API.
+	HelpURL = "https://www.buildbuddy.io/docs/enterprise-api#errors"
+
+	// RetryableMetadataKey is the ErrorInfo metadata key which says whether
+	// the request may be retried, as "true" or "false".
+	RetryableMetadataKey = "retryable"
+
+	// CauseMetadataKey is the ErrorInfo metadata key holding the reason of an
+	// internal error detail that was replaced by an API reason.
+	CauseMetadataKey = "cause"
+)
+
+// New attaches the reason and metadata to err. The reason of the first call
+// wins, so that helpers deeper in the stack can be more specific than their
+// callers.
+func New(reason apipb.Error_Reason, err error, metadata map[string]string) error {
+	if err == nil || Reason(err) != apipb.Error_REASON_UNSPECIFIED {
+		return err
+	}
+	return status.WithErrorInfo(err, reason.String(), metadata)
+}
+
+// MissingFieldError returns an InvalidArgument error for a request which is
+// missing a required field.
+func MissingFieldError(field, msg string) error {
+	return New(apipb.Error_MISSING_FIELD, status.InvalidArgumentError(msg), map[string]string{"field": field})
+}
+
+// InvalidPageTokenError returns an InvalidArgument error for a page token
+// which can't be parsed.
+func InvalidPageTokenError() error {
+	return New(apipb.Error_INVALID_PAGE_TOKEN, status.InvalidArgumentError("Invalid pagination token"), nil)
+}
+
+// RequestTooLargeError returns an InvalidArgument error for a request which
+// is larger than the API accepts.
+func RequestTooLargeError(msg string) error {
+	return New(apipb.Error_REQUEST_TOO_LARGE, status.InvalidArgumentError(msg), nil)
+}
+
+// InvocationNotFoundError returns a NotFound error for an invocation which
+// doesn't exist or isn't visible to the caller.
+func InvocationNotFoundError(invocationID string) error {
+	err := status.NotFoundErrorf("Invocation %q not found", invocationID)
+	return New(apipb.Error_INVOCATION_NOT_FOUND, err, map[string]string{"invocation_id": invocationID})
+}
+
+// NotConfiguredError returns a FailedPrecondition error for a request which
+// the server isn't configured to handle.
+func NotConfiguredError(msg string) error {
+	return New(apipb.Error_NOT_CONFIGURED, status.FailedPreconditionError(msg), nil)
+}
+
+// MissingCapabilityError returns a PermissionDenied error for an API key
+// which lacks a capability the request requires.
+func MissingCapabilityError(capability, msg string) error {
+	return New(apipb.Error_MISSING_CAPABILITY, status.PermissionDeniedError(msg), map[string]string{"capability": capability})
+}
+
+// Reason returns the API reason attached to err, or REASON_UNSPECIFIED
+// if there is none.
+func Reason(err error) apipb.Error_Reason {
+	if ei := errorInfo(err); ei != nil && ei.GetDomain() == status.ErrorDomain {
+		return apipb.Error_Reason(apipb.Error_Reason_value[ei.GetReason()])
+	}
+	return apipb.Error_REASON_UNSPECIFIED
+}
+
+// Normalize returns err in the API's error model: with an ErrorInfo detail
+// holding an API reason, derived from the status code if none was attached,
+// whether the request is retryable, and a Help detail. An ErrorInfo with a
+// reason which isn't an API reason is replaced, keeping its reason as the
+// "cause" metadata. Other details, such as RetryInfo, are kept.
+func Normalize(err error) error {
+	if err == nil {
+		return nil
+	}
+	st := gstatus.Convert(err)
+	reason := Reason(err)
+	metadata := map[string]string{}
+	if ei := errorInfo(err); ei != nil {
+		for k, v := range ei.GetMetadata() {
+			metadata[k] = v
+		}
+		if reason == apipb.Error_REASON_UNSPECIFIED {
+			metadata[CauseMetadataKey] = ei.GetReason()
+		}
+	}
+	if reason == apipb.Error_REASON_UNSPECIFIED {
+		reason = reasonForCode(err)
+	}
+	metadata[RetryableMetadataKey] = strconv.FormatBool(status.IsRetryable(err))
+
+	details := []proto.Message{
+		&errdetails.ErrorInfo{
+			Reason:   reason.String(),
+			Domain:   status.ErrorDomain,
+			Metadata: metadata,
+		},
+		&errdetails.Help{
+			Links: []*errdetails.Help_Link{{
+				Description: "API error reasons",
+				Url:         HelpURL,
+			}},
+		},
+	}
+	for _, d := range st.Details() {
+		switch d.(type) {
+		case *errdetails.ErrorInfo, *errdetails.Help:
+			continue
+		}
+		if m, ok := d.(proto.Message); ok {
+			details = append(details, m)
+		}
+	}
+	normalized, detailsErr := gstatus.New(st.Code(), st.Message()).WithDetails(details...)
+	if detailsErr != nil {
+		// Only OK statuses can't have details, and those aren't errors.
+		return err
+	}
+	return normalized.Err()
+}
+
+// ToProto returns the REST representation of err.
+func ToProto(err error) *apipb.Error {
+	err = Normalize(err)
+	st := gstatus.Convert(err)
+	ei := errorInfo(err)
+	metadata := map[string]string{}
+	for k, v := range ei.GetMetadata() {
+		if k != RetryableMetadataKey {
+			metadata[k] = v
+		}
+	}
+	return &apipb.Error{
+		Code:      int32(st.Code()),
+		Message:   st.Message(),
+		Reason:    Reason(err),
+		Retryable: ei.GetMetadata()[RetryableMetadataKey] == "true",
+		HelpUrl:   HelpURL,
+		Metadata:  metadata,
+	}
+}
+
+// WriteHTTPError writes err to a REST API response, as an Error in the
+// request's content type with an HTTP status matching its code.
+func WriteHTTPError(w http.ResponseWriter, r *http.Request, err error) {
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(HTTPStatus(gstatus.Code(err)))
+	if err := protolet.WriteProtoToResponse(ToProto(err), w, r); err != nil {
+		w.Write([]byte(err.Error()))
+	}
+}
+
+// HTTPStatus returns the HTTP status code which corresponds to a gRPC code.
+func HTTPStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499 // Client Closed Request
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func reasonForCode(err error) apipb.Error_Reason {
+	switch gstatus.Code(err) {
+	case codes.Canceled:
+		return apipb.Error_CANCELLED
+	case codes.InvalidArgument, codes.OutOfRange:
+		return apipb.Error_INVALID_ARGUMENT
+	case codes.DeadlineExceeded:
+		return apipb.Error_DEADLINE_EXCEEDED
+	case codes.NotFound:
+		return apipb.Error_NOT_FOUND
+	case codes.AlreadyExists:
+		return apipb.Error_ALREADY_EXISTS
+	case codes.PermissionDenied:
+		return apipb.Error_PERMISSION_DENIED
+	case codes.Unauthenticated:
+		return apipb.Error_UNAUTHENTICATED
+	case codes.ResourceExhausted:
+		if len(status.QuotaFailureViolations(err)) > 0 {
+			return apipb.Error_QUOTA_EXCEEDED
+		}
+		return apipb.Error_RESOURCE_EXHAUSTED
+	case codes.FailedPrecondition:
+		return apipb.Error_FAILED_PRECONDITION
+	case codes.Unimplemented:
+		return apipb.Error_UNIMPLEMENTED
+	case codes.Unavailable, codes.Aborted:
+		return apipb.Error_UNAVAILABLE
+	default:
+		return apipb.Error_INTERNAL
+	}
+}
+
+func errorInfo(err error) *errdetails.ErrorInfo {
+	for _, d := range gstatus.Convert(err).Details() {
+		if ei, ok := d.(*errdetails.ErrorInfo); ok {
+			return ei
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package api_error_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/api_error"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
+)
+
+func TestNormalize_DerivesReasonFromCode(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		reason    apipb.Error_Reason
+		retryable bool
+	}{
+		{status.InvalidArgumentError("bad"), apipb.Error_INVALID_ARGUMENT, false},
+		{status.NotFoundError("missing"), apipb.Error_NOT_FOUND, false},
+		{status.UnauthenticatedError("no key"), apipb.Error_UNAUTHENTICATED, false},
+		{status.UnavailableError("down"), apipb.Error_UNAVAILABLE, true},
+		{status.ResourceExhaustedError("busy"), apipb.Error_RESOURCE_EXHAUSTED, true},
+		{status.WithQuotaFailure(status.ResourceExhaustedError("quota"), "group", "too many"), apipb.Error_QUOTA_EXCEEDED, false},
+		{status.WithRetryInfo(status.ResourceExhaustedError("slow down"), time.Second), apipb.Error_RESOURCE_EXHAUSTED, true},
+		{assert.AnError, apipb.Error_INTERNAL, false},
+	} {
+		pb := api_error.ToProto(tc.err)
+		assert.Equal(t, tc.reason, pb.GetReason(), "reason of %v", tc.err)
+		assert.Equal(t, tc.retryable, pb.GetRetryable(), "retryable of %v", tc.err)
+		assert.Equal(t, api_error.HelpURL, pb.GetHelpUrl())
+	}
+}
+
+func TestNormalize_KeepsSpecificReason(t *testing.T) {
+	err := api_error.MissingFieldError("invocation_id", "invocation_id is required")
+
+	err = api_error.Normalize(api_error.Normalize(err))
+
+	assert.True(t, status.IsInvalidArgumentError(err))
+	assert.Equal(t, apipb.Error_MISSING_FIELD, api_error.Reason(err))
+	pb := api_error.ToProto(err)
+	assert.Equal(t, "invocation_id is required", pb.GetMessage())
+	assert.Equal(t, map[string]string{"field": "invocation_id"}, pb.GetMetadata())
+}
+
+func TestNormalize_ReplacesInternalReason(t *testing.T) {
+	err := status.WithErrorInfo(status.FailedPreconditionError("too old"), "UNSUPPORTED_CLIENT_VERSION", map[string]string{"client_version": "1.0"})
+	err = status.WithRetryInfo(err, time.Minute)
+
+	err = api_error.Normalize(err)
+
+	assert.Equal(t, "FAILED_PRECONDITION", status.ErrorReason(err))
+	pb := api_error.ToProto(err)
+	assert.Equal(t, apipb.Error_FAILED_PRECONDITION, pb.GetReason())
+	assert.Equal(t, "UNSUPPORTED_CLIENT_VERSION", pb.GetMetadata()[api_error.CauseMetadataKey])
+	assert.Equal(t, "1.0", pb.GetMetadata()["client_version"])
+	delay, ok := status.RetryDelay(err)
+	require.True(t, ok, "RetryInfo should be kept")
+	assert.Equal(t, time.Minute, delay)
+}
+
+func TestNew_FirstReasonWins(t *testing.T) {
+	err := api_error.InvocationNotFoundError("abc")
+
+	err = api_error.New(apipb.Error_NOT_FOUND, err, nil)
+
+	assert.Equal(t, apipb.Error_INVOCATION_NOT_FOUND, api_error.Reason(err))
+	assert.Nil(t, api_error.New(apipb.Error_INTERNAL, nil, nil))
+	assert.Nil(t, api_error.Normalize(nil))
+}
+
+func TestWriteHTTPError(t *testing.T) {
+	r := httptest.NewRequest("POST", "/api/v1/GetInvocation", nil)
+	w := httptest.NewRecorder()
+
+	api_error.WriteHTTPError(w, r, api_error.InvocationNotFoundError("abc"))
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	pb := &apipb.Error{}
+	require.NoError(t, jsonpb.Unmarshal(w.Body, pb))
+	assert.Equal(t, int32(codes.NotFound), pb.GetCode())
+	assert.Equal(t, apipb.Error_INVOCATION_NOT_FOUND, pb.GetReason())
+	assert.Equal(t, "abc", pb.GetMetadata()["invocation_id"])
+}
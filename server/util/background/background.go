@@ -3,6 +3,8 @@ package background
 import (
 	"context"
 	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/deadline"
 )
 
 type disconnectedContext struct {
@@ -28,7 +30,8 @@ func (ctx disconnectedContext) Value(key interface{}) interface{} {
 // other values stored in the context. For that, we have this beauty. Use it
 // to make a copy of your expired context and do your cleanup work.
 func ExtendContextForFinalization(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
-	ctx := disconnectedContext{parent: parent}
+	// Cleanup may run past the budget for the request's internal calls too.
+	ctx := disconnectedContext{parent: deadline.WithoutBudget(parent)}
 	// If the original context already had a deadline, ensure that the given timeout
 	// doesn't result in a new deadline that's even shorter.
 	if originalDeadline, ok := parent.Deadline(); ok {
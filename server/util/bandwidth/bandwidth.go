@@ -0,0 +1,232 @@
+// Package bandwidth limits the rate at which a process transfers blobs to and
+// from the remote cache's CAS, so that large transfers don't saturate a slow
+// link (such as an office uplink) and starve its other traffic, like the
+// build event stream.
+package bandwidth
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+)
+
+const (
+	uploadDirection   = "upload"
+	downloadDirection = "download"
+)
+
+var (
+	// The RPCs that transfer blobs to or from the CAS. Other RPCs, such as
+	// action cache lookups, are small and latency sensitive, so they aren't
+	// limited.
+	casMethodPrefixes = []string{
+		"/google.bytestream.ByteStream/",
+		"/build.bazel.remote.execution.v2.ContentAddressableStorage/",
+	}
+)
+
+// Limiter is a token bucket which limits the number of bytes transferred per
+// second. Up to one second's worth of bytes may be transferred in a burst.
+// A nil Limiter doesn't limit anything.
+type Limiter struct {
+	bytesPerSecond float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a Limiter which allows the given number of bytes per
+// second, or nil if the number isn't positive.
+func NewLimiter(bytesPerSecond int64) *Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &Limiter{
+		bytesPerSecond: float64(bytesPerSecond),
+		tokens:         float64(bytesPerSecond),
+		last:           time.Now(),
+	}
+}
+
+// WaitN blocks until n more bytes may be transferred. Transfers larger than
+// the burst size are allowed, but the next transfer waits for them to be paid
+// back.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.bytesPerSecond
+	if l.tokens > l.bytesPerSecond {
+		l.tokens = l.bytesPerSecond
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	wait := time.Duration(0)
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.bytesPerSecond * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func isCASMethod(method string) bool {
+	for _, prefix := range casMethodPrefixes {
+		if strings.HasPrefix(method, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// wait waits on the limiter and records how long the transfer was throttled.
+func wait(ctx context.Context, l *Limiter, direction string, n int) error {
+	if l == nil {
+		return nil
+	}
+	start := time.Now()
+	err := l.WaitN(ctx, n)
+	if d := time.Since(start); d > time.Millisecond {
+		metrics.CacheClientThrottledDurationUsec.With(prometheus.Labels{
+			metrics.TransferDirectionLabel: direction,
+		}).Add(float64(d.Microseconds()))
+	}
+	return err
+}
+
+// transfer tracks the bytes transferred by a single RPC, to record its
+// throughput once it's done. Messages may be sent and received concurrently,
+// so the byte counts are updated atomically.
+type transfer struct {
+	start         time.Time
+	sentBytes     int64
+	receivedBytes int64
+	once          sync.Once
+}
+
+func (t *transfer) done() {
+	t.once.Do(func() {
+		sent, received := atomic.LoadInt64(&t.sentBytes), atomic.LoadInt64(&t.receivedBytes)
+		direction, size := uploadDirection, sent
+		if received > sent {
+			direction, size = downloadDirection, received
+		}
+		duration := time.Since(t.start)
+		if size == 0 || duration <= 0 {
+			return
+		}
+		metrics.CacheClientTransferThroughputBytesPerSecond.With(prometheus.Labels{
+			metrics.TransferDirectionLabel: direction,
+		}).Observe(float64(size) / duration.Seconds())
+	})
+}
+
+// DialOptions returns the options which limit the CAS transfers made over a
+// connection to the given upload and download limiters, which may be nil, and
+// record the throughput of each transfer. Limiters may be shared by several
+// connections, to limit the process as a whole.
+func DialOptions(upload, download *Limiter) []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(unaryClientInterceptor(upload, download)),
+		grpc.WithChainStreamInterceptor(streamClientInterceptor(upload, download)),
+	}
+}
+
+func unaryClientInterceptor(upload, download *Limiter) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if !isCASMethod(method) {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		t := &transfer{start: time.Now()}
+		if m, ok := req.(proto.Message); ok {
+			t.sentBytes = int64(proto.Size(m))
+			if err := wait(ctx, upload, uploadDirection, int(t.sentBytes)); err != nil {
+				return err
+			}
+		}
+		if err := invoker(ctx, method, req, reply, cc, opts...); err != nil {
+			return err
+		}
+		if m, ok := reply.(proto.Message); ok {
+			t.receivedBytes = int64(proto.Size(m))
+		}
+		t.done()
+		// The reply was already received, but waiting here delays the
+		// caller's next download, which keeps the average rate in check.
+		return wait(ctx, download, downloadDirection, int(t.receivedBytes))
+	}
+}
+
+func streamClientInterceptor(upload, download *Limiter) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil || !isCASMethod(method) {
+			return stream, err
+		}
+		return &limitedClientStream{
+			ClientStream: stream,
+			upload:       upload,
+			download:     download,
+			// Client-streaming RPCs, like ByteStream.Write, are done once
+			// their only response is received; others once the response
+			// stream ends.
+			singleResponse: desc.ClientStreams && !desc.ServerStreams,
+			transfer:       &transfer{start: time.Now()},
+		}, nil
+	}
+}
+
+type limitedClientStream struct {
+	grpc.ClientStream
+	upload         *Limiter
+	download       *Limiter
+	singleResponse bool
+	transfer       *transfer
+}
+
+func (s *limitedClientStream) SendMsg(m interface{}) error {
+	if msg, ok := m.(proto.Message); ok {
+		n := proto.Size(msg)
+		atomic.AddInt64(&s.transfer.sentBytes, int64(n))
+		if err := wait(s.Context(), s.upload, uploadDirection, n); err != nil {
+			return err
+		}
+	}
+	return s.ClientStream.SendMsg(m)
+}
+
+func (s *limitedClientStream) RecvMsg(m interface{}) error {
+	if err := s.ClientStream.RecvMsg(m); err != nil {
+		s.transfer.done()
+		return err
+	}
+	n := 0
+	if msg, ok := m.(proto.Message); ok {
+		n = proto.Size(msg)
+		atomic.AddInt64(&s.transfer.receivedBytes, int64(n))
+	}
+	if s.singleResponse {
+		s.transfer.done()
+	}
+	return wait(s.Context(), s.download, downloadDirection, n)
+}
@@ -0,0 +1,43 @@
+package bandwidth_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/bandwidth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNilLimiter(t *testing.T) {
+	assert.Nil(t, bandwidth.NewLimiter(0))
+	var l *bandwidth.Limiter
+	assert.NoError(t, l.WaitN(context.Background(), 1e9))
+}
+
+func TestWaitN(t *testing.T) {
+	ctx := context.Background()
+	l := bandwidth.NewLimiter(10000)
+
+	// A second's worth of bytes may be transferred right away.
+	start := time.Now()
+	assert.NoError(t, l.WaitN(ctx, 10000))
+	assert.Less(t, int64(time.Since(start)), int64(50*time.Millisecond))
+
+	// After that, 1000 more bytes take about 100ms.
+	start = time.Now()
+	assert.NoError(t, l.WaitN(ctx, 1000))
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(80*time.Millisecond))
+}
+
+func TestWaitNCanceled(t *testing.T) {
+	l := bandwidth.NewLimiter(1000)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	assert.NoError(t, l.WaitN(ctx, 1000))
+	// Ten more seconds' worth of bytes would outlast the context.
+	start := time.Now()
+	assert.Error(t, l.WaitN(ctx, 10000))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
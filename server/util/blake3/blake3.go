@@ -0,0 +1,258 @@
+// Package blake3 implements the BLAKE3 hash function with its default 32 byte
+// output, as specified by https://github.com/BLAKE3-team/BLAKE3-specs.
+//
+// Only the regular hashing mode is supported (not keyed hashing or key
+// derivation), and input is hashed one chunk at a time, without SIMD.
+package blake3
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+const (
+	// Size is the size of a BLAKE3 hash in bytes.
+	Size = 32
+	// BlockSize is the block size of BLAKE3 in bytes.
+	BlockSize = 64
+
+	chunkLen = 1024
+
+	flagChunkStart = 1 << 0
+	flagChunkEnd   = 1 << 1
+	flagParent     = 1 << 2
+	flagRoot       = 1 << 3
+)
+
+var iv = [8]uint32{
+	0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A,
+	0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19,
+}
+
+var msgPermutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func g(s *[16]uint32, a, b, c, d int, mx, my uint32) {
+	s[a] = s[a] + s[b] + mx
+	s[d] = bits.RotateLeft32(s[d]^s[a], -16)
+	s[c] = s[c] + s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -12)
+	s[a] = s[a] + s[b] + my
+	s[d] = bits.RotateLeft32(s[d]^s[a], -8)
+	s[c] = s[c] + s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -7)
+}
+
+func round(s *[16]uint32, m *[16]uint32) {
+	// Mix the columns.
+	g(s, 0, 4, 8, 12, m[0], m[1])
+	g(s, 1, 5, 9, 13, m[2], m[3])
+	g(s, 2, 6, 10, 14, m[4], m[5])
+	g(s, 3, 7, 11, 15, m[6], m[7])
+	// Mix the diagonals.
+	g(s, 0, 5, 10, 15, m[8], m[9])
+	g(s, 1, 6, 11, 12, m[10], m[11])
+	g(s, 2, 7, 8, 13, m[12], m[13])
+	g(s, 3, 4, 9, 14, m[14], m[15])
+}
+
+func compress(cv *[8]uint32, block *[16]uint32, counter uint64, blockLen, flags uint32) [16]uint32 {
+	s := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		iv[0], iv[1], iv[2], iv[3],
+		uint32(counter), uint32(counter >> 32), blockLen, flags,
+	}
+	m := *block
+	for r := 0; r < 7; r++ {
+		round(&s, &m)
+		if r < 6 {
+			var permuted [16]uint32
+			for i, j := range msgPermutation {
+				permuted[i] = m[j]
+			}
+			m = permuted
+		}
+	}
+	for i := 0; i < 8; i++ {
+		s[i] ^= s[i+8]
+		s[i+8] ^= cv[i]
+	}
+	return s
+}
+
+func wordsFromBlock(b *[BlockSize]byte) [16]uint32 {
+	var words [16]uint32
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+	return words
+}
+
+// output is the input to the final compression of a node of the hash tree,
+// from which either its chaining value or, for the root, the hash is
+// computed.
+type output struct {
+	inputCV  [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+func (o *output) chainingValue() [8]uint32 {
+	s := compress(&o.inputCV, &o.block, o.counter, o.blockLen, o.flags)
+	var cv [8]uint32
+	copy(cv[:], s[:8])
+	return cv
+}
+
+func (o *output) rootHash() [Size]byte {
+	// The root's output counter is the index of the output block, which is
+	// always 0 for the default output size.
+	s := compress(&o.inputCV, &o.block, 0, o.blockLen, o.flags|flagRoot)
+	var sum [Size]byte
+	for i := 0; i < 8; i++ {
+		binary.LittleEndian.PutUint32(sum[4*i:], s[i])
+	}
+	return sum
+}
+
+func parentOutput(left, right [8]uint32) *output {
+	o := &output{inputCV: iv, blockLen: BlockSize, flags: flagParent}
+	copy(o.block[:8], left[:])
+	copy(o.block[8:], right[:])
+	return o
+}
+
+// chunkState holds the state of hashing a chunk of up to chunkLen bytes of
+// the input.
+type chunkState struct {
+	cv               [8]uint32
+	counter          uint64
+	block            [BlockSize]byte
+	blockLen         int
+	blocksCompressed int
+}
+
+func newChunkState(counter uint64) chunkState {
+	return chunkState{cv: iv, counter: counter}
+}
+
+func (c *chunkState) len() int {
+	return BlockSize*c.blocksCompressed + c.blockLen
+}
+
+func (c *chunkState) startFlag() uint32 {
+	if c.blocksCompressed == 0 {
+		return flagChunkStart
+	}
+	return 0
+}
+
+func (c *chunkState) update(p []byte) {
+	for len(p) > 0 {
+		// The last block of the chunk is only compressed by output, as it
+		// needs the chunk end flag, so a full block is only compressed once
+		// more input arrives.
+		if c.blockLen == BlockSize {
+			words := wordsFromBlock(&c.block)
+			s := compress(&c.cv, &words, c.counter, BlockSize, c.startFlag())
+			copy(c.cv[:], s[:8])
+			c.blocksCompressed++
+			c.block = [BlockSize]byte{}
+			c.blockLen = 0
+		}
+		n := copy(c.block[c.blockLen:], p)
+		c.blockLen += n
+		p = p[n:]
+	}
+}
+
+func (c *chunkState) output() *output {
+	return &output{
+		inputCV:  c.cv,
+		block:    wordsFromBlock(&c.block),
+		counter:  c.counter,
+		blockLen: uint32(c.blockLen),
+		flags:    c.startFlag() | flagChunkEnd,
+	}
+}
+
+// digest is a hash.Hash computing BLAKE3 hashes.
+type digest struct {
+	chunk chunkState
+	// The chaining values of the complete subtrees to the left of the
+	// current chunk, largest first.
+	cvStack [][8]uint32
+}
+
+// New returns a hash.Hash computing the BLAKE3 hash of its input.
+func New() hash.Hash {
+	d := &digest{}
+	d.Reset()
+	return d
+}
+
+// Sum256 returns the BLAKE3 hash of data.
+func Sum256(data []byte) [Size]byte {
+	d := &digest{}
+	d.Reset()
+	d.Write(data)
+	return d.sum()
+}
+
+func (d *digest) Reset() {
+	d.chunk = newChunkState(0)
+	d.cvStack = d.cvStack[:0]
+}
+
+func (d *digest) Size() int { return Size }
+
+func (d *digest) BlockSize() int { return BlockSize }
+
+func (d *digest) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// A full chunk is only added to the tree once more input arrives, as
+		// the last chunk is the root if it is the only one.
+		if d.chunk.len() == chunkLen {
+			cv := d.chunk.output().chainingValue()
+			totalChunks := d.chunk.counter + 1
+			d.addChunkChainingValue(cv, totalChunks)
+			d.chunk = newChunkState(totalChunks)
+		}
+		want := chunkLen - d.chunk.len()
+		if want > len(p) {
+			want = len(p)
+		}
+		d.chunk.update(p[:want])
+		p = p[want:]
+	}
+	return n, nil
+}
+
+// addChunkChainingValue adds the chaining value of a completed chunk to the
+// tree, merging it with the subtrees that it completes: one for each trailing
+// zero bit of the total number of chunks.
+func (d *digest) addChunkChainingValue(cv [8]uint32, totalChunks uint64) {
+	for totalChunks&1 == 0 {
+		left := d.cvStack[len(d.cvStack)-1]
+		d.cvStack = d.cvStack[:len(d.cvStack)-1]
+		cv = parentOutput(left, cv).chainingValue()
+		totalChunks >>= 1
+	}
+	d.cvStack = append(d.cvStack, cv)
+}
+
+func (d *digest) sum() [Size]byte {
+	o := d.chunk.output()
+	for i := len(d.cvStack) - 1; i >= 0; i-- {
+		o = parentOutput(d.cvStack[i], o.chainingValue())
+	}
+	return o.rootHash()
+}
+
+func (d *digest) Sum(b []byte) []byte {
+	sum := d.sum()
+	return append(b, sum[:]...)
+}
@@ -0,0 +1,68 @@
+package blake3
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// input returns the input of the official test vectors: the repeating byte
+// sequence 0, 1, ..., 250.
+func input(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+func TestSum256(t *testing.T) {
+	for _, tc := range []struct {
+		input []byte
+		want  string
+	}{
+		{[]byte{}, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+		{[]byte("abc"), "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"},
+		{input(1), "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213"},
+		{input(1023), "10108970eeda3eb932baac1428c7a2163b0e924c9a9e25b35bba72b28f70bd11"},
+		{input(1024), "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+		{input(1025), "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+		{input(2048), "e776b6028c7cd22a4d0ba182a8bf62205d2ef576467e838ed6f2529b85fba24a"},
+		{input(2049), "5f4d72f40d7a5f82b15ca2b2e44b1de3c2ef86c426c95c1af0b6879522563030"},
+		{input(3072), "b98cb0ff3623be03326b373de6b9095218513e64f1ee2edd2525c7ad1e5cffd2"},
+	} {
+		sum := Sum256(tc.input)
+		assert.Equal(t, tc.want, hex.EncodeToString(sum[:]), "input of %d bytes", len(tc.input))
+	}
+}
+
+func TestWriteInPieces(t *testing.T) {
+	data := input(10*chunkLen + 17)
+	want := Sum256(data)
+	for _, pieceSize := range []int{1, 63, 64, 65, 1023, 1024, 1025, 4096} {
+		h := New()
+		for i := 0; i < len(data); i += pieceSize {
+			end := i + pieceSize
+			if end > len(data) {
+				end = len(data)
+			}
+			h.Write(data[i:end])
+		}
+		assert.Equal(t, want[:], h.Sum(nil), "pieces of %d bytes", pieceSize)
+	}
+}
+
+func TestSumDoesNotChangeState(t *testing.T) {
+	h := New()
+	h.Write(input(3000))
+	first := h.Sum(nil)
+	assert.Equal(t, first, h.Sum(nil))
+	h.Write(input(5))
+	assert.NotEqual(t, first, h.Sum(nil))
+
+	h.Reset()
+	h.Write([]byte("abc"))
+	sum := Sum256([]byte("abc"))
+	assert.Equal(t, sum[:], h.Sum(nil))
+}
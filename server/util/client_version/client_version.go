@@ -0,0 +1,165 @@
+package client_version
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+const (
+	bazelToolName = "bazel"
+
+	// UnsupportedVersionReason is the ErrorInfo reason attached to errors
+	// returned to clients that are too old to be supported.
+	UnsupportedVersionReason = "CLIENT_VERSION_UNSUPPORTED"
+)
+
+// Version is a parsed Bazel version, such as "4.1.0" or "5.0.0-pre.20210708.4".
+type Version struct {
+	// Major, minor, and patch version numbers.
+	parts [3]int
+	// Any suffix following the version numbers, such as "-pre.20210708.4" or
+	// "rc1". Versions with a suffix are pre-releases, which sort before the
+	// corresponding release.
+	suffix string
+}
+
+// Parse parses a Bazel version. Missing minor and patch versions are treated
+// as zero.
+func Parse(s string) (*Version, error) {
+	v := &Version{}
+	rest := strings.TrimSpace(s)
+	for i := 0; i < len(v.parts); i++ {
+		end := 0
+		for end < len(rest) && rest[end] >= '0' && rest[end] <= '9' {
+			end++
+		}
+		if end == 0 {
+			if i == 0 {
+				return nil, status.InvalidArgumentErrorf("invalid version %q", s)
+			}
+			break
+		}
+		n, err := strconv.Atoi(rest[:end])
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid version %q", s)
+		}
+		v.parts[i] = n
+		rest = rest[end:]
+		if i < len(v.parts)-1 && strings.HasPrefix(rest, ".") && len(rest) > 1 && rest[1] >= '0' && rest[1] <= '9' {
+			rest = rest[1:]
+			continue
+		}
+		break
+	}
+	v.suffix = rest
+	return v, nil
+}
+
+// Compare returns -1, 0, or 1 if v is older than, the same as, or newer than
+// other, respectively.
+func (v *Version) Compare(other *Version) int {
+	for i := range v.parts {
+		if v.parts[i] != other.parts[i] {
+			if v.parts[i] < other.parts[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case v.suffix == other.suffix:
+		return 0
+	case v.suffix == "":
+		return 1
+	case other.suffix == "":
+		return -1
+	case v.suffix < other.suffix:
+		return -1
+	default:
+		return 1
+	}
+}
+
+func (v *Version) String() string {
+	return fmt.Sprintf("%d.%d.%d%s", v.parts[0], v.parts[1], v.parts[2], v.suffix)
+}
+
+// Policy determines which Bazel versions are supported.
+type Policy struct {
+	min         *Version
+	recommended *Version
+}
+
+// NewPolicy returns a policy which rejects Bazel versions older than
+// minVersion, and warns about versions older than recommendedVersion. Either
+// may be empty, in which case no versions are rejected or warned about,
+// respectively.
+func NewPolicy(minVersion, recommendedVersion string) (*Policy, error) {
+	p := &Policy{}
+	var err error
+	if minVersion != "" {
+		if p.min, err = Parse(minVersion); err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid min_bazel_version: %s", err)
+		}
+	}
+	if recommendedVersion != "" {
+		if p.recommended, err = Parse(recommendedVersion); err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid recommended_bazel_version: %s", err)
+		}
+	}
+	return p, nil
+}
+
+// NewPolicyFromConfig returns the policy configured by the app's
+// min_bazel_version and recommended_bazel_version options.
+func NewPolicyFromConfig(c *config.Configurator) (*Policy, error) {
+	return NewPolicy(c.GetAppMinBazelVersion(), c.GetAppRecommendedBazelVersion())
+}
+
+// Check checks whether the given Bazel version is allowed by the policy. It
+// returns a FailedPrecondition error if the version is too old to be
+// supported, and a warning message to be shown to the user if it is older
+// than recommended. Versions that can't be parsed, such as development
+// builds, are always allowed.
+func (p *Policy) Check(bazelVersion string) (string, error) {
+	if p == nil || bazelVersion == "" {
+		return "", nil
+	}
+	v, err := Parse(bazelVersion)
+	if err != nil {
+		return "", nil
+	}
+	if p.min != nil && v.Compare(p.min) < 0 {
+		err := status.FailedPreconditionErrorf("Bazel %s is no longer supported by this server. Please upgrade to Bazel %s or newer.", bazelVersion, p.min)
+		return "", status.WithErrorInfo(err, UnsupportedVersionReason, map[string]string{
+			"client_version":        bazelVersion,
+			"min_supported_version": p.min.String(),
+		})
+	}
+	if p.recommended != nil && v.Compare(p.recommended) < 0 {
+		return fmt.Sprintf("Bazel %s is deprecated and support for it will be removed. Please upgrade to Bazel %s or newer.", bazelVersion, p.recommended), nil
+	}
+	return "", nil
+}
+
+// IsDeprecated returns whether the given Bazel version is older than the
+// minimum or recommended version.
+func (p *Policy) IsDeprecated(bazelVersion string) bool {
+	warning, err := p.Check(bazelVersion)
+	return warning != "" || err != nil
+}
+
+// BazelVersion returns the Bazel version from a client version string of the
+// form "{tool_name}/{tool_version}", as reported in RequestMetadata, or "" if
+// the client is not Bazel.
+func BazelVersion(clientVersion string) string {
+	parts := strings.SplitN(clientVersion, "/", 2)
+	if len(parts) != 2 || parts[0] != bazelToolName {
+		return ""
+	}
+	return parts[1]
+}
@@ -0,0 +1,77 @@
+package client_version_test
+
+import (
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/client_version"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompare(t *testing.T) {
+	// Versions in ascending order.
+	versions := []string{
+		"3",
+		"3.7.2",
+		"4.0.0-pre.20201103.3",
+		"4.0.0rc1",
+		"4.0.0",
+		"4.1.0",
+		"4.10.0",
+		"5.0.0-pre.20210708.4",
+	}
+	for i := range versions {
+		for j := range versions {
+			a, err := client_version.Parse(versions[i])
+			require.NoError(t, err)
+			b, err := client_version.Parse(versions[j])
+			require.NoError(t, err)
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			assert.Equal(t, want, a.Compare(b), "Compare(%q, %q)", versions[i], versions[j])
+		}
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, v := range []string{"", "development version", "v4.1.0"} {
+		_, err := client_version.Parse(v)
+		assert.True(t, status.IsInvalidArgumentError(err), "Parse(%q)", v)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	p, err := client_version.NewPolicy("3.7.0", "4.0.0")
+	require.NoError(t, err)
+
+	warning, err := p.Check("3.6.0")
+	assert.True(t, status.IsFailedPreconditionError(err))
+	assert.Equal(t, client_version.UnsupportedVersionReason, status.ErrorReason(err))
+	assert.Empty(t, warning)
+
+	warning, err = p.Check("3.7.2")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, warning)
+	assert.True(t, p.IsDeprecated("3.7.2"))
+
+	for _, v := range []string{"4.0.0", "5.0.0-pre.20210708.4", "development version", ""} {
+		warning, err = p.Check(v)
+		assert.NoError(t, err)
+		assert.Empty(t, warning, "Check(%q)", v)
+		assert.False(t, p.IsDeprecated(v))
+	}
+
+	_, err = client_version.NewPolicy("latest", "")
+	assert.True(t, status.IsInvalidArgumentError(err))
+}
+
+func TestBazelVersion(t *testing.T) {
+	assert.Equal(t, "4.1.0", client_version.BazelVersion("bazel/4.1.0"))
+	assert.Equal(t, "", client_version.BazelVersion("grpc-go/1.38.0"))
+	assert.Equal(t, "", client_version.BazelVersion("bazel"))
+}
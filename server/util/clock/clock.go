@@ -0,0 +1,26 @@
+package clock
+
+import (
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+)
+
+type realClock struct{}
+
+// Real returns a clock which tells the system time.
+func Real() interfaces.Clock {
+	return realClock{}
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
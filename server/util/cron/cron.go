@@ -0,0 +1,177 @@
+// Package cron parses cron schedules, such as "0 3 * * *" for every day at
+// 3:00, and computes when they next occur.
+package cron
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+// How far ahead Next searches for a matching time. Schedules which never
+// match, such as "0 0 30 2 *", give up after this.
+const maxSearchYears = 5
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+type field struct {
+	name     string
+	min, max int
+}
+
+var fields = []field{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	// 7 is also accepted for Sunday, and folded into 0.
+	{"day of week", 0, 7},
+}
+
+// Schedule is a parsed cron schedule. Each field is a bitset of the values
+// that match.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// Whether the day of month and day of week fields were restricted, rather
+	// than "*". If both are, a day matches if either field matches, as in
+	// standard cron.
+	domRestricted, dowRestricted bool
+}
+
+// Parse parses a standard five-field cron expression ("minute hour
+// day-of-month month day-of-week"). Fields may be "*", numbers, ranges
+// ("1-5"), steps ("*/15", "0-30/10"), or comma-separated lists of these. The
+// macros "@hourly", "@daily", "@weekly", "@monthly", and "@yearly" are also
+// accepted.
+func Parse(spec string) (*Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if m, ok := macros[spec]; ok {
+		spec = m
+	}
+	parts := strings.Fields(spec)
+	if len(parts) != len(fields) {
+		return nil, status.InvalidArgumentErrorf("cron schedule %q must have %d fields", spec, len(fields))
+	}
+	bits := make([]uint64, len(fields))
+	for i, part := range parts {
+		b, err := parseField(part, fields[i])
+		if err != nil {
+			return nil, err
+		}
+		bits[i] = b
+	}
+	s := &Schedule{
+		minute:        bits[0],
+		hour:          bits[1],
+		dom:           bits[2],
+		month:         bits[3],
+		dow:           bits[4],
+		domRestricted: parts[2] != "*",
+		dowRestricted: parts[4] != "*",
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow = s.dow&^(1<<7) | 1
+	}
+	return s, nil
+}
+
+func parseField(s string, f field) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(s, ",") {
+		rangeStr, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n <= 0 {
+				return 0, status.InvalidArgumentErrorf("invalid step in cron %s field %q", f.name, item)
+			}
+			rangeStr, step = item[:i], n
+		}
+		lo, hi := f.min, f.max
+		if rangeStr != "*" {
+			var err error
+			if i := strings.Index(rangeStr, "-"); i >= 0 {
+				lo, err = parseValue(rangeStr[:i], f)
+				if err == nil {
+					hi, err = parseValue(rangeStr[i+1:], f)
+				}
+			} else {
+				lo, err = parseValue(rangeStr, f)
+				hi = lo
+				if step > 1 {
+					// "a/n" means every n starting at a.
+					hi = f.max
+				}
+			}
+			if err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, status.InvalidArgumentErrorf("invalid range in cron %s field %q", f.name, item)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseValue(s string, f field) (int, error) {
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, status.InvalidArgumentErrorf("cron %s must be between %d and %d, got %q", f.name, f.min, f.max, s)
+	}
+	return v, nil
+}
+
+func has(bits uint64, v int) bool {
+	return bits&(1<<uint(v)) != 0
+}
+
+func (s *Schedule) matchesDay(t time.Time) bool {
+	dom := has(s.dom, t.Day())
+	dow := has(s.dow, int(t.Weekday()))
+	if s.domRestricted && s.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// Next returns the first time after t that matches the schedule, in t's
+// location. It returns the zero time if the schedule never matches.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(maxSearchYears, 0, 0)
+	for t.Before(end) {
+		if !has(s.month, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !has(s.hour, t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if !has(s.minute, t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,61 @@
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/cron"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNext(t *testing.T) {
+	// A Wednesday.
+	start := time.Date(2021, 6, 16, 10, 30, 15, 0, time.UTC)
+	for _, tc := range []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2021, 6, 16, 10, 31, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2021, 6, 16, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2021, 6, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2021, 6, 17, 3, 0, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2021, 6, 16, 10, 40, 0, 0, time.UTC)},
+		{"5/20 10 * * *", time.Date(2021, 6, 16, 10, 45, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2021, 6, 16, 13, 0, 0, 0, time.UTC)},
+		{"0 0 * * 1,5", time.Date(2021, 6, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2021, 6, 20, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2021, 6, 20, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// If both the day of month and day of week are restricted, either
+		// one matching is enough.
+		{"0 0 1 * 5", time.Date(2021, 6, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		s, err := cron.Parse(tc.spec)
+		require.NoError(t, err, tc.spec)
+		assert.Equal(t, tc.want, s.Next(start), tc.spec)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"@every 5m",
+	} {
+		_, err := cron.Parse(spec)
+		assert.Error(t, err, spec)
+	}
+}
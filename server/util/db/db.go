@@ -25,6 +25,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/metrics"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/deadline"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 )
@@ -38,6 +39,9 @@ const (
 	gormStmtStartTimeKey             = "buildbuddy:op_start_time"
 	gormRecordOpStartTimeCallbackKey = "buildbuddy:record_op_start_time"
 	gormRecordMetricsCallbackKey     = "buildbuddy:record_metrics"
+	gormStmtCancelKey                = "buildbuddy:cancel"
+	gormApplyBudgetCallbackKey       = "buildbuddy:apply_deadline_budget"
+	gormReleaseBudgetCallbackKey     = "buildbuddy:release_deadline_budget"
 )
 
 var (
@@ -176,6 +180,53 @@ func instrumentGORM(gdb *gorm.DB) {
 	gdb.Callback().Update().After("*").Register(gormRecordMetricsCallbackKey, recordMetrics)
 }
 
+// enforceDeadlineBudgets makes queries run while serving a request use the
+// request's budget for internal calls as their deadline, and fail fast once it
+// has been spent.
+func enforceDeadlineBudgets(gdb *gorm.DB) {
+	applyBudget := func(db *gorm.DB) {
+		if db.DryRun || db.Statement == nil || db.Statement.Context == nil {
+			return
+		}
+		ctx, cancel, err := deadline.ForInternalCall(db.Statement.Context)
+		if err != nil {
+			db.AddError(err)
+			return
+		}
+		db.Statement.Context = ctx
+		db.Statement.Settings.Store(gormStmtCancelKey, cancel)
+	}
+	releaseBudget := func(db *gorm.DB) {
+		if db.Statement == nil {
+			return
+		}
+		if v, ok := db.Statement.Settings.LoadAndDelete(gormStmtCancelKey); ok {
+			v.(context.CancelFunc)()
+		}
+	}
+	gdb.Callback().Create().Before("*").Register(gormApplyBudgetCallbackKey, applyBudget)
+	gdb.Callback().Delete().Before("*").Register(gormApplyBudgetCallbackKey, applyBudget)
+	gdb.Callback().Query().Before("*").Register(gormApplyBudgetCallbackKey, applyBudget)
+	gdb.Callback().Raw().Before("*").Register(gormApplyBudgetCallbackKey, applyBudget)
+	gdb.Callback().Update().Before("*").Register(gormApplyBudgetCallbackKey, applyBudget)
+	gdb.Callback().Create().After("*").Register(gormReleaseBudgetCallbackKey, releaseBudget)
+	gdb.Callback().Delete().After("*").Register(gormReleaseBudgetCallbackKey, releaseBudget)
+	gdb.Callback().Query().After("*").Register(gormReleaseBudgetCallbackKey, releaseBudget)
+	gdb.Callback().Raw().After("*").Register(gormReleaseBudgetCallbackKey, releaseBudget)
+	gdb.Callback().Update().After("*").Register(gormReleaseBudgetCallbackKey, releaseBudget)
+
+	// Rows are read after the Row callbacks return, so their context can't be
+	// cancelled there. Only fail fast if the budget has already been spent.
+	gdb.Callback().Row().Before("*").Register(gormApplyBudgetCallbackKey, func(db *gorm.DB) {
+		if db.DryRun || db.Statement == nil || db.Statement.Context == nil {
+			return
+		}
+		if err := deadline.Check(db.Statement.Context); err != nil {
+			db.AddError(err)
+		}
+	})
+}
+
 func openDB(configurator *config.Configurator, dialect string, connString string) (*gorm.DB, error) {
 	var dialector gorm.Dialector
 	switch dialect {
@@ -206,6 +257,7 @@ func openDB(configurator *config.Configurator, dialect string, connString string
 	}
 
 	instrumentGORM(gdb)
+	enforceDeadlineBudgets(gdb)
 
 	return gdb, nil
 }
@@ -0,0 +1,259 @@
+// Package deadline derives the deadlines of the internal calls made while
+// serving a request (to the blobstore, database, and backing cache) from the
+// deadline set by the client, so that no work is done after the client has
+// given up.
+//
+// When a request is received, WithBudget records the point by which internal
+// calls must finish, leaving the rest of the request's time to handle their
+// results. ForInternalCall then gives each internal call that deadline, or
+// fails fast once it has passed.
+package deadline
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+const (
+	budgetContextKey = "deadline.budget"
+
+	// MinBudget is the least time worth starting internal work with.
+	// Requests which arrive with less time than this remaining are rejected.
+	MinBudget = 10 * time.Millisecond
+)
+
+// WithBudget returns a context recording that internal calls made while
+// serving the request must finish once the given fraction of its remaining
+// time has passed. It returns a DeadlineExceeded error if the request has
+// less than MinBudget remaining. Contexts without a deadline are returned
+// unchanged.
+func WithBudget(ctx context.Context, fraction float64) (context.Context, error) {
+	d, ok := ctx.Deadline()
+	if !ok {
+		return ctx, nil
+	}
+	now := time.Now()
+	remaining := d.Sub(now)
+	if remaining < MinBudget {
+		return nil, status.DeadlineExceededErrorf("Request deadline is too close to be met (%s remaining)", remaining)
+	}
+	return context.WithValue(ctx, budgetContextKey, now.Add(time.Duration(float64(remaining)*fraction))), nil
+}
+
+// Budget returns the time by which internal calls made while serving the
+// request must finish, if the request has a budget.
+func Budget(ctx context.Context) (time.Time, bool) {
+	t, ok := ctx.Value(budgetContextKey).(time.Time)
+	return t, ok
+}
+
+// WithoutBudget returns a context for work which should continue after the
+// request's budget has been spent, such as cleanup.
+func WithoutBudget(ctx context.Context) context.Context {
+	if _, ok := Budget(ctx); !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, budgetContextKey, nil)
+}
+
+// Check returns a DeadlineExceeded error if the request's budget for internal
+// calls has been spent.
+func Check(ctx context.Context) error {
+	if budget, ok := Budget(ctx); ok && !time.Now().Before(budget) {
+		return status.DeadlineExceededError("Deadline for internal calls exceeded")
+	}
+	return nil
+}
+
+// ForInternalCall returns a context for an internal call made while serving a
+// request, with the request's budget as its deadline. It returns a
+// DeadlineExceeded error instead if the budget has been spent. If the request
+// has no budget, the context is returned unchanged.
+func ForInternalCall(ctx context.Context) (context.Context, context.CancelFunc, error) {
+	budget, ok := Budget(ctx)
+	if !ok {
+		return ctx, func() {}, nil
+	}
+	if err := Check(ctx); err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithDeadline(ctx, budget)
+	return ctx, cancel, nil
+}
+
+// budgetedBlobstore gives each blobstore call the request's budget.
+type budgetedBlobstore struct {
+	bs interfaces.Blobstore
+}
+
+// Blobstore returns a Blobstore which calls bs with the budget of the request
+// being served.
+func Blobstore(bs interfaces.Blobstore) interfaces.Blobstore {
+	return &budgetedBlobstore{bs: bs}
+}
+
+func (b *budgetedBlobstore) BlobExists(ctx context.Context, blobName string) (bool, error) {
+	ctx, cancel, err := ForInternalCall(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer cancel()
+	return b.bs.BlobExists(ctx, blobName)
+}
+
+func (b *budgetedBlobstore) ReadBlob(ctx context.Context, blobName string) ([]byte, error) {
+	ctx, cancel, err := ForInternalCall(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	return b.bs.ReadBlob(ctx, blobName)
+}
+
+func (b *budgetedBlobstore) WriteBlob(ctx context.Context, blobName string, data []byte) (int, error) {
+	ctx, cancel, err := ForInternalCall(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+	return b.bs.WriteBlob(ctx, blobName, data)
+}
+
+func (b *budgetedBlobstore) DeleteBlob(ctx context.Context, blobName string) error {
+	ctx, cancel, err := ForInternalCall(ctx)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	return b.bs.DeleteBlob(ctx, blobName)
+}
+
+// budgetedCache gives each cache call the request's budget.
+type budgetedCache struct {
+	c interfaces.Cache
+}
+
+// Cache returns a Cache which calls c with the budget of the request being
+// served. Readers and writers keep the budget until they are closed.
+func Cache(c interfaces.Cache) interfaces.Cache {
+	return &budgetedCache{c: c}
+}
+
+func (b *budgetedCache) WithPrefix(prefix string) interfaces.Cache {
+	return &budgetedCache{c: b.c.WithPrefix(prefix)}
+}
+
+func (b *budgetedCache) Contains(ctx context.Context, d *repb.Digest) (bool, error) {
+	ctx, cancel, err := ForInternalCall(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer cancel()
+	return b.c.Contains(ctx, d)
+}
+
+func (b *budgetedCache) ContainsMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest]bool, error) {
+	ctx, cancel, err := ForInternalCall(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	return b.c.ContainsMulti(ctx, digests)
+}
+
+func (b *budgetedCache) Get(ctx context.Context, d *repb.Digest) ([]byte, error) {
+	ctx, cancel, err := ForInternalCall(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	return b.c.Get(ctx, d)
+}
+
+func (b *budgetedCache) GetMulti(ctx context.Context, digests []*repb.Digest) (map[*repb.Digest][]byte, error) {
+	ctx, cancel, err := ForInternalCall(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	return b.c.GetMulti(ctx, digests)
+}
+
+func (b *budgetedCache) Set(ctx context.Context, d *repb.Digest, data []byte) error {
+	ctx, cancel, err := ForInternalCall(ctx)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	return b.c.Set(ctx, d, data)
+}
+
+func (b *budgetedCache) SetMulti(ctx context.Context, kvs map[*repb.Digest][]byte) error {
+	ctx, cancel, err := ForInternalCall(ctx)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	return b.c.SetMulti(ctx, kvs)
+}
+
+func (b *budgetedCache) Delete(ctx context.Context, d *repb.Digest) error {
+	ctx, cancel, err := ForInternalCall(ctx)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	return b.c.Delete(ctx, d)
+}
+
+type cancelOnCloseReader struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r *cancelOnCloseReader) Close() error {
+	defer r.cancel()
+	return r.ReadCloser.Close()
+}
+
+func (b *budgetedCache) Reader(ctx context.Context, d *repb.Digest, offset int64) (io.ReadCloser, error) {
+	ctx, cancel, err := ForInternalCall(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r, err := b.c.Reader(ctx, d, offset)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &cancelOnCloseReader{ReadCloser: r, cancel: cancel}, nil
+}
+
+type cancelOnCloseWriter struct {
+	io.WriteCloser
+	cancel context.CancelFunc
+}
+
+func (w *cancelOnCloseWriter) Close() error {
+	defer w.cancel()
+	return w.WriteCloser.Close()
+}
+
+func (b *budgetedCache) Writer(ctx context.Context, d *repb.Digest) (io.WriteCloser, error) {
+	ctx, cancel, err := ForInternalCall(ctx)
+	if err != nil {
+		return nil, err
+	}
+	w, err := b.c.Writer(ctx, d)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &cancelOnCloseWriter{WriteCloser: w, cancel: cancel}, nil
+}
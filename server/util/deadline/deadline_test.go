@@ -0,0 +1,117 @@
+package deadline_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/memory_cache"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testdigest"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/teststorage"
+	"github.com/buildbuddy-io/buildbuddy/server/util/deadline"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithBudget(t *testing.T) {
+	// Requests without a deadline have no budget.
+	ctx, err := deadline.WithBudget(context.Background(), 0.5)
+	require.NoError(t, err)
+	_, ok := deadline.Budget(ctx)
+	assert.False(t, ok)
+	internalCtx, cancel, err := deadline.ForInternalCall(ctx)
+	require.NoError(t, err)
+	cancel()
+	assert.Equal(t, ctx, internalCtx)
+
+	clientCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ctx, err = deadline.WithBudget(clientCtx, 0.5)
+	require.NoError(t, err)
+	budget, ok := deadline.Budget(ctx)
+	require.True(t, ok)
+	clientDeadline, _ := clientCtx.Deadline()
+	assert.True(t, budget.Before(clientDeadline.Add(-4*time.Second)), "budget should be about half of the remaining time")
+	assert.True(t, budget.After(time.Now().Add(4*time.Second)), "budget should be about half of the remaining time")
+
+	internalCtx, cancel, err = deadline.ForInternalCall(ctx)
+	require.NoError(t, err)
+	defer cancel()
+	internalDeadline, ok := internalCtx.Deadline()
+	require.True(t, ok)
+	assert.Equal(t, budget, internalDeadline)
+
+	assert.Equal(t, context.Background(), deadline.WithoutBudget(context.Background()))
+	_, ok = deadline.Budget(deadline.WithoutBudget(ctx))
+	assert.False(t, ok, "WithoutBudget should remove the budget")
+}
+
+func TestRequestsNearTheirDeadlineAreRejected(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), deadline.MinBudget/2)
+	defer cancel()
+	_, err := deadline.WithBudget(ctx, 0.9)
+	assert.True(t, status.IsDeadlineExceededError(err), "expected DeadlineExceeded, got %v", err)
+}
+
+func TestSpentBudgetFailsFast(t *testing.T) {
+	clientCtx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	ctx, err := deadline.WithBudget(clientCtx, 0.02)
+	require.NoError(t, err)
+	budget, _ := deadline.Budget(ctx)
+	time.Sleep(time.Until(budget))
+
+	assert.True(t, status.IsDeadlineExceededError(deadline.Check(ctx)))
+	_, _, err = deadline.ForInternalCall(ctx)
+	assert.True(t, status.IsDeadlineExceededError(err), "expected DeadlineExceeded, got %v", err)
+	assert.NoError(t, deadline.Check(deadline.WithoutBudget(ctx)))
+	assert.NoError(t, clientCtx.Err(), "the client's own deadline should not have passed yet")
+}
+
+func getAnonContext(t *testing.T) context.Context {
+	flags.Set(t, "auth.enable_anonymous_usage", "true")
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers()))
+	ctx, err := prefix.AttachUserPrefixToContext(context.Background(), te)
+	require.NoError(t, err)
+	return ctx
+}
+
+func newMemoryCache(t *testing.T) interfaces.Cache {
+	mc, err := memory_cache.NewMemoryCache(1_000_000_000) // 1GB
+	require.NoError(t, err)
+	return mc
+}
+
+func TestCacheConformance(t *testing.T) {
+	clientCtx, cancel := context.WithTimeout(getAnonContext(t), 1*time.Minute)
+	defer cancel()
+	ctx, err := deadline.WithBudget(clientCtx, 0.9)
+	require.NoError(t, err)
+	teststorage.RunCacheTests(t, ctx, func(t *testing.T) interfaces.Cache {
+		return deadline.Cache(newMemoryCache(t))
+	})
+}
+
+func TestCacheFailsFastOnceBudgetIsSpent(t *testing.T) {
+	clientCtx, cancel := context.WithTimeout(getAnonContext(t), 1*time.Second)
+	defer cancel()
+	ctx, err := deadline.WithBudget(clientCtx, 0.02)
+	require.NoError(t, err)
+	c := deadline.Cache(newMemoryCache(t)).WithPrefix("ac")
+	d, data := testdigest.NewRandomDigestBuf(t, 100)
+	require.NoError(t, c.Set(ctx, d, data))
+
+	budget, _ := deadline.Budget(ctx)
+	time.Sleep(time.Until(budget))
+	_, err = c.Get(ctx, d)
+	assert.True(t, status.IsDeadlineExceededError(err), "expected DeadlineExceeded, got %v", err)
+	_, err = c.Reader(ctx, d, 0)
+	assert.True(t, status.IsDeadlineExceededError(err), "expected DeadlineExceeded, got %v", err)
+}
@@ -0,0 +1,146 @@
+// Package failure_clusters extracts failure snippets from the console logs of
+// failed invocations and fingerprints them, so that failures which likely
+// share a root cause can be counted together across invocations.
+package failure_clusters
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// The maximum number of lines following an error line which are
+	// considered part of its failure.
+	maxContextLines = 20
+	// The maximum number of stack frames used to fingerprint a failure.
+	maxFingerprintFrames = 10
+	// The maximum number of characters of a snippet which are stored.
+	maxSnippetLength = 2000
+	// MaxFailuresPerInvocation is the maximum number of distinct failures
+	// extracted from an invocation.
+	MaxFailuresPerInvocation = 20
+)
+
+var (
+	// Matches the escape sequences used to format console output.
+	ansiEscapeRegexp = regexp.MustCompile("\x1b\\[[0-9;?]*[a-zA-Z]")
+	errorLineRegexp  = regexp.MustCompile(`^(ERROR|FAILED):\s`)
+	// Lines which end the context of an error.
+	boundaryLineRegexp = regexp.MustCompile(`^(ERROR|FAILED|INFO|WARNING|DEBUG|Target |Aspect |Use --|\(\d\d:\d\d:\d\d\))`)
+	// Bazel prints these once a build has failed; they don't say why.
+	summaryLineRegexp = regexp.MustCompile(`^(ERROR|FAILED): (Build did NOT complete successfully|Build failed\. Not running target|Couldn't start the build\. Unable to run tests|command succeeded, but not all targets were analyzed)`)
+
+	labelRegexp = regexp.MustCompile(`(@[\w.~-]*)?//[\w./+-]*(:[\w./+=,@~-]+)?`)
+	// Lines which look like the frames of a stack trace in common languages:
+	// Java ("at com.example.Foo.bar(Foo.java:12)"), Python
+	// ("File "foo.py", line 12, in bar"), Go ("foo.go:12 +0x1f"), C++
+	// sanitizers ("#3 0x4f2a in bar foo.cc:12"), and Node ("at bar (foo.js:1:2)").
+	stackFrameRegexp = regexp.MustCompile(`^(at\s+\S|File ".*", line \d+|#\d+\s+0x[0-9a-fA-F]+|\S+\.go:\d+( \+0x[0-9a-f]+)?$)`)
+
+	uuidRegexp   = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+	hexRegexp    = regexp.MustCompile(`0x[0-9a-fA-F]+`)
+	hashRegexp   = regexp.MustCompile(`\b[0-9a-fA-F]{12,}\b`)
+	dirRegexp    = regexp.MustCompile(`(?:[\w.@+~-]*/)+`)
+	numberRegexp = regexp.MustCompile(`\d+`)
+	spaceRegexp  = regexp.MustCompile(`\s+`)
+)
+
+// Failure is a failure extracted from an invocation's console log.
+type Failure struct {
+	// Fingerprint identifies the failure's cluster. Failures with the same
+	// fingerprint only differ in details like paths, line numbers, or
+	// addresses.
+	Fingerprint string
+	// Label is the target which failed, if known.
+	Label string
+	// Snippet is the failure as printed, without formatting.
+	Snippet string
+	// Line is the index of the first line of the failure in the console log.
+	Line int
+}
+
+// Normalize replaces the details of a console line which vary between
+// occurrences of the same failure, such as labels, paths, numbers, addresses,
+// and digests, with placeholders.
+func Normalize(line string) string {
+	line = ansiEscapeRegexp.ReplaceAllString(line, "")
+	line = labelRegexp.ReplaceAllString(line, "<label>")
+	line = uuidRegexp.ReplaceAllString(line, "<uuid>")
+	line = hexRegexp.ReplaceAllString(line, "<hex>")
+	line = hashRegexp.ReplaceAllString(line, "<hash>")
+	// Keep file names but not the directories they are in, which often
+	// include the user's home directory or output base.
+	line = dirRegexp.ReplaceAllString(line, "")
+	line = numberRegexp.ReplaceAllString(line, "<n>")
+	return strings.TrimSpace(spaceRegexp.ReplaceAllString(line, " "))
+}
+
+// fingerprint hashes the normalized error line along with either the stack
+// frames which follow it or, if there are none, the rest of its context.
+// Ignoring the message lines around a stack trace means that exceptions
+// thrown from the same place are clustered even if their messages differ.
+func fingerprint(errorLine string, context []string) string {
+	var frames, rest []string
+	for _, line := range context {
+		normalized := Normalize(line)
+		if normalized == "" {
+			continue
+		}
+		if stackFrameRegexp.MatchString(strings.TrimSpace(line)) {
+			if len(frames) < maxFingerprintFrames {
+				frames = append(frames, normalized)
+			}
+			continue
+		}
+		rest = append(rest, normalized)
+	}
+	parts := []string{Normalize(errorLine)}
+	if len(frames) > 0 {
+		parts = append(parts, frames...)
+	} else {
+		parts = append(parts, rest...)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(parts, "\n"))))
+}
+
+// Extract returns the distinct failures printed in the given console log, in
+// the order they were first printed.
+func Extract(consoleLog string) []*Failure {
+	lines := strings.Split(ansiEscapeRegexp.ReplaceAllString(consoleLog, ""), "\n")
+	for n, line := range lines {
+		lines[n] = strings.TrimRight(line, " \r\t")
+	}
+	seen := make(map[string]struct{})
+	var failures []*Failure
+	for n := 0; n < len(lines) && len(failures) < MaxFailuresPerInvocation; n++ {
+		errorLine := lines[n]
+		if !errorLineRegexp.MatchString(errorLine) || summaryLineRegexp.MatchString(errorLine) {
+			continue
+		}
+		var context []string
+		for _, line := range lines[n+1:] {
+			if len(context) == maxContextLines || line == "" || boundaryLineRegexp.MatchString(line) {
+				break
+			}
+			context = append(context, line)
+		}
+		fp := fingerprint(errorLine, context)
+		if _, ok := seen[fp]; ok {
+			continue
+		}
+		seen[fp] = struct{}{}
+		snippet := strings.Join(append([]string{errorLine}, context...), "\n")
+		if r := []rune(snippet); len(r) > maxSnippetLength {
+			snippet = string(r[:maxSnippetLength])
+		}
+		failures = append(failures, &Failure{
+			Fingerprint: fp,
+			Label:       labelRegexp.FindString(errorLine),
+			Snippet:     snippet,
+			Line:        n,
+		})
+	}
+	return failures
+}
@@ -0,0 +1,66 @@
+package failure_clusters_test
+
+import (
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/failure_clusters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalize(t *testing.T) {
+	assert.Equal(
+		t,
+		"ERROR: BUILD:<n>:<n>: Compiling foo.cc failed: (Exit <n>)",
+		failure_clusters.Normalize("\x1b[31m\x1b[1mERROR: \x1b[0m/home/alice/src/BUILD:12:8:   Compiling foo.cc failed: (Exit 1)"),
+	)
+	assert.Equal(
+		t,
+		"Executing genrule <label> failed in sandbox <hash>",
+		failure_clusters.Normalize("Executing genrule //pkg/sub:gen_txt failed in sandbox 3fa9c2e1b7d04a55"),
+	)
+	assert.Equal(
+		t,
+		"segfault at <hex> in worker <uuid>",
+		failure_clusters.Normalize("segfault at 0x7ffd1a2b in worker 123e4567-e89b-12d3-a456-426614174000"),
+	)
+}
+
+func TestExtract(t *testing.T) {
+	log := `INFO: Analyzed 3 targets (0 packages loaded, 0 targets configured).
+ERROR: /home/alice/ws/BUILD:3:8: Compiling a.cc failed: (Exit 1)
+a.cc:10:3: error: use of undeclared identifier 'foo'
+INFO: Elapsed time: 1.2s
+ERROR: /home/alice/ws2/BUILD:4:8: Compiling a.cc failed: (Exit 1)
+a.cc:11:3: error: use of undeclared identifier 'foo'
+
+ERROR: /home/alice/ws/java/BUILD:1:1: Testing //java:server_test failed
+Exception in thread "main" java.lang.NullPointerException: request 1234 has no user
+	at com.example.Server.handle(Server.java:42)
+	at com.example.Server.main(Server.java:10)
+ERROR: Build did NOT complete successfully
+`
+	failures := failure_clusters.Extract(log)
+	require.Len(t, failures, 2, "failures which only differ in directories and numbers should be extracted once")
+	assert.Equal(t, "ERROR: /home/alice/ws/BUILD:3:8: Compiling a.cc failed: (Exit 1)\na.cc:10:3: error: use of undeclared identifier 'foo'", failures[0].Snippet)
+	assert.Equal(t, 1, failures[0].Line)
+	assert.Equal(t, "//java:server_test", failures[1].Label)
+	assert.Equal(t, 7, failures[1].Line)
+
+	// A stack trace is fingerprinted by its frames rather than its message.
+	other := failure_clusters.Extract(`ERROR: /home/bob/ws/java/BUILD:1:1: Testing //java:other_test failed
+Exception in thread "main" java.lang.NullPointerException: request 99 has no session
+	at com.example.Server.handle(Server.java:45)
+	at com.example.Server.main(Server.java:10)
+`)
+	require.Len(t, other, 1)
+	assert.Equal(t, failures[1].Fingerprint, other[0].Fingerprint)
+
+	different := failure_clusters.Extract(`ERROR: /home/bob/ws/java/BUILD:1:1: Testing //java:other_test failed
+	at com.example.Client.connect(Client.java:7)
+`)
+	require.Len(t, different, 1)
+	assert.NotEqual(t, failures[1].Fingerprint, different[0].Fingerprint)
+
+	assert.Empty(t, failure_clusters.Extract("INFO: Build completed successfully, 4 total actions\n"))
+}
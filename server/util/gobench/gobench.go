@@ -0,0 +1,163 @@
+// Package gobench parses the results of Go benchmarks, as printed by
+// `go test -bench` or as emitted by `go test -bench -json`.
+package gobench
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+// Format is the format of benchmark output.
+type Format int
+
+const (
+	// AutoDetect detects the format from the output itself.
+	AutoDetect Format = iota
+	// Text is the output of `go test -bench`.
+	Text
+	// JSON is the output of `go test -bench -json` (see `go doc test2json`).
+	JSON
+)
+
+const (
+	benchmarkPrefix = "Benchmark"
+	packagePrefix   = "pkg:"
+
+	// The maximum length of a line of output.
+	maxLineLength = 1024 * 1024
+)
+
+// Result is a single measurement reported by a benchmark, such as its time
+// per operation.
+type Result struct {
+	// The import path of the benchmark's package, if known.
+	Package string
+	// The benchmark's name, including any sub-benchmark names and
+	// GOMAXPROCS suffix. Ex: "BenchmarkDecode/small-8"
+	Name string
+	// The number of iterations that the benchmark ran for.
+	Iterations int64
+	// The value and unit of the measurement. Ex: 1234.5, "ns/op"
+	Value float64
+	Unit  string
+}
+
+// HigherIsBetter returns whether larger values of the given unit are an
+// improvement, such as for throughput ("MB/s"). For other units, such as
+// "ns/op" or "allocs/op", smaller values are an improvement.
+func HigherIsBetter(unit string) bool {
+	return strings.HasSuffix(unit, "/s")
+}
+
+// Parse returns the benchmark results in the given output.
+func Parse(data []byte, format Format) ([]*Result, error) {
+	if format == AutoDetect {
+		format = Text
+		if strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+			format = JSON
+		}
+	}
+	switch format {
+	case Text:
+		return parseText(bytes.NewReader(data), "")
+	case JSON:
+		return parseJSON(data)
+	}
+	return nil, status.InvalidArgumentErrorf("unknown benchmark output format %d", format)
+}
+
+// testEvent is an event emitted by test2json.
+type testEvent struct {
+	Action  string
+	Package string
+	Output  string
+}
+
+func parseJSON(data []byte) ([]*Result, error) {
+	// test2json may split a benchmark's result line across several output
+	// events, so the output of each package is joined before parsing it.
+	var packages []string
+	outputByPackage := map[string]*strings.Builder{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		event := &testEvent{}
+		if err := dec.Decode(event); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid test2json output: %s", err)
+		}
+		if event.Action != "output" {
+			continue
+		}
+		output, ok := outputByPackage[event.Package]
+		if !ok {
+			output = &strings.Builder{}
+			outputByPackage[event.Package] = output
+			packages = append(packages, event.Package)
+		}
+		output.WriteString(event.Output)
+	}
+	var results []*Result
+	for _, pkg := range packages {
+		pkgResults, err := parseText(strings.NewReader(outputByPackage[pkg].String()), pkg)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, pkgResults...)
+	}
+	return results, nil
+}
+
+func parseText(r io.Reader, pkg string) ([]*Result, error) {
+	var results []*Result
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineLength)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, packagePrefix) {
+			pkg = strings.TrimSpace(strings.TrimPrefix(line, packagePrefix))
+			continue
+		}
+		results = append(results, parseLine(line, pkg)...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid benchmark output: %s", err)
+	}
+	return results, nil
+}
+
+// parseLine parses a benchmark result line, such as
+// "BenchmarkDecode-8   1000   1234 ns/op   56 B/op   2 allocs/op". Lines which
+// are not benchmark results yield no results.
+func parseLine(line, pkg string) []*Result {
+	fields := strings.Fields(line)
+	// A result line has a name, an iteration count, and value-unit pairs.
+	if len(fields) < 4 || len(fields)%2 != 0 || !strings.HasPrefix(fields[0], benchmarkPrefix) {
+		return nil
+	}
+	iterations, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil
+	}
+	var results []*Result
+	for i := 2; i < len(fields); i += 2 {
+		value, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return nil
+		}
+		results = append(results, &Result{
+			Package:    pkg,
+			Name:       fields[0],
+			Iterations: iterations,
+			Value:      value,
+			Unit:       fields[i+1],
+		})
+	}
+	return results
+}
@@ -0,0 +1,61 @@
+package gobench_test
+
+import (
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/gobench"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseText(t *testing.T) {
+	output := `goos: linux
+goarch: amd64
+pkg: example.com/codec
+cpu: Intel(R) Xeon(R) CPU @ 2.20GHz
+BenchmarkDecode/small-8         	 1000000	      1052 ns/op	  95.06 MB/s	     128 B/op	       2 allocs/op
+BenchmarkEncode-8               	  500000	      2400 ns/op
+--- BENCH: BenchmarkEncode-8
+    codec_test.go:12: some log output
+PASS
+ok  	example.com/codec	3.201s
+`
+	results, err := gobench.Parse([]byte(output), gobench.AutoDetect)
+	require.NoError(t, err)
+	assert.Equal(t, []*gobench.Result{
+		{Package: "example.com/codec", Name: "BenchmarkDecode/small-8", Iterations: 1000000, Value: 1052, Unit: "ns/op"},
+		{Package: "example.com/codec", Name: "BenchmarkDecode/small-8", Iterations: 1000000, Value: 95.06, Unit: "MB/s"},
+		{Package: "example.com/codec", Name: "BenchmarkDecode/small-8", Iterations: 1000000, Value: 128, Unit: "B/op"},
+		{Package: "example.com/codec", Name: "BenchmarkDecode/small-8", Iterations: 1000000, Value: 2, Unit: "allocs/op"},
+		{Package: "example.com/codec", Name: "BenchmarkEncode-8", Iterations: 500000, Value: 2400, Unit: "ns/op"},
+	}, results)
+}
+
+func TestParseJSON(t *testing.T) {
+	// test2json splits benchmark result lines across output events.
+	output := `{"Action":"output","Package":"example.com/codec","Output":"goos: linux\n"}
+{"Action":"output","Package":"example.com/codec","Test":"BenchmarkDecode","Output":"BenchmarkDecode\n"}
+{"Action":"output","Package":"example.com/codec","Test":"BenchmarkDecode","Output":"BenchmarkDecode-8   \t"}
+{"Action":"output","Package":"example.com/other","Test":"BenchmarkOther","Output":"BenchmarkOther-8 \t 10\t 5 ns/op\n"}
+{"Action":"output","Package":"example.com/codec","Test":"BenchmarkDecode","Output":" 1000000\t      1052 ns/op\n"}
+{"Action":"pass","Package":"example.com/codec","Elapsed":3.2}
+`
+	results, err := gobench.Parse([]byte(output), gobench.JSON)
+	require.NoError(t, err)
+	assert.Equal(t, []*gobench.Result{
+		{Package: "example.com/codec", Name: "BenchmarkDecode-8", Iterations: 1000000, Value: 1052, Unit: "ns/op"},
+		{Package: "example.com/other", Name: "BenchmarkOther-8", Iterations: 10, Value: 5, Unit: "ns/op"},
+	}, results)
+}
+
+func TestParseInvalidJSON(t *testing.T) {
+	_, err := gobench.Parse([]byte(`{"Action": `), gobench.AutoDetect)
+	assert.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+}
+
+func TestHigherIsBetter(t *testing.T) {
+	assert.True(t, gobench.HigherIsBetter("MB/s"))
+	assert.False(t, gobench.HigherIsBetter("ns/op"))
+	assert.False(t, gobench.HigherIsBetter("allocs/op"))
+}
@@ -2,13 +2,51 @@ package grpc_client
 
 import (
 	"context"
+	"flag"
+	"fmt"
+	"io"
 	"math"
 	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/rpc/filters"
+	"github.com/buildbuddy-io/buildbuddy/server/util/bandwidth"
+	"github.com/buildbuddy-io/buildbuddy/server/util/retry"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials/google"
+
+	// Registers the client-side health checking function used when
+	// grpc_client_enable_health_check is set.
+	_ "google.golang.org/grpc/health"
+)
+
+var (
+	maxRecvMsgSizeBytes   = flag.Int("grpc_client_max_recv_msg_size_bytes", math.MaxInt32, "Configures the max GRPC receive message size [bytes] for outgoing connections.")
+	maxSendMsgSizeBytes   = flag.Int("grpc_client_max_send_msg_size_bytes", math.MaxInt32, "Configures the max GRPC send message size [bytes] for outgoing connections.")
+	initialWindowSize     = flag.Int("grpc_client_initial_window_size_bytes", 0, "Configures the initial GRPC per-stream flow control window size [bytes] for outgoing connections. Values below 64KB are ignored.")
+	initialConnWindowSize = flag.Int("grpc_client_initial_conn_window_size_bytes", 0, "Configures the initial GRPC per-connection flow control window size [bytes] for outgoing connections. Values below 64KB are ignored.")
+
+	lbPolicy          = flag.String("grpc_client_lb_policy", "pick_first", "The load balancing policy used to pick a backend within each pooled connection. One of {'pick_first', 'round_robin'}")
+	enableHealthCheck = flag.Bool("grpc_client_enable_health_check", false, "If true, subchannels of pooled connections are health checked using the grpc.health.v1 service and unhealthy backends are skipped.")
+
+	maxCASUploadBytesPerSecond   = flag.Int64("grpc_client_max_cas_upload_bytes_per_second", 0, "If set, limits how fast this process uploads blobs to the CAS, across all of its connections [bytes/second]. Other RPCs, such as build event uploads, are not limited.")
+	maxCASDownloadBytesPerSecond = flag.Int64("grpc_client_max_cas_download_bytes_per_second", 0, "If set, limits how fast this process downloads blobs from the CAS, across all of its connections [bytes/second].")
+
+	breakerFailureThreshold = flag.Int("grpc_client_circuit_breaker_failure_threshold", 25, "The number of consecutive failed RPCs to a target after which RPCs to it fail immediately, until a probe RPC succeeds. 0 disables the circuit breaker.")
+	breakerOpenDuration     = flag.Duration("grpc_client_circuit_breaker_open_duration", 5*time.Second, "How long RPCs to a target fail immediately after its circuit breaker opens, before a probe RPC is sent.")
+
+	casLimitersOnce    sync.Once
+	casUploadLimiter   *bandwidth.Limiter
+	casDownloadLimiter *bandwidth.Limiter
+
+	breakersMu sync.Mutex
+	// Circuit breakers by target, shared by all connections to the target.
+	breakers = map[string]*retry.CircuitBreaker{}
 )
 
 // DialTarget handles some of the logic around detecting the correct GRPC
@@ -36,11 +74,179 @@ func DialTargetWithOptions(target string, grpcsBytestream bool, extraOptions ...
 		}
 		target = u.Host
 	}
+	if cb := circuitBreakerForTarget(target); cb != nil {
+		dialOptions = append(dialOptions, circuitBreakerDialOptions(cb)...)
+	}
 
 	// Connect to host/port and create a new client
 	return grpc.Dial(target, dialOptions...)
 }
 
+// DialTargetPooled dials size connections to the same target and returns a
+// ClientConnPool that spreads RPCs across them. This avoids head-of-line
+// blocking when many concurrent streams share a single HTTP/2 connection.
+// Sizes below 1 dial a single connection.
+func DialTargetPooled(target string, size int, extraOptions ...grpc.DialOption) (*ClientConnPool, error) {
+	if *lbPolicy != "pick_first" && *lbPolicy != "round_robin" {
+		return nil, status.InvalidArgumentErrorf("unknown grpc_client_lb_policy %q", *lbPolicy)
+	}
+	serviceConfig := fmt.Sprintf(`{"loadBalancingConfig": [{%q: {}}]`, *lbPolicy)
+	if *enableHealthCheck {
+		serviceConfig += `, "healthCheckConfig": {"serviceName": ""}`
+	}
+	serviceConfig += "}"
+	options := append([]grpc.DialOption{grpc.WithDefaultServiceConfig(serviceConfig)}, extraOptions...)
+
+	if size < 1 {
+		size = 1
+	}
+	conns := make([]*grpc.ClientConn, 0, size)
+	for i := 0; i < size; i++ {
+		conn, err := DialTargetWithOptions(target, true, options...)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return NewClientConnPool(conns...), nil
+}
+
+// ClientConnPool is a grpc.ClientConnInterface which round-robins RPCs
+// across a fixed set of connections.
+type ClientConnPool struct {
+	conns []*grpc.ClientConn
+	next  uint32
+}
+
+func NewClientConnPool(conns ...*grpc.ClientConn) *ClientConnPool {
+	return &ClientConnPool{conns: conns}
+}
+
+func (p *ClientConnPool) pick() *grpc.ClientConn {
+	n := atomic.AddUint32(&p.next, 1)
+	return p.conns[int(n)%len(p.conns)]
+}
+
+func (p *ClientConnPool) Invoke(ctx context.Context, method string, args interface{}, reply interface{}, opts ...grpc.CallOption) error {
+	return p.pick().Invoke(ctx, method, args, reply, opts...)
+}
+
+func (p *ClientConnPool) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return p.pick().NewStream(ctx, desc, method, opts...)
+}
+
+// Size returns the number of connections held by the pool.
+func (p *ClientConnPool) Size() int {
+	return len(p.conns)
+}
+
+// GetState returns the "best" connectivity state of any connection in the
+// pool, so that a pool is considered Ready as long as one of its
+// connections is able to serve RPCs.
+func (p *ClientConnPool) GetState() connectivity.State {
+	best := connectivity.Shutdown
+	for _, c := range p.conns {
+		s := c.GetState()
+		if s == connectivity.Ready {
+			return s
+		}
+		if stateRank(s) < stateRank(best) {
+			best = s
+		}
+	}
+	return best
+}
+
+func stateRank(s connectivity.State) int {
+	switch s {
+	case connectivity.Ready:
+		return 0
+	case connectivity.Connecting:
+		return 1
+	case connectivity.Idle:
+		return 2
+	case connectivity.TransientFailure:
+		return 3
+	default:
+		return 4
+	}
+}
+
+func (p *ClientConnPool) Close() error {
+	var lastErr error
+	for _, c := range p.conns {
+		if err := c.Close(); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// circuitBreakerForTarget returns the circuit breaker shared by connections to
+// the target, or nil if circuit breakers are disabled.
+func circuitBreakerForTarget(target string) *retry.CircuitBreaker {
+	if *breakerFailureThreshold <= 0 {
+		return nil
+	}
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	cb, ok := breakers[target]
+	if !ok {
+		cb = retry.NewCircuitBreaker(target, *breakerFailureThreshold, *breakerOpenDuration)
+		breakers[target] = cb
+	}
+	return cb
+}
+
+// circuitBreakerDialOptions returns interceptors which fail RPCs immediately
+// while the circuit breaker is open, and report RPC outcomes to it. Streams
+// are reported when they end.
+func circuitBreakerDialOptions(cb *retry.CircuitBreaker) []grpc.DialOption {
+	unary := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return cb.Do(func() error {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		})
+	}
+	stream := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if err := cb.Allow(); err != nil {
+			return nil, err
+		}
+		s, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			cb.Record(err)
+			return nil, err
+		}
+		return &circuitBreakerClientStream{ClientStream: s, cb: cb}, nil
+	}
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(unary),
+		grpc.WithChainStreamInterceptor(stream),
+	}
+}
+
+// circuitBreakerClientStream reports the outcome of a stream to a circuit
+// breaker once the stream ends.
+type circuitBreakerClientStream struct {
+	grpc.ClientStream
+	cb       *retry.CircuitBreaker
+	recorded int32
+}
+
+func (s *circuitBreakerClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil && atomic.CompareAndSwapInt32(&s.recorded, 0, 1) {
+		if err == io.EOF {
+			s.cb.Record(nil)
+		} else {
+			s.cb.Record(err)
+		}
+	}
+	return err
+}
+
 type rpcCredentials struct {
 	authorization string
 }
@@ -62,9 +268,21 @@ func (c *rpcCredentials) RequireTransportSecurity() bool {
 }
 
 func CommonGRPCClientOptions() []grpc.DialOption {
-	return []grpc.DialOption{
+	// The limiters are shared by all connections, so that the limits apply
+	// to the process as a whole.
+	casLimitersOnce.Do(func() {
+		casUploadLimiter = bandwidth.NewLimiter(*maxCASUploadBytesPerSecond)
+		casDownloadLimiter = bandwidth.NewLimiter(*maxCASDownloadBytesPerSecond)
+	})
+	options := []grpc.DialOption{
 		filters.GetUnaryClientInterceptor(),
 		filters.GetStreamClientInterceptor(),
-		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(math.MaxInt32)),
+		grpc.WithDefaultCallOptions(
+			grpc.MaxCallRecvMsgSize(*maxRecvMsgSizeBytes),
+			grpc.MaxCallSendMsgSize(*maxSendMsgSizeBytes),
+		),
+		grpc.WithInitialWindowSize(int32(*initialWindowSize)),
+		grpc.WithInitialConnWindowSize(int32(*initialConnWindowSize)),
 	}
+	return append(options, bandwidth.DialOptions(casUploadLimiter, casDownloadLimiter)...)
 }
@@ -0,0 +1,106 @@
+package grpc_client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health"
+
+	hlpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// startServer starts a gRPC server serving the health service and returns
+// its target.
+func startServer(t *testing.T) string {
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	hlpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return fmt.Sprintf("grpc://%s", lis.Addr().String())
+}
+
+// connRecorder records which connection of a pool each RPC was sent on.
+type connRecorder struct {
+	mu    sync.Mutex
+	conns []*grpc.ClientConn
+}
+
+func (r *connRecorder) dialOption() grpc.DialOption {
+	return grpc.WithChainUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		r.mu.Lock()
+		r.conns = append(r.conns, cc)
+		r.mu.Unlock()
+		return invoker(ctx, method, req, reply, cc, opts...)
+	})
+}
+
+func TestDialTargetPooled_Size(t *testing.T) {
+	target := startServer(t)
+	for _, test := range []struct {
+		size     int
+		wantSize int
+	}{
+		{size: -1, wantSize: 1},
+		{size: 0, wantSize: 1},
+		{size: 1, wantSize: 1},
+		{size: 4, wantSize: 4},
+	} {
+		pool, err := DialTargetPooled(target, test.size)
+		require.NoError(t, err)
+		assert.Equal(t, test.wantSize, pool.Size(), "size %d", test.size)
+		pool.Close()
+	}
+}
+
+func TestClientConnPool_RoundRobin(t *testing.T) {
+	target := startServer(t)
+	recorder := &connRecorder{}
+	pool, err := DialTargetPooled(target, 3, recorder.dialOption())
+	require.NoError(t, err)
+	defer pool.Close()
+	client := hlpb.NewHealthClient(pool)
+
+	for i := 0; i < 9; i++ {
+		_, err := client.Check(context.Background(), &hlpb.HealthCheckRequest{})
+		require.NoError(t, err)
+	}
+
+	// Every connection is used in turn.
+	require.Len(t, recorder.conns, 9)
+	assert.NotSame(t, recorder.conns[0], recorder.conns[1])
+	assert.NotSame(t, recorder.conns[1], recorder.conns[2])
+	assert.NotSame(t, recorder.conns[0], recorder.conns[2])
+	for i := 3; i < len(recorder.conns); i++ {
+		assert.Same(t, recorder.conns[i-3], recorder.conns[i], "RPC %d", i)
+	}
+	assert.Equal(t, connectivity.Ready, pool.GetState())
+}
+
+func TestClientConnPool_Close(t *testing.T) {
+	target := startServer(t)
+	pool, err := DialTargetPooled(target, 3)
+	require.NoError(t, err)
+	client := hlpb.NewHealthClient(pool)
+	_, err = client.Check(context.Background(), &hlpb.HealthCheckRequest{})
+	require.NoError(t, err)
+
+	require.NoError(t, pool.Close())
+
+	for i, conn := range pool.conns {
+		assert.Equal(t, connectivity.Shutdown, conn.GetState(), "connection %d", i)
+	}
+	assert.Equal(t, connectivity.Shutdown, pool.GetState())
+	for i := 0; i < pool.Size(); i++ {
+		_, err = client.Check(context.Background(), &hlpb.HealthCheckRequest{})
+		assert.Error(t, err)
+	}
+}
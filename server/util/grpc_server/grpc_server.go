@@ -57,6 +57,7 @@ func extractInvocationID(ctx context.Context) []attribute.KeyValue {
 }
 
 func CommonGRPCServerOptions(env environment.Env) []grpc.ServerOption {
+	configurator := env.GetConfigurator()
 	return []grpc.ServerOption{
 		filters.GetUnaryInterceptor(env),
 		filters.GetStreamInterceptor(env),
@@ -64,6 +65,11 @@ func CommonGRPCServerOptions(env environment.Env) []grpc.ServerOption {
 		grpc.ChainStreamInterceptor(otelgrpc.StreamServerInterceptor(otelgrpc.WithContextAttrExtractor(extractInvocationID))),
 		grpc.StreamInterceptor(grpc_prometheus.StreamServerInterceptor),
 		grpc.UnaryInterceptor(grpc_prometheus.UnaryServerInterceptor),
-		grpc.MaxRecvMsgSize(env.GetConfigurator().GetGRPCMaxRecvMsgSizeBytes()),
+		grpc.MaxRecvMsgSize(configurator.GetGRPCMaxRecvMsgSizeBytes()),
+		grpc.MaxSendMsgSize(configurator.GetGRPCMaxSendMsgSizeBytes()),
+		// Window sizes below 64KB are ignored by grpc-go, so a zero value
+		// leaves the default (BDP-estimated) flow control in place.
+		grpc.InitialWindowSize(configurator.GetGRPCInitialWindowSize()),
+		grpc.InitialConnWindowSize(configurator.GetGRPCInitialConnWindowSize()),
 	}
 }
@@ -0,0 +1,256 @@
+// Package lcov parses code coverage reports in the LCOV tracefile format, as
+// written by `bazel coverage` (see `man geninfo`).
+package lcov
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+const (
+	// The maximum length of a line in a report.
+	maxLineLength = 1024 * 1024
+)
+
+// File is the coverage of a single source file.
+type File struct {
+	// The path of the source file. Ex: "server/util/lcov/lcov.go"
+	SourceFile string
+	// The number of times each instrumented line was executed, by line
+	// number.
+	Lines map[int]int64
+	// The number of times each function was called, by function name.
+	Functions map[string]int64
+	// Whether each branch was taken, keyed by "<line>,<block>,<branch>".
+	Branches map[string]bool
+}
+
+func newFile(sourceFile string) *File {
+	return &File{
+		SourceFile: sourceFile,
+		Lines:      map[int]int64{},
+		Functions:  map[string]int64{},
+		Branches:   map[string]bool{},
+	}
+}
+
+// Report is the coverage of a set of source files.
+type Report struct {
+	// Coverage by source file path.
+	Files map[string]*File
+}
+
+// NewReport returns an empty report.
+func NewReport() *Report {
+	return &Report{Files: map[string]*File{}}
+}
+
+// Summary is the number of instrumented and covered lines, functions, and
+// branches in a report.
+type Summary struct {
+	LinesFound     int64
+	LinesHit       int64
+	FunctionsFound int64
+	FunctionsHit   int64
+	BranchesFound  int64
+	BranchesHit    int64
+}
+
+// LinePercent returns the percentage of instrumented lines that were
+// executed, or 0 if no lines were instrumented.
+func (s *Summary) LinePercent() float64 {
+	if s.LinesFound == 0 {
+		return 0
+	}
+	return float64(s.LinesHit) / float64(s.LinesFound) * 100
+}
+
+// Merge adds the coverage in other to the report. Coverage of the same source
+// file is combined, so a line executed by either report counts as executed.
+func (r *Report) Merge(other *Report) {
+	for path, f := range other.Files {
+		merged, ok := r.Files[path]
+		if !ok {
+			merged = newFile(path)
+			r.Files[path] = merged
+		}
+		for line, count := range f.Lines {
+			merged.Lines[line] += count
+		}
+		for name, count := range f.Functions {
+			merged.Functions[name] += count
+		}
+		for key, taken := range f.Branches {
+			merged.Branches[key] = merged.Branches[key] || taken
+		}
+	}
+}
+
+// Summary returns the totals for all files in the report.
+func (r *Report) Summary() *Summary {
+	s := &Summary{}
+	for _, f := range r.Files {
+		s.LinesFound += int64(len(f.Lines))
+		for _, count := range f.Lines {
+			if count > 0 {
+				s.LinesHit++
+			}
+		}
+		s.FunctionsFound += int64(len(f.Functions))
+		for _, count := range f.Functions {
+			if count > 0 {
+				s.FunctionsHit++
+			}
+		}
+		s.BranchesFound += int64(len(f.Branches))
+		for _, taken := range f.Branches {
+			if taken {
+				s.BranchesHit++
+			}
+		}
+	}
+	return s
+}
+
+// Parse returns the coverage in the given LCOV tracefile. Records for the same
+// source file are merged. Summary lines (LF, LH, FNF, FNH, BRF, and BRH) are
+// ignored in favor of counting the individual lines, functions, and branches,
+// so that reports can be merged accurately.
+func Parse(data []byte) (*Report, error) {
+	r := NewReport()
+	var current *File
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, maxLineLength)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line == "end_of_record" {
+			if current != nil {
+				r.Merge(&Report{Files: map[string]*File{current.SourceFile: current}})
+			}
+			current = nil
+			continue
+		}
+		key, value, ok := cut(line, ":")
+		if !ok {
+			return nil, status.InvalidArgumentErrorf("invalid LCOV line %d: %q", lineNumber, line)
+		}
+		if key == "SF" {
+			current = newFile(value)
+			continue
+		}
+		if key == "TN" {
+			continue
+		}
+		if current == nil {
+			// Other records are only meaningful within a source file.
+			continue
+		}
+		var err error
+		switch key {
+		case "DA":
+			err = parseLine(current, value)
+		case "FNDA":
+			err = parseFunctionData(current, value)
+		case "FN":
+			// Functions that are declared but never called have no FNDA
+			// record, so record them as uncalled.
+			_, name, ok := cut(value, ",")
+			if !ok {
+				err = status.InvalidArgumentErrorf("invalid function %q", value)
+			} else if _, ok := current.Functions[name]; !ok {
+				current.Functions[name] = 0
+			}
+		case "BRDA":
+			err = parseBranch(current, value)
+		}
+		if err != nil {
+			return nil, status.WrapErrorf(err, "invalid LCOV line %d", lineNumber)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, status.InvalidArgumentErrorf("error reading LCOV report: %s", err)
+	}
+	if current != nil {
+		// Tolerate a missing end_of_record at the end of the report.
+		r.Merge(&Report{Files: map[string]*File{current.SourceFile: current}})
+	}
+	return r, nil
+}
+
+// parseLine parses "<line>,<count>[,<checksum>]".
+func parseLine(f *File, value string) error {
+	fields := strings.Split(value, ",")
+	if len(fields) < 2 {
+		return status.InvalidArgumentErrorf("invalid line data %q", value)
+	}
+	line, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return status.InvalidArgumentErrorf("invalid line number %q", fields[0])
+	}
+	count, err := parseCount(fields[1])
+	if err != nil {
+		return err
+	}
+	f.Lines[line] += count
+	return nil
+}
+
+// parseFunctionData parses "<count>,<name>".
+func parseFunctionData(f *File, value string) error {
+	countStr, name, ok := cut(value, ",")
+	if !ok {
+		return status.InvalidArgumentErrorf("invalid function data %q", value)
+	}
+	count, err := parseCount(countStr)
+	if err != nil {
+		return err
+	}
+	f.Functions[name] += count
+	return nil
+}
+
+// parseBranch parses "<line>,<block>,<branch>,<taken>", where taken is "-" if
+// the branch's block was never executed.
+func parseBranch(f *File, value string) error {
+	fields := strings.Split(value, ",")
+	if len(fields) != 4 {
+		return status.InvalidArgumentErrorf("invalid branch data %q", value)
+	}
+	taken := false
+	if fields[3] != "-" {
+		count, err := parseCount(fields[3])
+		if err != nil {
+			return err
+		}
+		taken = count > 0
+	}
+	key := strings.Join(fields[:3], ",")
+	f.Branches[key] = f.Branches[key] || taken
+	return nil
+}
+
+func parseCount(s string) (int64, error) {
+	// Some tools write counts as floating point numbers.
+	count, err := strconv.ParseFloat(s, 64)
+	if err != nil || count < 0 {
+		return 0, status.InvalidArgumentErrorf("invalid execution count %q", s)
+	}
+	return int64(count), nil
+}
+
+func cut(s, sep string) (string, string, bool) {
+	i := strings.Index(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
@@ -0,0 +1,78 @@
+package lcov_test
+
+import (
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/lcov"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const report = `TN:
+SF:pkg/foo.go
+FN:3,Foo
+FN:10,Bar
+FNDA:4,Foo
+FNF:2
+FNH:1
+BRDA:4,0,0,3
+BRDA:4,0,1,-
+DA:3,4
+DA:4,4
+DA:5,0
+DA:10,0
+LF:4
+LH:2
+end_of_record
+SF:pkg/bar.go
+DA:1,1
+end_of_record
+`
+
+func TestParse(t *testing.T) {
+	r, err := lcov.Parse([]byte(report))
+	require.NoError(t, err)
+	require.Len(t, r.Files, 2)
+	foo := r.Files["pkg/foo.go"]
+	assert.Equal(t, map[int]int64{3: 4, 4: 4, 5: 0, 10: 0}, foo.Lines)
+	assert.Equal(t, map[string]int64{"Foo": 4, "Bar": 0}, foo.Functions)
+	assert.Equal(t, map[string]bool{"4,0,0": true, "4,0,1": false}, foo.Branches)
+
+	assert.Equal(t, &lcov.Summary{
+		LinesFound:     5,
+		LinesHit:       3,
+		FunctionsFound: 2,
+		FunctionsHit:   1,
+		BranchesFound:  2,
+		BranchesHit:    1,
+	}, r.Summary())
+}
+
+func TestMerge(t *testing.T) {
+	a, err := lcov.Parse([]byte("SF:foo.go\nDA:1,1\nDA:2,0\nend_of_record\n"))
+	require.NoError(t, err)
+	b, err := lcov.Parse([]byte("SF:foo.go\nDA:1,0\nDA:2,2\nDA:3,0\nend_of_record\nSF:bar.go\nDA:1,0\nend_of_record\n"))
+	require.NoError(t, err)
+
+	merged := lcov.NewReport()
+	merged.Merge(a)
+	merged.Merge(b)
+	s := merged.Summary()
+	assert.Equal(t, int64(4), s.LinesFound)
+	assert.Equal(t, int64(2), s.LinesHit)
+	assert.Equal(t, float64(50), s.LinePercent())
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, data := range []string{
+		"SF:foo.go\nDA:one,1\n",
+		"SF:foo.go\nDA:1\n",
+		"SF:foo.go\nDA:1,-1\n",
+		"SF:foo.go\nBRDA:1,0,0\n",
+		"not lcov\n",
+	} {
+		_, err := lcov.Parse([]byte(data))
+		assert.True(t, status.IsInvalidArgumentError(err), "%q: expected InvalidArgument, got %v", data, err)
+	}
+}
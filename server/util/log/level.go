@@ -0,0 +1,310 @@
+package log
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/request_info"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	scopeContextKey = "log.scope"
+
+	// The longest that debug logging may be enabled for a single ID.
+	MaxDebugDuration = 24 * time.Hour
+	// How long debug logging is enabled for an ID if no duration is given.
+	defaultDebugDuration = 15 * time.Minute
+)
+
+// levels holds the log levels that may be changed at runtime. The global level
+// is applied to log.Logger itself; subsystem levels apply to the loggers
+// returned by NamedSubLogger, and debug scopes enable debug logging of the
+// requests of particular invocations or operations.
+var levels = struct {
+	mu         sync.RWMutex
+	subsystems map[string]zerolog.Level
+	known      map[string]struct{}
+	// Debug scope IDs, mapped to the time their debug logging expires.
+	scopes map[string]time.Time
+}{
+	subsystems: make(map[string]zerolog.Level),
+	known:      make(map[string]struct{}),
+	scopes:     make(map[string]time.Time),
+}
+
+func parseLevel(level string) (zerolog.Level, error) {
+	l, err := zerolog.ParseLevel(level)
+	if err != nil || level == "" {
+		return zerolog.NoLevel, status.InvalidArgumentErrorf("Invalid log level %q", level)
+	}
+	return l, nil
+}
+
+// SetLevel changes the global log level, which is initially the level passed
+// to Configure.
+func SetLevel(level string) error {
+	l, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+	levels.mu.Lock()
+	defer levels.mu.Unlock()
+	log.Logger = log.Logger.Level(l)
+	return nil
+}
+
+// SetSubsystemLevel changes the log level of the loggers returned by
+// NamedSubLogger for the given subsystem, overriding the global level. An
+// empty level makes them follow the global level again.
+func SetSubsystemLevel(subsystem, level string) error {
+	if subsystem == "" {
+		return status.InvalidArgumentError("A subsystem is required")
+	}
+	levels.mu.Lock()
+	defer levels.mu.Unlock()
+	if level == "" {
+		delete(levels.subsystems, subsystem)
+		return nil
+	}
+	l, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+	levels.subsystems[subsystem] = l
+	return nil
+}
+
+// EnableDebugLogging enables debug logging for the given invocation or
+// operation ID until the duration passes, regardless of the global level. It
+// applies to the logs written with a context belonging to the ID, such as
+// those written by CtxDebugf.
+func EnableDebugLogging(id string, d time.Duration) error {
+	if id == "" {
+		return status.InvalidArgumentError("An invocation or operation ID is required")
+	}
+	if d <= 0 || d > MaxDebugDuration {
+		return status.InvalidArgumentErrorf("Debug logging duration must be greater than 0 and at most %s", MaxDebugDuration)
+	}
+	levels.mu.Lock()
+	defer levels.mu.Unlock()
+	levels.scopes[id] = time.Now().Add(d)
+	return nil
+}
+
+// DisableDebugLogging stops debug logging for the given ID early.
+func DisableDebugLogging(id string) {
+	levels.mu.Lock()
+	defer levels.mu.Unlock()
+	delete(levels.scopes, id)
+}
+
+// WithScope returns a context whose logs belong to the given invocation or
+// operation IDs, so that they are written if debug logging is enabled for any
+// of them. The invocation ID of a gRPC request is always in scope.
+func WithScope(ctx context.Context, ids ...string) context.Context {
+	scope := append([]string{}, scopeFromContext(ctx)...)
+	for _, id := range ids {
+		if id != "" {
+			scope = append(scope, id)
+		}
+	}
+	return context.WithValue(ctx, scopeContextKey, scope)
+}
+
+func scopeFromContext(ctx context.Context) []string {
+	scope, _ := ctx.Value(scopeContextKey).([]string)
+	return scope
+}
+
+// debugScoped returns whether debug logging is enabled for any of the IDs ctx
+// belongs to.
+func debugScoped(ctx context.Context) bool {
+	levels.mu.RLock()
+	numScopes := len(levels.scopes)
+	levels.mu.RUnlock()
+	if numScopes == 0 {
+		return false
+	}
+
+	ids := scopeFromContext(ctx)
+	if iid := request_info.FromContext(ctx).InvocationID; iid != "" {
+		ids = append(ids, iid)
+	}
+	now := time.Now()
+	levels.mu.Lock()
+	defer levels.mu.Unlock()
+	for _, id := range ids {
+		expiry, ok := levels.scopes[id]
+		if !ok {
+			continue
+		}
+		if now.After(expiry) {
+			delete(levels.scopes, id)
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// ctxLogger returns the logger for logs written with ctx, which writes debug
+// logs if debug logging is enabled for ctx's scope.
+func ctxLogger(ctx context.Context) *zerolog.Logger {
+	if log.Logger.GetLevel() > zerolog.DebugLevel && debugScoped(ctx) {
+		l := log.Logger.Level(zerolog.DebugLevel)
+		return &l
+	}
+	return &log.Logger
+}
+
+func subsystemLevel(name string) (zerolog.Level, bool) {
+	levels.mu.RLock()
+	defer levels.mu.RUnlock()
+	l, ok := levels.subsystems[name]
+	return l, ok
+}
+
+// CtxDebugf logs to the DEBUG log if the global level allows it, or if debug
+// logging is enabled for an ID that ctx belongs to. Arguments are handled in
+// the manner of fmt.Printf.
+func CtxDebugf(ctx context.Context, format string, args ...interface{}) {
+	ctxLogger(ctx).Debug().Msgf(format, args...)
+}
+
+// CtxInfof logs to the INFO log if the global level allows it, or if debug
+// logging is enabled for an ID that ctx belongs to. Arguments are handled in
+// the manner of fmt.Printf.
+func CtxInfof(ctx context.Context, format string, args ...interface{}) {
+	ctxLogger(ctx).Info().Msgf(format, args...)
+}
+
+// LevelState describes the log levels currently in effect.
+type LevelState struct {
+	Level string `json:"level"`
+	// The levels of subsystems that override the global level.
+	Subsystems map[string]string `json:"subsystems"`
+	// The names of the subsystems that have loggers.
+	KnownSubsystems []string `json:"known_subsystems"`
+	// The IDs with debug logging enabled, mapped to when it expires.
+	DebugLogging map[string]time.Time `json:"debug_logging"`
+}
+
+// Levels returns the log levels currently in effect.
+func Levels() *LevelState {
+	levels.mu.RLock()
+	defer levels.mu.RUnlock()
+	state := &LevelState{
+		Level:        log.Logger.GetLevel().String(),
+		Subsystems:   make(map[string]string, len(levels.subsystems)),
+		DebugLogging: make(map[string]time.Time, len(levels.scopes)),
+	}
+	for name, l := range levels.subsystems {
+		state.Subsystems[name] = l.String()
+	}
+	for name := range levels.known {
+		state.KnownSubsystems = append(state.KnownSubsystems, name)
+	}
+	sort.Strings(state.KnownSubsystems)
+	now := time.Now()
+	for id, expiry := range levels.scopes {
+		if now.Before(expiry) {
+			state.DebugLogging[id] = expiry
+		}
+	}
+	return state
+}
+
+// LevelHandler returns an HTTP handler for viewing and changing log levels at
+// runtime. GET requests return the current levels as JSON. POST requests
+// change them according to their form values:
+//
+// level sets the global level, or the level of subsystem if it is also set. An
+// empty level with a subsystem resets the subsystem to the global level.
+//
+// debug_id enables debug logging for an invocation or operation ID, for
+// debug_duration (such as "30m") or 15 minutes. A debug_duration of "0"
+// disables it again.
+func LevelHandler() http.Handler {
+	return http.HandlerFunc(serveLevels)
+}
+
+func serveLevels(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := updateLevels(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(Levels()); err != nil {
+		Warningf("Error writing log levels: %s", err)
+	}
+}
+
+func updateLevels(r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	if id := r.Form.Get("debug_id"); id != "" || r.Form.Get("debug_duration") != "" {
+		d := defaultDebugDuration
+		if v := r.Form.Get("debug_duration"); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil {
+				return status.InvalidArgumentErrorf("Invalid debug_duration %q", v)
+			}
+			d = parsed
+		}
+		if d == 0 && id != "" {
+			DisableDebugLogging(id)
+			Infof("Disabled debug logging for %q", id)
+			return nil
+		}
+		if err := EnableDebugLogging(id, d); err != nil {
+			return err
+		}
+		Infof("Enabled debug logging for %q for %s", id, d)
+		return nil
+	}
+	level := strings.ToLower(r.Form.Get("level"))
+	if subsystem := r.Form.Get("subsystem"); subsystem != "" {
+		if err := SetSubsystemLevel(subsystem, level); err != nil {
+			return err
+		}
+		Infof("Set log level of subsystem %q to %q", subsystem, level)
+		return nil
+	}
+	if _, ok := r.Form["level"]; !ok {
+		return status.InvalidArgumentError("One of level or debug_id is required")
+	}
+	if err := SetLevel(level); err != nil {
+		return err
+	}
+	// Log at warning so that the change is visible at any level.
+	Warningf("Set log level to %q", level)
+	return nil
+}
+
+func (l *Logger) logger() *zerolog.Logger {
+	if lvl, ok := subsystemLevel(l.name); ok {
+		zl := l.zl.Level(lvl)
+		return &zl
+	}
+	if lvl := log.Logger.GetLevel(); lvl != l.zl.GetLevel() {
+		zl := l.zl.Level(lvl)
+		return &zl
+	}
+	return &l.zl
+}
@@ -0,0 +1,132 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func captureLogs(t *testing.T, level zerolog.Level) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	original := log.Logger
+	log.Logger = zerolog.New(buf).Level(level)
+	t.Cleanup(func() { log.Logger = original })
+	return buf
+}
+
+func TestSubsystemLevel(t *testing.T) {
+	buf := captureLogs(t, zerolog.InfoLevel)
+	l := NamedSubLogger("test-subsystem")
+
+	l.Debug("hidden")
+	assert.Empty(t, buf.String())
+
+	require.NoError(t, SetSubsystemLevel("test-subsystem", "debug"))
+	l.Debug("shown")
+	assert.Contains(t, buf.String(), "shown")
+	buf.Reset()
+
+	// Other loggers still follow the global level.
+	Debug("hidden")
+	assert.Empty(t, buf.String())
+
+	require.NoError(t, SetSubsystemLevel("test-subsystem", ""))
+	l.Debug("hidden")
+	assert.Empty(t, buf.String())
+
+	require.NoError(t, SetLevel("warn"))
+	l.Info("hidden")
+	assert.Empty(t, buf.String())
+	assert.Contains(t, Levels().KnownSubsystems, "test-subsystem")
+
+	assert.Error(t, SetSubsystemLevel("test-subsystem", "loud"))
+	assert.Error(t, SetLevel(""))
+}
+
+func TestDebugLoggingScopedToID(t *testing.T) {
+	buf := captureLogs(t, zerolog.WarnLevel)
+	ctx := WithScope(context.Background(), "operation-1")
+	other := WithScope(context.Background(), "operation-2")
+
+	CtxDebugf(ctx, "hidden")
+	assert.Empty(t, buf.String())
+
+	require.NoError(t, EnableDebugLogging("operation-1", time.Minute))
+	CtxDebugf(ctx, "shown")
+	CtxDebugf(other, "hidden")
+	Debugf("hidden")
+	assert.Contains(t, buf.String(), "shown")
+	assert.NotContains(t, buf.String(), "hidden")
+	buf.Reset()
+
+	DisableDebugLogging("operation-1")
+	CtxDebugf(ctx, "hidden")
+	assert.Empty(t, buf.String())
+
+	// Expired IDs are no longer debug logged.
+	levels.mu.Lock()
+	levels.scopes["operation-1"] = time.Now().Add(-time.Second)
+	levels.mu.Unlock()
+	CtxDebugf(ctx, "hidden")
+	assert.Empty(t, buf.String())
+
+	assert.Error(t, EnableDebugLogging("operation-1", 0))
+	assert.Error(t, EnableDebugLogging("operation-1", MaxDebugDuration+time.Second))
+	assert.Error(t, EnableDebugLogging("", time.Minute))
+}
+
+func postLevels(t *testing.T, values url.Values) (*httptest.ResponseRecorder, *LevelState) {
+	req := httptest.NewRequest(http.MethodPost, "/loglevel", strings.NewReader(values.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	LevelHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		return rec, nil
+	}
+	state := &LevelState{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), state))
+	return rec, state
+}
+
+func TestLevelHandler(t *testing.T) {
+	captureLogs(t, zerolog.InfoLevel)
+
+	_, state := postLevels(t, url.Values{"level": {"error"}})
+	assert.Equal(t, "error", state.Level)
+
+	_, state = postLevels(t, url.Values{"level": {"debug"}, "subsystem": {"executor"}})
+	assert.Equal(t, map[string]string{"executor": "debug"}, state.Subsystems)
+	_, state = postLevels(t, url.Values{"level": {""}, "subsystem": {"executor"}})
+	assert.Empty(t, state.Subsystems)
+
+	_, state = postLevels(t, url.Values{"debug_id": {"invocation-1"}, "debug_duration": {"30m"}})
+	require.Contains(t, state.DebugLogging, "invocation-1")
+	assert.True(t, state.DebugLogging["invocation-1"].After(time.Now().Add(29*time.Minute)))
+	_, state = postLevels(t, url.Values{"debug_id": {"invocation-1"}, "debug_duration": {"0"}})
+	assert.NotContains(t, state.DebugLogging, "invocation-1")
+
+	for _, values := range []url.Values{
+		{},
+		{"level": {"loud"}},
+		{"debug_id": {"invocation-1"}, "debug_duration": {"forever"}},
+		{"debug_duration": {"30m"}},
+	} {
+		rec, _ := postLevels(t, values)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, "%v", values)
+	}
+
+	rec := httptest.NewRecorder()
+	LevelHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/loglevel", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
@@ -12,7 +12,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/buildbuddy-io/buildbuddy/server/util/bazel_request"
+	"github.com/buildbuddy-io/buildbuddy/server/util/request_info"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/uuid"
 	"github.com/rs/zerolog"
@@ -64,18 +64,29 @@ func fmtErr(err error) string {
 }
 
 func LogGRPCRequest(ctx context.Context, fullMethod string, dur time.Duration, err error) {
-	if log.Logger.GetLevel() > zerolog.InfoLevel {
+	if log.Logger.GetLevel() > zerolog.InfoLevel && !debugScoped(ctx) {
 		return
 	}
-	reqID, _ := uuid.GetFromContext(ctx) // Ignore error, we're logging anyway.
+	info := request_info.FromContext(ctx)
+	reqID := info.RequestID
+	if reqID == "" {
+		reqID, _ = uuid.GetFromContext(ctx) // Ignore error, we're logging anyway.
+	}
 	// ByteStream and DistributedCache services share some method names.
 	// We disambiguate them in the logs by adding a D prefix to DistributedCache methods.
 	fullMethod = strings.Replace(fullMethod, "distributed_cache.DistributedCache/", "D", 1)
 	shortPath := "/" + path.Base(fullMethod)
-	if iid := bazel_request.GetInvocationID(ctx); iid != "" {
-		Infof("%s %s %s %s %s [%s]", "gRPC", reqID, iid, shortPath, fmtErr(err), formatDuration(dur))
+	caller := ""
+	if info.GroupID != "" {
+		caller += " group=" + info.GroupID
+	}
+	if info.ClientVersion != "" {
+		caller += fmt.Sprintf(" client=%q", info.ClientVersion)
+	}
+	if iid := info.InvocationID; iid != "" {
+		CtxInfof(ctx, "%s %s %s %s %s [%s]%s", "gRPC", reqID, iid, shortPath, fmtErr(err), formatDuration(dur), caller)
 	} else {
-		Infof("%s %s %s %s [%s]", "gRPC", reqID, shortPath, fmtErr(err), formatDuration(dur))
+		CtxInfof(ctx, "%s %s %s %s [%s]%s", "gRPC", reqID, shortPath, fmtErr(err), formatDuration(dur), caller)
 	}
 	if logErrorStackTraces {
 		code := gstatus.Code(err)
@@ -89,7 +100,7 @@ func LogGRPCRequest(ctx context.Context, fullMethod string, dur time.Duration, e
 			for _, f := range se.StackTrace() {
 				stackBuf += fmt.Sprintf("%+s:%d\n", f, f)
 			}
-			Info(stackBuf)
+			CtxInfof(ctx, "%s", stackBuf)
 		}
 	}
 }
@@ -184,47 +195,48 @@ func Configure(opts Opts) error {
 }
 
 type Logger struct {
-	zl zerolog.Logger
+	name string
+	zl   zerolog.Logger
 }
 
 // Debug logs to the DEBUG log.
 func (l *Logger) Debug(message string) {
-	l.zl.Debug().Msg(message)
+	l.logger().Debug().Msg(message)
 }
 
 // Debugf logs to the DEBUG log. Arguments are handled in the manner of fmt.Printf.
 func (l *Logger) Debugf(format string, args ...interface{}) {
-	l.zl.Debug().Msgf(format, args...)
+	l.logger().Debug().Msgf(format, args...)
 }
 
 // Info logs to the INFO log.
 func (l *Logger) Info(message string) {
-	l.zl.Info().Msg(message)
+	l.logger().Info().Msg(message)
 }
 
 // Infof logs to the INFO log. Arguments are handled in the manner of fmt.Printf.
 func (l *Logger) Infof(format string, args ...interface{}) {
-	l.zl.Info().Msgf(format, args...)
+	l.logger().Info().Msgf(format, args...)
 }
 
 // Warning logs to the WARNING log.
 func (l *Logger) Warning(message string) {
-	l.zl.Warn().Msg(message)
+	l.logger().Warn().Msg(message)
 }
 
 // Warningf logs to the WARNING log. Arguments are handled in the manner of fmt.Printf.
 func (l *Logger) Warningf(format string, args ...interface{}) {
-	l.zl.Warn().Msgf(format, args...)
+	l.logger().Warn().Msgf(format, args...)
 }
 
 // Error logs to the ERROR log.
 func (l *Logger) Error(message string) {
-	l.zl.Error().Msg(message)
+	l.logger().Error().Msg(message)
 }
 
 // Errorf logs to the ERROR log. Arguments are handled in the manner of fmt.Printf.
 func (l *Logger) Errorf(format string, args ...interface{}) {
-	l.zl.Error().Msgf(format, args...)
+	l.logger().Error().Msgf(format, args...)
 }
 
 // Fatal logs to the FATAL log. Arguments are handled in the manner of fmt.Print.
@@ -243,9 +255,15 @@ func (l *Logger) Fatalf(format string, args ...interface{}) {
 	os.Exit(1)
 }
 
+// NamedSubLogger returns a logger for the named subsystem, whose level may be
+// changed at runtime with SetSubsystemLevel.
 func NamedSubLogger(name string) Logger {
+	levels.mu.Lock()
+	levels.known[name] = struct{}{}
+	levels.mu.Unlock()
 	return Logger{
-		zl: log.Logger.With().Str("name", name).Logger(),
+		name: name,
+		zl:   log.Logger.With().Str("name", name).Logger(),
 	}
 }
 
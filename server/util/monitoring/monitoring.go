@@ -5,6 +5,7 @@ import (
 	"net/http/pprof"
 
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/reliability"
 	"github.com/buildbuddy-io/buildbuddy/server/util/statusz"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -24,6 +25,12 @@ func RegisterMonitoringHandlers(mux *http.ServeMux) {
 
 	// Statusz page
 	mux.Handle("/statusz", statusz.Server())
+
+	// Success rates and latencies per service
+	mux.Handle("/reliability", reliability.Handler())
+
+	// Runtime log level control
+	mux.Handle("/loglevel", log.LevelHandler())
 }
 
 // StartMonitoringHandler enables the prometheus and pprof monitoring handlers
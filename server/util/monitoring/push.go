@@ -0,0 +1,94 @@
+package monitoring
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	defaultPushInterval = 15 * time.Second
+
+	instanceLabel = "instance"
+)
+
+// pushgatewaySink pushes metrics to the Prometheus Pushgateway, so that they
+// reach the monitoring stack even if the process can't be scraped.
+type pushgatewaySink struct {
+	conf    *config.MonitoringConfig
+	job     string
+	labels  map[string]string
+	timeout time.Duration
+}
+
+// newPushgatewaySink returns a sink which groups metrics under the configured
+// job name, or defaultJob if there is none.
+func newPushgatewaySink(conf *config.MonitoringConfig, defaultJob string, timeout time.Duration) (*pushgatewaySink, error) {
+	job := conf.PushJobName
+	if job == "" {
+		job = defaultJob
+	}
+	labels, err := parsePushLabels(conf.PushLabels)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := labels[instanceLabel]; !ok {
+		// Replicas would overwrite each other's metrics if they were all
+		// grouped under the same job alone.
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, status.UnavailableErrorf("could not determine instance label for pushed metrics: %s", err)
+		}
+		labels[instanceLabel] = hostname
+	}
+	return &pushgatewaySink{conf: conf, job: job, labels: labels, timeout: timeout}, nil
+}
+
+func (s *pushgatewaySink) pusher() *push.Pusher {
+	pusher := push.New(s.conf.PushGatewayURL, s.job).Client(&http.Client{Timeout: s.timeout})
+	for name, value := range s.labels {
+		pusher = pusher.Grouping(name, value)
+	}
+	if s.conf.PushBasicAuthUsername != "" {
+		pusher = pusher.BasicAuth(s.conf.PushBasicAuthUsername, s.conf.PushBasicAuthPassword)
+	}
+	return pusher
+}
+
+func (s *pushgatewaySink) Name() string {
+	return "Pushgateway at " + s.conf.PushGatewayURL
+}
+
+func (s *pushgatewaySink) Export(ctx context.Context, families []*dto.MetricFamily) error {
+	return s.pusher().Gatherer(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return families, nil
+	})).Push()
+}
+
+// Close deletes the pushed metrics, so that the Pushgateway doesn't keep
+// serving them after the process has exited.
+func (s *pushgatewaySink) Close(ctx context.Context) error {
+	return s.pusher().Delete()
+}
+
+// parsePushLabels parses labels in the format name=value.
+func parsePushLabels(pushLabels []string) (map[string]string, error) {
+	labels := make(map[string]string, len(pushLabels))
+	for _, label := range pushLabels {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, status.InvalidArgumentErrorf("Push label %q has invalid format, expected name=value", label)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
@@ -0,0 +1,148 @@
+package monitoring
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePushLabels(t *testing.T) {
+	labels, err := parsePushLabels(nil)
+	require.NoError(t, err)
+	assert.Empty(t, labels)
+
+	labels, err = parsePushLabels([]string{"env=prod", "region=us-west1", "query=a=b"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"env": "prod", "region": "us-west1", "query": "a=b"}, labels)
+
+	for _, invalid := range []string{"env", "env=", "=prod", ""} {
+		_, err := parsePushLabels([]string{"region=us-west1", invalid})
+		assert.Error(t, err, "label %q", invalid)
+	}
+}
+
+// pushRequest is a request received by a fake Pushgateway.
+type pushRequest struct {
+	method   string
+	path     string
+	username string
+	password string
+	body     string
+}
+
+// fakePushgateway records the requests sent to it.
+type fakePushgateway struct {
+	mu       sync.Mutex
+	requests []*pushRequest
+}
+
+func (g *fakePushgateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := ioutil.ReadAll(r.Body)
+	username, password, _ := r.BasicAuth()
+	g.mu.Lock()
+	g.requests = append(g.requests, &pushRequest{
+		method:   r.Method,
+		path:     r.URL.Path,
+		username: username,
+		password: password,
+		body:     string(b),
+	})
+	g.mu.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (g *fakePushgateway) received() []*pushRequest {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]*pushRequest{}, g.requests...)
+}
+
+func startPushgateway(t *testing.T) (*fakePushgateway, string) {
+	gateway := &fakePushgateway{}
+	server := httptest.NewServer(gateway)
+	t.Cleanup(server.Close)
+	return gateway, server.URL
+}
+
+func TestPushgatewaySink(t *testing.T) {
+	gateway, url := startPushgateway(t)
+	sink, err := newPushgatewaySink(&config.MonitoringConfig{
+		PushGatewayURL:        url,
+		PushJobName:           "custom-job",
+		PushLabels:            []string{"env=prod", "instance=app-1"},
+		PushBasicAuthUsername: "user",
+		PushBasicAuthPassword: "pass",
+	}, "buildbuddy", time.Second)
+	require.NoError(t, err)
+
+	reg := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_pushed_total"})
+	reg.MustRegister(counter)
+	counter.Inc()
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	require.NoError(t, sink.Export(context.Background(), families))
+	require.NoError(t, sink.Close(context.Background()))
+
+	requests := gateway.received()
+	require.Len(t, requests, 2)
+	assert.Equal(t, "PUT", requests[0].method)
+	assert.Equal(t, "/metrics/job/custom-job/env/prod/instance/app-1", requests[0].path)
+	assert.Equal(t, "user", requests[0].username)
+	assert.Equal(t, "pass", requests[0].password)
+	assert.Contains(t, requests[0].body, "test_pushed_total")
+	// Closing the sink deletes the pushed metrics.
+	assert.Equal(t, "DELETE", requests[1].method)
+	assert.Equal(t, "/metrics/job/custom-job/env/prod/instance/app-1", requests[1].path)
+}
+
+func TestPushgatewaySink_Defaults(t *testing.T) {
+	sink, err := newPushgatewaySink(&config.MonitoringConfig{PushGatewayURL: "http://localhost:9091"}, "buildbuddy-executor", time.Second)
+	require.NoError(t, err)
+
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	assert.Equal(t, "buildbuddy-executor", sink.job)
+	assert.Equal(t, map[string]string{"instance": hostname}, sink.labels)
+
+	_, err = newPushgatewaySink(&config.MonitoringConfig{PushGatewayURL: "http://localhost:9091", PushLabels: []string{"env"}}, "buildbuddy", time.Second)
+	assert.Error(t, err)
+}
+
+func TestStartMetricsExporters_Pushgateway(t *testing.T) {
+	gateway, url := startPushgateway(t)
+	te := testenv.GetTestEnv(t)
+	conf := te.GetConfigurator().GetMonitoringConfig()
+	conf.PushGatewayURL = url
+	conf.PushIntervalSeconds = 1
+	conf.PushLabels = []string{"instance=app-1"}
+
+	require.NoError(t, StartMetricsExporters(te, "buildbuddy"))
+
+	// Metrics are pushed periodically until the server shuts down.
+	assert.Eventually(t, func() bool {
+		return len(gateway.received()) >= 2
+	}, 10*time.Second, 50*time.Millisecond)
+	te.GetHealthChecker().Shutdown()
+	te.GetHealthChecker().WaitForGracefulShutdown()
+
+	requests := gateway.received()
+	for _, r := range requests[:len(requests)-1] {
+		assert.Equal(t, "PUT", r.method)
+		assert.Equal(t, "/metrics/job/buildbuddy/instance/app-1", r.path)
+	}
+	// The pushed metrics are deleted on shutdown.
+	assert.Equal(t, "DELETE", requests[len(requests)-1].method)
+}
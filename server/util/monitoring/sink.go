@@ -0,0 +1,97 @@
+package monitoring
+
+import (
+	"context"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// MetricsSink receives periodic snapshots of all registered metrics, for
+// exporting them to a monitoring system that doesn't scrape the Prometheus
+// metrics endpoint.
+type MetricsSink interface {
+	// Name describes the sink in logs.
+	Name() string
+
+	// Export sends a snapshot of all metrics to the sink.
+	Export(ctx context.Context, families []*dto.MetricFamily) error
+
+	// Close is called on graceful shutdown, after the last snapshot has been
+	// exported.
+	Close(ctx context.Context) error
+}
+
+// StartMetricsExporters starts exporting metrics to each of the sinks which
+// are configured in the monitoring config. Pushed metrics are grouped under
+// defaultJob unless a job name is configured.
+func StartMetricsExporters(env environment.Env, defaultJob string) error {
+	conf := env.GetConfigurator().GetMonitoringConfig()
+	if conf.PushGatewayURL != "" {
+		interval := time.Duration(conf.PushIntervalSeconds) * time.Second
+		if interval <= 0 {
+			interval = defaultPushInterval
+		}
+		sink, err := newPushgatewaySink(conf, defaultJob, interval)
+		if err != nil {
+			return err
+		}
+		StartMetricsSink(env, sink, interval)
+	}
+	if conf.StatsDAddress != "" {
+		interval := time.Duration(conf.StatsDFlushIntervalSeconds) * time.Second
+		if interval <= 0 {
+			interval = defaultStatsDFlushInterval
+		}
+		sink, err := newStatsDSink(conf)
+		if err != nil {
+			return err
+		}
+		StartMetricsSink(env, sink, interval)
+	}
+	return nil
+}
+
+// StartMetricsSink exports a snapshot of all metrics registered with the
+// default Prometheus registry to the given sink at the given interval, until
+// the server shuts down.
+func StartMetricsSink(env environment.Env, sink MetricsSink, interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		log.Infof("Exporting metrics to %s every %s", sink.Name(), interval)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			exportMetrics(ctx, sink)
+		}
+	}()
+	env.GetHealthChecker().RegisterShutdownFunction(func(ctx context.Context) error {
+		cancel()
+		<-done
+		// Export once more so that the sink sees the final values.
+		exportMetrics(ctx, sink)
+		return sink.Close(ctx)
+	})
+}
+
+func exportMetrics(ctx context.Context, sink MetricsSink) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		// Gather returns as many metrics as it can even if some fail.
+		log.Warningf("Error gathering metrics for %s: %s", sink.Name(), err)
+	}
+	if err := sink.Export(ctx, families); err != nil {
+		log.Warningf("Could not export metrics to %s: %s", sink.Name(), err)
+	}
+}
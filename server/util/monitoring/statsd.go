@@ -0,0 +1,197 @@
+package monitoring
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	defaultStatsDFlushInterval = 10 * time.Second
+
+	// The maximum size of a UDP packet sent to the StatsD agent, chosen so
+	// that packets aren't fragmented on a typical network.
+	maxStatsDPacketBytes = 1432
+)
+
+// statsDSink sends metrics to a StatsD agent, such as the Datadog agent, over
+// UDP.
+//
+// StatsD counters are increments, so the change in each Prometheus counter
+// since the previous export is sent. Gauges are sent as gauges. Histograms and
+// summaries are sent as the counters "<name>.count" and "<name>.sum", and
+// summary quantiles as gauges; histogram buckets are not sent.
+type statsDSink struct {
+	address   string
+	conn      net.Conn
+	prefix    string
+	dogStatsD bool
+	tags      []string
+
+	// The value of each counter at the previous export, by series and tags.
+	lastCounterValues map[string]float64
+}
+
+func newStatsDSink(conf *config.MonitoringConfig) (*statsDSink, error) {
+	if len(conf.StatsDTags) > 0 && !conf.StatsDDogStatsD {
+		return nil, status.InvalidArgumentError("StatsD tags are only supported for DogStatsD")
+	}
+	for _, tag := range conf.StatsDTags {
+		if tag == "" || strings.ContainsAny(tag, "|,#\n") {
+			return nil, status.InvalidArgumentErrorf("StatsD tag %q is invalid", tag)
+		}
+	}
+	conn, err := net.Dial("udp", conf.StatsDAddress)
+	if err != nil {
+		return nil, status.UnavailableErrorf("could not connect to StatsD agent at %q: %s", conf.StatsDAddress, err)
+	}
+	return &statsDSink{
+		address:           conf.StatsDAddress,
+		conn:              conn,
+		prefix:            conf.StatsDPrefix,
+		dogStatsD:         conf.StatsDDogStatsD,
+		tags:              conf.StatsDTags,
+		lastCounterValues: map[string]float64{},
+	}, nil
+}
+
+func (s *statsDSink) Name() string {
+	return "StatsD agent at " + s.address
+}
+
+func (s *statsDSink) Export(ctx context.Context, families []*dto.MetricFamily) error {
+	var packet bytes.Buffer
+	for _, line := range s.format(families) {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxStatsDPacketBytes {
+			if _, err := s.conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		if _, err := s.conn.Write(packet.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *statsDSink) Close(ctx context.Context) error {
+	return s.conn.Close()
+}
+
+// format returns the StatsD lines for the given metrics.
+func (s *statsDSink) format(families []*dto.MetricFamily) []string {
+	var lines []string
+	for _, family := range families {
+		name := sanitizeStatsDName(s.prefix + family.GetName())
+		for _, m := range family.GetMetric() {
+			labels := m.GetLabel()
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				lines = s.appendCounter(lines, name, labels, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				lines = s.appendGauge(lines, name, labels, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				lines = s.appendGauge(lines, name, labels, m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				lines = s.appendCounter(lines, name+".count", labels, float64(m.GetHistogram().GetSampleCount()))
+				lines = s.appendCounter(lines, name+".sum", labels, m.GetHistogram().GetSampleSum())
+			case dto.MetricType_SUMMARY:
+				lines = s.appendCounter(lines, name+".count", labels, float64(m.GetSummary().GetSampleCount()))
+				lines = s.appendCounter(lines, name+".sum", labels, m.GetSummary().GetSampleSum())
+				for _, q := range m.GetSummary().GetQuantile() {
+					quantile := strconv.FormatFloat(q.GetQuantile(), 'f', -1, 64)
+					quantileLabels := append(labels[:len(labels):len(labels)], &dto.LabelPair{Name: stringPtr("quantile"), Value: &quantile})
+					lines = s.appendGauge(lines, name, quantileLabels, q.GetValue())
+				}
+			}
+		}
+	}
+	return lines
+}
+
+func (s *statsDSink) appendCounter(lines []string, name string, labels []*dto.LabelPair, value float64) []string {
+	series, tags := s.series(name, labels), s.tagSuffix(labels)
+	key := series + tags
+	delta := value - s.lastCounterValues[key]
+	if delta < 0 {
+		// The counter was reset.
+		delta = value
+	}
+	s.lastCounterValues[key] = value
+	if delta == 0 {
+		return lines
+	}
+	return append(lines, series+":"+formatStatsDValue(delta)+"|c"+tags)
+}
+
+func (s *statsDSink) appendGauge(lines []string, name string, labels []*dto.LabelPair, value float64) []string {
+	return append(lines, s.series(name, labels)+":"+formatStatsDValue(value)+"|g"+s.tagSuffix(labels))
+}
+
+// series returns the StatsD name of a series. Without DogStatsD tags, label
+// values are appended to the name, ordered by label name, so that each series
+// has a name of its own.
+func (s *statsDSink) series(name string, labels []*dto.LabelPair) string {
+	if s.dogStatsD {
+		return name
+	}
+	parts := []string{name}
+	for _, l := range sortedLabels(labels) {
+		parts = append(parts, sanitizeStatsDName(l.GetValue()))
+	}
+	return strings.Join(parts, ".")
+}
+
+// tagSuffix returns the DogStatsD tags for a series, if tags are enabled.
+func (s *statsDSink) tagSuffix(labels []*dto.LabelPair) string {
+	if !s.dogStatsD || len(labels)+len(s.tags) == 0 {
+		return ""
+	}
+	tags := append([]string{}, s.tags...)
+	for _, l := range sortedLabels(labels) {
+		tags = append(tags, sanitizeStatsDName(l.GetName())+":"+sanitizeStatsDName(l.GetValue()))
+	}
+	return "|#" + strings.Join(tags, ",")
+}
+
+func sortedLabels(labels []*dto.LabelPair) []*dto.LabelPair {
+	sorted := append([]*dto.LabelPair{}, labels...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].GetName() < sorted[j].GetName() })
+	return sorted
+}
+
+// sanitizeStatsDName replaces characters which have a meaning in the StatsD
+// protocol.
+func sanitizeStatsDName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func formatStatsDValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
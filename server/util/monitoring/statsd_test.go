@@ -0,0 +1,96 @@
+package monitoring
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsDSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	for _, testCase := range []struct {
+		dogStatsD bool
+		tags      []string
+		first     []string
+		second    []string
+	}{
+		{
+			dogStatsD: false,
+			first: []string{
+				"bb.test_duration_seconds.count:1|c",
+				"bb.test_duration_seconds.sum:0.5|c",
+				"bb.test_queue_length:3|g",
+				"bb.test_requests.OK.GET:2|c",
+			},
+			second: []string{
+				"bb.test_queue_length:3|g",
+				"bb.test_requests.OK.GET:1|c",
+			},
+		},
+		{
+			dogStatsD: true,
+			tags:      []string{"env:prod"},
+			first: []string{
+				"bb.test_duration_seconds.count:1|c|#env:prod",
+				"bb.test_duration_seconds.sum:0.5|c|#env:prod",
+				"bb.test_queue_length:3|g|#env:prod",
+				"bb.test_requests:2|c|#env:prod,code:OK,method:GET",
+			},
+			second: []string{
+				"bb.test_queue_length:3|g|#env:prod",
+				"bb.test_requests:1|c|#env:prod,code:OK,method:GET",
+			},
+		},
+	} {
+		reg := prometheus.NewRegistry()
+		counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_requests"}, []string{"code", "method"})
+		gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_queue_length"})
+		histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_duration_seconds"})
+		reg.MustRegister(counter, gauge, histogram)
+
+		sink, err := newStatsDSink(&config.MonitoringConfig{
+			StatsDAddress:   conn.LocalAddr().String(),
+			StatsDPrefix:    "bb.",
+			StatsDDogStatsD: testCase.dogStatsD,
+			StatsDTags:      testCase.tags,
+		})
+		require.NoError(t, err)
+
+		counter.WithLabelValues("OK", "GET").Add(2)
+		gauge.Set(3)
+		histogram.Observe(0.5)
+		assert.Equal(t, testCase.first, exportAndReceive(t, sink, reg, conn))
+
+		// Only the change in counters since the last export is sent.
+		counter.WithLabelValues("OK", "GET").Inc()
+		assert.Equal(t, testCase.second, exportAndReceive(t, sink, reg, conn))
+
+		require.NoError(t, sink.Close(context.Background()))
+	}
+}
+
+func exportAndReceive(t *testing.T, sink *statsDSink, reg *prometheus.Registry, conn net.PacketConn) []string {
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	require.NoError(t, sink.Export(context.Background(), families))
+	buf := make([]byte, maxStatsDPacketBytes)
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	return strings.Split(string(buf[:n]), "\n")
+}
+
+func TestNewStatsDSink_InvalidTags(t *testing.T) {
+	_, err := newStatsDSink(&config.MonitoringConfig{StatsDAddress: "localhost:8125", StatsDTags: []string{"env:prod"}})
+	assert.Error(t, err, "tags require DogStatsD")
+	_, err = newStatsDSink(&config.MonitoringConfig{StatsDAddress: "localhost:8125", StatsDDogStatsD: true, StatsDTags: []string{"a|b"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,350 @@
+// Package parquet writes flat tables as Apache Parquet files.
+//
+// Only what's needed to export records is supported: required (non-null)
+// columns of a few primitive types, written with the PLAIN encoding and
+// without compression, one data page per column per row group. See
+// https://github.com/apache/parquet-format for the file format.
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+const (
+	magic = "PAR1"
+
+	// The number of rows buffered before they are written as a row group.
+	defaultRowGroupSize = 64 * 1024
+
+	createdBy = "buildbuddy"
+)
+
+// ColumnType is the type of the values of a column.
+type ColumnType int
+
+const (
+	// Int64 columns hold int64 values.
+	Int64 ColumnType = iota
+	// Double columns hold float64 values.
+	Double
+	// Bool columns hold bool values.
+	Bool
+	// String columns hold string values, stored as UTF-8 byte arrays.
+	String
+)
+
+// Column describes a column of the table.
+type Column struct {
+	Name string
+	Type ColumnType
+}
+
+// Physical types, encodings and other enum values of the Parquet format.
+const (
+	typeBoolean   = 0
+	typeInt64     = 2
+	typeDouble    = 5
+	typeByteArray = 6
+
+	convertedTypeUTF8 = 0
+
+	repetitionRequired = 0
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	codecUncompressed = 0
+
+	pageTypeDataPage = 0
+)
+
+// Writer writes rows to a Parquet file.
+type Writer struct {
+	w       io.Writer
+	columns []Column
+
+	// The number of bytes written so far, which is the offset of the next
+	// write from the start of the file.
+	offset int64
+
+	// Values of the buffered rows, encoded per column.
+	values    []*bytes.Buffer
+	boolBits  [][]bool
+	rowCount  int64
+	rowGroups []*rowGroup
+	numRows   int64
+
+	rowGroupSize int64
+	closed       bool
+}
+
+type columnChunk struct {
+	fileOffset       int64
+	numValues        int64
+	uncompressedSize int64
+}
+
+type rowGroup struct {
+	columns       []*columnChunk
+	totalByteSize int64
+	numRows       int64
+}
+
+// NewWriter returns a Writer of a file with the given columns to w. The file
+// is only complete once the Writer is closed.
+func NewWriter(w io.Writer, columns []Column) (*Writer, error) {
+	if len(columns) == 0 {
+		return nil, status.InvalidArgumentError("A parquet file must have at least one column")
+	}
+	pw := &Writer{
+		w:            w,
+		columns:      columns,
+		values:       make([]*bytes.Buffer, len(columns)),
+		boolBits:     make([][]bool, len(columns)),
+		rowGroupSize: defaultRowGroupSize,
+	}
+	for i := range columns {
+		pw.values[i] = &bytes.Buffer{}
+	}
+	if err := pw.write([]byte(magic)); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// Write appends a row to the file. The row must hold a value of the type of
+// each column, in the order of the columns.
+func (pw *Writer) Write(row []interface{}) error {
+	if pw.closed {
+		return status.FailedPreconditionError("Writer is closed")
+	}
+	if len(row) != len(pw.columns) {
+		return status.InvalidArgumentErrorf("Row has %d values, but the file has %d columns", len(row), len(pw.columns))
+	}
+	for i, c := range pw.columns {
+		if err := checkValue(c, row[i]); err != nil {
+			return err
+		}
+	}
+	for i, c := range pw.columns {
+		pw.appendValue(i, c, row[i])
+	}
+	pw.rowCount++
+	if pw.rowCount >= pw.rowGroupSize {
+		return pw.flushRowGroup()
+	}
+	return nil
+}
+
+// checkValue returns an error if v is not a value of the column's type.
+func checkValue(c Column, v interface{}) error {
+	ok := false
+	want := ""
+	switch c.Type {
+	case Int64:
+		_, ok = v.(int64)
+		want = "an int64"
+	case Double:
+		_, ok = v.(float64)
+		want = "a float64"
+	case Bool:
+		_, ok = v.(bool)
+		want = "a bool"
+	case String:
+		_, ok = v.(string)
+		want = "a string"
+	default:
+		return status.InvalidArgumentErrorf("Column %q has unknown type %d", c.Name, c.Type)
+	}
+	if !ok {
+		return status.InvalidArgumentErrorf("Value of column %q must be %s, but is %T", c.Name, want, v)
+	}
+	return nil
+}
+
+func (pw *Writer) appendValue(i int, c Column, v interface{}) {
+	buf := pw.values[i]
+	switch c.Type {
+	case Int64:
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], uint64(v.(int64)))
+		buf.Write(b[:])
+	case Double:
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v.(float64)))
+		buf.Write(b[:])
+	case Bool:
+		// Booleans are bit-packed, so they are only encoded once the page is
+		// complete.
+		pw.boolBits[i] = append(pw.boolBits[i], v.(bool))
+	case String:
+		s := v.(string)
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], uint32(len(s)))
+		buf.Write(b[:])
+		buf.WriteString(s)
+	}
+}
+
+// flushRowGroup writes the buffered rows as a row group, with one column
+// chunk of a single data page per column.
+func (pw *Writer) flushRowGroup() error {
+	if pw.rowCount == 0 {
+		return nil
+	}
+	rg := &rowGroup{numRows: pw.rowCount}
+	for i, c := range pw.columns {
+		data := pw.values[i]
+		if c.Type == Bool {
+			data = bytes.NewBuffer(packBits(pw.boolBits[i]))
+		}
+		header := &thriftWriter{}
+		header.i32Field(1, pageTypeDataPage)
+		header.i32Field(2, int32(data.Len()))
+		header.i32Field(3, int32(data.Len()))
+		header.structField(5)
+		header.i32Field(1, int32(pw.rowCount))
+		header.i32Field(2, encodingPlain)
+		header.i32Field(3, encodingRLE)
+		header.i32Field(4, encodingRLE)
+		header.endStruct()
+		header.endStruct()
+
+		chunk := &columnChunk{
+			fileOffset:       pw.offset,
+			numValues:        pw.rowCount,
+			uncompressedSize: int64(header.buf.Len() + data.Len()),
+		}
+		if err := pw.write(header.buf.Bytes()); err != nil {
+			return err
+		}
+		if err := pw.write(data.Bytes()); err != nil {
+			return err
+		}
+		rg.columns = append(rg.columns, chunk)
+		rg.totalByteSize += chunk.uncompressedSize
+
+		pw.values[i].Reset()
+		pw.boolBits[i] = pw.boolBits[i][:0]
+	}
+	pw.rowGroups = append(pw.rowGroups, rg)
+	pw.numRows += pw.rowCount
+	pw.rowCount = 0
+	return nil
+}
+
+// Close writes the remaining rows and the file footer. It doesn't close the
+// underlying writer.
+func (pw *Writer) Close() error {
+	if pw.closed {
+		return nil
+	}
+	pw.closed = true
+	if err := pw.flushRowGroup(); err != nil {
+		return err
+	}
+	footer := pw.fileMetadata()
+	if err := pw.write(footer); err != nil {
+		return err
+	}
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(footer)))
+	if err := pw.write(length[:]); err != nil {
+		return err
+	}
+	return pw.write([]byte(magic))
+}
+
+// fileMetadata returns the FileMetaData of the file, which describes its
+// schema and where its row groups are.
+func (pw *Writer) fileMetadata() []byte {
+	t := &thriftWriter{}
+	t.i32Field(1, 1 /*=version*/)
+
+	t.listField(2, thriftStruct, len(pw.columns)+1)
+	// The root of the schema is a group holding all of the columns.
+	t.beginStruct()
+	t.stringField(4, "schema")
+	t.i32Field(5, int32(len(pw.columns)))
+	t.endStruct()
+	for _, c := range pw.columns {
+		t.beginStruct()
+		t.i32Field(1, physicalType(c.Type))
+		t.i32Field(3, repetitionRequired)
+		t.stringField(4, c.Name)
+		if c.Type == String {
+			t.i32Field(6, convertedTypeUTF8)
+		}
+		t.endStruct()
+	}
+
+	t.i64Field(3, pw.numRows)
+
+	t.listField(4, thriftStruct, len(pw.rowGroups))
+	for _, rg := range pw.rowGroups {
+		t.beginStruct()
+		t.listField(1, thriftStruct, len(rg.columns))
+		for i, chunk := range rg.columns {
+			c := pw.columns[i]
+			t.beginStruct()
+			t.i64Field(2, chunk.fileOffset)
+			t.structField(3)
+			t.i32Field(1, physicalType(c.Type))
+			t.listField(2, thriftI32, 2)
+			t.i32(encodingPlain)
+			t.i32(encodingRLE)
+			t.listField(3, thriftBinary, 1)
+			t.string(c.Name)
+			t.i32Field(4, codecUncompressed)
+			t.i64Field(5, chunk.numValues)
+			t.i64Field(6, chunk.uncompressedSize)
+			t.i64Field(7, chunk.uncompressedSize)
+			t.i64Field(9, chunk.fileOffset)
+			t.endStruct()
+			t.endStruct()
+		}
+		t.i64Field(2, rg.totalByteSize)
+		t.i64Field(3, rg.numRows)
+		t.endStruct()
+	}
+
+	t.stringField(6, createdBy)
+	t.endStruct()
+	return t.buf.Bytes()
+}
+
+func (pw *Writer) write(b []byte) error {
+	n, err := pw.w.Write(b)
+	pw.offset += int64(n)
+	return err
+}
+
+func physicalType(t ColumnType) int32 {
+	switch t {
+	case Int64:
+		return typeInt64
+	case Double:
+		return typeDouble
+	case Bool:
+		return typeBoolean
+	default:
+		return typeByteArray
+	}
+}
+
+// packBits packs booleans into bytes, least significant bit first, as the
+// PLAIN encoding of booleans does.
+func packBits(bits []bool) []byte {
+	packed := make([]byte, (len(bits)+7)/8)
+	for i, b := range bits {
+		if b {
+			packed[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return packed
+}
@@ -0,0 +1,201 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// thriftReader decodes Thrift compact protocol structs into maps from field
+// ID to value, for checking what thriftWriter encoded.
+type thriftReader struct {
+	t *testing.T
+	r *bytes.Reader
+}
+
+func (tr *thriftReader) uvarint() uint64 {
+	v, err := binary.ReadUvarint(tr.r)
+	require.NoError(tr.t, err)
+	return v
+}
+
+func (tr *thriftReader) varint() int64 {
+	v := tr.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (tr *thriftReader) readByte() byte {
+	b, err := tr.r.ReadByte()
+	require.NoError(tr.t, err)
+	return b
+}
+
+func (tr *thriftReader) value(valueType byte) interface{} {
+	switch valueType {
+	case thriftI32, thriftI64:
+		return tr.varint()
+	case thriftBinary:
+		b := make([]byte, tr.uvarint())
+		_, err := tr.r.Read(b)
+		require.NoError(tr.t, err)
+		return string(b)
+	case thriftList:
+		header := tr.readByte()
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(tr.uvarint())
+		}
+		list := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			list = append(list, tr.value(header&0x0f))
+		}
+		return list
+	case thriftStruct:
+		return tr.readStruct()
+	default:
+		require.FailNowf(tr.t, "unexpected type", "type %d", valueType)
+		return nil
+	}
+}
+
+func (tr *thriftReader) readStruct() map[int16]interface{} {
+	s := map[int16]interface{}{}
+	lastID := int16(0)
+	for {
+		header := tr.readByte()
+		if header == 0 {
+			return s
+		}
+		id := lastID + int16(header>>4)
+		if header>>4 == 0 {
+			id = int16(tr.varint())
+		}
+		s[id] = tr.value(header & 0x0f)
+		lastID = id
+	}
+}
+
+func readFooter(t *testing.T, file []byte) map[int16]interface{} {
+	require.True(t, len(file) > 12)
+	require.Equal(t, magic, string(file[:4]))
+	require.Equal(t, magic, string(file[len(file)-4:]))
+	footerLen := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	footer := file[len(file)-8-footerLen : len(file)-8]
+	tr := &thriftReader{t: t, r: bytes.NewReader(footer)}
+	metadata := tr.readStruct()
+	assert.Equal(t, 0, tr.r.Len(), "footer has trailing bytes")
+	return metadata
+}
+
+// readPage returns the values of the data page at offset.
+func readPage(t *testing.T, file []byte, offset int64) (map[int16]interface{}, []byte) {
+	r := bytes.NewReader(file[offset:])
+	tr := &thriftReader{t: t, r: r}
+	header := tr.readStruct()
+	size := header[3].(int64)
+	start := int(offset) + len(file[offset:]) - r.Len()
+	return header, file[start : start+int(size)]
+}
+
+var testColumns = []Column{
+	{Name: "invocation_id", Type: String},
+	{Name: "duration_usec", Type: Int64},
+	{Name: "hit_rate", Type: Double},
+	{Name: "success", Type: Bool},
+}
+
+func TestWrite(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf, testColumns)
+	require.NoError(t, err)
+	require.NoError(t, w.Write([]interface{}{"a", int64(1), 0.5, true}))
+	require.NoError(t, w.Write([]interface{}{"bb", int64(-2), 1.0, false}))
+	require.NoError(t, w.Write([]interface{}{"", int64(1 << 40), 0.0, true}))
+	require.NoError(t, w.Close())
+
+	file := buf.Bytes()
+	metadata := readFooter(t, file)
+	assert.Equal(t, int64(1), metadata[1])
+	assert.Equal(t, int64(3), metadata[3])
+	assert.Equal(t, createdBy, metadata[6])
+
+	schema := metadata[2].([]interface{})
+	require.Len(t, schema, 5)
+	root := schema[0].(map[int16]interface{})
+	assert.Equal(t, "schema", root[4])
+	assert.Equal(t, int64(4), root[5])
+	for i, c := range testColumns {
+		element := schema[i+1].(map[int16]interface{})
+		assert.Equal(t, c.Name, element[4])
+		assert.Equal(t, int64(physicalType(c.Type)), element[1])
+		assert.Equal(t, int64(repetitionRequired), element[3])
+	}
+
+	rowGroups := metadata[4].([]interface{})
+	require.Len(t, rowGroups, 1)
+	rg := rowGroups[0].(map[int16]interface{})
+	assert.Equal(t, int64(3), rg[3])
+	chunks := rg[1].([]interface{})
+	require.Len(t, chunks, 4)
+
+	var pages [][]byte
+	for i, c := range chunks {
+		chunk := c.(map[int16]interface{})
+		chunkMetadata := chunk[3].(map[int16]interface{})
+		assert.Equal(t, []interface{}{testColumns[i].Name}, chunkMetadata[3])
+		assert.Equal(t, int64(3), chunkMetadata[5])
+		header, page := readPage(t, file, chunkMetadata[9].(int64))
+		assert.Equal(t, int64(pageTypeDataPage), header[1])
+		assert.Equal(t, int64(3), header[5].(map[int16]interface{})[1])
+		pages = append(pages, page)
+	}
+
+	assert.Equal(t, []byte("\x01\x00\x00\x00a\x02\x00\x00\x00bb\x00\x00\x00\x00"), pages[0])
+	require.Len(t, pages[1], 24)
+	assert.Equal(t, int64(-2), int64(binary.LittleEndian.Uint64(pages[1][8:])))
+	assert.Equal(t, int64(1<<40), int64(binary.LittleEndian.Uint64(pages[1][16:])))
+	require.Len(t, pages[2], 24)
+	assert.Equal(t, 0.5, math.Float64frombits(binary.LittleEndian.Uint64(pages[2])))
+	assert.Equal(t, []byte{0b101}, pages[3])
+}
+
+func TestWriteSplitsRowGroups(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf, testColumns)
+	require.NoError(t, err)
+	w.rowGroupSize = 2
+	for i := 0; i < 5; i++ {
+		require.NoError(t, w.Write([]interface{}{"x", int64(i), 0.0, false}))
+	}
+	require.NoError(t, w.Close())
+
+	metadata := readFooter(t, buf.Bytes())
+	assert.Equal(t, int64(5), metadata[3])
+	rowGroups := metadata[4].([]interface{})
+	require.Len(t, rowGroups, 3)
+	for i, want := range []int64{2, 2, 1} {
+		assert.Equal(t, want, rowGroups[i].(map[int16]interface{})[3])
+	}
+}
+
+func TestWriteEmpty(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf, testColumns)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	metadata := readFooter(t, buf.Bytes())
+	assert.Equal(t, int64(0), metadata[3])
+	assert.Empty(t, metadata[4])
+}
+
+func TestWriteRejectsMismatchedRows(t *testing.T) {
+	w, err := NewWriter(&bytes.Buffer{}, testColumns)
+	require.NoError(t, err)
+	assert.Error(t, w.Write([]interface{}{"a", int64(1), 0.5}))
+	assert.Error(t, w.Write([]interface{}{"a", 1, 0.5, true}))
+}
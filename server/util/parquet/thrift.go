@@ -0,0 +1,107 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Types of the Thrift compact protocol, which Parquet encodes its metadata
+// with. See
+// https://github.com/apache/thrift/blob/master/doc/specs/thrift-compact-protocol.md
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes a Thrift struct with the compact protocol. Writes
+// start inside the outermost struct, which is ended with endStruct.
+type thriftWriter struct {
+	buf bytes.Buffer
+
+	// The ID of the last field written to the current struct, which the IDs
+	// of the following fields are encoded relative to.
+	lastFieldID int16
+	// The last field IDs of the enclosing structs.
+	parentFieldIDs []int16
+}
+
+func (t *thriftWriter) fieldHeader(id int16, fieldType byte) {
+	if delta := id - t.lastFieldID; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | fieldType)
+	} else {
+		t.buf.WriteByte(fieldType)
+		t.varint(int64(id))
+	}
+	t.lastFieldID = id
+}
+
+func (t *thriftWriter) i32Field(id int16, v int32) {
+	t.fieldHeader(id, thriftI32)
+	t.i32(v)
+}
+
+func (t *thriftWriter) i64Field(id int16, v int64) {
+	t.fieldHeader(id, thriftI64)
+	t.varint(v)
+}
+
+func (t *thriftWriter) stringField(id int16, s string) {
+	t.fieldHeader(id, thriftBinary)
+	t.string(s)
+}
+
+// structField begins a struct-valued field, which must be ended with
+// endStruct.
+func (t *thriftWriter) structField(id int16) {
+	t.fieldHeader(id, thriftStruct)
+	t.beginStruct()
+}
+
+// listField begins a list-valued field. It must be followed by size
+// elements of the given type, with beginStruct and endStruct around each
+// struct element.
+func (t *thriftWriter) listField(id int16, elemType byte, size int) {
+	t.fieldHeader(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elemType)
+	} else {
+		t.buf.WriteByte(0xf0 | elemType)
+		t.uvarint(uint64(size))
+	}
+}
+
+func (t *thriftWriter) beginStruct() {
+	t.parentFieldIDs = append(t.parentFieldIDs, t.lastFieldID)
+	t.lastFieldID = 0
+}
+
+func (t *thriftWriter) endStruct() {
+	t.buf.WriteByte(0) // STOP
+	if n := len(t.parentFieldIDs); n > 0 {
+		t.lastFieldID = t.parentFieldIDs[n-1]
+		t.parentFieldIDs = t.parentFieldIDs[:n-1]
+	}
+}
+
+func (t *thriftWriter) i32(v int32) {
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) string(s string) {
+	t.uvarint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+// varint writes a zigzag-encoded varint, as integers are encoded.
+func (t *thriftWriter) varint(v int64) {
+	t.uvarint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	t.buf.Write(b[:n])
+}
@@ -0,0 +1,129 @@
+// Package platform_policy applies an organization's policy for the platform
+// properties of its remote executions, so that the policy is enforced by the
+// server rather than depending on every client's configuration.
+//
+// A policy consists of default properties, which are added to actions that
+// don't set them, and forced properties, which replace whatever value actions
+// set. For example, a policy could default "Pool" to "linux" and force
+// "dockerNetwork" to "off".
+package platform_policy
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+// ParseProperties parses a comma-separated list of name=value platform
+// properties, as stored in a group's policy. Names may not be repeated, and
+// are compared ignoring case like the properties themselves.
+func ParseProperties(list string) ([]*repb.Platform_Property, error) {
+	var props []*repb.Platform_Property
+	seen := make(map[string]struct{})
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, status.InvalidArgumentErrorf("Invalid platform property %q: expected name=value", entry)
+		}
+		name := strings.TrimSpace(parts[0])
+		if _, ok := seen[strings.ToLower(name)]; ok {
+			return nil, status.InvalidArgumentErrorf("Platform property %q is set more than once", name)
+		}
+		seen[strings.ToLower(name)] = struct{}{}
+		props = append(props, &repb.Platform_Property{Name: name, Value: strings.TrimSpace(parts[1])})
+	}
+	return props, nil
+}
+
+// NormalizeProperties validates a comma-separated list of name=value platform
+// properties and returns it in the canonical form that is stored.
+func NormalizeProperties(list string) (string, error) {
+	props, err := ParseProperties(list)
+	if err != nil {
+		return "", err
+	}
+	entries := make([]string, 0, len(props))
+	for _, p := range props {
+		entries = append(entries, p.GetName()+"="+p.GetValue())
+	}
+	return strings.Join(entries, ","), nil
+}
+
+// Policy is the platform property policy of a group.
+type Policy struct {
+	defaults []*repb.Platform_Property
+	forced   []*repb.Platform_Property
+}
+
+// New returns the policy with the given comma-separated default and forced
+// properties, or nil if neither are set.
+func New(defaults, forced string) (*Policy, error) {
+	p := &Policy{}
+	var err error
+	if p.defaults, err = ParseProperties(defaults); err != nil {
+		return nil, err
+	}
+	if p.forced, err = ParseProperties(forced); err != nil {
+		return nil, err
+	}
+	if len(p.defaults) == 0 && len(p.forced) == 0 {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// Override records a property value which was set by an action but replaced
+// by a forced property.
+type Override struct {
+	Name     string
+	OldValue string
+	NewValue string
+}
+
+// Apply returns the platform with the policy applied, sorted by name as
+// required by the remote execution API, and the values set by the action that
+// the policy overrode. The given platform is not modified. A nil policy
+// returns the platform unchanged.
+func (p *Policy) Apply(plat *repb.Platform) (*repb.Platform, []*Override) {
+	if p == nil {
+		return plat, nil
+	}
+	var props []*repb.Platform_Property
+	index := make(map[string]int)
+	for _, prop := range plat.GetProperties() {
+		index[strings.ToLower(prop.GetName())] = len(props)
+		props = append(props, &repb.Platform_Property{Name: prop.GetName(), Value: prop.GetValue()})
+	}
+	for _, d := range p.defaults {
+		if _, ok := index[strings.ToLower(d.GetName())]; !ok {
+			index[strings.ToLower(d.GetName())] = len(props)
+			props = append(props, &repb.Platform_Property{Name: d.GetName(), Value: d.GetValue()})
+		}
+	}
+	var overrides []*Override
+	for _, f := range p.forced {
+		i, ok := index[strings.ToLower(f.GetName())]
+		if !ok {
+			props = append(props, &repb.Platform_Property{Name: f.GetName(), Value: f.GetValue()})
+			continue
+		}
+		if props[i].GetValue() != f.GetValue() {
+			overrides = append(overrides, &Override{Name: props[i].GetName(), OldValue: props[i].GetValue(), NewValue: f.GetValue()})
+			props[i].Value = f.GetValue()
+		}
+	}
+	sort.SliceStable(props, func(i, j int) bool {
+		if props[i].GetName() != props[j].GetName() {
+			return props[i].GetName() < props[j].GetName()
+		}
+		return props[i].GetValue() < props[j].GetValue()
+	})
+	return &repb.Platform{Properties: props}, overrides
+}
@@ -0,0 +1,84 @@
+package platform_policy_test
+
+import (
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/platform_policy"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+func platform(props ...string) *repb.Platform {
+	p := &repb.Platform{}
+	for i := 0; i < len(props); i += 2 {
+		p.Properties = append(p.Properties, &repb.Platform_Property{Name: props[i], Value: props[i+1]})
+	}
+	return p
+}
+
+func TestApply(t *testing.T) {
+	policy, err := platform_policy.New("Pool=linux, container-image=docker://gcr.io/org/image", "dockerNetwork=off,recycle-runner=false")
+	require.NoError(t, err)
+
+	plat, overrides := policy.Apply(platform("dockerNetwork", "bridge", "OSFamily", "linux", "Pool", "gpu"))
+	assert.Equal(t, platform(
+		"OSFamily", "linux",
+		"Pool", "gpu",
+		"container-image", "docker://gcr.io/org/image",
+		"dockerNetwork", "off",
+		"recycle-runner", "false",
+	), plat)
+	assert.Equal(t, []*platform_policy.Override{{Name: "dockerNetwork", OldValue: "bridge", NewValue: "off"}}, overrides)
+
+	// Names are compared ignoring case, and actions that already comply
+	// aren't reported as overridden.
+	plat, overrides = policy.Apply(platform("pool", "mac", "DockerNetwork", "off"))
+	assert.Equal(t, platform(
+		"DockerNetwork", "off",
+		"container-image", "docker://gcr.io/org/image",
+		"pool", "mac",
+		"recycle-runner", "false",
+	), plat)
+	assert.Empty(t, overrides)
+
+	var nilPolicy *platform_policy.Policy
+	original := platform("Pool", "gpu")
+	plat, overrides = nilPolicy.Apply(original)
+	assert.Equal(t, original, plat)
+	assert.Empty(t, overrides)
+}
+
+func TestApplyDoesNotModifyPlatform(t *testing.T) {
+	policy, err := platform_policy.New("", "dockerNetwork=off")
+	require.NoError(t, err)
+	original := platform("dockerNetwork", "bridge")
+	policy.Apply(original)
+	assert.Equal(t, platform("dockerNetwork", "bridge"), original)
+}
+
+func TestNew(t *testing.T) {
+	policy, err := platform_policy.New(" , ", "")
+	require.NoError(t, err)
+	assert.Nil(t, policy)
+
+	for _, list := range []string{"Pool", "=linux", "Pool=linux,pool=mac"} {
+		_, err := platform_policy.New(list, "")
+		assert.True(t, status.IsInvalidArgumentError(err), "%q: expected InvalidArgument, got %v", list, err)
+	}
+}
+
+func TestNormalizeProperties(t *testing.T) {
+	normalized, err := platform_policy.NormalizeProperties(" Pool = linux ,, dockerNetwork=off ")
+	require.NoError(t, err)
+	assert.Equal(t, "Pool=linux,dockerNetwork=off", normalized)
+
+	normalized, err = platform_policy.NormalizeProperties("")
+	require.NoError(t, err)
+	assert.Equal(t, "", normalized)
+
+	_, err = platform_policy.NormalizeProperties("Pool")
+	assert.Error(t, err)
+}
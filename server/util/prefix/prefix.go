@@ -43,6 +43,17 @@ func AttachUserPrefixToContext(ctx context.Context, env environment.Env) (contex
 	return context.WithValue(ctx, userPrefix, prefix), nil
 }
 
+// AttachGroupPrefixToContext returns a context for reading and writing the
+// cache entries of the given group, for use by the server itself rather than
+// on behalf of an authenticated request. An empty group ID selects the
+// entries of anonymous users.
+func AttachGroupPrefixToContext(ctx context.Context, groupID string) context.Context {
+	if groupID == "" {
+		groupID = "ANON"
+	}
+	return context.WithValue(ctx, userPrefix, addPrefix(groupID, ""))
+}
+
 func UserPrefixFromContext(ctx context.Context) (string, error) {
 	if v := ctx.Value(userPrefix); v != nil {
 		return v.(string), nil
@@ -5,6 +5,8 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"path/filepath"
 	"sync"
@@ -18,6 +20,25 @@ import (
 	gstatus "google.golang.org/grpc/status"
 )
 
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Protos are marshaled into buffers from this pool before they're copied into
+// the chunk, so that writing a proto to a stream doesn't allocate. Buffers
+// which grew larger than maxPooledBufferSizeBytes aren't returned to the pool,
+// so that a few large protos don't pin memory.
+var marshalBufferPool = sync.Pool{
+	New: func() interface{} {
+		return proto.NewBuffer(make([]byte, 0, 4096))
+	},
+}
+
+const maxPooledBufferSizeBytes = 1024 * 1024
+
+// formatChecksum formats the checksum of a stream as returned by Checksum.
+func formatChecksum(h hash.Hash32) string {
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
 // BufferedProtoWriter chunks together and writes protos to blobstore after
 // a chunk exceeds maxBufferSizeBytes size. The caller is responsible for
 // calling Flush to ensure all data is written.
@@ -28,7 +49,8 @@ type BufferedProtoWriter struct {
 	streamID            string
 	maxBufferSizeBytes  int
 	writeSequenceNumber int
-	writeMutex          sync.Mutex // protects(writeBuf), protects(writeSequenceNumber), protects(lastWriteTime)
+	checksum            hash.Hash32
+	writeMutex          sync.Mutex // protects(writeBuf), protects(writeSequenceNumber), protects(lastWriteTime), protects(checksum)
 }
 
 // BufferedProtoReader reads the chunks written by BufferedProtoWriter. Callers
@@ -41,6 +63,10 @@ type BufferedProtoReader struct {
 	q        *blobQueue
 	readBuf  *bytes.Buffer
 	streamID string
+	// If set, the stream is verified against this checksum once it has been
+	// read.
+	expectedChecksum string
+	checksum         hash.Hash32
 }
 
 func NewBufferedProtoReader(bs interfaces.Blobstore, streamID string) *BufferedProtoReader {
@@ -48,9 +74,17 @@ func NewBufferedProtoReader(bs interfaces.Blobstore, streamID string) *BufferedP
 		streamID: streamID,
 		bs:       bs,
 		q:        newBlobQueue(bs, streamID),
+		checksum: crc32.New(crc32cTable),
 	}
 }
 
+// VerifyChecksum makes ReadProto return a DataLoss error instead of io.EOF if
+// the stream doesn't match the checksum returned by the writer's Checksum.
+// The stream must have been completely written.
+func (w *BufferedProtoReader) VerifyChecksum(checksum string) {
+	w.expectedChecksum = checksum
+}
+
 func NewBufferedProtoWriter(bs interfaces.Blobstore, streamID string, bufferSizeBytes int) *BufferedProtoWriter {
 	return &BufferedProtoWriter{
 		streamID:           streamID,
@@ -60,11 +94,22 @@ func NewBufferedProtoWriter(bs interfaces.Blobstore, streamID string, bufferSize
 		writeBuf:            bytes.NewBuffer(make([]byte, 0, bufferSizeBytes)),
 		writeSequenceNumber: 0,
 		lastWriteTime:       time.Now(),
+		checksum:            crc32.New(crc32cTable),
 	}
 }
 
-func chunkName(streamID string, sequenceNumber int) string {
-	chunkFileName := fmt.Sprintf("%s-%d.chunk", streamID, sequenceNumber)
+// Checksum returns the CRC-32C checksum, as hex, of all the data written to
+// the stream so far, whether or not it has been flushed.
+func (w *BufferedProtoWriter) Checksum() string {
+	w.writeMutex.Lock()
+	defer w.writeMutex.Unlock()
+	return formatChecksum(w.checksum)
+}
+
+// ChunkName returns the name of the blob holding the chunk with the given
+// sequence number in the stream.
+func ChunkName(streamID string, sequenceNumber int) string {
+	chunkFileName := fmt.Sprintf("%s-%d.chunk", filepath.Base(streamID), sequenceNumber)
 	return filepath.Join(streamID, "/chunks/", chunkFileName)
 }
 
@@ -73,7 +118,7 @@ func (w *BufferedProtoWriter) internalFlush(ctx context.Context) error {
 		return nil
 	}
 
-	tmpFilePath := chunkName(w.streamID, w.writeSequenceNumber)
+	tmpFilePath := ChunkName(w.streamID, w.writeSequenceNumber)
 	if _, err := w.bs.WriteBlob(ctx, tmpFilePath, w.writeBuf.Bytes()); err != nil {
 		return err
 	}
@@ -94,17 +139,27 @@ func (w *BufferedProtoWriter) TimeSinceLastWrite() time.Duration {
 	return time.Now().Sub(w.lastWriteTime)
 }
 
+func putMarshalBuffer(buf *proto.Buffer) {
+	if cap(buf.Bytes()) > maxPooledBufferSizeBytes {
+		return
+	}
+	buf.Reset()
+	marshalBufferPool.Put(buf)
+}
+
 func (w *BufferedProtoWriter) WriteProtoToStream(ctx context.Context, msg proto.Message) error {
 	w.writeMutex.Lock()
 	defer w.writeMutex.Unlock()
 
-	protoBytes, err := proto.Marshal(msg)
-	if err != nil {
+	buf := marshalBufferPool.Get().(*proto.Buffer)
+	defer putMarshalBuffer(buf)
+	if err := buf.Marshal(msg); err != nil {
 		return err
 	}
-	msgLength := int64(len(protoBytes))
-	varintBuf := make([]byte, binary.MaxVarintLen64)
-	varintSize := binary.PutVarint(varintBuf, msgLength)
+	protoBytes := buf.Bytes()
+	start := w.writeBuf.Len()
+	var varintBuf [binary.MaxVarintLen64]byte
+	varintSize := binary.PutVarint(varintBuf[:], int64(len(protoBytes)))
 	// Write a header-chunk to know how big the proto is
 	if _, err := w.writeBuf.Write(varintBuf[:varintSize]); err != nil {
 		return err
@@ -113,6 +168,7 @@ func (w *BufferedProtoWriter) WriteProtoToStream(ctx context.Context, msg proto.
 	if _, err := w.writeBuf.Write(protoBytes); err != nil {
 		return err
 	}
+	w.checksum.Write(w.writeBuf.Bytes()[start:])
 
 	// Flush, if we need to.
 	if w.writeBuf.Len() > w.maxBufferSizeBytes {
@@ -159,7 +215,7 @@ func (q *blobQueue) pushNewFuture(ctx context.Context) {
 	go func() {
 		defer close(future)
 
-		tmpFilePath := chunkName(q.streamID, sequenceNumber)
+		tmpFilePath := ChunkName(q.streamID, sequenceNumber)
 		data, err := q.blobstore.ReadBlob(ctx, tmpFilePath)
 		future <- blobReadResult{
 			data: data,
@@ -195,10 +251,14 @@ func (w *BufferedProtoReader) ReadProto(ctx context.Context, msg proto.Message)
 			fileData, err := w.q.pop(ctx)
 			if err != nil {
 				if gstatus.Code(err) == gcodes.NotFound {
+					if w.expectedChecksum != "" && formatChecksum(w.checksum) != w.expectedChecksum {
+						return status.DataLossErrorf("stream %s does not match its checksum (got %s, want %s)", w.streamID, formatChecksum(w.checksum), w.expectedChecksum)
+					}
 					return io.EOF
 				}
 				return err
 			}
+			w.checksum.Write(fileData)
 			w.readBuf = bytes.NewBuffer(fileData)
 		}
 		// read proto from buf
@@ -207,8 +267,12 @@ func (w *BufferedProtoReader) ReadProto(ctx context.Context, msg proto.Message)
 			w.readBuf = nil
 			continue
 		}
-		protoBytes := make([]byte, count)
-		w.readBuf.Read(protoBytes)
+		if count < 0 {
+			return status.DataLossErrorf("stream %s has a proto of negative length", w.streamID)
+		}
+		// Unmarshal copies the fields out of the chunk, so the proto can be
+		// read from the chunk in place.
+		protoBytes := w.readBuf.Next(int(count))
 		if err := proto.Unmarshal(protoBytes, msg); err != nil {
 			return err
 		}
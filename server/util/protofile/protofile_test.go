@@ -0,0 +1,141 @@
+package protofile_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	"github.com/buildbuddy-io/buildbuddy/server/util/protofile"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+)
+
+// memoryBlobstore keeps blobs in memory, so that benchmarks measure the cost
+// of encoding the stream rather than of storing it.
+type memoryBlobstore struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func newMemoryBlobstore() *memoryBlobstore {
+	return &memoryBlobstore{blobs: make(map[string][]byte)}
+}
+
+func (m *memoryBlobstore) BlobExists(ctx context.Context, blobName string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.blobs[blobName]
+	return ok, nil
+}
+
+func (m *memoryBlobstore) ReadBlob(ctx context.Context, blobName string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.blobs[blobName]
+	if !ok {
+		return nil, status.NotFoundErrorf("blob %q not found", blobName)
+	}
+	return data, nil
+}
+
+func (m *memoryBlobstore) WriteBlob(ctx context.Context, blobName string, data []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[blobName] = append([]byte{}, data...)
+	return len(data), nil
+}
+
+func (m *memoryBlobstore) DeleteBlob(ctx context.Context, blobName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.blobs, blobName)
+	return nil
+}
+
+func progressEvent(i int) *inpb.InvocationEvent {
+	return &inpb.InvocationEvent{
+		SequenceNumber: int64(i),
+		BuildEvent: &build_event_stream.BuildEvent{
+			Payload: &build_event_stream.BuildEvent_Progress{
+				Progress: &build_event_stream.Progress{
+					Stderr: fmt.Sprintf("[%d / 1,000] Compiling src/file_%d.cc; 1s remote\n", i, i),
+				},
+			},
+		},
+	}
+}
+
+func TestWriteAndReadStream(t *testing.T) {
+	ctx := context.Background()
+	bs := newMemoryBlobstore()
+	w := protofile.NewBufferedProtoWriter(bs, "stream", 1000)
+	var events []*inpb.InvocationEvent
+	for i := 0; i < 100; i++ {
+		events = append(events, progressEvent(i))
+	}
+	// A proto larger than the chunk size.
+	events = append(events, &inpb.InvocationEvent{
+		BuildEvent: &build_event_stream.BuildEvent{
+			Payload: &build_event_stream.BuildEvent_Progress{
+				Progress: &build_event_stream.Progress{Stdout: strings.Repeat("x", 5000)},
+			},
+		},
+	})
+	for _, e := range events {
+		require.NoError(t, w.WriteProtoToStream(ctx, e))
+	}
+	require.NoError(t, w.Flush(ctx))
+
+	r := protofile.NewBufferedProtoReader(bs, "stream")
+	r.VerifyChecksum(w.Checksum())
+	for _, want := range events {
+		got := &inpb.InvocationEvent{}
+		require.NoError(t, r.ReadProto(ctx, got))
+		assert.True(t, proto.Equal(want, got), "got %v, want %v", got, want)
+	}
+	assert.Equal(t, io.EOF, r.ReadProto(ctx, &inpb.InvocationEvent{}))
+}
+
+func BenchmarkWriteProtoToStream(b *testing.B) {
+	ctx := context.Background()
+	w := protofile.NewBufferedProtoWriter(newMemoryBlobstore(), "stream", 4*1024*1024)
+	event := progressEvent(1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := w.WriteProtoToStream(ctx, event); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadProto(b *testing.B) {
+	ctx := context.Background()
+	bs := newMemoryBlobstore()
+	w := protofile.NewBufferedProtoWriter(bs, "stream", 4*1024*1024)
+	for i := 0; i < b.N; i++ {
+		if err := w.WriteProtoToStream(ctx, progressEvent(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := w.Flush(ctx); err != nil {
+		b.Fatal(err)
+	}
+	r := protofile.NewBufferedProtoReader(bs, "stream")
+	event := &inpb.InvocationEvent{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := r.ReadProto(ctx, event); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
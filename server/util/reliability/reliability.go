@@ -0,0 +1,306 @@
+// Package reliability keeps a short in-memory history of the outcome and
+// latency of each gRPC request served, and summarizes it as success rates
+// and latency percentiles per service. This gives small deployments basic
+// reliability reporting without running Prometheus.
+package reliability
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/statusz"
+	"google.golang.org/grpc/codes"
+
+	gstatus "google.golang.org/grpc/status"
+)
+
+const (
+	bucketDuration = time.Minute
+
+	// MinWindow is the shortest window that can be summarized, since
+	// requests are counted by the minute.
+	MinWindow = bucketDuration
+
+	// MaxWindow is the longest window that can be summarized.
+	MaxWindow = 24 * time.Hour
+
+	// DefaultWindow is the window summarized if none is specified.
+	DefaultWindow = time.Hour
+
+	numBuckets = int(MaxWindow / bucketDuration)
+)
+
+var (
+	// Upper bounds of the latency histogram buckets. Percentiles are
+	// reported as the upper bound of the bucket they fall in.
+	latencyBounds = [...]time.Duration{
+		1 * time.Millisecond,
+		2 * time.Millisecond,
+		5 * time.Millisecond,
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		50 * time.Millisecond,
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		500 * time.Millisecond,
+		1 * time.Second,
+		2 * time.Second,
+		5 * time.Second,
+		10 * time.Second,
+		30 * time.Second,
+		1 * time.Minute,
+		5 * time.Minute,
+	}
+
+	defaultTracker = NewTracker()
+
+	statuszTemplate = template.Must(template.New("reliability").Parse(`
+<table>
+  <tr><th>Service</th><th>Requests</th><th>Success rate</th><th>p50</th><th>p90</th><th>p99</th></tr>
+  {{range .Services}}
+  <tr><td>{{.Service}}</td><td>{{.Requests}}</td><td>{{printf "%.3f%%" .SuccessPercent}}</td><td>{{.P50Ms}}ms</td><td>{{.P90Ms}}ms</td><td>{{.P99Ms}}ms</td></tr>
+  {{end}}
+</table>`))
+)
+
+func init() {
+	statusz.AddSection("reliability", "Request success rates and latencies over the last hour", statusz.StatusFunc(func(ctx context.Context) string {
+		buf := &strings.Builder{}
+		if err := statuszTemplate.Execute(buf, defaultTracker.Summarize(DefaultWindow)); err != nil {
+			return template.HTMLEscapeString(err.Error())
+		}
+		return buf.String()
+	}))
+}
+
+// bucket holds the requests received during one minute. Its fields are
+// updated atomically, so that recording a request doesn't take a lock.
+type bucket struct {
+	// The start of the minute that this bucket holds, in unix minutes. A
+	// bucket holding a minute outside of the window being summarized is
+	// ignored, so buckets only need to be cleared when they're reused.
+	minute          int64
+	requests        int64
+	failures        int64
+	latency         [len(latencyBounds) + 1]int64
+	maxLatencyNanos int64
+}
+
+// serviceBuckets holds a service's buckets for the last MaxWindow.
+type serviceBuckets struct {
+	// Held while clearing a bucket to reuse it for a new minute, which
+	// happens at most once a minute.
+	resetMu sync.Mutex
+	buckets [numBuckets]bucket
+}
+
+// Tracker records requests and summarizes them. It is safe for concurrent
+// use.
+type Tracker struct {
+	// Maps service names to *serviceBuckets.
+	services sync.Map
+	now      func() time.Time
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{now: time.Now}
+}
+
+// NewTrackerForTesting returns a tracker which uses the given clock.
+func NewTrackerForTesting(now func() time.Time) *Tracker {
+	t := NewTracker()
+	t.now = now
+	return t
+}
+
+// IsFailure returns whether a request which returned err should count
+// against its service's success rate. Errors caused by the client, such as
+// NotFound or PermissionDenied, are not failures.
+func IsFailure(err error) bool {
+	switch gstatus.Code(err) {
+	case codes.Unknown, codes.Internal, codes.Unavailable, codes.DataLoss, codes.DeadlineExceeded:
+		return true
+	default:
+		return false
+	}
+}
+
+// ServiceName returns the name of the service that a gRPC method belongs to,
+// given its full name (like "/google.bytestream.ByteStream/Read").
+func ServiceName(fullMethod string) string {
+	return strings.TrimPrefix(path.Dir(fullMethod), "/")
+}
+
+// Record records a gRPC request to the default tracker.
+func Record(fullMethod string, duration time.Duration, err error) {
+	defaultTracker.Record(ServiceName(fullMethod), duration, err)
+}
+
+// Handler returns an HTTP handler serving summaries from the default tracker.
+func Handler() http.Handler {
+	return defaultTracker
+}
+
+func (t *Tracker) serviceBuckets(service string) *serviceBuckets {
+	if v, ok := t.services.Load(service); ok {
+		return v.(*serviceBuckets)
+	}
+	v, _ := t.services.LoadOrStore(service, &serviceBuckets{})
+	return v.(*serviceBuckets)
+}
+
+// Record records a request to the given service.
+func (t *Tracker) Record(service string, duration time.Duration, err error) {
+	minute := t.now().Unix() / int64(bucketDuration/time.Second)
+	latencyIndex := sort.Search(len(latencyBounds), func(i int) bool { return duration <= latencyBounds[i] })
+
+	sb := t.serviceBuckets(service)
+	b := &sb.buckets[minute%int64(numBuckets)]
+	if atomic.LoadInt64(&b.minute) != minute {
+		sb.resetMu.Lock()
+		if atomic.LoadInt64(&b.minute) != minute {
+			atomic.StoreInt64(&b.requests, 0)
+			atomic.StoreInt64(&b.failures, 0)
+			for i := range b.latency {
+				atomic.StoreInt64(&b.latency[i], 0)
+			}
+			atomic.StoreInt64(&b.maxLatencyNanos, 0)
+			atomic.StoreInt64(&b.minute, minute)
+		}
+		sb.resetMu.Unlock()
+	}
+	atomic.AddInt64(&b.requests, 1)
+	if IsFailure(err) {
+		atomic.AddInt64(&b.failures, 1)
+	}
+	atomic.AddInt64(&b.latency[latencyIndex], 1)
+	for {
+		max := atomic.LoadInt64(&b.maxLatencyNanos)
+		if int64(duration) <= max || atomic.CompareAndSwapInt64(&b.maxLatencyNanos, max, int64(duration)) {
+			break
+		}
+	}
+}
+
+// totals holds the requests received over a window.
+type totals struct {
+	requests   int64
+	failures   int64
+	latency    [len(latencyBounds) + 1]int64
+	maxLatency time.Duration
+}
+
+type ServiceSummary struct {
+	Service        string  `json:"service"`
+	Requests       int64   `json:"requests"`
+	Failures       int64   `json:"failures"`
+	SuccessPercent float64 `json:"success_percent"`
+	P50Ms          int64   `json:"p50_ms"`
+	P90Ms          int64   `json:"p90_ms"`
+	P99Ms          int64   `json:"p99_ms"`
+}
+
+type Summary struct {
+	WindowSeconds int64             `json:"window_seconds"`
+	Services      []*ServiceSummary `json:"services"`
+}
+
+// Summarize returns a summary of the requests recorded within the given
+// window. Requests are counted by the minute, so the window is rounded down
+// to a whole number of minutes, and is at least MinWindow and at most
+// MaxWindow. Services without any requests in the window are omitted.
+func (t *Tracker) Summarize(window time.Duration) *Summary {
+	if window < MinWindow {
+		window = MinWindow
+	}
+	if window > MaxWindow {
+		window = MaxWindow
+	}
+	minutes := int64(window / bucketDuration)
+	now := t.now().Unix() / int64(bucketDuration/time.Second)
+	// Always include the current, partial minute.
+	oldest := now - minutes + 1
+
+	summary := &Summary{WindowSeconds: minutes * int64(bucketDuration/time.Second), Services: []*ServiceSummary{}}
+	t.services.Range(func(k, v interface{}) bool {
+		service, sb := k.(string), v.(*serviceBuckets)
+		total := totals{}
+		for i := range sb.buckets {
+			b := &sb.buckets[i]
+			if minute := atomic.LoadInt64(&b.minute); minute < oldest || minute > now {
+				continue
+			}
+			total.requests += atomic.LoadInt64(&b.requests)
+			total.failures += atomic.LoadInt64(&b.failures)
+			for j := range b.latency {
+				total.latency[j] += atomic.LoadInt64(&b.latency[j])
+			}
+			if max := time.Duration(atomic.LoadInt64(&b.maxLatencyNanos)); max > total.maxLatency {
+				total.maxLatency = max
+			}
+		}
+		if total.requests == 0 {
+			return true
+		}
+		summary.Services = append(summary.Services, &ServiceSummary{
+			Service:        service,
+			Requests:       total.requests,
+			Failures:       total.failures,
+			SuccessPercent: 100 * float64(total.requests-total.failures) / float64(total.requests),
+			P50Ms:          total.percentile(0.50).Milliseconds(),
+			P90Ms:          total.percentile(0.90).Milliseconds(),
+			P99Ms:          total.percentile(0.99).Milliseconds(),
+		})
+		return true
+	})
+	sort.Slice(summary.Services, func(i, j int) bool {
+		return summary.Services[i].Service < summary.Services[j].Service
+	})
+	return summary
+}
+
+func (b *totals) percentile(p float64) time.Duration {
+	rank := int64(p * float64(b.requests))
+	if rank < 1 {
+		rank = 1
+	}
+	seen := int64(0)
+	for i, n := range b.latency {
+		seen += n
+		if seen < rank {
+			continue
+		}
+		if i == len(latencyBounds) || latencyBounds[i] > b.maxLatency {
+			return b.maxLatency
+		}
+		return latencyBounds[i]
+	}
+	return b.maxLatency
+}
+
+// ServeHTTP serves a JSON summary. The window can be set with the "window"
+// query parameter, as a duration like "5m" or "24h" of at least MinWindow.
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	window := DefaultWindow
+	if s := r.URL.Query().Get("window"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < MinWindow || d > MaxWindow {
+			http.Error(w, fmt.Sprintf("Invalid window %q: must be a duration between %s and %s", s, MinWindow, MaxWindow), http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t.Summarize(window)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
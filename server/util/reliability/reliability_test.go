@@ -0,0 +1,132 @@
+package reliability_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/reliability"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummarize(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	tr := reliability.NewTrackerForTesting(func() time.Time { return now })
+
+	// Two hours ago: only failures.
+	now = now.Add(-2 * time.Hour)
+	for i := 0; i < 10; i++ {
+		tr.Record("cache", time.Millisecond, status.InternalError("boom"))
+	}
+	now = now.Add(2 * time.Hour)
+
+	// Recently: 100 cache requests, one of which failed, and a few client
+	// errors which don't count as failures.
+	for i := 0; i < 95; i++ {
+		tr.Record("cache", 3*time.Millisecond, nil)
+	}
+	tr.Record("cache", 3*time.Millisecond, status.UnavailableError("unavailable"))
+	for i := 0; i < 4; i++ {
+		tr.Record("cache", 150*time.Millisecond, status.NotFoundError("not found"))
+	}
+	tr.Record("execution", 7*time.Second, nil)
+
+	summary := tr.Summarize(time.Hour)
+	assert.Equal(t, int64(3600), summary.WindowSeconds)
+	require.Len(t, summary.Services, 2)
+	assert.Equal(t, &reliability.ServiceSummary{
+		Service:        "cache",
+		Requests:       100,
+		Failures:       1,
+		SuccessPercent: 99,
+		P50Ms:          5,
+		P90Ms:          5,
+		P99Ms:          150,
+	}, summary.Services[0])
+	assert.Equal(t, "execution", summary.Services[1].Service)
+	assert.Equal(t, int64(7000), summary.Services[1].P99Ms)
+
+	summary = tr.Summarize(24 * time.Hour)
+	require.Len(t, summary.Services, 2)
+	assert.Equal(t, int64(110), summary.Services[0].Requests)
+	assert.Equal(t, int64(11), summary.Services[0].Failures)
+
+	// Windows are counted in whole minutes, including the current one.
+	summary = tr.Summarize(30 * time.Second)
+	assert.Equal(t, int64(60), summary.WindowSeconds)
+	require.Len(t, summary.Services, 2)
+	assert.Equal(t, int64(100), summary.Services[0].Requests)
+	assert.Equal(t, int64(3600), tr.Summarize(time.Hour+30*time.Second).WindowSeconds)
+
+	// Requests older than the max window are forgotten.
+	now = now.Add(25 * time.Hour)
+	assert.Empty(t, tr.Summarize(24*time.Hour).Services)
+}
+
+func TestServeHTTP(t *testing.T) {
+	tr := reliability.NewTracker()
+	tr.Record("cache", time.Millisecond, nil)
+
+	rec := httptest.NewRecorder()
+	tr.ServeHTTP(rec, httptest.NewRequest("GET", "/reliability?window=5m", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	summary := &reliability.Summary{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), summary))
+	assert.Equal(t, int64(300), summary.WindowSeconds)
+	require.Len(t, summary.Services, 1)
+	assert.Equal(t, int64(1), summary.Services[0].Requests)
+
+	for _, window := range []string{"foo", "-1h", "0s", "30s", "48h"} {
+		rec = httptest.NewRecorder()
+		tr.ServeHTTP(rec, httptest.NewRequest("GET", "/reliability?window="+window, nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, window)
+	}
+}
+
+func TestRecordConcurrently(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	var mu sync.Mutex
+	tr := reliability.NewTrackerForTesting(func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	})
+
+	// Requests are recorded while the minute changes, so that buckets are
+	// reused while other requests are being recorded.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				var err error
+				if j%10 == 0 {
+					err = status.InternalError("boom")
+				}
+				tr.Record("cache", time.Duration(j)*time.Millisecond, err)
+				if i == 0 && j%100 == 0 {
+					mu.Lock()
+					now = now.Add(time.Minute)
+					mu.Unlock()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	summary := tr.Summarize(reliability.MaxWindow)
+	require.Len(t, summary.Services, 1)
+	assert.Equal(t, int64(8000), summary.Services[0].Requests)
+	assert.Equal(t, int64(800), summary.Services[0].Failures)
+	assert.Equal(t, int64(999), summary.Services[0].P99Ms)
+}
+
+func TestServiceName(t *testing.T) {
+	assert.Equal(t, "google.bytestream.ByteStream", reliability.ServiceName("/google.bytestream.ByteStream/Read"))
+}
@@ -0,0 +1,81 @@
+package request_info
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/bazel_request"
+	"github.com/buildbuddy-io/buildbuddy/server/util/uuid"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	infoContextKey = "requestinfo.info"
+)
+
+// Info describes who made a request, and with what. It is computed once per
+// request by the gRPC server interceptors, after authentication, so that
+// handlers, logs, and metrics don't need to re-authenticate the caller or
+// re-parse request headers.
+type Info struct {
+	// RequestID uniquely identifies the request in logs.
+	RequestID string
+	// InvocationID is the ID of the Bazel invocation that made the request,
+	// if any.
+	InvocationID string
+	// UserID and GroupID identify the authenticated caller. They are empty
+	// for anonymous requests.
+	UserID  string
+	GroupID string
+	// ClientVersion identifies the client that made the request, such as
+	// "bazel/4.1.0".
+	ClientVersion string
+}
+
+// Identity is the subset of interfaces.UserInfo needed to populate an Info.
+type Identity interface {
+	GetUserID() string
+	GetGroupID() string
+}
+
+// New returns the Info for the incoming request in ctx. user is the
+// authenticated caller, or nil if the request is anonymous.
+func New(ctx context.Context, user Identity) *Info {
+	info := &Info{}
+	info.RequestID, _ = uuid.GetFromContext(ctx)
+	if user != nil {
+		info.UserID = user.GetUserID()
+		info.GroupID = user.GetGroupID()
+	}
+	if rmd := bazel_request.GetRequestMetadata(ctx); rmd != nil {
+		info.InvocationID = rmd.GetToolInvocationId()
+		if td := rmd.GetToolDetails(); td.GetToolVersion() != "" {
+			info.ClientVersion = fmt.Sprintf("%s/%s", td.GetToolName(), td.GetToolVersion())
+		} else {
+			info.ClientVersion = td.GetToolName()
+		}
+	}
+	if info.ClientVersion == "" {
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if ua := md.Get("user-agent"); len(ua) > 0 {
+				info.ClientVersion = ua[0]
+			}
+		}
+	}
+	return info
+}
+
+// WithInfo returns a context containing the given request info.
+func WithInfo(ctx context.Context, info *Info) context.Context {
+	return context.WithValue(ctx, infoContextKey, info)
+}
+
+// FromContext returns the request info stored in ctx. If there is none (for
+// example, in background tasks not associated with a request), an empty Info
+// is returned.
+func FromContext(ctx context.Context) *Info {
+	if info, ok := ctx.Value(infoContextKey).(*Info); ok {
+		return info
+	}
+	return &Info{}
+}
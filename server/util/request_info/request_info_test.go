@@ -0,0 +1,59 @@
+package request_info_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/bazel_request"
+	"github.com/buildbuddy-io/buildbuddy/server/util/request_info"
+	"github.com/buildbuddy-io/buildbuddy/server/util/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+type fakeUser struct{}
+
+func (fakeUser) GetUserID() string  { return "US1" }
+func (fakeUser) GetGroupID() string { return "GR1" }
+
+func TestNew(t *testing.T) {
+	rmd, err := proto.Marshal(&repb.RequestMetadata{
+		ToolInvocationId: "invocation-1",
+		ToolDetails:      &repb.ToolDetails{ToolName: "bazel", ToolVersion: "4.1.0"},
+	})
+	require.NoError(t, err)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		bazel_request.RequestMetadataKey, string(rmd),
+		"user-agent", "grpc-go/1.0",
+	))
+	ctx, err = uuid.SetInContext(ctx)
+	require.NoError(t, err)
+	requestID, err := uuid.GetFromContext(ctx)
+	require.NoError(t, err)
+
+	info := request_info.New(ctx, fakeUser{})
+	assert.Equal(t, &request_info.Info{
+		RequestID:     requestID,
+		InvocationID:  "invocation-1",
+		UserID:        "US1",
+		GroupID:       "GR1",
+		ClientVersion: "bazel/4.1.0",
+	}, info)
+
+	ctx = request_info.WithInfo(ctx, info)
+	assert.Same(t, info, request_info.FromContext(ctx))
+}
+
+func TestNew_Anonymous(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("user-agent", "grpc-go/1.0"))
+	info := request_info.New(ctx, nil)
+	assert.Equal(t, &request_info.Info{ClientVersion: "grpc-go/1.0"}, info)
+}
+
+func TestFromContext_Empty(t *testing.T) {
+	assert.Equal(t, &request_info.Info{}, request_info.FromContext(context.Background()))
+}
@@ -0,0 +1,88 @@
+package retry
+
+import (
+	"flag"
+	"sync"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+var (
+	budgetMaxTokens  = flag.Int("retry_budget_max_tokens", 100, "The size of the process-wide retry budget shared by RPCs to BuildBuddy services. Each failed attempt costs one token and retries stop while fewer than half of the tokens are left. 0 disables the budget.")
+	budgetTokenRatio = flag.Float64("retry_budget_token_ratio", 0.1, "The number of retry budget tokens earned back by each successful attempt.")
+
+	defaultBudgetOnce sync.Once
+	defaultBudget     *Budget
+)
+
+// Budget limits how often the operations sharing it are retried, so that
+// retries can't multiply the load on a backend which is already failing and
+// keep it from recovering.
+//
+// It follows gRPC's retry throttling: each failed attempt costs a token, each
+// successful attempt earns back tokenRatio tokens, and retries are only
+// allowed while more than half of the tokens are left. While most attempts
+// succeed, the budget stays full and failures are retried as usual. Once
+// more than about tokenRatio of the attempts fail, retries stop until enough
+// attempts succeed again.
+//
+// A nil *Budget allows all retries.
+type Budget struct {
+	maxTokens  float64
+	tokenRatio float64
+
+	mu     sync.Mutex
+	tokens float64
+}
+
+// NewBudget returns a full budget with the given number of tokens.
+func NewBudget(maxTokens int, tokenRatio float64) *Budget {
+	return &Budget{
+		maxTokens:  float64(maxTokens),
+		tokenRatio: tokenRatio,
+		tokens:     float64(maxTokens),
+	}
+}
+
+// DefaultBudget returns the process-wide budget configured by the
+// --retry_budget_* flags, or nil if it is disabled.
+func DefaultBudget() *Budget {
+	defaultBudgetOnce.Do(func() {
+		if *budgetMaxTokens > 0 {
+			defaultBudget = NewBudget(*budgetMaxTokens, *budgetTokenRatio)
+		}
+	})
+	return defaultBudget
+}
+
+// Record updates the budget with the outcome of an attempt. Only errors
+// which indicate that the backend is unhealthy (see status.IsRetryable) cost
+// tokens.
+func (b *Budget) Record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.tokens += b.tokenRatio
+		if b.tokens > b.maxTokens {
+			b.tokens = b.maxTokens
+		}
+	} else if status.IsRetryable(err) {
+		b.tokens--
+		if b.tokens < 0 {
+			b.tokens = 0
+		}
+	}
+}
+
+// AllowRetry returns whether a failed attempt may be retried.
+func (b *Budget) AllowRetry() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens > b.maxTokens/2
+}
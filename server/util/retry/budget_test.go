@@ -0,0 +1,56 @@
+package retry_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/retry"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBudget_StopsRetriesWhenMostAttemptsFail(t *testing.T) {
+	b := retry.NewBudget(10, 0.5)
+
+	// Spending half of the tokens stops retries.
+	for i := 0; i < 4; i++ {
+		b.Record(status.UnavailableError("down"))
+	}
+	assert.True(t, b.AllowRetry())
+	b.Record(status.UnavailableError("down"))
+	assert.False(t, b.AllowRetry())
+
+	// Permanent errors don't cost tokens, and successes earn them back.
+	b.Record(status.InvalidArgumentError("bad"))
+	assert.False(t, b.AllowRetry())
+	b.Record(nil)
+	assert.True(t, b.AllowRetry())
+}
+
+func TestBudget_Nil(t *testing.T) {
+	var b *retry.Budget
+	b.Record(status.UnavailableError("down"))
+	assert.True(t, b.AllowRetry())
+}
+
+func TestDo_StopsRetryingWhenBudgetIsSpent(t *testing.T) {
+	opts := testOptions()
+	opts.MaxAttempts = 10
+	opts.Budget = retry.NewBudget(4, 0.1)
+
+	attempts := 0
+	err := retry.Do(context.Background(), opts, func() error {
+		attempts++
+		return status.UnavailableError("try again")
+	})
+	assert.True(t, status.IsUnavailableError(err))
+	assert.Equal(t, 2, attempts)
+
+	// Other operations sharing the budget aren't retried either.
+	attempts = 0
+	retry.Do(context.Background(), opts, func() error {
+		attempts++
+		return status.UnavailableError("try again")
+	})
+	assert.Equal(t, 1, attempts)
+}
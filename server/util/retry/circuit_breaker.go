@@ -0,0 +1,159 @@
+package retry
+
+import (
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"google.golang.org/grpc/codes"
+
+	gstatus "google.golang.org/grpc/status"
+)
+
+type breakerState int
+
+const (
+	// Requests are allowed.
+	breakerClosed breakerState = iota
+	// Requests are rejected until the open duration has passed.
+	breakerOpen
+	// A single probe request is allowed, to find out whether the backend has
+	// recovered.
+	breakerHalfOpen
+)
+
+// CircuitBreaker stops sending requests to a backend after it fails
+// repeatedly, so that clients fail fast instead of piling more load onto it
+// while it recovers.
+//
+// After failureThreshold consecutive failures the breaker opens and rejects
+// all requests with an Unavailable error. After openDuration it lets a single
+// probe request through: if the probe succeeds the breaker closes again,
+// otherwise it stays open for another openDuration.
+//
+// A nil *CircuitBreaker allows all requests.
+type CircuitBreaker struct {
+	name             string
+	failureThreshold int
+	openDuration     time.Duration
+
+	mu                  sync.Mutex
+	state               breakerState
+	consecutiveFailures int
+	openedAt            time.Time
+	probeInFlight       bool
+	probeStartedAt      time.Time
+}
+
+// NewCircuitBreaker returns a closed circuit breaker. The name identifies the
+// backend in errors and logs.
+func NewCircuitBreaker(name string, failureThreshold int, openDuration time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		name:             name,
+		failureThreshold: failureThreshold,
+		openDuration:     openDuration,
+	}
+}
+
+// Allow returns an Unavailable error if requests to the backend should not be
+// sent right now. Otherwise, the outcome of the request must be reported with
+// Record.
+func (cb *CircuitBreaker) Allow() error {
+	if cb == nil {
+		return nil
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case breakerOpen:
+		if time.Since(cb.openedAt) < cb.openDuration {
+			return cb.openError()
+		}
+		cb.state = breakerHalfOpen
+		cb.startProbe()
+		return nil
+	case breakerHalfOpen:
+		// Probes whose outcome is never reported are given up on after
+		// openDuration, so that the breaker can't get stuck.
+		if cb.probeInFlight && time.Since(cb.probeStartedAt) < cb.openDuration {
+			return cb.openError()
+		}
+		cb.startProbe()
+		return nil
+	default:
+		return nil
+	}
+}
+
+// Record updates the breaker with the outcome of a request that was allowed.
+// Only errors which indicate that the backend is unhealthy count as failures.
+func (cb *CircuitBreaker) Record(err error) {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if gstatus.Code(err) == codes.Canceled {
+		// The client gave up, so the request says nothing about the backend.
+		cb.probeInFlight = false
+		return
+	}
+	if !IsBackendFailure(err) {
+		if cb.state != breakerClosed {
+			log.Infof("Circuit breaker for %s closed: backend recovered", cb.name)
+		}
+		cb.state = breakerClosed
+		cb.consecutiveFailures = 0
+		cb.probeInFlight = false
+		return
+	}
+	cb.consecutiveFailures++
+	if cb.state == breakerHalfOpen || cb.consecutiveFailures >= cb.failureThreshold {
+		if cb.state == breakerClosed {
+			log.Warningf("Circuit breaker for %s opened after %d consecutive failures: %s", cb.name, cb.consecutiveFailures, err)
+		}
+		cb.state = breakerOpen
+		cb.openedAt = time.Now()
+		cb.probeInFlight = false
+	}
+}
+
+// Do calls fn if the breaker allows it, and records its outcome.
+func (cb *CircuitBreaker) Do(fn func() error) error {
+	if err := cb.Allow(); err != nil {
+		return err
+	}
+	err := fn()
+	cb.Record(err)
+	return err
+}
+
+func (cb *CircuitBreaker) startProbe() {
+	cb.probeInFlight = true
+	cb.probeStartedAt = time.Now()
+}
+
+func (cb *CircuitBreaker) openError() error {
+	return status.UnavailableErrorf("circuit breaker for %s is open after repeated failures", cb.name)
+}
+
+// IsBackendFailure returns whether err indicates that the backend which
+// returned it is unhealthy, as opposed to the request being invalid or
+// referring to something that doesn't exist. Errors that aren't gRPC
+// statuses, such as those returned by cloud storage clients, are considered
+// backend failures.
+func IsBackendFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch gstatus.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown, codes.Aborted:
+		return true
+	case codes.ResourceExhausted:
+		// Quota failures are the client's fault, not the backend's.
+		return len(status.QuotaFailureViolations(err)) == 0
+	default:
+		return false
+	}
+}
@@ -0,0 +1,88 @@
+package retry_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/retry"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := retry.NewCircuitBreaker("test", 3, 10*time.Millisecond)
+	calls := 0
+	fail := func() error {
+		calls++
+		return status.UnavailableError("down")
+	}
+	succeed := func() error {
+		calls++
+		return nil
+	}
+
+	// Non-consecutive failures and errors that aren't the backend's fault
+	// don't open the breaker.
+	cb.Do(fail)
+	cb.Do(fail)
+	cb.Do(succeed)
+	cb.Do(fail)
+	cb.Do(func() error { return status.NotFoundError("not found") })
+	assert.NoError(t, cb.Allow())
+	cb.Record(nil)
+
+	// Consecutive failures do.
+	for i := 0; i < 3; i++ {
+		cb.Do(fail)
+	}
+	calls = 0
+	err := cb.Do(succeed)
+	assert.True(t, status.IsUnavailableError(err))
+	assert.Equal(t, 0, calls, "requests should fail immediately while the breaker is open")
+
+	// After the open duration, a single probe is let through. If it fails,
+	// the breaker stays open.
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, cb.Allow())
+	assert.Error(t, cb.Allow(), "only one probe should be let through")
+	cb.Record(status.UnavailableError("still down"))
+	assert.Error(t, cb.Allow())
+
+	// If the probe succeeds, the breaker closes.
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, cb.Do(succeed))
+	assert.NoError(t, cb.Allow())
+	assert.NoError(t, cb.Allow())
+}
+
+func TestDo_FailsFastWhenCircuitBreakerIsOpen(t *testing.T) {
+	opts := testOptions()
+	opts.CircuitBreaker = retry.NewCircuitBreaker("test", 2, time.Minute)
+
+	attempts := 0
+	err := retry.Do(context.Background(), opts, func() error {
+		attempts++
+		return status.UnavailableError("try again")
+	})
+	assert.True(t, status.IsUnavailableError(err))
+	assert.Equal(t, 2, attempts)
+
+	attempts = 0
+	err = retry.Do(context.Background(), opts, func() error {
+		attempts++
+		return nil
+	})
+	assert.True(t, status.IsUnavailableError(err))
+	assert.Equal(t, 0, attempts)
+}
+
+func TestIsBackendFailure(t *testing.T) {
+	assert.False(t, retry.IsBackendFailure(nil))
+	assert.True(t, retry.IsBackendFailure(status.UnavailableError("down")))
+	assert.True(t, retry.IsBackendFailure(status.DeadlineExceededError("slow")))
+	assert.False(t, retry.IsBackendFailure(status.NotFoundError("not found")))
+	assert.False(t, retry.IsBackendFailure(status.InvalidArgumentError("bad")))
+	assert.True(t, retry.IsBackendFailure(status.ResourceExhaustedError("overloaded")))
+	assert.False(t, retry.IsBackendFailure(status.WithQuotaFailure(status.ResourceExhaustedError("slow down"), "group:GR123", "too many requests")))
+}
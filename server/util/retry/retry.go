@@ -0,0 +1,76 @@
+package retry
+
+import (
+	"context"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+// Options configures how an operation is retried.
+type Options struct {
+	// MaxAttempts is the maximum number of times the operation is attempted,
+	// including the first attempt.
+	MaxAttempts int
+	// InitialBackoff is how long to wait before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff is the maximum amount of time to wait between attempts,
+	// unless the server asks for a longer delay with a RetryInfo detail.
+	MaxBackoff time.Duration
+	// Multiplier is the factor by which the backoff increases after each
+	// attempt.
+	Multiplier float64
+	// Budget, if set, limits retries across all of the operations sharing it.
+	Budget *Budget
+	// CircuitBreaker, if set, fails attempts immediately while the backend
+	// has been failing repeatedly.
+	CircuitBreaker *CircuitBreaker
+}
+
+// DefaultOptions returns the options used for RPCs to BuildBuddy services.
+// Retries are limited by the process-wide DefaultBudget.
+func DefaultOptions() *Options {
+	return &Options{
+		MaxAttempts:    5,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     5 * time.Second,
+		Multiplier:     2,
+		Budget:         DefaultBudget(),
+	}
+}
+
+// Do calls fn until it succeeds, it returns an error which is not retryable
+// (see status.IsRetryable), the attempts are exhausted, the retry budget is
+// spent, the circuit breaker is open, or ctx is done. It returns the last
+// error returned by fn, or the circuit breaker's error if it rejected the
+// attempt.
+//
+// If fn returns an error with a RetryInfo detail, Do waits for the delay
+// requested by the server instead of its own backoff.
+func Do(ctx context.Context, opts *Options, fn func() error) error {
+	backoff := opts.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		if err := opts.CircuitBreaker.Allow(); err != nil {
+			return err
+		}
+		err := fn()
+		opts.CircuitBreaker.Record(err)
+		opts.Budget.Record(err)
+		if err == nil || attempt >= opts.MaxAttempts || !status.IsRetryable(err) || !opts.Budget.AllowRetry() {
+			return err
+		}
+		delay := backoff
+		if d, ok := status.RetryDelay(err); ok {
+			delay = d
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		backoff = time.Duration(float64(backoff) * opts.Multiplier)
+		if backoff > opts.MaxBackoff {
+			backoff = opts.MaxBackoff
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package retry_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/retry"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+)
+
+func testOptions() *retry.Options {
+	return &retry.Options{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+		Multiplier:     2,
+	}
+}
+
+func TestDo_RetriesUnavailable(t *testing.T) {
+	attempts := 0
+	err := retry.Do(context.Background(), testOptions(), func() error {
+		attempts++
+		if attempts < 3 {
+			return status.UnavailableError("try again")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestDo_GivesUpAfterMaxAttempts(t *testing.T) {
+	attempts := 0
+	err := retry.Do(context.Background(), testOptions(), func() error {
+		attempts++
+		return status.UnavailableError("try again")
+	})
+	assert.True(t, status.IsUnavailableError(err))
+	assert.Equal(t, 3, attempts)
+}
+
+func TestDo_DoesNotRetryPermanentErrors(t *testing.T) {
+	for _, err := range []error{
+		status.InvalidArgumentError("bad"),
+		status.WithQuotaFailure(status.ResourceExhaustedError("slow down"), "group:GR123", "too many requests"),
+	} {
+		attempts := 0
+		gotErr := retry.Do(context.Background(), testOptions(), func() error {
+			attempts++
+			return err
+		})
+		assert.Equal(t, err, gotErr)
+		assert.Equal(t, 1, attempts)
+	}
+}
+
+func TestDo_HonorsRetryInfo(t *testing.T) {
+	attempts := 0
+	start := time.Now()
+	err := retry.Do(context.Background(), testOptions(), func() error {
+		attempts++
+		if attempts == 1 {
+			// Quota failures are retried if the server says when to retry.
+			err := status.ResourceExhaustedError("slow down")
+			err = status.WithQuotaFailure(err, "group:GR123", "too many requests")
+			return status.WithRetryInfo(err, 50*time.Millisecond)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(50*time.Millisecond))
+}
@@ -0,0 +1,126 @@
+package status
+
+import (
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// ErrorDomain is the domain set on ErrorInfo details attached to errors
+	// returned by BuildBuddy.
+	ErrorDomain = "buildbuddy.io"
+)
+
+// withDetails returns a copy of err with the given details attached,
+// preserving its code, message, stack trace, and any existing details.
+func withDetails(err error, details ...proto.Message) error {
+	if err == nil {
+		return nil
+	}
+	st, err2 := status.Convert(err).WithDetails(details...)
+	if err2 != nil {
+		// Details can only fail to attach if they can't be marshaled, or if
+		// err is OK, in which case there's nothing to attach them to.
+		return err
+	}
+	if w, ok := err.(*wrappedError); ok {
+		return &wrappedError{st.Err(), w.stack}
+	}
+	return &wrappedError{st.Err(), callers()}
+}
+
+// WithRetryInfo attaches a RetryInfo detail to err, telling clients how long
+// to wait before retrying the request.
+func WithRetryInfo(err error, retryDelay time.Duration) error {
+	return withDetails(err, &errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(retryDelay)})
+}
+
+// WithErrorInfo attaches an ErrorInfo detail to err. The reason should be a
+// constant, UPPER_SNAKE_CASE identifier of the cause of the error which
+// clients can match on, and metadata may hold any additional context.
+func WithErrorInfo(err error, reason string, metadata map[string]string) error {
+	return withDetails(err, &errdetails.ErrorInfo{
+		Reason:   reason,
+		Domain:   ErrorDomain,
+		Metadata: metadata,
+	})
+}
+
+// WithQuotaFailure attaches a QuotaFailure detail to err, describing the
+// quota (such as a per-group request limit) that was exceeded.
+func WithQuotaFailure(err error, subject, description string) error {
+	return withDetails(err, &errdetails.QuotaFailure{
+		Violations: []*errdetails.QuotaFailure_Violation{{
+			Subject:     subject,
+			Description: description,
+		}},
+	})
+}
+
+// RetryDelay returns the retry delay from the RetryInfo attached to err, if
+// any.
+func RetryDelay(err error) (time.Duration, bool) {
+	for _, d := range status.Convert(err).Details() {
+		if ri, ok := d.(*errdetails.RetryInfo); ok && ri.GetRetryDelay() != nil {
+			delay, err := ptypes.Duration(ri.GetRetryDelay())
+			if err != nil || delay < 0 {
+				return 0, false
+			}
+			return delay, true
+		}
+	}
+	return 0, false
+}
+
+// ErrorReason returns the reason from the ErrorInfo attached to err, or ""
+// if there is none.
+func ErrorReason(err error) string {
+	for _, d := range status.Convert(err).Details() {
+		if ei, ok := d.(*errdetails.ErrorInfo); ok {
+			return ei.GetReason()
+		}
+	}
+	return ""
+}
+
+// QuotaFailureViolations returns the violations from any QuotaFailure details
+// attached to err.
+func QuotaFailureViolations(err error) []*errdetails.QuotaFailure_Violation {
+	var violations []*errdetails.QuotaFailure_Violation
+	for _, d := range status.Convert(err).Details() {
+		if qf, ok := d.(*errdetails.QuotaFailure); ok {
+			violations = append(violations, qf.GetViolations()...)
+		}
+	}
+	return violations
+}
+
+// IsRetryable returns whether the request that returned err may succeed if
+// it is retried as-is.
+//
+// Errors with a RetryInfo detail are always retryable, since the server has
+// explicitly asked the client to retry. Otherwise, Unavailable and Aborted
+// errors are retryable, as are ResourceExhausted errors which weren't caused
+// by a quota failure (quotas are unlikely to be replenished during a retry
+// loop unless the server says so).
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := RetryDelay(err); ok {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Aborted:
+		return true
+	case codes.ResourceExhausted:
+		return len(QuotaFailureViolations(err)) == 0
+	default:
+		return false
+	}
+}
@@ -198,9 +198,15 @@ func UnauthenticatedErrorf(format string, a ...interface{}) error {
 	return UnauthenticatedError(fmt.Sprintf(format, a...))
 }
 
-// Wrap adds additional context to an error, preserving the underlying status code.
+// Wrap adds additional context to an error, preserving the underlying status
+// code and details.
 func WrapError(err error, msg string) error {
-	return makeStatusError(status.Code(err), fmt.Sprintf("%s: %s", msg, message(err)))
+	p := status.Convert(err).Proto()
+	p.Message = fmt.Sprintf("%s: %s", msg, message(err))
+	return &wrappedError{
+		status.ErrorProto(p),
+		callers(),
+	}
 }
 
 // Wrapf is the "Printf" version of `Wrap`.
@@ -2,6 +2,7 @@ package status_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/pkg/errors"
@@ -52,3 +53,29 @@ func TestHasStacktrace(t *testing.T) {
 	stackTrace := se.StackTrace()
 	assert.NotNil(t, stackTrace)
 }
+
+func TestDetails(t *testing.T) {
+	err := status.UnavailableError("Unavailable")
+	_, ok := status.RetryDelay(err)
+	assert.False(t, ok)
+	assert.Equal(t, "", status.ErrorReason(err))
+	assert.True(t, status.IsRetryable(err))
+
+	err = status.WithRetryInfo(err, 3*time.Second)
+	err = status.WithErrorInfo(err, "EXECUTOR_POOL_DRAINING", map[string]string{"pool": "default"})
+	err = status.WrapError(err, "wrapped")
+	assert.True(t, status.IsUnavailableError(err))
+	delay, ok := status.RetryDelay(err)
+	assert.True(t, ok)
+	assert.Equal(t, 3*time.Second, delay)
+	assert.Equal(t, "EXECUTOR_POOL_DRAINING", status.ErrorReason(err))
+	_, ok = err.(interface {
+		StackTrace() errors.StackTrace
+	})
+	assert.True(t, ok)
+
+	err = status.WithQuotaFailure(status.ResourceExhaustedError("ResourceExhausted"), "group:GR123", "request rate exceeded")
+	assert.Len(t, status.QuotaFailureViolations(err), 1)
+	assert.False(t, status.IsRetryable(err))
+	assert.True(t, status.IsRetryable(status.WithRetryInfo(err, time.Second)))
+}
@@ -0,0 +1,64 @@
+// Package tags validates the tags that can be attached to invocations, such as
+// "release" or "nightly".
+package tags
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+const (
+	// MaxTagLength is the maximum length of a tag.
+	MaxTagLength = 64
+
+	// MaxTagsPerInvocation is the maximum number of tags that can be attached
+	// to an invocation.
+	MaxTagsPerInvocation = 32
+)
+
+var (
+	tagRegex = regexp.MustCompile(`^[a-z0-9._-]+$`)
+)
+
+// Normalize returns the canonical form of the given tag. Tags are not case
+// sensitive.
+func Normalize(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// Validate returns an InvalidArgument error if the given (normalized) tag
+// is not a valid tag.
+func Validate(tag string) error {
+	if tag == "" {
+		return status.InvalidArgumentError("tag must not be empty")
+	}
+	if len(tag) > MaxTagLength {
+		return status.InvalidArgumentErrorf("tag %q is longer than %d characters", tag, MaxTagLength)
+	}
+	if !tagRegex.MatchString(tag) {
+		return status.InvalidArgumentErrorf("tag %q may only contain letters, digits, '.', '_', and '-'", tag)
+	}
+	return nil
+}
+
+// Parse returns the valid tags in the given comma-separated list, normalized
+// and without duplicates. Invalid tags are dropped, as are any tags beyond
+// MaxTagsPerInvocation.
+func Parse(list string) []string {
+	var parsed []string
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(list, ",") {
+		tag = Normalize(tag)
+		if seen[tag] || Validate(tag) != nil {
+			continue
+		}
+		if len(parsed) == MaxTagsPerInvocation {
+			break
+		}
+		seen[tag] = true
+		parsed = append(parsed, tag)
+	}
+	return parsed
+}
@@ -0,0 +1,33 @@
+package tags_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/tags"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	for _, test := range []struct {
+		list     string
+		expected []string
+	}{
+		{"", nil},
+		{"release", []string{"release"}},
+		{" Release , nightly,release", []string{"release", "nightly"}},
+		{"v1.2.3,bisect_run,not a tag,,", []string{"v1.2.3", "bisect_run"}},
+		{strings.Repeat("a", tags.MaxTagLength+1) + ",ok", []string{"ok"}},
+	} {
+		assert.Equal(t, test.expected, tags.Parse(test.list), test.list)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, tags.Validate("nightly-2021.06"))
+	for _, tag := range []string{"", "two words", "a/b", "UPPER", strings.Repeat("a", tags.MaxTagLength+1)} {
+		err := tags.Validate(tag)
+		assert.True(t, status.IsInvalidArgumentError(err), "%q: expected InvalidArgument, got %v", tag, err)
+	}
+}
@@ -0,0 +1,122 @@
+// Package toucher marks cache entries as recently used in the background, so
+// that reads don't have to wait on the writes needed to keep actively-used
+// entries from being evicted ahead of idle ones.
+package toucher
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/lru"
+)
+
+const (
+	defaultFlushInterval = 1 * time.Second
+	defaultMaxPending    = 10000
+	// The number of recently touched keys remembered in order to skip
+	// touching them again within the minimum touch interval.
+	maxRecentKeys = 100000
+)
+
+// TouchFunc marks the entries with the given keys as recently used.
+type TouchFunc func(ctx context.Context, keys []string)
+
+type Opts struct {
+	// How often pending touches are applied. Defaults to 1 second.
+	FlushInterval time.Duration
+	// The maximum number of keys waiting to be touched. Touches beyond this
+	// are dropped. Defaults to 10000.
+	MaxPending int
+	// If set, keys that were touched within this duration are not touched
+	// again.
+	MinTouchInterval time.Duration
+}
+
+// Toucher collects the keys of cache entries that were read and periodically
+// passes them, in a single batch, to a TouchFunc. Keys read several times
+// between flushes are only touched once.
+type Toucher struct {
+	touchFn TouchFunc
+	opts    Opts
+
+	mu      sync.Mutex // protects(pending, recent)
+	pending map[string]struct{}
+	recent  *lru.LRU
+}
+
+// New returns a toucher that calls touchFn with batches of touched keys from
+// a background goroutine.
+func New(touchFn TouchFunc, opts *Opts) (*Toucher, error) {
+	t := &Toucher{
+		touchFn: touchFn,
+		pending: make(map[string]struct{}),
+	}
+	if opts != nil {
+		t.opts = *opts
+	}
+	if t.opts.FlushInterval <= 0 {
+		t.opts.FlushInterval = defaultFlushInterval
+	}
+	if t.opts.MaxPending <= 0 {
+		t.opts.MaxPending = defaultMaxPending
+	}
+	if t.opts.MinTouchInterval > 0 {
+		recent, err := lru.NewLRU(&lru.Config{
+			MaxSize: maxRecentKeys,
+			SizeFn:  func(key interface{}, value interface{}) int64 { return 1 },
+		})
+		if err != nil {
+			return nil, err
+		}
+		t.recent = recent
+	}
+	go func() {
+		for range time.Tick(t.opts.FlushInterval) {
+			t.Flush(context.Background())
+		}
+	}()
+	return t, nil
+}
+
+// Touch schedules the entry with the given key to be touched. It never
+// blocks on the touch itself.
+func (t *Toucher) Touch(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.pending[key]; ok {
+		return
+	}
+	if t.recent != nil {
+		if v, ok := t.recent.Peek(key); ok && time.Since(v.(time.Time)) < t.opts.MinTouchInterval {
+			return
+		}
+	}
+	if len(t.pending) >= t.opts.MaxPending {
+		log.Debugf("Dropping touch of %q: too many pending touches", key)
+		return
+	}
+	t.pending[key] = struct{}{}
+}
+
+// Flush touches all pending keys.
+func (t *Toucher) Flush(ctx context.Context) {
+	t.mu.Lock()
+	if len(t.pending) == 0 {
+		t.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	keys := make([]string, 0, len(t.pending))
+	for k := range t.pending {
+		keys = append(keys, k)
+		if t.recent != nil {
+			t.recent.Add(k, now)
+		}
+	}
+	t.pending = make(map[string]struct{})
+	t.mu.Unlock()
+
+	t.touchFn(ctx, keys)
+}
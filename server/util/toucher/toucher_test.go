@@ -0,0 +1,79 @@
+package toucher_test
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/toucher"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recorder struct {
+	mu      sync.Mutex
+	batches [][]string
+}
+
+func (r *recorder) touch(ctx context.Context, keys []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sort.Strings(keys)
+	r.batches = append(r.batches, keys)
+}
+
+func (r *recorder) takeBatches() [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := r.batches
+	r.batches = nil
+	return b
+}
+
+func TestTouch_BatchesAndDedupes(t *testing.T) {
+	r := &recorder{}
+	// Use a long flush interval so that the test controls when touches are
+	// applied.
+	tc, err := toucher.New(r.touch, &toucher.Opts{FlushInterval: time.Hour, MaxPending: 3})
+	require.NoError(t, err)
+
+	tc.Touch("a")
+	tc.Touch("b")
+	tc.Touch("a")
+	tc.Touch("c")
+	tc.Touch("d") // Dropped: too many pending touches.
+	assert.Empty(t, r.takeBatches())
+
+	tc.Flush(context.Background())
+	assert.Equal(t, [][]string{{"a", "b", "c"}}, r.takeBatches())
+
+	// Nothing is pending.
+	tc.Flush(context.Background())
+	assert.Empty(t, r.takeBatches())
+}
+
+func TestTouch_MinTouchInterval(t *testing.T) {
+	r := &recorder{}
+	tc, err := toucher.New(r.touch, &toucher.Opts{FlushInterval: time.Hour, MinTouchInterval: time.Hour})
+	require.NoError(t, err)
+
+	tc.Touch("a")
+	tc.Flush(context.Background())
+	tc.Touch("a")
+	tc.Touch("b")
+	tc.Flush(context.Background())
+	assert.Equal(t, [][]string{{"a"}, {"b"}}, r.takeBatches())
+}
+
+func TestTouch_FlushesPeriodically(t *testing.T) {
+	r := &recorder{}
+	tc, err := toucher.New(r.touch, &toucher.Opts{FlushInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+
+	tc.Touch("a")
+	assert.Eventually(t, func() bool {
+		return len(r.takeBatches()) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
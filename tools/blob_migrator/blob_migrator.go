@@ -0,0 +1,93 @@
+// blob_migrator copies invocation blobs from one blobstore backend to another
+// and switches invocations over to the new backend once their blobs have been
+// copied and verified. Servers can keep running during the migration, and it
+// can be safely interrupted and re-run.
+//
+// Both backends must be configured in the config file (see the
+// storage.additional_backends option), and servers must be configured to be
+// able to read from the destination backend before migrating.
+//
+// Example usage:
+//
+//	$ bazel run //tools/blob_migrator -- \
+//	  --config_file=/config.yaml \
+//	  --from=gcs \
+//	  --to=s3 \
+//	  --max_bytes_per_second=50000000
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
+	"github.com/buildbuddy-io/buildbuddy/server/blob_migrator"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/healthcheck"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+)
+
+var (
+	configFile        = flag.String("config_file", "/config.yaml", "The path to a buildbuddy config file")
+	from              = flag.String("from", "", "The ID of the backend to migrate invocations from.")
+	to                = flag.String("to", "", "The ID of the backend to migrate invocations to.")
+	maxBytesPerSecond = flag.Int64("max_bytes_per_second", 0, "The maximum number of bytes to copy per second. 0 means no limit.")
+	batchSize         = flag.Int("batch_size", 100, "How many invocations to look up at a time.")
+	deleteSource      = flag.Bool("delete_source", false, "If true, delete blobs from the source backend once invocations have been switched over.")
+	dryRun            = flag.Bool("dry_run", false, "If true, copy and verify blobs without switching invocations over to the destination backend.")
+)
+
+func main() {
+	flag.Parse()
+
+	configurator, err := config.NewConfigurator(*configFile)
+	if err != nil {
+		log.Fatalf("Error loading config from file: %s", err)
+	}
+	dbHandle, err := db.GetConfiguredDatabase(configurator, healthcheck.NewHealthChecker("blob-migrator"))
+	if err != nil {
+		log.Fatalf("Error configuring database: %s", err)
+	}
+	bs, err := blobstore.GetConfiguredBlobstore(configurator)
+	if err != nil {
+		log.Fatalf("Error configuring blobstore: %s", err)
+	}
+	backends, err := blobstore.GetConfiguredBackends(configurator, bs)
+	if err != nil {
+		log.Fatalf("Error configuring blobstore backends: %s", err)
+	}
+
+	m, err := blob_migrator.New(dbHandle, backends, blob_migrator.Options{
+		FromBackendID:     *from,
+		ToBackendID:       *to,
+		MaxBytesPerSecond: *maxBytesPerSecond,
+		BatchSize:         *batchSize,
+		DeleteSource:      *deleteSource,
+		DryRun:            *dryRun,
+	})
+	if err != nil {
+		log.Fatalf("Error configuring migration: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		log.Printf("Stopping migration...")
+		cancel()
+	}()
+
+	stats, err := m.Run(ctx)
+	log.Printf("Migrated %d invocations (%d blobs, %d bytes) from %q to %q, %d failures", stats.Invocations, stats.Blobs, stats.Bytes, *from, *to, stats.Failures)
+	if err != nil {
+		log.Fatalf("Migration did not complete: %s", err)
+	}
+	if stats.Failures > 0 {
+		os.Exit(1)
+	}
+}
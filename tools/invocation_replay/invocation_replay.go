@@ -0,0 +1,107 @@
+// invocation_replay re-runs event parsing for invocations from their raw
+// events stored in the blobstore, and re-populates the database rows derived
+// from them. Run it after deploying an event parser fix or a new invocation
+// column to apply the change to invocations that had already finished.
+//
+// Either specific invocations can be replayed, or all finished invocations
+// as a backfill. A backfill logs its progress after each batch, and can be
+// resumed after an interruption by passing the last replayed invocation ID as
+// --after_invocation_id.
+//
+// Example usage:
+//
+//	$ bazel run //tools/invocation_replay -- \
+//	  --config_file=/config.yaml \
+//	  --invocation_id=c6b2b6de-c7bb-4dd9-b7fd-a530362f0845
+//
+//	$ bazel run //tools/invocation_replay -- \
+//	  --config_file=/config.yaml \
+//	  --all
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/invocationdb"
+	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/invocation_replay"
+	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/healthcheck"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+)
+
+var (
+	configFile        = flag.String("config_file", "/config.yaml", "The path to a buildbuddy config file")
+	invocationIDs     = flag.String("invocation_id", "", "A comma-separated list of IDs of invocations to replay.")
+	all               = flag.Bool("all", false, "If true, replay all finished invocations.")
+	afterInvocationID = flag.String("after_invocation_id", "", "If set with --all, only replay invocations with a greater ID than this, to resume an interrupted backfill.")
+	batchSize         = flag.Int("batch_size", 100, "How many invocations to look up at a time.")
+)
+
+func main() {
+	flag.Parse()
+
+	opts := invocation_replay.Options{
+		AfterInvocationID: *afterInvocationID,
+		BatchSize:         *batchSize,
+	}
+	if *invocationIDs != "" {
+		opts.InvocationIDs = strings.Split(*invocationIDs, ",")
+	}
+	if *all == (len(opts.InvocationIDs) > 0) {
+		log.Fatalf("Exactly one of --invocation_id or --all must be set")
+	}
+
+	configurator, err := config.NewConfigurator(*configFile)
+	if err != nil {
+		log.Fatalf("Error loading config from file: %s", err)
+	}
+	healthChecker := healthcheck.NewHealthChecker("invocation-replay")
+	env := real_environment.NewRealEnv(configurator, healthChecker)
+	dbHandle, err := db.GetConfiguredDatabase(configurator, healthChecker)
+	if err != nil {
+		log.Fatalf("Error configuring database: %s", err)
+	}
+	env.SetDBHandle(dbHandle)
+	bs, err := blobstore.GetConfiguredBlobstore(configurator)
+	if err != nil {
+		log.Fatalf("Error configuring blobstore: %s", err)
+	}
+	env.SetBlobstore(bs)
+	backends, err := blobstore.GetConfiguredBackends(configurator, bs)
+	if err != nil {
+		log.Fatalf("Error configuring blobstore backends: %s", err)
+	}
+	env.SetBlobstoreBackends(backends)
+	env.SetInvocationDB(invocationdb.NewInvocationDB(env, dbHandle))
+
+	r, err := invocation_replay.New(env, opts)
+	if err != nil {
+		log.Fatalf("Error configuring replay: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		log.Printf("Stopping replay...")
+		cancel()
+	}()
+
+	stats, err := r.Run(ctx)
+	log.Printf("Replayed %d invocations, %d failures, up to invocation %q", stats.Invocations, stats.Failures, stats.LastInvocationID)
+	if err != nil {
+		log.Fatalf("Replay did not complete: %s", err)
+	}
+	if stats.Failures > 0 {
+		os.Exit(1)
+	}
+}
@@ -54,6 +54,7 @@ var (
 	apiKey        = flag.String("api_key", "", "API key to use")
 	summary       = flag.Bool("summary", true, "Whether to show summary at the end of the run.")
 	verbose       = flag.Bool("verbose", false, "Print detailed information for each executed command")
+	poolSize      = flag.Int("connection_pool_size", 1, "Number of connections to open to the server. RPCs are spread across them.")
 	rawResultsDir = flag.String("raw_results_dir", "", "If specified, raw per-command data will be written as a CSV file into this directory.")
 
 	prepareConcurrency      = flag.Int("prepare_concurrency", 100, "Number of workers to start to prepare commands to be executed")
@@ -818,6 +819,7 @@ func (g *runner) run(ctx context.Context) error {
 
 type ClientSource struct {
 	byteStreamClient bspb.ByteStreamClient
+	casClient        repb.ContentAddressableStorageClient
 	executionClient  repb.ExecutionClient
 }
 
@@ -829,6 +831,10 @@ func (c *ClientSource) GetByteStreamClient() bspb.ByteStreamClient {
 	return c.byteStreamClient
 }
 
+func (c *ClientSource) GetContentAddressableStorageClient() repb.ContentAddressableStorageClient {
+	return c.casClient
+}
+
 func main() {
 	flag.Parse()
 	rand.Seed(time.Now().UnixNano())
@@ -883,13 +889,14 @@ func main() {
 		}
 	}
 
-	clientConn, err := grpc_client.DialTargetWithOptions(*server, true, grpc.WithBlock(), grpc.WithTimeout(5*time.Second))
+	clientConn, err := grpc_client.DialTargetPooled(*server, *poolSize, grpc.WithBlock(), grpc.WithTimeout(5*time.Second))
 	if err != nil {
 		log.Fatalf("Could not connect to server %q: %s", *server, err)
 	}
 
 	source := &ClientSource{
 		byteStreamClient: bspb.NewByteStreamClient(clientConn),
+		casClient:        repb.NewContentAddressableStorageClient(clientConn),
 		executionClient:  repb.NewExecutionClient(clientConn),
 	}
 